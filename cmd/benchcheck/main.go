@@ -0,0 +1,72 @@
+// Command benchcheck compares `go test -bench` output read from stdin against a
+// stored baseline and exits non-zero if any benchmark regressed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/accretional/collector/pkg/bench"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	baselinePath := flag.String("baseline", "pkg/bench/baseline.json", "path to the baseline file")
+	tolerance := flag.Float64("tolerance", 0.25, "allowed slowdown before failing (0.25 = 25%)")
+	update := flag.Bool("update", false, "write the current results as the new baseline")
+	flag.Parse()
+
+	current, err := bench.ParseResults(os.Stdin)
+	if err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		return fmt.Errorf("no benchmark results found on stdin")
+	}
+
+	if *update {
+		if err := bench.SaveBaseline(*baselinePath, current); err != nil {
+			return err
+		}
+		log.Printf("Wrote %d benchmarks to %s", len(current), *baselinePath)
+		return nil
+	}
+
+	baseline, err := bench.LoadBaseline(*baselinePath)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cur := current[name]
+		if base, ok := baseline[name]; ok {
+			fmt.Printf("%-50s %12.0f ns/op  (baseline %12.0f, %+6.1f%%)\n", name, cur.NsPerOp, base.NsPerOp, (cur.NsPerOp/base.NsPerOp-1)*100)
+		} else {
+			fmt.Printf("%-50s %12.0f ns/op  (no baseline)\n", name, cur.NsPerOp)
+		}
+	}
+
+	regressions := bench.Compare(baseline, current, *tolerance)
+	if len(regressions) > 0 {
+		for _, r := range regressions {
+			fmt.Printf("REGRESSION %s\n", r)
+		}
+		return fmt.Errorf("%d benchmark(s) regressed by more than %.0f%%", len(regressions), *tolerance*100)
+	}
+
+	fmt.Println("No regressions")
+	return nil
+}
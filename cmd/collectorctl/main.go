@@ -0,0 +1,928 @@
+// Command collectorctl is a command-line client for a running collector.
+//
+// Usage:
+//
+//	collectorctl      [-addr host:port] <command> [flags]
+//
+// Commands:
+//
+//	backup-schedules  List automatic backup schedules
+//	clone             Clone a collection within the collector
+//	deprecate         Mark a registered service or method as deprecated
+//	diff              Compare two collections or snapshots record by record
+//	goroutines        Dump the collector's goroutine stacks
+//	hold              Place or lift a legal hold on a collection or record
+//	holds             List legal holds or their audit trail
+//	lineage           Show where a collection's records came from
+//	preflight         Re-run the collector's startup checks while it serves
+//	rehearse          Restore a backup into a throwaway namespace and check it
+//	resources         Show the collector's open stores, connections and memory
+//	schedule-backup   Set or remove a collection's automatic backups
+//	snapshot          Take or delete a read-only snapshot of a collection
+//	snapshots         List collection snapshots
+//	stream            Read a stream's events from a write-once collection
+//	top               Show the most called, failing or slowest dispatched methods
+//	upgrade           Enable full-text search or JSON on a collection's store
+//	verify            Check a collection's database, indexes, files and checksums
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// adminTokenHeader is collection.AdminTokenMetadataKey, without linking in
+// the storage engine.
+const adminTokenHeader = "x-collector-admin-token"
+
+// principalHeader is collection.PrincipalMetadataKey.
+const principalHeader = "x-collector-principal"
+
+// authorizationHeader is collection.AuthorizationMetadataKey.
+const authorizationHeader = "authorization"
+
+// command is a collectorctl subcommand.
+type command struct {
+	summary string
+	run     func(ctx context.Context, conn *grpc.ClientConn, args []string) error
+}
+
+var commands = map[string]command{
+	"backup-schedules": {summary: "List automatic backup schedules", run: runBackupSchedules},
+	"clone":            {summary: "Clone a collection within the collector", run: runClone},
+	"deprecate":        {summary: "Mark a registered service or method as deprecated", run: runDeprecate},
+	"diff":             {summary: "Compare two collections or snapshots record by record", run: runDiff},
+	"goroutines":       {summary: "Dump the collector's goroutine stacks", run: runGoroutines},
+	"hold":             {summary: "Place or lift a legal hold on a collection or record", run: runHold},
+	"holds":            {summary: "List legal holds or their audit trail", run: runHolds},
+	"lineage":          {summary: "Show where a collection's records came from", run: runLineage},
+	"preflight":        {summary: "Re-run the collector's startup checks while it serves", run: runPreflight},
+	"rehearse":         {summary: "Restore a backup into a throwaway namespace and check it", run: runRehearse},
+	"resources":        {summary: "Show the collector's open stores, connections and memory", run: runResources},
+	"schedule-backup":  {summary: "Set or remove a collection's automatic backups", run: runScheduleBackup},
+	"snapshot":         {summary: "Take or delete a read-only snapshot of a collection", run: runSnapshot},
+	"snapshots":        {summary: "List collection snapshots", run: runSnapshots},
+	"stream":           {summary: "Read a stream's events from a write-once collection", run: runStream},
+	"top":              {summary: "Show the most called, failing or slowest dispatched methods", run: runTop},
+	"upgrade":          {summary: "Enable full-text search or JSON on a collection's store", run: runUpgrade},
+	"verify":           {summary: "Check a collection's database, indexes, files and checksums", run: runVerify},
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	addr := flag.String("addr", "localhost:50051", "collector address")
+	timeout := flag.Duration("timeout", 5*time.Minute, "request timeout")
+	adminToken := flag.String("admin-token", os.Getenv("COLLECTOR_ADMIN_TOKEN"), "token for admin calls (defaults to $COLLECTOR_ADMIN_TOKEN)")
+	principal := flag.String("principal", os.Getenv("COLLECTOR_PRINCIPAL"), "principal to name as the caller, unauthenticated, e.g. for leases (defaults to $COLLECTOR_PRINCIPAL)")
+	token := flag.String("token", os.Getenv("COLLECTOR_TOKEN"), "bearer token authenticating the caller, e.g. for legal holds and approvals (defaults to $COLLECTOR_TOKEN)")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown command %q", flag.Arg(0))
+	}
+
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", *addr, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if *adminToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, adminTokenHeader, *adminToken)
+	}
+	if *principal != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, principalHeader, *principal)
+	}
+	if *token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, authorizationHeader, "Bearer "+*token)
+	}
+	return cmd.run(ctx, conn, flag.Args()[1:])
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: collectorctl [-addr host:port] <command> [flags]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-17s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nGlobal flags:\n")
+	flag.PrintDefaults()
+}
+
+// filterFlags collects repeated -where expressions.
+type filterFlags []string
+
+func (f *filterFlags) String() string     { return strings.Join(*f, ",") }
+func (f *filterFlags) Set(v string) error { *f = append(*f, v); return nil }
+
+func runClone(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("clone", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "namespace of the source collection")
+	from := fs.String("from", "", "source collection name")
+	to := fs.String("to", "", "destination collection name")
+	destNamespace := fs.String("dest-namespace", "", "destination namespace (defaults to -namespace)")
+	includeFiles := fs.Bool("include-files", false, "also copy the collection's files")
+	query := fs.String("query", "", "only clone records matching this full-text query")
+	var where filterFlags
+	fs.Var(&where, "where", "only clone records matching field<op>value, op one of = != > >= < <= ~ (repeatable)")
+	fs.Parse(args)
+
+	if *namespace == "" || *from == "" || *to == "" {
+		fs.Usage()
+		return fmt.Errorf("-namespace, -from and -to are required")
+	}
+
+	filters, err := parseFilters(where)
+	if err != nil {
+		return err
+	}
+
+	resp, err := pb.NewCollectionRepoClient(conn).CloneCollection(ctx, &pb.CloneCollectionRequest{
+		Namespace:     *namespace,
+		SourceName:    *from,
+		DestName:      *to,
+		DestNamespace: *destNamespace,
+		IncludeFiles:  *includeFiles,
+		FullText:      *query,
+		Filters:       filters,
+	})
+	if err != nil {
+		return fmt.Errorf("clone failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("clone failed: %s", resp.Status.GetMessage())
+	}
+
+	fmt.Printf("Cloned %s/%s to %s: %d records, %d files, %d bytes\n",
+		*namespace, *from, resp.CollectionId, resp.RecordsCloned, resp.FilesCloned, resp.BytesTransferred)
+	return nil
+}
+
+func runDeprecate(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("deprecate", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "namespace of the registered service")
+	service := fs.String("service", "", "service name")
+	method := fs.String("method", "", "method name (defaults to the whole service)")
+	message := fs.String("message", "", "notice shown to callers")
+	sunset := fs.String("sunset", "", "sunset date, RFC 3339 or YYYY-MM-DD")
+	replacement := fs.String("replacement", "", "what callers should use instead")
+	remove := fs.Bool("clear", false, "remove the deprecation instead")
+	fs.Parse(args)
+
+	if *namespace == "" || *service == "" {
+		fs.Usage()
+		return fmt.Errorf("-namespace and -service are required")
+	}
+
+	req := &pb.DeprecateServiceRequest{Namespace: *namespace, ServiceName: *service, MethodName: *method}
+	if !*remove {
+		req.Deprecation = &pb.Deprecation{Message: *message, Replacement: *replacement}
+		if *sunset != "" {
+			t, err := time.Parse(time.RFC3339, *sunset)
+			if err != nil {
+				if t, err = time.Parse(time.DateOnly, *sunset); err != nil {
+					return fmt.Errorf("invalid -sunset %q: expected RFC 3339 or YYYY-MM-DD", *sunset)
+				}
+			}
+			req.Deprecation.SunsetAt = timestamppb.New(t)
+		}
+	}
+
+	resp, err := pb.NewCollectorRegistryClient(conn).DeprecateService(ctx, req)
+	if err != nil {
+		return fmt.Errorf("deprecate failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("deprecate failed: %s", resp.Status.GetMessage())
+	}
+
+	target := *namespace + "/" + *service
+	if *method != "" {
+		target += "." + *method
+	}
+	if *remove {
+		fmt.Printf("Cleared deprecation of %s\n", target)
+	} else {
+		fmt.Printf("Deprecated %s\n", target)
+	}
+	return nil
+}
+
+func runGoroutines(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("goroutines", flag.ExitOnError)
+	aggregate := fs.Bool("aggregate", false, "group identical stacks with counts")
+	fs.Parse(args)
+
+	resp, err := pb.NewCollectionRepoClient(conn).DumpGoroutines(ctx, &pb.DumpGoroutinesRequest{Aggregate: *aggregate})
+	if err != nil {
+		return fmt.Errorf("goroutines failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("goroutines failed: %s", resp.Status.GetMessage())
+	}
+	fmt.Print(resp.Dump)
+	return nil
+}
+
+// parseDiffSource parses namespace/name, or namespace/name@snapshot.
+func parseDiffSource(s string) (*pb.DiffSource, error) {
+	coll, snapshot, _ := strings.Cut(s, "@")
+	namespace, name, ok := strings.Cut(coll, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("invalid collection %q: expected namespace/name or namespace/name@snapshot", s)
+	}
+	return &pb.DiffSource{Collection: &pb.NamespacedName{Namespace: namespace, Name: name}, Snapshot: snapshot}, nil
+}
+
+func runDiff(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fromFlag := fs.String("from", "", "collection to compare from, namespace/name or namespace/name@snapshot")
+	toFlag := fs.String("to", "", "collection to compare to, namespace/name or namespace/name@snapshot")
+	fields := fs.Bool("fields", false, "show which JSON fields of changed records differ")
+	summaryOnly := fs.Bool("summary", false, "only print the totals")
+	fs.Parse(args)
+
+	if *fromFlag == "" || *toFlag == "" {
+		fs.Usage()
+		return fmt.Errorf("-from and -to are required")
+	}
+	from, err := parseDiffSource(*fromFlag)
+	if err != nil {
+		return err
+	}
+	to, err := parseDiffSource(*toFlag)
+	if err != nil {
+		return err
+	}
+
+	stream, err := pb.NewCollectionRepoClient(conn).DiffCollections(ctx, &pb.DiffCollectionsRequest{
+		From:       from,
+		To:         to,
+		FieldDiffs: *fields && !*summaryOnly,
+	})
+	if err != nil {
+		return fmt.Errorf("diff failed: %w", err)
+	}
+	marks := map[pb.DiffKind]string{
+		pb.DiffKind_DIFF_ADDED:   "+",
+		pb.DiffKind_DIFF_REMOVED: "-",
+		pb.DiffKind_DIFF_CHANGED: "~",
+	}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return fmt.Errorf("diff failed: stream ended without a summary")
+		}
+		if err != nil {
+			return fmt.Errorf("diff failed: %w", err)
+		}
+		for _, d := range resp.Diffs {
+			if *summaryOnly {
+				continue
+			}
+			fmt.Printf("%s %s\n", marks[d.Kind], d.Id)
+			for _, f := range d.Fields {
+				fmt.Printf("    %s: %s -> %s\n", f.Path, orAbsent(f.OldJson), orAbsent(f.NewJson))
+			}
+		}
+		if sum := resp.Summary; sum != nil {
+			fmt.Printf("%d added, %d removed, %d changed, %d unchanged\n", sum.Added, sum.Removed, sum.Changed, sum.Unchanged)
+			return nil
+		}
+	}
+}
+
+// orAbsent shows a field missing from one side of a diff.
+func orAbsent(v string) string {
+	if v == "" {
+		return "(absent)"
+	}
+	return v
+}
+
+func runPreflight(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("preflight", flag.ExitOnError)
+	var peers []string
+	fs.Func("peer", "address of a collector that must be reachable (repeatable)", func(v string) error {
+		peers = append(peers, v)
+		return nil
+	})
+	fs.Parse(args)
+
+	resp, err := pb.NewCollectionRepoClient(conn).PreflightCheck(ctx, &pb.PreflightCheckRequest{Peers: peers})
+	if err != nil {
+		return fmt.Errorf("preflight failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("preflight failed: %s", resp.Status.GetMessage())
+	}
+	for _, r := range resp.Results {
+		fmt.Printf("%-5s %-12s %s\n", strings.TrimPrefix(r.Outcome.String(), "PREFLIGHT_"), r.Check, r.Detail)
+	}
+	if !resp.Passed {
+		return fmt.Errorf("preflight checks failed")
+	}
+	return nil
+}
+
+func runResources(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("resources", flag.ExitOnError)
+	fs.Parse(args)
+
+	resp, err := pb.NewCollectionRepoClient(conn).ServerResources(ctx, &pb.ServerResourcesRequest{})
+	if err != nil {
+		return fmt.Errorf("resources failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("resources failed: %s", resp.Status.GetMessage())
+	}
+
+	mem := resp.Memory
+	fmt.Printf("Goroutines: %d\n", resp.Goroutines)
+	if resp.OpenFiles >= 0 {
+		fmt.Printf("Open files: %d\n", resp.OpenFiles)
+	}
+	fmt.Printf("Memory:     %d bytes heap (%d objects), %d bytes stacks, %d bytes from the OS, %d GCs\n",
+		mem.GetHeapAllocBytes(), mem.GetHeapObjects(), mem.GetStackInuseBytes(), mem.GetSysBytes(), mem.GetNumGc())
+	fmt.Printf("Stores (%d):\n", len(resp.Stores))
+	for _, st := range resp.Stores {
+		fmt.Printf("  %-10s %s %s\n", st.Owner, st.Path, st.Collection)
+	}
+	fmt.Printf("Peers (%d):\n", len(resp.Peers))
+	for _, p := range resp.Peers {
+		fmt.Printf("  %s: %d channels, %d active calls\n", p.Address, p.Channels, p.ActiveCalls)
+	}
+	for _, sub := range resp.Subsystems {
+		names := make([]string, 0, len(sub.Counts))
+		for name := range sub.Counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		counts := make([]string, len(names))
+		for i, name := range names {
+			counts[i] = fmt.Sprintf("%s=%d", name, sub.Counts[name])
+		}
+		fmt.Printf("%s: %s\n", sub.Name, strings.Join(counts, " "))
+	}
+	return nil
+}
+
+func runSnapshot(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "namespace of the collection")
+	collection := fs.String("collection", "", "collection name")
+	name := fs.String("name", "", "snapshot name")
+	remove := fs.Bool("delete", false, "delete the snapshot instead of taking it")
+	fs.Parse(args)
+
+	if *namespace == "" || *collection == "" || *name == "" {
+		fs.Usage()
+		return fmt.Errorf("-namespace, -collection and -name are required")
+	}
+	coll := &pb.NamespacedName{Namespace: *namespace, Name: *collection}
+	client := pb.NewCollectionRepoClient(conn)
+
+	if *remove {
+		resp, err := client.DeleteSnapshot(ctx, &pb.DeleteSnapshotRequest{Collection: coll, Name: *name})
+		if err != nil {
+			return fmt.Errorf("delete snapshot failed: %w", err)
+		}
+		if resp.Status.GetCode() != pb.Status_OK {
+			return fmt.Errorf("delete snapshot failed: %s", resp.Status.GetMessage())
+		}
+		fmt.Printf("Deleted snapshot %s of %s/%s, %d bytes freed\n", *name, *namespace, *collection, resp.BytesFreed)
+		return nil
+	}
+
+	resp, err := client.CreateSnapshot(ctx, &pb.CreateSnapshotRequest{Collection: coll, Name: *name})
+	if err != nil {
+		return fmt.Errorf("snapshot failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("snapshot failed: %s", resp.Status.GetMessage())
+	}
+	snap := resp.Snapshot
+	fmt.Printf("Snapshot %s of %s/%s (%s): %d records, %d files, %d bytes\n",
+		snap.Name, *namespace, *collection, snap.Method, snap.RecordCount, snap.FileCount, snap.SizeBytes)
+	return nil
+}
+
+func runUpgrade(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "namespace of the collection")
+	collection := fs.String("collection", "", "collection name")
+	fts := fs.Bool("fts", false, "enable full-text search, indexing existing records")
+	jsonCol := fs.Bool("json", false, "enable JSON filtering")
+	fs.Parse(args)
+
+	if *namespace == "" || *collection == "" || (!*fts && !*jsonCol) {
+		fs.Usage()
+		return fmt.Errorf("-namespace, -collection and -fts or -json are required")
+	}
+	resp, err := pb.NewCollectionRepoClient(conn).EnableStoreOptions(ctx, &pb.EnableStoreOptionsRequest{
+		Collection: &pb.NamespacedName{Namespace: *namespace, Name: *collection},
+		EnableFts:  *fts,
+		EnableJson: *jsonCol,
+	})
+	if err != nil {
+		return fmt.Errorf("upgrade failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("upgrade failed: %s", resp.Status.GetMessage())
+	}
+	opts := resp.StoreOptions
+	fmt.Printf("%s/%s: fts=%v json=%v, %d records indexed\n",
+		*namespace, *collection, opts.GetEnableFts(), opts.GetEnableJson(), resp.RecordsIndexed)
+	return nil
+}
+
+func runVerify(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "namespace of the collection")
+	collection := fs.String("collection", "", "collection name")
+	maxProblems := fs.Int("max-problems", 0, "problems to list per check (0 for the server default)")
+	fs.Parse(args)
+
+	if *namespace == "" || *collection == "" {
+		fs.Usage()
+		return fmt.Errorf("-namespace and -collection are required")
+	}
+	resp, err := pb.NewCollectionRepoClient(conn).VerifyCollection(ctx, &pb.VerifyCollectionRequest{
+		Collection:  &pb.NamespacedName{Namespace: *namespace, Name: *collection},
+		MaxProblems: int32(*maxProblems),
+	})
+	if err != nil {
+		return fmt.Errorf("verify failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("verify failed: %s", resp.Status.GetMessage())
+	}
+	printChecks(resp.Checks)
+	if !resp.Ok {
+		return fmt.Errorf("%s", resp.Status.GetMessage())
+	}
+	fmt.Println(resp.Status.GetMessage())
+	return nil
+}
+
+// printChecks prints verification checks and the problems they list.
+func printChecks(checks []*pb.VerifyCheck) {
+	for _, check := range checks {
+		switch {
+		case check.Skipped:
+			fmt.Printf("%-12s skipped: %s\n", check.Name, check.SkipReason)
+		case check.Ok:
+			fmt.Printf("%-12s ok, %d checked\n", check.Name, check.Checked)
+		default:
+			fmt.Printf("%-12s %d problems, %d checked\n", check.Name, check.ProblemCount, check.Checked)
+		}
+		for _, p := range check.Problems {
+			if p.RecordId != "" {
+				fmt.Printf("    %s: %s\n", p.RecordId, p.Message)
+			} else {
+				fmt.Printf("    %s\n", p.Message)
+			}
+		}
+		if listed := int64(len(check.Problems)); check.ProblemCount > listed {
+			fmt.Printf("    ... and %d more\n", check.ProblemCount-listed)
+		}
+	}
+}
+
+func runHold(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("hold", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "namespace of the collection to hold")
+	collection := fs.String("collection", "", "collection to hold")
+	record := fs.String("record", "", "hold only this record")
+	lift := fs.String("lift", "", "lift the hold with this ID instead")
+	reason := fs.String("reason", "", "why the hold is placed or lifted")
+	fs.Parse(args)
+
+	client := pb.NewCollectionRepoClient(conn)
+	var hold *pb.LegalHold
+	switch {
+	case *lift != "":
+		resp, err := client.LiftLegalHold(ctx, &pb.LiftLegalHoldRequest{HoldId: *lift, Reason: *reason})
+		if err != nil {
+			return fmt.Errorf("lift failed: %w", err)
+		}
+		if resp.Status.GetCode() != pb.Status_OK {
+			return fmt.Errorf("lift failed: %s", resp.Status.GetMessage())
+		}
+		hold = resp.Hold
+	case *namespace != "" && *collection != "":
+		resp, err := client.PlaceLegalHold(ctx, &pb.PlaceLegalHoldRequest{
+			Collection: &pb.NamespacedName{Namespace: *namespace, Name: *collection},
+			RecordId:   *record,
+			Reason:     *reason,
+		})
+		if err != nil {
+			return fmt.Errorf("hold failed: %w", err)
+		}
+		if resp.Status.GetCode() != pb.Status_OK {
+			return fmt.Errorf("hold failed: %s", resp.Status.GetMessage())
+		}
+		hold = resp.Hold
+	default:
+		fs.Usage()
+		return fmt.Errorf("-namespace and -collection, or -lift, are required")
+	}
+	printHold(hold)
+	return nil
+}
+
+func runHolds(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("holds", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "only list this namespace's holds")
+	all := fs.Bool("all", false, "also list lifted holds")
+	audit := fs.Bool("audit", false, "list the audit trail instead")
+	limit := fs.Int("limit", 0, "audit events to list (0 for the server default)")
+	fs.Parse(args)
+
+	client := pb.NewCollectionRepoClient(conn)
+	if *audit {
+		resp, err := client.ListLegalHoldAudit(ctx, &pb.ListLegalHoldAuditRequest{Namespace: *namespace, Limit: int32(*limit)})
+		if err != nil {
+			return fmt.Errorf("holds failed: %w", err)
+		}
+		if resp.Status.GetCode() != pb.Status_OK {
+			return fmt.Errorf("holds failed: %s", resp.Status.GetMessage())
+		}
+		for _, e := range resp.Events {
+			outcome := "allowed"
+			if !e.Allowed {
+				outcome = "blocked"
+			}
+			target := e.Collection.GetNamespace() + "/" + e.Collection.GetName()
+			if e.RecordId != "" {
+				target += "/" + e.RecordId
+			}
+			fmt.Printf("%s  %-7s %-7s %s by %q  %s\n", e.At.AsTime().Format(time.RFC3339), e.Action, outcome, target, e.Principal, e.Message)
+		}
+		return nil
+	}
+
+	resp, err := client.ListLegalHolds(ctx, &pb.ListLegalHoldsRequest{Namespace: *namespace, IncludeLifted: *all})
+	if err != nil {
+		return fmt.Errorf("holds failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("holds failed: %s", resp.Status.GetMessage())
+	}
+	for _, h := range resp.Holds {
+		printHold(h)
+	}
+	return nil
+}
+
+// printHold prints a legal hold on one line.
+func printHold(h *pb.LegalHold) {
+	target := h.Collection.GetNamespace() + "/" + h.Collection.GetName()
+	if h.RecordId != "" {
+		target += "/" + h.RecordId
+	}
+	fmt.Printf("%s  %s  placed by %s %s", h.Id, target, h.PlacedBy, h.PlacedAt.AsTime().Format(time.RFC3339))
+	if h.Reason != "" {
+		fmt.Printf(" (%s)", h.Reason)
+	}
+	if h.LiftedBy != "" {
+		fmt.Printf("; lifted by %s %s", h.LiftedBy, h.LiftedAt.AsTime().Format(time.RFC3339))
+	}
+	fmt.Println()
+}
+
+func runLineage(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("lineage", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "namespace of the collection")
+	collection := fs.String("collection", "", "collection name")
+	var records filterFlags
+	fs.Var(&records, "record", "also show this record's provenance (repeatable)")
+	fs.Parse(args)
+
+	if *namespace == "" || *collection == "" {
+		fs.Usage()
+		return fmt.Errorf("-namespace and -collection are required")
+	}
+	resp, err := pb.NewCollectionRepoClient(conn).GetLineage(ctx, &pb.GetLineageRequest{
+		Collection: &pb.NamespacedName{Namespace: *namespace, Name: *collection},
+		RecordIds:  records,
+	})
+	if err != nil {
+		return fmt.Errorf("lineage failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("lineage failed: %s", resp.Status.GetMessage())
+	}
+	name := func(n *pb.NamespacedName) string { return n.GetNamespace() + "/" + n.GetName() }
+	for _, e := range resp.Events {
+		fmt.Printf("%s  %-7s %s@%s -> %s@%s  %s", e.Id, e.Kind, name(e.SourceCollection), e.SourceCollector,
+			name(e.DestCollection), e.DestCollector, time.Unix(e.CreatedAt, 0).Format(time.RFC3339))
+		if e.BackupId != "" {
+			fmt.Printf("  %s", e.BackupId)
+		}
+		fmt.Println()
+	}
+	for _, o := range resp.Origins {
+		lineage := "original"
+		if len(o.LineageIds) > 0 {
+			lineage = strings.Join(o.LineageIds, " -> ")
+		}
+		fmt.Printf("%8d records from %s@%s: %s\n", o.RecordCount, name(o.OriginCollection), o.OriginCollector, lineage)
+	}
+	for _, r := range resp.Records {
+		fmt.Printf("%s: from %s@%s via [%s]\n", r.RecordId, name(r.OriginCollection), r.OriginCollector, strings.Join(r.LineageIds, ", "))
+	}
+	return nil
+}
+
+func runRehearse(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("rehearse", flag.ExitOnError)
+	backupID := fs.String("backup", "", "ID of the backup to restore")
+	ttl := fs.Duration("ttl", 0, "keep the restored collection this long (0 drops it once checked)")
+	var queries filterFlags
+	fs.Var(&queries, "query", "SELECT run against the restored database, attached as \"restored\" (repeatable)")
+	minRows := fs.Int64("min-rows", 1, "rows each -query must return")
+	maxProblems := fs.Int("max-problems", 0, "problems to list per check (0 for the server default)")
+	fs.Parse(args)
+
+	if *backupID == "" {
+		fs.Usage()
+		return fmt.Errorf("-backup is required")
+	}
+	req := &pb.RehearseRestoreRequest{
+		BackupId:    *backupID,
+		TtlMs:       ttl.Milliseconds(),
+		MaxProblems: int32(*maxProblems),
+	}
+	for _, q := range queries {
+		req.SmokeQueries = append(req.SmokeQueries, &pb.SmokeQuery{Query: q, MinRows: *minRows})
+	}
+	resp, err := pb.NewCollectionRepoClient(conn).RehearseRestore(ctx, req)
+	if err != nil {
+		return fmt.Errorf("rehearse failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("rehearse failed: %s", resp.Status.GetMessage())
+	}
+	fmt.Printf("restored into %s/%s: %d records, %d files\n",
+		resp.Collection.GetNamespace(), resp.Collection.GetName(), resp.RecordsRestored, resp.FilesRestored)
+	printChecks(resp.Checks)
+	for _, q := range resp.SmokeQueries {
+		if q.Ok {
+			fmt.Printf("%-12s ok, %d rows\n", q.Name, q.Rows)
+		} else {
+			fmt.Printf("%-12s failed: %s\n", q.Name, q.Error)
+		}
+	}
+	if resp.ExpiresAt != 0 {
+		fmt.Printf("kept until %s\n", time.Unix(resp.ExpiresAt, 0).Format(time.RFC3339))
+	}
+	if !resp.Ok {
+		return fmt.Errorf("%s", resp.Status.GetMessage())
+	}
+	fmt.Println(resp.Status.GetMessage())
+	return nil
+}
+
+func runScheduleBackup(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("schedule-backup", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "namespace of the collection")
+	collection := fs.String("collection", "", "collection name")
+	cron := fs.String("cron", "", "cron expression, e.g. \"0 3 * * *\" or @daily")
+	dest := fs.String("dest", "", "directory backups are written to")
+	files := fs.Bool("files", false, "include the collection's files")
+	timezone := fs.String("tz", "", "IANA time zone the cron expression is read in (default UTC)")
+	remove := fs.Bool("delete", false, "remove the collection's schedule")
+	fs.Parse(args)
+
+	if *namespace == "" || *collection == "" || (!*remove && (*cron == "" || *dest == "")) {
+		fs.Usage()
+		return fmt.Errorf("-namespace, -collection and -cron and -dest, or -delete, are required")
+	}
+	sched := &pb.BackupSchedule{
+		Collection:   &pb.NamespacedName{Namespace: *namespace, Name: *collection},
+		Cron:         *cron,
+		DestDir:      *dest,
+		IncludeFiles: *files,
+		Timezone:     *timezone,
+	}
+	if *remove {
+		sched = &pb.BackupSchedule{Collection: sched.Collection}
+	}
+	resp, err := pb.NewCollectionRepoClient(conn).SetBackupSchedule(ctx, &pb.SetBackupScheduleRequest{Schedule: sched})
+	if err != nil {
+		return fmt.Errorf("schedule-backup failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("schedule-backup failed: %s", resp.Status.GetMessage())
+	}
+	fmt.Println(resp.Status.GetMessage())
+	return nil
+}
+
+func runBackupSchedules(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("backup-schedules", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "only schedules in this namespace")
+	fs.Parse(args)
+
+	resp, err := pb.NewCollectionRepoClient(conn).ListBackupSchedules(ctx, &pb.ListBackupSchedulesRequest{Namespace: *namespace})
+	if err != nil {
+		return fmt.Errorf("backup-schedules failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("backup-schedules failed: %s", resp.Status.GetMessage())
+	}
+
+	fmt.Printf("%-30s %-16s %-20s %-20s %s\n", "COLLECTION", "CRON", "NEXT", "LAST", "LAST STATUS")
+	for _, sched := range resp.Schedules {
+		coll := sched.Collection.GetNamespace() + "/" + sched.Collection.GetName()
+		last, status := "-", "-"
+		if sched.LastRunAt != 0 {
+			last = time.Unix(sched.LastRunAt, 0).UTC().Format("2006-01-02 15:04:05")
+			status = sched.LastStatus.GetCode().String()
+		}
+		next := time.Unix(sched.NextRunAt, 0).UTC().Format("2006-01-02 15:04:05")
+		fmt.Printf("%-30s %-16s %-20s %-20s %s\n", coll, sched.Cron, next, last, status)
+	}
+	return nil
+}
+
+func runSnapshots(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "only snapshots in this namespace")
+	collection := fs.String("collection", "", "only snapshots of this collection (requires -namespace)")
+	fs.Parse(args)
+
+	req := &pb.ListSnapshotsRequest{Namespace: *namespace}
+	if *collection != "" {
+		if *namespace == "" {
+			return fmt.Errorf("-collection requires -namespace")
+		}
+		req.Collection = &pb.NamespacedName{Namespace: *namespace, Name: *collection}
+	}
+	resp, err := pb.NewCollectionRepoClient(conn).ListSnapshots(ctx, req)
+	if err != nil {
+		return fmt.Errorf("snapshots failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("snapshots failed: %s", resp.Status.GetMessage())
+	}
+
+	fmt.Printf("%-30s %-20s %-20s %-8s %10s %12s\n", "COLLECTION", "NAME", "CREATED", "METHOD", "RECORDS", "BYTES")
+	for _, snap := range resp.Snapshots {
+		coll := snap.Collection.GetNamespace() + "/" + snap.Collection.GetName()
+		created := time.Unix(snap.CreatedAt, 0).UTC().Format("2006-01-02 15:04:05")
+		fmt.Printf("%-30s %-20s %-20s %-8s %10d %12d\n", coll, snap.Name, created, snap.Method, snap.RecordCount, snap.SizeBytes)
+	}
+	return nil
+}
+
+func runStream(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("stream", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "namespace of the collection")
+	collection := fs.String("collection", "", "collection name")
+	stream := fs.String("stream", "", "stream key")
+	from := fs.Uint64("from", 1, "first sequence to read")
+	limit := fs.Int("limit", 0, "events to read (0 for the server default)")
+	fs.Parse(args)
+
+	if *namespace == "" || *collection == "" || *stream == "" {
+		fs.Usage()
+		return fmt.Errorf("-namespace, -collection and -stream are required")
+	}
+	resp, err := pb.NewCollectionRepoClient(conn).ReadStream(ctx, &pb.ReadStreamRequest{
+		Collection:   &pb.NamespacedName{Namespace: *namespace, Name: *collection},
+		Stream:       *stream,
+		FromSequence: *from,
+		Limit:        int32(*limit),
+	})
+	if err != nil {
+		return fmt.Errorf("stream failed: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return fmt.Errorf("stream failed: %s", resp.Status.GetMessage())
+	}
+	for _, e := range resp.Events {
+		fmt.Printf("%6d  %s  %-16s %s\n", e.Sequence, e.CreatedAt.AsTime().Format(time.RFC3339), e.Type, e.Data)
+	}
+	fmt.Printf("%s is at sequence %d\n", *stream, resp.LastSequence)
+	return nil
+}
+
+func runTop(ctx context.Context, conn *grpc.ClientConn, args []string) error {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	stage := fs.String("stage", "", "only \"dispatch\" or \"serve\" calls")
+	namespace := fs.String("namespace", "", "only methods in this namespace")
+	by := fs.String("by", "calls", "order by calls, failures or latency")
+	limit := fs.Int("n", 10, "number of methods to show")
+	fs.Parse(args)
+
+	orders := map[string]pb.MethodOrder{
+		"calls":    pb.MethodOrder_METHOD_ORDER_CALLS,
+		"failures": pb.MethodOrder_METHOD_ORDER_FAILURES,
+		"latency":  pb.MethodOrder_METHOD_ORDER_LATENCY,
+	}
+	order, ok := orders[*by]
+	if !ok {
+		return fmt.Errorf("invalid -by %q: expected calls, failures or latency", *by)
+	}
+
+	resp, err := pb.NewCollectiveDispatcherClient(conn).TopMethods(ctx, &pb.TopMethodsRequest{
+		Stage:     *stage,
+		Namespace: *namespace,
+		OrderBy:   order,
+		Limit:     int32(*limit),
+	})
+	if err != nil {
+		return fmt.Errorf("top failed: %w", err)
+	}
+	if resp.Status.GetCode() != 200 {
+		return fmt.Errorf("top failed: %s", resp.Status.GetMessage())
+	}
+
+	fmt.Printf("%-8s %-40s %10s %8s %10s %10s\n", "STAGE", "METHOD", "CALLS", "FAILED", "P50 MS", "P99 MS")
+	for _, m := range resp.Methods {
+		method := fmt.Sprintf("%s/%s.%s", m.Namespace, m.ServiceName, m.MethodName)
+		fmt.Printf("%-8s %-40s %10d %7.1f%% %10.1f %10.1f\n", m.Stage, method, m.Calls, m.FailureRate*100, m.P50LatencyMs, m.P99LatencyMs)
+	}
+	return nil
+}
+
+// filterOps maps expression operators to filter operators. Two-character
+// operators come first so that ">=" is not read as ">".
+var filterOps = []struct {
+	token string
+	op    pb.FilterOperator
+}{
+	{">=", pb.FilterOperator_OP_GREATER_EQUAL},
+	{"<=", pb.FilterOperator_OP_LESS_EQUAL},
+	{"!=", pb.FilterOperator_OP_NOT_EQUALS},
+	{"=", pb.FilterOperator_OP_EQUALS},
+	{">", pb.FilterOperator_OP_GREATER_THAN},
+	{"<", pb.FilterOperator_OP_LESS_THAN},
+	{"~", pb.FilterOperator_OP_CONTAINS},
+}
+
+// parseFilters turns expressions like "year>=2023" into request filters.
+func parseFilters(exprs []string) (map[string]*pb.Filter, error) {
+	filters := make(map[string]*pb.Filter, len(exprs))
+	for _, expr := range exprs {
+		idx, fo := -1, filterOps[0]
+		for _, candidate := range filterOps {
+			if i := strings.Index(expr, candidate.token); i > 0 && (idx < 0 || i < idx) {
+				idx, fo = i, candidate
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid filter %q: expected field<op>value", expr)
+		}
+
+		field := strings.TrimSpace(expr[:idx])
+		raw := strings.TrimSpace(expr[idx+len(fo.token):])
+		filters[field] = &pb.Filter{Operator: fo.op, Value: parseValue(raw)}
+	}
+	return filters, nil
+}
+
+// parseValue interprets a filter value as a number or boolean when possible.
+func parseValue(raw string) *structpb.Value {
+	if n, err := strconv.ParseFloat(raw, 64); err == nil {
+		return structpb.NewNumberValue(n)
+	}
+	if b, err := strconv.ParseBool(raw); err == nil {
+		return structpb.NewBoolValue(b)
+	}
+	return structpb.NewStringValue(strings.Trim(raw, `"'`))
+}
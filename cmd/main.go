@@ -20,14 +20,15 @@ func main() {
 
 func run() error {
 	ctx := context.Background()
-	basePath := "./data/collections"
+	// Same layout as the server, so it can serve this collection's data
+	layout := collection.NewPathLayout(os.Getenv("COLLECTOR_DATA_DIR"))
 
 	// 1. Setup Namespace/Name
 	namespace := "demo"
 	name := "tasks"
-	fullPath := filepath.Join(basePath, namespace, name)
+	dbPath := layout.CollectionDB(namespace, name)
 
-	if err := os.MkdirAll(fullPath, 0755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
 		return fmt.Errorf("create dir: %w", err)
 	}
 
@@ -43,7 +44,6 @@ func run() error {
 	// 3. Initialize Dependencies (The "Glue")
 
 	// A. SQLite Store
-	dbPath := filepath.Join(fullPath, "data.db")
 	storeOpts := collection.Options{
 		EnableFTS:  true,
 		EnableJSON: true,
@@ -57,7 +57,7 @@ func run() error {
 	// B. Local Filesystem
 	// (We need a concrete implementation of collection.FileSystem)
 	// For this example, we use a simple wrapper around os methods.
-	fs, err := collection.NewLocalFileSystem(filepath.Join(fullPath, "files"))
+	fs, err := collection.NewLocalFileSystem(layout.CollectionFiles(namespace, name))
 	if err != nil {
 		log.Fatalf("Failed to create filesystem: %v", err)
 	}
@@ -2,28 +2,47 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/channelpool"
 	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/cron"
+	"github.com/accretional/collector/pkg/db/duckdb"
 	"github.com/accretional/collector/pkg/db/sqlite"
 	"github.com/accretional/collector/pkg/dispatch"
+	"github.com/accretional/collector/pkg/fs/s3"
+	"github.com/accretional/collector/pkg/grpcconfig"
+	"github.com/accretional/collector/pkg/jobs"
 	"github.com/accretional/collector/pkg/registry"
+	"github.com/accretional/collector/pkg/worker"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/descriptorpb"
 )
 
+// defaultCollectorPort is the port the collector serves gRPC on.
+const defaultCollectorPort = 50051
+
 func main() {
+	// `server preflight` checks the host and configuration without serving
+	if len(os.Args) > 1 && os.Args[1] == "preflight" {
+		os.Exit(preflight(os.Args[2:]))
+	}
 	if err := run(); err != nil {
 		log.Fatal(err)
 	}
@@ -35,7 +54,21 @@ func run() error {
 	// Configuration
 	namespace := "production"
 	collectorID := "collector-001"
-	collectorPort := 50051
+	collectorPort := defaultCollectorPort
+	collectorVersion := "0.1.0"
+
+	// Everything the collector stores lives under COLLECTOR_DATA_DIR (./data
+	// by default), laid out the same way for every component
+	layout := collection.NewPathLayout(os.Getenv("COLLECTOR_DATA_DIR"))
+	// MoveCollectionStorage may move collections under the data dir or
+	// COLLECTOR_STORAGE_ROOTS, e.g. /mnt/disk2,/mnt/disk3
+	layout.StorageRoots = commaList(os.Getenv("COLLECTOR_STORAGE_ROOTS"))
+
+	// gRPC keepalive, message size and flow control (COLLECTOR_GRPC_* variables)
+	grpcConfig, err := grpcconfig.FromEnv()
+	if err != nil {
+		return fmt.Errorf("invalid gRPC configuration: %w", err)
+	}
 
 	log.Printf("Starting Collector (ID: %s, Namespace: %s)", collectorID, namespace)
 
@@ -43,7 +76,7 @@ func run() error {
 	// 1. Setup Registry Collections
 	// ========================================================================
 
-	registryPath := "./data/registry"
+	registryPath := layout.Dir("registry")
 	if err := os.MkdirAll(registryPath, 0755); err != nil {
 		return fmt.Errorf("create registry dir: %w", err)
 	}
@@ -102,31 +135,465 @@ func run() error {
 	}
 	log.Printf("✓ Registered CollectionRepo in namespace '%s'", namespace)
 
+	if err := registry.RegisterCollectionBackupService(ctx, registryServer, namespace); err != nil {
+		return fmt.Errorf("register CollectionBackup: %w", err)
+	}
+	log.Printf("✓ Registered CollectionBackup in namespace '%s'", namespace)
+
+	if err := registry.RegisterWorkerService(ctx, registryServer, namespace); err != nil {
+		return fmt.Errorf("register CollectiveWorker: %w", err)
+	}
+	log.Printf("✓ Registered CollectiveWorker in namespace '%s'", namespace)
+
 	// ========================================================================
 	// 2. Setup Collection Repository
 	// ========================================================================
 
-	repoPath := "./data/repo"
-	if err := os.MkdirAll(repoPath, 0755); err != nil {
+	repoDBPath := layout.RepoDB()
+	if err := os.MkdirAll(filepath.Dir(repoDBPath), 0755); err != nil {
 		return fmt.Errorf("create repo dir: %w", err)
 	}
-
-	repoDBPath := filepath.Join(repoPath, "collections.db")
-	repoStore, err := sqlite.NewSqliteStore(repoDBPath, collection.Options{EnableJSON: true})
+	repoOpts := collection.Options{EnableJSON: true}
+	// Optional geo index for location-bearing records, e.g.
+	// COLLECTOR_GEO_FIELDS=location.lat,location.lon
+	if fields := os.Getenv("COLLECTOR_GEO_FIELDS"); fields != "" {
+		lat, lon, ok := strings.Cut(fields, ",")
+		if !ok {
+			return fmt.Errorf("COLLECTOR_GEO_FIELDS must be <lat field>,<lon field>, got %q", fields)
+		}
+		repoOpts.Geo = &collection.GeoOptions{LatField: strings.TrimSpace(lat), LonField: strings.TrimSpace(lon)}
+	}
+	// Optional compression of record data at rest, e.g.
+	// COLLECTOR_COMPRESSION_MIN_SIZE=1024 compresses records of 1KB and up
+	if v := os.Getenv("COLLECTOR_COMPRESSION_MIN_SIZE"); v != "" {
+		minSize, err := strconv.Atoi(v)
+		if err != nil || minSize <= 0 {
+			return fmt.Errorf("COLLECTOR_COMPRESSION_MIN_SIZE must be a positive number of bytes, got %q", v)
+		}
+		repoOpts.Compression = &collection.CompressionOptions{MinSize: minSize}
+	}
+	// Optional sharing of identical record data, for crawled or mirrored content
+	if v := os.Getenv("COLLECTOR_DEDUPLICATE"); v != "" {
+		dedup, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_DEDUPLICATE must be true or false, got %q", v)
+		}
+		repoOpts.Deduplicate = dedup
+	}
+	// Optional near-duplicate index for FindSimilar
+	if v := os.Getenv("COLLECTOR_SIMILARITY"); v != "" {
+		similarity, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_SIMILARITY must be true or false, got %q", v)
+		}
+		repoOpts.EnableSimilarity = similarity
+	}
+	repoStore, err := sqlite.NewSqliteStore(repoDBPath, repoOpts)
 	if err != nil {
 		return fmt.Errorf("init repo store: %w", err)
 	}
 	defer repoStore.Close()
 
 	collectionRepo := collection.NewCollectionRepo(repoStore)
+	collectionRepo.SetPathLayout(layout)
+	// Namespace aliases (COLLECTOR_NAMESPACE_ALIASES=alias=namespace,...),
+	// resolved by the repository, registry and dispatcher; more can be added
+	// with AliasNamespace, and RenameNamespace moves a namespace in all three
+	namespaceAliases := collection.NewNamespaceAliases()
+	for _, pair := range commaList(os.Getenv("COLLECTOR_NAMESPACE_ALIASES")) {
+		alias, target, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("COLLECTOR_NAMESPACE_ALIASES entries must be alias=namespace, got %q", pair)
+		}
+		if err := namespaceAliases.Add(alias, target); err != nil {
+			return fmt.Errorf("COLLECTOR_NAMESPACE_ALIASES: %w", err)
+		}
+	}
+	collectionRepo.SetNamespaceAliases(namespaceAliases)
+	registryServer.SetNamespaceAliases(namespaceAliases)
+	// MoveCollectionStorage reopens moved collections with the same options
+	collectionRepo.SetStoreOpener(sqlite.StoreOpener(repoOpts))
+	// Temporary collections live in memory or under the system temp directory
+	// and are dropped on expiry, at the end of their session, or on shutdown
+	collectionRepo.SetTempStoreFactory(sqlite.TempStoreFactory(filepath.Join(os.TempDir(), "collector-temp"), repoOpts))
+	collectionRepo.Temporary().Start(collection.DefaultTempReapInterval)
+	defer collectionRepo.Temporary().Close()
+	// Optional object storage for collection files, enabling signed URLs;
+	// credentials come from the AWS_* variables (and S3_ENDPOINT for MinIO etc.)
+	if bucket := os.Getenv("COLLECTOR_FILES_BUCKET"); bucket != "" {
+		filesFS, err := s3.NewFileSystem(s3.ConfigFromEnv(bucket))
+		if err != nil {
+			return fmt.Errorf("init files bucket: %w", err)
+		}
+		collectionRepo.SetFileSystem(filesFS)
+		log.Printf("✓ Collection files stored in bucket %s", bucket)
+	}
+	artifacts := collection.NewArtifactPipeline(collection.ArtifactPipelineOptions{
+		Defaults: []collection.ArtifactProcessor{&collection.ThumbnailProcessor{}},
+	})
+	defer artifacts.Stop()
+	collectionRepo.SetArtifactPipeline(artifacts)
+	// Flag mass deletions and runaway growth; deletes are only held for
+	// confirmation when COLLECTOR_BLOCK_MASS_DELETES is set
+	monitorOpts := collection.MonitorOptions{
+		OnAnomaly: func(a *pb.Anomaly) { log.Printf("Warning: anomaly %s: %s", a.Id, a.Description) },
+	}
+	if v := os.Getenv("COLLECTOR_BLOCK_MASS_DELETES"); v != "" {
+		block, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_BLOCK_MASS_DELETES must be true or false, got %q", v)
+		}
+		monitorOpts.BlockDeletes = block
+	}
+	changeMonitor := collection.NewChangeMonitor(monitorOpts)
+	collectionRepo.SetChangeMonitor(changeMonitor)
+	// Name this collector in the CRDT fields of replicated collections
+	nodeID := os.Getenv("COLLECTOR_NODE_ID")
+	if nodeID == "" {
+		host, _ := os.Hostname()
+		nodeID = fmt.Sprintf("%s:%d", host, collectorPort)
+	}
+	collectionRepo.SetNodeID(nodeID)
+	// Timestamps of records, backups and dispatches come from one clock,
+	// corrected by COLLECTOR_CLOCK_OFFSET (e.g. -1.5s) on hosts known to
+	// run fast or slow
+	var clock collection.Clock = collection.SystemClock{}
+	if v := os.Getenv("COLLECTOR_CLOCK_OFFSET"); v != "" {
+		offset, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_CLOCK_OFFSET must be a duration, got %q", v)
+		}
+		clock = collection.SkewedClock{Base: clock, Offset: offset}
+		log.Printf("✓ Clock offset: %s", offset)
+	}
+	collectionRepo.SetClock(clock)
+	// HLCs from peers and from a standby's primary are followed only while
+	// their clocks are within COLLECTOR_MAX_CLOCK_SKEW (default 500ms)
+	maxSkew := collection.DefaultMaxClockSkew
+	if v := os.Getenv("COLLECTOR_MAX_CLOCK_SKEW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_MAX_CLOCK_SKEW must be a duration, got %q", v)
+		}
+		maxSkew = d
+	}
+	// Records carry a checksum of their data; with
+	// COLLECTOR_VERIFY_CHECKSUMS=true every read is checked against it
+	if v := os.Getenv("COLLECTOR_VERIFY_CHECKSUMS"); v != "" {
+		verify, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_VERIFY_CHECKSUMS must be true or false, got %q", v)
+		}
+		collectionRepo.SetVerifyChecksums(verify)
+	}
 	log.Println("✓ Collection repository created")
 
+	// Optional two-person approval of dangerous calls, e.g.
+	// COLLECTOR_APPROVAL_METHODS=/collector.CollectionService/DeleteByFilter
+	// with COLLECTOR_APPROVAL_NAMESPACES=prod-* and COLLECTOR_APPROVERS=alice,bob.
+	// Approvals persist in system/approvals on a database of their own.
+	serverOpts := grpcConfig.ServerOptions()
+
+	// Authenticate callers by the bearer tokens in
+	// COLLECTOR_PRINCIPAL_TOKENS_FILE ("<principal> <token>" per line), for
+	// approvals, legal holds and method ACLs, which refuse principals that
+	// are only named in the x-collector-principal header. Before the
+	// interceptors that check them
+	var principalAuth *collection.PrincipalAuthenticator
+	if path := os.Getenv("COLLECTOR_PRINCIPAL_TOKENS_FILE"); path != "" {
+		tokens, err := collection.LoadPrincipalTokens(path)
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_PRINCIPAL_TOKENS_FILE: %w", err)
+		}
+		principalAuth = collection.NewPrincipalAuthenticator(collection.PrincipalAuthenticatorOptions{Tokens: tokens})
+		serverOpts = append(serverOpts,
+			grpc.ChainUnaryInterceptor(principalAuth.UnaryInterceptor()),
+			grpc.ChainStreamInterceptor(principalAuth.StreamInterceptor()))
+		log.Printf("✓ Authenticating principals by %d tokens", len(tokens))
+	}
+
+	// Confine calls bound to a namespace to it, filling it into requests
+	// that leave it out. COLLECTOR_PRINCIPAL_NAMESPACES=principal=namespace,...
+	// binds authenticated principals to theirs, which the
+	// x-collector-namespace header must agree with; otherwise the header
+	// binds calls. With COLLECTOR_REQUIRE_NAMESPACE set, unbound calls are
+	// refused. Before the interceptors after authentication, so they see
+	// the namespace filled in
+	bindingOpts := collection.NamespaceBindingOptions{Aliases: namespaceAliases}
+	for _, pair := range commaList(os.Getenv("COLLECTOR_PRINCIPAL_NAMESPACES")) {
+		principal, namespace, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("COLLECTOR_PRINCIPAL_NAMESPACES entries must be principal=namespace, got %q", pair)
+		}
+		if bindingOpts.Principals == nil {
+			if principalAuth == nil {
+				return fmt.Errorf("COLLECTOR_PRINCIPAL_NAMESPACES requires COLLECTOR_PRINCIPAL_TOKENS_FILE: bindings need authenticated principals")
+			}
+			bindingOpts.Principals = make(map[string]string)
+		}
+		bindingOpts.Principals[principal] = namespace
+	}
+	if v := os.Getenv("COLLECTOR_REQUIRE_NAMESPACE"); v != "" {
+		required, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_REQUIRE_NAMESPACE must be true or false, got %q", v)
+		}
+		bindingOpts.Required = required
+	}
+	if !bindingOpts.Required {
+		log.Println("Note: namespace binding is not required; clients that omit x-collector-namespace are not confined to a namespace")
+	}
+	namespaceBinding := collection.NewNamespaceBinding(bindingOpts)
+	serverOpts = append(serverOpts,
+		grpc.ChainUnaryInterceptor(namespaceBinding.UnaryInterceptor()),
+		grpc.ChainStreamInterceptor(namespaceBinding.StreamInterceptor()))
+
+	// Watch free space under the data root and moved collections' directories:
+	// below COLLECTOR_DISK_MIN_FREE_BYTES non-essential writes are refused
+	// and backup, clone and fetch jobs pause; below
+	// COLLECTOR_DISK_LOW_FREE_BYTES a warning is logged
+	diskOpts := collection.DiskWatchdogOptions{Locate: collectionRepo.StoragePath}
+	for env, field := range map[string]*uint64{
+		"COLLECTOR_DISK_MIN_FREE_BYTES": &diskOpts.MinFreeBytes,
+		"COLLECTOR_DISK_LOW_FREE_BYTES": &diskOpts.LowFreeBytes,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil || n == 0 {
+				return fmt.Errorf("%s must be a positive number of bytes, got %q", env, v)
+			}
+			*field = n
+		}
+	}
+	diskWatchdog := collection.NewDiskWatchdog([]string{layout.Root}, diskOpts)
+	diskWatchdog.Start()
+	defer diskWatchdog.Stop()
+	serverOpts = append(serverOpts,
+		grpc.ChainUnaryInterceptor(diskWatchdog.UnaryInterceptor()),
+		grpc.ChainStreamInterceptor(diskWatchdog.StreamInterceptor()))
+	log.Printf("✓ Watching disk space of %s", diskWatchdog)
+
+	// Remove the temp files interrupted clones, fetches and pushes leave in
+	// the collections directory, at startup and every
+	// COLLECTOR_TEMP_FILE_SWEEP_INTERVAL, once unmodified for
+	// COLLECTOR_TEMP_FILE_MAX_AGE
+	var sweepOpts collection.TempFileSweeperOptions
+	for env, field := range map[string]*time.Duration{
+		"COLLECTOR_TEMP_FILE_MAX_AGE":        &sweepOpts.MaxAge,
+		"COLLECTOR_TEMP_FILE_SWEEP_INTERVAL": &sweepOpts.Interval,
+	} {
+		if v := os.Getenv(env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("%s must be a positive duration, got %q", env, v)
+			}
+			*field = d
+		}
+	}
+	tempSweeper := collection.NewTempFileSweeper([]string{layout.CollectionsDir()}, sweepOpts)
+	tempSweeper.Start()
+	defer tempSweeper.Stop()
+	log.Printf("✓ Sweeping orphaned temp files in %s", tempSweeper)
+
+	// Debugging: with COLLECTOR_ADMIN_TOKEN set, DumpGoroutines,
+	// ServerResources and SubscribeState require it, and COLLECTOR_DEBUG_ADDR (e.g.
+	// localhost:6060) serves net/http/pprof to bearers of it
+	if token := os.Getenv("COLLECTOR_ADMIN_TOKEN"); token != "" {
+		adminAuth := collection.NewAdminAuth(token)
+		serverOpts = append(serverOpts,
+			grpc.ChainUnaryInterceptor(adminAuth.UnaryInterceptor()),
+			grpc.ChainStreamInterceptor(adminAuth.StreamInterceptor()))
+		if addr := os.Getenv("COLLECTOR_DEBUG_ADDR"); addr != "" {
+			debugLis, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("listen on COLLECTOR_DEBUG_ADDR: %w", err)
+			}
+			debugServer := &http.Server{Handler: adminAuth.DebugHandler(), ReadHeaderTimeout: 10 * time.Second}
+			go func() {
+				if err := debugServer.Serve(debugLis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Printf("Warning: debug server stopped: %v", err)
+				}
+			}()
+			defer debugServer.Close()
+			log.Printf("✓ Serving pprof on %s/debug/pprof/", debugLis.Addr())
+		}
+	} else if os.Getenv("COLLECTOR_DEBUG_ADDR") != "" {
+		return fmt.Errorf("COLLECTOR_DEBUG_ADDR requires COLLECTOR_ADMIN_TOKEN")
+	}
+	var approvalGate *collection.ApprovalGate
+	if methods := commaList(os.Getenv("COLLECTOR_APPROVAL_METHODS")); len(methods) > 0 {
+		if principalAuth == nil {
+			return fmt.Errorf("COLLECTOR_APPROVAL_METHODS requires COLLECTOR_PRINCIPAL_TOKENS_FILE: approvals need authenticated principals")
+		}
+		approvalsPath := layout.Dir("approvals")
+		if err := os.MkdirAll(approvalsPath, 0755); err != nil {
+			return fmt.Errorf("create approvals dir: %w", err)
+		}
+		approvalsStore, err := sqlite.NewSqliteStore(filepath.Join(approvalsPath, "approvals.db"), collection.Options{EnableJSON: true})
+		if err != nil {
+			return fmt.Errorf("init approvals store: %w", err)
+		}
+		defer approvalsStore.Close()
+		approvalsColl, err := collection.NewCollection(
+			&pb.Collection{Namespace: collection.ApprovalsNamespace, Name: collection.ApprovalsCollection},
+			approvalsStore,
+			&collection.LocalFileSystem{},
+		)
+		if err != nil {
+			return fmt.Errorf("create approvals collection: %w", err)
+		}
+		var policies []collection.ApprovalPolicy
+		for _, method := range methods {
+			policies = append(policies, collection.ApprovalPolicy{
+				Method:     method,
+				Namespaces: commaList(os.Getenv("COLLECTOR_APPROVAL_NAMESPACES")),
+				Approvers:  commaList(os.Getenv("COLLECTOR_APPROVERS")),
+			})
+		}
+		approvalGate = collection.NewApprovalGate(approvalsColl, policies)
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(approvalGate.UnaryInterceptor()))
+		log.Printf("✓ Approvals required for %s", strings.Join(methods, ", "))
+	}
+
+	// Optional legal holds placed and lifted by
+	// COLLECTOR_LEGAL_HOLD_CUSTODIANS=alice,bob, blocking deletes, updates,
+	// overwriting restores and backup pruning of held data. Holds and their
+	// audit trail persist in system/legal_holds on a database of their own.
+	var legalHolds *collection.LegalHolds
+	if custodians := commaList(os.Getenv("COLLECTOR_LEGAL_HOLD_CUSTODIANS")); len(custodians) > 0 {
+		if principalAuth == nil {
+			return fmt.Errorf("COLLECTOR_LEGAL_HOLD_CUSTODIANS requires COLLECTOR_PRINCIPAL_TOKENS_FILE: custodians must be authenticated")
+		}
+		holdsPath := layout.Dir("legal_holds")
+		if err := os.MkdirAll(holdsPath, 0755); err != nil {
+			return fmt.Errorf("create legal holds dir: %w", err)
+		}
+		holdsStore, err := sqlite.NewSqliteStore(filepath.Join(holdsPath, "legal_holds.db"), collection.Options{EnableJSON: true})
+		if err != nil {
+			return fmt.Errorf("init legal holds store: %w", err)
+		}
+		defer holdsStore.Close()
+		holdsColl, err := collection.NewCollection(
+			&pb.Collection{Namespace: collection.LegalHoldsNamespace, Name: collection.LegalHoldsCollection},
+			holdsStore,
+			&collection.LocalFileSystem{},
+		)
+		if err != nil {
+			return fmt.Errorf("create legal holds collection: %w", err)
+		}
+		legalHolds, err = collection.NewLegalHolds(ctx, holdsColl, custodians)
+		if err != nil {
+			return err
+		}
+		collectionRepo.SetLegalHolds(legalHolds)
+		log.Printf("✓ Legal holds placed and lifted by %s", strings.Join(custodians, ", "))
+	}
+
+	// Optional changelog capture for point-in-time restores:
+	// COLLECTOR_CHANGELOG=* records every collection's writes, or a list of
+	// namespaces only theirs. Changes persist in system/changelog on a
+	// database of their own and are trimmed as backups are pruned.
+	var changeLog *collection.ChangeLog
+	if namespaces := commaList(os.Getenv("COLLECTOR_CHANGELOG")); len(namespaces) > 0 {
+		if len(namespaces) == 1 && namespaces[0] == "*" {
+			namespaces = nil
+		}
+		changeLogPath := layout.Dir("changelog")
+		if err := os.MkdirAll(changeLogPath, 0755); err != nil {
+			return fmt.Errorf("create changelog dir: %w", err)
+		}
+		changeLogStore, err := sqlite.NewSqliteStore(filepath.Join(changeLogPath, "changelog.db"), collection.Options{EnableJSON: true})
+		if err != nil {
+			return fmt.Errorf("init changelog store: %w", err)
+		}
+		defer changeLogStore.Close()
+		changeLogColl, err := collection.NewCollection(
+			&pb.Collection{Namespace: collection.ChangeLogNamespace, Name: collection.ChangeLogCollection},
+			changeLogStore,
+			&collection.LocalFileSystem{},
+		)
+		if err != nil {
+			return fmt.Errorf("create changelog collection: %w", err)
+		}
+		changeLog, err = collection.NewChangeLog(ctx, changeLogColl, namespaces)
+		if err != nil {
+			return err
+		}
+		collectionRepo.SetChangeLog(changeLog)
+		log.Printf("✓ Changelog capturing writes since %s", changeLog.Started().Format(time.RFC3339))
+	}
+
+	// Opt-in anonymous usage reports: with COLLECTOR_USAGE_REPORTS=true,
+	// counts of collections, records and RPCs served are reported every
+	// COLLECTOR_USAGE_INTERVAL to system/usage_reports on a database of
+	// their own, and POSTed to COLLECTOR_USAGE_ENDPOINT when set
+	if v := os.Getenv("COLLECTOR_USAGE_REPORTS"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_USAGE_REPORTS must be true or false, got %q", v)
+		}
+		if enabled {
+			usageInterval := collection.DefaultUsageInterval
+			if v := os.Getenv("COLLECTOR_USAGE_INTERVAL"); v != "" {
+				if usageInterval, err = time.ParseDuration(v); err != nil || usageInterval <= 0 {
+					return fmt.Errorf("COLLECTOR_USAGE_INTERVAL must be a positive duration, got %q", v)
+				}
+			}
+			usagePath := layout.Dir("usage")
+			if err := os.MkdirAll(usagePath, 0755); err != nil {
+				return fmt.Errorf("create usage reports dir: %w", err)
+			}
+			usageStore, err := sqlite.NewSqliteStore(filepath.Join(usagePath, "usage_reports.db"), collection.Options{EnableJSON: true})
+			if err != nil {
+				return fmt.Errorf("init usage reports store: %w", err)
+			}
+			defer usageStore.Close()
+			usageColl, err := collection.NewCollection(
+				&pb.Collection{Namespace: collection.UsageNamespace, Name: collection.UsageCollection},
+				usageStore,
+				&collection.LocalFileSystem{},
+			)
+			if err != nil {
+				return fmt.Errorf("create usage reports collection: %w", err)
+			}
+			usage, err := collection.NewUsageReporter(ctx, collectionRepo, usageColl)
+			if err != nil {
+				return err
+			}
+			usage.Endpoint = os.Getenv("COLLECTOR_USAGE_ENDPOINT")
+			serverOpts = append(serverOpts,
+				grpc.ChainUnaryInterceptor(usage.UnaryInterceptor()),
+				grpc.ChainStreamInterceptor(usage.StreamInterceptor()))
+			usage.Start(usageInterval)
+			defer usage.Stop()
+			log.Printf("✓ Anonymous usage reported every %s as installation %s", usageInterval, usage.InstallationID())
+		}
+	}
+
+	// Warm standby: with COLLECTOR_STANDBY_OF set to a primary's address,
+	// its collections and object storage backups are pulled every
+	// COLLECTOR_STANDBY_INTERVAL and writes are refused until Promote
+	var standby *collection.Standby
+	if primary := os.Getenv("COLLECTOR_STANDBY_OF"); primary != "" {
+		primaryConn, err := grpc.NewClient(primary, append(grpcConfig.DialOptions(), grpc.WithTransportCredentials(insecure.NewCredentials()))...)
+		if err != nil {
+			return fmt.Errorf("connect to primary %s: %w", primary, err)
+		}
+		defer primaryConn.Close()
+		standby = collection.NewStandby(collectionRepo, primary, primaryConn)
+		standby.SetClock(clock)
+		standby.SetMaxClockSkew(maxSkew)
+		serverOpts = append(serverOpts,
+			grpc.ChainUnaryInterceptor(standby.UnaryInterceptor()),
+			grpc.ChainStreamInterceptor(standby.StreamInterceptor()))
+	}
+
 	// ========================================================================
 	// 3. Create Single gRPC Server with ALL Services
 	// ========================================================================
 
 	// Create one gRPC server with validation for this namespace
-	grpcServer := registry.NewServerWithValidation(registryServer, namespace)
+	grpcServer := registry.NewServerWithValidation(registryServer, namespace, serverOpts...)
 
 	// Register ALL services on the same server
 
@@ -136,36 +603,266 @@ func run() error {
 
 	// 2. Collection Service
 	collectionServer := collection.NewCollectionServer(collectionRepo)
+	collectionServer.SetRecordSizeLimits(collection.RecordSizeLimits{MaxMessageSize: grpcConfig.MaxMessageSize})
+	collectionServer.SetChangeMonitor(changeMonitor)
+	collectionServer.SetDescriptorResolver(registryServer)
+	// Collections setting enforce_message_type refuse writes that are not
+	// their message type; COLLECTOR_ENFORCE_MESSAGE_TYPES=true makes every
+	// typed collection do so
+	if v := os.Getenv("COLLECTOR_ENFORCE_MESSAGE_TYPES"); v != "" {
+		enforce, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_ENFORCE_MESSAGE_TYPES must be true or false, got %q", v)
+		}
+		collectionServer.SetEnforceMessageTypes(enforce)
+	}
 	pb.RegisterCollectionServiceServer(grpcServer, collectionServer)
 	log.Println("✓ Registered CollectionService")
 
+	// Channels to other collectors, shared by dispatch, clone and fetch traffic
+	peerChannels := channelpool.New(channelpool.Options{
+		KeepaliveTime:    grpcConfig.KeepaliveTime,
+		KeepaliveTimeout: grpcConfig.KeepaliveTimeout,
+		DialOptions:      grpcConfig.DialOptions(),
+	})
+	defer peerChannels.Close()
+
 	// 4. CollectionRepo Service
-	repoGrpcServer := collection.NewGrpcServer(collectionRepo)
+	repoGrpcServer := collection.NewGrpcServerWithLayout(collectionRepo, layout)
+	// Collections served here are routed to COLLECTOR_ADVERTISE_ADDR, the
+	// address other collectors and clients reach this one at
+	advertiseAddr := os.Getenv("COLLECTOR_ADVERTISE_ADDR")
+	if advertiseAddr == "" {
+		advertiseAddr = fmt.Sprintf("localhost:%d", collectorPort)
+	}
+	repoGrpcServer.SetEndpoint(advertiseAddr)
+	repoGrpcServer.SetChannelPool(peerChannels)
+	if backups := repoGrpcServer.Backups(); backups != nil {
+		namespaceBinding.SetBackups(backups)
+	}
+	if approvalGate != nil {
+		repoGrpcServer.SetApprovalGate(approvalGate)
+	}
+	if legalHolds != nil {
+		repoGrpcServer.SetLegalHolds(legalHolds)
+	}
+	if changeLog != nil {
+		repoGrpcServer.SetChangeLog(changeLog)
+	}
+	repoGrpcServer.SetDiskWatchdog(diskWatchdog)
+	repoGrpcServer.SetTempFileSweeper(tempSweeper)
+	repoGrpcServer.SetPreflight(preflightOptions(layout, collectorPort))
+	// AnalyticsQuery runs on SQLite unless COLLECTOR_ANALYTICS_ENGINE=duckdb,
+	// which needs a build with -tags duckdb
+	switch engine := os.Getenv("COLLECTOR_ANALYTICS_ENGINE"); engine {
+	case "", "sqlite":
+	case "duckdb":
+		analytics, err := duckdb.Linked()
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_ANALYTICS_ENGINE: %w", err)
+		}
+		repoGrpcServer.SetAnalyticsEngine(analytics)
+	default:
+		return fmt.Errorf("COLLECTOR_ANALYTICS_ENGINE must be sqlite or duckdb, got %q", engine)
+	}
 	pb.RegisterCollectionRepoServer(grpcServer, repoGrpcServer)
 	log.Println("✓ Registered CollectionRepo")
 
+	if standby != nil {
+		standbyInterval := collection.DefaultStandbyInterval
+		if v := os.Getenv("COLLECTOR_STANDBY_INTERVAL"); v != "" {
+			if standbyInterval, err = time.ParseDuration(v); err != nil || standbyInterval <= 0 {
+				return fmt.Errorf("COLLECTOR_STANDBY_INTERVAL must be a positive duration, got %q", v)
+			}
+		}
+		standby.Endpoint = advertiseAddr
+		if backups := repoGrpcServer.Backups(); backups != nil {
+			standby.SetBackups(backups)
+		}
+		repoGrpcServer.SetStandby(standby)
+		standby.Start(standbyInterval)
+		defer standby.Stop()
+		log.Printf("✓ Standby of %s, syncing every %s until promoted", standby.Primary(), standbyInterval)
+	}
+
+	// 5. CollectionBackup Service, on the same backups
+	if backups := repoGrpcServer.Backups(); backups != nil {
+		pb.RegisterCollectionBackupServer(grpcServer, collection.NewBackupServer(backups))
+		log.Println("✓ Registered CollectionBackup")
+	}
+
+	// Automatic backups set with SetBackupSchedule, and retention: backups
+	// past COLLECTOR_BACKUP_MAX_COUNT, COLLECTOR_BACKUP_MAX_AGE or
+	// COLLECTOR_BACKUP_MAX_BYTES are pruned every
+	// COLLECTOR_BACKUP_PRUNE_INTERVAL, unless their schedule sets its own
+	if backups := repoGrpcServer.Backups(); backups != nil {
+		backups.SetClock(clock)
+		// Backups to s3:// and gcs:// paths; S3 credentials come from the
+		// AWS_* variables (and S3_ENDPOINT), GCS HMAC keys from GCS_*
+		backups.SetObjectStorage(collection.StorageTypeS3, func(bucket string) (collection.ObjectStorage, error) {
+			return s3.NewFileSystem(s3.ConfigFromEnv(bucket))
+		})
+		backups.SetObjectStorage(collection.StorageTypeGCS, func(bucket string) (collection.ObjectStorage, error) {
+			return s3.NewFileSystem(s3.GCSConfigFromEnv(bucket))
+		})
+		// COLLECTOR_BACKUP_KEY_FILE encrypts new backups with the file's last
+		// key, and decrypts backups taken with any of its keys
+		if path := os.Getenv("COLLECTOR_BACKUP_KEY_FILE"); path != "" {
+			keys, err := collection.LoadKeyFile(path)
+			if err != nil {
+				return fmt.Errorf("COLLECTOR_BACKUP_KEY_FILE: %w", err)
+			}
+			backups.SetKeyProvider(keys)
+			log.Println("✓ Backups encrypted at rest")
+		}
+		var retention collection.RetentionPolicy
+		if v := os.Getenv("COLLECTOR_BACKUP_MAX_COUNT"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("COLLECTOR_BACKUP_MAX_COUNT must be a positive number, got %q", v)
+			}
+			retention.MaxCount = n
+		}
+		if v := os.Getenv("COLLECTOR_BACKUP_MAX_BYTES"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("COLLECTOR_BACKUP_MAX_BYTES must be a positive number of bytes, got %q", v)
+			}
+			retention.MaxTotalBytes = n
+		}
+		pruneInterval := collection.DefaultPruneInterval
+		for env, field := range map[string]*time.Duration{
+			"COLLECTOR_BACKUP_MAX_AGE":        &retention.MaxAge,
+			"COLLECTOR_BACKUP_PRUNE_INTERVAL": &pruneInterval,
+		} {
+			if v := os.Getenv(env); v != "" {
+				d, err := time.ParseDuration(v)
+				if err != nil || d <= 0 {
+					return fmt.Errorf("%s must be a positive duration, got %q", env, v)
+				}
+				*field = d
+			}
+		}
+		backups.SetRetentionPolicy(retention)
+		backups.StartScheduler()
+		defer backups.StopScheduler()
+		backups.StartPruner(pruneInterval)
+		defer backups.StopPruner()
+		log.Printf("✓ Backup retention: %s, pruned every %s", retention, pruneInterval)
+	}
+
+	// Background jobs persist in system/jobs, on a store of their own so job
+	// updates never contend with collection writes
+	jobsPath := layout.Dir("jobs")
+	if err := os.MkdirAll(jobsPath, 0755); err != nil {
+		return fmt.Errorf("create jobs dir: %w", err)
+	}
+	jobsStore, err := sqlite.NewSqliteStore(filepath.Join(jobsPath, "jobs.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		return fmt.Errorf("init jobs store: %w", err)
+	}
+	defer jobsStore.Close()
+
+	jobsColl, err := collection.NewCollection(
+		&pb.Collection{Namespace: collection.JobsNamespace, Name: collection.JobsCollection},
+		jobsStore,
+		&collection.LocalFileSystem{},
+	)
+	if err != nil {
+		return fmt.Errorf("create jobs collection: %w", err)
+	}
+	if err := repoGrpcServer.UseJobStore(ctx, collection.NewJobStore(jobsColl), jobs.Options{}); err != nil {
+		return fmt.Errorf("start jobs: %w", err)
+	}
+	defer repoGrpcServer.StopJobs()
+	log.Println("✓ Background jobs resumed from system/jobs")
+
+	// COLLECTOR_VERIFY_CRON (e.g. "0 3 * * *", local time) submits a verify
+	// job for every collection on that schedule
+	if v := os.Getenv("COLLECTOR_VERIFY_CRON"); v != "" {
+		schedule, err := cron.Parse(v)
+		if err != nil {
+			return fmt.Errorf("COLLECTOR_VERIFY_CRON must be a cron expression, got %q: %w", v, err)
+		}
+		repoGrpcServer.StartVerification(schedule, time.Local)
+		defer repoGrpcServer.StopVerification()
+		log.Printf("✓ Collections verified on schedule %q", v)
+	}
+
+	// Restore rehearsals kept with a TTL are dropped once it passes, and all
+	// of them on shutdown
+	repoGrpcServer.StartRehearsalReaper(collection.DefaultRehearsalReapInterval)
+	defer repoGrpcServer.StopRehearsalReaper()
+
+	// Saved searches persist in system/saved_searches; their alerts follow
+	// the change feeds of the searched collections
+	searchesPath := layout.Dir("saved_searches")
+	if err := os.MkdirAll(searchesPath, 0755); err != nil {
+		return fmt.Errorf("create saved searches dir: %w", err)
+	}
+	searchesStore, err := sqlite.NewSqliteStore(filepath.Join(searchesPath, "saved_searches.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		return fmt.Errorf("init saved searches store: %w", err)
+	}
+	defer searchesStore.Close()
+	searchesColl, err := collection.NewCollection(
+		&pb.Collection{Namespace: collection.SavedSearchesNamespace, Name: collection.SavedSearchesCollection},
+		searchesStore,
+		&collection.LocalFileSystem{},
+	)
+	if err != nil {
+		return fmt.Errorf("create saved searches collection: %w", err)
+	}
+	savedSearches := collection.NewSavedSearchStore(searchesColl)
+	collectionServer.SetSavedSearches(savedSearches)
+	alertInterval := collection.DefaultAlertInterval
+	if v := os.Getenv("COLLECTOR_ALERT_INTERVAL"); v != "" {
+		if alertInterval, err = time.ParseDuration(v); err != nil || alertInterval <= 0 {
+			return fmt.Errorf("COLLECTOR_ALERT_INTERVAL must be a positive duration, got %q", v)
+		}
+	}
+	alerter := collection.NewSearchAlerter(collectionRepo, savedSearches)
+	alerter.Start(alertInterval)
+	defer alerter.Stop()
+	log.Printf("✓ Saved search alerts checked every %s", alertInterval)
+
+	// Transactional outbox: with COLLECTOR_OUTBOX_WEBHOOK set, messages
+	// written by WriteWithOutbox are POSTed to it every
+	// COLLECTOR_OUTBOX_INTERVAL and marked sent
+	if url := os.Getenv("COLLECTOR_OUTBOX_WEBHOOK"); url != "" {
+		outboxInterval := collection.DefaultOutboxInterval
+		if v := os.Getenv("COLLECTOR_OUTBOX_INTERVAL"); v != "" {
+			if outboxInterval, err = time.ParseDuration(v); err != nil || outboxInterval <= 0 {
+				return fmt.Errorf("COLLECTOR_OUTBOX_INTERVAL must be a positive duration, got %q", v)
+			}
+		}
+		relay := collection.NewOutboxRelay(collectionRepo, collection.NewWebhookPublisher(url))
+		relay.Start(outboxInterval)
+		defer relay.Stop()
+		log.Printf("✓ Outbox messages relayed to %s every %s", url, outboxInterval)
+	}
+
 	// ========================================================================
-	// 4. Start Server and Create Loopback Connection
+	// 4. Listen and Create Loopback Connection
 	// ========================================================================
 
+	// The server is only started once every service is registered (section
+	// 6); the loopback connection dials lazily, so it can be created now
 	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", collectorPort))
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
-
-	// Start server in background so we can connect to it
-	go grpcServer.Serve(lis)
-	time.Sleep(100 * time.Millisecond) // Let server start
+	defer lis.Close()
 
 	actualAddr := lis.Addr().String()
-	log.Printf("✓ Server started on %s", actualAddr)
+	log.Printf("✓ Listening on %s", actualAddr)
 
 	// ========================================================================
 	// 5. Setup Dispatcher with gRPC-based Registry Validation
 	// ========================================================================
 
 	// Create loopback gRPC connection to our own server for service-to-service communication
-	loopbackConn, err := grpc.NewClient(actualAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	loopbackConn, err := grpc.NewClient(actualAddr, append(grpcConfig.DialOptions(), grpc.WithTransportCredentials(insecure.NewCredentials()))...)
 	if err != nil {
 		return fmt.Errorf("failed to create loopback connection: %w", err)
 	}
@@ -186,11 +883,199 @@ func run() error {
 		validator,
 	)
 	log.Println("✓ Dispatcher created with gRPC-based registry validation")
+	dispatcher.SetClock(clock)
+	// Handshakes exchange HLCs with peers, and warn of peers whose clock is
+	// off by more than maxSkew
+	dispatcher.SetHybridClock(collectionRepo.HybridClock())
+	dispatcher.SetMaxClockSkew(maxSkew)
+	dispatcher.SetChannelPool(peerChannels)
+	dispatcher.SetResultCache(validator, dispatch.DefaultResultCacheSize)
+	// Deprecated methods are flagged in responses; past their sunset date they
+	// are refused only when COLLECTOR_DISPATCH_ENFORCE_SUNSET=true
+	dispatcher.SetDeprecations(validator, os.Getenv("COLLECTOR_DISPATCH_ENFORCE_SUNSET") == "true")
+	// Method ACLs name peer collectors by the principals they authenticate
+	// as: COLLECTOR_PEER_PRINCIPALS lists them, and COLLECTOR_PEER_TOKEN is
+	// the token this collector presents on its Serve calls to them
+	if peers := commaList(os.Getenv("COLLECTOR_PEER_PRINCIPALS")); len(peers) > 0 {
+		if principalAuth == nil {
+			return fmt.Errorf("COLLECTOR_PEER_PRINCIPALS requires COLLECTOR_PRINCIPAL_TOKENS_FILE: peers need authenticated principals")
+		}
+		dispatcher.AddCollectorPrincipals(peers...)
+	}
+	dispatcher.SetPeerToken(os.Getenv("COLLECTOR_PEER_TOKEN"))
+
+	// Collector inventory (system/collectors), kept current by the Connect handshake
+	if _, err := collectionRepo.CreateCollection(ctx, &pb.Collection{
+		Namespace: dispatch.InventoryNamespace,
+		Name:      dispatch.InventoryCollection,
+	}); err != nil {
+		return fmt.Errorf("create inventory collection: %w", err)
+	}
+	inventoryColl, err := collectionRepo.GetCollection(ctx, dispatch.InventoryNamespace, dispatch.InventoryCollection)
+	if err != nil {
+		return fmt.Errorf("get inventory collection: %w", err)
+	}
+	dispatcher.SetVersion(collectorVersion)
+	if err := dispatcher.SetInventory(ctx, dispatch.NewInventory(inventoryColl)); err != nil {
+		return fmt.Errorf("init collector inventory: %w", err)
+	}
+	log.Printf("✓ Collector inventory at %s/%s", dispatch.InventoryNamespace, dispatch.InventoryCollection)
+
+	// Dispatch payload limits, and logging of every dispatched method
+	var payloadLimits dispatch.PayloadLimits
+	for env, field := range map[string]*int{
+		"COLLECTOR_DISPATCH_MAX_INPUT_BYTES":  &payloadLimits.MaxInputBytes,
+		"COLLECTOR_DISPATCH_MAX_OUTPUT_BYTES": &payloadLimits.MaxOutputBytes,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("%s must be a positive number of bytes, got %q", env, v)
+			}
+			*field = n
+		}
+	}
+	dispatcher.SetPayloadLimits(payloadLimits)
+	if os.Getenv("COLLECTOR_DISPATCH_LOG_PAYLOADS") == "true" {
+		dispatcher.AddPayloadInspector(dispatch.LogPayloads())
+	}
+
+	// Per-method dispatch metrics and reclaimed temp files for Prometheus at
+	// COLLECTOR_METRICS_ADDR (e.g. :9090); TopMethods and ServerResources
+	// report them over gRPC regardless
+	if addr := os.Getenv("COLLECTOR_METRICS_ADDR"); addr != "" {
+		metricsLis, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("listen on COLLECTOR_METRICS_ADDR: %w", err)
+		}
+		metricsMux := http.NewServeMux()
+		dispatchMetrics, tempFileMetrics := dispatcher.MetricsHandler(), tempSweeper.MetricsHandler()
+		metricsMux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			dispatchMetrics.ServeHTTP(w, r)
+			tempFileMetrics.ServeHTTP(w, r)
+		}))
+		metricsServer := &http.Server{Handler: metricsMux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := metricsServer.Serve(metricsLis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("Warning: metrics server stopped: %v", err)
+			}
+		}()
+		defer metricsServer.Close()
+		log.Printf("✓ Serving metrics on %s/metrics", metricsLis.Addr())
+	}
+
+	// Scheduled dispatches (system/schedules) and their runs (system/dispatches)
+	schedulesPath := layout.Dir("dispatch")
+	if err := os.MkdirAll(schedulesPath, 0755); err != nil {
+		return fmt.Errorf("create schedules dir: %w", err)
+	}
+	var scheduleColls []*collection.Collection
+	for _, name := range []string{dispatch.SchedulesCollection, dispatch.DispatchesCollection} {
+		store, err := sqlite.NewSqliteStore(filepath.Join(schedulesPath, name+".db"), collection.Options{EnableJSON: true})
+		if err != nil {
+			return fmt.Errorf("init %s store: %w", name, err)
+		}
+		defer store.Close()
+
+		coll, err := collection.NewCollection(
+			&pb.Collection{Namespace: dispatch.SchedulesNamespace, Name: name},
+			store,
+			&collection.LocalFileSystem{},
+		)
+		if err != nil {
+			return fmt.Errorf("create %s collection: %w", name, err)
+		}
+		scheduleColls = append(scheduleColls, coll)
+	}
+	if err := dispatcher.SetScheduleStore(ctx, dispatch.NewScheduleStore(scheduleColls[0], scheduleColls[1])); err != nil {
+		return fmt.Errorf("init schedules: %w", err)
+	}
+	log.Printf("✓ Scheduled dispatches at %s/%s", dispatch.SchedulesNamespace, dispatch.SchedulesCollection)
+
+	// Optional external peer discovery, e.g. COLLECTOR_DISCOVERY=k8s:/collector:grpc
+	discoverySpec := os.Getenv("COLLECTOR_DISCOVERY")
+	if discoverySpec != "" {
+		resolver, err := dispatch.ParsePeerResolver(discoverySpec)
+		if err != nil {
+			return fmt.Errorf("configure peer discovery: %w", err)
+		}
+		dispatcher.AddPeerResolver(resolver)
+	}
+
+	dispatcher.SetNamespaceAliases(namespaceAliases)
+	renamers := []collection.NamespaceRenamer{collectionRepo, savedSearches, registryServer, dispatcher}
+	repoGrpcServer.SetNamespaceAliases(namespaceAliases, renamers...)
+	// Aliases from COLLECTOR_NAMESPACE_ALIASES are checked like those added
+	// with AliasNamespace, now that everything keyed by namespace is loaded
+	for _, a := range namespaceAliases.List() {
+		if err := collection.CheckNamespaceAlias(ctx, a.Alias, renamers...); err != nil {
+			return fmt.Errorf("COLLECTOR_NAMESPACE_ALIASES: %w", err)
+		}
+	}
 
 	// Register Dispatcher service
 	pb.RegisterCollectiveDispatcherServer(grpcServer, dispatcher)
 	log.Println("✓ Registered CollectiveDispatcher service")
 
+	// Workflows run their steps through the dispatcher; definitions, runs and
+	// step history each get a database in the workflows directory
+	workflowsPath := layout.Dir("workflows")
+	if err := os.MkdirAll(workflowsPath, 0755); err != nil {
+		return fmt.Errorf("create workflows dir: %w", err)
+	}
+	var workflowColls []*collection.Collection
+	for _, name := range []string{worker.DefinitionsCollection, worker.WorkflowsCollection, worker.ExecutionsCollection} {
+		store, err := sqlite.NewSqliteStore(filepath.Join(workflowsPath, name+".db"), collection.Options{EnableJSON: true})
+		if err != nil {
+			return fmt.Errorf("init %s store: %w", name, err)
+		}
+		defer store.Close()
+
+		coll, err := collection.NewCollection(
+			&pb.Collection{Namespace: worker.Namespace, Name: name},
+			store,
+			&collection.LocalFileSystem{},
+		)
+		if err != nil {
+			return fmt.Errorf("create %s collection: %w", name, err)
+		}
+		workflowColls = append(workflowColls, coll)
+	}
+	workflowEngine := worker.NewEngine(worker.NewCollectionStore(workflowColls[0], workflowColls[1], workflowColls[2]), dispatcher)
+	pb.RegisterCollectiveWorkerServer(grpcServer, workflowEngine)
+	log.Println("✓ Registered CollectiveWorker service")
+
+	// ========================================================================
+	// 6. Serve
+	// ========================================================================
+
+	// Serve until shutdown; if the server fails, the group's context is
+	// cancelled, which also triggers shutdown below
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		if err := grpcServer.Serve(lis); err != nil {
+			return fmt.Errorf("server error: %w", err)
+		}
+		return nil
+	})
+	defer grpcServer.Stop()
+	if err := waitForReady(gctx, loopbackConn); err != nil {
+		return err
+	}
+	log.Printf("✓ Server ready on %s", actualAddr)
+
+	// Background work that dispatches through the loopback connection
+	// starts once the server is ready
+	dispatcher.StartScheduler()
+	if discoverySpec != "" {
+		dispatcher.StartDiscovery(30 * time.Second)
+		log.Printf("✓ Peer discovery enabled (%s)", discoverySpec)
+	}
+	if err := workflowEngine.Start(ctx); err != nil {
+		return fmt.Errorf("resume workflows: %w", err)
+	}
+	defer workflowEngine.Stop()
+
 	log.Println("\n========================================")
 	log.Printf("Collector %s running on localhost:%d", collectorID, collectorPort)
 	log.Println("All services available:")
@@ -198,33 +1083,49 @@ func run() error {
 	log.Println("  - CollectionService")
 	log.Println("  - CollectiveDispatcher")
 	log.Println("  - CollectionRepo")
+	log.Println("  - CollectionBackup")
+	log.Println("  - CollectiveWorker")
 	log.Printf("Namespace: %s", namespace)
 	log.Println("Registry validation: ENABLED")
 	log.Println("========================================")
 	log.Println("Press Ctrl+C to shutdown")
 
-	// Handle shutdown in background
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-		<-sigChan
+	// Shut down on a signal, or when the server fails
+	sigCtx, stop := signal.NotifyContext(gctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	g.Go(func() error {
+		<-sigCtx.Done()
 
 		log.Println("\nShutting down...")
 		grpcServer.GracefulStop()
 		dispatcher.Shutdown()
 		log.Println("Shutdown complete")
-	}()
+		return nil
+	})
 
-	// Serve (blocks until shutdown)
-	if err := grpcServer.Serve(lis); err != nil {
-		return fmt.Errorf("server error: %w", err)
-	}
+	// Blocks until shutdown
+	return g.Wait()
+}
 
-	wg.Wait()
-	return nil
+// readyTimeout bounds how long startup waits for the server to accept
+// connections.
+const readyTimeout = 10 * time.Second
+
+// waitForReady blocks until conn has connected to the server, so services
+// that call it during startup don't race the listener.
+func waitForReady(ctx context.Context, conn *grpc.ClientConn) error {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			return nil
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("server not ready: %w", ctx.Err())
+		}
+	}
 }
 
 // grpcRegistryClientValidator wraps a gRPC Registry client to implement ServiceMethodValidator
@@ -262,3 +1163,56 @@ func (v *grpcRegistryClientValidator) ValidateServiceMethod(ctx context.Context,
 	// If registration succeeded, the service wasn't registered before
 	return fmt.Errorf("service %s.%s was not registered in namespace %s", serviceName, methodName, namespace)
 }
+
+// CachePolicy reads a method's cache policy through the Registry's
+// ValidateMethod RPC.
+func (v *grpcRegistryClientValidator) CachePolicy(ctx context.Context, namespace, serviceName, methodName string) (time.Duration, error) {
+	resp, err := v.client.ValidateMethod(ctx, &pb.ValidateMethodRequest{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		MethodName:  methodName,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read cache policy for %s.%s: %w", serviceName, methodName, err)
+	}
+	return time.Duration(resp.CachePolicy.GetTtlMs()) * time.Millisecond, nil
+}
+
+// Deprecation reads a method's deprecation through the Registry's
+// ValidateMethod RPC.
+func (v *grpcRegistryClientValidator) Deprecation(ctx context.Context, namespace, serviceName, methodName string) (*pb.Deprecation, error) {
+	resp, err := v.client.ValidateMethod(ctx, &pb.ValidateMethodRequest{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		MethodName:  methodName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deprecation for %s.%s: %w", serviceName, methodName, err)
+	}
+	return resp.Deprecation, nil
+}
+
+// MethodACL reads a method's allowed callers through the Registry's
+// ValidateMethod RPC.
+func (v *grpcRegistryClientValidator) MethodACL(ctx context.Context, namespace, serviceName, methodName string) (*pb.MethodACL, error) {
+	resp, err := v.client.ValidateMethod(ctx, &pb.ValidateMethodRequest{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		MethodName:  methodName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read acl for %s.%s: %w", serviceName, methodName, err)
+	}
+	return resp.Acl, nil
+}
+
+// commaList splits a comma-separated setting, dropping empty entries.
+func commaList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/cron"
+	"github.com/accretional/collector/pkg/dispatch"
+	"github.com/accretional/collector/pkg/grpcconfig"
+)
+
+// Settings validated by checkConfig, as run parses them.
+var (
+	boolSettings = []string{
+		"COLLECTOR_DEDUPLICATE", "COLLECTOR_SIMILARITY", "COLLECTOR_BLOCK_MASS_DELETES",
+		"COLLECTOR_VERIFY_CHECKSUMS", "COLLECTOR_USAGE_REPORTS",
+	}
+	durationSettings = []string{
+		"COLLECTOR_TEMP_FILE_MAX_AGE", "COLLECTOR_TEMP_FILE_SWEEP_INTERVAL", "COLLECTOR_USAGE_INTERVAL",
+		"COLLECTOR_STANDBY_INTERVAL", "COLLECTOR_BACKUP_MAX_AGE", "COLLECTOR_BACKUP_PRUNE_INTERVAL",
+		"COLLECTOR_ALERT_INTERVAL", "COLLECTOR_OUTBOX_INTERVAL",
+	}
+	sizeSettings = []string{
+		"COLLECTOR_COMPRESSION_MIN_SIZE", "COLLECTOR_DISK_MIN_FREE_BYTES", "COLLECTOR_DISK_LOW_FREE_BYTES",
+		"COLLECTOR_BACKUP_MAX_COUNT", "COLLECTOR_BACKUP_MAX_BYTES",
+		"COLLECTOR_DISPATCH_MAX_INPUT_BYTES", "COLLECTOR_DISPATCH_MAX_OUTPUT_BYTES",
+	}
+)
+
+// checkConfig validates the COLLECTOR_* settings, returning every problem
+// rather than the first run would stop at.
+func checkConfig() error {
+	var errs []error
+	if _, err := grpcconfig.FromEnv(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid gRPC configuration: %w", err))
+	}
+	for _, env := range boolSettings {
+		if v := os.Getenv(env); v != "" {
+			if _, err := strconv.ParseBool(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s must be true or false, got %q", env, v))
+			}
+		}
+	}
+	for _, env := range durationSettings {
+		if v := os.Getenv(env); v != "" {
+			if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+				errs = append(errs, fmt.Errorf("%s must be a positive duration, got %q", env, v))
+			}
+		}
+	}
+	for _, env := range sizeSettings {
+		if v := os.Getenv(env); v != "" {
+			if n, err := strconv.ParseInt(v, 10, 64); err != nil || n <= 0 {
+				errs = append(errs, fmt.Errorf("%s must be a positive number, got %q", env, v))
+			}
+		}
+	}
+	if v := os.Getenv("COLLECTOR_CLOCK_OFFSET"); v != "" {
+		if _, err := time.ParseDuration(v); err != nil {
+			errs = append(errs, fmt.Errorf("COLLECTOR_CLOCK_OFFSET must be a duration, got %q", v))
+		}
+	}
+	if fields := os.Getenv("COLLECTOR_GEO_FIELDS"); fields != "" && !strings.Contains(fields, ",") {
+		errs = append(errs, fmt.Errorf("COLLECTOR_GEO_FIELDS must be <lat field>,<lon field>, got %q", fields))
+	}
+	aliases := collection.NewNamespaceAliases()
+	for _, pair := range commaList(os.Getenv("COLLECTOR_NAMESPACE_ALIASES")) {
+		alias, target, ok := strings.Cut(pair, "=")
+		if !ok {
+			errs = append(errs, fmt.Errorf("COLLECTOR_NAMESPACE_ALIASES entries must be alias=namespace, got %q", pair))
+		} else if err := aliases.Add(alias, target); err != nil {
+			errs = append(errs, fmt.Errorf("COLLECTOR_NAMESPACE_ALIASES: %w", err))
+		}
+	}
+	if os.Getenv("COLLECTOR_DEBUG_ADDR") != "" && os.Getenv("COLLECTOR_ADMIN_TOKEN") == "" {
+		errs = append(errs, errors.New("COLLECTOR_DEBUG_ADDR requires COLLECTOR_ADMIN_TOKEN"))
+	}
+	if path := os.Getenv("COLLECTOR_BACKUP_KEY_FILE"); path != "" {
+		if _, err := collection.LoadKeyFile(path); err != nil {
+			errs = append(errs, fmt.Errorf("COLLECTOR_BACKUP_KEY_FILE: %w", err))
+		}
+	}
+	if v := os.Getenv("COLLECTOR_VERIFY_CRON"); v != "" {
+		if _, err := cron.Parse(v); err != nil {
+			errs = append(errs, fmt.Errorf("COLLECTOR_VERIFY_CRON must be a cron expression, got %q: %w", v, err))
+		}
+	}
+	if spec := os.Getenv("COLLECTOR_DISCOVERY"); spec != "" {
+		if _, err := dispatch.ParsePeerResolver(spec); err != nil {
+			errs = append(errs, fmt.Errorf("configure peer discovery: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// preflightOptions returns what the server checks before serving: its
+// configuration, data directory, listen addresses and standby primary.
+func preflightOptions(layout collection.PathLayout, collectorPort int) collection.PreflightOptions {
+	opts := collection.PreflightOptions{
+		Config: checkConfig,
+		Dirs:   []string{layout.Root},
+		Listen: []string{fmt.Sprintf("localhost:%d", collectorPort)},
+	}
+	for _, env := range []string{"COLLECTOR_METRICS_ADDR", "COLLECTOR_DEBUG_ADDR"} {
+		if addr := os.Getenv(env); addr != "" {
+			opts.Listen = append(opts.Listen, addr)
+		}
+	}
+	if primary := os.Getenv("COLLECTOR_STANDBY_OF"); primary != "" {
+		opts.Peers = append(opts.Peers, primary)
+	}
+	if v := os.Getenv("COLLECTOR_CLOCK_OFFSET"); v != "" {
+		if offset, err := time.ParseDuration(v); err == nil {
+			opts.Clock = collection.SkewedClock{Base: collection.SystemClock{}, Offset: offset}
+		}
+	}
+	return opts
+}
+
+// preflight runs `server preflight`, checking the host and configuration
+// without serving, and returns the exit code: 1 when a check failed.
+func preflight(args []string) int {
+	flags := flag.NewFlagSet("preflight", flag.ExitOnError)
+	certFile := flags.String("tls-cert", "", "PEM certificate to check, e.g. the one a TLS-terminating proxy serves")
+	keyFile := flags.String("tls-key", "", "PEM private key of -tls-cert")
+	timeout := flags.Duration("peer-timeout", collection.DefaultPreflightPeerTimeout, "how long each peer has to answer")
+	var peers []string
+	flags.Func("peer", "address of a collector that must be reachable (repeatable)", func(v string) error {
+		peers = append(peers, v)
+		return nil
+	})
+	flags.Parse(args)
+
+	opts := preflightOptions(collection.NewPathLayout(os.Getenv("COLLECTOR_DATA_DIR")), defaultCollectorPort)
+	opts.TLSCertFile, opts.TLSKeyFile = *certFile, *keyFile
+	opts.Peers = append(opts.Peers, peers...)
+	opts.PeerTimeout = *timeout
+
+	results := collection.RunPreflight(context.Background(), opts)
+	for _, r := range results {
+		outcome := strings.TrimPrefix(r.Outcome.String(), "PREFLIGHT_")
+		fmt.Printf("%-5s %-12s %s\n", outcome, r.Check, r.Detail)
+	}
+	if !collection.PreflightPassed(results) {
+		fmt.Println("preflight failed")
+		return 1
+	}
+	fmt.Println("preflight passed")
+	return 0
+}
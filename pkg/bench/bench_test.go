@@ -0,0 +1,258 @@
+package bench_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"github.com/accretional/collector/pkg/dispatch"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// seed keeps generated datasets identical across runs so results are comparable.
+const seed = 42
+
+var words = []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel"}
+
+// newCollection creates a file-backed collection pre-populated with n deterministic records.
+func newCollection(b *testing.B, n int) *collection.Collection {
+	b.Helper()
+	dir := b.TempDir()
+
+	store, err := sqlite.NewSqliteStore(filepath.Join(dir, "bench.db"), collection.Options{
+		EnableFTS:  true,
+		EnableJSON: true,
+	})
+	if err != nil {
+		b.Fatalf("failed to create store: %v", err)
+	}
+
+	fs, err := collection.NewLocalFileSystem(filepath.Join(dir, "files"))
+	if err != nil {
+		b.Fatalf("failed to create filesystem: %v", err)
+	}
+
+	coll, err := collection.NewCollection(&pb.Collection{Namespace: "bench", Name: "records"}, store, fs)
+	if err != nil {
+		b.Fatalf("failed to create collection: %v", err)
+	}
+	b.Cleanup(func() { coll.Close() })
+
+	rng := rand.New(rand.NewSource(seed))
+	records := make([]*pb.CollectionRecord, n)
+	for i := range records {
+		records[i] = newRecord(fmt.Sprintf("seed-%d", i), rng)
+	}
+	if err := store.CreateRecords(context.Background(), records); err != nil {
+		b.Fatalf("failed to seed records: %v", err)
+	}
+
+	return coll
+}
+
+func newRecord(id string, rng *rand.Rand) *pb.CollectionRecord {
+	now := timestamppb.Now()
+	data := fmt.Sprintf(`{"title": "%s %s", "category": "%s", "score": %d}`,
+		words[rng.Intn(len(words))], words[rng.Intn(len(words))], words[rng.Intn(4)], rng.Intn(1000))
+	return &pb.CollectionRecord{
+		Id:        id,
+		ProtoData: []byte(data),
+		Metadata:  &pb.Metadata{CreatedAt: now, UpdatedAt: now},
+	}
+}
+
+func BenchmarkCRUD(b *testing.B) {
+	ctx := context.Background()
+
+	b.Run("Create", func(b *testing.B) {
+		coll := newCollection(b, 0)
+		rng := rand.New(rand.NewSource(seed))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := coll.CreateRecord(ctx, newRecord(fmt.Sprintf("r-%d", i), rng)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Get", func(b *testing.B) {
+		coll := newCollection(b, 1000)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := coll.GetRecord(ctx, fmt.Sprintf("seed-%d", i%1000)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Update", func(b *testing.B) {
+		coll := newCollection(b, 1000)
+		rng := rand.New(rand.NewSource(seed))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := coll.UpdateRecord(ctx, newRecord(fmt.Sprintf("seed-%d", i%1000), rng)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Delete", func(b *testing.B) {
+		coll := newCollection(b, b.N)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := coll.DeleteRecord(ctx, fmt.Sprintf("seed-%d", i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("List", func(b *testing.B) {
+		coll := newCollection(b, 1000)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := coll.ListRecords(ctx, (i*50)%1000, 50); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSearch(b *testing.B) {
+	ctx := context.Background()
+	coll := newCollection(b, 5000)
+
+	b.Run("FullText", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := coll.Search(ctx, &collection.SearchQuery{FullText: words[i%len(words)], Limit: 20}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("JSONFilter", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := coll.Search(ctx, &collection.SearchQuery{
+				Filters: map[string]collection.Filter{
+					"category": {Operator: collection.OpEquals, Value: words[i%4]},
+					"score":    {Operator: collection.OpGreaterThan, Value: 500},
+				},
+				Limit: 20,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkBackup(b *testing.B) {
+	ctx := context.Background()
+	coll := newCollection(b, 5000)
+	dir := b.TempDir()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := coll.Store.Backup(ctx, filepath.Join(dir, fmt.Sprintf("backup-%d.db", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCloneStream measures the Pack -> Unpack path used to stream a collection to a peer.
+func BenchmarkCloneStream(b *testing.B) {
+	ctx := context.Background()
+	coll := newCollection(b, 5000)
+	transport := &collection.SqliteTransport{}
+	dir := b.TempDir()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader, size, err := transport.Pack(ctx, coll, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(size)
+		if err := transport.Unpack(ctx, reader, filepath.Join(dir, fmt.Sprintf("clone-%d.db", i))); err != nil {
+			b.Fatal(err)
+		}
+		reader.Close()
+	}
+}
+
+func echoHandler(ctx context.Context, input interface{}) (interface{}, error) {
+	return input, nil
+}
+
+// startDispatcher runs a dispatcher on a loopback TCP port.
+func startDispatcher(b *testing.B, id string, namespaces []string) (*dispatch.Dispatcher, string) {
+	b.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("failed to listen: %v", err)
+	}
+
+	d := dispatch.NewDispatcher(id, lis.Addr().String(), namespaces)
+	server := grpc.NewServer()
+	pb.RegisterCollectiveDispatcherServer(server, d)
+	go server.Serve(lis)
+
+	b.Cleanup(func() {
+		d.Shutdown()
+		server.Stop()
+	})
+	return d, lis.Addr().String()
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	ctx := context.Background()
+	input, _ := anypb.New(&pb.Status{Message: "ping"})
+	req := &pb.DispatchRequest{
+		Namespace:  "bench",
+		Service:    &pb.ServiceTypeRef{ServiceName: "Echo"},
+		MethodName: "Ping",
+		Input:      input,
+	}
+
+	b.Run("Local", func(b *testing.B) {
+		d, _ := startDispatcher(b, "local", []string{"bench"})
+		d.RegisterService("bench", "Echo", "Ping", echoHandler)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			resp, err := d.Dispatch(ctx, req)
+			if err != nil || resp.Status.Code != 200 {
+				b.Fatalf("dispatch failed: %v %v", err, resp.GetStatus())
+			}
+		}
+	})
+
+	b.Run("TwoNode", func(b *testing.B) {
+		caller, _ := startDispatcher(b, "caller", []string{"bench"})
+		executor, peerAddr := startDispatcher(b, "executor", []string{"bench"})
+		executor.RegisterService("bench", "Echo", "Ping", echoHandler)
+
+		if _, err := caller.ConnectTo(ctx, peerAddr, []string{"bench"}); err != nil {
+			b.Fatalf("failed to connect: %v", err)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			resp, err := caller.Dispatch(ctx, req)
+			if err != nil || resp.Status.Code != 200 {
+				b.Fatalf("dispatch failed: %v %v", err, resp.GetStatus())
+			}
+			if resp.HandledByCollectorId != "executor" {
+				b.Fatalf("expected remote execution, got %q", resp.HandledByCollectorId)
+			}
+		}
+	})
+}
@@ -0,0 +1,129 @@
+// Package bench contains the reproducible benchmark suite for the store, transport
+// and dispatcher, along with tooling to compare benchmark runs against a stored
+// baseline so regressions fail the build.
+//
+// Run the suite and gate on regressions with:
+//
+//	make bench
+//
+// After an intentional performance change, refresh the baseline with:
+//
+//	make bench-baseline
+package bench
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Result is a single benchmark measurement.
+type Result struct {
+	NsPerOp     float64 `json:"ns_per_op"`
+	BytesPerOp  int64   `json:"bytes_per_op,omitempty"`
+	AllocsPerOp int64   `json:"allocs_per_op,omitempty"`
+}
+
+// Baseline maps benchmark names (without the -GOMAXPROCS suffix) to their reference results.
+type Baseline map[string]Result
+
+// Regression describes a benchmark that got slower than the allowed tolerance.
+type Regression struct {
+	Name     string
+	Baseline float64
+	Current  float64
+	Ratio    float64
+}
+
+func (r Regression) String() string {
+	return fmt.Sprintf("%s: %.0f ns/op -> %.0f ns/op (%+.1f%%)", r.Name, r.Baseline, r.Current, (r.Ratio-1)*100)
+}
+
+var benchLine = regexp.MustCompile(`^(Benchmark\S+?)(?:-\d+)?\s+\d+\s+([\d.]+) ns/op(.*)$`)
+
+// ParseResults reads `go test -bench` output. When a benchmark appears more than
+// once (e.g. with -count), the fastest run is kept to reduce noise.
+func ParseResults(r io.Reader) (Baseline, error) {
+	results := make(Baseline)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m := benchLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if m == nil {
+			continue
+		}
+		ns, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ns/op for %s: %w", m[1], err)
+		}
+
+		res := Result{NsPerOp: ns}
+		fields := strings.Fields(m[3])
+		for i := 1; i < len(fields); i++ {
+			switch fields[i] {
+			case "B/op":
+				res.BytesPerOp, _ = strconv.ParseInt(fields[i-1], 10, 64)
+			case "allocs/op":
+				res.AllocsPerOp, _ = strconv.ParseInt(fields[i-1], 10, 64)
+			}
+		}
+
+		if prev, ok := results[m[1]]; !ok || res.NsPerOp < prev.NsPerOp {
+			results[m[1]] = res
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read benchmark output: %w", err)
+	}
+	return results, nil
+}
+
+// LoadBaseline reads a baseline file written by SaveBaseline.
+func LoadBaseline(path string) (Baseline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline: %w", err)
+	}
+	var baseline Baseline
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, fmt.Errorf("failed to parse baseline: %w", err)
+	}
+	return baseline, nil
+}
+
+// SaveBaseline writes results as an indented JSON baseline file.
+func SaveBaseline(path string, baseline Baseline) error {
+	data, err := json.MarshalIndent(baseline, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode baseline: %w", err)
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Compare returns the benchmarks in current whose ns/op exceeds the baseline by more
+// than tolerance (0.2 allows a 20% slowdown). Benchmarks missing from either side are ignored.
+func Compare(baseline, current Baseline, tolerance float64) []Regression {
+	var regressions []Regression
+	for name, cur := range current {
+		base, ok := baseline[name]
+		if !ok || base.NsPerOp <= 0 {
+			continue
+		}
+		ratio := cur.NsPerOp / base.NsPerOp
+		if ratio > 1+tolerance {
+			regressions = append(regressions, Regression{
+				Name:     name,
+				Baseline: base.NsPerOp,
+				Current:  cur.NsPerOp,
+				Ratio:    ratio,
+			})
+		}
+	}
+	sort.Slice(regressions, func(i, j int) bool { return regressions[i].Name < regressions[j].Name })
+	return regressions
+}
@@ -0,0 +1,79 @@
+package bench_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/accretional/collector/pkg/bench"
+)
+
+const sampleOutput = `goos: linux
+goarch: amd64
+pkg: github.com/accretional/collector/pkg/bench
+BenchmarkCRUD/Create-8         	    1000	    950000 ns/op	    2048 B/op	      40 allocs/op
+BenchmarkCRUD/Get-8            	   20000	     46000 ns/op
+BenchmarkCRUD/Get-8            	   20000	     44000 ns/op
+BenchmarkCloneStream-8         	     100	  13875354 ns/op	 104.21 MB/s
+PASS
+ok  	github.com/accretional/collector/pkg/bench	11.137s
+`
+
+func TestParseResults(t *testing.T) {
+	results, err := bench.ParseResults(strings.NewReader(sampleOutput))
+	if err != nil {
+		t.Fatalf("ParseResults failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 benchmarks, got %d: %v", len(results), results)
+	}
+
+	create := results["BenchmarkCRUD/Create"]
+	if create.NsPerOp != 950000 || create.BytesPerOp != 2048 || create.AllocsPerOp != 40 {
+		t.Errorf("unexpected Create result: %+v", create)
+	}
+	// Repeated runs keep the fastest measurement
+	if get := results["BenchmarkCRUD/Get"]; get.NsPerOp != 44000 {
+		t.Errorf("expected fastest Get run, got %v", get.NsPerOp)
+	}
+	if _, ok := results["BenchmarkCloneStream"]; !ok {
+		t.Error("expected benchmark with MB/s to be parsed")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	baseline := bench.Baseline{
+		"BenchmarkA": {NsPerOp: 100},
+		"BenchmarkB": {NsPerOp: 100},
+		"BenchmarkC": {NsPerOp: 100},
+	}
+	current := bench.Baseline{
+		"BenchmarkA": {NsPerOp: 110}, // within tolerance
+		"BenchmarkB": {NsPerOp: 150}, // regression
+		"BenchmarkD": {NsPerOp: 999}, // new benchmark, no baseline
+	}
+
+	regressions := bench.Compare(baseline, current, 0.2)
+	if len(regressions) != 1 || regressions[0].Name != "BenchmarkB" {
+		t.Fatalf("expected only BenchmarkB to regress, got %v", regressions)
+	}
+	if regressions[0].Ratio != 1.5 {
+		t.Errorf("expected ratio 1.5, got %v", regressions[0].Ratio)
+	}
+}
+
+func TestBaselineRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	want := bench.Baseline{"BenchmarkA": {NsPerOp: 123.5, AllocsPerOp: 7}}
+
+	if err := bench.SaveBaseline(path, want); err != nil {
+		t.Fatalf("SaveBaseline failed: %v", err)
+	}
+	got, err := bench.LoadBaseline(path)
+	if err != nil {
+		t.Fatalf("LoadBaseline failed: %v", err)
+	}
+	if got["BenchmarkA"] != want["BenchmarkA"] {
+		t.Errorf("round trip mismatch: got %+v", got)
+	}
+}
@@ -0,0 +1,293 @@
+// Package channelpool shares gRPC client channels to peer collectors.
+// Dispatch, clone and fetch traffic to the same address is multiplexed over
+// a small set of pooled channels instead of dialing per call, channels carry
+// keepalive settings, and channels left idle are closed by a reaper and
+// redialed transparently on the next call.
+package channelpool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	// DefaultChannelsPerPeer is the number of channels opened to a peer. One
+	// HTTP/2 channel multiplexes any number of concurrent calls.
+	DefaultChannelsPerPeer = 1
+	// DefaultIdleTimeout is how long a channel may go without calls before it
+	// is closed.
+	DefaultIdleTimeout = 10 * time.Minute
+	// DefaultKeepaliveTime is the interval between keepalive pings on a channel
+	// with calls in flight. It matches the minimum ping interval gRPC servers
+	// enforce by default.
+	DefaultKeepaliveTime = 5 * time.Minute
+	// DefaultKeepaliveTimeout is how long a ping may go unanswered before the
+	// channel is considered broken.
+	DefaultKeepaliveTimeout = 20 * time.Second
+)
+
+// ErrClosed is returned for calls made through a closed Pool.
+var ErrClosed = errors.New("channel pool closed")
+
+// Options configures a Pool. Zero fields take their defaults.
+type Options struct {
+	// ChannelsPerPeer caps the channels opened to one address. A new channel
+	// is only opened while every existing one has calls in flight.
+	ChannelsPerPeer int
+	// IdleTimeout closes channels that have had no calls for this long.
+	IdleTimeout time.Duration
+	// KeepaliveTime and KeepaliveTimeout tune client keepalive pings.
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// DialOptions are added to every channel after the pool's own transport
+	// and keepalive options, so they take precedence.
+	DialOptions []grpc.DialOption
+}
+
+func (o Options) withDefaults() Options {
+	if o.ChannelsPerPeer <= 0 {
+		o.ChannelsPerPeer = DefaultChannelsPerPeer
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = DefaultIdleTimeout
+	}
+	if o.KeepaliveTime <= 0 {
+		o.KeepaliveTime = DefaultKeepaliveTime
+	}
+	if o.KeepaliveTimeout <= 0 {
+		o.KeepaliveTimeout = DefaultKeepaliveTimeout
+	}
+	return o
+}
+
+// Pool holds gRPC channels to peers, keyed by address. It is safe for
+// concurrent use.
+type Pool struct {
+	opts   Options
+	peers  map[string][]*pooledConn
+	closed bool
+	mu     sync.Mutex
+
+	reaping sync.Once
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type pooledConn struct {
+	conn     *grpc.ClientConn
+	active   int // Calls and streams in flight
+	lastUsed time.Time
+}
+
+// PeerStats describes the pooled channels to one address.
+type PeerStats struct {
+	Address     string
+	Channels    int
+	ActiveCalls int
+}
+
+// New creates an empty Pool. Channels are dialed on first use.
+func New(opts Options) *Pool {
+	return &Pool{
+		opts:  opts.withDefaults(),
+		peers: make(map[string][]*pooledConn),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Channel returns a connection to address backed by the pool. It can be
+// passed to any generated client constructor and kept indefinitely: every
+// call borrows a pooled channel, dialing or redialing it as needed.
+func (p *Pool) Channel(address string) grpc.ClientConnInterface {
+	return &channel{pool: p, address: address}
+}
+
+// Stats reports the open channels per address.
+func (p *Pool) Stats() []PeerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]PeerStats, 0, len(p.peers))
+	for address, conns := range p.peers {
+		s := PeerStats{Address: address, Channels: len(conns)}
+		for _, pc := range conns {
+			s.ActiveCalls += pc.active
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// Close closes every channel and stops the reaper. Calls made afterwards
+// fail with ErrClosed.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	for address, conns := range p.peers {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+		delete(p.peers, address)
+	}
+	p.mu.Unlock()
+
+	close(p.stop)
+	p.reaping.Do(func() { close(p.done) }) // The reaper never started
+	<-p.done
+}
+
+// acquire borrows the least busy channel to address, dialing a new one while
+// all existing channels are busy and the peer is below ChannelsPerPeer.
+func (p *Pool) acquire(address string) (*pooledConn, error) {
+	p.reaping.Do(func() { go p.reap() })
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrClosed
+	}
+
+	var best *pooledConn
+	for _, pc := range p.peers[address] {
+		if best == nil || pc.active < best.active {
+			best = pc
+		}
+	}
+	if best == nil || (best.active > 0 && len(p.peers[address]) < p.opts.ChannelsPerPeer) {
+		conn, err := p.dial(address)
+		if err != nil {
+			return nil, err
+		}
+		best = &pooledConn{conn: conn}
+		p.peers[address] = append(p.peers[address], best)
+	}
+	best.active++
+	best.lastUsed = time.Now()
+	return best, nil
+}
+
+// release returns a channel borrowed with acquire.
+func (p *Pool) release(pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.active--
+	pc.lastUsed = time.Now()
+}
+
+func (p *Pool) dial(address string) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    p.opts.KeepaliveTime,
+			Timeout: p.opts.KeepaliveTimeout,
+		}),
+	}
+	return grpc.NewClient(address, append(opts, p.opts.DialOptions...)...)
+}
+
+// reap closes idle channels until the pool is closed.
+func (p *Pool) reap() {
+	defer close(p.done)
+
+	interval := p.opts.IdleTimeout / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.reapIdle()
+		}
+	}
+}
+
+func (p *Pool) reapIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for address, conns := range p.peers {
+		kept := conns[:0]
+		for _, pc := range conns {
+			if pc.active == 0 && time.Since(pc.lastUsed) >= p.opts.IdleTimeout {
+				pc.conn.Close()
+				continue
+			}
+			kept = append(kept, pc)
+		}
+		if len(kept) == 0 {
+			delete(p.peers, address)
+		} else {
+			p.peers[address] = kept
+		}
+	}
+}
+
+// channel is a grpc.ClientConnInterface that borrows a pooled channel for
+// each call.
+type channel struct {
+	pool    *Pool
+	address string
+}
+
+func (c *channel) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	pc, err := c.pool.acquire(c.address)
+	if err != nil {
+		return err
+	}
+	defer c.pool.release(pc)
+	return pc.conn.Invoke(ctx, method, args, reply, opts...)
+}
+
+func (c *channel) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	pc, err := c.pool.acquire(c.address)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := pc.conn.NewStream(ctx, desc, method, opts...)
+	if err != nil {
+		c.pool.release(pc)
+		return nil, err
+	}
+	s := &trackedStream{ClientStream: stream, serverStreams: desc.ServerStreams}
+	s.finish = func() { s.once.Do(func() { c.pool.release(pc) }) }
+	s.stopWatch = context.AfterFunc(ctx, s.finish)
+	return s, nil
+}
+
+// trackedStream holds its channel until the stream ends, so the reaper never
+// closes a channel under a running stream.
+type trackedStream struct {
+	grpc.ClientStream
+	serverStreams bool
+	once          sync.Once
+	finish        func()
+	stopWatch     func() bool
+}
+
+func (s *trackedStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	// A stream ends with its first error, or with its only response when the
+	// server does not stream
+	if err != nil || !s.serverStreams {
+		s.stopWatch()
+		s.finish()
+	}
+	return err
+}
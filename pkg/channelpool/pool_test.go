@@ -0,0 +1,147 @@
+package channelpool_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/accretional/collector/pkg/channelpool"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// startPeer serves the gRPC health service, which has a unary and a
+// server-streaming method.
+func startPeer(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+// channels returns the number of pooled channels to address.
+func channels(pool *channelpool.Pool, address string) int {
+	for _, s := range pool.Stats() {
+		if s.Address == address {
+			return s.Channels
+		}
+	}
+	return 0
+}
+
+func TestPool_MultiplexesCallsOverOneChannel(t *testing.T) {
+	address := startPeer(t)
+	pool := channelpool.New(channelpool.Options{})
+	defer pool.Close()
+
+	client := healthpb.NewHealthClient(pool.Channel(address))
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+				t.Errorf("Check failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// A second client to the same address shares the channel too
+	if _, err := healthpb.NewHealthClient(pool.Channel(address)).Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	stats := pool.Stats()
+	if len(stats) != 1 || stats[0].Channels != 1 || stats[0].ActiveCalls != 0 {
+		t.Errorf("expected one idle channel, got %+v", stats)
+	}
+}
+
+func TestPool_OpensMoreChannelsWhenBusy(t *testing.T) {
+	address := startPeer(t)
+	pool := channelpool.New(channelpool.Options{ChannelsPerPeer: 2})
+	defer pool.Close()
+	client := healthpb.NewHealthClient(pool.Channel(address))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if _, err := client.Watch(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+			t.Fatalf("Watch failed: %v", err)
+		}
+	}
+	if n := channels(pool, address); n != 2 {
+		t.Errorf("expected busy calls to spread over 2 channels, got %d", n)
+	}
+	stats := pool.Stats()
+	if stats[0].ActiveCalls != 3 {
+		t.Errorf("expected 3 active streams, got %+v", stats)
+	}
+}
+
+func TestPool_ReapsIdleChannels(t *testing.T) {
+	address := startPeer(t)
+	pool := channelpool.New(channelpool.Options{IdleTimeout: 50 * time.Millisecond})
+	defer pool.Close()
+	client := healthpb.NewHealthClient(pool.Channel(address))
+
+	// Channels with a running stream are kept
+	ctx, cancel := context.WithCancel(context.Background())
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if _, err := watch.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if n := channels(pool, address); n != 1 {
+		t.Fatalf("expected the streaming channel to be kept, got %d channels", n)
+	}
+
+	// Once the stream ends the channel is reaped
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for channels(pool, address) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle channel was not reaped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// and redialed on the next call
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Check after reaping failed: %v", err)
+	}
+	if n := channels(pool, address); n != 1 {
+		t.Errorf("expected a redialed channel, got %d", n)
+	}
+}
+
+func TestPool_Close(t *testing.T) {
+	address := startPeer(t)
+	pool := channelpool.New(channelpool.Options{})
+	client := healthpb.NewHealthClient(pool.Channel(address))
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+
+	pool.Close()
+	pool.Close() // Closing twice is harmless
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); !errors.Is(err, channelpool.ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if stats := pool.Stats(); len(stats) != 0 {
+		t.Errorf("expected no channels after Close, got %+v", stats)
+	}
+}
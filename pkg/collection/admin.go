@@ -0,0 +1,142 @@
+package collection
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strings"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AdminTokenMetadataKey is the gRPC metadata header carrying the admin token
+// for AdminMethods.
+const AdminTokenMetadataKey = "x-collector-admin-token"
+
+// AdminMethods are the calls that require the admin token: they expose the
+// process's internals.
+var AdminMethods = map[string]bool{
+	"/collector.CollectionRepo/DumpGoroutines":  true,
+	"/collector.CollectionRepo/ServerResources": true,
+	"/collector.CollectionRepo/PreflightCheck":  true,
+	"/collector.CollectionRepo/SubscribeState":  true,
+}
+
+type adminKey struct{}
+
+// isAdmin reports whether a call was authenticated by an AdminAuth.
+func isAdmin(ctx context.Context) bool {
+	admin, _ := ctx.Value(adminKey{}).(bool)
+	return admin
+}
+
+// AdminAuth authenticates operators of the collector by a shared token,
+// for the debugging RPCs and HTTP endpoints.
+type AdminAuth struct {
+	token []byte
+}
+
+// NewAdminAuth creates an AdminAuth accepting token, which must not be
+// empty.
+func NewAdminAuth(token string) *AdminAuth {
+	return &AdminAuth{token: []byte(token)}
+}
+
+// authorize checks a presented token in constant time.
+func (a *AdminAuth) authorize(token string) error {
+	if token == "" {
+		return status.Errorf(codes.Unauthenticated, "admin token required (%s)", AdminTokenMetadataKey)
+	}
+	if len(a.token) == 0 || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+		return status.Error(codes.PermissionDenied, "invalid admin token")
+	}
+	return nil
+}
+
+// UnaryInterceptor requires the admin token on AdminMethods calls. Other
+// calls presenting it are authenticated as admin too, for RPCs such as
+// MoveCollectionStorage that admins may run without an approval.
+func (a *AdminAuth) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		token := incomingMetadata(ctx, AdminTokenMetadataKey)
+		if !AdminMethods[info.FullMethod] {
+			if token != "" && a.authorize(token) == nil {
+				ctx = context.WithValue(ctx, adminKey{}, true)
+			}
+			return handler(ctx, req)
+		}
+		if err := a.authorize(token); err != nil {
+			return nil, err
+		}
+		return handler(context.WithValue(ctx, adminKey{}, true), req)
+	}
+}
+
+// StreamInterceptor requires the admin token on AdminMethods streams.
+func (a *AdminAuth) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if AdminMethods[info.FullMethod] {
+			if err := a.authorize(incomingMetadata(ss.Context(), AdminTokenMetadataKey)); err != nil {
+				return err
+			}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// DebugHandler serves net/http/pprof under /debug/pprof/ to requests
+// bearing the admin token ("Authorization: Bearer <token>"), including
+// CPU profiles (/debug/pprof/profile?seconds=N), runtime execution traces
+// (/debug/pprof/trace?seconds=N) and goroutine dumps
+// (/debug/pprof/goroutine?debug=2).
+func (a *AdminAuth) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if err := a.authorize(token); err != nil {
+			code := http.StatusForbidden
+			if status.Code(err) == codes.Unauthenticated {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				code = http.StatusUnauthorized
+			}
+			http.Error(w, status.Convert(err).Message(), code)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// DumpGoroutines returns the stacks of every goroutine, e.g. to find the one
+// a stuck clone stream is blocked in. It is only served to calls
+// authenticated by an AdminAuth interceptor.
+func (s *GrpcServer) DumpGoroutines(ctx context.Context, req *pb.DumpGoroutinesRequest) (*pb.DumpGoroutinesResponse, error) {
+	if !isAdmin(ctx) {
+		return &pb.DumpGoroutinesResponse{Status: &pb.Status{Code: pb.Status_PERMISSION_DENIED, Message: "DumpGoroutines requires admin authentication"}}, nil
+	}
+	debug := 2
+	if req.Aggregate {
+		debug = 1
+	}
+	var buf bytes.Buffer
+	if err := runtimepprof.Lookup("goroutine").WriteTo(&buf, debug); err != nil {
+		return &pb.DumpGoroutinesResponse{Status: &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()}}, nil
+	}
+	return &pb.DumpGoroutinesResponse{
+		Status:     &pb.Status{Code: pb.Status_OK},
+		Goroutines: int32(runtime.NumGoroutine()),
+		Dump:       buf.String(),
+	}, nil
+}
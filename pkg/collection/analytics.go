@@ -0,0 +1,460 @@
+package collection
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/types/known/structpb"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// DefaultAnalyticsMaxRows caps the rows returned by an analytics query when
+	// the request does not specify a limit.
+	DefaultAnalyticsMaxRows = 1000
+
+	// DefaultAnalyticsMaxLoadRecords and DefaultAnalyticsMaxLoadBytes cap
+	// what one analytics query loads into its session when its engine's
+	// AnalyticsLoadLimit leaves them unset.
+	DefaultAnalyticsMaxLoadRecords = 1_000_000
+	DefaultAnalyticsMaxLoadBytes   = 256 << 20
+
+	// analyticsPageSize is how many records are read from a store at a time
+	// while loading it into an analytics session.
+	analyticsPageSize = 500
+)
+
+var (
+	// ErrInvalidAnalyticsQuery is returned for queries and aliases an engine
+	// refuses, and queries that fail to run.
+	ErrInvalidAnalyticsQuery = errors.New("invalid analytics query")
+	// ErrAnalyticsTooLarge is returned when a query's attachments hold more
+	// than its engine's AnalyticsLoadLimit allows loading.
+	ErrAnalyticsTooLarge = errors.New("analytics sources exceed the load limit")
+)
+
+// AnalyticsLoadLimit caps what one query loads into its session, across all
+// its attachments: every record is copied into memory before the query
+// runs. Zero fields take their defaults.
+type AnalyticsLoadLimit struct {
+	MaxRecords int64 // DefaultAnalyticsMaxLoadRecords if zero
+	MaxBytes   int64 // Of record data; DefaultAnalyticsMaxLoadBytes if zero
+}
+
+// AnalyticsLoad counts what a query has loaded against its limit.
+type AnalyticsLoad struct {
+	limit          AnalyticsLoadLimit
+	records, bytes int64
+}
+
+// Start returns the count of a new query's load.
+func (l AnalyticsLoadLimit) Start() *AnalyticsLoad {
+	if l.MaxRecords <= 0 {
+		l.MaxRecords = DefaultAnalyticsMaxLoadRecords
+	}
+	if l.MaxBytes <= 0 {
+		l.MaxBytes = DefaultAnalyticsMaxLoadBytes
+	}
+	return &AnalyticsLoad{limit: l}
+}
+
+// add counts records records of bytes bytes, returning ErrAnalyticsTooLarge
+// past the limit.
+func (l *AnalyticsLoad) add(records, bytes int64) error {
+	l.records += records
+	l.bytes += bytes
+	if l.records > l.limit.MaxRecords {
+		return fmt.Errorf("%w: more than %d records", ErrAnalyticsTooLarge, l.limit.MaxRecords)
+	}
+	if l.bytes > l.limit.MaxBytes {
+		return fmt.Errorf("%w: more than %d bytes", ErrAnalyticsTooLarge, l.limit.MaxBytes)
+	}
+	return nil
+}
+
+var analyticsAliasPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// AnalyticsColumns are the columns of the records table each attachment is
+// loaded into, in the order ScanAnalyticsRecords passes them: proto_data is
+// the record's data as written, whatever the store compressed or shared, and
+// created_at and updated_at are Unix seconds.
+var AnalyticsColumns = []string{"id", "proto_data", "data_uri", "created_at", "updated_at", "labels", "jsontext", "checksum", "hlc"}
+
+// AnalyticsAttachment is a collection made visible to an analytics query as
+// the table <Alias>.records (e.g. "SELECT COUNT(*) FROM alias.records").
+type AnalyticsAttachment struct {
+	Alias string
+	// Store holds the collection's records, and only them: every record it
+	// lists is loaded.
+	Store Store
+}
+
+// AnalyticsResult holds the tabular output of an analytics query.
+type AnalyticsResult struct {
+	Columns   []string
+	Rows      [][]interface{}
+	Truncated bool
+}
+
+// AnalyticsEngine executes read-only analytical queries over attached collections.
+// The default engine is SQLite-based; pkg/db/duckdb runs them on DuckDB, and
+// other engines can be plugged in by implementing this interface and passing
+// it to GrpcServer.SetAnalyticsEngine.
+type AnalyticsEngine interface {
+	// Name identifies the engine in responses.
+	Name() string
+
+	// Query loads the records of the given attachments into a session of its
+	// own and runs a single SELECT statement over them.
+	Query(ctx context.Context, attachments []AnalyticsAttachment, query string, maxRows int) (*AnalyticsResult, error)
+}
+
+// SqliteAnalyticsEngine runs analytics queries in an isolated in-memory SQLite session.
+// Each attachment is loaded into an in-memory database of its own and the
+// session is put into query_only mode, so queries only ever read copies.
+type SqliteAnalyticsEngine struct {
+	// LoadLimit caps the records each query loads.
+	LoadLimit AnalyticsLoadLimit
+}
+
+// Name returns the engine identifier.
+func (e *SqliteAnalyticsEngine) Name() string { return "sqlite" }
+
+// Query executes the query against a fresh session with all attachments loaded.
+func (e *SqliteAnalyticsEngine) Query(ctx context.Context, attachments []AnalyticsAttachment, query string, maxRows int) (*AnalyticsResult, error) {
+	if err := ValidateAnalyticsQuery(query); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open analytics session: %w", err)
+	}
+	defer db.Close()
+
+	// Attachments are per-connection, so pin the session to a single connection.
+	db.SetMaxOpenConns(1)
+
+	for _, a := range attachments {
+		if err := ValidateAnalyticsAlias(a.Alias); err != nil {
+			return nil, err
+		}
+	}
+	load := e.LoadLimit.Start()
+	for _, a := range attachments {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ATTACH DATABASE ':memory:' AS %s", a.Alias)); err != nil {
+			return nil, fmt.Errorf("failed to attach %s: %w", a.Alias, err)
+		}
+		if err := e.load(ctx, db, a, load); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", a.Alias, err)
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+		return nil, fmt.Errorf("failed to enable query_only: %w", err)
+	}
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAnalyticsQuery, err)
+	}
+	defer rows.Close()
+	return ReadAnalyticsResult(rows, maxRows)
+}
+
+// load copies the records of an attachment into <alias>.records.
+func (e *SqliteAnalyticsEngine) load(ctx context.Context, db *sql.DB, a AnalyticsAttachment, load *AnalyticsLoad) error {
+	create := fmt.Sprintf(`CREATE TABLE %s.records (
+		id TEXT PRIMARY KEY, proto_data BLOB, data_uri TEXT, created_at INTEGER, updated_at INTEGER,
+		labels TEXT, jsontext TEXT, checksum TEXT, hlc INTEGER)`, a.Alias)
+	if _, err := db.ExecContext(ctx, create); err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s.records VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", a.Alias))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	err = ScanAnalyticsRecords(ctx, a.Store, load, func(row []interface{}) error {
+		_, err := stmt.ExecContext(ctx, row...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ScanAnalyticsRecords calls fn with the AnalyticsColumns of every record of
+// store, reading it a page at a time, and counts them in load, stopping
+// with ErrAnalyticsTooLarge past its limit; a store holding more records
+// than the limit allows is refused before any is read. Records are read as
+// the store returns them, decompressed and with shared data resolved. A
+// record moved between pages by concurrent writes is passed once; records
+// written during the scan may be missed.
+func ScanAnalyticsRecords(ctx context.Context, store Store, load *AnalyticsLoad, fn func(row []interface{}) error) error {
+	count, err := store.CountRecords(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to count records: %w", err)
+	}
+	if load.records+count > load.limit.MaxRecords {
+		return fmt.Errorf("%w: %d records, more than %d", ErrAnalyticsTooLarge, load.records+count, load.limit.MaxRecords)
+	}
+	seen := make(map[string]bool)
+	for offset := 0; ; offset += analyticsPageSize {
+		records, err := store.ListRecords(ctx, offset, analyticsPageSize)
+		if err != nil {
+			return fmt.Errorf("failed to list records: %w", err)
+		}
+		for _, r := range records {
+			if seen[r.Id] {
+				continue
+			}
+			seen[r.Id] = true
+			if err := load.add(1, int64(len(r.ProtoData))); err != nil {
+				return err
+			}
+			if err := fn(analyticsRow(r)); err != nil {
+				return err
+			}
+		}
+		if len(records) < analyticsPageSize {
+			return nil
+		}
+	}
+}
+
+// analyticsRow returns the AnalyticsColumns of a record. jsontext is the
+// record's data if that is JSON and "{}" otherwise, as stores keep it.
+func analyticsRow(r *pb.CollectionRecord) []interface{} {
+	labels, _ := json.Marshal(r.GetMetadata().GetLabels())
+	jsonText := "{}"
+	if json.Valid(r.ProtoData) {
+		jsonText = string(r.ProtoData)
+	}
+	return []interface{}{
+		r.Id,
+		r.ProtoData,
+		r.DataUri,
+		r.GetMetadata().GetCreatedAt().GetSeconds(),
+		r.GetMetadata().GetUpdatedAt().GetSeconds(),
+		string(labels),
+		jsonText,
+		r.GetMetadata().GetChecksum(),
+		r.GetMetadata().GetHlc(),
+	}
+}
+
+// ReadAnalyticsResult reads up to maxRows rows of a query's result
+// (DefaultAnalyticsMaxRows if maxRows is not positive), marking it truncated
+// if there were more.
+func ReadAnalyticsResult(rows *sql.Rows, maxRows int) (*AnalyticsResult, error) {
+	if maxRows <= 0 {
+		maxRows = DefaultAnalyticsMaxRows
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns: %w", err)
+	}
+
+	result := &AnalyticsResult{Columns: columns}
+	for rows.Next() {
+		if len(result.Rows) == maxRows {
+			result.Truncated = true
+			break
+		}
+
+		values := make([]interface{}, len(columns))
+		scanArgs := make([]interface{}, len(columns))
+		for i := range values {
+			scanArgs[i] = &values[i]
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAnalyticsQuery, err)
+	}
+
+	return result, nil
+}
+
+// ValidateAnalyticsAlias reports whether alias can name an attachment: a
+// letter or underscore, then letters, digits and underscores.
+func ValidateAnalyticsAlias(alias string) error {
+	if !analyticsAliasPattern.MatchString(alias) {
+		return fmt.Errorf("%w: invalid alias %q", ErrInvalidAnalyticsQuery, alias)
+	}
+	return nil
+}
+
+// ValidateAnalyticsQuery enforces the restricted analytics dialect: exactly one
+// SELECT or WITH statement. Writes are additionally blocked by the engine itself.
+func ValidateAnalyticsQuery(query string) error {
+	q := strings.TrimSpace(query)
+	q = strings.TrimSuffix(q, ";")
+	if q == "" {
+		return fmt.Errorf("%w: query is required", ErrInvalidAnalyticsQuery)
+	}
+	if strings.Contains(q, ";") {
+		return fmt.Errorf("%w: only a single statement is allowed", ErrInvalidAnalyticsQuery)
+	}
+
+	upper := strings.ToUpper(q)
+	if !strings.HasPrefix(upper, "SELECT") && !strings.HasPrefix(upper, "WITH") {
+		return fmt.Errorf("%w: only SELECT queries are allowed", ErrInvalidAnalyticsQuery)
+	}
+	return nil
+}
+
+// defaultAnalyticsAlias derives a schema alias from a collection's namespace and name.
+func defaultAnalyticsAlias(namespace, name string) string {
+	alias := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, namespace+"_"+name)
+
+	if alias == "" || (alias[0] >= '0' && alias[0] <= '9') {
+		alias = "_" + alias
+	}
+	return alias
+}
+
+// AnalyticsQuery resolves the requested collections and runs the query on the analytics engine.
+func (s *GrpcServer) AnalyticsQuery(ctx context.Context, req *pb.AnalyticsQueryRequest) (*pb.AnalyticsQueryResponse, error) {
+	if len(req.Sources) == 0 {
+		return &pb.AnalyticsQueryResponse{
+			Status: &pb.Status{
+				Code:    pb.Status_INVALID_ARGUMENT,
+				Message: "at least one source collection is required",
+			},
+		}, nil
+	}
+	if err := ValidateAnalyticsQuery(req.Query); err != nil {
+		return &pb.AnalyticsQueryResponse{
+			Status: &pb.Status{
+				Code:    pb.Status_INVALID_ARGUMENT,
+				Message: err.Error(),
+			},
+		}, nil
+	}
+
+	attachments := make([]AnalyticsAttachment, 0, len(req.Sources))
+	seen := make(map[string]bool)
+	for _, src := range req.Sources {
+		if src.Collection == nil {
+			return &pb.AnalyticsQueryResponse{
+				Status: &pb.Status{
+					Code:    pb.Status_INVALID_ARGUMENT,
+					Message: "source collection is required",
+				},
+			}, nil
+		}
+
+		coll, err := s.repo.GetCollection(ctx, src.Collection.Namespace, src.Collection.Name)
+		if err != nil {
+			return &pb.AnalyticsQueryResponse{
+				Status: &pb.Status{
+					Code:    pb.Status_NOT_FOUND,
+					Message: fmt.Sprintf("collection not found: %v", err),
+				},
+			}, nil
+		}
+
+		// The records of collections on the repository's shared store are
+		// not told apart by collection, so one would show every other's.
+		if repo, ok := s.repo.(*DefaultCollectionRepo); ok && repo.sharesStore(coll.Meta.Namespace, coll.Meta.Name) {
+			return &pb.AnalyticsQueryResponse{
+				Status: &pb.Status{
+					Code:    pb.Status_FAILED_PRECONDITION,
+					Message: fmt.Sprintf("collection %s/%s is on the repository's shared store; move it to storage of its own to query it", src.Collection.Namespace, src.Collection.Name),
+				},
+			}, nil
+		}
+
+		alias := src.Alias
+		if alias == "" {
+			alias = defaultAnalyticsAlias(src.Collection.Namespace, src.Collection.Name)
+		}
+		if !analyticsAliasPattern.MatchString(alias) || seen[alias] {
+			return &pb.AnalyticsQueryResponse{
+				Status: &pb.Status{
+					Code:    pb.Status_INVALID_ARGUMENT,
+					Message: fmt.Sprintf("invalid or duplicate alias %q", alias),
+				},
+			}, nil
+		}
+		seen[alias] = true
+
+		attachments = append(attachments, AnalyticsAttachment{Alias: alias, Store: coll.Store})
+	}
+
+	result, err := s.analytics.Query(ctx, attachments, req.Query, int(req.MaxRows))
+	if err != nil {
+		code := pb.Status_INTERNAL
+		switch {
+		case errors.Is(err, ErrInvalidAnalyticsQuery):
+			code = pb.Status_INVALID_ARGUMENT
+		case errors.Is(err, ErrAnalyticsTooLarge):
+			code = pb.Status_RESOURCE_EXHAUSTED
+		}
+		return &pb.AnalyticsQueryResponse{
+			Status: &pb.Status{
+				Code:    code,
+				Message: fmt.Sprintf("analytics query failed: %v", err),
+			},
+			Engine: s.analytics.Name(),
+		}, nil
+	}
+
+	rows := make([]*structpb.Struct, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		fields := make(map[string]*structpb.Value, len(result.Columns))
+		for i, col := range result.Columns {
+			v := row[i]
+			// Text columns come back as []byte; keep them readable, and
+			// let structpb base64-encode genuinely binary values.
+			if b, ok := v.([]byte); ok && utf8.Valid(b) {
+				v = string(b)
+			}
+			value, err := structpb.NewValue(v)
+			if err != nil {
+				value = structpb.NewStringValue(fmt.Sprintf("%v", v))
+			}
+			fields[col] = value
+		}
+		rows = append(rows, &structpb.Struct{Fields: fields})
+	}
+
+	return &pb.AnalyticsQueryResponse{
+		Status: &pb.Status{
+			Code:    pb.Status_OK,
+			Message: fmt.Sprintf("returned %d rows", len(rows)),
+		},
+		Columns:   result.Columns,
+		Rows:      rows,
+		Truncated: result.Truncated,
+		Engine:    s.analytics.Name(),
+	}, nil
+}
+
+// SetAnalyticsEngine replaces the engine used by AnalyticsQuery.
+func (s *GrpcServer) SetAnalyticsEngine(engine AnalyticsEngine) {
+	s.analytics = engine
+}
@@ -0,0 +1,307 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+)
+
+func setupAnalyticsServer(t *testing.T) (*collection.GrpcServer, collection.CollectionRepo, func()) {
+	t.Helper()
+	ctx := context.Background()
+
+	repo, cleanup := setupTestRepo(t)
+	server := collection.NewGrpcServerWithDataDir(repo, t.TempDir())
+
+	// Only collections with a store of their own can be queried
+	repo.(*collection.DefaultCollectionRepo).SetStoreOpener(sqlite.StoreOpener(collection.Options{
+		EnableJSON:  true,
+		Compression: &collection.CompressionOptions{MinSize: 64},
+		Deduplicate: true,
+	}))
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "analytics", Name: "orders"}); err != nil {
+		cleanup()
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	if _, err := repo.(*collection.DefaultCollectionRepo).MoveStorage(ctx, "analytics", "orders", t.TempDir()); err != nil {
+		cleanup()
+		t.Fatalf("failed to move collection: %v", err)
+	}
+
+	coll, err := repo.GetCollection(ctx, "analytics", "orders")
+	if err != nil {
+		cleanup()
+		t.Fatalf("failed to get collection: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		region := "east"
+		if i%2 == 0 {
+			region = "west"
+		}
+		err := coll.CreateRecord(ctx, &pb.CollectionRecord{
+			Id:        fmt.Sprintf("order-%d", i),
+			ProtoData: []byte(fmt.Sprintf(`{"region": "%s", "amount": %d}`, region, i*10)),
+		})
+		if err != nil {
+			cleanup()
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+
+	return server, repo, cleanup
+}
+
+func TestAnalyticsQuery_Aggregation(t *testing.T) {
+	server, _, cleanup := setupAnalyticsServer(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	resp, err := server.AnalyticsQuery(ctx, &pb.AnalyticsQueryRequest{
+		Sources: []*pb.AnalyticsSource{
+			{Collection: &pb.NamespacedName{Namespace: "analytics", Name: "orders"}, Alias: "o"},
+		},
+		Query: `SELECT json_extract(jsontext, '$.region') AS region,
+		               SUM(json_extract(jsontext, '$.amount')) AS total
+		        FROM o.records GROUP BY region ORDER BY region`,
+	})
+	if err != nil {
+		t.Fatalf("AnalyticsQuery failed: %v", err)
+	}
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("expected OK, got %v: %s", resp.Status.Code, resp.Status.Message)
+	}
+	if resp.Engine != "sqlite" {
+		t.Errorf("expected sqlite engine, got %q", resp.Engine)
+	}
+	if len(resp.Rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(resp.Rows))
+	}
+
+	east := resp.Rows[0].Fields
+	if east["region"].GetStringValue() != "east" {
+		t.Errorf("expected first region 'east', got %v", east["region"])
+	}
+	// east amounts: 10 + 30 + 50 + 70 + 90
+	if east["total"].GetNumberValue() != 250 {
+		t.Errorf("expected east total 250, got %v", east["total"].GetNumberValue())
+	}
+}
+
+func TestAnalyticsQuery_DefaultAlias(t *testing.T) {
+	server, _, cleanup := setupAnalyticsServer(t)
+	defer cleanup()
+
+	resp, err := server.AnalyticsQuery(context.Background(), &pb.AnalyticsQueryRequest{
+		Sources: []*pb.AnalyticsSource{
+			{Collection: &pb.NamespacedName{Namespace: "analytics", Name: "orders"}},
+		},
+		Query: "SELECT COUNT(*) AS n FROM analytics_orders.records",
+	})
+	if err != nil {
+		t.Fatalf("AnalyticsQuery failed: %v", err)
+	}
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("expected OK, got %v: %s", resp.Status.Code, resp.Status.Message)
+	}
+	if n := resp.Rows[0].Fields["n"].GetNumberValue(); n != 10 {
+		t.Errorf("expected 10 records, got %v", n)
+	}
+}
+
+func TestAnalyticsQuery_Truncation(t *testing.T) {
+	server, _, cleanup := setupAnalyticsServer(t)
+	defer cleanup()
+
+	resp, err := server.AnalyticsQuery(context.Background(), &pb.AnalyticsQueryRequest{
+		Sources: []*pb.AnalyticsSource{
+			{Collection: &pb.NamespacedName{Namespace: "analytics", Name: "orders"}, Alias: "o"},
+		},
+		Query:   "SELECT id FROM o.records",
+		MaxRows: 3,
+	})
+	if err != nil {
+		t.Fatalf("AnalyticsQuery failed: %v", err)
+	}
+	if len(resp.Rows) != 3 || !resp.Truncated {
+		t.Errorf("expected 3 truncated rows, got %d (truncated=%v)", len(resp.Rows), resp.Truncated)
+	}
+}
+
+func TestAnalyticsQuery_RejectsWrites(t *testing.T) {
+	server, repo, cleanup := setupAnalyticsServer(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	queries := []string{
+		"DELETE FROM o.records",
+		"SELECT 1; DELETE FROM o.records",
+		"WITH x AS (SELECT 1) DELETE FROM o.records",
+		"",
+	}
+
+	for _, q := range queries {
+		resp, err := server.AnalyticsQuery(ctx, &pb.AnalyticsQueryRequest{
+			Sources: []*pb.AnalyticsSource{
+				{Collection: &pb.NamespacedName{Namespace: "analytics", Name: "orders"}, Alias: "o"},
+			},
+			Query: q,
+		})
+		if err != nil {
+			t.Fatalf("AnalyticsQuery returned error: %v", err)
+		}
+		if resp.Status.Code == pb.Status_OK {
+			t.Errorf("expected query %q to be rejected", q)
+		}
+	}
+
+	coll, err := repo.GetCollection(ctx, "analytics", "orders")
+	if err != nil {
+		t.Fatalf("failed to get collection: %v", err)
+	}
+	count, err := coll.CountRecords(ctx)
+	if err != nil {
+		t.Fatalf("CountRecords failed: %v", err)
+	}
+	if count != 10 {
+		t.Errorf("expected records to be untouched, got %d", count)
+	}
+}
+
+func TestAnalyticsQuery_UnknownCollection(t *testing.T) {
+	server, _, cleanup := setupAnalyticsServer(t)
+	defer cleanup()
+
+	resp, err := server.AnalyticsQuery(context.Background(), &pb.AnalyticsQueryRequest{
+		Sources: []*pb.AnalyticsSource{
+			{Collection: &pb.NamespacedName{Namespace: "analytics", Name: "missing"}},
+		},
+		Query: "SELECT 1",
+	})
+	if err != nil {
+		t.Fatalf("AnalyticsQuery returned error: %v", err)
+	}
+	if resp.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND, got %v", resp.Status.Code)
+	}
+}
+
+func TestAnalyticsQuery_SharedStore(t *testing.T) {
+	server, repo, cleanup := setupAnalyticsServer(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Collections on the shared store hold each other's records
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "analytics", Name: "shared"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	resp, err := server.AnalyticsQuery(ctx, &pb.AnalyticsQueryRequest{
+		Sources: []*pb.AnalyticsSource{
+			{Collection: &pb.NamespacedName{Namespace: "analytics", Name: "shared"}, Alias: "s"},
+		},
+		Query: "SELECT COUNT(*) AS n FROM s.records",
+	})
+	if err != nil {
+		t.Fatalf("AnalyticsQuery returned error: %v", err)
+	}
+	if resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION for a collection on the shared store, got %v", resp.Status.Code)
+	}
+}
+
+func TestAnalyticsQuery_DecodedData(t *testing.T) {
+	server, repo, cleanup := setupAnalyticsServer(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	coll, err := repo.GetCollection(ctx, "analytics", "orders")
+	if err != nil {
+		t.Fatalf("failed to get collection: %v", err)
+	}
+	data := `{"note": "` + strings.Repeat("compressible ", 20) + `"}`
+	for _, id := range []string{"big-1", "big-2"} {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: []byte(data)}); err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+	stats, err := coll.CompressionStats(ctx)
+	if err != nil || stats.GetCompressedRecords() != 2 {
+		t.Fatalf("expected the records to be stored compressed, got %v (%v)", stats, err)
+	}
+
+	resp, err := server.AnalyticsQuery(ctx, &pb.AnalyticsQueryRequest{
+		Sources: []*pb.AnalyticsSource{
+			{Collection: &pb.NamespacedName{Namespace: "analytics", Name: "orders"}, Alias: "o"},
+		},
+		Query: "SELECT id, CAST(proto_data AS TEXT) AS data FROM o.records WHERE id LIKE 'big-%' ORDER BY id",
+	})
+	if err != nil {
+		t.Fatalf("AnalyticsQuery failed: %v", err)
+	}
+	if resp.Status.Code != pb.Status_OK || len(resp.Rows) != 2 {
+		t.Fatalf("expected 2 rows, got %v: %s (%d rows)", resp.Status.Code, resp.Status.Message, len(resp.Rows))
+	}
+	for _, row := range resp.Rows {
+		if got := row.Fields["data"].GetStringValue(); got != data {
+			t.Errorf("%s: expected the record data as written, got %q", row.Fields["id"].GetStringValue(), got)
+		}
+	}
+}
+
+// failingEngine fails every query as an engine failing to load would.
+type failingEngine struct{}
+
+func (failingEngine) Name() string { return "failing" }
+
+func (failingEngine) Query(ctx context.Context, attachments []collection.AnalyticsAttachment, query string, maxRows int) (*collection.AnalyticsResult, error) {
+	return nil, errors.New("failed to attach o: disk I/O error")
+}
+
+func TestAnalyticsQuery_StatusCodes(t *testing.T) {
+	server, _, cleanup := setupAnalyticsServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	query := func(q string) pb.Status_Code {
+		t.Helper()
+		resp, err := server.AnalyticsQuery(ctx, &pb.AnalyticsQueryRequest{
+			Sources: []*pb.AnalyticsSource{
+				{Collection: &pb.NamespacedName{Namespace: "analytics", Name: "orders"}, Alias: "o"},
+			},
+			Query: q,
+		})
+		if err != nil {
+			t.Fatalf("AnalyticsQuery returned error: %v", err)
+		}
+		return resp.Status.Code
+	}
+
+	// Queries that cannot run are the caller's to fix
+	if code := query("SELECT nope FROM o.records"); code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT for a bad column, got %v", code)
+	}
+
+	// Sources larger than the load limit are refused, by count before
+	// loading or by size while loading
+	for _, limit := range []collection.AnalyticsLoadLimit{{MaxRecords: 5}, {MaxBytes: 64}} {
+		server.SetAnalyticsEngine(&collection.SqliteAnalyticsEngine{LoadLimit: limit})
+		if code := query("SELECT COUNT(*) FROM o.records"); code != pb.Status_RESOURCE_EXHAUSTED {
+			t.Errorf("expected RESOURCE_EXHAUSTED under %+v, got %v", limit, code)
+		}
+	}
+	server.SetAnalyticsEngine(&collection.SqliteAnalyticsEngine{LoadLimit: collection.AnalyticsLoadLimit{MaxRecords: 10}})
+	if code := query("SELECT COUNT(*) FROM o.records"); code != pb.Status_OK {
+		t.Errorf("expected sources within the limit to load, got %v", code)
+	}
+
+	// The engine's own failures are not
+	server.SetAnalyticsEngine(failingEngine{})
+	if code := query("SELECT 1"); code != pb.Status_INTERNAL {
+		t.Errorf("expected INTERNAL for a failed load, got %v", code)
+	}
+}
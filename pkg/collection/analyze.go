@@ -0,0 +1,288 @@
+package collection
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	// DefaultAnalyzeSampleSize is the number of records Analyze samples by default.
+	DefaultAnalyzeSampleSize = 1000
+
+	// maxAnalyzeDepth limits how deep Analyze descends into nested objects.
+	maxAnalyzeDepth = 3
+
+	// minTextFieldLength is the average length above which a string field is treated as free text.
+	minTextFieldLength = 40
+)
+
+// DescriptorResolver resolves a collection's message type to its descriptor.
+// When set on a CollectionServer, Analyze only suggests fields declared in the
+// schema, and typed items are decoded to JSON (see SetDescriptorResolver).
+// It returns a NotFound status error for unknown messages.
+type DescriptorResolver interface {
+	ResolveMessage(ctx context.Context, namespace, messageName string) (protoreflect.MessageDescriptor, error)
+}
+
+// fieldProfile accumulates statistics for one JSON path across sampled records.
+type fieldProfile struct {
+	path     string
+	jsonType string
+	present  int
+	distinct map[string]struct{}
+	textLen  int
+}
+
+// profileRecords walks the JSON payloads and collects per-field statistics.
+func profileRecords(records []*pb.CollectionRecord) map[string]*fieldProfile {
+	profiles := make(map[string]*fieldProfile)
+
+	var walk func(prefix string, obj map[string]interface{}, depth int)
+	walk = func(prefix string, obj map[string]interface{}, depth int) {
+		for key, value := range obj {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+
+			var jsonType string
+			switch v := value.(type) {
+			case map[string]interface{}:
+				if depth < maxAnalyzeDepth {
+					walk(path, v, depth+1)
+				}
+				continue
+			case []interface{}, nil:
+				continue
+			case string:
+				jsonType = "string"
+			case float64:
+				jsonType = "number"
+			case bool:
+				jsonType = "bool"
+			}
+
+			p := profiles[path]
+			if p == nil {
+				p = &fieldProfile{path: path, jsonType: jsonType, distinct: make(map[string]struct{})}
+				profiles[path] = p
+			}
+			p.present++
+			p.distinct[fmt.Sprintf("%v", value)] = struct{}{}
+			if s, ok := value.(string); ok {
+				p.textLen += len(s)
+			}
+		}
+	}
+
+	for _, r := range records {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(r.ProtoData, &doc); err != nil {
+			continue
+		}
+		walk("", doc, 1)
+	}
+	return profiles
+}
+
+// descriptorKind resolves a dotted JSON path against a message descriptor and returns
+// the field's kind, or false if the path is not a singular scalar field of the schema.
+func descriptorKind(md protoreflect.MessageDescriptor, path string) (string, bool) {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		fd := md.Fields().ByJSONName(part)
+		if fd == nil {
+			fd = md.Fields().ByName(protoreflect.Name(part))
+		}
+		if fd == nil || fd.IsList() || fd.IsMap() {
+			return "", false
+		}
+		if i == len(parts)-1 {
+			if fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+				return "", false
+			}
+			return fd.Kind().String(), true
+		}
+		if fd.Message() == nil {
+			return "", false
+		}
+		md = fd.Message()
+	}
+	return "", false
+}
+
+// AnalyzeFields builds index suggestions from sampled records and search usage.
+// Fields already in indexed are not suggested. If md is non-nil, fields not declared
+// in the message descriptor are ignored.
+func AnalyzeFields(records []*pb.CollectionRecord, usage map[string]FieldUsage, indexed []string, md protoreflect.MessageDescriptor) (suggestions []*pb.FieldSuggestion, textFields []string) {
+	profiles := profileRecords(records)
+	total := len(records)
+
+	alreadyIndexed := make(map[string]bool, len(indexed))
+	for _, f := range indexed {
+		alreadyIndexed[f] = true
+	}
+
+	// Fields that were searched on but never seen in the sample still deserve a look.
+	for field := range usage {
+		if _, ok := profiles[field]; !ok {
+			profiles[field] = &fieldProfile{path: field, distinct: map[string]struct{}{}}
+		}
+	}
+
+	type scored struct {
+		s     *pb.FieldSuggestion
+		score float64
+	}
+	var candidates []scored
+
+	for path, p := range profiles {
+		jsonType := p.jsonType
+		if md != nil {
+			kind, ok := descriptorKind(md, path)
+			if !ok {
+				continue
+			}
+			jsonType = kind
+		}
+
+		var presence float64
+		if total > 0 {
+			presence = float64(p.present) / float64(total)
+		}
+		if p.jsonType == "string" && p.present > 0 && p.textLen/p.present >= minTextFieldLength {
+			textFields = append(textFields, path)
+			continue // Free text belongs in FTS, not a field index
+		}
+		if alreadyIndexed[path] {
+			continue
+		}
+
+		u := usage[path]
+		uses := u.Filters + u.OrderBys
+		distinct := len(p.distinct)
+
+		var reason string
+		switch {
+		case uses > 0 && u.Slow > 0:
+			reason = fmt.Sprintf("used in %d searches, %d of them slow", uses, u.Slow)
+		case uses > 0:
+			reason = fmt.Sprintf("used in %d searches", uses)
+		case presence >= 0.8 && distinct > 1 && distinct <= p.present/2:
+			reason = fmt.Sprintf("present in %.0f%% of records with %d distinct values", presence*100, distinct)
+		default:
+			continue
+		}
+
+		candidates = append(candidates, scored{
+			s: &pb.FieldSuggestion{
+				Field:          path,
+				JsonType:       jsonType,
+				Presence:       presence,
+				DistinctValues: int64(distinct),
+				FilterUses:     uses,
+				SlowQueries:    u.Slow,
+				Reason:         reason,
+			},
+			score: float64(u.Slow)*10 + float64(uses)*3 + presence,
+		})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].s.Field < candidates[j].s.Field
+	})
+	for _, c := range candidates {
+		suggestions = append(suggestions, c.s)
+	}
+	sort.Strings(textFields)
+	return suggestions, textFields
+}
+
+// Analyze samples the collection and its search history and suggests fields to index.
+func (s *CollectionServer) Analyze(ctx context.Context, req *pb.AnalyzeRequest) (*pb.AnalyzeResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+
+	sampleSize := int(req.SampleSize)
+	if sampleSize <= 0 {
+		sampleSize = DefaultAnalyzeSampleSize
+	}
+	records, err := collection.ListRecords(ctx, 0, sampleSize)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to sample records: %v", err)
+	}
+
+	var md protoreflect.MessageDescriptor
+	if s.descriptors != nil && collection.Meta.MessageType != nil && collection.Meta.MessageType.MessageName != "" {
+		mt := collection.Meta.MessageType
+		md, err = s.descriptors.ResolveMessage(ctx, mt.Namespace, mt.MessageName)
+		if err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "failed to resolve message type %s: %v", mt.MessageName, err)
+		}
+	}
+
+	usage := s.queries.FieldUsage(req.Namespace, req.CollectionName)
+	suggestions, textFields := AnalyzeFields(records, usage, collection.Meta.IndexedFields, md)
+
+	resp := &pb.AnalyzeResponse{
+		Status:         &pb.Status{Code: pb.Status_OK, Message: fmt.Sprintf("%d suggestions", len(suggestions))},
+		SampledRecords: int64(len(records)),
+		Suggestions:    suggestions,
+		FtsRecommended: len(textFields) > 0,
+		TextFields:     textFields,
+	}
+
+	if req.Apply && len(suggestions) > 0 {
+		indexed := append([]string(nil), collection.Meta.IndexedFields...)
+		for _, sug := range suggestions {
+			indexed = append(indexed, sug.Field)
+		}
+		collection.Meta.IndexedFields = indexed
+
+		if err := s.repo.UpdateCollectionMetadata(ctx, req.Namespace, req.CollectionName, collection.Meta); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update metadata: %v", err)
+		}
+		if err := collection.Store.ReIndex(ctx); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to re-index: %v", err)
+		}
+		resp.AppliedIndexedFields = indexed
+	}
+
+	return resp, nil
+}
+
+// SetDescriptorResolver makes Analyze schema-aware, and makes Create and
+// Update decode typed items to JSON and reads return records as their
+// collection's message type. The registry's RegistryServer is one.
+func (s *CollectionServer) SetDescriptorResolver(r DescriptorResolver) {
+	s.descriptors = r
+}
+
+// QueryLog returns the log of searches served by this server.
+func (s *CollectionServer) QueryLog() *QueryLog {
+	return s.queries
+}
+
+// timeSearch runs a search and records it in the query log.
+func (s *CollectionServer) timeSearch(ctx context.Context, c *Collection, query *SearchQuery) ([]*SearchResult, error) {
+	start := time.Now()
+	results, err := c.Search(ctx, query)
+	if err == nil {
+		s.queries.Record(c.Meta.Namespace, c.Meta.Name, query, time.Since(start))
+	}
+	return results, err
+}
@@ -0,0 +1,218 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func analyzeRecords(n int) []*pb.CollectionRecord {
+	records := make([]*pb.CollectionRecord, n)
+	for i := range records {
+		records[i] = &pb.CollectionRecord{
+			Id: fmt.Sprintf("r-%d", i),
+			ProtoData: []byte(fmt.Sprintf(
+				`{"status": %q, "user": {"region": %q, "id": "u-%d"}, "body": %q, "extra": "x%d"}`,
+				[]string{"open", "closed"}[i%2], []string{"eu", "us", "ap"}[i%3], i,
+				strings.Repeat("lorem ipsum ", 5), i)),
+		}
+	}
+	return records
+}
+
+func TestQueryLog_RecordsUsageAndSlowQueries(t *testing.T) {
+	log := collection.NewQueryLog(50 * time.Millisecond)
+
+	log.Record("ns", "c", &collection.SearchQuery{
+		Filters: map[string]collection.Filter{"status": {Operator: collection.OpEquals, Value: "open"}},
+		OrderBy: "created",
+	}, 10*time.Millisecond)
+	log.Record("ns", "c", &collection.SearchQuery{
+		Filters: map[string]collection.Filter{"status": {Operator: collection.OpEquals, Value: "closed"}},
+	}, 80*time.Millisecond)
+
+	usage := log.FieldUsage("ns", "c")
+	if usage["status"].Filters != 2 || usage["status"].Slow != 1 || usage["created"].OrderBys != 1 {
+		t.Errorf("unexpected usage: %+v", usage)
+	}
+	slow := log.SlowQueries("ns", "c")
+	if len(slow) != 1 || slow[0].Fields[0] != "status" {
+		t.Errorf("unexpected slow queries: %+v", slow)
+	}
+	if len(log.FieldUsage("ns", "other")) != 0 {
+		t.Error("expected usage to be tracked per collection")
+	}
+}
+
+func TestQueryLog_BoundsFieldUsage(t *testing.T) {
+	log := collection.NewQueryLog(time.Hour)
+	search := func(field string) {
+		log.Record("ns", "c", &collection.SearchQuery{
+			Filters: map[string]collection.Filter{field: {Operator: collection.OpEquals, Value: "x"}},
+		}, time.Millisecond)
+	}
+	search("status")
+	search("status")
+
+	// Invented fields cannot grow the log past its bound, and evict the
+	// least used fields first
+	for i := 0; i < 2*collection.MaxTrackedFields; i++ {
+		search(fmt.Sprintf("invented-%d", i))
+	}
+	usage := log.FieldUsage("ns", "c")
+	if len(usage) != collection.MaxTrackedFields {
+		t.Errorf("expected %d tracked fields, got %d", collection.MaxTrackedFields, len(usage))
+	}
+	if usage["status"].Filters != 2 {
+		t.Errorf("expected the most used field kept, got %+v", usage["status"])
+	}
+	if _, ok := usage[fmt.Sprintf("invented-%d", 2*collection.MaxTrackedFields-1)]; !ok {
+		t.Error("expected the latest field tracked")
+	}
+}
+
+func TestAnalyzeFields(t *testing.T) {
+	usage := map[string]collection.FieldUsage{"user.id": {Filters: 4, Slow: 2}}
+
+	suggestions, textFields := collection.AnalyzeFields(analyzeRecords(30), usage, []string{"status"}, nil)
+
+	if len(suggestions) != 2 {
+		t.Fatalf("expected 2 suggestions, got %+v", suggestions)
+	}
+	// Search history outranks shape-based suggestions
+	if suggestions[0].Field != "user.id" || suggestions[0].SlowQueries != 2 {
+		t.Errorf("expected user.id first, got %+v", suggestions[0])
+	}
+	if suggestions[1].Field != "user.region" || suggestions[1].DistinctValues != 3 {
+		t.Errorf("expected user.region second, got %+v", suggestions[1])
+	}
+	if len(textFields) != 1 || textFields[0] != "body" {
+		t.Errorf("expected body as text field, got %v", textFields)
+	}
+}
+
+func TestAnalyzeFields_DescriptorRestrictsFields(t *testing.T) {
+	md := analyzeDescriptor(t)
+	usage := map[string]collection.FieldUsage{"extra": {Filters: 5}}
+
+	suggestions, _ := collection.AnalyzeFields(analyzeRecords(30), usage, nil, md)
+
+	fields := make([]string, len(suggestions))
+	for i, s := range suggestions {
+		fields[i] = s.Field
+	}
+	if fmt.Sprint(fields) != "[status]" {
+		t.Fatalf("expected only declared fields, got %v", fields)
+	}
+	if suggestions[0].JsonType != "string" {
+		t.Errorf("expected type from descriptor, got %q", suggestions[0].JsonType)
+	}
+}
+
+type staticResolver struct {
+	md protoreflect.MessageDescriptor
+}
+
+func (r staticResolver) ResolveMessage(ctx context.Context, namespace, messageName string) (protoreflect.MessageDescriptor, error) {
+	return r.md, nil
+}
+
+func analyzeDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("ticket.proto"),
+		Package: proto.String("analyze"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Ticket"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("status"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), JsonName: proto.String("status")},
+				{Name: proto.String("body"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), JsonName: proto.String("body")},
+			},
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build descriptor: %v", err)
+	}
+	return fd.Messages().Get(0)
+}
+
+func TestCollectionServer_AnalyzeAndApply(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewCollectionServer(repo)
+	ctx := context.Background()
+
+	_, err := repo.CreateCollection(ctx, &pb.Collection{
+		Namespace:   "test",
+		Name:        "tickets",
+		MessageType: &pb.MessageTypeRef{Namespace: "test", MessageName: "Ticket"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	for _, r := range analyzeRecords(20) {
+		if _, err := server.Create(ctx, &pb.CreateRequest{
+			Namespace: "test", CollectionName: "tickets", Id: r.Id, Item: &anypb.Any{Value: r.ProtoData},
+		}); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+
+	_, err = server.Search(ctx, &pb.SearchRequest{
+		Namespace:      "test",
+		CollectionName: "tickets",
+		Filters: map[string]*pb.Filter{
+			"status": {Operator: pb.FilterOperator_OP_EQUALS, Value: structpb.NewStringValue("open")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if server.QueryLog().FieldUsage("test", "tickets")["status"].Filters != 1 {
+		t.Fatal("expected search to be recorded in the query log")
+	}
+
+	server.SetDescriptorResolver(staticResolver{md: analyzeDescriptor(t)})
+	resp, err := server.Analyze(ctx, &pb.AnalyzeRequest{Namespace: "test", CollectionName: "tickets", Apply: true})
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	if resp.SampledRecords != 20 || !resp.FtsRecommended {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	if len(resp.Suggestions) != 1 || resp.Suggestions[0].Field != "status" || resp.Suggestions[0].FilterUses != 1 {
+		t.Fatalf("unexpected suggestions: %+v", resp.Suggestions)
+	}
+	if fmt.Sprint(resp.AppliedIndexedFields) != "[status]" {
+		t.Errorf("unexpected applied fields: %v", resp.AppliedIndexedFields)
+	}
+
+	coll, err := repo.GetCollection(ctx, "test", "tickets")
+	if err != nil {
+		t.Fatalf("GetCollection failed: %v", err)
+	}
+	if fmt.Sprint(coll.Meta.IndexedFields) != "[status]" {
+		t.Errorf("expected indexed fields to be persisted, got %v", coll.Meta.IndexedFields)
+	}
+
+	// Once applied, the field is no longer suggested
+	resp, err = server.Analyze(ctx, &pb.AnalyzeRequest{Namespace: "test", CollectionName: "tickets"})
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	if len(resp.Suggestions) != 0 {
+		t.Errorf("expected no suggestions after apply, got %+v", resp.Suggestions)
+	}
+}
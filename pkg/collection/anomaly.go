@@ -0,0 +1,394 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// DefaultMonitorWindow is the span write and delete rates are measured over.
+	DefaultMonitorWindow = 5 * time.Minute
+	// DefaultMassDeleteFraction is the share of a collection that may be
+	// deleted within a window before it is flagged.
+	DefaultMassDeleteFraction = 0.25
+	// DefaultMinMassDelete keeps small collections from being flagged for a
+	// handful of deletes.
+	DefaultMinMassDelete = 100
+	// DefaultGrowthFactor flags a collection that grows by this multiple of
+	// its size within a window.
+	DefaultGrowthFactor = 1.0
+	// DefaultMinGrowth keeps small collections from being flagged for
+	// ordinary ingestion.
+	DefaultMinGrowth = 1000
+
+	// maxAnomalies bounds the anomalies a ChangeMonitor remembers.
+	maxAnomalies = 100
+)
+
+var (
+	// ErrDeletesBlocked is returned for deletes refused while a mass-deletion
+	// anomaly awaits confirmation.
+	ErrDeletesBlocked = errors.New("deletes are blocked pending confirmation of a mass deletion")
+	// ErrAnomalyNotFound is returned when confirming an unknown anomaly.
+	ErrAnomalyNotFound = errors.New("anomaly not found")
+)
+
+// MonitorOptions configures a ChangeMonitor. Zero fields take their defaults.
+type MonitorOptions struct {
+	// Window is the span rates are measured over.
+	Window time.Duration
+	// MassDeleteFraction and MinMassDelete set the deletes within a window,
+	// the larger of the fraction of the collection and the minimum, that
+	// are flagged as a mass deletion.
+	MassDeleteFraction float64
+	MinMassDelete      int64
+	// GrowthFactor and MinGrowth set the net new records within a window,
+	// the larger of the multiple of the collection and the minimum, that
+	// are flagged as runaway growth.
+	GrowthFactor float64
+	MinGrowth    int64
+	// BlockDeletes refuses deletes from a collection flagged for mass
+	// deletion, starting with the delete that crossed the threshold, until
+	// the anomaly is confirmed.
+	BlockDeletes bool
+	// OnAnomaly, when set, is called with each new anomaly.
+	OnAnomaly func(*pb.Anomaly)
+}
+
+// WithDefaults returns o with zero fields set to their defaults.
+func (o MonitorOptions) WithDefaults() MonitorOptions {
+	if o.Window <= 0 {
+		o.Window = DefaultMonitorWindow
+	}
+	if o.MassDeleteFraction <= 0 {
+		o.MassDeleteFraction = DefaultMassDeleteFraction
+	}
+	if o.MinMassDelete <= 0 {
+		o.MinMassDelete = DefaultMinMassDelete
+	}
+	if o.GrowthFactor <= 0 {
+		o.GrowthFactor = DefaultGrowthFactor
+	}
+	if o.MinGrowth <= 0 {
+		o.MinGrowth = DefaultMinGrowth
+	}
+	return o
+}
+
+// ChangeMonitor tracks write, delete and growth rates per collection and
+// flags anomalies: deletes or net growth within a window far out of
+// proportion to the collection's size. Collections report to it through
+// Collection.Monitor.
+type ChangeMonitor struct {
+	opts MonitorOptions
+
+	mu         sync.Mutex
+	activity   map[string]*collectionActivity
+	anomalies  []*pb.Anomaly // oldest first
+	blockedBy  map[string]*pb.Anomaly
+	flaggedNow map[string]map[pb.AnomalyKind]bool
+}
+
+// changeKind is a kind of change counted by a ChangeMonitor.
+type changeKind int
+
+const (
+	changeCreate changeKind = iota
+	changeUpdate
+	changeDelete
+)
+
+// windowCounts are the changes seen in one window.
+type windowCounts struct {
+	start  time.Time
+	counts [3]int64 // by changeKind
+}
+
+type collectionActivity struct {
+	size          int64 // records, counted when first seen and tracked since
+	current, last windowCounts
+}
+
+// NewChangeMonitor creates a monitor with the given options.
+func NewChangeMonitor(opts MonitorOptions) *ChangeMonitor {
+	return &ChangeMonitor{
+		opts:       opts.WithDefaults(),
+		activity:   make(map[string]*collectionActivity),
+		blockedBy:  make(map[string]*pb.Anomaly),
+		flaggedNow: make(map[string]map[pb.AnomalyKind]bool),
+	}
+}
+
+func monitorKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// tracked returns the activity of c, counting its records when it is first
+// seen; fresh reports whether they were just counted.
+func (m *ChangeMonitor) tracked(ctx context.Context, c *Collection) (a *collectionActivity, fresh bool) {
+	key := monitorKey(c.Meta.Namespace, c.Meta.Name)
+	m.mu.Lock()
+	a, ok := m.activity[key]
+	m.mu.Unlock()
+	if ok {
+		return a, false
+	}
+
+	size, err := c.Store.CountRecords(ctx)
+	if err != nil {
+		log.Printf("Warning: change monitor: failed to count %s: %v", key, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a, ok := m.activity[key]; ok {
+		return a, false
+	}
+	a = &collectionActivity{size: size, current: windowCounts{start: time.Now()}}
+	m.activity[key] = a
+	return a, true
+}
+
+// roll advances a's windows to now. Callers hold m.mu.
+func (m *ChangeMonitor) roll(a *collectionActivity, now time.Time) {
+	elapsed := now.Sub(a.current.start)
+	switch {
+	case elapsed >= 2*m.opts.Window:
+		a.last = windowCounts{}
+		a.current = windowCounts{start: now}
+	case elapsed >= m.opts.Window:
+		a.last = a.current
+		a.current = windowCounts{start: a.current.start.Add(m.opts.Window)}
+	}
+}
+
+// recent estimates a count over the last window, weighting the previous
+// window by how much of it still overlaps. Callers hold m.mu and have
+// rolled a.
+func (m *ChangeMonitor) recent(a *collectionActivity, now time.Time, kind changeKind) int64 {
+	overlap := 1 - float64(now.Sub(a.current.start))/float64(m.opts.Window)
+	return a.current.counts[kind] + int64(float64(a.last.counts[kind])*max(overlap, 0))
+}
+
+// beforeDelete checks whether c may delete a record: not while a mass
+// deletion awaits confirmation, nor, when blocking, if this delete flags one.
+func (m *ChangeMonitor) beforeDelete(ctx context.Context, c *Collection) error {
+	a, _ := m.tracked(ctx, c)
+	key := monitorKey(c.Meta.Namespace, c.Meta.Name)
+
+	m.mu.Lock()
+	if blocked := m.blockedBy[key]; blocked != nil {
+		m.mu.Unlock()
+		return fmt.Errorf("%w (anomaly %s)", ErrDeletesBlocked, blocked.Id)
+	}
+	now := time.Now()
+	m.roll(a, now)
+	deleted := m.recent(a, now, changeDelete)
+	observed := deleted + 1
+	baseline := a.size + deleted // Before the window's deletes
+	threshold := max(m.opts.MinMassDelete, int64(m.opts.MassDeleteFraction*float64(baseline)))
+	anomaly := m.flag(c, pb.AnomalyKind_ANOMALY_MASS_DELETION, observed, threshold, baseline, now)
+	if anomaly != nil && m.opts.BlockDeletes {
+		anomaly.Blocking = true
+		m.blockedBy[key] = anomaly
+	}
+	m.mu.Unlock()
+
+	if anomaly == nil {
+		return nil
+	}
+	m.notify(anomaly)
+	if anomaly.Blocking {
+		return fmt.Errorf("%w (anomaly %s)", ErrDeletesBlocked, anomaly.Id)
+	}
+	return nil
+}
+
+// observe records a change c made.
+func (m *ChangeMonitor) observe(ctx context.Context, c *Collection, kind changeKind) {
+	a, fresh := m.tracked(ctx, c)
+
+	m.mu.Lock()
+	now := time.Now()
+	m.roll(a, now)
+	a.current.counts[kind]++
+	switch {
+	case fresh:
+		// The count already includes this change
+	case kind == changeCreate:
+		a.size++
+	case kind == changeDelete:
+		a.size--
+	}
+
+	net := m.recent(a, now, changeCreate) - m.recent(a, now, changeDelete)
+	baseline := a.size - net
+	threshold := max(m.opts.MinGrowth, int64(m.opts.GrowthFactor*float64(baseline)))
+	anomaly := m.flag(c, pb.AnomalyKind_ANOMALY_RUNAWAY_GROWTH, net, threshold, baseline, now)
+	m.mu.Unlock()
+
+	if anomaly != nil {
+		m.notify(anomaly)
+	}
+}
+
+// flag records an anomaly of kind when observed reaches threshold, once per
+// excursion: the kind is flagged again only after falling back below it.
+// Callers hold m.mu.
+func (m *ChangeMonitor) flag(c *Collection, kind pb.AnomalyKind, observed, threshold, baseline int64, now time.Time) *pb.Anomaly {
+	key := monitorKey(c.Meta.Namespace, c.Meta.Name)
+	if m.flaggedNow[key] == nil {
+		m.flaggedNow[key] = make(map[pb.AnomalyKind]bool)
+	}
+	if observed < threshold {
+		delete(m.flaggedNow[key], kind)
+		return nil
+	}
+	if m.flaggedNow[key][kind] {
+		return nil
+	}
+	m.flaggedNow[key][kind] = true
+
+	what := "deletes"
+	if kind == pb.AnomalyKind_ANOMALY_RUNAWAY_GROWTH {
+		what = "net new records"
+	}
+	anomaly := &pb.Anomaly{
+		Id:             uuid.New().String(),
+		Namespace:      c.Meta.Namespace,
+		CollectionName: c.Meta.Name,
+		Kind:           kind,
+		Description: fmt.Sprintf("%d %s within %s in %s of about %d records (threshold %d)",
+			observed, what, m.opts.Window, key, baseline, threshold),
+		Observed:     observed,
+		Threshold:    threshold,
+		BaselineSize: baseline,
+		DetectedAt:   timestamppb.New(now),
+	}
+	m.anomalies = append(m.anomalies, anomaly)
+	if len(m.anomalies) > maxAnomalies {
+		m.anomalies = m.anomalies[len(m.anomalies)-maxAnomalies:]
+	}
+	return anomaly
+}
+
+func (m *ChangeMonitor) notify(anomaly *pb.Anomaly) {
+	if m.opts.OnAnomaly != nil {
+		m.opts.OnAnomaly(proto.Clone(anomaly).(*pb.Anomaly))
+	}
+}
+
+// Anomalies returns the anomalies flagged for a collection, most recent
+// first.
+func (m *ChangeMonitor) Anomalies(namespace, name string) []*pb.Anomaly {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var list []*pb.Anomaly
+	for i := len(m.anomalies) - 1; i >= 0; i-- {
+		if a := m.anomalies[i]; a.Namespace == namespace && a.CollectionName == name {
+			list = append(list, proto.Clone(a).(*pb.Anomaly))
+		}
+	}
+	return list
+}
+
+// Activity returns a collection's current change rates and estimated size.
+func (m *ChangeMonitor) Activity(namespace, name string) *pb.CollectionActivity {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	activity := &pb.CollectionActivity{WindowSeconds: int64(m.opts.Window.Seconds())}
+	a, ok := m.activity[monitorKey(namespace, name)]
+	if !ok {
+		return activity
+	}
+	now := time.Now()
+	m.roll(a, now)
+	writes := m.recent(a, now, changeCreate) + m.recent(a, now, changeUpdate)
+	activity.WritesPerSecond = float64(writes) / m.opts.Window.Seconds()
+	activity.DeletesPerSecond = float64(m.recent(a, now, changeDelete)) / m.opts.Window.Seconds()
+	activity.Size = a.size
+	return activity
+}
+
+// Confirm acknowledges an anomaly. Confirming a blocking mass deletion lets
+// deletes resume, and the deletes so far no longer count towards the next
+// one.
+func (m *ChangeMonitor) Confirm(namespace, name, id string) (*pb.Anomaly, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, anomaly := range m.anomalies {
+		if anomaly.Id != id || anomaly.Namespace != namespace || anomaly.CollectionName != name {
+			continue
+		}
+		if anomaly.ConfirmedAt == nil {
+			anomaly.ConfirmedAt = timestamppb.Now()
+		}
+		key := monitorKey(namespace, name)
+		if m.blockedBy[key] == anomaly {
+			delete(m.blockedBy, key)
+			delete(m.flaggedNow[key], pb.AnomalyKind_ANOMALY_MASS_DELETION)
+			if a := m.activity[key]; a != nil {
+				a.current.counts[changeDelete], a.last.counts[changeDelete] = 0, 0
+			}
+		}
+		return proto.Clone(anomaly).(*pb.Anomaly), nil
+	}
+	return nil, ErrAnomalyNotFound
+}
+
+// SetChangeMonitor enables the anomaly RPCs, reporting from monitor.
+func (s *CollectionServer) SetChangeMonitor(monitor *ChangeMonitor) {
+	s.monitor = monitor
+}
+
+func (s *CollectionServer) changeMonitor(ctx context.Context, namespace, name string) (*ChangeMonitor, error) {
+	if s.monitor == nil {
+		return nil, status.Error(codes.FailedPrecondition, "change monitoring is not enabled on this server")
+	}
+	if _, err := s.repo.GetCollection(ctx, namespace, name); err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	return s.monitor, nil
+}
+
+// ListAnomalies returns a collection's flagged anomalies and current rates.
+func (s *CollectionServer) ListAnomalies(ctx context.Context, req *pb.ListAnomaliesRequest) (*pb.ListAnomaliesResponse, error) {
+	monitor, err := s.changeMonitor(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ListAnomaliesResponse{
+		Status:    &pb.Status{Code: pb.Status_OK},
+		Anomalies: monitor.Anomalies(req.Namespace, req.CollectionName),
+		Activity:  monitor.Activity(req.Namespace, req.CollectionName),
+	}, nil
+}
+
+// ConfirmAnomaly acknowledges an anomaly, unblocking deletes it blocked.
+func (s *CollectionServer) ConfirmAnomaly(ctx context.Context, req *pb.ConfirmAnomalyRequest) (*pb.ConfirmAnomalyResponse, error) {
+	monitor, err := s.changeMonitor(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, err
+	}
+	anomaly, err := monitor.Confirm(req.Namespace, req.CollectionName, req.Id)
+	if errors.Is(err, ErrAnomalyNotFound) {
+		return nil, status.Errorf(codes.NotFound, "anomaly %s not found", req.Id)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	return &pb.ConfirmAnomalyResponse{Status: &pb.Status{Code: pb.Status_OK}, Anomaly: anomaly}, nil
+}
@@ -0,0 +1,134 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func setupMonitored(t *testing.T, opts collection.MonitorOptions) (*collection.CollectionServer, *[]*pb.Anomaly) {
+	t.Helper()
+	repo, cleanup := setupTestRepo(t)
+	t.Cleanup(cleanup)
+	if _, err := repo.CreateCollection(context.Background(), &pb.Collection{Namespace: "test", Name: "events"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	var (
+		mu      sync.Mutex
+		flagged []*pb.Anomaly
+	)
+	opts.OnAnomaly = func(a *pb.Anomaly) {
+		mu.Lock()
+		defer mu.Unlock()
+		flagged = append(flagged, a)
+	}
+	monitor := collection.NewChangeMonitor(opts)
+	repo.(*collection.DefaultCollectionRepo).SetChangeMonitor(monitor)
+	server := collection.NewCollectionServer(repo)
+	server.SetChangeMonitor(monitor)
+	return server, &flagged
+}
+
+func createEvents(t *testing.T, server *collection.CollectionServer, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := server.Create(context.Background(), &pb.CreateRequest{
+			Namespace: "test", CollectionName: "events", Id: fmt.Sprintf("e%d", i),
+			Item: &anypb.Any{Value: []byte(`{"kind": "click"}`)},
+		}); err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+}
+
+func deleteEvent(server *collection.CollectionServer, i int) error {
+	_, err := server.Delete(context.Background(), &pb.DeleteRequest{Namespace: "test", CollectionName: "events", Id: fmt.Sprintf("e%d", i)})
+	return err
+}
+
+func TestChangeMonitor_BlocksMassDeletion(t *testing.T) {
+	ctx := context.Background()
+	server, flagged := setupMonitored(t, collection.MonitorOptions{MinMassDelete: 3, MinGrowth: 100, BlockDeletes: true})
+	createEvents(t, server, 10)
+
+	// A quarter of 10 rounds down, so the minimum of 3 applies
+	for i := 0; i < 2; i++ {
+		if err := deleteEvent(server, i); err != nil {
+			t.Fatalf("Delete %d failed: %v", i, err)
+		}
+	}
+	if err := deleteEvent(server, 2); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected the third delete to be blocked, got %v", err)
+	}
+	if err := deleteEvent(server, 3); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected deletes to stay blocked, got %v", err)
+	}
+
+	list, err := server.ListAnomalies(ctx, &pb.ListAnomaliesRequest{Namespace: "test", CollectionName: "events"})
+	if err != nil {
+		t.Fatalf("ListAnomalies failed: %v", err)
+	}
+	if len(list.Anomalies) != 1 || len(*flagged) != 1 {
+		t.Fatalf("expected one anomaly, got %v (reported %v)", list.Anomalies, *flagged)
+	}
+	anomaly := list.Anomalies[0]
+	if anomaly.Kind != pb.AnomalyKind_ANOMALY_MASS_DELETION || !anomaly.Blocking || anomaly.Observed != 3 || anomaly.BaselineSize != 10 {
+		t.Errorf("unexpected anomaly %v", anomaly)
+	}
+	if list.Activity.Size != 8 || list.Activity.DeletesPerSecond <= 0 || list.Activity.WritesPerSecond <= 0 {
+		t.Errorf("unexpected activity %v", list.Activity)
+	}
+
+	confirmed, err := server.ConfirmAnomaly(ctx, &pb.ConfirmAnomalyRequest{Namespace: "test", CollectionName: "events", Id: anomaly.Id})
+	if err != nil || confirmed.Anomaly.ConfirmedAt == nil {
+		t.Fatalf("ConfirmAnomaly returned %v, %v", confirmed.GetAnomaly(), err)
+	}
+	if err := deleteEvent(server, 2); err != nil {
+		t.Errorf("expected deletes to resume after confirmation, got %v", err)
+	}
+
+	_, err = server.ConfirmAnomaly(ctx, &pb.ConfirmAnomalyRequest{Namespace: "test", CollectionName: "events", Id: "missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for a missing anomaly, got %v", err)
+	}
+}
+
+func TestChangeMonitor_FlagsGrowth(t *testing.T) {
+	ctx := context.Background()
+	server, flagged := setupMonitored(t, collection.MonitorOptions{MinGrowth: 5, MinMassDelete: 3})
+	createEvents(t, server, 8)
+
+	if len(*flagged) != 1 || (*flagged)[0].Kind != pb.AnomalyKind_ANOMALY_RUNAWAY_GROWTH || (*flagged)[0].Observed != 5 {
+		t.Fatalf("expected growth to be flagged once, got %v", *flagged)
+	}
+
+	// Without BlockDeletes, mass deletions are only reported
+	for i := 0; i < 4; i++ {
+		if err := deleteEvent(server, i); err != nil {
+			t.Fatalf("Delete %d failed: %v", i, err)
+		}
+	}
+	if len(*flagged) != 2 || (*flagged)[1].Kind != pb.AnomalyKind_ANOMALY_MASS_DELETION || (*flagged)[1].Blocking {
+		t.Errorf("expected a non-blocking mass deletion, got %v", *flagged)
+	}
+
+	if _, err := server.ListAnomalies(ctx, &pb.ListAnomaliesRequest{Namespace: "test", CollectionName: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for a missing collection, got %v", err)
+	}
+}
+
+func TestChangeMonitor_Unconfigured(t *testing.T) {
+	server := collection.NewCollectionServer(nil)
+	_, err := server.ListAnomalies(context.Background(), &pb.ListAnomaliesRequest{})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition without a monitor, got %v", err)
+	}
+}
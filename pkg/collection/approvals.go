@@ -0,0 +1,457 @@
+package collection
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// ApprovalsNamespace and ApprovalsCollection name the collection that
+	// conventionally holds approvals.
+	ApprovalsNamespace  = "system"
+	ApprovalsCollection = "approvals"
+
+	// ApprovalMetadataKey is the gRPC metadata header carrying the ID of the
+	// approval a held call is repeated with. Held calls also return it in a
+	// trailer of the same name.
+	ApprovalMetadataKey = "x-collector-approval"
+
+	// DefaultApprovalTTL is how long an approval can be decided and redeemed.
+	DefaultApprovalTTL = 24 * time.Hour
+)
+
+var (
+	// ErrApprovalNotFound is returned for approvals that do not exist.
+	ErrApprovalNotFound = errors.New("approval not found")
+	// ErrApprovalDenied is returned when a principal may not decide an
+	// approval: it requested it, is anonymous, or is not a listed approver.
+	ErrApprovalDenied = errors.New("principal may not decide this approval")
+	// ErrApprovalDecided is returned when deciding an approval that is no
+	// longer pending.
+	ErrApprovalDecided = errors.New("approval is no longer pending")
+)
+
+// ApprovalPolicy holds calls to a method until a second principal approves
+// them.
+type ApprovalPolicy struct {
+	// Method is the full gRPC method, e.g.
+	// "/collector.CollectionService/DeleteByFilter".
+	Method string
+	// Namespaces are path.Match patterns (e.g. "prod-*") for the namespaces
+	// the policy covers; empty covers every namespace. A request's namespace
+	// is its namespace or dest_namespace field, or that of its collection.
+	Namespaces []string
+	// Approvers, when set, are the only principals who may approve.
+	// Requesters can never approve their own calls.
+	Approvers []string
+	// TTL is how long the approval can be decided and redeemed; zero means
+	// DefaultApprovalTTL.
+	TTL time.Duration
+}
+
+func (p ApprovalPolicy) covers(method, namespace string) bool {
+	if p.Method != method {
+		return false
+	}
+	if len(p.Namespaces) == 0 {
+		return true
+	}
+	for _, pattern := range p.Namespaces {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ApprovalGate enforces two-person approval for the calls its policies
+// cover. Its interceptor holds a covered call as a pending approval; once a
+// different principal approves it, the requester repeats the identical call
+// with the approval's ID in the ApprovalMetadataKey header and it runs once.
+// Approvals are kept in a collection, conventionally system/approvals, as
+// JSON with proto field names.
+type ApprovalGate struct {
+	coll     *Collection
+	policies []ApprovalPolicy
+	mu       sync.Mutex // serializes read-modify-write of approvals
+}
+
+// NewApprovalGate creates a gate enforcing policies, keeping approvals in
+// coll.
+func NewApprovalGate(coll *Collection, policies []ApprovalPolicy) *ApprovalGate {
+	return &ApprovalGate{coll: coll, policies: policies}
+}
+
+func (g *ApprovalGate) policyFor(method, namespace string) (ApprovalPolicy, bool) {
+	for _, p := range g.policies {
+		if p.covers(method, namespace) {
+			return p, true
+		}
+	}
+	return ApprovalPolicy{}, false
+}
+
+// UnaryInterceptor returns a gRPC interceptor that holds covered calls for
+// approval. Callers must be authenticated (see AuthenticatedPrincipal), so
+// install it after a PrincipalAuthenticator.
+func (g *ApprovalGate) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return handler(ctx, req)
+		}
+		namespace := requestNamespace(msg.ProtoReflect())
+		policy, ok := g.policyFor(info.FullMethod, namespace)
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		requester := AuthenticatedPrincipal(ctx)
+		if requester == "" {
+			return nil, status.Errorf(codes.PermissionDenied, "%s requires approval, and approvals require an authenticated principal", info.FullMethod)
+		}
+		digest, err := requestDigest(msg)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to digest request: %v", err)
+		}
+
+		if id := incomingMetadata(ctx, ApprovalMetadataKey); id != "" {
+			if err := g.redeem(ctx, id, info.FullMethod, requester, digest); err != nil {
+				return nil, err
+			}
+			return handler(context.WithValue(ctx, approvedKey{}, true), req)
+		}
+
+		approval, err := g.hold(ctx, policy, info.FullMethod, namespace, requester, msg, digest)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to hold request for approval: %v", err)
+		}
+		_ = grpc.SetTrailer(ctx, metadata.Pairs(ApprovalMetadataKey, approval.Id))
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"%s requires approval by another principal: approval %s is pending; repeat the call with %s: %s once approved",
+			info.FullMethod, approval.Id, ApprovalMetadataKey, approval.Id)
+	}
+}
+
+type approvedKey struct{}
+
+// isApproved reports whether a call is running on an approval redeemed by an
+// ApprovalGate.
+func isApproved(ctx context.Context) bool {
+	approved, _ := ctx.Value(approvedKey{}).(bool)
+	return approved
+}
+
+// requestNamespace returns the namespace a request targets: its namespace or
+// dest_namespace field, or that of its collection field.
+func requestNamespace(m protoreflect.Message) string {
+	fields := m.Descriptor().Fields()
+	for _, name := range []protoreflect.Name{"namespace", "dest_namespace"} {
+		if f := fields.ByName(name); f != nil && f.Kind() == protoreflect.StringKind && f.Cardinality() != protoreflect.Repeated {
+			if v := m.Get(f).String(); v != "" {
+				return v
+			}
+		}
+	}
+	if f := fields.ByName("collection"); f != nil && f.Kind() == protoreflect.MessageKind && f.Cardinality() != protoreflect.Repeated && m.Has(f) {
+		return requestNamespace(m.Get(f).Message())
+	}
+	return ""
+}
+
+func requestDigest(m proto.Message) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (g *ApprovalGate) hold(ctx context.Context, policy ApprovalPolicy, method, namespace, requester string, req proto.Message, digest string) (*pb.Approval, error) {
+	held, err := anypb.New(req)
+	if err != nil {
+		return nil, err
+	}
+	ttl := policy.TTL
+	if ttl <= 0 {
+		ttl = DefaultApprovalTTL
+	}
+	now := time.Now()
+	approval := &pb.Approval{
+		Id:            uuid.New().String(),
+		Method:        method,
+		Namespace:     namespace,
+		RequestedBy:   requester,
+		Request:       held,
+		RequestDigest: digest,
+		State:         pb.ApprovalState_APPROVAL_PENDING,
+		CreatedAt:     timestamppb.New(now),
+		ExpiresAt:     timestamppb.New(now.Add(ttl)),
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.save(ctx, approval, true); err != nil {
+		return nil, err
+	}
+	return approval, nil
+}
+
+// redeem checks that an approved approval matches a repeated call and marks
+// it executed, returning a gRPC status error otherwise.
+func (g *ApprovalGate) redeem(ctx context.Context, id, method, requester, digest string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	approval, err := g.get(ctx, id)
+	if errors.Is(err, ErrApprovalNotFound) {
+		return status.Errorf(codes.NotFound, "approval %s not found", id)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "%v", err)
+	}
+	if approval.Method != method || approval.RequestedBy != requester || approval.RequestDigest != digest {
+		return status.Errorf(codes.PermissionDenied, "approval %s does not cover this call", id)
+	}
+	if approval.State != pb.ApprovalState_APPROVAL_APPROVED {
+		return status.Errorf(codes.FailedPrecondition, "approval %s is %s", id, approvalStateName(approval.State))
+	}
+
+	approval.State = pb.ApprovalState_APPROVAL_EXECUTED
+	if err := g.save(ctx, approval, false); err != nil {
+		return status.Errorf(codes.Internal, "failed to redeem approval %s: %v", id, err)
+	}
+	return nil
+}
+
+// Get returns an approval, or ErrApprovalNotFound.
+func (g *ApprovalGate) Get(ctx context.Context, id string) (*pb.Approval, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.get(ctx, id)
+}
+
+// get reads an approval, expiring it if its TTL has passed. Callers hold
+// g.mu.
+func (g *ApprovalGate) get(ctx context.Context, id string) (*pb.Approval, error) {
+	record, err := g.coll.GetRecord(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrApprovalNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read approval %s: %w", id, err)
+	}
+	approval, err := decodeApproval(record.ProtoData)
+	if err != nil {
+		return nil, err
+	}
+	if g.expire(approval) {
+		if err := g.save(ctx, approval, false); err != nil {
+			return nil, err
+		}
+	}
+	return approval, nil
+}
+
+// expire marks an undecided or unredeemed approval past its TTL expired and
+// reports whether it did.
+func (g *ApprovalGate) expire(approval *pb.Approval) bool {
+	switch approval.State {
+	case pb.ApprovalState_APPROVAL_PENDING, pb.ApprovalState_APPROVAL_APPROVED:
+		if approval.ExpiresAt != nil && time.Now().After(approval.ExpiresAt.AsTime()) {
+			approval.State = pb.ApprovalState_APPROVAL_EXPIRED
+			return true
+		}
+	}
+	return false
+}
+
+func (g *ApprovalGate) save(ctx context.Context, approval *pb.Approval, create bool) error {
+	data, err := jobJSON.Marshal(approval)
+	if err != nil {
+		return fmt.Errorf("failed to encode approval: %w", err)
+	}
+	record := &pb.CollectionRecord{Id: approval.Id, ProtoData: data, Metadata: &pb.Metadata{
+		CreatedAt: approval.CreatedAt,
+		UpdatedAt: timestamppb.Now(),
+		Labels: map[string]string{
+			"namespace": approval.Namespace,
+			"state":     approvalStateName(approval.State),
+		},
+	}}
+	if create {
+		return g.coll.CreateRecord(ctx, record)
+	}
+	return g.coll.UpdateRecord(ctx, record)
+}
+
+func decodeApproval(data []byte) (*pb.Approval, error) {
+	approval := &pb.Approval{}
+	if err := protojson.Unmarshal(data, approval); err != nil {
+		return nil, fmt.Errorf("failed to decode approval: %w", err)
+	}
+	return approval, nil
+}
+
+func approvalStateName(state pb.ApprovalState) string {
+	return strings.ToLower(strings.TrimPrefix(state.String(), "APPROVAL_"))
+}
+
+// List returns approvals newest first, limited to a namespace when it is
+// set. Only pending approvals are listed unless includeDecided is set.
+func (g *ApprovalGate) List(ctx context.Context, namespace string, includeDecided bool) ([]*pb.Approval, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	query := &SearchQuery{LabelFilters: map[string]string{}}
+	if namespace != "" {
+		query.LabelFilters["namespace"] = namespace
+	}
+	if !includeDecided {
+		query.LabelFilters["state"] = approvalStateName(pb.ApprovalState_APPROVAL_PENDING)
+	}
+	results, err := g.coll.Search(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list approvals: %w", err)
+	}
+	list := make([]*pb.Approval, 0, len(results))
+	for _, r := range results {
+		approval, err := decodeApproval(r.Record.ProtoData)
+		if err != nil {
+			continue
+		}
+		if g.expire(approval) {
+			if err := g.save(ctx, approval, false); err != nil {
+				return nil, err
+			}
+			if !includeDecided {
+				continue
+			}
+		}
+		list = append(list, approval)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.AsTime().After(list[j].CreatedAt.AsTime())
+	})
+	return list, nil
+}
+
+// Approve approves a pending approval on behalf of approver, who must not
+// have requested it and, if the covering policy lists approvers, must be one
+// of them.
+func (g *ApprovalGate) Approve(ctx context.Context, id, approver, reason string) (*pb.Approval, error) {
+	return g.decide(ctx, id, approver, reason, pb.ApprovalState_APPROVAL_APPROVED)
+}
+
+// Reject rejects a pending approval on behalf of approver, under the same
+// rules as Approve.
+func (g *ApprovalGate) Reject(ctx context.Context, id, approver, reason string) (*pb.Approval, error) {
+	return g.decide(ctx, id, approver, reason, pb.ApprovalState_APPROVAL_REJECTED)
+}
+
+func (g *ApprovalGate) decide(ctx context.Context, id, approver, reason string, state pb.ApprovalState) (*pb.Approval, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	approval, err := g.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if approver == "" || approver == approval.RequestedBy {
+		return nil, ErrApprovalDenied
+	}
+	if policy, ok := g.policyFor(approval.Method, approval.Namespace); ok && len(policy.Approvers) > 0 && !slices.Contains(policy.Approvers, approver) {
+		return nil, ErrApprovalDenied
+	}
+	if approval.State != pb.ApprovalState_APPROVAL_PENDING {
+		return nil, fmt.Errorf("%w: approval %s is %s", ErrApprovalDecided, id, approvalStateName(approval.State))
+	}
+
+	approval.State = state
+	approval.DecidedBy = approver
+	approval.Reason = reason
+	approval.DecidedAt = timestamppb.Now()
+	if err := g.save(ctx, approval, false); err != nil {
+		return nil, err
+	}
+	return approval, nil
+}
+
+// SetApprovalGate enables the approval RPCs, deciding approvals held by
+// gate. The gate's UnaryInterceptor must also be installed on the server.
+func (s *GrpcServer) SetApprovalGate(gate *ApprovalGate) {
+	s.approvals = gate
+}
+
+func approvalErrorStatus(err error) *pb.Status {
+	switch {
+	case errors.Is(err, ErrApprovalNotFound):
+		return &pb.Status{Code: pb.Status_NOT_FOUND, Message: err.Error()}
+	case errors.Is(err, ErrApprovalDenied):
+		return &pb.Status{Code: pb.Status_PERMISSION_DENIED, Message: err.Error()}
+	case errors.Is(err, ErrApprovalDecided):
+		return &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: err.Error()}
+	}
+	return &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()}
+}
+
+var errApprovalsDisabled = &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: "approvals are not enabled on this server"}
+
+// ListApprovals lists held requests, pending ones by default.
+func (s *GrpcServer) ListApprovals(ctx context.Context, req *pb.ListApprovalsRequest) (*pb.ListApprovalsResponse, error) {
+	if s.approvals == nil {
+		return &pb.ListApprovalsResponse{Status: errApprovalsDisabled}, nil
+	}
+	list, err := s.approvals.List(ctx, req.Namespace, req.IncludeDecided)
+	if err != nil {
+		return &pb.ListApprovalsResponse{Status: approvalErrorStatus(err)}, nil
+	}
+	return &pb.ListApprovalsResponse{Status: &pb.Status{Code: pb.Status_OK}, Approvals: list}, nil
+}
+
+// Approve approves a held request on behalf of the calling principal.
+func (s *GrpcServer) Approve(ctx context.Context, req *pb.ApproveRequest) (*pb.ApproveResponse, error) {
+	if s.approvals == nil {
+		return &pb.ApproveResponse{Status: errApprovalsDisabled}, nil
+	}
+	approval, err := s.approvals.Approve(ctx, req.Id, AuthenticatedPrincipal(ctx), req.Reason)
+	if err != nil {
+		return &pb.ApproveResponse{Status: approvalErrorStatus(err)}, nil
+	}
+	return &pb.ApproveResponse{Status: &pb.Status{Code: pb.Status_OK, Message: "Approved"}, Approval: approval}, nil
+}
+
+// Reject rejects a held request on behalf of the calling principal.
+func (s *GrpcServer) Reject(ctx context.Context, req *pb.RejectRequest) (*pb.RejectResponse, error) {
+	if s.approvals == nil {
+		return &pb.RejectResponse{Status: errApprovalsDisabled}, nil
+	}
+	approval, err := s.approvals.Reject(ctx, req.Id, AuthenticatedPrincipal(ctx), req.Reason)
+	if err != nil {
+		return &pb.RejectResponse{Status: approvalErrorStatus(err)}, nil
+	}
+	return &pb.RejectResponse{Status: &pb.Status{Code: pb.Status_OK, Message: "Rejected"}, Approval: approval}, nil
+}
@@ -0,0 +1,158 @@
+package collection_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const deleteByFilterMethod = "/collector.CollectionService/DeleteByFilter"
+
+func setupApprovals(t *testing.T) (*collection.ApprovalGate, *collection.GrpcServer) {
+	t.Helper()
+	store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), "approvals.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	coll, err := collection.NewCollection(
+		&pb.Collection{Namespace: collection.ApprovalsNamespace, Name: collection.ApprovalsCollection},
+		store, &collection.LocalFileSystem{},
+	)
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	gate := collection.NewApprovalGate(coll, []collection.ApprovalPolicy{{
+		Method:     deleteByFilterMethod,
+		Namespaces: []string{"prod-*"},
+		Approvers:  []string{"bob", "carol"},
+	}})
+
+	repo, cleanup := setupTestRepo(t)
+	t.Cleanup(cleanup)
+	server := collection.NewGrpcServer(repo)
+	server.SetApprovalGate(gate)
+	return gate, server
+}
+
+func TestApprovalGate(t *testing.T) {
+	gate, server := setupApprovals(t)
+	auth := collection.NewPrincipalAuthenticator(collection.PrincipalAuthenticatorOptions{
+		Tokens: map[string]string{"alice-token": "alice", "bob-token": "bob"},
+	}).UnaryInterceptor()
+	interceptor := gate.UnaryInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: deleteByFilterMethod}
+	executed := 0
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		executed++
+		return &pb.DeleteByFilterResponse{}, nil
+	}
+	send := func(md metadata.MD, req *pb.DeleteByFilterRequest) error {
+		_, err := auth(metadata.NewIncomingContext(context.Background(), md), req, info, func(ctx context.Context, req any) (any, error) {
+			return interceptor(ctx, req, info, handler)
+		})
+		return err
+	}
+	call := func(principal, approval string, req *pb.DeleteByFilterRequest) error {
+		md := metadata.MD{}
+		if principal != "" {
+			md.Append(collection.AuthorizationMetadataKey, "Bearer "+principal+"-token")
+		}
+		if approval != "" {
+			md.Append(collection.ApprovalMetadataKey, approval)
+		}
+		return send(md, req)
+	}
+	req := &pb.DeleteByFilterRequest{Namespace: "prod-eu", CollectionName: "orders", Filter: &pb.SearchRequest{FullText: "test"}}
+
+	// Uncovered namespaces run directly; covered calls need an authenticated principal
+	if err := call("", "", &pb.DeleteByFilterRequest{Namespace: "staging"}); err != nil || executed != 1 {
+		t.Fatalf("expected an uncovered call to run, got %v", err)
+	}
+	if err := call("", "", req); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for an anonymous call, got %v", err)
+	}
+	if err := send(metadata.Pairs(collection.PrincipalMetadataKey, "alice"), req); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected a principal named only in the header to be anonymous, got %v", err)
+	}
+	if err := call("mallory", "", req); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected an unknown token refused, got %v", err)
+	}
+	if err := call("alice", "", req); status.Code(err) != codes.FailedPrecondition || executed != 1 {
+		t.Fatalf("expected the call to be held, got %v", err)
+	}
+
+	ctx := context.Background()
+	list, err := server.ListApprovals(ctx, &pb.ListApprovalsRequest{Namespace: "prod-eu"})
+	if err != nil || len(list.Approvals) != 1 {
+		t.Fatalf("expected one pending approval, got %v (%v)", list.GetApprovals(), err)
+	}
+	approval := list.Approvals[0]
+	if approval.RequestedBy != "alice" || approval.Method != deleteByFilterMethod || approval.State != pb.ApprovalState_APPROVAL_PENDING {
+		t.Errorf("unexpected approval %v", approval)
+	}
+
+	for principal, code := range map[string]pb.Status_Code{"alice": pb.Status_PERMISSION_DENIED, "mallory": pb.Status_PERMISSION_DENIED, "": pb.Status_PERMISSION_DENIED} {
+		resp, _ := server.Approve(collection.WithPrincipal(ctx, principal), &pb.ApproveRequest{Id: approval.Id})
+		if resp.Status.Code != code {
+			t.Errorf("approval by %q: expected %v, got %v", principal, code, resp.Status)
+		}
+	}
+	headerOnly := metadata.NewIncomingContext(ctx, metadata.Pairs(collection.PrincipalMetadataKey, "bob"))
+	if resp, _ := server.Approve(headerOnly, &pb.ApproveRequest{Id: approval.Id}); resp.Status.Code != pb.Status_PERMISSION_DENIED {
+		t.Errorf("expected an approver named only in the header refused, got %v", resp.Status)
+	}
+	if err := call("alice", approval.Id, req); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a pending approval not to be redeemable, got %v", err)
+	}
+
+	resp, err := server.Approve(collection.WithPrincipal(ctx, "bob"), &pb.ApproveRequest{Id: approval.Id, Reason: "ticket 42"})
+	if err != nil || resp.Status.Code != pb.Status_OK || resp.Approval.DecidedBy != "bob" {
+		t.Fatalf("Approve returned %v, %v", resp.GetStatus(), err)
+	}
+	again, _ := server.Reject(collection.WithPrincipal(ctx, "carol"), &pb.RejectRequest{Id: approval.Id})
+	if again.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected a decided approval to stay decided, got %v", again.Status)
+	}
+
+	// The approval covers only the identical call, by its requester, once
+	changed := &pb.DeleteByFilterRequest{Namespace: "prod-eu", CollectionName: "orders", Filter: &pb.SearchRequest{FullText: "all"}}
+	if err := call("alice", approval.Id, changed); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected a different request to be refused, got %v", err)
+	}
+	if err := call("bob", approval.Id, req); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected another principal to be refused, got %v", err)
+	}
+	if err := call("alice", approval.Id, req); err != nil || executed != 2 {
+		t.Fatalf("expected the approved call to run, got %v", err)
+	}
+	if err := call("alice", approval.Id, req); status.Code(err) != codes.FailedPrecondition || executed != 2 {
+		t.Errorf("expected the approval to be used up, got %v", err)
+	}
+
+	list, _ = server.ListApprovals(ctx, &pb.ListApprovalsRequest{})
+	if len(list.Approvals) != 0 {
+		t.Errorf("expected no pending approvals, got %v", list.Approvals)
+	}
+	list, _ = server.ListApprovals(ctx, &pb.ListApprovalsRequest{IncludeDecided: true})
+	if len(list.Approvals) != 1 || list.Approvals[0].State != pb.ApprovalState_APPROVAL_EXECUTED {
+		t.Errorf("expected the executed approval, got %v", list.Approvals)
+	}
+}
+
+func TestApprovals_Disabled(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	resp, err := collection.NewGrpcServer(repo).Approve(context.Background(), &pb.ApproveRequest{Id: "x"})
+	if err != nil || resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION without a gate, got %v, %v", resp.GetStatus(), err)
+	}
+}
@@ -0,0 +1,254 @@
+package collection
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+const (
+	DefaultArtifactWorkers      = 2
+	DefaultArtifactMaxAttempts  = 3
+	DefaultArtifactRetryBackoff = 500 * time.Millisecond
+	DefaultArtifactQueueSize    = 100
+)
+
+// DerivedFile is one output of an ArtifactProcessor. It is stored as an
+// attachment named "<source name>.<Name>", e.g. "photo.jpg.thumb.png".
+type DerivedFile struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// ArtifactProcessor turns an uploaded attachment into derived files, such as
+// image thumbnails or document previews.
+type ArtifactProcessor interface {
+	// Name identifies the processor; it is recorded on derived attachments.
+	Name() string
+	// Accepts reports whether the processor handles the content type.
+	Accepts(contentType string) bool
+	Process(ctx context.Context, src *pb.Attachment, content []byte) ([]DerivedFile, error)
+}
+
+// ArtifactPipelineOptions configures an ArtifactPipeline.
+type ArtifactPipelineOptions struct {
+	Workers      int
+	MaxAttempts  int           // Attempts per job, including the first
+	RetryBackoff time.Duration // Doubles after every failed attempt
+	QueueSize    int
+
+	// Defaults run for collections without their own configuration.
+	Defaults []ArtifactProcessor
+}
+
+// ArtifactStats counts pipeline jobs.
+type ArtifactStats struct {
+	Processed int64 // Jobs that stored their outputs
+	Failed    int64 // Jobs that failed every attempt
+	Retries   int64
+}
+
+type artifactJob struct {
+	collection *Collection
+	recordID   string
+	src        *pb.Attachment
+	content    []byte
+	processor  ArtifactProcessor
+}
+
+// ArtifactPipeline runs ArtifactProcessors over new attachments on a pool of
+// background workers, retrying failed jobs with exponential backoff. Jobs are
+// held in memory; those still queued when the pipeline stops are dropped.
+type ArtifactPipeline struct {
+	opts ArtifactPipelineOptions
+
+	mu         sync.RWMutex
+	processors map[string][]ArtifactProcessor // "namespace/name" -> processors
+
+	jobs    chan artifactJob
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+	stop    chan struct{}
+	stopped sync.Once
+
+	processed, failed, retries atomic.Int64
+}
+
+// NewArtifactPipeline creates a pipeline and starts its workers.
+func NewArtifactPipeline(opts ArtifactPipelineOptions) *ArtifactPipeline {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultArtifactWorkers
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultArtifactMaxAttempts
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = DefaultArtifactRetryBackoff
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultArtifactQueueSize
+	}
+
+	p := &ArtifactPipeline{
+		opts:       opts,
+		processors: make(map[string][]ArtifactProcessor),
+		jobs:       make(chan artifactJob, opts.QueueSize),
+		stop:       make(chan struct{}),
+	}
+	for i := 0; i < opts.Workers; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// Configure sets the processors for one collection, replacing the defaults.
+// Configuring no processors disables post-processing for the collection.
+func (p *ArtifactPipeline) Configure(namespace, name string, processors ...ArtifactProcessor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processors[namespace+"/"+name] = processors
+}
+
+func (p *ArtifactPipeline) processorsFor(c *Collection) []ArtifactProcessor {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if processors, ok := p.processors[c.Meta.Namespace+"/"+c.Meta.Name]; ok {
+		return processors
+	}
+	return p.opts.Defaults
+}
+
+// Enqueue queues a job for every processor of c that accepts src. It blocks
+// while the queue is full, until space frees up or ctx is done.
+func (p *ArtifactPipeline) Enqueue(ctx context.Context, c *Collection, recordID string, src *pb.Attachment, content []byte) error {
+	for _, proc := range p.processorsFor(c) {
+		if !proc.Accepts(src.ContentType) {
+			continue
+		}
+		p.pending.Add(1)
+		select {
+		case p.jobs <- artifactJob{collection: c, recordID: recordID, src: src, content: content, processor: proc}:
+		case <-p.stop:
+			p.pending.Done()
+			return fmt.Errorf("artifact pipeline is stopped")
+		case <-ctx.Done():
+			p.pending.Done()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (p *ArtifactPipeline) work() {
+	defer p.workers.Done()
+	for {
+		select {
+		case job := <-p.jobs:
+			p.run(job)
+			p.pending.Done()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// run processes a job, retrying until it succeeds, exhausts its attempts, or
+// its record disappears.
+func (p *ArtifactPipeline) run(job artifactJob) {
+	ctx := context.Background()
+	backoff := p.opts.RetryBackoff
+	name := job.processor.Name()
+
+	for attempt := 1; ; attempt++ {
+		err := p.process(ctx, job)
+		if err == nil {
+			p.processed.Add(1)
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			// The record or source was deleted while the job was queued
+			return
+		}
+		if attempt >= p.opts.MaxAttempts {
+			p.failed.Add(1)
+			log.Printf("Warning: %s failed for %s after %d attempts: %v", name, job.src.Uri, attempt, err)
+			return
+		}
+
+		p.retries.Add(1)
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *ArtifactPipeline) process(ctx context.Context, job artifactJob) error {
+	if current, err := job.collection.attachment(ctx, job.recordID, job.src.Name); err != nil {
+		return err
+	} else if current.Sha256 != job.src.Sha256 {
+		// Replaced since queuing; the replacement has its own job
+		return sql.ErrNoRows
+	}
+
+	files, err := job.processor.Process(ctx, job.src, job.content)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		derived := &pb.Attachment{
+			Name:        job.src.Name + "." + f.Name,
+			ContentType: f.ContentType,
+			DerivedFrom: job.src.Name,
+			Processor:   job.processor.Name(),
+		}
+		if _, err := job.collection.putAttachment(ctx, job.recordID, derived, f.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait blocks until every queued job has finished or ctx is done.
+func (p *ArtifactPipeline) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns job counts since the pipeline started.
+func (p *ArtifactPipeline) Stats() ArtifactStats {
+	return ArtifactStats{
+		Processed: p.processed.Load(),
+		Failed:    p.failed.Load(),
+		Retries:   p.retries.Load(),
+	}
+}
+
+// Stop stops the workers. Running jobs finish their current attempt; queued
+// jobs are dropped.
+func (p *ArtifactPipeline) Stop() {
+	p.stopped.Do(func() {
+		close(p.stop)
+		p.workers.Wait()
+	})
+}
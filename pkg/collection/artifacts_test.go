@@ -0,0 +1,155 @@
+package collection_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// flakyProcessor fails its first failures calls, then emits a text summary.
+type flakyProcessor struct {
+	failures int32
+	calls    atomic.Int32
+}
+
+func (f *flakyProcessor) Name() string                    { return "summary" }
+func (f *flakyProcessor) Accepts(contentType string) bool { return true }
+func (f *flakyProcessor) Process(ctx context.Context, src *pb.Attachment, content []byte) ([]collection.DerivedFile, error) {
+	if f.calls.Add(1) <= f.failures {
+		return nil, errors.New("transient failure")
+	}
+	return []collection.DerivedFile{{Name: "summary.txt", ContentType: "text/plain", Content: []byte(src.Name)}}, nil
+}
+
+func setupPipelineCollection(t *testing.T, opts collection.ArtifactPipelineOptions) (*collection.Collection, *collection.ArtifactPipeline) {
+	t.Helper()
+	coll, cleanup := setupTestCollection(t)
+	t.Cleanup(cleanup)
+
+	pipeline := collection.NewArtifactPipeline(opts)
+	t.Cleanup(pipeline.Stop)
+	coll.Artifacts = pipeline
+
+	if err := coll.CreateRecord(context.Background(), &pb.CollectionRecord{Id: "doc", ProtoData: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	return coll, pipeline
+}
+
+func waitForPipeline(t *testing.T, p *collection.ArtifactPipeline) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Wait(ctx); err != nil {
+		t.Fatalf("pipeline did not drain: %v", err)
+	}
+}
+
+func TestArtifactPipeline_Thumbnail(t *testing.T) {
+	ctx := context.Background()
+	coll, pipeline := setupPipelineCollection(t, collection.ArtifactPipelineOptions{
+		Defaults: []collection.ArtifactProcessor{&collection.ThumbnailProcessor{MaxSize: 64}},
+	})
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 200, 100))); err != nil {
+		t.Fatalf("failed to encode image: %v", err)
+	}
+	if _, err := coll.AddAttachment(ctx, "doc", "photo", "", img.Bytes()); err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+	// Non-images are not thumbnailed
+	if _, err := coll.AddAttachment(ctx, "doc", "notes.txt", "", []byte("text")); err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+	waitForPipeline(t, pipeline)
+
+	attachments, err := coll.ListAttachments(ctx, "doc")
+	if err != nil {
+		t.Fatalf("ListAttachments failed: %v", err)
+	}
+	if len(attachments) != 3 {
+		t.Fatalf("expected 3 attachments, got %v", attachments)
+	}
+	thumb := attachments[2]
+	if thumb.Name != "photo.thumb.png" || thumb.DerivedFrom != "photo" || thumb.Processor != "thumbnail" {
+		t.Fatalf("unexpected derived attachment: %+v", thumb)
+	}
+	content, err := coll.FS.Load(ctx, thumb.Uri)
+	if err != nil {
+		t.Fatalf("failed to load thumbnail: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("failed to decode thumbnail: %v", err)
+	}
+	if size := decoded.Bounds().Size(); size.X != 64 || size.Y != 32 {
+		t.Errorf("expected a 64x32 thumbnail, got %v", size)
+	}
+
+	// Removing the source removes what was derived from it
+	if err := coll.RemoveAttachment(ctx, "doc", "photo"); err != nil {
+		t.Fatalf("RemoveAttachment failed: %v", err)
+	}
+	if remaining, _ := coll.ListAttachments(ctx, "doc"); len(remaining) != 1 || remaining[0].Name != "notes.txt" {
+		t.Errorf("expected only notes.txt to remain, got %v", remaining)
+	}
+}
+
+func TestArtifactPipeline_Retries(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyProcessor{failures: 2}
+	coll, pipeline := setupPipelineCollection(t, collection.ArtifactPipelineOptions{
+		MaxAttempts:  3,
+		RetryBackoff: time.Millisecond,
+		Defaults:     []collection.ArtifactProcessor{flaky},
+	})
+
+	if _, err := coll.AddAttachment(ctx, "doc", "a.bin", "", []byte{1}); err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+	waitForPipeline(t, pipeline)
+	if stats := pipeline.Stats(); stats.Processed != 1 || stats.Retries != 2 || stats.Failed != 0 {
+		t.Errorf("unexpected stats after recovery: %+v", stats)
+	}
+
+	flaky.failures = 100
+	if _, err := coll.AddAttachment(ctx, "doc", "b.bin", "", []byte{2}); err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+	waitForPipeline(t, pipeline)
+	if stats := pipeline.Stats(); stats.Failed != 1 {
+		t.Errorf("expected one failed job, got %+v", stats)
+	}
+
+	attachments, _ := coll.ListAttachments(ctx, "doc")
+	if len(attachments) != 3 || attachments[1].Name != "a.bin.summary.txt" {
+		t.Errorf("expected only a.bin to have a summary, got %v", attachments)
+	}
+}
+
+func TestArtifactPipeline_PerCollectionConfig(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyProcessor{}
+	coll, pipeline := setupPipelineCollection(t, collection.ArtifactPipelineOptions{
+		Defaults: []collection.ArtifactProcessor{flaky},
+	})
+
+	// An explicit empty configuration turns processing off for the collection
+	pipeline.Configure(coll.GetNamespace(), coll.GetName())
+	if _, err := coll.AddAttachment(ctx, "doc", "a.bin", "", []byte{1}); err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+	waitForPipeline(t, pipeline)
+	if flaky.calls.Load() != 0 {
+		t.Errorf("expected the default processor to be skipped, got %d calls", flaky.calls.Load())
+	}
+}
@@ -0,0 +1,296 @@
+package collection
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ErrInvalidAttachmentName is returned for attachment names that are empty or
+// contain path separators.
+var ErrInvalidAttachmentName = errors.New("attachment name must be a plain file name")
+
+// AttachmentsNamespace is the FileSystem directory holding every
+// collection's attachments. It is reserved as a namespace: a collection in it
+// would otherwise have its own directory inside another namespace's
+// attachments.
+const AttachmentsNamespace = "attachments"
+
+// ErrReservedNamespace is returned when creating a collection in, or renaming
+// a namespace to, AttachmentsNamespace.
+var ErrReservedNamespace = fmt.Errorf("namespace %q is reserved", AttachmentsNamespace)
+
+// AttachmentStore is implemented by stores that keep metadata for files
+// attached to records. Attachment content lives in the collection FileSystem.
+type AttachmentStore interface {
+	// PutAttachment records (or replaces) an attachment with its extracted
+	// text, indexes that text with the record, and sets the record's data_uri.
+	// It returns sql.ErrNoRows if the record does not exist.
+	PutAttachment(ctx context.Context, recordID string, a *pb.Attachment, text, dataURI string) error
+	ListAttachments(ctx context.Context, recordID string) ([]*pb.Attachment, error)
+	// DeleteAttachment removes an attachment, clearing the record's data_uri
+	// once none remain. It returns sql.ErrNoRows if the attachment does not exist.
+	DeleteAttachment(ctx context.Context, recordID, name string) error
+}
+
+func (c *Collection) attachmentStore() (AttachmentStore, error) {
+	as, ok := c.Store.(AttachmentStore)
+	if !ok {
+		return nil, fmt.Errorf("collection store does not support attachments")
+	}
+	if c.FS == nil {
+		return nil, fmt.Errorf("collection has no filesystem for attachments")
+	}
+	return as, nil
+}
+
+// AttachmentDir is the FileSystem directory holding a record's attachments,
+// and the record's data_uri while it has any.
+func (c *Collection) AttachmentDir(recordID string) string {
+	return path.Join(AttachmentsNamespace, c.Meta.Namespace, c.Meta.Name, url.PathEscape(recordID))
+}
+
+// AddAttachment stores content as a named attachment of a record, replacing an
+// existing attachment with the same name. An empty contentType is detected
+// from the content and name. Text is extracted for full-text search when the
+// collection has an extractor for the content type; extraction failures are
+// logged and leave the attachment unindexed. If the collection has an
+// artifact pipeline, the attachment is queued for post-processing.
+func (c *Collection) AddAttachment(ctx context.Context, recordID, name, contentType string, content []byte) (*pb.Attachment, error) {
+	attachment, err := c.putAttachment(ctx, recordID, &pb.Attachment{Name: name, ContentType: contentType}, content)
+	if err != nil {
+		return nil, err
+	}
+	if c.Artifacts != nil {
+		if err := c.Artifacts.Enqueue(ctx, c, recordID, attachment, content); err != nil {
+			log.Printf("Warning: failed to queue %s for processing: %v", attachment.Uri, err)
+		}
+	}
+	return attachment, nil
+}
+
+// putAttachment saves content and records metadata for a, filling in its
+// content type, checksum and location.
+func (c *Collection) putAttachment(ctx context.Context, recordID string, a *pb.Attachment, content []byte) (*pb.Attachment, error) {
+	as, err := c.attachmentStore()
+	if err != nil {
+		return nil, err
+	}
+	if a.Name == "" || a.Name == "." || a.Name == ".." || strings.ContainsAny(a.Name, `/\`) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAttachmentName, a.Name)
+	}
+	if _, err := c.Store.GetRecord(ctx, recordID); err != nil {
+		return nil, err
+	}
+
+	if a.ContentType == "" {
+		a.ContentType = DetectContentType(a.Name, content)
+	}
+	sum := sha256.Sum256(content)
+	dir := c.AttachmentDir(recordID)
+	a.Size = int64(len(content))
+	a.Sha256 = hex.EncodeToString(sum[:])
+	a.Uri = path.Join(dir, a.Name)
+	a.CreatedAt = timestamppb.New(c.now())
+
+	if err := c.FS.Save(ctx, a.Uri, content); err != nil {
+		return nil, fmt.Errorf("failed to save attachment: %w", err)
+	}
+	text := c.extractText(ctx, a, content)
+	if err := as.PutAttachment(ctx, recordID, a, text, dir); err != nil {
+		c.FS.Delete(ctx, a.Uri)
+		return nil, err
+	}
+	return a, nil
+}
+
+// extractText returns the searchable text of an attachment, or "" if it has none.
+func (c *Collection) extractText(ctx context.Context, a *pb.Attachment, content []byte) string {
+	extractors := c.Extractors
+	if extractors == nil {
+		extractors = DefaultTextExtractors()
+	}
+	e := extractors.For(a.ContentType)
+	if e == nil {
+		return ""
+	}
+	text, err := e.ExtractText(ctx, content)
+	if err != nil {
+		log.Printf("Warning: failed to extract text from %s: %v", a.Uri, err)
+		return ""
+	}
+	return text
+}
+
+// ListAttachments returns a record's attachments ordered by name.
+func (c *Collection) ListAttachments(ctx context.Context, recordID string) ([]*pb.Attachment, error) {
+	as, err := c.attachmentStore()
+	if err != nil {
+		return nil, err
+	}
+	return as.ListAttachments(ctx, recordID)
+}
+
+// attachment returns a record's attachment by name, or sql.ErrNoRows.
+func (c *Collection) attachment(ctx context.Context, recordID, name string) (*pb.Attachment, error) {
+	attachments, err := c.ListAttachments(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// RemoveAttachment deletes a named attachment, its content, and any artifacts
+// derived from it. It returns sql.ErrNoRows if the record has no such
+// attachment.
+func (c *Collection) RemoveAttachment(ctx context.Context, recordID, name string) error {
+	as, err := c.attachmentStore()
+	if err != nil {
+		return err
+	}
+	attachments, err := as.ListAttachments(ctx, recordID)
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		if a.DerivedFrom != name {
+			continue
+		}
+		if err := as.DeleteAttachment(ctx, recordID, a.Name); err != nil {
+			return err
+		}
+		if err := c.FS.Delete(ctx, a.Uri); err != nil {
+			return err
+		}
+	}
+
+	if err := as.DeleteAttachment(ctx, recordID, name); err != nil {
+		return err
+	}
+	return c.FS.Delete(ctx, path.Join(c.AttachmentDir(recordID), name))
+}
+
+// deleteAttachmentFiles removes the content of a record's attachments ahead
+// of the record itself; the store drops their metadata with the record.
+func (c *Collection) deleteAttachmentFiles(ctx context.Context, recordID string) {
+	as, ok := c.Store.(AttachmentStore)
+	if !ok || c.FS == nil {
+		return
+	}
+	attachments, err := as.ListAttachments(ctx, recordID)
+	if err != nil {
+		log.Printf("Warning: failed to list attachments of %s: %v", recordID, err)
+		return
+	}
+	for _, a := range attachments {
+		if err := c.FS.Delete(ctx, a.Uri); err != nil {
+			log.Printf("Warning: failed to delete attachment %s: %v", a.Uri, err)
+		}
+	}
+}
+
+// AddAttachment stores a file attached to a record.
+func (s *CollectionServer) AddAttachment(ctx context.Context, req *pb.AddAttachmentRequest) (*pb.AddAttachmentResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+
+	attachment, err := collection.AddAttachment(ctx, req.RecordId, req.Name, req.ContentType, req.Content)
+	if err != nil {
+		return nil, attachmentError(err)
+	}
+	return &pb.AddAttachmentResponse{
+		Status:     &pb.Status{Code: pb.Status_OK},
+		Attachment: attachment,
+	}, nil
+}
+
+// ListAttachments lists the files attached to a record.
+func (s *CollectionServer) ListAttachments(ctx context.Context, req *pb.ListAttachmentsRequest) (*pb.ListAttachmentsResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+
+	attachments, err := collection.ListAttachments(ctx, req.RecordId)
+	if err != nil {
+		return nil, attachmentError(err)
+	}
+	return &pb.ListAttachmentsResponse{
+		Status:      &pb.Status{Code: pb.Status_OK},
+		Attachments: attachments,
+	}, nil
+}
+
+// RemoveAttachment deletes a file attached to a record.
+func (s *CollectionServer) RemoveAttachment(ctx context.Context, req *pb.RemoveAttachmentRequest) (*pb.RemoveAttachmentResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+
+	if err := collection.RemoveAttachment(ctx, req.RecordId, req.Name); err != nil {
+		return nil, attachmentError(err)
+	}
+	return &pb.RemoveAttachmentResponse{Status: &pb.Status{Code: pb.Status_OK}}, nil
+}
+
+// attachmentError maps attachment failures to gRPC status errors.
+func attachmentError(err error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return status.Error(codes.NotFound, "record or attachment not found")
+	case errors.Is(err, ErrInvalidAttachmentName):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Errorf(codes.Internal, "attachment operation failed: %v", err)
+	}
+}
+
+// PutAttachment flushes pending writes, so the record exists, and delegates.
+func (b *BufferedStore) PutAttachment(ctx context.Context, recordID string, a *pb.Attachment, text, dataURI string) error {
+	if err := b.flush(ctx); err != nil {
+		return err
+	}
+	as, ok := b.inner.(AttachmentStore)
+	if !ok {
+		return fmt.Errorf("store does not support attachments")
+	}
+	return as.PutAttachment(ctx, recordID, a, text, dataURI)
+}
+
+// ListAttachments delegates to the wrapped store.
+func (b *BufferedStore) ListAttachments(ctx context.Context, recordID string) ([]*pb.Attachment, error) {
+	as, ok := b.inner.(AttachmentStore)
+	if !ok {
+		return nil, fmt.Errorf("store does not support attachments")
+	}
+	return as.ListAttachments(ctx, recordID)
+}
+
+// DeleteAttachment delegates to the wrapped store.
+func (b *BufferedStore) DeleteAttachment(ctx context.Context, recordID, name string) error {
+	as, ok := b.inner.(AttachmentStore)
+	if !ok {
+		return fmt.Errorf("store does not support attachments")
+	}
+	return as.DeleteAttachment(ctx, recordID, name)
+}
@@ -0,0 +1,212 @@
+package collection_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCollection_Attachments(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "doc", ProtoData: []byte(`{"title": "report"}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	added, err := coll.AddAttachment(ctx, "doc", "notes.txt", "", []byte("hello"))
+	if err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+	if added.Size != 5 || added.ContentType != "text/plain; charset=utf-8" ||
+		added.Sha256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("unexpected attachment metadata: %+v", added)
+	}
+	if _, err := coll.AddAttachment(ctx, "doc", "raw", "image/png", []byte{0x89, 'P', 'N', 'G'}); err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+
+	record, err := coll.GetRecord(ctx, "doc")
+	if err != nil {
+		t.Fatalf("GetRecord failed: %v", err)
+	}
+	if record.DataUri != coll.AttachmentDir("doc") {
+		t.Errorf("data_uri = %q, want %q", record.DataUri, coll.AttachmentDir("doc"))
+	}
+
+	attachments, err := coll.ListAttachments(ctx, "doc")
+	if err != nil {
+		t.Fatalf("ListAttachments failed: %v", err)
+	}
+	if len(attachments) != 2 || attachments[0].Name != "notes.txt" || attachments[1].Name != "raw" {
+		t.Fatalf("unexpected attachments: %v", attachments)
+	}
+	content, err := coll.FS.Load(ctx, attachments[0].Uri)
+	if err != nil || string(content) != "hello" {
+		t.Errorf("attachment content = %q (%v)", content, err)
+	}
+
+	// Removing the last attachment clears data_uri
+	for _, name := range []string{"notes.txt", "raw"} {
+		if err := coll.RemoveAttachment(ctx, "doc", name); err != nil {
+			t.Fatalf("RemoveAttachment(%s) failed: %v", name, err)
+		}
+	}
+	if err := coll.RemoveAttachment(ctx, "doc", "raw"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for a missing attachment, got %v", err)
+	}
+	record, _ = coll.GetRecord(ctx, "doc")
+	if record.DataUri != "" {
+		t.Errorf("expected data_uri to be cleared, got %q", record.DataUri)
+	}
+	if _, err := coll.FS.Stat(ctx, attachments[0].Uri); err == nil {
+		t.Error("expected attachment content to be deleted")
+	}
+
+	// Deleting a record removes its attachments
+	added, err = coll.AddAttachment(ctx, "doc", "again.txt", "", []byte("again"))
+	if err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+	if err := coll.DeleteRecord(ctx, "doc"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if remaining, _ := coll.ListAttachments(ctx, "doc"); len(remaining) != 0 {
+		t.Errorf("expected no attachments after delete, got %v", remaining)
+	}
+	if _, err := coll.FS.Stat(ctx, added.Uri); err == nil {
+		t.Error("expected attachment content to be deleted with the record")
+	}
+}
+
+func TestCollection_AttachmentTextSearch(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	coll.Extractors = collection.DefaultTextExtractors()
+	coll.Extractors["application/pdf"] = collection.TextExtractorFunc(func(ctx context.Context, content []byte) (string, error) {
+		return strings.TrimPrefix(string(content), "%PDF-1.4 "), nil
+	})
+
+	for _, id := range []string{"a", "b"} {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: []byte(`{"title": "report"}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	search := func(term string) []string {
+		t.Helper()
+		results, err := coll.Search(ctx, &collection.SearchQuery{FullText: term})
+		if err != nil {
+			t.Fatalf("Search(%s) failed: %v", term, err)
+		}
+		var ids []string
+		for _, r := range results {
+			ids = append(ids, r.Record.Id)
+		}
+		return ids
+	}
+
+	if _, err := coll.AddAttachment(ctx, "a", "notes.txt", "", []byte("quarterly zebra migration")); err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+	pdf, err := coll.AddAttachment(ctx, "b", "scan", "", []byte("%PDF-1.4 giraffe sighting"))
+	if err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+	if pdf.ContentType != "application/pdf" {
+		t.Errorf("expected sniffed application/pdf, got %s", pdf.ContentType)
+	}
+	png, err := coll.AddAttachment(ctx, "b", "image", "", []byte("\x89PNG\r\n\x1a\nzebra"))
+	if err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+	if png.ContentType != "image/png" {
+		t.Errorf("expected sniffed image/png, got %s", png.ContentType)
+	}
+
+	if ids := search("zebra"); len(ids) != 1 || ids[0] != "a" {
+		t.Errorf("expected only a to match zebra, got %v", ids)
+	}
+	if ids := search("giraffe"); len(ids) != 1 || ids[0] != "b" {
+		t.Errorf("expected only b to match giraffe, got %v", ids)
+	}
+
+	// Record updates keep attachment text indexed
+	if err := coll.UpdateRecord(ctx, &pb.CollectionRecord{Id: "a", ProtoData: []byte(`{"title": "revised"}`)}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if ids := search("zebra"); len(ids) != 1 {
+		t.Errorf("expected attachment text to survive an update, got %v", ids)
+	}
+
+	if err := coll.RemoveAttachment(ctx, "a", "notes.txt"); err != nil {
+		t.Fatalf("RemoveAttachment failed: %v", err)
+	}
+	if ids := search("zebra"); len(ids) != 0 {
+		t.Errorf("expected no matches after removal, got %v", ids)
+	}
+	if ids := search("revised"); len(ids) != 1 {
+		t.Errorf("expected record content to stay indexed, got %v", ids)
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"data.json", `{"a": 1}`, "application/json"},
+		{"page", "<html><body>hi</body></html>", "text/html; charset=utf-8"},
+		{"notes", "just text", "text/plain; charset=utf-8"},
+		{"photo.txt", "\xff\xd8\xff\xe0", "image/jpeg"},
+		{"blob", "\x00\x01\x02", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := collection.DetectContentType(tt.name, []byte(tt.content)); got != tt.want {
+			t.Errorf("DetectContentType(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCollectionServer_AttachmentErrors(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewCollectionServer(repo)
+	ctx := context.Background()
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "files"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	_, err := server.AddAttachment(ctx, &pb.AddAttachmentRequest{
+		Namespace: "test", CollectionName: "files", RecordId: "missing", Name: "a.txt", Content: []byte("x"),
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for a missing record, got %v", err)
+	}
+
+	_, err = server.AddAttachment(ctx, &pb.AddAttachmentRequest{
+		Namespace: "test", CollectionName: "files", RecordId: "missing", Name: "../escape", Content: []byte("x"),
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a path name, got %v", err)
+	}
+
+	_, err = server.RemoveAttachment(ctx, &pb.RemoveAttachmentRequest{
+		Namespace: "test", CollectionName: "files", RecordId: "missing", Name: "a.txt",
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for a missing attachment, got %v", err)
+	}
+}
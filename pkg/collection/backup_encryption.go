@@ -0,0 +1,443 @@
+package collection
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// Encrypted backups use envelope encryption. Each backup gets a random
+// AES-256 data key, which the BackupManager's KeyProvider wraps; every file
+// of the backup is sealed with AES-GCM under the data key, in chunks, after
+// a header holding the wrapped key. The ID of the key that wrapped it is
+// kept in the backup's metadata.
+const (
+	// encryptedMagic starts every encrypted backup file.
+	encryptedMagic = "CLENC001"
+	// encryptChunkSize is how much plaintext each sealed chunk holds.
+	encryptChunkSize = 64 << 10
+	// dataKeySize is the length of backup data keys: AES-256.
+	dataKeySize = 32
+	// noncePrefixSize is the random part of chunk nonces, followed by the
+	// chunk number.
+	noncePrefixSize = 8
+)
+
+// ErrBackupDecryption is returned for encrypted backups that cannot be
+// decrypted: with no KeyProvider set, a key the provider does not have, or
+// contents that fail authentication.
+var ErrBackupDecryption = errors.New("backup decryption failed")
+
+// KeyProvider wraps the data keys backups are encrypted with. KeyFile keeps
+// keys in a local file; NewKMSKeyProvider uses a key management service.
+type KeyProvider interface {
+	// WrapKey encrypts a new backup's data key, returning the ID of the key
+	// it used.
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped with the key keyID.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// SetKeyProvider encrypts new backups with data keys wrapped by keys, and
+// decrypts encrypted backups for restores and verification. Backups taken
+// before it are unaffected. Call it before serving requests.
+func (bm *BackupManager) SetKeyProvider(keys KeyProvider) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.keys = keys
+}
+
+// KeyFile is a KeyProvider of AES-256 keys read from a file. Each line is a
+// key ID and its base64 key, separated by whitespace; blank lines and lines
+// starting with # are ignored. New backups use the last key, so keys are
+// rotated by appending one and keeping the old ones for older backups.
+type KeyFile struct {
+	keys    map[string][]byte
+	current string
+}
+
+// LoadKeyFile reads a key file.
+func LoadKeyFile(path string) (*KeyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	kf := &KeyFile{keys: make(map[string][]byte)}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("key file line %d: expected <key id> <base64 key>", i+1)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("key file line %d: key %s must be %d base64 bytes", i+1, fields[0], dataKeySize)
+		}
+		kf.keys[fields[0]] = key
+		kf.current = fields[0]
+	}
+	if kf.current == "" {
+		return nil, fmt.Errorf("key file %s has no keys", path)
+	}
+	return kf, nil
+}
+
+// WrapKey seals dataKey with the file's last key.
+func (kf *KeyFile) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	aead, err := newGCM(kf.keys[kf.current])
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return kf.current, aead.Seal(nonce, nonce, dataKey, []byte(kf.current)), nil
+}
+
+// UnwrapKey opens a data key sealed with the key keyID.
+func (kf *KeyFile) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := kf.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q is not in the key file", keyID)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is truncated")
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("wrapped key does not open with key %q", keyID)
+	}
+	return dataKey, nil
+}
+
+// KMS is a key management service holding a backup master key, such as AWS
+// KMS or Cloud KMS behind a small adapter.
+type KMS interface {
+	Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// kmsKeyProvider wraps data keys with a key held by a KMS.
+type kmsKeyProvider struct {
+	kms   KMS
+	keyID string
+}
+
+// NewKMSKeyProvider returns a KeyProvider wrapping data keys with the KMS
+// key keyID. Backups keep the key ID they were wrapped with, so a rotated
+// keyID still decrypts older backups while the KMS keeps the old key.
+func NewKMSKeyProvider(kms KMS, keyID string) KeyProvider {
+	return &kmsKeyProvider{kms: kms, keyID: keyID}
+}
+
+func (p *kmsKeyProvider) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	wrapped, err := p.kms.Encrypt(ctx, p.keyID, dataKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("kms encrypt with %s: %w", p.keyID, err)
+	}
+	return p.keyID, wrapped, nil
+}
+
+func (p *kmsKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	dataKey, err := p.kms.Decrypt(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("kms decrypt with %s: %w", keyID, err)
+	}
+	return dataKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptBackup encrypts a backup staged at localPath, and its files in
+// localPath+".files" if there are any, in place with a new data key. It
+// returns the ID of the key the data key was wrapped with and how many
+// bytes encryption added.
+func encryptBackup(ctx context.Context, keys KeyProvider, localPath string) (string, int64, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", 0, err
+	}
+	keyID, wrapped, err := keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	if len(wrapped) > 0xffff {
+		return "", 0, fmt.Errorf("wrapped data key is %d bytes, over the 65535 an encrypted backup holds", len(wrapped))
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", 0, err
+	}
+
+	paths := []string{localPath}
+	err = filepath.WalkDir(localPath+".files", func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		paths = append(paths, p)
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", 0, err
+	}
+	var added int64
+	for _, p := range paths {
+		n, err := encryptFile(p, aead, wrapped)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to encrypt %s: %w", filepath.Base(p), err)
+		}
+		added += n
+	}
+	return keyID, added, nil
+}
+
+// encryptFile replaces the file at path with its encryption under aead,
+// returning how many bytes it grew by.
+func encryptFile(path string, aead cipher.AEAD, wrapped []byte) (int64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	tmp := path + ".encrypting"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(out)
+	header := make([]byte, 0, len(encryptedMagic)+2+len(wrapped)+noncePrefixSize)
+	header = append(header, encryptedMagic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err = rand.Read(prefix); err == nil {
+		header = append(header, prefix...)
+		w.Write(header)
+		err = sealChunks(w, bufio.NewReader(in), aead, prefix)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	before, err := in.Stat()
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	after, err := os.Stat(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return after.Size() - before.Size(), nil
+}
+
+// chunkNonce returns the nonce of chunk n of a file.
+func chunkNonce(prefix []byte, n uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte(nil), prefix...), n)
+}
+
+// chunkAAD authenticates whether a chunk is a file's last, so files cut
+// short at a chunk boundary fail to decrypt.
+func chunkAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// sealChunks writes r to w in sealed chunks, ending with a last chunk that
+// may be empty.
+func sealChunks(w io.Writer, r *bufio.Reader, aead cipher.AEAD, prefix []byte) error {
+	buf := make([]byte, encryptChunkSize)
+	sealed := make([]byte, 0, encryptChunkSize+aead.Overhead())
+	for n := uint32(0); ; n++ {
+		size, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := size < len(buf)
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		if n == ^uint32(0) && !last {
+			return fmt.Errorf("file is too large to encrypt")
+		}
+		sealed = aead.Seal(sealed[:0], chunkNonce(prefix, n), buf[:size], chunkAAD(last))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// backupDecrypter decrypts the files of one encrypted backup, unwrapping
+// its data key once.
+type backupDecrypter struct {
+	keys    KeyProvider
+	keyID   string
+	wrapped []byte
+	aead    cipher.AEAD
+}
+
+// decryptFile writes the decryption of the file at src to dest.
+func (d *backupDecrypter) decryptFile(ctx context.Context, src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+	header := make([]byte, len(encryptedMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return fmt.Errorf("%w: %s is not an encrypted backup file", ErrBackupDecryption, filepath.Base(src))
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint16(header[len(encryptedMagic):]))
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return fmt.Errorf("%w: %s is truncated", ErrBackupDecryption, filepath.Base(src))
+	}
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return fmt.Errorf("%w: %s is truncated", ErrBackupDecryption, filepath.Base(src))
+	}
+	if d.aead == nil || !bytes.Equal(wrapped, d.wrapped) {
+		dataKey, err := d.keys.UnwrapKey(ctx, d.keyID, wrapped)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBackupDecryption, err)
+		}
+		if d.aead, err = newGCM(dataKey); err != nil {
+			return fmt.Errorf("%w: %v", ErrBackupDecryption, err)
+		}
+		d.wrapped = wrapped
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	err = openChunks(w, r, d.aead, prefix)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return fmt.Errorf("%w: %s: %v", ErrBackupDecryption, filepath.Base(src), err)
+	}
+	return nil
+}
+
+// openChunks writes the plaintext of the sealed chunks in r to w.
+func openChunks(w io.Writer, r *bufio.Reader, aead cipher.AEAD, prefix []byte) error {
+	buf := make([]byte, encryptChunkSize+aead.Overhead())
+	plain := make([]byte, 0, encryptChunkSize)
+	for n := uint32(0); ; n++ {
+		size, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := size < len(buf)
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		plain, err = aead.Open(plain[:0], chunkNonce(prefix, n), buf[:size], chunkAAD(last))
+		if err != nil {
+			return fmt.Errorf("chunk %d is corrupt or was encrypted with another key", n)
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptBackup decrypts an encrypted backup at localPath, with its files
+// in localPath+".files" if withFiles, into a temporary directory the
+// returned cleanup removes.
+func (bm *BackupManager) decryptBackup(ctx context.Context, backup *pb.BackupMetadata, localPath string, withFiles bool) (string, func(), error) {
+	if bm.keys == nil {
+		return "", nil, fmt.Errorf("%w: backup %s is encrypted with key %s and no key provider is set", ErrBackupDecryption, backup.BackupId, backup.EncryptionKeyId)
+	}
+	tmpDir, err := os.MkdirTemp("", "backup-decrypt-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	d := &backupDecrypter{keys: bm.keys, keyID: backup.EncryptionKeyId}
+	plainPath := filepath.Join(tmpDir, filepath.Base(localPath))
+	if err := d.decryptFile(ctx, localPath, plainPath); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if !withFiles {
+		return plainPath, cleanup, nil
+	}
+	filesDir := localPath + ".files"
+	err = filepath.WalkDir(filesDir, func(p string, e os.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(filesDir, p)
+		if err != nil {
+			return err
+		}
+		return d.decryptFile(ctx, p, filepath.Join(plainPath+".files", rel))
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		cleanup()
+		return "", nil, err
+	}
+	return plainPath, cleanup, nil
+}
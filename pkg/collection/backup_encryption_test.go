@@ -0,0 +1,156 @@
+package collection_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+)
+
+// addKey appends a new random key to a key file and loads it.
+func addKey(t *testing.T, path, id string) *collection.KeyFile {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = fmt.Fprintf(f, "# added by the test\n%s %s\n", id, base64.StdEncoding.EncodeToString(key))
+		f.Close()
+	}
+	if err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	keys, err := collection.LoadKeyFile(path)
+	if err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	return keys
+}
+
+func TestEncryptedBackups(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	dir := t.TempDir()
+	layout := collection.NewPathLayout(filepath.Join(dir, "data"))
+	repo.SetPathLayout(layout)
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "docs")
+	for i := 0; i < 50; i++ {
+		data := []byte(fmt.Sprintf(`{"secret": "classified-%d"}`, i))
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: fmt.Sprintf("doc-%02d", i), ProtoData: data}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	if err := coll.FS.Save(ctx, "notes/plan.txt", []byte("classified plans")); err != nil {
+		t.Fatalf("failed to save file: %v", err)
+	}
+
+	bm, err := collection.NewBackupManager(repo, &collection.SqliteTransport{}, filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("failed to create backup manager: %v", err)
+	}
+	defer bm.Close()
+	bm.SetPathLayout(layout)
+	keyFile := filepath.Join(dir, "keys")
+	bm.SetKeyProvider(addKey(t, keyFile, "key-1"))
+
+	docs := &pb.NamespacedName{Namespace: "test", Name: "docs"}
+	backupPath := filepath.Join(dir, "backups", "docs.db")
+	resp, _ := bm.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: docs, DestPath: backupPath, IncludeFiles: true})
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", resp.Status)
+	}
+	if resp.Backup.EncryptionKeyId != "key-1" {
+		t.Errorf("expected the backup encrypted with key-1, got %q", resp.Backup.EncryptionKeyId)
+	}
+	for _, path := range []string{backupPath, filepath.Join(backupPath+".files", "notes", "plan.txt")} {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		if bytes.Contains(raw, []byte("classified")) || bytes.HasPrefix(raw, []byte("SQLite format 3")) {
+			t.Errorf("expected %s encrypted, found plaintext", filepath.Base(path))
+		}
+	}
+
+	if verify, _ := bm.VerifyBackup(ctx, &pb.VerifyBackupRequest{BackupId: resp.Backup.BackupId}); !verify.IsValid {
+		t.Fatalf("expected the encrypted backup valid, got %s", verify.ErrorMessage)
+	}
+	restore, _ := bm.RestoreBackup(ctx, &pb.RestoreBackupRequest{BackupId: resp.Backup.BackupId, DestNamespace: "restored", DestName: "docs"})
+	if restore.Status.Code != pb.Status_OK {
+		t.Fatalf("restore failed: %v", restore.Status)
+	}
+	restored, err := repo.GetCollection(ctx, "restored", "docs")
+	if err != nil {
+		t.Fatalf("failed to open restored collection: %v", err)
+	}
+	if record, err := restored.GetRecord(ctx, "doc-07"); err != nil || !strings.Contains(string(record.ProtoData), "classified-7") {
+		t.Errorf("expected doc-07 restored in plaintext, got %v", err)
+	}
+	if content, err := restored.FS.Load(ctx, "notes/plan.txt"); err != nil || string(content) != "classified plans" {
+		t.Errorf("expected the file restored in plaintext, got %q (%v)", content, err)
+	}
+
+	// Incremental backups are encrypted too, and rebuilt from their chain
+	full, _ := bm.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: docs, DestPath: filepath.Join(dir, "backups", "full.db"), Incremental: true})
+	if err := coll.UpdateRecord(ctx, &pb.CollectionRecord{Id: "doc-03", ProtoData: []byte(`{"secret": "updated"}`)}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+
+	// Rotating keys: new backups use the last key, old ones keep decrypting
+	keys := addKey(t, keyFile, "key-2")
+	bm.SetKeyProvider(keys)
+	inc, _ := bm.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: docs, DestPath: filepath.Join(dir, "backups", "inc.db"), Incremental: true})
+	if inc.Status.Code != pb.Status_OK || inc.Backup.ParentBackupId != full.Backup.BackupId {
+		t.Fatalf("expected an incremental backup on top of %s, got %v", full.Backup.BackupId, inc.Status)
+	}
+	if inc.Backup.EncryptionKeyId != "key-2" {
+		t.Errorf("expected the new backup encrypted with key-2, got %q", inc.Backup.EncryptionKeyId)
+	}
+	restore, _ = bm.RestoreBackup(ctx, &pb.RestoreBackupRequest{BackupId: inc.Backup.BackupId, DestNamespace: "restored", DestName: "chain"})
+	if restore.Status.Code != pb.Status_OK {
+		t.Fatalf("restore of the chain failed: %v", restore.Status)
+	}
+	chain, _ := repo.GetCollection(ctx, "restored", "chain")
+	if record, err := chain.GetRecord(ctx, "doc-03"); err != nil || !strings.Contains(string(record.ProtoData), "updated") {
+		t.Errorf("expected the update restored through the chain, got %v", err)
+	}
+
+	// Without the key the backup cannot be read
+	bm.SetKeyProvider(addKey(t, filepath.Join(dir, "other-keys"), "key-3"))
+	verify, _ := bm.VerifyBackup(ctx, &pb.VerifyBackupRequest{BackupId: resp.Backup.BackupId})
+	if verify.IsValid || verify.Status.Message != "backup decryption failed" {
+		t.Errorf("expected decryption to fail without key-1, got %q: %s", verify.Status.Message, verify.ErrorMessage)
+	}
+	restore, _ = bm.RestoreBackup(ctx, &pb.RestoreBackupRequest{BackupId: resp.Backup.BackupId, DestNamespace: "restored", DestName: "nokey"})
+	if restore.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION restoring without the key, got %v", restore.Status)
+	}
+
+	// Tampering changes the stored checksum, before it would fail authentication
+	bm.SetKeyProvider(keys)
+	raw, _ := os.ReadFile(backupPath)
+	raw[len(raw)/2] ^= 0xff
+	if err := os.WriteFile(backupPath, raw, 0644); err != nil {
+		t.Fatalf("failed to tamper with the backup: %v", err)
+	}
+	verify, _ = bm.VerifyBackup(ctx, &pb.VerifyBackupRequest{BackupId: resp.Backup.BackupId})
+	if verify.IsValid || verify.Status.Message != "backup checksum mismatch" {
+		t.Errorf("expected a tampered backup invalid, got valid=%v: %s", verify.IsValid, verify.ErrorMessage)
+	}
+}
@@ -0,0 +1,326 @@
+package collection
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// Incremental backups copy database pages rather than records. The first
+// backup of a chain is a copy of the database file, taken under the store's
+// write barrier; each later one holds only the pages whose hashes differ
+// from the previous backup of the chain. Restores copy the chain's full
+// backup and write each incremental backup's pages over it in turn.
+const (
+	// MaxIncrementalChain is how many incremental backups follow a full one
+	// before the next starts a new chain, bounding the backups a restore
+	// has to read.
+	MaxIncrementalChain = 24
+
+	// incrementalMagic starts every incremental backup file.
+	incrementalMagic = "CLINCR01"
+	// pageHashSize is the length of the page hashes kept per backup.
+	pageHashSize = 16
+	// sqliteHeader starts every SQLite database file.
+	sqliteHeader = "SQLite format 3\x00"
+)
+
+// ErrIncrementalUnsupported is returned for incremental backups of
+// collections whose store cannot hold its writes with its database file up
+// to date, see WriteBarrier.
+var ErrIncrementalUnsupported = errors.New("incremental backups need a store with a write barrier")
+
+// pageState is the state of a database's pages as of a backup.
+type pageState struct {
+	backupID string // Backup taken at this state
+	parentID string // Backup the pages were compared to, "" for full copies
+	depth    int    // Incremental backups since the chain's full copy
+	pageSize int
+	hashes   []byte // pageHashSize bytes per page
+}
+
+// pageHash returns the hash a page is compared by.
+func pageHash(page []byte) []byte {
+	sum := sha256.Sum256(page)
+	return sum[:pageHashSize]
+}
+
+// backupPages writes a backup of coll's database to dest: the pages changed
+// since the last backup of its chain, or a full copy starting a new chain.
+func (bm *BackupManager) backupPages(ctx context.Context, coll *Collection, name *pb.NamespacedName, dest string) (*pageState, error) {
+	barrier, ok := coll.Store.(WriteBarrier)
+	if !ok {
+		return nil, ErrIncrementalUnsupported
+	}
+	parent, err := bm.metaStore.lastPageState(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the last incremental backup: %w", err)
+	}
+	if parent != nil && parent.depth >= MaxIncrementalChain {
+		parent = nil
+	}
+
+	var state *pageState
+	err = barrier.WithWriteBarrier(ctx, func(path string) error {
+		if path == "" {
+			return ErrIncrementalUnsupported
+		}
+		state, err = writePageBackup(path, dest, parent)
+		return err
+	})
+	if err != nil {
+		os.Remove(dest)
+		return nil, err
+	}
+	return state, nil
+}
+
+// writePageBackup copies the database at dbPath to dest, whole if parent is
+// nil or has another page size, and otherwise as an incremental backup of
+// the pages that differ from parent's.
+func writePageBackup(dbPath, dest string, parent *pageState) (*pageState, error) {
+	in, err := os.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(in, header); err != nil || !bytes.HasPrefix(header, []byte(sqliteHeader)) {
+		return nil, fmt.Errorf("%s is not a SQLite database", dbPath)
+	}
+	pageSize := int(binary.BigEndian.Uint16(header[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+	pageCount := int(info.Size() / int64(pageSize))
+	if parent != nil && parent.pageSize != pageSize {
+		parent = nil
+	}
+
+	state := &pageState{pageSize: pageSize, hashes: make([]byte, 0, pageCount*pageHashSize)}
+	if parent != nil {
+		state.parentID = parent.backupID
+		state.depth = parent.depth + 1
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(out)
+	var number [4]byte
+	if parent != nil {
+		w.WriteString(incrementalMagic)
+		binary.BigEndian.PutUint32(number[:], uint32(pageSize))
+		w.Write(number[:])
+		binary.BigEndian.PutUint32(number[:], uint32(pageCount))
+		w.Write(number[:])
+	}
+
+	page := make([]byte, pageSize)
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		out.Close()
+		return nil, err
+	}
+	for pgno := 1; pgno <= pageCount; pgno++ {
+		if _, err := io.ReadFull(in, page); err != nil {
+			out.Close()
+			return nil, fmt.Errorf("failed to read page %d: %w", pgno, err)
+		}
+		hash := pageHash(page)
+		state.hashes = append(state.hashes, hash...)
+		if parent != nil {
+			offset := (pgno - 1) * pageHashSize
+			if offset+pageHashSize <= len(parent.hashes) && bytes.Equal(parent.hashes[offset:offset+pageHashSize], hash) {
+				continue
+			}
+			binary.BigEndian.PutUint32(number[:], uint32(pgno))
+			w.Write(number[:])
+		}
+		w.Write(page)
+	}
+	if parent != nil {
+		// Page 0 ends the pages, so truncated backups are detected
+		binary.BigEndian.PutUint32(number[:], 0)
+		w.Write(number[:])
+	}
+	err = w.Flush()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write backup: %w", err)
+	}
+	return state, nil
+}
+
+// applyPageBackup writes the pages of the incremental backup at deltaPath
+// over the database at dbPath, leaving it as it was when the backup was
+// taken.
+func applyPageBackup(dbPath, deltaPath string) error {
+	in, err := os.Open(deltaPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+	header := make([]byte, len(incrementalMagic)+8)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(incrementalMagic)]) != incrementalMagic {
+		return fmt.Errorf("%s is not an incremental backup", filepath.Base(deltaPath))
+	}
+	pageSize := int64(binary.BigEndian.Uint32(header[len(incrementalMagic):]))
+	pageCount := int64(binary.BigEndian.Uint32(header[len(incrementalMagic)+4:]))
+
+	out, err := os.OpenFile(dbPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	page := make([]byte, pageSize)
+	var number [4]byte
+	for {
+		if _, err = io.ReadFull(r, number[:]); err != nil {
+			break
+		}
+		pgno := int64(binary.BigEndian.Uint32(number[:]))
+		if pgno == 0 {
+			break
+		}
+		if pgno > pageCount {
+			err = fmt.Errorf("page %d is past the end of the database", pgno)
+			break
+		}
+		if _, err = io.ReadFull(r, page); err != nil {
+			break
+		}
+		if _, err = out.WriteAt(page, (pgno-1)*pageSize); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = out.Truncate(pageCount * pageSize)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply %s: %w", filepath.Base(deltaPath), err)
+	}
+	return nil
+}
+
+// rebuildBackup rebuilds the database of an incremental backup, whose pages
+// were downloaded to deltaPath, from the backups of its chain. The returned
+// cleanup removes it.
+func (bm *BackupManager) rebuildBackup(ctx context.Context, backup *pb.BackupMetadata, deltaPath string) (string, func(), error) {
+	// Newest first, back to the chain's full copy
+	var chain []*pb.BackupMetadata
+	seen := map[string]bool{backup.BackupId: true}
+	for parentID := backup.ParentBackupId; parentID != ""; {
+		if seen[parentID] {
+			return "", nil, fmt.Errorf("backup chain of %s loops at %s", backup.BackupId, parentID)
+		}
+		seen[parentID] = true
+		parent, err := bm.metaStore.GetBackup(ctx, parentID)
+		if err != nil {
+			return "", nil, fmt.Errorf("backup %s of the chain of %s is missing: %w", parentID, backup.BackupId, err)
+		}
+		chain = append(chain, parent)
+		parentID = parent.ParentBackupId
+	}
+
+	tmpDir, err := os.MkdirTemp("", "backup-rebuild-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+	dbPath := filepath.Join(tmpDir, backup.BackupId+".db")
+	for i := len(chain) - 1; i >= 0; i-- {
+		path, done, err := bm.downloadBackup(ctx, chain[i], false)
+		if err == nil {
+			if i == len(chain)-1 {
+				err = copyFile(path, dbPath)
+			} else {
+				err = applyPageBackup(dbPath, path)
+			}
+			done()
+		}
+		if err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("failed to read backup %s: %w", chain[i].BackupId, err)
+		}
+	}
+	if err := applyPageBackup(dbPath, deltaPath); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dbPath, cleanup, nil
+}
+
+// lastPageState returns the page state of the most recent backup of coll
+// that has one, or nil if there is none.
+func (s *BackupMetadataStore) lastPageState(ctx context.Context, coll *pb.NamespacedName) (*pageState, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state := &pageState{}
+	err := s.db.QueryRowContext(ctx, `
+	SELECT p.backup_id, p.depth, p.page_size, p.hashes
+	FROM backup_pages p JOIN backups b ON b.backup_id = p.backup_id
+	WHERE b.collection_namespace = ? AND b.collection_name = ?
+	ORDER BY b.timestamp DESC, b.rowid DESC
+	LIMIT 1
+	`, coll.Namespace, coll.Name).Scan(&state.backupID, &state.depth, &state.pageSize, &state.hashes)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// savePageState saves the page state of a backup.
+func (s *BackupMetadataStore) savePageState(ctx context.Context, backupID string, state *pageState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO backup_pages (backup_id, depth, page_size, hashes) VALUES (?, ?, ?, ?)`,
+		backupID, state.depth, state.pageSize, state.hashes)
+	return err
+}
+
+// childBackups returns the IDs of the incremental backups taken on top of a
+// backup.
+func (s *BackupMetadataStore) childBackups(ctx context.Context, backupID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT backup_id FROM backups WHERE parent_backup_id = ? ORDER BY timestamp`, backupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
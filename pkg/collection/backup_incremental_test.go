@@ -0,0 +1,167 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+)
+
+func TestIncrementalBackups(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	dir := t.TempDir()
+	layout := collection.NewPathLayout(filepath.Join(dir, "data"))
+	repo.SetPathLayout(layout)
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "docs")
+	padding := strings.Repeat("x", 500)
+	for i := 0; i < 200; i++ {
+		data := []byte(fmt.Sprintf(`{"n": %d, "padding": %q}`, i, padding))
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: fmt.Sprintf("doc-%03d", i), ProtoData: data}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	bm, err := collection.NewBackupManager(repo, &collection.SqliteTransport{}, filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("failed to create backup manager: %v", err)
+	}
+	defer bm.Close()
+	bm.SetPathLayout(layout)
+	clock := collection.NewFixedClock(time.Unix(1700000000, 0))
+	bm.SetClock(clock)
+	docs := &pb.NamespacedName{Namespace: "test", Name: "docs"}
+	plain, _ := bm.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: docs, DestPath: filepath.Join(dir, "backups", "plain.db")})
+	if plain.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", plain.Status)
+	}
+	backup := func(name string) *pb.BackupMetadata {
+		t.Helper()
+		clock.Advance(time.Hour)
+		resp, _ := bm.BackupCollection(ctx, &pb.BackupCollectionRequest{
+			Collection:  docs,
+			DestPath:    filepath.Join(dir, "backups", name),
+			Incremental: true,
+		})
+		if resp.Status.Code != pb.Status_OK {
+			t.Fatalf("backup %s failed: %v", name, resp.Status)
+		}
+		return resp.Backup
+	}
+
+	full := backup("full.db")
+	if full.ParentBackupId != "" {
+		t.Fatalf("expected the first incremental backup to be a full copy, got parent %q", full.ParentBackupId)
+	}
+	if err := coll.UpdateRecord(ctx, &pb.CollectionRecord{Id: "doc-007", ProtoData: []byte(`{"n": 7, "updated": true}`)}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	first := backup("inc1.db")
+	if first.ParentBackupId != full.BackupId || first.SizeBytes*4 > full.SizeBytes {
+		t.Errorf("expected a small backup on top of %s, got %d bytes on top of %q (full: %d bytes)",
+			full.BackupId, first.SizeBytes, first.ParentBackupId, full.SizeBytes)
+	}
+	if err := coll.DeleteRecord(ctx, "doc-100"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "doc-new", ProtoData: []byte(`{"n": -1}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	second := backup("inc2.db")
+	if second.ParentBackupId != first.BackupId {
+		t.Errorf("expected the chain to continue from %s, got %q", first.BackupId, second.ParentBackupId)
+	}
+
+	if verify, _ := bm.VerifyBackup(ctx, &pb.VerifyBackupRequest{BackupId: second.BackupId}); !verify.IsValid {
+		t.Fatalf("expected the rebuilt backup valid, got %s", verify.ErrorMessage)
+	}
+	restore, _ := bm.RestoreBackup(ctx, &pb.RestoreBackupRequest{
+		BackupId:      second.BackupId,
+		DestNamespace: "restored",
+		DestName:      "docs",
+	})
+	if restore.Status.Code != pb.Status_OK {
+		t.Fatalf("restore failed: %v", restore.Status)
+	}
+	restored, err := repo.GetCollection(ctx, "restored", "docs")
+	if err != nil {
+		t.Fatalf("failed to open restored collection: %v", err)
+	}
+	if n, _ := restored.Store.CountRecords(ctx); n != 200 {
+		t.Errorf("expected 200 records restored, got %d", n)
+	}
+	if record, err := restored.GetRecord(ctx, "doc-007"); err != nil || !strings.Contains(string(record.ProtoData), "updated") {
+		t.Errorf("expected the update restored, got %v", err)
+	}
+	if _, err := restored.GetRecord(ctx, "doc-100"); err == nil {
+		t.Error("expected the deleted record absent")
+	}
+	if _, err := restored.GetRecord(ctx, "doc-new"); err != nil {
+		t.Errorf("expected the new record restored: %v", err)
+	}
+
+	// Retention keeps the backups a kept incremental backup needs
+	bm.SetRetentionPolicy(collection.RetentionPolicy{MaxCount: 1})
+	events, err := bm.Prune(ctx)
+	if err != nil || len(events) != 1 || events[0].BackupId != plain.Backup.BackupId {
+		t.Errorf("expected only the backup outside the chain pruned, got %v (%v)", events, err)
+	}
+	bm.SetRetentionPolicy(collection.RetentionPolicy{})
+
+	// The chain can only be deleted from its end
+	resp, _ := bm.DeleteBackup(ctx, &pb.DeleteBackupRequest{BackupId: first.BackupId})
+	if resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION deleting inside a chain, got %v", resp.Status)
+	}
+	for _, b := range []*pb.BackupMetadata{second, first, full} {
+		if resp, _ := bm.DeleteBackup(ctx, &pb.DeleteBackupRequest{BackupId: b.BackupId}); resp.Status.Code != pb.Status_OK {
+			t.Errorf("failed to delete %s: %v", b.BackupId, resp.Status)
+		}
+	}
+	if again := backup("again.db"); again.ParentBackupId != "" {
+		t.Errorf("expected a new chain once the last was deleted, got parent %q", again.ParentBackupId)
+	}
+}
+
+func TestIncrementalBackupUnsupported(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewMemoryStore("incremental-unsupported", collection.Options{})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	coll, _ := collection.NewCollection(&pb.Collection{Namespace: "test", Name: "mem"}, store, nil)
+	defer coll.Close()
+	repo := collection.NewCollectionRepo(store)
+	repo.SetStoreOpener(func(path string, opts *pb.StoreOptions) (collection.Store, error) { return store, nil })
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "mem"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	dir := t.TempDir()
+	bm, err := collection.NewBackupManager(repo, &collection.SqliteTransport{}, filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("failed to create backup manager: %v", err)
+	}
+	defer bm.Close()
+	resp, _ := bm.BackupCollection(ctx, &pb.BackupCollectionRequest{
+		Collection:  &pb.NamespacedName{Namespace: "test", Name: "mem"},
+		DestPath:    filepath.Join(dir, "mem.db"),
+		Incremental: true,
+	})
+	if resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION for a store without a file, got %v", resp.Status)
+	}
+}
@@ -0,0 +1,130 @@
+package collection
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrBackupChecksumMismatch is returned for backups whose database or files
+// no longer match the checksums in their manifest.
+var ErrBackupChecksumMismatch = errors.New("backup does not match its checksums")
+
+// buildBackupManifest sums a backup's database at dbPath and the files in
+// its ".files" directory, as they will be stored.
+func buildBackupManifest(dbPath string) (*pb.BackupManifest, error) {
+	dbSum, err := fileSHA256(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum backup database: %w", err)
+	}
+	files, err := filesSHA256(dbPath + ".files")
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum backup files: %w", err)
+	}
+	return &pb.BackupManifest{DbSha256: dbSum, FilesSha256: files}, nil
+}
+
+// checkBackupManifest checks a backup's stored database at dbPath, and its
+// files if withFiles, against the backup's manifest. Backups taken before
+// manifests were kept pass unchecked.
+func checkBackupManifest(backup *pb.BackupMetadata, dbPath string, withFiles bool) error {
+	manifest := backup.GetManifest()
+	if manifest == nil {
+		return nil
+	}
+	sum, err := fileSHA256(dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to checksum backup database: %w", err)
+	}
+	if sum != manifest.DbSha256 {
+		return fmt.Errorf("%w: database of %s has sha256 %s, expected %s", ErrBackupChecksumMismatch, backup.BackupId, sum, manifest.DbSha256)
+	}
+	if !withFiles {
+		return nil
+	}
+
+	files, err := filesSHA256(dbPath + ".files")
+	if err != nil {
+		return fmt.Errorf("failed to checksum backup files: %w", err)
+	}
+	var problems []string
+	for name, want := range manifest.FilesSha256 {
+		switch got, ok := files[name]; {
+		case !ok:
+			problems = append(problems, name+" is missing")
+		case got != want:
+			problems = append(problems, name+" has changed")
+		}
+	}
+	for name := range files {
+		if _, ok := manifest.FilesSha256[name]; !ok {
+			problems = append(problems, name+" was not backed up")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%w: files of %s: %s", ErrBackupChecksumMismatch, backup.BackupId, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// unmarshalManifest decodes a manifest as the metadata store keeps it; nil
+// for backups without one.
+func unmarshalManifest(data []byte) (*pb.BackupManifest, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	manifest := &pb.BackupManifest{}
+	if err := proto.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode backup manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// filesSHA256 sums the files under dir by their slash-separated path within
+// it; a missing dir has none.
+func filesSHA256(dir string) (map[string]string, error) {
+	sums := make(map[string]string)
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		sum, err := fileSHA256(p)
+		if err != nil {
+			return err
+		}
+		sums[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// fileSHA256 returns the hex SHA-256 of a file's contents.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
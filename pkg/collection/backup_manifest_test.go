@@ -0,0 +1,101 @@
+package collection
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+func TestBackupManifest(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	store, err := createTestStore(filepath.Join(tmpDir, "source.db"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	fsDir := filepath.Join(tmpDir, "files")
+	os.MkdirAll(filepath.Join(fsDir, "docs"), 0755)
+	for i := 0; i < 3; i++ {
+		os.WriteFile(filepath.Join(fsDir, "docs", fmt.Sprintf("file-%d.txt", i)), []byte(fmt.Sprintf("content %d", i)), 0644)
+	}
+	fs, err := NewLocalFileSystem(fsDir)
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+	coll, err := NewCollection(&pb.Collection{Namespace: "test", Name: "users"}, store, fs)
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "u1", ProtoData: []byte("data")})
+	repo := &MockCollectionRepo{collections: map[string]*Collection{"test/users": coll}}
+	bm, err := NewBackupManager(repo, &SqliteTransport{}, filepath.Join(tmpDir, "backups", "metadata.db"))
+	if err != nil {
+		t.Fatalf("failed to create backup manager: %v", err)
+	}
+	defer bm.Close()
+	bm.SetPathLayout(NewPathLayout(filepath.Join(tmpDir, "data")))
+
+	backupPath := filepath.Join(tmpDir, "backups", "users.db")
+	resp, _ := bm.BackupCollection(ctx, &pb.BackupCollectionRequest{
+		Collection:   &pb.NamespacedName{Namespace: "test", Name: "users"},
+		DestPath:     backupPath,
+		IncludeFiles: true,
+	})
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", resp.Status)
+	}
+
+	// The manifest sums the database and every file, and is kept
+	data, _ := os.ReadFile(backupPath)
+	sum := sha256.Sum256(data)
+	manifest := resp.Backup.Manifest
+	if manifest.GetDbSha256() != hex.EncodeToString(sum[:]) || len(manifest.GetFilesSha256()) != 3 || manifest.FilesSha256["docs/file-1.txt"] == "" {
+		t.Fatalf("unexpected manifest %v", manifest)
+	}
+	stored, err := bm.metaStore.GetBackup(ctx, resp.Backup.BackupId)
+	if err != nil || stored.Manifest.GetDbSha256() != manifest.DbSha256 || len(stored.Manifest.GetFilesSha256()) != 3 {
+		t.Fatalf("expected the manifest stored, got %v %v", stored.GetManifest(), err)
+	}
+	verify, _ := bm.VerifyBackup(ctx, &pb.VerifyBackupRequest{BackupId: resp.Backup.BackupId})
+	if !verify.IsValid {
+		t.Fatalf("expected the backup valid, got %s", verify.ErrorMessage)
+	}
+
+	// A changed file fails verification and restores
+	filePath := filepath.Join(backupPath+".files", "docs", "file-1.txt")
+	os.WriteFile(filePath, []byte("changed"), 0644)
+	verify, _ = bm.VerifyBackup(ctx, &pb.VerifyBackupRequest{BackupId: resp.Backup.BackupId})
+	if verify.IsValid || verify.Status.Message != "backup checksum mismatch" {
+		t.Errorf("expected a checksum mismatch, got %q: %s", verify.Status.Message, verify.ErrorMessage)
+	}
+	restore, _ := bm.RestoreBackup(ctx, &pb.RestoreBackupRequest{BackupId: resp.Backup.BackupId, DestNamespace: "restored", DestName: "users"})
+	if restore.Status.Code != pb.Status_DATA_LOSS {
+		t.Errorf("expected DATA_LOSS restoring a changed backup, got %v", restore.Status)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "data", "restored")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing restored, got %v", err)
+	}
+
+	// So do missing and added files
+	os.WriteFile(filePath, []byte("content 1"), 0644)
+	os.Remove(filepath.Join(backupPath+".files", "docs", "file-2.txt"))
+	os.WriteFile(filepath.Join(backupPath+".files", "extra.txt"), []byte("extra"), 0644)
+	err = checkBackupManifest(resp.Backup, backupPath, true)
+	if want := fmt.Sprintf("%v: files of %s: docs/file-2.txt is missing, extra.txt was not backed up", ErrBackupChecksumMismatch, resp.Backup.BackupId); err == nil || err.Error() != want {
+		t.Errorf("expected %q, got %v", want, err)
+	}
+
+	// A changed database is caught whether or not files are checked
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(backupPath, data, 0644)
+	if err := checkBackupManifest(resp.Backup, backupPath, false); err == nil {
+		t.Errorf("expected a changed database caught")
+	}
+}
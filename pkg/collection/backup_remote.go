@@ -0,0 +1,246 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// Storage types of backups kept in object storage, named by the scheme of
+// their dest_path, e.g. s3://bucket/backups/users.db.
+const (
+	StorageTypeS3  = "s3"
+	StorageTypeGCS = "gcs"
+)
+
+// ErrObjectStorageUnavailable is returned for backups in object storage of a
+// type the BackupManager has no ObjectStorageOpener for.
+var ErrObjectStorageUnavailable = errors.New("object storage not configured")
+
+// ObjectStorage keeps backups in a bucket. s3.FileSystem implements it for
+// S3-compatible storage and, through its XML API, Google Cloud Storage.
+type ObjectStorage interface {
+	// UploadFile uploads a local file to key, in parts if it is large.
+	UploadFile(ctx context.Context, key, localPath string) error
+	// DownloadFile downloads key to a new local file.
+	DownloadFile(ctx context.Context, key, localPath string) error
+	List(ctx context.Context, prefix string) ([]string, error)
+	Stat(ctx context.Context, key string) (int64, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// ObjectStorageOpener opens the bucket named in a backup's dest_path.
+type ObjectStorageOpener func(bucket string) (ObjectStorage, error)
+
+// SetObjectStorage keeps backups whose dest_path starts with storageType://
+// (StorageTypeS3 or StorageTypeGCS) in buckets opened with open. Backups are
+// staged on local disk, then uploaded; restores and verification download
+// them again. Call it before serving requests.
+func (bm *BackupManager) SetObjectStorage(storageType string, open ObjectStorageOpener) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if bm.objectStorage == nil {
+		bm.objectStorage = make(map[string]ObjectStorageOpener)
+	}
+	bm.objectStorage[storageType] = open
+}
+
+// backupStorageType returns the storage type of a backup path: "local", or
+// the scheme of an object storage URI.
+func backupStorageType(p string) string {
+	for _, t := range []string{StorageTypeS3, StorageTypeGCS} {
+		if strings.HasPrefix(p, t+"://") {
+			return t
+		}
+	}
+	return "local"
+}
+
+// joinBackupPath joins a backup directory, local or an object storage URI,
+// and a file name.
+func joinBackupPath(dir, name string) string {
+	if backupStorageType(dir) == "local" {
+		return filepath.Join(dir, name)
+	}
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
+
+// openObjectStorage opens the bucket of an object storage URI and returns
+// it with the object key.
+func (bm *BackupManager) openObjectStorage(uri string) (ObjectStorage, string, error) {
+	storageType := backupStorageType(uri)
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(uri, storageType+"://"), "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return nil, "", fmt.Errorf("invalid backup path %q: expected %s://bucket/key", uri, storageType)
+	}
+	open := bm.objectStorage[storageType]
+	if open == nil {
+		return nil, "", fmt.Errorf("%w: %s", ErrObjectStorageUnavailable, storageType)
+	}
+	store, err := open(bucket)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open bucket %s: %w", bucket, err)
+	}
+	return store, key, nil
+}
+
+// uploadBackup uploads a backup staged at localPath, with its files in
+// localPath+".files" if includeFiles, to key and key+".files/". A failed
+// upload removes what it uploaded.
+func uploadBackup(ctx context.Context, store ObjectStorage, localPath, key string, includeFiles bool) error {
+	if err := store.UploadFile(ctx, key, localPath); err != nil {
+		return fmt.Errorf("failed to upload backup database: %w", err)
+	}
+	if !includeFiles {
+		return nil
+	}
+	filesDir := localPath + ".files"
+	err := filepath.WalkDir(filesDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(filesDir, p)
+		if err != nil {
+			return err
+		}
+		return store.UploadFile(ctx, key+".files/"+filepath.ToSlash(rel), p)
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		deleteBackupObjects(context.Background(), store, key)
+		return fmt.Errorf("failed to upload backup files: %w", err)
+	}
+	return nil
+}
+
+// deleteBackupObjects removes a backup's database and files from object
+// storage and returns the size of the database.
+func deleteBackupObjects(ctx context.Context, store ObjectStorage, key string) (int64, error) {
+	size, _ := store.Stat(ctx, key)
+	files, err := store.List(ctx, key+".files/")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list backup files: %w", err)
+	}
+	for _, file := range append(files, key) {
+		if err := store.Delete(ctx, file); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// statBackup returns the size of a backup's database, failing if it is
+// missing.
+func (bm *BackupManager) statBackup(ctx context.Context, backup *pb.BackupMetadata) (int64, error) {
+	if backupStorageType(backup.StoragePath) == "local" {
+		info, err := os.Stat(backup.StoragePath)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	store, key, err := bm.openObjectStorage(backup.StoragePath)
+	if err != nil {
+		return 0, err
+	}
+	return store.Stat(ctx, key)
+}
+
+// fetchBackup returns the local paths of a backup's database and, if
+// withFiles, its files directory. Backups in object storage are downloaded,
+// encrypted backups decrypted and incremental backups rebuilt into
+// temporary directories the returned cleanup removes.
+func (bm *BackupManager) fetchBackup(ctx context.Context, backup *pb.BackupMetadata, withFiles bool) (string, string, func(), error) {
+	localPath, cleanup, err := bm.downloadBackup(ctx, backup, withFiles)
+	if err != nil {
+		return "", "", nil, err
+	}
+	filesDir := localPath + ".files"
+	if backup.ParentBackupId == "" {
+		return localPath, filesDir, cleanup, nil
+	}
+	dbPath, rebuilt, err := bm.rebuildBackup(ctx, backup, localPath)
+	if err != nil {
+		cleanup()
+		return "", "", nil, err
+	}
+	return dbPath, filesDir, func() { rebuilt(); cleanup() }, nil
+}
+
+// downloadBackup returns the local path of a backup's stored database, with
+// its files beside it in ".files" if withFiles, once they are checked against
+// its manifest. Backups in object storage are downloaded, and encrypted
+// backups decrypted, to a temporary directory the returned cleanup removes.
+func (bm *BackupManager) downloadBackup(ctx context.Context, backup *pb.BackupMetadata, withFiles bool) (string, func(), error) {
+	localPath, cleanup, err := bm.downloadStoredBackup(ctx, backup, withFiles)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := checkBackupManifest(backup, localPath, withFiles); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if backup.EncryptionKeyId == "" {
+		return localPath, cleanup, nil
+	}
+	defer cleanup()
+	return bm.decryptBackup(ctx, backup, localPath, withFiles)
+}
+
+// downloadStoredBackup returns the local path of a backup's database as
+// stored, downloading backups in object storage.
+func (bm *BackupManager) downloadStoredBackup(ctx context.Context, backup *pb.BackupMetadata, withFiles bool) (string, func(), error) {
+	if backupStorageType(backup.StoragePath) == "local" {
+		return backup.StoragePath, func() {}, nil
+	}
+	store, key, err := bm.openObjectStorage(backup.StoragePath)
+	if err != nil {
+		return "", nil, err
+	}
+	tmpDir, err := os.MkdirTemp("", "backup-download-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	localPath := filepath.Join(tmpDir, path.Base(key))
+	if err := store.DownloadFile(ctx, key, localPath); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to download backup: %w", err)
+	}
+	if !withFiles {
+		return localPath, cleanup, nil
+	}
+
+	files, err := store.List(ctx, key+".files/")
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to list backup files: %w", err)
+	}
+	if int64(len(files)) < backup.FileCount {
+		cleanup()
+		return "", nil, fmt.Errorf("backup files missing: found %d of %d", len(files), backup.FileCount)
+	}
+	filesDir := localPath + ".files"
+	if err := os.MkdirAll(filesDir, 0755); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	for _, file := range files {
+		rel := strings.TrimPrefix(file, key+".files/")
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			cleanup()
+			return "", nil, fmt.Errorf("invalid backup file name %q", rel)
+		}
+		if err := store.DownloadFile(ctx, file, filepath.Join(filesDir, filepath.FromSlash(rel))); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("failed to download backup file %s: %w", rel, err)
+		}
+	}
+	return localPath, cleanup, nil
+}
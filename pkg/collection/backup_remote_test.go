@@ -0,0 +1,177 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// dirStorage is an ObjectStorage keeping objects as files under a directory.
+type dirStorage struct {
+	root string
+}
+
+func (d *dirStorage) UploadFile(ctx context.Context, key, localPath string) error {
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(d.root, key)), 0755); err != nil {
+		return err
+	}
+	return copyFile(localPath, filepath.Join(d.root, key))
+}
+
+func (d *dirStorage) DownloadFile(ctx context.Context, key, localPath string) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	return copyFile(filepath.Join(d.root, key), localPath)
+}
+
+func (d *dirStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(d.root, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		key, _ := filepath.Rel(d.root, p)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, filepath.ToSlash(key))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (d *dirStorage) Stat(ctx context.Context, key string) (int64, error) {
+	info, err := os.Stat(filepath.Join(d.root, key))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (d *dirStorage) Delete(ctx context.Context, key string) error {
+	return os.Remove(filepath.Join(d.root, key))
+}
+
+func TestBackupObjectStorage(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+
+	store, err := createTestStore(filepath.Join(tmpDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 10; i++ {
+		store.CreateRecord(ctx, &pb.CollectionRecord{
+			Id:        fmt.Sprintf("record-%d", i),
+			Metadata:  &pb.Metadata{CreatedAt: timestamppb.Now(), UpdatedAt: timestamppb.Now()},
+			ProtoData: []byte(fmt.Sprintf("data-%d", i)),
+		})
+	}
+	files, err := NewLocalFileSystem(filepath.Join(tmpDir, "files"))
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+	for _, name := range []string{"a.txt", "docs/b.txt"} {
+		if err := files.Save(ctx, name, []byte("content of "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := &MockCollectionRepo{collections: make(map[string]*Collection)}
+	coll, _ := NewCollection(&pb.Collection{Namespace: "test", Name: "users"}, store, files)
+	repo.collections["test/users"] = coll
+
+	bm, err := NewBackupManager(repo, &SqliteTransport{}, filepath.Join(tmpDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("failed to create backup manager: %v", err)
+	}
+	defer bm.Close()
+	bm.SetPathLayout(NewPathLayout(filepath.Join(tmpDir, "data")))
+	users := &pb.NamespacedName{Namespace: "test", Name: "users"}
+
+	// Without storage configured, object storage is unavailable
+	resp, _ := bm.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: users, DestPath: "s3://backups/users.db"})
+	if resp.Status.Code != pb.Status_UNIMPLEMENTED {
+		t.Fatalf("expected UNIMPLEMENTED without storage, got %v", resp.Status)
+	}
+
+	buckets := filepath.Join(tmpDir, "buckets")
+	bm.SetObjectStorage(StorageTypeS3, func(bucket string) (ObjectStorage, error) {
+		return &dirStorage{root: filepath.Join(buckets, bucket)}, nil
+	})
+	resp, _ = bm.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: users, DestPath: "s3://backups/"})
+	if resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT without a key, got %v", resp.Status)
+	}
+
+	resp, _ = bm.BackupCollection(ctx, &pb.BackupCollectionRequest{
+		Collection:   users,
+		DestPath:     "s3://backups/nightly/users.db",
+		IncludeFiles: true,
+	})
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", resp.Status)
+	}
+	backup := resp.Backup
+	if backup.StorageType != StorageTypeS3 || backup.StoragePath != "s3://backups/nightly/users.db" || backup.FileCount != 2 {
+		t.Errorf("unexpected backup metadata %v", backup)
+	}
+	if _, err := os.Stat(filepath.Join(buckets, "backups", "nightly", "users.db.files", "docs", "b.txt")); err != nil {
+		t.Errorf("expected the files uploaded: %v", err)
+	}
+	resp, _ = bm.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: users, DestPath: "s3://backups/nightly/users.db"})
+	if resp.Status.Code != pb.Status_ALREADY_EXISTS {
+		t.Errorf("expected ALREADY_EXISTS for an existing object, got %v", resp.Status)
+	}
+
+	verify, _ := bm.VerifyBackup(ctx, &pb.VerifyBackupRequest{BackupId: backup.BackupId})
+	if !verify.IsValid {
+		t.Errorf("expected the backup valid, got %s", verify.ErrorMessage)
+	}
+
+	restore, _ := bm.RestoreBackup(ctx, &pb.RestoreBackupRequest{
+		BackupId:      backup.BackupId,
+		DestNamespace: "restored",
+		DestName:      "users",
+	})
+	if restore.Status.Code != pb.Status_OK || restore.FilesRestored != 2 {
+		t.Fatalf("restore failed: %v", restore)
+	}
+	restored, err := os.ReadFile(filepath.Join(bm.layout.CollectionFiles("restored", "users"), "docs", "b.txt"))
+	if err != nil || string(restored) != "content of docs/b.txt" {
+		t.Errorf("expected the files restored, got %q (%v)", restored, err)
+	}
+
+	// A lost file makes the backup invalid
+	os.Remove(filepath.Join(buckets, "backups", "nightly", "users.db.files", "a.txt"))
+	if verify, _ := bm.VerifyBackup(ctx, &pb.VerifyBackupRequest{BackupId: backup.BackupId}); verify.IsValid {
+		t.Error("expected the backup invalid without its files")
+	}
+
+	deleted, _ := bm.DeleteBackup(ctx, &pb.DeleteBackupRequest{BackupId: backup.BackupId})
+	if deleted.Status.Code != pb.Status_OK || deleted.BytesFreed == 0 {
+		t.Fatalf("delete failed: %v", deleted)
+	}
+	if left, _ := (&dirStorage{root: filepath.Join(buckets, "backups")}).List(ctx, ""); len(left) != 0 {
+		t.Errorf("expected every object deleted, got %v", left)
+	}
+}
+
+func TestJoinBackupPath(t *testing.T) {
+	for dir, want := range map[string]string{
+		"/var/backups/":       "/var/backups/users.db",
+		"s3://bucket/nightly": "s3://bucket/nightly/users.db",
+		"gcs://bucket/":       "gcs://bucket/users.db",
+	} {
+		if got := joinBackupPath(dir, "users.db"); got != want {
+			t.Errorf("joinBackupPath(%q) = %q, want %q", dir, got, want)
+		}
+	}
+}
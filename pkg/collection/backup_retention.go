@@ -0,0 +1,350 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// DefaultPruneInterval is how often StartPruner applies retention when
+// given no interval.
+const DefaultPruneInterval = time.Hour
+
+// Reasons a backup is pruned, as recorded in PruneEvent.reason.
+const (
+	PruneReasonMaxCount      = "max_count"
+	PruneReasonMaxAge        = "max_age"
+	PruneReasonMaxTotalBytes = "max_total_bytes"
+)
+
+// RetentionPolicy limits the backups kept of a collection. Zero limits do
+// not apply, and the newest backup is always kept.
+type RetentionPolicy struct {
+	MaxCount      int           // Backups kept, newest first
+	MaxAge        time.Duration // Backups older than this are pruned
+	MaxTotalBytes int64         // Older backups past this total size are pruned
+}
+
+// IsZero reports whether the policy keeps every backup.
+func (p RetentionPolicy) IsZero() bool {
+	return p.MaxCount <= 0 && p.MaxAge <= 0 && p.MaxTotalBytes <= 0
+}
+
+// String describes the policy, for logs.
+func (p RetentionPolicy) String() string {
+	var limits []string
+	if p.MaxCount > 0 {
+		limits = append(limits, fmt.Sprintf("%d backups", p.MaxCount))
+	}
+	if p.MaxAge > 0 {
+		limits = append(limits, p.MaxAge.String())
+	}
+	if p.MaxTotalBytes > 0 {
+		limits = append(limits, fmt.Sprintf("%d bytes", p.MaxTotalBytes))
+	}
+	if len(limits) == 0 {
+		return "keep all"
+	}
+	return strings.Join(limits, ", ")
+}
+
+// retentionPolicy converts a schedule's retention.
+func retentionPolicy(r *pb.BackupRetention) RetentionPolicy {
+	return RetentionPolicy{
+		MaxCount:      int(r.GetMaxCount()),
+		MaxAge:        time.Duration(r.GetMaxAgeSeconds()) * time.Second,
+		MaxTotalBytes: r.GetMaxTotalBytes(),
+	}
+}
+
+// backupPruner applies retention in the background.
+type backupPruner struct {
+	policy RetentionPolicy // Default for collections without their own
+	stop   chan struct{}
+	done   chan struct{}
+	mu     sync.Mutex
+}
+
+// SetRetentionPolicy sets the retention of collections whose backup
+// schedule has none of its own. The zero policy, the default, keeps every
+// backup.
+func (bm *BackupManager) SetRetentionPolicy(policy RetentionPolicy) {
+	bm.pruner.mu.Lock()
+	defer bm.pruner.mu.Unlock()
+	bm.pruner.policy = policy
+}
+
+// retentionFor returns the retention of a collection's backups: its
+// schedule's, if set, or the default.
+func (bm *BackupManager) retentionFor(coll *pb.NamespacedName) RetentionPolicy {
+	bm.schedules.mu.Lock()
+	e := bm.schedules.entries[scheduleKey(coll)]
+	var policy RetentionPolicy
+	if e != nil {
+		policy = retentionPolicy(e.schedule.Retention)
+	}
+	bm.schedules.mu.Unlock()
+	if !policy.IsZero() {
+		return policy
+	}
+
+	bm.pruner.mu.Lock()
+	defer bm.pruner.mu.Unlock()
+	return bm.pruner.policy
+}
+
+// Prune deletes the backups of every collection that its retention no
+// longer keeps, with their files, and records a PruneEvent for each.
+func (bm *BackupManager) Prune(ctx context.Context) ([]*pb.PruneEvent, error) {
+	colls, err := bm.metaStore.BackupCollections(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backed up collections: %w", err)
+	}
+	var events []*pb.PruneEvent
+	for _, coll := range colls {
+		pruned, err := bm.pruneCollection(ctx, coll, bm.clock.Now())
+		events = append(events, pruned...)
+		if err != nil {
+			return events, err
+		}
+	}
+	return events, nil
+}
+
+// pruneCollection applies a collection's retention at now.
+func (bm *BackupManager) pruneCollection(ctx context.Context, coll *pb.NamespacedName, now time.Time) ([]*pb.PruneEvent, error) {
+	policy := bm.retentionFor(coll)
+	if policy.IsZero() {
+		return nil, nil
+	}
+	backups, _, err := bm.metaStore.ListBackups(ctx, &pb.ListBackupsRequest{Collection: coll})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups of %s: %w", scheduleKey(coll), err)
+	}
+
+	// Newest first, so the limits keep the most recent backups
+	var events []*pb.PruneEvent
+	var keptBytes, oldestKept int64
+	needed := make(map[string]bool) // Parents of kept incremental backups
+	for i, backup := range backups {
+		reason := ""
+		switch {
+		case i == 0, needed[backup.BackupId]:
+		case policy.MaxCount > 0 && i >= policy.MaxCount:
+			reason = PruneReasonMaxCount
+		case policy.MaxAge > 0 && now.Sub(time.Unix(backup.Timestamp, 0)) > policy.MaxAge:
+			reason = PruneReasonMaxAge
+		case policy.MaxTotalBytes > 0 && keptBytes+backup.SizeBytes > policy.MaxTotalBytes:
+			reason = PruneReasonMaxTotalBytes
+		}
+		if reason == "" {
+			keptBytes += backup.SizeBytes
+			oldestKept = backup.Timestamp
+			needed[backup.ParentBackupId] = true
+			continue
+		}
+		if err := bm.holds.check(ctx, LegalHoldPrune, coll.Namespace, coll.Name, ""); err != nil {
+			log.Printf("Not pruning backups of %s: %v", scheduleKey(coll), err)
+			return events, nil
+		}
+
+		resp, err := bm.DeleteBackup(ctx, &pb.DeleteBackupRequest{BackupId: backup.BackupId})
+		if err != nil {
+			return events, err
+		}
+		if resp.Status.Code != pb.Status_OK {
+			return events, fmt.Errorf("failed to prune backup %s: %s", backup.BackupId, resp.Status.Message)
+		}
+		event := &pb.PruneEvent{
+			BackupId:        backup.BackupId,
+			Collection:      coll,
+			BackupTimestamp: backup.Timestamp,
+			PrunedAt:        now.Unix(),
+			Reason:          reason,
+			BytesFreed:      backup.SizeBytes,
+		}
+		if err := bm.metaStore.SavePruneEvent(ctx, event); err != nil {
+			log.Printf("Warning: failed to record pruning of backup %s: %v", backup.BackupId, err)
+		}
+		log.Printf("Pruned backup %s of %s (%s, %d bytes)", backup.BackupId, scheduleKey(coll), reason, backup.SizeBytes)
+		events = append(events, event)
+	}
+
+	// Changes before the oldest backup kept can no longer be replayed
+	if len(events) > 0 && bm.changes != nil {
+		if _, err := bm.changes.Trim(ctx, coll.Namespace, coll.Name, time.Unix(oldestKept, 0)); err != nil {
+			log.Printf("Warning: failed to trim the changelog of %s: %v", scheduleKey(coll), err)
+		}
+	}
+	return events, nil
+}
+
+// StartPruner applies retention every interval (DefaultPruneInterval if
+// zero) until StopPruner or Close.
+func (bm *BackupManager) StartPruner(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultPruneInterval
+	}
+	p := bm.pruner
+	p.mu.Lock()
+	if p.stop != nil {
+		p.mu.Unlock()
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	p.stop, p.done = stop, done
+	p.mu.Unlock()
+
+	prune := func() {
+		if _, err := bm.Prune(context.Background()); err != nil {
+			log.Printf("Warning: backup pruning failed: %v", err)
+		}
+	}
+	go func() {
+		defer close(done)
+		prune()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			prune()
+		}
+	}()
+}
+
+// StopPruner ends the StartPruner loop and waits for it to return.
+func (bm *BackupManager) StopPruner() {
+	p := bm.pruner
+	p.mu.Lock()
+	stop, done := p.stop, p.done
+	p.stop, p.done = nil, nil
+	p.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// ListPruneEvents lists the backups retention has deleted, newest first.
+func (bm *BackupManager) ListPruneEvents(ctx context.Context, req *pb.ListPruneEventsRequest) (*pb.ListPruneEventsResponse, error) {
+	events, err := bm.metaStore.ListPruneEvents(ctx, req)
+	if err != nil {
+		return &pb.ListPruneEventsResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: fmt.Sprintf("failed to list prune events: %v", err)},
+		}, nil
+	}
+	return &pb.ListPruneEventsResponse{
+		Status: &pb.Status{Code: pb.Status_OK, Message: fmt.Sprintf("found %d prune events", len(events))},
+		Events: events,
+	}, nil
+}
+
+// BackupCollections lists the collections that have backups.
+func (s *BackupMetadataStore) BackupCollections(ctx context.Context) ([]*pb.NamespacedName, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT DISTINCT collection_namespace, collection_name FROM backups
+	ORDER BY collection_namespace, collection_name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var colls []*pb.NamespacedName
+	for rows.Next() {
+		coll := &pb.NamespacedName{}
+		if err := rows.Scan(&coll.Namespace, &coll.Name); err != nil {
+			return nil, err
+		}
+		colls = append(colls, coll)
+	}
+	return colls, rows.Err()
+}
+
+// SavePruneEvent records a backup deleted by retention.
+func (s *BackupMetadataStore) SavePruneEvent(ctx context.Context, event *pb.PruneEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `
+	INSERT INTO prune_events (
+		backup_id, collection_namespace, collection_name, backup_timestamp,
+		pruned_at, reason, bytes_freed
+	) VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, event.BackupId, event.Collection.Namespace, event.Collection.Name, event.BackupTimestamp,
+		event.PrunedAt, event.Reason, event.BytesFreed)
+	return err
+}
+
+// ListPruneEvents lists prune events with optional filters, newest first.
+func (s *BackupMetadataStore) ListPruneEvents(ctx context.Context, req *pb.ListPruneEventsRequest) ([]*pb.PruneEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var whereClauses []string
+	var args []interface{}
+	if req.Collection != nil {
+		whereClauses = append(whereClauses, "collection_namespace = ? AND collection_name = ?")
+		args = append(args, req.Collection.Namespace, req.Collection.Name)
+	} else if req.Namespace != "" {
+		whereClauses = append(whereClauses, "collection_namespace = ?")
+		args = append(args, req.Namespace)
+	}
+	if req.SinceTimestamp > 0 {
+		whereClauses = append(whereClauses, "pruned_at >= ?")
+		args = append(args, req.SinceTimestamp)
+	}
+	whereClause := ""
+	if len(whereClauses) > 0 {
+		whereClause = "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+	SELECT backup_id, collection_namespace, collection_name, backup_timestamp,
+	       pruned_at, reason, bytes_freed
+	FROM prune_events %s
+	ORDER BY pruned_at DESC, id DESC
+	LIMIT %d
+	`, whereClause, limit), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prune events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*pb.PruneEvent
+	for rows.Next() {
+		event := &pb.PruneEvent{Collection: &pb.NamespacedName{}}
+		if err := rows.Scan(&event.BackupId, &event.Collection.Namespace, &event.Collection.Name,
+			&event.BackupTimestamp, &event.PrunedAt, &event.Reason, &event.BytesFreed); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// ListPruneEvents lists backups deleted by retention.
+func (s *GrpcServer) ListPruneEvents(ctx context.Context, req *pb.ListPruneEventsRequest) (*pb.ListPruneEventsResponse, error) {
+	if s.backupManager == nil {
+		return &pb.ListPruneEventsResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: "backup manager not initialized"},
+		}, nil
+	}
+	return s.backupManager.ListPruneEvents(ctx, req)
+}
@@ -0,0 +1,135 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// saveTestBackups records backups of test/users taken an hour apart, the
+// newest first, each 100 bytes with a files directory.
+func saveTestBackups(t *testing.T, bm *BackupManager, dir string, now time.Time, n int) []string {
+	t.Helper()
+	var ids []string
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("users-%d.db", i))
+		if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(path+".files", 0755); err != nil {
+			t.Fatal(err)
+		}
+		id := fmt.Sprintf("backup-%d", i)
+		if err := bm.metaStore.SaveBackup(context.Background(), &pb.BackupMetadata{
+			BackupId:    id,
+			Collection:  &pb.NamespacedName{Namespace: "test", Name: "users"},
+			Timestamp:   now.Add(-time.Duration(i) * time.Hour).Unix(),
+			SizeBytes:   100,
+			StoragePath: path,
+			StorageType: "local",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestBackupRetention(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	users := &pb.NamespacedName{Namespace: "test", Name: "users"}
+
+	for _, tc := range []struct {
+		name   string
+		policy RetentionPolicy
+		kept   int
+		reason string
+	}{
+		{"count", RetentionPolicy{MaxCount: 2}, 2, PruneReasonMaxCount},
+		{"age", RetentionPolicy{MaxAge: 90 * time.Minute}, 2, PruneReasonMaxAge},
+		{"bytes", RetentionPolicy{MaxTotalBytes: 350}, 3, PruneReasonMaxTotalBytes},
+		{"newest is kept", RetentionPolicy{MaxTotalBytes: 10}, 1, PruneReasonMaxTotalBytes},
+		{"keep all", RetentionPolicy{}, 5, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			bm, err := NewBackupManager(&MockCollectionRepo{collections: make(map[string]*Collection)}, &SqliteTransport{}, filepath.Join(dir, "metadata.db"))
+			if err != nil {
+				t.Fatalf("failed to create backup manager: %v", err)
+			}
+			defer bm.Close()
+			ids := saveTestBackups(t, bm, dir, now, 5)
+			bm.SetRetentionPolicy(tc.policy)
+
+			events, err := bm.pruneCollection(ctx, users, now)
+			if err != nil {
+				t.Fatalf("pruneCollection failed: %v", err)
+			}
+			if len(events) != 5-tc.kept {
+				t.Fatalf("expected %d backups pruned, got %v", 5-tc.kept, events)
+			}
+			for i, event := range events {
+				if event.BackupId != ids[tc.kept+i] || event.Reason != tc.reason || event.BytesFreed != 100 {
+					t.Errorf("unexpected event %v", event)
+				}
+				if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("users-%d.db.files", tc.kept+i))); !os.IsNotExist(err) {
+					t.Errorf("expected the files of %s removed, got %v", event.BackupId, err)
+				}
+			}
+			list, _ := bm.ListBackups(ctx, &pb.ListBackupsRequest{Collection: users})
+			if len(list.Backups) != tc.kept || list.Backups[0].BackupId != ids[0] {
+				t.Errorf("expected the newest %d backups kept, got %v", tc.kept, list.Backups)
+			}
+
+			logged, _ := bm.ListPruneEvents(ctx, &pb.ListPruneEventsRequest{Namespace: "test"})
+			if len(logged.Events) != len(events) {
+				t.Errorf("expected %d prune events listed, got %d", len(events), len(logged.Events))
+			}
+		})
+	}
+}
+
+func TestBackupRetentionFromSchedule(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := createTestStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	repo := &MockCollectionRepo{collections: make(map[string]*Collection)}
+	coll, _ := NewCollection(&pb.Collection{Namespace: "test", Name: "users"}, store, nil)
+	repo.collections["test/users"] = coll
+
+	bm, err := NewBackupManager(repo, &SqliteTransport{}, filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("failed to create backup manager: %v", err)
+	}
+	defer bm.Close()
+	saveTestBackups(t, bm, dir, time.Now(), 4)
+	bm.SetRetentionPolicy(RetentionPolicy{MaxCount: 3})
+
+	resp, _ := bm.SetSchedule(ctx, &pb.SetBackupScheduleRequest{Schedule: &pb.BackupSchedule{
+		Collection: &pb.NamespacedName{Namespace: "test", Name: "users"},
+		Cron:       "@daily",
+		DestDir:    dir,
+		Retention:  &pb.BackupRetention{MaxCount: 1},
+	}})
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("SetSchedule failed: %v", resp.Status)
+	}
+
+	events, err := bm.Prune(ctx)
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if len(events) != 3 {
+		t.Errorf("expected the schedule's retention to override the default, got %d pruned", len(events))
+	}
+}
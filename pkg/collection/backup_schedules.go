@@ -0,0 +1,414 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/cron"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultBackupScheduleTimeout bounds each scheduled backup.
+const DefaultBackupScheduleTimeout = time.Hour
+
+// ScheduledBackupLabel is set to "true" in the metadata of backups taken by a
+// schedule, so ListBackups can select them.
+const ScheduledBackupLabel = "scheduled"
+
+// backupScheduleEntry is a schedule with its parsed cron expression.
+type backupScheduleEntry struct {
+	schedule *pb.BackupSchedule
+	cron     *cron.Schedule
+	loc      *time.Location
+}
+
+// backupScheduler takes scheduled backups; entries are keyed by
+// namespace/name, one schedule per collection.
+type backupScheduler struct {
+	entries map[string]*backupScheduleEntry
+	wake    chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+	mu      sync.Mutex
+}
+
+func newBackupScheduler() *backupScheduler {
+	return &backupScheduler{
+		entries: make(map[string]*backupScheduleEntry),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// notify wakes the scheduler loop to recompute its next tick.
+func (s *backupScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// newBackupScheduleEntry validates a schedule and parses its cron expression.
+func newBackupScheduleEntry(sched *pb.BackupSchedule) (*backupScheduleEntry, error) {
+	if sched.Collection.GetNamespace() == "" || sched.Collection.GetName() == "" {
+		return nil, fmt.Errorf("collection namespace and name are required")
+	}
+	if sched.DestDir == "" {
+		return nil, fmt.Errorf("dest_dir is required")
+	}
+	c, err := cron.Parse(sched.Cron)
+	if err != nil {
+		return nil, err
+	}
+	loc := time.UTC
+	if sched.Timezone != "" {
+		if loc, err = time.LoadLocation(sched.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+	return &backupScheduleEntry{schedule: sched, cron: c, loc: loc}, nil
+}
+
+// next returns the Unix time of the next tick after t, or 0 if there is
+// none.
+func (e *backupScheduleEntry) next(t time.Time) int64 {
+	next := e.cron.Next(t.In(e.loc))
+	if next.IsZero() {
+		return 0
+	}
+	return next.Unix()
+}
+
+func scheduleKey(coll *pb.NamespacedName) string {
+	return coll.GetNamespace() + "/" + coll.GetName()
+}
+
+// loadSchedules registers the schedules kept in the metadata store. Ticks
+// missed while the manager was not running are not made up; each schedule
+// next fires at its first tick from now.
+func (bm *BackupManager) loadSchedules(ctx context.Context) error {
+	list, err := bm.metaStore.ListSchedules(ctx, "")
+	if err != nil {
+		return fmt.Errorf("failed to load backup schedules: %w", err)
+	}
+	now := bm.clock.Now()
+	bm.schedules.mu.Lock()
+	defer bm.schedules.mu.Unlock()
+	for _, sched := range list {
+		entry, err := newBackupScheduleEntry(sched)
+		if err != nil {
+			log.Printf("Warning: skipping backup schedule for %s: %v", scheduleKey(sched.Collection), err)
+			continue
+		}
+		sched.NextRunAt = entry.next(now)
+		bm.schedules.entries[scheduleKey(sched.Collection)] = entry
+	}
+	return nil
+}
+
+// SetSchedule sets the backup schedule of a collection, replacing any it
+// had. A schedule with an empty cron expression removes the collection's
+// schedule; backups already taken are kept.
+func (bm *BackupManager) SetSchedule(ctx context.Context, req *pb.SetBackupScheduleRequest) (*pb.SetBackupScheduleResponse, error) {
+	if req.Schedule.GetCollection().GetNamespace() == "" || req.Schedule.GetCollection().GetName() == "" {
+		return &pb.SetBackupScheduleResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection namespace and name are required"},
+		}, nil
+	}
+	sched := proto.Clone(req.Schedule).(*pb.BackupSchedule)
+	key := scheduleKey(sched.Collection)
+
+	if sched.Cron == "" {
+		if err := bm.metaStore.DeleteSchedule(ctx, sched.Collection); err != nil {
+			return &pb.SetBackupScheduleResponse{
+				Status: &pb.Status{Code: pb.Status_INTERNAL, Message: fmt.Sprintf("failed to delete backup schedule: %v", err)},
+			}, nil
+		}
+		bm.schedules.mu.Lock()
+		delete(bm.schedules.entries, key)
+		bm.schedules.mu.Unlock()
+		bm.schedules.notify()
+		return &pb.SetBackupScheduleResponse{
+			Status: &pb.Status{Code: pb.Status_OK, Message: fmt.Sprintf("backup schedule of %s removed", key)},
+		}, nil
+	}
+
+	entry, err := newBackupScheduleEntry(sched)
+	if err != nil {
+		return &pb.SetBackupScheduleResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: err.Error()},
+		}, nil
+	}
+	if _, err := bm.repo.GetCollection(ctx, sched.Collection.Namespace, sched.Collection.Name); err != nil {
+		return &pb.SetBackupScheduleResponse{
+			Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: fmt.Sprintf("collection not found: %v", err)},
+		}, nil
+	}
+	sched.LastRunAt, sched.LastBackupId, sched.LastStatus = 0, "", nil
+	sched.NextRunAt = entry.next(bm.clock.Now())
+
+	if err := bm.metaStore.SaveSchedule(ctx, sched); err != nil {
+		return &pb.SetBackupScheduleResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: fmt.Sprintf("failed to save backup schedule: %v", err)},
+		}, nil
+	}
+	bm.schedules.mu.Lock()
+	bm.schedules.entries[key] = entry
+	bm.schedules.mu.Unlock()
+	bm.schedules.notify()
+
+	return &pb.SetBackupScheduleResponse{
+		Status:   &pb.Status{Code: pb.Status_OK, Message: fmt.Sprintf("next backup of %s at %s", key, time.Unix(sched.NextRunAt, 0).UTC().Format(time.RFC3339))},
+		Schedule: proto.Clone(sched).(*pb.BackupSchedule),
+	}, nil
+}
+
+// ListSchedules lists backup schedules, optionally only those of one
+// namespace, ordered by collection.
+func (bm *BackupManager) ListSchedules(ctx context.Context, req *pb.ListBackupSchedulesRequest) (*pb.ListBackupSchedulesResponse, error) {
+	bm.schedules.mu.Lock()
+	var schedules []*pb.BackupSchedule
+	for _, e := range bm.schedules.entries {
+		if req.Namespace == "" || e.schedule.Collection.Namespace == req.Namespace {
+			schedules = append(schedules, proto.Clone(e.schedule).(*pb.BackupSchedule))
+		}
+	}
+	bm.schedules.mu.Unlock()
+
+	sort.Slice(schedules, func(i, j int) bool {
+		return scheduleKey(schedules[i].Collection) < scheduleKey(schedules[j].Collection)
+	})
+	return &pb.ListBackupSchedulesResponse{
+		Status:    &pb.Status{Code: pb.Status_OK, Message: fmt.Sprintf("found %d backup schedules", len(schedules))},
+		Schedules: schedules,
+	}, nil
+}
+
+// StartScheduler takes scheduled backups until StopScheduler or Close.
+// Backups run one at a time; a tick that comes while an earlier backup is
+// still running is skipped.
+func (bm *BackupManager) StartScheduler() {
+	s := bm.schedules
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.cancel, s.done = cancel, done
+	s.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			wait := time.Hour
+			if next := bm.runDueSchedules(ctx, bm.clock.Now()); !next.IsZero() {
+				wait = next.Sub(bm.clock.Now())
+			}
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-s.wake:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// StopScheduler ends the StartScheduler loop, cancelling any backup in
+// progress, and waits for it to return.
+func (bm *BackupManager) StopScheduler() {
+	s := bm.schedules
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel, s.done = nil, nil
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// runDueSchedules takes the backups due at now and returns the time of the
+// next tick, or the zero time if nothing is scheduled.
+func (bm *BackupManager) runDueSchedules(ctx context.Context, now time.Time) time.Time {
+	var due []*backupScheduleEntry
+	bm.schedules.mu.Lock()
+	for _, e := range bm.schedules.entries {
+		if e.schedule.NextRunAt != 0 && e.schedule.NextRunAt <= now.Unix() {
+			due = append(due, e)
+		}
+	}
+	bm.schedules.mu.Unlock()
+
+	for _, e := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		bm.runSchedule(ctx, e, now)
+	}
+
+	var earliest int64
+	bm.schedules.mu.Lock()
+	for _, e := range bm.schedules.entries {
+		if next := e.schedule.NextRunAt; next != 0 && (earliest == 0 || next < earliest) {
+			earliest = next
+		}
+	}
+	bm.schedules.mu.Unlock()
+	if earliest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(earliest, 0)
+}
+
+// runSchedule takes one scheduled backup and records its outcome on the
+// schedule.
+func (bm *BackupManager) runSchedule(ctx context.Context, e *backupScheduleEntry, scheduledAt time.Time) {
+	bm.schedules.mu.Lock()
+	sched := proto.Clone(e.schedule).(*pb.BackupSchedule)
+	bm.schedules.mu.Unlock()
+
+	metadata := make(map[string]string, len(sched.Metadata)+1)
+	for k, v := range sched.Metadata {
+		metadata[k] = v
+	}
+	metadata[ScheduledBackupLabel] = "true"
+	name := fmt.Sprintf("%s_%s_%s.db", sched.Collection.Namespace, sched.Collection.Name, scheduledAt.UTC().Format("20060102T150405Z"))
+
+	ctx, cancel := context.WithTimeout(ctx, DefaultBackupScheduleTimeout)
+	defer cancel()
+	resp, err := bm.BackupCollection(ctx, &pb.BackupCollectionRequest{
+		Collection:   sched.Collection,
+		DestPath:     joinBackupPath(sched.DestDir, name),
+		IncludeFiles: sched.IncludeFiles,
+		Metadata:     metadata,
+	})
+	status := resp.GetStatus()
+	if err != nil {
+		status = &pb.Status{Code: pb.Status_INTERNAL, Message: fmt.Sprintf("backup failed: %v", err)}
+	}
+	if status.GetCode() != pb.Status_OK {
+		log.Printf("Warning: scheduled backup of %s failed: %s", scheduleKey(sched.Collection), status.GetMessage())
+	} else if _, err := bm.pruneCollection(ctx, sched.Collection, bm.clock.Now()); err != nil {
+		log.Printf("Warning: pruning backups of %s failed: %v", scheduleKey(sched.Collection), err)
+	}
+
+	// Ticks that passed while the backup ran are skipped
+	bm.schedules.mu.Lock()
+	current := bm.schedules.entries[scheduleKey(sched.Collection)] == e
+	if current {
+		e.schedule.LastRunAt = scheduledAt.Unix()
+		e.schedule.LastStatus = status
+		if backup := resp.GetBackup(); backup != nil {
+			e.schedule.LastBackupId = backup.BackupId
+		}
+		finished := bm.clock.Now()
+		if finished.Before(scheduledAt) {
+			finished = scheduledAt
+		}
+		e.schedule.NextRunAt = e.next(finished)
+		sched = proto.Clone(e.schedule).(*pb.BackupSchedule)
+	}
+	bm.schedules.mu.Unlock()
+
+	// A schedule removed or replaced while its backup ran is left as it is
+	if current {
+		if err := bm.metaStore.SaveSchedule(context.Background(), sched); err != nil {
+			log.Printf("Warning: failed to save backup schedule of %s: %v", scheduleKey(sched.Collection), err)
+		}
+	}
+}
+
+// SaveSchedule stores a collection's backup schedule, replacing any it had.
+func (s *BackupMetadataStore) SaveSchedule(ctx context.Context, sched *pb.BackupSchedule) error {
+	data, err := proto.Marshal(sched)
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup schedule: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.db.ExecContext(ctx, `
+	INSERT INTO backup_schedules (collection_namespace, collection_name, schedule)
+	VALUES (?, ?, ?)
+	ON CONFLICT (collection_namespace, collection_name) DO UPDATE SET schedule = excluded.schedule
+	`, sched.Collection.Namespace, sched.Collection.Name, data)
+	return err
+}
+
+// DeleteSchedule removes a collection's backup schedule.
+func (s *BackupMetadataStore) DeleteSchedule(ctx context.Context, coll *pb.NamespacedName) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM backup_schedules WHERE collection_namespace = ? AND collection_name = ?", coll.Namespace, coll.Name)
+	return err
+}
+
+// ListSchedules lists the stored backup schedules, optionally only those of
+// one namespace.
+func (s *BackupMetadataStore) ListSchedules(ctx context.Context, namespace string) ([]*pb.BackupSchedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := "SELECT schedule FROM backup_schedules"
+	var args []interface{}
+	if namespace != "" {
+		query += " WHERE collection_namespace = ?"
+		args = append(args, namespace)
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY collection_namespace, collection_name", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query backup schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []*pb.BackupSchedule
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		sched := &pb.BackupSchedule{}
+		if err := proto.Unmarshal(data, sched); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal backup schedule: %w", err)
+		}
+		schedules = append(schedules, sched)
+	}
+	return schedules, rows.Err()
+}
+
+// SetBackupSchedule sets or removes a collection's automatic backups.
+func (s *GrpcServer) SetBackupSchedule(ctx context.Context, req *pb.SetBackupScheduleRequest) (*pb.SetBackupScheduleResponse, error) {
+	if s.backupManager == nil {
+		return &pb.SetBackupScheduleResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: "backup manager not initialized"},
+		}, nil
+	}
+	return s.backupManager.SetSchedule(ctx, req)
+}
+
+// ListBackupSchedules lists automatic backup schedules.
+func (s *GrpcServer) ListBackupSchedules(ctx context.Context, req *pb.ListBackupSchedulesRequest) (*pb.ListBackupSchedulesResponse, error) {
+	if s.backupManager == nil {
+		return &pb.ListBackupSchedulesResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: "backup manager not initialized"},
+		}, nil
+	}
+	return s.backupManager.ListSchedules(ctx, req)
+}
+
+// Backups returns the server's backup manager, or nil if it failed to
+// start.
+func (s *GrpcServer) Backups() *BackupManager {
+	return s.backupManager
+}
@@ -0,0 +1,157 @@
+package collection
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+func TestBackupSchedules(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+
+	store, err := createTestStore(filepath.Join(tmpDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	repo := &MockCollectionRepo{collections: make(map[string]*Collection)}
+	coll, err := NewCollection(&pb.Collection{Namespace: "test", Name: "users"}, store, nil)
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	repo.collections["test/users"] = coll
+
+	metaPath := filepath.Join(tmpDir, "backups", "metadata.db")
+	bm, err := NewBackupManager(repo, &SqliteTransport{}, metaPath)
+	if err != nil {
+		t.Fatalf("failed to create backup manager: %v", err)
+	}
+
+	users := &pb.NamespacedName{Namespace: "test", Name: "users"}
+	for _, tc := range []struct {
+		schedule *pb.BackupSchedule
+		code     pb.Status_Code
+	}{
+		{&pb.BackupSchedule{Collection: users, Cron: "every day", DestDir: tmpDir}, pb.Status_INVALID_ARGUMENT},
+		{&pb.BackupSchedule{Collection: users, Cron: "@daily"}, pb.Status_INVALID_ARGUMENT},
+		{&pb.BackupSchedule{Collection: &pb.NamespacedName{Namespace: "test", Name: "missing"}, Cron: "@daily", DestDir: tmpDir}, pb.Status_NOT_FOUND},
+	} {
+		resp, _ := bm.SetSchedule(ctx, &pb.SetBackupScheduleRequest{Schedule: tc.schedule})
+		if resp.Status.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.schedule, tc.code, resp.Status)
+		}
+	}
+
+	destDir := filepath.Join(tmpDir, "scheduled")
+	resp, _ := bm.SetSchedule(ctx, &pb.SetBackupScheduleRequest{Schedule: &pb.BackupSchedule{
+		Collection: users,
+		Cron:       "@hourly",
+		DestDir:    destDir,
+		Metadata:   map[string]string{"tier": "gold"},
+	}})
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("SetSchedule failed: %v", resp.Status)
+	}
+	next := time.Unix(resp.Schedule.NextRunAt, 0)
+	if next.Minute() != 0 || !next.After(time.Now()) {
+		t.Errorf("expected the next backup on the hour, got %s", next)
+	}
+
+	// Nothing is due until the next tick
+	bm.runDueSchedules(ctx, time.Now())
+	if list, _ := bm.ListBackups(ctx, &pb.ListBackupsRequest{}); len(list.Backups) != 0 {
+		t.Fatalf("expected no backups before the first tick, got %d", len(list.Backups))
+	}
+	if got := bm.runDueSchedules(ctx, next); !got.After(next) {
+		t.Errorf("expected the next tick after %s, got %s", next, got)
+	}
+	list, _ := bm.ListBackups(ctx, &pb.ListBackupsRequest{LabelSelector: ScheduledBackupLabel + "=true,tier=gold"})
+	if len(list.Backups) != 1 || filepath.Dir(list.Backups[0].StoragePath) != destDir {
+		t.Fatalf("expected one scheduled backup in %s, got %v", destDir, list.Backups)
+	}
+
+	// Schedules and their last run survive a restart
+	bm.Close()
+	bm, err = NewBackupManager(repo, &SqliteTransport{}, metaPath)
+	if err != nil {
+		t.Fatalf("failed to reopen backup manager: %v", err)
+	}
+	defer bm.Close()
+	schedules, _ := bm.ListSchedules(ctx, &pb.ListBackupSchedulesRequest{Namespace: "test"})
+	if len(schedules.Schedules) != 1 {
+		t.Fatalf("expected the schedule to be reloaded, got %v", schedules.Schedules)
+	}
+	sched := schedules.Schedules[0]
+	if sched.LastBackupId != list.Backups[0].BackupId || sched.LastStatus.GetCode() != pb.Status_OK || sched.LastRunAt != next.Unix() {
+		t.Errorf("expected the last run recorded, got %v", sched)
+	}
+
+	resp, _ = bm.SetSchedule(ctx, &pb.SetBackupScheduleRequest{Schedule: &pb.BackupSchedule{Collection: users}})
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("removing the schedule failed: %v", resp.Status)
+	}
+	if schedules, _ := bm.ListSchedules(ctx, &pb.ListBackupSchedulesRequest{}); len(schedules.Schedules) != 0 {
+		t.Errorf("expected no schedules after removal, got %v", schedules.Schedules)
+	}
+}
+
+func TestBackupSchedulerStartStop(t *testing.T) {
+	tmpDir := t.TempDir()
+	bm, err := NewBackupManager(&MockCollectionRepo{collections: make(map[string]*Collection)}, &SqliteTransport{}, filepath.Join(tmpDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("failed to create backup manager: %v", err)
+	}
+	bm.StartScheduler()
+	bm.StartScheduler()
+	bm.StopScheduler()
+	bm.StopScheduler()
+	bm.StartScheduler()
+	if err := bm.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestBackupScheduleClock(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	store, err := createTestStore(filepath.Join(tmpDir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	repo := &MockCollectionRepo{collections: make(map[string]*Collection)}
+	coll, _ := NewCollection(&pb.Collection{Namespace: "test", Name: "users"}, store, nil)
+	repo.collections["test/users"] = coll
+
+	bm, err := NewBackupManager(repo, &SqliteTransport{}, filepath.Join(tmpDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("failed to create backup manager: %v", err)
+	}
+	defer bm.Close()
+	clock := NewFixedClock(time.Date(2024, 5, 9, 2, 30, 0, 0, time.UTC))
+	bm.SetClock(clock)
+	bm.SetIDGenerator(&SequentialIDs{})
+
+	resp, _ := bm.SetSchedule(ctx, &pb.SetBackupScheduleRequest{Schedule: &pb.BackupSchedule{
+		Collection: &pb.NamespacedName{Namespace: "test", Name: "users"},
+		Cron:       "0 3 * * *",
+		DestDir:    tmpDir,
+	}})
+	want := time.Date(2024, 5, 9, 3, 0, 0, 0, time.UTC)
+	if resp.Status.Code != pb.Status_OK || resp.Schedule.NextRunAt != want.Unix() {
+		t.Fatalf("expected the next backup at %s, got %v", want, resp)
+	}
+
+	clock.Set(want)
+	if next := bm.runDueSchedules(ctx, clock.Now()); !next.Equal(want.Add(24 * time.Hour)) {
+		t.Errorf("expected the following backup a day later, got %s", next)
+	}
+	list, _ := bm.ListBackups(ctx, &pb.ListBackupsRequest{})
+	if len(list.Backups) != 1 || list.Backups[0].BackupId != "backup-1" || list.Backups[0].Timestamp != want.Unix() {
+		t.Errorf("expected backup-1 taken at %s, got %v", want, list.Backups)
+	}
+}
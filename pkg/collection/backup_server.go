@@ -0,0 +1,45 @@
+package collection
+
+import (
+	"context"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// BackupServer implements the CollectionBackup service on a BackupManager,
+// usually the GrpcServer's (see GrpcServer.Backups), so both services serve
+// the same backups.
+type BackupServer struct {
+	pb.UnimplementedCollectionBackupServer
+	bm *BackupManager
+}
+
+// NewBackupServer creates a CollectionBackup server managing bm's backups.
+func NewBackupServer(bm *BackupManager) *BackupServer {
+	return &BackupServer{bm: bm}
+}
+
+// Backup creates a backup of a collection.
+func (s *BackupServer) Backup(ctx context.Context, req *pb.BackupCollectionRequest) (*pb.BackupCollectionResponse, error) {
+	return s.bm.BackupCollection(ctx, req)
+}
+
+// Restore restores a collection from a backup.
+func (s *BackupServer) Restore(ctx context.Context, req *pb.RestoreBackupRequest) (*pb.RestoreBackupResponse, error) {
+	return s.bm.RestoreBackup(ctx, req)
+}
+
+// List lists backups, optionally of one collection.
+func (s *BackupServer) List(ctx context.Context, req *pb.ListBackupsRequest) (*pb.ListBackupsResponse, error) {
+	return s.bm.ListBackups(ctx, req)
+}
+
+// Delete deletes a backup and its files.
+func (s *BackupServer) Delete(ctx context.Context, req *pb.DeleteBackupRequest) (*pb.DeleteBackupResponse, error) {
+	return s.bm.DeleteBackup(ctx, req)
+}
+
+// Verify checks a backup's integrity.
+func (s *BackupServer) Verify(ctx context.Context, req *pb.VerifyBackupRequest) (*pb.VerifyBackupResponse, error) {
+	return s.bm.VerifyBackup(ctx, req)
+}
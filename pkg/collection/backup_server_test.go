@@ -0,0 +1,63 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/testkit"
+)
+
+func TestBackupServer(t *testing.T) {
+	ctx := context.Background()
+	collector := testkit.NewMesh(t, 1, testkit.Options{}).Collectors[0]
+	if _, err := collector.Repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := collector.Repo.GetCollection(ctx, "test", "docs")
+	for i := 0; i < 3; i++ {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: fmt.Sprintf("doc-%d", i), ProtoData: []byte(`{}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	conn, err := collector.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewCollectionBackupClient(conn)
+	docs := &pb.NamespacedName{Namespace: "test", Name: "docs"}
+
+	backup, err := client.Backup(ctx, &pb.BackupCollectionRequest{Collection: docs, DestPath: filepath.Join(t.TempDir(), "docs.db")})
+	if err != nil || backup.Status.Code != pb.Status_OK {
+		t.Fatalf("Backup failed: %v %v", backup.GetStatus(), err)
+	}
+	id := backup.Backup.BackupId
+
+	// The repository's backup RPCs see the same backups
+	listed, err := pb.NewCollectionRepoClient(conn).ListBackups(ctx, &pb.ListBackupsRequest{Collection: docs})
+	if err != nil || len(listed.Backups) != 1 || listed.Backups[0].BackupId != id {
+		t.Errorf("expected the backup listed by CollectionRepo, got %v %v", listed, err)
+	}
+
+	verified, err := client.Verify(ctx, &pb.VerifyBackupRequest{BackupId: id})
+	if err != nil || !verified.IsValid {
+		t.Errorf("expected a valid backup, got %v %v", verified, err)
+	}
+	restored, err := client.Restore(ctx, &pb.RestoreBackupRequest{BackupId: id, DestNamespace: "restored", DestName: "docs"})
+	if err != nil || restored.Status.Code != pb.Status_OK || restored.RecordsRestored != 3 {
+		t.Errorf("expected 3 records restored, got %v %v", restored, err)
+	}
+
+	deleted, err := client.Delete(ctx, &pb.DeleteBackupRequest{BackupId: id})
+	if err != nil || deleted.Status.Code != pb.Status_OK {
+		t.Fatalf("Delete failed: %v %v", deleted.GetStatus(), err)
+	}
+	list, err := client.List(ctx, &pb.ListBackupsRequest{Collection: docs})
+	if err != nil || len(list.Backups) != 0 {
+		t.Errorf("expected no backups after Delete, got %v %v", list, err)
+	}
+}
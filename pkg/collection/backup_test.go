@@ -75,7 +75,21 @@ func (m *mockStore) DeleteRecord(ctx context.Context, id string) error {
 }
 
 func (m *mockStore) ListRecords(ctx context.Context, offset, limit int) ([]*pb.CollectionRecord, error) {
-	return nil, fmt.Errorf("not implemented")
+	rows, err := m.db.QueryContext(ctx, "SELECT id, proto_data FROM records ORDER BY id LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*pb.CollectionRecord
+	for rows.Next() {
+		r := &pb.CollectionRecord{}
+		if err := rows.Scan(&r.Id, &r.ProtoData); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
 }
 
 func (m *mockStore) CountRecords(ctx context.Context) (int64, error) {
@@ -269,6 +283,32 @@ func TestListBackups(t *testing.T) {
 	if len(backups) != 2 {
 		t.Errorf("expected 2 backups with limit, got %d", len(backups))
 	}
+
+	// Label selectors apply to backup metadata
+	for i, tier := range []string{"gold", "gold", "silver"} {
+		if err := metaStore.SaveBackup(ctx, &pb.BackupMetadata{
+			BackupId:   fmt.Sprintf("tagged-%d", i),
+			Collection: &pb.NamespacedName{Namespace: "test", Name: "orders"},
+			Timestamp:  time.Now().Unix() + int64(i),
+			Metadata:   map[string]string{"tier": tier},
+		}); err != nil {
+			t.Fatalf("failed to save backup: %v", err)
+		}
+	}
+	backups, totalCount, err = metaStore.ListBackups(ctx, &pb.ListBackupsRequest{
+		Namespace:     "test",
+		LabelSelector: "tier=gold",
+		Limit:         1,
+	})
+	if err != nil {
+		t.Fatalf("failed to list backups with selector: %v", err)
+	}
+	if totalCount != 2 || len(backups) != 1 || backups[0].Metadata["tier"] != "gold" {
+		t.Errorf("expected 1 of 2 gold backups, got %d of %d", len(backups), totalCount)
+	}
+	if _, totalCount, _ = metaStore.ListBackups(ctx, &pb.ListBackupsRequest{LabelSelector: "!tier"}); totalCount != 5 {
+		t.Errorf("expected 5 untagged backups, got %d", totalCount)
+	}
 }
 
 // TestDeleteBackup tests backup deletion
@@ -913,6 +953,8 @@ func TestRestoreWithOverwrite(t *testing.T) {
 		t.Fatalf("failed to create backup manager: %v", err)
 	}
 	defer backupManager.Close()
+	layout := NewPathLayout(filepath.Join(tmpDir, "data"))
+	backupManager.SetPathLayout(layout)
 
 	// First restore (should succeed)
 	restoreResp, err := backupManager.RestoreBackup(ctx, &pb.RestoreBackupRequest{
@@ -930,9 +972,85 @@ func TestRestoreWithOverwrite(t *testing.T) {
 		t.Errorf("first restore returned error: %s", restoreResp.Status.Message)
 	}
 
+	if _, err := os.Stat(layout.CollectionDB("restored", "collection1")); err != nil {
+		t.Errorf("expected the restored database under the data root: %v", err)
+	}
+
 	t.Logf("First restore: %d records restored", restoreResp.RecordsRestored)
 }
 
+func TestRestoreDryRun(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+
+	backupPath := filepath.Join(tmpDir, "backup.db")
+	backupStore, err := createTestStore(backupPath)
+	if err != nil {
+		t.Fatalf("failed to create backup store: %v", err)
+	}
+	backupStore.Close()
+
+	// The destination already holds records a restore would replace
+	destStore, err := createTestStore(filepath.Join(tmpDir, "dest.db"))
+	if err != nil {
+		t.Fatalf("failed to create destination store: %v", err)
+	}
+	defer destStore.Close()
+	for i := 0; i < 3; i++ {
+		destStore.CreateRecord(ctx, &pb.CollectionRecord{
+			Id:        fmt.Sprintf("live-%d", i),
+			Metadata:  &pb.Metadata{CreatedAt: timestamppb.Now(), UpdatedAt: timestamppb.Now()},
+			ProtoData: []byte("live"),
+		})
+	}
+	dest, err := NewCollection(&pb.Collection{Namespace: "restored", Name: "live"}, destStore, &LocalFileSystem{})
+	if err != nil {
+		t.Fatalf("failed to create destination collection: %v", err)
+	}
+
+	repo := &MockCollectionRepo{collections: map[string]*Collection{"restored/live": dest}}
+	backupManager, err := NewBackupManager(repo, &SqliteTransport{}, filepath.Join(tmpDir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("failed to create backup manager: %v", err)
+	}
+	defer backupManager.Close()
+	layout := NewPathLayout(filepath.Join(tmpDir, "data"))
+	backupManager.SetPathLayout(layout)
+	if err := backupManager.metaStore.SaveBackup(ctx, &pb.BackupMetadata{
+		BackupId:    "dry-run-backup",
+		Collection:  &pb.NamespacedName{Namespace: "test", Name: "original"},
+		Timestamp:   time.Now().Unix(),
+		RecordCount: 50,
+		StoragePath: backupPath,
+		StorageType: "local",
+	}); err != nil {
+		t.Fatalf("failed to save backup: %v", err)
+	}
+
+	resp, err := backupManager.RestoreBackup(ctx, &pb.RestoreBackupRequest{
+		BackupId:      "dry-run-backup",
+		DestNamespace: "restored",
+		DestName:      "live",
+		Overwrite:     true,
+		DryRun:        true,
+		SampleSize:    2,
+	})
+	if err != nil || resp.Status.Code != pb.Status_OK {
+		t.Fatalf("dry run failed: %v, %v", resp.GetStatus(), err)
+	}
+	if resp.RecordsRestored != 50 || resp.Overwritten.Count != 3 || len(resp.Overwritten.SampleIds) != 2 || !resp.Overwritten.DryRun {
+		t.Errorf("unexpected dry run report: %v", resp)
+	}
+
+	// Nothing was replaced
+	if n, err := dest.CountRecords(ctx); err != nil || n != 3 {
+		t.Errorf("expected the destination to be untouched, got %d records (%v)", n, err)
+	}
+	if _, err := os.Stat(layout.CollectionDB("restored", "live")); !os.IsNotExist(err) {
+		t.Errorf("expected no restored database, got %v", err)
+	}
+}
+
 // TestBackupEmptyCollection tests backup of empty collection
 func TestBackupEmptyCollection(t *testing.T) {
 	ctx := context.Background()
@@ -0,0 +1,216 @@
+package collection
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultExactCardinality is how many distinct values are counted exactly
+	// before switching to an estimate.
+	DefaultExactCardinality = 10000
+	// MaxExactCardinality bounds the memory a request can ask exact counting
+	// to use.
+	MaxExactCardinality = 1 << 20
+)
+
+// DistinctTarget names what Cardinality counts: a field path (see
+// ParseFieldPath) or a label key. Exactly one is set.
+type DistinctTarget struct {
+	Field string
+	Label string
+}
+
+// Validate checks that exactly one target is set and the field path parses.
+func (t DistinctTarget) Validate() error {
+	if (t.Field == "") == (t.Label == "") {
+		return fmt.Errorf("cardinality needs exactly one of field and label")
+	}
+	if t.Field != "" {
+		if _, err := ParseFieldPath(t.Field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CardinalityResult is a distinct-value count.
+type CardinalityResult struct {
+	Count         int64
+	Approximate   bool
+	RelativeError float64 // Standard error when Approximate
+}
+
+// DistinctCounter is implemented by stores that count distinct values in SQL.
+type DistinctCounter interface {
+	// CountDistinct counts the distinct non-null values of target among
+	// records matching query, stopping once it passes limit.
+	CountDistinct(ctx context.Context, query *SearchQuery, target DistinctTarget, limit int64) (int64, error)
+}
+
+// ValueScanner is implemented by stores that can stream a target's values
+// without decoding records.
+type ValueScanner interface {
+	// ScanValues calls fn with an encoding of every non-null value of target
+	// among records matching query; equal values have equal encodings.
+	ScanValues(ctx context.Context, query *SearchQuery, target DistinctTarget, fn func(string) error) error
+}
+
+// Cardinality counts the distinct values of target among records matching
+// query. Counts up to exactThreshold are exact (using the store's
+// DistinctCounter when available); larger ones are HyperLogLog estimates.
+func Cardinality(ctx context.Context, store Store, query *SearchQuery, target DistinctTarget, exactThreshold int64) (CardinalityResult, error) {
+	if err := target.Validate(); err != nil {
+		return CardinalityResult{}, err
+	}
+	if exactThreshold <= 0 {
+		exactThreshold = DefaultExactCardinality
+	}
+	exactThreshold = min(exactThreshold, MaxExactCardinality)
+
+	if dc, ok := store.(DistinctCounter); ok {
+		n, err := dc.CountDistinct(ctx, query, target, exactThreshold)
+		if err != nil {
+			return CardinalityResult{}, err
+		}
+		if n <= exactThreshold {
+			return CardinalityResult{Count: n}, nil
+		}
+	}
+
+	est := &distinctEstimator{exact: make(map[string]struct{}), threshold: exactThreshold}
+	if err := ScanValues(ctx, store, query, target, est.add); err != nil {
+		return CardinalityResult{}, err
+	}
+	return est.result(), nil
+}
+
+// ScanValues streams target's values using the store's ValueScanner when
+// available, or by decoding the records of an unpaginated Search.
+func ScanValues(ctx context.Context, store Store, query *SearchQuery, target DistinctTarget, fn func(string) error) error {
+	if vs, ok := store.(ValueScanner); ok {
+		return vs.ScanValues(ctx, query, target, fn)
+	}
+
+	var path FieldPath
+	if target.Field != "" {
+		var err error
+		if path, err = ParseFieldPath(target.Field); err != nil {
+			return err
+		}
+	}
+
+	unpaged := *query
+	unpaged.Limit, unpaged.Offset, unpaged.OrderBy = 0, 0, ""
+	results, err := store.Search(ctx, &unpaged)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		var values []interface{}
+		if target.Label != "" {
+			record := r.Record
+			if record.Metadata == nil {
+				// Search results may carry only the payload
+				if record, err = store.GetRecord(ctx, record.Id); err != nil {
+					return err
+				}
+			}
+			if v, ok := record.GetMetadata().GetLabels()[target.Label]; ok {
+				values = []interface{}{v}
+			}
+		} else {
+			var doc interface{}
+			if json.Unmarshal(r.Record.ProtoData, &doc) != nil {
+				continue
+			}
+			v := path.Lookup(doc)
+			if _, _, wildcard := path.SplitWildcard(); wildcard {
+				values, _ = v.([]interface{})
+			} else if v != nil {
+				values = []interface{}{v}
+			}
+		}
+		for _, v := range values {
+			encoded, _ := json.Marshal(v)
+			if err := fn(string(encoded)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// distinctEstimator counts values exactly until it has seen more than
+// threshold distinct ones, then moves to a HyperLogLog sketch.
+type distinctEstimator struct {
+	exact     map[string]struct{}
+	threshold int64
+	sketch    *HyperLogLog
+}
+
+func (e *distinctEstimator) add(v string) error {
+	if e.sketch != nil {
+		e.sketch.Add(v)
+		return nil
+	}
+	e.exact[v] = struct{}{}
+	if int64(len(e.exact)) > e.threshold {
+		e.sketch = NewHyperLogLog()
+		for seen := range e.exact {
+			e.sketch.Add(seen)
+		}
+		e.exact = nil
+	}
+	return nil
+}
+
+func (e *distinctEstimator) result() CardinalityResult {
+	if e.sketch == nil {
+		return CardinalityResult{Count: int64(len(e.exact))}
+	}
+	return CardinalityResult{Count: e.sketch.Count(), Approximate: true, RelativeError: e.sketch.RelativeError()}
+}
+
+// Cardinality counts the distinct values of target among records matching query.
+func (c *Collection) Cardinality(ctx context.Context, query *SearchQuery, target DistinctTarget, exactThreshold int64) (CardinalityResult, error) {
+	return Cardinality(ctx, c.Store, query, target, exactThreshold)
+}
+
+func (s *CollectionServer) Cardinality(ctx context.Context, req *pb.CardinalityRequest) (*pb.CardinalityResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+
+	target := DistinctTarget{Field: req.GetField(), Label: req.GetLabel()}
+	if err := target.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	filters, err := convertFilters(req.Filters)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := ParseLabelSelector(req.LabelSelector)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	query := &SearchQuery{FullText: req.FullText, Filters: filters, Labels: labels}
+	result, err := collection.Cardinality(ctx, query, target, req.ExactThreshold)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cardinality failed: %v", err)
+	}
+
+	return &pb.CardinalityResponse{
+		Status:        &pb.Status{Code: pb.Status_OK},
+		Count:         result.Count,
+		Approximate:   result.Approximate,
+		RelativeError: result.RelativeError,
+	}, nil
+}
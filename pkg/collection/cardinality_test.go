@@ -0,0 +1,162 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// searchOnlyStore hides the store's optional capabilities, forcing fallbacks.
+type searchOnlyStore struct{ collection.Store }
+
+func TestCardinality_Exact(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	docs := []string{
+		`{"status": "open", "tags": ["a", "b"], "n": 1}`,
+		`{"status": "open", "tags": ["b", "c"], "n": "1"}`,
+		`{"status": "closed", "tags": [], "n": null}`,
+		`{"status": "stale", "tags": ["a"]}`,
+	}
+	for i, doc := range docs {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{
+			Id:        fmt.Sprint(i),
+			ProtoData: []byte(doc),
+			Metadata:  &pb.Metadata{Labels: map[string]string{"user": fmt.Sprint("u", i%2)}},
+		}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		target collection.DistinctTarget
+		query  collection.SearchQuery
+		want   int64
+	}{
+		{"field", collection.DistinctTarget{Field: "status"}, collection.SearchQuery{}, 3},
+		{"types stay distinct, nulls skipped", collection.DistinctTarget{Field: "n"}, collection.SearchQuery{}, 2},
+		{"array elements", collection.DistinctTarget{Field: "tags[*]"}, collection.SearchQuery{}, 3},
+		{"label", collection.DistinctTarget{Label: "user"}, collection.SearchQuery{}, 2},
+		{"filtered", collection.DistinctTarget{Field: "tags[*]"}, collection.SearchQuery{
+			Filters: map[string]collection.Filter{"status": {Operator: collection.OpEquals, Value: "open"}},
+		}, 3},
+		{"missing field", collection.DistinctTarget{Field: "nope"}, collection.SearchQuery{}, 0},
+	}
+	for _, tt := range tests {
+		for _, store := range []collection.Store{coll.Store, searchOnlyStore{coll.Store}} {
+			got, err := collection.Cardinality(ctx, store, &tt.query, tt.target, 0)
+			if err != nil {
+				t.Fatalf("%s: Cardinality failed: %v", tt.name, err)
+			}
+			if got.Count != tt.want || got.Approximate {
+				t.Errorf("%s (%T): got %+v, want exact %d", tt.name, store, got, tt.want)
+			}
+		}
+	}
+
+	if _, err := coll.Cardinality(ctx, &collection.SearchQuery{}, collection.DistinctTarget{Field: "a", Label: "b"}, 0); err == nil {
+		t.Error("expected an error for two targets")
+	}
+}
+
+func TestCardinality_Approximate(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const distinct = 5000
+	now := timestamppb.Now()
+	records := make([]*pb.CollectionRecord, 0, distinct)
+	for i := 0; i < distinct; i++ {
+		records = append(records, &pb.CollectionRecord{
+			Id:        fmt.Sprint(i),
+			ProtoData: []byte(fmt.Sprintf(`{"session": "s-%d", "bucket": %d}`, i, i%10)),
+			Metadata:  &pb.Metadata{CreatedAt: now, UpdatedAt: now},
+		})
+	}
+	if err := coll.Store.(collection.BatchCreator).CreateRecords(ctx, records); err != nil {
+		t.Fatalf("CreateRecords failed: %v", err)
+	}
+
+	for _, store := range []collection.Store{coll.Store, searchOnlyStore{coll.Store}} {
+		got, err := collection.Cardinality(ctx, store, &collection.SearchQuery{}, collection.DistinctTarget{Field: "session"}, 100)
+		if err != nil {
+			t.Fatalf("Cardinality failed: %v", err)
+		}
+		if !got.Approximate || got.RelativeError == 0 {
+			t.Errorf("expected an approximate count, got %+v", got)
+		}
+		if math.Abs(float64(got.Count-distinct)) > 0.05*distinct {
+			t.Errorf("estimate %d is more than 5%% off %d", got.Count, distinct)
+		}
+
+		// Small sets stay exact even past the threshold's record count
+		got, err = collection.Cardinality(ctx, store, &collection.SearchQuery{}, collection.DistinctTarget{Field: "bucket"}, 100)
+		if err != nil || got.Count != 10 || got.Approximate {
+			t.Errorf("expected exactly 10 buckets, got %+v (%v)", got, err)
+		}
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 20000, 200000} {
+		h := collection.NewHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.Add(fmt.Sprint("value-", i))
+			h.Add(fmt.Sprint("value-", i)) // duplicates do not count
+		}
+		if got := h.Count(); math.Abs(float64(got)-float64(n)) > 0.03*float64(n)+1 {
+			t.Errorf("Count() = %d, want about %d", got, n)
+		}
+	}
+}
+
+func TestCollectionServer_Cardinality(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewCollectionServer(repo)
+	ctx := context.Background()
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "events"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	for i, kind := range []string{"click", "view", "click", "buy"} {
+		if _, err := server.Create(ctx, &pb.CreateRequest{
+			Namespace: "test", CollectionName: "events", Id: fmt.Sprint(i),
+			Item: &anypb.Any{Value: []byte(fmt.Sprintf(`{"kind": %q}`, kind))},
+		}); err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+
+	resp, err := server.Cardinality(ctx, &pb.CardinalityRequest{
+		Namespace: "test", CollectionName: "events",
+		Target: &pb.CardinalityRequest_Field{Field: "kind"},
+	})
+	if err != nil {
+		t.Fatalf("Cardinality failed: %v", err)
+	}
+	if resp.Count != 3 || resp.Approximate {
+		t.Errorf("expected exactly 3 kinds, got %v", resp)
+	}
+
+	for _, req := range []*pb.CardinalityRequest{
+		{Namespace: "test", CollectionName: "events"},
+		{Namespace: "test", CollectionName: "events", Target: &pb.CardinalityRequest_Field{Field: "kind["}},
+	} {
+		if _, err := server.Cardinality(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for %v, got %v", req, err)
+		}
+	}
+}
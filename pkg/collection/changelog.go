@@ -0,0 +1,322 @@
+package collection
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// ChangeLogNamespace and ChangeLogCollection name the collection that
+	// conventionally holds the changelog.
+	ChangeLogNamespace  = "system"
+	ChangeLogCollection = "changelog"
+)
+
+// Operations of changelog entries.
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// changeLogStartID is the record marking when the changelog began capturing.
+const changeLogStartID = "changelog-start"
+
+// ErrChangeLogGap is returned for point-in-time restores the changelog
+// cannot take to the point asked for.
+var ErrChangeLogGap = errors.New("changelog does not cover the point in time")
+
+// ChangeLog records every record write to the collections it captures, so
+// RestoreBackup can restore a backup and replay the changes made after it up
+// to a point in time. Entries are kept in a collection, conventionally
+// system/changelog, ordered by the time they were recorded in nanoseconds,
+// and trimmed as backup retention prunes the backups they follow.
+type ChangeLog struct {
+	coll       *Collection
+	namespaces map[string]bool // nil captures every namespace
+	clock      Clock
+	started    time.Time // When capture began
+
+	mu   sync.Mutex
+	last int64 // Time of the last entry, in Unix nanoseconds
+}
+
+// changeEntry is a changelog entry as stored. At orders entries and is
+// unique.
+type changeEntry struct {
+	At         int64           `json:"at"` // Unix nanoseconds
+	Op         string          `json:"op"`
+	Namespace  string          `json:"namespace"`
+	Collection string          `json:"collection"`
+	RecordID   string          `json:"record_id"`
+	Record     json.RawMessage `json:"record,omitempty"` // The record written, as JSON
+}
+
+// NewChangeLog creates a ChangeLog kept in coll capturing the collections of
+// namespaces, or of every namespace when there are none. The first
+// changelog kept in coll marks when capture began; restores to earlier
+// points fail with ErrChangeLogGap.
+func NewChangeLog(ctx context.Context, coll *Collection, namespaces []string) (*ChangeLog, error) {
+	l := &ChangeLog{coll: coll, clock: SystemClock{}}
+	if len(namespaces) > 0 {
+		l.namespaces = make(map[string]bool, len(namespaces))
+		for _, ns := range namespaces {
+			l.namespaces[ns] = true
+		}
+	}
+	record, err := coll.GetRecord(ctx, changeLogStartID)
+	switch {
+	case err == nil:
+		l.started = record.Metadata.GetCreatedAt().AsTime()
+	case errors.Is(err, sql.ErrNoRows):
+		l.started = l.clock.Now()
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: changeLogStartID, ProtoData: []byte(`{}`), Metadata: &pb.Metadata{
+			CreatedAt: timestamppb.New(l.started),
+			UpdatedAt: timestamppb.New(l.started),
+			Labels:    map[string]string{"kind": "start"},
+		}}); err != nil {
+			return nil, fmt.Errorf("failed to start changelog: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("failed to read changelog: %w", err)
+	}
+	return l, nil
+}
+
+// SetClock sets the clock entries are timed by. Call it before serving
+// requests.
+func (l *ChangeLog) SetClock(clock Clock) {
+	l.clock = clock
+}
+
+// Started returns when the changelog began capturing.
+func (l *ChangeLog) Started() time.Time {
+	return l.started
+}
+
+// Captures reports whether the changelog records a namespace's writes.
+func (l *ChangeLog) Captures(namespace string) bool {
+	return l != nil && (l.namespaces == nil || l.namespaces[namespace])
+}
+
+// record adds an entry for a write to c, logging rather than failing when it
+// cannot, as the write is already made. It is nil-safe.
+func (l *ChangeLog) record(ctx context.Context, c *Collection, op, id string, record *pb.CollectionRecord) {
+	if !l.Captures(c.Meta.Namespace) || c.Meta.GetTemporary() != nil {
+		return
+	}
+	entry := changeEntry{Op: op, Namespace: c.Meta.Namespace, Collection: c.Meta.Name, RecordID: id}
+	if record != nil {
+		data, err := protojson.Marshal(record)
+		if err != nil {
+			log.Printf("Warning: failed to record %s of %s/%s/%s: %v", op, c.Meta.Namespace, c.Meta.Name, id, err)
+			return
+		}
+		entry.Record = data
+	}
+
+	// Entries are strictly ordered by time, even within a clock tick
+	l.mu.Lock()
+	entry.At = l.clock.Now().UnixNano()
+	if entry.At <= l.last {
+		entry.At = l.last + 1
+	}
+	l.last = entry.At
+	l.mu.Unlock()
+
+	data, err := json.Marshal(entry)
+	if err == nil {
+		at := timestamppb.New(time.Unix(0, entry.At))
+		err = l.coll.CreateRecord(ctx, &pb.CollectionRecord{
+			Id:        "change-" + strconv.FormatInt(entry.At, 10),
+			ProtoData: data,
+			Metadata: &pb.Metadata{CreatedAt: at, UpdatedAt: at, Labels: map[string]string{
+				"kind":       "change",
+				"namespace":  entry.Namespace,
+				"collection": entry.Collection,
+			}},
+		})
+	}
+	if err != nil {
+		log.Printf("Warning: failed to record %s of %s/%s/%s: %v", op, c.Meta.Namespace, c.Meta.Name, id, err)
+	}
+}
+
+// changes calls fn with the entries of a collection recorded at or after
+// from and at or before to, in order.
+func (l *ChangeLog) changes(ctx context.Context, namespace, name string, from, to time.Time, fn func(*changeEntry) error) error {
+	next := from.UnixNano()
+	for {
+		results, err := l.coll.Search(ctx, &SearchQuery{
+			LabelFilters: map[string]string{"kind": "change", "namespace": namespace, "collection": name},
+			Filters:      map[string]Filter{"at": {Operator: OpGreaterEqual, Value: next}},
+			OrderBy:      "at",
+			Ascending:    true,
+			Limit:        catchUpPageSize,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read changelog: %w", err)
+		}
+		for _, r := range results {
+			var entry changeEntry
+			if err := json.Unmarshal(r.Record.ProtoData, &entry); err != nil {
+				return fmt.Errorf("failed to decode changelog entry %s: %w", r.Record.Id, err)
+			}
+			if entry.At > to.UnixNano() {
+				return nil
+			}
+			if err := fn(&entry); err != nil {
+				return err
+			}
+			next = entry.At + 1
+		}
+		if len(results) < catchUpPageSize {
+			return nil
+		}
+	}
+}
+
+// Replay applies to store the changes to a collection recorded at or after
+// from and at or before to, and returns how many were applied. Writes are
+// applied as upserts and deletes of records that are gone are skipped, so
+// replaying from before the point a copy was taken brings it up to date.
+func (l *ChangeLog) Replay(ctx context.Context, store Store, namespace, name string, from, to time.Time) (int64, error) {
+	if from.Before(l.started) {
+		return 0, fmt.Errorf("%w: capture began %s, after %s", ErrChangeLogGap, l.started.Format(time.RFC3339), from.Format(time.RFC3339))
+	}
+	var applied int64
+	err := l.changes(ctx, namespace, name, from, to, func(entry *changeEntry) error {
+		if entry.Op == ChangeDelete {
+			if err := store.DeleteRecord(ctx, entry.RecordID); err != nil {
+				return fmt.Errorf("failed to replay delete of %s: %w", entry.RecordID, err)
+			}
+			applied++
+			return nil
+		}
+		record := &pb.CollectionRecord{}
+		if err := protojson.Unmarshal(entry.Record, record); err != nil {
+			return fmt.Errorf("failed to decode change to %s: %w", entry.RecordID, err)
+		}
+		exists, err := RecordExists(ctx, store, record.Id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			err = store.UpdateRecord(ctx, record)
+		} else {
+			err = store.CreateRecord(ctx, record)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replay %s of %s: %w", entry.Op, record.Id, err)
+		}
+		applied++
+		return nil
+	})
+	return applied, err
+}
+
+// Trim removes the entries of a collection recorded before before, which no
+// restore needs once the backups they follow are gone, and returns how many
+// it removed.
+func (l *ChangeLog) Trim(ctx context.Context, namespace, name string, before time.Time) (int64, error) {
+	var ids []string
+	err := l.changes(ctx, namespace, name, time.Unix(0, 0), before.Add(-time.Nanosecond), func(entry *changeEntry) error {
+		ids = append(ids, "change-"+strconv.FormatInt(entry.At, 10))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var trimmed int64
+	for _, id := range ids {
+		if err := l.coll.DeleteRecord(ctx, id); err != nil {
+			return trimmed, fmt.Errorf("failed to trim changelog: %w", err)
+		}
+		trimmed++
+	}
+	return trimmed, nil
+}
+
+// latestBackupAt returns a collection's latest backup taken at or before at.
+func (bm *BackupManager) latestBackupAt(ctx context.Context, coll *pb.NamespacedName, at time.Time) (*pb.BackupMetadata, error) {
+	backups, _, err := bm.metaStore.ListBackups(ctx, &pb.ListBackupsRequest{Collection: coll})
+	if err != nil {
+		return nil, err
+	}
+	// Newest first
+	for _, backup := range backups {
+		if backup.Timestamp <= at.Unix() {
+			return backup, nil
+		}
+	}
+	return nil, fmt.Errorf("no backup of %s taken at or before %s", namespacedKey(coll), at.Format(time.RFC3339))
+}
+
+// checkPointInTime returns the Status refusing a restore of backup to at, or
+// nil if the changelog can take it there.
+func (bm *BackupManager) checkPointInTime(backup *pb.BackupMetadata, at time.Time) *pb.Status {
+	taken := time.Unix(backup.Timestamp, 0)
+	r, ok := bm.repo.(*DefaultCollectionRepo)
+	switch {
+	case bm.changes == nil:
+		return &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: "point-in-time restores need a changelog"}
+	case !ok || r.opener == nil:
+		return &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: "point-in-time restores need a store opener"}
+	case !bm.changes.Captures(backup.Collection.GetNamespace()):
+		return &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: fmt.Sprintf("the changelog does not capture namespace %s", backup.Collection.GetNamespace())}
+	case at.Before(taken):
+		return &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: fmt.Sprintf("backup %s was taken after point_in_time", backup.BackupId)}
+	case at.After(bm.clock.Now()):
+		return &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "point_in_time is in the future"}
+	case taken.Before(bm.changes.Started()):
+		return &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: fmt.Sprintf("%v: backup %s predates the changelog", ErrChangeLogGap, backup.BackupId)}
+	}
+	return nil
+}
+
+// replayChanges applies the changes recorded after backup was taken up to at
+// to its restored copy at dbPath, opened with the repository's StoreOpener.
+func (bm *BackupManager) replayChanges(ctx context.Context, backup *pb.BackupMetadata, dbPath string, at time.Time) (int64, error) {
+	r := bm.repo.(*DefaultCollectionRepo)
+	var stored *pb.StoreOptions
+	if coll, err := bm.repo.GetCollection(ctx, backup.Collection.Namespace, backup.Collection.Name); err == nil {
+		stored = coll.Meta.GetStoreOptions()
+	}
+	store, err := r.opener(dbPath, stored)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open restored store: %w", err)
+	}
+	defer store.Close()
+	return bm.changes.Replay(ctx, store, backup.Collection.Namespace, backup.Collection.Name, time.Unix(backup.Timestamp, 0), at)
+}
+
+// SetChangeLog records the writes of the collections log captures, so
+// backups of them can be restored to a point in time. Give the GrpcServer
+// the same changelog.
+func (r *DefaultCollectionRepo) SetChangeLog(log *ChangeLog) {
+	r.changelog = log
+}
+
+// SetChangeLog lets RestoreBackup replay changes recorded in log to a point
+// in time, and backup retention trim them. Give the repository the same
+// changelog to record them.
+func (bm *BackupManager) SetChangeLog(log *ChangeLog) {
+	bm.changes = log
+}
+
+// SetChangeLog enables point-in-time restores from changes recorded in log.
+// Give the repository the same changelog to record them.
+func (s *GrpcServer) SetChangeLog(log *ChangeLog) {
+	s.backupManager.SetChangeLog(log)
+}
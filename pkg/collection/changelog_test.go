@@ -0,0 +1,162 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestPointInTimeRestore(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	dir := t.TempDir()
+	layout := collection.NewPathLayout(filepath.Join(dir, "data"))
+	repo.SetPathLayout(layout)
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+	server := collection.NewGrpcServerWithLayout(repo, layout)
+
+	changeStore, err := sqlite.NewSqliteStore(filepath.Join(dir, "changelog.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create changelog store: %v", err)
+	}
+	defer changeStore.Close()
+	changeColl, err := collection.NewCollection(
+		&pb.Collection{Namespace: collection.ChangeLogNamespace, Name: collection.ChangeLogCollection},
+		changeStore, &collection.LocalFileSystem{})
+	if err != nil {
+		t.Fatalf("failed to create changelog collection: %v", err)
+	}
+	changes, err := collection.NewChangeLog(ctx, changeColl, nil)
+	if err != nil {
+		t.Fatalf("NewChangeLog failed: %v", err)
+	}
+	clock := collection.NewFixedClock(time.Now().Add(time.Minute))
+	changes.SetClock(clock)
+	repo.SetClock(clock)
+	server.Backups().SetClock(clock)
+	repo.SetChangeLog(changes)
+	server.SetChangeLog(changes)
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	docs := &pb.NamespacedName{Namespace: "test", Name: "docs"}
+	coll, _ := repo.GetCollection(ctx, "test", "docs")
+	for _, id := range []string{"r1", "r2"} {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: []byte(`{"v": 1}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	backup, _ := server.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: docs, DestPath: filepath.Join(dir, "backups", "docs.db")})
+	if backup.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", backup.Status)
+	}
+
+	// Changes after the backup, up to the point restored to...
+	clock.Advance(time.Minute)
+	if err := coll.UpdateRecord(ctx, &pb.CollectionRecord{Id: "r1", ProtoData: []byte(`{"v": 2}`)}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "r3", ProtoData: []byte(`{"v": 1}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := coll.DeleteRecord(ctx, "r2"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	pointInTime := clock.Now().Add(time.Second)
+
+	// ...and after it
+	clock.Advance(time.Minute)
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "r4", ProtoData: []byte(`{"v": 1}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := coll.UpdateRecord(ctx, &pb.CollectionRecord{Id: "r3", ProtoData: []byte(`{"v": 3}`)}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+
+	want := map[string]string{"r1": `{"v": 2}`, "r3": `{"v": 1}`}
+	check := func(name string, store collection.Store) {
+		t.Helper()
+		records, err := store.ListRecords(ctx, 0, 100)
+		if err != nil {
+			t.Fatalf("ListRecords failed: %v", err)
+		}
+		got := map[string]string{}
+		for _, r := range records {
+			got[r.Id] = string(r.ProtoData)
+		}
+		if len(got) != len(want) || got["r1"] != want["r1"] || got["r3"] != want["r3"] {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+
+	// The latest backup before the point is picked and brought forward
+	restore, _ := server.RestoreBackup(ctx, &pb.RestoreBackupRequest{
+		Collection: docs, PointInTime: timestamppb.New(pointInTime), DestNamespace: "test", DestName: "asof",
+	})
+	if restore.Status.Code != pb.Status_OK || restore.BackupId != backup.Backup.BackupId || restore.ChangesReplayed != 5 {
+		t.Fatalf("expected the backup restored with its 5 changes replayed, got %v", restore)
+	}
+	restored, err := sqlite.NewSqliteStore(layout.CollectionDB("test", "asof"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to open restored store: %v", err)
+	}
+	check("new collection", restored)
+	restored.Close()
+
+	// Restoring over the live collection rolls it back to the point
+	restore, _ = server.RestoreBackup(ctx, &pb.RestoreBackupRequest{
+		BackupId: backup.Backup.BackupId, PointInTime: timestamppb.New(pointInTime), DestNamespace: "test", DestName: "docs", Overwrite: true,
+	})
+	if restore.Status.Code != pb.Status_OK {
+		t.Fatalf("point-in-time restore over the live collection failed: %v", restore.Status)
+	}
+	coll, _ = repo.GetCollection(ctx, "test", "docs")
+	check("live collection", coll.Store)
+
+	// Points the changelog cannot reach are refused
+	restore, _ = server.RestoreBackup(ctx, &pb.RestoreBackupRequest{
+		Collection: docs, PointInTime: timestamppb.New(clock.Now().Add(time.Hour)), DestNamespace: "test", DestName: "future",
+	})
+	if restore.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT for a future point, got %v", restore.Status)
+	}
+	restore, _ = server.RestoreBackup(ctx, &pb.RestoreBackupRequest{
+		Collection: docs, PointInTime: timestamppb.New(pointInTime.Add(-time.Hour)), DestNamespace: "test", DestName: "early",
+	})
+	if restore.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND before the first backup, got %v", restore.Status)
+	}
+	if _, err := changes.Replay(ctx, coll.Store, "test", "docs", time.Now().Add(-time.Hour), pointInTime); !errors.Is(err, collection.ErrChangeLogGap) {
+		t.Errorf("expected ErrChangeLogGap replaying from before capture began, got %v", err)
+	}
+	disabled := collection.NewGrpcServerWithLayout(repo, layout)
+	restore, _ = disabled.RestoreBackup(ctx, &pb.RestoreBackupRequest{
+		BackupId: backup.Backup.BackupId, PointInTime: timestamppb.New(pointInTime), DestNamespace: "test", DestName: "other",
+	})
+	if restore.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION without a changelog, got %v", restore.Status)
+	}
+
+	// Pruning the backup trims the changes that followed it
+	clock.Advance(time.Minute)
+	if backup, _ := server.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: docs, DestPath: filepath.Join(dir, "backups", "docs-2.db")}); backup.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", backup.Status)
+	}
+	server.Backups().SetRetentionPolicy(collection.RetentionPolicy{MaxCount: 1})
+	if pruned, err := server.Backups().Prune(ctx); err != nil || len(pruned) != 1 {
+		t.Fatalf("expected the first backup pruned, got %v %v", pruned, err)
+	}
+	if trimmed, err := changes.Trim(ctx, "test", "docs", clock.Now()); err != nil || trimmed != 0 {
+		t.Errorf("expected the changes before the kept backup already trimmed, got %d %v", trimmed, err)
+	}
+}
@@ -0,0 +1,226 @@
+package collection
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultPullLimit is the page size for PullChanges when the request sets none.
+const DefaultPullLimit = 100
+
+// ChangeFeed is implemented by stores that can list records in modification
+// order, which PullChanges needs to page through remote changes.
+type ChangeFeed interface {
+	// ChangesSince returns up to limit records ordered by (updated_at, id) that
+	// come after the (since, afterID) cursor.
+	ChangesSince(ctx context.Context, since time.Time, afterID string, limit int) ([]*pb.CollectionRecord, error)
+	// DeletedSince returns the IDs of records deleted at or after since. Stores
+	// without record history return nil.
+	DeletedSince(ctx context.Context, since time.Time) ([]string, error)
+}
+
+// PushChanges applies a client's local changes. A change is applied only if
+// the remote record still has the updated_at the client based it on (or, for
+// new records, does not exist); otherwise it is returned as a conflict along
+// with the current remote version. Changes marked merge skip that check and
+// contribute only their managed fields, which merge with the remote ones.
+// With ID_COLLISION_REMAP, a created record whose ID is taken is stored
+// under its origin's instead.
+func (s *CollectionServer) PushChanges(ctx context.Context, req *pb.PushChangesRequest) (*pb.PushChangesResponse, error) {
+	remap := req.OnIdCollision == pb.IdCollisionPolicy_ID_COLLISION_REMAP
+	if remap && req.Origin == "" {
+		return nil, status.Error(codes.InvalidArgument, "origin is required to remap colliding ids")
+	}
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+
+	resp := &pb.PushChangesResponse{Status: &pb.Status{Code: pb.Status_OK}}
+	for _, change := range req.Changes {
+		if change.Id == "" {
+			return nil, status.Error(codes.InvalidArgument, "change id is required")
+		}
+
+		remote, err := collection.GetRecord(ctx, change.Id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Errorf(codes.Internal, "failed to read record %s: %v", change.Id, err)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			remote = nil
+		}
+
+		if remap && remote != nil && change.BaseUpdatedAt == nil && !change.Deleted && !change.Merge {
+			id := RemappedID(req.Origin, change.Id)
+			taken, err := collection.Exists(ctx, id)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to read record %s: %v", id, err)
+			}
+			if !taken {
+				if resp.RemappedIds == nil {
+					resp.RemappedIds = make(map[string]string)
+				}
+				resp.RemappedIds[change.Id] = id
+				change, remote = &pb.RecordChange{Id: id, Data: change.Data}, nil
+			}
+		}
+
+		if change.Merge && !change.Deleted && remote != nil {
+			// Managed fields merge rather than conflict, so a replica can push
+			// their state whatever version it last saw
+			data, err := overlayFields(collection.Meta.GetManagedFields(), remote.ProtoData, change.Data)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "failed to merge change to %s: %v", change.Id, err)
+			}
+			change = &pb.RecordChange{Id: change.Id, Data: data, BaseUpdatedAt: remote.Metadata.GetUpdatedAt()}
+		}
+
+		if reason := changeConflict(change, remote); reason != "" {
+			resp.Conflicts = append(resp.Conflicts, &pb.ChangeConflict{
+				Id:     change.Id,
+				Remote: toSyncRecord(remote),
+				Reason: reason,
+			})
+			continue
+		}
+
+		switch {
+		case change.Deleted:
+			if remote != nil {
+				if err := collection.DeleteRecord(ctx, change.Id); err != nil {
+					return nil, status.Errorf(codes.Internal, "failed to delete record %s: %v", change.Id, err)
+				}
+			}
+			resp.DeletedIds = append(resp.DeletedIds, change.Id)
+			continue
+		case remote == nil:
+			err = collection.CreateRecord(ctx, &pb.CollectionRecord{Id: change.Id, ProtoData: change.Data})
+		default:
+			err = collection.UpdateRecord(ctx, &pb.CollectionRecord{
+				Id:        change.Id,
+				ProtoData: change.Data,
+				Metadata:  &pb.Metadata{Labels: remote.Metadata.GetLabels()},
+			})
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to apply change to %s: %v", change.Id, err)
+		}
+
+		stored, err := collection.GetRecord(ctx, change.Id)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to read back record %s: %v", change.Id, err)
+		}
+		resp.Applied = append(resp.Applied, toSyncRecord(stored))
+	}
+
+	return resp, nil
+}
+
+// RemappedID is the ID a record created at origin is stored under when its
+// own is taken.
+func RemappedID(origin, id string) string {
+	return origin + ":" + id
+}
+
+// changeConflict returns why change cannot be applied on top of remote, or ""
+// if it can. Versions are compared at the one-second resolution of updated_at.
+func changeConflict(change *pb.RecordChange, remote *pb.CollectionRecord) string {
+	switch {
+	case remote == nil && change.BaseUpdatedAt != nil && !change.Deleted:
+		return "record was deleted remotely"
+	case remote == nil:
+		return ""
+	case change.BaseUpdatedAt == nil:
+		return "record already exists remotely"
+	case remote.Metadata.GetUpdatedAt().GetSeconds() != change.BaseUpdatedAt.Seconds:
+		return "record was modified remotely"
+	}
+	return ""
+}
+
+// PullChanges returns records modified after the request's cursor, oldest first.
+func (s *CollectionServer) PullChanges(ctx context.Context, req *pb.PullChangesRequest) (*pb.PullChangesResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+
+	feed, ok := collection.Store.(ChangeFeed)
+	if !ok {
+		return nil, status.Error(codes.FailedPrecondition, "collection store does not support change feeds")
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = DefaultPullLimit
+	}
+	var since time.Time
+	if req.Since != nil {
+		since = req.Since.AsTime()
+	}
+
+	// Fetch one extra record to learn whether another page follows
+	records, err := feed.ChangesSince(ctx, since, req.AfterId, limit+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list changes: %v", err)
+	}
+	deleted, err := feed.DeletedSince(ctx, since)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list deletions: %v", err)
+	}
+
+	resp := &pb.PullChangesResponse{
+		Status:     &pb.Status{Code: pb.Status_OK},
+		DeletedIds: deleted,
+	}
+	if len(records) > limit {
+		records = records[:limit]
+		resp.HasMore = true
+	}
+	for _, r := range records {
+		resp.Records = append(resp.Records, toSyncRecord(r))
+	}
+	return resp, nil
+}
+
+// toSyncRecord converts a stored record to its sync representation; nil stays nil.
+func toSyncRecord(r *pb.CollectionRecord) *pb.SyncRecord {
+	if r == nil {
+		return nil
+	}
+	return &pb.SyncRecord{
+		Id:        r.Id,
+		Data:      r.ProtoData,
+		CreatedAt: r.Metadata.GetCreatedAt(),
+		UpdatedAt: r.Metadata.GetUpdatedAt(),
+		Hlc:       r.Metadata.GetHlc(),
+	}
+}
+
+// ChangesSince flushes pending writes and delegates to the wrapped store's change feed.
+func (b *BufferedStore) ChangesSince(ctx context.Context, since time.Time, afterID string, limit int) ([]*pb.CollectionRecord, error) {
+	if err := b.flush(ctx); err != nil {
+		return nil, err
+	}
+	feed, ok := b.inner.(ChangeFeed)
+	if !ok {
+		return nil, fmt.Errorf("store does not support change feeds")
+	}
+	return feed.ChangesSince(ctx, since, afterID, limit)
+}
+
+// DeletedSince delegates to the wrapped store's change feed.
+func (b *BufferedStore) DeletedSince(ctx context.Context, since time.Time) ([]string, error) {
+	feed, ok := b.inner.(ChangeFeed)
+	if !ok {
+		return nil, fmt.Errorf("store does not support change feeds")
+	}
+	return feed.DeletedSince(ctx, since)
+}
@@ -0,0 +1,82 @@
+package collection
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// ChecksumSchema adds the column holding each record's checksum.
+const ChecksumSchema = `
+ALTER TABLE records ADD COLUMN checksum TEXT;
+`
+
+// checksumPrefix names the algorithm of a record checksum.
+const checksumPrefix = "sha256:"
+
+// checksumPageSize is how many records VerifyChecksums reads at a time.
+const checksumPageSize = 500
+
+// ErrChecksumMismatch is returned when a record's data no longer matches the
+// checksum it was written with.
+var ErrChecksumMismatch = errors.New("record checksum mismatch")
+
+// RecordChecksum returns the checksum of record data, as kept in
+// Metadata.checksum. It covers the data as written, so recompressing or
+// deduplicating the stored bytes does not change it.
+func RecordChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return checksumPrefix + hex.EncodeToString(sum[:])
+}
+
+// VerifyChecksum checks a record's data against the checksum in its metadata.
+// Records without a checksum, written before checksums, pass.
+func VerifyChecksum(record *pb.CollectionRecord) error {
+	want := record.GetMetadata().GetChecksum()
+	if want == "" {
+		return nil
+	}
+	if !strings.HasPrefix(want, checksumPrefix) {
+		return fmt.Errorf("%w: record %s has an unknown checksum %q", ErrChecksumMismatch, record.Id, want)
+	}
+	if got := RecordChecksum(record.ProtoData); got != want {
+		return fmt.Errorf("%w: record %s has %s, was written with %s", ErrChecksumMismatch, record.Id, got, want)
+	}
+	return nil
+}
+
+// ChecksumReport is the result of checking every record of a store against
+// its checksum.
+type ChecksumReport struct {
+	Checked   int64    // Records read
+	Unchecked int64    // Records without a checksum
+	Corrupt   []string // IDs of records whose data does not match
+}
+
+// VerifyChecksums reads every record of store and reports those whose data
+// no longer matches their checksum.
+func VerifyChecksums(ctx context.Context, store Store) (*ChecksumReport, error) {
+	report := &ChecksumReport{}
+	for offset := 0; ; offset += checksumPageSize {
+		records, err := store.ListRecords(ctx, offset, checksumPageSize)
+		if err != nil {
+			return report, fmt.Errorf("failed to list records: %w", err)
+		}
+		for _, record := range records {
+			report.Checked++
+			if record.GetMetadata().GetChecksum() == "" {
+				report.Unchecked++
+			} else if VerifyChecksum(record) != nil {
+				report.Corrupt = append(report.Corrupt, record.Id)
+			}
+		}
+		if len(records) < checksumPageSize {
+			return report, nil
+		}
+	}
+}
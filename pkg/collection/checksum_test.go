@@ -0,0 +1,127 @@
+package collection_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+)
+
+func TestRecordChecksums(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), "test.db"), collection.Options{
+		EnableJSON:  true,
+		Compression: &collection.CompressionOptions{MinSize: 16},
+	})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	coll, _ := collection.NewCollection(&pb.Collection{Namespace: "test", Name: "docs"}, store, nil)
+	defer coll.Close()
+
+	data := []byte(`{"title": "a record long enough to be compressed at rest"}`)
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "a", ProtoData: data}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "b", ProtoData: data}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	record, err := coll.GetRecord(ctx, "a")
+	if err != nil {
+		t.Fatalf("GetRecord failed: %v", err)
+	}
+	if want := collection.RecordChecksum(data); record.Metadata.Checksum != want {
+		t.Fatalf("expected the checksum of the uncompressed data %s, got %q", want, record.Metadata.Checksum)
+	}
+
+	updated := []byte(`{"title": "updated"}`)
+	if err := coll.UpdateRecord(ctx, &pb.CollectionRecord{Id: "b", ProtoData: updated}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if record, _ := coll.GetRecord(ctx, "b"); record.Metadata.Checksum != collection.RecordChecksum(updated) {
+		t.Errorf("expected the update to refresh the checksum, got %q", record.Metadata.Checksum)
+	}
+
+	// Silently corrupt a record's data, and add one written before checksums
+	if err := store.ExecuteRaw(`UPDATE records SET proto_data = ? WHERE id = ?`, []byte(`{"title": "bit rot"}`), "a"); err != nil {
+		t.Fatalf("failed to corrupt record: %v", err)
+	}
+	if err := store.ExecuteRaw(`INSERT INTO records (id, proto_data, created_at, updated_at, labels) VALUES ('legacy', '{}', 0, 0, '{}')`); err != nil {
+		t.Fatalf("failed to add legacy record: %v", err)
+	}
+	if _, err := coll.GetRecord(ctx, "a"); err != nil {
+		t.Errorf("expected reads unverified by default, got %v", err)
+	}
+	coll.VerifyChecksums = true
+	if _, err := coll.GetRecord(ctx, "a"); !errors.Is(err, collection.ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if _, err := coll.GetRecord(ctx, "legacy"); err != nil {
+		t.Errorf("expected a record without a checksum to pass, got %v", err)
+	}
+
+	report, err := collection.VerifyChecksums(ctx, store)
+	if err != nil {
+		t.Fatalf("VerifyChecksums failed: %v", err)
+	}
+	if report.Checked != 3 || report.Unchecked != 1 || len(report.Corrupt) != 1 || report.Corrupt[0] != "a" {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+func TestVerifyBackupChecksums(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "docs")
+	for _, id := range []string{"a", "b"} {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: []byte(`{"v": 1}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	dir := t.TempDir()
+	bm, err := collection.NewBackupManager(repo, &collection.SqliteTransport{}, filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("failed to create backup manager: %v", err)
+	}
+	defer bm.Close()
+	backupPath := filepath.Join(dir, "docs.db")
+	resp, _ := bm.BackupCollection(ctx, &pb.BackupCollectionRequest{
+		Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"},
+		DestPath:   backupPath,
+	})
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", resp.Status)
+	}
+	verify, _ := bm.VerifyBackup(ctx, &pb.VerifyBackupRequest{BackupId: resp.Backup.BackupId})
+	if !verify.IsValid {
+		t.Fatalf("expected the backup valid, got %s", verify.ErrorMessage)
+	}
+
+	db, err := sql.Open("sqlite", backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE records SET proto_data = '{"v": 2}' WHERE id = 'b'`); err != nil {
+		t.Fatalf("failed to corrupt backup: %v", err)
+	}
+	db.Close()
+
+	verify, _ = bm.VerifyBackup(ctx, &pb.VerifyBackupRequest{BackupId: resp.Backup.BackupId})
+	// The backup's manifest catches the change before its records are read
+	if verify.IsValid || verify.Status.Message != "backup checksum mismatch" {
+		t.Errorf("expected the changed backup reported, got %q: %s", verify.Status.Message, verify.ErrorMessage)
+	}
+}
@@ -0,0 +1,116 @@
+package collection
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Clock tells the time. Collections, the backup manager and the dispatcher
+// read timestamps from one, so tests can fix the time and skew corrections
+// apply everywhere at once. Elapsed-time measurements such as latencies
+// still use the monotonic system clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock that reads the system time.
+type SystemClock struct{}
+
+// Now returns the current time.
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FixedClock is a Clock that only moves when told to, for tests.
+type FixedClock struct {
+	t  time.Time
+	mu sync.Mutex
+}
+
+// NewFixedClock returns a clock stopped at t.
+func NewFixedClock(t time.Time) *FixedClock {
+	return &FixedClock{t: t}
+}
+
+// Now returns the clock's time.
+func (c *FixedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// Set moves the clock to t.
+func (c *FixedClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = t
+}
+
+// Advance moves the clock forward by d.
+func (c *FixedClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// SkewedClock corrects another clock by a fixed offset, for hosts whose
+// clock is known to run fast or slow.
+type SkewedClock struct {
+	Base   Clock
+	Offset time.Duration // Added to Base's time
+}
+
+// Now returns the base clock's time plus the offset.
+func (c SkewedClock) Now() time.Time {
+	return c.Base.Now().Add(c.Offset)
+}
+
+// IDGenerator makes unique identifiers, for backups, schedules and
+// dispatch runs.
+type IDGenerator interface {
+	NewID() string
+}
+
+// UUIDGenerator generates random UUIDs.
+type UUIDGenerator struct{}
+
+// NewID returns a new random UUID.
+func (UUIDGenerator) NewID() string {
+	return uuid.New().String()
+}
+
+// HexIDGenerator generates random hex strings of Bytes bytes, 8 if zero.
+type HexIDGenerator struct {
+	Bytes int
+}
+
+// NewID returns a new random hex string.
+func (g HexIDGenerator) NewID() string {
+	n := g.Bytes
+	if n <= 0 {
+		n = 8
+	}
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SequentialIDs generates Prefix followed by 1, 2, 3, ..., for tests.
+type SequentialIDs struct {
+	Prefix string
+	n      int64
+	mu     sync.Mutex
+}
+
+// NewID returns the next ID in the sequence.
+func (g *SequentialIDs) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n++
+	return fmt.Sprintf("%s%d", g.Prefix, g.n)
+}
@@ -0,0 +1,50 @@
+package collection_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestCollectionClock(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "clocked"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "clocked")
+
+	start := time.Date(2024, 5, 9, 12, 0, 0, 0, time.UTC)
+	clock := collection.NewFixedClock(start)
+	coll.Clock = collection.SkewedClock{Base: clock, Offset: -time.Minute}
+
+	record := &pb.CollectionRecord{Id: "r1", ProtoData: []byte(`{}`)}
+	if err := coll.CreateRecord(ctx, record); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if got := record.Metadata.CreatedAt.AsTime(); !got.Equal(start.Add(-time.Minute)) {
+		t.Errorf("expected the skewed clock's time, got %s", got)
+	}
+
+	clock.Advance(time.Hour)
+	if err := coll.UpdateRecord(ctx, record); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if got := record.Metadata.UpdatedAt.AsTime(); !got.Equal(start.Add(59 * time.Minute)) {
+		t.Errorf("expected the update stamped an hour later, got %s", got)
+	}
+}
+
+func TestSequentialIDs(t *testing.T) {
+	ids := &collection.SequentialIDs{Prefix: "id-"}
+	if a, b := ids.NewID(), ids.NewID(); a != "id-1" || b != "id-2" {
+		t.Errorf("unexpected IDs %s, %s", a, b)
+	}
+	if a, b := (collection.HexIDGenerator{}).NewID(), (collection.HexIDGenerator{}).NewID(); len(a) != 16 || a == b {
+		t.Errorf("expected distinct 16-character hex IDs, got %s, %s", a, b)
+	}
+}
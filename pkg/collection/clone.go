@@ -2,15 +2,20 @@ package collection
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 
 	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/channelpool"
 	"github.com/accretional/collector/pkg/fs/local"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -23,16 +28,21 @@ type CloneManager struct {
 	repo      CollectionRepo
 	transport Transport
 	fetcher   *Fetcher
-	dataDir   string
+	layout    PathLayout
+	endpoint  string // Address of this collector, see SetEndpoint
+
+	// Optional shared channels to remote collectors, see SetChannelPool
+	pool *channelpool.Pool
 }
 
-// NewCloneManager creates a new CloneManager.
+// NewCloneManager creates a new CloneManager writing clones under dataDir,
+// laid out as NewPathLayout(dataDir) says.
 func NewCloneManager(repo CollectionRepo, dataDir string) *CloneManager {
 	return &CloneManager{
 		repo:      repo,
 		transport: &SqliteTransport{},
 		fetcher:   NewFetcher(),
-		dataDir:   dataDir,
+		layout:    NewPathLayout(dataDir),
 	}
 }
 
@@ -53,22 +63,47 @@ func (cm *CloneManager) CloneLocal(ctx context.Context, req *pb.CloneRequest) (*
 	if err != nil {
 		return nil, fmt.Errorf("failed to get source collection: %w", err)
 	}
+	if _, err := cm.repo.GetCollection(ctx, req.DestNamespace, req.DestName); err == nil {
+		return nil, fmt.Errorf("destination collection %s/%s already exists", req.DestNamespace, req.DestName)
+	}
+
+	// Resolve the record filter before copying anything
+	var keep []string
+	filtered := req.FullText != "" || len(req.Filters) > 0
+	if filtered {
+		filters, err := convertFilters(req.Filters)
+		if err != nil {
+			return nil, err
+		}
+		results, err := srcCollection.Search(ctx, &SearchQuery{FullText: req.FullText, Filters: filters})
+		if err != nil {
+			return nil, fmt.Errorf("failed to select records: %w", err)
+		}
+		keep = make([]string, len(results))
+		for i, r := range results {
+			keep[i] = r.Record.Id
+		}
+	}
 
 	// Create destination paths
-	destDBPath := filepath.Join(cm.dataDir, "collections", req.DestNamespace, req.DestName+".db")
-	destFilesPath := filepath.Join(cm.dataDir, "files", req.DestNamespace, req.DestName)
+	destDBPath := cm.layout.CollectionDB(req.DestNamespace, req.DestName)
+	destFilesPath := cm.layout.CollectionFiles(req.DestNamespace, req.DestName)
 
 	// Clone database
 	if err := cm.transport.Clone(ctx, srcCollection, destDBPath); err != nil {
 		return nil, fmt.Errorf("failed to clone database: %w", err)
 	}
 
-	// Count records from source collection (they're the same in the clone)
-	srcRecords, err := srcCollection.Store.ListRecords(ctx, 999999, 0)
+	// Drop records outside the filter and count what remains in the clone
+	recordCount, err := pruneClonedRecords(ctx, destDBPath, keep, filtered)
 	if err != nil {
-		return nil, fmt.Errorf("failed to count records: %w", err)
+		os.Remove(destDBPath)
+		return nil, fmt.Errorf("failed to filter cloned records: %w", err)
+	}
+	if err := stampProvenance(ctx, destDBPath, cm.lineageEvent(LineageClone, cm.endpoint, req.SourceCollection, req.DestNamespace, req.DestName)); err != nil {
+		os.Remove(destDBPath)
+		return nil, fmt.Errorf("failed to record lineage: %w", err)
 	}
-	recordCount := int64(len(srcRecords))
 
 	// Clone files if requested
 	var fileCount int64
@@ -98,9 +133,10 @@ func (cm *CloneManager) CloneLocal(ctx context.Context, req *pb.CloneRequest) (*
 
 	// Create collection metadata in repository
 	destMeta := &pb.Collection{
-		Namespace:   req.DestNamespace,
-		Name:        req.DestName,
-		MessageType: srcCollection.Meta.MessageType,
+		Namespace:      req.DestNamespace,
+		Name:           req.DestName,
+		MessageType:    srcCollection.Meta.MessageType,
+		ServerEndpoint: cm.endpoint,
 		Metadata: &pb.Metadata{
 			Labels: map[string]string{
 				"cloned_from": fmt.Sprintf("%s/%s", srcNamespace, srcName),
@@ -128,8 +164,84 @@ func (cm *CloneManager) CloneLocal(ctx context.Context, req *pb.CloneRequest) (*
 	}, nil
 }
 
+// lineageEvent describes a copy of source, on the collector at
+// sourceEndpoint, to namespace/name on this collector.
+func (cm *CloneManager) lineageEvent(kind, sourceEndpoint string, source *pb.NamespacedName, namespace, name string) *pb.LineageEvent {
+	return &pb.LineageEvent{
+		Id:               "lineage-" + HexIDGenerator{}.NewID(),
+		Kind:             kind,
+		SourceCollector:  sourceEndpoint,
+		SourceCollection: source,
+		DestCollector:    cm.endpoint,
+		DestCollection:   &pb.NamespacedName{Namespace: namespace, Name: name},
+		CreatedAt:        SystemClock{}.Now().Unix(),
+	}
+}
+
+// pruneClonedRecords deletes every record not in keep from the cloned database at
+// dbPath when filtered is set, and returns the number of records left.
+func pruneClonedRecords(ctx context.Context, dbPath string, keep []string, filtered bool) (int64, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_busy_timeout=10000", dbPath))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open clone: %w", err)
+	}
+	defer db.Close()
+
+	if filtered {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx, "CREATE TEMP TABLE clone_keep (id TEXT PRIMARY KEY)"); err != nil {
+			return 0, err
+		}
+		for _, id := range keep {
+			if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO clone_keep (id) VALUES (?)", id); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM records WHERE id NOT IN (SELECT id FROM clone_keep)"); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+	}
+
+	var count int64
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM records").Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
 // CloneRemote clones a collection to a remote collector using streaming.
 func (cm *CloneManager) CloneRemote(ctx context.Context, req *pb.CloneRequest) (*pb.CloneResponse, error) {
+	return cm.cloneRemote(ctx, req, nil)
+}
+
+// SetChannelPool makes remote clones and fetches use pool's channels instead
+// of dialing a dedicated connection per transfer.
+func (cm *CloneManager) SetChannelPool(pool *channelpool.Pool) {
+	cm.pool = pool
+}
+
+// dial returns a connection to endpoint and a function that releases it.
+func (cm *CloneManager) dial(endpoint string) (grpc.ClientConnInterface, func(), error) {
+	if cm.pool != nil {
+		return cm.pool.Channel(endpoint), func() {}, nil
+	}
+	conn, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() { conn.Close() }, nil
+}
+
+// cloneRemote is CloneRemote, reporting bytes sent to progress when it is set.
+func (cm *CloneManager) cloneRemote(ctx context.Context, req *pb.CloneRequest, progress ProgressReporter) (*pb.CloneResponse, error) {
 	// Validate request
 	if req.SourceCollection == nil {
 		return nil, fmt.Errorf("source collection is required")
@@ -145,11 +257,11 @@ func (cm *CloneManager) CloneRemote(ctx context.Context, req *pb.CloneRequest) (
 	}
 
 	// Connect to remote collector
-	conn, err := grpc.NewClient(req.DestEndpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, release, err := cm.dial(req.DestEndpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to remote collector: %w", err)
 	}
-	defer conn.Close()
+	defer release()
 
 	remoteRepoClient := pb.NewCollectionRepoClient(conn)
 
@@ -176,6 +288,7 @@ func (cm *CloneManager) CloneRemote(ctx context.Context, req *pb.CloneRequest) (
 				IncludeFiles:     req.IncludeFiles,
 				TotalSize:        size,
 				MessageType:      srcCollection.Meta.MessageType,
+				SourceEndpoint:   cm.endpoint,
 			},
 		},
 	}
@@ -208,6 +321,9 @@ func (cm *CloneManager) CloneRemote(ctx context.Context, req *pb.CloneRequest) (
 		}
 
 		totalSent += int64(n)
+		if progress != nil {
+			progress(totalSent, size)
+		}
 
 		if err == io.EOF {
 			break
@@ -220,6 +336,14 @@ func (cm *CloneManager) CloneRemote(ctx context.Context, req *pb.CloneRequest) (
 		return nil, fmt.Errorf("failed to close stream: %w", err)
 	}
 
+	// Remember where the copy lives so Discover on this collector reports it
+	if resp.Status.GetCode() == pb.Status_OK {
+		replica := &pb.ReplicaRef{Endpoint: req.DestEndpoint, Namespace: req.DestNamespace, Name: req.DestName}
+		if err := cm.RecordReplica(ctx, req.SourceCollection, replica); err != nil {
+			log.Printf("Warning: failed to record replica %s/%s@%s: %v", req.DestNamespace, req.DestName, req.DestEndpoint, err)
+		}
+	}
+
 	// Convert PushCollectionResponse to CloneResponse
 	return &pb.CloneResponse{
 		Status:           resp.Status,
@@ -230,8 +354,27 @@ func (cm *CloneManager) CloneRemote(ctx context.Context, req *pb.CloneRequest) (
 	}, nil
 }
 
+// RouteRemote asks another collector where one of its collections is
+// served, failing with NOT_FOUND if it does not know the collection.
+// Collectors that report statuses as HTTP codes are understood too.
+func RouteRemote(ctx context.Context, client pb.CollectionRepoClient, collection *pb.NamespacedName) (*pb.RouteResponse, error) {
+	resp, err := client.Route(ctx, &pb.RouteRequest{Collection: collection})
+	if err != nil {
+		return nil, err
+	}
+	if resp.GetCollection() == nil {
+		return nil, status.Errorf(codes.NotFound, "collection %s/%s not found: %s", collection.GetNamespace(), collection.GetName(), resp.GetStatus().GetMessage())
+	}
+	return resp, nil
+}
+
 // FetchRemote fetches a collection from a remote collector using streaming.
 func (cm *CloneManager) FetchRemote(ctx context.Context, req *pb.FetchRequest) (*pb.FetchResponse, error) {
+	return cm.fetchRemote(ctx, req, nil)
+}
+
+// fetchRemote is FetchRemote, reporting bytes received to progress when it is set.
+func (cm *CloneManager) fetchRemote(ctx context.Context, req *pb.FetchRequest, progress ProgressReporter) (*pb.FetchResponse, error) {
 	// Validate request
 	if req.SourceEndpoint == "" {
 		return nil, fmt.Errorf("source endpoint is required")
@@ -244,11 +387,11 @@ func (cm *CloneManager) FetchRemote(ctx context.Context, req *pb.FetchRequest) (
 	}
 
 	// Connect to remote collector
-	conn, err := grpc.NewClient(req.SourceEndpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, release, err := cm.dial(req.SourceEndpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to remote collector: %w", err)
 	}
-	defer conn.Close()
+	defer release()
 
 	remoteRepoClient := pb.NewCollectionRepoClient(conn)
 
@@ -275,7 +418,7 @@ func (cm *CloneManager) FetchRemote(ctx context.Context, req *pb.FetchRequest) (
 	}
 
 	// Create temporary file for receiving data
-	destDBPath := filepath.Join(cm.dataDir, "collections", req.DestNamespace, req.DestName+".db")
+	destDBPath := cm.layout.CollectionDB(req.DestNamespace, req.DestName)
 	if err := os.MkdirAll(filepath.Dir(destDBPath), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create destination directory: %w", err)
 	}
@@ -286,10 +429,9 @@ func (cm *CloneManager) FetchRemote(ctx context.Context, req *pb.FetchRequest) (
 		return nil, fmt.Errorf("failed to create temp file: %w", err)
 	}
 	defer func() {
+		// Gone after a successful rename; left behind by a failed or cancelled transfer
 		f.Close()
-		if err != nil {
-			os.Remove(tmpFile)
-		}
+		os.Remove(tmpFile)
 	}()
 
 	// Receive and write data chunks
@@ -313,6 +455,9 @@ func (cm *CloneManager) FetchRemote(ctx context.Context, req *pb.FetchRequest) (
 			return nil, fmt.Errorf("failed to write chunk: %w", err)
 		}
 		totalReceived += int64(n)
+		if progress != nil {
+			progress(totalReceived, metadata.TotalSize)
+		}
 	}
 
 	// Close temp file
@@ -320,20 +465,23 @@ func (cm *CloneManager) FetchRemote(ctx context.Context, req *pb.FetchRequest) (
 		return nil, fmt.Errorf("failed to close temp file: %w", err)
 	}
 
+	event := cm.lineageEvent(LineageFetch, req.SourceEndpoint, req.SourceCollection, req.DestNamespace, req.DestName)
+	if err := stampProvenance(ctx, tmpFile, event); err != nil {
+		return nil, fmt.Errorf("failed to record lineage: %w", err)
+	}
+
 	// Rename to final location
 	if err := os.Rename(tmpFile, destDBPath); err != nil {
 		return nil, fmt.Errorf("failed to rename temp file: %w", err)
 	}
 
 	// Get remote collection metadata for creating local entry
-	routeResp, err := remoteRepoClient.Route(ctx, &pb.RouteRequest{
-		Collection: req.SourceCollection,
-	})
+	routeResp, err := RouteRemote(ctx, remoteRepoClient, req.SourceCollection)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get collection metadata: %w", err)
 	}
 
-	// Create destination collection metadata
+	// Create destination collection metadata, or refresh it when re-fetching
 	destMeta := &pb.Collection{
 		Namespace:   req.DestNamespace,
 		Name:        req.DestName,
@@ -348,12 +496,15 @@ func (cm *CloneManager) FetchRemote(ctx context.Context, req *pb.FetchRequest) (
 		},
 	}
 
-	_, err = cm.repo.CreateCollection(ctx, destMeta)
-	if err != nil {
+	if err = cm.registerCopy(ctx, destMeta); err != nil {
 		os.Remove(destDBPath)
 		return nil, fmt.Errorf("failed to create collection metadata: %w", err)
 	}
 
+	if req.NotifySource {
+		cm.notifySource(ctx, remoteRepoClient, req)
+	}
+
 	return &pb.FetchResponse{
 		Status: &pb.Status{
 			Code:    pb.Status_OK,
@@ -382,7 +533,7 @@ func (cm *CloneManager) ReceivePushedCollection(stream pb.CollectionRepo_PushCol
 	}
 
 	// Create destination paths
-	destDBPath := filepath.Join(cm.dataDir, "collections", metadata.DestNamespace, metadata.DestName+".db")
+	destDBPath := cm.layout.CollectionDB(metadata.DestNamespace, metadata.DestName)
 	if err := os.MkdirAll(filepath.Dir(destDBPath), 0755); err != nil {
 		return fmt.Errorf("failed to create destination directory: %w", err)
 	}
@@ -393,10 +544,9 @@ func (cm *CloneManager) ReceivePushedCollection(stream pb.CollectionRepo_PushCol
 		return fmt.Errorf("failed to create temp file: %w", err)
 	}
 	defer func() {
+		// Gone after a successful rename; left behind by a failed or cancelled transfer
 		f.Close()
-		if err != nil {
-			os.Remove(tmpFile)
-		}
+		os.Remove(tmpFile)
 	}()
 
 	// Receive and write data chunks
@@ -427,6 +577,11 @@ func (cm *CloneManager) ReceivePushedCollection(stream pb.CollectionRepo_PushCol
 		return fmt.Errorf("failed to close temp file: %w", err)
 	}
 
+	event := cm.lineageEvent(LineagePush, metadata.SourceEndpoint, metadata.SourceCollection, metadata.DestNamespace, metadata.DestName)
+	if err := stampProvenance(ctx, tmpFile, event); err != nil {
+		return fmt.Errorf("failed to record lineage: %w", err)
+	}
+
 	if err := os.Rename(tmpFile, destDBPath); err != nil {
 		return fmt.Errorf("failed to rename temp file: %w", err)
 	}
@@ -436,7 +591,7 @@ func (cm *CloneManager) ReceivePushedCollection(stream pb.CollectionRepo_PushCol
 	recordCount := int64(0)
 	fileCount := int64(0)
 
-	// Create collection metadata in repository using message type from source
+	// Create (or refresh) collection metadata in repository using message type from source
 	destMeta := &pb.Collection{
 		Namespace:   metadata.DestNamespace,
 		Name:        metadata.DestName,
@@ -449,8 +604,11 @@ func (cm *CloneManager) ReceivePushedCollection(stream pb.CollectionRepo_PushCol
 			},
 		},
 	}
+	if metadata.SourceEndpoint != "" {
+		destMeta.Metadata.Labels["cloned_from"] += "@" + metadata.SourceEndpoint
+	}
 
-	_, err = cm.repo.CreateCollection(ctx, destMeta)
+	err = cm.registerCopy(ctx, destMeta)
 	if err != nil {
 		os.Remove(destDBPath)
 		return fmt.Errorf("failed to create collection metadata: %w", err)
@@ -471,6 +629,26 @@ func (cm *CloneManager) ReceivePushedCollection(stream pb.CollectionRepo_PushCol
 	return stream.SendAndClose(resp)
 }
 
+// notifySource registers a fetched copy with the collector it was fetched from.
+// Failures are logged; the fetch itself has already succeeded.
+func (cm *CloneManager) notifySource(ctx context.Context, source pb.CollectionRepoClient, req *pb.FetchRequest) {
+	if cm.endpoint == "" {
+		log.Printf("Warning: not notifying %s of fetched copy: local endpoint not set", req.SourceEndpoint)
+		return
+	}
+
+	resp, err := source.RegisterReplica(ctx, &pb.RegisterReplicaRequest{
+		SourceCollection: req.SourceCollection,
+		Replica:          &pb.ReplicaRef{Endpoint: cm.endpoint, Namespace: req.DestNamespace, Name: req.DestName},
+	})
+	if err == nil && resp.Status.GetCode() != pb.Status_OK {
+		err = fmt.Errorf("%s", resp.Status.GetMessage())
+	}
+	if err != nil {
+		log.Printf("Warning: failed to register replica with %s: %v", req.SourceEndpoint, err)
+	}
+}
+
 // StreamCollectionToPuller handles outgoing collection pull streams (server-side).
 func (cm *CloneManager) StreamCollectionToPuller(req *pb.PullCollectionRequest, stream pb.CollectionRepo_PullCollectionServer) error {
 	ctx := stream.Context()
@@ -2,18 +2,73 @@ package collection
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"time"
 
 	pb "github.com/accretional/collector/gen/collector"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// RecordCounter is implemented by stores that can answer existence and count
+// queries without reading record payloads. Collection falls back to GetRecord
+// and Search for stores that do not implement it.
+type RecordCounter interface {
+	RecordExists(ctx context.Context, id string) (bool, error)
+	CountMatching(ctx context.Context, query *SearchQuery) (int64, error)
+}
+
 // Collection is the domain entity handling logic.
 type Collection struct {
 	Meta  *pb.Collection
 	Store Store
 	FS    FileSystem
+
+	// Sampler, when set, decides which incoming records are written.
+	Sampler *Sampler
+
+	// Extractors pull searchable text from attachments; nil uses
+	// DefaultTextExtractors.
+	Extractors TextExtractors
+
+	// Artifacts, when set, post-processes new attachments into derived
+	// attachments such as thumbnails.
+	Artifacts *ArtifactPipeline
+
+	// Monitor, when set, tracks the collection's change rates and may refuse
+	// deletes during a suspected mass deletion.
+	Monitor *ChangeMonitor
+
+	// Leases, when set, restricts writes to leased records to their holders.
+	Leases *LeaseManager
+
+	// Holds, when set, refuses updates and deletes of held records.
+	Holds *LegalHolds
+
+	// Changelog, when set, records the collection's writes for
+	// point-in-time restores.
+	Changelog *ChangeLog
+
+	// Fields, when set, merges writes into the collection's managed fields.
+	Fields *FieldManager
+
+	// Clock, when set, stamps record and attachment times; nil reads the
+	// system clock.
+	Clock Clock
+
+	// HLC, when set, stamps every write with a hybrid logical clock
+	// timestamp; nil leaves records' hlc as written.
+	HLC *HybridClock
+
+	// VerifyChecksums checks records read by GetRecord against the checksum
+	// they were written with, failing with ErrChecksumMismatch.
+	VerifyChecksums bool
+
+	// gate pauses writes while the repository moves the collection's storage.
+	gate      *storageGate
+	gateMoves int64
 }
 
 // NewCollection initializes a Collection.
@@ -37,9 +92,25 @@ func NewCollection(meta *pb.Collection, store Store, fs FileSystem) (*Collection
 	}, nil
 }
 
+// now returns the time from the collection's clock.
+func (c *Collection) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock.Now()
+	}
+	return time.Now()
+}
+
+// stampHLC sets a record's hlc to the collection's next HLC.
+func (c *Collection) stampHLC(record *pb.CollectionRecord) {
+	if c.HLC != nil {
+		record.Metadata.Hlc = int64(c.HLC.Now())
+	}
+}
+
 // --- Store Delegates ---
 
 func (c *Collection) CreateRecord(ctx context.Context, record *pb.CollectionRecord) error {
+	outbox, ctx := takeOutbox(ctx)
 	if record.Id == "" {
 		return fmt.Errorf("record id required")
 	}
@@ -50,16 +121,51 @@ func (c *Collection) CreateRecord(ctx context.Context, record *pb.CollectionReco
 
 	// Set timestamps if missing
 	if record.Metadata.CreatedAt == nil {
-		now := timestamppb.Now()
+		now := timestamppb.New(c.now())
 		record.Metadata.CreatedAt = now
 		record.Metadata.UpdatedAt = now
 	}
 
-	return c.Store.CreateRecord(ctx, record)
+	if c.Sampler != nil {
+		if keep, reason := c.Sampler.Decide(record); !keep {
+			return fmt.Errorf("%w: %s", ErrSampledOut, reason)
+		}
+	}
+
+	if c.managesFields() {
+		data, err := c.Fields.mergeFields(c.Meta.ManagedFields, nil, record.ProtoData)
+		if err != nil {
+			return err
+		}
+		record.ProtoData = data
+	}
+	record.Metadata.Checksum = RecordChecksum(record.ProtoData)
+	c.stampHLC(record)
+
+	end, err := c.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer end()
+	if err := c.writeRecord(ctx, record, false, outbox); err != nil {
+		return err
+	}
+	c.Changelog.record(ctx, c, ChangeCreate, record.Id, record)
+	if c.Monitor != nil {
+		c.Monitor.observe(ctx, c, changeCreate)
+	}
+	return nil
 }
 
 func (c *Collection) GetRecord(ctx context.Context, id string) (*pb.CollectionRecord, error) {
-	return c.Store.GetRecord(ctx, id)
+	record, err := c.Store.GetRecord(ctx, id)
+	if err != nil || !c.VerifyChecksums {
+		return record, err
+	}
+	if err := VerifyChecksum(record); err != nil {
+		return nil, err
+	}
+	return record, nil
 }
 
 func (c *Collection) UpdateRecord(ctx context.Context, record *pb.CollectionRecord) error {
@@ -72,14 +178,90 @@ func (c *Collection) UpdateRecord(ctx context.Context, record *pb.CollectionReco
 		record.Metadata = &pb.Metadata{}
 	}
 
+	if c.managesFields() {
+		defer c.Fields.lock(c, record.Id)()
+		stored, err := c.Store.GetRecord(ctx, record.Id)
+		if err != nil {
+			return err
+		}
+		data, err := c.Fields.mergeFields(c.Meta.ManagedFields, stored.ProtoData, record.ProtoData)
+		if err != nil {
+			return err
+		}
+		record.ProtoData = data
+	}
+	return c.writeUpdate(ctx, record)
+}
+
+// writeUpdate writes an update whose managed fields are already merged.
+func (c *Collection) writeUpdate(ctx context.Context, record *pb.CollectionRecord) error {
+	outbox, ctx := takeOutbox(ctx)
 	// Always update the UpdatedAt timestamp
-	record.Metadata.UpdatedAt = timestamppb.Now()
+	record.Metadata.UpdatedAt = timestamppb.New(c.now())
+	record.Metadata.Checksum = RecordChecksum(record.ProtoData)
+	c.stampHLC(record)
+
+	if c.Leases != nil {
+		if err := c.Leases.checkWrite(ctx, c, record.Id); err != nil {
+			return err
+		}
+	}
+	if err := c.Holds.check(ctx, LegalHoldUpdate, c.Meta.Namespace, c.Meta.Name, record.Id); err != nil {
+		return err
+	}
+	if err := c.sealed("update", record.Id); err != nil {
+		return err
+	}
 
-	return c.Store.UpdateRecord(ctx, record)
+	end, err := c.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer end()
+	if err := c.writeRecord(ctx, record, true, outbox); err != nil {
+		return err
+	}
+	c.Changelog.record(ctx, c, ChangeUpdate, record.Id, record)
+	if c.Monitor != nil {
+		c.Monitor.observe(ctx, c, changeUpdate)
+	}
+	return nil
 }
 
 func (c *Collection) DeleteRecord(ctx context.Context, id string) error {
-	return c.Store.DeleteRecord(ctx, id)
+	if c.Leases != nil {
+		if err := c.Leases.checkWrite(ctx, c, id); err != nil {
+			return err
+		}
+	}
+	if err := c.Holds.check(ctx, LegalHoldDelete, c.Meta.Namespace, c.Meta.Name, id); err != nil {
+		return err
+	}
+	if err := c.sealed("delete", id); err != nil {
+		return err
+	}
+	if c.Monitor != nil {
+		if err := c.Monitor.beforeDelete(ctx, c); err != nil {
+			return err
+		}
+	}
+	end, err := c.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer end()
+	c.deleteAttachmentFiles(ctx, id)
+	if err := c.Store.DeleteRecord(ctx, id); err != nil {
+		return err
+	}
+	c.Changelog.record(ctx, c, ChangeDelete, id, nil)
+	if c.Leases != nil {
+		c.Leases.forget(c, id)
+	}
+	if c.Monitor != nil {
+		c.Monitor.observe(ctx, c, changeDelete)
+	}
+	return nil
 }
 
 func (c *Collection) ListRecords(ctx context.Context, offset, limit int) ([]*pb.CollectionRecord, error) {
@@ -91,9 +273,60 @@ func (c *Collection) CountRecords(ctx context.Context) (int64, error) {
 }
 
 func (c *Collection) Search(ctx context.Context, query *SearchQuery) ([]*SearchResult, error) {
+	if !query.AsOf.IsZero() {
+		if _, err := historyReader(c.Store); err != nil {
+			return nil, err
+		}
+	}
 	return c.Store.Search(ctx, query)
 }
 
+// Exists reports whether a record with the given id exists.
+func (c *Collection) Exists(ctx context.Context, id string) (bool, error) {
+	return RecordExists(ctx, c.Store, id)
+}
+
+// Count returns the number of records matching the query's full-text and filter
+// criteria. Ordering and pagination are ignored.
+func (c *Collection) Count(ctx context.Context, query *SearchQuery) (int64, error) {
+	return CountMatching(ctx, c.Store, query)
+}
+
+// RecordExists checks for a record using the store's RecordCounter fast path when available.
+func RecordExists(ctx context.Context, store Store, id string) (bool, error) {
+	if rc, ok := store.(RecordCounter); ok {
+		return rc.RecordExists(ctx, id)
+	}
+	_, err := store.GetRecord(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CountMatching counts matching records using the store's RecordCounter fast path when available.
+func CountMatching(ctx context.Context, store Store, query *SearchQuery) (int64, error) {
+	if !query.AsOf.IsZero() {
+		if _, err := historyReader(store); err != nil {
+			return 0, err
+		}
+	}
+	if rc, ok := store.(RecordCounter); ok {
+		return rc.CountMatching(ctx, query)
+	}
+	if query.FullText == "" && len(query.Filters) == 0 && len(query.LabelRequirements()) == 0 && query.Geo == nil &&
+		query.CreatedAfter.IsZero() && query.CreatedBefore.IsZero() {
+		return store.CountRecords(ctx)
+	}
+	unpaged := *query
+	unpaged.Limit, unpaged.Offset, unpaged.OrderBy = 0, 0, ""
+	results, err := store.Search(ctx, &unpaged)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(results)), nil
+}
+
 func (c *Collection) Checkpoint(ctx context.Context) error {
 	return c.Store.Checkpoint(ctx)
 }
@@ -120,6 +353,11 @@ func (c *Collection) SaveFile(ctx context.Context, path string, data *pb.Collect
 		return fmt.Errorf("unknown content type")
 	}
 
+	end, err := c.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer end()
 	return c.FS.Save(ctx, path, content)
 }
 
@@ -152,6 +390,11 @@ func (c *Collection) GetFile(ctx context.Context, path string) (*pb.CollectionDa
 }
 
 func (c *Collection) DeleteFile(ctx context.Context, path string) error {
+	end, err := c.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer end()
 	return c.FS.Delete(ctx, path)
 }
 
@@ -3,10 +3,12 @@ package collection
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"os"
 	"strconv"
 
 	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/grpcconfig"
 	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -16,12 +18,21 @@ import (
 
 type CollectionServer struct {
 	pb.UnimplementedCollectionServiceServer
-	repo CollectionRepo
+	repo        CollectionRepo
+	queries     *QueryLog
+	descriptors DescriptorResolver
+	limits      RecordSizeLimits
+	searches    *SavedSearchStore // nil unless saved searches are enabled
+	monitor     *ChangeMonitor    // nil unless change monitoring is enabled
+
+	enforceTypes bool // Enforce every collection's message type, not only those asking for it
 }
 
 func NewCollectionServer(repo CollectionRepo) *CollectionServer {
 	return &CollectionServer{
-		repo: repo,
+		repo:    repo,
+		queries: NewQueryLog(DefaultSlowQueryThreshold),
+		limits:  RecordSizeLimits{MaxMessageSize: grpcconfig.DefaultMaxMessageSize, MaxRecordSize: DefaultMaxRecordSize},
 	}
 }
 
@@ -31,46 +42,84 @@ func (s *CollectionServer) Create(ctx context.Context, req *pb.CreateRequest) (*
 		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
 	}
 
-	id := req.Id
+	if err := s.checkRecordSize(len(req.Item.GetValue())); err != nil {
+		return nil, err
+	}
+	data, err := s.decodeItem(ctx, collection, req.Item)
+	if err != nil {
+		return nil, err
+	}
+	return createRecord(ctx, collection, req.Id, data)
+}
+
+// createRecord stores data as a new record with id, generating an ID if it
+// is empty.
+func createRecord(ctx context.Context, collection *Collection, id string, data []byte) (*pb.CreateResponse, error) {
 	if id == "" {
 		id = uuid.New().String()
 	}
 
 	record := &pb.CollectionRecord{
 		Id:        id,
-		ProtoData: req.Item.Value,
+		ProtoData: data,
 	}
 
 	if err := collection.CreateRecord(ctx, record); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create record: %v", err)
+		if errors.Is(err, ErrSampledOut) {
+			// Sampling drops are expected for ingestion collections, not failures
+			return &pb.CreateResponse{
+				Id: id,
+				Status: &pb.Status{
+					Code:    pb.Status_OK,
+					Message: err.Error(),
+					Details: map[string]string{"sampled": "dropped"},
+				},
+			}, nil
+		}
+		return nil, writeStatus(err, "create", id)
 	}
 
 	return &pb.CreateResponse{Id: id}, nil
 }
 
 func (s *CollectionServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
-	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	collection, record, err := s.getRecord(ctx, req)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+		return nil, err
+	}
+	if err := s.checkMessageSize(req.Id, len(record.ProtoData)); err != nil {
+		return nil, err
 	}
 
-	record, err := collection.GetRecord(ctx, req.Id)
+	return &pb.GetResponse{Item: encodeItem(collection, s.messageType(ctx, collection), record.ProtoData)}, nil
+}
+
+// getRecord reads the record a GetRequest names.
+func (s *CollectionServer) getRecord(ctx context.Context, req *pb.GetRequest) (*Collection, *pb.CollectionRecord, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "record not found: %v", err)
+		return nil, nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
 	}
-
-	// Build TypeUrl if MessageType is available
-	typeUrl := "type.googleapis.com/unknown"
-	if collection.Meta.MessageType != nil && collection.Meta.MessageType.MessageName != "" {
-		typeUrl = "type.googleapis.com/collector." + collection.Meta.MessageType.MessageName
+	if ctx, err = readConsistency(ctx, collection, req.Consistency); err != nil {
+		return nil, nil, err
 	}
 
-	any := &anypb.Any{
-		TypeUrl: typeUrl,
-		Value:   record.ProtoData,
+	var record *pb.CollectionRecord
+	if req.AsOf != nil {
+		record, err = collection.GetRecordAsOf(ctx, req.Id, req.AsOf.AsTime())
+	} else {
+		record, err = collection.GetRecord(ctx, req.Id)
 	}
-
-	return &pb.GetResponse{Item: any}, nil
+	if errors.Is(err, ErrHistoryUnavailable) {
+		return nil, nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if errors.Is(err, ErrChecksumMismatch) {
+		return nil, nil, status.Error(codes.DataLoss, err.Error())
+	}
+	if err != nil {
+		return nil, nil, status.Errorf(codes.NotFound, "record not found: %v", err)
+	}
+	return collection, record, nil
 }
 
 // buildTypeUrl builds a type URL from a collection's message type
@@ -99,7 +148,7 @@ func convertStructpbValue(v *structpb.Value) interface{} {
 	case *structpb.Value_StructValue:
 		return v.GetStructValue()
 	case *structpb.Value_ListValue:
-		return v.GetListValue()
+		return v.GetListValue().AsSlice()
 	default:
 		return nil
 	}
@@ -111,13 +160,28 @@ func (s *CollectionServer) Update(ctx context.Context, req *pb.UpdateRequest) (*
 		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
 	}
 
+	if req.Id == "" {
+		return nil, invalidRecord(codes.InvalidArgument, "id", ViolationRequired, nil, "id is required")
+	}
+	if err := s.checkRecordSize(len(req.Item.GetValue())); err != nil {
+		return nil, err
+	}
+	data, err := s.decodeItem(ctx, collection, req.Item)
+	if err != nil {
+		return nil, err
+	}
+
 	record := &pb.CollectionRecord{
 		Id:        req.Id,
-		ProtoData: req.Item.Value,
+		ProtoData: data,
 	}
 
-	if err := collection.UpdateRecord(ctx, record); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to update record: %v", err)
+	err = collection.UpdateRecord(WithLeaseToken(ctx, req.LeaseToken), record)
+	if errors.Is(err, ErrRecordLeased) || errors.Is(err, ErrLegalHold) || errors.Is(err, ErrRecordSealed) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, writeStatus(err, "update", req.Id)
 	}
 
 	return &pb.UpdateResponse{}, nil
@@ -129,7 +193,11 @@ func (s *CollectionServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*
 		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
 	}
 
-	if err := collection.DeleteRecord(ctx, req.Id); err != nil {
+	err = collection.DeleteRecord(WithLeaseToken(ctx, req.LeaseToken), req.Id)
+	if errors.Is(err, ErrDeletesBlocked) || errors.Is(err, ErrRecordLeased) || errors.Is(err, ErrLegalHold) || errors.Is(err, ErrRecordSealed) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to delete record: %v", err)
 	}
 	return &pb.DeleteResponse{}, nil
@@ -140,6 +208,9 @@ func (s *CollectionServer) List(ctx context.Context, req *pb.ListRequest) (*pb.L
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
 	}
+	if ctx, err = readConsistency(ctx, collection, req.Consistency); err != nil {
+		return nil, err
+	}
 
 	offset, err := pageTokenToOffset(req.PageToken)
 	if err != nil {
@@ -150,18 +221,23 @@ func (s *CollectionServer) List(ctx context.Context, req *pb.ListRequest) (*pb.L
 		limit = 100
 	}
 
-	records, err := collection.ListRecords(ctx, offset, limit)
+	var records []*pb.CollectionRecord
+	if req.AsOf != nil {
+		records, err = collection.ListRecordsAsOf(ctx, req.AsOf.AsTime(), offset, limit)
+	} else {
+		records, err = collection.ListRecords(ctx, offset, limit)
+	}
+	if errors.Is(err, ErrHistoryUnavailable) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to list records: %v", err)
 	}
 
-	typeUrl := buildTypeUrl(collection)
+	md := s.messageType(ctx, collection)
 	items := make([]*anypb.Any, len(records))
 	for i, record := range records {
-		items[i] = &anypb.Any{
-			TypeUrl: typeUrl,
-			Value:   record.ProtoData,
-		}
+		items[i] = encodeItem(collection, md, record.ProtoData)
 	}
 
 	var nextPageToken string
@@ -180,10 +256,47 @@ func (s *CollectionServer) Search(ctx context.Context, req *pb.SearchRequest) (*
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
 	}
+	if ctx, err = readConsistency(ctx, collection, req.Consistency); err != nil {
+		return nil, err
+	}
+
+	query, err := searchQueryFromProto(req)
+	if err != nil {
+		return nil, err
+	}
 
+	results, err := s.timeSearch(ctx, collection, query)
+	if errors.Is(err, ErrHistoryUnavailable) || errors.Is(err, ErrGeoUnavailable) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if errors.Is(err, ErrInvalidFunctionCall) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "search failed: %v", err)
+	}
+
+	md := s.messageType(ctx, collection)
+	resp := &pb.SearchResponse{
+		Results: make([]*pb.SearchResult, len(results)),
+	}
+	for i, res := range results {
+		resp.Results[i] = &pb.SearchResult{
+			Item:     encodeItem(collection, md, res.Record.ProtoData),
+			Score:    res.Score,
+			Distance: res.Distance,
+		}
+	}
+
+	return resp, nil
+}
+
+// searchQueryFromProto converts a search request to a SearchQuery, returning
+// InvalidArgument errors for malformed fields.
+func searchQueryFromProto(req *pb.SearchRequest) (*SearchQuery, error) {
+	var err error
 	query := &SearchQuery{
 		FullText:            req.FullText,
-		Filters:             make(map[string]Filter),
 		LabelFilters:        req.LabelFilters,
 		Vector:              req.Vector,
 		SimilarityThreshold: req.SimilarityThreshold,
@@ -192,8 +305,99 @@ func (s *CollectionServer) Search(ctx context.Context, req *pb.SearchRequest) (*
 		OrderBy:             req.OrderBy,
 		Ascending:           req.Ascending,
 	}
+	if req.AsOf != nil {
+		if req.FullText != "" {
+			return nil, status.Error(codes.InvalidArgument, "full_text cannot be combined with as_of")
+		}
+		query.AsOf = req.AsOf.AsTime()
+	}
+	if query.Labels, err = ParseLabelSelector(req.LabelSelector); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.OrderBy != "" {
+		path, err := ParseFieldPath(req.OrderBy)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid order_by: %v", err)
+		}
+		if _, _, wildcard := path.SplitWildcard(); wildcard {
+			return nil, status.Error(codes.InvalidArgument, "order_by cannot contain [*]")
+		}
+	}
+
+	if query.Geo, err = GeoFilterFromProto(req.Geo); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	filters, err := convertFilters(req.Filters)
+	if err != nil {
+		return nil, err
+	}
+	query.Filters = filters
+	return query, nil
+}
+
+func (s *CollectionServer) Exists(ctx context.Context, req *pb.ExistsRequest) (*pb.ExistsResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if ctx, err = readConsistency(ctx, collection, req.Consistency); err != nil {
+		return nil, err
+	}
+
+	exists, err := collection.Exists(ctx, req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "exists check failed: %v", err)
+	}
+
+	return &pb.ExistsResponse{
+		Status: &pb.Status{Code: pb.Status_OK},
+		Exists: exists,
+	}, nil
+}
+
+func (s *CollectionServer) Count(ctx context.Context, req *pb.CountRequest) (*pb.CountResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if ctx, err = readConsistency(ctx, collection, req.Consistency); err != nil {
+		return nil, err
+	}
 
-	for k, v := range req.Filters {
+	filters, err := convertFilters(req.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := ParseLabelSelector(req.LabelSelector)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	geo, err := GeoFilterFromProto(req.Geo)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	count, err := collection.Count(ctx, &SearchQuery{FullText: req.FullText, Filters: filters, Labels: labels, Geo: geo})
+	if errors.Is(err, ErrGeoUnavailable) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "count failed: %v", err)
+	}
+
+	return &pb.CountResponse{
+		Status: &pb.Status{Code: pb.Status_OK},
+		Count:  count,
+	}, nil
+}
+
+// convertFilters maps request filters onto store filters.
+func convertFilters(in map[string]*pb.Filter) (map[string]Filter, error) {
+	filters := make(map[string]Filter, len(in))
+	for k, v := range in {
 		var op FilterOperator
 		switch v.Operator {
 		case pb.FilterOperator_OP_EQUALS:
@@ -216,36 +420,47 @@ func (s *CollectionServer) Search(ctx context.Context, req *pb.SearchRequest) (*
 			op = OpExists
 		case pb.FilterOperator_OP_NOT_EXISTS:
 			op = OpNotExists
+		case pb.FilterOperator_OP_ARRAY_CONTAINS:
+			op = OpArrayContains
+		case pb.FilterOperator_OP_ARRAY_CONTAINS_ANY:
+			op = OpArrayContainsAny
+		case pb.FilterOperator_OP_BETWEEN:
+			op = OpBetween
+		case pb.FilterOperator_OP_SAME_DAY:
+			op = OpSameDay
+		case pb.FilterOperator_OP_SAME_WEEK:
+			op = OpSameWeek
+		case pb.FilterOperator_OP_IS_NULL:
+			op = OpIsNull
+		case pb.FilterOperator_OP_IS_NOT_NULL:
+			op = OpIsNotNull
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, "unsupported filter operator: %v", v.Operator)
 		}
-		query.Filters[k] = Filter{
+		// Keys are field paths, or calls of the store's custom SQL functions
+		if _, isCall, err := ParseFunctionCall(k); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		} else if isCall && (op == OpArrayContains || op == OpArrayContainsAny) {
+			return nil, status.Errorf(codes.InvalidArgument, "%s cannot be used with a function in %q", v.Operator, k)
+		} else if !isCall {
+			path, err := ParseFieldPath(k)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			if _, _, wildcard := path.SplitWildcard(); wildcard && (op == OpArrayContains || op == OpArrayContainsAny) {
+				return nil, status.Errorf(codes.InvalidArgument, "%s cannot be used with [*] in %q", v.Operator, k)
+			}
+		}
+		filter := Filter{
 			Operator: op,
 			Value:    convertStructpbValue(v.Value),
 		}
-	}
-
-	results, err := collection.Search(ctx, query)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "search failed: %v", err)
-	}
-
-	typeUrl := buildTypeUrl(collection)
-	resp := &pb.SearchResponse{
-		Results: make([]*pb.SearchResult, len(results)),
-	}
-	for i, res := range results {
-		resp.Results[i] = &pb.SearchResult{
-			Item: &anypb.Any{
-				TypeUrl: typeUrl,
-				Value:   res.Record.ProtoData,
-			},
-			Score:    res.Score,
-			Distance: res.Distance,
+		if err := filter.Validate(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "filter on %q: %v", k, err)
 		}
+		filters[k] = filter
 	}
-
-	return resp, nil
+	return filters, nil
 }
 
 func (s *CollectionServer) Batch(ctx context.Context, req *pb.BatchRequest) (*pb.BatchResponse, error) {
@@ -258,8 +473,7 @@ func (s *CollectionServer) Batch(ctx context.Context, req *pb.BatchRequest) (*pb
 		case *pb.RequestOp_Create:
 			createResp, createErr := s.Create(ctx, o.Create)
 			if createErr != nil {
-				s, _ := status.FromError(createErr)
-				resp = &pb.ResponseOp{Status: &pb.Status{Code: pb.Status_Code(s.Code()), Message: s.Message()}}
+				resp = &pb.ResponseOp{Status: batchStatus(createErr)}
 			} else {
 				resp = &pb.ResponseOp{
 					Status:   &pb.Status{Code: pb.Status_OK},
@@ -269,8 +483,7 @@ func (s *CollectionServer) Batch(ctx context.Context, req *pb.BatchRequest) (*pb
 		case *pb.RequestOp_Update:
 			updateResp, updateErr := s.Update(ctx, o.Update)
 			if updateErr != nil {
-				s, _ := status.FromError(updateErr)
-				resp = &pb.ResponseOp{Status: &pb.Status{Code: pb.Status_Code(s.Code()), Message: s.Message()}}
+				resp = &pb.ResponseOp{Status: batchStatus(updateErr)}
 			} else {
 				resp = &pb.ResponseOp{
 					Status:   &pb.Status{Code: pb.Status_OK},
@@ -280,8 +493,7 @@ func (s *CollectionServer) Batch(ctx context.Context, req *pb.BatchRequest) (*pb
 		case *pb.RequestOp_Delete:
 			deleteResp, deleteErr := s.Delete(ctx, o.Delete)
 			if deleteErr != nil {
-				s, _ := status.FromError(deleteErr)
-				resp = &pb.ResponseOp{Status: &pb.Status{Code: pb.Status_Code(s.Code()), Message: s.Message()}}
+				resp = &pb.ResponseOp{Status: batchStatus(deleteErr)}
 			} else {
 				resp = &pb.ResponseOp{
 					Status:   &pb.Status{Code: pb.Status_OK},
@@ -317,10 +529,50 @@ func (s *CollectionServer) Describe(ctx context.Context, req *pb.DescribeRequest
 		size = info.Size()
 	}
 
-	return &pb.DescribeResponse{
+	resp := &pb.DescribeResponse{
 		CollectionDefinition: collection.Meta,
 		RecordCount:          count,
 		StorageSizeBytes:     size,
+	}
+	if collection.Sampler != nil {
+		resp.SamplingStats = collection.Sampler.Stats()
+	}
+	if buffer, ok := collection.Store.(*BufferedStore); ok {
+		resp.WriteBehindStats = buffer.Stats()
+	}
+	if resp.CompressionStats, err = collection.CompressionStats(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get compression stats: %v", err)
+	}
+	if resp.DeduplicationStats, err = collection.DeduplicationStats(ctx); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get deduplication stats: %v", err)
+	}
+
+	return resp, nil
+}
+
+// Flush writes any records queued by write-behind ingestion to the store.
+func (s *CollectionServer) Flush(ctx context.Context, req *pb.FlushRequest) (*pb.FlushResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+
+	buffer, ok := collection.Store.(*BufferedStore)
+	if !ok {
+		return &pb.FlushResponse{
+			Status: &pb.Status{Code: pb.Status_OK, Message: "write-behind is not enabled"},
+		}, nil
+	}
+
+	flushed, err := buffer.Flush(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "flush failed: %v", err)
+	}
+
+	return &pb.FlushResponse{
+		Status:  &pb.Status{Code: pb.Status_OK},
+		Flushed: flushed,
+		Stats:   buffer.Stats(),
 	}, nil
 }
 
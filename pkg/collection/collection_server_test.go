@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	pb "github.com/accretional/collector/gen/collector"
 	"github.com/accretional/collector/pkg/collection"
@@ -11,6 +12,7 @@ import (
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Re-export for cleaner test code
@@ -516,6 +518,127 @@ func TestCollectionServer_Search_WithFilters(t *testing.T) {
 	}
 }
 
+// TestCollectionServer_SearchFieldPaths tests nested paths and array operators over gRPC
+func TestCollectionServer_SearchFieldPaths(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewCollectionServer(repo)
+	ctx := context.Background()
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "orders"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	for id, data := range map[string]string{
+		"1": `{"items": [{"sku": "A", "qty": 1}], "tags": ["gift", "rush"]}`,
+		"2": `{"items": [{"sku": "B", "qty": 3}, {"sku": "A", "qty": 2}], "tags": ["rush"]}`,
+	} {
+		if _, err := server.Create(ctx, &pb.CreateRequest{
+			Namespace: "test", CollectionName: "orders", Id: id,
+			Item: &anypb.Any{Value: []byte(data)},
+		}); err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+
+	tags, _ := structpb.NewList([]interface{}{"gift", "rush"})
+	qtyRange, _ := structpb.NewList([]interface{}{1, 2})
+	tests := []struct {
+		name    string
+		filters map[string]*pb.Filter
+		want    int
+	}{
+		{"index", map[string]*pb.Filter{"items[0].sku": {Operator: pb.FilterOperator_OP_EQUALS, Value: structpb.NewStringValue("A")}}, 1},
+		{"wildcard", map[string]*pb.Filter{"items[*].qty": {Operator: pb.FilterOperator_OP_GREATER_THAN, Value: structpb.NewNumberValue(1)}}, 1},
+		{"wildcard in", map[string]*pb.Filter{"items[*].sku": {Operator: pb.FilterOperator_OP_IN, Value: structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{structpb.NewStringValue("A")}})}}, 2},
+		{"contains all", map[string]*pb.Filter{"tags": {Operator: pb.FilterOperator_OP_ARRAY_CONTAINS, Value: structpb.NewListValue(tags)}}, 1},
+		{"contains any", map[string]*pb.Filter{"tags": {Operator: pb.FilterOperator_OP_ARRAY_CONTAINS_ANY, Value: structpb.NewListValue(tags)}}, 2},
+		{"between", map[string]*pb.Filter{"items[0].qty": {Operator: pb.FilterOperator_OP_BETWEEN, Value: structpb.NewListValue(qtyRange)}}, 1},
+	}
+	for _, tt := range tests {
+		resp, err := server.Search(ctx, &pb.SearchRequest{Namespace: "test", CollectionName: "orders", Filters: tt.filters})
+		if err != nil {
+			t.Fatalf("%s: Search failed: %v", tt.name, err)
+		}
+		if len(resp.Results) != tt.want {
+			t.Errorf("%s: expected %d results, got %d", tt.name, tt.want, len(resp.Results))
+		}
+	}
+
+	for _, req := range []*pb.SearchRequest{
+		{Filters: map[string]*pb.Filter{"items[x]": {Operator: pb.FilterOperator_OP_EXISTS}}},
+		{Filters: map[string]*pb.Filter{"items[*]": {Operator: pb.FilterOperator_OP_ARRAY_CONTAINS, Value: structpb.NewStringValue("A")}}},
+		{OrderBy: "items[*].qty"},
+		{Filters: map[string]*pb.Filter{"items[0].qty": {Operator: pb.FilterOperator_OP_BETWEEN, Value: structpb.NewNumberValue(1)}}},
+		{Filters: map[string]*pb.Filter{"created": {Operator: pb.FilterOperator_OP_SAME_WEEK, Value: structpb.NewStringValue("soon")}}},
+	} {
+		req.Namespace, req.CollectionName = "test", "orders"
+		if _, err := server.Search(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for %v, got %v", req, err)
+		}
+	}
+}
+
+// TestCollectionServer_ExistsAndCount tests the Exists and Count RPCs
+func TestCollectionServer_ExistsAndCount(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewCollectionServer(repo)
+	ctx := context.Background()
+
+	_, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "items"})
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	for i, year := range []int{2020, 2023, 2024} {
+		_, err = server.Create(ctx, &pb.CreateRequest{
+			Namespace:      "test",
+			CollectionName: "items",
+			Item:           &anypb.Any{Value: []byte(fmt.Sprintf(`{"title": "Book %d", "year": %d}`, i, year))},
+			Id:             fmt.Sprint(i),
+		})
+		if err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+
+	for id, want := range map[string]bool{"1": true, "missing": false} {
+		resp, err := server.Exists(ctx, &pb.ExistsRequest{Namespace: "test", CollectionName: "items", Id: id})
+		if err != nil {
+			t.Fatalf("Exists failed: %v", err)
+		}
+		if resp.Exists != want {
+			t.Errorf("Exists(%q) = %v, want %v", id, resp.Exists, want)
+		}
+	}
+
+	resp, err := server.Count(ctx, &pb.CountRequest{
+		Namespace:      "test",
+		CollectionName: "items",
+		Filters: map[string]*pb.Filter{
+			"year": {Operator: pb.FilterOperator_OP_GREATER_EQUAL, Value: structpb.NewNumberValue(2023)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Count failed: %v", err)
+	}
+	if resp.Count != 2 {
+		t.Errorf("expected 2 records with year >= 2023, got %d", resp.Count)
+	}
+
+	resp, err = server.Count(ctx, &pb.CountRequest{Namespace: "test", CollectionName: "items", FullText: "Book"})
+	if err != nil {
+		t.Fatalf("Count failed: %v", err)
+	}
+	if resp.Count != 3 {
+		t.Errorf("expected 3 full-text matches, got %d", resp.Count)
+	}
+
+	_, err = server.Exists(ctx, &pb.ExistsRequest{Namespace: "test", CollectionName: "nope", Id: "1"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for missing collection, got %v", err)
+	}
+}
+
 // TestCollectionServer_Batch tests the Batch RPC
 func TestCollectionServer_Batch(t *testing.T) {
 	repo, cleanup := setupTestRepo(t)
@@ -718,3 +841,33 @@ func TestCollectionServer_Invoke(t *testing.T) {
 		t.Errorf("expected Unimplemented code, got %v", st.Code())
 	}
 }
+
+func TestCollectionServer_AsOfRequiresHistory(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewCollectionServer(repo)
+	ctx := context.Background()
+
+	_, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "items"})
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	asOf := timestamppb.New(time.Now().Add(-time.Hour))
+
+	_, err = server.Get(ctx, &pb.GetRequest{Namespace: "test", CollectionName: "items", Id: "1", AsOf: asOf})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition from Get, got %v", err)
+	}
+	_, err = server.List(ctx, &pb.ListRequest{Namespace: "test", CollectionName: "items", AsOf: asOf})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition from List, got %v", err)
+	}
+	_, err = server.Search(ctx, &pb.SearchRequest{Namespace: "test", CollectionName: "items", AsOf: asOf})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition from Search, got %v", err)
+	}
+	_, err = server.Search(ctx, &pb.SearchRequest{Namespace: "test", CollectionName: "items", FullText: "x", AsOf: asOf})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for full_text with as_of, got %v", err)
+	}
+}
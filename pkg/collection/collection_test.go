@@ -2,7 +2,9 @@ package collection_test
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	pb "github.com/accretional/collector/gen/collector"
 	"github.com/accretional/collector/pkg/collection"
@@ -70,3 +72,62 @@ func TestRealFTS(t *testing.T) {
 		t.Logf("Found %d results", len(results))
 	}
 }
+
+// plainStore hides optional capabilities such as RecordCounter.
+type plainStore struct {
+	collection.Store
+}
+
+func TestExistsAndCount_FallbackAndBuffered(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		err := coll.CreateRecord(ctx, &pb.CollectionRecord{
+			Id:        fmt.Sprintf("rec-%d", i),
+			ProtoData: []byte(fmt.Sprintf(`{"even": %v}`, i%2 == 0)),
+		})
+		if err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+
+	evens := &collection.SearchQuery{
+		Filters: map[string]collection.Filter{"even": {Operator: collection.OpEquals, Value: true}},
+		Limit:   1,
+	}
+	stores := map[string]collection.Store{
+		"fast":     coll.Store,
+		"fallback": plainStore{coll.Store},
+	}
+	for name, store := range stores {
+		ok, err := collection.RecordExists(ctx, store, "rec-2")
+		if err != nil || !ok {
+			t.Errorf("%s: expected rec-2 to exist, got %v (%v)", name, ok, err)
+		}
+		ok, err = collection.RecordExists(ctx, store, "missing")
+		if err != nil || ok {
+			t.Errorf("%s: expected missing record, got %v (%v)", name, ok, err)
+		}
+		// Pagination does not cap counts
+		count, err := collection.CountMatching(ctx, store, evens)
+		if err != nil || count != 2 {
+			t.Errorf("%s: expected 2 matches, got %d (%v)", name, count, err)
+		}
+	}
+
+	buffer := collection.NewBufferedStore(coll.Store, collection.WriteBufferOptions{FlushInterval: time.Hour})
+	defer buffer.Stop(ctx)
+	coll.Store = buffer
+
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "queued", ProtoData: []byte(`{"even": true}`)}); err != nil {
+		t.Fatalf("failed to queue record: %v", err)
+	}
+	if ok, err := coll.Exists(ctx, "queued"); err != nil || !ok {
+		t.Errorf("expected queued record to exist, got %v (%v)", ok, err)
+	}
+	if count, err := coll.Count(ctx, evens); err != nil || count != 3 {
+		t.Errorf("expected count to include queued record, got %d (%v)", count, err)
+	}
+}
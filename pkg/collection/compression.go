@@ -0,0 +1,169 @@
+package collection
+
+import (
+	"container/heap"
+	"context"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+const (
+	// DefaultCompressionMinSize is the smallest record data compressed at
+	// rest; smaller records gain little and are stored as is.
+	DefaultCompressionMinSize = 1024
+	// DefaultCompressionTrainAfter is how many records are compressed before
+	// a dictionary is trained from a sample of the collection.
+	DefaultCompressionTrainAfter = 1000
+	// MaxDictionarySize caps the trained dictionary: records of a few KB gain
+	// little from a larger one, and every encoder and decoder loads it.
+	MaxDictionarySize = 32 * 1024
+
+	// dictionarySegment is the length of the sample substrings a dictionary
+	// is assembled from, and dictionaryGram the length of the substrings
+	// counted to score them.
+	dictionarySegment = 48
+	dictionaryGram    = 8
+)
+
+// CompressionOptions enables transparent compression of record data at rest.
+// Each collection trains its own dictionary from a sample of its records, so
+// the field names and values its records share compress well even in small
+// records. Zero fields take their defaults.
+type CompressionOptions struct {
+	// MinSize is the smallest record data, in bytes, that is compressed.
+	MinSize int
+	// TrainAfter is how many records are compressed without a dictionary
+	// before one is trained.
+	TrainAfter int
+	// DictionarySize caps the trained dictionary, in bytes, up to
+	// MaxDictionarySize.
+	DictionarySize int
+}
+
+// WithDefaults returns o with zero fields set to their defaults.
+func (o CompressionOptions) WithDefaults() CompressionOptions {
+	if o.MinSize <= 0 {
+		o.MinSize = DefaultCompressionMinSize
+	}
+	if o.TrainAfter <= 0 {
+		o.TrainAfter = DefaultCompressionTrainAfter
+	}
+	if o.DictionarySize <= 0 || o.DictionarySize > MaxDictionarySize {
+		o.DictionarySize = MaxDictionarySize
+	}
+	return o
+}
+
+// CompressionReporter is implemented by stores that compress record data,
+// to report how well it compresses.
+type CompressionReporter interface {
+	CompressionStats(ctx context.Context) (*pb.CompressionStats, error)
+}
+
+// CompressionStats reports how well the collection's record data compresses,
+// or nil if its store does not compress.
+func (c *Collection) CompressionStats(ctx context.Context) (*pb.CompressionStats, error) {
+	cr, ok := c.Store.(CompressionReporter)
+	if !ok {
+		return nil, nil
+	}
+	return cr.CompressionStats(ctx)
+}
+
+// TrainDictionary builds a preset compression dictionary of up to size bytes
+// from sample record data. It picks the sample substrings that cover the most
+// substrings shared between samples, placing the most valuable last, where
+// references to it are cheapest. It returns nil when the samples share
+// nothing worth a dictionary.
+func TrainDictionary(samples [][]byte, size int) []byte {
+	if size <= 0 || size > MaxDictionarySize {
+		size = MaxDictionarySize
+	}
+
+	// Count the samples each substring appears in; substrings of a single
+	// sample do not help compress others
+	freq := make(map[string]int)
+	for _, sample := range samples {
+		seen := make(map[string]bool)
+		for i := 0; i+dictionaryGram <= len(sample); i++ {
+			gram := string(sample[i : i+dictionaryGram])
+			if !seen[gram] {
+				seen[gram] = true
+				freq[gram]++
+			}
+		}
+	}
+	score := func(segment []byte) int {
+		total := 0
+		for i := 0; i+dictionaryGram <= len(segment); i++ {
+			if n := freq[string(segment[i:i+dictionaryGram])]; n > 1 {
+				total += n
+			}
+		}
+		return total
+	}
+
+	// Candidate segments overlap by half, so shared substrings are not split
+	// at a segment boundary in every sample
+	candidates := &segmentHeap{}
+	for _, sample := range samples {
+		for i := 0; i < len(sample); i += dictionarySegment / 2 {
+			segment := sample[i:min(i+dictionarySegment, len(sample))]
+			if s := score(segment); s > 0 {
+				*candidates = append(*candidates, scoredSegment{segment, s})
+			}
+		}
+	}
+	heap.Init(candidates)
+
+	// Greedily take the best segment, then zero the substrings it covers.
+	// Scores only fall, so a popped segment whose rescored value still beats
+	// the next best is the best.
+	var picked [][]byte
+	total := 0
+	for candidates.Len() > 0 && total < size {
+		top := heap.Pop(candidates).(scoredSegment)
+		s := score(top.segment)
+		if s == 0 {
+			continue
+		}
+		if candidates.Len() > 0 && s < (*candidates)[0].score {
+			heap.Push(candidates, scoredSegment{top.segment, s})
+			continue
+		}
+		segment := top.segment[:min(len(top.segment), size-total)]
+		for i := 0; i+dictionaryGram <= len(segment); i++ {
+			delete(freq, string(segment[i:i+dictionaryGram]))
+		}
+		picked = append(picked, segment)
+		total += len(segment)
+	}
+	if len(picked) == 0 {
+		return nil
+	}
+
+	dict := make([]byte, 0, total)
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, picked[i]...)
+	}
+	return dict
+}
+
+type scoredSegment struct {
+	segment []byte
+	score   int
+}
+
+// segmentHeap is a max-heap of segments by score.
+type segmentHeap []scoredSegment
+
+func (h segmentHeap) Len() int           { return len(h) }
+func (h segmentHeap) Less(i, j int) bool { return h[i].score > h[j].score }
+func (h segmentHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *segmentHeap) Push(x any)        { *h = append(*h, x.(scoredSegment)) }
+func (h *segmentHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,75 @@
+package collection
+
+import (
+	"context"
+	"strings"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ConsistencyMetadataKey is the response header naming the consistency a
+	// read got: "strong" or "eventual".
+	ConsistencyMetadataKey = "x-collector-consistency"
+	// PrimaryMetadataKey is the response trailer naming the collector that
+	// serves strong reads of a copy, when one is refused.
+	PrimaryMetadataKey = "x-collector-primary"
+)
+
+type consistencyKey struct{}
+
+// WithConsistency returns a context whose reads have consistency c. Eventual
+// reads of write-behind collections skip flushing the buffer, so they miss
+// records still waiting in it.
+func WithConsistency(ctx context.Context, c pb.ReadConsistency) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, c)
+}
+
+func eventualRead(ctx context.Context) bool {
+	c, _ := ctx.Value(consistencyKey{}).(pb.ReadConsistency)
+	return c == pb.ReadConsistency_CONSISTENCY_EVENTUAL
+}
+
+// Primary returns the endpoint of the collector a copy of a remote collection
+// was fetched or cloned from, or "" for collections that are not such copies.
+func (c *Collection) Primary() string {
+	labels := c.Meta.GetMetadata().GetLabels()
+	for _, key := range []string{"fetched_from", "cloned_from"} {
+		if _, endpoint, ok := strings.Cut(labels[key], "@"); ok && endpoint != "" {
+			return endpoint
+		}
+	}
+	return ""
+}
+
+// readConsistency resolves the consistency of a read of collection, echoes it
+// in the response header and returns the context to read with. Strong reads
+// of copies are refused with FailedPrecondition, naming the primary in a
+// trailer for the client to retry against.
+func readConsistency(ctx context.Context, collection *Collection, requested pb.ReadConsistency) (context.Context, error) {
+	primary := collection.Primary()
+	resolved := requested
+	if resolved == pb.ReadConsistency_CONSISTENCY_UNSPECIFIED {
+		resolved = pb.ReadConsistency_CONSISTENCY_STRONG
+		if primary != "" {
+			resolved = pb.ReadConsistency_CONSISTENCY_EVENTUAL
+		}
+	}
+	if resolved == pb.ReadConsistency_CONSISTENCY_STRONG && primary != "" {
+		_ = grpc.SetTrailer(ctx, metadata.Pairs(PrimaryMetadataKey, primary))
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"%s/%s is a copy; read it from its primary at %s for strong consistency",
+			collection.Meta.Namespace, collection.Meta.Name, primary)
+	}
+
+	name := "strong"
+	if resolved == pb.ReadConsistency_CONSISTENCY_EVENTUAL {
+		name = "eventual"
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(ConsistencyMetadataKey, name))
+	return WithConsistency(ctx, resolved), nil
+}
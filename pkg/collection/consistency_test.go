@@ -0,0 +1,90 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// headerStream records the metadata a handler sets.
+type headerStream struct {
+	header, trailer metadata.MD
+}
+
+func (s *headerStream) Method() string { return "" }
+func (s *headerStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+func (s *headerStream) SendHeader(md metadata.MD) error { return s.SetHeader(md) }
+func (s *headerStream) SetTrailer(md metadata.MD) error {
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
+func TestCollectionServer_ReadConsistency(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewCollectionServer(repo)
+	ctx := context.Background()
+
+	for _, meta := range []*pb.Collection{
+		{Namespace: "test", Name: "ingest", WriteBehind: &pb.WriteBehindConfig{Enabled: true, FlushIntervalMs: 60000}},
+		{Namespace: "test", Name: "copy", Metadata: &pb.Metadata{Labels: map[string]string{"fetched_from": "test/users@primary:50051"}}},
+	} {
+		if _, err := repo.CreateCollection(ctx, meta); err != nil {
+			t.Fatalf("failed to create collection: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := server.Create(ctx, &pb.CreateRequest{
+			Namespace: "test", CollectionName: "ingest", Id: fmt.Sprintf("e-%d", i), Item: &anypb.Any{Value: []byte(`{"n": 1}`)},
+		}); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+
+	count := func(name string, c pb.ReadConsistency) (int64, *headerStream, error) {
+		stream := &headerStream{}
+		resp, err := server.Count(grpc.NewContextWithServerTransportStream(ctx, stream), &pb.CountRequest{
+			Namespace: "test", CollectionName: name, Consistency: c,
+		})
+		return resp.GetCount(), stream, err
+	}
+
+	// Eventual reads skip the write-behind buffer; strong reads flush it
+	n, stream, err := count("ingest", pb.ReadConsistency_CONSISTENCY_EVENTUAL)
+	if err != nil || n != 0 {
+		t.Fatalf("expected an eventual count of 0 buffered records, got %d, %v", n, err)
+	}
+	if got := stream.header.Get(collection.ConsistencyMetadataKey); len(got) != 1 || got[0] != "eventual" {
+		t.Errorf("expected the eventual consistency header, got %v", got)
+	}
+	n, stream, err = count("ingest", pb.ReadConsistency_CONSISTENCY_UNSPECIFIED)
+	if err != nil || n != 3 {
+		t.Fatalf("expected a strong count of 3 records, got %d, %v", n, err)
+	}
+	if got := stream.header.Get(collection.ConsistencyMetadataKey); len(got) != 1 || got[0] != "strong" {
+		t.Errorf("expected the strong consistency header, got %v", got)
+	}
+
+	// Copies serve eventual reads and send strong ones to their primary
+	if _, stream, err = count("copy", pb.ReadConsistency_CONSISTENCY_UNSPECIFIED); err != nil || stream.header.Get(collection.ConsistencyMetadataKey)[0] != "eventual" {
+		t.Errorf("expected copies to default to eventual reads, got %v, %v", stream.header, err)
+	}
+	_, stream, err = count("copy", pb.ReadConsistency_CONSISTENCY_STRONG)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected a strong read of a copy to be refused, got %v", err)
+	}
+	if got := stream.trailer.Get(collection.PrimaryMetadataKey); len(got) != 1 || got[0] != "primary:50051" {
+		t.Errorf("expected the primary in the trailer, got %v", got)
+	}
+}
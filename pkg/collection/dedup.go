@@ -0,0 +1,23 @@
+package collection
+
+import (
+	"context"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// DeduplicationReporter is implemented by stores that share identical record
+// data, to report how much space it saves.
+type DeduplicationReporter interface {
+	DeduplicationStats(ctx context.Context) (*pb.DeduplicationStats, error)
+}
+
+// DeduplicationStats reports how much space sharing identical record data
+// saves, or nil if the collection's store does not deduplicate.
+func (c *Collection) DeduplicationStats(ctx context.Context) (*pb.DeduplicationStats, error) {
+	dr, ok := c.Store.(DeduplicationReporter)
+	if !ok {
+		return nil, nil
+	}
+	return dr.DeduplicationStats(ctx)
+}
@@ -0,0 +1,258 @@
+package collection
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// diffPageSize is how many records a diff reads from each side at a time.
+const diffPageSize = 500
+
+// DefaultDiffBatchSize is how many record diffs DiffCollections sends per
+// response unless the request says otherwise.
+const DefaultDiffBatchSize = 500
+
+// DiffCollections compares from and to record by record, calling fn for each
+// record added in to, removed from from, or changed between them, and returns
+// the totals. Records are compared by data, data_uri and labels; timestamps
+// are ignored, and JSON data that decodes to the same value is equal. With
+// fieldDiffs, changed JSON records list the fields that differ.
+//
+// Each side is paged through as it is read, so a side taking writes during
+// the diff may be seen partly before and partly after them; diff snapshots
+// for a consistent result.
+func DiffCollections(ctx context.Context, from, to *Collection, fieldDiffs bool, fn func(*pb.RecordDiff) error) (*pb.DiffSummary, error) {
+	summary := &pb.DiffSummary{}
+
+	// Records of from: removed, changed or unchanged
+	err := eachRecord(ctx, from, func(rec *pb.CollectionRecord) error {
+		other, err := to.GetRecord(ctx, rec.Id)
+		if errors.Is(err, sql.ErrNoRows) {
+			summary.Removed++
+			return fn(&pb.RecordDiff{Id: rec.Id, Kind: pb.DiffKind_DIFF_REMOVED})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", rec.Id, err)
+		}
+		if recordsEqual(rec, other) {
+			summary.Unchanged++
+			return nil
+		}
+		summary.Changed++
+		diff := &pb.RecordDiff{Id: rec.Id, Kind: pb.DiffKind_DIFF_CHANGED}
+		if fieldDiffs {
+			diff.Fields = diffFields(rec.ProtoData, other.ProtoData)
+		}
+		return fn(diff)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Records only in to
+	err = eachRecord(ctx, to, func(rec *pb.CollectionRecord) error {
+		_, err := from.GetRecord(ctx, rec.Id)
+		if errors.Is(err, sql.ErrNoRows) {
+			summary.Added++
+			return fn(&pb.RecordDiff{Id: rec.Id, Kind: pb.DiffKind_DIFF_ADDED})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", rec.Id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// eachRecord calls fn with every record of c, a page at a time.
+func eachRecord(ctx context.Context, c *Collection, fn func(*pb.CollectionRecord) error) error {
+	for offset := 0; ; offset += diffPageSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		records, err := c.ListRecords(ctx, offset, diffPageSize)
+		if err != nil {
+			return fmt.Errorf("failed to list %s/%s: %w", c.Meta.Namespace, c.Meta.Name, err)
+		}
+		for _, rec := range records {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		if len(records) < diffPageSize {
+			return nil
+		}
+	}
+}
+
+// recordsEqual reports whether two versions of a record hold the same data,
+// data_uri and labels.
+func recordsEqual(a, b *pb.CollectionRecord) bool {
+	if a.DataUri != b.DataUri || !labelsEqual(a.GetMetadata().GetLabels(), b.GetMetadata().GetLabels()) {
+		return false
+	}
+	if bytes.Equal(a.ProtoData, b.ProtoData) {
+		return true
+	}
+	var av, bv interface{}
+	if json.Unmarshal(a.ProtoData, &av) != nil || json.Unmarshal(b.ProtoData, &bv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// diffFields lists the fields that differ between two JSON documents, or
+// nothing if either is not JSON.
+func diffFields(a, b []byte) []*pb.FieldDiff {
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return nil
+	}
+	var diffs []*pb.FieldDiff
+	diffValues(nil, av, bv, true, true, &diffs)
+	return diffs
+}
+
+// diffValues appends the differences between a and b, found at path, to
+// diffs. hasA and hasB say whether the field is present on each side.
+func diffValues(path FieldPath, a, b interface{}, hasA, hasB bool, diffs *[]*pb.FieldDiff) {
+	if hasA && hasB {
+		switch av := a.(type) {
+		case map[string]interface{}:
+			if bv, ok := b.(map[string]interface{}); ok {
+				keys := make([]string, 0, len(av)+len(bv))
+				for k := range av {
+					keys = append(keys, k)
+				}
+				for k := range bv {
+					if _, ok := av[k]; !ok {
+						keys = append(keys, k)
+					}
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					ak, okA := av[k]
+					bk, okB := bv[k]
+					diffValues(append(path[:len(path):len(path)], PathSegment{Key: k}), ak, bk, okA, okB, diffs)
+				}
+				return
+			}
+		case []interface{}:
+			if bv, ok := b.([]interface{}); ok && len(av) == len(bv) {
+				for i := range av {
+					diffValues(append(path[:len(path):len(path)], PathSegment{Index: i, IsIndex: true}), av[i], bv[i], true, true, diffs)
+				}
+				return
+			}
+		}
+		if reflect.DeepEqual(a, b) {
+			return
+		}
+	}
+	diff := &pb.FieldDiff{Path: path.String()}
+	if hasA {
+		diff.OldJson = jsonValue(a)
+	}
+	if hasB {
+		diff.NewJson = jsonValue(b)
+	}
+	*diffs = append(*diffs, diff)
+}
+
+func jsonValue(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// diffSource returns the collection or snapshot a diff reads, and the
+// function releasing it.
+func (s *GrpcServer) diffSource(ctx context.Context, src *pb.DiffSource) (*Collection, func(), error) {
+	if src.GetCollection().GetNamespace() == "" || src.GetCollection().GetName() == "" {
+		return nil, nil, status.Error(codes.InvalidArgument, "from and to need a collection namespace and name")
+	}
+	ns, name := src.Collection.Namespace, src.Collection.Name
+	if src.Snapshot == "" {
+		coll, err := s.repo.GetCollection(ctx, ns, name)
+		if err != nil {
+			return nil, nil, status.Error(codes.NotFound, err.Error())
+		}
+		return coll, func() {}, nil
+	}
+	if s.snapshots == nil {
+		return nil, nil, status.Error(codes.Internal, "snapshot manager not initialized")
+	}
+	coll, err := s.snapshots.Open(ctx, ns, name, src.Snapshot)
+	switch {
+	case errors.Is(err, ErrSnapshotNotFound):
+		return nil, nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrSnapshotsUnreadable):
+		return nil, nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+	return coll, func() { coll.Close() }, nil
+}
+
+// DiffCollections streams the records added, removed and changed between two
+// collections or snapshots, in batches, ending with a summary.
+func (s *GrpcServer) DiffCollections(req *pb.DiffCollectionsRequest, stream pb.CollectionRepo_DiffCollectionsServer) error {
+	ctx := stream.Context()
+	from, releaseFrom, err := s.diffSource(ctx, req.From)
+	if err != nil {
+		return err
+	}
+	defer releaseFrom()
+	to, releaseTo, err := s.diffSource(ctx, req.To)
+	if err != nil {
+		return err
+	}
+	defer releaseTo()
+
+	batchSize := int(req.BatchSize)
+	if batchSize <= 0 {
+		batchSize = DefaultDiffBatchSize
+	}
+	batch := &pb.DiffCollectionsResponse{}
+	summary, err := DiffCollections(ctx, from, to, req.FieldDiffs, func(diff *pb.RecordDiff) error {
+		batch.Diffs = append(batch.Diffs, diff)
+		if len(batch.Diffs) < batchSize {
+			return nil
+		}
+		err := stream.Send(batch)
+		batch = &pb.DiffCollectionsResponse{}
+		return err
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	batch.Summary = summary
+	return stream.Send(batch)
+}
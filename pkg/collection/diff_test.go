@@ -0,0 +1,140 @@
+package collection_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestDiffCollectionsAgainstSnapshot(t *testing.T) {
+	ctx := context.Background()
+	repo, server, addr := startRepoServer(t)
+	repo.(*collection.DefaultCollectionRepo).SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "users"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "users")
+	for id, data := range map[string]string{
+		"same":    `{"name": "ada", "tags": ["a", "b"]}`,
+		"edited":  `{"name": "bob", "address": {"city": "Paris", "zip": "75001"}, "tags": ["x"]}`,
+		"deleted": `{"name": "cy"}`,
+	} {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: []byte(data)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	resp, _ := server.CreateSnapshot(ctx, &pb.CreateSnapshotRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "users"}, Name: "v1"})
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("CreateSnapshot failed: %v", resp.Status)
+	}
+
+	if err := coll.UpdateRecord(ctx, &pb.CollectionRecord{Id: "edited", ProtoData: []byte(`{"name": "bob", "address": {"city": "Lyon"}, "tags": ["x"], "age": 40}`)}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if err := coll.DeleteRecord(ctx, "deleted"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "added", ProtoData: []byte(`{"name": "dee"}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	stream, err := pb.NewCollectionRepoClient(conn).DiffCollections(ctx, &pb.DiffCollectionsRequest{
+		From:       &pb.DiffSource{Collection: &pb.NamespacedName{Namespace: "test", Name: "users"}, Snapshot: "v1"},
+		To:         &pb.DiffSource{Collection: &pb.NamespacedName{Namespace: "test", Name: "users"}},
+		FieldDiffs: true,
+		BatchSize:  1,
+	})
+	if err != nil {
+		t.Fatalf("DiffCollections failed: %v", err)
+	}
+
+	diffs := map[string]*pb.RecordDiff{}
+	var summary *pb.DiffSummary
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		for _, d := range msg.Diffs {
+			diffs[d.Id] = d
+		}
+		if msg.Summary != nil {
+			summary = msg.Summary
+		}
+	}
+
+	if summary == nil || summary.Added != 1 || summary.Removed != 1 || summary.Changed != 1 || summary.Unchanged != 1 {
+		t.Fatalf("unexpected summary %v", summary)
+	}
+	if diffs["added"].GetKind() != pb.DiffKind_DIFF_ADDED || diffs["deleted"].GetKind() != pb.DiffKind_DIFF_REMOVED {
+		t.Errorf("unexpected diffs %v", diffs)
+	}
+	if _, ok := diffs["same"]; ok {
+		t.Error("expected no diff for an unchanged record")
+	}
+
+	want := map[string][2]string{
+		"address.city": {`"Paris"`, `"Lyon"`},
+		"address.zip":  {`"75001"`, ""},
+		"age":          {"", "40"},
+	}
+	fields := diffs["edited"].GetFields()
+	if len(fields) != len(want) {
+		t.Fatalf("expected %d field diffs, got %v", len(want), fields)
+	}
+	for _, f := range fields {
+		w, ok := want[f.Path]
+		if !ok || f.OldJson != w[0] || f.NewJson != w[1] {
+			t.Errorf("unexpected field diff %v", f)
+		}
+	}
+}
+
+func TestDiffCollectionsRejectsUnknownSources(t *testing.T) {
+	ctx := context.Background()
+	repo, _, addr := startRepoServer(t)
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "users"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewCollectionRepoClient(conn)
+	users := &pb.NamespacedName{Namespace: "test", Name: "users"}
+
+	for _, tc := range []struct {
+		req  *pb.DiffCollectionsRequest
+		code codes.Code
+	}{
+		{&pb.DiffCollectionsRequest{From: &pb.DiffSource{Collection: users}}, codes.InvalidArgument},
+		{&pb.DiffCollectionsRequest{From: &pb.DiffSource{Collection: users}, To: &pb.DiffSource{Collection: &pb.NamespacedName{Namespace: "test", Name: "missing"}}}, codes.NotFound},
+		{&pb.DiffCollectionsRequest{From: &pb.DiffSource{Collection: users, Snapshot: "nope"}, To: &pb.DiffSource{Collection: users}}, codes.NotFound},
+	} {
+		stream, err := client.DiffCollections(ctx, tc.req)
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if status.Code(err) != tc.code {
+			t.Errorf("expected %v, got %v", tc.code, err)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	// DefaultDiskCheckInterval is how often a DiskWatchdog checks free space.
+	DefaultDiskCheckInterval = 10 * time.Second
+	// DefaultLowFreeBytes is the free space below which a volume is reported
+	// as low.
+	DefaultLowFreeBytes = 2 << 30
+	// DefaultMinFreeBytes is the free space below which a volume is critical:
+	// non-essential writes to it are refused and jobs writing to it pause.
+	DefaultMinFreeBytes = 512 << 20
+)
+
+// DiskLevel grades the free space of a volume.
+type DiskLevel int
+
+const (
+	DiskOK DiskLevel = iota
+	DiskLow
+	DiskCritical
+)
+
+func (l DiskLevel) String() string {
+	switch l {
+	case DiskLow:
+		return "low"
+	case DiskCritical:
+		return "critical"
+	}
+	return "ok"
+}
+
+// DiskUsageFunc reports the free and total bytes of the volume holding path.
+type DiskUsageFunc func(path string) (free, total uint64, err error)
+
+// DiskVolume is the state of a watched data directory at its last check.
+type DiskVolume struct {
+	Dir         string
+	Free, Total uint64
+	Level       DiskLevel
+	CheckedAt   time.Time
+}
+
+// DiskWatchdogOptions configures a DiskWatchdog. Zero fields take their
+// defaults.
+type DiskWatchdogOptions struct {
+	// Interval is how often Start checks the data directories.
+	Interval time.Duration
+	// LowFreeBytes and MinFreeBytes are the free space below which a volume
+	// is low and critical.
+	LowFreeBytes uint64
+	MinFreeBytes uint64
+	// Usage reads free space; it defaults to DiskUsage.
+	Usage DiskUsageFunc
+	// OnEvent, when set, is called when a data directory changes level.
+	OnEvent func(DiskVolume)
+	// Locate returns the directory a collection is stored in, or "" for the
+	// first data directory. DefaultCollectionRepo.StoragePath fits.
+	Locate func(namespace, name string) string
+}
+
+// WithDefaults returns o with zero fields set to their defaults.
+func (o DiskWatchdogOptions) WithDefaults() DiskWatchdogOptions {
+	if o.Interval <= 0 {
+		o.Interval = DefaultDiskCheckInterval
+	}
+	if o.LowFreeBytes == 0 {
+		o.LowFreeBytes = DefaultLowFreeBytes
+	}
+	if o.MinFreeBytes == 0 {
+		o.MinFreeBytes = DefaultMinFreeBytes
+	}
+	if o.Usage == nil {
+		o.Usage = DiskUsage
+	}
+	return o
+}
+
+// DiskProtectedMethods are the calls a DiskWatchdog refuses while the volume
+// they write to is critical. Calls that free space (deletes, acks), flush
+// buffered data or move collections off a full disk stay available.
+var DiskProtectedMethods = map[string]bool{
+	"/collector.CollectionService/Create":          true,
+	"/collector.CollectionService/Update":          true,
+	"/collector.CollectionService/UploadRecord":    true,
+	"/collector.CollectionService/Batch":           true,
+	"/collector.CollectionService/Increment":       true,
+	"/collector.CollectionService/Enqueue":         true,
+	"/collector.CollectionService/WriteWithOutbox": true,
+	"/collector.CollectionService/PushChanges":     true,
+	"/collector.CollectionService/AddAttachment":   true,
+	"/collector.CollectionService/SaveSearch":      true,
+	"/collector.CollectionRepo/CreateCollection":   true,
+	"/collector.CollectionRepo/Clone":              true,
+	"/collector.CollectionRepo/CloneCollection":    true,
+	"/collector.CollectionRepo/Fetch":              true,
+	"/collector.CollectionRepo/BackupCollection":   true,
+	"/collector.CollectionRepo/RestoreBackup":      true,
+	"/collector.CollectionRepo/PushCollection":     true,
+	"/collector.CollectionRepo/StartTransfer":      true,
+	"/collector.CollectionBackup/Backup":           true,
+	"/collector.CollectionBackup/Restore":          true,
+}
+
+// DiskWatchdog watches the free space of the collector's data directories.
+// When a directory's volume drops below the thresholds it reports an event;
+// while it is critical, its interceptors refuse non-essential writes with
+// ResourceExhausted and WaitForSpace holds jobs writing to it, so databases
+// are not left half-written when the disk fills up.
+type DiskWatchdog struct {
+	dirs []string
+	opts DiskWatchdogOptions
+
+	mu      sync.Mutex
+	volumes map[string]DiskVolume
+	failed  map[string]bool // Directories whose usage could not be read
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDiskWatchdog creates a watchdog for the given data directories. The
+// first is where collections without a storage path of their own live.
+func NewDiskWatchdog(dirs []string, opts DiskWatchdogOptions) *DiskWatchdog {
+	w := &DiskWatchdog{opts: opts.WithDefaults(), volumes: make(map[string]DiskVolume), failed: make(map[string]bool)}
+	for _, dir := range dirs {
+		if abs, err := filepath.Abs(dir); err == nil {
+			w.dirs = append(w.dirs, abs)
+		}
+	}
+	return w
+}
+
+// level grades free space against the thresholds.
+func (w *DiskWatchdog) level(free uint64) DiskLevel {
+	switch {
+	case free < w.opts.MinFreeBytes:
+		return DiskCritical
+	case free < w.opts.LowFreeBytes:
+		return DiskLow
+	}
+	return DiskOK
+}
+
+// usage reads the free space of the volume holding path, which need not
+// exist yet.
+func (w *DiskWatchdog) usage(path string) (free, total uint64, err error) {
+	for {
+		if _, statErr := os.Stat(path); statErr == nil {
+			return w.opts.Usage(path)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return w.opts.Usage(path)
+		}
+		path = parent
+	}
+}
+
+// Check reads the free space of every data directory, reports the ones that
+// changed level and returns their state.
+func (w *DiskWatchdog) Check() []DiskVolume {
+	var changed, checked []DiskVolume
+	for _, dir := range w.dirs {
+		free, total, err := w.usage(dir)
+		w.mu.Lock()
+		if err != nil {
+			if !w.failed[dir] {
+				log.Printf("Warning: failed to read free space of %s: %v", dir, err)
+			}
+			w.failed[dir] = true
+			w.mu.Unlock()
+			continue
+		}
+		delete(w.failed, dir)
+		vol := DiskVolume{Dir: dir, Free: free, Total: total, Level: w.level(free), CheckedAt: time.Now()}
+		prev, seen := w.volumes[dir]
+		w.volumes[dir] = vol
+		w.mu.Unlock()
+
+		checked = append(checked, vol)
+		if (seen && prev.Level != vol.Level) || (!seen && vol.Level != DiskOK) {
+			changed = append(changed, vol)
+		}
+	}
+	for _, vol := range changed {
+		log.Printf("Disk space on %s is %s: %d of %d bytes free", vol.Dir, vol.Level, vol.Free, vol.Total)
+		if w.opts.OnEvent != nil {
+			w.opts.OnEvent(vol)
+		}
+	}
+	return checked
+}
+
+// Volumes returns the state of the data directories at their last check.
+func (w *DiskWatchdog) Volumes() []DiskVolume {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	volumes := make([]DiskVolume, 0, len(w.volumes))
+	for _, vol := range w.volumes {
+		volumes = append(volumes, vol)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Dir < volumes[j].Dir })
+	return volumes
+}
+
+// LevelFor returns the level of the volume holding path: that of the data
+// directory containing it at its last check, or a fresh reading for paths
+// outside them. Unreadable volumes are taken to be fine.
+func (w *DiskWatchdog) LevelFor(path string) DiskLevel {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return DiskOK
+	}
+	w.mu.Lock()
+	var best DiskVolume
+	for dir, vol := range w.volumes {
+		if (abs == dir || strings.HasPrefix(abs, dir+string(filepath.Separator))) && len(dir) > len(best.Dir) {
+			best = vol
+		}
+	}
+	w.mu.Unlock()
+	if best.Dir != "" {
+		return best.Level
+	}
+	free, _, err := w.usage(abs)
+	if err != nil {
+		return DiskOK
+	}
+	return w.level(free)
+}
+
+// WaitForSpace blocks while the volume holding path is critical, checking
+// again every interval, and returns early with the context's error.
+func (w *DiskWatchdog) WaitForSpace(ctx context.Context, path string) error {
+	if w == nil {
+		return nil
+	}
+	logged := false
+	for w.LevelFor(path) == DiskCritical {
+		if !logged {
+			log.Printf("Pausing a job writing to %s until disk space is freed", path)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(w.opts.Interval):
+		}
+		w.Check()
+	}
+	return nil
+}
+
+// requestPath returns the path a request writes to: its dest_path, the
+// storage directory of the collection it names, or the first data directory.
+func (w *DiskWatchdog) requestPath(m protoreflect.Message) string {
+	if f := m.Descriptor().Fields().ByName("dest_path"); f != nil && f.Kind() == protoreflect.StringKind && f.Cardinality() != protoreflect.Repeated {
+		if path := m.Get(f).String(); path != "" {
+			return path
+		}
+	}
+	if w.opts.Locate != nil {
+		if dir := w.opts.Locate(requestCollection(m)); dir != "" {
+			return dir
+		}
+	}
+	if len(w.dirs) > 0 {
+		return w.dirs[0]
+	}
+	return "."
+}
+
+// requestCollection returns the collection a request targets, by its
+// namespace and collection_name fields or its collection field.
+func requestCollection(m protoreflect.Message) (namespace, name string) {
+	namespace = requestNamespace(m)
+	fields := m.Descriptor().Fields()
+	if f := fields.ByName("collection_name"); f != nil && f.Kind() == protoreflect.StringKind && f.Cardinality() != protoreflect.Repeated {
+		return namespace, m.Get(f).String()
+	}
+	if f := fields.ByName("collection"); f != nil && f.Kind() == protoreflect.MessageKind && f.Cardinality() != protoreflect.Repeated && m.Has(f) {
+		if nf := f.Message().Fields().ByName("name"); nf != nil && nf.Kind() == protoreflect.StringKind {
+			return namespace, m.Get(f).Message().Get(nf).String()
+		}
+	}
+	return namespace, ""
+}
+
+func (w *DiskWatchdog) refuse(method, path string) error {
+	return status.Errorf(codes.ResourceExhausted,
+		"%s refused: the volume holding %s has under %d bytes free; deletes are still accepted",
+		method, path, w.opts.MinFreeBytes)
+}
+
+// UnaryInterceptor refuses DiskProtectedMethods calls that write to a critical
+// volume.
+func (w *DiskWatchdog) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		msg, ok := req.(proto.Message)
+		if !ok || !DiskProtectedMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		if path := w.requestPath(msg.ProtoReflect()); w.LevelFor(path) == DiskCritical {
+			return nil, w.refuse(info.FullMethod, path)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor refuses DiskProtectedMethods streams while the first data
+// directory is critical; their target is not known until the stream starts.
+func (w *DiskWatchdog) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if DiskProtectedMethods[info.FullMethod] && len(w.dirs) > 0 && w.LevelFor(w.dirs[0]) == DiskCritical {
+			return w.refuse(info.FullMethod, w.dirs[0])
+		}
+		return handler(srv, ss)
+	}
+}
+
+// Start checks the data directories now and then every interval until Stop.
+func (w *DiskWatchdog) Start() {
+	w.mu.Lock()
+	if w.stop != nil {
+		w.mu.Unlock()
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	w.stop, w.done = stop, done
+	w.mu.Unlock()
+
+	w.Check()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(w.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			w.Check()
+		}
+	}()
+}
+
+// Stop ends the Start loop.
+func (w *DiskWatchdog) Stop() {
+	w.mu.Lock()
+	stop, done := w.stop, w.done
+	w.stop, w.done = nil, nil
+	w.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// String describes the watchdog's thresholds, for logs.
+func (w *DiskWatchdog) String() string {
+	return fmt.Sprintf("%s (low under %d bytes free, critical under %d)", strings.Join(w.dirs, ", "), w.opts.LowFreeBytes, w.opts.MinFreeBytes)
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd)
+
+package collection
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DiskUsage is not supported on this platform; watchdogs treat its volumes
+// as having space.
+func DiskUsage(path string) (free, total uint64, err error) {
+	return 0, 0, fmt.Errorf("reading free space of %s: %w", path, errors.ErrUnsupported)
+}
@@ -0,0 +1,81 @@
+package collection_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDiskWatchdog(t *testing.T) {
+	dir := t.TempDir()
+	var free atomic.Uint64
+	free.Store(10 << 30)
+	var (
+		mu     sync.Mutex
+		events []collection.DiskLevel
+	)
+	w := collection.NewDiskWatchdog([]string{dir}, collection.DiskWatchdogOptions{
+		Interval:     10 * time.Millisecond,
+		LowFreeBytes: 1 << 30,
+		MinFreeBytes: 1 << 20,
+		Usage: func(string) (uint64, uint64, error) {
+			return free.Load(), 100 << 30, nil
+		},
+		OnEvent: func(vol collection.DiskVolume) {
+			mu.Lock()
+			events = append(events, vol.Level)
+			mu.Unlock()
+		},
+	})
+
+	w.Check()
+	free.Store(512 << 20)
+	w.Check()
+	free.Store(1 << 10)
+	w.Check()
+	w.Check()
+	mu.Lock()
+	if len(events) != 2 || events[0] != collection.DiskLow || events[1] != collection.DiskCritical {
+		t.Errorf("expected low then critical events, got %v", events)
+	}
+	mu.Unlock()
+
+	// Non-essential writes are refused; deletes still free space
+	intercept := w.UnaryInterceptor()
+	handler := func(ctx context.Context, req any) (any, error) { return "ok", nil }
+	_, err := intercept(context.Background(), &pb.CreateRequest{Namespace: "test", CollectionName: "docs"},
+		&grpc.UnaryServerInfo{FullMethod: "/collector.CollectionService/Create"}, handler)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected Create to be refused with ResourceExhausted, got %v", err)
+	}
+	if _, err := intercept(context.Background(), &pb.DeleteRequest{Namespace: "test", CollectionName: "docs"},
+		&grpc.UnaryServerInfo{FullMethod: "/collector.CollectionService/Delete"}, handler); err != nil {
+		t.Errorf("expected Delete to be allowed, got %v", err)
+	}
+
+	// Jobs wait until space is freed, or give up with their context
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := w.WaitForSpace(ctx, dir); err != context.DeadlineExceeded {
+		t.Errorf("expected WaitForSpace to wait out the context, got %v", err)
+	}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		free.Store(10 << 30)
+	}()
+	if err := w.WaitForSpace(context.Background(), dir); err != nil {
+		t.Errorf("expected WaitForSpace to resume, got %v", err)
+	}
+	if _, err := intercept(context.Background(), &pb.CreateRequest{Namespace: "test", CollectionName: "docs"},
+		&grpc.UnaryServerInfo{FullMethod: "/collector.CollectionService/Create"}, handler); err != nil {
+		t.Errorf("expected Create to be allowed once space is freed, got %v", err)
+	}
+}
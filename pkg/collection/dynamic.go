@@ -0,0 +1,134 @@
+package collection
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// typeURLPrefix prefixes the type URLs of Get responses for collections whose
+// message type resolves, as anypb.New does.
+const typeURLPrefix = "type.googleapis.com/"
+
+// recordJSON encodes decoded items for storage. Proto field names keep
+// indexed fields and filters the same as in the .proto file.
+var recordJSON = protojson.MarshalOptions{UseProtoNames: true}
+
+// typeNamespace is the namespace a collection's message type is registered
+// in: the one its message type names, or the collection's own.
+func typeNamespace(coll *Collection) string {
+	if ns := coll.Meta.MessageType.GetNamespace(); ns != "" {
+		return ns
+	}
+	return coll.Meta.Namespace
+}
+
+// decodeItem returns the data to store for an item. With a descriptor
+// resolver set, an item whose type URL names a resolvable message is
+// decoded with dynamicpb and stored as JSON, so the store can index and
+// search its fields; the message must be the collection's message type if
+// it has one. Other items are stored as sent, once they conform.
+func (s *CollectionServer) decodeItem(ctx context.Context, coll *Collection, item *anypb.Any) ([]byte, error) {
+	typeURL := item.GetTypeUrl()
+	if s.descriptors == nil || typeURL == "" {
+		return s.conform(ctx, coll, item.GetValue())
+	}
+	name := typeURL[strings.LastIndex(typeURL, "/")+1:]
+	md, err := s.descriptors.ResolveMessage(ctx, typeNamespace(coll), name)
+	if status.Code(err) == codes.NotFound {
+		return s.conform(ctx, coll, item.GetValue())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to resolve item type %s: %v", name, err)
+	}
+	if declared := s.messageType(ctx, coll); declared != nil && declared.FullName() != md.FullName() {
+		return nil, invalidRecord(codes.InvalidArgument, "item.type_url", ViolationType, nil,
+			"item is a %s, but %s/%s holds %s", md.FullName(), coll.Meta.Namespace, coll.Meta.Name, declared.FullName())
+	}
+
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(item.GetValue(), msg); err != nil {
+		return nil, invalidRecord(codes.InvalidArgument, "item.value", ViolationType, nil, "item is not a valid %s: %v", md.FullName(), err)
+	}
+	data, err := recordJSON.Marshal(msg)
+	if err != nil {
+		return nil, invalidRecord(codes.InvalidArgument, "item.value", ViolationType, nil, "item %s cannot be stored as JSON: %v", md.FullName(), err)
+	}
+	return data, nil
+}
+
+// SetEnforceMessageTypes makes writes to every collection with a message
+// type conform to it, as if each set enforce_message_type.
+func (s *CollectionServer) SetEnforceMessageTypes(enforce bool) {
+	s.enforceTypes = enforce
+}
+
+// conform checks data about to be stored as sent against its collection's
+// message type, when that is enforced. JSON must be a valid message, and is
+// stored as decoded items are; binary data must decode as one without
+// unknown fields, and is stored as JSON.
+func (s *CollectionServer) conform(ctx context.Context, coll *Collection, data []byte) ([]byte, error) {
+	typeName := coll.Meta.MessageType.GetMessageName()
+	if typeName == "" || !(s.enforceTypes || coll.Meta.EnforceMessageType) {
+		return data, nil
+	}
+	if s.descriptors == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s/%s enforces message type %s, but no descriptor resolver is set", coll.Meta.Namespace, coll.Meta.Name, typeName)
+	}
+	md, err := s.descriptors.ResolveMessage(ctx, typeNamespace(coll), typeName)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s/%s enforces message type %s, which cannot be resolved: %v", coll.Meta.Namespace, coll.Meta.Name, typeName, err)
+	}
+
+	msg := dynamicpb.NewMessage(md)
+	if json.Valid(data) {
+		if err := protojson.Unmarshal(data, msg); err != nil {
+			return nil, invalidRecord(codes.InvalidArgument, "item.value", ViolationType, data, "item is not a valid %s: %v", md.FullName(), err)
+		}
+	} else if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, invalidRecord(codes.InvalidArgument, "item.value", ViolationType, nil, "item is not a valid %s: %v", md.FullName(), err)
+	} else if len(msg.GetUnknown()) > 0 {
+		return nil, invalidRecord(codes.InvalidArgument, "item.value", ViolationType, nil, "item has fields %s does not define", md.FullName())
+	}
+	stored, err := recordJSON.Marshal(msg)
+	if err != nil {
+		return nil, invalidRecord(codes.InvalidArgument, "item.value", ViolationType, nil, "item %s cannot be stored as JSON: %v", md.FullName(), err)
+	}
+	return stored, nil
+}
+
+// encodeItem returns a record's data as an Any. With md, the collection's
+// resolved message type, data that decodes as one is encoded as that
+// message; other data is returned as stored.
+func encodeItem(coll *Collection, md protoreflect.MessageDescriptor, data []byte) *anypb.Any {
+	if md != nil {
+		msg := dynamicpb.NewMessage(md)
+		if protojson.Unmarshal(data, msg) == nil {
+			if value, err := proto.Marshal(msg); err == nil {
+				return &anypb.Any{TypeUrl: typeURLPrefix + string(md.FullName()), Value: value}
+			}
+		}
+	}
+	return &anypb.Any{TypeUrl: buildTypeUrl(coll), Value: data}
+}
+
+// messageType resolves a collection's message type, or returns nil when it
+// has none or it cannot be resolved.
+func (s *CollectionServer) messageType(ctx context.Context, coll *Collection) protoreflect.MessageDescriptor {
+	if s.descriptors == nil || coll.Meta.MessageType.GetMessageName() == "" {
+		return nil
+	}
+	md, err := s.descriptors.ResolveMessage(ctx, typeNamespace(coll), coll.Meta.MessageType.MessageName)
+	if err != nil {
+		return nil
+	}
+	return md
+}
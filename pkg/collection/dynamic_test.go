@@ -0,0 +1,223 @@
+package collection_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// typesResolver resolves the messages of one file by full name.
+type typesResolver struct {
+	file protoreflect.FileDescriptor
+}
+
+func (r typesResolver) ResolveMessage(ctx context.Context, namespace, messageName string) (protoreflect.MessageDescriptor, error) {
+	if md := r.file.Messages().ByName(protoreflect.Name(strings.TrimPrefix(messageName, "shop."))); md != nil && namespace == "shop" {
+		return md, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "message %s is not registered", messageName)
+}
+
+func shopTypes(t *testing.T) typesResolver {
+	t.Helper()
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name: proto.String(name), Number: proto.Int32(number),
+			Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: typ.Enum(),
+		}
+	}
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("shop.proto"),
+		Package: proto.String("shop"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Order"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("customer_name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("total_cents", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+			}},
+			{Name: proto.String("Refund"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("reason", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build descriptor: %v", err)
+	}
+	return typesResolver{file: fd}
+}
+
+// packOrder encodes an Order as anypb.New would.
+func packOrder(t *testing.T, types typesResolver, customer string, cents int32) *anypb.Any {
+	t.Helper()
+	md := types.file.Messages().ByName("Order")
+	msg := dynamicpb.NewMessage(md)
+	msg.Set(md.Fields().ByName("customer_name"), protoreflect.ValueOfString(customer))
+	msg.Set(md.Fields().ByName("total_cents"), protoreflect.ValueOfInt32(cents))
+	item, err := anypb.New(msg)
+	if err != nil {
+		t.Fatalf("failed to pack order: %v", err)
+	}
+	return item
+}
+
+// sameItem reports whether two packed messages have the same type and
+// contents, whatever the order their fields were encoded in.
+func sameItem(types typesResolver, a, b *anypb.Any) bool {
+	if a.GetTypeUrl() != b.GetTypeUrl() {
+		return false
+	}
+	md, err := types.ResolveMessage(context.Background(), "shop", a.TypeUrl[strings.LastIndex(a.TypeUrl, "/")+1:])
+	if err != nil {
+		return false
+	}
+	am, bm := dynamicpb.NewMessage(md), dynamicpb.NewMessage(md)
+	return proto.Unmarshal(a.Value, am) == nil && proto.Unmarshal(b.Value, bm) == nil && proto.Equal(am, bm)
+}
+
+func TestCollectionServer_DecodesTypedItems(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	types := shopTypes(t)
+	server := collection.NewCollectionServer(repo)
+	server.SetDescriptorResolver(types)
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{
+		Namespace: "shop", Name: "orders",
+		MessageType: &pb.MessageTypeRef{MessageName: "shop.Order"},
+	}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	for id, cents := range map[string]int32{"o1": 1250, "o2": 99} {
+		if _, err := server.Create(ctx, &pb.CreateRequest{Namespace: "shop", CollectionName: "orders", Id: id, Item: packOrder(t, types, "Ada Lovelace", cents)}); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+
+	// Decoded fields are searchable by their proto names, and as text
+	resp, err := server.Search(ctx, &pb.SearchRequest{
+		Namespace: "shop", CollectionName: "orders",
+		Filters: map[string]*pb.Filter{"total_cents": {Operator: pb.FilterOperator_OP_GREATER_THAN, Value: structpb.NewNumberValue(1000)}},
+	})
+	if err != nil || len(resp.Results) != 1 || !sameItem(types, resp.Results[0].Item, packOrder(t, types, "Ada Lovelace", 1250)) {
+		t.Fatalf("expected o1 to match total_cents > 1000, got %v %v", resp, err)
+	}
+	if resp, _ := server.Search(ctx, &pb.SearchRequest{Namespace: "shop", CollectionName: "orders", FullText: "Lovelace"}); len(resp.Results) != 2 {
+		t.Errorf("expected full-text search to find both orders, got %v", resp)
+	}
+
+	// Get returns the message as it was sent
+	get, err := server.Get(ctx, &pb.GetRequest{Namespace: "shop", CollectionName: "orders", Id: "o2"})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	want := packOrder(t, types, "Ada Lovelace", 99)
+	if !sameItem(types, get.Item, want) {
+		t.Errorf("expected %v back, got %v", want, get.Item)
+	}
+
+	// Updates are decoded too, and items of another type are refused
+	if _, err := server.Update(ctx, &pb.UpdateRequest{Namespace: "shop", CollectionName: "orders", Id: "o2", Item: packOrder(t, types, "Grace Hopper", 100)}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if resp, _ := server.Search(ctx, &pb.SearchRequest{Namespace: "shop", CollectionName: "orders", FullText: "Hopper"}); len(resp.Results) != 1 {
+		t.Errorf("expected the update indexed, got %v", resp)
+	}
+	refund, _ := anypb.New(dynamicpb.NewMessage(types.file.Messages().ByName("Refund")))
+	if _, err := server.Create(ctx, &pb.CreateRequest{Namespace: "shop", CollectionName: "orders", Item: refund}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected a Refund refused by an Order collection, got %v", err)
+	}
+	bad := &anypb.Any{TypeUrl: want.TypeUrl, Value: []byte{0xff}}
+	if _, err := server.Create(ctx, &pb.CreateRequest{Namespace: "shop", CollectionName: "orders", Item: bad}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected an undecodable item refused, got %v", err)
+	}
+
+	// Items of unregistered types are stored as sent
+	if _, err := server.Create(ctx, &pb.CreateRequest{Namespace: "shop", CollectionName: "orders", Id: "raw", Item: &anypb.Any{TypeUrl: "test.Item", Value: []byte(`{"note": "hand written"}`)}}); err != nil {
+		t.Fatalf("Create of an untyped item failed: %v", err)
+	}
+	if get, _ := server.Get(ctx, &pb.GetRequest{Namespace: "shop", CollectionName: "orders", Id: "raw"}); string(get.Item.Value) != `{"note": "hand written"}` {
+		t.Errorf("expected the untyped item returned as stored, got %s", get.Item.Value)
+	}
+}
+
+func TestCollectionServer_EnforcesMessageTypes(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	types := shopTypes(t)
+	server := collection.NewCollectionServer(repo)
+	server.SetDescriptorResolver(types)
+	for name, enforce := range map[string]bool{"orders": true, "drafts": false} {
+		if _, err := repo.CreateCollection(ctx, &pb.Collection{
+			Namespace: "shop", Name: name,
+			MessageType:        &pb.MessageTypeRef{MessageName: "shop.Order"},
+			EnforceMessageType: enforce,
+		}); err != nil {
+			t.Fatalf("failed to create collection: %v", err)
+		}
+	}
+	create := func(name, id string, value []byte) error {
+		_, err := server.Create(ctx, &pb.CreateRequest{Namespace: "shop", CollectionName: name, Id: id, Item: &anypb.Any{TypeUrl: "test.Item", Value: value}})
+		return err
+	}
+
+	// Conforming items are stored as JSON, whether sent as JSON or binary
+	if err := create("orders", "o1", []byte(`{"customerName": "Ada Lovelace", "total_cents": 1250}`)); err != nil {
+		t.Fatalf("Create of a conforming item failed: %v", err)
+	}
+	if err := create("orders", "o2", packOrder(t, types, "Grace Hopper", 99).Value); err != nil {
+		t.Fatalf("Create of a conforming binary item failed: %v", err)
+	}
+	resp, err := server.Search(ctx, &pb.SearchRequest{
+		Namespace: "shop", CollectionName: "orders",
+		Filters: map[string]*pb.Filter{"customer_name": {Operator: pb.FilterOperator_OP_EQUALS, Value: structpb.NewStringValue("Grace Hopper")}},
+	})
+	if err != nil || len(resp.Results) != 1 || !sameItem(types, resp.Results[0].Item, packOrder(t, types, "Grace Hopper", 99)) {
+		t.Errorf("expected the binary item stored as searchable JSON, got %v %v", resp, err)
+	}
+
+	// Others are refused, where the collection enforces its type
+	for name, value := range map[string][]byte{
+		"unknown field": []byte(`{"customer_name": "x", "discount": 5}`),
+		"wrong type":    []byte(`{"total_cents": "lots"}`),
+		"not a message": []byte(`[1, 2]`),
+		"binary":        {0xff},
+		"extra fields":  append(packOrder(t, types, "x", 1).Value, 0x18, 0x01),
+	} {
+		if err := create("orders", "", value); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", name, err)
+		}
+	}
+	if err := create("drafts", "d1", []byte(`{"discount": 5}`)); err != nil {
+		t.Errorf("expected a collection not enforcing its type to store anything, got %v", err)
+	}
+
+	// A server can enforce every collection's type
+	server.SetEnforceMessageTypes(true)
+	if err := create("drafts", "", []byte(`{"discount": 5}`)); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected the server to enforce drafts' type, got %v", err)
+	}
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "shop", Name: "unknown", MessageType: &pb.MessageTypeRef{MessageName: "shop.Unknown"}}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	if err := create("unknown", "", []byte(`{}`)); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected an unresolvable type to fail, got %v", err)
+	}
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "shop", Name: "untyped", EnforceMessageType: true}); err == nil {
+		t.Errorf("expected a collection enforcing no type refused")
+	}
+}
@@ -0,0 +1,288 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// Labels of the records holding stream events.
+const (
+	EventStreamLabel   = "stream"
+	EventSequenceLabel = "sequence"
+	EventTypeLabel     = "type"
+)
+
+// AnySequence appends an event whatever the stream's last sequence is.
+const AnySequence int64 = -1
+
+// defaultStreamReadLimit is how many events ReadStream returns by default.
+const defaultStreamReadLimit = 100
+
+var (
+	// ErrNotWriteOnce is returned for event streams in collections that are
+	// not write-once, whose events could be changed or removed.
+	ErrNotWriteOnce = errors.New("event streams need a write-once collection")
+	// ErrSequenceConflict is returned when an append expected a stream's last
+	// sequence and another event was appended first.
+	ErrSequenceConflict = errors.New("stream's last sequence is not the one expected")
+)
+
+// EventStreams turns write-once collections into event stores. Every stream
+// key has its own sequence, numbered from 1 with no gaps, so the event with
+// a sequence is found by its record id and the last one by probing. Appends
+// to a stream are serialized; the last sequence of each stream appended to
+// or read is remembered.
+type EventStreams struct {
+	mu    sync.Mutex
+	heads map[string]*streamHead
+}
+
+// streamHead is the last sequence of a stream, as found in a store.
+type streamHead struct {
+	mu       sync.Mutex
+	store    Store // The store sequence was found in; nil until probed
+	sequence uint64
+}
+
+// NewEventStreams creates an EventStreams.
+func NewEventStreams() *EventStreams {
+	return &EventStreams{heads: make(map[string]*streamHead)}
+}
+
+// eventID is the record id of a stream's event.
+func eventID(stream string, sequence uint64) string {
+	return stream + "@" + strconv.FormatUint(sequence, 10)
+}
+
+// Append appends an event to a stream of a write-once collection. expected
+// is the sequence the stream's last event must have, 0 for a stream without
+// events, or AnySequence; otherwise the append fails with
+// ErrSequenceConflict.
+func (e *EventStreams) Append(ctx context.Context, coll *Collection, stream, eventType string, data []byte, expected int64) (*pb.StreamEvent, error) {
+	head, err := e.lock(ctx, coll, stream)
+	if err != nil {
+		return nil, err
+	}
+	defer head.mu.Unlock()
+	if expected != AnySequence && uint64(expected) != head.sequence {
+		return nil, fmt.Errorf("%w: expected %d, stream %s is at %d", ErrSequenceConflict, expected, stream, head.sequence)
+	}
+
+	sequence := head.sequence + 1
+	record := &pb.CollectionRecord{
+		Id:        eventID(stream, sequence),
+		ProtoData: data,
+		Metadata: &pb.Metadata{Labels: map[string]string{
+			EventStreamLabel:   stream,
+			EventSequenceLabel: strconv.FormatUint(sequence, 10),
+			EventTypeLabel:     eventType,
+		}},
+	}
+	if err := coll.CreateRecord(ctx, record); err != nil {
+		if errors.Is(err, ErrRecordExists) {
+			// Appended to elsewhere; probe again next time
+			head.store = nil
+			return nil, fmt.Errorf("%w: stream %s was appended to concurrently", ErrSequenceConflict, stream)
+		}
+		return nil, err
+	}
+	head.sequence = sequence
+	return streamEvent(record), nil
+}
+
+// Read returns up to limit events of a stream in sequence order, starting
+// at from (1 when 0), and the stream's last sequence.
+func (e *EventStreams) Read(ctx context.Context, coll *Collection, stream string, from uint64, limit int) ([]*pb.StreamEvent, uint64, error) {
+	head, err := e.lock(ctx, coll, stream)
+	if err != nil {
+		return nil, 0, err
+	}
+	last := head.sequence
+	head.mu.Unlock()
+
+	if from == 0 {
+		from = 1
+	}
+	if limit <= 0 {
+		limit = defaultStreamReadLimit
+	}
+	var events []*pb.StreamEvent
+	for seq := from; seq <= last && len(events) < limit; seq++ {
+		record, err := coll.GetRecord(ctx, eventID(stream, seq))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read event %d of stream %s: %w", seq, stream, err)
+		}
+		events = append(events, streamEvent(record))
+	}
+	return events, last, nil
+}
+
+// Fold replays a stream's events from sequence from (1 when 0) through fn,
+// in order, and returns the sequence of the last event folded, or from-1 if
+// there were none. Applications rebuild their state from a snapshot by
+// folding the events after it.
+func (e *EventStreams) Fold(ctx context.Context, coll *Collection, stream string, from uint64, fn func(*pb.StreamEvent) error) (uint64, error) {
+	if from == 0 {
+		from = 1
+	}
+	folded := from - 1
+	for {
+		events, last, err := e.Read(ctx, coll, stream, folded+1, defaultStreamReadLimit)
+		if err != nil {
+			return folded, err
+		}
+		for _, event := range events {
+			if err := fn(event); err != nil {
+				return folded, err
+			}
+			folded = event.Sequence
+		}
+		if len(events) == 0 || folded >= last {
+			return folded, nil
+		}
+	}
+}
+
+// lock returns a stream's head, locked and probed in the collection's
+// current store.
+func (e *EventStreams) lock(ctx context.Context, coll *Collection, stream string) (*streamHead, error) {
+	if !coll.writeOnce() {
+		return nil, fmt.Errorf("%w: %s/%s", ErrNotWriteOnce, coll.Meta.Namespace, coll.Meta.Name)
+	}
+	if stream == "" {
+		return nil, fmt.Errorf("stream is required")
+	}
+	key := coll.Meta.Namespace + "/" + coll.Meta.Name + "/" + stream
+	e.mu.Lock()
+	head, ok := e.heads[key]
+	if !ok {
+		head = &streamHead{}
+		e.heads[key] = head
+	}
+	e.mu.Unlock()
+
+	head.mu.Lock()
+	if head.store != coll.Store {
+		sequence, err := lastSequence(ctx, coll, stream)
+		if err != nil {
+			head.mu.Unlock()
+			return nil, err
+		}
+		head.store, head.sequence = coll.Store, sequence
+	}
+	return head, nil
+}
+
+// lastSequence finds a stream's last sequence by doubling past it and then
+// bisecting, which its gapless sequence allows.
+func lastSequence(ctx context.Context, coll *Collection, stream string) (uint64, error) {
+	exists := func(sequence uint64) (bool, error) {
+		return coll.Exists(ctx, eventID(stream, sequence))
+	}
+	var lo, hi uint64 = 0, 1 // Event lo exists (or lo is 0); hi is the next to try
+	for {
+		ok, err := exists(hi)
+		if err != nil {
+			return 0, fmt.Errorf("failed to find the end of stream %s: %w", stream, err)
+		}
+		if !ok {
+			break
+		}
+		lo, hi = hi, hi*2
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		ok, err := exists(mid)
+		if err != nil {
+			return 0, fmt.Errorf("failed to find the end of stream %s: %w", stream, err)
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// streamEvent converts an event's record.
+func streamEvent(record *pb.CollectionRecord) *pb.StreamEvent {
+	labels := record.GetMetadata().GetLabels()
+	sequence, _ := strconv.ParseUint(labels[EventSequenceLabel], 10, 64)
+	return &pb.StreamEvent{
+		Stream:    labels[EventStreamLabel],
+		Sequence:  sequence,
+		Type:      labels[EventTypeLabel],
+		Data:      record.ProtoData,
+		CreatedAt: record.GetMetadata().GetCreatedAt(),
+	}
+}
+
+// AppendEvent appends an event to a stream of a write-once collection.
+func (s *GrpcServer) AppendEvent(ctx context.Context, req *pb.AppendEventRequest) (*pb.AppendEventResponse, error) {
+	if req.Collection == nil || req.Collection.Namespace == "" || req.Collection.Name == "" || req.Stream == "" {
+		return &pb.AppendEventResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection namespace, name and stream are required"},
+		}, nil
+	}
+	coll, err := s.repo.GetCollection(ctx, req.Collection.Namespace, req.Collection.Name)
+	if err != nil {
+		return &pb.AppendEventResponse{Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: err.Error()}}, nil
+	}
+	expected := AnySequence
+	switch {
+	case req.NewStream:
+		expected = 0
+	case req.ExpectedSequence > 0:
+		expected = int64(req.ExpectedSequence)
+	}
+	event, err := s.events.Append(ctx, coll, req.Stream, req.Type, req.Data, expected)
+	if err != nil {
+		return &pb.AppendEventResponse{Status: eventErrorStatus(err)}, nil
+	}
+	return &pb.AppendEventResponse{Status: &pb.Status{Code: pb.Status_OK}, Event: event}, nil
+}
+
+// ReadStream returns a stream's events in sequence order.
+func (s *GrpcServer) ReadStream(ctx context.Context, req *pb.ReadStreamRequest) (*pb.ReadStreamResponse, error) {
+	if req.Collection == nil || req.Collection.Namespace == "" || req.Collection.Name == "" || req.Stream == "" {
+		return &pb.ReadStreamResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection namespace, name and stream are required"},
+		}, nil
+	}
+	coll, err := s.repo.GetCollection(ctx, req.Collection.Namespace, req.Collection.Name)
+	if err != nil {
+		return &pb.ReadStreamResponse{Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: err.Error()}}, nil
+	}
+	events, last, err := s.events.Read(ctx, coll, req.Stream, req.FromSequence, int(req.Limit))
+	if err != nil {
+		return &pb.ReadStreamResponse{Status: eventErrorStatus(err)}, nil
+	}
+	return &pb.ReadStreamResponse{Status: &pb.Status{Code: pb.Status_OK}, Events: events, LastSequence: last}, nil
+}
+
+// Events returns the server's event streams.
+func (s *GrpcServer) Events() *EventStreams {
+	return s.events
+}
+
+// eventErrorStatus converts an event stream error to a Status.
+func eventErrorStatus(err error) *pb.Status {
+	code := pb.Status_INTERNAL
+	switch {
+	case errors.Is(err, ErrNotWriteOnce):
+		code = pb.Status_FAILED_PRECONDITION
+	case errors.Is(err, ErrSequenceConflict):
+		code = pb.Status_ABORTED
+	}
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		code = pb.Status_INVALID_ARGUMENT
+	}
+	return &pb.Status{Code: code, Message: err.Error()}
+}
@@ -0,0 +1,88 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+)
+
+func TestEventStreams(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	layout := collection.NewPathLayout(filepath.Join(t.TempDir(), "data"))
+	repo.SetPathLayout(layout)
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+	server := collection.NewGrpcServerWithLayout(repo, layout)
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "shop", Name: "events", StoreOptions: &pb.StoreOptions{WriteOnce: true}}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "shop", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	events := &pb.NamespacedName{Namespace: "shop", Name: "events"}
+
+	// Sequences are per stream, from 1
+	for i := 1; i <= 3; i++ {
+		resp, _ := server.AppendEvent(ctx, &pb.AppendEventRequest{
+			Collection: events, Stream: "cart-1", Type: "item_added", Data: []byte(fmt.Sprintf(`{"qty": %d}`, i)),
+		})
+		if resp.Status.Code != pb.Status_OK || resp.Event.Sequence != uint64(i) {
+			t.Fatalf("AppendEvent %d failed: %v %v", i, resp.Status, resp.Event)
+		}
+	}
+	resp, _ := server.AppendEvent(ctx, &pb.AppendEventRequest{Collection: events, Stream: "cart-2", Type: "opened", NewStream: true})
+	if resp.Status.Code != pb.Status_OK || resp.Event.Sequence != 1 {
+		t.Fatalf("expected cart-2 to start at 1, got %v %v", resp.Status, resp.Event)
+	}
+
+	// Appends expecting a stale sequence are aborted
+	resp, _ = server.AppendEvent(ctx, &pb.AppendEventRequest{Collection: events, Stream: "cart-1", Type: "checked_out", ExpectedSequence: 2})
+	if resp.Status.Code != pb.Status_ABORTED {
+		t.Errorf("expected ABORTED for a stale sequence, got %v", resp.Status)
+	}
+	resp, _ = server.AppendEvent(ctx, &pb.AppendEventRequest{Collection: events, Stream: "cart-1", Type: "opened", NewStream: true})
+	if resp.Status.Code != pb.Status_ABORTED {
+		t.Errorf("expected ABORTED for new_stream on an existing stream, got %v", resp.Status)
+	}
+	resp, _ = server.AppendEvent(ctx, &pb.AppendEventRequest{Collection: events, Stream: "cart-1", Type: "checked_out", ExpectedSequence: 3})
+	if resp.Status.Code != pb.Status_OK || resp.Event.Sequence != 4 {
+		t.Fatalf("expected sequence 4, got %v %v", resp.Status, resp.Event)
+	}
+
+	read, _ := server.ReadStream(ctx, &pb.ReadStreamRequest{Collection: events, Stream: "cart-1", FromSequence: 2, Limit: 2})
+	if read.Status.Code != pb.Status_OK || read.LastSequence != 4 || len(read.Events) != 2 {
+		t.Fatalf("expected events 2 and 3 of 4, got %v", read)
+	}
+	if read.Events[0].Sequence != 2 || read.Events[1].Sequence != 3 || string(read.Events[1].Data) != `{"qty": 3}` || read.Events[1].Type != "item_added" {
+		t.Errorf("unexpected events %v", read.Events)
+	}
+
+	// A fresh EventStreams finds where the streams end and folds them
+	streams := collection.NewEventStreams()
+	coll, _ := repo.GetCollection(ctx, "shop", "events")
+	var types []string
+	last, err := streams.Fold(ctx, coll, "cart-1", 0, func(e *pb.StreamEvent) error {
+		types = append(types, e.Type)
+		return nil
+	})
+	if err != nil || last != 4 || fmt.Sprint(types) != "[item_added item_added item_added checked_out]" {
+		t.Errorf("expected four events folded, got %v %d %v", types, last, err)
+	}
+	if event, err := streams.Append(ctx, coll, "cart-2", "closed", []byte(`{}`), 1); err != nil || event.Sequence != 2 {
+		t.Errorf("expected cart-2's next sequence found, got %v %v", event, err)
+	}
+
+	// Only write-once collections hold streams
+	resp, _ = server.AppendEvent(ctx, &pb.AppendEventRequest{Collection: &pb.NamespacedName{Namespace: "shop", Name: "docs"}, Stream: "cart-1"})
+	if resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION for a collection that is not write-once, got %v", resp.Status)
+	}
+}
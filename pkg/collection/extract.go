@@ -0,0 +1,99 @@
+package collection
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// TextExtractor pulls searchable text out of file content. Extracted text is
+// added to the owning record's full-text index.
+type TextExtractor interface {
+	ExtractText(ctx context.Context, content []byte) (string, error)
+}
+
+// TextExtractorFunc adapts a function to TextExtractor.
+type TextExtractorFunc func(ctx context.Context, content []byte) (string, error)
+
+func (f TextExtractorFunc) ExtractText(ctx context.Context, content []byte) (string, error) {
+	return f(ctx, content)
+}
+
+// TextExtractors maps media types to extractors. Keys are exact media types
+// ("application/pdf") or major-type wildcards ("text/*").
+type TextExtractors map[string]TextExtractor
+
+// DefaultTextExtractors handles plain text and JSON. Formats such as PDF need
+// an extractor registered for their media type.
+func DefaultTextExtractors() TextExtractors {
+	return TextExtractors{
+		"text/*":           TextExtractorFunc(extractPlainText),
+		"application/json": TextExtractorFunc(extractJSONText),
+	}
+}
+
+// For returns the extractor for contentType, or nil if there is none.
+func (m TextExtractors) For(contentType string) TextExtractor {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	if e, ok := m[mediaType]; ok {
+		return e
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	return m[major+"/*"]
+}
+
+func extractPlainText(ctx context.Context, content []byte) (string, error) {
+	if !utf8.Valid(content) {
+		return "", fmt.Errorf("content is not valid UTF-8")
+	}
+	return string(content), nil
+}
+
+// extractJSONText returns the string values of a JSON document, so keys and
+// punctuation are not indexed.
+func extractJSONText(ctx context.Context, content []byte) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(content, &v); err != nil {
+		return "", err
+	}
+	var parts []string
+	var walk func(interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case string:
+			parts = append(parts, t)
+		case []interface{}:
+			for _, e := range t {
+				walk(e)
+			}
+		case map[string]interface{}:
+			for _, e := range t {
+				walk(e)
+			}
+		}
+	}
+	walk(v)
+	return strings.Join(parts, " "), nil
+}
+
+// DetectContentType sniffs content's media type, preferring the type implied
+// by name's extension when sniffing can only tell it is generic text or
+// binary (e.g. JSON, CSV, or Markdown files).
+func DetectContentType(name string, content []byte) string {
+	sniffed := http.DetectContentType(content)
+	if sniffed != "application/octet-stream" && !strings.HasPrefix(sniffed, "text/plain") {
+		return sniffed
+	}
+	if byExt := mime.TypeByExtension(path.Ext(name)); byExt != "" {
+		return byExt
+	}
+	return sniffed
+}
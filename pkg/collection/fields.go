@@ -0,0 +1,367 @@
+package collection
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrNotCounter is returned when incrementing a field that is not
+	// declared as a FIELD_COUNTER or FIELD_G_COUNTER managed field.
+	ErrNotCounter = errors.New("field is not a counter")
+	// ErrNegativeIncrement is returned when decrementing a G-counter, which
+	// can only grow.
+	ErrNegativeIncrement = errors.New("G-counters cannot be decremented")
+	// ErrFieldValue is returned when a record or managed field does not hold
+	// a value of the field's kind, e.g. a counter holding a string.
+	ErrFieldValue = errors.New("record does not hold a valid value for the field")
+)
+
+// FieldManager maintains the managed fields of collections (see
+// pb.ManagedField): it merges writes into them instead of letting writes
+// overwrite them, and serializes the read-merge-write of each record so that
+// increments and merges are atomic within this collector. Its node ID names
+// this collector's entries in G-counters and registers and must differ
+// between collectors that replicate the same collections.
+type FieldManager struct {
+	node  string
+	locks [64]sync.Mutex // striped by collection and record ID
+}
+
+// NewFieldManager creates a FieldManager for the collector named node.
+func NewFieldManager(node string) *FieldManager {
+	return &FieldManager{node: node}
+}
+
+// Node returns the manager's node ID.
+func (m *FieldManager) Node() string {
+	return m.node
+}
+
+// defaultFieldNode names this collector by its hostname.
+func defaultFieldNode() string {
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return "local"
+}
+
+func (m *FieldManager) lock(c *Collection, id string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(c.Meta.Namespace + "/" + c.Meta.Name + "/" + id))
+	mu := &m.locks[h.Sum32()%uint32(len(m.locks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// managesFields reports whether writes to c go through its FieldManager.
+func (c *Collection) managesFields() bool {
+	return c.Fields != nil && len(c.Meta.GetManagedFields()) > 0
+}
+
+func (c *Collection) managedField(path string) *pb.ManagedField {
+	for _, f := range c.Meta.GetManagedFields() {
+		if f.Path == path {
+			return f
+		}
+	}
+	return nil
+}
+
+// mergeFields merges the managed fields of stored, which is nil for new
+// records, into incoming. Records that are not JSON objects are left alone.
+func (m *FieldManager) mergeFields(fields []*pb.ManagedField, stored, incoming []byte) ([]byte, error) {
+	in, ok := decodeObject(incoming)
+	if !ok {
+		return incoming, nil
+	}
+	var prev map[string]any
+	if stored != nil {
+		prev, _ = decodeObject(stored)
+	}
+
+	now := time.Now()
+	for _, f := range fields {
+		sv, sok := lookupPath(prev, f.Path)
+		iv, iok := lookupPath(in, f.Path)
+		switch f.Kind {
+		case pb.FieldKind_FIELD_COUNTER:
+			if sok {
+				setPath(in, f.Path, sv)
+			}
+		case pb.FieldKind_FIELD_G_COUNTER:
+			if !sok && !iok {
+				continue
+			}
+			merged := map[string]any{}
+			mergeGCounter(merged, sv)
+			if n, ok := fieldInt(iv); ok && prev == nil {
+				// A bare number on a new record is this node's count
+				merged[m.node] = json.Number(fmt.Sprint(n))
+			} else {
+				mergeGCounter(merged, iv)
+			}
+			setPath(in, f.Path, merged)
+		case pb.FieldKind_FIELD_LWW_REGISTER:
+			if !iok {
+				if sok {
+					setPath(in, f.Path, sv)
+				}
+				continue
+			}
+			current, _ := asRegister(sv)
+			written, ok := asRegister(iv)
+			if !ok {
+				if current != nil && reflect.DeepEqual(current["value"], iv) {
+					setPath(in, f.Path, sv)
+					continue
+				}
+				written = map[string]any{"value": iv, "ts": json.Number(fmt.Sprint(now.UnixNano())), "node": m.node}
+			}
+			if current != nil && !registerNewer(written, current) {
+				written = current
+			}
+			setPath(in, f.Path, written)
+		}
+	}
+	return json.Marshal(in)
+}
+
+// overlayFields copies the managed fields present in change over the fields
+// of stored, for merging a replica's state without taking its other fields.
+func overlayFields(fields []*pb.ManagedField, stored, change []byte) ([]byte, error) {
+	out, ok := decodeObject(stored)
+	if !ok {
+		return nil, fmt.Errorf("%w: stored record is not a JSON object", ErrFieldValue)
+	}
+	in, ok := decodeObject(change)
+	if !ok {
+		return nil, fmt.Errorf("%w: change is not a JSON object", ErrFieldValue)
+	}
+	for _, f := range fields {
+		if v, ok := lookupPath(in, f.Path); ok {
+			setPath(out, f.Path, v)
+		}
+	}
+	return json.Marshal(out)
+}
+
+// Increment atomically adds delta to a counter field of record id and returns
+// the field's new value. With upsert, a missing record is created holding
+// just the counter. G-counters add delta to this collector's entry.
+func (c *Collection) Increment(ctx context.Context, id, path string, delta int64, upsert bool) (int64, error) {
+	field := c.managedField(path)
+	if field == nil || (field.Kind != pb.FieldKind_FIELD_COUNTER && field.Kind != pb.FieldKind_FIELD_G_COUNTER) {
+		return 0, fmt.Errorf("%w: %s", ErrNotCounter, path)
+	}
+	if field.Kind == pb.FieldKind_FIELD_G_COUNTER && delta < 0 {
+		return 0, ErrNegativeIncrement
+	}
+	if c.Fields == nil {
+		return 0, fmt.Errorf("managed fields are not enabled for this collection")
+	}
+	defer c.Fields.lock(c, id)()
+
+	stored, err := c.Store.GetRecord(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) && upsert {
+		stored = nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	obj := map[string]any{}
+	if stored != nil {
+		var ok bool
+		if obj, ok = decodeObject(stored.ProtoData); !ok {
+			return 0, fmt.Errorf("%w: record %s is not a JSON object", ErrFieldValue, id)
+		}
+	}
+	current, _ := lookupPath(obj, path)
+
+	var value int64
+	switch field.Kind {
+	case pb.FieldKind_FIELD_COUNTER:
+		n, ok := fieldInt(current)
+		if current != nil && !ok {
+			return 0, fmt.Errorf("%w: %s is not an integer", ErrFieldValue, path)
+		}
+		value = n + delta
+		setPath(obj, path, json.Number(fmt.Sprint(value)))
+	case pb.FieldKind_FIELD_G_COUNTER:
+		counts := map[string]any{}
+		mergeGCounter(counts, current)
+		n, _ := fieldInt(counts[c.Fields.node])
+		counts[c.Fields.node] = json.Number(fmt.Sprint(n + delta))
+		value = GCounterValue(counts)
+		setPath(obj, path, counts)
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return 0, err
+	}
+	if stored == nil {
+		err = c.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: data})
+	} else {
+		err = c.writeUpdate(ctx, &pb.CollectionRecord{
+			Id:        id,
+			ProtoData: data,
+			DataUri:   stored.DataUri,
+			Metadata:  &pb.Metadata{CreatedAt: stored.Metadata.GetCreatedAt(), Labels: stored.Metadata.GetLabels()},
+		})
+	}
+	if err != nil {
+		return 0, err
+	}
+	return value, nil
+}
+
+// GCounterValue returns the value of a G-counter field as stored in a record:
+// the sum of its entries.
+func GCounterValue(v any) int64 {
+	counts := map[string]any{}
+	mergeGCounter(counts, v)
+	var total int64
+	for _, c := range counts {
+		n, _ := fieldInt(c)
+		total += n
+	}
+	return total
+}
+
+// mergeGCounter merges the entries of a stored G-counter into counts, keeping
+// the larger count of each node.
+func mergeGCounter(counts map[string]any, v any) {
+	entries, ok := v.(map[string]any)
+	if !ok {
+		return
+	}
+	for node, c := range entries {
+		n, ok := fieldInt(c)
+		if !ok {
+			continue
+		}
+		if prev, ok := fieldInt(counts[node]); !ok || n > prev {
+			counts[node] = json.Number(fmt.Sprint(n))
+		}
+	}
+}
+
+// asRegister returns v as an LWW register, if it has the register's shape.
+func asRegister(v any) (map[string]any, bool) {
+	reg, ok := v.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	_, hasValue := reg["value"]
+	_, hasTS := fieldInt(reg["ts"])
+	_, hasNode := reg["node"].(string)
+	if !hasValue || !hasTS || !hasNode || len(reg) != 3 {
+		return nil, false
+	}
+	return reg, true
+}
+
+// registerNewer reports whether register a was written after b, breaking
+// timestamp ties by node ID.
+func registerNewer(a, b map[string]any) bool {
+	ta, _ := fieldInt(a["ts"])
+	tb, _ := fieldInt(b["ts"])
+	if ta != tb {
+		return ta > tb
+	}
+	return a["node"].(string) > b["node"].(string)
+}
+
+func fieldInt(v any) (int64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	case float64:
+		return int64(n), n == float64(int64(n))
+	}
+	return 0, false
+}
+
+func decodeObject(data []byte) (map[string]any, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil || obj == nil {
+		return nil, false
+	}
+	return obj, true
+}
+
+func lookupPath(obj map[string]any, path string) (any, bool) {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		v, ok := obj[part]
+		if !ok {
+			return nil, false
+		}
+		if i == len(parts)-1 {
+			return v, true
+		}
+		if obj, ok = v.(map[string]any); !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// setPath sets the value at a dotted path, replacing whatever is in the way.
+func setPath(obj map[string]any, path string, v any) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := obj[part].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			obj[part] = next
+		}
+		obj = next
+	}
+	obj[parts[len(parts)-1]] = v
+}
+
+// Increment atomically adds to a record's counter field.
+func (s *CollectionServer) Increment(ctx context.Context, req *pb.IncrementRequest) (*pb.IncrementResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if req.Id == "" || req.Field == "" {
+		return nil, status.Error(codes.InvalidArgument, "id and field are required")
+	}
+	if collection.Fields == nil {
+		return nil, status.Error(codes.FailedPrecondition, "managed fields are not enabled for this collection")
+	}
+
+	value, err := collection.Increment(ctx, req.Id, req.Field, req.Delta, req.Upsert)
+	switch {
+	case err == nil:
+		return &pb.IncrementResponse{Status: &pb.Status{Code: pb.Status_OK}, Value: value}, nil
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, status.Errorf(codes.NotFound, "record %s not found", req.Id)
+	case errors.Is(err, ErrNotCounter) || errors.Is(err, ErrNegativeIncrement):
+		return nil, invalidRecord(codes.InvalidArgument, req.Field, ViolationType, nil, "%v", err)
+	case errors.Is(err, ErrFieldValue):
+		return nil, invalidRecord(codes.FailedPrecondition, req.Field, ViolationType, nil, "%v", err)
+	}
+	return nil, leaseStatus(err)
+}
@@ -0,0 +1,157 @@
+package collection_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func setupManagedFields(t *testing.T) (*collection.CollectionServer, func(id string) map[string]any) {
+	t.Helper()
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	t.Cleanup(cleanup)
+	repo.(*collection.DefaultCollectionRepo).SetNodeID("node-a")
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{
+		Namespace: "test", Name: "posts",
+		ManagedFields: []*pb.ManagedField{
+			{Path: "views", Kind: pb.FieldKind_FIELD_COUNTER},
+			{Path: "stats.likes", Kind: pb.FieldKind_FIELD_G_COUNTER},
+			{Path: "title", Kind: pb.FieldKind_FIELD_LWW_REGISTER},
+		},
+	}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	server := collection.NewCollectionServer(repo)
+	get := func(id string) map[string]any {
+		t.Helper()
+		resp, err := server.Get(ctx, &pb.GetRequest{Namespace: "test", CollectionName: "posts", Id: id})
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		var doc map[string]any
+		if err := json.Unmarshal(resp.Item.Value, &doc); err != nil {
+			t.Fatalf("record is not JSON: %v", err)
+		}
+		return doc
+	}
+	return server, get
+}
+
+func TestCollectionServer_Increment(t *testing.T) {
+	ctx := context.Background()
+	server, get := setupManagedFields(t)
+
+	// Concurrent increments are not lost, and upsert creates the record
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := server.Increment(ctx, &pb.IncrementRequest{
+				Namespace: "test", CollectionName: "posts", Id: "p1", Field: "views", Delta: 1, Upsert: true,
+			}); err != nil {
+				t.Errorf("Increment failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if views := get("p1")["views"]; views != float64(20) {
+		t.Fatalf("expected 20 views, got %v", views)
+	}
+
+	// Updates keep the server's count
+	if _, err := server.Update(ctx, &pb.UpdateRequest{
+		Namespace: "test", CollectionName: "posts", Id: "p1", Item: &anypb.Any{Value: []byte(`{"views": 3, "body": "edited"}`)},
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if doc := get("p1"); doc["views"] != float64(20) || doc["body"] != "edited" {
+		t.Errorf("expected the update to keep the counter, got %v", doc)
+	}
+
+	resp, err := server.Increment(ctx, &pb.IncrementRequest{Namespace: "test", CollectionName: "posts", Id: "p1", Field: "views", Delta: -5})
+	if err != nil || resp.Value != 15 {
+		t.Errorf("expected a decrement to 15, got %v, %v", resp.GetValue(), err)
+	}
+
+	for name, req := range map[string]*pb.IncrementRequest{
+		"undeclared field":    {Id: "p1", Field: "body", Delta: 1},
+		"register field":      {Id: "p1", Field: "title", Delta: 1},
+		"G-counter decrement": {Id: "p1", Field: "stats.likes", Delta: -1},
+	} {
+		req.Namespace, req.CollectionName = "test", "posts"
+		if _, err := server.Increment(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", name, err)
+		}
+	}
+	if _, err := server.Increment(ctx, &pb.IncrementRequest{Namespace: "test", CollectionName: "posts", Id: "missing", Field: "views", Delta: 1}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound without upsert, got %v", err)
+	}
+}
+
+func TestCollectionServer_CRDTFields(t *testing.T) {
+	ctx := context.Background()
+	server, get := setupManagedFields(t)
+
+	if _, err := server.Create(ctx, &pb.CreateRequest{
+		Namespace: "test", CollectionName: "posts", Id: "p1",
+		Item: &anypb.Any{Value: []byte(`{"title": "Draft", "body": "hello"}`)},
+	}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := server.Increment(ctx, &pb.IncrementRequest{Namespace: "test", CollectionName: "posts", Id: "p1", Field: "stats.likes", Delta: 2}); err != nil {
+			t.Fatalf("Increment failed: %v", err)
+		}
+	}
+	doc := get("p1")
+	title, ok := doc["title"].(map[string]any)
+	if !ok || title["value"] != "Draft" || title["node"] != "node-a" {
+		t.Fatalf("expected the title to be wrapped in a register, got %v", doc["title"])
+	}
+	if likes := doc["stats"].(map[string]any)["likes"]; collection.GCounterValue(likes) != 4 {
+		t.Fatalf("expected 4 likes, got %v", likes)
+	}
+
+	// A replica pushes its own likes and an older title: the counts merge,
+	// the newer title wins and the replica's other fields are ignored
+	push, err := server.PushChanges(ctx, &pb.PushChangesRequest{Namespace: "test", CollectionName: "posts", Changes: []*pb.RecordChange{{
+		Id:    "p1",
+		Merge: true,
+		Data: []byte(`{"body": "stale", "stats": {"likes": {"node-a": 1, "node-b": 5}},
+			"title": {"value": "Old", "ts": 1, "node": "node-b"}}`),
+	}}})
+	if err != nil || len(push.Applied) != 1 || len(push.Conflicts) != 0 {
+		t.Fatalf("PushChanges returned %v, %v", push, err)
+	}
+	doc = get("p1")
+	if likes := doc["stats"].(map[string]any)["likes"]; collection.GCounterValue(likes) != 9 {
+		t.Errorf("expected 9 merged likes, got %v", likes)
+	}
+	if doc["title"].(map[string]any)["value"] != "Draft" || doc["body"] != "hello" {
+		t.Errorf("expected the stale title and body to be ignored, got %v", doc)
+	}
+
+	// A newer bare value replaces the register; the same value keeps it
+	if _, err := server.Update(ctx, &pb.UpdateRequest{
+		Namespace: "test", CollectionName: "posts", Id: "p1",
+		Item: &anypb.Any{Value: []byte(`{"title": "Final", "body": "hello"}`)},
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	doc = get("p1")
+	if doc["title"].(map[string]any)["value"] != "Final" {
+		t.Errorf("expected the new title, got %v", doc["title"])
+	}
+	if likes := doc["stats"].(map[string]any)["likes"]; collection.GCounterValue(likes) != 9 {
+		t.Errorf("expected the update to keep the likes, got %v", likes)
+	}
+}
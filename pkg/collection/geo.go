@@ -0,0 +1,142 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// EarthRadiusMeters is the mean Earth radius used for distances.
+const EarthRadiusMeters = 6371008.8
+
+// ErrGeoUnavailable is returned for geo filters against a store without a geo
+// index (see Options.Geo).
+var ErrGeoUnavailable = errors.New("geo index is not enabled for this collection")
+
+// GeoOptions declares the JSON fields holding each record's location, as
+// field paths (see ParseFieldPath). Records without numeric, in-range values
+// at both paths are not indexed and never match geo filters.
+type GeoOptions struct {
+	LatField string
+	LonField string
+}
+
+// Validate checks that both fields are set and are paths to single values.
+func (o *GeoOptions) Validate() error {
+	for _, field := range []string{o.LatField, o.LonField} {
+		path, err := ParseFieldPath(field)
+		if err != nil {
+			return fmt.Errorf("invalid geo field: %w", err)
+		}
+		if _, _, wildcard := path.SplitWildcard(); wildcard {
+			return fmt.Errorf("invalid geo field %q: [*] paths select several values", field)
+		}
+	}
+	return nil
+}
+
+// BoundingBox is a latitude/longitude rectangle in degrees. A box with
+// MinLon > MaxLon crosses the antimeridian.
+type BoundingBox struct {
+	MinLat, MinLon float64
+	MaxLat, MaxLon float64
+}
+
+// CrossesAntimeridian reports whether the box wraps from 180 to -180.
+func (b BoundingBox) CrossesAntimeridian() bool {
+	return b.MinLon > b.MaxLon
+}
+
+// GeoRadius is a circle of Meters around a point.
+type GeoRadius struct {
+	Lat, Lon float64
+	Meters   float64
+}
+
+// Bounds returns a box enclosing the circle, for index lookups.
+func (r GeoRadius) Bounds() BoundingBox {
+	dLat := r.Meters / EarthRadiusMeters * 180 / math.Pi
+	box := BoundingBox{MinLat: r.Lat - dLat, MaxLat: r.Lat + dLat, MinLon: -180, MaxLon: 180}
+	if box.MinLat <= -90 || box.MaxLat >= 90 {
+		// The circle covers a pole, and with it every longitude
+		box.MinLat, box.MaxLat = math.Max(box.MinLat, -90), math.Min(box.MaxLat, 90)
+		return box
+	}
+
+	// Widest longitude span of the circle, at the latitude of its tangents
+	dLon := math.Asin(math.Min(1, math.Sin(r.Meters/EarthRadiusMeters)/math.Cos(r.Lat*math.Pi/180))) * 180 / math.Pi
+	if dLon >= 180 {
+		return box
+	}
+	box.MinLon, box.MaxLon = r.Lon-dLon, r.Lon+dLon
+	if box.MinLon < -180 {
+		box.MinLon += 360
+	}
+	if box.MaxLon > 180 {
+		box.MaxLon -= 360
+	}
+	return box
+}
+
+// GeoFilter restricts a search to records located in a box or a circle.
+// Exactly one of Box and Radius is set.
+type GeoFilter struct {
+	Box    *BoundingBox
+	Radius *GeoRadius
+}
+
+// Validate checks the filter's coordinates.
+func (f *GeoFilter) Validate() error {
+	switch {
+	case (f.Box == nil) == (f.Radius == nil):
+		return fmt.Errorf("geo filter needs exactly one of bounding_box and radius")
+	case f.Box != nil:
+		if !validLat(f.Box.MinLat) || !validLat(f.Box.MaxLat) || f.Box.MinLat > f.Box.MaxLat {
+			return fmt.Errorf("invalid bounding box latitudes [%v, %v]", f.Box.MinLat, f.Box.MaxLat)
+		}
+		if !validLon(f.Box.MinLon) || !validLon(f.Box.MaxLon) {
+			return fmt.Errorf("invalid bounding box longitudes [%v, %v]", f.Box.MinLon, f.Box.MaxLon)
+		}
+	default:
+		if !validLat(f.Radius.Lat) || !validLon(f.Radius.Lon) {
+			return fmt.Errorf("invalid radius center (%v, %v)", f.Radius.Lat, f.Radius.Lon)
+		}
+		if !(f.Radius.Meters > 0) {
+			return fmt.Errorf("radius must be positive, got %v", f.Radius.Meters)
+		}
+	}
+	return nil
+}
+
+func validLat(lat float64) bool { return lat >= -90 && lat <= 90 }
+func validLon(lon float64) bool { return lon >= -180 && lon <= 180 }
+
+// GeoFilterFromProto converts and validates a request geo filter. A nil
+// filter converts to nil.
+func GeoFilterFromProto(in *pb.GeoFilter) (*GeoFilter, error) {
+	if in == nil {
+		return nil, nil
+	}
+	f := &GeoFilter{}
+	if b := in.GetBoundingBox(); b != nil {
+		f.Box = &BoundingBox{MinLat: b.MinLat, MinLon: b.MinLon, MaxLat: b.MaxLat, MaxLon: b.MaxLon}
+	}
+	if r := in.GetRadius(); r != nil {
+		f.Radius = &GeoRadius{Lat: r.Lat, Lon: r.Lon, Meters: r.Meters}
+	}
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// HaversineMeters returns the great-circle distance between two points.
+func HaversineMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * EarthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -0,0 +1,126 @@
+package collection_test
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestGeoRadius_Bounds(t *testing.T) {
+	tests := []struct {
+		name   string
+		radius collection.GeoRadius
+		check  func(b collection.BoundingBox) bool
+	}{
+		{"equator", collection.GeoRadius{Lat: 0, Lon: 0, Meters: 111195}, func(b collection.BoundingBox) bool {
+			return math.Abs(b.MaxLat-1) < 1e-3 && math.Abs(b.MaxLon-1) < 1e-3 && !b.CrossesAntimeridian()
+		}},
+		{"antimeridian", collection.GeoRadius{Lat: 0, Lon: 179.5, Meters: 111195}, func(b collection.BoundingBox) bool {
+			return b.CrossesAntimeridian() && math.Abs(b.MaxLon+179.5) < 1e-3
+		}},
+		{"pole", collection.GeoRadius{Lat: 89.5, Lon: 10, Meters: 111195}, func(b collection.BoundingBox) bool {
+			return b.MaxLat == 90 && b.MinLon == -180 && b.MaxLon == 180
+		}},
+	}
+	for _, tt := range tests {
+		if b := tt.radius.Bounds(); !tt.check(b) {
+			t.Errorf("%s: unexpected bounds %+v", tt.name, b)
+		}
+	}
+}
+
+func TestGeoFilterFromProto(t *testing.T) {
+	valid := []*pb.GeoFilter{
+		{Area: &pb.GeoFilter_BoundingBox{BoundingBox: &pb.BoundingBox{MinLat: -10, MinLon: 170, MaxLat: 10, MaxLon: -170}}},
+		{Area: &pb.GeoFilter_Radius{Radius: &pb.GeoRadius{Lat: 51.5, Lon: -0.12, Meters: 500}}},
+	}
+	for _, in := range valid {
+		if _, err := collection.GeoFilterFromProto(in); err != nil {
+			t.Errorf("GeoFilterFromProto(%v) failed: %v", in, err)
+		}
+	}
+
+	invalid := []*pb.GeoFilter{
+		{},
+		{Area: &pb.GeoFilter_BoundingBox{BoundingBox: &pb.BoundingBox{MinLat: 10, MaxLat: -10}}},
+		{Area: &pb.GeoFilter_BoundingBox{BoundingBox: &pb.BoundingBox{MaxLat: 1, MaxLon: 181}}},
+		{Area: &pb.GeoFilter_Radius{Radius: &pb.GeoRadius{Lat: 91, Meters: 1}}},
+		{Area: &pb.GeoFilter_Radius{Radius: &pb.GeoRadius{Meters: -5}}},
+	}
+	for _, in := range invalid {
+		if _, err := collection.GeoFilterFromProto(in); err == nil {
+			t.Errorf("expected an error for %v", in)
+		}
+	}
+}
+
+func TestCollectionServer_GeoSearch(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), "geo.db"), collection.Options{
+		EnableJSON: true,
+		Geo:        &collection.GeoOptions{LatField: "lat", LonField: "lng"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	repo := collection.NewCollectionRepo(store)
+	server := collection.NewCollectionServer(repo)
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "stations"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	for id, data := range map[string]string{
+		"kings-cross": `{"lat": 51.5308, "lng": -0.1238}`,
+		"euston":      `{"lat": 51.5282, "lng": -0.1337}`,
+		"waterloo":    `{"lat": 51.5031, "lng": -0.1132}`,
+		"paris-nord":  `{"lat": 48.8809, "lng": 2.3553}`,
+	} {
+		if _, err := server.Create(ctx, &pb.CreateRequest{
+			Namespace: "test", CollectionName: "stations", Id: id,
+			Item: &anypb.Any{Value: []byte(data)},
+		}); err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+
+	near := &pb.GeoFilter{Area: &pb.GeoFilter_Radius{Radius: &pb.GeoRadius{Lat: 51.5308, Lon: -0.1238, Meters: 1000}}}
+	resp, err := server.Search(ctx, &pb.SearchRequest{Namespace: "test", CollectionName: "stations", Geo: near})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(resp.Results) != 2 || resp.Results[0].Distance != 0 || resp.Results[1].Distance < 700 || resp.Results[1].Distance > 800 {
+		t.Errorf("expected King's Cross then Euston (~750m), got %v", resp.Results)
+	}
+
+	count, err := server.Count(ctx, &pb.CountRequest{
+		Namespace: "test", CollectionName: "stations",
+		Geo: &pb.GeoFilter{Area: &pb.GeoFilter_BoundingBox{BoundingBox: &pb.BoundingBox{MinLat: 51, MinLon: -1, MaxLat: 52, MaxLon: 1}}},
+	})
+	if err != nil || count.Count != 3 {
+		t.Errorf("expected 3 London stations, got %v (%v)", count.GetCount(), err)
+	}
+
+	bad := &pb.GeoFilter{Area: &pb.GeoFilter_Radius{Radius: &pb.GeoRadius{Lat: 100, Meters: 1}}}
+	if _, err := server.Search(ctx, &pb.SearchRequest{Namespace: "test", CollectionName: "stations", Geo: bad}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+
+	plain, cleanup := setupTestRepo(t)
+	defer cleanup()
+	if _, err := plain.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "stations"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	_, err = collection.NewCollectionServer(plain).Search(ctx, &pb.SearchRequest{Namespace: "test", CollectionName: "stations", Geo: near})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition without a geo index, got %v", err)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"net"
 
 	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/channelpool"
+	"github.com/accretional/collector/pkg/jobs"
 	"google.golang.org/grpc"
 )
 
@@ -14,36 +16,63 @@ import (
 type GrpcServer struct {
 	pb.UnimplementedCollectionRepoServer
 	repo          CollectionRepo
+	layout        PathLayout
 	cloneManager  *CloneManager
 	backupManager *BackupManager
+	snapshots     *SnapshotManager
+	jobs          *jobs.Manager
+	analytics     AnalyticsEngine
+	approvals     *ApprovalGate    // nil unless approvals are enabled
+	holds         *LegalHolds      // nil unless legal holds are enabled
+	disk          *DiskWatchdog    // nil unless disk space is watched
+	tempFiles     *TempFileSweeper // nil unless orphaned temp files are swept
+	aliases       *NamespaceAliases
+	renamers      []NamespaceRenamer
+	verification  verifyScheduler
+	rehearsals    rehearsals
+	events        *EventStreams
+	standby       *Standby // nil unless this collector is a standby
+	preflight     PreflightOptions
 }
 
-// NewGrpcServer creates a new instance of our gRPC server.
+// NewGrpcServer creates a new instance of our gRPC server, keeping its data
+// under DefaultDataRoot.
 func NewGrpcServer(repo CollectionRepo) *GrpcServer {
-	backupManager, err := NewBackupManager(repo, &SqliteTransport{}, "./data/backups/metadata.db")
-	if err != nil {
-		log.Printf("Warning: failed to initialize backup manager: %v", err)
-	}
-
-	return &GrpcServer{
-		repo:          repo,
-		cloneManager:  NewCloneManager(repo, "./data"),
-		backupManager: backupManager,
-	}
+	return NewGrpcServerWithLayout(repo, NewPathLayout(DefaultDataRoot))
 }
 
 // NewGrpcServerWithDataDir creates a new instance with a custom data directory.
 func NewGrpcServerWithDataDir(repo CollectionRepo, dataDir string) *GrpcServer {
-	backupManager, err := NewBackupManager(repo, &SqliteTransport{}, dataDir+"/backups/metadata.db")
+	return NewGrpcServerWithLayout(repo, NewPathLayout(dataDir))
+}
+
+// NewGrpcServerWithLayout creates a new instance keeping clones, backups,
+// restores and snapshots where layout says. Give a DefaultCollectionRepo
+// the same layout with SetPathLayout.
+func NewGrpcServerWithLayout(repo CollectionRepo, layout PathLayout) *GrpcServer {
+	backupManager, err := NewBackupManager(repo, &SqliteTransport{}, layout.BackupMetadata())
 	if err != nil {
 		log.Printf("Warning: failed to initialize backup manager: %v", err)
+	} else {
+		backupManager.SetPathLayout(layout)
+	}
+	snapshots, err := NewSnapshotManager(repo, layout.SnapshotsDir())
+	if err != nil {
+		log.Printf("Warning: failed to initialize snapshot manager: %v", err)
 	}
 
-	return &GrpcServer{
+	s := &GrpcServer{
 		repo:          repo,
-		cloneManager:  NewCloneManager(repo, dataDir),
+		layout:        layout,
+		cloneManager:  NewCloneManager(repo, layout.Root),
 		backupManager: backupManager,
+		snapshots:     snapshots,
+		analytics:     &SqliteAnalyticsEngine{},
+		events:        NewEventStreams(),
 	}
+	// Jobs live in memory until UseJobStore is called
+	s.jobs = s.newJobManager(jobs.NewMemoryStore(), jobs.Options{})
+	return s
 }
 
 // CreateCollection forwards the request to the underlying repository.
@@ -56,9 +85,44 @@ func (s *GrpcServer) Discover(ctx context.Context, req *pb.DiscoverRequest) (*pb
 	return s.repo.Discover(ctx, req)
 }
 
-// Route forwards the request to the underlying repository.
+// Route returns the endpoint serving a collection: its server_endpoint, or
+// this collector's (see SetEndpoint) for collections served here.
+// Collections the repository does not know are NOT_FOUND, and collections
+// served here are UNAVAILABLE until an endpoint is set.
 func (s *GrpcServer) Route(ctx context.Context, req *pb.RouteRequest) (*pb.RouteResponse, error) {
-	return s.repo.Route(ctx, req)
+	if req.GetCollection().GetNamespace() == "" || req.GetCollection().GetName() == "" {
+		return &pb.RouteResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection namespace and name are required"},
+		}, nil
+	}
+	resp, err := s.repo.Route(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.GetCollection() == nil {
+		return &pb.RouteResponse{
+			Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: resp.GetStatus().GetMessage()},
+		}, nil
+	}
+
+	endpoint := resp.Collection.ServerEndpoint
+	if endpoint == "" {
+		endpoint = s.cloneManager.Endpoint()
+	}
+	if endpoint == "" {
+		endpoint = resp.ServerEndpoint
+	}
+	if endpoint == "" {
+		return &pb.RouteResponse{
+			Status:     &pb.Status{Code: pb.Status_UNAVAILABLE, Message: "no endpoint is configured for this collector, see SetEndpoint"},
+			Collection: resp.Collection,
+		}, nil
+	}
+	return &pb.RouteResponse{
+		Status:         &pb.Status{Code: pb.Status_OK, Message: "OK"},
+		ServerEndpoint: endpoint,
+		Collection:     resp.Collection,
+	}, nil
 }
 
 // SearchCollections forwards the request to the underlying repository.
@@ -83,11 +147,71 @@ func (s *GrpcServer) Clone(ctx context.Context, req *pb.CloneRequest) (*pb.Clone
 		// Local clone
 		return s.cloneManager.CloneLocal(ctx, req)
 	}
+	if req.FullText != "" || len(req.Filters) > 0 {
+		return &pb.CloneResponse{
+			Status: &pb.Status{
+				Code:    pb.Status_INVALID_ARGUMENT,
+				Message: "record filters are only supported for local clones",
+			},
+		}, nil
+	}
 
 	// Remote clone
 	return s.cloneManager.CloneRemote(ctx, req)
 }
 
+// CloneCollection clones a collection within this collector, optionally keeping
+// only the records that match a full-text query and filters.
+func (s *GrpcServer) CloneCollection(ctx context.Context, req *pb.CloneCollectionRequest) (*pb.CloneResponse, error) {
+	if req == nil || req.Namespace == "" || req.SourceName == "" || req.DestName == "" {
+		return &pb.CloneResponse{
+			Status: &pb.Status{
+				Code:    pb.Status_INVALID_ARGUMENT,
+				Message: "namespace, source_name and dest_name are required",
+			},
+		}, nil
+	}
+
+	destNamespace := req.DestNamespace
+	if destNamespace == "" {
+		destNamespace = req.Namespace
+	}
+
+	return s.cloneManager.CloneLocal(ctx, &pb.CloneRequest{
+		SourceCollection: &pb.NamespacedName{Namespace: req.Namespace, Name: req.SourceName},
+		DestNamespace:    destNamespace,
+		DestName:         req.DestName,
+		IncludeFiles:     req.IncludeFiles,
+		FullText:         req.FullText,
+		Filters:          req.Filters,
+	})
+}
+
+// RegisterReplica records that a copy of a local collection lives on another collector.
+func (s *GrpcServer) RegisterReplica(ctx context.Context, req *pb.RegisterReplicaRequest) (*pb.RegisterReplicaResponse, error) {
+	if req.SourceCollection == nil || req.Replica == nil || req.Replica.Endpoint == "" {
+		return &pb.RegisterReplicaResponse{
+			Status: &pb.Status{
+				Code:    pb.Status_INVALID_ARGUMENT,
+				Message: "source_collection and replica endpoint are required",
+			},
+		}, nil
+	}
+
+	if err := s.cloneManager.RecordReplica(ctx, req.SourceCollection, req.Replica); err != nil {
+		return &pb.RegisterReplicaResponse{
+			Status: &pb.Status{
+				Code:    pb.Status_NOT_FOUND,
+				Message: err.Error(),
+			},
+		}, nil
+	}
+
+	return &pb.RegisterReplicaResponse{
+		Status: &pb.Status{Code: pb.Status_OK, Message: "Replica registered"},
+	}, nil
+}
+
 // Fetch fetches a collection from a remote collector.
 func (s *GrpcServer) Fetch(ctx context.Context, req *pb.FetchRequest) (*pb.FetchResponse, error) {
 	// Validate request
@@ -183,8 +307,37 @@ func (s *GrpcServer) VerifyBackup(ctx context.Context, req *pb.VerifyBackupReque
 	return s.backupManager.VerifyBackup(ctx, req)
 }
 
+// SetDiskWatchdog pauses backup, clone and fetch jobs while the volume they
+// write to is critical. The watchdog's interceptors refuse the corresponding
+// calls and must be installed on the server separately.
+func (s *GrpcServer) SetDiskWatchdog(w *DiskWatchdog) {
+	s.disk = w
+}
+
+// SetChannelPool shares pool's channels for remote clones and fetches.
+func (s *GrpcServer) SetChannelPool(pool *channelpool.Pool) {
+	s.cloneManager.SetChannelPool(pool)
+}
+
+// SetEndpoint sets the address other collectors use to reach this one.
+// Collections served here, including cloned and fetched ones, are routed to
+// it, and it is recorded in the lineage of copies made here.
+func (s *GrpcServer) SetEndpoint(endpoint string) {
+	s.cloneManager.SetEndpoint(endpoint)
+	if s.backupManager != nil {
+		s.backupManager.SetEndpoint(endpoint)
+	}
+	if repo, ok := s.repo.(*DefaultCollectionRepo); ok {
+		repo.SetEndpoint(endpoint)
+	}
+}
+
 // Start runs the gRPC server on the given port.
+// If no endpoint has been set, localhost:port is used.
 func (s *GrpcServer) Start(port int) error {
+	if s.cloneManager.Endpoint() == "" {
+		s.SetEndpoint(fmt.Sprintf("localhost:%d", port))
+	}
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
@@ -2,10 +2,17 @@ package collection_test
 
 import (
 	"context"
+	"fmt"
+	"path/filepath"
 	"testing"
 
 	pb "github.com/accretional/collector/gen/collector"
 	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
@@ -274,10 +281,23 @@ func TestGrpcServer_Route(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Route failed: %v", err)
 	}
+	if resp.Status.Code != pb.Status_OK || resp.ServerEndpoint != "localhost:9090" || resp.Collection.GetName() != "routed" {
+		t.Errorf("expected routed to localhost:9090, got %v", resp)
+	}
 
-	// Implementation returns 501 Not Implemented
-	if resp.Status.Code != 501 {
-		t.Logf("Route returned status %d", resp.Status.Code)
+	// Collections without an endpoint are served by this collector, once it
+	// knows its address
+	if _, err := server.CreateCollection(ctx, &pb.CreateCollectionRequest{Collection: &pb.Collection{Namespace: "test", Name: "local"}}); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	resp, err = server.Route(ctx, &pb.RouteRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "local"}})
+	if err != nil || resp.Status.Code != pb.Status_UNAVAILABLE || resp.ServerEndpoint != "" {
+		t.Errorf("expected UNAVAILABLE without an endpoint, got %v %v", resp, err)
+	}
+	server.SetEndpoint("collector-a:7000")
+	resp, err = server.Route(ctx, &pb.RouteRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "local"}})
+	if err != nil || resp.Status.Code != pb.Status_OK || resp.ServerEndpoint != "collector-a:7000" {
+		t.Errorf("expected local routed to this collector, got %v %v", resp, err)
 	}
 }
 
@@ -299,10 +319,34 @@ func TestGrpcServer_Route_NonExistent(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Route failed: %v", err)
 	}
+	if resp.Status.Code != pb.Status_NOT_FOUND || resp.Collection != nil {
+		t.Errorf("expected NOT_FOUND, got %v", resp)
+	}
 
-	// Implementation returns 501 Not Implemented
-	if resp.Status.Code != 501 {
-		t.Logf("Route returned status %d", resp.Status.Code)
+	if resp, _ := server.Route(ctx, &pb.RouteRequest{}); resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT without a collection, got %v", resp.Status)
+	}
+}
+
+func TestRouteRemote(t *testing.T) {
+	ctx := context.Background()
+	_, server, addr := startRepoServer(t)
+	if _, err := server.CreateCollection(ctx, &pb.CreateCollectionRequest{Collection: &pb.Collection{Namespace: "test", Name: "remote"}}); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewCollectionRepoClient(conn)
+
+	resp, err := collection.RouteRemote(ctx, client, &pb.NamespacedName{Namespace: "test", Name: "remote"})
+	if err != nil || resp.ServerEndpoint != addr {
+		t.Errorf("expected remote routed to %s, got %v %v", addr, resp, err)
+	}
+	if _, err := collection.RouteRemote(ctx, client, &pb.NamespacedName{Namespace: "test", Name: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
 	}
 }
 
@@ -604,9 +648,8 @@ func TestGrpcServer_Integration_CreateAndRoute(t *testing.T) {
 		t.Fatalf("Route failed: %v", err)
 	}
 
-	// Implementation returns 501 Not Implemented for Route
-	if routeResp.Status.Code != 501 {
-		t.Logf("Route completed with status %d", routeResp.Status.Code)
+	if routeResp.Status.Code != pb.Status_OK || routeResp.Collection.GetName() != "test-flow" {
+		t.Errorf("Route returned %v", routeResp)
 	}
 
 	// 3. Discover it
@@ -624,3 +667,76 @@ func TestGrpcServer_Integration_CreateAndRoute(t *testing.T) {
 		t.Logf("Discover completed with status %d", discoverResp.Status.Code)
 	}
 }
+
+// TestGrpcServer_CloneCollection tests filtered local cloning through the CloneCollection RPC
+func TestGrpcServer_CloneCollection(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	dataDir := t.TempDir()
+	server := collection.NewGrpcServerWithDataDir(repo, dataDir)
+	ctx := context.Background()
+
+	_, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "library", Name: "books"})
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	src, err := repo.GetCollection(ctx, "library", "books")
+	if err != nil {
+		t.Fatalf("failed to get collection: %v", err)
+	}
+	for i, year := range []int{2020, 2023, 2024} {
+		err := src.CreateRecord(ctx, &pb.CollectionRecord{
+			Id:        fmt.Sprintf("book-%d", i),
+			ProtoData: []byte(fmt.Sprintf(`{"year": %d}`, year)),
+		})
+		if err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+
+	resp, err := server.CloneCollection(ctx, &pb.CloneCollectionRequest{
+		Namespace:  "library",
+		SourceName: "books",
+		DestName:   "recent",
+		Filters: map[string]*pb.Filter{
+			"year": {Operator: pb.FilterOperator_OP_GREATER_EQUAL, Value: structpb.NewNumberValue(2023)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CloneCollection failed: %v", err)
+	}
+	if resp.CollectionId != "library/recent" || resp.RecordsCloned != 2 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	dest, err := repo.GetCollection(ctx, "library", "recent")
+	if err != nil {
+		t.Fatalf("cloned collection not registered: %v", err)
+	}
+	if dest.Meta.Metadata.Labels["cloned_from"] != "library/books" {
+		t.Errorf("expected cloned_from label, got %v", dest.Meta.Metadata.Labels)
+	}
+
+	cloneStore, err := sqlite.NewSqliteStore(filepath.Join(dataDir, "collections", "library", "recent.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to open clone: %v", err)
+	}
+	defer cloneStore.Close()
+	if _, err := cloneStore.GetRecord(ctx, "book-0"); err == nil {
+		t.Error("expected filtered-out record to be absent from the clone")
+	}
+	if count, _ := cloneStore.CountRecords(ctx); count != 2 {
+		t.Errorf("expected 2 records in the clone, got %d", count)
+	}
+
+	// Cloning onto an existing collection fails without touching it
+	_, err = server.CloneCollection(ctx, &pb.CloneCollectionRequest{Namespace: "library", SourceName: "books", DestName: "recent"})
+	if err == nil {
+		t.Error("expected error when the destination exists")
+	}
+
+	invalid, err := server.CloneCollection(ctx, &pb.CloneCollectionRequest{Namespace: "library", SourceName: "books"})
+	if err != nil || invalid.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT for missing dest_name, got %v (%v)", invalid, err)
+	}
+}
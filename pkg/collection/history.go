@@ -0,0 +1,60 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// ErrHistoryUnavailable is returned for as-of reads against a store that does
+// not keep record history.
+var ErrHistoryUnavailable = errors.New("record history is not enabled for this collection")
+
+// HistoryReader is implemented by stores that can serve records as they
+// existed at an earlier time. Stores that implement it also honor
+// SearchQuery.AsOf in Search and CountMatching.
+type HistoryReader interface {
+	HistoryEnabled() bool
+	GetRecordAsOf(ctx context.Context, id string, asOf time.Time) (*pb.CollectionRecord, error)
+	ListRecordsAsOf(ctx context.Context, asOf time.Time, offset, limit int) ([]*pb.CollectionRecord, error)
+}
+
+// historyReader returns store's HistoryReader if it has history enabled.
+func historyReader(store Store) (HistoryReader, error) {
+	hr, ok := store.(HistoryReader)
+	if !ok || !hr.HistoryEnabled() {
+		return nil, ErrHistoryUnavailable
+	}
+	return hr, nil
+}
+
+// GetRecordAsOf returns the version of a record that was current at asOf.
+// It returns sql.ErrNoRows if the record did not exist at that time.
+func GetRecordAsOf(ctx context.Context, store Store, id string, asOf time.Time) (*pb.CollectionRecord, error) {
+	hr, err := historyReader(store)
+	if err != nil {
+		return nil, err
+	}
+	return hr.GetRecordAsOf(ctx, id, asOf)
+}
+
+// ListRecordsAsOf lists records as they existed at asOf, newest first.
+func ListRecordsAsOf(ctx context.Context, store Store, asOf time.Time, offset, limit int) ([]*pb.CollectionRecord, error) {
+	hr, err := historyReader(store)
+	if err != nil {
+		return nil, err
+	}
+	return hr.ListRecordsAsOf(ctx, asOf, offset, limit)
+}
+
+// GetRecordAsOf returns the version of a record that was current at asOf.
+func (c *Collection) GetRecordAsOf(ctx context.Context, id string, asOf time.Time) (*pb.CollectionRecord, error) {
+	return GetRecordAsOf(ctx, c.Store, id, asOf)
+}
+
+// ListRecordsAsOf lists records as they existed at asOf, newest first.
+func (c *Collection) ListRecordsAsOf(ctx context.Context, asOf time.Time, offset, limit int) ([]*pb.CollectionRecord, error) {
+	return ListRecordsAsOf(ctx, c.Store, asOf, offset, limit)
+}
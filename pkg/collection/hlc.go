@@ -0,0 +1,82 @@
+package collection
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HLCSchema adds the column holding each record's hybrid logical clock
+// timestamp.
+const HLCSchema = `
+ALTER TABLE records ADD COLUMN hlc INTEGER;
+`
+
+// hlcLogicalBits is how many low bits of an HLC hold its logical counter.
+const hlcLogicalBits = 16
+
+// DefaultMaxClockSkew is how far another collector's clock may run ahead of
+// this one's before its HLCs are no longer observed.
+const DefaultMaxClockSkew = 500 * time.Millisecond
+
+// HLC is a hybrid logical clock timestamp: the unix milliseconds of its
+// physical time, shifted left 16 bits, plus a logical counter ordering the
+// events of one millisecond. HLCs compare as integers. They stay within the
+// clock skew of wall time, but never go backwards when a clock does, and an
+// HLC issued after another collector's is observed is always above it.
+type HLC int64
+
+// NewHLC returns the HLC of physical time wall, truncated to the
+// millisecond, and logical counter logical.
+func NewHLC(wall time.Time, logical uint16) HLC {
+	return HLC(wall.UnixMilli()<<hlcLogicalBits | int64(logical))
+}
+
+// Wall returns the HLC's physical time.
+func (h HLC) Wall() time.Time {
+	return time.UnixMilli(int64(h) >> hlcLogicalBits).UTC()
+}
+
+// Logical returns the HLC's logical counter.
+func (h HLC) Logical() uint16 {
+	return uint16(h)
+}
+
+// String formats the HLC as its physical time and logical counter.
+func (h HLC) String() string {
+	return fmt.Sprintf("%s+%d", h.Wall().Format(time.RFC3339Nano), h.Logical())
+}
+
+// HybridClock issues HLCs from a physical clock. One is shared by every
+// collection of a repository, and by the dispatcher, which advances it with
+// the HLCs of the collectors it shakes hands with.
+type HybridClock struct {
+	clock Clock
+	mu    sync.Mutex
+	last  HLC
+}
+
+// NewHybridClock returns a hybrid clock reading physical time from clock.
+func NewHybridClock(clock Clock) *HybridClock {
+	return &HybridClock{clock: clock}
+}
+
+// Now returns an HLC above every one issued or observed before: the
+// physical time if it is ahead of them, or the last one's successor.
+func (c *HybridClock) Now() HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = max(c.last+1, NewHLC(c.clock.Now(), 0))
+	return c.last
+}
+
+// Observe advances the clock past remote, an HLC received from another
+// collector or replicated with a record, and returns an HLC above both.
+// Callers should not observe HLCs of collectors whose clock is far ahead,
+// or this clock runs ahead of physical time with them.
+func (c *HybridClock) Observe(remote HLC) HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = max(c.last+1, remote+1, NewHLC(c.clock.Now(), 0))
+	return c.last
+}
@@ -0,0 +1,83 @@
+package collection_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestHybridClock(t *testing.T) {
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := collection.NewFixedClock(base)
+	hlc := collection.NewHybridClock(clock)
+
+	first := hlc.Now()
+	if !first.Wall().Equal(base) || first.Logical() != 0 {
+		t.Fatalf("expected the physical time, got %s", first)
+	}
+	// Within a millisecond, and when the clock goes backwards, the logical
+	// counter orders events
+	second := hlc.Now()
+	clock.Set(base.Add(-time.Second))
+	third := hlc.Now()
+	if second != first+1 || third != second+1 || !third.Wall().Equal(base) || third.Logical() != 2 {
+		t.Errorf("expected successors of %s, got %s then %s", first, second, third)
+	}
+	clock.Set(base.Add(time.Second))
+	if now := hlc.Now(); !now.Wall().Equal(base.Add(time.Second)) || now.Logical() != 0 {
+		t.Errorf("expected the clock to catch up with physical time, got %s", now)
+	}
+
+	// An observed HLC ahead of physical time is passed
+	remote := collection.NewHLC(base.Add(time.Minute), 7)
+	if observed := hlc.Observe(remote); observed != remote+1 {
+		t.Errorf("expected %s's successor, got %s", remote, observed)
+	}
+	if now := hlc.Now(); now <= remote {
+		t.Errorf("expected HLCs after %s, got %s", remote, now)
+	}
+	if observed := hlc.Observe(collection.NewHLC(base, 0)); observed <= remote {
+		t.Errorf("expected an HLC behind the clock not to move it back, got %s", observed)
+	}
+}
+
+func TestCollection_StampsHLCs(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo.(*collection.DefaultCollectionRepo).SetClock(collection.NewFixedClock(time.Now()))
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "events"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, err := repo.GetCollection(ctx, "test", "events")
+	if err != nil {
+		t.Fatalf("failed to get collection: %v", err)
+	}
+
+	// The clock is stopped, yet every write orders after the last
+	for _, id := range []string{"e1", "e2"} {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: []byte(`{}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	if err := coll.UpdateRecord(ctx, &pb.CollectionRecord{Id: "e1", ProtoData: []byte(`{"n": 1}`)}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	var stamps []int64
+	for _, id := range []string{"e2", "e1"} {
+		record, err := coll.GetRecord(ctx, id)
+		if err != nil {
+			t.Fatalf("GetRecord failed: %v", err)
+		}
+		stamps = append(stamps, record.Metadata.Hlc)
+	}
+	if stamps[0] == 0 || stamps[1] <= stamps[0] {
+		t.Errorf("expected the update's HLC after the later create's, got %v", stamps)
+	}
+	if records, err := coll.ListRecords(ctx, 0, 10); err != nil || len(records) != 2 || records[0].Metadata.Hlc == 0 {
+		t.Errorf("expected listed records to carry their HLC, got %v %v", records, err)
+	}
+}
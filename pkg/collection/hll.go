@@ -0,0 +1,70 @@
+package collection
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of hash bits that pick a register; 2^14
+// registers give a standard error of about 0.8% in 16KB.
+const hllPrecision = 14
+
+// HyperLogLog estimates the number of distinct strings added to it in fixed
+// memory.
+type HyperLogLog struct {
+	registers []uint8
+}
+
+// NewHyperLogLog returns an empty sketch.
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+// Add records a value.
+func (h *HyperLogLog) Add(value string) {
+	x := hash64(value)
+	idx := x >> (64 - hllPrecision)
+	// Rank of the first set bit in the remaining bits, capped for all-zero input
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// Count returns the estimated number of distinct values added.
+func (h *HyperLogLog) Count() int64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate while many registers are empty
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// RelativeError is the sketch's standard error as a fraction of the count.
+func (h *HyperLogLog) RelativeError() float64 {
+	return 1.04 / math.Sqrt(float64(len(h.registers)))
+}
+
+// hash64 is FNV-1a followed by the splitmix64 finalizer, which spreads
+// FNV's weak high bits.
+func hash64(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	x := f.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,151 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultImpactSample is how many affected IDs an Impact lists by default.
+	DefaultImpactSample = 10
+	// MaxImpactSample caps the affected IDs an Impact lists.
+	MaxImpactSample = 1000
+
+	// deleteByFilterPage is how many matching IDs DeleteByFilter collects per
+	// search.
+	deleteByFilterPage = 500
+)
+
+// ImpactSample returns the number of affected IDs to report for a requested
+// sample size: the default when unset, capped at MaxImpactSample.
+func ImpactSample(n int) int {
+	switch {
+	case n <= 0:
+		return DefaultImpactSample
+	case n > MaxImpactSample:
+		return MaxImpactSample
+	}
+	return n
+}
+
+// hasCriteria reports whether q restricts the records it matches.
+func (q *SearchQuery) hasCriteria() bool {
+	return q.FullText != "" || len(q.Filters) > 0 || len(q.LabelRequirements()) > 0 ||
+		len(q.Vector) > 0 || q.Geo != nil || len(q.IDs) > 0 ||
+		!q.CreatedAfter.IsZero() || !q.CreatedBefore.IsZero()
+}
+
+// DeleteByFilter deletes every record matching q, ignoring its limit, offset
+// and ordering, and reports how many were deleted with up to sample of their
+// IDs. With dryRun it only reports what would be deleted. A query without
+// criteria is refused rather than treated as matching everything.
+//
+// The matching IDs are collected before anything is deleted; if a delete
+// fails, the returned Impact covers the records deleted before it.
+func (c *Collection) DeleteByFilter(ctx context.Context, q *SearchQuery, dryRun bool, sample int) (*pb.Impact, error) {
+	if !q.hasCriteria() {
+		return nil, errors.New("delete by filter requires at least one criterion")
+	}
+	if !q.AsOf.IsZero() {
+		return nil, errors.New("delete by filter cannot match records as of a past time")
+	}
+	sample = ImpactSample(sample)
+
+	page := *q
+	page.OrderBy, page.Offset = "", 0
+	if dryRun {
+		count, err := c.Count(ctx, q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count matching records: %w", err)
+		}
+		page.Limit = sample
+		results, err := c.Search(ctx, &page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search matching records: %w", err)
+		}
+		impact := &pb.Impact{Count: count, DryRun: true}
+		for _, r := range results {
+			impact.SampleIds = append(impact.SampleIds, r.Record.Id)
+		}
+		return impact, nil
+	}
+
+	var ids []string
+	page.Limit = deleteByFilterPage
+	for {
+		results, err := c.Search(ctx, &page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search matching records: %w", err)
+		}
+		for _, r := range results {
+			ids = append(ids, r.Record.Id)
+		}
+		if len(results) < page.Limit {
+			break
+		}
+		page.Offset += len(results)
+	}
+
+	impact := &pb.Impact{}
+	for _, id := range ids {
+		if err := c.DeleteRecord(ctx, id); err != nil {
+			return impact, fmt.Errorf("failed to delete %s: %w", id, err)
+		}
+		impact.Count++
+		if len(impact.SampleIds) < sample {
+			impact.SampleIds = append(impact.SampleIds, id)
+		}
+	}
+	return impact, nil
+}
+
+// recordsImpact reports every record of c as affected, e.g. by a restore that
+// replaces the collection.
+func recordsImpact(ctx context.Context, c *Collection, sample int) (*pb.Impact, error) {
+	count, err := c.CountRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	records, err := c.ListRecords(ctx, 0, ImpactSample(sample))
+	if err != nil {
+		return nil, err
+	}
+	impact := &pb.Impact{Count: count}
+	for _, r := range records {
+		impact.SampleIds = append(impact.SampleIds, r.Id)
+	}
+	return impact, nil
+}
+
+// DeleteByFilter deletes the records matching a search, or with dry_run
+// reports how many would be deleted and a sample of their IDs.
+func (s *CollectionServer) DeleteByFilter(ctx context.Context, req *pb.DeleteByFilterRequest) (*pb.DeleteByFilterResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if req.Filter == nil {
+		return nil, status.Error(codes.InvalidArgument, "filter is required")
+	}
+	query, err := searchQueryFromProto(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if !query.hasCriteria() || !query.AsOf.IsZero() {
+		return nil, status.Error(codes.InvalidArgument, "filter must have criteria and cannot be as_of a past time")
+	}
+
+	impact, err := collection.DeleteByFilter(ctx, query, req.DryRun, int(req.SampleSize))
+	switch {
+	case errors.Is(err, ErrDeletesBlocked), errors.Is(err, ErrRecordLeased), errors.Is(err, ErrLegalHold), errors.Is(err, ErrRecordSealed):
+		return nil, status.Errorf(codes.FailedPrecondition, "deleted %d records before: %v", impact.GetCount(), err)
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "deleted %d records before: %v", impact.GetCount(), err)
+	}
+	return &pb.DeleteByFilterResponse{Status: &pb.Status{Code: pb.Status_OK}, Impact: impact}, nil
+}
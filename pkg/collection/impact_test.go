@@ -0,0 +1,70 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestCollectionServer_DeleteByFilter(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "logs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	server := collection.NewCollectionServer(repo)
+	for i := 0; i < 6; i++ {
+		level := "info"
+		if i%2 == 0 {
+			level = "debug"
+		}
+		if _, err := server.Create(ctx, &pb.CreateRequest{
+			Namespace: "test", CollectionName: "logs", Id: fmt.Sprintf("l%d", i),
+			Item: &anypb.Any{Value: []byte(fmt.Sprintf(`{"level": %q}`, level))},
+		}); err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+	filter := &pb.SearchRequest{FullText: "debug"}
+
+	dry, err := server.DeleteByFilter(ctx, &pb.DeleteByFilterRequest{
+		Namespace: "test", CollectionName: "logs", Filter: filter, DryRun: true, SampleSize: 2,
+	})
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if dry.Impact.Count != 3 || len(dry.Impact.SampleIds) != 2 || !dry.Impact.DryRun {
+		t.Errorf("unexpected dry run impact %v", dry.Impact)
+	}
+	if count, _ := server.Count(ctx, &pb.CountRequest{Namespace: "test", CollectionName: "logs"}); count.GetCount() != 6 {
+		t.Errorf("expected the dry run to delete nothing, got %d records", count.GetCount())
+	}
+
+	resp, err := server.DeleteByFilter(ctx, &pb.DeleteByFilterRequest{Namespace: "test", CollectionName: "logs", Filter: filter})
+	if err != nil {
+		t.Fatalf("DeleteByFilter failed: %v", err)
+	}
+	if resp.Impact.Count != 3 || resp.Impact.DryRun {
+		t.Errorf("unexpected impact %v", resp.Impact)
+	}
+	if count, _ := server.Count(ctx, &pb.CountRequest{Namespace: "test", CollectionName: "logs"}); count.GetCount() != 3 {
+		t.Errorf("expected 3 records left, got %d", count.GetCount())
+	}
+
+	for name, req := range map[string]*pb.DeleteByFilterRequest{
+		"no filter":    {Namespace: "test", CollectionName: "logs"},
+		"no criteria":  {Namespace: "test", CollectionName: "logs", Filter: &pb.SearchRequest{Limit: 5}},
+		"bad selector": {Namespace: "test", CollectionName: "logs", Filter: &pb.SearchRequest{LabelSelector: "a in ("}},
+	} {
+		if _, err := server.DeleteByFilter(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", name, err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package collection
 
 import (
 	"context"
+	"time"
 
 	pb "github.com/accretional/collector/gen/collector"
 )
@@ -16,6 +17,14 @@ type FileSystem interface {
 	Stat(ctx context.Context, path string) (int64, error)
 }
 
+// URLSigner is implemented by FileSystems backed by object storage that can
+// hand out presigned URLs, letting clients transfer files directly.
+type URLSigner interface {
+	// SignURL returns a URL allowing method ("GET" or "PUT") on path until
+	// expiry elapses.
+	SignURL(ctx context.Context, path, method string, expiry time.Duration) (string, error)
+}
+
 // CollectionRepo defines the interface for a collection repository.
 type CollectionRepo interface {
 	CreateCollection(ctx context.Context, collection *pb.Collection) (*pb.CreateCollectionResponse, error)
@@ -0,0 +1,332 @@
+package collection
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/jobs"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// JobsNamespace and JobsCollection name the collection that conventionally
+	// holds background jobs.
+	JobsNamespace  = "system"
+	JobsCollection = "jobs"
+)
+
+// Job kinds run by GrpcServer. Params and results are the messages of the
+// matching RPC.
+const (
+	JobKindBackup   = "backup"   // BackupCollectionRequest -> BackupCollectionResponse
+	JobKindClone    = "clone"    // CloneRequest -> CloneResponse, local or remote
+	JobKindFetch    = "fetch"    // FetchRequest -> FetchResponse
+	JobKindReindex  = "reindex"  // NamespacedName
+	JobKindVerify   = "verify"   // VerifyCollectionRequest -> VerifyCollectionResponse
+	JobKindRehearse = "rehearse" // RehearseRestoreRequest -> RehearseRestoreResponse
+	JobKindMigrate  = "migrate"  // MigrateRecordsRequest -> MigrateRecordsResponse
+
+	JobKindRollbackMigration = "rollback-migration" // RollbackMigrationRequest -> RollbackMigrationResponse
+)
+
+// JobStore is a jobs.Store kept in a collection, conventionally system/jobs
+// on a store of its own. Each record is a Job encoded as JSON with proto field
+// names, labelled with the job's labels, so jobs can also be searched with
+// the regular Search API.
+type JobStore struct {
+	coll *Collection
+	mu   sync.Mutex // serializes access so job updates never contend for the sqlite lock
+}
+
+// NewJobStore creates a JobStore backed by coll.
+func NewJobStore(coll *Collection) *JobStore {
+	return &JobStore{coll: coll}
+}
+
+var jobJSON = protojson.MarshalOptions{UseProtoNames: true}
+
+func (s *JobStore) Save(ctx context.Context, job *pb.Job) error {
+	data, err := jobJSON.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode job: %w", err)
+	}
+	record := &pb.CollectionRecord{Id: job.JobId, ProtoData: data, Metadata: &pb.Metadata{Labels: job.Labels}}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.coll.GetRecord(ctx, job.JobId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.coll.CreateRecord(ctx, record)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read job %s: %w", job.JobId, err)
+	}
+	record.Metadata.CreatedAt = existing.GetMetadata().GetCreatedAt()
+	return s.coll.UpdateRecord(ctx, record)
+}
+
+func (s *JobStore) Load(ctx context.Context, id string) (*pb.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := s.coll.GetRecord(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, jobs.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job %s: %w", id, err)
+	}
+	return decodeJob(record.ProtoData)
+}
+
+func (s *JobStore) List(ctx context.Context) ([]*pb.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results, err := s.coll.Search(ctx, &SearchQuery{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	list := make([]*pb.Job, 0, len(results))
+	for _, r := range results {
+		job, err := decodeJob(r.Record.ProtoData)
+		if err != nil {
+			continue
+		}
+		list = append(list, job)
+	}
+	return list, nil
+}
+
+func (s *JobStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.coll.DeleteRecord(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+func decodeJob(data []byte) (*pb.Job, error) {
+	job := &pb.Job{}
+	if err := protojson.Unmarshal(data, job); err != nil {
+		return nil, fmt.Errorf("failed to decode job: %w", err)
+	}
+	return job, nil
+}
+
+// newJobManager creates a job manager on store with the server's job kinds.
+func (s *GrpcServer) newJobManager(store jobs.Store, opts jobs.Options) *jobs.Manager {
+	m := jobs.NewManager(store, opts)
+
+	// Jobs that write locally wait for disk space rather than fill the disk
+	m.Register(JobKindBackup, jobs.Typed(func(ctx context.Context, req *pb.BackupCollectionRequest, _ jobs.ProgressFunc) (proto.Message, error) {
+		if err := s.disk.WaitForSpace(ctx, req.DestPath); err != nil {
+			return nil, err
+		}
+		resp, err := s.BackupCollection(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return resp, jobStatusError(resp.Status)
+	}), jobs.KindOptions{})
+
+	// Transfers are bandwidth-bound, so few run at once
+	m.Register(JobKindClone, jobs.Typed(func(ctx context.Context, req *pb.CloneRequest, progress jobs.ProgressFunc) (proto.Message, error) {
+		var resp *pb.CloneResponse
+		var err error
+		if req.DestEndpoint == "" {
+			if err := s.disk.WaitForSpace(ctx, s.cloneManager.layout.Root); err != nil {
+				return nil, err
+			}
+			resp, err = s.cloneManager.CloneLocal(ctx, req)
+		} else {
+			resp, err = s.cloneManager.cloneRemote(ctx, req, ProgressReporter(progress))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return resp, jobStatusError(resp.Status)
+	}), jobs.KindOptions{Concurrency: 2})
+
+	m.Register(JobKindFetch, jobs.Typed(func(ctx context.Context, req *pb.FetchRequest, progress jobs.ProgressFunc) (proto.Message, error) {
+		if err := s.disk.WaitForSpace(ctx, s.cloneManager.layout.Root); err != nil {
+			return nil, err
+		}
+		resp, err := s.cloneManager.fetchRemote(ctx, req, ProgressReporter(progress))
+		if err != nil {
+			return nil, err
+		}
+		return resp, jobStatusError(resp.Status)
+	}), jobs.KindOptions{Concurrency: 2})
+
+	m.Register(JobKindReindex, jobs.Typed(func(ctx context.Context, name *pb.NamespacedName, _ jobs.ProgressFunc) (proto.Message, error) {
+		collection, err := s.repo.GetCollection(ctx, name.Namespace, name.Name)
+		if err != nil {
+			return nil, jobs.Permanent(err)
+		}
+		return nil, collection.Store.ReIndex(ctx)
+	}), jobs.KindOptions{Concurrency: 1})
+
+	// Verification reads the whole store, so one runs at a time
+	m.Register(JobKindVerify, jobs.Typed(func(ctx context.Context, req *pb.VerifyCollectionRequest, _ jobs.ProgressFunc) (proto.Message, error) {
+		resp, err := s.VerifyCollection(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return resp, jobStatusError(resp.Status)
+	}), jobs.KindOptions{Concurrency: 1})
+
+	// Rehearsals restore a whole backup to disk
+	m.Register(JobKindRehearse, jobs.Typed(func(ctx context.Context, req *pb.RehearseRestoreRequest, _ jobs.ProgressFunc) (proto.Message, error) {
+		if err := s.disk.WaitForSpace(ctx, s.cloneManager.layout.Root); err != nil {
+			return nil, err
+		}
+		resp, err := s.RehearseRestore(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return resp, jobStatusError(resp.Status)
+	}), jobs.KindOptions{Concurrency: 1})
+
+	// Migrations rewrite a whole collection and report progress per batch
+	m.Register(JobKindMigrate, jobs.Typed(func(ctx context.Context, req *pb.MigrateRecordsRequest, progress jobs.ProgressFunc) (proto.Message, error) {
+		resp, err := s.migrateRecords(ctx, req, progress)
+		if err != nil {
+			return nil, err
+		}
+		return resp, jobStatusError(resp.Status)
+	}), jobs.KindOptions{Concurrency: 1})
+
+	m.Register(JobKindRollbackMigration, jobs.Typed(func(ctx context.Context, req *pb.RollbackMigrationRequest, progress jobs.ProgressFunc) (proto.Message, error) {
+		resp, err := s.rollbackMigration(ctx, req, progress)
+		if err != nil {
+			return nil, err
+		}
+		return resp, jobStatusError(resp.Status)
+	}), jobs.KindOptions{Concurrency: 1})
+
+	return m
+}
+
+// jobStatusError turns a failed response status into a job error. Internal
+// and unavailable failures may be transient and are retried.
+func jobStatusError(st *pb.Status) error {
+	switch st.GetCode() {
+	case pb.Status_OK:
+		return nil
+	case pb.Status_INTERNAL, pb.Status_UNAVAILABLE, pb.Status_ABORTED:
+		return fmt.Errorf("%s: %s", st.GetCode(), st.GetMessage())
+	default:
+		return jobs.Permanent(fmt.Errorf("%s: %s", st.GetCode(), st.GetMessage()))
+	}
+}
+
+// UseJobStore moves background jobs to store, typically a JobStore over
+// system/jobs, and resumes the jobs left unfinished there. Call it before
+// serving.
+func (s *GrpcServer) UseJobStore(ctx context.Context, store jobs.Store, opts jobs.Options) error {
+	m := s.newJobManager(store, opts)
+	if err := m.Start(ctx); err != nil {
+		return err
+	}
+	previous := s.jobs
+	s.jobs = m
+	previous.Stop()
+	return nil
+}
+
+// StopJobs stops background jobs. Unfinished jobs in a persistent store are
+// resumed by the next UseJobStore.
+func (s *GrpcServer) StopJobs() {
+	s.jobs.Stop()
+}
+
+// SubmitJob starts a background job.
+func (s *GrpcServer) SubmitJob(ctx context.Context, req *pb.SubmitJobRequest) (*pb.SubmitJobResponse, error) {
+	if req.Params == nil {
+		return &pb.SubmitJobResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "params are required"},
+		}, nil
+	}
+
+	job, err := s.jobs.Submit(ctx, req.Kind, req.Params, jobs.SubmitOptions{
+		MaxAttempts: int(req.MaxAttempts),
+		Labels:      req.Labels,
+	})
+	if errors.Is(err, jobs.ErrUnknownKind) {
+		return &pb.SubmitJobResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: err.Error()},
+		}, nil
+	}
+	if err != nil {
+		return &pb.SubmitJobResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()},
+		}, nil
+	}
+
+	return &pb.SubmitJobResponse{
+		Status: &pb.Status{Code: pb.Status_OK, Message: "Job submitted"},
+		Job:    job,
+	}, nil
+}
+
+// ListJobs lists background jobs, newest first.
+func (s *GrpcServer) ListJobs(ctx context.Context, req *pb.ListJobsRequest) (*pb.ListJobsResponse, error) {
+	selector, err := ParseLabelSelector(req.LabelSelector)
+	if err != nil {
+		return &pb.ListJobsResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: err.Error()},
+		}, nil
+	}
+
+	list, err := s.jobs.List(ctx, jobs.ListOptions{
+		Kind:   req.Kind,
+		States: req.States,
+		Match:  selector.Matches,
+		Limit:  int(req.Limit),
+	})
+	if err != nil {
+		return &pb.ListJobsResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()},
+		}, nil
+	}
+
+	return &pb.ListJobsResponse{Status: &pb.Status{Code: pb.Status_OK}, Jobs: list}, nil
+}
+
+// GetJob reports a background job's state.
+func (s *GrpcServer) GetJob(ctx context.Context, req *pb.GetJobRequest) (*pb.GetJobResponse, error) {
+	job, err := s.jobs.Get(ctx, req.JobId)
+	if err != nil {
+		return &pb.GetJobResponse{Status: jobErrorStatus(err)}, nil
+	}
+	return &pb.GetJobResponse{Status: &pb.Status{Code: pb.Status_OK}, Job: job}, nil
+}
+
+// CancelJob stops a background job.
+func (s *GrpcServer) CancelJob(ctx context.Context, req *pb.CancelJobRequest) (*pb.CancelJobResponse, error) {
+	job, err := s.jobs.Cancel(ctx, req.JobId)
+	if err != nil {
+		return &pb.CancelJobResponse{Status: jobErrorStatus(err)}, nil
+	}
+	return &pb.CancelJobResponse{
+		Status: &pb.Status{Code: pb.Status_OK, Message: "Job stopped"},
+		Job:    job,
+	}, nil
+}
+
+func jobErrorStatus(err error) *pb.Status {
+	if errors.Is(err, jobs.ErrNotFound) {
+		return &pb.Status{Code: pb.Status_NOT_FOUND, Message: err.Error()}
+	}
+	return &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()}
+}
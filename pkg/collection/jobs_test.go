@@ -0,0 +1,170 @@
+package collection_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/jobs"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// waitForJob polls GetJob until the job finishes.
+func waitForJob(t *testing.T, server *collection.GrpcServer, id string) *pb.Job {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := server.GetJob(context.Background(), &pb.GetJobRequest{JobId: id})
+		if err != nil || resp.Status.Code != pb.Status_OK {
+			t.Fatalf("GetJob failed: %v (%v)", resp, err)
+		}
+		if jobs.Finished(resp.Job.State) {
+			return resp.Job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return nil
+}
+
+func mustAny(t *testing.T, m proto.Message) *anypb.Any {
+	t.Helper()
+	a, err := anypb.New(m)
+	if err != nil {
+		t.Fatalf("anypb.New failed: %v", err)
+	}
+	return a
+}
+
+func TestGrpcServer_PersistentJobs(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	jobsColl, cleanupJobs := setupTestCollection(t)
+	defer cleanupJobs()
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "prod", Name: "users"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	users, _ := repo.GetCollection(ctx, "prod", "users")
+	users.CreateRecord(ctx, &pb.CollectionRecord{Id: "u1", ProtoData: []byte(`{"name": "ada"}`)})
+
+	server := collection.NewGrpcServerWithDataDir(repo, t.TempDir())
+	defer server.StopJobs()
+	if err := server.UseJobStore(ctx, collection.NewJobStore(jobsColl), jobs.Options{}); err != nil {
+		t.Fatalf("UseJobStore failed: %v", err)
+	}
+
+	reindex, err := server.SubmitJob(ctx, &pb.SubmitJobRequest{
+		Kind:   collection.JobKindReindex,
+		Params: mustAny(t, &pb.NamespacedName{Namespace: "prod", Name: "users"}),
+		Labels: map[string]string{"team": "search"},
+	})
+	if err != nil || reindex.Status.Code != pb.Status_OK {
+		t.Fatalf("SubmitJob failed: %v (%v)", reindex, err)
+	}
+	if job := waitForJob(t, server, reindex.Job.JobId); job.State != pb.JobState_JOB_SUCCEEDED {
+		t.Errorf("expected reindex to succeed, got %v", job)
+	}
+
+	backup, _ := server.SubmitJob(ctx, &pb.SubmitJobRequest{
+		Kind: collection.JobKindBackup,
+		Params: mustAny(t, &pb.BackupCollectionRequest{
+			Collection: &pb.NamespacedName{Namespace: "prod", Name: "users"},
+			DestPath:   filepath.Join(t.TempDir(), "users.db"),
+		}),
+	})
+	job := waitForJob(t, server, backup.Job.JobId)
+	result := &pb.BackupCollectionResponse{}
+	if job.State != pb.JobState_JOB_SUCCEEDED || job.Result.UnmarshalTo(result) != nil || result.Backup.GetBackupId() == "" {
+		t.Errorf("expected a backup result, got %v", job)
+	}
+
+	// Missing collections fail without retrying
+	missing, _ := server.SubmitJob(ctx, &pb.SubmitJobRequest{
+		Kind:   collection.JobKindReindex,
+		Params: mustAny(t, &pb.NamespacedName{Namespace: "prod", Name: "missing"}),
+	})
+	if job := waitForJob(t, server, missing.Job.JobId); job.State != pb.JobState_JOB_FAILED || job.Attempts != 1 {
+		t.Errorf("expected a single failed attempt, got %v", job)
+	}
+
+	list, err := server.ListJobs(ctx, &pb.ListJobsRequest{LabelSelector: "team=search"})
+	if err != nil || len(list.Jobs) != 1 || list.Jobs[0].JobId != reindex.Job.JobId {
+		t.Errorf("unexpected selector listing: %v (%v)", list, err)
+	}
+	list, _ = server.ListJobs(ctx, &pb.ListJobsRequest{States: []pb.JobState{pb.JobState_JOB_FAILED}})
+	if len(list.Jobs) != 1 || list.Jobs[0].JobId != missing.Job.JobId {
+		t.Errorf("unexpected state listing: %v", list)
+	}
+
+	// Jobs outlive the server: a fresh store over the same collection sees them
+	stored, err := collection.NewJobStore(jobsColl).Load(ctx, backup.Job.JobId)
+	if err != nil || stored.State != pb.JobState_JOB_SUCCEEDED {
+		t.Errorf("expected the backup job to be persisted, got %v (%v)", stored, err)
+	}
+}
+
+func TestGrpcServer_ResumesStoredJobs(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	jobsColl, cleanupJobs := setupTestCollection(t)
+	defer cleanupJobs()
+	repo.CreateCollection(ctx, &pb.Collection{Namespace: "prod", Name: "users"})
+
+	// A reindex left running by a collector that crashed
+	store := collection.NewJobStore(jobsColl)
+	err := store.Save(ctx, &pb.Job{
+		JobId:       "interrupted",
+		Kind:        collection.JobKindReindex,
+		State:       pb.JobState_JOB_RUNNING,
+		Params:      mustAny(t, &pb.NamespacedName{Namespace: "prod", Name: "users"}),
+		Attempts:    1,
+		MaxAttempts: 3,
+		CreatedAt:   time.Now().Unix(),
+	})
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	server := collection.NewGrpcServerWithDataDir(repo, t.TempDir())
+	defer server.StopJobs()
+	if err := server.UseJobStore(ctx, store, jobs.Options{}); err != nil {
+		t.Fatalf("UseJobStore failed: %v", err)
+	}
+	if job := waitForJob(t, server, "interrupted"); job.State != pb.JobState_JOB_SUCCEEDED || job.Attempts != 2 {
+		t.Errorf("expected the job to resume on its second attempt, got %v", job)
+	}
+}
+
+func TestGrpcServer_JobValidation(t *testing.T) {
+	ctx := context.Background()
+	_, server, _ := startRepoServer(t)
+
+	resp, err := server.SubmitJob(ctx, &pb.SubmitJobRequest{Kind: "compact", Params: mustAny(t, &pb.NamespacedName{})})
+	if err != nil || resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT for an unknown kind, got %v (%v)", resp, err)
+	}
+	resp, err = server.SubmitJob(ctx, &pb.SubmitJobRequest{Kind: collection.JobKindReindex})
+	if err != nil || resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT without params, got %v (%v)", resp, err)
+	}
+
+	list, err := server.ListJobs(ctx, &pb.ListJobsRequest{LabelSelector: "env in ()"})
+	if err != nil || list.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT for a bad selector, got %v (%v)", list, err)
+	}
+	got, err := server.GetJob(ctx, &pb.GetJobRequest{JobId: "missing"})
+	if err != nil || got.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND, got %v (%v)", got, err)
+	}
+	cancelled, err := server.CancelJob(ctx, &pb.CancelJobRequest{JobId: "missing"})
+	if err != nil || cancelled.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND, got %v (%v)", cancelled, err)
+	}
+}
@@ -0,0 +1,129 @@
+package collection
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Language selects how a collection's text is tokenized for full-text search.
+type Language string
+
+const (
+	// LanguageEnglish splits text on Unicode word boundaries and stems words
+	// with the Porter stemmer, so "running" matches "run". It is the default.
+	LanguageEnglish Language = "english"
+	// LanguageSimple splits text on Unicode word boundaries without stemming,
+	// for languages the English stemmer would mangle.
+	LanguageSimple Language = "simple"
+	// LanguageCJK indexes runs of Chinese, Japanese and Korean characters,
+	// which are written without spaces between words, as overlapping
+	// character pairs. Other text is handled as in LanguageEnglish.
+	LanguageCJK Language = "cjk"
+)
+
+// ParseLanguage returns the Language named s; the empty string is
+// LanguageEnglish.
+func ParseLanguage(s string) (Language, error) {
+	switch l := Language(strings.ToLower(s)); l {
+	case "", "en":
+		return LanguageEnglish, nil
+	case LanguageEnglish, LanguageSimple, LanguageCJK:
+		return l, nil
+	case "zh", "ja", "ko":
+		return LanguageCJK, nil
+	}
+	return "", fmt.Errorf("unknown language %q: want %s, %s or %s", s, LanguageEnglish, LanguageSimple, LanguageCJK)
+}
+
+// Tokenizer returns the SQLite FTS5 tokenizer for the language.
+func (l Language) Tokenizer() string {
+	if l == LanguageSimple {
+		return "unicode61 remove_diacritics 2"
+	}
+	return "porter unicode61"
+}
+
+// Segmented reports whether text in the language is segmented with
+// SegmentCJK before it is indexed and SegmentCJKQuery before it is searched.
+func (l Language) Segmented() bool {
+	return l == LanguageCJK
+}
+
+// SegmentCJK rewrites each run of Chinese, Japanese or Korean characters in
+// text as its overlapping character pairs separated by spaces, so a word
+// tokenizer indexes every pair: "東京都" becomes "東京 京都". Other text is
+// unchanged.
+func SegmentCJK(text string) string {
+	var out strings.Builder
+	segmentCJK(text, func(run []rune) {
+		out.WriteByte(' ')
+		out.WriteString(strings.Join(bigrams(run), " "))
+		out.WriteByte(' ')
+	}, func(r rune) {
+		out.WriteRune(r)
+	})
+	return out.String()
+}
+
+// SegmentCJKQuery rewrites the runs of Chinese, Japanese or Korean characters
+// in an FTS5 query to match text indexed with SegmentCJK. A run of several
+// characters becomes a phrase of its pairs, and a single character a prefix
+// query for the pairs it starts. Runs inside quoted phrases become part of
+// the phrase.
+func SegmentCJKQuery(query string) string {
+	var out strings.Builder
+	quoted := false
+	segmentCJK(query, func(run []rune) {
+		pairs := strings.Join(bigrams(run), " ")
+		switch {
+		case quoted:
+			out.WriteString(" " + pairs + " ")
+		case len(run) == 1:
+			out.WriteString(" " + pairs + "* ")
+		default:
+			out.WriteString(` "` + pairs + `" `)
+		}
+	}, func(r rune) {
+		if r == '"' {
+			quoted = !quoted
+		}
+		out.WriteRune(r)
+	})
+	return out.String()
+}
+
+// segmentCJK calls run for each run of CJK characters in text and other for
+// every other character, in order.
+func segmentCJK(text string, run func([]rune), other func(rune)) {
+	var pending []rune
+	for _, r := range text {
+		if isCJK(r) {
+			pending = append(pending, r)
+			continue
+		}
+		if len(pending) > 0 {
+			run(pending)
+			pending = pending[:0]
+		}
+		other(r)
+	}
+	if len(pending) > 0 {
+		run(pending)
+	}
+}
+
+func bigrams(run []rune) []string {
+	if len(run) == 1 {
+		return []string{string(run)}
+	}
+	pairs := make([]string, 0, len(run)-1)
+	for i := 0; i+1 < len(run); i++ {
+		pairs = append(pairs, string(run[i:i+2]))
+	}
+	return pairs
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
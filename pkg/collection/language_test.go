@@ -0,0 +1,46 @@
+package collection_test
+
+import (
+	"testing"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestSegmentCJK(t *testing.T) {
+	for text, want := range map[string]string{
+		"東京都":          " 東京 京都 ",
+		"Visit 東京 now": "Visit  東京  now",
+		"雨":            " 雨 ",
+		"no cjk here":  "no cjk here",
+	} {
+		if got := collection.SegmentCJK(text); got != want {
+			t.Errorf("SegmentCJK(%q) = %q, want %q", text, got, want)
+		}
+	}
+
+	for query, want := range map[string]string{
+		"東京都 OR rain": ` "東京 京都"  OR rain`,
+		"雨":           " 雨* ",
+		`"東京都 tower"`: `" 東京 京都  tower"`,
+	} {
+		if got := collection.SegmentCJKQuery(query); got != want {
+			t.Errorf("SegmentCJKQuery(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestParseLanguage(t *testing.T) {
+	for name, want := range map[string]collection.Language{
+		"":       collection.LanguageEnglish,
+		"simple": collection.LanguageSimple,
+		"ZH":     collection.LanguageCJK,
+		"cjk":    collection.LanguageCJK,
+	} {
+		if got, err := collection.ParseLanguage(name); err != nil || got != want {
+			t.Errorf("ParseLanguage(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if _, err := collection.ParseLanguage("klingon"); err == nil {
+		t.Error("expected an unknown language to be rejected")
+	}
+}
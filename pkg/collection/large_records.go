@@ -0,0 +1,225 @@
+package collection
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	// DefaultMaxRecordSize is the largest record CollectionServer accepts,
+	// however it is sent.
+	DefaultMaxRecordSize = 64 * 1024 * 1024
+
+	// messageOverhead is room left in a gRPC message for the fields around
+	// the record data.
+	messageOverhead = 64 * 1024
+)
+
+// RecordSizeLimits bounds the records CollectionServer handles.
+type RecordSizeLimits struct {
+	// MaxMessageSize is the gRPC message size limit of the server and its
+	// clients (see grpcconfig). Get refuses records that would not fit;
+	// they are read with DownloadRecord instead.
+	MaxMessageSize int
+	// MaxRecordSize is the hard cap on record data for Create, Update and
+	// UploadRecord.
+	MaxRecordSize int
+}
+
+// SetRecordSizeLimits changes the record size limits. Zero fields keep
+// their current values.
+func (s *CollectionServer) SetRecordSizeLimits(limits RecordSizeLimits) {
+	if limits.MaxMessageSize > 0 {
+		s.limits.MaxMessageSize = limits.MaxMessageSize
+	}
+	if limits.MaxRecordSize > 0 {
+		s.limits.MaxRecordSize = limits.MaxRecordSize
+	}
+}
+
+// checkRecordSize rejects record data over the hard cap.
+func (s *CollectionServer) checkRecordSize(size int) error {
+	if size > s.limits.MaxRecordSize {
+		return invalidRecord(codes.InvalidArgument, "item.value", ViolationMaxSize, nil, "record is %d bytes, over the %d byte limit", size, s.limits.MaxRecordSize)
+	}
+	return nil
+}
+
+// checkMessageSize rejects records that would not fit in one response
+// message. Clients fall back to DownloadRecord on ResourceExhausted, which
+// is also what the transport reports for oversized messages.
+func (s *CollectionServer) checkMessageSize(id string, size int) error {
+	if size > s.limits.MaxMessageSize-messageOverhead {
+		return status.Errorf(codes.ResourceExhausted, "record %s is %d bytes, too large for a %d byte message; use DownloadRecord", id, size, s.limits.MaxMessageSize)
+	}
+	return nil
+}
+
+// UploadRecord creates a record from a header followed by chunks of its
+// data, for records too large for Create.
+func (s *CollectionServer) UploadRecord(stream pb.CollectionService_UploadRecordServer) error {
+	ctx := stream.Context()
+
+	first, err := stream.Recv()
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to receive header: %v", err)
+	}
+	header := first.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "first message must be a header")
+	}
+	if err := s.checkRecordSize(int(header.TotalSize)); err != nil {
+		return err
+	}
+
+	collection, err := s.repo.GetCollection(ctx, header.Namespace, header.CollectionName)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+
+	var data bytes.Buffer
+	data.Grow(int(header.TotalSize))
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to receive chunk: %v", err)
+		}
+		chunk := msg.GetChunk()
+		if err := s.checkRecordSize(data.Len() + len(chunk)); err != nil {
+			return err
+		}
+		data.Write(chunk)
+	}
+	if header.TotalSize > 0 && int64(data.Len()) != header.TotalSize {
+		return status.Errorf(codes.InvalidArgument, "received %d of %d bytes", data.Len(), header.TotalSize)
+	}
+
+	stored, err := s.conform(ctx, collection, data.Bytes())
+	if err != nil {
+		return err
+	}
+	resp, err := createRecord(ctx, collection, header.Id, stored)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&pb.UploadRecordResponse{
+		Status:        resp.Status,
+		Id:            resp.Id,
+		BytesReceived: int64(data.Len()),
+	})
+}
+
+// DownloadRecord sends a record as a header followed by chunks of its data,
+// for records too large for Get.
+func (s *CollectionServer) DownloadRecord(req *pb.GetRequest, stream pb.CollectionService_DownloadRecordServer) error {
+	collection, record, err := s.getRecord(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+
+	if err := stream.Send(&pb.DownloadRecordResponse{
+		Data: &pb.DownloadRecordResponse_Header_{Header: &pb.DownloadRecordResponse_Header{
+			TypeUrl:   buildTypeUrl(collection),
+			TotalSize: int64(len(record.ProtoData)),
+		}},
+	}); err != nil {
+		return err
+	}
+	for data := record.ProtoData; len(data) > 0; {
+		n := min(len(data), ChunkSize)
+		if err := stream.Send(&pb.DownloadRecordResponse{
+			Data: &pb.DownloadRecordResponse_Chunk{Chunk: data[:n]},
+		}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// CreateLargeRecord creates a record through client, with Create when it
+// fits in a message of maxMessageSize bytes and with UploadRecord otherwise.
+func CreateLargeRecord(ctx context.Context, client pb.CollectionServiceClient, req *pb.CreateRequest, maxMessageSize int) (*pb.CreateResponse, error) {
+	data := req.Item.GetValue()
+	if len(data) <= maxMessageSize-messageOverhead {
+		return client.Create(ctx, req)
+	}
+
+	stream, err := client.UploadRecord(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload stream: %w", err)
+	}
+	if err := stream.Send(&pb.UploadRecordRequest{
+		Data: &pb.UploadRecordRequest_Header_{Header: &pb.UploadRecordRequest_Header{
+			Namespace:      req.Namespace,
+			CollectionName: req.CollectionName,
+			Id:             req.Id,
+			TotalSize:      int64(len(data)),
+		}},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to send header: %w", err)
+	}
+	for len(data) > 0 {
+		n := min(len(data), ChunkSize)
+		if err := stream.Send(&pb.UploadRecordRequest{
+			Data: &pb.UploadRecordRequest_Chunk{Chunk: data[:n]},
+		}); err != nil {
+			break // The server ended the stream; CloseAndRecv reports why
+		}
+		data = data[n:]
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CreateResponse{Status: resp.Status, Id: resp.Id}, nil
+}
+
+// GetLargeRecord reads a record through client with Get, falling back to
+// DownloadRecord when the record is too large for one message.
+func GetLargeRecord(ctx context.Context, client pb.CollectionServiceClient, req *pb.GetRequest) (*pb.GetResponse, error) {
+	resp, err := client.Get(ctx, req)
+	if status.Code(err) != codes.ResourceExhausted {
+		return resp, err
+	}
+
+	stream, err := client.DownloadRecord(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open download stream: %w", err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	header := first.GetHeader()
+	if header == nil {
+		return nil, fmt.Errorf("download stream did not start with a header")
+	}
+
+	var data bytes.Buffer
+	data.Grow(int(header.TotalSize))
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data.Write(msg.GetChunk())
+	}
+	if int64(data.Len()) != header.TotalSize {
+		return nil, fmt.Errorf("received %d of %d bytes", data.Len(), header.TotalSize)
+	}
+	return &pb.GetResponse{Item: &anypb.Any{TypeUrl: header.TypeUrl, Value: data.Bytes()}}, nil
+}
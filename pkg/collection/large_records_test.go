@@ -0,0 +1,128 @@
+package collection_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// serveCollections serves server over gRPC with default transport limits and
+// returns a client for it.
+func serveCollections(t *testing.T, server *collection.CollectionServer) pb.CollectionServiceClient {
+	t.Helper()
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	pb.RegisterCollectionServiceServer(grpcServer, server)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewCollectionServiceClient(conn)
+}
+
+func TestLargeRecords_ChunkedCreateAndGet(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	ctx := context.Background()
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "blobs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	server := collection.NewCollectionServer(repo)
+	client := serveCollections(t, server)
+
+	const messageLimit = 4 * 1024 * 1024
+	data := bytes.Repeat([]byte("0123456789abcdef"), 6*1024*1024/16) // 6MB
+	create := &pb.CreateRequest{
+		Namespace:      "test",
+		CollectionName: "blobs",
+		Id:             "big",
+		Item:           &anypb.Any{TypeUrl: "type.googleapis.com/test.Blob", Value: data},
+	}
+
+	// A single Create fails at the transport
+	if _, err := client.Create(ctx, create); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected Create to exceed the message limit, got %v", err)
+	}
+
+	// CreateLargeRecord streams it instead
+	created, err := collection.CreateLargeRecord(ctx, client, create, messageLimit)
+	if err != nil || created.Id != "big" {
+		t.Fatalf("CreateLargeRecord failed: %v (%v)", created, err)
+	}
+
+	// Get explains why it cannot send the record
+	get := &pb.GetRequest{Namespace: "test", CollectionName: "blobs", Id: "big"}
+	_, err = client.Get(ctx, get)
+	if status.Code(err) != codes.ResourceExhausted || !strings.Contains(err.Error(), "DownloadRecord") {
+		t.Errorf("expected Get to point at DownloadRecord, got %v", err)
+	}
+
+	// GetLargeRecord falls back to DownloadRecord
+	got, err := collection.GetLargeRecord(ctx, client, get)
+	if err != nil {
+		t.Fatalf("GetLargeRecord failed: %v", err)
+	}
+	if !bytes.Equal(got.Item.Value, data) {
+		t.Errorf("expected %d bytes back, got %d", len(data), len(got.Item.Value))
+	}
+
+	// Small records take the unary path both ways
+	small := &pb.CreateRequest{Namespace: "test", CollectionName: "blobs", Item: &anypb.Any{Value: []byte("small")}}
+	created, err = collection.CreateLargeRecord(ctx, client, small, messageLimit)
+	if err != nil || created.Id == "" {
+		t.Fatalf("CreateLargeRecord failed for a small record: %v (%v)", created, err)
+	}
+	got, err = collection.GetLargeRecord(ctx, client, &pb.GetRequest{Namespace: "test", CollectionName: "blobs", Id: created.Id})
+	if err != nil || string(got.Item.Value) != "small" {
+		t.Errorf("GetLargeRecord failed for a small record: %v (%v)", got, err)
+	}
+}
+
+func TestLargeRecords_HardCap(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	ctx := context.Background()
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "blobs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	server := collection.NewCollectionServer(repo)
+	server.SetRecordSizeLimits(collection.RecordSizeLimits{MaxRecordSize: 2 * 1024 * 1024})
+	client := serveCollections(t, server)
+
+	for name, size := range map[string]int{"unary": 3 * 1024 * 1024, "chunked": 5 * 1024 * 1024} {
+		_, err := collection.CreateLargeRecord(ctx, client, &pb.CreateRequest{
+			Namespace:      "test",
+			CollectionName: "blobs",
+			Item:           &anypb.Any{Value: make([]byte, size)},
+		}, 4*1024*1024)
+		if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "byte limit") {
+			t.Errorf("%s: expected a record size error, got %v", name, err)
+		}
+	}
+
+	// Updates are capped too
+	if _, err := client.Create(ctx, &pb.CreateRequest{Namespace: "test", CollectionName: "blobs", Id: "r", Item: &anypb.Any{Value: []byte("x")}}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	_, err := client.Update(ctx, &pb.UpdateRequest{Namespace: "test", CollectionName: "blobs", Id: "r", Item: &anypb.Any{Value: make([]byte, 3*1024*1024)}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected Update to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DefaultDataRoot is the directory a collector keeps its data in unless
+// configured otherwise.
+const DefaultDataRoot = "./data"
+
+// PathLayout decides where a collector's data lives under its data root.
+// Configure one on the server and pass it to the repo, clone, backup and
+// restore paths so that every component agrees on where a collection's
+// database and files are, and relocating the root moves them all.
+//
+//	<root>/collections/<namespace>/<name>.db   collection databases
+//	<root>/files/<namespace>/<name>/           collection files
+//	<root>/backups/metadata.db                 backup catalog
+//	<root>/snapshots/                          snapshots
+//	<root>/restores/<id>/                      restores replacing live collections
+//	<root>/<subsystem>/                        registry, repo, jobs, ...
+//
+// StorageRoots are further directories, such as other disks, that
+// MoveCollectionStorage may move collections to.
+type PathLayout struct {
+	Root         string
+	StorageRoots []string
+}
+
+// ErrStorageDirNotAllowed is returned for a directory outside the layout's
+// root and storage roots.
+var ErrStorageDirNotAllowed = errors.New("directory is outside the storage roots")
+
+// NewPathLayout returns the layout rooted at root, or at DefaultDataRoot if
+// root is empty.
+func NewPathLayout(root string) PathLayout {
+	if root == "" {
+		root = DefaultDataRoot
+	}
+	return PathLayout{Root: root}
+}
+
+// Dir returns the directory of a subsystem, e.g. "registry" or "jobs".
+func (l PathLayout) Dir(subsystem string) string {
+	return filepath.Join(l.Root, subsystem)
+}
+
+// CollectionsDir returns the directory holding collection databases.
+func (l PathLayout) CollectionsDir() string {
+	return l.Dir("collections")
+}
+
+// CollectionDB returns the database path of a collection.
+func (l PathLayout) CollectionDB(namespace, name string) string {
+	return filepath.Join(l.CollectionsDir(), namespace, name+".db")
+}
+
+// PartitionsDir returns the directory a partitioned store opened at
+// dbPath, where an unpartitioned one would keep its database, keeps its
+// partitions in.
+func PartitionsDir(dbPath string) string {
+	return strings.TrimSuffix(dbPath, ".db") + ".partitions"
+}
+
+// FilesDir returns the directory holding collection files.
+func (l PathLayout) FilesDir() string {
+	return l.Dir("files")
+}
+
+// CollectionFiles returns the files directory of a collection.
+func (l PathLayout) CollectionFiles(namespace, name string) string {
+	return filepath.Join(l.FilesDir(), namespace, name)
+}
+
+// BackupMetadata returns the path of the backup catalog.
+func (l PathLayout) BackupMetadata() string {
+	return filepath.Join(l.Dir("backups"), "metadata.db")
+}
+
+// SnapshotsDir returns the directory holding snapshots.
+func (l PathLayout) SnapshotsDir() string {
+	return l.Dir("snapshots")
+}
+
+// RestoresDir returns the directory holding the restores that replaced
+// live collections, each laid out like a data root of its own.
+func (l PathLayout) RestoresDir() string {
+	return l.Dir("restores")
+}
+
+// RepoDB returns the path of the repo's shared collection database.
+func (l PathLayout) RepoDB() string {
+	return filepath.Join(l.Dir("repo"), "collections.db")
+}
+
+// StorageDir checks that dir is the root, one of the storage roots, or a
+// directory under one, and returns it cleaned. Paths with ".." elements are
+// refused before cleaning, so they cannot climb out of a root.
+func (l PathLayout) StorageDir(dir string) (string, error) {
+	if slices.Contains(strings.Split(filepath.ToSlash(dir), "/"), "..") {
+		return "", fmt.Errorf("%w: %q contains \"..\"", ErrStorageDirNotAllowed, dir)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %q: %w", dir, err)
+	}
+	for _, root := range append([]string{l.Root}, l.StorageRoots...) {
+		rootAbs, err := filepath.Abs(root)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve storage root %q: %w", root, err)
+		}
+		if rel, err := filepath.Rel(rootAbs, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.Clean(dir), nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrStorageDirNotAllowed, dir)
+}
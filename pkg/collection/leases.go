@@ -0,0 +1,203 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// DefaultLeaseTTL is how long a lease lasts unless a TTL is given.
+	DefaultLeaseTTL = 30 * time.Second
+	// MaxLeaseTTL caps the TTL of a lease; holders renew longer ones.
+	MaxLeaseTTL = time.Hour
+)
+
+var (
+	// ErrRecordLeased is returned when acquiring, or writing without its
+	// token, a record another holder leases.
+	ErrRecordLeased = errors.New("record is leased by another holder")
+	// ErrLeaseNotHeld is returned when renewing or releasing a lease with a
+	// token that does not hold it, e.g. because it expired.
+	ErrLeaseNotHeld = errors.New("lease is not held")
+)
+
+// LeaseManager grants exclusive, expiring write leases on records. While a
+// record is leased, Collection.UpdateRecord and DeleteRecord require the
+// lease's token in their context (see WithLeaseToken); records without a live
+// lease can be written by anyone. Leases are kept in memory and lapse when
+// the server restarts, so a holder must tolerate losing one.
+type LeaseManager struct {
+	mu     sync.Mutex
+	leases map[string]*pb.Lease // by leaseKey
+}
+
+// NewLeaseManager creates a LeaseManager without leases.
+func NewLeaseManager() *LeaseManager {
+	return &LeaseManager{leases: make(map[string]*pb.Lease)}
+}
+
+func leaseKey(namespace, collection, id string) string {
+	return namespace + "/" + collection + "/" + id
+}
+
+// live returns the unexpired lease on a record, dropping an expired one.
+// Callers hold m.mu.
+func (m *LeaseManager) live(key string, now time.Time) *pb.Lease {
+	lease, ok := m.leases[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(lease.ExpiresAt.AsTime()) {
+		delete(m.leases, key)
+		return nil
+	}
+	return lease
+}
+
+// Acquire leases a record of c to holder for ttl, clamped to (0,
+// MaxLeaseTTL]. With the token of the current lease it renews that lease
+// instead. It fails with ErrRecordLeased while someone else holds the record,
+// and with ErrLeaseNotHeld when renewing a lease that has lapsed.
+func (m *LeaseManager) Acquire(c *Collection, id, holder, token string, ttl time.Duration) (*pb.Lease, error) {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	ttl = min(ttl, MaxLeaseTTL)
+	key := leaseKey(c.Meta.Namespace, c.Meta.Name, id)
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lease := m.live(key, now)
+	switch {
+	case lease != nil && lease.Token != token:
+		return nil, fmt.Errorf("%w: %s until %s", ErrRecordLeased, lease.Holder, lease.ExpiresAt.AsTime().Format(time.RFC3339))
+	case lease == nil && token != "":
+		return nil, ErrLeaseNotHeld
+	case lease == nil:
+		lease = &pb.Lease{
+			Namespace:      c.Meta.Namespace,
+			CollectionName: c.Meta.Name,
+			RecordId:       id,
+			Token:          uuid.New().String(),
+			Holder:         holder,
+			AcquiredAt:     timestamppb.New(now),
+		}
+		m.leases[key] = lease
+	}
+	lease.ExpiresAt = timestamppb.New(now.Add(ttl))
+	return proto.Clone(lease).(*pb.Lease), nil
+}
+
+// Release ends the lease token holds on a record of c. Releasing a lapsed
+// lease fails with ErrLeaseNotHeld.
+func (m *LeaseManager) Release(c *Collection, id, token string) error {
+	key := leaseKey(c.Meta.Namespace, c.Meta.Name, id)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lease := m.live(key, time.Now())
+	if lease == nil || lease.Token != token {
+		return ErrLeaseNotHeld
+	}
+	delete(m.leases, key)
+	return nil
+}
+
+// checkWrite reports whether a record of c may be written with the lease
+// token in ctx.
+func (m *LeaseManager) checkWrite(ctx context.Context, c *Collection, id string) error {
+	key := leaseKey(c.Meta.Namespace, c.Meta.Name, id)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lease := m.live(key, time.Now())
+	if lease != nil && lease.Token != leaseTokenFromContext(ctx) {
+		return fmt.Errorf("%w: %s until %s", ErrRecordLeased, lease.Holder, lease.ExpiresAt.AsTime().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// forget drops any lease on a deleted record.
+func (m *LeaseManager) forget(c *Collection, id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.leases, leaseKey(c.Meta.Namespace, c.Meta.Name, id))
+}
+
+type leaseTokenKey struct{}
+
+// WithLeaseToken returns a context whose writes present token for leased
+// records.
+func WithLeaseToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, leaseTokenKey{}, token)
+}
+
+func leaseTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(leaseTokenKey{}).(string)
+	return token
+}
+
+// leaseStatus converts lease errors to gRPC status errors.
+func leaseStatus(err error) error {
+	if errors.Is(err, ErrRecordLeased) || errors.Is(err, ErrLeaseNotHeld) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Errorf(codes.Internal, "%v", err)
+}
+
+// AcquireLease leases a record to the caller, or renews the caller's lease.
+func (s *CollectionServer) AcquireLease(ctx context.Context, req *pb.AcquireLeaseRequest) (*pb.AcquireLeaseResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if collection.Leases == nil {
+		return nil, status.Error(codes.FailedPrecondition, "leases are not enabled for this collection")
+	}
+	if req.TtlMs < 0 || req.TtlMs > MaxLeaseTTL.Milliseconds() {
+		return nil, status.Errorf(codes.InvalidArgument, "ttl_ms must be between 0 and %d", MaxLeaseTTL.Milliseconds())
+	}
+	exists, err := collection.Exists(ctx, req.RecordId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check record: %v", err)
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "record %s not found", req.RecordId)
+	}
+
+	holder := req.Holder
+	if holder == "" {
+		holder = PrincipalFromContext(ctx)
+	}
+	lease, err := collection.Leases.Acquire(collection, req.RecordId, holder, req.Token, time.Duration(req.TtlMs)*time.Millisecond)
+	if err != nil {
+		return nil, leaseStatus(err)
+	}
+	return &pb.AcquireLeaseResponse{Status: &pb.Status{Code: pb.Status_OK}, Lease: lease}, nil
+}
+
+// ReleaseLease ends a lease before it expires.
+func (s *CollectionServer) ReleaseLease(ctx context.Context, req *pb.ReleaseLeaseRequest) (*pb.ReleaseLeaseResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if collection.Leases == nil {
+		return nil, status.Error(codes.FailedPrecondition, "leases are not enabled for this collection")
+	}
+	if err := collection.Leases.Release(collection, req.RecordId, req.Token); err != nil {
+		return nil, leaseStatus(err)
+	}
+	return &pb.ReleaseLeaseResponse{Status: &pb.Status{Code: pb.Status_OK}}, nil
+}
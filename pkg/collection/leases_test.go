@@ -0,0 +1,112 @@
+package collection_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestCollectionServer_Leases(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "tasks"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	server := collection.NewCollectionServer(repo)
+	for _, id := range []string{"task-1", "task-2"} {
+		if _, err := server.Create(ctx, &pb.CreateRequest{
+			Namespace: "test", CollectionName: "tasks", Id: id, Item: &anypb.Any{Value: []byte(`{"state": "queued"}`)},
+		}); err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+	update := func(token string) error {
+		_, err := server.Update(ctx, &pb.UpdateRequest{
+			Namespace: "test", CollectionName: "tasks", Id: "task-1",
+			Item: &anypb.Any{Value: []byte(`{"state": "running"}`)}, LeaseToken: token,
+		})
+		return err
+	}
+
+	acquired, err := server.AcquireLease(collection.WithPrincipal(ctx, "worker-a"), &pb.AcquireLeaseRequest{
+		Namespace: "test", CollectionName: "tasks", RecordId: "task-1", TtlMs: 60000,
+	})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	lease := acquired.Lease
+	if lease.Holder != "worker-a" || lease.Token == "" {
+		t.Errorf("unexpected lease %v", lease)
+	}
+
+	// Only the holder can claim or write the record
+	_, err = server.AcquireLease(ctx, &pb.AcquireLeaseRequest{Namespace: "test", CollectionName: "tasks", RecordId: "task-1", Holder: "worker-b"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a second claim to fail, got %v", err)
+	}
+	if err := update(""); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected an update without the token to fail, got %v", err)
+	}
+	if _, err := server.Delete(ctx, &pb.DeleteRequest{Namespace: "test", CollectionName: "tasks", Id: "task-1", LeaseToken: "wrong"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a delete with the wrong token to fail, got %v", err)
+	}
+	if err := update(lease.Token); err != nil {
+		t.Errorf("expected the holder's update to succeed, got %v", err)
+	}
+	if _, err := server.Update(ctx, &pb.UpdateRequest{
+		Namespace: "test", CollectionName: "tasks", Id: "task-2", Item: &anypb.Any{Value: []byte(`{}`)},
+	}); err != nil {
+		t.Errorf("expected unleased records to stay writable, got %v", err)
+	}
+
+	renewed, err := server.AcquireLease(ctx, &pb.AcquireLeaseRequest{
+		Namespace: "test", CollectionName: "tasks", RecordId: "task-1", Token: lease.Token, TtlMs: 120000,
+	})
+	if err != nil || renewed.Lease.Token != lease.Token || !renewed.Lease.ExpiresAt.AsTime().After(lease.ExpiresAt.AsTime()) {
+		t.Fatalf("expected the lease to be renewed, got %v (%v)", renewed.GetLease(), err)
+	}
+
+	if _, err := server.ReleaseLease(ctx, &pb.ReleaseLeaseRequest{Namespace: "test", CollectionName: "tasks", RecordId: "task-1", Token: lease.Token}); err != nil {
+		t.Fatalf("ReleaseLease failed: %v", err)
+	}
+	if err := update(""); err != nil {
+		t.Errorf("expected the record to be writable after release, got %v", err)
+	}
+	if _, err := server.ReleaseLease(ctx, &pb.ReleaseLeaseRequest{Namespace: "test", CollectionName: "tasks", RecordId: "task-1", Token: lease.Token}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a second release to fail, got %v", err)
+	}
+
+	_, err = server.AcquireLease(ctx, &pb.AcquireLeaseRequest{Namespace: "test", CollectionName: "tasks", RecordId: "missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for a missing record, got %v", err)
+	}
+	_, err = server.AcquireLease(ctx, &pb.AcquireLeaseRequest{Namespace: "test", CollectionName: "tasks", RecordId: "task-2", TtlMs: int64(2 * time.Hour / time.Millisecond)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a long TTL, got %v", err)
+	}
+}
+
+func TestLeaseManager_Expiry(t *testing.T) {
+	coll := &collection.Collection{Meta: &pb.Collection{Namespace: "test", Name: "tasks"}}
+	leases := collection.NewLeaseManager()
+	lease, err := leases.Acquire(coll, "task-1", "worker-a", "", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	// A lapsed lease can be claimed by another holder but not renewed
+	if _, err := leases.Acquire(coll, "task-1", "worker-a", lease.Token, time.Second); err != collection.ErrLeaseNotHeld {
+		t.Errorf("expected ErrLeaseNotHeld renewing a lapsed lease, got %v", err)
+	}
+	if _, err := leases.Acquire(coll, "task-1", "worker-b", "", time.Second); err != nil {
+		t.Errorf("expected a lapsed lease to be claimable, got %v", err)
+	}
+}
@@ -0,0 +1,415 @@
+package collection
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// LegalHoldsNamespace and LegalHoldsCollection name the collection that
+	// conventionally holds legal holds and their audit trail.
+	LegalHoldsNamespace  = "system"
+	LegalHoldsCollection = "legal_holds"
+
+	// DefaultLegalHoldAuditLimit is how many audit events are listed unless
+	// a limit is given.
+	DefaultLegalHoldAuditLimit = 100
+)
+
+// Actions of LegalHoldAuditEvent.
+const (
+	LegalHoldPlace          = "place"
+	LegalHoldLift           = "lift"
+	LegalHoldUpdate         = "update"          // Collection.UpdateRecord
+	LegalHoldDelete         = "delete"          // Collection.DeleteRecord
+	LegalHoldRestore        = "restore"         // RestoreBackup overwriting the collection
+	LegalHoldPrune          = "prune"           // Backup retention
+	LegalHoldDropPartitions = "drop_partitions" // Collection.DropPartitionsBefore
+)
+
+var (
+	// ErrLegalHold is returned for operations a legal hold blocks.
+	ErrLegalHold = errors.New("held under legal hold")
+	// ErrLegalHoldNotFound is returned for holds that do not exist.
+	ErrLegalHoldNotFound = errors.New("legal hold not found")
+	// ErrLegalHoldDenied is returned when a principal who is not a custodian
+	// places or lifts a hold.
+	ErrLegalHoldDenied = errors.New("principal may not place or lift legal holds")
+	// ErrLegalHoldLifted is returned when lifting a hold already lifted.
+	ErrLegalHoldLifted = errors.New("legal hold is already lifted")
+)
+
+// LegalHolds keeps held collections and records from being updated,
+// deleted, overwritten by a restore or having their backups pruned until a
+// custodian lifts the hold. Placing and lifting holds, including denied
+// attempts, and every operation a hold blocks are kept as audit events.
+// Holds and events are kept in a collection, conventionally
+// system/legal_holds, as JSON with proto field names; active holds are also
+// kept in memory, as every write checks them.
+type LegalHolds struct {
+	coll       *Collection
+	custodians []string
+	mu         sync.Mutex // serializes read-modify-write of holds
+
+	activeMu sync.RWMutex
+	active   map[string]*pb.LegalHold // by ID
+}
+
+// NewLegalHolds creates LegalHolds kept in coll, loading its active holds.
+// Only custodians may place and lift holds; with none, any authenticated
+// principal (see AuthenticatedPrincipal) may.
+func NewLegalHolds(ctx context.Context, coll *Collection, custodians []string) (*LegalHolds, error) {
+	h := &LegalHolds{coll: coll, custodians: custodians, active: make(map[string]*pb.LegalHold)}
+	holds, err := h.search(ctx, map[string]string{"kind": "hold", "state": "active"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load legal holds: %w", err)
+	}
+	for _, hold := range holds {
+		h.active[hold.Id] = hold
+	}
+	return h, nil
+}
+
+func (h *LegalHolds) mayDecide(principal string) bool {
+	if principal == "" {
+		return false
+	}
+	return len(h.custodians) == 0 || slices.Contains(h.custodians, principal)
+}
+
+// Place holds a collection, or one of its records when recordID is set, on
+// behalf of principal.
+func (h *LegalHolds) Place(ctx context.Context, coll *Collection, recordID, principal, reason string) (*pb.LegalHold, error) {
+	name := &pb.NamespacedName{Namespace: coll.Meta.Namespace, Name: coll.Meta.Name}
+	if !h.mayDecide(principal) {
+		h.audit(ctx, LegalHoldPlace, name, recordID, principal, false, "", ErrLegalHoldDenied.Error())
+		return nil, ErrLegalHoldDenied
+	}
+	if recordID != "" {
+		if _, err := coll.GetRecord(ctx, recordID); err != nil {
+			return nil, fmt.Errorf("record %s: %w", recordID, err)
+		}
+	}
+
+	hold := &pb.LegalHold{
+		Id:         "hold-" + uuid.New().String(),
+		Collection: name,
+		RecordId:   recordID,
+		Reason:     reason,
+		PlacedBy:   principal,
+		PlacedAt:   timestamppb.Now(),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.save(ctx, hold, true); err != nil {
+		return nil, err
+	}
+	h.activeMu.Lock()
+	h.active[hold.Id] = hold
+	h.activeMu.Unlock()
+	h.audit(ctx, LegalHoldPlace, name, recordID, principal, true, hold.Id, reason)
+	return proto.Clone(hold).(*pb.LegalHold), nil
+}
+
+// Lift lifts a hold on behalf of principal.
+func (h *LegalHolds) Lift(ctx context.Context, id, principal, reason string) (*pb.LegalHold, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hold, err := h.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !h.mayDecide(principal) {
+		h.audit(ctx, LegalHoldLift, hold.Collection, hold.RecordId, principal, false, id, ErrLegalHoldDenied.Error())
+		return nil, ErrLegalHoldDenied
+	}
+	if hold.LiftedBy != "" {
+		return nil, fmt.Errorf("%w: lifted by %s", ErrLegalHoldLifted, hold.LiftedBy)
+	}
+
+	hold.LiftedBy = principal
+	hold.LiftReason = reason
+	hold.LiftedAt = timestamppb.Now()
+	if err := h.save(ctx, hold, false); err != nil {
+		return nil, err
+	}
+	h.activeMu.Lock()
+	delete(h.active, id)
+	h.activeMu.Unlock()
+	h.audit(ctx, LegalHoldLift, hold.Collection, hold.RecordId, principal, true, id, reason)
+	return hold, nil
+}
+
+// List returns holds newest first, limited to a namespace when it is set.
+// Only active holds are listed unless includeLifted is set.
+func (h *LegalHolds) List(ctx context.Context, namespace string, includeLifted bool) ([]*pb.LegalHold, error) {
+	labels := map[string]string{"kind": "hold"}
+	if namespace != "" {
+		labels["namespace"] = namespace
+	}
+	if !includeLifted {
+		labels["state"] = "active"
+	}
+	holds, err := h.search(ctx, labels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list legal holds: %w", err)
+	}
+	sort.Slice(holds, func(i, j int) bool {
+		return holds[i].PlacedAt.AsTime().After(holds[j].PlacedAt.AsTime())
+	})
+	return holds, nil
+}
+
+// Audit returns the newest audit events, at most limit of them or
+// DefaultLegalHoldAuditLimit, limited to a namespace when it is set.
+func (h *LegalHolds) Audit(ctx context.Context, namespace string, limit int) ([]*pb.LegalHoldAuditEvent, error) {
+	if limit <= 0 {
+		limit = DefaultLegalHoldAuditLimit
+	}
+	query := &SearchQuery{LabelFilters: map[string]string{"kind": "audit"}}
+	if namespace != "" {
+		query.LabelFilters["namespace"] = namespace
+	}
+	results, err := h.coll.Search(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list legal hold audit events: %w", err)
+	}
+	events := make([]*pb.LegalHoldAuditEvent, 0, len(results))
+	for _, r := range results {
+		event := &pb.LegalHoldAuditEvent{}
+		if err := protojson.Unmarshal(r.Record.ProtoData, event); err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].At.AsTime().After(events[j].At.AsTime())
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+// holding returns an active hold covering a record of a collection, or any
+// active hold on the collection or its records when recordID is empty.
+func (h *LegalHolds) holding(namespace, name, recordID string) *pb.LegalHold {
+	h.activeMu.RLock()
+	defer h.activeMu.RUnlock()
+	for _, hold := range h.active {
+		if hold.Collection.Namespace != namespace || hold.Collection.Name != name {
+			continue
+		}
+		if recordID == "" || hold.RecordId == "" || hold.RecordId == recordID {
+			return hold
+		}
+	}
+	return nil
+}
+
+// check returns ErrLegalHold, and audits the attempt, when a hold blocks
+// action on a record of a collection, or on the collection when recordID is
+// empty. h may be nil.
+func (h *LegalHolds) check(ctx context.Context, action, namespace, name, recordID string) error {
+	if h == nil {
+		return nil
+	}
+	hold := h.holding(namespace, name, recordID)
+	if hold == nil {
+		return nil
+	}
+	target := namespace + "/" + name
+	if recordID != "" {
+		target += "/" + recordID
+	}
+	err := fmt.Errorf("%w: cannot %s %s (hold %s)", ErrLegalHold, action, target, hold.Id)
+	h.audit(ctx, action, &pb.NamespacedName{Namespace: namespace, Name: name}, recordID,
+		AuthenticatedPrincipal(ctx), false, hold.Id, err.Error())
+	return err
+}
+
+// audit records an audit event, logging rather than failing when it cannot.
+func (h *LegalHolds) audit(ctx context.Context, action string, coll *pb.NamespacedName, recordID, principal string, allowed bool, holdID, message string) {
+	event := &pb.LegalHoldAuditEvent{
+		Id:         "audit-" + uuid.New().String(),
+		Action:     action,
+		Collection: coll,
+		RecordId:   recordID,
+		Principal:  principal,
+		Allowed:    allowed,
+		HoldId:     holdID,
+		Message:    message,
+		At:         timestamppb.Now(),
+	}
+	data, err := jobJSON.Marshal(event)
+	if err == nil {
+		err = h.coll.CreateRecord(ctx, &pb.CollectionRecord{Id: event.Id, ProtoData: data, Metadata: &pb.Metadata{
+			CreatedAt: event.At,
+			UpdatedAt: event.At,
+			Labels: map[string]string{
+				"kind":      "audit",
+				"namespace": coll.GetNamespace(),
+				"action":    action,
+			},
+		}})
+	}
+	if err != nil {
+		log.Printf("Warning: failed to audit legal hold %s of %s: %v", action, namespacedKey(coll), err)
+	}
+}
+
+// get reads a hold, or returns ErrLegalHoldNotFound. Callers hold h.mu.
+func (h *LegalHolds) get(ctx context.Context, id string) (*pb.LegalHold, error) {
+	record, err := h.coll.GetRecord(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrLegalHoldNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read legal hold %s: %w", id, err)
+	}
+	hold := &pb.LegalHold{}
+	if err := protojson.Unmarshal(record.ProtoData, hold); err != nil || hold.Collection == nil {
+		return nil, ErrLegalHoldNotFound
+	}
+	return hold, nil
+}
+
+func (h *LegalHolds) search(ctx context.Context, labels map[string]string) ([]*pb.LegalHold, error) {
+	results, err := h.coll.Search(ctx, &SearchQuery{LabelFilters: labels})
+	if err != nil {
+		return nil, err
+	}
+	holds := make([]*pb.LegalHold, 0, len(results))
+	for _, r := range results {
+		hold := &pb.LegalHold{}
+		if err := protojson.Unmarshal(r.Record.ProtoData, hold); err != nil || hold.Collection == nil {
+			continue
+		}
+		holds = append(holds, hold)
+	}
+	return holds, nil
+}
+
+func (h *LegalHolds) save(ctx context.Context, hold *pb.LegalHold, create bool) error {
+	data, err := jobJSON.Marshal(hold)
+	if err != nil {
+		return fmt.Errorf("failed to encode legal hold: %w", err)
+	}
+	state := "active"
+	if hold.LiftedBy != "" {
+		state = "lifted"
+	}
+	record := &pb.CollectionRecord{Id: hold.Id, ProtoData: data, Metadata: &pb.Metadata{
+		CreatedAt: hold.PlacedAt,
+		UpdatedAt: timestamppb.Now(),
+		Labels: map[string]string{
+			"kind":      "hold",
+			"namespace": hold.Collection.Namespace,
+			"state":     state,
+		},
+	}}
+	if create {
+		return h.coll.CreateRecord(ctx, record)
+	}
+	return h.coll.UpdateRecord(ctx, record)
+}
+
+// SetLegalHolds enables the legal hold RPCs and blocks restores overwriting,
+// and retention pruning the backups of, held collections. Give the
+// repository the same holds to block updates and deletes.
+func (s *GrpcServer) SetLegalHolds(holds *LegalHolds) {
+	s.holds = holds
+	s.backupManager.SetLegalHolds(holds)
+}
+
+func legalHoldErrorStatus(err error) *pb.Status {
+	switch {
+	case errors.Is(err, ErrLegalHoldNotFound), errors.Is(err, sql.ErrNoRows):
+		return &pb.Status{Code: pb.Status_NOT_FOUND, Message: err.Error()}
+	case errors.Is(err, ErrLegalHoldDenied):
+		return &pb.Status{Code: pb.Status_PERMISSION_DENIED, Message: err.Error()}
+	case errors.Is(err, ErrLegalHoldLifted):
+		return &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: err.Error()}
+	}
+	return &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()}
+}
+
+var errLegalHoldsDisabled = &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: "legal holds are not enabled on this server"}
+
+// PlaceLegalHold holds a collection or record on behalf of the calling
+// principal. Temporary collections cannot be held.
+func (s *GrpcServer) PlaceLegalHold(ctx context.Context, req *pb.PlaceLegalHoldRequest) (*pb.PlaceLegalHoldResponse, error) {
+	if s.holds == nil {
+		return &pb.PlaceLegalHoldResponse{Status: errLegalHoldsDisabled}, nil
+	}
+	if req.Collection.GetNamespace() == "" || req.Collection.GetName() == "" {
+		return &pb.PlaceLegalHoldResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection namespace and name are required"},
+		}, nil
+	}
+	coll, err := s.repo.GetCollection(ctx, req.Collection.Namespace, req.Collection.Name)
+	if err != nil {
+		return &pb.PlaceLegalHoldResponse{
+			Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: err.Error()},
+		}, nil
+	}
+	if coll.Meta.GetTemporary() != nil {
+		return &pb.PlaceLegalHoldResponse{
+			Status: &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: "temporary collections cannot be held"},
+		}, nil
+	}
+	hold, err := s.holds.Place(ctx, coll, req.RecordId, AuthenticatedPrincipal(ctx), req.Reason)
+	if err != nil {
+		return &pb.PlaceLegalHoldResponse{Status: legalHoldErrorStatus(err)}, nil
+	}
+	return &pb.PlaceLegalHoldResponse{Status: &pb.Status{Code: pb.Status_OK, Message: "Placed"}, Hold: hold}, nil
+}
+
+// LiftLegalHold lifts a hold on behalf of the calling principal.
+func (s *GrpcServer) LiftLegalHold(ctx context.Context, req *pb.LiftLegalHoldRequest) (*pb.LiftLegalHoldResponse, error) {
+	if s.holds == nil {
+		return &pb.LiftLegalHoldResponse{Status: errLegalHoldsDisabled}, nil
+	}
+	hold, err := s.holds.Lift(ctx, req.HoldId, AuthenticatedPrincipal(ctx), req.Reason)
+	if err != nil {
+		return &pb.LiftLegalHoldResponse{Status: legalHoldErrorStatus(err)}, nil
+	}
+	return &pb.LiftLegalHoldResponse{Status: &pb.Status{Code: pb.Status_OK, Message: "Lifted"}, Hold: hold}, nil
+}
+
+// ListLegalHolds lists holds, active ones by default.
+func (s *GrpcServer) ListLegalHolds(ctx context.Context, req *pb.ListLegalHoldsRequest) (*pb.ListLegalHoldsResponse, error) {
+	if s.holds == nil {
+		return &pb.ListLegalHoldsResponse{Status: errLegalHoldsDisabled}, nil
+	}
+	holds, err := s.holds.List(ctx, req.Namespace, req.IncludeLifted)
+	if err != nil {
+		return &pb.ListLegalHoldsResponse{Status: legalHoldErrorStatus(err)}, nil
+	}
+	return &pb.ListLegalHoldsResponse{Status: &pb.Status{Code: pb.Status_OK}, Holds: holds}, nil
+}
+
+// ListLegalHoldAudit lists the newest legal hold audit events.
+func (s *GrpcServer) ListLegalHoldAudit(ctx context.Context, req *pb.ListLegalHoldAuditRequest) (*pb.ListLegalHoldAuditResponse, error) {
+	if s.holds == nil {
+		return &pb.ListLegalHoldAuditResponse{Status: errLegalHoldsDisabled}, nil
+	}
+	events, err := s.holds.Audit(ctx, req.Namespace, int(req.Limit))
+	if err != nil {
+		return &pb.ListLegalHoldAuditResponse{Status: legalHoldErrorStatus(err)}, nil
+	}
+	return &pb.ListLegalHoldAuditResponse{Status: &pb.Status{Code: pb.Status_OK}, Events: events}, nil
+}
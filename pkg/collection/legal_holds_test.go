@@ -0,0 +1,171 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestLegalHolds(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	dir := t.TempDir()
+	layout := collection.NewPathLayout(filepath.Join(dir, "data"))
+	repo.SetPathLayout(layout)
+	server := collection.NewGrpcServerWithLayout(repo, layout)
+	clock := collection.NewFixedClock(time.Unix(1700000000, 0))
+	server.Backups().SetClock(clock)
+
+	holdsStore, err := sqlite.NewSqliteStore(filepath.Join(dir, "legal_holds.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create legal holds store: %v", err)
+	}
+	defer holdsStore.Close()
+	holdsColl, err := collection.NewCollection(
+		&pb.Collection{Namespace: collection.LegalHoldsNamespace, Name: collection.LegalHoldsCollection},
+		holdsStore, &collection.LocalFileSystem{})
+	if err != nil {
+		t.Fatalf("failed to create legal holds collection: %v", err)
+	}
+	holds, err := collection.NewLegalHolds(ctx, holdsColl, []string{"counsel"})
+	if err != nil {
+		t.Fatalf("NewLegalHolds failed: %v", err)
+	}
+	repo.SetLegalHolds(holds)
+	server.SetLegalHolds(holds)
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "docs")
+	for i := 0; i < 5; i++ {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: fmt.Sprintf("doc-%d", i), ProtoData: []byte(`{}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	docs := &pb.NamespacedName{Namespace: "test", Name: "docs"}
+	counsel := collection.WithPrincipal(ctx, "counsel")
+	mallory := collection.WithPrincipal(ctx, "mallory")
+
+	// Only custodians place holds
+	placed, _ := server.PlaceLegalHold(mallory, &pb.PlaceLegalHoldRequest{Collection: docs, RecordId: "doc-1"})
+	if placed.Status.Code != pb.Status_PERMISSION_DENIED {
+		t.Fatalf("expected PERMISSION_DENIED for a non-custodian, got %v", placed.Status)
+	}
+	placed, _ = server.PlaceLegalHold(counsel, &pb.PlaceLegalHoldRequest{Collection: docs, RecordId: "doc-1", Reason: "litigation"})
+	if placed.Status.Code != pb.Status_OK {
+		t.Fatalf("PlaceLegalHold failed: %v", placed.Status)
+	}
+	recordHold := placed.Hold.Id
+
+	// A held record can be neither deleted nor updated; others can
+	coll, _ = repo.GetCollection(ctx, "test", "docs")
+	if err := coll.DeleteRecord(mallory, "doc-1"); !errors.Is(err, collection.ErrLegalHold) {
+		t.Errorf("expected ErrLegalHold deleting a held record, got %v", err)
+	}
+	if err := coll.UpdateRecord(ctx, &pb.CollectionRecord{Id: "doc-1", ProtoData: []byte(`{"x": 1}`)}); !errors.Is(err, collection.ErrLegalHold) {
+		t.Errorf("expected ErrLegalHold updating a held record, got %v", err)
+	}
+	if err := coll.DeleteRecord(ctx, "doc-2"); err != nil {
+		t.Errorf("expected an unheld record deleted, got %v", err)
+	}
+
+	// A collection hold blocks overwriting restores and backup pruning
+	backup, _ := server.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: docs, DestPath: filepath.Join(dir, "backups", "docs-1.db")})
+	if backup.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", backup.Status)
+	}
+	placed, _ = server.PlaceLegalHold(counsel, &pb.PlaceLegalHoldRequest{Collection: docs})
+	if placed.Status.Code != pb.Status_OK {
+		t.Fatalf("PlaceLegalHold failed: %v", placed.Status)
+	}
+	collectionHold := placed.Hold.Id
+	restore, _ := server.RestoreBackup(ctx, &pb.RestoreBackupRequest{BackupId: backup.Backup.BackupId, DestNamespace: "test", DestName: "docs", Overwrite: true})
+	if restore.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION overwriting a held collection, got %v", restore.Status)
+	}
+	clock.Advance(time.Minute)
+	if backup, _ := server.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: docs, DestPath: filepath.Join(dir, "backups", "docs-2.db")}); backup.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", backup.Status)
+	}
+	server.Backups().SetRetentionPolicy(collection.RetentionPolicy{MaxCount: 1})
+	if pruned, err := server.Backups().Prune(ctx); err != nil || len(pruned) != 0 {
+		t.Errorf("expected nothing pruned while held, got %v %v", pruned, err)
+	}
+
+	// Lifting the holds lets the delete and pruning through
+	lifted, _ := server.LiftLegalHold(mallory, &pb.LiftLegalHoldRequest{HoldId: collectionHold})
+	if lifted.Status.Code != pb.Status_PERMISSION_DENIED {
+		t.Errorf("expected PERMISSION_DENIED lifting as a non-custodian, got %v", lifted.Status)
+	}
+	claimed := metadata.NewIncomingContext(ctx, metadata.Pairs(collection.PrincipalMetadataKey, "counsel"))
+	if lifted, _ := server.LiftLegalHold(claimed, &pb.LiftLegalHoldRequest{HoldId: collectionHold}); lifted.Status.Code != pb.Status_PERMISSION_DENIED {
+		t.Errorf("expected PERMISSION_DENIED lifting as a custodian named only in the header, got %v", lifted.Status)
+	}
+	for _, id := range []string{collectionHold, recordHold} {
+		lifted, _ = server.LiftLegalHold(counsel, &pb.LiftLegalHoldRequest{HoldId: id, Reason: "settled"})
+		if lifted.Status.Code != pb.Status_OK || lifted.Hold.LiftedBy != "counsel" {
+			t.Fatalf("LiftLegalHold failed: %v", lifted.Status)
+		}
+	}
+	if lifted, _ = server.LiftLegalHold(counsel, &pb.LiftLegalHoldRequest{HoldId: recordHold}); lifted.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION lifting a lifted hold, got %v", lifted.Status)
+	}
+	if err := coll.DeleteRecord(ctx, "doc-1"); err != nil {
+		t.Errorf("expected the delete allowed once lifted, got %v", err)
+	}
+	if pruned, err := server.Backups().Prune(ctx); err != nil || len(pruned) != 1 {
+		t.Errorf("expected the older backup pruned once lifted, got %v %v", pruned, err)
+	}
+
+	list, _ := server.ListLegalHolds(ctx, &pb.ListLegalHoldsRequest{Namespace: "test"})
+	if len(list.Holds) != 0 {
+		t.Errorf("expected no active holds, got %v", list.Holds)
+	}
+	list, _ = server.ListLegalHolds(ctx, &pb.ListLegalHoldsRequest{Namespace: "test", IncludeLifted: true})
+	if len(list.Holds) != 2 {
+		t.Errorf("expected both lifted holds listed, got %v", list.Holds)
+	}
+
+	// Every attempt is audited
+	audit, _ := server.ListLegalHoldAudit(ctx, &pb.ListLegalHoldAuditRequest{Namespace: "test"})
+	if audit.Status.Code != pb.Status_OK {
+		t.Fatalf("ListLegalHoldAudit failed: %v", audit.Status)
+	}
+	counts := map[string]int{}
+	for _, e := range audit.Events {
+		outcome := "allowed"
+		if !e.Allowed {
+			outcome = "blocked"
+		}
+		counts[e.Action+" "+outcome]++
+	}
+	want := map[string]int{
+		"place allowed": 2, "place blocked": 1,
+		"delete blocked": 1, "update blocked": 1, "restore blocked": 1, "prune blocked": 1,
+		"lift allowed": 2, "lift blocked": 2,
+	}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("expected audit events %v, got %v", want, counts)
+	}
+	for _, e := range audit.Events {
+		if e.Action == collection.LegalHoldDelete && (e.Principal != "mallory" || e.HoldId != recordHold) {
+			t.Errorf("expected the blocked delete attributed to mallory and the record hold, got %v", e)
+		}
+	}
+
+	disabled := collection.NewGrpcServerWithLayout(repo, layout)
+	if resp, _ := disabled.ListLegalHolds(ctx, &pb.ListLegalHoldsRequest{}); resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION without legal holds, got %v", resp.Status)
+	}
+}
@@ -0,0 +1,395 @@
+package collection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/jobs"
+	"google.golang.org/protobuf/proto"
+)
+
+// MigrationLabel is set on every record a migration rewrites, to the
+// migration's id, so RollbackMigration can find them.
+const MigrationLabel = "collector.migration"
+
+// DefaultMigrationBatchSize is how many records a migration reads and
+// writes per batch unless the request says otherwise.
+const DefaultMigrationBatchSize = 500
+
+// maxMigrationProblems is how many skipped and failed records a migration
+// lists. Problems past it are counted, not listed.
+const maxMigrationProblems = 100
+
+// ErrMigrationIrreversible is returned for migrations of a collection
+// without record history that are not marked irreversible.
+var ErrMigrationIrreversible = errors.New("record history is not enabled for this collection, so the migration could not be rolled back; set irreversible to migrate anyway")
+
+// MigrationStats counts what a migration or rollback did. For rollbacks,
+// Migrated counts the records restored.
+type MigrationStats struct {
+	Scanned, Migrated, Unchanged, Skipped, Failed int64
+	Problems                                      []*pb.VerifyProblem
+}
+
+func (st *MigrationStats) problem(recordID, format string, args ...interface{}) {
+	if len(st.Problems) < maxMigrationProblems {
+		st.Problems = append(st.Problems, &pb.VerifyProblem{RecordId: recordID, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// validateMapping checks that a mapping does something and that its paths
+// are well formed.
+func validateMapping(m *pb.FieldMapping) error {
+	if len(m.GetRenames()) == 0 && len(m.GetDrops()) == 0 && len(m.GetDefaults()) == 0 {
+		return errors.New("mapping has no renames, drops or defaults")
+	}
+	var paths []string
+	for from, to := range m.Renames {
+		if from == to {
+			return fmt.Errorf("rename of %q to itself", from)
+		}
+		paths = append(paths, from, to)
+	}
+	paths = append(paths, m.Drops...)
+	for path := range m.Defaults {
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+			return fmt.Errorf("invalid field path %q", path)
+		}
+	}
+	return nil
+}
+
+// ApplyFieldMapping rewrites a record's JSON data through a mapping: fields
+// are renamed, replacing whatever is at the new path, then dropped, then
+// defaults are set where absent. It reports whether anything changed, and
+// fails for data that is not a JSON object.
+func ApplyFieldMapping(data []byte, m *pb.FieldMapping) ([]byte, bool, error) {
+	obj, ok := decodeObject(data)
+	if !ok {
+		return nil, false, errors.New("data is not a JSON object")
+	}
+
+	changed := false
+	for from, to := range m.GetRenames() {
+		if v, ok := removePath(obj, from); ok {
+			setPath(obj, to, v)
+			changed = true
+		}
+	}
+	for _, path := range m.GetDrops() {
+		if _, ok := removePath(obj, path); ok {
+			changed = true
+		}
+	}
+	for path, v := range m.GetDefaults() {
+		if _, ok := lookupPath(obj, path); ok {
+			continue
+		}
+		setPath(obj, path, v.AsInterface())
+		changed = true
+	}
+	if !changed {
+		return data, false, nil
+	}
+	out, err := json.Marshal(obj)
+	return out, err == nil, err
+}
+
+// removePath deletes the value at a dotted path and returns it.
+func removePath(obj map[string]any, path string) (any, bool) {
+	key := path
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		v, _ := lookupPath(obj, path[:i])
+		parent, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		obj, key = parent, path[i+1:]
+	}
+	v, ok := obj[key]
+	delete(obj, key)
+	return v, ok
+}
+
+// MigrateRecords rewrites every JSON record of coll through a mapping, a
+// batch at a time, labelling each rewritten record with MigrationLabel set
+// to id. Records that are not JSON objects are skipped, and records that
+// cannot be written are counted as failed; neither stops the migration.
+// progress, if not nil, is called after each batch.
+func MigrateRecords(ctx context.Context, coll *Collection, id string, m *pb.FieldMapping, batchSize int, dryRun bool, progress jobs.ProgressFunc) (*MigrationStats, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultMigrationBatchSize
+	}
+	total, err := coll.CountRecords(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count records: %w", err)
+	}
+
+	stats := &MigrationStats{}
+	for offset := 0; ; offset += batchSize {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		records, err := coll.ListRecords(ctx, offset, batchSize)
+		if err != nil {
+			return stats, fmt.Errorf("failed to list records: %w", err)
+		}
+		for _, rec := range records {
+			stats.Scanned++
+			data, changed, err := ApplyFieldMapping(rec.ProtoData, m)
+			switch {
+			case err != nil:
+				stats.Skipped++
+				stats.problem(rec.Id, "skipped: %v", err)
+				continue
+			case !changed:
+				stats.Unchanged++
+				continue
+			case dryRun:
+				stats.Migrated++
+				continue
+			}
+
+			labels := maps.Clone(rec.GetMetadata().GetLabels())
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[MigrationLabel] = id
+			update := &pb.CollectionRecord{
+				Id:        rec.Id,
+				ProtoData: data,
+				DataUri:   rec.DataUri,
+				Metadata:  &pb.Metadata{CreatedAt: rec.GetMetadata().GetCreatedAt(), Labels: labels},
+			}
+			if err := coll.UpdateRecord(ctx, update); err != nil {
+				stats.Failed++
+				stats.problem(rec.Id, "write failed: %v", err)
+				continue
+			}
+			stats.Migrated++
+		}
+		if progress != nil {
+			progress(stats.Scanned, max(total, stats.Scanned))
+		}
+		if len(records) < batchSize {
+			return stats, nil
+		}
+	}
+}
+
+// RollbackMigration puts the records a migration rewrote back as they were
+// when it started, read from record history. Records written again since
+// keep the label, and lose those writes too. Records deleted since stay
+// deleted.
+func RollbackMigration(ctx context.Context, coll *Collection, id string, batchSize int, progress jobs.ProgressFunc) (*MigrationStats, error) {
+	started, err := migrationStart(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := historyReader(coll.Store); err != nil {
+		return nil, err
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultMigrationBatchSize
+	}
+
+	// Gather the ids first: restoring removes the label, which would shift
+	// pages of a search by it
+	var ids []string
+	err = eachRecord(ctx, coll, func(rec *pb.CollectionRecord) error {
+		if rec.GetMetadata().GetLabels()[MigrationLabel] == id {
+			ids = append(ids, rec.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &MigrationStats{}
+	for i, recordID := range ids {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		stats.Scanned++
+		previous, err := coll.GetRecordAsOf(ctx, recordID, started)
+		if err != nil {
+			stats.Failed++
+			stats.problem(recordID, "no version from before the migration: %v", err)
+			continue
+		}
+		restore := proto.Clone(previous).(*pb.CollectionRecord)
+		if restore.Metadata == nil {
+			restore.Metadata = &pb.Metadata{}
+		}
+		if err := coll.UpdateRecord(ctx, restore); err != nil {
+			stats.Failed++
+			stats.problem(recordID, "write failed: %v", err)
+			continue
+		}
+		stats.Migrated++
+		if progress != nil && ((i+1)%batchSize == 0 || i+1 == len(ids)) {
+			progress(int64(i+1), int64(len(ids)))
+		}
+	}
+	return stats, nil
+}
+
+// newMigrationID returns the id of a migration started at started. Ids
+// carry the start time, the point rollbacks restore records to.
+func newMigrationID(started time.Time) string {
+	return fmt.Sprintf("%d-%s", started.Unix(), HexIDGenerator{Bytes: 4}.NewID())
+}
+
+// migrationStart returns the start time carried by a migration id.
+func migrationStart(id string) (time.Time, error) {
+	secs, _, ok := strings.Cut(id, "-")
+	unix, err := strconv.ParseInt(secs, 10, 64)
+	if !ok || err != nil {
+		return time.Time{}, fmt.Errorf("invalid migration id %q", id)
+	}
+	return time.Unix(unix, 0), nil
+}
+
+// MigrateRecords rewrites a collection's records through a field mapping.
+// Unless the request is a dry run, its collection must keep record history
+// so RollbackMigration can undo it, or the request must be marked
+// irreversible. Submit it as a "migrate" job to run it in the background
+// with progress.
+func (s *GrpcServer) MigrateRecords(ctx context.Context, req *pb.MigrateRecordsRequest) (*pb.MigrateRecordsResponse, error) {
+	return s.migrateRecords(ctx, req, nil)
+}
+
+func (s *GrpcServer) migrateRecords(ctx context.Context, req *pb.MigrateRecordsRequest, progress jobs.ProgressFunc) (*pb.MigrateRecordsResponse, error) {
+	if req.Collection.GetNamespace() == "" || req.Collection.GetName() == "" {
+		return &pb.MigrateRecordsResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection namespace and name are required"},
+		}, nil
+	}
+	if err := validateMapping(req.Mapping); err != nil {
+		return &pb.MigrateRecordsResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: err.Error()},
+		}, nil
+	}
+	coll, err := s.repo.GetCollection(ctx, req.Collection.Namespace, req.Collection.Name)
+	if err != nil {
+		return &pb.MigrateRecordsResponse{
+			Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: err.Error()},
+		}, nil
+	}
+	if _, err := historyReader(coll.Store); err != nil && !req.DryRun && !req.Irreversible {
+		return &pb.MigrateRecordsResponse{
+			Status: &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: ErrMigrationIrreversible.Error()},
+		}, nil
+	}
+
+	started := coll.now()
+	id := newMigrationID(started)
+	if !req.DryRun {
+		// History has second granularity: start writing in the next second,
+		// so the versions current at the start are the ones before it
+		next := started.Truncate(time.Second).Add(time.Second)
+		select {
+		case <-time.After(next.Sub(started)):
+		case <-ctx.Done():
+			return &pb.MigrateRecordsResponse{
+				Status: &pb.Status{Code: pb.Status_CANCELLED, Message: ctx.Err().Error()},
+			}, nil
+		}
+	}
+
+	stats, err := MigrateRecords(ctx, coll, id, req.Mapping, int(req.BatchSize), req.DryRun, progress)
+	if stats == nil {
+		stats = &MigrationStats{}
+	}
+	resp := &pb.MigrateRecordsResponse{
+		Status:     &pb.Status{Code: pb.Status_OK},
+		Scanned:    stats.Scanned,
+		Migrated:   stats.Migrated,
+		Unchanged:  stats.Unchanged,
+		Skipped:    stats.Skipped,
+		Failed:     stats.Failed,
+		Problems:   stats.Problems,
+		StartedAt:  started.Unix(),
+		FinishedAt: coll.now().Unix(),
+	}
+	if !req.DryRun {
+		resp.MigrationId = id
+	}
+	key := req.Collection.Namespace + "/" + req.Collection.Name
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		resp.Status = &pb.Status{Code: pb.Status_CANCELLED, Message: fmt.Sprintf("migration of %s stopped after %d records: %v", key, stats.Scanned, err)}
+	case err != nil:
+		resp.Status = &pb.Status{Code: pb.Status_INTERNAL, Message: fmt.Sprintf("migration of %s stopped after %d records: %v", key, stats.Scanned, err)}
+	case req.DryRun:
+		resp.Status.Message = fmt.Sprintf("dry run: %d of %d records of %s would be migrated", stats.Migrated, stats.Scanned, key)
+	default:
+		resp.Status.Message = fmt.Sprintf("migrated %d of %d records of %s", stats.Migrated, stats.Scanned, key)
+	}
+	if stats.Failed > 0 {
+		log.Printf("Warning: migration %s of %s could not write %d records", id, key, stats.Failed)
+	}
+	return resp, nil
+}
+
+// RollbackMigration puts the records a migration rewrote back as they were
+// when it started. Submit it as a "rollback-migration" job to run it in the
+// background with progress.
+func (s *GrpcServer) RollbackMigration(ctx context.Context, req *pb.RollbackMigrationRequest) (*pb.RollbackMigrationResponse, error) {
+	return s.rollbackMigration(ctx, req, nil)
+}
+
+func (s *GrpcServer) rollbackMigration(ctx context.Context, req *pb.RollbackMigrationRequest, progress jobs.ProgressFunc) (*pb.RollbackMigrationResponse, error) {
+	if req.Collection.GetNamespace() == "" || req.Collection.GetName() == "" || req.MigrationId == "" {
+		return &pb.RollbackMigrationResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection namespace and name and migration_id are required"},
+		}, nil
+	}
+	if _, err := migrationStart(req.MigrationId); err != nil {
+		return &pb.RollbackMigrationResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: err.Error()},
+		}, nil
+	}
+	coll, err := s.repo.GetCollection(ctx, req.Collection.Namespace, req.Collection.Name)
+	if err != nil {
+		return &pb.RollbackMigrationResponse{
+			Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: err.Error()},
+		}, nil
+	}
+
+	stats, err := RollbackMigration(ctx, coll, req.MigrationId, int(req.BatchSize), progress)
+	if errors.Is(err, ErrHistoryUnavailable) {
+		return &pb.RollbackMigrationResponse{
+			Status: &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: err.Error()},
+		}, nil
+	}
+	if stats == nil {
+		stats = &MigrationStats{}
+	}
+	resp := &pb.RollbackMigrationResponse{
+		Status:   &pb.Status{Code: pb.Status_OK, Message: fmt.Sprintf("restored %d records of migration %s", stats.Migrated, req.MigrationId)},
+		Scanned:  stats.Scanned,
+		Restored: stats.Migrated,
+		Failed:   stats.Failed,
+		Problems: stats.Problems,
+	}
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		resp.Status = &pb.Status{Code: pb.Status_CANCELLED, Message: fmt.Sprintf("rollback of migration %s stopped after %d records: %v", req.MigrationId, stats.Scanned, err)}
+	case err != nil:
+		resp.Status = &pb.Status{Code: pb.Status_INTERNAL, Message: fmt.Sprintf("rollback of migration %s stopped after %d records: %v", req.MigrationId, stats.Scanned, err)}
+	}
+	return resp, nil
+}
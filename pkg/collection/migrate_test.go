@@ -0,0 +1,140 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestApplyFieldMapping(t *testing.T) {
+	mapping := &pb.FieldMapping{
+		Renames:  map[string]string{"zip": "address.postal_code", "fullName": "name"},
+		Drops:    []string{"legacy", "address.fax"},
+		Defaults: map[string]*structpb.Value{"active": structpb.NewBoolValue(true), "address.country": structpb.NewStringValue("US")},
+	}
+	tests := []struct {
+		name, data, want string
+		changed          bool
+	}{
+		{"everything applies", `{"fullName": "Ada", "zip": "02139", "legacy": 1, "address": {"fax": "555"}}`,
+			`{"active":true,"address":{"country":"US","postal_code":"02139"},"name":"Ada"}`, true},
+		{"already migrated", `{"name": "Ada", "active": false, "address": {"country": "UK"}}`,
+			`{"name": "Ada", "active": false, "address": {"country": "UK"}}`, false},
+		{"large numbers survive", `{"id": 9007199254740993, "active": true, "address": {"country": "US"}, "legacy": null}`,
+			`{"active":true,"address":{"country":"US"},"id":9007199254740993}`, true},
+	}
+	for _, tc := range tests {
+		got, changed, err := collection.ApplyFieldMapping([]byte(tc.data), mapping)
+		if err != nil || changed != tc.changed || string(got) != tc.want {
+			t.Errorf("%s: expected %s (changed=%v), got %s (changed=%v) %v", tc.name, tc.want, tc.changed, got, changed, err)
+		}
+	}
+	if _, _, err := collection.ApplyFieldMapping([]byte(`["not", "an", "object"]`), mapping); err == nil {
+		t.Error("expected data that is not an object refused")
+	}
+}
+
+func TestMigrateRecordsAndRollback(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := sqlite.NewSqliteStore(filepath.Join(dir, "repo.db"), collection.Options{EnableJSON: true, EnableHistory: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	repo := collection.NewCollectionRepo(store)
+	server := collection.NewGrpcServerWithDataDir(repo, dir)
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "users"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "users")
+	for i := 0; i < 7; i++ {
+		data := fmt.Sprintf(`{"fullName": "user %d"}`, i)
+		if i == 6 {
+			data = `{"name": "already migrated", "active": true}`
+		}
+		record := &pb.CollectionRecord{Id: fmt.Sprintf("user-%d", i), ProtoData: []byte(data), Metadata: &pb.Metadata{Labels: map[string]string{"team": "growth"}}}
+		if err := coll.CreateRecord(ctx, record); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "blob", ProtoData: []byte{0x0a, 0x01}}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	before, _ := coll.GetRecord(ctx, "user-0")
+
+	name := &pb.NamespacedName{Namespace: "test", Name: "users"}
+	mapping := &pb.FieldMapping{
+		Renames:  map[string]string{"fullName": "name"},
+		Defaults: map[string]*structpb.Value{"active": structpb.NewBoolValue(true)},
+	}
+
+	// A dry run counts without writing
+	dry, _ := server.MigrateRecords(ctx, &pb.MigrateRecordsRequest{Collection: name, Mapping: mapping, DryRun: true})
+	if dry.Status.Code != pb.Status_OK || dry.Migrated != 6 || dry.MigrationId != "" {
+		t.Fatalf("unexpected dry run %v", dry)
+	}
+	if got, _ := coll.GetRecord(ctx, "user-0"); string(got.ProtoData) != `{"fullName": "user 0"}` {
+		t.Errorf("expected a dry run to write nothing, got %s", got.ProtoData)
+	}
+
+	resp, _ := server.MigrateRecords(ctx, &pb.MigrateRecordsRequest{Collection: name, Mapping: mapping, BatchSize: 3})
+	if resp.Status.Code != pb.Status_OK || resp.Scanned != 8 || resp.Migrated != 6 || resp.Unchanged != 1 || resp.Skipped != 1 || resp.Failed != 0 {
+		t.Fatalf("unexpected migration %v", resp)
+	}
+	got, _ := coll.GetRecord(ctx, "user-0")
+	if string(got.ProtoData) != `{"active":true,"name":"user 0"}` {
+		t.Errorf("expected user-0 migrated, got %s", got.ProtoData)
+	}
+	labels := got.Metadata.Labels
+	if labels["team"] != "growth" || labels[collection.MigrationLabel] != resp.MigrationId || !got.Metadata.CreatedAt.AsTime().Equal(before.Metadata.CreatedAt.AsTime()) {
+		t.Errorf("expected labels and creation time kept, got %v", got.Metadata)
+	}
+
+	// Rolling back restores the records as they were
+	rb, _ := server.RollbackMigration(ctx, &pb.RollbackMigrationRequest{Collection: name, MigrationId: resp.MigrationId})
+	if rb.Status.Code != pb.Status_OK || rb.Restored != 6 || rb.Failed != 0 {
+		t.Fatalf("unexpected rollback %v", rb)
+	}
+	for i := 0; i < 6; i++ {
+		got, _ := coll.GetRecord(ctx, fmt.Sprintf("user-%d", i))
+		if string(got.ProtoData) != fmt.Sprintf(`{"fullName": "user %d"}`, i) || got.Metadata.Labels[collection.MigrationLabel] != "" || got.Metadata.Labels["team"] != "growth" {
+			t.Errorf("expected user-%d restored, got %s %v", i, got.ProtoData, got.Metadata.Labels)
+		}
+	}
+	if rb, _ := server.RollbackMigration(ctx, &pb.RollbackMigrationRequest{Collection: name, MigrationId: "not-an-id"}); rb.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected an invalid migration id refused, got %v", rb.Status)
+	}
+}
+
+func TestMigrateRecordsWithoutHistory(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewGrpcServerWithDataDir(repo, t.TempDir())
+	repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "users"})
+	coll, _ := repo.GetCollection(ctx, "test", "users")
+	coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "user-0", ProtoData: []byte(`{"legacy": 1}`)})
+
+	req := &pb.MigrateRecordsRequest{
+		Collection: &pb.NamespacedName{Namespace: "test", Name: "users"},
+		Mapping:    &pb.FieldMapping{Drops: []string{"legacy"}},
+	}
+	if resp, _ := server.MigrateRecords(ctx, req); resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Fatalf("expected a migration without history refused, got %v", resp.Status)
+	}
+	req.Irreversible = true
+	if resp, _ := server.MigrateRecords(ctx, req); resp.Status.Code != pb.Status_OK || resp.Migrated != 1 {
+		t.Fatalf("expected an irreversible migration to run, got %v", resp)
+	}
+	req.Mapping = &pb.FieldMapping{}
+	if resp, _ := server.MigrateRecords(ctx, req); resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected an empty mapping refused, got %v", resp.Status)
+	}
+}
@@ -0,0 +1,281 @@
+package collection
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// NamespaceMetadataKey is the gRPC metadata header binding a call to one
+// namespace. Like PrincipalMetadataKey it is not authenticated, so on its
+// own it is not a security boundary: a client sets it to leave the
+// namespace out of its requests. Deployments that confine tenants to their
+// namespace map each authenticated principal to its namespace with
+// NamespaceBindingOptions.Principals, against which the header is only a
+// hint that must agree, or attach the namespace with WithNamespace in an
+// interceptor of their own.
+const NamespaceMetadataKey = "x-collector-namespace"
+
+type namespaceKey struct{}
+
+// WithNamespace returns a context whose calls are bound to namespace. It
+// takes precedence over the NamespaceMetadataKey header.
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, namespace)
+}
+
+// NamespaceFromContext returns the namespace a call asks to be bound to,
+// from WithNamespace or the incoming NamespaceMetadataKey header, or "" if
+// it names none. A NamespaceBinding with principal mappings binds calls by
+// their principal instead.
+func NamespaceFromContext(ctx context.Context) string {
+	if ns, ok := ctx.Value(namespaceKey{}).(string); ok {
+		return ns
+	}
+	return incomingMetadata(ctx, NamespaceMetadataKey)
+}
+
+// namespaceFields are the request fields naming a namespace.
+var namespaceFields = map[protoreflect.Name]bool{"namespace": true, "dest_namespace": true, "namespaces": true}
+
+// NamespaceBindingOptions configures a NamespaceBinding.
+type NamespaceBindingOptions struct {
+	Required   bool              // Refuse calls not bound to a namespace
+	Aliases    *NamespaceAliases // Optional: lets bound calls name their namespace by an alias
+	Principals map[string]string // Optional: namespaces by authenticated principal, binding their calls
+}
+
+// NamespaceBinding confines calls bound to a namespace to it. With
+// Principals set, a call made by a mapped principal (see
+// AuthenticatedPrincipal) is bound to its namespace, and a
+// NamespaceMetadataKey header naming another is refused; calls by other
+// principals are bound only by WithNamespace, or narrowed by the header
+// when the binding is not Required. Without Principals the header binds
+// calls on its own. Every
+// namespace a request leaves empty, at any depth, is set to the bound one;
+// a request naming another namespace, or a method whose requests name none
+// (e.g. ListJobs or RenameNamespace), is refused with PERMISSION_DENIED.
+// So are requests that reach another namespace by other names: aliasing a
+// name that is not already the bound namespace's, or restoring a backup of
+// another namespace's collection.
+type NamespaceBinding struct {
+	opts    NamespaceBindingOptions
+	scoped  sync.Map // protoreflect.FullName -> bool: whether the message names a namespace
+	backups *BackupManager
+}
+
+// NewNamespaceBinding creates a NamespaceBinding.
+func NewNamespaceBinding(opts NamespaceBindingOptions) *NamespaceBinding {
+	return &NamespaceBinding{opts: opts}
+}
+
+// SetBackups looks up the backups bound calls restore by ID in backups, so
+// they can restore those of their namespace. Without it, bound calls cannot
+// restore by backup ID. Call it before serving requests.
+func (b *NamespaceBinding) SetBackups(backups *BackupManager) {
+	b.backups = backups
+}
+
+// bind applies the call's binding, if any, to a request.
+func (b *NamespaceBinding) bind(ctx context.Context, method string, req any) error {
+	namespace, err := b.namespace(ctx, method)
+	if err != nil {
+		return err
+	}
+	if namespace == "" {
+		if b.opts.Required {
+			return status.Errorf(codes.PermissionDenied, "%s refused: calls must be bound to a namespace (%s)", method, NamespaceMetadataKey)
+		}
+		return nil
+	}
+	msg, ok := req.(proto.Message)
+	if !ok || !b.namesNamespace(msg.ProtoReflect().Descriptor(), nil) {
+		return status.Errorf(codes.PermissionDenied, "%s is not available to calls bound to namespace %s", method, namespace)
+	}
+	if err := b.bindMessage(msg.ProtoReflect(), namespace); err != nil {
+		return err
+	}
+	return b.checkNames(ctx, msg, namespace)
+}
+
+// namespace returns the namespace a call is bound to, or "" if it is not.
+func (b *NamespaceBinding) namespace(ctx context.Context, method string) (string, error) {
+	if ns, ok := ctx.Value(namespaceKey{}).(string); ok {
+		return ns, nil
+	}
+	hint := incomingMetadata(ctx, NamespaceMetadataKey)
+	if len(b.opts.Principals) == 0 {
+		return hint, nil
+	}
+	principal := AuthenticatedPrincipal(ctx)
+	mapped, ok := b.opts.Principals[principal]
+	if !ok {
+		// The header only narrows what an unmapped caller may reach; it
+		// does not satisfy Required
+		if b.opts.Required {
+			return "", nil
+		}
+		return hint, nil
+	}
+	if hint != "" && b.check(hint, mapped) != nil {
+		return "", status.Errorf(codes.PermissionDenied, "%s refused: principal %s is bound to namespace %s, not %s", method, principal, mapped, hint)
+	}
+	return mapped, nil
+}
+
+// checkNames refuses requests that reach another namespace by other names
+// than its own: an alias, which must already be one of the bound
+// namespace's, and a backup, which must be of one of its collections.
+func (b *NamespaceBinding) checkNames(ctx context.Context, msg proto.Message, namespace string) error {
+	switch req := msg.(type) {
+	case *pb.AliasNamespaceRequest:
+		return b.check(req.Alias, namespace)
+	case *pb.RestoreBackupRequest:
+		if req.BackupId == "" {
+			return nil
+		}
+		if b.backups == nil {
+			return status.Errorf(codes.PermissionDenied, "restoring backups by ID is not available to calls bound to namespace %s", namespace)
+		}
+		// Backups that do not exist are refused alike, so bound calls
+		// cannot probe for other namespaces' backup IDs
+		backup, err := b.backups.metaStore.GetBackup(ctx, req.BackupId)
+		if err != nil || b.check(backup.GetCollection().GetNamespace(), namespace) != nil {
+			return status.Errorf(codes.PermissionDenied, "call is bound to namespace %s and cannot restore backup %s", namespace, req.BackupId)
+		}
+	}
+	return nil
+}
+
+// namesNamespace reports whether messages of md have a namespace field, at
+// any depth.
+func (b *NamespaceBinding) namesNamespace(md protoreflect.MessageDescriptor, visiting map[protoreflect.FullName]bool) bool {
+	if scoped, ok := b.scoped.Load(md.FullName()); ok {
+		return scoped.(bool)
+	}
+	if visiting[md.FullName()] {
+		return false
+	}
+	if visiting == nil {
+		visiting = make(map[protoreflect.FullName]bool)
+	}
+	visiting[md.FullName()] = true
+
+	// Own fields first, so a message is not cut short by a cycle back to it
+	scoped := false
+	fields := md.Fields()
+	for i := 0; i < fields.Len() && !scoped; i++ {
+		f := fields.Get(i)
+		scoped = namespaceFields[f.Name()] && f.Kind() == protoreflect.StringKind
+	}
+	for i := 0; i < fields.Len() && !scoped; i++ {
+		if f := fields.Get(i); f.Kind() == protoreflect.MessageKind && !f.IsMap() && !wellKnown(f.Message()) {
+			scoped = b.namesNamespace(f.Message(), visiting)
+		}
+	}
+	b.scoped.Store(md.FullName(), scoped)
+	return scoped
+}
+
+// bindMessage sets m's empty namespace fields, and those of the messages it
+// holds, to namespace, and refuses any naming another.
+func (b *NamespaceBinding) bindMessage(m protoreflect.Message, namespace string) error {
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		f := fields.Get(i)
+		switch {
+		case namespaceFields[f.Name()] && f.Kind() == protoreflect.StringKind && f.IsList():
+			if !m.Has(f) {
+				m.Mutable(f).List().Append(protoreflect.ValueOfString(namespace))
+				continue
+			}
+			list := m.Get(f).List()
+			for j := 0; j < list.Len(); j++ {
+				if err := b.check(list.Get(j).String(), namespace); err != nil {
+					return err
+				}
+			}
+		case namespaceFields[f.Name()] && f.Kind() == protoreflect.StringKind:
+			if m.Get(f).String() == "" {
+				m.Set(f, protoreflect.ValueOfString(namespace))
+			} else if err := b.check(m.Get(f).String(), namespace); err != nil {
+				return err
+			}
+		case f.Kind() == protoreflect.MessageKind && !f.IsMap() && !wellKnown(f.Message()):
+			if !m.Has(f) {
+				continue
+			}
+			if f.IsList() {
+				list := m.Mutable(f).List()
+				for j := 0; j < list.Len(); j++ {
+					if err := b.bindMessage(list.Get(j).Message(), namespace); err != nil {
+						return err
+					}
+				}
+			} else if err := b.bindMessage(m.Mutable(f).Message(), namespace); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check refuses a namespace other than the bound one, or an alias of it.
+func (b *NamespaceBinding) check(named, namespace string) error {
+	if named == namespace || (b.opts.Aliases != nil && b.opts.Aliases.Resolve(named) == b.opts.Aliases.Resolve(namespace)) {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "call is bound to namespace %s and cannot name namespace %s", namespace, named)
+}
+
+// wellKnown reports whether md is one of protobuf's own types, which never
+// name a namespace.
+func wellKnown(md protoreflect.MessageDescriptor) bool {
+	return strings.HasPrefix(string(md.FullName()), "google.protobuf.")
+}
+
+// UnaryInterceptor applies the call's namespace binding to its request.
+func (b *NamespaceBinding) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := b.bind(ctx, info.FullMethod, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// boundStream applies a namespace binding to every message received.
+type boundStream struct {
+	grpc.ServerStream
+	binding *NamespaceBinding
+	method  string
+}
+
+func (s *boundStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.binding.bind(s.Context(), s.method, m)
+}
+
+// StreamInterceptor applies the call's namespace binding to every message
+// of a stream, as it is received.
+func (b *NamespaceBinding) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		namespace, err := b.namespace(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		if namespace == "" && !b.opts.Required {
+			return handler(srv, ss)
+		}
+		return handler(srv, &boundStream{ServerStream: ss, binding: b, method: info.FullMethod})
+	}
+}
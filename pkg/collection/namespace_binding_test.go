@@ -0,0 +1,210 @@
+package collection_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// boundTo returns an incoming context bound to namespace by metadata.
+func boundTo(namespace string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(collection.NamespaceMetadataKey, namespace))
+}
+
+func TestNamespaceBinding_Unary(t *testing.T) {
+	aliases := collection.NewNamespaceAliases()
+	if err := aliases.Add("a", "tenant-a"); err != nil {
+		t.Fatalf("failed to add alias: %v", err)
+	}
+	intercept := collection.NewNamespaceBinding(collection.NamespaceBindingOptions{Aliases: aliases}).UnaryInterceptor()
+	call := func(ctx context.Context, method string, req proto.Message) (proto.Message, error) {
+		var seen proto.Message
+		_, err := intercept(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req any) (any, error) {
+			seen = req.(proto.Message)
+			return nil, nil
+		})
+		return seen, err
+	}
+
+	// Namespaces left out are filled in, at any depth
+	seen, err := call(boundTo("tenant-a"), "/collector.CollectionService/Batch", &pb.BatchRequest{
+		Operations: []*pb.RequestOp{{Operation: &pb.RequestOp_Create{Create: &pb.CreateRequest{Id: "r1"}}}},
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	batch := seen.(*pb.BatchRequest)
+	if batch.Namespace != "tenant-a" || batch.Operations[0].GetCreate().Namespace != "tenant-a" {
+		t.Errorf("expected tenant-a filled in, got %v", batch)
+	}
+	if seen, _ := call(boundTo("tenant-a"), "/collector.CollectionRepo/Discover", &pb.DiscoverRequest{}); seen.(*pb.DiscoverRequest).Namespace != "tenant-a" {
+		t.Errorf("expected discovery scoped to tenant-a, got %v", seen)
+	}
+
+	// The bound namespace, or an alias of it, may be named
+	for _, ns := range []string{"tenant-a", "a"} {
+		if _, err := call(boundTo("tenant-a"), "/collector.CollectionService/Get", &pb.GetRequest{Namespace: ns, CollectionName: "users", Id: "r1"}); err != nil {
+			t.Errorf("expected %s allowed, got %v", ns, err)
+		}
+	}
+
+	// Others are refused, as are methods that cannot be confined
+	for name, tc := range map[string]struct {
+		method string
+		req    proto.Message
+	}{
+		"other namespace": {"/collector.CollectionService/Get", &pb.GetRequest{Namespace: "tenant-b"}},
+		"nested":          {"/collector.CollectionRepo/Clone", &pb.CloneRequest{SourceCollection: &pb.NamespacedName{Namespace: "tenant-b", Name: "users"}}},
+		"destination":     {"/collector.CollectionRepo/CloneCollection", &pb.CloneCollectionRequest{DestNamespace: "tenant-b"}},
+		"unscoped":        {"/collector.CollectionRepo/RenameNamespace", &pb.RenameNamespaceRequest{From: "tenant-a", To: "tenant-b"}},
+		"claimed alias":   {"/collector.CollectionRepo/AliasNamespace", &pb.AliasNamespaceRequest{Alias: "tenant-b"}},
+		"backup by ID":    {"/collector.CollectionRepo/RestoreBackup", &pb.RestoreBackupRequest{BackupId: "b1", DestName: "users"}},
+	} {
+		if _, err := call(boundTo("tenant-a"), tc.method, tc.req); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s: expected PermissionDenied, got %v", name, err)
+		}
+	}
+
+	// WithNamespace takes precedence over the header, and unbound calls pass
+	if _, err := call(collection.WithNamespace(boundTo("tenant-a"), "tenant-b"), "/collector.CollectionService/Get", &pb.GetRequest{Namespace: "tenant-b"}); err != nil {
+		t.Errorf("expected the WithNamespace binding to apply, got %v", err)
+	}
+	if seen, err := call(context.Background(), "/collector.CollectionRepo/RenameNamespace", &pb.RenameNamespaceRequest{From: "x", To: "y"}); err != nil || seen == nil {
+		t.Errorf("expected an unbound call through, got %v", err)
+	}
+
+	required := collection.NewNamespaceBinding(collection.NamespaceBindingOptions{Required: true}).UnaryInterceptor()
+	if _, err := required(context.Background(), &pb.GetRequest{}, &grpc.UnaryServerInfo{FullMethod: "/collector.CollectionService/Get"}, nil); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected an unbound call refused when required, got %v", err)
+	}
+}
+
+func TestNamespaceBinding_Principals(t *testing.T) {
+	intercept := collection.NewNamespaceBinding(collection.NamespaceBindingOptions{
+		Required:   true,
+		Principals: map[string]string{"alice": "tenant-a"},
+	}).UnaryInterceptor()
+	get := func(ctx context.Context, req *pb.GetRequest) (*pb.GetRequest, error) {
+		var seen *pb.GetRequest
+		_, err := intercept(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/collector.CollectionService/Get"}, func(ctx context.Context, req any) (any, error) {
+			seen = req.(*pb.GetRequest)
+			return nil, nil
+		})
+		return seen, err
+	}
+	alice := func(ctx context.Context) context.Context { return collection.WithPrincipal(ctx, "alice") }
+
+	// A mapped principal is bound to its namespace, with or without the
+	// header naming it
+	for name, ctx := range map[string]context.Context{
+		"no header":       alice(context.Background()),
+		"matching header": alice(boundTo("tenant-a")),
+	} {
+		seen, err := get(ctx, &pb.GetRequest{CollectionName: "users", Id: "r1"})
+		if err != nil || seen.Namespace != "tenant-a" {
+			t.Errorf("%s: expected tenant-a filled in, got %v (%v)", name, seen, err)
+		}
+	}
+	if _, err := get(alice(context.Background()), &pb.GetRequest{Namespace: "tenant-b"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected alice refused another namespace, got %v", err)
+	}
+
+	// The header cannot move a principal out of its namespace, nor bind a
+	// caller the mapping does not
+	if _, err := get(alice(boundTo("tenant-b")), &pb.GetRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected a header disagreeing with the mapping refused, got %v", err)
+	}
+	for name, ctx := range map[string]context.Context{
+		"anonymous":         boundTo("tenant-b"),
+		"unmapped":          collection.WithPrincipal(boundTo("tenant-b"), "mallory"),
+		"claimed in header": metadata.NewIncomingContext(context.Background(), metadata.Pairs(collection.NamespaceMetadataKey, "tenant-a", collection.PrincipalMetadataKey, "alice")),
+	} {
+		if _, err := get(ctx, &pb.GetRequest{}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s: expected a header-only binding refused when required, got %v", name, err)
+		}
+	}
+}
+
+// recvStream is a server stream receiving msgs.
+type recvStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	msgs []*pb.UploadRecordRequest
+}
+
+func (s *recvStream) Context() context.Context { return s.ctx }
+
+func (s *recvStream) RecvMsg(m any) error {
+	proto.Merge(m.(proto.Message), s.msgs[0])
+	s.msgs = s.msgs[1:]
+	return nil
+}
+
+func TestNamespaceBinding_Stream(t *testing.T) {
+	intercept := collection.NewNamespaceBinding(collection.NamespaceBindingOptions{}).StreamInterceptor()
+	info := &grpc.StreamServerInfo{FullMethod: "/collector.CollectionService/UploadRecord"}
+	stream := &recvStream{ctx: boundTo("tenant-a"), msgs: []*pb.UploadRecordRequest{
+		{Data: &pb.UploadRecordRequest_Header_{Header: &pb.UploadRecordRequest_Header{CollectionName: "files"}}},
+		{Data: &pb.UploadRecordRequest_Header_{Header: &pb.UploadRecordRequest_Header{Namespace: "tenant-b"}}},
+	}}
+
+	err := intercept(nil, stream, info, func(srv any, ss grpc.ServerStream) error {
+		first := &pb.UploadRecordRequest{}
+		if err := ss.RecvMsg(first); err != nil || first.GetHeader().Namespace != "tenant-a" {
+			t.Errorf("expected tenant-a filled into the header, got %v %v", first, err)
+		}
+		return ss.RecvMsg(&pb.UploadRecordRequest{})
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected a message naming another namespace refused, got %v", err)
+	}
+}
+
+func TestNamespaceBinding_Backups(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewGrpcServerWithDataDir(repo, t.TempDir())
+	backupOf := func(namespace string) string {
+		t.Helper()
+		if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: namespace, Name: "users"}); err != nil {
+			t.Fatalf("failed to create collection: %v", err)
+		}
+		resp, err := server.BackupCollection(ctx, &pb.BackupCollectionRequest{
+			Collection: &pb.NamespacedName{Namespace: namespace, Name: "users"},
+			DestPath:   filepath.Join(t.TempDir(), namespace+".db"),
+		})
+		if err != nil || resp.Status.Code != pb.Status_OK {
+			t.Fatalf("backup of %s failed: %v %v", namespace, resp, err)
+		}
+		return resp.Backup.BackupId
+	}
+	own, other := backupOf("tenant-a"), backupOf("tenant-b")
+
+	binding := collection.NewNamespaceBinding(collection.NamespaceBindingOptions{})
+	binding.SetBackups(server.Backups())
+	intercept := binding.UnaryInterceptor()
+	restore := func(backupID string) error {
+		_, err := intercept(boundTo("tenant-a"), &pb.RestoreBackupRequest{BackupId: backupID, DestName: "restored"},
+			&grpc.UnaryServerInfo{FullMethod: "/collector.CollectionRepo/RestoreBackup"},
+			func(ctx context.Context, req any) (any, error) { return nil, nil })
+		return err
+	}
+
+	if err := restore(own); err != nil {
+		t.Errorf("expected tenant-a's backup restorable, got %v", err)
+	}
+	for name, id := range map[string]string{"other namespace": other, "unknown": "no-such-backup"} {
+		if err := restore(id); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s: expected PermissionDenied, got %v", name, err)
+		}
+	}
+}
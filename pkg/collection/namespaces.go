@@ -0,0 +1,405 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// ErrInvalidAlias is returned for aliases that are empty, contain a
+	// slash, name themselves or are the target of other aliases.
+	ErrInvalidAlias = errors.New("invalid namespace alias")
+	// ErrRenameConflict is returned when a namespace cannot be renamed
+	// because its new name is taken or one of its collections cannot move.
+	ErrRenameConflict = errors.New("namespace cannot be renamed")
+	// ErrNamespaceInUse is returned for a namespace that holds collections,
+	// services or other state, and so cannot be renamed onto or become an
+	// alias.
+	ErrNamespaceInUse = errors.New("namespace is in use")
+)
+
+// NamespaceAliases maps alternative names of namespaces to their canonical
+// names, so that "prod" can also be addressed as "production" during a
+// migration. It is safe for concurrent use, and a nil *NamespaceAliases
+// resolves every namespace to itself.
+type NamespaceAliases struct {
+	mu      sync.RWMutex
+	aliases map[string]string // alias -> canonical namespace
+}
+
+// NewNamespaceAliases creates an empty alias table.
+func NewNamespaceAliases() *NamespaceAliases {
+	return &NamespaceAliases{aliases: make(map[string]string)}
+}
+
+// Resolve returns the canonical name of namespace.
+func (a *NamespaceAliases) Resolve(namespace string) string {
+	if a == nil {
+		return namespace
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if target, ok := a.aliases[namespace]; ok {
+		return target
+	}
+	return namespace
+}
+
+// Add makes alias another name for namespace, replacing any previous target
+// of alias. An alias of an alias points at the latter's target.
+func (a *NamespaceAliases) Add(alias, namespace string) error {
+	if alias == "" || namespace == "" || strings.Contains(alias, "/") {
+		return fmt.Errorf("%w: %q", ErrInvalidAlias, alias)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if target, ok := a.aliases[namespace]; ok {
+		namespace = target
+	}
+	if alias == namespace {
+		return fmt.Errorf("%w: %q names itself", ErrInvalidAlias, alias)
+	}
+	for other, target := range a.aliases {
+		if target == alias {
+			return fmt.Errorf("%w: %q is the target of alias %q", ErrInvalidAlias, alias, other)
+		}
+	}
+	a.aliases[alias] = namespace
+	return nil
+}
+
+// Remove deletes alias, reporting whether it existed.
+func (a *NamespaceAliases) Remove(alias string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.aliases[alias]
+	delete(a.aliases, alias)
+	return ok
+}
+
+// List returns the aliases, sorted by alias.
+func (a *NamespaceAliases) List() []*pb.NamespaceAlias {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	list := make([]*pb.NamespaceAlias, 0, len(a.aliases))
+	for alias, target := range a.aliases {
+		list = append(list, &pb.NamespaceAlias{Alias: alias, Namespace: target})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Alias < list[j].Alias })
+	return list
+}
+
+// retarget points the aliases of from at to after from was renamed, and
+// makes from itself an alias of to if keep is set.
+func (a *NamespaceAliases) retarget(from, to string, keep bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for alias, target := range a.aliases {
+		if target == from {
+			a.aliases[alias] = to
+		}
+	}
+	if keep {
+		a.aliases[from] = to
+	}
+}
+
+// NamespaceRenamer is a subsystem holding state keyed by namespace: the
+// repository's collections, the registry's services, the dispatcher's
+// advertised namespaces.
+type NamespaceRenamer interface {
+	// CheckNamespaceUnused returns an ErrNamespaceInUse error if namespace
+	// holds anything.
+	CheckNamespaceUnused(ctx context.Context, namespace string) error
+	// CheckNamespaceRename reports why from cannot be renamed to to,
+	// without changing anything.
+	CheckNamespaceRename(ctx context.Context, from, to string) error
+	// RenameNamespace moves everything in from to to.
+	RenameNamespace(ctx context.Context, from, to string) error
+}
+
+// RenameNamespace renames from to to in every renamer, all or nothing: all
+// of them are checked before any is changed, and if one then fails, those
+// already renamed are renamed back. Aliases of from are pointed at
+// to, and with keepAlias from itself becomes an alias of to so that clients
+// still using it keep working.
+func RenameNamespace(ctx context.Context, aliases *NamespaceAliases, from, to string, keepAlias bool, renamers ...NamespaceRenamer) error {
+	if from == "" || to == "" || from == to || strings.Contains(to, "/") {
+		return fmt.Errorf("%w: cannot rename %q to %q", ErrRenameConflict, from, to)
+	}
+	if to == AttachmentsNamespace {
+		return fmt.Errorf("%w: %w", ErrRenameConflict, ErrReservedNamespace)
+	}
+	if aliases.Resolve(from) != from {
+		return fmt.Errorf("%w: %q is an alias; rename %q instead", ErrRenameConflict, from, aliases.Resolve(from))
+	}
+	if aliases.Resolve(to) != to {
+		return fmt.Errorf("%w: %q is an alias of %q", ErrRenameConflict, to, aliases.Resolve(to))
+	}
+	for _, r := range renamers {
+		if err := r.CheckNamespaceRename(ctx, from, to); err != nil {
+			return err
+		}
+	}
+	for i, r := range renamers {
+		if err := r.RenameNamespace(ctx, from, to); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if undoErr := renamers[j].RenameNamespace(ctx, to, from); undoErr != nil {
+					log.Printf("Warning: failed to undo renaming namespace %s to %s: %v", from, to, undoErr)
+				}
+			}
+			return fmt.Errorf("rename namespace %s to %s: %w", from, to, err)
+		}
+	}
+	if aliases != nil {
+		aliases.retarget(from, to, keepAlias)
+	}
+	return nil
+}
+
+// CheckNamespaceAlias returns an ErrNamespaceInUse error if alias is in use
+// in any of renamers: once aliased, what it holds could no longer be
+// addressed. AddNamespaceAlias checks new aliases with it; check the aliases
+// a collector starts with once its renamers have loaded their state.
+func CheckNamespaceAlias(ctx context.Context, alias string, renamers ...NamespaceRenamer) error {
+	for _, r := range renamers {
+		if err := r.CheckNamespaceUnused(ctx, alias); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddNamespaceAlias makes alias another name for namespace in aliases if
+// CheckNamespaceAlias allows it.
+func AddNamespaceAlias(ctx context.Context, aliases *NamespaceAliases, alias, namespace string, renamers ...NamespaceRenamer) error {
+	if err := CheckNamespaceAlias(ctx, alias, renamers...); err != nil {
+		return err
+	}
+	return aliases.Add(alias, namespace)
+}
+
+// SetNamespaceAliases makes the repository resolve aliases wherever a
+// collection is addressed by namespace. Call it before serving requests.
+func (r *DefaultCollectionRepo) SetNamespaceAliases(aliases *NamespaceAliases) {
+	r.aliases = aliases
+}
+
+// resolveCollection returns collection with its namespace resolved, cloned
+// if the namespace was an alias.
+func (r *DefaultCollectionRepo) resolveCollection(collection *pb.Collection) *pb.Collection {
+	if ns := r.aliases.Resolve(collection.GetNamespace()); ns != collection.GetNamespace() {
+		collection = proto.Clone(collection).(*pb.Collection)
+		collection.Namespace = ns
+	}
+	return collection
+}
+
+// namespaceKeys returns the names of the collections in namespace. Callers
+// hold r.service.mu.
+func (r *DefaultCollectionRepo) namespaceKeys(namespace string) []string {
+	var names []string
+	for key := range r.service.collections {
+		if ns, name, _ := strings.Cut(key, "/"); ns == namespace {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// CheckNamespaceUnused reports namespaces that have collections.
+func (r *DefaultCollectionRepo) CheckNamespaceUnused(ctx context.Context, namespace string) error {
+	r.service.mu.RLock()
+	defer r.service.mu.RUnlock()
+	if len(r.namespaceKeys(namespace)) > 0 {
+		return fmt.Errorf("%w: %s has collections", ErrNamespaceInUse, namespace)
+	}
+	return nil
+}
+
+// CheckNamespaceRename refuses to rename into a namespace that has
+// collections, and to move temporary or queue collections or ones whose
+// storage is being moved.
+func (r *DefaultCollectionRepo) CheckNamespaceRename(ctx context.Context, from, to string) error {
+	if err := r.CheckNamespaceUnused(ctx, to); err != nil {
+		return fmt.Errorf("%w: %w", ErrRenameConflict, err)
+	}
+	r.service.mu.RLock()
+	defer r.service.mu.RUnlock()
+	r.storageMu.Lock()
+	defer r.storageMu.Unlock()
+	for _, name := range r.namespaceKeys(from) {
+		key := from + "/" + name
+		meta := r.service.collections[key]
+		switch {
+		case meta.GetTemporary() != nil:
+			return fmt.Errorf("%w: %s is temporary", ErrRenameConflict, key)
+		case meta.GetQueue().GetEnabled():
+			return fmt.Errorf("%w: %s is a queue, whose messages are keyed by collection", ErrRenameConflict, key)
+		case r.moving[key]:
+			return fmt.Errorf("%w: %s is moving storage", ErrRenameConflict, key)
+		}
+	}
+	return nil
+}
+
+// RenameNamespace moves the collections of from to to, with their
+// write-behind buffers, sampling state, moved storage and leases. Records
+// and files are not keyed by namespace and stay where they are.
+func (r *DefaultCollectionRepo) RenameNamespace(ctx context.Context, from, to string) error {
+	r.service.mu.Lock()
+	defer r.service.mu.Unlock()
+	r.storageMu.Lock()
+	defer r.storageMu.Unlock()
+
+	for _, name := range r.namespaceKeys(from) {
+		oldKey, newKey := from+"/"+name, to+"/"+name
+		meta := proto.Clone(r.service.collections[oldKey]).(*pb.Collection)
+		meta.Namespace = to
+		r.service.collections[newKey] = meta
+		delete(r.service.collections, oldKey)
+		r.service.changed()
+		if s, ok := r.service.samplers[oldKey]; ok {
+			r.service.samplers[newKey] = s
+			delete(r.service.samplers, oldKey)
+		}
+		if b, ok := r.service.buffers[oldKey]; ok {
+			r.service.buffers[newKey] = b
+			delete(r.service.buffers, oldKey)
+		}
+		if s, ok := r.storage[oldKey]; ok {
+			r.storage[newKey] = s
+			delete(r.storage, oldKey)
+		}
+		if g, ok := r.gates[oldKey]; ok {
+			r.gates[newKey] = g
+			delete(r.gates, oldKey)
+		}
+	}
+
+	r.leases.mu.Lock()
+	for key, lease := range r.leases.leases {
+		if rest, ok := strings.CutPrefix(key, from+"/"); ok {
+			r.leases.leases[to+"/"+rest] = lease
+			delete(r.leases.leases, key)
+		}
+	}
+	r.leases.mu.Unlock()
+	return nil
+}
+
+// CheckNamespaceUnused reports namespaces that have saved searches.
+func (s *SavedSearchStore) CheckNamespaceUnused(ctx context.Context, namespace string) error {
+	existing, err := s.List(ctx, namespace, "")
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("%w: %s has saved searches", ErrNamespaceInUse, namespace)
+	}
+	return nil
+}
+
+// CheckNamespaceRename refuses to rename into a namespace that has saved
+// searches.
+func (s *SavedSearchStore) CheckNamespaceRename(ctx context.Context, from, to string) error {
+	err := s.CheckNamespaceUnused(ctx, to)
+	if errors.Is(err, ErrNamespaceInUse) {
+		return fmt.Errorf("%w: %w", ErrRenameConflict, err)
+	}
+	return err
+}
+
+// RenameNamespace moves the saved searches of from to to.
+func (s *SavedSearchStore) RenameNamespace(ctx context.Context, from, to string) error {
+	searches, err := s.List(ctx, from, "")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, search := range searches {
+		moved := proto.Clone(search).(*pb.SavedSearch)
+		moved.Namespace = to
+		if err := s.save(ctx, moved); err != nil {
+			return fmt.Errorf("failed to move saved search %s: %w", search.Name, err)
+		}
+		if err := s.coll.DeleteRecord(ctx, savedSearchID(from, search.CollectionName, search.Name)); err != nil {
+			return fmt.Errorf("failed to move saved search %s: %w", search.Name, err)
+		}
+	}
+	return nil
+}
+
+// SetNamespaceAliases enables the namespace alias and rename RPCs. Renames
+// move each renamer's state, in order; pass the repository first. Call it
+// before serving requests.
+func (s *GrpcServer) SetNamespaceAliases(aliases *NamespaceAliases, renamers ...NamespaceRenamer) {
+	s.aliases = aliases
+	s.renamers = renamers
+}
+
+func aliasesDisabled() *pb.Status {
+	return &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: "namespace aliases are not enabled"}
+}
+
+// AliasNamespace makes alias another name for a namespace. Namespaces in
+// use in any renamer given to SetNamespaceAliases cannot become aliases.
+func (s *GrpcServer) AliasNamespace(ctx context.Context, req *pb.AliasNamespaceRequest) (*pb.AliasNamespaceResponse, error) {
+	if s.aliases == nil {
+		return &pb.AliasNamespaceResponse{Status: aliasesDisabled()}, nil
+	}
+	err := AddNamespaceAlias(ctx, s.aliases, req.Alias, req.Namespace, s.renamers...)
+	switch {
+	case err == nil:
+		return &pb.AliasNamespaceResponse{Status: &pb.Status{Code: pb.Status_OK}}, nil
+	case errors.Is(err, ErrNamespaceInUse):
+		return &pb.AliasNamespaceResponse{Status: &pb.Status{Code: pb.Status_ALREADY_EXISTS, Message: err.Error()}}, nil
+	case errors.Is(err, ErrInvalidAlias):
+		return &pb.AliasNamespaceResponse{Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: err.Error()}}, nil
+	}
+	return &pb.AliasNamespaceResponse{Status: &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()}}, nil
+}
+
+// RemoveNamespaceAlias deletes an alias.
+func (s *GrpcServer) RemoveNamespaceAlias(ctx context.Context, req *pb.RemoveNamespaceAliasRequest) (*pb.RemoveNamespaceAliasResponse, error) {
+	if s.aliases == nil {
+		return &pb.RemoveNamespaceAliasResponse{Status: aliasesDisabled()}, nil
+	}
+	if !s.aliases.Remove(req.Alias) {
+		return &pb.RemoveNamespaceAliasResponse{Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: fmt.Sprintf("alias %s not found", req.Alias)}}, nil
+	}
+	return &pb.RemoveNamespaceAliasResponse{Status: &pb.Status{Code: pb.Status_OK}}, nil
+}
+
+// ListNamespaceAliases returns the aliases, sorted by alias.
+func (s *GrpcServer) ListNamespaceAliases(ctx context.Context, req *pb.ListNamespaceAliasesRequest) (*pb.ListNamespaceAliasesResponse, error) {
+	if s.aliases == nil {
+		return &pb.ListNamespaceAliasesResponse{Status: aliasesDisabled()}, nil
+	}
+	return &pb.ListNamespaceAliasesResponse{Status: &pb.Status{Code: pb.Status_OK}, Aliases: s.aliases.List()}, nil
+}
+
+// RenameNamespace renames a namespace in every renamer given to
+// SetNamespaceAliases, all or nothing.
+func (s *GrpcServer) RenameNamespace(ctx context.Context, req *pb.RenameNamespaceRequest) (*pb.RenameNamespaceResponse, error) {
+	if s.aliases == nil {
+		return &pb.RenameNamespaceResponse{Status: aliasesDisabled()}, nil
+	}
+	err := RenameNamespace(ctx, s.aliases, req.From, req.To, req.KeepAlias, s.renamers...)
+	switch {
+	case err == nil:
+		return &pb.RenameNamespaceResponse{Status: &pb.Status{Code: pb.Status_OK}}, nil
+	case errors.Is(err, ErrRenameConflict):
+		return &pb.RenameNamespaceResponse{Status: &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: err.Error()}}, nil
+	}
+	return &pb.RenameNamespaceResponse{Status: &pb.Status{Code: pb.Status_ABORTED, Message: err.Error()}}, nil
+}
@@ -0,0 +1,129 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// failingRenamer fails renames after a successful check.
+type failingRenamer struct{ renames []string }
+
+func (f *failingRenamer) CheckNamespaceUnused(ctx context.Context, namespace string) error {
+	return nil
+}
+func (f *failingRenamer) CheckNamespaceRename(ctx context.Context, from, to string) error { return nil }
+func (f *failingRenamer) RenameNamespace(ctx context.Context, from, to string) error {
+	f.renames = append(f.renames, from+"->"+to)
+	if to == "production" {
+		return errors.New("registry unavailable")
+	}
+	return nil
+}
+
+func TestNamespaceAliases(t *testing.T) {
+	aliases := collection.NewNamespaceAliases()
+	if err := aliases.Add("production", "prod"); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := aliases.Add("live", "production"); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if got := aliases.Resolve("live"); got != "prod" {
+		t.Errorf("expected an alias of an alias to resolve to prod, got %s", got)
+	}
+	for _, bad := range [][2]string{{"prod", "prod"}, {"prod", "staging"}, {"", "prod"}, {"a/b", "prod"}} {
+		if err := aliases.Add(bad[0], bad[1]); !errors.Is(err, collection.ErrInvalidAlias) {
+			t.Errorf("Add(%q, %q): expected ErrInvalidAlias, got %v", bad[0], bad[1], err)
+		}
+	}
+	if !aliases.Remove("live") || aliases.Resolve("live") != "live" {
+		t.Errorf("expected live to be removed")
+	}
+}
+
+func TestRenameNamespace(t *testing.T) {
+	ctx := context.Background()
+	repoIface, _, searches := setupSavedSearches(t)
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	aliases := collection.NewNamespaceAliases()
+	repo.SetNamespaceAliases(aliases)
+	server := collection.NewGrpcServer(repo)
+	server.SetNamespaceAliases(aliases, repo, searches)
+
+	if err := searches.Save(ctx, &pb.SavedSearch{Namespace: "test", CollectionName: "tickets", Name: "open"}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	tickets, _ := repo.GetCollection(ctx, "test", "tickets")
+	if err := tickets.CreateRecord(ctx, &pb.CollectionRecord{Id: "t1", ProtoData: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	// Aliases address the namespace everywhere
+	if resp, _ := server.AliasNamespace(ctx, &pb.AliasNamespaceRequest{Alias: "qa", Namespace: "test"}); resp.Status.Code != pb.Status_OK {
+		t.Fatalf("AliasNamespace returned %v", resp.Status)
+	}
+	if coll, err := repo.GetCollection(ctx, "qa", "tickets"); err != nil || coll.Meta.Namespace != "test" {
+		t.Fatalf("expected qa/tickets to resolve to test/tickets, got %v", err)
+	}
+	route, _ := repo.Route(ctx, &pb.RouteRequest{Collection: &pb.NamespacedName{Namespace: "qa", Name: "tickets"}})
+	if route.GetCollection().GetNamespace() != "test" {
+		t.Errorf("expected Route to resolve the alias, got %v", route)
+	}
+	if resp, _ := server.AliasNamespace(ctx, &pb.AliasNamespaceRequest{Alias: "test", Namespace: "other"}); resp.Status.Code != pb.Status_ALREADY_EXISTS {
+		t.Errorf("expected a namespace with collections to be refused as an alias, got %v", resp.Status)
+	}
+	if resp, _ := server.AliasNamespace(ctx, &pb.AliasNamespaceRequest{Alias: "a/b", Namespace: "test"}); resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected an invalid alias to be refused, got %v", resp.Status)
+	}
+	// Aliases a collector starts with are checked the same way
+	if err := collection.CheckNamespaceAlias(ctx, "test", repo, searches); !errors.Is(err, collection.ErrNamespaceInUse) {
+		t.Errorf("expected ErrNamespaceInUse for a namespace with collections, got %v", err)
+	}
+
+	resp, _ := server.RenameNamespace(ctx, &pb.RenameNamespaceRequest{From: "test", To: "staging", KeepAlias: true})
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("RenameNamespace returned %v", resp.Status)
+	}
+	renamed, err := repo.GetCollection(ctx, "staging", "tickets")
+	if err != nil || renamed.Meta.Namespace != "staging" {
+		t.Fatalf("expected staging/tickets, got %v", err)
+	}
+	if exists, _ := renamed.Exists(ctx, "t1"); !exists {
+		t.Errorf("expected records to survive the rename")
+	}
+	for _, ns := range []string{"test", "qa"} {
+		if coll, err := repo.GetCollection(ctx, ns, "tickets"); err != nil || coll.Meta.Namespace != "staging" {
+			t.Errorf("expected %s to be an alias of staging, got %v", ns, err)
+		}
+	}
+	if moved, err := searches.Get(ctx, "staging", "tickets", "open"); err != nil || moved.Namespace != "staging" {
+		t.Errorf("expected the saved search to move, got %v, %v", moved, err)
+	}
+	if _, err := searches.Get(ctx, "test", "tickets", "open"); !errors.Is(err, collection.ErrSavedSearchNotFound) {
+		t.Errorf("expected the old saved search to be gone, got %v", err)
+	}
+
+	// A failing participant renames everything back
+	failing := &failingRenamer{}
+	err = collection.RenameNamespace(ctx, aliases, "staging", "production", false, repo, searches, failing)
+	if err == nil {
+		t.Fatal("expected the rename to fail")
+	}
+	if _, err := repo.GetCollection(ctx, "staging", "tickets"); err != nil {
+		t.Errorf("expected staging/tickets after the rollback, got %v", err)
+	}
+	if _, err := searches.Get(ctx, "staging", "tickets", "open"); err != nil {
+		t.Errorf("expected the saved search back in staging, got %v", err)
+	}
+	if len(failing.renames) != 1 {
+		t.Errorf("expected only the renamers that succeeded to be undone, got %v", failing.renames)
+	}
+
+	if err := collection.RenameNamespace(ctx, aliases, "staging", "test", false, repo); !errors.Is(err, collection.ErrRenameConflict) {
+		t.Errorf("expected renaming onto an alias to conflict, got %v", err)
+	}
+}
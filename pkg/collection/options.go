@@ -6,4 +6,49 @@ type Options struct {
 	EnableJSON       bool
 	EnableVector     bool
 	VectorDimensions int
+
+	// Language selects how text is tokenized for full-text search; empty
+	// means LanguageEnglish.
+	Language Language
+
+	// Synonyms are groups of equivalent terms, such as {"k8s", "kubernetes"},
+	// and Stopwords are words left out of queries. Both apply when
+	// full-text queries run, so changing them needs no reindexing.
+	Synonyms  [][]string
+	Stopwords []string
+
+	// EnableHistory keeps prior versions of updated and deleted records so
+	// reads can be served as of an earlier time.
+	EnableHistory bool
+
+	// Geo indexes each record's location, read from the declared JSON fields,
+	// for bounding-box and radius filters. Requires EnableJSON.
+	Geo *GeoOptions
+
+	// Compression compresses record data over a size threshold at rest,
+	// with a dictionary trained from the collection's own records.
+	Compression *CompressionOptions
+
+	// Deduplicate stores identical record data once, shared by every record
+	// holding it, for collections of crawled or mirrored content.
+	Deduplicate bool
+
+	// EnableSimilarity fingerprints each record's text with SimHash so
+	// near-duplicates can be found with FindSimilar.
+	EnableSimilarity bool
+
+	// WriteOnce seals records once created: the store rejects every update
+	// and delete of a record, however it is attempted.
+	WriteOnce bool
+
+	// PartitionPeriod ("hourly", "daily" or "monthly") keeps records in one
+	// store per period of their creation time, so retention drops whole
+	// periods; see PartitionDropper. Empty stores them unpartitioned.
+	PartitionPeriod string
+
+	// Functions are custom SQL functions, by name, usable in the store's
+	// Search filters (see SQLFunction), and Extensions names registered
+	// SQLExtensions whose functions are loaded as well.
+	Functions  map[string]SQLFunction
+	Extensions []string
 }
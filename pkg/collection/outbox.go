@@ -0,0 +1,449 @@
+package collection
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// DefaultOutboxInterval is how often an OutboxRelay publishes pending
+	// messages.
+	DefaultOutboxInterval = time.Second
+	// DefaultOutboxRetryDelay is the delay before a message that failed to
+	// publish is retried, doubled with every further failure.
+	DefaultOutboxRetryDelay = time.Second
+	// MaxOutboxRetryDelay caps the delay between retries.
+	MaxOutboxRetryDelay = 10 * time.Minute
+	// DefaultOutboxSentRetention is how long published messages are kept
+	// for ListOutbox.
+	DefaultOutboxSentRetention = 24 * time.Hour
+	// DefaultOutboxListLimit is how many messages ListOutbox returns when no
+	// limit is given.
+	DefaultOutboxListLimit = 100
+
+	// outboxBatchSize is how many pending messages are read at a time.
+	outboxBatchSize = 100
+)
+
+// ErrOutboxUnavailable is returned for outbox writes to a store that does
+// not implement OutboxStore.
+var ErrOutboxUnavailable = errors.New("store does not support an outbox")
+
+// OutboxStore is implemented by stores that write outbox messages in the
+// same transaction as a record. Messages name their collection, so one
+// store can hold the outboxes of many collections.
+type OutboxStore interface {
+	// WriteWithOutbox creates record, or updates it if update, and adds msgs
+	// in one transaction: all are written or none are.
+	WriteWithOutbox(ctx context.Context, record *pb.CollectionRecord, update bool, msgs []*pb.OutboxMessage) error
+	// PendingOutbox returns up to max unsent messages due by now, oldest
+	// first, leaving out those behind an earlier unsent message with the
+	// same topic and key that is not yet due.
+	PendingOutbox(ctx context.Context, now time.Time, max int) ([]*pb.OutboxMessage, error)
+	// MarkOutboxSent records that a message was published.
+	MarkOutboxSent(ctx context.Context, id string, at time.Time) error
+	// MarkOutboxFailed records a failed publish of a message, to be retried
+	// at retryAt.
+	MarkOutboxFailed(ctx context.Context, id, reason string, retryAt time.Time) error
+	// ListOutbox returns up to limit messages of a collection, oldest first,
+	// with those already sent if includeSent.
+	ListOutbox(ctx context.Context, namespace, name string, includeSent bool, limit int) ([]*pb.OutboxMessage, error)
+	// PurgeOutbox removes messages sent before before and returns how many.
+	PurgeOutbox(ctx context.Context, before time.Time) (int64, error)
+}
+
+type outboxKey struct{}
+
+// WithOutbox returns a context whose CreateRecord or UpdateRecord writes msgs
+// in the same store transaction as the record, for an OutboxRelay to
+// publish. Each message needs a topic and is given its ID, collection,
+// record and creation time; its key defaults to the record's ID.
+func WithOutbox(ctx context.Context, msgs ...*pb.OutboxMessage) context.Context {
+	return context.WithValue(ctx, outboxKey{}, msgs)
+}
+
+// takeOutbox returns the outbox messages of the write ctx is for, and a
+// context for the rest of the write that carries none.
+func takeOutbox(ctx context.Context) ([]*pb.OutboxMessage, context.Context) {
+	msgs, _ := ctx.Value(outboxKey{}).([]*pb.OutboxMessage)
+	if msgs == nil {
+		return nil, ctx
+	}
+	return msgs, context.WithValue(ctx, outboxKey{}, []*pb.OutboxMessage(nil))
+}
+
+// writeRecord creates or updates record in c's store, with the outbox
+// messages of the write in the same transaction.
+func (c *Collection) writeRecord(ctx context.Context, record *pb.CollectionRecord, update bool, outbox []*pb.OutboxMessage) error {
+	if len(outbox) == 0 {
+		if update {
+			return c.Store.UpdateRecord(ctx, record)
+		}
+		return c.Store.CreateRecord(ctx, record)
+	}
+
+	// The record bypasses write-behind buffering, after what is buffered
+	// so far is flushed
+	store := c.Store
+	if buffer, ok := store.(*BufferedStore); ok {
+		if _, err := buffer.Flush(ctx); err != nil {
+			return err
+		}
+		store = buffer.inner
+	}
+	os, ok := store.(OutboxStore)
+	if !ok {
+		return ErrOutboxUnavailable
+	}
+	now := timestamppb.New(c.now())
+	for _, msg := range outbox {
+		if msg.Topic == "" {
+			return fmt.Errorf("outbox message topic required")
+		}
+		msg.Id = uuid.New().String()
+		msg.Namespace, msg.CollectionName, msg.RecordId = c.Meta.Namespace, c.Meta.Name, record.Id
+		msg.CreatedAt, msg.SentAt = now, nil
+		msg.Attempts, msg.LastError = 0, ""
+		if msg.Key == "" {
+			msg.Key = record.Id
+		}
+	}
+	return os.WriteWithOutbox(ctx, record, update, outbox)
+}
+
+// ListOutbox lists up to limit of c's outbox messages, defaulting to
+// DefaultOutboxListLimit, with those already sent if includeSent.
+func (c *Collection) ListOutbox(ctx context.Context, includeSent bool, limit int) ([]*pb.OutboxMessage, error) {
+	store := c.Store
+	if buffer, ok := store.(*BufferedStore); ok {
+		store = buffer.inner
+	}
+	os, ok := store.(OutboxStore)
+	if !ok {
+		return nil, ErrOutboxUnavailable
+	}
+	if limit <= 0 {
+		limit = DefaultOutboxListLimit
+	}
+	return os.ListOutbox(ctx, c.Meta.Namespace, c.Meta.Name, includeSent, limit)
+}
+
+// outboxStores returns the repository's stores that hold outboxes.
+func (r *DefaultCollectionRepo) outboxStores() []OutboxStore {
+	stores := []Store{r.store}
+	r.storageMu.Lock()
+	for _, s := range r.storage {
+		stores = append(stores, s.store)
+	}
+	r.storageMu.Unlock()
+	r.temps.mu.Lock()
+	for _, t := range r.temps.temps {
+		stores = append(stores, t.store)
+	}
+	r.temps.mu.Unlock()
+
+	var outboxes []OutboxStore
+	for _, s := range stores {
+		if os, ok := s.(OutboxStore); ok {
+			outboxes = append(outboxes, os)
+		}
+	}
+	return outboxes
+}
+
+// OutboxPublisher publishes outbox messages. Publish must not return until
+// the message is durably accepted: once it returns nil the message is
+// marked sent and never published again. The collector ships a webhook
+// publisher only; publishing to a broker such as Kafka takes an
+// implementation of this interface around the broker's client.
+type OutboxPublisher interface {
+	Publish(ctx context.Context, msg *pb.OutboxMessage) error
+}
+
+// WebhookPublisher POSTs each message's payload to URL with its headers,
+// and X-Outbox-Id, X-Outbox-Topic, X-Outbox-Key and X-Outbox-Record headers
+// for receivers to deduplicate and route by.
+type WebhookPublisher struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookPublisher creates a WebhookPublisher for url.
+func NewWebhookPublisher(url string) *WebhookPublisher {
+	return &WebhookPublisher{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Publish POSTs msg, failing unless the webhook responds with a 2xx status.
+func (p *WebhookPublisher) Publish(ctx context.Context, msg *pb.OutboxMessage) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for k, v := range msg.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("X-Outbox-Id", msg.Id)
+	req.Header.Set("X-Outbox-Topic", msg.Topic)
+	req.Header.Set("X-Outbox-Key", msg.Key)
+	req.Header.Set("X-Outbox-Record", msg.Namespace+"/"+msg.CollectionName+"/"+msg.RecordId)
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// OutboxRelay publishes the outbox messages of a repository's collections
+// and marks them sent. Messages are published at least once, in order for
+// each topic and key: a message that fails is retried after a growing
+// delay, and the messages after it with the same topic and key wait for it.
+type OutboxRelay struct {
+	repo       *DefaultCollectionRepo
+	publishers map[string]OutboxPublisher // By topic; "" is the default
+	clock      Clock
+
+	// RetryDelay is the delay before the first retry of a failed message,
+	// doubled for each further failure up to MaxOutboxRetryDelay.
+	RetryDelay time.Duration
+	// SentRetention is how long published messages are kept.
+	SentRetention time.Duration
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewOutboxRelay creates a relay for the outboxes of repo's collections,
+// publishing with publisher unless Route names another for a message's
+// topic. publisher may be nil if every topic is routed.
+func NewOutboxRelay(repo *DefaultCollectionRepo, publisher OutboxPublisher) *OutboxRelay {
+	r := &OutboxRelay{
+		repo:          repo,
+		publishers:    make(map[string]OutboxPublisher),
+		clock:         SystemClock{},
+		RetryDelay:    DefaultOutboxRetryDelay,
+		SentRetention: DefaultOutboxSentRetention,
+	}
+	if publisher != nil {
+		r.publishers[""] = publisher
+	}
+	return r
+}
+
+// Route publishes the messages of topic with publisher. Call it before
+// Start.
+func (r *OutboxRelay) Route(topic string, publisher OutboxPublisher) {
+	r.publishers[topic] = publisher
+}
+
+// SetClock sets the clock messages are due and sent by. Call it before
+// Start.
+func (r *OutboxRelay) SetClock(clock Clock) {
+	r.clock = clock
+}
+
+// Start runs Relay every interval until Stop.
+func (r *OutboxRelay) Start(interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	r.stop, r.done = stop, done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			if _, err := r.Relay(context.Background()); err != nil {
+				log.Printf("Warning: outbox relay: %v", err)
+			}
+		}
+	}()
+}
+
+// Stop ends the Start loop, waiting for a running pass to finish.
+func (r *OutboxRelay) Stop() {
+	r.mu.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Relay publishes every due message once, removes published messages past
+// SentRetention, and returns how many it published. A store that fails does
+// not hold up the others.
+func (r *OutboxRelay) Relay(ctx context.Context) (int64, error) {
+	now := r.clock.Now()
+	var published int64
+	var errs []error
+	for _, store := range r.repo.outboxStores() {
+		n, err := r.relayStore(ctx, store, now)
+		published += n
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := store.PurgeOutbox(ctx, now.Add(-r.SentRetention)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to purge sent messages: %w", err))
+		}
+	}
+	return published, errors.Join(errs...)
+}
+
+// relayStore publishes the messages of one store due at now.
+func (r *OutboxRelay) relayStore(ctx context.Context, store OutboxStore, now time.Time) (int64, error) {
+	var published int64
+	failed := make(map[[2]string]bool) // Topics and keys with a failed message
+	for {
+		msgs, err := store.PendingOutbox(ctx, now, outboxBatchSize)
+		if err != nil {
+			return published, fmt.Errorf("failed to read outbox: %w", err)
+		}
+		for _, msg := range msgs {
+			key := [2]string{msg.Topic, msg.Key}
+			if failed[key] {
+				continue
+			}
+			if err := r.publish(ctx, msg); err != nil {
+				failed[key] = true
+				retryAt := now.Add(r.retryDelay(msg.Attempts + 1))
+				if err := store.MarkOutboxFailed(ctx, msg.Id, err.Error(), retryAt); err != nil {
+					return published, fmt.Errorf("failed to mark message %s failed: %w", msg.Id, err)
+				}
+				continue
+			}
+			if err := store.MarkOutboxSent(ctx, msg.Id, now); err != nil {
+				return published, fmt.Errorf("failed to mark message %s sent: %w", msg.Id, err)
+			}
+			published++
+		}
+		// Failed messages are no longer due and hold back the rest of their
+		// key, so the next page holds only messages not yet tried
+		if len(msgs) < outboxBatchSize {
+			return published, nil
+		}
+	}
+}
+
+// publish publishes msg with the publisher of its topic.
+func (r *OutboxRelay) publish(ctx context.Context, msg *pb.OutboxMessage) error {
+	publisher, ok := r.publishers[msg.Topic]
+	if !ok {
+		publisher, ok = r.publishers[""]
+	}
+	if !ok {
+		return fmt.Errorf("no publisher for topic %q", msg.Topic)
+	}
+	return publisher.Publish(ctx, msg)
+}
+
+// retryDelay returns the delay before retrying a message that has failed
+// attempts times.
+func (r *OutboxRelay) retryDelay(attempts int32) time.Duration {
+	delay := r.RetryDelay
+	if delay <= 0 {
+		delay = DefaultOutboxRetryDelay
+	}
+	for i := int32(1); i < attempts && delay < MaxOutboxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, MaxOutboxRetryDelay)
+}
+
+// WriteWithOutbox writes a record and outbox messages announcing it in one
+// transaction.
+func (s *CollectionServer) WriteWithOutbox(ctx context.Context, req *pb.WriteWithOutboxRequest) (*pb.WriteWithOutboxResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if req.Record == nil || req.Record.Id == "" {
+		return nil, invalidRecord(codes.InvalidArgument, "id", ViolationRequired, nil, "id is required")
+	}
+	if err := s.checkRecordSize(len(req.Record.ProtoData)); err != nil {
+		return nil, err
+	}
+	if len(req.Messages) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "messages are required")
+	}
+	for _, msg := range req.Messages {
+		if msg.Topic == "" {
+			return nil, status.Error(codes.InvalidArgument, "every message needs a topic")
+		}
+	}
+
+	ctx = WithOutbox(ctx, req.Messages...)
+	action := "create"
+	if req.Update {
+		action = "update"
+		err = collection.UpdateRecord(ctx, req.Record)
+	} else {
+		err = collection.CreateRecord(ctx, req.Record)
+	}
+	if err != nil {
+		return nil, outboxStatus(err, action, req.Record.Id)
+	}
+	ids := make([]string, len(req.Messages))
+	for i, msg := range req.Messages {
+		ids[i] = msg.Id
+	}
+	return &pb.WriteWithOutboxResponse{Status: &pb.Status{Code: pb.Status_OK}, Ids: ids}, nil
+}
+
+// ListOutbox lists a collection's outbox messages.
+func (s *CollectionServer) ListOutbox(ctx context.Context, req *pb.ListOutboxRequest) (*pb.ListOutboxResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if req.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit must not be negative")
+	}
+	msgs, err := collection.ListOutbox(ctx, req.IncludeSent, int(req.Limit))
+	if errors.Is(err, ErrOutboxUnavailable) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	return &pb.ListOutboxResponse{Status: &pb.Status{Code: pb.Status_OK}, Messages: msgs}, nil
+}
+
+// outboxStatus converts outbox errors to gRPC status errors.
+func outboxStatus(err error, action, id string) error {
+	for _, target := range []error{ErrOutboxUnavailable, ErrSampledOut, ErrRecordLeased, ErrLegalHold, ErrRecordSealed} {
+		if errors.Is(err, target) {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+	return writeStatus(err, action, id)
+}
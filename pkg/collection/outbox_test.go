@@ -0,0 +1,168 @@
+package collection_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakePublisher records the messages it publishes.
+type fakePublisher struct {
+	topics, keys, ids []string
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, msg *pb.OutboxMessage) error {
+	p.topics = append(p.topics, msg.Topic)
+	p.keys = append(p.keys, msg.Key)
+	p.ids = append(p.ids, msg.Id)
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "orders"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	server := collection.NewCollectionServer(repo)
+	list := func(includeSent bool) []*pb.OutboxMessage {
+		t.Helper()
+		resp, err := server.ListOutbox(ctx, &pb.ListOutboxRequest{Namespace: "test", CollectionName: "orders", IncludeSent: includeSent})
+		if err != nil {
+			t.Fatalf("ListOutbox failed: %v", err)
+		}
+		return resp.Messages
+	}
+
+	// The record and its messages are written together...
+	resp, err := server.WriteWithOutbox(ctx, &pb.WriteWithOutboxRequest{
+		Namespace: "test", CollectionName: "orders",
+		Record: &pb.CollectionRecord{Id: "o1", ProtoData: []byte(`{"total": 5}`)},
+		Messages: []*pb.OutboxMessage{
+			{Topic: "orders", Payload: []byte("created o1"), Headers: map[string]string{"X-Event": "created"}},
+			{Topic: "audit", Key: "k", Payload: []byte("audit o1")},
+		},
+	})
+	if err != nil || len(resp.Ids) != 2 {
+		t.Fatalf("WriteWithOutbox returned %v, %v", resp.GetIds(), err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "orders")
+	if _, err := coll.GetRecord(ctx, "o1"); err != nil {
+		t.Fatalf("expected the record written: %v", err)
+	}
+	pending := list(false)
+	if len(pending) != 2 || pending[0].Id != resp.Ids[0] || pending[0].Key != "o1" || pending[0].RecordId != "o1" ||
+		pending[0].Namespace != "test" || pending[0].Headers["X-Event"] != "created" || pending[1].Key != "k" {
+		t.Fatalf("unexpected pending messages %v", pending)
+	}
+
+	// ...or neither is
+	_, err = server.WriteWithOutbox(ctx, &pb.WriteWithOutboxRequest{
+		Namespace: "test", CollectionName: "orders",
+		Record:   &pb.CollectionRecord{Id: "o1", ProtoData: []byte(`{"total": 6}`)},
+		Messages: []*pb.OutboxMessage{{Topic: "orders", Payload: []byte("created o1 again")}},
+	})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists for a duplicate record, got %v", err)
+	}
+	if n := len(list(false)); n != 2 {
+		t.Errorf("expected the duplicate's message not written, got %d pending", n)
+	}
+	_, err = server.WriteWithOutbox(ctx, &pb.WriteWithOutboxRequest{
+		Namespace: "test", CollectionName: "orders",
+		Record:   &pb.CollectionRecord{Id: "o2", ProtoData: []byte(`{}`)},
+		Messages: []*pb.OutboxMessage{{Payload: []byte("no topic")}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a message without a topic, got %v", err)
+	}
+
+	// The relay POSTs messages to the webhook, routes others to their
+	// topic's publisher and marks them sent
+	var (
+		mu       sync.Mutex
+		received []string
+		failures int
+	)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, r.Header.Get("X-Outbox-Key")+":"+r.Header.Get("X-Event")+":"+r.Header.Get("X-Outbox-Id"))
+	}))
+	defer webhook.Close()
+	audit := &fakePublisher{}
+	clock := collection.NewFixedClock(time.Now().Add(time.Minute))
+	relay := collection.NewOutboxRelay(repo, collection.NewWebhookPublisher(webhook.URL))
+	relay.Route("audit", audit)
+	relay.SetClock(clock)
+
+	if n, err := relay.Relay(ctx); err != nil || n != 2 {
+		t.Fatalf("expected 2 messages relayed, got %d %v", n, err)
+	}
+	if len(received) != 1 || received[0] != "o1:created:"+resp.Ids[0] {
+		t.Errorf("unexpected webhook deliveries %v", received)
+	}
+	if len(audit.topics) != 1 || audit.topics[0] != "audit" || audit.keys[0] != "k" || audit.ids[0] != resp.Ids[1] {
+		t.Errorf("unexpected audit messages %v %v %v", audit.topics, audit.keys, audit.ids)
+	}
+	if n := len(list(false)); n != 0 {
+		t.Errorf("expected nothing pending, got %d", n)
+	}
+	if sent := list(true); len(sent) != 2 || sent[0].SentAt == nil || sent[0].Attempts != 1 {
+		t.Errorf("expected both messages listed as sent, got %v", sent)
+	}
+
+	// A message that fails is retried later, holding back the messages
+	// after it with the same key
+	for i, event := range []string{"created", "paid"} {
+		req := &pb.WriteWithOutboxRequest{
+			Namespace: "test", CollectionName: "orders", Update: i > 0,
+			Record:   &pb.CollectionRecord{Id: "o2", ProtoData: []byte(`{"total": 1}`)},
+			Messages: []*pb.OutboxMessage{{Topic: "orders", Headers: map[string]string{"X-Event": event}}},
+		}
+		if _, err := server.WriteWithOutbox(ctx, req); err != nil {
+			t.Fatalf("WriteWithOutbox failed: %v", err)
+		}
+	}
+	received, failures = nil, 1
+	if n, err := relay.Relay(ctx); err != nil || n != 0 {
+		t.Fatalf("expected nothing relayed past the failure, got %d %v", n, err)
+	}
+	pending = list(false)
+	if len(pending) != 2 || pending[0].Attempts != 1 || !strings.Contains(pending[0].LastError, "503") || pending[1].Attempts != 0 {
+		t.Fatalf("expected the failure recorded on the first message only, got %v", pending)
+	}
+	if n, _ := relay.Relay(ctx); n != 0 {
+		t.Errorf("expected the failed message not retried before its delay, got %d relayed", n)
+	}
+	clock.Advance(collection.DefaultOutboxRetryDelay)
+	if n, err := relay.Relay(ctx); err != nil || n != 2 {
+		t.Fatalf("expected both messages relayed on retry, got %d %v", n, err)
+	}
+	if len(received) != 2 || !strings.HasPrefix(received[0], "o2:created:") || !strings.HasPrefix(received[1], "o2:paid:") {
+		t.Errorf("expected the messages relayed in order, got %v", received)
+	}
+
+	// Sent messages are purged once past retention
+	clock.Advance(collection.DefaultOutboxSentRetention + time.Minute)
+	relay.Relay(ctx)
+	if n := len(list(true)); n != 0 {
+		t.Errorf("expected sent messages purged, got %d", n)
+	}
+}
@@ -0,0 +1,99 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrPartitionedUnavailable is returned when creating a partitioned
+	// collection in a repository without a StoreOpener.
+	ErrPartitionedUnavailable = errors.New("partitioned collections are not enabled")
+	// ErrNotPartitioned is returned for dropping partitions of a collection
+	// whose store is not partitioned.
+	ErrNotPartitioned = errors.New("collection is not partitioned")
+)
+
+// PartitionDropper is implemented by stores that keep records in one
+// partition per period of their creation time, such as a collection created
+// with a partition period, and can delete whole partitions at once.
+type PartitionDropper interface {
+	// DropPartitionsBefore deletes every partition whose period ends at or
+	// before cutoff and returns their keys.
+	DropPartitionsBefore(ctx context.Context, cutoff time.Time) ([]string, error)
+	// DropPartitionsBeforeImpact reports the records DropPartitionsBefore
+	// would delete, with up to sample of their IDs.
+	DropPartitionsBeforeImpact(ctx context.Context, cutoff time.Time, sample int) (*pb.Impact, error)
+}
+
+// DropPartitionsBefore deletes the partitions of c's store whose period ends
+// at or before cutoff, and reports the records deleted with up to sample of
+// their IDs, and the partitions dropped. With dryRun it only reports the
+// records. Like DeleteByFilter it is refused for write-once collections,
+// under a legal hold on the collection or any of its records, and while
+// deletes are blocked. Dropped records are not recorded in the changelog,
+// and their attachments' files are left in place.
+func (c *Collection) DropPartitionsBefore(ctx context.Context, cutoff time.Time, dryRun bool, sample int) (*pb.Impact, []string, error) {
+	dropper, ok := c.Store.(PartitionDropper)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s/%s", ErrNotPartitioned, c.Meta.Namespace, c.Meta.Name)
+	}
+	impact, err := dropper.DropPartitionsBeforeImpact(ctx, cutoff, sample)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to count records to drop: %w", err)
+	}
+	if dryRun || impact.Count == 0 {
+		return impact, nil, nil
+	}
+
+	if err := c.Holds.check(ctx, LegalHoldDropPartitions, c.Meta.Namespace, c.Meta.Name, ""); err != nil {
+		return nil, nil, err
+	}
+	if err := c.sealed("drop partitions of", c.Meta.Namespace+"/"+c.Meta.Name); err != nil {
+		return nil, nil, err
+	}
+	if c.Monitor != nil {
+		if err := c.Monitor.beforeDelete(ctx, c); err != nil {
+			return nil, nil, err
+		}
+	}
+	end, err := c.beginWrite()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer end()
+	dropped, err := dropper.DropPartitionsBefore(ctx, cutoff)
+	if err != nil {
+		return nil, dropped, fmt.Errorf("failed to drop partitions: %w", err)
+	}
+	impact.DryRun = false
+	return impact, dropped, nil
+}
+
+// DropPartitions drops the partitions of a partitioned collection before a
+// cutoff, or with dry_run reports how many records would be dropped and a
+// sample of their IDs.
+func (s *CollectionServer) DropPartitions(ctx context.Context, req *pb.DropPartitionsRequest) (*pb.DropPartitionsResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if req.Before == nil {
+		return nil, status.Error(codes.InvalidArgument, "before is required")
+	}
+
+	impact, dropped, err := collection.DropPartitionsBefore(ctx, req.Before.AsTime(), req.DryRun, int(req.SampleSize))
+	switch {
+	case errors.Is(err, ErrNotPartitioned), errors.Is(err, ErrDeletesBlocked), errors.Is(err, ErrLegalHold), errors.Is(err, ErrRecordSealed):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "dropped partitions %v before: %v", dropped, err)
+	}
+	return &pb.DropPartitionsResponse{Status: &pb.Status{Code: pb.Status_OK}, Impact: impact, Partitions: dropped}, nil
+}
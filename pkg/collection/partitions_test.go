@@ -0,0 +1,91 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestPartitionedCollection_DropPartitions(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	layout := collection.NewPathLayout(filepath.Join(t.TempDir(), "data"))
+	repo.SetPathLayout(layout)
+	events := &pb.Collection{Namespace: "test", Name: "events", StoreOptions: &pb.StoreOptions{PartitionPeriod: "daily"}}
+
+	// Partitioned collections need their own store
+	if _, err := repo.CreateCollection(ctx, events); !errors.Is(err, collection.ErrPartitionedUnavailable) {
+		t.Fatalf("expected ErrPartitionedUnavailable without a store opener, got %v", err)
+	}
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+	if _, err := repo.CreateCollection(ctx, events); err != nil {
+		t.Fatalf("failed to create partitioned collection: %v", err)
+	}
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	coll, err := repo.GetCollection(ctx, "test", "events")
+	if err != nil {
+		t.Fatalf("GetCollection failed: %v", err)
+	}
+	if coll.Meta.StoreOptions.GetPartitionPeriod() != "daily" {
+		t.Errorf("expected the collection to record its partition period, got %v", coll.Meta.StoreOptions)
+	}
+	if got, want := coll.Store.Path(), collection.PartitionsDir(layout.CollectionDB("test", "events")); got != want {
+		t.Errorf("expected the collection's partitions in %s, got %s", want, got)
+	}
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for day := 0; day < 3; day++ {
+		ts := timestamppb.New(base.AddDate(0, 0, day))
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{
+			Id:        fmt.Sprintf("e%d", day),
+			ProtoData: []byte(`{}`),
+			Metadata:  &pb.Metadata{CreatedAt: ts, UpdatedAt: ts},
+		}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	server := collection.NewCollectionServer(repo)
+	cutoff := timestamppb.New(base.AddDate(0, 0, 2).Truncate(24 * time.Hour))
+	dry, err := server.DropPartitions(ctx, &pb.DropPartitionsRequest{Namespace: "test", CollectionName: "events", Before: cutoff, DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if dry.Impact.Count != 2 || !dry.Impact.DryRun || len(dry.Partitions) != 0 {
+		t.Errorf("unexpected dry run %v", dry)
+	}
+	resp, err := server.DropPartitions(ctx, &pb.DropPartitionsRequest{Namespace: "test", CollectionName: "events", Before: cutoff})
+	if err != nil {
+		t.Fatalf("DropPartitions failed: %v", err)
+	}
+	if resp.Impact.Count != 2 || resp.Impact.DryRun || fmt.Sprint(resp.Partitions) != "[20240301 20240302]" {
+		t.Errorf("unexpected drop %v", resp)
+	}
+	if count, _ := coll.CountRecords(ctx); count != 1 {
+		t.Errorf("expected 1 record left, got %d", count)
+	}
+
+	// Unpartitioned collections have no partitions to drop, and partitioned
+	// ones cannot be moved
+	_, err = server.DropPartitions(ctx, &pb.DropPartitionsRequest{Namespace: "test", CollectionName: "docs", Before: cutoff})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FAILED_PRECONDITION for an unpartitioned collection, got %v", err)
+	}
+	if _, err := repo.MoveStorage(ctx, "test", "events", filepath.Join(t.TempDir(), "elsewhere")); err == nil {
+		t.Errorf("expected moving a partitioned collection to be refused")
+	}
+}
@@ -0,0 +1,176 @@
+package collection
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PathSegment is one step of a FieldPath: an object key, an array index, or
+// the [*] wildcard over array elements.
+type PathSegment struct {
+	Key      string
+	Index    int // Negative indexes count from the end of the array
+	IsIndex  bool
+	Wildcard bool
+}
+
+// FieldPath addresses a value nested inside a record's JSON, such as
+// items[0].price or metadata.owner.id.
+type FieldPath []PathSegment
+
+// ParseFieldPath parses a JMESPath-style field expression:
+//
+//	status                 top-level field
+//	metadata.owner.id      nested objects
+//	items[0].price         array index; items[-1] is the last element
+//	items[*].sku           every element of an array (at most one wildcard)
+//	labels["app.kubernetes.io/name"]   keys that are not identifiers
+//
+// A leading "$." is accepted, so SQLite JSON paths parse as well.
+func ParseFieldPath(expr string) (FieldPath, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(expr), "$.")
+	if s == "" {
+		return nil, fmt.Errorf("empty field path")
+	}
+
+	var path FieldPath
+	wildcards := 0
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid field path %q: unclosed [", expr)
+			}
+			inner := s[i+1 : i+end]
+			i += end + 1
+
+			switch {
+			case inner == "*":
+				wildcards++
+				path = append(path, PathSegment{Wildcard: true})
+			case strings.HasPrefix(inner, `"`):
+				key, err := strconv.Unquote(inner)
+				if err != nil || strings.Contains(key, `"`) {
+					return nil, fmt.Errorf("invalid field path %q: bad quoted key %s", expr, inner)
+				}
+				path = append(path, PathSegment{Key: key})
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid field path %q: bad index [%s]", expr, inner)
+				}
+				path = append(path, PathSegment{Index: n, IsIndex: true})
+			}
+		case s[i] == '.' && len(path) > 0:
+			i++
+			fallthrough
+		default:
+			end := i
+			for end < len(s) && isPathKeyChar(s[end]) {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("invalid field path %q: expected a field name at offset %d", expr, i)
+			}
+			path = append(path, PathSegment{Key: s[i:end]})
+			i = end
+		}
+	}
+	if wildcards > 1 {
+		return nil, fmt.Errorf("invalid field path %q: at most one [*] is supported", expr)
+	}
+	return path, nil
+}
+
+func isPathKeyChar(c byte) bool {
+	return c == '_' || c == '-' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// JSONPath renders the path in SQLite JSON path syntax, quoting every key.
+// It must not contain a wildcard; see SplitWildcard.
+func (p FieldPath) JSONPath() string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, seg := range p {
+		switch {
+		case seg.IsIndex && seg.Index < 0:
+			fmt.Fprintf(&b, "[#%d]", seg.Index)
+		case seg.IsIndex:
+			fmt.Fprintf(&b, "[%d]", seg.Index)
+		default:
+			b.WriteString(`."` + seg.Key + `"`)
+		}
+	}
+	return b.String()
+}
+
+// String renders the path in the syntax ParseFieldPath reads, quoting keys
+// that are not identifiers.
+func (p FieldPath) String() string {
+	var b strings.Builder
+	for i, seg := range p {
+		switch {
+		case seg.Wildcard:
+			b.WriteString("[*]")
+		case seg.IsIndex:
+			fmt.Fprintf(&b, "[%d]", seg.Index)
+		case seg.Key == "" || strings.IndexFunc(seg.Key, func(r rune) bool { return r > 0x7f || !isPathKeyChar(byte(r)) }) >= 0:
+			b.WriteString("[" + strconv.Quote(seg.Key) + "]")
+		default:
+			if i > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(seg.Key)
+		}
+	}
+	return b.String()
+}
+
+// SplitWildcard splits the path at its [*] into the path of the array and the
+// path within each element. ok is false when the path has no wildcard.
+func (p FieldPath) SplitWildcard() (array, element FieldPath, ok bool) {
+	for i, seg := range p {
+		if seg.Wildcard {
+			return p[:i], p[i+1:], true
+		}
+	}
+	return p, nil, false
+}
+
+// Lookup returns the value at the path in a decoded JSON document, or nil if
+// any step is missing. Wildcard paths return a []interface{} of the values
+// found in each element.
+func (p FieldPath) Lookup(doc interface{}) interface{} {
+	for i, seg := range p {
+		switch {
+		case seg.Wildcard:
+			items, _ := doc.([]interface{})
+			values := make([]interface{}, 0, len(items))
+			for _, item := range items {
+				if v := p[i+1:].Lookup(item); v != nil {
+					values = append(values, v)
+				}
+			}
+			return values
+		case seg.IsIndex:
+			items, _ := doc.([]interface{})
+			idx := seg.Index
+			if idx < 0 {
+				idx += len(items)
+			}
+			if idx < 0 || idx >= len(items) {
+				return nil
+			}
+			doc = items[idx]
+		default:
+			obj, _ := doc.(map[string]interface{})
+			doc = obj[seg.Key]
+		}
+		if doc == nil {
+			return nil
+		}
+	}
+	return doc
+}
@@ -0,0 +1,106 @@
+package collection_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestParseFieldPath(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"status", `$."status"`},
+		{"$.status", `$."status"`},
+		{"metadata.owner.id", `$."metadata"."owner"."id"`},
+		{"items[0].price", `$."items"[0]."price"`},
+		{"items[-1]", `$."items"[#-1]`},
+		{`labels["app.kubernetes.io/name"]`, `$."labels"."app.kubernetes.io/name"`},
+		{"matrix[1][2]", `$."matrix"[1][2]`},
+	}
+	for _, tt := range tests {
+		path, err := collection.ParseFieldPath(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseFieldPath(%q) failed: %v", tt.expr, err)
+		}
+		if got := path.JSONPath(); got != tt.want {
+			t.Errorf("ParseFieldPath(%q).JSONPath() = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+
+	path, err := collection.ParseFieldPath("orders[*].items[0].sku")
+	if err != nil {
+		t.Fatalf("ParseFieldPath failed: %v", err)
+	}
+	array, element, ok := path.SplitWildcard()
+	if !ok || array.JSONPath() != `$."orders"` || element.JSONPath() != `$."items"[0]."sku"` {
+		t.Errorf("unexpected split: %s %s %v", array.JSONPath(), element.JSONPath(), ok)
+	}
+
+	for _, invalid := range []string{"", "a..b", ".a", "a[", "a[x]", "a[*][*]", `a["b"c"]`, "a b"} {
+		if _, err := collection.ParseFieldPath(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestFieldPath_Lookup(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"items": [{"sku": "A", "price": 5}, {"sku": "B"}], "owner": {"id": "u1"}}`), &doc)
+
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"owner.id", "u1"},
+		{"items[1].sku", "B"},
+		{"items[-2].price", "5"},
+		{"items[*].sku", "[A B]"},
+		{"items[*].price", "[5]"},
+		{"items[5].sku", "<nil>"},
+		{"owner.missing.id", "<nil>"},
+	}
+	for _, tt := range tests {
+		path, err := collection.ParseFieldPath(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseFieldPath(%q) failed: %v", tt.expr, err)
+		}
+		if got := fmt.Sprint(path.Lookup(doc)); got != tt.want {
+			t.Errorf("Lookup(%q) = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseFunctionCall(t *testing.T) {
+	call, ok, err := collection.ParseFunctionCall(`score(title, "a, b", 'it''s', 2, -1.5, null, labels["x.y"])`)
+	if !ok || err != nil {
+		t.Fatalf("ParseFunctionCall failed: %v %v", ok, err)
+	}
+	want := []string{`$."title"`, "a, b", "it's", "2", "-1.5", "<nil>", `$."labels"."x.y"`}
+	if call.Name != "score" || len(call.Args) != len(want) {
+		t.Fatalf("unexpected call %+v", call)
+	}
+	for i, arg := range call.Args {
+		got := fmt.Sprint(arg.Value)
+		if arg.Field != nil {
+			got = arg.Field.JSONPath()
+		}
+		if got != want[i] {
+			t.Errorf("argument %d = %s, want %s", i, got, want[i])
+		}
+	}
+
+	for _, path := range []string{"status", "items[0].price", `["f(x)"]`} {
+		if _, ok, err := collection.ParseFunctionCall(path); ok || err != nil {
+			t.Errorf("expected %q not parsed as a call, got %v %v", path, ok, err)
+		}
+	}
+	for _, invalid := range []string{"f(x", "f(x,)", "f(items[*].sku)", `f("unclosed)`} {
+		if _, ok, err := collection.ParseFunctionCall(invalid); !ok || err == nil {
+			t.Errorf("expected an error for %q, got %v %v", invalid, ok, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package collection
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Names of the preflight checks, in the order they run.
+const (
+	PreflightConfig      = "config"
+	PreflightDirectories = "directories"
+	PreflightSQLite      = "sqlite"
+	PreflightClock       = "clock"
+	PreflightPorts       = "ports"
+	PreflightTLS         = "tls"
+	PreflightPeers       = "peers"
+)
+
+const (
+	// DefaultPreflightPeerTimeout bounds how long a peer has to answer.
+	DefaultPreflightPeerTimeout = 5 * time.Second
+
+	// DefaultCertExpiryWarning is how close to expiry a certificate is
+	// reported as a warning.
+	DefaultCertExpiryWarning = 14 * 24 * time.Hour
+
+	// maxClockStep is how far the wall clock may drift from the monotonic
+	// clock during the clock check before it is reported as stepping.
+	maxClockStep = time.Second
+)
+
+// preflightClockFloor is a time every sane clock is past.
+var preflightClockFloor = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// PreflightOptions says what RunPreflight checks. Checks with nothing to
+// check are skipped.
+type PreflightOptions struct {
+	// Config validates the configuration, returning every problem found.
+	Config func() error
+	// Dirs must be writable directories, or creatable ones.
+	Dirs []string
+	// Listen are the addresses the server will listen on, which must be
+	// free.
+	Listen []string
+	// TLSCertFile and TLSKeyFile are a PEM certificate and key that must
+	// load as a pair and be valid now.
+	TLSCertFile string
+	TLSKeyFile  string
+	// Peers are collectors that must answer over gRPC.
+	Peers []string
+
+	// PeerTimeout defaults to DefaultPreflightPeerTimeout.
+	PeerTimeout time.Duration
+	// CertExpiryWarning defaults to DefaultCertExpiryWarning.
+	CertExpiryWarning time.Duration
+	// Clock is the clock the server will run on; it defaults to SystemClock.
+	Clock Clock
+}
+
+// RunPreflight runs every check, in order, and returns their results.
+func RunPreflight(ctx context.Context, opts PreflightOptions) []*pb.PreflightResult {
+	if opts.Clock == nil {
+		opts.Clock = SystemClock{}
+	}
+	if opts.PeerTimeout <= 0 {
+		opts.PeerTimeout = DefaultPreflightPeerTimeout
+	}
+	if opts.CertExpiryWarning <= 0 {
+		opts.CertExpiryWarning = DefaultCertExpiryWarning
+	}
+	return []*pb.PreflightResult{
+		checkConfig(opts.Config),
+		checkDirectories(opts.Dirs),
+		checkSQLite(ctx),
+		checkClock(opts.Clock),
+		checkPorts(opts.Listen),
+		checkTLS(opts.TLSCertFile, opts.TLSKeyFile, opts.Clock.Now(), opts.CertExpiryWarning),
+		checkPeers(ctx, opts.Peers, opts.PeerTimeout),
+	}
+}
+
+// PreflightPassed reports whether no check failed.
+func PreflightPassed(results []*pb.PreflightResult) bool {
+	for _, r := range results {
+		if r.Outcome == pb.PreflightOutcome_PREFLIGHT_FAIL {
+			return false
+		}
+	}
+	return true
+}
+
+func preflightResult(check string, outcome pb.PreflightOutcome, format string, args ...any) *pb.PreflightResult {
+	return &pb.PreflightResult{Check: check, Outcome: outcome, Detail: fmt.Sprintf(format, args...)}
+}
+
+func checkConfig(validate func() error) *pb.PreflightResult {
+	if validate == nil {
+		return preflightResult(PreflightConfig, pb.PreflightOutcome_PREFLIGHT_SKIP, "no configuration to validate")
+	}
+	if err := validate(); err != nil {
+		return preflightResult(PreflightConfig, pb.PreflightOutcome_PREFLIGHT_FAIL, "%s", strings.ReplaceAll(err.Error(), "\n", "; "))
+	}
+	return preflightResult(PreflightConfig, pb.PreflightOutcome_PREFLIGHT_PASS, "configuration is valid")
+}
+
+// checkDirectories checks that each directory, or the nearest existing
+// parent of one still to be created, is a directory this process can write
+// to. Nothing is left behind.
+func checkDirectories(dirs []string) *pb.PreflightResult {
+	if len(dirs) == 0 {
+		return preflightResult(PreflightDirectories, pb.PreflightOutcome_PREFLIGHT_SKIP, "no directories to check")
+	}
+	var problems []string
+	for _, dir := range dirs {
+		if err := checkWritableDir(dir); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return preflightResult(PreflightDirectories, pb.PreflightOutcome_PREFLIGHT_FAIL, "%s", strings.Join(problems, "; "))
+	}
+	return preflightResult(PreflightDirectories, pb.PreflightOutcome_PREFLIGHT_PASS, "%s writable", strings.Join(dirs, ", "))
+}
+
+func checkWritableDir(dir string) error {
+	existing := filepath.Clean(dir)
+	for {
+		info, err := os.Stat(existing)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s: %s is not a directory", dir, existing)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return fmt.Errorf("%s: no existing parent directory", dir)
+		}
+		existing = parent
+	}
+	f, err := os.CreateTemp(existing, ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("%s: cannot write to %s: %v", dir, existing, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// checkSQLite checks that the SQLite library has the FTS5 and JSON1
+// features stores rely on, by using them.
+func checkSQLite(ctx context.Context) *pb.PreflightResult {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return preflightResult(PreflightSQLite, pb.PreflightOutcome_PREFLIGHT_FAIL, "cannot open SQLite: %v", err)
+	}
+	defer db.Close()
+
+	var version string
+	if err := db.QueryRowContext(ctx, `SELECT sqlite_version()`).Scan(&version); err != nil {
+		return preflightResult(PreflightSQLite, pb.PreflightOutcome_PREFLIGHT_FAIL, "cannot query SQLite: %v", err)
+	}
+	var missing []string
+	if _, err := db.ExecContext(ctx, `CREATE VIRTUAL TABLE preflight_fts USING fts5(body)`); err != nil {
+		missing = append(missing, fmt.Sprintf("FTS5 (%v)", err))
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, `SELECT json_extract('{"a": 1}', '$.a')`).Scan(&n); err != nil || n != 1 {
+		missing = append(missing, fmt.Sprintf("JSON1 (%v)", err))
+	}
+	if len(missing) > 0 {
+		return preflightResult(PreflightSQLite, pb.PreflightOutcome_PREFLIGHT_FAIL, "SQLite %s lacks %s", version, strings.Join(missing, ", "))
+	}
+	return preflightResult(PreflightSQLite, pb.PreflightOutcome_PREFLIGHT_PASS, "SQLite %s with FTS5 and JSON1", version)
+}
+
+// checkClock checks that the clock is not behind the binary's build time,
+// and that the wall clock keeps pace with the monotonic clock.
+func checkClock(clock Clock) *pb.PreflightResult {
+	now := clock.Now()
+	floor := preflightClockFloor
+	if built := buildTime(); built.After(floor) {
+		floor = built
+	}
+	if now.Before(floor) {
+		return preflightResult(PreflightClock, pb.PreflightOutcome_PREFLIGHT_FAIL,
+			"clock reads %s, before %s; timestamps of records and backups would be wrong", now.UTC().Format(time.RFC3339), floor.Format(time.RFC3339))
+	}
+
+	start := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	end := time.Now()
+	if step := end.Round(0).Sub(start.Round(0)) - end.Sub(start); step > maxClockStep || step < -maxClockStep {
+		return preflightResult(PreflightClock, pb.PreflightOutcome_PREFLIGHT_WARN,
+			"wall clock stepped %s while checking; it may be adjusted abruptly while serving", step)
+	}
+	detail := fmt.Sprintf("clock reads %s", now.UTC().Format(time.RFC3339))
+	if skewed, ok := clock.(SkewedClock); ok {
+		detail += fmt.Sprintf(", corrected by %s", skewed.Offset)
+	}
+	return preflightResult(PreflightClock, pb.PreflightOutcome_PREFLIGHT_PASS, "%s", detail)
+}
+
+// buildTime returns the commit time of the binary's VCS revision, or the
+// zero time if it was not recorded.
+func buildTime() time.Time {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return time.Time{}
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.time" {
+			t, _ := time.Parse(time.RFC3339, setting.Value)
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func checkPorts(addrs []string) *pb.PreflightResult {
+	if len(addrs) == 0 {
+		return preflightResult(PreflightPorts, pb.PreflightOutcome_PREFLIGHT_SKIP, "no listen addresses to check")
+	}
+	var problems []string
+	for _, addr := range addrs {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", addr, err))
+			continue
+		}
+		lis.Close()
+	}
+	if len(problems) > 0 {
+		return preflightResult(PreflightPorts, pb.PreflightOutcome_PREFLIGHT_FAIL, "%s", strings.Join(problems, "; "))
+	}
+	return preflightResult(PreflightPorts, pb.PreflightOutcome_PREFLIGHT_PASS, "%s free", strings.Join(addrs, ", "))
+}
+
+func checkTLS(certFile, keyFile string, now time.Time, warnBefore time.Duration) *pb.PreflightResult {
+	switch {
+	case certFile == "" && keyFile == "":
+		return preflightResult(PreflightTLS, pb.PreflightOutcome_PREFLIGHT_SKIP, "no TLS certificate configured")
+	case certFile == "" || keyFile == "":
+		return preflightResult(PreflightTLS, pb.PreflightOutcome_PREFLIGHT_FAIL, "a TLS certificate needs both a certificate and a key file")
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return preflightResult(PreflightTLS, pb.PreflightOutcome_PREFLIGHT_FAIL, "cannot load %s and %s: %v", certFile, keyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return preflightResult(PreflightTLS, pb.PreflightOutcome_PREFLIGHT_FAIL, "cannot parse %s: %v", certFile, err)
+	}
+	switch {
+	case now.Before(leaf.NotBefore):
+		return preflightResult(PreflightTLS, pb.PreflightOutcome_PREFLIGHT_FAIL, "certificate for %s is not valid until %s", leaf.Subject.CommonName, leaf.NotBefore.Format(time.RFC3339))
+	case !now.Before(leaf.NotAfter):
+		return preflightResult(PreflightTLS, pb.PreflightOutcome_PREFLIGHT_FAIL, "certificate for %s expired %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	case leaf.NotAfter.Sub(now) < warnBefore:
+		return preflightResult(PreflightTLS, pb.PreflightOutcome_PREFLIGHT_WARN, "certificate for %s expires %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return preflightResult(PreflightTLS, pb.PreflightOutcome_PREFLIGHT_PASS, "certificate for %s valid until %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+}
+
+// checkPeers checks that each peer answers a gRPC call. Any answer, even an
+// error status, shows the peer is reachable.
+func checkPeers(ctx context.Context, peers []string, timeout time.Duration) *pb.PreflightResult {
+	if len(peers) == 0 {
+		return preflightResult(PreflightPeers, pb.PreflightOutcome_PREFLIGHT_SKIP, "no peers to check")
+	}
+	var problems []string
+	for _, peer := range peers {
+		if err := pingPeer(ctx, peer, timeout); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", peer, err))
+		}
+	}
+	if len(problems) > 0 {
+		return preflightResult(PreflightPeers, pb.PreflightOutcome_PREFLIGHT_FAIL, "%s", strings.Join(problems, "; "))
+	}
+	return preflightResult(PreflightPeers, pb.PreflightOutcome_PREFLIGHT_PASS, "%s reachable", strings.Join(peers, ", "))
+}
+
+func pingPeer(ctx context.Context, peer string, timeout time.Duration) error {
+	conn, err := grpc.NewClient(peer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err = pb.NewCollectionRepoClient(conn).Discover(ctx, &pb.DiscoverRequest{PageSize: 1}, grpc.WaitForReady(true))
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return fmt.Errorf("unreachable: %v", status.Convert(err).Message())
+	}
+	return nil
+}
+
+// SetPreflight sets what the PreflightCheck RPC checks. Listen addresses
+// are not checked while serving.
+func (s *GrpcServer) SetPreflight(opts PreflightOptions) {
+	s.preflight = opts
+}
+
+// PreflightCheck runs the preflight checks against the running server,
+// and reaches the request's peers as well as the configured ones.
+func (s *GrpcServer) PreflightCheck(ctx context.Context, req *pb.PreflightCheckRequest) (*pb.PreflightCheckResponse, error) {
+	opts := s.preflight
+	opts.Listen = nil
+	opts.Peers = append(append([]string(nil), opts.Peers...), req.Peers...)
+	results := RunPreflight(ctx, opts)
+	for _, r := range results {
+		if r.Check == PreflightPorts {
+			r.Detail = "listen addresses are in use by this server"
+		}
+	}
+	return &pb.PreflightCheckResponse{
+		Status:  &pb.Status{Code: pb.Status_OK},
+		Results: results,
+		Passed:  PreflightPassed(results),
+	}, nil
+}
@@ -0,0 +1,158 @@
+package collection_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// writeTestCert writes a self-signed certificate valid until notAfter and
+// its key, returning their paths.
+func writeTestCert(t *testing.T, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "collector.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func outcomes(results []*pb.PreflightResult) map[string]pb.PreflightOutcome {
+	byCheck := make(map[string]pb.PreflightOutcome)
+	for _, r := range results {
+		byCheck[r.Check] = r.Outcome
+	}
+	return byCheck
+}
+
+func TestRunPreflight(t *testing.T) {
+	ctx := context.Background()
+
+	// With nothing configured, only SQLite and the clock are checked
+	results := collection.RunPreflight(ctx, collection.PreflightOptions{})
+	got := outcomes(results)
+	if got[collection.PreflightSQLite] != pb.PreflightOutcome_PREFLIGHT_PASS || got[collection.PreflightClock] != pb.PreflightOutcome_PREFLIGHT_PASS {
+		t.Fatalf("expected SQLite and clock checks to pass, got %v", results)
+	}
+	for _, check := range []string{collection.PreflightConfig, collection.PreflightDirectories, collection.PreflightPorts, collection.PreflightTLS, collection.PreflightPeers} {
+		if got[check] != pb.PreflightOutcome_PREFLIGHT_SKIP {
+			t.Errorf("expected %s skipped, got %v", check, got[check])
+		}
+	}
+	if !collection.PreflightPassed(results) {
+		t.Errorf("expected preflight passed, got %v", results)
+	}
+
+	// A good setup passes; directories still to be created count as
+	// writable, and certificates near expiry only warn
+	root := t.TempDir()
+	certFile, keyFile := writeTestCert(t, time.Now().Add(48*time.Hour))
+	_, _, peer := startRepoServer(t)
+	results = collection.RunPreflight(ctx, collection.PreflightOptions{
+		Config:      func() error { return nil },
+		Dirs:        []string{root, filepath.Join(root, "data", "collections")},
+		Listen:      []string{"127.0.0.1:0"},
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+		Peers:       []string{peer},
+	})
+	got = outcomes(results)
+	for _, check := range []string{collection.PreflightConfig, collection.PreflightDirectories, collection.PreflightPorts, collection.PreflightPeers} {
+		if got[check] != pb.PreflightOutcome_PREFLIGHT_PASS {
+			t.Errorf("expected %s passed, got %v", check, results)
+		}
+	}
+	if got[collection.PreflightTLS] != pb.PreflightOutcome_PREFLIGHT_WARN || !collection.PreflightPassed(results) {
+		t.Errorf("expected a warning for the expiring certificate, got %v", results)
+	}
+	if _, err := os.Stat(filepath.Join(root, "data")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected preflight to create nothing, got %v", err)
+	}
+
+	// Each problem fails its check
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer taken.Close()
+	notDir := filepath.Join(root, "file")
+	os.WriteFile(notDir, nil, 0644)
+	expiredCert, expiredKey := writeTestCert(t, time.Now().Add(-time.Minute))
+	unreachable, _ := net.Listen("tcp", "127.0.0.1:0")
+	unreachable.Close()
+	results = collection.RunPreflight(ctx, collection.PreflightOptions{
+		Config:      func() error { return errors.New("COLLECTOR_DEDUPLICATE must be true or false") },
+		Dirs:        []string{filepath.Join(notDir, "data")},
+		Listen:      []string{taken.Addr().String()},
+		TLSCertFile: expiredCert,
+		TLSKeyFile:  expiredKey,
+		Peers:       []string{unreachable.Addr().String()},
+		PeerTimeout: time.Second,
+	})
+	for check, outcome := range outcomes(results) {
+		if check != collection.PreflightSQLite && check != collection.PreflightClock && outcome != pb.PreflightOutcome_PREFLIGHT_FAIL {
+			t.Errorf("expected %s failed, got %v", check, results)
+		}
+	}
+	if collection.PreflightPassed(results) {
+		t.Errorf("expected preflight failed")
+	}
+
+	// A clock behind the binary cannot be trusted
+	results = collection.RunPreflight(ctx, collection.PreflightOptions{Clock: collection.NewFixedClock(time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC))})
+	if outcomes(results)[collection.PreflightClock] != pb.PreflightOutcome_PREFLIGHT_FAIL {
+		t.Errorf("expected a clock in 2001 to fail, got %v", results)
+	}
+}
+
+func TestPreflightCheckRPC(t *testing.T) {
+	ctx := context.Background()
+	_, server, addr := startRepoServer(t)
+	server.SetPreflight(collection.PreflightOptions{
+		Dirs:   []string{t.TempDir()},
+		Listen: []string{addr}, // In use by the server itself
+	})
+
+	resp, err := server.PreflightCheck(ctx, &pb.PreflightCheckRequest{Peers: []string{addr}})
+	if err != nil || resp.Status.Code != pb.Status_OK || !resp.Passed {
+		t.Fatalf("PreflightCheck failed: %v %v", resp, err)
+	}
+	got := outcomes(resp.Results)
+	if got[collection.PreflightPorts] != pb.PreflightOutcome_PREFLIGHT_SKIP ||
+		got[collection.PreflightDirectories] != pb.PreflightOutcome_PREFLIGHT_PASS ||
+		got[collection.PreflightPeers] != pb.PreflightOutcome_PREFLIGHT_PASS {
+		t.Errorf("unexpected results %v", resp.Results)
+	}
+}
@@ -0,0 +1,168 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// PrincipalMetadataKey is the gRPC metadata header naming the caller. The
+// collector does not authenticate it, so it only serves where a wrong name
+// does no harm, such as a lease's holder. Approvals, legal holds and method
+// ACLs take the principal from AuthenticatedPrincipal instead.
+const PrincipalMetadataKey = "x-collector-principal"
+
+// AuthorizationMetadataKey is the gRPC metadata header carrying a caller's
+// bearer token ("Bearer <token>") for a PrincipalAuthenticator.
+const AuthorizationMetadataKey = "authorization"
+
+type principalKey struct{}
+
+// WithPrincipal returns a context whose calls are made by principal, an
+// authenticated identity: a PrincipalAuthenticator attaches it, as may
+// interceptors of a deployment's own or in-process callers. It takes
+// precedence over the PrincipalMetadataKey header.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal making a call, from
+// WithPrincipal or the incoming PrincipalMetadataKey header, or "" if the
+// caller is anonymous.
+func PrincipalFromContext(ctx context.Context) string {
+	if p := AuthenticatedPrincipal(ctx); p != "" {
+		return p
+	}
+	return incomingMetadata(ctx, PrincipalMetadataKey)
+}
+
+// AuthenticatedPrincipal returns the principal attached to a call with
+// WithPrincipal, e.g. by a PrincipalAuthenticator, or "" if the caller was
+// not authenticated. Unlike PrincipalFromContext it ignores the
+// PrincipalMetadataKey header, which any client can set.
+func AuthenticatedPrincipal(ctx context.Context) string {
+	p, _ := ctx.Value(principalKey{}).(string)
+	return p
+}
+
+// incomingMetadata returns the first value of an incoming gRPC metadata
+// header, or "".
+func incomingMetadata(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// PrincipalAuthenticatorOptions configures a PrincipalAuthenticator.
+type PrincipalAuthenticatorOptions struct {
+	Tokens           map[string]string // Principals by bearer token
+	PeerCertificates bool              // Authenticate mutual TLS clients as their verified certificate's common name
+}
+
+// PrincipalAuthenticator establishes who makes each call, for approvals,
+// legal holds and method ACLs: the principal of the bearer token the call
+// presents, or of its verified client certificate. Calls presenting neither
+// are anonymous; calls presenting an unknown token are refused with
+// UNAUTHENTICATED.
+type PrincipalAuthenticator struct {
+	opts PrincipalAuthenticatorOptions
+}
+
+// NewPrincipalAuthenticator creates a PrincipalAuthenticator.
+func NewPrincipalAuthenticator(opts PrincipalAuthenticatorOptions) *PrincipalAuthenticator {
+	return &PrincipalAuthenticator{opts: opts}
+}
+
+// LoadPrincipalTokens reads a principal token file: one "<principal>
+// <token>" per line, with blank lines and lines starting with # ignored.
+func LoadPrincipalTokens(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read principal tokens: %w", err)
+	}
+	tokens := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("principal tokens line %d: expected <principal> <token>", i+1)
+		}
+		if _, exists := tokens[fields[1]]; exists {
+			return nil, fmt.Errorf("principal tokens line %d: token of %s is already another principal's", i+1, fields[0])
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("principal tokens file %s has no tokens", path)
+	}
+	return tokens, nil
+}
+
+// authenticate returns ctx with the call's authenticated principal attached,
+// if it has one.
+func (a *PrincipalAuthenticator) authenticate(ctx context.Context) (context.Context, error) {
+	if auth := incomingMetadata(ctx, AuthorizationMetadataKey); auth != "" {
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		principal := a.opts.Tokens[token]
+		if !ok || principal == "" {
+			return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+		}
+		return WithPrincipal(ctx, principal), nil
+	}
+	if a.opts.PeerCertificates {
+		if p, ok := peer.FromContext(ctx); ok {
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+				if cn := info.State.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+					return WithPrincipal(ctx, cn), nil
+				}
+			}
+		}
+	}
+	return ctx, nil
+}
+
+// UnaryInterceptor authenticates the principal of each call.
+func (a *PrincipalAuthenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// authenticatedStream carries a stream's authenticated context.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context { return s.ctx }
+
+// StreamInterceptor authenticates the principal of each stream.
+func (a *PrincipalAuthenticator) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
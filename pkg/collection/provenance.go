@@ -0,0 +1,249 @@
+package collection
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// ProvenanceSchema keeps where a database's records came from. Records
+// without a record_provenance row were first written to the collection they
+// are in; copies add a row for each record they copy and append their
+// lineage_events ID to every row's lineage, a JSON array oldest first.
+// Events travel with the database, so every ID in a lineage resolves in the
+// same file.
+const ProvenanceSchema = `
+CREATE TABLE IF NOT EXISTS lineage_events (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    source_collector TEXT NOT NULL,
+    source_collection TEXT NOT NULL,
+    dest_collector TEXT NOT NULL,
+    dest_collection TEXT NOT NULL,
+    backup_id TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS record_provenance (
+    record_id TEXT PRIMARY KEY,
+    origin_collector TEXT NOT NULL,
+    origin_collection TEXT NOT NULL,
+    lineage TEXT NOT NULL DEFAULT '[]'
+);
+CREATE TRIGGER IF NOT EXISTS record_provenance_ad AFTER DELETE ON records BEGIN
+    DELETE FROM record_provenance WHERE record_id = old.id;
+END;
+`
+
+// Kinds of LineageEvent.
+const (
+	LineageClone   = "clone"   // CloneLocal, within a collector
+	LineageFetch   = "fetch"   // FetchRemote, pulled from another collector
+	LineagePush    = "push"    // CloneRemote, received from another collector
+	LineageRestore = "restore" // RestoreBackup
+)
+
+// stampProvenance records event in the copied database at dbPath: records
+// copied for the first time get the event's source as their origin, and
+// every record's lineage ends with the event.
+func stampProvenance(ctx context.Context, dbPath string, event *pb.LineageEvent) error {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_busy_timeout=10000", dbPath))
+	if err != nil {
+		return fmt.Errorf("failed to open copy: %w", err)
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, ProvenanceSchema); err != nil {
+		return fmt.Errorf("provenance schema failed: %w", err)
+	}
+	source := namespacedKey(event.SourceCollection)
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO lineage_events (id, kind, source_collector, source_collection, dest_collector, dest_collection, backup_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.Id, event.Kind, event.SourceCollector, source, event.DestCollector,
+		namespacedKey(event.DestCollection), event.BackupId, event.CreatedAt,
+	); err != nil {
+		return fmt.Errorf("failed to record lineage event: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO record_provenance (record_id, origin_collector, origin_collection)
+		SELECT id, ?, ? FROM records WHERE id NOT IN (SELECT record_id FROM record_provenance)`,
+		event.SourceCollector, source,
+	); err != nil {
+		return fmt.Errorf("failed to stamp record origins: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE record_provenance SET lineage = json_insert(lineage, '$[#]', ?)`, event.Id); err != nil {
+		return fmt.Errorf("failed to extend record lineage: %w", err)
+	}
+	return tx.Commit()
+}
+
+// namespacedKey returns "namespace/name", as lineage tables keep collections.
+func namespacedKey(n *pb.NamespacedName) string {
+	return n.GetNamespace() + "/" + n.GetName()
+}
+
+// parseNamespacedKey reverses namespacedKey.
+func parseNamespacedKey(key string) *pb.NamespacedName {
+	namespace, name, _ := strings.Cut(key, "/")
+	return &pb.NamespacedName{Namespace: namespace, Name: name}
+}
+
+// GetLineage reports where a collection's records came from: the copies its
+// database went through, its records grouped by origin and lineage, and the
+// provenance of the requested records. Records without provenance were
+// first written to the collection itself, on this collector.
+//
+// Copies land in the layout's database file for the collection, so lineage
+// is read from there when it exists, and from the collection's store
+// otherwise.
+func (s *GrpcServer) GetLineage(ctx context.Context, req *pb.GetLineageRequest) (*pb.GetLineageResponse, error) {
+	if req.Collection.GetNamespace() == "" || req.Collection.GetName() == "" {
+		return &pb.GetLineageResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection namespace and name are required"},
+		}, nil
+	}
+	coll, err := s.repo.GetCollection(ctx, req.Collection.Namespace, req.Collection.Name)
+	if err != nil {
+		return &pb.GetLineageResponse{
+			Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: err.Error()},
+		}, nil
+	}
+
+	path := s.lineageDB(coll)
+	if path == "" {
+		return &pb.GetLineageResponse{
+			Status: &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: "collection has no database file"},
+		}, nil
+	}
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=10000", path))
+	if err != nil {
+		return &pb.GetLineageResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: fmt.Sprintf("failed to open collection database: %v", err)},
+		}, nil
+	}
+	defer db.Close()
+
+	resp := &pb.GetLineageResponse{Status: &pb.Status{Code: pb.Status_OK}}
+	self := &lineageOrigin{collector: s.cloneManager.Endpoint(), collection: namespacedKey(req.Collection)}
+	if err := readLineage(ctx, db, self, req.RecordIds, resp); err != nil {
+		return &pb.GetLineageResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: fmt.Sprintf("failed to read lineage: %v", err)},
+		}, nil
+	}
+	resp.Status.Message = fmt.Sprintf("%d lineage events, %d origins", len(resp.Events), len(resp.Origins))
+	return resp, nil
+}
+
+// lineageDB returns the path of the database holding coll's provenance, or
+// "" for a store in memory.
+func (s *GrpcServer) lineageDB(coll *Collection) string {
+	if repo, ok := s.repo.(*DefaultCollectionRepo); ok && repo.StoragePath(coll.Meta.Namespace, coll.Meta.Name) != "" {
+		return coll.Store.Path()
+	}
+	path := s.cloneManager.layout.CollectionDB(coll.Meta.Namespace, coll.Meta.Name)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	return coll.Store.Path()
+}
+
+// lineageOrigin is the origin of records without provenance.
+type lineageOrigin struct {
+	collector  string
+	collection string
+}
+
+// readLineage fills resp from the provenance tables of db. A database
+// written before provenance has no tables, and all its records are self's.
+func readLineage(ctx context.Context, db *sql.DB, self *lineageOrigin, recordIDs []string, resp *pb.GetLineageResponse) error {
+	var tables int
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('lineage_events', 'record_provenance')`,
+	).Scan(&tables); err != nil {
+		return err
+	}
+	provenance := "(SELECT NULL AS record_id, NULL AS origin_collector, NULL AS origin_collection, NULL AS lineage)"
+	if tables == 2 {
+		provenance = "record_provenance"
+		if err := readLineageEvents(ctx, db, resp); err != nil {
+			return err
+		}
+	}
+
+	origins, err := db.QueryContext(ctx, `
+		SELECT COALESCE(p.origin_collector, ?), COALESCE(p.origin_collection, ?), COALESCE(p.lineage, '[]'), COUNT(*)
+		FROM records r LEFT JOIN `+provenance+` p ON p.record_id = r.id
+		GROUP BY 1, 2, 3 ORDER BY 4 DESC, 1, 2, 3`, self.collector, self.collection)
+	if err != nil {
+		return err
+	}
+	defer origins.Close()
+	for origins.Next() {
+		var collector, collection, lineage string
+		origin := &pb.LineageOrigin{}
+		if err := origins.Scan(&collector, &collection, &lineage, &origin.RecordCount); err != nil {
+			return err
+		}
+		origin.OriginCollector, origin.OriginCollection = collector, parseNamespacedKey(collection)
+		if err := json.Unmarshal([]byte(lineage), &origin.LineageIds); err != nil {
+			return fmt.Errorf("invalid lineage %q: %w", lineage, err)
+		}
+		resp.Origins = append(resp.Origins, origin)
+	}
+	if err := origins.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range recordIDs {
+		var collector, collection, lineage string
+		err := db.QueryRowContext(ctx, `
+			SELECT COALESCE(p.origin_collector, ?), COALESCE(p.origin_collection, ?), COALESCE(p.lineage, '[]')
+			FROM records r LEFT JOIN `+provenance+` p ON p.record_id = r.id WHERE r.id = ?`,
+			self.collector, self.collection, id).Scan(&collector, &collection, &lineage)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		record := &pb.RecordProvenance{RecordId: id, OriginCollector: collector, OriginCollection: parseNamespacedKey(collection)}
+		if err := json.Unmarshal([]byte(lineage), &record.LineageIds); err != nil {
+			return fmt.Errorf("invalid lineage of %s: %w", id, err)
+		}
+		resp.Records = append(resp.Records, record)
+	}
+	return nil
+}
+
+// readLineageEvents adds db's lineage events to resp, oldest first.
+func readLineageEvents(ctx context.Context, db *sql.DB, resp *pb.GetLineageResponse) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, kind, source_collector, source_collection, dest_collector, dest_collection, backup_id, created_at
+		FROM lineage_events ORDER BY created_at, rowid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var source, dest string
+		event := &pb.LineageEvent{}
+		if err := rows.Scan(&event.Id, &event.Kind, &event.SourceCollector, &source,
+			&event.DestCollector, &dest, &event.BackupId, &event.CreatedAt); err != nil {
+			return err
+		}
+		event.SourceCollection, event.DestCollection = parseNamespacedKey(source), parseNamespacedKey(dest)
+		resp.Events = append(resp.Events, event)
+	}
+	return rows.Err()
+}
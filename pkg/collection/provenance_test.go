@@ -0,0 +1,90 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestGetLineage(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	dir := t.TempDir()
+	layout := collection.NewPathLayout(filepath.Join(dir, "data"))
+	repo.SetPathLayout(layout)
+	server := collection.NewGrpcServerWithLayout(repo, layout)
+	server.SetEndpoint("collector-a:50051")
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "docs")
+	for i := 0; i < 10; i++ {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: fmt.Sprintf("doc-%02d", i), ProtoData: []byte(`{}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	docs := &pb.NamespacedName{Namespace: "test", Name: "docs"}
+
+	// Records written here originate here
+	resp, _ := server.GetLineage(ctx, &pb.GetLineageRequest{Collection: docs, RecordIds: []string{"doc-01"}})
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("GetLineage failed: %v", resp.Status)
+	}
+	if len(resp.Events) != 0 || len(resp.Origins) != 1 || resp.Origins[0].RecordCount != 10 ||
+		resp.Origins[0].OriginCollector != "collector-a:50051" || resp.Origins[0].OriginCollection.Name != "docs" {
+		t.Errorf("expected every record original to test/docs, got %v %v", resp.Events, resp.Origins)
+	}
+	if len(resp.Records) != 1 || len(resp.Records[0].LineageIds) != 0 {
+		t.Errorf("expected doc-01 without lineage, got %v", resp.Records)
+	}
+
+	// A clone stamps its records with their origin and the clone
+	clone, _ := server.CloneCollection(ctx, &pb.CloneCollectionRequest{Namespace: "test", SourceName: "docs", DestName: "copy"})
+	if clone.Status.Code != pb.Status_OK {
+		t.Fatalf("clone failed: %v", clone.Status)
+	}
+	resp, _ = server.GetLineage(ctx, &pb.GetLineageRequest{
+		Collection: &pb.NamespacedName{Namespace: "test", Name: "copy"},
+		RecordIds:  []string{"doc-03", "missing"},
+	})
+	if len(resp.Events) != 1 || resp.Events[0].Kind != collection.LineageClone || resp.Events[0].DestCollection.Name != "copy" {
+		t.Fatalf("expected one clone event, got %v", resp.Events)
+	}
+	cloneID := resp.Events[0].Id
+	if len(resp.Origins) != 1 || resp.Origins[0].OriginCollection.Name != "docs" || resp.Origins[0].RecordCount != 10 ||
+		len(resp.Origins[0].LineageIds) != 1 || resp.Origins[0].LineageIds[0] != cloneID {
+		t.Errorf("expected the clone's records from test/docs through %s, got %v", cloneID, resp.Origins)
+	}
+	if len(resp.Records) != 1 || resp.Records[0].RecordId != "doc-03" || resp.Records[0].OriginCollector != "collector-a:50051" {
+		t.Errorf("expected doc-03 alone reported, got %v", resp.Records)
+	}
+
+	// So does a restore, keeping origins stamped before the backup
+	backup, _ := server.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: docs, DestPath: filepath.Join(dir, "backups", "docs.db")})
+	if backup.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", backup.Status)
+	}
+	restore, _ := server.RestoreBackup(ctx, &pb.RestoreBackupRequest{BackupId: backup.Backup.BackupId, DestNamespace: "restored", DestName: "docs"})
+	if restore.Status.Code != pb.Status_OK {
+		t.Fatalf("restore failed: %v", restore.Status)
+	}
+	resp, _ = server.GetLineage(ctx, &pb.GetLineageRequest{Collection: &pb.NamespacedName{Namespace: "restored", Name: "docs"}})
+	if len(resp.Events) != 1 || resp.Events[0].Kind != collection.LineageRestore || resp.Events[0].BackupId != backup.Backup.BackupId {
+		t.Fatalf("expected one restore event, got %v", resp.Events)
+	}
+	if len(resp.Origins) != 1 || resp.Origins[0].OriginCollection.Namespace != "test" || resp.Origins[0].LineageIds[0] != resp.Events[0].Id {
+		t.Errorf("expected the restored records from test/docs through the restore, got %v", resp.Origins)
+	}
+
+	resp, _ = server.GetLineage(ctx, &pb.GetLineageRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "nope"}})
+	if resp.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND for a missing collection, got %v", resp.Status)
+	}
+}
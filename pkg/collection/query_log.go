@@ -0,0 +1,153 @@
+package collection
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSlowQueryThreshold marks searches slower than this as slow.
+	DefaultSlowQueryThreshold = 100 * time.Millisecond
+
+	// maxSlowQueries is the number of slow queries kept per collection.
+	maxSlowQueries = 100
+
+	// MaxTrackedFields is the number of fields whose usage is kept per
+	// collection. Searches name fields freely, so past it the least used
+	// field is forgotten to make room for a new one.
+	MaxTrackedFields = 1000
+)
+
+// FieldUsage counts how often Search requests used a field.
+type FieldUsage struct {
+	Filters  int64 // Searches filtering on the field
+	OrderBys int64 // Searches ordering by the field
+	Slow     int64 // Slow searches that filtered or ordered on the field
+}
+
+// SlowQuery describes a search that exceeded the slow-query threshold.
+type SlowQuery struct {
+	Fields   []string
+	FullText bool
+	Duration time.Duration
+	At       time.Time
+}
+
+// QueryLog records which fields searches use and which searches were slow, per collection.
+// It is safe for concurrent use.
+type QueryLog struct {
+	threshold time.Duration
+
+	mu    sync.Mutex
+	usage map[string]map[string]*FieldUsage // collection key -> field -> usage
+	slow  map[string][]SlowQuery
+}
+
+// NewQueryLog creates a QueryLog. A non-positive threshold uses DefaultSlowQueryThreshold.
+func NewQueryLog(slowThreshold time.Duration) *QueryLog {
+	if slowThreshold <= 0 {
+		slowThreshold = DefaultSlowQueryThreshold
+	}
+	return &QueryLog{
+		threshold: slowThreshold,
+		usage:     make(map[string]map[string]*FieldUsage),
+		slow:      make(map[string][]SlowQuery),
+	}
+}
+
+// Record logs a completed search against namespace/name.
+func (l *QueryLog) Record(namespace, name string, q *SearchQuery, d time.Duration) {
+	key := namespace + "/" + name
+	isSlow := d >= l.threshold
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fields := l.usage[key]
+	if fields == nil {
+		fields = make(map[string]*FieldUsage)
+		l.usage[key] = fields
+	}
+	get := func(field string) *FieldUsage {
+		u := fields[field]
+		if u == nil {
+			if len(fields) >= MaxTrackedFields {
+				evictLeastUsed(fields, q)
+			}
+			u = &FieldUsage{}
+			fields[field] = u
+		}
+		return u
+	}
+
+	var used []string
+	for field := range q.Filters {
+		u := get(field)
+		u.Filters++
+		if isSlow {
+			u.Slow++
+		}
+		used = append(used, field)
+	}
+	if q.OrderBy != "" {
+		u := get(q.OrderBy)
+		u.OrderBys++
+		if isSlow && q.Filters[q.OrderBy].Operator == "" {
+			u.Slow++
+		}
+		used = append(used, q.OrderBy)
+	}
+
+	if isSlow {
+		sort.Strings(used)
+		entries := append(l.slow[key], SlowQuery{
+			Fields:   used,
+			FullText: q.FullText != "",
+			Duration: d,
+			At:       time.Now(),
+		})
+		if len(entries) > maxSlowQueries {
+			entries = entries[len(entries)-maxSlowQueries:]
+		}
+		l.slow[key] = entries
+	}
+}
+
+// evictLeastUsed forgets the field searches used least, other than those q
+// uses.
+func evictLeastUsed(fields map[string]*FieldUsage, q *SearchQuery) {
+	var victim string
+	var least int64 = -1
+	for field, u := range fields {
+		if _, ok := q.Filters[field]; ok || field == q.OrderBy {
+			continue
+		}
+		if uses := u.Filters + u.OrderBys; least < 0 || uses < least || (uses == least && field < victim) {
+			victim, least = field, uses
+		}
+	}
+	if least >= 0 {
+		delete(fields, victim)
+	}
+}
+
+// FieldUsage returns a copy of the per-field usage for namespace/name.
+func (l *QueryLog) FieldUsage(namespace, name string) map[string]FieldUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make(map[string]FieldUsage)
+	for field, u := range l.usage[namespace+"/"+name] {
+		out[field] = *u
+	}
+	return out
+}
+
+// SlowQueries returns the most recent slow searches against namespace/name, oldest first.
+func (l *QueryLog) SlowQueries(namespace, name string) []SlowQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]SlowQuery(nil), l.slow[namespace+"/"+name]...)
+}
@@ -0,0 +1,304 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// DefaultVisibilityTimeout is how long a dequeued message stays hidden
+	// unless the queue or the Dequeue call sets a timeout.
+	DefaultVisibilityTimeout = 30 * time.Second
+	// MaxVisibilityTimeout caps the visibility timeout of a delivery.
+	MaxVisibilityTimeout = 12 * time.Hour
+	// DefaultMaxAttempts is how many deliveries a message gets before it is
+	// dead-lettered unless the queue sets max_attempts.
+	DefaultMaxAttempts = 5
+	// MaxDequeueMessages caps the messages one Dequeue call returns.
+	MaxDequeueMessages = 100
+	// DefaultDeadLetterLimit is how many dead letters are listed when no
+	// limit is given.
+	DefaultDeadLetterLimit = 100
+)
+
+var (
+	// ErrNotQueue is returned for queue operations on a collection created
+	// without queue.enabled.
+	ErrNotQueue = errors.New("collection is not a queue")
+	// ErrQueueUnavailable is returned for queue operations against a store
+	// that does not implement QueueStore.
+	ErrQueueUnavailable = errors.New("store does not support queues")
+	// ErrInvalidReceipt is returned when acking or nacking with a receipt
+	// that no longer names the message's current delivery, because it was
+	// acked, nacked or redelivered after its visibility timeout.
+	ErrInvalidReceipt = errors.New("receipt does not match a current delivery")
+)
+
+// QueueStore is implemented by stores that hold queue messages. Queues are
+// named by their collection's namespace and name, so one store can hold the
+// queues of many collections.
+type QueueStore interface {
+	// Enqueue adds messages, which have their ID, item, enqueued_at and
+	// visible_at set.
+	Enqueue(ctx context.Context, queue string, msgs []*pb.QueueMessage) error
+	// Dequeue delivers up to max visible messages, oldest first, hiding each
+	// for visibility and giving it a new receipt. Visible messages that have
+	// already been delivered maxAttempts times are dead-lettered instead.
+	Dequeue(ctx context.Context, queue string, max int, visibility time.Duration, maxAttempts int) ([]*pb.QueueMessage, error)
+	// Ack removes a delivered message. It returns ErrInvalidReceipt unless
+	// receipt names the message's current delivery.
+	Ack(ctx context.Context, queue, id, receipt string) error
+	// Nack makes a delivered message visible again after delay, or
+	// dead-letters it if it has been delivered maxAttempts times, and reports
+	// which. It returns ErrInvalidReceipt like Ack.
+	Nack(ctx context.Context, queue, id, receipt string, delay time.Duration, reason string, maxAttempts int) (bool, error)
+	// QueueStats counts a queue's messages by state.
+	QueueStats(ctx context.Context, queue string) (*pb.QueueStats, error)
+	// DeadLetters returns up to limit dead-lettered messages, oldest first.
+	DeadLetters(ctx context.Context, queue string, limit int) ([]*pb.QueueMessage, error)
+	// RedriveDeadLetters makes dead-lettered messages deliverable again with
+	// their attempts reset, every one when ids is empty, and returns how many
+	// it redrove.
+	RedriveDeadLetters(ctx context.Context, queue string, ids []string) (int64, error)
+}
+
+// queue returns the store and name of c's queue.
+func (c *Collection) queue() (QueueStore, string, error) {
+	if !c.Meta.GetQueue().GetEnabled() {
+		return nil, "", ErrNotQueue
+	}
+	// Messages bypass write-behind buffering: they are not records, and a
+	// buffered Enqueue could not promise delivery.
+	store := c.Store
+	if buffer, ok := store.(*BufferedStore); ok {
+		store = buffer.inner
+	}
+	qs, ok := store.(QueueStore)
+	if !ok {
+		return nil, "", ErrQueueUnavailable
+	}
+	return qs, c.Meta.Namespace + "/" + c.Meta.Name, nil
+}
+
+func (c *Collection) maxAttempts() int {
+	if n := c.Meta.GetQueue().GetMaxAttempts(); n > 0 {
+		return int(n)
+	}
+	return DefaultMaxAttempts
+}
+
+// Enqueue adds items to c's queue, deliverable after delay, and returns their
+// message IDs.
+func (c *Collection) Enqueue(ctx context.Context, items []*anypb.Any, delay time.Duration) ([]string, error) {
+	qs, name, err := c.queue()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	msgs := make([]*pb.QueueMessage, len(items))
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = uuid.New().String()
+		msgs[i] = &pb.QueueMessage{
+			Id:         ids[i],
+			Item:       item,
+			EnqueuedAt: timestamppb.New(now),
+			VisibleAt:  timestamppb.New(now.Add(max(delay, 0))),
+		}
+	}
+	if err := qs.Enqueue(ctx, name, msgs); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Dequeue delivers up to max messages from c's queue, hiding them for
+// visibility, which defaults to the queue's visibility timeout.
+func (c *Collection) Dequeue(ctx context.Context, max int, visibility time.Duration) ([]*pb.QueueMessage, error) {
+	qs, name, err := c.queue()
+	if err != nil {
+		return nil, err
+	}
+	if max <= 0 {
+		max = 1
+	}
+	if visibility <= 0 {
+		visibility = time.Duration(c.Meta.Queue.VisibilityTimeoutMs) * time.Millisecond
+	}
+	if visibility <= 0 {
+		visibility = DefaultVisibilityTimeout
+	}
+	return qs.Dequeue(ctx, name, min(max, MaxDequeueMessages), min(visibility, MaxVisibilityTimeout), c.maxAttempts())
+}
+
+// Ack removes a delivered message from c's queue.
+func (c *Collection) Ack(ctx context.Context, id, receipt string) error {
+	qs, name, err := c.queue()
+	if err != nil {
+		return err
+	}
+	return qs.Ack(ctx, name, id, receipt)
+}
+
+// Nack returns a delivered message to c's queue after delay, and reports
+// whether it was dead-lettered instead.
+func (c *Collection) Nack(ctx context.Context, id, receipt string, delay time.Duration, reason string) (bool, error) {
+	qs, name, err := c.queue()
+	if err != nil {
+		return false, err
+	}
+	return qs.Nack(ctx, name, id, receipt, max(delay, 0), reason, c.maxAttempts())
+}
+
+// QueueStats counts the messages in c's queue by state.
+func (c *Collection) QueueStats(ctx context.Context) (*pb.QueueStats, error) {
+	qs, name, err := c.queue()
+	if err != nil {
+		return nil, err
+	}
+	return qs.QueueStats(ctx, name)
+}
+
+// DeadLetters lists up to limit of c's dead-lettered messages, defaulting to
+// DefaultDeadLetterLimit.
+func (c *Collection) DeadLetters(ctx context.Context, limit int) ([]*pb.QueueMessage, error) {
+	qs, name, err := c.queue()
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = DefaultDeadLetterLimit
+	}
+	return qs.DeadLetters(ctx, name, limit)
+}
+
+// RedriveDeadLetters makes dead-lettered messages of c deliverable again,
+// every one when ids is empty.
+func (c *Collection) RedriveDeadLetters(ctx context.Context, ids []string) (int64, error) {
+	qs, name, err := c.queue()
+	if err != nil {
+		return 0, err
+	}
+	return qs.RedriveDeadLetters(ctx, name, ids)
+}
+
+// queueStatus converts queue errors to gRPC status errors.
+func queueStatus(err error) error {
+	if errors.Is(err, ErrNotQueue) || errors.Is(err, ErrQueueUnavailable) || errors.Is(err, ErrInvalidReceipt) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Errorf(codes.Internal, "%v", err)
+}
+
+// Enqueue adds messages to a queue collection.
+func (s *CollectionServer) Enqueue(ctx context.Context, req *pb.EnqueueRequest) (*pb.EnqueueResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if len(req.Items) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "items are required")
+	}
+	if req.DelayMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "delay_ms must not be negative")
+	}
+	ids, err := collection.Enqueue(ctx, req.Items, time.Duration(req.DelayMs)*time.Millisecond)
+	if err != nil {
+		return nil, queueStatus(err)
+	}
+	return &pb.EnqueueResponse{Status: &pb.Status{Code: pb.Status_OK}, Ids: ids}, nil
+}
+
+// Dequeue delivers messages from a queue collection.
+func (s *CollectionServer) Dequeue(ctx context.Context, req *pb.DequeueRequest) (*pb.DequeueResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if req.MaxMessages < 0 || req.MaxMessages > MaxDequeueMessages {
+		return nil, status.Errorf(codes.InvalidArgument, "max_messages must be between 0 and %d", MaxDequeueMessages)
+	}
+	if req.VisibilityTimeoutMs < 0 || req.VisibilityTimeoutMs > MaxVisibilityTimeout.Milliseconds() {
+		return nil, status.Errorf(codes.InvalidArgument, "visibility_timeout_ms must be between 0 and %d", MaxVisibilityTimeout.Milliseconds())
+	}
+	msgs, err := collection.Dequeue(ctx, int(req.MaxMessages), time.Duration(req.VisibilityTimeoutMs)*time.Millisecond)
+	if err != nil {
+		return nil, queueStatus(err)
+	}
+	return &pb.DequeueResponse{Status: &pb.Status{Code: pb.Status_OK}, Messages: msgs}, nil
+}
+
+// Ack acknowledges a delivered message, removing it from its queue.
+func (s *CollectionServer) Ack(ctx context.Context, req *pb.AckRequest) (*pb.AckResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if err := collection.Ack(ctx, req.Id, req.Receipt); err != nil {
+		return nil, queueStatus(err)
+	}
+	return &pb.AckResponse{Status: &pb.Status{Code: pb.Status_OK}}, nil
+}
+
+// Nack returns a delivered message to its queue for redelivery.
+func (s *CollectionServer) Nack(ctx context.Context, req *pb.NackRequest) (*pb.NackResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if req.DelayMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "delay_ms must not be negative")
+	}
+	dead, err := collection.Nack(ctx, req.Id, req.Receipt, time.Duration(req.DelayMs)*time.Millisecond, req.Reason)
+	if err != nil {
+		return nil, queueStatus(err)
+	}
+	return &pb.NackResponse{Status: &pb.Status{Code: pb.Status_OK}, DeadLettered: dead}, nil
+}
+
+// QueueStats counts a queue collection's messages by state.
+func (s *CollectionServer) QueueStats(ctx context.Context, req *pb.QueueStatsRequest) (*pb.QueueStatsResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	stats, err := collection.QueueStats(ctx)
+	if err != nil {
+		return nil, queueStatus(err)
+	}
+	return &pb.QueueStatsResponse{Status: &pb.Status{Code: pb.Status_OK}, Stats: stats}, nil
+}
+
+// ListDeadLetters lists a queue collection's dead-lettered messages.
+func (s *CollectionServer) ListDeadLetters(ctx context.Context, req *pb.ListDeadLettersRequest) (*pb.ListDeadLettersResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	msgs, err := collection.DeadLetters(ctx, int(req.Limit))
+	if err != nil {
+		return nil, queueStatus(err)
+	}
+	return &pb.ListDeadLettersResponse{Status: &pb.Status{Code: pb.Status_OK}, Messages: msgs}, nil
+}
+
+// RedriveDeadLetters makes dead-lettered messages deliverable again.
+func (s *CollectionServer) RedriveDeadLetters(ctx context.Context, req *pb.RedriveDeadLettersRequest) (*pb.RedriveDeadLettersResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	n, err := collection.RedriveDeadLetters(ctx, req.Ids)
+	if err != nil {
+		return nil, queueStatus(err)
+	}
+	return &pb.RedriveDeadLettersResponse{Status: &pb.Status{Code: pb.Status_OK}, Redriven: n}, nil
+}
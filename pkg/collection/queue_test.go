@@ -0,0 +1,143 @@
+package collection_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestCollectionServer_Queue(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{
+		Namespace: "test", Name: "jobs",
+		Queue: &pb.QueueConfig{Enabled: true, MaxAttempts: 2},
+	}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	server := collection.NewCollectionServer(repo)
+	dequeue := func(max int32, visibilityMs int64) []*pb.QueueMessage {
+		t.Helper()
+		resp, err := server.Dequeue(ctx, &pb.DequeueRequest{
+			Namespace: "test", CollectionName: "jobs", MaxMessages: max, VisibilityTimeoutMs: visibilityMs,
+		})
+		if err != nil {
+			t.Fatalf("Dequeue failed: %v", err)
+		}
+		return resp.Messages
+	}
+	stats := func() *pb.QueueStats {
+		t.Helper()
+		resp, err := server.QueueStats(ctx, &pb.QueueStatsRequest{Namespace: "test", CollectionName: "jobs"})
+		if err != nil {
+			t.Fatalf("QueueStats failed: %v", err)
+		}
+		return resp.Stats
+	}
+
+	enqueued, err := server.Enqueue(ctx, &pb.EnqueueRequest{Namespace: "test", CollectionName: "jobs", Items: []*anypb.Any{
+		{TypeUrl: "type.googleapis.com/job", Value: []byte("a")},
+		{Value: []byte("b")},
+		{Value: []byte("c")},
+	}})
+	if err != nil || len(enqueued.Ids) != 3 {
+		t.Fatalf("Enqueue returned %v, %v", enqueued.GetIds(), err)
+	}
+	if _, err := server.Enqueue(ctx, &pb.EnqueueRequest{
+		Namespace: "test", CollectionName: "jobs", Items: []*anypb.Any{{Value: []byte("later")}}, DelayMs: 60000,
+	}); err != nil {
+		t.Fatalf("delayed Enqueue failed: %v", err)
+	}
+
+	// Messages are delivered oldest first and hidden while in flight
+	msgs := dequeue(2, 0)
+	if len(msgs) != 2 || string(msgs[0].Item.Value) != "a" || msgs[0].Item.TypeUrl != "type.googleapis.com/job" || string(msgs[1].Item.Value) != "b" {
+		t.Fatalf("unexpected delivery %v", msgs)
+	}
+	if msgs[0].Attempts != 1 || msgs[0].Receipt == "" {
+		t.Errorf("unexpected delivery metadata %v", msgs[0])
+	}
+	if s := stats(); s.Ready != 1 || s.InFlight != 2 || s.Delayed != 1 {
+		t.Errorf("unexpected stats %v", s)
+	}
+
+	if _, err := server.Ack(ctx, &pb.AckRequest{Namespace: "test", CollectionName: "jobs", Id: msgs[0].Id, Receipt: msgs[0].Receipt}); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	if _, err := server.Ack(ctx, &pb.AckRequest{Namespace: "test", CollectionName: "jobs", Id: msgs[0].Id, Receipt: msgs[0].Receipt}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a second Ack to fail, got %v", err)
+	}
+	nack, err := server.Nack(ctx, &pb.NackRequest{Namespace: "test", CollectionName: "jobs", Id: msgs[1].Id, Receipt: msgs[1].Receipt, Reason: "flaky"})
+	if err != nil || nack.DeadLettered {
+		t.Fatalf("Nack returned %v, %v", nack, err)
+	}
+
+	// b comes back on its second attempt; c is delivered with a short timeout
+	msgs = dequeue(10, 20)
+	if len(msgs) != 2 {
+		t.Fatalf("unexpected redelivery %v", msgs)
+	}
+	if string(msgs[0].Item.Value) == "b" {
+		msgs[0], msgs[1] = msgs[1], msgs[0]
+	}
+	stale := msgs[0]
+	if retried := msgs[1]; string(retried.Item.Value) != "b" || retried.Attempts != 2 || retried.LastError != "flaky" {
+		t.Errorf("unexpected retry %v", retried)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// b used up its attempts and is dead-lettered; c timed out and is
+	// redelivered under a new receipt
+	redelivered := dequeue(10, 0)
+	if len(redelivered) != 1 || redelivered[0].Id != stale.Id || redelivered[0].Receipt == stale.Receipt {
+		t.Fatalf("unexpected redelivery %v", redelivered)
+	}
+	if _, err := server.Ack(ctx, &pb.AckRequest{Namespace: "test", CollectionName: "jobs", Id: stale.Id, Receipt: stale.Receipt}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a stale receipt to be refused, got %v", err)
+	}
+	nack, err = server.Nack(ctx, &pb.NackRequest{Namespace: "test", CollectionName: "jobs", Id: stale.Id, Receipt: redelivered[0].Receipt})
+	if err != nil || !nack.DeadLettered {
+		t.Fatalf("expected the last attempt to be dead-lettered, got %v, %v", nack, err)
+	}
+	if s := stats(); s.Ready != 0 || s.InFlight != 0 || s.Dead != 2 {
+		t.Errorf("unexpected stats %v", s)
+	}
+
+	dead, err := server.ListDeadLetters(ctx, &pb.ListDeadLettersRequest{Namespace: "test", CollectionName: "jobs"})
+	if err != nil || len(dead.Messages) != 2 {
+		t.Fatalf("ListDeadLetters returned %v, %v", dead.GetMessages(), err)
+	}
+	redrive, err := server.RedriveDeadLetters(ctx, &pb.RedriveDeadLettersRequest{Namespace: "test", CollectionName: "jobs", Ids: []string{stale.Id}})
+	if err != nil || redrive.Redriven != 1 {
+		t.Fatalf("RedriveDeadLetters returned %v, %v", redrive, err)
+	}
+	if msgs := dequeue(10, 0); len(msgs) != 1 || msgs[0].Id != stale.Id || msgs[0].Attempts != 1 {
+		t.Errorf("expected the redriven message with its attempts reset, got %v", msgs)
+	}
+}
+
+func TestCollectionServer_QueueDisabled(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "plain"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	server := collection.NewCollectionServer(repo)
+
+	_, err := server.Enqueue(ctx, &pb.EnqueueRequest{Namespace: "test", CollectionName: "plain", Items: []*anypb.Any{{Value: []byte("x")}}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for a collection that is not a queue, got %v", err)
+	}
+	_, err = server.Dequeue(ctx, &pb.DequeueRequest{Namespace: "test", CollectionName: "plain", MaxMessages: 1000})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for too many messages, got %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package collection
+
+import (
+	"errors"
+	"fmt"
+)
+
+// reflink is not supported on this platform; snapshots fall back to copies.
+func reflink(src, dest string) error {
+	return fmt.Errorf("reflink %s: %w", src, errors.ErrUnsupported)
+}
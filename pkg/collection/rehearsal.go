@@ -0,0 +1,320 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// RehearsalNamespacePrefix starts the namespaces restore rehearsals restore
+// into, followed by the rehearsal's ID.
+const RehearsalNamespacePrefix = "rehearsal-"
+
+// RehearsalCheckRecordCount is the check, reported after VerifyCollection's,
+// that a rehearsal restored as many records as its backup was taken with.
+const RehearsalCheckRecordCount = "record_count"
+
+// DefaultRehearsalReapInterval is how often rehearsal collections past their
+// TTL are dropped.
+const DefaultRehearsalReapInterval = time.Minute
+
+// ErrRehearsalUnavailable is returned for rehearsals on a repository that
+// cannot open a restored database on its own.
+var ErrRehearsalUnavailable = errors.New("restore rehearsals need a repository with a store opener")
+
+// rehearsals tracks the rehearsal collections kept for inspection.
+type rehearsals struct {
+	mu   sync.Mutex
+	live map[string]*liveRehearsal // by rehearsal ID
+	stop chan struct{}
+	done chan struct{}
+}
+
+type liveRehearsal struct {
+	collection *pb.NamespacedName
+	expiresAt  time.Time
+}
+
+// RehearseRestore restores a backup into a new rehearsal-<id> namespace,
+// verifies the restored database and files, runs the request's smoke
+// queries against it and reports the results. A backup that fails any of
+// this is still an OK response, with ok false. The restored collection is
+// dropped once the report is made, or kept until ttl_ms passes.
+//
+// The restored database is checked as restored, opened through the
+// repository's StoreOpener rather than as the collection the restore
+// registers.
+func (s *GrpcServer) RehearseRestore(ctx context.Context, req *pb.RehearseRestoreRequest) (*pb.RehearseRestoreResponse, error) {
+	bm := s.backupManager
+	if bm == nil {
+		return &pb.RehearseRestoreResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: "backup manager not initialized"},
+		}, nil
+	}
+	if req.BackupId == "" || req.TtlMs < 0 {
+		return &pb.RehearseRestoreResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "backup_id is required and ttl_ms cannot be negative"},
+		}, nil
+	}
+	for i, q := range req.SmokeQueries {
+		if err := ValidateAnalyticsQuery(q.Query); err != nil {
+			return &pb.RehearseRestoreResponse{
+				Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: fmt.Sprintf("smoke query %d: %v", i+1, err)},
+			}, nil
+		}
+	}
+	repo, ok := s.repo.(*DefaultCollectionRepo)
+	if !ok || repo.opener == nil {
+		return &pb.RehearseRestoreResponse{
+			Status: &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: ErrRehearsalUnavailable.Error()},
+		}, nil
+	}
+	backup, err := bm.metaStore.GetBackup(ctx, req.BackupId)
+	if err != nil {
+		return &pb.RehearseRestoreResponse{
+			Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: fmt.Sprintf("backup not found: %v", err)},
+		}, nil
+	}
+
+	id := bm.ids.NewID()
+	coll := &pb.NamespacedName{Namespace: RehearsalNamespacePrefix + id, Name: backup.Collection.Name}
+	resp := &pb.RehearseRestoreResponse{
+		Status:      &pb.Status{Code: pb.Status_OK},
+		RehearsalId: id,
+		Collection:  coll,
+		StartedAt:   bm.clock.Now().Unix(),
+	}
+
+	restore, _ := bm.RestoreBackup(ctx, &pb.RestoreBackupRequest{
+		BackupId:      backup.BackupId,
+		DestNamespace: coll.Namespace,
+		DestName:      coll.Name,
+	})
+	if restore.Status.GetCode() != pb.Status_OK {
+		resp.RestoreError = restore.Status.GetMessage()
+	} else {
+		resp.RecordsRestored = restore.RecordsRestored
+		resp.FilesRestored = restore.FilesRestored
+		resp.Checks, err = s.verifyRehearsal(ctx, repo, backup, coll, int(req.MaxProblems))
+		if err != nil {
+			s.dropRehearsal(coll)
+			return &pb.RehearseRestoreResponse{
+				Status: &pb.Status{Code: pb.Status_CANCELLED, Message: err.Error()},
+			}, nil
+		}
+		resp.SmokeQueries = s.runSmokeQueries(ctx, repo, backup, coll, req.SmokeQueries)
+	}
+	resp.FinishedAt = bm.clock.Now().Unix()
+
+	var failed []string
+	if resp.RestoreError != "" {
+		failed = append(failed, "restore: "+resp.RestoreError)
+	}
+	for _, check := range resp.Checks {
+		if !check.Skipped && !check.Ok {
+			failed = append(failed, fmt.Sprintf("%s (%d)", check.Name, check.ProblemCount))
+		}
+	}
+	for _, q := range resp.SmokeQueries {
+		if !q.Ok {
+			failed = append(failed, "smoke query "+q.Name)
+		}
+	}
+	resp.Ok = len(failed) == 0
+	resp.Status.Message = fmt.Sprintf("backup %s restored and passed verification", backup.BackupId)
+	if !resp.Ok {
+		resp.Status.Message = fmt.Sprintf("backup %s failed its restore rehearsal: %s", backup.BackupId, strings.Join(failed, ", "))
+		log.Printf("Warning: %s", resp.Status.Message)
+	}
+
+	if req.TtlMs > 0 && resp.RestoreError == "" {
+		expiresAt := bm.clock.Now().Add(time.Duration(req.TtlMs) * time.Millisecond)
+		s.rehearsals.mu.Lock()
+		if s.rehearsals.live == nil {
+			s.rehearsals.live = make(map[string]*liveRehearsal)
+		}
+		s.rehearsals.live[id] = &liveRehearsal{collection: coll, expiresAt: expiresAt}
+		s.rehearsals.mu.Unlock()
+		resp.ExpiresAt = expiresAt.Unix()
+	} else {
+		s.dropRehearsal(coll)
+	}
+	return resp, nil
+}
+
+// verifyRehearsal runs VerifyCollection over a restored database and files,
+// then checks its record count against the backup's.
+func (s *GrpcServer) verifyRehearsal(ctx context.Context, repo *DefaultCollectionRepo, backup *pb.BackupMetadata, coll *pb.NamespacedName, maxProblems int) ([]*pb.VerifyCheck, error) {
+	layout := s.backupManager.layout
+	var stored *pb.StoreOptions
+	if source, err := repo.GetCollection(ctx, backup.Collection.Namespace, backup.Collection.Name); err == nil {
+		stored = source.Meta.GetStoreOptions()
+	}
+	count := NewCheckReport(RehearsalCheckRecordCount, maxProblems)
+	store, err := repo.opener(layout.CollectionDB(coll.Namespace, coll.Name), stored)
+	if err != nil {
+		count.Problem("", "failed to open the restored database: %v", err)
+		return []*pb.VerifyCheck{count.Proto()}, nil
+	}
+	defer store.Close()
+
+	var fs FileSystem
+	if backup.IncludesFiles {
+		if local, err := NewLocalFileSystem(layout.CollectionFiles(coll.Namespace, coll.Name)); err == nil {
+			fs = local
+		}
+	}
+	restored, err := NewCollection(&pb.Collection{Namespace: coll.Namespace, Name: coll.Name}, store, fs)
+	if err != nil {
+		return nil, err
+	}
+	checks, err := VerifyCollection(ctx, restored, maxProblems)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := store.CountRecords(ctx)
+	if err != nil {
+		count.Problem("", "failed to count restored records: %v", err)
+	} else {
+		count.Checked(records)
+		if records != backup.RecordCount {
+			count.Problem("", "restored %d records, the backup was taken with %d", records, backup.RecordCount)
+		}
+	}
+	return append(checks, count.Proto()), nil
+}
+
+// runSmokeQueries runs the smoke queries of a rehearsal against the restored
+// database, opened like verifyRehearsal opens it.
+func (s *GrpcServer) runSmokeQueries(ctx context.Context, repo *DefaultCollectionRepo, backup *pb.BackupMetadata, coll *pb.NamespacedName, queries []*pb.SmokeQuery) []*pb.SmokeQueryResult {
+	if len(queries) == 0 {
+		return nil
+	}
+	var stored *pb.StoreOptions
+	if source, err := repo.GetCollection(ctx, backup.Collection.Namespace, backup.Collection.Name); err == nil {
+		stored = source.Meta.GetStoreOptions()
+	}
+	store, openErr := repo.opener(s.backupManager.layout.CollectionDB(coll.Namespace, coll.Name), stored)
+	if openErr == nil {
+		defer store.Close()
+	}
+
+	results := make([]*pb.SmokeQueryResult, 0, len(queries))
+	for i, q := range queries {
+		result := &pb.SmokeQueryResult{Name: q.Name}
+		if result.Name == "" {
+			result.Name = fmt.Sprintf("query-%d", i+1)
+		}
+		results = append(results, result)
+		if openErr != nil {
+			result.Error = fmt.Sprintf("failed to open the restored database: %v", openErr)
+			continue
+		}
+		rows, err := s.analytics.Query(ctx, []AnalyticsAttachment{{Alias: "restored", Store: store}}, q.Query, 0)
+		if err != nil {
+			result.Error = err.Error()
+			continue
+		}
+		result.Rows = int64(len(rows.Rows))
+		result.Ok = result.Rows >= q.MinRows
+		if !result.Ok {
+			result.Error = fmt.Sprintf("returned %d rows, expected at least %d", result.Rows, q.MinRows)
+		}
+	}
+	return results
+}
+
+// dropRehearsal forgets a rehearsal collection and deletes its namespace's
+// restored databases and files.
+func (s *GrpcServer) dropRehearsal(coll *pb.NamespacedName) {
+	if repo, ok := s.repo.(*DefaultCollectionRepo); ok {
+		repo.service.removeCollection(coll.Namespace + "/" + coll.Name)
+	}
+	layout := s.backupManager.layout
+	for _, dir := range []string{layout.CollectionsDir(), layout.FilesDir()} {
+		if err := os.RemoveAll(filepath.Join(dir, coll.Namespace)); err != nil {
+			log.Printf("Warning: failed to remove rehearsal %s: %v", coll.Namespace, err)
+		}
+	}
+}
+
+// dropRehearsalsWhere drops the kept rehearsal collections that match and
+// returns their names.
+func (s *GrpcServer) dropRehearsalsWhere(match func(*liveRehearsal) bool) []*pb.NamespacedName {
+	s.rehearsals.mu.Lock()
+	var dropped []*pb.NamespacedName
+	for id, r := range s.rehearsals.live {
+		if match(r) {
+			delete(s.rehearsals.live, id)
+			dropped = append(dropped, r.collection)
+		}
+	}
+	s.rehearsals.mu.Unlock()
+	for _, coll := range dropped {
+		s.dropRehearsal(coll)
+	}
+	return dropped
+}
+
+// ReapRehearsals drops the rehearsal collections whose TTL has passed and
+// returns their names.
+func (s *GrpcServer) ReapRehearsals() []*pb.NamespacedName {
+	if s.backupManager == nil {
+		return nil
+	}
+	now := s.backupManager.clock.Now()
+	return s.dropRehearsalsWhere(func(r *liveRehearsal) bool { return !now.Before(r.expiresAt) })
+}
+
+// StartRehearsalReaper runs ReapRehearsals every interval until
+// StopRehearsalReaper.
+func (s *GrpcServer) StartRehearsalReaper(interval time.Duration) {
+	r := &s.rehearsals
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	r.stop, r.done = stop, done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			s.ReapRehearsals()
+		}
+	}()
+}
+
+// StopRehearsalReaper ends the StartRehearsalReaper loop and drops every
+// kept rehearsal collection, e.g. on shutdown.
+func (s *GrpcServer) StopRehearsalReaper() {
+	r := &s.rehearsals
+	r.mu.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	if s.backupManager != nil {
+		s.dropRehearsalsWhere(func(*liveRehearsal) bool { return true })
+	}
+}
@@ -0,0 +1,129 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+)
+
+func TestRehearseRestore(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	dir := t.TempDir()
+	layout := collection.NewPathLayout(filepath.Join(dir, "data"))
+	repo.SetPathLayout(layout)
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+	server := collection.NewGrpcServerWithLayout(repo, layout)
+	clock := collection.NewFixedClock(time.Unix(1700000000, 0))
+	server.Backups().SetClock(clock)
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "docs")
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf(`{"n": %d}`, i))
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: fmt.Sprintf("doc-%02d", i), ProtoData: data}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	backupPath := filepath.Join(dir, "backups", "docs.db")
+	backup, _ := server.BackupCollection(ctx, &pb.BackupCollectionRequest{
+		Collection:   &pb.NamespacedName{Namespace: "test", Name: "docs"},
+		DestPath:     backupPath,
+		IncludeFiles: true,
+	})
+	if backup.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", backup.Status)
+	}
+	backupID := backup.Backup.BackupId
+
+	resp, _ := server.RehearseRestore(ctx, &pb.RehearseRestoreRequest{
+		BackupId: backupID,
+		SmokeQueries: []*pb.SmokeQuery{
+			{Name: "all records", Query: "SELECT id FROM restored.records", MinRows: 20},
+			{Query: "SELECT id FROM restored.records WHERE id = 'doc-07'", MinRows: 1},
+		},
+	})
+	if resp.Status.Code != pb.Status_OK {
+		t.Fatalf("RehearseRestore failed: %v", resp.Status)
+	}
+	if !resp.Ok {
+		t.Fatalf("expected the rehearsal to pass, got %s (checks %v, queries %v)", resp.Status.Message, resp.Checks, resp.SmokeQueries)
+	}
+	if !strings.HasPrefix(resp.Collection.Namespace, collection.RehearsalNamespacePrefix) || resp.Collection.Name != "docs" {
+		t.Errorf("expected a restore into rehearsal-<id>/docs, got %v", resp.Collection)
+	}
+	checks := map[string]*pb.VerifyCheck{}
+	for _, check := range resp.Checks {
+		checks[check.Name] = check
+	}
+	if count := checks[collection.RehearsalCheckRecordCount]; count == nil || count.Checked != 20 {
+		t.Errorf("expected 20 restored records counted, got %v", count)
+	}
+	if checks[collection.VerifyCheckIntegrity] == nil || len(resp.SmokeQueries) != 2 || resp.SmokeQueries[1].Name != "query-2" {
+		t.Errorf("expected the verification checks and both smoke queries reported, got %v %v", resp.Checks, resp.SmokeQueries)
+	}
+	if _, err := repo.GetCollection(ctx, resp.Collection.Namespace, "docs"); err == nil || resp.ExpiresAt != 0 {
+		t.Error("expected the rehearsal collection dropped without a TTL")
+	}
+	if _, err := os.Stat(filepath.Join(layout.CollectionsDir(), resp.Collection.Namespace)); !os.IsNotExist(err) {
+		t.Errorf("expected the restored database removed, got %v", err)
+	}
+
+	// With a TTL the collection is kept until it is reaped
+	resp, _ = server.RehearseRestore(ctx, &pb.RehearseRestoreRequest{BackupId: backupID, TtlMs: time.Hour.Milliseconds()})
+	if !resp.Ok || resp.ExpiresAt != clock.Now().Add(time.Hour).Unix() {
+		t.Fatalf("expected a kept rehearsal expiring in an hour, got %v", resp)
+	}
+	if _, err := repo.GetCollection(ctx, resp.Collection.Namespace, "docs"); err != nil {
+		t.Errorf("expected the rehearsal collection kept: %v", err)
+	}
+	if reaped := server.ReapRehearsals(); len(reaped) != 0 {
+		t.Errorf("expected nothing reaped before the TTL, got %v", reaped)
+	}
+	clock.Advance(time.Hour)
+	if reaped := server.ReapRehearsals(); len(reaped) != 1 || reaped[0].Namespace != resp.Collection.Namespace {
+		t.Errorf("expected the rehearsal reaped after its TTL, got %v", reaped)
+	}
+	if _, err := repo.GetCollection(ctx, resp.Collection.Namespace, "docs"); err == nil {
+		t.Error("expected the reaped collection gone")
+	}
+
+	// A failing smoke query fails the rehearsal
+	resp, _ = server.RehearseRestore(ctx, &pb.RehearseRestoreRequest{
+		BackupId:     backupID,
+		SmokeQueries: []*pb.SmokeQuery{{Name: "too many", Query: "SELECT id FROM restored.records", MinRows: 1000}},
+	})
+	if resp.Ok || resp.SmokeQueries[0].Ok || !strings.Contains(resp.Status.Message, "smoke query too many") {
+		t.Errorf("expected the smoke query to fail the rehearsal, got %q", resp.Status.Message)
+	}
+
+	// So does a backup that no longer restores
+	if err := os.Remove(backupPath); err != nil {
+		t.Fatalf("failed to remove backup: %v", err)
+	}
+	resp, _ = server.RehearseRestore(ctx, &pb.RehearseRestoreRequest{BackupId: backupID})
+	if resp.Status.Code != pb.Status_OK || resp.Ok || resp.RestoreError == "" {
+		t.Errorf("expected a restore error for a missing backup file, got %v", resp)
+	}
+
+	resp, _ = server.RehearseRestore(ctx, &pb.RehearseRestoreRequest{BackupId: "backup-missing"})
+	if resp.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND for an unknown backup, got %v", resp.Status)
+	}
+	resp, _ = server.RehearseRestore(ctx, &pb.RehearseRestoreRequest{BackupId: backupID, SmokeQueries: []*pb.SmokeQuery{{Query: "DELETE FROM restored.records"}}})
+	if resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT for a writing smoke query, got %v", resp.Status)
+	}
+}
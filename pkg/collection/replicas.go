@@ -0,0 +1,89 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SetEndpoint sets the address this collector is reachable at. Collections created
+// by clone and fetch are registered with it as their ServerEndpoint, and it is sent
+// to source collectors so they can record where copies live.
+func (cm *CloneManager) SetEndpoint(endpoint string) {
+	cm.endpoint = endpoint
+}
+
+// Endpoint returns the address set with SetEndpoint.
+func (cm *CloneManager) Endpoint() string {
+	return cm.endpoint
+}
+
+// registerCopy creates the repository entry for a cloned or fetched collection, or
+// refreshes the endpoint, message type and labels of an existing entry when a copy
+// is re-synced.
+func (cm *CloneManager) registerCopy(ctx context.Context, meta *pb.Collection) error {
+	if meta.ServerEndpoint == "" {
+		meta.ServerEndpoint = cm.endpoint
+	}
+
+	existing, err := cm.repo.GetCollection(ctx, meta.Namespace, meta.Name)
+	if err != nil {
+		_, err = cm.repo.CreateCollection(ctx, meta)
+		return err
+	}
+
+	updated := proto.Clone(existing.Meta).(*pb.Collection)
+	updated.ServerEndpoint = meta.ServerEndpoint
+	if meta.MessageType != nil {
+		updated.MessageType = meta.MessageType
+	}
+	if updated.Metadata == nil {
+		updated.Metadata = &pb.Metadata{}
+	}
+	if updated.Metadata.Labels == nil {
+		updated.Metadata.Labels = make(map[string]string)
+	}
+	for k, v := range meta.GetMetadata().GetLabels() {
+		updated.Metadata.Labels[k] = v
+	}
+	updated.Metadata.UpdatedAt = timestamppb.Now()
+
+	return cm.repo.UpdateCollectionMetadata(ctx, meta.Namespace, meta.Name, updated)
+}
+
+// RecordReplica records that a copy of the local collection source exists at
+// replica.Endpoint. An existing entry for the same copy is refreshed. The replica
+// list is returned by Discover and Route as part of the collection.
+func (cm *CloneManager) RecordReplica(ctx context.Context, source *pb.NamespacedName, replica *pb.ReplicaRef) error {
+	if source == nil || replica == nil || replica.Endpoint == "" {
+		return fmt.Errorf("source collection and replica endpoint are required")
+	}
+
+	coll, err := cm.repo.GetCollection(ctx, source.Namespace, source.Name)
+	if err != nil {
+		return err
+	}
+
+	updated := proto.Clone(coll.Meta).(*pb.Collection)
+	entry := proto.Clone(replica).(*pb.ReplicaRef)
+	if entry.SyncedAt == nil {
+		entry.SyncedAt = timestamppb.Now()
+	}
+
+	replaced := false
+	for i, r := range updated.Replicas {
+		if r.Endpoint == entry.Endpoint && r.Namespace == entry.Namespace && r.Name == entry.Name {
+			updated.Replicas[i] = entry
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		updated.Replicas = append(updated.Replicas, entry)
+	}
+
+	return cm.repo.UpdateCollectionMetadata(ctx, source.Namespace, source.Name, updated)
+}
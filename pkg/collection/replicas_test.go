@@ -0,0 +1,139 @@
+package collection_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc"
+)
+
+// startRepoServer serves a CollectionRepo over loopback TCP and returns its repo, server and address.
+func startRepoServer(t *testing.T) (collection.CollectionRepo, *collection.GrpcServer, string) {
+	t.Helper()
+	repo, cleanup := setupTestRepo(t)
+	t.Cleanup(cleanup)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+
+	server := collection.NewGrpcServerWithDataDir(repo, t.TempDir())
+	server.SetEndpoint(addr)
+	t.Cleanup(server.StopJobs)
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterCollectionRepoServer(grpcServer, server)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	return repo, server, addr
+}
+
+func TestReplicas_FetchAndCloneRegisterCopies(t *testing.T) {
+	ctx := context.Background()
+	srcRepo, srcServer, srcAddr := startRepoServer(t)
+	dstRepo, dstServer, dstAddr := startRepoServer(t)
+
+	_, err := srcRepo.CreateCollection(ctx, &pb.Collection{
+		Namespace:   "prod",
+		Name:        "users",
+		MessageType: &pb.MessageTypeRef{MessageName: "User"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	src, _ := srcRepo.GetCollection(ctx, "prod", "users")
+	if err := src.CreateRecord(ctx, &pb.CollectionRecord{Id: "u1", ProtoData: []byte(`{"name": "ada"}`)}); err != nil {
+		t.Fatalf("failed to create record: %v", err)
+	}
+
+	// Fetch with notify_source: the copy is routed locally and the source learns about it
+	_, err = dstServer.Fetch(ctx, &pb.FetchRequest{
+		SourceEndpoint:   srcAddr,
+		SourceCollection: &pb.NamespacedName{Namespace: "prod", Name: "users"},
+		DestNamespace:    "prod",
+		DestName:         "users",
+		NotifySource:     true,
+	})
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	route, err := dstRepo.Route(ctx, &pb.RouteRequest{Collection: &pb.NamespacedName{Namespace: "prod", Name: "users"}})
+	if err != nil || route.ServerEndpoint != dstAddr {
+		t.Fatalf("expected fetched copy routed to %s, got %v (%v)", dstAddr, route.GetServerEndpoint(), err)
+	}
+	if route.Collection.MessageType.GetMessageName() != "User" {
+		t.Errorf("expected message type to be copied, got %v", route.Collection.MessageType)
+	}
+
+	// Re-fetching refreshes the existing entry instead of failing
+	_, err = dstServer.Fetch(ctx, &pb.FetchRequest{
+		SourceEndpoint:   srcAddr,
+		SourceCollection: &pb.NamespacedName{Namespace: "prod", Name: "users"},
+		DestNamespace:    "prod",
+		DestName:         "users",
+		NotifySource:     true,
+	})
+	if err != nil {
+		t.Fatalf("re-Fetch failed: %v", err)
+	}
+
+	// Push a second copy from the source side
+	resp, err := srcServer.Clone(ctx, &pb.CloneRequest{
+		SourceCollection: &pb.NamespacedName{Namespace: "prod", Name: "users"},
+		DestEndpoint:     dstAddr,
+		DestNamespace:    "staging",
+		DestName:         "users",
+	})
+	if err != nil || resp.Status.GetCode() != pb.Status_OK {
+		t.Fatalf("Clone failed: %v (%v)", resp, err)
+	}
+
+	pushed, err := dstRepo.GetCollection(ctx, "staging", "users")
+	if err != nil {
+		t.Fatalf("pushed copy not registered: %v", err)
+	}
+	if pushed.Meta.ServerEndpoint != dstAddr || pushed.Meta.Metadata.Labels["cloned_from"] != "prod/users@"+srcAddr {
+		t.Errorf("unexpected pushed copy metadata: %v", pushed.Meta)
+	}
+
+	discover, err := srcRepo.Discover(ctx, &pb.DiscoverRequest{Namespace: "prod"})
+	if err != nil || len(discover.Collections) != 1 {
+		t.Fatalf("Discover failed: %v (%v)", discover, err)
+	}
+	replicas := discover.Collections[0].Replicas
+	if len(replicas) != 2 {
+		t.Fatalf("expected 2 replicas (re-fetch deduplicated), got %v", replicas)
+	}
+	for _, r := range replicas {
+		if r.Endpoint != dstAddr || r.SyncedAt == nil {
+			t.Errorf("unexpected replica: %v", r)
+		}
+	}
+}
+
+func TestGrpcServer_RegisterReplica_Validation(t *testing.T) {
+	_, server, _ := startRepoServer(t)
+	ctx := context.Background()
+
+	resp, err := server.RegisterReplica(ctx, &pb.RegisterReplicaRequest{
+		SourceCollection: &pb.NamespacedName{Namespace: "prod", Name: "users"},
+	})
+	if err != nil || resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT without a replica, got %v (%v)", resp, err)
+	}
+
+	resp, err = server.RegisterReplica(ctx, &pb.RegisterReplicaRequest{
+		SourceCollection: &pb.NamespacedName{Namespace: "prod", Name: "missing"},
+		Replica:          &pb.ReplicaRef{Endpoint: "elsewhere:50051", Namespace: "prod", Name: "missing"},
+	})
+	if err != nil || resp.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND for unknown collection, got %v (%v)", resp, err)
+	}
+}
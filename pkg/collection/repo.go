@@ -3,8 +3,10 @@ package collection
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/proto"
 )
 
 // Store defines the interface for the underlying database.
@@ -43,35 +45,107 @@ type Store interface {
 // DefaultCollectionRepo is a facade that provides a simple interface for managing collections.
 // It uses a CollectionRepoService and a Store to do the heavy lifting.
 type DefaultCollectionRepo struct {
-	service *CollectionRepoService
-	store   Store
+	service    *CollectionRepoService
+	store      Store
+	extractors TextExtractors
+	artifacts  *ArtifactPipeline
+	fs         FileSystem
+	layout     PathLayout
+	monitor    *ChangeMonitor
+	leases     *LeaseManager
+	holds      *LegalHolds
+	changelog  *ChangeLog
+	fields     *FieldManager
+	temps      *TempCollections
+	aliases    *NamespaceAliases
+	clock      Clock
+	hlc        *HybridClock
+	verify     bool
+
+	opener    StoreOpener
+	storageMu sync.Mutex
+	storage   map[string]*collectionStorage // Collections moved off the shared store
+	gates     map[string]*storageGate
+	moving    map[string]bool
 }
 
 // NewCollectionRepo creates a new DefaultCollectionRepo with the given Store.
 func NewCollectionRepo(store Store) *DefaultCollectionRepo {
 	service := NewCollectionRepoService(store)
 
-	return &DefaultCollectionRepo{
-		service: service,
-		store:   store,
+	r := &DefaultCollectionRepo{
+		service:    service,
+		store:      store,
+		layout:     NewPathLayout(DefaultDataRoot),
+		extractors: DefaultTextExtractors(),
+		leases:     NewLeaseManager(),
+		fields:     NewFieldManager(defaultFieldNode()),
+		storage:    make(map[string]*collectionStorage),
+		gates:      make(map[string]*storageGate),
+		moving:     make(map[string]bool),
+		hlc:        NewHybridClock(SystemClock{}),
 	}
+	r.temps = newTempCollections(r)
+	return r
+}
+
+// SetTextExtractor registers the extractor used to index attachments of
+// mediaType (e.g. "application/pdf", or "text/*" for a whole major type) in
+// every collection. Call it before serving requests.
+func (r *DefaultCollectionRepo) SetTextExtractor(mediaType string, e TextExtractor) {
+	r.extractors[mediaType] = e
 }
 
 // CreateCollection creates a new collection.
 func (r *DefaultCollectionRepo) CreateCollection(ctx context.Context, collection *pb.Collection) (*pb.CreateCollectionResponse, error) {
-	return r.service.CreateCollection(ctx, collection)
+	collection = r.resolveCollection(collection)
+	if collection.GetNamespace() == AttachmentsNamespace {
+		return nil, ErrReservedNamespace
+	}
+	if collection.GetEnforceMessageType() && collection.GetMessageType().GetMessageName() == "" {
+		return nil, fmt.Errorf("collection %s/%s cannot enforce a message type without one", collection.Namespace, collection.Name)
+	}
+	if collection.GetTemporary() != nil {
+		if collection.GetStoreOptions().GetWriteOnce() {
+			return nil, fmt.Errorf("temporary collection %s/%s cannot be write-once", collection.Namespace, collection.Name)
+		}
+		if collection.GetStoreOptions().GetPartitionPeriod() != "" {
+			return nil, fmt.Errorf("temporary collection %s/%s cannot be partitioned", collection.Namespace, collection.Name)
+		}
+		return r.temps.create(ctx, collection)
+	}
+	if collection.GetStoreOptions().GetWriteOnce() || collection.GetStoreOptions().GetPartitionPeriod() != "" {
+		return r.createOwnStore(ctx, collection)
+	}
+	return r.service.CreateCollection(ctx, withStoreOptions(collection, r.store))
 }
 
 // Discover finds collections based on the provided criteria.
 func (r *DefaultCollectionRepo) Discover(ctx context.Context, req *pb.DiscoverRequest) (*pb.DiscoverResponse, error) {
+	if ns := r.aliases.Resolve(req.Namespace); ns != req.Namespace {
+		req = proto.Clone(req).(*pb.DiscoverRequest)
+		req.Namespace = ns
+	}
 	return r.service.Discover(ctx, req)
 }
 
 // Route directs a request to the appropriate collection server.
 func (r *DefaultCollectionRepo) Route(ctx context.Context, req *pb.RouteRequest) (*pb.RouteResponse, error) {
+	if req.Collection != nil {
+		if ns := r.aliases.Resolve(req.Collection.Namespace); ns != req.Collection.Namespace {
+			req = proto.Clone(req).(*pb.RouteRequest)
+			req.Collection.Namespace = ns
+		}
+	}
 	return r.service.Route(ctx, req)
 }
 
+// SetEndpoint sets the address this collector is reachable at, which Route
+// returns for collections without a server_endpoint of their own.
+func (r *DefaultCollectionRepo) SetEndpoint(endpoint string) {
+	r.service.SetEndpoint(endpoint)
+}
+
 // SearchCollections searches across multiple collections.
 func (r *DefaultCollectionRepo) SearchCollections(ctx context.Context, req *pb.SearchCollectionsRequest) (*pb.SearchCollectionsResponse, error) {
 	return r.service.SearchCollections(ctx, req)
@@ -80,19 +154,145 @@ func (r *DefaultCollectionRepo) SearchCollections(ctx context.Context, req *pb.S
 // GetCollection retrieves a Collection instance by namespace and name.
 func (r *DefaultCollectionRepo) GetCollection(ctx context.Context, namespace, name string) (*Collection, error) {
 	// Check if collection exists in the service
+	namespace = r.aliases.Resolve(namespace)
 	key := namespace + "/" + name
+	// Each handle gets its own copy of the metadata, so callers can change
+	// it, and persist it with UpdateCollectionMetadata, without racing
+	// other requests reading the repository's.
+	r.service.mu.RLock()
 	meta, exists := r.service.collections[key]
+	if exists {
+		meta = proto.Clone(meta).(*pb.Collection)
+	}
+	r.service.mu.RUnlock()
 	if !exists {
 		return nil, fmt.Errorf("collection %s not found", key)
 	}
+	store := r.store
+	tempStore, temporary, expired := r.temps.storeFor(key)
+	if expired {
+		return nil, fmt.Errorf("collection %s not found: temporary collection expired", key)
+	}
+	if temporary {
+		store = tempStore
+	}
+	moved, gate, moves := r.storageFor(key)
+	if moved != nil {
+		store = moved.store
+	}
+
+	// Use a local filesystem implementation unless one was configured
+	fs := r.fs
+	if moved != nil && moved.fs != nil {
+		fs = moved.fs
+	}
+	if fs == nil {
+		local, err := NewLocalFileSystem(r.layout.FilesDir())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create filesystem: %w", err)
+		}
+		fs = local
+	}
 
-	// Use a local filesystem implementation
-	fs, err := NewLocalFileSystem("./data/files")
+	collection, err := NewCollection(meta, store, fs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create filesystem: %w", err)
+		return nil, err
 	}
 
-	return NewCollection(meta, r.store, fs)
+	if meta.Sampling != nil {
+		sampler, err := r.service.samplerFor(key, meta.Sampling)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sampling policy: %w", err)
+		}
+		collection.Sampler = sampler
+	}
+
+	if meta.WriteBehind.GetEnabled() && !temporary {
+		collection.Store = r.service.bufferFor(key, meta.WriteBehind, store)
+	}
+	collection.gate, collection.gateMoves = gate, moves
+	collection.Extractors = r.extractors
+	collection.Artifacts = r.artifacts
+	collection.Monitor = r.monitor
+	collection.Leases = r.leases
+	collection.Holds = r.holds
+	collection.Changelog = r.changelog
+	collection.Fields = r.fields
+	collection.Clock = r.clock
+	collection.HLC = r.hlc
+	collection.VerifyChecksums = r.verify
+
+	return collection, nil
+}
+
+// SetFileSystem stores collection files in fs, e.g. an object-storage bucket,
+// instead of the layout's files directory. Call it before serving requests.
+func (r *DefaultCollectionRepo) SetFileSystem(fs FileSystem) {
+	r.fs = fs
+}
+
+// SetPathLayout keeps collection files where layout says instead of under
+// DefaultDataRoot. Give the GrpcServer the same layout. Call it before
+// serving requests.
+func (r *DefaultCollectionRepo) SetPathLayout(layout PathLayout) {
+	r.layout = layout
+}
+
+// SetChangeMonitor reports every collection's changes to monitor, which may
+// refuse deletes during a suspected mass deletion. Call it before serving
+// requests.
+func (r *DefaultCollectionRepo) SetChangeMonitor(monitor *ChangeMonitor) {
+	r.monitor = monitor
+}
+
+// SetLegalHolds refuses updates and deletes of records under a hold in holds. Give
+// the GrpcServer the same holds. Call it before serving requests.
+func (r *DefaultCollectionRepo) SetLegalHolds(holds *LegalHolds) {
+	r.holds = holds
+}
+
+// SetNodeID names this collector in the G-counters and registers of managed
+// fields; it defaults to the hostname and must differ between collectors that
+// replicate the same collections. Call it before serving requests.
+func (r *DefaultCollectionRepo) SetNodeID(node string) {
+	r.fields = NewFieldManager(node)
+}
+
+// SetClock stamps every collection's records with clock's time instead of
+// the system time, and expires temporary collections by it. Call it before
+// serving requests.
+func (r *DefaultCollectionRepo) SetClock(clock Clock) {
+	r.clock = clock
+	r.hlc = NewHybridClock(clock)
+}
+
+// HybridClock returns the clock stamping every collection's records with
+// HLCs, for the dispatcher to advance with those of other collectors.
+func (r *DefaultCollectionRepo) HybridClock() *HybridClock {
+	return r.hlc
+}
+
+// SetVerifyChecksums checks every record read with GetRecord against the
+// checksum it was written with. Call it before serving requests.
+func (r *DefaultCollectionRepo) SetVerifyChecksums(verify bool) {
+	r.verify = verify
+}
+
+// SetTempStoreFactory enables temporary collections, opening their stores
+// with factory. Call it before serving requests.
+func (r *DefaultCollectionRepo) SetTempStoreFactory(factory TempStoreFactory) {
+	r.temps.factory = factory
+}
+
+// Temporary returns the repository's temporary collections.
+func (r *DefaultCollectionRepo) Temporary() *TempCollections {
+	return r.temps
+}
+
+// SetArtifactPipeline post-processes new attachments in every collection with
+// the given pipeline. Call it before serving requests.
+func (r *DefaultCollectionRepo) SetArtifactPipeline(p *ArtifactPipeline) {
+	r.artifacts = p
 }
 
 // UpdateCollectionMetadata updates the metadata for an existing collection.
@@ -101,11 +301,26 @@ func (r *DefaultCollectionRepo) UpdateCollectionMetadata(ctx context.Context, na
 	defer r.service.mu.Unlock()
 
 	key := namespace + "/" + name
-	if _, exists := r.service.collections[key]; !exists {
+	existing, exists := r.service.collections[key]
+	if !exists {
 		return fmt.Errorf("collection %s not found", key)
 	}
 
-	// Update the collection metadata
+	// Update the collection metadata; sampling counters restart under the new policy.
+	// Where the collection is stored, and the store's features, are not the
+	// caller's to change.
+	meta.StoragePath = existing.StoragePath
+	meta.StoreOptions = existing.StoreOptions
 	r.service.collections[key] = meta
+	r.service.changed()
+	delete(r.service.samplers, key)
+
+	// Drain the write-behind buffer so new buffer settings (or disabling it) take effect
+	if buffer, ok := r.service.buffers[key]; ok {
+		delete(r.service.buffers, key)
+		if err := buffer.Stop(ctx); err != nil {
+			return fmt.Errorf("failed to flush write buffer: %w", err)
+		}
+	}
 	return nil
 }
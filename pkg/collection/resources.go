@@ -0,0 +1,142 @@
+package collection
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sort"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Stores returns the stores the repository holds open: its shared store,
+// those of moved collections and those of temporary collections.
+func (r *DefaultCollectionRepo) Stores() []*pb.StoreHandle {
+	stores := []*pb.StoreHandle{{Path: r.store.Path(), Owner: "repository"}}
+
+	r.storageMu.Lock()
+	for key, moved := range r.storage {
+		stores = append(stores, &pb.StoreHandle{Path: moved.store.Path(), Owner: "moved", Collection: key})
+	}
+	r.storageMu.Unlock()
+
+	r.temps.mu.Lock()
+	for key, t := range r.temps.temps {
+		stores = append(stores, &pb.StoreHandle{Path: t.store.Path(), Owner: "temporary", Collection: key})
+	}
+	r.temps.mu.Unlock()
+
+	collections := stores[1:]
+	sort.Slice(collections, func(i, j int) bool { return collections[i].Collection < collections[j].Collection })
+	return stores
+}
+
+// ResourceUsage counts what the repository holds in memory: loaded
+// collections, write-behind buffers and the records queued in them, leases,
+// and temporary and moved collections.
+func (r *DefaultCollectionRepo) ResourceUsage() map[string]int64 {
+	usage := make(map[string]int64)
+
+	r.service.mu.RLock()
+	usage["collections"] = int64(len(r.service.collections))
+	usage["write_behind_buffers"] = int64(len(r.service.buffers))
+	buffers := make([]*BufferedStore, 0, len(r.service.buffers))
+	for _, b := range r.service.buffers {
+		buffers = append(buffers, b)
+	}
+	r.service.mu.RUnlock()
+	for _, b := range buffers {
+		usage["buffered_records"] += b.Stats().Pending
+	}
+
+	r.leases.mu.Lock()
+	usage["leases"] = int64(len(r.leases.leases))
+	r.leases.mu.Unlock()
+
+	r.temps.mu.Lock()
+	usage["temporary_collections"] = int64(len(r.temps.temps))
+	r.temps.mu.Unlock()
+
+	r.storageMu.Lock()
+	usage["moved_collections"] = int64(len(r.storage))
+	usage["moves_in_progress"] = int64(len(r.moving))
+	r.storageMu.Unlock()
+	return usage
+}
+
+// openFiles counts the process's open file descriptors, or returns -1 where
+// /proc does not list them.
+func openFiles() int32 {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return int32(len(fds))
+}
+
+// ServerResources reports the process's open stores, peer connections,
+// goroutines and memory, and what each subsystem holds, to help find leaks
+// in long-running collectors.
+func (s *GrpcServer) ServerResources(ctx context.Context, req *pb.ServerResourcesRequest) (*pb.ServerResourcesResponse, error) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	resp := &pb.ServerResourcesResponse{
+		Status:      &pb.Status{Code: pb.Status_OK},
+		CollectedAt: timestamppb.Now(),
+		Goroutines:  int32(runtime.NumGoroutine()),
+		OpenFiles:   openFiles(),
+		Memory: &pb.MemoryUsage{
+			HeapAllocBytes:  mem.HeapAlloc,
+			HeapInuseBytes:  mem.HeapInuse,
+			HeapObjects:     mem.HeapObjects,
+			StackInuseBytes: mem.StackInuse,
+			SysBytes:        mem.Sys,
+			TotalAllocBytes: mem.TotalAlloc,
+			NumGc:           mem.NumGC,
+			GcPauseTotalNs:  mem.PauseTotalNs,
+		},
+	}
+
+	if repo, ok := s.repo.(*DefaultCollectionRepo); ok {
+		resp.Stores = repo.Stores()
+		resp.Subsystems = append(resp.Subsystems, &pb.SubsystemUsage{Name: "repository", Counts: repo.ResourceUsage()})
+	}
+	if s.backupManager != nil && s.backupManager.metaStore != nil {
+		resp.Stores = append(resp.Stores, &pb.StoreHandle{Path: s.backupManager.metaStore.path, Owner: "backups"})
+	}
+	if s.snapshots != nil {
+		resp.Stores = append(resp.Stores, &pb.StoreHandle{Path: s.snapshots.Path(), Owner: "snapshots"})
+	}
+
+	if pool := s.cloneManager.pool; pool != nil {
+		pooled := &pb.SubsystemUsage{Name: "channel_pool", Counts: map[string]int64{}}
+		for _, peer := range pool.Stats() {
+			resp.Peers = append(resp.Peers, &pb.PeerConnection{
+				Address: peer.Address, Channels: int32(peer.Channels), ActiveCalls: int32(peer.ActiveCalls),
+			})
+			pooled.Counts["peers"]++
+			pooled.Counts["channels"] += int64(peer.Channels)
+			pooled.Counts["active_calls"] += int64(peer.ActiveCalls)
+		}
+		sort.Slice(resp.Peers, func(i, j int) bool { return resp.Peers[i].Address < resp.Peers[j].Address })
+		resp.Subsystems = append(resp.Subsystems, pooled)
+	}
+
+	resp.Subsystems = append(resp.Subsystems, &pb.SubsystemUsage{Name: "jobs", Counts: map[string]int64{"active": int64(s.jobs.Active())}})
+
+	if s.disk != nil {
+		disk := &pb.SubsystemUsage{Name: "disk", Counts: map[string]int64{}}
+		for _, vol := range s.disk.Volumes() {
+			disk.Counts["volumes"]++
+			if vol.Level == DiskCritical {
+				disk.Counts["critical_volumes"]++
+			}
+		}
+		resp.Subsystems = append(resp.Subsystems, disk)
+	}
+	if s.tempFiles != nil {
+		resp.Subsystems = append(resp.Subsystems, &pb.SubsystemUsage{Name: "temp_files", Counts: s.tempFiles.Stats()})
+	}
+	return resp, nil
+}
@@ -0,0 +1,49 @@
+package collection_test
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestServerResources(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	for _, meta := range []*pb.Collection{
+		{Namespace: "test", Name: "docs"},
+		{Namespace: "test", Name: "ingest", WriteBehind: &pb.WriteBehindConfig{Enabled: true, FlushIntervalMs: 60000}},
+	} {
+		if _, err := repo.CreateCollection(ctx, meta); err != nil {
+			t.Fatalf("failed to create collection: %v", err)
+		}
+	}
+	ingest, _ := repo.GetCollection(ctx, "test", "ingest")
+	if err := ingest.CreateRecord(ctx, &pb.CollectionRecord{Id: "e1", ProtoData: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	resp, err := collection.NewGrpcServer(repo).ServerResources(ctx, &pb.ServerResourcesRequest{})
+	if err != nil || resp.Status.Code != pb.Status_OK {
+		t.Fatalf("ServerResources returned %v, %v", resp, err)
+	}
+	if resp.Goroutines <= 0 || resp.Memory.GetHeapAllocBytes() == 0 {
+		t.Errorf("expected runtime stats, got %d goroutines and %v", resp.Goroutines, resp.Memory)
+	}
+	if len(resp.Stores) == 0 || resp.Stores[0].Owner != "repository" || resp.Stores[0].Path == "" {
+		t.Errorf("expected the repository's store first, got %v", resp.Stores)
+	}
+
+	var usage map[string]int64
+	for _, sub := range resp.Subsystems {
+		if sub.Name == "repository" {
+			usage = sub.Counts
+		}
+	}
+	if usage["collections"] != 2 || usage["write_behind_buffers"] != 1 || usage["buffered_records"] != 1 {
+		t.Errorf("unexpected repository usage %v", usage)
+	}
+}
@@ -0,0 +1,131 @@
+package collection
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// ErrSampledOut is returned by CreateRecord when a record is dropped by the
+// collection's sampling policy. Callers should treat it as a successful no-op.
+var ErrSampledOut = errors.New("record dropped by sampling policy")
+
+// Sampler applies a SamplingPolicy to incoming records and tracks how many
+// records were kept or dropped. It is safe for concurrent use.
+type Sampler struct {
+	policy *pb.SamplingPolicy
+
+	mu          sync.Mutex
+	stats       pb.SamplingStats
+	windowStart time.Time
+	windowCount int32
+	now         func() time.Time
+}
+
+// NewSampler creates a Sampler for the given policy.
+func NewSampler(policy *pb.SamplingPolicy) (*Sampler, error) {
+	if policy == nil {
+		return nil, fmt.Errorf("sampling policy is required")
+	}
+	if policy.HeadPercent < 0 || policy.HeadPercent > 100 {
+		return nil, fmt.Errorf("head_percent must be between 0 and 100, got %v", policy.HeadPercent)
+	}
+	if policy.MaxRecordsPerSecond < 0 {
+		return nil, fmt.Errorf("max_records_per_second must not be negative")
+	}
+	for _, rule := range policy.Rules {
+		if rule.Field == "" {
+			return nil, fmt.Errorf("sampling rule field is required")
+		}
+	}
+
+	return &Sampler{policy: policy, now: time.Now}, nil
+}
+
+// Decide reports whether the record should be written. When it returns false,
+// the reason describes which part of the policy dropped the record.
+func (s *Sampler) Decide(record *pb.CollectionRecord) (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 1. Rules: first match wins
+	if len(s.policy.Rules) > 0 {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(record.ProtoData, &doc); err == nil {
+			for _, rule := range s.policy.Rules {
+				value, ok := lookupJSONPath(doc, rule.Field)
+				if !ok || fmt.Sprintf("%v", value) != rule.Equals {
+					continue
+				}
+				if rule.Action == pb.SamplingRule_DROP {
+					s.stats.DroppedRule++
+					return false, fmt.Sprintf("rule %s=%s", rule.Field, rule.Equals)
+				}
+				s.stats.Kept++
+				return true, ""
+			}
+		}
+	}
+
+	// 2. Head sampling: hash the record ID so retries get the same decision
+	if p := s.policy.HeadPercent; p > 0 && p < 100 {
+		h := fnv.New32a()
+		h.Write([]byte(record.Id))
+		if float64(h.Sum32()%10000) >= p*100 {
+			s.stats.DroppedHead++
+			return false, fmt.Sprintf("head sampling at %v%%", p)
+		}
+	}
+
+	// 3. Rate cap over one-second windows
+	if limit := s.policy.MaxRecordsPerSecond; limit > 0 {
+		now := s.now()
+		if now.Sub(s.windowStart) >= time.Second {
+			s.windowStart = now
+			s.windowCount = 0
+		}
+		if s.windowCount >= limit {
+			s.stats.DroppedRate++
+			return false, fmt.Sprintf("rate cap of %d records/s", limit)
+		}
+		s.windowCount++
+	}
+
+	s.stats.Kept++
+	return true, ""
+}
+
+// Stats returns a snapshot of the sampler's counters.
+func (s *Sampler) Stats() *pb.SamplingStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &pb.SamplingStats{
+		Kept:        s.stats.Kept,
+		DroppedHead: s.stats.DroppedHead,
+		DroppedRate: s.stats.DroppedRate,
+		DroppedRule: s.stats.DroppedRule,
+	}
+}
+
+// lookupJSONPath resolves a dotted field path (e.g. "http.status") in a decoded JSON document.
+func lookupJSONPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = obj[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
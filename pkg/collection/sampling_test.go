@@ -0,0 +1,166 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestSampler_Rules(t *testing.T) {
+	sampler, err := collection.NewSampler(&pb.SamplingPolicy{
+		HeadPercent: 0.01,
+		Rules: []*pb.SamplingRule{
+			{Field: "level", Equals: "error", Action: pb.SamplingRule_KEEP},
+			{Field: "http.status", Equals: "200", Action: pb.SamplingRule_DROP},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewSampler failed: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		keep, _ := sampler.Decide(&pb.CollectionRecord{
+			Id:        fmt.Sprintf("err-%d", i),
+			ProtoData: []byte(`{"level": "error"}`),
+		})
+		if !keep {
+			t.Fatalf("expected error records to bypass head sampling")
+		}
+	}
+
+	keep, reason := sampler.Decide(&pb.CollectionRecord{
+		Id:        "ok-1",
+		ProtoData: []byte(`{"level": "info", "http": {"status": 200}}`),
+	})
+	if keep || reason == "" {
+		t.Errorf("expected nested DROP rule to match, got keep=%v reason=%q", keep, reason)
+	}
+
+	stats := sampler.Stats()
+	if stats.Kept != 20 || stats.DroppedRule != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSampler_HeadSamplingIsDeterministic(t *testing.T) {
+	sampler, err := collection.NewSampler(&pb.SamplingPolicy{HeadPercent: 25})
+	if err != nil {
+		t.Fatalf("NewSampler failed: %v", err)
+	}
+
+	kept := 0
+	for i := 0; i < 4000; i++ {
+		record := &pb.CollectionRecord{Id: fmt.Sprintf("event-%d", i)}
+		first, _ := sampler.Decide(record)
+		second, _ := sampler.Decide(record)
+		if first != second {
+			t.Fatalf("expected the same decision for record %s", record.Id)
+		}
+		if first {
+			kept++
+		}
+	}
+
+	// Expect roughly 25% of 4000 records
+	if kept < 800 || kept > 1200 {
+		t.Errorf("expected about 1000 kept records, got %d", kept)
+	}
+}
+
+func TestSampler_RateCap(t *testing.T) {
+	sampler, err := collection.NewSampler(&pb.SamplingPolicy{MaxRecordsPerSecond: 5})
+	if err != nil {
+		t.Fatalf("NewSampler failed: %v", err)
+	}
+
+	kept := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := sampler.Decide(&pb.CollectionRecord{Id: fmt.Sprintf("r-%d", i)}); ok {
+			kept++
+		}
+	}
+	if kept != 5 {
+		t.Errorf("expected 5 records within the window, got %d", kept)
+	}
+	if stats := sampler.Stats(); stats.DroppedRate != 5 {
+		t.Errorf("expected 5 rate drops, got %d", stats.DroppedRate)
+	}
+}
+
+func TestSampler_InvalidPolicy(t *testing.T) {
+	policies := []*pb.SamplingPolicy{
+		nil,
+		{HeadPercent: 150},
+		{MaxRecordsPerSecond: -1},
+		{Rules: []*pb.SamplingRule{{Equals: "x"}}},
+	}
+	for _, p := range policies {
+		if _, err := collection.NewSampler(p); err == nil {
+			t.Errorf("expected policy %v to be rejected", p)
+		}
+	}
+}
+
+func TestCollectionServer_CreateWithSampling(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewCollectionServer(repo)
+	ctx := context.Background()
+
+	_, err := repo.CreateCollection(ctx, &pb.Collection{
+		Namespace: "test",
+		Name:      "events",
+		Sampling: &pb.SamplingPolicy{
+			Rules: []*pb.SamplingRule{
+				{Field: "level", Equals: "debug", Action: pb.SamplingRule_DROP},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	for i, level := range []string{"info", "debug", "debug"} {
+		resp, err := server.Create(ctx, &pb.CreateRequest{
+			Namespace:      "test",
+			CollectionName: "events",
+			Id:             fmt.Sprintf("event-%d", i),
+			Item:           &anypb.Any{Value: []byte(fmt.Sprintf(`{"level": %q}`, level))},
+		})
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		dropped := resp.Status.GetDetails()["sampled"] == "dropped"
+		if dropped != (level == "debug") {
+			t.Errorf("record %d (%s): dropped=%v", i, level, dropped)
+		}
+	}
+
+	coll, err := repo.GetCollection(ctx, "test", "events")
+	if err != nil {
+		t.Fatalf("GetCollection failed: %v", err)
+	}
+	if _, err := coll.GetRecord(ctx, "event-1"); err == nil {
+		t.Error("expected dropped record to not be stored")
+	}
+	err = coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "direct", ProtoData: []byte(`{"level": "debug"}`)})
+	if !errors.Is(err, collection.ErrSampledOut) {
+		t.Errorf("expected ErrSampledOut, got %v", err)
+	}
+
+	desc, err := server.Describe(ctx, &pb.DescribeRequest{Namespace: "test", CollectionName: "events"})
+	if err != nil {
+		t.Fatalf("Describe failed: %v", err)
+	}
+	if desc.RecordCount != 1 {
+		t.Errorf("expected 1 stored record, got %d", desc.RecordCount)
+	}
+	if desc.SamplingStats.GetKept() != 1 || desc.SamplingStats.GetDroppedRule() != 3 {
+		t.Errorf("unexpected sampling stats: %+v", desc.SamplingStats)
+	}
+}
@@ -0,0 +1,507 @@
+package collection
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// SavedSearchesNamespace and SavedSearchesCollection name the collection
+	// that conventionally holds saved searches.
+	SavedSearchesNamespace  = "system"
+	SavedSearchesCollection = "saved_searches"
+
+	// DefaultAlertInterval is how often a SearchAlerter checks collections
+	// for new matches.
+	DefaultAlertInterval = 10 * time.Second
+
+	// alertBatchSize is how many changed records are matched per query.
+	alertBatchSize = 100
+)
+
+// ErrSavedSearchNotFound is returned for saved searches that do not exist.
+var ErrSavedSearchNotFound = errors.New("saved search not found")
+
+// SavedSearchStore keeps saved searches in a collection, conventionally
+// system/saved_searches. Each record is a SavedSearch encoded as JSON with
+// proto field names, keyed by namespace/collection/name and labelled with
+// the collection it searches.
+type SavedSearchStore struct {
+	coll *Collection
+	mu   sync.Mutex // serializes read-modify-write of searches and their cursors
+}
+
+// NewSavedSearchStore creates a SavedSearchStore backed by coll.
+func NewSavedSearchStore(coll *Collection) *SavedSearchStore {
+	return &SavedSearchStore{coll: coll}
+}
+
+func savedSearchID(namespace, collection, name string) string {
+	return namespace + "/" + collection + "/" + name
+}
+
+// Save creates or replaces a saved search.
+func (s *SavedSearchStore) Save(ctx context.Context, search *pb.SavedSearch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save(ctx, search)
+}
+
+func (s *SavedSearchStore) save(ctx context.Context, search *pb.SavedSearch) error {
+	data, err := jobJSON.Marshal(search)
+	if err != nil {
+		return fmt.Errorf("failed to encode saved search: %w", err)
+	}
+	id := savedSearchID(search.Namespace, search.CollectionName, search.Name)
+	record := &pb.CollectionRecord{Id: id, ProtoData: data, Metadata: &pb.Metadata{Labels: map[string]string{
+		"namespace":  search.Namespace,
+		"collection": search.CollectionName,
+	}}}
+
+	existing, err := s.coll.GetRecord(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.coll.CreateRecord(ctx, record)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read saved search %s: %w", id, err)
+	}
+	record.Metadata.CreatedAt = existing.GetMetadata().GetCreatedAt()
+	return s.coll.UpdateRecord(ctx, record)
+}
+
+// Get returns a saved search, or ErrSavedSearchNotFound.
+func (s *SavedSearchStore) Get(ctx context.Context, namespace, collection, name string) (*pb.SavedSearch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(ctx, namespace, collection, name)
+}
+
+func (s *SavedSearchStore) get(ctx context.Context, namespace, collection, name string) (*pb.SavedSearch, error) {
+	id := savedSearchID(namespace, collection, name)
+	record, err := s.coll.GetRecord(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSavedSearchNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read saved search %s: %w", id, err)
+	}
+	return decodeSavedSearch(record.ProtoData)
+}
+
+// List returns saved searches by name, limited to a namespace and collection
+// when they are set.
+func (s *SavedSearchStore) List(ctx context.Context, namespace, collection string) ([]*pb.SavedSearch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := &SearchQuery{LabelFilters: map[string]string{}}
+	if namespace != "" {
+		query.LabelFilters["namespace"] = namespace
+	}
+	if collection != "" {
+		query.LabelFilters["collection"] = collection
+	}
+	results, err := s.coll.Search(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list saved searches: %w", err)
+	}
+	list := make([]*pb.SavedSearch, 0, len(results))
+	for _, r := range results {
+		search, err := decodeSavedSearch(r.Record.ProtoData)
+		if err != nil {
+			continue
+		}
+		list = append(list, search)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return savedSearchID(list[i].Namespace, list[i].CollectionName, list[i].Name) <
+			savedSearchID(list[j].Namespace, list[j].CollectionName, list[j].Name)
+	})
+	return list, nil
+}
+
+// Delete removes a saved search, or returns ErrSavedSearchNotFound.
+func (s *SavedSearchStore) Delete(ctx context.Context, namespace, collection, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.coll.DeleteRecord(ctx, savedSearchID(namespace, collection, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrSavedSearchNotFound
+	}
+	return err
+}
+
+// advance moves a saved search's alert cursor, leaving the rest of the
+// search as it is now. Searches deleted in the meantime are ignored.
+func (s *SavedSearchStore) advance(ctx context.Context, search *pb.SavedSearch, until time.Time, afterID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.get(ctx, search.Namespace, search.CollectionName, search.Name)
+	if errors.Is(err, ErrSavedSearchNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	current.CheckedUntil = timestamppb.New(until)
+	current.CheckedAfterId = afterID
+	return s.save(ctx, current)
+}
+
+func decodeSavedSearch(data []byte) (*pb.SavedSearch, error) {
+	search := &pb.SavedSearch{}
+	if err := protojson.Unmarshal(data, search); err != nil {
+		return nil, fmt.Errorf("failed to decode saved search: %w", err)
+	}
+	return search, nil
+}
+
+// SetSavedSearches enables the saved search RPCs, keeping searches in store.
+func (s *CollectionServer) SetSavedSearches(store *SavedSearchStore) {
+	s.searches = store
+}
+
+func (s *CollectionServer) savedSearches() (*SavedSearchStore, error) {
+	if s.searches == nil {
+		return nil, status.Error(codes.FailedPrecondition, "saved searches are not enabled on this server")
+	}
+	return s.searches, nil
+}
+
+// SaveSearch creates or replaces a named search on a collection. An alert
+// added to a search is evaluated from the time it is saved; an alert kept
+// across saves keeps its place in the change feed.
+func (s *CollectionServer) SaveSearch(ctx context.Context, req *pb.SaveSearchRequest) (*pb.SaveSearchResponse, error) {
+	store, err := s.savedSearches()
+	if err != nil {
+		return nil, err
+	}
+	if req.Search == nil {
+		return nil, status.Error(codes.InvalidArgument, "search is required")
+	}
+	search := proto.Clone(req.Search).(*pb.SavedSearch)
+	if search.Name == "" || strings.Contains(search.Name, "/") {
+		return nil, status.Error(codes.InvalidArgument, "search name is required and cannot contain '/'")
+	}
+	if _, err := s.repo.GetCollection(ctx, search.Namespace, search.CollectionName); err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if search.Query == nil {
+		search.Query = &pb.SearchRequest{}
+	}
+	search.Query.Namespace, search.Query.CollectionName = search.Namespace, search.CollectionName
+	if _, err := searchQueryFromProto(search.Query); err != nil {
+		return nil, err
+	}
+	if err := s.validateAlert(ctx, search); err != nil {
+		return nil, err
+	}
+
+	now := timestamppb.Now()
+	search.CreatedAt, search.CheckedUntil, search.CheckedAfterId = now, now, ""
+	existing, err := store.Get(ctx, search.Namespace, search.CollectionName, search.Name)
+	switch {
+	case err == nil:
+		search.CreatedAt = existing.CreatedAt
+		if existing.Alert != nil && search.Alert != nil {
+			search.CheckedUntil, search.CheckedAfterId = existing.CheckedUntil, existing.CheckedAfterId
+		}
+	case !errors.Is(err, ErrSavedSearchNotFound):
+		return nil, status.Errorf(codes.Internal, "failed to read saved search: %v", err)
+	}
+
+	if err := store.Save(ctx, search); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save search: %v", err)
+	}
+	return &pb.SaveSearchResponse{Status: &pb.Status{Code: pb.Status_OK}, Search: search}, nil
+}
+
+func (s *CollectionServer) validateAlert(ctx context.Context, search *pb.SavedSearch) error {
+	alert := search.Alert
+	if alert == nil {
+		return nil
+	}
+	if alert.WebhookUrl == "" && alert.AlertsCollection == nil {
+		return status.Error(codes.InvalidArgument, "alert needs a webhook_url or alerts_collection")
+	}
+	if search.Query.AsOf != nil {
+		return status.Error(codes.InvalidArgument, "alerts cannot search as_of a past time")
+	}
+	if alert.WebhookUrl != "" {
+		u, err := url.Parse(alert.WebhookUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return status.Errorf(codes.InvalidArgument, "invalid webhook_url %q", alert.WebhookUrl)
+		}
+	}
+	if target := alert.AlertsCollection; target != nil {
+		if _, err := s.repo.GetCollection(ctx, target.Namespace, target.Name); err != nil {
+			return status.Errorf(codes.InvalidArgument, "alerts collection %s/%s not found", target.Namespace, target.Name)
+		}
+	}
+	return nil
+}
+
+// ListSavedSearches returns a collection's saved searches.
+func (s *CollectionServer) ListSavedSearches(ctx context.Context, req *pb.ListSavedSearchesRequest) (*pb.ListSavedSearchesResponse, error) {
+	store, err := s.savedSearches()
+	if err != nil {
+		return nil, err
+	}
+	searches, err := store.List(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	return &pb.ListSavedSearchesResponse{Status: &pb.Status{Code: pb.Status_OK}, Searches: searches}, nil
+}
+
+// DeleteSavedSearch removes a saved search and its alert.
+func (s *CollectionServer) DeleteSavedSearch(ctx context.Context, req *pb.DeleteSavedSearchRequest) (*pb.DeleteSavedSearchResponse, error) {
+	store, err := s.savedSearches()
+	if err != nil {
+		return nil, err
+	}
+	err = store.Delete(ctx, req.Namespace, req.CollectionName, req.Name)
+	if errors.Is(err, ErrSavedSearchNotFound) {
+		return nil, status.Errorf(codes.NotFound, "saved search %s not found", req.Name)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete saved search: %v", err)
+	}
+	return &pb.DeleteSavedSearchResponse{Status: &pb.Status{Code: pb.Status_OK}}, nil
+}
+
+// RunSavedSearch runs a saved search as a regular Search.
+func (s *CollectionServer) RunSavedSearch(ctx context.Context, req *pb.RunSavedSearchRequest) (*pb.SearchResponse, error) {
+	store, err := s.savedSearches()
+	if err != nil {
+		return nil, err
+	}
+	search, err := store.Get(ctx, req.Namespace, req.CollectionName, req.Name)
+	if errors.Is(err, ErrSavedSearchNotFound) {
+		return nil, status.Errorf(codes.NotFound, "saved search %s not found", req.Name)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	query := search.Query
+	if req.Limit > 0 {
+		query.Limit = req.Limit
+	}
+	return s.Search(ctx, query)
+}
+
+// SearchAlerter evaluates the alerts of saved searches against the change
+// feeds of their collections, delivering each record created or updated to
+// match. Deliveries are at least once: a failed delivery is retried on the
+// next check, after any matches delivered before it.
+type SearchAlerter struct {
+	repo     CollectionRepo
+	searches *SavedSearchStore
+
+	// Client sends webhook deliveries.
+	Client *http.Client
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewSearchAlerter creates an alerter for the searches in store over the
+// collections in repo.
+func NewSearchAlerter(repo CollectionRepo, store *SavedSearchStore) *SearchAlerter {
+	return &SearchAlerter{
+		repo:     repo,
+		searches: store,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Start runs Check every interval until Stop.
+func (a *SearchAlerter) Start(interval time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stop != nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	a.stop, a.done = stop, done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			if err := a.Check(context.Background()); err != nil {
+				log.Printf("Warning: search alerts: %v", err)
+			}
+		}
+	}()
+}
+
+// Stop ends the Start loop, waiting for a running check to finish.
+func (a *SearchAlerter) Stop() {
+	a.mu.Lock()
+	stop, done := a.stop, a.done
+	a.stop, a.done = nil, nil
+	a.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Check evaluates every alerting saved search once, up to the end of its
+// collection's change feed. A search that fails does not hold up the others.
+func (a *SearchAlerter) Check(ctx context.Context) error {
+	searches, err := a.searches.List(ctx, "", "")
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, search := range searches {
+		if search.Alert == nil {
+			continue
+		}
+		if err := a.check(ctx, search); err != nil {
+			errs = append(errs, fmt.Errorf("saved search %s: %w", savedSearchID(search.Namespace, search.CollectionName, search.Name), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *SearchAlerter) check(ctx context.Context, search *pb.SavedSearch) error {
+	coll, err := a.repo.GetCollection(ctx, search.Namespace, search.CollectionName)
+	if err != nil {
+		return err
+	}
+	feed, ok := coll.Store.(ChangeFeed)
+	if !ok {
+		return fmt.Errorf("collection store does not support change feeds")
+	}
+	query, err := searchQueryFromProto(search.Query)
+	if err != nil {
+		return err
+	}
+	query.Limit, query.Offset, query.OrderBy = 0, 0, ""
+
+	since, afterID := search.CheckedUntil.AsTime(), search.CheckedAfterId
+	for {
+		records, err := feed.ChangesSince(ctx, since, afterID, alertBatchSize)
+		if err != nil || len(records) == 0 {
+			return err
+		}
+
+		batch := *query
+		for _, r := range records {
+			batch.IDs = append(batch.IDs, r.Id)
+		}
+		results, err := coll.Search(ctx, &batch)
+		if err != nil {
+			return err
+		}
+		matched := make(map[string]bool, len(results))
+		for _, r := range results {
+			matched[r.Record.Id] = true
+		}
+
+		for _, r := range records {
+			if matched[r.Id] {
+				if err := a.deliver(ctx, search, r); err != nil {
+					if advanceErr := a.searches.advance(ctx, search, since, afterID); advanceErr != nil {
+						return errors.Join(err, advanceErr)
+					}
+					return err
+				}
+			}
+			since, afterID = r.Metadata.GetUpdatedAt().AsTime(), r.Id
+		}
+		if err := a.searches.advance(ctx, search, since, afterID); err != nil {
+			return err
+		}
+		if len(records) < alertBatchSize {
+			return nil
+		}
+	}
+}
+
+// deliver sends one match to the alert's webhook and alerts collection.
+func (a *SearchAlerter) deliver(ctx context.Context, search *pb.SavedSearch, record *pb.CollectionRecord) error {
+	event := &pb.SearchAlertEvent{
+		Namespace:       search.Namespace,
+		CollectionName:  search.CollectionName,
+		SearchName:      search.Name,
+		RecordId:        record.Id,
+		Data:            record.ProtoData,
+		RecordUpdatedAt: record.Metadata.GetUpdatedAt(),
+		MatchedAt:       timestamppb.Now(),
+	}
+	data, err := jobJSON.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %w", err)
+	}
+
+	if target := search.Alert.AlertsCollection; target != nil {
+		alerts, err := a.repo.GetCollection(ctx, target.Namespace, target.Name)
+		if err != nil {
+			return fmt.Errorf("alerts collection %s/%s: %w", target.Namespace, target.Name, err)
+		}
+		// Keyed by the record version, so a retried delivery is not duplicated
+		id := strings.Join([]string{search.Namespace, search.CollectionName, search.Name, record.Id,
+			strconv.FormatInt(record.Metadata.GetUpdatedAt().GetSeconds(), 10)}, ":")
+		exists, err := alerts.Exists(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to check alert %s: %w", id, err)
+		}
+		if !exists {
+			err := alerts.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: data, Metadata: &pb.Metadata{Labels: map[string]string{
+				"saved_search": search.Name,
+				"collection":   search.Namespace + "." + search.CollectionName,
+			}}})
+			if err != nil {
+				return fmt.Errorf("failed to write alert %s: %w", id, err)
+			}
+		}
+	}
+
+	if search.Alert.WebhookUrl != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, search.Alert.WebhookUrl, bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to build webhook request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := a.Client.Do(req)
+		if err != nil {
+			return fmt.Errorf("webhook failed: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook returned %s", resp.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package collection_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func setupSavedSearches(t *testing.T) (collection.CollectionRepo, *collection.CollectionServer, *collection.SavedSearchStore) {
+	t.Helper()
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	t.Cleanup(cleanup)
+	for _, name := range []string{"tickets", "alerts"} {
+		if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: name}); err != nil {
+			t.Fatalf("failed to create collection: %v", err)
+		}
+	}
+
+	store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), "saved_searches.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	coll, err := collection.NewCollection(
+		&pb.Collection{Namespace: collection.SavedSearchesNamespace, Name: collection.SavedSearchesCollection},
+		store, &collection.LocalFileSystem{},
+	)
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	searches := collection.NewSavedSearchStore(coll)
+
+	server := collection.NewCollectionServer(repo)
+	server.SetSavedSearches(searches)
+	return repo, server, searches
+}
+
+func createTicket(t *testing.T, server *collection.CollectionServer, id, data string) {
+	t.Helper()
+	if _, err := server.Create(context.Background(), &pb.CreateRequest{
+		Namespace: "test", CollectionName: "tickets", Id: id, Item: &anypb.Any{Value: []byte(data)},
+	}); err != nil {
+		t.Fatalf("failed to create record: %v", err)
+	}
+}
+
+func TestSavedSearches(t *testing.T) {
+	ctx := context.Background()
+	_, server, _ := setupSavedSearches(t)
+	createTicket(t, server, "t1", `{"title": "Database outage", "severity": "high"}`)
+	createTicket(t, server, "t2", `{"title": "Typo on homepage", "severity": "low"}`)
+
+	saved, err := server.SaveSearch(ctx, &pb.SaveSearchRequest{Search: &pb.SavedSearch{
+		Namespace: "test", CollectionName: "tickets", Name: "outages",
+		Query: &pb.SearchRequest{FullText: "outage"},
+	}})
+	if err != nil {
+		t.Fatalf("SaveSearch failed: %v", err)
+	}
+	if saved.Search.CreatedAt == nil || saved.Search.Query.CollectionName != "tickets" {
+		t.Errorf("expected the saved search to be completed, got %v", saved.Search)
+	}
+
+	resp, err := server.RunSavedSearch(ctx, &pb.RunSavedSearchRequest{Namespace: "test", CollectionName: "tickets", Name: "outages"})
+	if err != nil || len(resp.Results) != 1 {
+		t.Fatalf("RunSavedSearch returned %v, %v", resp.GetResults(), err)
+	}
+
+	list, err := server.ListSavedSearches(ctx, &pb.ListSavedSearchesRequest{Namespace: "test", CollectionName: "tickets"})
+	if err != nil || len(list.Searches) != 1 || list.Searches[0].Name != "outages" {
+		t.Fatalf("ListSavedSearches returned %v, %v", list.GetSearches(), err)
+	}
+
+	if _, err := server.DeleteSavedSearch(ctx, &pb.DeleteSavedSearchRequest{Namespace: "test", CollectionName: "tickets", Name: "outages"}); err != nil {
+		t.Fatalf("DeleteSavedSearch failed: %v", err)
+	}
+	_, err = server.RunSavedSearch(ctx, &pb.RunSavedSearchRequest{Namespace: "test", CollectionName: "tickets", Name: "outages"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound after delete, got %v", err)
+	}
+
+	for name, search := range map[string]*pb.SavedSearch{
+		"no name":       {Namespace: "test", CollectionName: "tickets"},
+		"empty alert":   {Namespace: "test", CollectionName: "tickets", Name: "x", Alert: &pb.SearchAlert{}},
+		"bad webhook":   {Namespace: "test", CollectionName: "tickets", Name: "x", Alert: &pb.SearchAlert{WebhookUrl: "ftp://example.com"}},
+		"missing sink":  {Namespace: "test", CollectionName: "tickets", Name: "x", Alert: &pb.SearchAlert{AlertsCollection: &pb.NamespacedName{Namespace: "test", Name: "nope"}}},
+		"bad selector":  {Namespace: "test", CollectionName: "tickets", Name: "x", Query: &pb.SearchRequest{LabelSelector: "a in ("}},
+		"missing table": {Namespace: "test", CollectionName: "nope", Name: "x"},
+	} {
+		if _, err := server.SaveSearch(ctx, &pb.SaveSearchRequest{Search: search}); err == nil {
+			t.Errorf("%s: expected SaveSearch to fail", name)
+		}
+	}
+
+	unconfigured := collection.NewCollectionServer(nil)
+	_, err = unconfigured.ListSavedSearches(ctx, &pb.ListSavedSearchesRequest{})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition without a store, got %v", err)
+	}
+}
+
+func TestSearchAlerter(t *testing.T) {
+	ctx := context.Background()
+	repo, server, searches := setupSavedSearches(t)
+
+	var (
+		mu       sync.Mutex
+		received []*pb.SearchAlertEvent
+		failing  = true
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		event := &pb.SearchAlertEvent{}
+		if err := protojson.Unmarshal(body, event); err != nil {
+			t.Errorf("failed to decode alert: %v", err)
+		}
+		received = append(received, event)
+	}))
+	defer hook.Close()
+
+	// Records from before the alert are not reported
+	createTicket(t, server, "old", `{"title": "Old outage", "severity": "high"}`)
+	_, err := server.SaveSearch(ctx, &pb.SaveSearchRequest{Search: &pb.SavedSearch{
+		Namespace: "test", CollectionName: "tickets", Name: "urgent",
+		Query: &pb.SearchRequest{FullText: "outage", LabelSelector: "team=db"},
+		Alert: &pb.SearchAlert{
+			WebhookUrl:       hook.URL,
+			AlertsCollection: &pb.NamespacedName{Namespace: "test", Name: "alerts"},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("SaveSearch failed: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond) // Change feed cursors have one-second resolution
+
+	tickets, _ := repo.GetCollection(ctx, "test", "tickets")
+	for _, r := range []*pb.CollectionRecord{
+		{Id: "match", ProtoData: []byte(`{"title": "Replica outage"}`), Metadata: &pb.Metadata{Labels: map[string]string{"team": "db"}}},
+		{Id: "other-team", ProtoData: []byte(`{"title": "CDN outage"}`), Metadata: &pb.Metadata{Labels: map[string]string{"team": "edge"}}},
+		{Id: "no-text", ProtoData: []byte(`{"title": "Slow queries"}`), Metadata: &pb.Metadata{Labels: map[string]string{"team": "db"}}},
+	} {
+		if err := tickets.CreateRecord(ctx, r); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	alerter := collection.NewSearchAlerter(repo, searches)
+	if err := alerter.Check(ctx); err == nil {
+		t.Fatal("expected the failing webhook to be reported")
+	}
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if err := alerter.Check(ctx); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	// Nothing new to deliver
+	if err := alerter.Check(ctx); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 || received[0].RecordId != "match" || received[0].SearchName != "urgent" {
+		t.Fatalf("expected one webhook delivery for match, got %v", received)
+	}
+	alerts, _ := repo.GetCollection(ctx, "test", "alerts")
+	if n, err := alerts.Count(ctx, &collection.SearchQuery{LabelFilters: map[string]string{"saved_search": "urgent"}}); err != nil || n != 1 {
+		t.Errorf("expected one alert record despite the retried delivery, got %d (%v)", n, err)
+	}
+
+	saved, err := searches.Get(ctx, "test", "tickets", "urgent")
+	if err != nil || saved.CheckedAfterId == "" {
+		t.Errorf("expected the cursor to have advanced, got %v (%v)", saved, err)
+	}
+}
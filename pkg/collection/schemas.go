@@ -25,3 +25,95 @@ CREATE VIRTUAL TABLE IF NOT EXISTS records_fts USING fts5(
     tokenize = "porter unicode61"
 );
 `
+
+// FTSSchemaFor creates the full-text search table with the given FTS5
+// tokenizer (see Language.Tokenizer).
+func FTSSchemaFor(tokenizer string) string {
+	return `
+CREATE VIRTUAL TABLE IF NOT EXISTS records_fts USING fts5(
+    content,
+    content_rowid=rowid,
+    tokenize = "` + tokenizer + `"
+);
+`
+}
+
+// HistorySchema keeps superseded record versions for as-of reads. Each row is
+// the version that was current during [valid_from, valid_to), in Unix seconds.
+// Updates close a version at the new updated_at; deletes close it at the
+// deletion time.
+const HistorySchema = `
+CREATE TABLE IF NOT EXISTS records_history (
+    id TEXT NOT NULL,
+    proto_data BLOB,
+    data_uri TEXT,
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL,
+    labels TEXT,
+    jsontext TEXT,
+    valid_from INTEGER NOT NULL,
+    valid_to INTEGER NOT NULL,
+    encoding INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS records_history_id ON records_history(id, valid_from);
+CREATE TRIGGER IF NOT EXISTS records_history_au AFTER UPDATE ON records BEGIN
+    INSERT INTO records_history (id, proto_data, encoding, data_uri, created_at, updated_at, labels, jsontext, valid_from, valid_to)
+    VALUES (old.id, old.proto_data, old.encoding, old.data_uri, old.created_at, old.updated_at, old.labels, old.jsontext, old.updated_at, new.updated_at);
+END;
+CREATE TRIGGER IF NOT EXISTS records_history_ad AFTER DELETE ON records BEGIN
+    INSERT INTO records_history (id, proto_data, encoding, data_uri, created_at, updated_at, labels, jsontext, valid_from, valid_to)
+    VALUES (old.id, old.proto_data, old.encoding, old.data_uri, old.created_at, old.updated_at, old.labels, old.jsontext, old.updated_at, CAST(strftime('%s', 'now') AS INTEGER));
+END;
+`
+
+// AttachmentSchema records metadata for files attached to records, plus any
+// text extracted from them for full-text search. Attachment rows are removed
+// with their record; the files themselves are removed by
+// Collection.DeleteRecord.
+const AttachmentSchema = `
+CREATE TABLE IF NOT EXISTS attachments (
+    record_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    sha256 TEXT NOT NULL,
+    uri TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    text TEXT,
+    derived_from TEXT NOT NULL DEFAULT '',
+    processor TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (record_id, name)
+);
+CREATE TRIGGER IF NOT EXISTS attachments_ad AFTER DELETE ON records BEGIN
+    DELETE FROM attachments WHERE record_id = old.id;
+END;
+`
+
+// GeoSchema creates an R-tree over record locations, keyed by records rowid.
+// It is populated by triggers that read the fields declared in Options.Geo.
+const GeoSchema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS records_geo USING rtree(
+    id,
+    min_lat, max_lat,
+    min_lon, max_lon
+);
+`
+
+// EncodingSchema adds the column recording how each record's proto_data is
+// stored, as flags the store sets: 0 is the data as written, anything else
+// (compressed, a reference to shared data) is for the store to undo on read.
+// Keeping it apart from the data means no data can be mistaken for encoded.
+const EncodingSchema = `
+ALTER TABLE records ADD COLUMN encoding INTEGER NOT NULL DEFAULT 0;
+`
+
+// CompressionSchema keeps the dictionaries compressed record data refers to.
+// IDs are derived from the dictionary content, so dictionaries copied between
+// databases (e.g. when merging partitions) never collide.
+const CompressionSchema = `
+CREATE TABLE IF NOT EXISTS compression_dictionaries (
+    id INTEGER PRIMARY KEY,
+    dictionary BLOB NOT NULL,
+    created_at INTEGER NOT NULL
+);
+`
@@ -1,27 +1,55 @@
 package collection
 
 import (
+	"fmt"
+	"math"
+	"time"
+
 	pb "github.com/accretional/collector/gen/collector"
 )
 
 // SearchQuery is the generic query structure passed to the Store.
 type SearchQuery struct {
 	FullText            string
-	Filters             map[string]Filter // Field path -> Filter
-	LabelFilters        map[string]string
+	Filters             map[string]Filter // Field path (see ParseFieldPath) -> Filter
+	LabelFilters        map[string]string // Exact matches; combined with Labels
+	Labels              LabelSelector
 	Vector              []float32 // For vector similarity search
 	SimilarityThreshold float32
 	Limit               int
 	Offset              int
-	OrderBy             string
+	OrderBy             string // Field path; must not contain [*]
 	Ascending           bool
+
+	// Optional creation-time range [CreatedAfter, CreatedBefore); zero values are unbounded.
+	// Time-partitioned stores use it to skip partitions outside the range.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// Optional location filter; requires a store with a geo index (see
+	// Options.Geo). Radius searches report each hit's distance in meters in
+	// SearchResult.Distance and, unless ordered otherwise, sort nearest first.
+	Geo *GeoFilter
+
+	// Optional point in time to search as of; requires a store with history
+	// enabled (see HistoryReader). The zero value searches current data.
+	AsOf time.Time
+
+	// Optional record IDs to restrict the search to; empty searches every
+	// record.
+	IDs []string
+}
+
+// LabelRequirements returns LabelFilters and Labels as a single selector.
+func (q *SearchQuery) LabelRequirements() LabelSelector {
+	return append(SelectorFromMap(q.LabelFilters), q.Labels...)
 }
 
 // SearchResult represents a search hit with relevance info.
 type SearchResult struct {
 	Record   *pb.CollectionRecord
 	Score    float64
-	Distance float64 // For vector search
+	Distance float64 // For vector search, or meters for geo radius search
 }
 
 // Filter represents a condition on a structured field.
@@ -43,4 +71,86 @@ const (
 	OpIn           FilterOperator = "IN"
 	OpExists       FilterOperator = "EXISTS"
 	OpNotExists    FilterOperator = "NOT_EXISTS"
+
+	// OpArrayContains matches arrays holding the value, or every value of a
+	// []interface{}; OpArrayContainsAny matches arrays holding any of them.
+	OpArrayContains    FilterOperator = "ARRAY_CONTAINS"
+	OpArrayContainsAny FilterOperator = "ARRAY_CONTAINS_ANY"
+
+	// OpBetween matches values in the inclusive range given by a two-element
+	// list. OpSameDay and OpSameWeek match dates on the same UTC day or ISO week
+	// (Monday to Sunday) as the value; see FilterTime for accepted forms.
+	OpBetween  FilterOperator = "BETWEEN"
+	OpSameDay  FilterOperator = "SAME_DAY"
+	OpSameWeek FilterOperator = "SAME_WEEK"
+
+	// OpIsNull matches fields present with a JSON null; OpIsNotNull matches
+	// fields present with any other value. OpNotExists matches both missing
+	// and null fields.
+	OpIsNull    FilterOperator = "IS_NULL"
+	OpIsNotNull FilterOperator = "IS_NOT_NULL"
 )
+
+// Validate checks that the filter's value has the form its operator needs.
+func (f Filter) Validate() error {
+	switch f.Operator {
+	case OpBetween:
+		if len(FilterValues(f.Value)) != 2 {
+			return fmt.Errorf("%s needs a [low, high] list, got %v", f.Operator, f.Value)
+		}
+	case OpSameDay, OpSameWeek:
+		if _, err := FilterTime(f.Value); err != nil {
+			return fmt.Errorf("%s: %w", f.Operator, err)
+		}
+	}
+	return nil
+}
+
+// FilterTime interprets a date filter value: a time.Time, Unix seconds, or an
+// RFC 3339 timestamp or YYYY-MM-DD date string. Results are in UTC.
+func FilterTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UTC(), nil
+	case float64:
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	case int:
+		return time.Unix(int64(v), 0).UTC(), nil
+	case int64:
+		return time.Unix(v, 0).UTC(), nil
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t.UTC(), nil
+		}
+		if t, err := time.Parse(time.DateOnly, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %v: want an RFC 3339 timestamp, YYYY-MM-DD date, or Unix seconds", v)
+}
+
+// WeekStart returns the Monday starting t's ISO week, at midnight UTC.
+func WeekStart(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// FilterValues returns a filter value as a list: list values as they are,
+// and any other non-nil value as a single element.
+func FilterValues(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return v
+	case []string:
+		values := make([]interface{}, len(v))
+		for i, s := range v {
+			values[i] = s
+		}
+		return values
+	default:
+		return []interface{}{v}
+	}
+}
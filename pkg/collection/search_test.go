@@ -463,6 +463,141 @@ func TestSearch_JSONBNestedFields(t *testing.T) {
 	}
 }
 
+func TestSearch_JSONPathArrays(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	records := []*pb.CollectionRecord{
+		createTestRecord(t, "1", map[string]interface{}{
+			"items":    []interface{}{map[string]interface{}{"sku": "A", "price": 5}, map[string]interface{}{"sku": "B", "price": 40}},
+			"tags":     []interface{}{"red", "sale"},
+			"metadata": map[string]interface{}{"owner": map[string]interface{}{"id": "u1"}, "k8s.io/zone": "a"},
+		}),
+		createTestRecord(t, "2", map[string]interface{}{
+			"items":    []interface{}{map[string]interface{}{"sku": "C", "price": 20}},
+			"tags":     []interface{}{"blue"},
+			"metadata": map[string]interface{}{"owner": map[string]interface{}{"id": "u2"}},
+		}),
+		createTestRecord(t, "3", map[string]interface{}{
+			"items": []interface{}{map[string]interface{}{"sku": "B"}},
+			"tags":  []interface{}{"red", "blue", "sale"},
+		}),
+	}
+	for _, record := range records {
+		if err := coll.CreateRecord(ctx, record); err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		filters     map[string]collection.Filter
+		expectedIDs []string
+	}{
+		{"index", map[string]collection.Filter{"items[0].price": {Operator: collection.OpLessThan, Value: 10}}, []string{"1"}},
+		{"last element", map[string]collection.Filter{"items[-1].sku": {Operator: collection.OpEquals, Value: "B"}}, []string{"1", "3"}},
+		{"nested object", map[string]collection.Filter{"metadata.owner.id": {Operator: collection.OpEquals, Value: "u2"}}, []string{"2"}},
+		{"quoted key", map[string]collection.Filter{`metadata["k8s.io/zone"]`: {Operator: collection.OpExists}}, []string{"1"}},
+		{"any element", map[string]collection.Filter{"items[*].price": {Operator: collection.OpGreaterEqual, Value: 20}}, []string{"1", "2"}},
+		{"any element in", map[string]collection.Filter{"items[*].sku": {Operator: collection.OpIn, Value: []interface{}{"A", "C"}}}, []string{"1", "2"}},
+		{"no element has field", map[string]collection.Filter{"items[*].price": {Operator: collection.OpNotExists}}, []string{"3"}},
+		{"array contains", map[string]collection.Filter{"tags": {Operator: collection.OpArrayContains, Value: "red"}}, []string{"1", "3"}},
+		{"array contains all", map[string]collection.Filter{"tags": {Operator: collection.OpArrayContains, Value: []interface{}{"red", "blue"}}}, []string{"3"}},
+		{"array contains any", map[string]collection.Filter{"tags": {Operator: collection.OpArrayContainsAny, Value: []string{"blue", "green"}}}, []string{"3", "2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := coll.Search(ctx, &collection.SearchQuery{Filters: tt.filters, OrderBy: "items[0].sku", Ascending: true})
+			if err != nil {
+				t.Fatalf("search failed: %v", err)
+			}
+			var ids []string
+			for _, result := range results {
+				ids = append(ids, result.Record.Id)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.expectedIDs) {
+				t.Errorf("expected %v, got %v", tt.expectedIDs, ids)
+			}
+		})
+	}
+
+	if _, err := coll.Search(ctx, &collection.SearchQuery{OrderBy: "items[*].price"}); err == nil {
+		t.Error("expected an error ordering by a wildcard path")
+	}
+	if _, err := coll.Search(ctx, &collection.SearchQuery{Filters: map[string]collection.Filter{"items[": {Operator: collection.OpExists}}}); err == nil {
+		t.Error("expected an error for an invalid path")
+	}
+}
+
+func TestSearch_RangeDateAndNullOperators(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// 2024-03-04 is a Monday
+	records := []*pb.CollectionRecord{
+		createTestRecord(t, "1", map[string]interface{}{"price": 10, "shipped": "2024-03-04T09:00:00Z", "note": nil}),
+		createTestRecord(t, "2", map[string]interface{}{"price": 25.5, "shipped": "2024-03-04T23:59:59.5Z", "note": "fragile"}),
+		createTestRecord(t, "3", map[string]interface{}{"price": 40, "shipped": 1710028800}), // 2024-03-10, a Sunday
+		createTestRecord(t, "4", map[string]interface{}{"price": 99, "shipped": "2024-03-11", "events": []interface{}{map[string]interface{}{"at": "2024-03-04T12:00:00Z"}}}),
+	}
+	for _, record := range records {
+		if err := coll.CreateRecord(ctx, record); err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		key         string
+		filter      collection.Filter
+		expectedIDs []string
+	}{
+		{"between", "price", collection.Filter{Operator: collection.OpBetween, Value: []interface{}{10, 40}}, []string{"1", "2", "3"}},
+		{"between exclusive of others", "price", collection.Filter{Operator: collection.OpBetween, Value: []interface{}{11, 39}}, []string{"2"}},
+		{"between dates", "shipped", collection.Filter{Operator: collection.OpBetween, Value: []interface{}{"2024-03-04T10:00:00Z", "2024-03-05"}}, []string{"2"}},
+		{"same day", "shipped", collection.Filter{Operator: collection.OpSameDay, Value: "2024-03-04T18:30:00+02:00"}, []string{"1", "2"}},
+		{"same day from unix", "shipped", collection.Filter{Operator: collection.OpSameDay, Value: float64(1710072000)}, []string{"3"}},
+		{"same week", "shipped", collection.Filter{Operator: collection.OpSameWeek, Value: "2024-03-07"}, []string{"1", "2", "3"}},
+		{"same week next", "shipped", collection.Filter{Operator: collection.OpSameWeek, Value: "2024-03-17"}, []string{"4"}},
+		{"same day in array", "events[*].at", collection.Filter{Operator: collection.OpSameDay, Value: "2024-03-04"}, []string{"4"}},
+		{"is null", "note", collection.Filter{Operator: collection.OpIsNull}, []string{"1"}},
+		{"is not null", "note", collection.Filter{Operator: collection.OpIsNotNull}, []string{"2"}},
+		{"not exists includes null", "note", collection.Filter{Operator: collection.OpNotExists}, []string{"1", "3", "4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := coll.Search(ctx, &collection.SearchQuery{
+				Filters:   map[string]collection.Filter{tt.key: tt.filter},
+				OrderBy:   "price",
+				Ascending: true,
+			})
+			if err != nil {
+				t.Fatalf("search failed: %v", err)
+			}
+			var ids []string
+			for _, result := range results {
+				ids = append(ids, result.Record.Id)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.expectedIDs) {
+				t.Errorf("expected %v, got %v", tt.expectedIDs, ids)
+			}
+		})
+	}
+
+	for _, invalid := range []collection.Filter{
+		{Operator: collection.OpBetween, Value: 5},
+		{Operator: collection.OpSameDay, Value: "last tuesday"},
+	} {
+		if _, err := coll.Search(ctx, &collection.SearchQuery{Filters: map[string]collection.Filter{"price": invalid}}); err == nil {
+			t.Errorf("expected an error for %+v", invalid)
+		}
+	}
+}
+
 func TestSearch_JSONBExists(t *testing.T) {
 	coll, cleanup := setupTestCollection(t)
 	defer cleanup()
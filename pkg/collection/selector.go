@@ -0,0 +1,194 @@
+package collection
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SelectorOperator is the comparison in a label selector requirement.
+type SelectorOperator string
+
+const (
+	SelectorEquals       SelectorOperator = "="
+	SelectorNotEquals    SelectorOperator = "!="
+	SelectorIn           SelectorOperator = "in"
+	SelectorNotIn        SelectorOperator = "notin"
+	SelectorExists       SelectorOperator = "exists"
+	SelectorDoesNotExist SelectorOperator = "!"
+)
+
+// Requirement is one clause of a label selector.
+type Requirement struct {
+	Key      string
+	Operator SelectorOperator
+	Values   []string // One value for = and !=, a set for in and notin
+}
+
+// LabelSelector matches labels against every requirement, using Kubernetes
+// selector semantics: != and notin also match labels that are absent.
+type LabelSelector []Requirement
+
+var (
+	selectorKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+	selectorValuePattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?)?$`)
+	setRequirement       = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+)
+
+// ParseLabelSelector parses a comma-separated Kubernetes-style selector:
+//
+//	env=prod, tier!=cache          equality and inequality (== is accepted)
+//	region in (us-east, us-west)   set membership
+//	track notin (canary)
+//	owner, !deprecated             existence and absence
+//
+// An empty string parses to an empty selector, which matches everything.
+func ParseLabelSelector(s string) (LabelSelector, error) {
+	var selector LabelSelector
+	for _, clause := range splitSelector(s) {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			if strings.TrimSpace(s) == "" {
+				break
+			}
+			return nil, fmt.Errorf("invalid label selector %q: empty requirement", s)
+		}
+		req, err := parseRequirement(clause)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label selector %q: %w", s, err)
+		}
+		selector = append(selector, req)
+	}
+	return selector, nil
+}
+
+// splitSelector splits on commas outside parentheses.
+func splitSelector(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseRequirement(clause string) (Requirement, error) {
+	if m := setRequirement.FindStringSubmatch(clause); m != nil {
+		req := Requirement{Key: m[1], Operator: SelectorOperator(m[2])}
+		for _, v := range strings.Split(m[3], ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				return req, fmt.Errorf("empty value in %s set for key %q", req.Operator, req.Key)
+			}
+			req.Values = append(req.Values, v)
+		}
+		return req, req.validate()
+	}
+
+	for _, op := range []string{"!=", "==", "="} {
+		if key, value, ok := strings.Cut(clause, op); ok {
+			operator := SelectorEquals
+			if op == "!=" {
+				operator = SelectorNotEquals
+			}
+			req := Requirement{Key: strings.TrimSpace(key), Operator: operator, Values: []string{strings.TrimSpace(value)}}
+			return req, req.validate()
+		}
+	}
+
+	if key, ok := strings.CutPrefix(clause, "!"); ok {
+		req := Requirement{Key: strings.TrimSpace(key), Operator: SelectorDoesNotExist}
+		return req, req.validate()
+	}
+	req := Requirement{Key: clause, Operator: SelectorExists}
+	return req, req.validate()
+}
+
+func (r Requirement) validate() error {
+	if !selectorKeyPattern.MatchString(r.Key) {
+		return fmt.Errorf("invalid label key %q", r.Key)
+	}
+	if (r.Operator == SelectorIn || r.Operator == SelectorNotIn) && len(r.Values) == 0 {
+		return fmt.Errorf("%s requires at least one value", r.Operator)
+	}
+	for _, v := range r.Values {
+		if !selectorValuePattern.MatchString(v) {
+			return fmt.Errorf("invalid label value %q for key %q", v, r.Key)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether labels satisfy the requirement.
+func (r Requirement) Matches(labels map[string]string) bool {
+	value, present := labels[r.Key]
+	switch r.Operator {
+	case SelectorEquals:
+		return present && value == r.Values[0]
+	case SelectorNotEquals:
+		return !present || value != r.Values[0]
+	case SelectorIn:
+		return present && containsString(r.Values, value)
+	case SelectorNotIn:
+		return !present || !containsString(r.Values, value)
+	case SelectorExists:
+		return present
+	case SelectorDoesNotExist:
+		return !present
+	}
+	return false
+}
+
+// Matches reports whether labels satisfy every requirement.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectorFromMap converts exact-match label filters into a selector, in key
+// order.
+func SelectorFromMap(labels map[string]string) LabelSelector {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	selector := make(LabelSelector, 0, len(keys))
+	for _, k := range keys {
+		selector = append(selector, Requirement{Key: k, Operator: SelectorEquals, Values: []string{labels[k]}})
+	}
+	return selector
+}
+
+// parseSelectorWithFilters parses selector and adds legacy exact-match filters.
+func parseSelectorWithFilters(selector string, filters map[string]string) (LabelSelector, error) {
+	parsed, err := ParseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return append(SelectorFromMap(filters), parsed...), nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package collection_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	selector, err := collection.ParseLabelSelector("env==prod, tier!=cache,region in (us-east, us-west), track notin (canary), owner, !deprecated")
+	if err != nil {
+		t.Fatalf("ParseLabelSelector failed: %v", err)
+	}
+	want := collection.LabelSelector{
+		{Key: "env", Operator: collection.SelectorEquals, Values: []string{"prod"}},
+		{Key: "tier", Operator: collection.SelectorNotEquals, Values: []string{"cache"}},
+		{Key: "region", Operator: collection.SelectorIn, Values: []string{"us-east", "us-west"}},
+		{Key: "track", Operator: collection.SelectorNotIn, Values: []string{"canary"}},
+		{Key: "owner", Operator: collection.SelectorExists},
+		{Key: "deprecated", Operator: collection.SelectorDoesNotExist},
+	}
+	if !reflect.DeepEqual(selector, want) {
+		t.Errorf("got %+v, want %+v", selector, want)
+	}
+
+	if empty, err := collection.ParseLabelSelector("  "); err != nil || len(empty) != 0 {
+		t.Errorf("expected an empty selector, got %v (%v)", empty, err)
+	}
+
+	for _, invalid := range []string{"env=prod,", "=prod", "env in ()", "env in (a b)", "env=$x", "a\"b=c"} {
+		if _, err := collection.ParseLabelSelector(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestLabelSelector_Matches(t *testing.T) {
+	labels := map[string]string{"env": "prod", "region": "us-west", "owner": "data"}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"env=prod", true},
+		{"env=dev", false},
+		{"env!=dev", true},
+		{"tier!=cache", true}, // absent labels satisfy !=
+		{"region in (us-east,us-west)", true},
+		{"region notin (us-west)", false},
+		{"tier notin (cache)", true},
+		{"owner,!deprecated", true},
+		{"env=prod,deprecated", false},
+		{"app.kubernetes.io/name", false},
+	}
+	for _, tt := range tests {
+		selector, err := collection.ParseLabelSelector(tt.selector)
+		if err != nil {
+			t.Fatalf("ParseLabelSelector(%q) failed: %v", tt.selector, err)
+		}
+		if got := selector.Matches(labels); got != tt.want {
+			t.Errorf("%q.Matches = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestCollectionServer_SearchLabelSelector(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewCollectionServer(repo)
+	ctx := context.Background()
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "hosts"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, err := repo.GetCollection(ctx, "test", "hosts")
+	if err != nil {
+		t.Fatalf("failed to get collection: %v", err)
+	}
+
+	hosts := map[string]map[string]string{
+		"web-1":   {"role": "web", "env": "prod"},
+		"web-2":   {"role": "web", "env": "staging"},
+		"db-1":    {"role": "db", "env": "prod", "primary": "true"},
+		"cache-1": {"role": "cache"},
+	}
+	for id, labels := range hosts {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{
+			Id:        id,
+			ProtoData: []byte(`{}`),
+			Metadata:  &pb.Metadata{Labels: labels},
+		}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		selector string
+		want     int64
+	}{
+		{"env=prod", 2},
+		{"env!=prod", 2},
+		{"role in (web,db)", 3},
+		{"env notin (staging)", 3},
+		{"primary", 1},
+		{"!env", 1},
+		{"role=web,env=prod", 1},
+	}
+	for _, tt := range tests {
+		resp, err := server.Search(ctx, &pb.SearchRequest{Namespace: "test", CollectionName: "hosts", LabelSelector: tt.selector})
+		if err != nil {
+			t.Fatalf("Search(%q) failed: %v", tt.selector, err)
+		}
+		if int64(len(resp.Results)) != tt.want {
+			t.Errorf("Search(%q) returned %d results, want %d", tt.selector, len(resp.Results), tt.want)
+		}
+
+		count, err := server.Count(ctx, &pb.CountRequest{Namespace: "test", CollectionName: "hosts", LabelSelector: tt.selector})
+		if err != nil {
+			t.Fatalf("Count(%q) failed: %v", tt.selector, err)
+		}
+		if count.Count != tt.want {
+			t.Errorf("Count(%q) = %d, want %d", tt.selector, count.Count, tt.want)
+		}
+	}
+
+	// Legacy exact-match filters still apply, alongside a selector
+	resp, err := server.Search(ctx, &pb.SearchRequest{
+		Namespace: "test", CollectionName: "hosts",
+		LabelFilters:  map[string]string{"role": "web"},
+		LabelSelector: "env=staging",
+	})
+	if err != nil || len(resp.Results) != 1 {
+		t.Errorf("expected one result for combined filters, got %v (%v)", resp.GetResults(), err)
+	}
+
+	if _, err := server.Search(ctx, &pb.SearchRequest{Namespace: "test", CollectionName: "hosts", LabelSelector: "env in ("}); err == nil {
+		t.Error("expected an error for an invalid selector")
+	}
+}
@@ -3,10 +3,14 @@ package collection
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
+	"slices"
 	"strings"
 	"sync"
 
 	pb "github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
 )
 
 // CollectionRepoService provides a persistent implementation of the CollectionRepo interface.
@@ -14,7 +18,19 @@ import (
 type CollectionRepoService struct {
 	store       Store
 	collections map[string]*pb.Collection // Track created collections by namespace/name
+	samplers    map[string]*Sampler       // Sampling state for collections with a sampling policy
+	buffers     map[string]*BufferedStore // Write-behind buffers for collections that enable them
 	mu          sync.RWMutex
+
+	// generation is bumped by every change to collections, under mu. The
+	// sorted listing Discover pages through is rebuilt only when it moves,
+	// and Discover's etags name it.
+	generation uint64
+	listingMu  sync.Mutex
+	listing    []*pb.Collection // Sorted by key, as of listingGen
+	listingGen uint64
+	instance   string // Tells this service's etags from another's, or an earlier run's
+	endpoint   string // Address of this collector, see SetEndpoint
 }
 
 // NewCollectionRepoService creates a new service instance.
@@ -22,9 +38,57 @@ func NewCollectionRepoService(store Store) *CollectionRepoService {
 	return &CollectionRepoService{
 		store:       store,
 		collections: make(map[string]*pb.Collection),
+		samplers:    make(map[string]*Sampler),
+		buffers:     make(map[string]*BufferedStore),
+		generation:  1,
+		instance:    uuid.NewString()[:8],
 	}
 }
 
+// SetEndpoint sets the address this collector is reachable at. Route returns
+// it for collections without a server_endpoint of their own.
+func (s *CollectionRepoService) SetEndpoint(endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoint = endpoint
+}
+
+// changed records a change to collections. Callers hold mu for writing.
+func (s *CollectionRepoService) changed() {
+	s.generation++
+}
+
+// sortedCollections returns every collection sorted by key, reusing the
+// listing of the last call while nothing has changed. Callers hold mu.
+func (s *CollectionRepoService) sortedCollections() []*pb.Collection {
+	s.listingMu.Lock()
+	defer s.listingMu.Unlock()
+	if s.listingGen != s.generation {
+		keys := make([]string, 0, len(s.collections))
+		for key := range s.collections {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		s.listing = make([]*pb.Collection, len(keys))
+		for i, key := range keys {
+			s.listing[i] = s.collections[key]
+		}
+		s.listingGen = s.generation
+	}
+	return s.listing
+}
+
+// discoverETag names the response to req as of the current generation.
+// Callers hold mu.
+func (s *CollectionRepoService) discoverETag(req *pb.DiscoverRequest) string {
+	query := proto.Clone(req).(*pb.DiscoverRequest)
+	query.IfNoneMatch = ""
+	data, _ := proto.MarshalOptions{Deterministic: true}.Marshal(query)
+	h := fnv.New64a()
+	h.Write(data)
+	return fmt.Sprintf("%s-%d-%x", s.instance, s.generation, h.Sum64())
+}
+
 // CreateCollection creates a new collection.
 func (s *CollectionRepoService) CreateCollection(ctx context.Context, collection *pb.Collection) (*pb.CreateCollectionResponse, error) {
 	s.mu.Lock()
@@ -46,6 +110,7 @@ func (s *CollectionRepoService) CreateCollection(ctx context.Context, collection
 
 	// Track the collection
 	s.collections[id] = collection
+	s.changed()
 
 	return &pb.CreateCollectionResponse{
 		Status:       &pb.Status{Code: 200, Message: "OK"},
@@ -55,13 +120,30 @@ func (s *CollectionRepoService) CreateCollection(ctx context.Context, collection
 
 // Discover finds collections based on the provided criteria.
 func (s *CollectionRepoService) Discover(ctx context.Context, req *pb.DiscoverRequest) (*pb.DiscoverResponse, error) {
+	selector, err := parseSelectorWithFilters(req.LabelSelector, req.LabelFilter)
+	if err != nil {
+		return &pb.DiscoverResponse{
+			Status: &pb.Status{Code: 400, Message: err.Error()},
+		}, nil
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	// Polling clients that are up to date get the etag back and nothing else
+	etag := s.discoverETag(req)
+	if req.IfNoneMatch != "" && req.IfNoneMatch == etag {
+		return &pb.DiscoverResponse{
+			Status:      &pb.Status{Code: 200, Message: "Not Modified"},
+			Etag:        etag,
+			NotModified: true,
+		}, nil
+	}
+
 	var matched []*pb.Collection
 
-	// Filter collections based on criteria
-	for _, coll := range s.collections {
+	// Filter collections based on criteria, in key order so pages are stable
+	for _, coll := range s.sortedCollections() {
 		// Filter by namespace
 		if req.Namespace != "" && coll.Namespace != req.Namespace {
 			continue
@@ -76,20 +158,8 @@ func (s *CollectionRepoService) Discover(ctx context.Context, req *pb.DiscoverRe
 		}
 
 		// Filter by labels
-		if len(req.LabelFilter) > 0 {
-			if coll.Metadata == nil || coll.Metadata.Labels == nil {
-				continue
-			}
-			matches := true
-			for key, value := range req.LabelFilter {
-				if coll.Metadata.Labels[key] != value {
-					matches = false
-					break
-				}
-			}
-			if !matches {
-				continue
-			}
+		if !selector.Matches(coll.Metadata.GetLabels()) {
+			continue
 		}
 
 		matched = append(matched, coll)
@@ -129,6 +199,7 @@ func (s *CollectionRepoService) Discover(ctx context.Context, req *pb.DiscoverRe
 		Status:        &pb.Status{Code: 200, Message: "OK"},
 		Collections:   results,
 		NextPageToken: nextPageToken,
+		Etag:          etag,
 	}, nil
 }
 
@@ -153,11 +224,16 @@ func (s *CollectionRepoService) Route(ctx context.Context, req *pb.RouteRequest)
 		}, nil
 	}
 
-	// Return the server endpoint
+	// Return the server endpoint, or this collector's for collections served here
 	endpoint := coll.ServerEndpoint
 	if endpoint == "" {
-		// Default to a local endpoint if not specified
-		endpoint = "localhost:50051"
+		endpoint = s.endpoint
+	}
+	if endpoint == "" {
+		return &pb.RouteResponse{
+			Status:     &pb.Status{Code: 503, Message: fmt.Sprintf("no endpoint is configured for collection %s", id)},
+			Collection: coll,
+		}, nil
 	}
 
 	return &pb.RouteResponse{
@@ -215,3 +291,45 @@ func (s *CollectionRepoService) SearchCollections(ctx context.Context, req *pb.S
 		TotalMatches: 0,
 	}, nil
 }
+
+// samplerFor returns the shared sampler for a collection, creating it on first use
+// so that counters and rate windows persist across GetCollection calls.
+func (s *CollectionRepoService) samplerFor(key string, policy *pb.SamplingPolicy) (*Sampler, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sampler, ok := s.samplers[key]; ok {
+		return sampler, nil
+	}
+
+	sampler, err := NewSampler(policy)
+	if err != nil {
+		return nil, err
+	}
+	s.samplers[key] = sampler
+	return sampler, nil
+}
+
+// removeCollection forgets a collection and its sampling state.
+func (s *CollectionRepoService) removeCollection(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.collections, key)
+	delete(s.samplers, key)
+	s.changed()
+}
+
+// bufferFor returns the shared write-behind buffer for a collection, starting it on
+// first use in front of store.
+func (s *CollectionRepoService) bufferFor(key string, cfg *pb.WriteBehindConfig, store Store) *BufferedStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if buffer, ok := s.buffers[key]; ok {
+		return buffer
+	}
+
+	buffer := NewBufferedStore(store, WriteBufferOptionsFromConfig(cfg))
+	s.buffers[key] = buffer
+	return buffer
+}
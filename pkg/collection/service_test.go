@@ -287,6 +287,55 @@ func TestService_Discover_WithLabelFilter(t *testing.T) {
 	}
 }
 
+func TestService_Discover_WithLabelSelector(t *testing.T) {
+	service, cleanup := setupTestService(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for name, labels := range map[string]map[string]string{
+		"orders":   {"env": "prod", "tier": "gold"},
+		"sessions": {"env": "staging", "tier": "silver"},
+		"archive":  {"env": "prod", "deprecated": "true"},
+		"scratch":  nil,
+	} {
+		if _, err := service.CreateCollection(ctx, &pb.Collection{
+			Namespace: "test",
+			Name:      name,
+			Metadata:  &pb.Metadata{Labels: labels},
+		}); err != nil {
+			t.Fatalf("CreateCollection failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		selector string
+		filter   map[string]string
+		want     int
+	}{
+		{selector: "env in (prod,staging),!deprecated", want: 2},
+		{selector: "tier notin (gold)", want: 3},
+		{selector: "env=prod", filter: map[string]string{"tier": "gold"}, want: 1},
+		{selector: "deprecated", want: 1},
+	}
+	for _, tt := range tests {
+		resp, err := service.Discover(ctx, &pb.DiscoverRequest{LabelSelector: tt.selector, LabelFilter: tt.filter})
+		if err != nil {
+			t.Fatalf("Discover(%q) failed: %v", tt.selector, err)
+		}
+		if len(resp.Collections) != tt.want {
+			t.Errorf("Discover(%q) returned %d collections, want %d", tt.selector, len(resp.Collections), tt.want)
+		}
+	}
+
+	resp, err := service.Discover(ctx, &pb.DiscoverRequest{LabelSelector: "env in prod"})
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if resp.Status.Code != 400 {
+		t.Errorf("expected status 400 for an invalid selector, got %v", resp.Status)
+	}
+}
+
 func TestService_Discover_Pagination(t *testing.T) {
 	service, cleanup := setupTestService(t)
 	defer cleanup()
@@ -331,6 +380,55 @@ func TestService_Discover_Pagination(t *testing.T) {
 	if len(page2.Collections) != 3 {
 		t.Errorf("expected 3 collections in page 2, got %d", len(page2.Collections))
 	}
+	// Collections are listed by key, so pages neither overlap nor skip
+	if page1.Collections[0].Name != "a" || page2.Collections[0].Name != "d" {
+		t.Errorf("expected pages to start at a and d, got %s and %s", page1.Collections[0].Name, page2.Collections[0].Name)
+	}
+}
+
+func TestService_Discover_ETag(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "users"}); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	req := &pb.DiscoverRequest{Namespace: "test"}
+	first, err := repo.Discover(ctx, req)
+	if err != nil || first.Etag == "" || len(first.Collections) != 1 {
+		t.Fatalf("Discover failed: %v %v", first, err)
+	}
+
+	// Polling with the etag is answered without collections until one changes
+	req.IfNoneMatch = first.Etag
+	resp, _ := repo.Discover(ctx, req)
+	if !resp.NotModified || len(resp.Collections) != 0 || resp.Etag != first.Etag {
+		t.Errorf("expected not modified, got %v", resp)
+	}
+	if resp, _ := repo.Discover(ctx, &pb.DiscoverRequest{Namespace: "other", IfNoneMatch: first.Etag}); resp.NotModified {
+		t.Errorf("expected the etag of another query not to match")
+	}
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "orders"}); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	resp, _ = repo.Discover(ctx, req)
+	if resp.NotModified || len(resp.Collections) != 2 || resp.Etag == first.Etag {
+		t.Fatalf("expected the new collection listed under a new etag, got %v", resp)
+	}
+
+	// Metadata updates change the etag too
+	req.IfNoneMatch = resp.Etag
+	if err := repo.UpdateCollectionMetadata(ctx, "test", "users", &pb.Collection{
+		Namespace: "test", Name: "users", Metadata: &pb.Metadata{Labels: map[string]string{"env": "prod"}},
+	}); err != nil {
+		t.Fatalf("UpdateCollectionMetadata failed: %v", err)
+	}
+	resp, _ = repo.Discover(ctx, req)
+	if resp.NotModified || resp.Collections[1].Metadata.GetLabels()["env"] != "prod" {
+		t.Errorf("expected the updated labels listed, got %v", resp)
+	}
 }
 
 // TestService_Route tests routing to collections
@@ -393,7 +491,6 @@ func TestService_Route_DefaultEndpoint(t *testing.T) {
 		t.Fatalf("CreateCollection failed: %v", err)
 	}
 
-	// Route should return default endpoint
 	req := &pb.RouteRequest{
 		Collection: &pb.NamespacedName{
 			Namespace: "test",
@@ -401,13 +498,24 @@ func TestService_Route_DefaultEndpoint(t *testing.T) {
 		},
 	}
 
+	// Without a configured endpoint there is nowhere to route to
 	resp, err := service.Route(ctx, req)
 	if err != nil {
 		t.Fatalf("Route failed: %v", err)
 	}
+	if resp.Status.Code != 503 || resp.ServerEndpoint != "" {
+		t.Errorf("expected status 503 and no endpoint, got %d %q", resp.Status.Code, resp.ServerEndpoint)
+	}
+
+	// Route should return this collector's endpoint
+	service.SetEndpoint("collector-1.internal:7000")
+	resp, err = service.Route(ctx, req)
+	if err != nil {
+		t.Fatalf("Route failed: %v", err)
+	}
 
-	if resp.ServerEndpoint != "localhost:50051" {
-		t.Errorf("expected default endpoint 'localhost:50051', got '%s'", resp.ServerEndpoint)
+	if resp.ServerEndpoint != "collector-1.internal:7000" {
+		t.Errorf("expected endpoint 'collector-1.internal:7000', got '%s'", resp.ServerEndpoint)
 	}
 }
 
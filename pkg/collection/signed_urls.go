@@ -0,0 +1,103 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultSignedURLExpiry is how long signed URLs stay valid when the request
+// does not say.
+const DefaultSignedURLExpiry = 15 * time.Minute
+
+// MaxSignedURLExpiry is the longest validity a signed URL can be requested
+// with, the limit S3 puts on presigned URLs.
+const MaxSignedURLExpiry = 7 * 24 * time.Hour
+
+// ErrSigningUnsupported is returned when the collection's FileSystem cannot
+// issue signed URLs, e.g. local disk.
+var ErrSigningUnsupported = errors.New("collection filesystem does not support signed URLs")
+
+// ownsPath reports whether p lies in the collection's file area: its
+// "<namespace>/<name>/" directory or its attachment directories. Nothing
+// under the attachments directory belongs to a collection's own directory,
+// which is why AttachmentsNamespace is reserved.
+func (c *Collection) ownsPath(p string) bool {
+	if p == "" || p != path.Clean(p) || strings.HasPrefix(p, "/") || strings.HasPrefix(p, "../") {
+		return false
+	}
+	roots := []string{path.Join(AttachmentsNamespace, c.Meta.Namespace, c.Meta.Name)}
+	if c.Meta.Namespace != AttachmentsNamespace {
+		roots = append(roots, path.Join(c.Meta.Namespace, c.Meta.Name))
+	}
+	for _, root := range roots {
+		if strings.HasPrefix(p, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// SignedURL returns a URL that lets a client GET or PUT the file at p
+// directly against the FileSystem's storage until expiry elapses.
+func (c *Collection) SignedURL(ctx context.Context, p, method string, expiry time.Duration) (string, error) {
+	signer, ok := c.FS.(URLSigner)
+	if !ok {
+		return "", ErrSigningUnsupported
+	}
+	if !c.ownsPath(p) {
+		return "", fmt.Errorf("path %q is outside collection %s/%s", p, c.Meta.Namespace, c.Meta.Name)
+	}
+	return signer.SignURL(ctx, p, method, expiry)
+}
+
+// GenerateSignedURL issues a presigned download or upload URL for a file.
+func (s *CollectionServer) GenerateSignedURL(ctx context.Context, req *pb.GenerateSignedURLRequest) (*pb.GenerateSignedURLResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	if method != http.MethodGet && method != http.MethodPut {
+		return nil, status.Errorf(codes.InvalidArgument, "method must be GET or PUT, got %q", req.Method)
+	}
+	if int64(req.ExpiresInSeconds) > int64(MaxSignedURLExpiry/time.Second) {
+		return nil, status.Errorf(codes.InvalidArgument, "expires_in_seconds must be at most %d (%s), got %d", int64(MaxSignedURLExpiry/time.Second), MaxSignedURLExpiry, req.ExpiresInSeconds)
+	}
+	expiry := DefaultSignedURLExpiry
+	if req.ExpiresInSeconds > 0 {
+		expiry = time.Duration(req.ExpiresInSeconds) * time.Second
+	}
+	if !collection.ownsPath(req.Path) {
+		return nil, status.Errorf(codes.InvalidArgument, "path %q is outside the collection", req.Path)
+	}
+
+	expiresAt := time.Now().Add(expiry)
+	url, err := collection.SignedURL(ctx, req.Path, method, expiry)
+	if errors.Is(err, ErrSigningUnsupported) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to sign URL: %v", err)
+	}
+
+	return &pb.GenerateSignedURLResponse{
+		Status:    &pb.Status{Code: pb.Status_OK},
+		Url:       url,
+		Method:    method,
+		ExpiresAt: timestamppb.New(expiresAt),
+	}, nil
+}
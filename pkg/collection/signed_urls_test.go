@@ -0,0 +1,109 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/fs/s3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCollectionServer_GenerateSignedURL(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewCollectionServer(repo)
+	ctx := context.Background()
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "media", Name: "videos"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	req := &pb.GenerateSignedURLRequest{Namespace: "media", CollectionName: "videos", Path: "media/videos/intro.mp4"}
+
+	// Local disk cannot sign URLs
+	if _, err := server.GenerateSignedURL(ctx, req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition for local files, got %v", err)
+	}
+
+	bucket, err := s3.NewFileSystem(s3.Config{
+		Endpoint:        "http://minio.local:9000",
+		Region:          "us-east-1",
+		Bucket:          "files",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create bucket filesystem: %v", err)
+	}
+	repo.(*collection.DefaultCollectionRepo).SetFileSystem(bucket)
+
+	req.Method = "put"
+	req.ExpiresInSeconds = 60
+	resp, err := server.GenerateSignedURL(ctx, req)
+	if err != nil {
+		t.Fatalf("GenerateSignedURL failed: %v", err)
+	}
+	u, err := url.Parse(resp.Url)
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", resp.Url, err)
+	}
+	if resp.Method != "PUT" || u.Path != "/files/media/videos/intro.mp4" ||
+		u.Query().Get("X-Amz-Expires") != "60" || u.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("unexpected signed URL: %s %s", resp.Method, resp.Url)
+	}
+
+	// Attachment URIs of the collection can be signed too
+	req.Path = "attachments/media/videos/rec-1/poster.png"
+	if _, err := server.GenerateSignedURL(ctx, req); err != nil {
+		t.Errorf("expected attachment path to be signable, got %v", err)
+	}
+
+	for _, p := range []string{"media/other/secret.txt", "media/videos/../other/x", "/media/videos/x", ""} {
+		req.Path = p
+		if _, err := server.GenerateSignedURL(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for %q, got %v", p, err)
+		}
+	}
+
+	req.Path = "media/videos/intro.mp4"
+	req.ExpiresInSeconds = 7*24*3600 + 1
+	if _, err := server.GenerateSignedURL(ctx, req); status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "expires_in_seconds") {
+		t.Errorf("expected InvalidArgument for an expiry over 7 days, got %v", err)
+	}
+	req.ExpiresInSeconds = 7 * 24 * 3600
+	if _, err := server.GenerateSignedURL(ctx, req); err != nil {
+		t.Errorf("expected a 7 day expiry to be allowed, got %v", err)
+	}
+
+	req.Method = "DELETE"
+	if _, err := server.GenerateSignedURL(ctx, req); status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "GET or PUT") {
+		t.Errorf("expected InvalidArgument for DELETE, got %v", err)
+	}
+}
+
+func TestAttachmentsNamespaceReserved(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// A collection "attachments/media" would own media's attachment directory
+	_, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: collection.AttachmentsNamespace, Name: "media"})
+	if !errors.Is(err, collection.ErrReservedNamespace) {
+		t.Fatalf("expected ErrReservedNamespace, got %v", err)
+	}
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "media", Name: "videos"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	err = collection.RenameNamespace(ctx, nil, "media", collection.AttachmentsNamespace, false, repo.(*collection.DefaultCollectionRepo))
+	if !errors.Is(err, collection.ErrReservedNamespace) || !errors.Is(err, collection.ErrRenameConflict) {
+		t.Fatalf("expected renaming to the attachments namespace to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package collection
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"math/bits"
+	"sort"
+	"strings"
+	"unicode"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultSimilarityDistance is the largest SimHash distance, in differing
+	// bits out of 64, at which records count as near-duplicates.
+	DefaultSimilarityDistance = 3
+	// MaxSimilarityDistance is the largest distance FindSimilar accepts;
+	// beyond it unrelated records start to match.
+	MaxSimilarityDistance = 16
+	// DefaultSimilarLimit is how many similar records FindSimilar returns
+	// when no limit is given.
+	DefaultSimilarLimit = 10
+)
+
+// ErrSimilarityUnavailable is returned for similarity lookups against a store
+// without a similarity index (see Options.EnableSimilarity).
+var ErrSimilarityUnavailable = errors.New("similarity index is not enabled for this collection")
+
+// SimilarRecord is a near-duplicate found by FindSimilar.
+type SimilarRecord struct {
+	Record *pb.CollectionRecord
+	// Distance is the number of differing SimHash bits, 0 for records whose
+	// text is the same.
+	Distance int
+}
+
+// Similarity is 1 for identical fingerprints, falling linearly to 0 when
+// every bit differs.
+func (r SimilarRecord) Similarity() float64 {
+	return 1 - float64(r.Distance)/64
+}
+
+// SimilarityIndex is implemented by stores that index record fingerprints
+// for near-duplicate lookups.
+type SimilarityIndex interface {
+	// FindSimilar returns up to limit records, other than id, whose
+	// fingerprints are within maxDistance bits of id's, closest first. It
+	// returns sql.ErrNoRows if id does not exist.
+	FindSimilar(ctx context.Context, id string, maxDistance, limit int) ([]*SimilarRecord, error)
+}
+
+// FindSimilar returns near-duplicates of record id. maxDistance and limit
+// default to DefaultSimilarityDistance and DefaultSimilarLimit.
+func (c *Collection) FindSimilar(ctx context.Context, id string, maxDistance, limit int) ([]*SimilarRecord, error) {
+	index, ok := c.Store.(SimilarityIndex)
+	if !ok {
+		return nil, ErrSimilarityUnavailable
+	}
+	if maxDistance <= 0 {
+		maxDistance = DefaultSimilarityDistance
+	}
+	if limit <= 0 {
+		limit = DefaultSimilarLimit
+	}
+	return index.FindSimilar(ctx, id, min(maxDistance, MaxSimilarityDistance), limit)
+}
+
+// FindSimilar returns near-duplicates of a record.
+func (s *CollectionServer) FindSimilar(ctx context.Context, req *pb.FindSimilarRequest) (*pb.FindSimilarResponse, error) {
+	collection, err := s.repo.GetCollection(ctx, req.Namespace, req.CollectionName)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "collection not found: %v", err)
+	}
+	if req.MaxDistance < 0 || req.MaxDistance > MaxSimilarityDistance {
+		return nil, status.Errorf(codes.InvalidArgument, "max_distance must be between 0 and %d", MaxSimilarityDistance)
+	}
+
+	similar, err := collection.FindSimilar(ctx, req.Id, int(req.MaxDistance), int(req.Limit))
+	if errors.Is(err, ErrSimilarityUnavailable) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "record %s not found", req.Id)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "similarity lookup failed: %v", err)
+	}
+
+	md := s.messageType(ctx, collection)
+	resp := &pb.FindSimilarResponse{Status: &pb.Status{Code: pb.Status_OK}}
+	for _, r := range similar {
+		resp.Results = append(resp.Results, &pb.SimilarRecord{
+			Id:         r.Record.Id,
+			Item:       encodeItem(collection, md, r.Record.ProtoData),
+			Distance:   int32(r.Distance),
+			Similarity: r.Similarity(),
+		})
+	}
+	return resp, nil
+}
+
+// SimHash fingerprints the text of record data: the string values of JSON
+// data, or the data itself otherwise. Texts that differ in a few words get
+// fingerprints that differ in a few bits. Words and word pairs are the
+// features, so shared field names do not make records look alike.
+func SimHash(data []byte) uint64 {
+	var weights [64]int
+	var previous string
+	for _, word := range strings.FieldsFunc(strings.ToLower(recordText(data)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		addFeature(&weights, word)
+		if previous != "" {
+			addFeature(&weights, previous+" "+word)
+		}
+		previous = word
+	}
+
+	var hash uint64
+	for bit, w := range weights {
+		if w > 0 {
+			hash |= 1 << bit
+		}
+	}
+	return hash
+}
+
+// HammingDistance is the number of bits that differ between two fingerprints.
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func addFeature(weights *[64]int, feature string) {
+	h := fnv.New64a()
+	h.Write([]byte(feature))
+	sum := h.Sum64()
+	for bit := range weights {
+		if sum&(1<<bit) != 0 {
+			weights[bit]++
+		} else {
+			weights[bit]--
+		}
+	}
+}
+
+// recordText returns the string values of JSON data joined by spaces, or the
+// data as text if it is not JSON.
+func recordText(data []byte) string {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return string(data)
+	}
+	var text strings.Builder
+	var walk func(any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case string:
+			text.WriteString(v)
+			text.WriteByte(' ')
+		case []any:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[string]any:
+			// Sorted, so word pairs spanning two values are stable
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				walk(v[k])
+			}
+		}
+	}
+	walk(value)
+	return text.String()
+}
@@ -0,0 +1,119 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const article = `Severe storms swept across the northern plains on Tuesday, knocking out power to
+thousands of homes and closing several highways. Officials said crews were working through the night
+to restore electricity, and schools in three counties announced they would remain closed on Wednesday
+while roads are cleared of fallen trees and debris.`
+
+func TestSimHash(t *testing.T) {
+	original := collection.SimHash([]byte(fmt.Sprintf(`{"title": "Storms", "body": %q}`, article)))
+
+	// Field order and unrelated fields do not matter; the same text does
+	reordered := collection.SimHash([]byte(fmt.Sprintf(`{"body": %q, "title": "Storms", "views": 12}`, article)))
+	if original != reordered {
+		t.Errorf("expected the same fingerprint for the same text, got distance %d", collection.HammingDistance(original, reordered))
+	}
+
+	edited := collection.SimHash([]byte(fmt.Sprintf(`{"title": "Storms", "body": %q}`, article+" Updated at noon.")))
+	if d := collection.HammingDistance(original, edited); d > collection.DefaultSimilarityDistance {
+		t.Errorf("expected a lightly edited article to be a near-duplicate, got distance %d", d)
+	}
+
+	unrelated := collection.SimHash([]byte(`{"title": "Recipe", "body": "Whisk the eggs with sugar until pale, fold in flour and bake for twenty minutes."}`))
+	if d := collection.HammingDistance(original, unrelated); d <= collection.MaxSimilarityDistance {
+		t.Errorf("expected an unrelated text to be far away, got distance %d", d)
+	}
+}
+
+func TestCollectionServer_FindSimilar(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), "news.db"), collection.Options{EnableJSON: true, EnableSimilarity: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	repo := collection.NewCollectionRepo(store)
+	server := collection.NewCollectionServer(repo)
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "news"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	for id, body := range map[string]string{
+		"wire":    article,
+		"mirror":  article,
+		"edited":  article + " Updated at noon.",
+		"recipe":  "Whisk the eggs with sugar until pale, fold in flour and bake for twenty minutes.",
+		"weather": "Sunny skies are expected across the region through the weekend with light winds.",
+	} {
+		if _, err := server.Create(ctx, &pb.CreateRequest{
+			Namespace: "test", CollectionName: "news", Id: id,
+			Item: &anypb.Any{Value: []byte(fmt.Sprintf(`{"body": %q}`, body))},
+		}); err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+	}
+
+	// Wider than the default, so the lookup scans every fingerprint
+	resp, err := server.FindSimilar(ctx, &pb.FindSimilarRequest{Namespace: "test", CollectionName: "news", Id: "wire", MaxDistance: 8})
+	if err != nil {
+		t.Fatalf("FindSimilar failed: %v", err)
+	}
+	if len(resp.Results) != 2 || resp.Results[0].Id != "mirror" || resp.Results[0].Similarity != 1 || resp.Results[1].Id != "edited" {
+		t.Fatalf("expected the mirror then the edited copy, got %v", resp.Results)
+	}
+	if string(resp.Results[0].Item.Value) != fmt.Sprintf(`{"body": %q}`, article) {
+		t.Errorf("expected the mirror's data, got %s", resp.Results[0].Item.Value)
+	}
+
+	// Updates re-fingerprint the record and deletes drop it
+	if _, err := server.Update(ctx, &pb.UpdateRequest{
+		Namespace: "test", CollectionName: "news", Id: "edited",
+		Item: &anypb.Any{Value: []byte(`{"body": "Retracted."}`)},
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, err := server.Delete(ctx, &pb.DeleteRequest{Namespace: "test", CollectionName: "news", Id: "mirror"}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	resp, err = server.FindSimilar(ctx, &pb.FindSimilarRequest{Namespace: "test", CollectionName: "news", Id: "wire", MaxDistance: 8})
+	if err != nil || len(resp.Results) != 0 {
+		t.Errorf("expected no near-duplicates left, got %v (%v)", resp.GetResults(), err)
+	}
+
+	_, err = server.FindSimilar(ctx, &pb.FindSimilarRequest{Namespace: "test", CollectionName: "news", Id: "missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for a missing record, got %v", err)
+	}
+	_, err = server.FindSimilar(ctx, &pb.FindSimilarRequest{Namespace: "test", CollectionName: "news", Id: "wire", MaxDistance: 40})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a large distance, got %v", err)
+	}
+}
+
+func TestFindSimilar_Unavailable(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	ctx := context.Background()
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "plain"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	server := collection.NewCollectionServer(repo)
+	_, err := server.FindSimilar(ctx, &pb.FindSimilarRequest{Namespace: "test", CollectionName: "plain", Id: "x"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition without a similarity index, got %v", err)
+	}
+}
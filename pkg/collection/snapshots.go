@@ -0,0 +1,508 @@
+package collection
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/proto"
+)
+
+// How a snapshot's database was copied.
+const (
+	// SnapshotReflink snapshots share the collection's data blocks until
+	// either side changes them.
+	SnapshotReflink = "reflink"
+	// SnapshotCopy snapshots are full copies made with Store.Backup.
+	SnapshotCopy = "copy"
+)
+
+var (
+	// ErrInvalidSnapshotName is returned for snapshot names that are empty or
+	// contain path separators.
+	ErrInvalidSnapshotName = errors.New("invalid snapshot name")
+	// ErrSnapshotExists is returned when creating a snapshot under a name the
+	// collection already has one under.
+	ErrSnapshotExists = errors.New("snapshot already exists")
+	// ErrSnapshotNotFound is returned for snapshots that do not exist.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	// ErrSnapshotCollectionNotFound is returned when snapshotting a
+	// collection that does not exist.
+	ErrSnapshotCollectionNotFound = errors.New("collection to snapshot not found")
+	// ErrSnapshotReadOnly is returned by writes to an opened snapshot.
+	ErrSnapshotReadOnly = errors.New("snapshots are read-only")
+	// ErrSnapshotsUnreadable is returned by SnapshotManager.Open in a repository
+	// without a StoreOpener.
+	ErrSnapshotsUnreadable = errors.New("reading snapshots needs a store opener")
+)
+
+// WriteBarrier is implemented by stores that can briefly hold their writes
+// with the database file fully up to date, so it can be copied as is.
+type WriteBarrier interface {
+	// WithWriteBarrier runs fn with writes waiting and any write-ahead log
+	// checkpointed, passing the path of the database file.
+	WithWriteBarrier(ctx context.Context, fn func(path string) error) error
+}
+
+// SnapshotManager takes named, read-only point-in-time views of collections.
+// Snapshots are kept under one directory, as
+// <namespace>/<collection>/<name>.db with the collection's local files in
+// <name>.files, and are listed and deleted independently of backups.
+//
+// Where the filesystem supports it the database is reflinked while the store
+// holds a write barrier, so a snapshot costs no more than its metadata until
+// the collection changes; otherwise it is copied with VACUUM INTO. Local
+// files are hard linked: the filesystem replaces files rather than rewriting
+// them, so the links keep their content. Record and file writes to the
+// collection pause while the snapshot is taken.
+type SnapshotManager struct {
+	repo CollectionRepo
+	dir  string
+	db   *sql.DB
+	mu   sync.Mutex // Serializes creates and deletes
+}
+
+// NewSnapshotManager keeps snapshots of repo's collections in dir.
+func NewSnapshotManager(repo CollectionRepo, dir string) (*SnapshotManager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=10000", filepath.Join(dir, "metadata.db"))
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot metadata db: %w", err)
+	}
+	schema := `
+	CREATE TABLE IF NOT EXISTS snapshots (
+		namespace TEXT NOT NULL,
+		collection TEXT NOT NULL,
+		name TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		record_count INTEGER NOT NULL,
+		file_count INTEGER NOT NULL,
+		method TEXT NOT NULL,
+		db_path TEXT NOT NULL,
+		files_path TEXT NOT NULL,
+		collection_meta BLOB,
+		PRIMARY KEY (namespace, collection, name)
+	);
+	`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create snapshot schema: %w", err)
+	}
+	return &SnapshotManager{repo: repo, dir: dir, db: db}, nil
+}
+
+// Close closes the snapshot metadata store.
+func (m *SnapshotManager) Close() error {
+	return m.db.Close()
+}
+
+// Path returns the snapshot metadata store's path.
+func (m *SnapshotManager) Path() string {
+	return filepath.Join(m.dir, "metadata.db")
+}
+
+// resolve returns the namespace an alias stands for.
+func (m *SnapshotManager) resolve(namespace string) string {
+	if r, ok := m.repo.(*DefaultCollectionRepo); ok {
+		return r.aliases.Resolve(namespace)
+	}
+	return namespace
+}
+
+// Create snapshots a collection under name.
+func (m *SnapshotManager) Create(ctx context.Context, namespace, collection, name string) (*pb.CollectionSnapshot, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidSnapshotName, name)
+	}
+	coll, err := m.repo.GetCollection(ctx, namespace, collection)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotCollectionNotFound, err)
+	}
+	namespace = coll.Meta.Namespace
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, _, err := m.get(ctx, namespace, collection, name); err == nil {
+		return nil, fmt.Errorf("%w: %s/%s@%s", ErrSnapshotExists, namespace, collection, name)
+	} else if !errors.Is(err, ErrSnapshotNotFound) {
+		return nil, err
+	}
+
+	dir := filepath.Join(m.dir, namespace, collection)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	snap := &pb.CollectionSnapshot{
+		Collection: &pb.NamespacedName{Namespace: namespace, Name: collection},
+		Name:       name,
+		DbPath:     filepath.Join(dir, name+".db"),
+	}
+	cleanup := func() {
+		removeStoreFiles(snap.DbPath)
+		if snap.FilesPath != "" {
+			os.RemoveAll(snap.FilesPath)
+		}
+	}
+
+	// Pause the collection's writes so its records and files are taken at
+	// the same point
+	if r, ok := m.repo.(*DefaultCollectionRepo); ok {
+		_, gate, _ := r.storageFor(namespace + "/" + collection)
+		gate.mu.Lock()
+		defer gate.mu.Unlock()
+	}
+	store := coll.Store
+	if buffer, ok := store.(*BufferedStore); ok {
+		if _, err := buffer.Flush(ctx); err != nil {
+			return nil, fmt.Errorf("failed to flush write buffer: %w", err)
+		}
+		store = buffer.Unwrap()
+	}
+	snap.CreatedAt = time.Now().Unix()
+	if snap.Method, err = cloneStore(ctx, store, snap.DbPath); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to copy store: %w", err)
+	}
+	if snap.RecordCount, err = store.CountRecords(ctx); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to count records: %w", err)
+	}
+	if info, err := os.Stat(snap.DbPath); err == nil {
+		snap.SizeBytes = info.Size()
+	}
+
+	if coll.FS != nil {
+		snap.FilesPath = filepath.Join(dir, name+".files")
+		files, size, err := snapshotFiles(ctx, coll.FS, snap.FilesPath)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to snapshot files: %w", err)
+		}
+		if files == 0 {
+			os.RemoveAll(snap.FilesPath)
+			snap.FilesPath = ""
+		}
+		snap.FileCount, snap.SizeBytes = files, snap.SizeBytes+size
+	}
+
+	meta, err := proto.Marshal(coll.Meta)
+	if err == nil {
+		_, err = m.db.ExecContext(ctx, `INSERT INTO snapshots
+			(namespace, collection, name, created_at, size_bytes, record_count, file_count, method, db_path, files_path, collection_meta)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			namespace, collection, name, snap.CreatedAt, snap.SizeBytes, snap.RecordCount, snap.FileCount,
+			snap.Method, snap.DbPath, snap.FilesPath, meta)
+	}
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to save snapshot metadata: %w", err)
+	}
+	return snap, nil
+}
+
+// cloneStore copies store's database to dest, by reflink under a write
+// barrier where the store and filesystem allow it and with Backup otherwise.
+func cloneStore(ctx context.Context, store Store, dest string) (string, error) {
+	if barrier, ok := store.(WriteBarrier); ok {
+		err := barrier.WithWriteBarrier(ctx, func(path string) error {
+			return reflink(path, dest)
+		})
+		if err == nil {
+			return SnapshotReflink, nil
+		}
+		os.Remove(dest)
+	}
+	if err := store.Backup(ctx, dest); err != nil {
+		return "", err
+	}
+	return SnapshotCopy, nil
+}
+
+// snapshotFiles links every file of fs into dir, copying files it cannot
+// link, and returns how many files and bytes it took.
+func snapshotFiles(ctx context.Context, fs FileSystem, dir string) (int64, int64, error) {
+	dest, err := NewLocalFileSystem(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	local, ok := fs.(*LocalFileSystem)
+	if !ok {
+		size, err := CloneCollectionFiles(ctx, fs, dest, "")
+		if err != nil {
+			return 0, 0, err
+		}
+		files, err := dest.List(ctx, "")
+		return int64(len(files)), size, err
+	}
+
+	var files, size int64
+	root := local.fs.Root
+	err = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip directories and saves that are still being written
+		if d.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Link(path, target); err != nil {
+			if err := copyFile(path, target); err != nil {
+				return err
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files, size = files+1, size+info.Size()
+		return nil
+	})
+	return files, size, err
+}
+
+// copyFile copies the file at src to a new file at dest.
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// get returns a snapshot and the collection metadata saved with it.
+func (m *SnapshotManager) get(ctx context.Context, namespace, collection, name string) (*pb.CollectionSnapshot, *pb.Collection, error) {
+	row := m.db.QueryRowContext(ctx, `SELECT created_at, size_bytes, record_count, file_count, method, db_path, files_path, collection_meta
+		FROM snapshots WHERE namespace = ? AND collection = ? AND name = ?`, namespace, collection, name)
+	snap := &pb.CollectionSnapshot{
+		Collection: &pb.NamespacedName{Namespace: namespace, Name: collection},
+		Name:       name,
+	}
+	var metaBytes []byte
+	err := row.Scan(&snap.CreatedAt, &snap.SizeBytes, &snap.RecordCount, &snap.FileCount, &snap.Method, &snap.DbPath, &snap.FilesPath, &metaBytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, fmt.Errorf("%w: %s/%s@%s", ErrSnapshotNotFound, namespace, collection, name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &pb.Collection{}
+	if err := proto.Unmarshal(metaBytes, meta); err != nil {
+		return nil, nil, fmt.Errorf("invalid snapshot metadata: %w", err)
+	}
+	return snap, meta, nil
+}
+
+// Get returns one snapshot of a collection.
+func (m *SnapshotManager) Get(ctx context.Context, namespace, collection, name string) (*pb.CollectionSnapshot, error) {
+	snap, _, err := m.get(ctx, m.resolve(namespace), collection, name)
+	return snap, err
+}
+
+// List returns snapshots newest first: those of one collection when
+// collection is set, of one namespace when only namespace is, or all.
+func (m *SnapshotManager) List(ctx context.Context, namespace, collection string) ([]*pb.CollectionSnapshot, error) {
+	query := `SELECT namespace, collection, name, created_at, size_bytes, record_count, file_count, method, db_path, files_path FROM snapshots`
+	var args []interface{}
+	if namespace != "" {
+		query += " WHERE namespace = ?"
+		args = append(args, m.resolve(namespace))
+		if collection != "" {
+			query += " AND collection = ?"
+			args = append(args, collection)
+		}
+	}
+	query += " ORDER BY created_at DESC, namespace, collection, name"
+
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	defer rows.Close()
+	var snaps []*pb.CollectionSnapshot
+	for rows.Next() {
+		snap := &pb.CollectionSnapshot{Collection: &pb.NamespacedName{}}
+		if err := rows.Scan(&snap.Collection.Namespace, &snap.Collection.Name, &snap.Name, &snap.CreatedAt, &snap.SizeBytes,
+			&snap.RecordCount, &snap.FileCount, &snap.Method, &snap.DbPath, &snap.FilesPath); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, rows.Err()
+}
+
+// Delete removes a snapshot and returns the bytes it held. Blocks a reflinked
+// or hard linked snapshot shares with its collection are not freed until the
+// collection lets go of them too.
+func (m *SnapshotManager) Delete(ctx context.Context, namespace, collection, name string) (int64, error) {
+	namespace = m.resolve(namespace)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap, _, err := m.get(ctx, namespace, collection, name)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := m.db.ExecContext(ctx, "DELETE FROM snapshots WHERE namespace = ? AND collection = ? AND name = ?", namespace, collection, name); err != nil {
+		return 0, fmt.Errorf("failed to delete snapshot metadata: %w", err)
+	}
+	removeStoreFiles(snap.DbPath)
+	if snap.FilesPath != "" {
+		os.RemoveAll(snap.FilesPath)
+	}
+	return snap.SizeBytes, nil
+}
+
+// Open returns a snapshot as a read-only collection, with the collection
+// metadata it had when the snapshot was taken. Its record and file writes
+// fail with ErrSnapshotReadOnly. Close it when done.
+func (m *SnapshotManager) Open(ctx context.Context, namespace, collection, name string) (*Collection, error) {
+	snap, meta, err := m.get(ctx, m.resolve(namespace), collection, name)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := m.repo.(*DefaultCollectionRepo)
+	if !ok || r.opener == nil {
+		return nil, ErrSnapshotsUnreadable
+	}
+	store, err := r.opener(snap.DbPath, meta.GetStoreOptions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	var fs FileSystem
+	if snap.FilesPath != "" {
+		local, err := NewLocalFileSystem(snap.FilesPath)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("failed to open snapshot files: %w", err)
+		}
+		fs = readOnlyFS{local}
+	}
+	return NewCollection(meta, readOnlyStore{store}, fs)
+}
+
+// readOnlyStore serves the Store methods of an opened snapshot and refuses
+// its writes.
+type readOnlyStore struct {
+	Store
+}
+
+func (readOnlyStore) CreateRecord(context.Context, *pb.CollectionRecord) error {
+	return ErrSnapshotReadOnly
+}
+
+func (readOnlyStore) UpdateRecord(context.Context, *pb.CollectionRecord) error {
+	return ErrSnapshotReadOnly
+}
+
+func (readOnlyStore) DeleteRecord(context.Context, string) error { return ErrSnapshotReadOnly }
+
+func (readOnlyStore) ReIndex(context.Context) error { return ErrSnapshotReadOnly }
+
+func (readOnlyStore) ExecuteRaw(string, ...interface{}) error { return ErrSnapshotReadOnly }
+
+// readOnlyFS serves the files of an opened snapshot and refuses changes.
+type readOnlyFS struct {
+	FileSystem
+}
+
+func (readOnlyFS) Save(context.Context, string, []byte) error { return ErrSnapshotReadOnly }
+
+func (readOnlyFS) Delete(context.Context, string) error { return ErrSnapshotReadOnly }
+
+// CreateSnapshot takes a named, read-only point-in-time view of a collection.
+func (s *GrpcServer) CreateSnapshot(ctx context.Context, req *pb.CreateSnapshotRequest) (*pb.CreateSnapshotResponse, error) {
+	if s.snapshots == nil {
+		return &pb.CreateSnapshotResponse{Status: snapshotsDisabled()}, nil
+	}
+	if req.Collection == nil || req.Collection.Namespace == "" || req.Collection.Name == "" {
+		return &pb.CreateSnapshotResponse{Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection namespace and name are required"}}, nil
+	}
+	snap, err := s.snapshots.Create(ctx, req.Collection.Namespace, req.Collection.Name, req.Name)
+	if err != nil {
+		return &pb.CreateSnapshotResponse{Status: snapshotStatus(err)}, nil
+	}
+	return &pb.CreateSnapshotResponse{Status: &pb.Status{Code: pb.Status_OK}, Snapshot: snap}, nil
+}
+
+// ListSnapshots lists snapshots, newest first.
+func (s *GrpcServer) ListSnapshots(ctx context.Context, req *pb.ListSnapshotsRequest) (*pb.ListSnapshotsResponse, error) {
+	if s.snapshots == nil {
+		return &pb.ListSnapshotsResponse{Status: snapshotsDisabled()}, nil
+	}
+	namespace, collection := req.Namespace, ""
+	if req.Collection != nil {
+		namespace, collection = req.Collection.Namespace, req.Collection.Name
+	}
+	snaps, err := s.snapshots.List(ctx, namespace, collection)
+	if err != nil {
+		return &pb.ListSnapshotsResponse{Status: snapshotStatus(err)}, nil
+	}
+	return &pb.ListSnapshotsResponse{Status: &pb.Status{Code: pb.Status_OK}, Snapshots: snaps}, nil
+}
+
+// DeleteSnapshot deletes a snapshot.
+func (s *GrpcServer) DeleteSnapshot(ctx context.Context, req *pb.DeleteSnapshotRequest) (*pb.DeleteSnapshotResponse, error) {
+	if s.snapshots == nil {
+		return &pb.DeleteSnapshotResponse{Status: snapshotsDisabled()}, nil
+	}
+	if req.Collection == nil || req.Collection.Namespace == "" || req.Collection.Name == "" || req.Name == "" {
+		return &pb.DeleteSnapshotResponse{Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection and name are required"}}, nil
+	}
+	freed, err := s.snapshots.Delete(ctx, req.Collection.Namespace, req.Collection.Name, req.Name)
+	if err != nil {
+		return &pb.DeleteSnapshotResponse{Status: snapshotStatus(err)}, nil
+	}
+	return &pb.DeleteSnapshotResponse{Status: &pb.Status{Code: pb.Status_OK}, BytesFreed: freed}, nil
+}
+
+// Snapshots returns the server's snapshot manager, or nil if it failed to
+// start.
+func (s *GrpcServer) Snapshots() *SnapshotManager {
+	return s.snapshots
+}
+
+func snapshotsDisabled() *pb.Status {
+	return &pb.Status{Code: pb.Status_INTERNAL, Message: "snapshot manager not initialized"}
+}
+
+// snapshotStatus maps a SnapshotManager error to a status.
+func snapshotStatus(err error) *pb.Status {
+	code := pb.Status_INTERNAL
+	switch {
+	case errors.Is(err, ErrInvalidSnapshotName):
+		code = pb.Status_INVALID_ARGUMENT
+	case errors.Is(err, ErrSnapshotExists):
+		code = pb.Status_ALREADY_EXISTS
+	case errors.Is(err, ErrSnapshotNotFound), errors.Is(err, ErrSnapshotCollectionNotFound):
+		code = pb.Status_NOT_FOUND
+	}
+	return &pb.Status{Code: code, Message: err.Error()}
+}
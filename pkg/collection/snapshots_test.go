@@ -0,0 +1,160 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+)
+
+func TestSnapshotIsPointInTime(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	files, err := collection.NewLocalFileSystem(filepath.Join(t.TempDir(), "files"))
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+	repo.SetFileSystem(files)
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "docs")
+	for _, id := range []string{"a", "b"} {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: []byte(`{"v": 1}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	if err := coll.SaveFile(ctx, "readme.txt", &pb.CollectionData{Content: &pb.CollectionData_Data{Data: []byte("v1")}}); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+
+	snapshots, err := collection.NewSnapshotManager(repo, filepath.Join(t.TempDir(), "snapshots"))
+	if err != nil {
+		t.Fatalf("NewSnapshotManager failed: %v", err)
+	}
+	defer snapshots.Close()
+	snap, err := snapshots.Create(ctx, "test", "docs", "before")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if snap.RecordCount != 2 || snap.FileCount != 1 {
+		t.Errorf("expected 2 records and 1 file, got %d and %d", snap.RecordCount, snap.FileCount)
+	}
+	if snap.Method != collection.SnapshotReflink && snap.Method != collection.SnapshotCopy {
+		t.Errorf("unexpected method %q", snap.Method)
+	}
+	if _, err := snapshots.Create(ctx, "test", "docs", "before"); !errors.Is(err, collection.ErrSnapshotExists) {
+		t.Errorf("expected ErrSnapshotExists, got %v", err)
+	}
+
+	// Change everything the snapshot captured
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "c", ProtoData: []byte(`{"v": 1}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := coll.DeleteRecord(ctx, "a"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if err := coll.SaveFile(ctx, "readme.txt", &pb.CollectionData{Content: &pb.CollectionData_Data{Data: []byte("v2")}}); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+
+	view, err := snapshots.Open(ctx, "test", "docs", "before")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer view.Close()
+	if _, err := view.GetRecord(ctx, "a"); err != nil {
+		t.Errorf("expected the deleted record in the snapshot: %v", err)
+	}
+	if _, err := view.GetRecord(ctx, "c"); err == nil {
+		t.Error("expected the later record to be missing from the snapshot")
+	}
+	data, err := view.GetFile(ctx, "readme.txt")
+	if err != nil {
+		t.Fatalf("GetFile failed: %v", err)
+	}
+	if got := string(data.GetData()); got != "v1" {
+		t.Errorf("expected the snapshot's file to read v1, got %q", got)
+	}
+	if err := view.CreateRecord(ctx, &pb.CollectionRecord{Id: "d", ProtoData: []byte(`{}`)}); !errors.Is(err, collection.ErrSnapshotReadOnly) {
+		t.Errorf("expected ErrSnapshotReadOnly, got %v", err)
+	}
+	if err := view.SaveFile(ctx, "x.txt", &pb.CollectionData{Content: &pb.CollectionData_Data{Data: []byte("x")}}); !errors.Is(err, collection.ErrSnapshotReadOnly) {
+		t.Errorf("expected ErrSnapshotReadOnly from SaveFile, got %v", err)
+	}
+}
+
+func TestSnapshotListAndDelete(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	for _, name := range []string{"docs", "users"} {
+		if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: name}); err != nil {
+			t.Fatalf("failed to create collection: %v", err)
+		}
+	}
+
+	server := collection.NewGrpcServerWithDataDir(repo, t.TempDir())
+	for _, req := range []*pb.CreateSnapshotRequest{
+		{Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"}, Name: "one"},
+		{Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"}, Name: "two"},
+		{Collection: &pb.NamespacedName{Namespace: "test", Name: "users"}, Name: "one"},
+	} {
+		resp, err := server.CreateSnapshot(ctx, req)
+		if err != nil || resp.Status.Code != pb.Status_OK {
+			t.Fatalf("CreateSnapshot failed: %v %v", err, resp.GetStatus())
+		}
+	}
+
+	for _, tc := range []struct {
+		req  *pb.CreateSnapshotRequest
+		code pb.Status_Code
+	}{
+		{&pb.CreateSnapshotRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"}, Name: "../x"}, pb.Status_INVALID_ARGUMENT},
+		{&pb.CreateSnapshotRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"}, Name: "one"}, pb.Status_ALREADY_EXISTS},
+		{&pb.CreateSnapshotRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "missing"}, Name: "one"}, pb.Status_NOT_FOUND},
+	} {
+		resp, _ := server.CreateSnapshot(ctx, tc.req)
+		if resp.Status.Code != tc.code {
+			t.Errorf("CreateSnapshot(%s@%s): expected %v, got %v", tc.req.Collection.Name, tc.req.Name, tc.code, resp.Status)
+		}
+	}
+
+	list, _ := server.ListSnapshots(ctx, &pb.ListSnapshotsRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"}})
+	if len(list.Snapshots) != 2 {
+		t.Fatalf("expected 2 snapshots of docs, got %v", list.Snapshots)
+	}
+	list, _ = server.ListSnapshots(ctx, &pb.ListSnapshotsRequest{Namespace: "test"})
+	if len(list.Snapshots) != 3 {
+		t.Fatalf("expected 3 snapshots in the namespace, got %v", list.Snapshots)
+	}
+
+	del, _ := server.DeleteSnapshot(ctx, &pb.DeleteSnapshotRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"}, Name: "one"})
+	if del.Status.Code != pb.Status_OK || del.BytesFreed == 0 {
+		t.Fatalf("DeleteSnapshot failed: %v", del)
+	}
+	for _, snap := range list.Snapshots {
+		if snap.Collection.Name == "docs" && snap.Name == "one" {
+			if _, err := os.Stat(snap.DbPath); !os.IsNotExist(err) {
+				t.Errorf("expected %s to be removed, got %v", snap.DbPath, err)
+			}
+		}
+	}
+	del, _ = server.DeleteSnapshot(ctx, &pb.DeleteSnapshotRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"}, Name: "one"})
+	if del.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND deleting twice, got %v", del.Status)
+	}
+	list, _ = server.ListSnapshots(ctx, &pb.ListSnapshotsRequest{})
+	if len(list.Snapshots) != 2 {
+		t.Errorf("expected 2 snapshots left, got %v", list.Snapshots)
+	}
+}
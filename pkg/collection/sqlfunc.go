@@ -0,0 +1,234 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidFunctionCall is returned for filters calling a SQL function the
+// store does not have, or with the wrong number of arguments.
+var ErrInvalidFunctionCall = errors.New("invalid SQL function call")
+
+// SQLFunction is a custom SQL function written in Go. A store given it in
+// Options.Functions makes it usable in Search filters, keyed by a call such
+// as title_score(title, "go") whose result the filter compares with its
+// value.
+type SQLFunction struct {
+	// NArgs is how many arguments the function takes; -1 takes any number.
+	NArgs int
+	// Func computes the result. Arguments are nil, int64, float64, string
+	// or []byte, and so should the result be, though ints, floats and bools
+	// of other sizes are converted.
+	Func func(args []any) (any, error)
+}
+
+// SQLExtension is a vetted bundle of SQL functions, such as domain-specific
+// scoring or matching, that stores load by name through Options.Extensions.
+// Extensions are Go packages that call RegisterSQLExtension from init: the
+// SQLite driver is cgo-free, so shared-library extensions cannot be loaded.
+type SQLExtension struct {
+	Name      string
+	Functions map[string]SQLFunction
+}
+
+var sqlExtensions = struct {
+	mu     sync.RWMutex
+	byName map[string]SQLExtension
+}{byName: make(map[string]SQLExtension)}
+
+// RegisterSQLExtension makes ext loadable by stores. Names must be unique.
+func RegisterSQLExtension(ext SQLExtension) error {
+	if ext.Name == "" {
+		return fmt.Errorf("SQL extension name required")
+	}
+	for name, fn := range ext.Functions {
+		if err := validateSQLFunction(name, fn); err != nil {
+			return fmt.Errorf("SQL extension %s: %w", ext.Name, err)
+		}
+	}
+	sqlExtensions.mu.Lock()
+	defer sqlExtensions.mu.Unlock()
+	if _, ok := sqlExtensions.byName[ext.Name]; ok {
+		return fmt.Errorf("SQL extension %s already registered", ext.Name)
+	}
+	sqlExtensions.byName[ext.Name] = ext
+	return nil
+}
+
+// SQLExtensions returns the names of the registered extensions, sorted.
+func SQLExtensions() []string {
+	sqlExtensions.mu.RLock()
+	defer sqlExtensions.mu.RUnlock()
+	names := make([]string, 0, len(sqlExtensions.byName))
+	for name := range sqlExtensions.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SQLFunctions returns the functions a store opened with o makes available:
+// Functions and those of each of Extensions. A name given twice is an
+// error, as is an extension that is not registered.
+func (o Options) SQLFunctions() (map[string]SQLFunction, error) {
+	fns := make(map[string]SQLFunction, len(o.Functions))
+	for name, fn := range o.Functions {
+		if err := validateSQLFunction(name, fn); err != nil {
+			return nil, err
+		}
+		fns[name] = fn
+	}
+	sqlExtensions.mu.RLock()
+	defer sqlExtensions.mu.RUnlock()
+	for _, extName := range o.Extensions {
+		ext, ok := sqlExtensions.byName[extName]
+		if !ok {
+			return nil, fmt.Errorf("unknown SQL extension %q", extName)
+		}
+		for name, fn := range ext.Functions {
+			if _, dup := fns[name]; dup {
+				return nil, fmt.Errorf("SQL function %s of extension %s is already defined", name, extName)
+			}
+			fns[name] = fn
+		}
+	}
+	return fns, nil
+}
+
+func validateSQLFunction(name string, fn SQLFunction) error {
+	if !isFunctionName(name) {
+		return fmt.Errorf("invalid SQL function name %q", name)
+	}
+	if fn.Func == nil || fn.NArgs < -1 {
+		return fmt.Errorf("SQL function %s needs a Func and NArgs of -1 or more", name)
+	}
+	return nil
+}
+
+func isFunctionName(name string) bool {
+	if name == "" || ('0' <= name[0] && name[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// FunctionCall is a filter key calling a SQLFunction.
+type FunctionCall struct {
+	Name string
+	Args []FunctionArg
+}
+
+// FunctionArg is an argument of a FunctionCall: the record's value at Field,
+// or the literal Value when Field is nil.
+type FunctionArg struct {
+	Field FieldPath
+	Value any // nil, int64, float64 or string
+}
+
+// ParseFunctionCall parses a filter key of the form name(arg, ...), whose
+// arguments are field paths without [*], quoted strings, numbers, true,
+// false or null:
+//
+//	title_score(title, "go")
+//	distance_km(location.lat, location.lon, 37.77, -122.42)
+//
+// ok is false for keys that are not calls, such as field paths; a field
+// named like a call is still addressed as ["name(arg)"].
+func ParseFunctionCall(expr string) (call *FunctionCall, ok bool, err error) {
+	s := strings.TrimSpace(expr)
+	open := strings.IndexByte(s, '(')
+	if open <= 0 || !isFunctionName(s[:open]) {
+		return nil, false, nil
+	}
+	if !strings.HasSuffix(s, ")") {
+		return nil, true, fmt.Errorf("invalid function call %q: unclosed (", expr)
+	}
+	call = &FunctionCall{Name: s[:open]}
+	inner := strings.TrimSpace(s[open+1 : len(s)-1])
+	if inner == "" {
+		return call, true, nil
+	}
+	for _, raw := range splitCallArgs(inner) {
+		arg, err := parseCallArg(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid function call %q: %w", expr, err)
+		}
+		call.Args = append(call.Args, arg)
+	}
+	return call, true, nil
+}
+
+// splitCallArgs splits arguments at the commas outside quotes and brackets.
+func splitCallArgs(s string) []string {
+	var args []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(args, s[start:])
+}
+
+func parseCallArg(s string) (FunctionArg, error) {
+	switch {
+	case s == "":
+		return FunctionArg{}, fmt.Errorf("empty argument")
+	case s[0] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return FunctionArg{}, fmt.Errorf("bad string %s", s)
+		}
+		return FunctionArg{Value: v}, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return FunctionArg{}, fmt.Errorf("bad string %s", s)
+		}
+		return FunctionArg{Value: strings.ReplaceAll(s[1:len(s)-1], "''", "'")}, nil
+	case s == "true":
+		return FunctionArg{Value: int64(1)}, nil
+	case s == "false":
+		return FunctionArg{Value: int64(0)}, nil
+	case s == "null":
+		return FunctionArg{}, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return FunctionArg{Value: n}, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return FunctionArg{Value: f}, nil
+	}
+	path, err := ParseFieldPath(s)
+	if err != nil {
+		return FunctionArg{}, err
+	}
+	if _, _, wildcard := path.SplitWildcard(); wildcard {
+		return FunctionArg{}, fmt.Errorf("[*] cannot be passed to a function in %s", s)
+	}
+	return FunctionArg{Field: path}, nil
+}
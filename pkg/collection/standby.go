@@ -0,0 +1,562 @@
+package collection
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultStandbyInterval is how often a Standby pulls from its primary.
+const DefaultStandbyInterval = 5 * time.Second
+
+// standbyPageSize is how many collections and records a Standby asks its
+// primary for at a time.
+const standbyPageSize = 500
+
+// ErrStandbyPromoted is returned by syncs and promotions of a Standby that
+// has already been promoted.
+var ErrStandbyPromoted = errors.New("standby has been promoted")
+
+// StandbyWriteMethods are the calls a Standby refuses until it is promoted:
+// everything that changes records, collections, backups or other state a
+// sync would not bring over from the primary.
+var StandbyWriteMethods = map[string]bool{
+	"/collector.CollectionService/Create":             true,
+	"/collector.CollectionService/Update":             true,
+	"/collector.CollectionService/Delete":             true,
+	"/collector.CollectionService/UploadRecord":       true,
+	"/collector.CollectionService/SaveSearch":         true,
+	"/collector.CollectionService/DeleteSavedSearch":  true,
+	"/collector.CollectionService/ConfirmAnomaly":     true,
+	"/collector.CollectionService/DeleteByFilter":     true,
+	"/collector.CollectionService/DropPartitions":     true,
+	"/collector.CollectionService/AcquireLease":       true,
+	"/collector.CollectionService/ReleaseLease":       true,
+	"/collector.CollectionService/Increment":          true,
+	"/collector.CollectionService/Enqueue":            true,
+	"/collector.CollectionService/Dequeue":            true,
+	"/collector.CollectionService/Ack":                true,
+	"/collector.CollectionService/Nack":               true,
+	"/collector.CollectionService/RedriveDeadLetters": true,
+	"/collector.CollectionService/WriteWithOutbox":    true,
+	"/collector.CollectionService/PushChanges":        true,
+	"/collector.CollectionService/AddAttachment":      true,
+	"/collector.CollectionService/RemoveAttachment":   true,
+	"/collector.CollectionService/Batch":              true,
+	"/collector.CollectionService/Modify":             true,
+	"/collector.CollectionService/Invoke":             true,
+	"/collector.CollectionRepo/CreateCollection":      true,
+	"/collector.CollectionRepo/Clone":                 true,
+	"/collector.CollectionRepo/CloneCollection":       true,
+	"/collector.CollectionRepo/Fetch":                 true,
+	"/collector.CollectionRepo/RegisterReplica":       true,
+	"/collector.CollectionRepo/PushCollection":        true,
+	"/collector.CollectionRepo/BackupCollection":      true,
+	"/collector.CollectionRepo/RestoreBackup":         true,
+	"/collector.CollectionRepo/DeleteBackup":          true,
+	"/collector.CollectionRepo/SetBackupSchedule":     true,
+	"/collector.CollectionRepo/CreateSnapshot":        true,
+	"/collector.CollectionRepo/DeleteSnapshot":        true,
+	"/collector.CollectionRepo/SubmitJob":             true,
+	"/collector.CollectionRepo/StartTransfer":         true,
+	"/collector.CollectionRepo/Approve":               true,
+	"/collector.CollectionRepo/Reject":                true,
+	"/collector.CollectionRepo/PlaceLegalHold":        true,
+	"/collector.CollectionRepo/LiftLegalHold":         true,
+	"/collector.CollectionRepo/AppendEvent":           true,
+	"/collector.CollectionRepo/MoveCollectionStorage": true,
+	"/collector.CollectionRepo/EnableStoreOptions":    true,
+	"/collector.CollectionRepo/AliasNamespace":        true,
+	"/collector.CollectionRepo/RemoveNamespaceAlias":  true,
+	"/collector.CollectionRepo/RenameNamespace":       true,
+	"/collector.CollectionBackup/Backup":              true,
+	"/collector.CollectionBackup/Restore":             true,
+	"/collector.CollectionBackup/Delete":              true,
+}
+
+// Standby keeps this collector a warm standby of a primary. Each sync
+// creates the primary's collections here, routed to the primary, pulls the
+// records changed since the last sync through PullChanges and catalogues
+// the primary's backups kept in object storage, so they can be restored
+// here. Its interceptors refuse StandbyWriteMethods until Promote makes
+// this collector the primary.
+//
+// Deletes reach the standby only for collections whose store keeps record
+// history. Sync positions are kept in memory: a restarted standby pulls
+// every record again, skipping those it already has.
+type Standby struct {
+	repo    CollectionRepo
+	primary string
+	conn    grpc.ClientConnInterface
+	backups *BackupManager // nil unless backups are catalogued, see SetBackups
+	clock   Clock
+	maxSkew time.Duration // See SetMaxClockSkew
+
+	// Endpoint is this collector's address, which Promote routes the
+	// replicated collections to when the request names none.
+	Endpoint string
+
+	promoted atomic.Bool
+	syncMu   sync.Mutex           // Serializes syncs and promotion
+	synced   map[string]time.Time // Newest updated_at pulled, by namespace/name; guarded by syncMu
+
+	mu     sync.Mutex
+	status *pb.StandbyStatus
+
+	loopMu sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewStandby creates a Standby of the collector at primary, reached through
+// conn, replicating into repo.
+func NewStandby(repo CollectionRepo, primary string, conn grpc.ClientConnInterface) *Standby {
+	return &Standby{
+		repo:    repo,
+		primary: primary,
+		conn:    conn,
+		clock:   SystemClock{},
+		maxSkew: DefaultMaxClockSkew,
+		synced:  make(map[string]time.Time),
+		status:  &pb.StandbyStatus{PrimaryEndpoint: primary},
+	}
+}
+
+// SetBackups catalogues the primary's backups in object storage with bm, so
+// they can be listed and restored here. Call it before Start.
+func (s *Standby) SetBackups(bm *BackupManager) {
+	s.backups = bm
+}
+
+// SetClock sets the clock syncs and the promotion are timed by.
+func (s *Standby) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+// SetMaxClockSkew sets how far ahead of this collector's clock the HLC of a
+// pulled record may be and still be observed. Records further ahead are
+// applied, but leave the hybrid clock alone, so a primary whose clock runs
+// fast does not drag this collector's HLCs ahead of physical time. Syncs use
+// DefaultMaxClockSkew until this is called. Call it before Start.
+func (s *Standby) SetMaxClockSkew(max time.Duration) {
+	s.maxSkew = max
+}
+
+// Primary returns the endpoint of the primary.
+func (s *Standby) Primary() string {
+	return s.primary
+}
+
+// Promoted reports whether the standby has been promoted.
+func (s *Standby) Promoted() bool {
+	return s.promoted.Load()
+}
+
+// Status returns the standby's replication status.
+func (s *Standby) Status() *pb.StandbyStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return proto.Clone(s.status).(*pb.StandbyStatus)
+}
+
+// UnaryInterceptor refuses StandbyWriteMethods calls until promotion.
+func (s *Standby) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if StandbyWriteMethods[info.FullMethod] && !s.promoted.Load() {
+			return nil, s.refuse(info.FullMethod)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor refuses StandbyWriteMethods streams until promotion.
+func (s *Standby) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if StandbyWriteMethods[info.FullMethod] && !s.promoted.Load() {
+			return s.refuse(info.FullMethod)
+		}
+		return handler(srv, ss)
+	}
+}
+
+func (s *Standby) refuse(method string) error {
+	return status.Errorf(codes.FailedPrecondition,
+		"%s refused: this collector is a read-only standby of %s; write to the primary or promote this collector",
+		method, s.primary)
+}
+
+// Sync brings the standby up to date with the primary once.
+func (s *Standby) Sync(ctx context.Context) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	if s.promoted.Load() {
+		return ErrStandbyPromoted
+	}
+	return s.sync(ctx)
+}
+
+// sync is Sync, recording its outcome in the status. The caller holds
+// syncMu.
+func (s *Standby) sync(ctx context.Context) error {
+	collections, applied, backups, err := s.pull(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.RecordsApplied += applied
+	s.status.Backups += int32(backups)
+	if err != nil {
+		s.status.LastError = err.Error()
+		return err
+	}
+	s.status.Collections = int32(collections)
+	s.status.LastSync = timestamppb.New(s.clock.Now())
+	s.status.LastError = ""
+	return nil
+}
+
+// pull replicates the primary's collections and catalogues its backups,
+// returning how many collections there were, how many changes were applied
+// and how many backups catalogued.
+func (s *Standby) pull(ctx context.Context) (int, int64, int, error) {
+	repoClient := pb.NewCollectionRepoClient(s.conn)
+	collections, err := s.primaryCollections(ctx, repoClient)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	feed := pb.NewCollectionServiceClient(s.conn)
+	var applied int64
+	for _, meta := range collections {
+		coll, err := s.replica(ctx, meta)
+		if err != nil {
+			return 0, applied, 0, err
+		}
+		n, err := s.pullChanges(ctx, feed, coll)
+		applied += n
+		if err != nil {
+			return 0, applied, 0, fmt.Errorf("failed to pull %s/%s: %w", meta.Namespace, meta.Name, err)
+		}
+	}
+
+	backups, err := s.catalogBackups(ctx, repoClient)
+	if err != nil {
+		return 0, applied, backups, err
+	}
+	return len(collections), applied, backups, nil
+}
+
+// primaryCollections lists the primary's collections, leaving out its
+// system collections, which each collector keeps for itself.
+func (s *Standby) primaryCollections(ctx context.Context, client pb.CollectionRepoClient) ([]*pb.Collection, error) {
+	var collections []*pb.Collection
+	token := ""
+	for {
+		resp, err := client.Discover(ctx, &pb.DiscoverRequest{PageSize: standbyPageSize, PageToken: token})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list primary collections: %w", err)
+		}
+		for _, meta := range resp.Collections {
+			if meta.Namespace != "system" {
+				collections = append(collections, meta)
+			}
+		}
+		if token = resp.NextPageToken; token == "" {
+			return collections, nil
+		}
+	}
+}
+
+// replica returns the local copy of a primary collection, creating it routed
+// to the primary when it is new.
+func (s *Standby) replica(ctx context.Context, meta *pb.Collection) (*Collection, error) {
+	if coll, err := s.repo.GetCollection(ctx, meta.Namespace, meta.Name); err == nil {
+		return coll, nil
+	}
+	copied := proto.Clone(meta).(*pb.Collection)
+	copied.ServerEndpoint = s.primary
+	copied.Replicas = nil
+	copied.StoragePath = ""
+	if _, err := s.repo.CreateCollection(ctx, copied); err != nil {
+		return nil, fmt.Errorf("failed to create replica of %s/%s: %w", meta.Namespace, meta.Name, err)
+	}
+	return s.repo.GetCollection(ctx, meta.Namespace, meta.Name)
+}
+
+// pullChanges applies the changes to a collection since the last sync and
+// returns how many were applied. Timestamps have one-second resolution, so
+// each sync pulls the last synced second again: records updated in it after
+// the last sync are not missed, and those already here are skipped.
+func (s *Standby) pullChanges(ctx context.Context, feed pb.CollectionServiceClient, coll *Collection) (int64, error) {
+	key := coll.Meta.Namespace + "/" + coll.Meta.Name
+	since, afterID := s.synced[key], ""
+	var applied, skewed int64
+	var ahead time.Duration
+	defer func() {
+		if skewed > 0 {
+			log.Printf("Warning: %d of the records pulled for %s from primary %s have HLCs up to %s ahead of this collector's clock, more than the %s allowed; their HLCs were not observed",
+				skewed, key, s.primary, ahead.Round(time.Millisecond), s.maxSkew)
+		}
+	}()
+	for first := true; ; first = false {
+		req := &pb.PullChangesRequest{
+			Namespace:      coll.Meta.Namespace,
+			CollectionName: coll.Meta.Name,
+			AfterId:        afterID,
+			Limit:          standbyPageSize,
+		}
+		if !since.IsZero() {
+			req.Since = timestamppb.New(since)
+		}
+		resp, err := feed.PullChanges(ctx, req)
+		if err != nil {
+			return applied, err
+		}
+
+		// Every page reports the same deletions; apply them before the
+		// records, which may have been recreated since
+		if first {
+			for _, id := range resp.DeletedIds {
+				if _, err := coll.Store.GetRecord(ctx, id); errors.Is(err, sql.ErrNoRows) {
+					continue
+				}
+				if err := coll.Store.DeleteRecord(ctx, id); err != nil {
+					return applied, fmt.Errorf("failed to delete record %s: %w", id, err)
+				}
+				applied++
+			}
+		}
+		for _, r := range resp.Records {
+			changed, err := applyReplicated(ctx, coll.Store, r)
+			if err != nil {
+				return applied, err
+			}
+			// Writes here after a promotion order after the primary's,
+			// unless the primary's clock is too far ahead to follow
+			if coll.HLC != nil && r.Hlc != 0 {
+				if d := HLC(r.Hlc).Wall().Sub(s.clock.Now()); d > s.maxSkew {
+					skewed++
+					ahead = max(ahead, d)
+				} else {
+					coll.HLC.Observe(HLC(r.Hlc))
+				}
+			}
+			if changed {
+				applied++
+			}
+			since, afterID = r.UpdatedAt.AsTime(), r.Id
+		}
+		s.synced[key] = since
+		if !resp.HasMore {
+			return applied, nil
+		}
+	}
+}
+
+// applyReplicated writes a record pulled from the primary to store, keeping
+// its timestamps and HLC, unless store already has it. It reports whether
+// the record was written.
+func applyReplicated(ctx context.Context, store Store, r *pb.SyncRecord) (bool, error) {
+	record := &pb.CollectionRecord{
+		Id:        r.Id,
+		ProtoData: r.Data,
+		Metadata: &pb.Metadata{
+			CreatedAt: r.CreatedAt,
+			UpdatedAt: r.UpdatedAt,
+			Checksum:  RecordChecksum(r.Data),
+			Hlc:       r.Hlc,
+		},
+	}
+	existing, err := store.GetRecord(ctx, r.Id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if err := store.CreateRecord(ctx, record); err != nil {
+			return false, fmt.Errorf("failed to create record %s: %w", r.Id, err)
+		}
+		return true, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to read record %s: %w", r.Id, err)
+	case bytes.Equal(existing.ProtoData, r.Data) && proto.Equal(existing.Metadata.GetUpdatedAt(), r.UpdatedAt):
+		return false, nil
+	}
+	record.Metadata.Labels = existing.Metadata.GetLabels()
+	if err := store.UpdateRecord(ctx, record); err != nil {
+		return false, fmt.Errorf("failed to update record %s: %w", r.Id, err)
+	}
+	return true, nil
+}
+
+// catalogBackups adds the primary's backups kept in object storage to the
+// local catalog and returns how many were new. Backups on the primary's own
+// disk cannot be reached from here.
+func (s *Standby) catalogBackups(ctx context.Context, client pb.CollectionRepoClient) (int, error) {
+	if s.backups == nil {
+		return 0, nil
+	}
+	resp, err := client.ListBackups(ctx, &pb.ListBackupsRequest{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list primary backups: %w", err)
+	}
+	if resp.Status.GetCode() != pb.Status_OK {
+		return 0, fmt.Errorf("failed to list primary backups: %s", resp.Status.GetMessage())
+	}
+	added := 0
+	for _, backup := range resp.Backups {
+		if backupStorageType(backup.StoragePath) == "local" {
+			continue
+		}
+		_, err := s.backups.metaStore.GetBackup(ctx, backup.BackupId)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return added, fmt.Errorf("failed to read backup %s: %w", backup.BackupId, err)
+		}
+		if err := s.backups.metaStore.SaveBackup(ctx, backup); err != nil {
+			return added, fmt.Errorf("failed to catalogue backup %s: %w", backup.BackupId, err)
+		}
+		added++
+	}
+	return added, nil
+}
+
+// Promote makes this collector the primary. It stops syncing after a last
+// attempt to catch up with the primary, which may be down, routes the
+// replicated collections to endpoint, or Endpoint when it is empty, and
+// starts accepting writes. It returns how many Route entries changed.
+func (s *Standby) Promote(ctx context.Context, endpoint string) (int, error) {
+	s.Stop()
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	if s.promoted.Load() {
+		return 0, ErrStandbyPromoted
+	}
+	if err := s.sync(ctx); err != nil {
+		log.Printf("Warning: standby could not catch up with %s before promotion: %v", s.primary, err)
+	}
+
+	if endpoint == "" {
+		endpoint = s.Endpoint
+	}
+	found, err := s.repo.Discover(ctx, &pb.DiscoverRequest{PageSize: math.MaxInt32})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list collections: %w", err)
+	}
+	routed := 0
+	for _, meta := range found.Collections {
+		if meta.ServerEndpoint != s.primary {
+			continue
+		}
+		updated := proto.Clone(meta).(*pb.Collection)
+		updated.ServerEndpoint = endpoint
+		if err := s.repo.UpdateCollectionMetadata(ctx, meta.Namespace, meta.Name, updated); err != nil {
+			return routed, fmt.Errorf("failed to route %s/%s: %w", meta.Namespace, meta.Name, err)
+		}
+		routed++
+	}
+
+	s.promoted.Store(true)
+	s.mu.Lock()
+	s.status.Promoted = true
+	s.status.PromotedAt = timestamppb.New(s.clock.Now())
+	s.mu.Unlock()
+	return routed, nil
+}
+
+// Start syncs now and then every interval until Stop or promotion.
+func (s *Standby) Start(interval time.Duration) {
+	s.loopMu.Lock()
+	defer s.loopMu.Unlock()
+	if s.stop != nil || s.promoted.Load() {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	s.stop, s.done = stop, done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := s.Sync(context.Background()); err != nil {
+				if errors.Is(err, ErrStandbyPromoted) {
+					return
+				}
+				log.Printf("Warning: standby sync from %s: %v", s.primary, err)
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the Start loop, waiting for a running sync to finish.
+func (s *Standby) Stop() {
+	s.loopMu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.loopMu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+var errNotStandby = &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: "this collector is not a standby"}
+
+// SetStandby serves the standby RPCs for s.
+func (s *GrpcServer) SetStandby(standby *Standby) {
+	s.standby = standby
+}
+
+// GetStandbyStatus reports the standby's replication status.
+func (s *GrpcServer) GetStandbyStatus(ctx context.Context, req *pb.GetStandbyStatusRequest) (*pb.GetStandbyStatusResponse, error) {
+	if s.standby == nil {
+		return &pb.GetStandbyStatusResponse{Status: errNotStandby}, nil
+	}
+	return &pb.GetStandbyStatusResponse{
+		Status:  &pb.Status{Code: pb.Status_OK},
+		Standby: s.standby.Status(),
+	}, nil
+}
+
+// Promote makes this standby collector the primary.
+func (s *GrpcServer) Promote(ctx context.Context, req *pb.PromoteRequest) (*pb.PromoteResponse, error) {
+	if s.standby == nil {
+		return &pb.PromoteResponse{Status: errNotStandby}, nil
+	}
+	routed, err := s.standby.Promote(ctx, req.Endpoint)
+	switch {
+	case errors.Is(err, ErrStandbyPromoted):
+		return &pb.PromoteResponse{
+			Status:  &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: err.Error()},
+			Standby: s.standby.Status(),
+		}, nil
+	case err != nil:
+		return &pb.PromoteResponse{
+			Status:        &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()},
+			Standby:       s.standby.Status(),
+			RoutesUpdated: int32(routed),
+		}, nil
+	}
+	return &pb.PromoteResponse{
+		Status:        &pb.Status{Code: pb.Status_OK, Message: fmt.Sprintf("promoted, %d collections routed here", routed)},
+		Standby:       s.standby.Status(),
+		RoutesUpdated: int32(routed),
+	}, nil
+}
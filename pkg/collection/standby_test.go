@@ -0,0 +1,264 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// memStorage is an ObjectStorage keeping objects in memory.
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *memStorage) UploadFile(ctx context.Context, key, localPath string) error {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = data
+	return nil
+}
+
+func (m *memStorage) DownloadFile(ctx context.Context, key, localPath string) error {
+	m.mu.Lock()
+	data, ok := m.objects[key]
+	m.mu.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	return os.WriteFile(localPath, data, 0644)
+}
+
+func (m *memStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *memStorage) Stat(ctx context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[key]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(len(data)), nil
+}
+
+func (m *memStorage) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func TestStandby_ReplicatesAndPromotes(t *testing.T) {
+	ctx := context.Background()
+	bucket := &memStorage{objects: make(map[string][]byte)}
+	openBucket := func(string) (collection.ObjectStorage, error) { return bucket, nil }
+
+	// The primary serves its collections and change feed over loopback TCP
+	primaryRepo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	primaryAddr := lis.Addr().String()
+	primary := collection.NewGrpcServerWithDataDir(primaryRepo, t.TempDir())
+	defer primary.StopJobs()
+	primary.Backups().SetObjectStorage(collection.StorageTypeS3, openBucket)
+	grpcServer := grpc.NewServer()
+	pb.RegisterCollectionRepoServer(grpcServer, primary)
+	pb.RegisterCollectionServiceServer(grpcServer, collection.NewCollectionServer(primaryRepo))
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	if _, err := primaryRepo.CreateCollection(ctx, &pb.Collection{Namespace: "prod", Name: "users"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	users, _ := primaryRepo.GetCollection(ctx, "prod", "users")
+	for _, id := range []string{"u1", "u2"} {
+		if err := users.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: []byte(`{"name": "` + id + `"}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	usersRef := &pb.NamespacedName{Namespace: "prod", Name: "users"}
+	for _, dest := range []string{"s3://backups/users.db", filepath.Join(t.TempDir(), "users.db")} {
+		resp, err := primary.BackupCollection(ctx, &pb.BackupCollectionRequest{Collection: usersRef, DestPath: dest})
+		if err != nil || resp.Status.Code != pb.Status_OK {
+			t.Fatalf("BackupCollection to %s failed: %v %v", dest, resp.GetStatus(), err)
+		}
+	}
+
+	standbyRepo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	standbyServer := collection.NewGrpcServerWithDataDir(standbyRepo, t.TempDir())
+	defer standbyServer.StopJobs()
+	standbyServer.Backups().SetObjectStorage(collection.StorageTypeS3, openBucket)
+	conn, err := grpc.NewClient(primaryAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial primary: %v", err)
+	}
+	defer conn.Close()
+	standby := collection.NewStandby(standbyRepo, primaryAddr, conn)
+	standby.Endpoint = "standby:50051"
+	standby.SetBackups(standbyServer.Backups())
+	standbyServer.SetStandby(standby)
+
+	// A sync copies collections, records and backups in object storage,
+	// with the copies routed to the primary
+	if err := standby.Sync(ctx); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	replica, err := standbyRepo.GetCollection(ctx, "prod", "users")
+	if err != nil {
+		t.Fatalf("expected prod/users replicated: %v", err)
+	}
+	if record, err := replica.GetRecord(ctx, "u2"); err != nil || string(record.ProtoData) != `{"name": "u2"}` {
+		t.Errorf("expected u2 replicated, got %v %v", record, err)
+	}
+	route, _ := standbyRepo.Route(ctx, &pb.RouteRequest{Collection: usersRef})
+	if route.ServerEndpoint != primaryAddr {
+		t.Errorf("expected the replica routed to the primary, got %s", route.ServerEndpoint)
+	}
+	st := standby.Status()
+	if st.Collections != 1 || st.RecordsApplied != 2 || st.Backups != 1 || st.LastSync == nil || st.LastError != "" {
+		t.Errorf("unexpected status after first sync: %v", st)
+	}
+	backups, _ := standbyServer.ListBackups(ctx, &pb.ListBackupsRequest{Collection: usersRef})
+	if len(backups.Backups) != 1 || !strings.HasPrefix(backups.Backups[0].StoragePath, "s3://") {
+		t.Errorf("expected the object storage backup catalogued, got %v", backups.Backups)
+	}
+
+	// Later syncs pull only what changed
+	if err := users.UpdateRecord(ctx, &pb.CollectionRecord{Id: "u1", ProtoData: []byte(`{"name": "ada"}`)}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if err := users.CreateRecord(ctx, &pb.CollectionRecord{Id: "u3", ProtoData: []byte(`{"name": "u3"}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := standby.Sync(ctx); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if record, err := replica.GetRecord(ctx, "u1"); err != nil || string(record.ProtoData) != `{"name": "ada"}` {
+		t.Errorf("expected the update to u1 replicated, got %v %v", record, err)
+	}
+	if st := standby.Status(); st.RecordsApplied != 4 || st.Backups != 1 {
+		t.Errorf("expected 2 more changes and no new backups, got %v", st)
+	}
+
+	// Writes are refused until promotion; reads are served
+	intercept := standby.UnaryInterceptor()
+	handler := func(ctx context.Context, req any) (any, error) { return "ok", nil }
+	if _, err := intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/collector.CollectionService/Create"}, handler); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected writes refused on the standby, got %v", err)
+	}
+	if _, err := intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/collector.CollectionService/Get"}, handler); err != nil {
+		t.Errorf("expected reads served on the standby, got %v", err)
+	}
+
+	resp, err := standbyServer.Promote(ctx, &pb.PromoteRequest{})
+	if err != nil || resp.Status.Code != pb.Status_OK || resp.RoutesUpdated != 1 || !resp.Standby.Promoted {
+		t.Fatalf("Promote failed: %v %v", resp, err)
+	}
+	route, _ = standbyRepo.Route(ctx, &pb.RouteRequest{Collection: usersRef})
+	if route.ServerEndpoint != "standby:50051" {
+		t.Errorf("expected the collection routed to the promoted standby, got %s", route.ServerEndpoint)
+	}
+	if _, err := intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/collector.CollectionService/Create"}, handler); err != nil {
+		t.Errorf("expected writes accepted once promoted, got %v", err)
+	}
+	if err := standby.Sync(ctx); !errors.Is(err, collection.ErrStandbyPromoted) {
+		t.Errorf("expected ErrStandbyPromoted from Sync, got %v", err)
+	}
+	if resp, _ := standbyServer.Promote(ctx, &pb.PromoteRequest{}); resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected a second promotion refused, got %v", resp.Status)
+	}
+	if resp, _ := primary.GetStandbyStatus(ctx, &pb.GetStandbyStatusRequest{}); resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected GetStandbyStatus refused on a primary, got %v", resp.Status)
+	}
+}
+
+func TestStandby_IgnoresHLCsOfAFastPrimary(t *testing.T) {
+	ctx := context.Background()
+
+	// The primary's clock runs an hour ahead
+	primaryRepo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	primaryRepo.(*collection.DefaultCollectionRepo).SetClock(collection.SkewedClock{Base: collection.SystemClock{}, Offset: time.Hour})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	pb.RegisterCollectionRepoServer(grpcServer, collection.NewGrpcServer(primaryRepo))
+	pb.RegisterCollectionServiceServer(grpcServer, collection.NewCollectionServer(primaryRepo))
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	if _, err := primaryRepo.CreateCollection(ctx, &pb.Collection{Namespace: "prod", Name: "users"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	users, _ := primaryRepo.GetCollection(ctx, "prod", "users")
+	if err := users.CreateRecord(ctx, &pb.CollectionRecord{Id: "u1", ProtoData: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	standbyRepo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial primary: %v", err)
+	}
+	defer conn.Close()
+	standby := collection.NewStandby(standbyRepo, lis.Addr().String(), conn)
+	hlc := standbyRepo.(*collection.DefaultCollectionRepo).HybridClock()
+
+	// The record is applied, but its HLC does not drag the standby's ahead
+	if err := standby.Sync(ctx); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	replica, _ := standbyRepo.GetCollection(ctx, "prod", "users")
+	if exists, _ := replica.Exists(ctx, "u1"); !exists {
+		t.Fatal("expected u1 replicated")
+	}
+	if ahead := time.Until(hlc.Now().Wall()); ahead > time.Minute {
+		t.Errorf("expected the standby's HLCs to follow its own clock, got %s ahead", ahead)
+	}
+
+	// Within the allowed skew they are followed
+	standby.SetMaxClockSkew(2 * time.Hour)
+	if err := users.CreateRecord(ctx, &pb.CollectionRecord{Id: "u2", ProtoData: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := standby.Sync(ctx); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if ahead := time.Until(hlc.Now().Wall()); ahead < 59*time.Minute {
+		t.Errorf("expected the standby's HLCs to follow the primary's, got %s ahead", ahead)
+	}
+}
@@ -0,0 +1,532 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// movedStoreGrace is how long a store a collection moved away from stays
+// open for reads that started before the move.
+const movedStoreGrace = 30 * time.Second
+
+// catchUpPageSize is how many changed records a catch-up reads at a time.
+const catchUpPageSize = 500
+
+var (
+	// ErrStorageMoved is returned by writes through a Collection obtained
+	// before its storage moved; GetCollection returns one on the new storage.
+	ErrStorageMoved = errors.New("collection storage moved; get the collection again")
+	// ErrMoveUnavailable is returned by MoveStorage in a repository without a
+	// StoreOpener.
+	ErrMoveUnavailable = errors.New("storage relocation is not enabled")
+	// ErrMoveInProgress is returned when moving a collection that is already
+	// being moved.
+	ErrMoveInProgress = errors.New("collection storage is already being moved")
+)
+
+// StoreOpener opens the store at path, creating it if needed, with the
+// features recorded in stored (see Options.WithStored); nil stored uses the
+// opener's defaults. Repositories use it to open the copies MoveStorage
+// makes.
+type StoreOpener func(path string, stored *pb.StoreOptions) (Store, error)
+
+// storageGate pauses the record and file writes of one collection while its
+// storage is switched. Collections remember the moves they were created
+// after and refuse writes once another move has completed.
+type storageGate struct {
+	mu    sync.RWMutex
+	moves atomic.Int64
+}
+
+// beginWrite waits out a storage switch and returns the function ending the
+// write, or ErrStorageMoved if the collection's storage moved since c was
+// created.
+func (c *Collection) beginWrite() (func(), error) {
+	if c.gate == nil {
+		return func() {}, nil
+	}
+	c.gate.mu.RLock()
+	if c.gate.moves.Load() != c.gateMoves {
+		c.gate.mu.RUnlock()
+		return nil, ErrStorageMoved
+	}
+	return c.gate.mu.RUnlock, nil
+}
+
+// collectionStorage is where a moved collection lives.
+type collectionStorage struct {
+	dir      string
+	store    Store
+	fs       FileSystem // nil keeps the repository's filesystem
+	filesDir string     // Where fs keeps its files, if it is local
+}
+
+// storageFor returns the storage of a moved collection (nil for one on the
+// repository's store) and the gate its writes go through.
+func (r *DefaultCollectionRepo) storageFor(key string) (*collectionStorage, *storageGate, int64) {
+	r.storageMu.Lock()
+	defer r.storageMu.Unlock()
+	gate, ok := r.gates[key]
+	if !ok {
+		gate = &storageGate{}
+		r.gates[key] = gate
+	}
+	return r.storage[key], gate, gate.moves.Load()
+}
+
+// StoragePath returns the directory a moved collection is stored in, or ""
+// for one on the repository's store.
+func (r *DefaultCollectionRepo) StoragePath(namespace, name string) string {
+	r.storageMu.Lock()
+	defer r.storageMu.Unlock()
+	if moved := r.storage[namespace+"/"+name]; moved != nil {
+		return moved.dir
+	}
+	return ""
+}
+
+// sharesStore reports whether a collection keeps its records in the
+// repository's shared store, among those of every other collection there,
+// rather than in a store of its own: moved, write-once or temporary.
+func (r *DefaultCollectionRepo) sharesStore(namespace, name string) bool {
+	key := namespace + "/" + name
+	if _, temporary, _ := r.temps.storeFor(key); temporary {
+		return false
+	}
+	r.storageMu.Lock()
+	defer r.storageMu.Unlock()
+	return r.storage[key] == nil
+}
+
+// SetStoreOpener enables MoveStorage, opening the copies of moved collections
+// with opener. Call it before serving requests.
+func (r *DefaultCollectionRepo) SetStoreOpener(opener StoreOpener) {
+	r.opener = opener
+}
+
+// MoveStorage relocates a collection's store and, when they are on the local
+// filesystem, its files to where a PathLayout rooted at destDir keeps them
+// (destDir/collections/<namespace>/<name>.db and
+// destDir/files/<namespace>/<name>), for rebalancing
+// full disks. The collection keeps serving throughout: the store is copied
+// online, then record and file writes pause while the changes made during the
+// copy are applied to it, and the collection switches to the copy. Reads never
+// pause. A store the collection is moved away from that is its own (from an
+// earlier move) is closed and deleted once reads that started on it are done;
+// the repository's shared store is left as it is.
+func (r *DefaultCollectionRepo) MoveStorage(ctx context.Context, namespace, name, destDir string) (*pb.MoveCollectionStorageResponse, error) {
+	if r.opener == nil {
+		return nil, ErrMoveUnavailable
+	}
+	if destDir == "" {
+		return nil, fmt.Errorf("dest_dir is required")
+	}
+	key := namespace + "/" + name
+	coll, err := r.GetCollection(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if coll.Meta.GetTemporary() != nil {
+		return nil, fmt.Errorf("temporary collection %s cannot be moved", key)
+	}
+	// Backup merges partitions into one database, which would leave the
+	// moved collection unpartitioned
+	if coll.Meta.GetStoreOptions().GetPartitionPeriod() != "" {
+		return nil, fmt.Errorf("partitioned collection %s cannot be moved", key)
+	}
+
+	done, err := r.beginMove(key)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	old, gate, _ := r.storageFor(key)
+	src := r.store
+	if old != nil {
+		src = old.store
+	}
+	destLayout := NewPathLayout(destDir)
+	dbPath := destLayout.CollectionDB(namespace, name)
+	if old != nil && filepath.Clean(old.dir) == filepath.Clean(destDir) {
+		return nil, fmt.Errorf("collection %s is already stored in %s", key, destDir)
+	}
+	if _, err := os.Stat(dbPath); err == nil {
+		return nil, fmt.Errorf("%s already exists", dbPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	// Copy while the collection serves reads and writes
+	started := time.Now()
+	if err := coll.Store.Backup(ctx, dbPath); err != nil {
+		os.Remove(dbPath)
+		return nil, fmt.Errorf("failed to copy store: %w", err)
+	}
+	dest, err := r.opener(dbPath, coll.Meta.GetStoreOptions())
+	if err != nil {
+		os.Remove(dbPath)
+		return nil, fmt.Errorf("failed to open copied store: %w", err)
+	}
+	moved := &collectionStorage{dir: destDir, store: dest}
+	resp := &pb.MoveCollectionStorageResponse{DbPath: dbPath}
+	fail := func(err error) (*pb.MoveCollectionStorageResponse, error) {
+		dest.Close()
+		removeStoreFiles(dbPath)
+		if resp.FilesPath != "" {
+			os.RemoveAll(resp.FilesPath)
+		}
+		return nil, err
+	}
+
+	var srcFiles, destFiles FileSystem
+	if local, ok := coll.FS.(*LocalFileSystem); ok {
+		resp.FilesPath = destLayout.CollectionFiles(namespace, name)
+		destFS, err := NewLocalFileSystem(resp.FilesPath)
+		if err != nil {
+			return fail(fmt.Errorf("failed to create files directory: %w", err))
+		}
+		srcFiles, destFiles = local, destFS
+		moved.fs, moved.filesDir = destFS, resp.FilesPath
+		if _, err := syncFiles(ctx, srcFiles, destFiles); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Catch up with writes paused, then switch
+	gate.mu.Lock()
+	paused := time.Now()
+	if err := r.stopBuffer(ctx, key); err != nil {
+		gate.mu.Unlock()
+		return fail(err)
+	}
+	caughtUp, err := catchUp(ctx, src, dest, started)
+	if err == nil && srcFiles != nil {
+		resp.FilesCopied, err = syncFiles(ctx, srcFiles, destFiles)
+	}
+	if err != nil {
+		gate.mu.Unlock()
+		return fail(fmt.Errorf("failed to catch up: %w", err))
+	}
+
+	r.switchStorage(key, gate, moved)
+	resp.WritePauseMs = time.Since(paused).Milliseconds()
+	gate.mu.Unlock()
+
+	resp.CaughtUpRecords = caughtUp
+	resp.Status = &pb.Status{Code: pb.Status_OK, Message: fmt.Sprintf("moved %s to %s", key, destDir)}
+	if old != nil {
+		time.AfterFunc(movedStoreGrace, func() { old.release() })
+	}
+	return resp, nil
+}
+
+// SwapStorage switches a live collection to the database and files a
+// PathLayout rooted at dir keeps for it, e.g. a restored backup, replacing
+// its records and files. Record and file writes pause while the collection
+// switches, and writes buffered for the replaced store are flushed to it
+// first; reads never pause. Collections obtained before the swap refuse
+// writes with ErrStorageMoved. As with MoveStorage, a store of the
+// collection's own is closed and deleted once reads that started on it are
+// done, and the repository's shared store is left as it is.
+func (r *DefaultCollectionRepo) SwapStorage(ctx context.Context, namespace, name, dir string) error {
+	if r.opener == nil {
+		return ErrMoveUnavailable
+	}
+	key := namespace + "/" + name
+	coll, err := r.GetCollection(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+	if coll.Meta.GetTemporary() != nil {
+		return fmt.Errorf("temporary collection %s cannot be swapped", key)
+	}
+	done, err := r.beginMove(key)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	layout := NewPathLayout(dir)
+	dest, err := r.opener(layout.CollectionDB(namespace, name), coll.Meta.GetStoreOptions())
+	if err != nil {
+		return fmt.Errorf("failed to open swapped in store: %w", err)
+	}
+	filesDir := layout.CollectionFiles(namespace, name)
+	fs, err := NewLocalFileSystem(filesDir)
+	if err != nil {
+		dest.Close()
+		return fmt.Errorf("failed to create files directory: %w", err)
+	}
+	swapped := &collectionStorage{dir: dir, store: dest, fs: fs, filesDir: filesDir}
+
+	old, gate, _ := r.storageFor(key)
+	gate.mu.Lock()
+	if err := r.stopBuffer(ctx, key); err != nil {
+		gate.mu.Unlock()
+		dest.Close()
+		return err
+	}
+	r.switchStorage(key, gate, swapped)
+	gate.mu.Unlock()
+
+	if old != nil {
+		time.AfterFunc(movedStoreGrace, func() { old.release() })
+	}
+	return nil
+}
+
+// beginMove marks a collection's storage as changing, or returns
+// ErrMoveInProgress, and returns the function ending the change.
+func (r *DefaultCollectionRepo) beginMove(key string) (func(), error) {
+	r.storageMu.Lock()
+	defer r.storageMu.Unlock()
+	if r.moving[key] {
+		return nil, ErrMoveInProgress
+	}
+	r.moving[key] = true
+	return func() {
+		r.storageMu.Lock()
+		delete(r.moving, key)
+		r.storageMu.Unlock()
+	}, nil
+}
+
+// stopBuffer flushes and stops a collection's write-behind buffer, whose
+// writes are for the store being switched away from. Callers hold the
+// collection's gate.
+func (r *DefaultCollectionRepo) stopBuffer(ctx context.Context, key string) error {
+	r.service.mu.Lock()
+	buffer := r.service.buffers[key]
+	delete(r.service.buffers, key)
+	r.service.mu.Unlock()
+	if buffer == nil {
+		return nil
+	}
+	if err := buffer.Stop(ctx); err != nil {
+		return fmt.Errorf("failed to flush write buffer: %w", err)
+	}
+	return nil
+}
+
+// switchStorage makes a collection live in storage, refusing the writes of
+// Collections obtained before. Callers hold the collection's gate.
+func (r *DefaultCollectionRepo) switchStorage(key string, gate *storageGate, storage *collectionStorage) {
+	r.storageMu.Lock()
+	r.storage[key] = storage
+	gate.moves.Add(1)
+	r.storageMu.Unlock()
+	r.service.mu.Lock()
+	if meta, ok := r.service.collections[key]; ok {
+		meta.StoragePath = storage.dir
+		r.service.changed()
+	}
+	r.service.mu.Unlock()
+}
+
+// release closes a store a collection moved away from and deletes its data.
+func (s *collectionStorage) release() {
+	if err := s.store.Close(); err != nil {
+		log.Printf("Warning: failed to close moved store %s: %v", s.store.Path(), err)
+	}
+	removeStoreFiles(s.store.Path())
+	if s.filesDir != "" {
+		os.RemoveAll(s.filesDir)
+	}
+}
+
+func removeStoreFiles(dbPath string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(dbPath + suffix)
+	}
+}
+
+// catchUp applies to dest the record writes and deletes made to src since
+// the copy started. Stores without a change feed are compared record by
+// record.
+func catchUp(ctx context.Context, src, dest Store, since time.Time) (int64, error) {
+	var applied int64
+	feed, ok := src.(ChangeFeed)
+	if !ok {
+		return syncAllRecords(ctx, src, dest)
+	}
+
+	// Timestamps are in seconds; take the whole second the copy started in
+	cursor, afterID := since.Truncate(time.Second).Add(-time.Second), ""
+	for {
+		changed, err := feed.ChangesSince(ctx, cursor, afterID, catchUpPageSize)
+		if err != nil {
+			return applied, err
+		}
+		for _, rec := range changed {
+			if err := upsertRecord(ctx, dest, rec); err != nil {
+				return applied, fmt.Errorf("record %s: %w", rec.Id, err)
+			}
+			applied++
+			cursor, afterID = rec.Metadata.GetUpdatedAt().AsTime(), rec.Id
+		}
+		if len(changed) < catchUpPageSize {
+			break
+		}
+	}
+
+	if _, err := historyReader(src); err == nil {
+		deleted, err := feed.DeletedSince(ctx, since.Add(-time.Second))
+		if err != nil {
+			return applied, err
+		}
+		for _, id := range deleted {
+			if err := dest.DeleteRecord(ctx, id); err == nil {
+				applied++
+			}
+		}
+		return applied, nil
+	}
+	removed, err := removeMissing(ctx, src, dest)
+	return applied + removed, err
+}
+
+// syncAllRecords makes dest hold the records of src.
+func syncAllRecords(ctx context.Context, src, dest Store) (int64, error) {
+	var applied int64
+	for offset := 0; ; offset += catchUpPageSize {
+		page, err := src.ListRecords(ctx, offset, catchUpPageSize)
+		if err != nil {
+			return applied, err
+		}
+		for _, rec := range page {
+			if err := upsertRecord(ctx, dest, rec); err != nil {
+				return applied, fmt.Errorf("record %s: %w", rec.Id, err)
+			}
+			applied++
+		}
+		if len(page) < catchUpPageSize {
+			break
+		}
+	}
+	removed, err := removeMissing(ctx, src, dest)
+	return applied + removed, err
+}
+
+// removeMissing deletes the records of dest that src no longer has.
+func removeMissing(ctx context.Context, src, dest Store) (int64, error) {
+	var missing []string
+	for offset := 0; ; offset += catchUpPageSize {
+		page, err := dest.ListRecords(ctx, offset, catchUpPageSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, rec := range page {
+			exists, err := RecordExists(ctx, src, rec.Id)
+			if err != nil {
+				return 0, err
+			}
+			if !exists {
+				missing = append(missing, rec.Id)
+			}
+		}
+		if len(page) < catchUpPageSize {
+			break
+		}
+	}
+	for _, id := range missing {
+		if err := dest.DeleteRecord(ctx, id); err != nil {
+			return 0, fmt.Errorf("record %s: %w", id, err)
+		}
+	}
+	return int64(len(missing)), nil
+}
+
+func upsertRecord(ctx context.Context, store Store, rec *pb.CollectionRecord) error {
+	exists, err := RecordExists(ctx, store, rec.Id)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return store.UpdateRecord(ctx, rec)
+	}
+	return store.CreateRecord(ctx, rec)
+}
+
+// syncFiles copies the files of src that dest lacks or holds at another size,
+// deletes those src no longer has, and returns the number copied.
+func syncFiles(ctx context.Context, src, dest FileSystem) (int64, error) {
+	files, err := src.List(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list files: %w", err)
+	}
+	present := make(map[string]bool, len(files))
+	var copied int64
+	for _, path := range files {
+		present[path] = true
+		size, err := src.Stat(ctx, path)
+		if err != nil {
+			return copied, fmt.Errorf("failed to stat file %s: %w", path, err)
+		}
+		if destSize, err := dest.Stat(ctx, path); err == nil && destSize == size {
+			continue
+		}
+		content, err := src.Load(ctx, path)
+		if err != nil {
+			return copied, fmt.Errorf("failed to load file %s: %w", path, err)
+		}
+		if err := dest.Save(ctx, path, content); err != nil {
+			return copied, fmt.Errorf("failed to save file %s: %w", path, err)
+		}
+		copied++
+	}
+
+	existing, err := dest.List(ctx, "")
+	if err != nil {
+		return copied, fmt.Errorf("failed to list copied files: %w", err)
+	}
+	for _, path := range existing {
+		if !present[path] {
+			if err := dest.Delete(ctx, path); err != nil {
+				return copied, fmt.Errorf("failed to delete file %s: %w", path, err)
+			}
+		}
+	}
+	return copied, nil
+}
+
+// MoveCollectionStorage relocates a collection's store and files to a
+// directory under the root or storage roots of the server's PathLayout. It
+// only runs for callers authenticated by an AdminAuth, or on a call approved
+// through an ApprovalGate.
+func (s *GrpcServer) MoveCollectionStorage(ctx context.Context, req *pb.MoveCollectionStorageRequest) (*pb.MoveCollectionStorageResponse, error) {
+	if !isAdmin(ctx) && !isApproved(ctx) {
+		return &pb.MoveCollectionStorageResponse{Status: &pb.Status{Code: pb.Status_PERMISSION_DENIED, Message: "MoveCollectionStorage requires admin authentication or an approval"}}, nil
+	}
+	repo, ok := s.repo.(*DefaultCollectionRepo)
+	if !ok {
+		return &pb.MoveCollectionStorageResponse{Status: &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: ErrMoveUnavailable.Error()}}, nil
+	}
+	if req.Collection == nil || req.DestDir == "" {
+		return &pb.MoveCollectionStorageResponse{Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection and dest_dir are required"}}, nil
+	}
+	destDir, err := s.layout.StorageDir(req.DestDir)
+	if err != nil {
+		return &pb.MoveCollectionStorageResponse{Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: err.Error()}}, nil
+	}
+	resp, err := repo.MoveStorage(ctx, req.Collection.Namespace, req.Collection.Name, destDir)
+	switch {
+	case err == nil:
+		return resp, nil
+	case errors.Is(err, ErrMoveUnavailable):
+		return &pb.MoveCollectionStorageResponse{Status: &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: err.Error()}}, nil
+	case errors.Is(err, ErrMoveInProgress):
+		return &pb.MoveCollectionStorageResponse{Status: &pb.Status{Code: pb.Status_ABORTED, Message: err.Error()}}, nil
+	}
+	return &pb.MoveCollectionStorageResponse{Status: &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()}}, nil
+}
@@ -0,0 +1,293 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// moveAsAdmin calls MoveCollectionStorage through an AdminAuth interceptor
+// with its token.
+func moveAsAdmin(ctx context.Context, server *collection.GrpcServer, req *pb.MoveCollectionStorageRequest) (*pb.MoveCollectionStorageResponse, error) {
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(collection.AdminTokenMetadataKey, "admin-secret"))
+	info := &grpc.UnaryServerInfo{FullMethod: "/collector.CollectionRepo/MoveCollectionStorage"}
+	out, err := collection.NewAdminAuth("admin-secret").UnaryInterceptor()(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+		return server.MoveCollectionStorage(ctx, req.(*pb.MoveCollectionStorageRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.(*pb.MoveCollectionStorageResponse), nil
+}
+
+func TestMoveCollectionStorage(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	files, err := collection.NewLocalFileSystem(filepath.Join(t.TempDir(), "files"))
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+	repo.SetFileSystem(files)
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	before, _ := repo.GetCollection(ctx, "test", "docs")
+	for i := 0; i < 20; i++ {
+		if err := before.CreateRecord(ctx, &pb.CollectionRecord{Id: fmt.Sprintf("r%d", i), ProtoData: []byte(`{"n": 1}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	if err := before.SaveFile(ctx, "docs/readme.txt", &pb.CollectionData{Content: &pb.CollectionData_Data{Data: []byte("hello")}}); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+
+	// Writers keep going during the move; every write they saw succeed must
+	// be in the moved collection
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		written []string
+		stop    = make(chan struct{})
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		coll := before
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := fmt.Sprintf("w%d", i)
+			err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: []byte(`{"n": 2}`)})
+			if errors.Is(err, collection.ErrStorageMoved) {
+				coll, _ = repo.GetCollection(ctx, "test", "docs")
+				continue
+			}
+			if err != nil {
+				t.Errorf("CreateRecord failed: %v", err)
+				return
+			}
+			mu.Lock()
+			written = append(written, id)
+			mu.Unlock()
+		}
+	}()
+
+	disk2 := t.TempDir()
+	server := collection.NewGrpcServerWithLayout(repo, collection.PathLayout{Root: filepath.Join(t.TempDir(), "data"), StorageRoots: []string{disk2}})
+	dest := filepath.Join(disk2, "collector")
+	resp, err := moveAsAdmin(ctx, server, &pb.MoveCollectionStorageRequest{
+		Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"},
+		DestDir:    dest,
+	})
+	close(stop)
+	wg.Wait()
+	if err != nil || resp.Status.Code != pb.Status_OK {
+		t.Fatalf("MoveCollectionStorage returned %v, %v", resp, err)
+	}
+	if resp.DbPath != filepath.Join(dest, "collections", "test", "docs.db") {
+		t.Errorf("unexpected db path %s", resp.DbPath)
+	}
+	if _, err := os.Stat(resp.DbPath); err != nil {
+		t.Fatalf("expected the moved store on disk: %v", err)
+	}
+
+	after, err := repo.GetCollection(ctx, "test", "docs")
+	if err != nil {
+		t.Fatalf("failed to get moved collection: %v", err)
+	}
+	if after.Store.Path() != resp.DbPath || after.Meta.StoragePath != dest {
+		t.Errorf("expected the collection on its new store, got %s (%q)", after.Store.Path(), after.Meta.StoragePath)
+	}
+	mu.Lock()
+	ids := append([]string{"r0", "r19"}, written...)
+	mu.Unlock()
+	for _, id := range ids {
+		if exists, err := after.Exists(ctx, id); err != nil || !exists {
+			t.Fatalf("expected %s to survive the move, got %v, %v", id, exists, err)
+		}
+	}
+	if data, err := after.GetFile(ctx, "docs/readme.txt"); err != nil || string(data.GetData()) != "hello" {
+		t.Errorf("expected the file to move, got %v, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(resp.FilesPath, "docs", "readme.txt")); err != nil {
+		t.Errorf("expected the file under the new files directory: %v", err)
+	}
+
+	// Collections from before the move refuse writes rather than lose them
+	if err := before.CreateRecord(ctx, &pb.CollectionRecord{Id: "late", ProtoData: []byte(`{}`)}); !errors.Is(err, collection.ErrStorageMoved) {
+		t.Errorf("expected ErrStorageMoved, got %v", err)
+	}
+
+	resp, err = moveAsAdmin(ctx, server, &pb.MoveCollectionStorageRequest{
+		Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"},
+		DestDir:    dest,
+	})
+	if err != nil || resp.Status.Code == pb.Status_OK {
+		t.Errorf("expected moving to the same directory to fail, got %v, %v", resp, err)
+	}
+}
+
+func TestMoveCollectionStorage_Disabled(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	root := t.TempDir()
+	resp, err := moveAsAdmin(context.Background(), collection.NewGrpcServerWithLayout(repo, collection.NewPathLayout(root)), &pb.MoveCollectionStorageRequest{
+		Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"},
+		DestDir:    filepath.Join(root, "moved"),
+	})
+	if err != nil || resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION without a store opener, got %v, %v", resp, err)
+	}
+}
+
+func TestMoveCollectionStorage_Restricted(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	disk2 := t.TempDir()
+	layout := collection.PathLayout{Root: filepath.Join(t.TempDir(), "data"), StorageRoots: []string{disk2}}
+	server := collection.NewGrpcServerWithLayout(repo, layout)
+	docs := &pb.NamespacedName{Namespace: "test", Name: "docs"}
+
+	// Only admins, or approved calls, may move storage
+	resp, err := server.MoveCollectionStorage(ctx, &pb.MoveCollectionStorageRequest{Collection: docs, DestDir: disk2})
+	if err != nil || resp.Status.Code != pb.Status_PERMISSION_DENIED {
+		t.Errorf("expected PERMISSION_DENIED without the admin token, got %v, %v", resp, err)
+	}
+
+	outside := t.TempDir()
+	for _, dir := range []string{
+		outside,
+		"/etc",
+		disk2 + "/../" + filepath.Base(outside),
+		disk2 + "/a/../b",
+		layout.Root + "-sibling",
+	} {
+		resp, err := moveAsAdmin(ctx, server, &pb.MoveCollectionStorageRequest{Collection: docs, DestDir: dir})
+		if err != nil || resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+			t.Errorf("expected INVALID_ARGUMENT moving to %s, got %v, %v", dir, resp, err)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("expected nothing written outside the storage roots, got %d entries", len(entries))
+	}
+	if _, err := layout.StorageDir(disk2 + "/x/../y"); !errors.Is(err, collection.ErrStorageDirNotAllowed) {
+		t.Errorf("expected ErrStorageDirNotAllowed, got %v", err)
+	}
+
+	resp, err = moveAsAdmin(ctx, server, &pb.MoveCollectionStorageRequest{Collection: docs, DestDir: filepath.Join(disk2, "collector") + "/"})
+	if err != nil || resp.Status.Code != pb.Status_OK {
+		t.Fatalf("expected a move under a storage root to succeed, got %v, %v", resp, err)
+	}
+	if resp.DbPath != filepath.Join(disk2, "collector", "collections", "test", "docs.db") {
+		t.Errorf("unexpected db path %s", resp.DbPath)
+	}
+}
+
+func TestRestoreBackup_OverLiveCollection(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	dir := t.TempDir()
+	layout := collection.NewPathLayout(filepath.Join(dir, "data"))
+	repo.SetPathLayout(layout)
+	server := collection.NewGrpcServerWithLayout(repo, layout)
+	docs := &pb.NamespacedName{Namespace: "test", Name: "docs"}
+
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	live, _ := repo.GetCollection(ctx, "test", "docs")
+	for i := 0; i < 5; i++ {
+		if err := live.CreateRecord(ctx, &pb.CollectionRecord{Id: fmt.Sprintf("r%d", i), ProtoData: []byte(`{"n": 1}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	if err := live.SaveFile(ctx, "docs/readme.txt", &pb.CollectionData{Content: &pb.CollectionData_Data{Data: []byte("v1")}}); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+	backup, _ := server.BackupCollection(ctx, &pb.BackupCollectionRequest{
+		Collection: docs, DestPath: filepath.Join(dir, "backups", "docs.db"), IncludeFiles: true,
+	})
+	if backup.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", backup.Status)
+	}
+
+	// Changed after the backup
+	if err := live.DeleteRecord(ctx, "r0"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if err := live.CreateRecord(ctx, &pb.CollectionRecord{Id: "late", ProtoData: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	restore := &pb.RestoreBackupRequest{BackupId: backup.Backup.BackupId, DestNamespace: "test", DestName: "docs", Overwrite: true}
+
+	// Without a store opener the live store cannot be swapped
+	resp, _ := server.RestoreBackup(ctx, restore)
+	if resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Fatalf("expected FAILED_PRECONDITION without a store opener, got %v", resp.Status)
+	}
+	if entries, _ := os.ReadDir(layout.RestoresDir()); len(entries) != 0 {
+		t.Errorf("expected the failed restore cleaned up, got %d entries", len(entries))
+	}
+	if _, err := live.GetRecord(ctx, "late"); err != nil {
+		t.Errorf("expected the live collection untouched: %v", err)
+	}
+
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+	resp, _ = server.RestoreBackup(ctx, restore)
+	if resp.Status.Code != pb.Status_OK || resp.Overwritten.GetCount() != 5 {
+		t.Fatalf("restore over the live collection failed: %v (overwritten %v)", resp.Status, resp.Overwritten)
+	}
+	if err := live.CreateRecord(ctx, &pb.CollectionRecord{Id: "stale", ProtoData: []byte(`{}`)}); !errors.Is(err, collection.ErrStorageMoved) {
+		t.Errorf("expected ErrStorageMoved writing through a handle from before the restore, got %v", err)
+	}
+
+	restored, _ := repo.GetCollection(ctx, "test", "docs")
+	if _, err := restored.GetRecord(ctx, "r0"); err != nil {
+		t.Errorf("expected r0 restored: %v", err)
+	}
+	if _, err := restored.GetRecord(ctx, "late"); err == nil {
+		t.Error("expected the record written after the backup replaced")
+	}
+	if n, err := restored.CountRecords(ctx); err != nil || n != 5 {
+		t.Errorf("expected 5 restored records, got %d (%v)", n, err)
+	}
+	if data, err := restored.FS.Load(ctx, "docs/readme.txt"); err != nil || string(data) != "v1" {
+		t.Errorf("expected the backed up file restored, got %q (%v)", data, err)
+	}
+	if path := repo.StoragePath("test", "docs"); filepath.Dir(path) != layout.RestoresDir() {
+		t.Errorf("expected the collection stored under %s, got %q", layout.RestoresDir(), path)
+	}
+	if err := restored.CreateRecord(ctx, &pb.CollectionRecord{Id: "after", ProtoData: []byte(`{}`)}); err != nil {
+		t.Errorf("expected the restored collection writable: %v", err)
+	}
+
+	lineage, _ := server.GetLineage(ctx, &pb.GetLineageRequest{Collection: docs})
+	if len(lineage.Events) != 1 || lineage.Events[0].Kind != collection.LineageRestore {
+		t.Errorf("expected the swapped in store's restore event, got %v", lineage.Events)
+	}
+}
@@ -0,0 +1,155 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrStoreNotUpgradable is returned by EnableStoreOptions for stores that
+// cannot enable features after creation.
+var ErrStoreNotUpgradable = errors.New("store cannot enable features after creation")
+
+// OptionsReporter is implemented by stores that can report the options they
+// were opened with. The repository records them on the collections created
+// on the store.
+type OptionsReporter interface {
+	StoreOptions() Options
+}
+
+// StoreUpgrader is implemented by stores that can enable features after
+// creation. Upgrade enables the features of opts the store lacks, indexing
+// existing records as needed, and returns how many records were indexed.
+// Features the store already has, and those opts leaves off, are kept.
+type StoreUpgrader interface {
+	Upgrade(ctx context.Context, opts Options) (int64, error)
+}
+
+// Proto returns the options a collection's metadata records.
+func (o Options) Proto() *pb.StoreOptions {
+	return &pb.StoreOptions{
+		EnableFts:       o.EnableFTS,
+		EnableJson:      o.EnableJSON,
+		Language:        string(o.Language),
+		WriteOnce:       o.WriteOnce,
+		PartitionPeriod: o.PartitionPeriod,
+	}
+}
+
+// WithStored returns o with the features recorded in stored, so a reopened
+// store has the features its collection was created with. A nil stored
+// leaves o as it is.
+func (o Options) WithStored(stored *pb.StoreOptions) Options {
+	if stored == nil {
+		return o
+	}
+	o.EnableFTS = stored.EnableFts
+	o.EnableJSON = stored.EnableJson
+	o.WriteOnce = stored.WriteOnce
+	o.PartitionPeriod = stored.PartitionPeriod
+	if stored.Language != "" {
+		o.Language = Language(stored.Language)
+	}
+	return o
+}
+
+// withStoreOptions returns collection with the options of the store it is
+// created on, if the store reports them.
+func withStoreOptions(collection *pb.Collection, store Store) *pb.Collection {
+	reporter, ok := store.(OptionsReporter)
+	if !ok || collection == nil {
+		return collection
+	}
+	collection = proto.Clone(collection).(*pb.Collection)
+	collection.StoreOptions = reporter.StoreOptions().Proto()
+	return collection
+}
+
+// EnableStoreOptions enables full-text search or JSON on a collection's
+// store, backfilling the full-text index from the records already stored,
+// and records the new options in the collection's metadata. Collections on
+// the repository's shared store share its options, so all of them are
+// updated.
+func (r *DefaultCollectionRepo) EnableStoreOptions(ctx context.Context, namespace, name string, enable *pb.StoreOptions) (*pb.StoreOptions, int64, error) {
+	namespace = r.aliases.Resolve(namespace)
+	key := namespace + "/" + name
+	r.service.mu.RLock()
+	_, exists := r.service.collections[key]
+	r.service.mu.RUnlock()
+	if !exists {
+		return nil, 0, fmt.Errorf("collection %s not found", key)
+	}
+	if _, temporary, _ := r.temps.storeFor(key); temporary {
+		return nil, 0, fmt.Errorf("temporary collection %s cannot be upgraded", key)
+	}
+
+	store := r.store
+	moved, _, _ := r.storageFor(key)
+	if moved != nil {
+		store = moved.store
+	}
+	upgrader, ok := store.(StoreUpgrader)
+	if !ok {
+		return nil, 0, ErrStoreNotUpgradable
+	}
+	indexed, err := upgrader.Upgrade(ctx, Options{EnableFTS: enable.GetEnableFts(), EnableJSON: enable.GetEnableJson()})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to upgrade store: %w", err)
+	}
+	var opts *pb.StoreOptions
+	if reporter, ok := store.(OptionsReporter); ok {
+		opts = reporter.StoreOptions().Proto()
+	}
+
+	// Record the options on every collection the store holds
+	r.service.mu.Lock()
+	for k, meta := range r.service.collections {
+		if k != key {
+			if moved != nil || meta.StoragePath != "" || meta.GetTemporary() != nil {
+				continue
+			}
+		}
+		updated := proto.Clone(meta).(*pb.Collection)
+		updated.StoreOptions = opts
+		r.service.collections[k] = updated
+	}
+	r.service.changed()
+	r.service.mu.Unlock()
+	return opts, indexed, nil
+}
+
+// EnableStoreOptions turns on store features a collection was created
+// without.
+func (s *GrpcServer) EnableStoreOptions(ctx context.Context, req *pb.EnableStoreOptionsRequest) (*pb.EnableStoreOptionsResponse, error) {
+	if req.Collection == nil || req.Collection.Namespace == "" || req.Collection.Name == "" {
+		return &pb.EnableStoreOptionsResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection namespace and name are required"},
+		}, nil
+	}
+	repo, ok := s.repo.(*DefaultCollectionRepo)
+	if !ok {
+		return &pb.EnableStoreOptionsResponse{
+			Status: &pb.Status{Code: pb.Status_UNIMPLEMENTED, Message: "repository cannot upgrade stores"},
+		}, nil
+	}
+	if _, err := repo.GetCollection(ctx, req.Collection.Namespace, req.Collection.Name); err != nil {
+		return &pb.EnableStoreOptionsResponse{Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: err.Error()}}, nil
+	}
+	opts, indexed, err := repo.EnableStoreOptions(ctx, req.Collection.Namespace, req.Collection.Name,
+		&pb.StoreOptions{EnableFts: req.EnableFts, EnableJson: req.EnableJson})
+	if err != nil {
+		code := pb.Status_INTERNAL
+		if errors.Is(err, ErrStoreNotUpgradable) {
+			code = pb.Status_UNIMPLEMENTED
+		}
+		return &pb.EnableStoreOptionsResponse{Status: &pb.Status{Code: code, Message: err.Error()}}, nil
+	}
+	return &pb.EnableStoreOptionsResponse{
+		Status:         &pb.Status{Code: pb.Status_OK, Message: fmt.Sprintf("indexed %d records", indexed)},
+		StoreOptions:   opts,
+		RecordsIndexed: indexed,
+	}, nil
+}
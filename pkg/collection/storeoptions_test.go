@@ -0,0 +1,75 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+)
+
+func TestEnableStoreOptionsBackfillsFullText(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := sqlite.NewSqliteStore(filepath.Join(dir, "repo.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	repo := collection.NewCollectionRepo(store)
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+	server := collection.NewGrpcServerWithDataDir(repo, dir)
+
+	for _, name := range []string{"notes", "other"} {
+		if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: name}); err != nil {
+			t.Fatalf("failed to create collection: %v", err)
+		}
+	}
+	notes, _ := repo.GetCollection(ctx, "test", "notes")
+	if opts := notes.Meta.GetStoreOptions(); opts == nil || opts.EnableFts || !opts.EnableJson {
+		t.Fatalf("expected the store's options recorded at creation, got %v", opts)
+	}
+	for i := 0; i < 3; i++ {
+		if err := notes.CreateRecord(ctx, &pb.CollectionRecord{Id: fmt.Sprintf("n%d", i), ProtoData: []byte(`{"text": "quarterly report"}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	resp, _ := server.EnableStoreOptions(ctx, &pb.EnableStoreOptionsRequest{
+		Collection: &pb.NamespacedName{Namespace: "test", Name: "notes"},
+		EnableFts:  true,
+	})
+	if resp.Status.Code != pb.Status_OK || resp.RecordsIndexed != 3 || !resp.StoreOptions.GetEnableFts() {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	results, err := notes.Search(ctx, &collection.SearchQuery{FullText: "quarterly"})
+	if err != nil || len(results) != 3 {
+		t.Fatalf("expected backfilled records to be searchable, got %d (%v)", len(results), err)
+	}
+
+	// The shared store's other collections have it too
+	other, _ := repo.GetCollection(ctx, "test", "other")
+	if !other.Meta.GetStoreOptions().GetEnableFts() {
+		t.Error("expected every collection on the shared store to record full-text search")
+	}
+
+	// A moved store is opened with the recorded options, not the opener's
+	if _, err := repo.MoveStorage(ctx, "test", "notes", filepath.Join(dir, "moved")); err != nil {
+		t.Fatalf("MoveStorage failed: %v", err)
+	}
+	moved, _ := repo.GetCollection(ctx, "test", "notes")
+	if results, err := moved.Search(ctx, &collection.SearchQuery{FullText: "quarterly"}); err != nil || len(results) != 3 {
+		t.Errorf("expected full-text search on the moved store, got %d (%v)", len(results), err)
+	}
+
+	resp, _ = server.EnableStoreOptions(ctx, &pb.EnableStoreOptionsRequest{
+		Collection: &pb.NamespacedName{Namespace: "test", Name: "missing"},
+		EnableFts:  true,
+	})
+	if resp.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND, got %v", resp.Status)
+	}
+}
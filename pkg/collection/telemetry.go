@@ -0,0 +1,190 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/jobs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultStateSampleInterval is how often SubscribeState checks the
+// collector's state for changes when the subscriber does not say.
+const DefaultStateSampleInterval = time.Second
+
+// minStateSampleInterval bounds how often a subscriber can have state read.
+const minStateSampleInterval = 100 * time.Millisecond
+
+// finishedJobWindow is how long finished jobs stay in the state, so
+// subscribers see how they ended.
+const finishedJobWindow = time.Minute
+
+// stateSampler reads the collector's state for one subscription as values
+// by path. Collections are reread only when Discover's etag moves.
+type stateSampler struct {
+	server      *GrpcServer
+	prefixes    []string
+	etag        string
+	collections map[string]*structpb.Value
+}
+
+// sample returns the state under the subscription's prefixes.
+func (ss *stateSampler) sample(ctx context.Context) (map[string]*structpb.Value, error) {
+	if err := ss.sampleCollections(ctx); err != nil {
+		return nil, err
+	}
+	state := make(map[string]*structpb.Value)
+	maps.Copy(state, ss.collections)
+
+	if pool := ss.server.cloneManager.pool; pool != nil {
+		for _, peer := range pool.Stats() {
+			prefix := "connections/" + peer.Address + "/"
+			state[prefix+"channels"] = structpb.NewNumberValue(float64(peer.Channels))
+			state[prefix+"active_calls"] = structpb.NewNumberValue(float64(peer.ActiveCalls))
+		}
+	}
+
+	all, err := ss.server.jobs.List(ctx, jobs.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-finishedJobWindow).Unix()
+	for _, job := range all {
+		if jobs.Finished(job.State) && job.FinishedAt < cutoff {
+			continue
+		}
+		prefix := "jobs/" + job.JobId + "/"
+		state[prefix+"kind"] = structpb.NewStringValue(job.Kind)
+		state[prefix+"state"] = structpb.NewStringValue(job.State.String())
+		state[prefix+"attempts"] = structpb.NewNumberValue(float64(job.Attempts))
+		state[prefix+"progress_done"] = structpb.NewNumberValue(float64(job.ProgressDone))
+		state[prefix+"progress_total"] = structpb.NewNumberValue(float64(job.ProgressTotal))
+		if job.Error != "" {
+			state[prefix+"error"] = structpb.NewStringValue(job.Error)
+		}
+	}
+
+	for path := range state {
+		if !ss.watches(path) {
+			delete(state, path)
+		}
+	}
+	return state, nil
+}
+
+// sampleCollections rereads the collection listing if it has changed since
+// the last sample.
+func (ss *stateSampler) sampleCollections(ctx context.Context) error {
+	collections := make(map[string]*structpb.Value)
+	req := &pb.DiscoverRequest{PageSize: 1000, IfNoneMatch: ss.etag}
+	for {
+		resp, err := ss.server.repo.Discover(ctx, req)
+		if err != nil {
+			return err
+		}
+		if resp.NotModified {
+			return nil
+		}
+		if resp.Status != nil && resp.Status.Code != 200 {
+			return fmt.Errorf("failed to list collections: %s", resp.Status.Message)
+		}
+		if req.PageToken == "" {
+			ss.etag = resp.Etag
+		}
+		for _, coll := range resp.Collections {
+			prefix := "collections/" + coll.Namespace + "/" + coll.Name + "/"
+			collections[prefix+"message_type"] = structpb.NewStringValue(coll.MessageType.GetMessageName())
+			collections[prefix+"server_endpoint"] = structpb.NewStringValue(coll.ServerEndpoint)
+			collections[prefix+"storage_path"] = structpb.NewStringValue(coll.StoragePath)
+			collections[prefix+"replicas"] = structpb.NewNumberValue(float64(len(coll.Replicas)))
+			collections[prefix+"temporary"] = structpb.NewBoolValue(coll.Temporary != nil)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		req = &pb.DiscoverRequest{PageSize: req.PageSize, PageToken: resp.NextPageToken}
+	}
+	ss.collections = collections
+	return nil
+}
+
+// watches reports whether path is under one of the subscription's prefixes.
+func (ss *stateSampler) watches(path string) bool {
+	if len(ss.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range ss.prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// diffState returns the updates that turn prev into next, by path.
+func diffState(prev, next map[string]*structpb.Value) []*pb.StateUpdate {
+	var updates []*pb.StateUpdate
+	for path, value := range next {
+		if old, ok := prev[path]; !ok || !proto.Equal(old, value) {
+			updates = append(updates, &pb.StateUpdate{Path: path, Value: value})
+		}
+	}
+	for path := range prev {
+		if _, ok := next[path]; !ok {
+			updates = append(updates, &pb.StateUpdate{Path: path, Deleted: true})
+		}
+	}
+	slices.SortFunc(updates, func(a, b *pb.StateUpdate) int { return strings.Compare(a.Path, b.Path) })
+	return updates
+}
+
+// SubscribeState streams the collector's collections, peer connections and
+// jobs: the whole state first, then what changed each time it is sampled,
+// until the client goes away. Jobs stay for a minute after finishing.
+func (s *GrpcServer) SubscribeState(req *pb.SubscribeStateRequest, stream pb.CollectionRepo_SubscribeStateServer) error {
+	if req.SampleIntervalMs < 0 {
+		return status.Error(codes.InvalidArgument, "sample_interval_ms must not be negative")
+	}
+	interval := DefaultStateSampleInterval
+	if req.SampleIntervalMs > 0 {
+		interval = max(time.Duration(req.SampleIntervalMs)*time.Millisecond, minStateSampleInterval)
+	}
+
+	ctx := stream.Context()
+	sampler := &stateSampler{server: s, prefixes: req.Prefixes}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var prev map[string]*structpb.Value
+	for {
+		next, err := sampler.sample(ctx)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to read collector state: %v", err)
+		}
+		if updates := diffState(prev, next); prev == nil || len(updates) > 0 {
+			if err := stream.Send(&pb.StateNotification{
+				Timestamp:    timestamppb.Now(),
+				Updates:      updates,
+				SyncComplete: prev == nil,
+			}); err != nil {
+				return err
+			}
+		}
+		prev = next
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
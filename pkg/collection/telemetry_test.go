@@ -0,0 +1,90 @@
+package collection_test
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestSubscribeState(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	repo, server, addr := startRepoServer(t)
+	aliases := collection.NewNamespaceAliases()
+	repo.(*collection.DefaultCollectionRepo).SetNamespaceAliases(aliases)
+	server.SetNamespaceAliases(aliases, repo.(*collection.DefaultCollectionRepo))
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "prod", Name: "users", MessageType: &pb.MessageTypeRef{MessageName: "User"}}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	stream, err := pb.NewCollectionRepoClient(conn).SubscribeState(ctx, &pb.SubscribeStateRequest{Prefixes: []string{"collections"}, SampleIntervalMs: 100})
+	if err != nil {
+		t.Fatalf("SubscribeState failed: %v", err)
+	}
+	recv := func() map[string]*pb.StateUpdate {
+		t.Helper()
+		notification, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		updates := make(map[string]*pb.StateUpdate)
+		for _, update := range notification.Updates {
+			updates[update.Path] = update
+		}
+		return updates
+	}
+
+	// The whole state comes first
+	first, err := stream.Recv()
+	if err != nil || !first.SyncComplete {
+		t.Fatalf("expected the full state first, got %v %v", first, err)
+	}
+	var sawUsers bool
+	for _, update := range first.Updates {
+		if update.Path == "collections/prod/users/message_type" {
+			sawUsers = update.Value.GetStringValue() == "User"
+		}
+	}
+	if !sawUsers {
+		t.Errorf("expected prod/users in the full state, got %v", first.Updates)
+	}
+
+	// Then only changes: a new collection, and a renamed namespace's
+	// collections removed from the old name
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "prod", Name: "orders"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	updates := recv()
+	if len(updates) != 5 || updates["collections/prod/orders/replicas"].GetValue().GetNumberValue() != 0 {
+		t.Errorf("expected only prod/orders added, got %v", updates)
+	}
+
+	if resp, err := server.RenameNamespace(ctx, &pb.RenameNamespaceRequest{From: "prod", To: "live"}); err != nil || resp.Status.Code != pb.Status_OK {
+		t.Fatalf("RenameNamespace failed: %v %v", resp, err)
+	}
+	// The rename may land across samples
+	updates = recv()
+	for !updates["collections/prod/users/message_type"].GetDeleted() || updates["collections/live/users/message_type"] == nil {
+		maps.Copy(updates, recv())
+	}
+	if updates["collections/live/users/message_type"].GetValue().GetStringValue() != "User" {
+		t.Errorf("expected prod/users moved to live/users, got %v", updates)
+	}
+	for path, update := range updates {
+		if !strings.HasPrefix(path, "collections/") {
+			t.Errorf("expected only collections, got %v", update)
+		}
+	}
+}
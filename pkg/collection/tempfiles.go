@@ -0,0 +1,213 @@
+package collection
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTempFileMaxAge is how long a temp file goes unmodified before a
+	// TempFileSweeper treats it as orphaned.
+	DefaultTempFileMaxAge = time.Hour
+	// DefaultTempFileSweepInterval is how often Start sweeps.
+	DefaultTempFileSweepInterval = 10 * time.Minute
+)
+
+// TempFileSweeperOptions configures a TempFileSweeper. Zero fields take their
+// defaults.
+type TempFileSweeperOptions struct {
+	// MaxAge is how long a temp file must go unmodified to be removed.
+	// Transfers write to their temp file as data arrives, so only transfers
+	// stalled for this long lose theirs.
+	MaxAge time.Duration
+	// Interval is how often Start sweeps.
+	Interval time.Duration
+	// Now reads the clock; it defaults to time.Now.
+	Now func() time.Time
+}
+
+// WithDefaults returns o with zero fields set to their defaults.
+func (o TempFileSweeperOptions) WithDefaults() TempFileSweeperOptions {
+	if o.MaxAge <= 0 {
+		o.MaxAge = DefaultTempFileMaxAge
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultTempFileSweepInterval
+	}
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+	return o
+}
+
+// TempFileSweeper removes the .tmp files that clones, fetches and pushes
+// interrupted by a crash or restart leave behind in the collections
+// directory. Transfers that fail while the collector is running remove
+// their own.
+type TempFileSweeper struct {
+	dirs []string
+	opts TempFileSweeperOptions
+
+	mu             sync.Mutex
+	sweeps         int64
+	reclaimedFiles int64
+	reclaimedBytes int64
+	failures       int64 // Temp files that could not be removed
+	lastSweep      time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewTempFileSweeper creates a sweeper for the given directories, such as
+// <data dir>/collections.
+func NewTempFileSweeper(dirs []string, opts TempFileSweeperOptions) *TempFileSweeper {
+	return &TempFileSweeper{dirs: dirs, opts: opts.WithDefaults()}
+}
+
+// Sweep removes temp files older than MaxAge under the sweeper's directories
+// and returns how many it removed and the bytes they held. Directories that
+// do not exist yet are skipped.
+func (s *TempFileSweeper) Sweep() (files, bytes int64, err error) {
+	cutoff := s.opts.Now().Add(-s.opts.MaxAge)
+	var failures int64
+	for _, dir := range s.dirs {
+		walkErr := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() || !strings.HasSuffix(d.Name(), ".tmp") {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				// Renamed into place since the directory was read
+				return nil
+			}
+			if info.ModTime().After(cutoff) {
+				return nil
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Warning: failed to remove orphaned temp file %s: %v", path, err)
+				failures++
+				return nil
+			}
+			files, bytes = files+1, bytes+info.Size()
+			return nil
+		})
+		if walkErr != nil && err == nil {
+			err = fmt.Errorf("sweep %s: %w", dir, walkErr)
+		}
+	}
+
+	s.mu.Lock()
+	s.sweeps++
+	s.reclaimedFiles += files
+	s.reclaimedBytes += bytes
+	s.failures += failures
+	s.lastSweep = s.opts.Now()
+	s.mu.Unlock()
+	if files > 0 {
+		log.Printf("Removed %d orphaned temp files (%d bytes)", files, bytes)
+	}
+	return files, bytes, err
+}
+
+// Stats reports the sweeps run and what they reclaimed, for ServerResources.
+func (s *TempFileSweeper) Stats() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := map[string]int64{
+		"sweeps":          s.sweeps,
+		"reclaimed_files": s.reclaimedFiles,
+		"reclaimed_bytes": s.reclaimedBytes,
+		"failed_removals": s.failures,
+	}
+	if !s.lastSweep.IsZero() {
+		stats["last_sweep_unix"] = s.lastSweep.Unix()
+	}
+	return stats
+}
+
+// MetricsHandler serves the sweeper's counters in the Prometheus text format.
+func (s *TempFileSweeper) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := s.Stats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprintf(w, "# HELP collector_temp_files_reclaimed_total Orphaned temp files removed.\n")
+		fmt.Fprintf(w, "# TYPE collector_temp_files_reclaimed_total counter\n")
+		fmt.Fprintf(w, "collector_temp_files_reclaimed_total %d\n", stats["reclaimed_files"])
+		fmt.Fprintf(w, "# HELP collector_temp_bytes_reclaimed_total Bytes freed by removing orphaned temp files.\n")
+		fmt.Fprintf(w, "# TYPE collector_temp_bytes_reclaimed_total counter\n")
+		fmt.Fprintf(w, "collector_temp_bytes_reclaimed_total %d\n", stats["reclaimed_bytes"])
+		fmt.Fprintf(w, "# HELP collector_temp_file_sweeps_total Temp file sweeps run.\n")
+		fmt.Fprintf(w, "# TYPE collector_temp_file_sweeps_total counter\n")
+		fmt.Fprintf(w, "collector_temp_file_sweeps_total %d\n", stats["sweeps"])
+	})
+}
+
+// Start sweeps now and then every interval until Stop.
+func (s *TempFileSweeper) Start() {
+	s.mu.Lock()
+	if s.stop != nil {
+		s.mu.Unlock()
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	s.stop, s.done = stop, done
+	s.mu.Unlock()
+
+	s.sweep()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(s.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			s.sweep()
+		}
+	}()
+}
+
+func (s *TempFileSweeper) sweep() {
+	if _, _, err := s.Sweep(); err != nil {
+		log.Printf("Warning: temp file sweep failed: %v", err)
+	}
+}
+
+// Stop ends the Start loop.
+func (s *TempFileSweeper) Stop() {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// String describes the sweeper, for logs.
+func (s *TempFileSweeper) String() string {
+	return fmt.Sprintf("%s (older than %s, every %s)", strings.Join(s.dirs, ", "), s.opts.MaxAge, s.opts.Interval)
+}
+
+// SetTempFileSweeper reports sweeper's counters in ServerResources. The
+// sweeper must be started separately.
+func (s *GrpcServer) SetTempFileSweeper(sweeper *TempFileSweeper) {
+	s.tempFiles = sweeper
+}
@@ -0,0 +1,87 @@
+package collection_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestTempFileSweeperRemovesOrphans(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "collections")
+	old := time.Now().Add(-2 * time.Hour)
+	files := map[string]time.Time{
+		"prod/users.db.tmp":   old,        // Interrupted fetch
+		"prod/orders.db.tmp":  time.Now(), // Transfer still writing
+		"prod/users.db":       old,        // Not a temp file
+		"stage/events.db.tmp": old,
+	}
+	for name, mtime := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sweeper := collection.NewTempFileSweeper([]string{dir, filepath.Join(t.TempDir(), "missing")}, collection.TempFileSweeperOptions{})
+	removed, bytes, err := sweeper.Sweep()
+	if err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+	if removed != 2 || bytes != 20 {
+		t.Errorf("expected 2 files and 20 bytes reclaimed, got %d and %d", removed, bytes)
+	}
+	for name, gone := range map[string]bool{
+		"prod/users.db.tmp":   true,
+		"stage/events.db.tmp": true,
+		"prod/orders.db.tmp":  false,
+		"prod/users.db":       false,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if gone != os.IsNotExist(err) {
+			t.Errorf("%s: expected removed=%v, got %v", name, gone, err)
+		}
+	}
+
+	// Nothing left to reclaim; the counters keep the totals
+	if removed, _, _ := sweeper.Sweep(); removed != 0 {
+		t.Errorf("expected nothing reclaimed on the second sweep, got %d", removed)
+	}
+	stats := sweeper.Stats()
+	if stats["sweeps"] != 2 || stats["reclaimed_files"] != 2 || stats["reclaimed_bytes"] != 20 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+
+	rec := httptest.NewRecorder()
+	sweeper.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "collector_temp_bytes_reclaimed_total 20\n") {
+		t.Errorf("expected reclaimed bytes in metrics, got:\n%s", rec.Body.String())
+	}
+
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewGrpcServerWithDataDir(repo, t.TempDir())
+	server.SetTempFileSweeper(sweeper)
+	resp, _ := server.ServerResources(context.Background(), &pb.ServerResourcesRequest{})
+	var found bool
+	for _, sub := range resp.Subsystems {
+		if sub.Name == "temp_files" {
+			found = sub.Counts["reclaimed_files"] == 2
+		}
+	}
+	if !found {
+		t.Errorf("expected temp_files usage in ServerResources, got %v", resp.Subsystems)
+	}
+}
@@ -0,0 +1,222 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultTempReapInterval is how often expired temporary collections are
+// dropped.
+const DefaultTempReapInterval = time.Minute
+
+// ErrTemporaryUnavailable is returned when creating a temporary collection in
+// a repository without a TempStoreFactory.
+var ErrTemporaryUnavailable = errors.New("temporary collections are not enabled")
+
+// TempStoreFactory opens the store of a new temporary collection, in memory or
+// in a temporary file. name is unique among temporary collections; release
+// closes the store and deletes its data.
+type TempStoreFactory func(name string, inMemory bool) (store Store, release func() error, err error)
+
+// TempCollections tracks a repository's temporary collections: collections
+// created with Collection.temporary set, each on a store of its own, that are
+// dropped with their records when their TTL passes or their session ends.
+// Expired collections disappear from GetCollection at once and are dropped by
+// Reap, which Start runs periodically.
+type TempCollections struct {
+	repo    *DefaultCollectionRepo
+	factory TempStoreFactory
+
+	mu    sync.Mutex
+	temps map[string]*tempCollection // by namespace/name
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type tempCollection struct {
+	meta    *pb.Collection
+	store   Store
+	release func() error
+}
+
+func (t *tempCollection) expired(now time.Time) bool {
+	expiresAt := t.meta.Temporary.GetExpiresAt()
+	return expiresAt != nil && !now.Before(expiresAt.AsTime())
+}
+
+func newTempCollections(repo *DefaultCollectionRepo) *TempCollections {
+	return &TempCollections{repo: repo, temps: make(map[string]*tempCollection)}
+}
+
+// now returns the time from the repository's clock, by which TTLs run.
+func (tc *TempCollections) now() time.Time {
+	if tc.repo.clock != nil {
+		return tc.repo.clock.Now()
+	}
+	return time.Now()
+}
+
+// create opens a store for a temporary collection and registers it.
+func (tc *TempCollections) create(ctx context.Context, meta *pb.Collection) (*pb.CreateCollectionResponse, error) {
+	cfg := meta.Temporary
+	if tc.factory == nil {
+		return nil, ErrTemporaryUnavailable
+	}
+	if cfg.SessionId == "" && cfg.TtlMs <= 0 {
+		return nil, fmt.Errorf("temporary collections need a session_id or a positive ttl_ms")
+	}
+	if cfg.TtlMs > 0 {
+		cfg.ExpiresAt = timestamppb.New(tc.now().Add(time.Duration(cfg.TtlMs) * time.Millisecond))
+	}
+
+	store, release, err := tc.factory("temp-"+uuid.New().String(), cfg.InMemory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open temporary store: %w", err)
+	}
+	resp, err := tc.repo.service.CreateCollection(ctx, meta)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	tc.mu.Lock()
+	tc.temps[meta.Namespace+"/"+meta.Name] = &tempCollection{meta: meta, store: store, release: release}
+	tc.mu.Unlock()
+	return resp, nil
+}
+
+// storeFor returns the store of a live temporary collection. It reports
+// expired for one whose TTL has passed, which is dropped.
+func (tc *TempCollections) storeFor(key string) (store Store, ok, expired bool) {
+	tc.mu.Lock()
+	t, ok := tc.temps[key]
+	tc.mu.Unlock()
+	if !ok {
+		return nil, false, false
+	}
+	if t.expired(tc.now()) {
+		tc.drop(key)
+		return nil, true, true
+	}
+	return t.store, true, false
+}
+
+// drop unregisters a temporary collection and releases its store.
+func (tc *TempCollections) drop(key string) *pb.NamespacedName {
+	tc.mu.Lock()
+	t, ok := tc.temps[key]
+	delete(tc.temps, key)
+	tc.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	tc.repo.service.removeCollection(key)
+	if err := t.release(); err != nil {
+		log.Printf("Warning: failed to release temporary collection %s: %v", key, err)
+	}
+	return &pb.NamespacedName{Namespace: t.meta.Namespace, Name: t.meta.Name}
+}
+
+// dropWhere drops the temporary collections that match, in name order.
+func (tc *TempCollections) dropWhere(match func(*tempCollection) bool) []*pb.NamespacedName {
+	tc.mu.Lock()
+	var keys []string
+	for key, t := range tc.temps {
+		if match(t) {
+			keys = append(keys, key)
+		}
+	}
+	tc.mu.Unlock()
+	sort.Strings(keys)
+
+	var dropped []*pb.NamespacedName
+	for _, key := range keys {
+		if name := tc.drop(key); name != nil {
+			dropped = append(dropped, name)
+		}
+	}
+	return dropped
+}
+
+// EndSession drops the temporary collections of a session and returns their
+// names.
+func (tc *TempCollections) EndSession(sessionID string) []*pb.NamespacedName {
+	if sessionID == "" {
+		return nil
+	}
+	return tc.dropWhere(func(t *tempCollection) bool { return t.meta.Temporary.SessionId == sessionID })
+}
+
+// Reap drops the temporary collections whose TTL has passed and returns their
+// names.
+func (tc *TempCollections) Reap() []*pb.NamespacedName {
+	now := tc.now()
+	return tc.dropWhere(func(t *tempCollection) bool { return t.expired(now) })
+}
+
+// Close drops every temporary collection, e.g. on shutdown.
+func (tc *TempCollections) Close() {
+	tc.Stop()
+	tc.dropWhere(func(*tempCollection) bool { return true })
+}
+
+// Start runs Reap every interval until Stop.
+func (tc *TempCollections) Start(interval time.Duration) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.stop != nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	tc.stop, tc.done = stop, done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			tc.Reap()
+		}
+	}()
+}
+
+// Stop ends the Start loop.
+func (tc *TempCollections) Stop() {
+	tc.mu.Lock()
+	stop, done := tc.stop, tc.done
+	tc.stop, tc.done = nil, nil
+	tc.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// EndSession drops the temporary collections of a client session.
+func (s *GrpcServer) EndSession(ctx context.Context, req *pb.EndSessionRequest) (*pb.EndSessionResponse, error) {
+	repo, ok := s.repo.(*DefaultCollectionRepo)
+	if !ok {
+		return &pb.EndSessionResponse{Status: &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: ErrTemporaryUnavailable.Error()}}, nil
+	}
+	if req.SessionId == "" {
+		return &pb.EndSessionResponse{Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "session_id is required"}}, nil
+	}
+	dropped := repo.Temporary().EndSession(req.SessionId)
+	return &pb.EndSessionResponse{Status: &pb.Status{Code: pb.Status_OK}, Dropped: dropped}, nil
+}
@@ -0,0 +1,94 @@
+package collection_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+)
+
+func TestTemporaryCollections(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	clock := collection.NewFixedClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	repo.SetClock(clock)
+	tempDir := filepath.Join(t.TempDir(), "temp")
+	repo.SetTempStoreFactory(sqlite.TempStoreFactory(tempDir, collection.Options{EnableJSON: true}))
+	defer repo.Temporary().Close()
+
+	create := func(name string, cfg *pb.TemporaryConfig) *collection.Collection {
+		t.Helper()
+		if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "scratch", Name: name, Temporary: cfg}); err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		coll, err := repo.GetCollection(ctx, "scratch", name)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", name, err)
+		}
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "r1", ProtoData: []byte(`{"n": 1}`)}); err != nil {
+			t.Fatalf("failed to write to %s: %v", name, err)
+		}
+		return coll
+	}
+	onDisk := create("on-disk", &pb.TemporaryConfig{SessionId: "s1"})
+	inMemory := create("in-memory", &pb.TemporaryConfig{SessionId: "s1", InMemory: true})
+	short := create("short", &pb.TemporaryConfig{TtlMs: 50, InMemory: true})
+
+	// Each temporary collection has a store of its own
+	if onDisk.Store == inMemory.Store {
+		t.Error("expected temporary collections not to share a store")
+	}
+	if n, _ := inMemory.CountRecords(ctx); n != 1 {
+		t.Errorf("expected 1 record in memory, got %d", n)
+	}
+	files, _ := filepath.Glob(filepath.Join(tempDir, "*.db"))
+	if len(files) != 1 {
+		t.Fatalf("expected one temporary database file, got %v", files)
+	}
+
+	clock.Advance(80 * time.Millisecond)
+	if _, err := repo.GetCollection(ctx, "scratch", "short"); err == nil {
+		t.Error("expected an expired collection to be gone")
+	}
+	if _, err := short.CountRecords(ctx); err == nil {
+		t.Error("expected the expired collection's store to be released")
+	}
+
+	server := collection.NewGrpcServer(repo)
+	resp, err := server.EndSession(ctx, &pb.EndSessionRequest{SessionId: "s1"})
+	if err != nil || resp.Status.Code != pb.Status_OK || len(resp.Dropped) != 2 {
+		t.Fatalf("EndSession returned %v, %v", resp, err)
+	}
+	for _, name := range []string{"on-disk", "in-memory"} {
+		if _, err := repo.GetCollection(ctx, "scratch", name); err == nil {
+			t.Errorf("expected %s to be dropped with its session", name)
+		}
+	}
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary database file to be deleted, got %v", err)
+	}
+
+	// A dropped name can be reused
+	create("on-disk", &pb.TemporaryConfig{SessionId: "s2"})
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "scratch", Name: "unbound", Temporary: &pb.TemporaryConfig{}}); err == nil {
+		t.Error("expected a temporary collection without session or TTL to be refused")
+	}
+}
+
+func TestTemporaryCollections_Disabled(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	_, err := repo.CreateCollection(context.Background(), &pb.Collection{
+		Namespace: "scratch", Name: "tmp", Temporary: &pb.TemporaryConfig{TtlMs: 1000},
+	})
+	if err == nil {
+		t.Error("expected temporary collections to need a store factory")
+	}
+}
@@ -0,0 +1,82 @@
+package collection
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"strings"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// DefaultThumbnailSize is the default bound on a thumbnail's longer side.
+const DefaultThumbnailSize = 256
+
+// ThumbnailProcessor derives a PNG thumbnail ("<name>.thumb.png") from PNG,
+// JPEG and GIF attachments.
+type ThumbnailProcessor struct {
+	// MaxSize bounds the thumbnail's longer side in pixels; images already
+	// within it are copied at their original size.
+	MaxSize int
+}
+
+func (t *ThumbnailProcessor) Name() string { return "thumbnail" }
+
+func (t *ThumbnailProcessor) Accepts(contentType string) bool {
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+func (t *ThumbnailProcessor) Process(ctx context.Context, src *pb.Attachment, content []byte) ([]DerivedFile, error) {
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	maxSize := t.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultThumbnailSize
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleImage(img, maxSize)); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return []DerivedFile{{Name: "thumb.png", ContentType: "image/png", Content: buf.Bytes()}}, nil
+}
+
+// scaleImage shrinks img so its longer side is at most maxSize, using
+// nearest-neighbor sampling.
+func scaleImage(img image.Image, maxSize int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSize && h <= maxSize {
+		return img
+	}
+
+	tw, th := maxSize, h*maxSize/w
+	if h > w {
+		tw, th = w*maxSize/h, maxSize
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			dst.Set(x, y, img.At(b.Min.X+x*w/tw, b.Min.Y+y*h/th))
+		}
+	}
+	return dst
+}
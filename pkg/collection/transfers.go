@@ -0,0 +1,150 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/jobs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// validateTransfer checks a StartTransferRequest and returns the job it runs.
+func validateTransfer(req *pb.StartTransferRequest) (string, proto.Message, error) {
+	switch {
+	case req.GetClone() != nil:
+		clone := req.GetClone()
+		if clone.SourceCollection == nil || clone.DestEndpoint == "" {
+			return "", nil, fmt.Errorf("clone transfers need source_collection and dest_endpoint")
+		}
+		if clone.FullText != "" || len(clone.Filters) > 0 {
+			return "", nil, fmt.Errorf("record filters are only supported for local clones")
+		}
+		return JobKindClone, clone, nil
+	case req.GetFetch() != nil:
+		fetch := req.GetFetch()
+		if fetch.SourceEndpoint == "" || fetch.SourceCollection == nil || fetch.DestNamespace == "" || fetch.DestName == "" {
+			return "", nil, fmt.Errorf("fetch transfers need source_endpoint, source_collection, dest_namespace and dest_name")
+		}
+		return JobKindFetch, fetch, nil
+	default:
+		return "", nil, fmt.Errorf("one of clone and fetch is required")
+	}
+}
+
+// transferFromJob presents a clone or fetch job as a transfer.
+func transferFromJob(job *pb.Job) *pb.TransferJob {
+	t := &pb.TransferJob{
+		JobId:            job.JobId,
+		BytesTransferred: job.ProgressDone,
+		TotalBytes:       job.ProgressTotal,
+		CreatedAt:        job.CreatedAt,
+		StartedAt:        job.StartedAt,
+		FinishedAt:       job.FinishedAt,
+		Error:            job.Error,
+	}
+	switch job.State {
+	case pb.JobState_JOB_PENDING:
+		t.State = pb.TransferState_TRANSFER_PENDING
+	case pb.JobState_JOB_SUCCEEDED:
+		t.State, t.Error = pb.TransferState_TRANSFER_SUCCEEDED, ""
+	case pb.JobState_JOB_FAILED:
+		t.State = pb.TransferState_TRANSFER_FAILED
+	case pb.JobState_JOB_CANCELLED:
+		t.State = pb.TransferState_TRANSFER_CANCELLED
+	default:
+		t.State = pb.TransferState_TRANSFER_RUNNING
+	}
+
+	params, _ := job.Params.UnmarshalNew()
+	result, _ := job.Result.UnmarshalNew()
+	switch req := params.(type) {
+	case *pb.CloneRequest:
+		t.Request = &pb.TransferJob_Clone{Clone: req}
+	case *pb.FetchRequest:
+		t.Request = &pb.TransferJob_Fetch{Fetch: req}
+	}
+	switch resp := result.(type) {
+	case *pb.CloneResponse:
+		t.CollectionId, t.RecordsTransferred, t.FilesTransferred = resp.CollectionId, resp.RecordsCloned, resp.FilesCloned
+	case *pb.FetchResponse:
+		t.CollectionId, t.RecordsTransferred, t.FilesTransferred = resp.CollectionId, resp.RecordsFetched, resp.FilesFetched
+	}
+	return t
+}
+
+// transferJob returns the job behind a transfer ID, or jobs.ErrNotFound if it
+// is not a clone or fetch job.
+func (s *GrpcServer) transferJob(ctx context.Context, id string) (*pb.Job, error) {
+	job, err := s.jobs.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Kind != JobKindClone && job.Kind != JobKindFetch {
+		return nil, jobs.ErrNotFound
+	}
+	return job, nil
+}
+
+// StartTransfer starts a remote clone or fetch as a background job (see
+// JobKindClone and JobKindFetch), so a multi-hour transfer is tracked by job
+// ID instead of an open client RPC.
+func (s *GrpcServer) StartTransfer(ctx context.Context, req *pb.StartTransferRequest) (*pb.StartTransferResponse, error) {
+	kind, params, err := validateTransfer(req)
+	if err != nil {
+		return &pb.StartTransferResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: err.Error()},
+		}, nil
+	}
+
+	job, err := s.jobs.Submit(ctx, kind, params, jobs.SubmitOptions{})
+	if err != nil {
+		return &pb.StartTransferResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()},
+		}, nil
+	}
+	return &pb.StartTransferResponse{
+		Status: &pb.Status{Code: pb.Status_OK, Message: "Transfer started"},
+		Job:    transferFromJob(job),
+	}, nil
+}
+
+// GetTransfer reports the progress of a transfer job.
+func (s *GrpcServer) GetTransfer(ctx context.Context, req *pb.GetTransferRequest) (*pb.GetTransferResponse, error) {
+	job, err := s.transferJob(ctx, req.JobId)
+	if err != nil {
+		return &pb.GetTransferResponse{Status: jobErrorStatus(err)}, nil
+	}
+	return &pb.GetTransferResponse{Status: &pb.Status{Code: pb.Status_OK}, Job: transferFromJob(job)}, nil
+}
+
+// WatchTransfer streams a transfer job's state until it finishes.
+func (s *GrpcServer) WatchTransfer(req *pb.WatchTransferRequest, stream pb.CollectionRepo_WatchTransferServer) error {
+	if _, err := s.transferJob(stream.Context(), req.JobId); err != nil {
+		if errors.Is(err, jobs.ErrNotFound) {
+			return status.Error(codes.NotFound, err.Error())
+		}
+		return err
+	}
+	return s.jobs.Watch(stream.Context(), req.JobId, func(job *pb.Job) error {
+		return stream.Send(transferFromJob(job))
+	})
+}
+
+// CancelTransfer stops a transfer job.
+func (s *GrpcServer) CancelTransfer(ctx context.Context, req *pb.CancelTransferRequest) (*pb.CancelTransferResponse, error) {
+	if _, err := s.transferJob(ctx, req.JobId); err != nil {
+		return &pb.CancelTransferResponse{Status: jobErrorStatus(err)}, nil
+	}
+	job, err := s.jobs.Cancel(ctx, req.JobId)
+	if err != nil {
+		return &pb.CancelTransferResponse{Status: jobErrorStatus(err)}, nil
+	}
+	return &pb.CancelTransferResponse{
+		Status: &pb.Status{Code: pb.Status_OK, Message: "Transfer stopped"},
+		Job:    transferFromJob(job),
+	}, nil
+}
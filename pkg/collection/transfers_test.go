@@ -0,0 +1,153 @@
+package collection_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// watchTransfer follows a job over gRPC until it finishes and returns its final state.
+func watchTransfer(t *testing.T, addr, jobID string) *pb.TransferJob {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stream, err := pb.NewCollectionRepoClient(conn).WatchTransfer(ctx, &pb.WatchTransferRequest{JobId: jobID})
+	if err != nil {
+		t.Fatalf("WatchTransfer failed: %v", err)
+	}
+
+	var last *pb.TransferJob
+	for {
+		job, err := stream.Recv()
+		if err != nil {
+			break
+		}
+		last = job
+	}
+	if last == nil {
+		t.Fatalf("WatchTransfer sent no updates")
+	}
+	return last
+}
+
+func TestTransfer_FetchInBackground(t *testing.T) {
+	ctx := context.Background()
+	srcRepo, _, srcAddr := startRepoServer(t)
+	dstRepo, dstServer, dstAddr := startRepoServer(t)
+
+	_, err := srcRepo.CreateCollection(ctx, &pb.Collection{Namespace: "prod", Name: "users"})
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	src, _ := srcRepo.GetCollection(ctx, "prod", "users")
+	if err := src.CreateRecord(ctx, &pb.CollectionRecord{Id: "u1", ProtoData: []byte(`{"name": "ada"}`)}); err != nil {
+		t.Fatalf("failed to create record: %v", err)
+	}
+
+	started, err := dstServer.StartTransfer(ctx, &pb.StartTransferRequest{
+		Request: &pb.StartTransferRequest_Fetch{Fetch: &pb.FetchRequest{
+			SourceEndpoint:   srcAddr,
+			SourceCollection: &pb.NamespacedName{Namespace: "prod", Name: "users"},
+			DestNamespace:    "prod",
+			DestName:         "users-copy",
+		}},
+	})
+	if err != nil || started.Status.Code != pb.Status_OK {
+		t.Fatalf("StartTransfer failed: %v (%v)", started, err)
+	}
+
+	job := watchTransfer(t, dstAddr, started.Job.JobId)
+	if job.State != pb.TransferState_TRANSFER_SUCCEEDED {
+		t.Fatalf("expected SUCCEEDED, got %v: %s", job.State, job.Error)
+	}
+	if job.CollectionId != "prod/users-copy" || job.BytesTransferred == 0 || job.FinishedAt == 0 {
+		t.Errorf("unexpected finished job: %v", job)
+	}
+	if _, err := dstRepo.GetCollection(ctx, "prod", "users-copy"); err != nil {
+		t.Errorf("fetched collection not registered: %v", err)
+	}
+
+	got, err := dstServer.GetTransfer(ctx, &pb.GetTransferRequest{JobId: job.JobId})
+	if err != nil || got.Job.GetState() != pb.TransferState_TRANSFER_SUCCEEDED {
+		t.Errorf("GetTransfer did not report the finished job: %v (%v)", got, err)
+	}
+}
+
+func TestTransfer_Cancel(t *testing.T) {
+	ctx := context.Background()
+	_, server, _ := startRepoServer(t)
+
+	// A peer that accepts connections but never speaks gRPC keeps the transfer waiting
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	started, err := server.StartTransfer(ctx, &pb.StartTransferRequest{
+		Request: &pb.StartTransferRequest_Fetch{Fetch: &pb.FetchRequest{
+			SourceEndpoint:   lis.Addr().String(),
+			SourceCollection: &pb.NamespacedName{Namespace: "prod", Name: "users"},
+			DestNamespace:    "prod",
+			DestName:         "users",
+		}},
+	})
+	if err != nil || started.Status.Code != pb.Status_OK {
+		t.Fatalf("StartTransfer failed: %v (%v)", started, err)
+	}
+
+	cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := server.CancelTransfer(cancelCtx, &pb.CancelTransferRequest{JobId: started.Job.JobId})
+	if err != nil || resp.Job.GetState() != pb.TransferState_TRANSFER_CANCELLED {
+		t.Fatalf("expected CANCELLED, got %v (%v)", resp, err)
+	}
+}
+
+func TestTransfer_Validation(t *testing.T) {
+	ctx := context.Background()
+	_, server, _ := startRepoServer(t)
+
+	cases := []*pb.StartTransferRequest{
+		{},
+		{Request: &pb.StartTransferRequest_Clone{Clone: &pb.CloneRequest{
+			SourceCollection: &pb.NamespacedName{Namespace: "prod", Name: "users"},
+		}}},
+		{Request: &pb.StartTransferRequest_Fetch{Fetch: &pb.FetchRequest{SourceEndpoint: "elsewhere:50051"}}},
+	}
+	for _, req := range cases {
+		resp, err := server.StartTransfer(ctx, req)
+		if err != nil || resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+			t.Errorf("expected INVALID_ARGUMENT for %v, got %v (%v)", req, resp, err)
+		}
+	}
+
+	got, err := server.GetTransfer(ctx, &pb.GetTransferRequest{JobId: "missing"})
+	if err != nil || got.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND, got %v (%v)", got, err)
+	}
+	cancelled, err := server.CancelTransfer(ctx, &pb.CancelTransferRequest{JobId: "missing"})
+	if err != nil || cancelled.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND, got %v (%v)", cancelled, err)
+	}
+}
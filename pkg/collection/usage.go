@@ -0,0 +1,280 @@
+package collection
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// UsageNamespace and UsageCollection name the collection that
+	// conventionally holds usage reports.
+	UsageNamespace  = "system"
+	UsageCollection = "usage_reports"
+
+	// DefaultUsageInterval is how often a UsageReporter reports.
+	DefaultUsageInterval = 24 * time.Hour
+
+	// usageInstallationID is the record keeping the installation's ID.
+	usageInstallationID = "installation"
+)
+
+// UsageReporter reports anonymous usage: counts of namespaces, collections
+// and records, the mix of RPCs served and the collector's version. Each
+// report is kept in a collection, conventionally system/usage_reports, as
+// JSON with proto field names, and POSTed to Endpoint when set. Reports
+// carry a random installation ID, kept in the same collection, and nothing
+// that names or holds data.
+type UsageReporter struct {
+	repo           CollectionRepo
+	coll           *Collection
+	installationID string
+	started        time.Time
+	clock          Clock
+
+	// Endpoint, when set, receives each report as a JSON POST.
+	Endpoint string
+	// Client sends reports to Endpoint.
+	Client *http.Client
+	// Version is reported as the collector's version; it defaults to the
+	// module version or VCS revision the binary was built from.
+	Version string
+
+	mu          sync.Mutex
+	calls       map[string]int64 // By full method name, since periodStart
+	periodStart time.Time
+
+	loopMu sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewUsageReporter creates a UsageReporter for repo keeping reports in coll,
+// reusing the installation ID kept there or creating one.
+func NewUsageReporter(ctx context.Context, repo CollectionRepo, coll *Collection) (*UsageReporter, error) {
+	r := &UsageReporter{
+		repo:    repo,
+		coll:    coll,
+		clock:   SystemClock{},
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		Version: buildVersion(),
+		calls:   make(map[string]int64),
+	}
+	r.started = r.clock.Now()
+	r.periodStart = r.started
+
+	record, err := coll.GetRecord(ctx, usageInstallationID)
+	switch {
+	case err == nil:
+		installation := &pb.UsageReport{}
+		if err := protojson.Unmarshal(record.ProtoData, installation); err != nil {
+			return nil, fmt.Errorf("failed to decode installation ID: %w", err)
+		}
+		r.installationID = installation.InstallationId
+	case errors.Is(err, sql.ErrNoRows):
+		r.installationID = uuid.New().String()
+		data, err := jobJSON.Marshal(&pb.UsageReport{InstallationId: r.installationID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode installation ID: %w", err)
+		}
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{
+			Id: usageInstallationID, ProtoData: data,
+			Metadata: &pb.Metadata{Labels: map[string]string{"kind": "installation"}},
+		}); err != nil {
+			return nil, fmt.Errorf("failed to save installation ID: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("failed to load installation ID: %w", err)
+	}
+	return r, nil
+}
+
+// buildVersion returns the module version the binary was built from, or its
+// VCS revision for development builds.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return "devel"
+}
+
+// InstallationID returns the random ID reports are made under.
+func (r *UsageReporter) InstallationID() string {
+	return r.installationID
+}
+
+// SetClock sets the clock reports are timed by. Call it before Start.
+func (r *UsageReporter) SetClock(clock Clock) {
+	r.clock = clock
+	r.started = clock.Now()
+	r.periodStart = r.started
+}
+
+// UnaryInterceptor counts the unary calls the server handles.
+func (r *UsageReporter) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		r.count(info.FullMethod)
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor counts the streaming calls the server handles.
+func (r *UsageReporter) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		r.count(info.FullMethod)
+		return handler(srv, ss)
+	}
+}
+
+func (r *UsageReporter) count(method string) {
+	r.mu.Lock()
+	r.calls[method]++
+	r.mu.Unlock()
+}
+
+// Report makes a report of the period since the last one, keeps it and
+// sends it to Endpoint. A report that could not be sent is kept unsent,
+// and the error returned with it.
+func (r *UsageReporter) Report(ctx context.Context) (*pb.UsageReport, error) {
+	found, err := r.repo.Discover(ctx, &pb.DiscoverRequest{PageSize: math.MaxInt32})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	now := r.clock.Now()
+	r.mu.Lock()
+	calls, periodStart := r.calls, r.periodStart
+	r.calls, r.periodStart = make(map[string]int64), now
+	r.mu.Unlock()
+
+	report := &pb.UsageReport{
+		ReportId:       uuid.New().String(),
+		InstallationId: r.installationID,
+		Version:        r.Version,
+		GoVersion:      runtime.Version(),
+		Os:             runtime.GOOS,
+		Arch:           runtime.GOARCH,
+		PeriodStart:    timestamppb.New(periodStart),
+		PeriodEnd:      timestamppb.New(now),
+		Collections:    int64(len(found.Collections)),
+		RpcCalls:       calls,
+		UptimeSeconds:  int64(now.Sub(r.started).Seconds()),
+	}
+	// Collections may share a store, whose count covers them all
+	namespaces := make(map[string]bool)
+	counted := make(map[Store]bool)
+	for _, meta := range found.Collections {
+		namespaces[meta.Namespace] = true
+		coll, err := r.repo.GetCollection(ctx, meta.Namespace, meta.Name)
+		if err != nil || counted[coll.Store] {
+			continue // Deleted since it was listed, or counted
+		}
+		counted[coll.Store] = true
+		if n, err := coll.Store.CountRecords(ctx); err == nil {
+			report.Records += n
+		}
+	}
+	report.Namespaces = int64(len(namespaces))
+
+	var sendErr error
+	if r.Endpoint != "" {
+		if sendErr = r.send(ctx, report); sendErr == nil {
+			report.Sent = true
+		}
+	}
+	data, err := jobJSON.Marshal(report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode usage report: %w", err)
+	}
+	if err := r.coll.CreateRecord(ctx, &pb.CollectionRecord{
+		Id: report.ReportId, ProtoData: data,
+		Metadata: &pb.Metadata{Labels: map[string]string{"kind": "report"}},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to save usage report: %w", err)
+	}
+	return report, sendErr
+}
+
+// send POSTs report to Endpoint.
+func (r *UsageReporter) send(ctx context.Context, report *pb.UsageReport) error {
+	data, err := jobJSON.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode usage report: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to build usage report request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send usage report: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("usage report endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Start reports every interval until Stop.
+func (r *UsageReporter) Start(interval time.Duration) {
+	r.loopMu.Lock()
+	defer r.loopMu.Unlock()
+	if r.stop != nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	r.stop, r.done = stop, done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			if _, err := r.Report(context.Background()); err != nil {
+				log.Printf("Warning: usage report: %v", err)
+			}
+		}
+	}()
+}
+
+// Stop ends the Start loop, waiting for a running report to finish.
+func (r *UsageReporter) Stop() {
+	r.loopMu.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.loopMu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
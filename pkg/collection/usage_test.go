@@ -0,0 +1,115 @@
+package collection_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestUsageReporter(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	for _, name := range []string{"users", "orders"} {
+		if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: name}); err != nil {
+			t.Fatalf("failed to create collection: %v", err)
+		}
+	}
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "other", Name: "things"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	users, _ := repo.GetCollection(ctx, "test", "users")
+	for _, id := range []string{"u1", "u2", "u3"} {
+		if err := users.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: []byte(`{}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	usageStore, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), "usage.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create usage store: %v", err)
+	}
+	defer usageStore.Close()
+	usageColl, err := collection.NewCollection(
+		&pb.Collection{Namespace: collection.UsageNamespace, Name: collection.UsageCollection},
+		usageStore, &collection.LocalFileSystem{})
+	if err != nil {
+		t.Fatalf("failed to create usage collection: %v", err)
+	}
+	reporter, err := collection.NewUsageReporter(ctx, repo, usageColl)
+	if err != nil {
+		t.Fatalf("NewUsageReporter failed: %v", err)
+	}
+	clock := collection.NewFixedClock(time.Now())
+	reporter.SetClock(clock)
+
+	var received []*pb.UsageReport
+	status := http.StatusOK
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		report := &pb.UsageReport{}
+		if err := protojson.Unmarshal(data, report); err != nil {
+			t.Errorf("failed to decode posted report: %v", err)
+		}
+		received = append(received, report)
+		w.WriteHeader(status)
+	}))
+	defer endpoint.Close()
+	reporter.Endpoint = endpoint.URL
+
+	// Calls are counted by method
+	intercept := reporter.UnaryInterceptor()
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	for _, method := range []string{"/collector.CollectionService/Create", "/collector.CollectionService/Create", "/collector.CollectionService/Search"} {
+		intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+	}
+	clock.Advance(time.Hour)
+
+	report, err := reporter.Report(ctx)
+	if err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+	if report.Namespaces != 2 || report.Collections != 3 || report.Records != 3 || report.UptimeSeconds != 3600 ||
+		report.RpcCalls["/collector.CollectionService/Create"] != 2 || report.RpcCalls["/collector.CollectionService/Search"] != 1 ||
+		report.InstallationId == "" || report.Version == "" || !report.Sent {
+		t.Fatalf("unexpected report %v", report)
+	}
+	if len(received) != 1 || received[0].ReportId != report.ReportId || received[0].Records != 3 {
+		t.Fatalf("expected the report posted, got %v", received)
+	}
+	if _, err := usageColl.GetRecord(ctx, report.ReportId); err != nil {
+		t.Errorf("expected the report kept: %v", err)
+	}
+
+	// A report that cannot be sent is kept unsent, covering only its period
+	status = http.StatusServiceUnavailable
+	clock.Advance(time.Hour)
+	report, err = reporter.Report(ctx)
+	if err == nil || report == nil || report.Sent || len(report.RpcCalls) != 0 || report.PeriodStart.AsTime().Before(clock.Now().Add(-time.Hour)) {
+		t.Fatalf("expected an unsent report of the last hour, got %v %v", report, err)
+	}
+	record, err := usageColl.GetRecord(ctx, report.ReportId)
+	if err != nil {
+		t.Fatalf("expected the unsent report kept: %v", err)
+	}
+	kept := &pb.UsageReport{}
+	if err := protojson.Unmarshal(record.ProtoData, kept); err != nil || kept.Sent {
+		t.Errorf("expected the kept report unsent, got %v %v", kept, err)
+	}
+
+	// The installation ID outlives the reporter
+	again, err := collection.NewUsageReporter(ctx, repo, usageColl)
+	if err != nil || again.InstallationID() != reporter.InstallationID() {
+		t.Errorf("expected installation ID %s reused, got %v %v", reporter.InstallationID(), again.InstallationID(), err)
+	}
+}
@@ -0,0 +1,172 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reasons given by FieldViolations, named after the constraint a record
+// broke.
+const (
+	ViolationRequired = "REQUIRED" // A required field is missing
+	ViolationMaxSize  = "MAX_SIZE" // The record is over the size limit
+	ViolationUnique   = "UNIQUE"   // The value is already taken, e.g. a record ID
+	ViolationType     = "TYPE"     // The value is not of the field's type
+)
+
+// maxExcerpt is how much of an offending value a violation quotes.
+const maxExcerpt = 64
+
+// ErrRecordExists is returned by stores when creating a record whose ID is
+// taken.
+var ErrRecordExists = errors.New("record already exists")
+
+// FieldViolation describes one way a record fails validation.
+type FieldViolation struct {
+	// Field is the path of the offending field, e.g. "id" or "item.value".
+	Field string
+	// Reason names the broken constraint, e.g. ViolationMaxSize.
+	Reason string
+	// Description explains the violation.
+	Description string
+	// Value is the offending value, quoted in part in the description sent
+	// to clients.
+	Value []byte
+}
+
+// ValidationError reports why the server refused a record. As a gRPC error it
+// has its Code (InvalidArgument unless set) and carries its violations as
+// google.rpc.BadRequest details, so clients can point at the offending fields
+// without parsing the message.
+type ValidationError struct {
+	Code       codes.Code
+	Violations []FieldViolation
+}
+
+// invalidRecord returns a ValidationError with a single violation.
+func invalidRecord(code codes.Code, field, reason string, value []byte, format string, args ...any) *ValidationError {
+	return &ValidationError{Code: code, Violations: []FieldViolation{{
+		Field: field, Reason: reason, Description: fmt.Sprintf(format, args...), Value: value,
+	}}}
+}
+
+func (v FieldViolation) describe() string {
+	if v.Value == nil {
+		return v.Description
+	}
+	return fmt.Sprintf("%s (value %s)", v.Description, excerpt(v.Value))
+}
+
+// excerpt quotes the start of value, cut at a character boundary.
+func excerpt(value []byte) string {
+	if len(value) <= maxExcerpt {
+		return fmt.Sprintf("%q", value)
+	}
+	cut := maxExcerpt
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%q...", value[:cut])
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.Field + ": " + v.describe()
+	}
+	return "invalid record: " + strings.Join(parts, "; ")
+}
+
+// GRPCStatus returns the error as a status with google.rpc.BadRequest details.
+func (e *ValidationError) GRPCStatus() *status.Status {
+	code := e.Code
+	if code == codes.OK {
+		code = codes.InvalidArgument
+	}
+	st := status.New(code, e.Error())
+	br := &errdetails.BadRequest{}
+	for _, v := range e.Violations {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       v.Field,
+			Description: v.describe(),
+			Reason:      v.Reason,
+		})
+	}
+	if detailed, err := st.WithDetails(br); err == nil {
+		return detailed
+	}
+	return st
+}
+
+// FieldViolations returns the google.rpc.BadRequest field violations carried
+// by a gRPC error, or nil if it has none.
+func FieldViolations(err error) []*errdetails.BadRequest_FieldViolation {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil
+	}
+	var violations []*errdetails.BadRequest_FieldViolation
+	for _, d := range st.Details() {
+		if br, ok := d.(*errdetails.BadRequest); ok {
+			violations = append(violations, br.FieldViolations...)
+		}
+	}
+	return violations
+}
+
+// writeStatus converts an error writing record id to a gRPC status error:
+// validation errors keep their details, other errors are internal.
+func writeStatus(err error, action, id string) error {
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		return invalid
+	}
+	if errors.Is(err, ErrRecordExists) {
+		return invalidRecord(codes.AlreadyExists, "id", ViolationUnique, []byte(id), "a record with this id already exists")
+	}
+	return status.Errorf(codes.Internal, "failed to %s record: %v", action, err)
+}
+
+// batchStatus converts a failed batch operation's error to a Status, keeping
+// field violations as details keyed by field.
+func batchStatus(err error) *pb.Status {
+	st, _ := status.FromError(err)
+	result := &pb.Status{Code: statusCode(st.Code()), Message: st.Message()}
+	for _, v := range FieldViolations(err) {
+		if result.Details == nil {
+			result.Details = make(map[string]string)
+		}
+		result.Details[v.Field] = v.Reason + ": " + v.Description
+	}
+	return result
+}
+
+// statusCode converts a gRPC code to the Status code of the same name. Status
+// has no DEADLINE_EXCEEDED, so its codes are not numbered like gRPC's.
+func statusCode(code codes.Code) pb.Status_Code {
+	switch code {
+	case codes.Canceled:
+		return pb.Status_CANCELLED
+	case codes.DeadlineExceeded:
+		return pb.Status_UNAVAILABLE
+	}
+	var name strings.Builder
+	for i, r := range code.String() {
+		if i > 0 && unicode.IsUpper(r) {
+			name.WriteByte('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	if c, ok := pb.Status_Code_value[name.String()]; ok {
+		return pb.Status_Code(c)
+	}
+	return pb.Status_UNKNOWN
+}
@@ -0,0 +1,75 @@
+package collection_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestCollectionServer_ValidationDetails(t *testing.T) {
+	ctx := context.Background()
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "users"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	server := collection.NewCollectionServer(repo)
+	server.SetRecordSizeLimits(collection.RecordSizeLimits{MaxRecordSize: 16})
+
+	violation := func(err error, code codes.Code, field, reason string) string {
+		t.Helper()
+		if status.Code(err) != code {
+			t.Fatalf("expected %v, got %v", code, err)
+		}
+		violations := collection.FieldViolations(err)
+		if len(violations) != 1 || violations[0].Field != field || violations[0].Reason != reason {
+			t.Fatalf("expected a %s violation of %s, got %v", reason, field, violations)
+		}
+		return violations[0].Description
+	}
+
+	create := &pb.CreateRequest{Namespace: "test", CollectionName: "users", Id: "u1", Item: &anypb.Any{Value: []byte(`{"n": 1}`)}}
+	if _, err := server.Create(ctx, create); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	_, err := server.Create(ctx, create)
+	if desc := violation(err, codes.AlreadyExists, "id", collection.ViolationUnique); !strings.Contains(desc, `"u1"`) {
+		t.Errorf("expected the description to quote the id, got %q", desc)
+	}
+
+	_, err = server.Update(ctx, &pb.UpdateRequest{Namespace: "test", CollectionName: "users", Id: "u1", Item: &anypb.Any{Value: []byte(`{"name": "far too long"}`)}})
+	violation(err, codes.InvalidArgument, "item.value", collection.ViolationMaxSize)
+	_, err = server.Update(ctx, &pb.UpdateRequest{Namespace: "test", CollectionName: "users", Item: &anypb.Any{Value: []byte(`{}`)}})
+	violation(err, codes.InvalidArgument, "id", collection.ViolationRequired)
+
+	// Batch keeps the violations of failed operations
+	resp, err := server.Batch(ctx, &pb.BatchRequest{Operations: []*pb.RequestOp{
+		{Operation: &pb.RequestOp_Create{Create: create}},
+	}})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	st := resp.Responses[0].Status
+	if st.Code != pb.Status_ALREADY_EXISTS || !strings.HasPrefix(st.Details["id"], "UNIQUE: ") {
+		t.Errorf("expected the batch status to carry the violation, got %v", st)
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	err := &collection.ValidationError{Violations: []collection.FieldViolation{{
+		Field: "name", Reason: collection.ViolationType, Description: "not a string", Value: []byte(strings.Repeat("x", 100)),
+	}}}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument by default, got %v", status.Code(err))
+	}
+	desc := collection.FieldViolations(err)[0].Description
+	if !strings.HasSuffix(desc, `...)`) || strings.Count(desc, "x") != 64 {
+		t.Errorf("expected a 64 byte excerpt of the value, got %q", desc)
+	}
+}
@@ -0,0 +1,316 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/cron"
+	"github.com/accretional/collector/pkg/jobs"
+)
+
+// Checks run by VerifyCollection, in the order they are reported.
+const (
+	VerifyCheckIntegrity = "integrity" // The database file is well formed
+	VerifyCheckFTS       = "fts"       // The full-text index matches the records
+	VerifyCheckLabels    = "labels"    // Label columns decode as selectors read them
+	VerifyCheckDataURI   = "data_uri"  // Files named by data_uri exist
+	VerifyCheckChecksums = "checksums" // Record data matches its checksum
+)
+
+// ScheduledVerifyLabel is set to "true" on the verify jobs submitted by
+// StartVerification, along with "namespace" and "collection" labels naming
+// the collection, so ListJobs can select them.
+const ScheduledVerifyLabel = "scheduled"
+
+// DefaultVerifyMaxProblems is how many problems each check reports unless
+// the request says otherwise. Problems past it are counted, not listed.
+const DefaultVerifyMaxProblems = 100
+
+// StoreVerifier is implemented by stores that can check their own database
+// and indexes. Each method records what it looked at and the problems it
+// found in report, and returns an error only when the check could not run.
+type StoreVerifier interface {
+	VerifyIntegrity(ctx context.Context, report *CheckReport) error
+	VerifyFTS(ctx context.Context, report *CheckReport) error
+	VerifyLabels(ctx context.Context, report *CheckReport) error
+}
+
+// CheckReport collects the outcome of one verification check, listing at
+// most its maximum number of problems.
+type CheckReport struct {
+	check       *pb.VerifyCheck
+	maxProblems int
+}
+
+// NewCheckReport starts the report of the named check. A maxProblems of 0
+// or less uses DefaultVerifyMaxProblems.
+func NewCheckReport(name string, maxProblems int) *CheckReport {
+	if maxProblems <= 0 {
+		maxProblems = DefaultVerifyMaxProblems
+	}
+	return &CheckReport{check: &pb.VerifyCheck{Name: name}, maxProblems: maxProblems}
+}
+
+// Checked adds n to the pages, rows or records the check looked at.
+func (r *CheckReport) Checked(n int64) {
+	r.check.Checked += n
+}
+
+// Problem records a problem, tied to a record unless recordID is empty.
+func (r *CheckReport) Problem(recordID, format string, args ...interface{}) {
+	r.check.ProblemCount++
+	if len(r.check.Problems) < r.maxProblems {
+		r.check.Problems = append(r.check.Problems, &pb.VerifyProblem{
+			RecordId: recordID,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+}
+
+// Skip marks the check as not applicable to the collection.
+func (r *CheckReport) Skip(reason string) {
+	r.check.Skipped = true
+	r.check.SkipReason = reason
+}
+
+// Proto returns the finished check. It is ok if it ran and found nothing.
+func (r *CheckReport) Proto() *pb.VerifyCheck {
+	r.check.Ok = !r.check.Skipped && r.check.ProblemCount == 0
+	return r.check
+}
+
+// VerifyCollection checks a collection's database, full-text and label
+// indexes, the files its records reference, and its records' checksums,
+// listing at most maxProblems problems per check. Checks the collection's
+// store or filesystem cannot run are reported as skipped; a check that
+// fails part way reports the failure as a problem and the others still
+// run.
+//
+// The database, full-text and label checks cover the collection's whole
+// store, which collections on the repository's shared store have in
+// common.
+func VerifyCollection(ctx context.Context, c *Collection, maxProblems int) ([]*pb.VerifyCheck, error) {
+	verifier, _ := c.Store.(StoreVerifier)
+	storeCheck := func(fn func(StoreVerifier, context.Context, *CheckReport) error) func(*CheckReport) error {
+		return func(report *CheckReport) error {
+			if verifier == nil {
+				report.Skip("store cannot verify itself")
+				return nil
+			}
+			return fn(verifier, ctx, report)
+		}
+	}
+
+	checks := []struct {
+		name string
+		run  func(*CheckReport) error
+	}{
+		{VerifyCheckIntegrity, storeCheck(StoreVerifier.VerifyIntegrity)},
+		{VerifyCheckFTS, storeCheck(StoreVerifier.VerifyFTS)},
+		{VerifyCheckLabels, storeCheck(StoreVerifier.VerifyLabels)},
+		{VerifyCheckDataURI, func(report *CheckReport) error { return verifyDataURIs(ctx, c, report) }},
+		{VerifyCheckChecksums, func(report *CheckReport) error { return verifyRecordChecksums(ctx, c, report) }},
+	}
+
+	results := make([]*pb.VerifyCheck, 0, len(checks))
+	for _, check := range checks {
+		report := NewCheckReport(check.name, maxProblems)
+		if err := check.run(report); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			report.Problem("", "check failed: %v", err)
+		}
+		results = append(results, report.Proto())
+	}
+	return results, nil
+}
+
+// verifyDataURIs reports records whose data_uri names a file or directory
+// missing from the collection's filesystem. URIs with a scheme point
+// outside the filesystem and are not checked.
+func verifyDataURIs(ctx context.Context, c *Collection, report *CheckReport) error {
+	if c.FS == nil {
+		report.Skip("collection has no filesystem")
+		return nil
+	}
+	return eachRecord(ctx, c, func(rec *pb.CollectionRecord) error {
+		if rec.DataUri == "" || strings.Contains(rec.DataUri, "://") {
+			return nil
+		}
+		report.Checked(1)
+		if !fileExists(ctx, c.FS, rec.DataUri) {
+			report.Problem(rec.Id, "data_uri %s does not exist", rec.DataUri)
+		}
+		return nil
+	})
+}
+
+// fileExists reports whether path is a file, or a directory holding files,
+// in fs. Object stores have no directories, so those are listed.
+func fileExists(ctx context.Context, fs FileSystem, path string) bool {
+	if _, err := fs.Stat(ctx, path); err == nil {
+		return true
+	}
+	files, err := fs.List(ctx, path)
+	return err == nil && len(files) > 0
+}
+
+// verifyRecordChecksums reports records whose data no longer matches the
+// checksum it was written with.
+func verifyRecordChecksums(ctx context.Context, c *Collection, report *CheckReport) error {
+	checksums, err := VerifyChecksums(ctx, c.Store)
+	if checksums != nil {
+		report.Checked(checksums.Checked)
+		for _, id := range checksums.Corrupt {
+			report.Problem(id, "data does not match its checksum")
+		}
+	}
+	return err
+}
+
+// VerifyCollection checks a live collection and reports every check's
+// outcome. A collection with problems is still an OK response, with ok
+// false. Submit it as a "verify" job to run it in the background, or use
+// StartVerification to verify every collection on a schedule.
+func (s *GrpcServer) VerifyCollection(ctx context.Context, req *pb.VerifyCollectionRequest) (*pb.VerifyCollectionResponse, error) {
+	if req.Collection.GetNamespace() == "" || req.Collection.GetName() == "" {
+		return &pb.VerifyCollectionResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "collection namespace and name are required"},
+		}, nil
+	}
+	coll, err := s.repo.GetCollection(ctx, req.Collection.Namespace, req.Collection.Name)
+	if err != nil {
+		return &pb.VerifyCollectionResponse{
+			Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: err.Error()},
+		}, nil
+	}
+
+	started := coll.now()
+	checks, err := VerifyCollection(ctx, coll, int(req.MaxProblems))
+	if err != nil {
+		return &pb.VerifyCollectionResponse{
+			Status: &pb.Status{Code: pb.Status_CANCELLED, Message: err.Error()},
+		}, nil
+	}
+
+	ok := true
+	var failed []string
+	for _, check := range checks {
+		if !check.Skipped && !check.Ok {
+			ok = false
+			failed = append(failed, fmt.Sprintf("%s (%d)", check.Name, check.ProblemCount))
+		}
+	}
+	key := req.Collection.Namespace + "/" + req.Collection.Name
+	message := fmt.Sprintf("%s passed verification", key)
+	if !ok {
+		message = fmt.Sprintf("%s failed verification: %s", key, strings.Join(failed, ", "))
+		log.Printf("Warning: %s", message)
+	}
+
+	return &pb.VerifyCollectionResponse{
+		Status:     &pb.Status{Code: pb.Status_OK, Message: message},
+		Collection: req.Collection,
+		Ok:         ok,
+		Checks:     checks,
+		StartedAt:  started.Unix(),
+		FinishedAt: coll.now().Unix(),
+	}, nil
+}
+
+// verifyScheduler submits scheduled verify jobs.
+type verifyScheduler struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.Mutex
+}
+
+// StartVerification submits a verify job for every collection at each tick
+// of schedule, read in loc, until StopVerification. A collection whose
+// previous scheduled job has not finished is left out of the tick.
+func (s *GrpcServer) StartVerification(schedule *cron.Schedule, loc *time.Location) {
+	v := &s.verification
+	v.mu.Lock()
+	if v.cancel != nil {
+		v.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	v.cancel, v.done = cancel, done
+	v.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		for {
+			next := schedule.Next(time.Now().In(loc))
+			if next.IsZero() {
+				return
+			}
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+			if err := s.submitVerifyJobs(ctx); err != nil {
+				log.Printf("Warning: scheduled verification failed: %v", err)
+			}
+		}
+	}()
+}
+
+// StopVerification ends the StartVerification loop. Jobs already submitted
+// keep running.
+func (s *GrpcServer) StopVerification() {
+	v := &s.verification
+	v.mu.Lock()
+	cancel, done := v.cancel, v.done
+	v.cancel, v.done = nil, nil
+	v.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// submitVerifyJobs submits a scheduled verify job for each collection
+// without one still unfinished.
+func (s *GrpcServer) submitVerifyJobs(ctx context.Context) error {
+	unfinished, err := s.jobs.List(ctx, jobs.ListOptions{
+		Kind:   JobKindVerify,
+		States: []pb.JobState{pb.JobState_JOB_PENDING, pb.JobState_JOB_RUNNING, pb.JobState_JOB_RETRYING},
+		Match:  func(labels map[string]string) bool { return labels[ScheduledVerifyLabel] == "true" },
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list verify jobs: %w", err)
+	}
+	busy := make(map[string]bool, len(unfinished))
+	for _, job := range unfinished {
+		busy[job.Labels["namespace"]+"/"+job.Labels["collection"]] = true
+	}
+
+	found, err := s.repo.Discover(ctx, &pb.DiscoverRequest{PageSize: math.MaxInt32})
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	for _, coll := range found.Collections {
+		if busy[coll.Namespace+"/"+coll.Name] {
+			continue
+		}
+		req := &pb.VerifyCollectionRequest{Collection: &pb.NamespacedName{Namespace: coll.Namespace, Name: coll.Name}}
+		labels := map[string]string{ScheduledVerifyLabel: "true", "namespace": coll.Namespace, "collection": coll.Name}
+		if _, err := s.jobs.Submit(ctx, JobKindVerify, req, jobs.SubmitOptions{Labels: labels}); err != nil {
+			return fmt.Errorf("failed to submit verify job for %s/%s: %w", coll.Namespace, coll.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package collection_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+)
+
+func verifyChecks(t *testing.T, resp *pb.VerifyCollectionResponse) map[string]*pb.VerifyCheck {
+	t.Helper()
+	if resp.Status.GetCode() != pb.Status_OK {
+		t.Fatalf("VerifyCollection failed: %s", resp.Status.GetMessage())
+	}
+	checks := make(map[string]*pb.VerifyCheck)
+	for _, check := range resp.Checks {
+		checks[check.Name] = check
+	}
+	return checks
+}
+
+func TestVerifyCollectionFindsProblems(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := sqlite.NewSqliteStore(filepath.Join(dir, "repo.db"), collection.Options{EnableFTS: true, EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	repo := collection.NewCollectionRepo(store)
+	server := collection.NewGrpcServerWithDataDir(repo, dir)
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := repo.GetCollection(ctx, "test", "docs")
+	for i := 0; i < 5; i++ {
+		record := &pb.CollectionRecord{
+			Id:        fmt.Sprintf("doc-%d", i),
+			ProtoData: []byte(fmt.Sprintf(`{"title": "document %d"}`, i)),
+			Metadata:  &pb.Metadata{Labels: map[string]string{"team": "search"}},
+		}
+		if err := coll.CreateRecord(ctx, record); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	if _, err := coll.AddAttachment(ctx, "doc-0", "notes.txt", "text/plain", []byte("meeting notes")); err != nil {
+		t.Fatalf("AddAttachment failed: %v", err)
+	}
+
+	req := &pb.VerifyCollectionRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "docs"}}
+	resp, _ := server.VerifyCollection(ctx, req)
+	checks := verifyChecks(t, resp)
+	if !resp.Ok || len(checks) != 5 {
+		t.Fatalf("expected a healthy collection to pass all five checks, got %v", resp.Checks)
+	}
+	if checks[collection.VerifyCheckFTS].Checked != 5 || checks[collection.VerifyCheckDataURI].Checked != 1 {
+		t.Errorf("expected 5 records checked against the index and 1 data_uri, got %v", resp.Checks)
+	}
+
+	// Break one thing for each check but the database itself
+	corruptions := []string{
+		`UPDATE records SET labels = '{"team": 7' WHERE id = 'doc-1'`,
+		`UPDATE records SET proto_data = '{"title": "bit rot"}' WHERE id = 'doc-2'`,
+		`DELETE FROM records_fts WHERE rowid = (SELECT rowid FROM records WHERE id = 'doc-3')`,
+		`UPDATE records SET data_uri = 'attachments/missing' WHERE id = 'doc-4'`,
+	}
+	for _, query := range corruptions {
+		if err := store.ExecuteRaw(query); err != nil {
+			t.Fatalf("failed to corrupt the store: %v", err)
+		}
+	}
+
+	resp, _ = server.VerifyCollection(ctx, req)
+	checks = verifyChecks(t, resp)
+	if resp.Ok {
+		t.Fatal("expected verification to fail")
+	}
+	if !checks[collection.VerifyCheckIntegrity].Ok {
+		t.Errorf("expected the database itself to be intact, got %v", checks[collection.VerifyCheckIntegrity].Problems)
+	}
+	for name, id := range map[string]string{
+		collection.VerifyCheckLabels:    "doc-1",
+		collection.VerifyCheckChecksums: "doc-2",
+		collection.VerifyCheckFTS:       "doc-3",
+		collection.VerifyCheckDataURI:   "doc-4",
+	} {
+		check := checks[name]
+		if check.Ok || check.ProblemCount != 1 || check.Problems[0].RecordId != id {
+			t.Errorf("expected %s to report %s, got %v", name, id, check)
+		}
+	}
+
+	// Past max_problems, problems are counted but not listed
+	for i := 0; i < 5; i++ {
+		if err := store.ExecuteRaw(`UPDATE records SET labels = 'not json' WHERE id = ?`, fmt.Sprintf("doc-%d", i)); err != nil {
+			t.Fatalf("failed to corrupt labels: %v", err)
+		}
+	}
+	req.MaxProblems = 2
+	resp, _ = server.VerifyCollection(ctx, req)
+	if labels := verifyChecks(t, resp)[collection.VerifyCheckLabels]; labels.ProblemCount != 5 || len(labels.Problems) != 2 {
+		t.Errorf("expected 5 label problems with 2 listed, got %d with %d listed", labels.ProblemCount, len(labels.Problems))
+	}
+}
+
+func TestVerifyCollectionSkipsUnavailableChecks(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := sqlite.NewSqliteStore(filepath.Join(dir, "repo.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	repo := collection.NewCollectionRepo(store)
+	server := collection.NewGrpcServerWithDataDir(repo, dir)
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "plain"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	req := &pb.VerifyCollectionRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "plain"}}
+	resp, _ := server.VerifyCollection(ctx, req)
+	fts := verifyChecks(t, resp)[collection.VerifyCheckFTS]
+	if !resp.Ok || !fts.Skipped || fts.Ok {
+		t.Errorf("expected the fts check skipped without full-text search, got ok=%v %v", resp.Ok, fts)
+	}
+
+	resp, _ = server.VerifyCollection(ctx, &pb.VerifyCollectionRequest{Collection: &pb.NamespacedName{Namespace: "test", Name: "missing"}})
+	if resp.Status.GetCode() != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND for a missing collection, got %v", resp.Status)
+	}
+}
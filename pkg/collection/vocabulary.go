@@ -0,0 +1,218 @@
+package collection
+
+import (
+	"strings"
+	"unicode"
+)
+
+// QueryExpander rewrites full-text queries with a collection's synonyms and
+// stopwords, so domain terms match their equivalents without reindexing.
+type QueryExpander struct {
+	synonyms  map[string][]string
+	stopwords map[string]bool
+}
+
+// NewQueryExpander returns an expander for the given synonym groups, each a
+// set of equivalent terms, and stopwords. Terms match case-insensitively; a
+// synonym may be several words, which are searched as a phrase. It returns
+// nil if there is nothing to expand.
+func NewQueryExpander(synonyms [][]string, stopwords []string) *QueryExpander {
+	if len(synonyms) == 0 && len(stopwords) == 0 {
+		return nil
+	}
+	e := &QueryExpander{synonyms: make(map[string][]string), stopwords: make(map[string]bool)}
+	for _, group := range synonyms {
+		for _, term := range group {
+			key := strings.ToLower(term)
+			for _, other := range group {
+				if !containsFold(e.synonyms[key], other) {
+					e.synonyms[key] = append(e.synonyms[key], other)
+				}
+			}
+		}
+	}
+	for _, w := range stopwords {
+		e.stopwords[strings.ToLower(w)] = true
+	}
+	return e
+}
+
+// Expand rewrites an FTS5 query: each plain word with synonyms becomes an OR
+// of the group, joined to its neighbours with AND, and stopwords are dropped along with operators they leave
+// dangling. Phrases, prefix terms, column filters and NEAR groups are left
+// as written. A query of nothing but stopwords is returned unchanged. A nil
+// expander returns query as is.
+func (e *QueryExpander) Expand(query string) string {
+	if e == nil {
+		return query
+	}
+
+	var out []queryToken
+	tokens := tokenizeQuery(query)
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.text == "NEAR" && i+1 < len(tokens) && tokens[i+1].text == "(" {
+			// Kept as written, as a single operand
+			var inner []string
+			for i += 2; i < len(tokens) && tokens[i].text != ")"; i++ {
+				inner = append(inner, tokens[i].text)
+			}
+			out = append(out, queryToken{"NEAR(" + strings.Join(inner, " ") + ")", tokenTerm})
+			continue
+		}
+		if tok.kind != tokenTerm || !plainWord(tok.text) {
+			out = append(out, tok)
+			continue
+		}
+		key := strings.ToLower(tok.text)
+		if e.stopwords[key] {
+			continue
+		}
+		if group := e.synonyms[key]; len(group) > 1 {
+			quoted := make([]string, len(group))
+			for j, term := range group {
+				quoted[j] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+			}
+			tok = queryToken{"(" + strings.Join(quoted, " OR ") + ")", tokenGroup}
+		}
+		out = append(out, tok)
+	}
+
+	out = trimOperators(out)
+	if len(out) == 0 {
+		return query
+	}
+	// FTS5 only joins plain terms implicitly; groups need an explicit AND
+	var expanded strings.Builder
+	for i, tok := range out {
+		if i > 0 {
+			expanded.WriteByte(' ')
+			prev := out[i-1]
+			leftOperand := prev.kind == tokenTerm || prev.kind == tokenGroup || prev.kind == tokenClose
+			rightOperand := tok.kind == tokenTerm || tok.kind == tokenGroup || tok.kind == tokenOpen
+			grouped := prev.kind == tokenGroup || prev.kind == tokenClose || tok.kind == tokenGroup || tok.kind == tokenOpen
+			if leftOperand && rightOperand && grouped {
+				expanded.WriteString("AND ")
+			}
+		}
+		expanded.WriteString(tok.text)
+	}
+	return expanded.String()
+}
+
+type tokenKind int
+
+const (
+	tokenTerm tokenKind = iota
+	tokenOperator
+	tokenGroup // a synonym expansion
+	tokenOpen
+	tokenClose
+)
+
+type queryToken struct {
+	text string
+	kind tokenKind
+}
+
+// tokenizeQuery splits an FTS5 query into parentheses, quoted phrases,
+// operators and the words between them.
+func tokenizeQuery(query string) []queryToken {
+	var tokens []queryToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		switch r := runes[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{"(", tokenOpen})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{")", tokenClose})
+			i++
+		case r == '"':
+			// A phrase runs to the next quote not doubled as an escape
+			j := i + 1
+			for j < len(runes) {
+				if runes[j] == '"' {
+					if j+1 < len(runes) && runes[j+1] == '"' {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			j = min(j+1, len(runes))
+			tokens = append(tokens, queryToken{string(runes[i:j]), tokenTerm})
+			i = j
+		default:
+			j := i
+			for j < len(runes) && !unicode.IsSpace(runes[j]) && !strings.ContainsRune(`()"`, runes[j]) {
+				j++
+			}
+			word := string(runes[i:j])
+			kind := tokenTerm
+			if word == "AND" || word == "OR" || word == "NOT" {
+				kind = tokenOperator
+			}
+			tokens = append(tokens, queryToken{word, kind})
+			i = j
+		}
+	}
+	return tokens
+}
+
+// trimOperators removes operators and parentheses left without operands.
+func trimOperators(tokens []queryToken) []queryToken {
+	for changed := true; changed; {
+		changed = false
+		for i, tok := range tokens {
+			var prev, next *queryToken
+			if i > 0 {
+				prev = &tokens[i-1]
+			}
+			if i+1 < len(tokens) {
+				next = &tokens[i+1]
+			}
+			dangling := false
+			switch tok.kind {
+			case tokenOperator:
+				dangling = prev == nil || next == nil || prev.kind == tokenOperator || prev.kind == tokenOpen ||
+					next.kind == tokenClose
+			case tokenOpen:
+				dangling = next != nil && next.kind == tokenClose
+			}
+			if dangling {
+				if tok.kind == tokenOpen {
+					tokens = append(tokens[:i], tokens[i+2:]...)
+				} else {
+					tokens = append(tokens[:i], tokens[i+1:]...)
+				}
+				changed = true
+				break
+			}
+		}
+	}
+	return tokens
+}
+
+// plainWord reports whether word is a bare search term, not a prefix term,
+// column filter or other query syntax.
+func plainWord(word string) bool {
+	for _, r := range word {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return word != ""
+}
+
+func containsFold(terms []string, term string) bool {
+	for _, t := range terms {
+		if strings.EqualFold(t, term) {
+			return true
+		}
+	}
+	return false
+}
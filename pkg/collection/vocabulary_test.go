@@ -0,0 +1,37 @@
+package collection_test
+
+import (
+	"testing"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestQueryExpander(t *testing.T) {
+	e := collection.NewQueryExpander(
+		[][]string{{"k8s", "Kubernetes"}, {"db", "database", "data store"}},
+		[]string{"the", "of", "a"},
+	)
+	for query, want := range map[string]string{
+		"k8s":                    `("k8s" OR "Kubernetes")`,
+		"KUBERNETES upgrade":     `("k8s" OR "Kubernetes") AND upgrade`,
+		"scaling the db":         `scaling AND ("db" OR "database" OR "data store")`,
+		"the AND k8s":            `("k8s" OR "Kubernetes")`,
+		"k8s NOT a":              `("k8s" OR "Kubernetes")`,
+		"(the OR of) AND deploy": "deploy",
+		`"the k8s way"`:          `"the k8s way"`,
+		"k8s*":                   "k8s*",
+		"content:k8s":            "content:k8s",
+		"NEAR(k8s db, 5)":        "NEAR(k8s db, 5)",
+		"(deploy k8s) rollout":   `( deploy AND ("k8s" OR "Kubernetes") ) AND rollout`,
+		"the of":                 "the of",
+	} {
+		if got := e.Expand(query); got != want {
+			t.Errorf("Expand(%q) = %q, want %q", query, got, want)
+		}
+	}
+
+	var none *collection.QueryExpander
+	if collection.NewQueryExpander(nil, nil) != nil || none.Expand("k8s") != "k8s" {
+		t.Error("expected an empty vocabulary to leave queries unchanged")
+	}
+}
@@ -0,0 +1,567 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+const (
+	DefaultWriteBehindBatchSize     = 500
+	DefaultWriteBehindFlushInterval = 100 * time.Millisecond
+	DefaultWriteBehindMaxPending    = 10000
+	DefaultWriteBehindMaxAttempts   = 5
+)
+
+// BatchCreator is implemented by stores that can insert many records in one transaction.
+// BufferedStore uses it when available and falls back to CreateRecord otherwise.
+type BatchCreator interface {
+	CreateRecords(ctx context.Context, records []*pb.CollectionRecord) error
+}
+
+// WriteBufferOptions configures a BufferedStore.
+type WriteBufferOptions struct {
+	MaxBatchSize  int
+	FlushInterval time.Duration
+	MaxPending    int
+	// MaxAttempts is how many flushes a record may fail before it is
+	// dead-lettered: dropped from the queue and passed to OnDeadLetter.
+	MaxAttempts int
+	// OnDeadLetter receives dead-lettered records with the error of their
+	// last attempt. Without it they are logged.
+	OnDeadLetter func(record *pb.CollectionRecord, err error)
+}
+
+// WriteBufferOptionsFromConfig converts the proto config into options, applying defaults.
+func WriteBufferOptionsFromConfig(cfg *pb.WriteBehindConfig) WriteBufferOptions {
+	opts := WriteBufferOptions{
+		MaxBatchSize:  int(cfg.GetMaxBatchSize()),
+		FlushInterval: time.Duration(cfg.GetFlushIntervalMs()) * time.Millisecond,
+		MaxPending:    int(cfg.GetMaxPending()),
+		MaxAttempts:   int(cfg.GetMaxAttempts()),
+	}
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = DefaultWriteBehindBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultWriteBehindFlushInterval
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = DefaultWriteBehindMaxPending
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultWriteBehindMaxAttempts
+	}
+	return opts
+}
+
+type pendingRecord struct {
+	record   *pb.CollectionRecord
+	queuedAt time.Time
+	attempts int   // failed flushes
+	err      error // of the last failed flush
+}
+
+// BufferedStore is a write-behind Store. CreateRecord queues the record in memory
+// and returns immediately; a background flusher writes queued records to the
+// underlying store in batches. Every other operation flushes first, so reads
+// always observe acknowledged writes.
+//
+// The queue is in memory only; there is no write-ahead log. If the process
+// crashes, or exits without Close or Flush, the acknowledged creates still
+// queued are lost: up to FlushInterval's worth, or more while the store is
+// failing writes. Collections that cannot lose acknowledged writes should not
+// enable write-behind.
+type BufferedStore struct {
+	inner Store
+	opts  WriteBufferOptions
+
+	mu      sync.Mutex
+	pending []pendingRecord
+	ids     map[string]*pb.CollectionRecord
+	drained chan struct{} // closed and replaced after every flush
+	stats   pb.WriteBehindStats
+	closed  bool // set by Stop; creates then go straight to inner
+
+	flushMu sync.Mutex // serializes flushes
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	stopped sync.Once
+}
+
+// NewBufferedStore wraps inner with a write-behind buffer and starts the flusher.
+func NewBufferedStore(inner Store, opts WriteBufferOptions) *BufferedStore {
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = DefaultWriteBehindBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultWriteBehindFlushInterval
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = DefaultWriteBehindMaxPending
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultWriteBehindMaxAttempts
+	}
+
+	b := &BufferedStore{
+		inner:   inner,
+		opts:    opts,
+		ids:     make(map[string]*pb.CollectionRecord),
+		drained: make(chan struct{}),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *BufferedStore) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+		// Failures are recorded in Stats; failed records stay queued, so the
+		// next flush by a caller returns them too
+		_, _ = b.Flush(context.Background())
+	}
+}
+
+func (b *BufferedStore) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// CreateRecord queues the record for the next flush. It blocks while the
+// buffer is full, until space frees up or ctx is done. IDs already queued are
+// refused with ErrRecordExists; the store is not consulted, so a record whose
+// ID is already stored is acknowledged and then dropped by the flush that
+// finds the conflict. Once the buffer is stopped, records are written to the
+// underlying store directly.
+func (b *BufferedStore) CreateRecord(ctx context.Context, record *pb.CollectionRecord) error {
+	for {
+		b.mu.Lock()
+		if _, exists := b.ids[record.Id]; exists {
+			b.mu.Unlock()
+			return fmt.Errorf("%w: %s", ErrRecordExists, record.Id)
+		}
+		if b.closed {
+			b.mu.Unlock()
+			return b.inner.CreateRecord(ctx, record)
+		}
+		if len(b.pending) < b.opts.MaxPending {
+			b.pending = append(b.pending, pendingRecord{record: record, queuedAt: time.Now()})
+			b.ids[record.Id] = record
+			full := len(b.pending) >= b.opts.MaxBatchSize
+			b.mu.Unlock()
+			if full {
+				b.signal()
+			}
+			return nil
+		}
+		drained := b.drained
+		b.mu.Unlock()
+
+		b.signal()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			return fmt.Errorf("write buffer full: %w", ctx.Err())
+		}
+	}
+}
+
+// Flush writes all queued records to the underlying store and returns how many were written.
+// The records were acknowledged, so their writes are not cancelled with ctx. Records the
+// store rejects as duplicates are dropped; others that fail stay queued for the next
+// flush until they have failed MaxAttempts flushes, and are then dead-lettered. Either
+// way the failure is counted in flush_errors and returned.
+func (b *BufferedStore) Flush(ctx context.Context) (int64, error) {
+	ctx = context.WithoutCancel(ctx)
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	start := time.Now()
+	var written int64
+	var lastErr error
+	var failed []pendingRecord
+	for i := 0; i < len(batch); i += b.opts.MaxBatchSize {
+		end := i + b.opts.MaxBatchSize
+		if end > len(batch) {
+			end = len(batch)
+		}
+		n, retry, err := b.writeBatch(ctx, batch[i:end])
+		written += n
+		failed = append(failed, retry...)
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	var requeue, dead []pendingRecord
+	for _, p := range failed {
+		if p.attempts >= b.opts.MaxAttempts {
+			dead = append(dead, p)
+		} else {
+			requeue = append(requeue, p)
+		}
+	}
+
+	b.mu.Lock()
+	requeued := make(map[string]bool, len(requeue))
+	for _, p := range requeue {
+		requeued[p.record.Id] = true
+	}
+	for _, p := range batch {
+		if !requeued[p.record.Id] {
+			delete(b.ids, p.record.Id)
+		}
+	}
+	b.pending = append(requeue, b.pending...)
+	b.stats.Flushed += written
+	b.stats.DeadLettered += int64(len(dead))
+	b.stats.LastFlushDurationMs = time.Since(start).Milliseconds()
+	if lastErr != nil {
+		b.stats.FlushErrors++
+		b.stats.LastError = lastErr.Error()
+	}
+	close(b.drained)
+	b.drained = make(chan struct{})
+	b.mu.Unlock()
+
+	for _, p := range dead {
+		if b.opts.OnDeadLetter != nil {
+			b.opts.OnDeadLetter(p.record, p.err)
+		} else {
+			log.Printf("Warning: write-behind dropped record %s after %d failed flushes: %v", p.record.Id, p.attempts, p.err)
+		}
+	}
+	return written, lastErr
+}
+
+// writeBatch inserts one batch, retrying record-by-record if the batch insert fails
+// so that a single bad record does not take the rest of the batch with it. It returns
+// the records that failed other than as duplicates, with their attempts counted.
+func (b *BufferedStore) writeBatch(ctx context.Context, batch []pendingRecord) (int64, []pendingRecord, error) {
+	records := make([]*pb.CollectionRecord, len(batch))
+	for i, p := range batch {
+		records[i] = p.record
+	}
+
+	if bc, ok := b.inner.(BatchCreator); ok {
+		if err := bc.CreateRecords(ctx, records); err == nil {
+			b.mu.Lock()
+			b.stats.Batches++
+			b.mu.Unlock()
+			return int64(len(records)), nil, nil
+		}
+	}
+
+	var written int64
+	var retry []pendingRecord
+	var lastErr error
+	for i, r := range records {
+		if err := b.inner.CreateRecord(ctx, r); err != nil {
+			lastErr = fmt.Errorf("failed to flush record %s: %w", r.Id, err)
+			if !errors.Is(err, ErrRecordExists) {
+				p := batch[i]
+				p.attempts++
+				p.err = err
+				retry = append(retry, p)
+			}
+			continue
+		}
+		written++
+	}
+	b.mu.Lock()
+	b.stats.Batches++
+	b.mu.Unlock()
+	return written, retry, lastErr
+}
+
+// Stats returns a snapshot of the buffer's counters, including the current flush lag.
+func (b *BufferedStore) Stats() *pb.WriteBehindStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := &pb.WriteBehindStats{
+		Pending:             int64(len(b.ids)),
+		Flushed:             b.stats.Flushed,
+		Batches:             b.stats.Batches,
+		FlushErrors:         b.stats.FlushErrors,
+		LastFlushDurationMs: b.stats.LastFlushDurationMs,
+		LastError:           b.stats.LastError,
+		DeadLettered:        b.stats.DeadLettered,
+	}
+	if len(b.pending) > 0 {
+		stats.FlushLagMs = time.Since(b.pending[0].queuedAt).Milliseconds()
+	}
+	return stats
+}
+
+// Stop flushes queued records and stops the background flusher without closing the underlying store.
+// Creates made after Stop, e.g. through Collections obtained before it, are written directly.
+func (b *BufferedStore) Stop(ctx context.Context) error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.stopped.Do(func() {
+		close(b.stop)
+		<-b.done
+	})
+	_, err := b.Flush(ctx)
+	return err
+}
+
+// Unwrap returns the underlying store.
+func (b *BufferedStore) Unwrap() Store { return b.inner }
+
+// Close flushes queued records, stops the flusher and closes the underlying store.
+func (b *BufferedStore) Close() error {
+	flushErr := b.Stop(context.Background())
+	if err := b.inner.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+func (b *BufferedStore) Path() string { return b.inner.Path() }
+
+// flush writes the buffer out before an operation that must observe it.
+func (b *BufferedStore) flush(ctx context.Context) error {
+	if _, err := b.Flush(ctx); err != nil {
+		return fmt.Errorf("failed to flush write buffer: %w", err)
+	}
+	return nil
+}
+
+// flushForRead writes the buffer out before a read, unless the read is
+// eventually consistent.
+func (b *BufferedStore) flushForRead(ctx context.Context) error {
+	if eventualRead(ctx) {
+		return nil
+	}
+	return b.flush(ctx)
+}
+
+func (b *BufferedStore) GetRecord(ctx context.Context, id string) (*pb.CollectionRecord, error) {
+	b.mu.Lock()
+	record, ok := b.ids[id]
+	b.mu.Unlock()
+	if ok {
+		return record, nil
+	}
+	return b.inner.GetRecord(ctx, id)
+}
+
+func (b *BufferedStore) UpdateRecord(ctx context.Context, record *pb.CollectionRecord) error {
+	if err := b.flush(ctx); err != nil {
+		return err
+	}
+	return b.inner.UpdateRecord(ctx, record)
+}
+
+func (b *BufferedStore) DeleteRecord(ctx context.Context, id string) error {
+	if err := b.flush(ctx); err != nil {
+		return err
+	}
+	return b.inner.DeleteRecord(ctx, id)
+}
+
+func (b *BufferedStore) ListRecords(ctx context.Context, offset, limit int) ([]*pb.CollectionRecord, error) {
+	if err := b.flushForRead(ctx); err != nil {
+		return nil, err
+	}
+	return b.inner.ListRecords(ctx, offset, limit)
+}
+
+func (b *BufferedStore) CountRecords(ctx context.Context) (int64, error) {
+	if err := b.flushForRead(ctx); err != nil {
+		return 0, err
+	}
+	return b.inner.CountRecords(ctx)
+}
+
+func (b *BufferedStore) Search(ctx context.Context, query *SearchQuery) ([]*SearchResult, error) {
+	if err := b.flushForRead(ctx); err != nil {
+		return nil, err
+	}
+	return b.inner.Search(ctx, query)
+}
+
+func (b *BufferedStore) RecordExists(ctx context.Context, id string) (bool, error) {
+	b.mu.Lock()
+	_, ok := b.ids[id]
+	b.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	return RecordExists(ctx, b.inner, id)
+}
+
+func (b *BufferedStore) CountMatching(ctx context.Context, query *SearchQuery) (int64, error) {
+	if err := b.flushForRead(ctx); err != nil {
+		return 0, err
+	}
+	return CountMatching(ctx, b.inner, query)
+}
+
+func (b *BufferedStore) ScanValues(ctx context.Context, query *SearchQuery, target DistinctTarget, fn func(string) error) error {
+	if err := b.flushForRead(ctx); err != nil {
+		return err
+	}
+	return ScanValues(ctx, b.inner, query, target, fn)
+}
+
+// FindSimilar flushes queued records and looks up near-duplicates in the
+// wrapped store.
+func (b *BufferedStore) FindSimilar(ctx context.Context, id string, maxDistance, limit int) ([]*SimilarRecord, error) {
+	if err := b.flush(ctx); err != nil {
+		return nil, err
+	}
+	index, ok := b.inner.(SimilarityIndex)
+	if !ok {
+		return nil, ErrSimilarityUnavailable
+	}
+	return index.FindSimilar(ctx, id, maxDistance, limit)
+}
+
+// CompressionStats reports the wrapped store's compression stats, or nil if
+// it does not compress.
+func (b *BufferedStore) CompressionStats(ctx context.Context) (*pb.CompressionStats, error) {
+	cr, ok := b.inner.(CompressionReporter)
+	if !ok {
+		return nil, nil
+	}
+	return cr.CompressionStats(ctx)
+}
+
+// DeduplicationStats reports the wrapped store's deduplication stats, or nil
+// if it does not deduplicate.
+func (b *BufferedStore) DeduplicationStats(ctx context.Context) (*pb.DeduplicationStats, error) {
+	dr, ok := b.inner.(DeduplicationReporter)
+	if !ok {
+		return nil, nil
+	}
+	return dr.DeduplicationStats(ctx)
+}
+
+// verifier flushes queued records and returns the wrapped store's
+// verifier, or nil if it cannot verify itself.
+func (b *BufferedStore) verifier(ctx context.Context) (StoreVerifier, error) {
+	if err := b.flush(ctx); err != nil {
+		return nil, err
+	}
+	v, _ := b.inner.(StoreVerifier)
+	return v, nil
+}
+
+func (b *BufferedStore) VerifyIntegrity(ctx context.Context, report *CheckReport) error {
+	v, err := b.verifier(ctx)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		return v.VerifyIntegrity(ctx, report)
+	}
+	report.Skip("store cannot verify itself")
+	return nil
+}
+
+func (b *BufferedStore) VerifyFTS(ctx context.Context, report *CheckReport) error {
+	v, err := b.verifier(ctx)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		return v.VerifyFTS(ctx, report)
+	}
+	report.Skip("store cannot verify itself")
+	return nil
+}
+
+func (b *BufferedStore) VerifyLabels(ctx context.Context, report *CheckReport) error {
+	v, err := b.verifier(ctx)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		return v.VerifyLabels(ctx, report)
+	}
+	report.Skip("store cannot verify itself")
+	return nil
+}
+
+// HistoryEnabled reports whether the wrapped store keeps record history.
+func (b *BufferedStore) HistoryEnabled() bool {
+	hr, ok := b.inner.(HistoryReader)
+	return ok && hr.HistoryEnabled()
+}
+
+func (b *BufferedStore) GetRecordAsOf(ctx context.Context, id string, asOf time.Time) (*pb.CollectionRecord, error) {
+	if err := b.flush(ctx); err != nil {
+		return nil, err
+	}
+	return GetRecordAsOf(ctx, b.inner, id, asOf)
+}
+
+func (b *BufferedStore) ListRecordsAsOf(ctx context.Context, asOf time.Time, offset, limit int) ([]*pb.CollectionRecord, error) {
+	if err := b.flush(ctx); err != nil {
+		return nil, err
+	}
+	return ListRecordsAsOf(ctx, b.inner, asOf, offset, limit)
+}
+
+func (b *BufferedStore) Checkpoint(ctx context.Context) error {
+	if err := b.flush(ctx); err != nil {
+		return err
+	}
+	return b.inner.Checkpoint(ctx)
+}
+
+func (b *BufferedStore) ReIndex(ctx context.Context) error {
+	if err := b.flush(ctx); err != nil {
+		return err
+	}
+	return b.inner.ReIndex(ctx)
+}
+
+func (b *BufferedStore) Backup(ctx context.Context, destPath string) error {
+	if _, err := b.Flush(ctx); err != nil {
+		return fmt.Errorf("failed to flush before backup: %w", err)
+	}
+	return b.inner.Backup(ctx, destPath)
+}
+
+func (b *BufferedStore) ExecuteRaw(query string, args ...interface{}) error {
+	if err := b.flush(context.Background()); err != nil {
+		return err
+	}
+	return b.inner.ExecuteRaw(query, args...)
+}
@@ -0,0 +1,293 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestBufferedStore_FlushOnInterval(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	buffer := collection.NewBufferedStore(coll.Store, collection.WriteBufferOptions{
+		FlushInterval: 20 * time.Millisecond,
+	})
+	defer buffer.Stop(ctx)
+	coll.Store = buffer
+
+	for i := 0; i < 50; i++ {
+		if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: fmt.Sprintf("r-%d", i), ProtoData: []byte(`{}`)}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	// Queued records are visible through the buffer before they are flushed
+	if _, err := coll.GetRecord(ctx, "r-0"); err != nil {
+		t.Errorf("expected queued record to be readable: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for buffer.Stats().Pending > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := buffer.Stats()
+	if stats.Pending != 0 || stats.Flushed != 50 {
+		t.Errorf("expected all records flushed, got %+v", stats)
+	}
+
+	count, err := buffer.Unwrap().CountRecords(ctx)
+	if err != nil {
+		t.Fatalf("CountRecords failed: %v", err)
+	}
+	if count != 50 {
+		t.Errorf("expected 50 records in the store, got %d", count)
+	}
+}
+
+func TestBufferedStore_DuplicateAndFlushErrors(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "existing", ProtoData: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	buffer := collection.NewBufferedStore(coll.Store, collection.WriteBufferOptions{FlushInterval: time.Hour})
+	defer buffer.Stop(ctx)
+	coll.Store = buffer
+
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "new", ProtoData: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "new", ProtoData: []byte(`{}`)}); err == nil {
+		t.Error("expected duplicate queued id to be rejected")
+	}
+
+	// Stored IDs are not looked up per create: the conflict is found, and the
+	// record dropped, at flush time, like one created behind the buffer's back
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "existing", ProtoData: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "late", ProtoData: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := buffer.Unwrap().CreateRecord(ctx, newBufferedRecord("late")); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	flushed, err := buffer.Flush(ctx)
+	if !errors.Is(err, collection.ErrRecordExists) {
+		t.Errorf("expected flush to report the conflicting records, got %v", err)
+	}
+	if flushed != 1 {
+		t.Errorf("expected the valid record to be flushed, got %d", flushed)
+	}
+	if stats := buffer.Stats(); stats.FlushErrors != 1 || stats.LastError == "" || stats.Pending != 0 {
+		t.Errorf("expected flush error to be recorded and the conflicts dropped, got %+v", stats)
+	}
+}
+
+// failingStore fails creates while failing is set.
+type failingStore struct {
+	collection.Store
+	failing atomic.Bool
+}
+
+func (s *failingStore) CreateRecord(ctx context.Context, record *pb.CollectionRecord) error {
+	if s.failing.Load() {
+		return fmt.Errorf("disk unavailable")
+	}
+	return s.Store.CreateRecord(ctx, record)
+}
+
+func TestBufferedStore_KeepsFailedWrites(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+	inner := &failingStore{Store: coll.Store}
+	buffer := collection.NewBufferedStore(inner, collection.WriteBufferOptions{FlushInterval: time.Hour})
+	defer buffer.Stop(context.Background())
+
+	for _, id := range []string{"a", "b"} {
+		if err := buffer.CreateRecord(context.Background(), newBufferedRecord(id)); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	// A reader that gave up does not cancel the flush of acknowledged writes
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n, err := buffer.CountRecords(cancelled); err == nil && n != 2 {
+		t.Errorf("expected both records flushed for a cancelled reader, got %d", n)
+	}
+	if n, _ := inner.Store.CountRecords(context.Background()); n != 2 {
+		t.Errorf("expected both records stored, got %d", n)
+	}
+
+	// Records the store fails stay queued until it recovers
+	inner.failing.Store(true)
+	if err := buffer.CreateRecord(context.Background(), newBufferedRecord("c")); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if _, err := buffer.Flush(context.Background()); err == nil {
+		t.Error("expected the flush to fail")
+	}
+	if stats := buffer.Stats(); stats.Pending != 1 || stats.FlushErrors != 1 {
+		t.Errorf("expected c still queued, got %+v", stats)
+	}
+	if _, err := buffer.GetRecord(context.Background(), "c"); err != nil {
+		t.Errorf("expected c readable while queued: %v", err)
+	}
+	if _, err := buffer.CountRecords(context.Background()); err == nil {
+		t.Error("expected a read that cannot flush c to fail")
+	}
+	inner.failing.Store(false)
+	if n, err := buffer.Flush(context.Background()); err != nil || n != 1 {
+		t.Errorf("expected c flushed once the store recovered, got %d %v", n, err)
+	}
+
+	// Creates after Stop, e.g. through stale handles, go straight to the store
+	if err := buffer.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if err := buffer.CreateRecord(context.Background(), newBufferedRecord("d")); err != nil {
+		t.Fatalf("CreateRecord after Stop failed: %v", err)
+	}
+	if exists, _ := collection.RecordExists(context.Background(), inner.Store, "d"); !exists {
+		t.Error("expected a create after Stop to be written directly")
+	}
+}
+
+func TestBufferedStore_DeadLettersPoisonRecords(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+	ctx := context.Background()
+	inner := &failingStore{Store: coll.Store}
+	var dead []string
+	buffer := collection.NewBufferedStore(inner, collection.WriteBufferOptions{
+		FlushInterval: time.Hour,
+		MaxAttempts:   3,
+		OnDeadLetter: func(record *pb.CollectionRecord, err error) {
+			if err == nil {
+				t.Errorf("expected the last error with dead-lettered record %s", record.Id)
+			}
+			dead = append(dead, record.Id)
+		},
+	})
+	defer buffer.Stop(ctx)
+
+	inner.failing.Store(true)
+	if err := buffer.CreateRecord(ctx, newBufferedRecord("poison")); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := buffer.Flush(ctx); err == nil {
+			t.Fatalf("expected flush %d to fail", i)
+		}
+	}
+	if stats := buffer.Stats(); stats.Pending != 0 || stats.DeadLettered != 1 || stats.FlushErrors != 3 {
+		t.Errorf("expected the record dead-lettered after 3 failed flushes, got %+v", stats)
+	}
+	if fmt.Sprint(dead) != "[poison]" {
+		t.Errorf("expected poison dead-lettered, got %v", dead)
+	}
+
+	// The queue is unblocked for later records
+	inner.failing.Store(false)
+	if err := buffer.CreateRecord(ctx, newBufferedRecord("ok")); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if n, err := buffer.CountRecords(ctx); err != nil || n != 1 {
+		t.Errorf("expected only the later record stored, got %d, %v", n, err)
+	}
+}
+
+func TestBufferedStore_Backpressure(t *testing.T) {
+	coll, cleanup := setupTestCollection(t)
+	defer cleanup()
+
+	buffer := collection.NewBufferedStore(coll.Store, collection.WriteBufferOptions{
+		FlushInterval: time.Hour,
+		MaxBatchSize:  100,
+		MaxPending:    2,
+	})
+	defer buffer.Stop(context.Background())
+
+	// With a full buffer, creates wake the flusher and proceed once it drains
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 10; i++ {
+		if err := buffer.CreateRecord(ctx, newBufferedRecord(fmt.Sprintf("r-%d", i))); err != nil {
+			t.Fatalf("CreateRecord %d failed: %v", i, err)
+		}
+	}
+	if _, err := buffer.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if stats := buffer.Stats(); stats.Flushed != 10 {
+		t.Errorf("expected 10 flushed records, got %d", stats.Flushed)
+	}
+}
+
+func TestCollectionServer_FlushWriteBehind(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+	server := collection.NewCollectionServer(repo)
+	ctx := context.Background()
+
+	_, err := repo.CreateCollection(ctx, &pb.Collection{
+		Namespace:   "test",
+		Name:        "ingest",
+		WriteBehind: &pb.WriteBehindConfig{Enabled: true, FlushIntervalMs: 60000},
+	})
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err := server.Create(ctx, &pb.CreateRequest{
+			Namespace:      "test",
+			CollectionName: "ingest",
+			Id:             fmt.Sprintf("e-%d", i),
+			Item:           &anypb.Any{Value: []byte(`{"n": 1}`)},
+		})
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+
+	resp, err := server.Flush(ctx, &pb.FlushRequest{Namespace: "test", CollectionName: "ingest"})
+	if err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if resp.Flushed != 5 {
+		t.Errorf("expected 5 flushed records, got %d", resp.Flushed)
+	}
+
+	desc, err := server.Describe(ctx, &pb.DescribeRequest{Namespace: "test", CollectionName: "ingest"})
+	if err != nil {
+		t.Fatalf("Describe failed: %v", err)
+	}
+	if desc.RecordCount != 5 || desc.WriteBehindStats.GetPending() != 0 {
+		t.Errorf("unexpected describe result: count=%d stats=%+v", desc.RecordCount, desc.WriteBehindStats)
+	}
+}
+
+func newBufferedRecord(id string) *pb.CollectionRecord {
+	now := timestamppb.Now()
+	return &pb.CollectionRecord{
+		Id:        id,
+		ProtoData: []byte(`{}`),
+		Metadata:  &pb.Metadata{CreatedAt: now, UpdatedAt: now},
+	}
+}
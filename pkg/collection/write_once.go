@@ -0,0 +1,111 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// ErrRecordSealed is returned for updates and deletes of records in a
+	// write-once collection.
+	ErrRecordSealed = errors.New("record is sealed in a write-once collection")
+	// ErrWriteOnceUnavailable is returned when creating a write-once
+	// collection in a repository without a StoreOpener.
+	ErrWriteOnceUnavailable = errors.New("write-once collections are not enabled")
+)
+
+// WriteOnceSchema seals the records of a write-once store. Attachments can
+// still be added to a record, which only sets its data_uri; everything else
+// about it, and its existence, is fixed once it is created.
+const WriteOnceSchema = `
+CREATE TRIGGER IF NOT EXISTS records_write_once_bu BEFORE UPDATE OF id, proto_data, encoding, created_at, updated_at, labels ON records BEGIN
+    SELECT RAISE(ABORT, 'write-once collection: records are sealed');
+END;
+CREATE TRIGGER IF NOT EXISTS records_write_once_bd BEFORE DELETE ON records BEGIN
+    SELECT RAISE(ABORT, 'write-once collection: records are sealed');
+END;
+`
+
+// writeOnce reports whether the collection's records are sealed once
+// created.
+func (c *Collection) writeOnce() bool {
+	return c.Meta.GetStoreOptions().GetWriteOnce()
+}
+
+// sealed returns ErrRecordSealed for a write to a record of a write-once
+// collection. The store enforces the same; checking first keeps a refused
+// delete from removing the record's files.
+func (c *Collection) sealed(action, id string) error {
+	if !c.writeOnce() {
+		return nil
+	}
+	return fmt.Errorf("%w: cannot %s %s", ErrRecordSealed, action, id)
+}
+
+// createOwnStore creates a write-once or partitioned collection on a store
+// of its own, opened where the layout keeps collection stores, since the
+// seal applies to every record of a store, partitions split all of them by
+// time, and the repository's shared store holds other collections.
+func (r *DefaultCollectionRepo) createOwnStore(ctx context.Context, collection *pb.Collection) (*pb.CreateCollectionResponse, error) {
+	writeOnce, period := collection.StoreOptions.GetWriteOnce(), collection.StoreOptions.GetPartitionPeriod()
+	if r.opener == nil {
+		if writeOnce {
+			return nil, ErrWriteOnceUnavailable
+		}
+		return nil, ErrPartitionedUnavailable
+	}
+	key := collection.Namespace + "/" + collection.Name
+	r.service.mu.RLock()
+	_, exists := r.service.collections[key]
+	r.service.mu.RUnlock()
+	if exists {
+		return nil, fmt.Errorf("collection %s already exists", key)
+	}
+
+	// The collection's store has the shared store's features, sealed or
+	// partitioned
+	stored := proto.Clone(collection.StoreOptions).(*pb.StoreOptions)
+	if reporter, ok := r.store.(OptionsReporter); ok {
+		stored = reporter.StoreOptions().Proto()
+		stored.WriteOnce = writeOnce
+		stored.PartitionPeriod = period
+	}
+	path := r.layout.CollectionDB(collection.Namespace, collection.Name)
+	for _, existing := range []string{path, PartitionsDir(path)} {
+		if _, err := os.Stat(existing); err == nil {
+			return nil, fmt.Errorf("collection %s already has a store at %s", key, existing)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create collection directory: %w", err)
+	}
+	store, err := r.opener(path, stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open collection store: %w", err)
+	}
+	collection = proto.Clone(collection).(*pb.Collection)
+	if reporter, ok := store.(OptionsReporter); ok {
+		collection.StoreOptions = reporter.StoreOptions().Proto()
+	}
+	collection.StoreOptions.WriteOnce = writeOnce
+	collection.StoreOptions.PartitionPeriod = period
+	collection.StoragePath = r.layout.Root
+
+	resp, err := r.service.CreateCollection(ctx, collection)
+	if err != nil {
+		store.Close()
+		removeStoreFiles(path)
+		os.RemoveAll(PartitionsDir(path))
+		return nil, err
+	}
+	r.storageMu.Lock()
+	r.storage[key] = &collectionStorage{dir: r.layout.Root, store: store}
+	r.storageMu.Unlock()
+	return resp, nil
+}
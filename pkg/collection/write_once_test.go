@@ -0,0 +1,94 @@
+package collection_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+)
+
+func TestWriteOnceCollection(t *testing.T) {
+	ctx := context.Background()
+	repoIface, cleanup := setupTestRepo(t)
+	defer cleanup()
+	repo := repoIface.(*collection.DefaultCollectionRepo)
+	dir := t.TempDir()
+	layout := collection.NewPathLayout(filepath.Join(dir, "data"))
+	repo.SetPathLayout(layout)
+	audit := &pb.Collection{Namespace: "test", Name: "audit", StoreOptions: &pb.StoreOptions{WriteOnce: true}}
+
+	// Write-once collections need their own store
+	if _, err := repo.CreateCollection(ctx, audit); !errors.Is(err, collection.ErrWriteOnceUnavailable) {
+		t.Fatalf("expected ErrWriteOnceUnavailable without a store opener, got %v", err)
+	}
+	repo.SetStoreOpener(sqlite.StoreOpener(collection.Options{EnableJSON: true}))
+	if _, err := repo.CreateCollection(ctx, audit); err != nil {
+		t.Fatalf("failed to create write-once collection: %v", err)
+	}
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "test", Name: "docs"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+
+	coll, err := repo.GetCollection(ctx, "test", "audit")
+	if err != nil {
+		t.Fatalf("GetCollection failed: %v", err)
+	}
+	if !coll.Meta.StoreOptions.GetWriteOnce() || !coll.Meta.StoreOptions.GetEnableFts() {
+		t.Errorf("expected the shared store's options, sealed, got %v", coll.Meta.StoreOptions)
+	}
+	if got, want := coll.Store.Path(), layout.CollectionDB("test", "audit"); got != want {
+		t.Errorf("expected the collection's own store at %s, got %s", want, got)
+	}
+	if err := coll.CreateRecord(ctx, &pb.CollectionRecord{Id: "e1", ProtoData: []byte(`{"event": "login"}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	// Updates and deletes are refused by the collection and by its store
+	if err := coll.UpdateRecord(ctx, &pb.CollectionRecord{Id: "e1", ProtoData: []byte(`{"event": "logout"}`)}); !errors.Is(err, collection.ErrRecordSealed) {
+		t.Errorf("expected ErrRecordSealed updating, got %v", err)
+	}
+	if err := coll.DeleteRecord(ctx, "e1"); !errors.Is(err, collection.ErrRecordSealed) {
+		t.Errorf("expected ErrRecordSealed deleting, got %v", err)
+	}
+	record, _ := coll.GetRecord(ctx, "e1")
+	record.ProtoData = []byte(`{"event": "tampered"}`)
+	if err := coll.Store.UpdateRecord(ctx, record); !errors.Is(err, collection.ErrRecordSealed) {
+		t.Errorf("expected the store to refuse an update, got %v", err)
+	}
+	if err := coll.Store.DeleteRecord(ctx, "e1"); !errors.Is(err, collection.ErrRecordSealed) {
+		t.Errorf("expected the store to refuse a delete, got %v", err)
+	}
+	if record, err := coll.GetRecord(ctx, "e1"); err != nil || string(record.ProtoData) != `{"event": "login"}` {
+		t.Errorf("expected the record unchanged, got %v %v", record, err)
+	}
+
+	// Other collections on the shared store are unaffected
+	docs, _ := repo.GetCollection(ctx, "test", "docs")
+	if err := docs.CreateRecord(ctx, &pb.CollectionRecord{Id: "d1", ProtoData: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := docs.DeleteRecord(ctx, "d1"); err != nil {
+		t.Errorf("expected deletes allowed elsewhere, got %v", err)
+	}
+
+	// Nor can the collection be unsealed by replacing it
+	server := collection.NewGrpcServerWithLayout(repo, layout)
+	backup, _ := server.BackupCollection(ctx, &pb.BackupCollectionRequest{
+		Collection: &pb.NamespacedName{Namespace: "test", Name: "audit"}, DestPath: filepath.Join(dir, "backups", "audit.db"),
+	})
+	if backup.Status.Code != pb.Status_OK {
+		t.Fatalf("backup failed: %v", backup.Status)
+	}
+	restore, _ := server.RestoreBackup(ctx, &pb.RestoreBackupRequest{BackupId: backup.Backup.BackupId, DestNamespace: "test", DestName: "audit", Overwrite: true})
+	if restore.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION overwriting a write-once collection, got %v", restore.Status)
+	}
+	repo.UpdateCollectionMetadata(ctx, "test", "audit", &pb.Collection{Namespace: "test", Name: "audit"})
+	if coll, _ := repo.GetCollection(ctx, "test", "audit"); !coll.Meta.StoreOptions.GetWriteOnce() {
+		t.Errorf("expected metadata updates to keep the collection write-once")
+	}
+}
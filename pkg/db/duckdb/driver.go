@@ -0,0 +1,6 @@
+//go:build !duckdb
+
+package duckdb
+
+// linkedDriver is the database/sql driver linked into the collector, if any.
+const linkedDriver = ""
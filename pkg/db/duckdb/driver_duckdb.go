@@ -0,0 +1,8 @@
+//go:build duckdb
+
+package duckdb
+
+import _ "github.com/marcboeker/go-duckdb" // Registers "duckdb"; needs cgo
+
+// linkedDriver is the database/sql driver linked into the collector.
+const linkedDriver = "duckdb"
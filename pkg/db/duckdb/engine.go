@@ -0,0 +1,135 @@
+// Package duckdb runs analytics queries (see collection.AnalyticsEngine) on
+// DuckDB, whose columnar execution suits aggregations and joins over whole
+// collections better than SQLite's.
+//
+// DuckDB's driver needs cgo, so the package only links one, from
+// github.com/marcboeker/go-duckdb, when built with the duckdb build tag
+// (go build -tags duckdb); Linked then returns an engine using it. Without
+// the tag, import a driver that registers with database/sql and pass its
+// name to New.
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// lockdown is run once the attachments are loaded, before the query: it
+// keeps the query from reading or writing files, or fetching URLs, through
+// DuckDB's table functions, and from setting that back.
+var lockdown = []string{
+	"SET enable_external_access = false",
+	"SET lock_configuration = true",
+}
+
+// Engine runs each analytics query in an in-memory DuckDB database of its
+// own. Every attachment is loaded into a table <alias>.records with the
+// columns of collection.AnalyticsColumns: DuckDB cannot read SQLite files
+// without an extension it downloads at runtime, and the stored proto_data
+// may be compressed or shared between records, which only the store can
+// undo.
+type Engine struct {
+	// LoadLimit caps the records each query loads.
+	LoadLimit collection.AnalyticsLoadLimit
+
+	driverName string
+}
+
+// New returns an engine opening DuckDB databases with the named
+// database/sql driver.
+func New(driverName string) *Engine {
+	return &Engine{driverName: driverName}
+}
+
+// Linked returns an engine using the driver linked by the duckdb build tag,
+// or an error if the collector was built without it.
+func Linked() (*Engine, error) {
+	if linkedDriver == "" {
+		return nil, fmt.Errorf("DuckDB is not linked: build with -tags duckdb (requires cgo)")
+	}
+	return New(linkedDriver), nil
+}
+
+// Name returns the engine identifier.
+func (e *Engine) Name() string { return "duckdb" }
+
+// Query loads the attachments into a fresh database and runs the query.
+func (e *Engine) Query(ctx context.Context, attachments []collection.AnalyticsAttachment, query string, maxRows int) (*collection.AnalyticsResult, error) {
+	if err := collection.ValidateAnalyticsQuery(query); err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		if err := collection.ValidateAnalyticsAlias(a.Alias); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open(e.driverName, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open analytics session: %w", err)
+	}
+	defer db.Close()
+
+	// Settings are per-connection, so pin the session to a single connection.
+	db.SetMaxOpenConns(1)
+
+	budget := e.LoadLimit.Start()
+	for _, a := range attachments {
+		if err := load(ctx, db, a, budget); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", a.Alias, err)
+		}
+	}
+	for _, stmt := range lockdown {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("failed to restrict analytics session: %w", err)
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", collection.ErrInvalidAnalyticsQuery, err)
+	}
+	defer rows.Close()
+	return collection.ReadAnalyticsResult(rows, maxRows)
+}
+
+// schema returns the statements creating the table an attachment is loaded
+// into. alias has been validated.
+func schema(alias string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE SCHEMA "%s"`, alias),
+		fmt.Sprintf(`CREATE TABLE "%s".records (
+			id VARCHAR PRIMARY KEY, proto_data BLOB, data_uri VARCHAR, created_at BIGINT, updated_at BIGINT,
+			labels VARCHAR, jsontext VARCHAR, checksum VARCHAR, hlc BIGINT)`, alias),
+	}
+}
+
+// load copies the records of an attachment into <alias>.records.
+func load(ctx context.Context, db *sql.DB, a collection.AnalyticsAttachment, budget *collection.AnalyticsLoad) error {
+	for _, stmt := range schema(a.Alias) {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(`INSERT INTO "%s".records VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, a.Alias))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	err = collection.ScanAnalyticsRecords(ctx, a.Store, budget, func(row []interface{}) error {
+		_, err := stmt.ExecContext(ctx, row...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,66 @@
+//go:build duckdb
+
+package duckdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestLinkedEngine_EndToEnd(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), "orders.db"), collection.Options{
+		EnableJSON:  true,
+		Compression: &collection.CompressionOptions{MinSize: 16},
+	})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 10; i++ {
+		region := "east"
+		if i%2 == 0 {
+			region = "west"
+		}
+		if err := store.CreateRecord(ctx, &pb.CollectionRecord{
+			Id:        fmt.Sprintf("order-%d", i),
+			ProtoData: []byte(fmt.Sprintf(`{"region": %q, "amount": %d, "note": "a note long enough to compress"}`, region, i*10)),
+			Metadata:  &pb.Metadata{CreatedAt: timestamppb.Now(), UpdatedAt: timestamppb.Now()},
+		}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	engine, err := Linked()
+	if err != nil {
+		t.Fatalf("Linked failed: %v", err)
+	}
+	attachments := []collection.AnalyticsAttachment{{Alias: "o", Store: store}}
+
+	// Records are loaded decoded, and DuckDB SQL runs over them
+	result, err := engine.Query(ctx, attachments, `SELECT contains(jsontext, '"east"') AS east, COUNT(*) AS n
+		FROM o.records GROUP BY east ORDER BY east`, 0)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if got := fmt.Sprint(result.Rows); got != "[[false 5] [true 5]]" {
+		t.Errorf("unexpected rows %s", got)
+	}
+
+	// Queries cannot reach files, and limits hold
+	if _, err := engine.Query(ctx, attachments, "SELECT * FROM read_csv_auto('/etc/hostname')", 0); !errors.Is(err, collection.ErrInvalidAnalyticsQuery) {
+		t.Errorf("expected reading a file to be refused, got %v", err)
+	}
+	engine.LoadLimit = collection.AnalyticsLoadLimit{MaxRecords: 5}
+	if _, err := engine.Query(ctx, attachments, "SELECT COUNT(*) FROM o.records", 0); !errors.Is(err, collection.ErrAnalyticsTooLarge) {
+		t.Errorf("expected ErrAnalyticsTooLarge, got %v", err)
+	}
+}
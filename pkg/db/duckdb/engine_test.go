@@ -0,0 +1,39 @@
+package duckdb
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestQueryValidatesBeforeOpening(t *testing.T) {
+	// No driver is registered under this name, so anything that got as far
+	// as opening a session would fail differently
+	e := New("duckdb-not-linked")
+	ctx := context.Background()
+
+	if _, err := e.Query(ctx, nil, "DELETE FROM o.records", 0); err == nil || !strings.Contains(err.Error(), "only SELECT") {
+		t.Errorf("expected a write to be refused, got %v", err)
+	}
+	bad := []collection.AnalyticsAttachment{{Alias: `o"; DROP`}}
+	if _, err := e.Query(ctx, bad, "SELECT 1", 0); err == nil || !strings.Contains(err.Error(), "invalid alias") {
+		t.Errorf("expected an invalid alias to be refused, got %v", err)
+	}
+	if _, err := e.Query(ctx, nil, "SELECT 1", 0); err == nil || !strings.Contains(err.Error(), "duckdb-not-linked") {
+		t.Errorf("expected the missing driver to be reported, got %v", err)
+	}
+}
+
+func TestSchemaQuotesAlias(t *testing.T) {
+	stmts := schema("select")
+	if len(stmts) != 2 || stmts[0] != `CREATE SCHEMA "select"` || !strings.HasPrefix(stmts[1], `CREATE TABLE "select".records (`) {
+		t.Errorf("unexpected schema: %q", stmts)
+	}
+	for _, col := range collection.AnalyticsColumns {
+		if !strings.Contains(stmts[1], col+" ") {
+			t.Errorf("schema lacks column %s", col)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package postgres
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/storetest"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// dsnEnv names the Postgres database the integration tests run against; they
+// are skipped when it is unset.
+const dsnEnv = "COLLECTOR_POSTGRES_DSN"
+
+// testDB returns a connection to the database in dsnEnv, or skips t.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv(dsnEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", dsnEnv)
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		t.Fatalf("failed to connect to %s: %v", dsnEnv, err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestConformance(t *testing.T) {
+	db := testDB(t)
+	storetest.Run(t, func(t *testing.T, opts collection.Options) collection.Store {
+		suffix := make([]byte, 8)
+		rand.Read(suffix)
+		table := "storetest_" + hex.EncodeToString(suffix)
+		store, err := NewPostgresStore(db, table, opts)
+		if err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		t.Cleanup(func() {
+			db.Exec(`DROP TABLE IF EXISTS ` + quoteIdent(table))
+			store.Close()
+		})
+		return store
+	})
+}
@@ -0,0 +1,294 @@
+package postgres
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// rebind numbers the ? placeholders of q as Postgres' $1, $2, ... Queries
+// are built with ?, as in the SQLite store, so clauses can be composed
+// without tracking argument positions; none of the SQL they use contains a
+// literal ?.
+func rebind(q string) string {
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(q); i++ {
+		if q[i] == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(q[i])
+	}
+	return b.String()
+}
+
+// pathLiteral renders path as a Postgres text[] literal, for the #> and
+// #>> operators.
+func pathLiteral(path collection.FieldPath) string {
+	elems := make([]string, len(path))
+	for i, seg := range path {
+		if seg.IsIndex {
+			elems[i] = strconv.Itoa(seg.Index)
+			continue
+		}
+		elems[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(seg.Key) + `"`
+	}
+	return "{" + strings.Join(elems, ",") + "}"
+}
+
+// jsonArg is a filter value as a jsonb argument.
+func jsonArg(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// searchFrom builds the FROM and WHERE clauses shared by Search and
+// CountMatching.
+func (s *PostgresStore) searchFrom(q *collection.SearchQuery) (string, []interface{}, error) {
+	if !q.AsOf.IsZero() {
+		return "", nil, collection.ErrHistoryUnavailable
+	}
+	if q.Geo != nil {
+		return "", nil, fmt.Errorf("geo filters are not supported by the postgres store")
+	}
+	if q.FullText != "" && !s.StoreOptions().EnableFTS {
+		return "", nil, fmt.Errorf("full-text search is not enabled for this collection")
+	}
+
+	var args []interface{}
+	var whereClauses []string
+	if q.FullText != "" {
+		whereClauses = append(whereClauses, `r.fts @@ websearch_to_tsquery('`+s.config+`', ?)`)
+		args = append(args, q.FullText)
+	}
+	if len(q.IDs) > 0 {
+		whereClauses = append(whereClauses, `r.id IN (?`+strings.Repeat(", ?", len(q.IDs)-1)+`)`)
+		for _, id := range q.IDs {
+			args = append(args, id)
+		}
+	}
+
+	// JSON filters
+	for key, filter := range q.Filters {
+		clause, clauseArgs, err := filterClause(key, filter)
+		if err != nil {
+			return "", nil, err
+		}
+		whereClauses = append(whereClauses, clause)
+		args = append(args, clauseArgs...)
+	}
+
+	// Label selector
+	for _, req := range q.LabelRequirements() {
+		clause, clauseArgs := labelClause(req)
+		whereClauses = append(whereClauses, clause)
+		args = append(args, clauseArgs...)
+	}
+
+	// Creation-time range
+	if !q.CreatedAfter.IsZero() {
+		whereClauses = append(whereClauses, `r.created_at >= ?`)
+		args = append(args, q.CreatedAfter.Unix())
+	}
+	if !q.CreatedBefore.IsZero() {
+		whereClauses = append(whereClauses, `r.created_at < ?`)
+		args = append(args, q.CreatedBefore.Unix())
+	}
+
+	from := `FROM ` + quoteIdent(s.table) + ` r`
+	if len(whereClauses) > 0 {
+		from += " WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	return from, args, nil
+}
+
+// jsonField is SQL for a jsonb value whose placeholders are bound by args.
+type jsonField struct {
+	value string
+	args  []interface{}
+}
+
+// repeat returns the field's args n times, for SQL that uses the field n
+// times.
+func (f jsonField) repeat(n int) []interface{} {
+	var args []interface{}
+	for i := 0; i < n; i++ {
+		args = append(args, f.args...)
+	}
+	return args
+}
+
+// text is the field as text: strings unquoted, other values as JSON.
+func (f jsonField) text() string {
+	return `(` + f.value + ` #>> '{}')`
+}
+
+// day is the UTC date of the field, which may hold a timestamp string or
+// Unix seconds.
+func (f jsonField) day() string {
+	return `(CASE WHEN jsonb_typeof(` + f.value + `) = 'number' THEN (to_timestamp(` + f.text() + `::double precision) AT TIME ZONE 'UTC')::date ELSE (` + f.text() + `::timestamptz AT TIME ZONE 'UTC')::date END)`
+}
+
+// arrayElements is SQL for the elements of the array at path, or none if the
+// value there is not an array.
+const arrayElements = `jsonb_array_elements(CASE WHEN jsonb_typeof(r.jsontext #> ?::text[]) = 'array' THEN r.jsontext #> ?::text[] ELSE '[]'::jsonb END)`
+
+// filterClause translates a filter on a field path into a condition on the
+// record JSON, with the same semantics as the SQLite store: paths with [*]
+// match when any array element satisfies the filter, and NOT_EXISTS on them
+// matches when no element has the field.
+func filterClause(key string, filter collection.Filter) (string, []interface{}, error) {
+	if _, isCall, _ := collection.ParseFunctionCall(key); isCall {
+		return "", nil, fmt.Errorf("%w: custom functions are not supported by the Postgres store: %q", collection.ErrInvalidFunctionCall, key)
+	}
+	path, err := collection.ParseFieldPath(key)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := filter.Validate(); err != nil {
+		return "", nil, err
+	}
+
+	array, element, wildcard := path.SplitWildcard()
+	switch filter.Operator {
+	case collection.OpArrayContains, collection.OpArrayContainsAny:
+		if wildcard {
+			return "", nil, fmt.Errorf("%s cannot be used with [*] in %q", filter.Operator, key)
+		}
+		return arrayContainsClause(pathLiteral(path), filter)
+	}
+	if !wildcard {
+		return compareClause(jsonField{value: `(r.jsontext #> ?::text[])`, args: []interface{}{pathLiteral(path)}}, filter)
+	}
+
+	field := jsonField{value: `e.value`}
+	if len(element) > 0 {
+		field = jsonField{value: `(e.value #> ?::text[])`, args: []interface{}{pathLiteral(element)}}
+	}
+	negate := filter.Operator == collection.OpNotExists
+	if negate {
+		filter.Operator = collection.OpExists
+	}
+	cond, condArgs, err := compareClause(field, filter)
+	if err != nil {
+		return "", nil, err
+	}
+	clause := `EXISTS (SELECT 1 FROM ` + arrayElements + ` e(value) WHERE ` + cond + `)`
+	if negate {
+		clause = `NOT ` + clause
+	}
+	arrayPath := pathLiteral(array)
+	return clause, append([]interface{}{arrayPath, arrayPath}, condArgs...), nil
+}
+
+// compareClause applies a scalar filter operator to field. Values are
+// compared as jsonb, so numbers compare numerically and strings as text.
+func compareClause(field jsonField, filter collection.Filter) (string, []interface{}, error) {
+	args := field.repeat(1)
+	value := field.value
+	switch filter.Operator {
+	case collection.OpExists:
+		return value + ` IS NOT NULL`, args, nil
+	case collection.OpNotExists:
+		return value + ` IS NULL`, args, nil
+	case collection.OpIsNull:
+		return `jsonb_typeof(` + value + `) = 'null'`, args, nil
+	case collection.OpIsNotNull:
+		return `jsonb_typeof(` + value + `) != 'null'`, args, nil
+	case collection.OpContains:
+		return field.text() + ` LIKE ?`, append(args, "%"+fmt.Sprintf("%v", filter.Value)+"%"), nil
+	case collection.OpIn:
+		values := collection.FilterValues(filter.Value)
+		if len(values) == 0 {
+			return `FALSE`, nil, nil
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?::jsonb, ", len(values)), ", ")
+		for _, v := range values {
+			args = append(args, jsonArg(v))
+		}
+		return value + ` IN (` + placeholders + `)`, args, nil
+	case collection.OpBetween:
+		bounds := collection.FilterValues(filter.Value)
+		return value + ` BETWEEN ?::jsonb AND ?::jsonb`, append(args, jsonArg(bounds[0]), jsonArg(bounds[1])), nil
+	case collection.OpSameDay, collection.OpSameWeek:
+		t, _ := collection.FilterTime(filter.Value)
+		day := field.day()
+		if filter.Operator == collection.OpSameWeek {
+			// Postgres weeks start on Monday, as collection.WeekStart does
+			day = `date_trunc('week', ` + day + `)::date`
+			t = collection.WeekStart(t)
+		}
+		return day + ` = ?::date`, append(field.repeat(3), t.Format(time.DateOnly)), nil
+	case collection.OpEquals, collection.OpNotEquals, collection.OpGreaterThan,
+		collection.OpLessThan, collection.OpGreaterEqual, collection.OpLessEqual:
+		return fmt.Sprintf(`%s %s ?::jsonb`, value, filter.Operator), append(args, jsonArg(filter.Value)), nil
+	}
+	return "", nil, fmt.Errorf("unsupported filter operator %q", filter.Operator)
+}
+
+// arrayContainsClause matches records whose array at path holds every value
+// (OpArrayContains) or any value (OpArrayContainsAny) of the filter.
+func arrayContainsClause(path string, filter collection.Filter) (string, []interface{}, error) {
+	values := collection.FilterValues(filter.Value)
+	if len(values) == 0 {
+		return "", nil, fmt.Errorf("%s requires a value", filter.Operator)
+	}
+	const contains = `r.jsontext #> ?::text[] @> ?::jsonb`
+
+	if filter.Operator == collection.OpArrayContains {
+		return contains, []interface{}{path, jsonArg(values)}, nil
+	}
+	clauses := make([]string, len(values))
+	var args []interface{}
+	for i, v := range values {
+		clauses[i] = contains
+		args = append(args, path, jsonArg([]interface{}{v}))
+	}
+	return `(` + strings.Join(clauses, ` OR `) + `)`, args, nil
+}
+
+// orderByPath returns the path to sort by as a text[] literal.
+func orderByPath(field string) (string, error) {
+	path, err := collection.ParseFieldPath(field)
+	if err != nil {
+		return "", err
+	}
+	if _, _, wildcard := path.SplitWildcard(); wildcard {
+		return "", fmt.Errorf("cannot order by %q: [*] paths select several values", field)
+	}
+	return pathLiteral(path), nil
+}
+
+// labelClause translates a selector requirement into a condition on the
+// labels column.
+func labelClause(req collection.Requirement) (string, []interface{}) {
+	const label = `(r.labels ->> ?)`
+	args := []interface{}{req.Key}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(req.Values)), ", ")
+	values := make([]interface{}, len(req.Values))
+	for i, v := range req.Values {
+		values[i] = v
+	}
+
+	switch req.Operator {
+	case collection.SelectorEquals:
+		return label + ` = ?`, append(args, values...)
+	case collection.SelectorNotEquals:
+		return `coalesce(` + label + ` != ?, TRUE)`, append(args, values...)
+	case collection.SelectorIn:
+		return label + ` IN (` + placeholders + `)`, append(args, values...)
+	case collection.SelectorNotIn:
+		return `coalesce(` + label + ` NOT IN (` + placeholders + `), TRUE)`, append(args, values...)
+	case collection.SelectorDoesNotExist:
+		return label + ` IS NULL`, args
+	default:
+		return label + ` IS NOT NULL`, args
+	}
+}
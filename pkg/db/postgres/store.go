@@ -0,0 +1,588 @@
+// Package postgres implements collection.Store on PostgreSQL, so that the
+// collectors of a multi-node deployment can keep their collections in one
+// shared database instead of local SQLite files.
+//
+// The package does not link a driver. Import one that registers with
+// database/sql, such as github.com/jackc/pgx/v5/stdlib ("pgx") or
+// github.com/lib/pq ("postgres"), and pass its name to Open, or open the
+// *sql.DB yourself and share it between stores with NewPostgresStore.
+package postgres
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// MaxTableNameLength leaves room under Postgres' 63-byte identifier limit for
+// the suffixes of the table's index names.
+const MaxTableNameLength = 48
+
+// backupBatchSize is how many records Backup copies per SQLite transaction.
+const backupBatchSize = 500
+
+var tableNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// PostgresStore keeps one collection's records in a Postgres table. Record
+// data is stored as bytea and, when it is JSON, as jsonb for filtering;
+// full-text search uses a generated tsvector column.
+type PostgresStore struct {
+	db      *sql.DB
+	owned   bool // Close closes db, see Open
+	table   string
+	options collection.Options
+	config  string // Text search configuration
+	mu      sync.RWMutex
+}
+
+// Open connects to the database at dsn with the named database/sql driver
+// and returns a store for table. Closing the store closes the connection.
+func Open(driverName, dsn, table string, opts collection.Options) (*PostgresStore, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %w", err)
+	}
+	store, err := NewPostgresStore(db, table, opts)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	store.owned = true
+	return store, nil
+}
+
+// NewPostgresStore returns a store for table in db, creating the table and
+// its indexes if needed. Stores may share db; closing one leaves db open.
+//
+// Geo indexes, history, compression, deduplication, similarity and query
+// synonyms and stopwords are SQLite features and are refused.
+func NewPostgresStore(db *sql.DB, table string, opts collection.Options) (*PostgresStore, error) {
+	if !tableNamePattern.MatchString(table) || len(table) > MaxTableNameLength {
+		return nil, fmt.Errorf("invalid table name %q: want lowercase letters, digits and underscores, at most %d bytes", table, MaxTableNameLength)
+	}
+	if err := checkOptions(opts); err != nil {
+		return nil, err
+	}
+	language, err := collection.ParseLanguage(string(opts.Language))
+	if err != nil {
+		return nil, err
+	}
+	opts.Language = language
+
+	s := &PostgresStore{db: db, table: table, options: opts, config: textSearchConfig(language)}
+	for _, stmt := range s.schema(opts) {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("schema failed: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// checkOptions refuses the options only the SQLite store implements.
+func checkOptions(opts collection.Options) error {
+	var unsupported []string
+	if opts.EnableHistory {
+		unsupported = append(unsupported, "history")
+	}
+	if opts.Geo != nil {
+		unsupported = append(unsupported, "geo index")
+	}
+	if opts.Compression != nil {
+		unsupported = append(unsupported, "compression")
+	}
+	if opts.Deduplicate {
+		unsupported = append(unsupported, "deduplication")
+	}
+	if opts.EnableSimilarity {
+		unsupported = append(unsupported, "similarity")
+	}
+	if len(opts.Synonyms) > 0 || len(opts.Stopwords) > 0 {
+		unsupported = append(unsupported, "synonyms and stopwords")
+	}
+	if opts.EnableVector {
+		unsupported = append(unsupported, "vector search")
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("postgres store does not support %s", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// textSearchConfig is the Postgres text search configuration closest to
+// language. Postgres has no CJK segmentation, so CJK text is split on
+// whitespace and punctuation only.
+func textSearchConfig(language collection.Language) string {
+	if language == collection.LanguageEnglish {
+		return "english"
+	}
+	return "simple"
+}
+
+// schema returns the statements creating the table and the indexes opts
+// needs.
+func (s *PostgresStore) schema(opts collection.Options) []string {
+	t := quoteIdent(s.table)
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS ` + t + ` (
+			id TEXT PRIMARY KEY,
+			proto_data BYTEA,
+			data_uri TEXT,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL,
+			labels JSONB NOT NULL DEFAULT '{}',
+			jsontext JSONB NOT NULL DEFAULT '{}'
+		)`,
+		`ALTER TABLE ` + t + ` ADD COLUMN IF NOT EXISTS checksum TEXT`,
+		`ALTER TABLE ` + t + ` ADD COLUMN IF NOT EXISTS hlc BIGINT`,
+		`CREATE INDEX IF NOT EXISTS ` + quoteIdent(s.table+"_created_at") + ` ON ` + t + ` (created_at)`,
+		`CREATE INDEX IF NOT EXISTS ` + quoteIdent(s.table+"_labels") + ` ON ` + t + ` USING GIN (labels)`,
+	}
+	if opts.EnableJSON {
+		stmts = append(stmts, `CREATE INDEX IF NOT EXISTS `+quoteIdent(s.table+"_jsontext")+` ON `+t+` USING GIN (jsontext jsonb_path_ops)`)
+	}
+	if opts.EnableFTS {
+		stmts = append(stmts,
+			`ALTER TABLE `+t+` ADD COLUMN IF NOT EXISTS fts tsvector GENERATED ALWAYS AS (to_tsvector('`+s.config+`', jsontext)) STORED`,
+			`CREATE INDEX IF NOT EXISTS `+quoteIdent(s.table+"_fts")+` ON `+t+` USING GIN (fts)`)
+	}
+	return stmts
+}
+
+// TableName returns a table name for the collection namespace/name that is
+// valid for NewPostgresStore and distinct from every other collection's.
+func TableName(namespace, name string) string {
+	sum := sha256.Sum256([]byte(namespace + "/" + name))
+	prefix := "records_" + sanitize(namespace) + "_" + sanitize(name)
+	if max := MaxTableNameLength - 9; len(prefix) > max {
+		prefix = prefix[:max]
+	}
+	return fmt.Sprintf("%s_%x", prefix, sum[:4])
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, s)
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// StoreOptions returns the options the store was opened with.
+func (s *PostgresStore) StoreOptions() collection.Options {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.options
+}
+
+// Upgrade adds the JSON and full-text indexes if opts asks for them and the
+// store lacks them. Adding the generated full-text column indexes the
+// records already stored; Upgrade returns how many there were.
+func (s *PostgresStore) Upgrade(ctx context.Context, opts collection.Options) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addFTS := opts.EnableFTS && !s.options.EnableFTS
+	upgraded := s.options
+	upgraded.EnableJSON = s.options.EnableJSON || opts.EnableJSON
+	upgraded.EnableFTS = s.options.EnableFTS || opts.EnableFTS
+	for _, stmt := range s.schema(upgraded) {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return 0, fmt.Errorf("schema failed: %w", err)
+		}
+	}
+	s.options = upgraded
+	if !addFTS {
+		return 0, nil
+	}
+	var indexed int64
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+quoteIdent(s.table)).Scan(&indexed)
+	return indexed, err
+}
+
+// Table returns the store's table name.
+func (s *PostgresStore) Table() string { return s.table }
+
+func (s *PostgresStore) Close() error {
+	if s.owned {
+		return s.db.Close()
+	}
+	return nil
+}
+
+// Path returns "": the store has no file for file-based transports to copy.
+// Backup exports it to one.
+func (s *PostgresStore) Path() string { return "" }
+
+// recordArgs returns the column values of r, in the order id, proto_data,
+// data_uri, created_at, updated_at, labels, jsontext, checksum, hlc.
+func recordArgs(r *pb.CollectionRecord) []interface{} {
+	labelsJSON, _ := json.Marshal(r.Metadata.Labels)
+	if r.Metadata.Labels == nil {
+		labelsJSON = []byte("{}")
+	}
+	jsonText := "{}"
+	if json.Valid(r.ProtoData) {
+		jsonText = string(r.ProtoData)
+	}
+	return []interface{}{
+		r.Id,
+		r.ProtoData,
+		r.DataUri,
+		r.Metadata.CreatedAt.Seconds,
+		r.Metadata.UpdatedAt.Seconds,
+		string(labelsJSON),
+		jsonText,
+		r.Metadata.Checksum,
+		r.Metadata.Hlc,
+	}
+}
+
+func (s *PostgresStore) insertQuery() string {
+	return rebind(`INSERT INTO ` + quoteIdent(s.table) + ` (id, proto_data, data_uri, created_at, updated_at, labels, jsontext, checksum, hlc)
+		VALUES (?, ?, ?, ?, ?, ?::jsonb, ?::jsonb, ?, ?)`)
+}
+
+func (s *PostgresStore) CreateRecord(ctx context.Context, r *pb.CollectionRecord) error {
+	if _, err := s.db.ExecContext(ctx, s.insertQuery(), recordArgs(r)...); err != nil {
+		return recordExists(err, r.Id)
+	}
+	return nil
+}
+
+// CreateRecords inserts a batch of records in a single transaction.
+// Either all records are written or none are.
+func (s *PostgresStore) CreateRecords(ctx context.Context, records []*pb.CollectionRecord) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin batch: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, s.insertQuery())
+	if err != nil {
+		return fmt.Errorf("prepare batch insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		if _, err := stmt.ExecContext(ctx, recordArgs(r)...); err != nil {
+			return fmt.Errorf("insert record %s: %w", r.Id, recordExists(err, r.Id))
+		}
+	}
+	return tx.Commit()
+}
+
+// recordExists reports an insert that hit the primary key as
+// collection.ErrRecordExists. Drivers wrap the error differently but all
+// include the server's message.
+func recordExists(err error, id string) error {
+	if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+		return fmt.Errorf("%w: %s", collection.ErrRecordExists, id)
+	}
+	return err
+}
+
+// scanRecord reads the columns id, proto_data, data_uri, created_at,
+// updated_at, labels, checksum and hlc.
+func scanRecord(scan func(...interface{}) error) (*pb.CollectionRecord, error) {
+	var (
+		r                    pb.CollectionRecord
+		dataUri              sql.NullString
+		createdAt, updatedAt int64
+		labelsJSON           []byte
+		checksum             sql.NullString
+		hlc                  sql.NullInt64
+	)
+	if err := scan(&r.Id, &r.ProtoData, &dataUri, &createdAt, &updatedAt, &labelsJSON, &checksum, &hlc); err != nil {
+		return nil, err
+	}
+	r.Metadata = &pb.Metadata{
+		CreatedAt: &timestamppb.Timestamp{Seconds: createdAt},
+		UpdatedAt: &timestamppb.Timestamp{Seconds: updatedAt},
+		Checksum:  checksum.String,
+		Hlc:       hlc.Int64,
+	}
+	if dataUri.Valid {
+		r.DataUri = dataUri.String
+	}
+	if len(labelsJSON) > 0 {
+		json.Unmarshal(labelsJSON, &r.Metadata.Labels)
+		if len(r.Metadata.Labels) == 0 {
+			r.Metadata.Labels = nil
+		}
+	}
+	return &r, nil
+}
+
+const recordColumns = `id, proto_data, data_uri, created_at, updated_at, labels, checksum, hlc`
+
+// GetRecord returns sql.ErrNoRows if there is no record with id.
+func (s *PostgresStore) GetRecord(ctx context.Context, id string) (*pb.CollectionRecord, error) {
+	row := s.db.QueryRowContext(ctx, rebind(`SELECT `+recordColumns+` FROM `+quoteIdent(s.table)+` WHERE id = ?`), id)
+	return scanRecord(row.Scan)
+}
+
+func (s *PostgresStore) UpdateRecord(ctx context.Context, r *pb.CollectionRecord) error {
+	if !json.Valid(r.ProtoData) {
+		return fmt.Errorf("invalid JSON")
+	}
+	labelsJSON, _ := json.Marshal(r.Metadata.Labels)
+	if r.Metadata.Labels == nil {
+		labelsJSON = []byte("{}")
+	}
+	res, err := s.db.ExecContext(ctx,
+		rebind(`UPDATE `+quoteIdent(s.table)+` SET proto_data = ?, updated_at = ?, labels = ?::jsonb, jsontext = ?::jsonb, checksum = ?, hlc = ? WHERE id = ?`),
+		r.ProtoData,
+		r.Metadata.UpdatedAt.Seconds,
+		string(labelsJSON),
+		string(r.ProtoData),
+		r.Metadata.Checksum,
+		r.Metadata.Hlc,
+		r.Id,
+	)
+	if err != nil {
+		return err
+	}
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("record not found")
+	}
+	return nil
+}
+
+func (s *PostgresStore) DeleteRecord(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, rebind(`DELETE FROM `+quoteIdent(s.table)+` WHERE id = ?`), id)
+	return err
+}
+
+func (s *PostgresStore) ListRecords(ctx context.Context, offset, limit int) ([]*pb.CollectionRecord, error) {
+	rows, err := s.db.QueryContext(ctx,
+		rebind(`SELECT `+recordColumns+` FROM `+quoteIdent(s.table)+` ORDER BY created_at DESC, id LIMIT ? OFFSET ?`),
+		limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []*pb.CollectionRecord
+	for rows.Next() {
+		r, err := scanRecord(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, r)
+	}
+	return items, rows.Err()
+}
+
+func (s *PostgresStore) CountRecords(ctx context.Context) (int64, error) {
+	var c int64
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+quoteIdent(s.table)).Scan(&c)
+	return c, err
+}
+
+// RecordExists reports whether a record with the given id exists.
+func (s *PostgresStore) RecordExists(ctx context.Context, id string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, rebind(`SELECT EXISTS(SELECT 1 FROM `+quoteIdent(s.table)+` WHERE id = ?)`), id).Scan(&exists)
+	return exists, err
+}
+
+// Search runs q against the table. Full-text hits are scored with ts_rank,
+// so unlike the SQLite store's bm25 scores, higher scores rank better.
+func (s *PostgresStore) Search(ctx context.Context, q *collection.SearchQuery) ([]*collection.SearchResult, error) {
+	var query strings.Builder
+	var args []interface{}
+	query.WriteString(`SELECT r.id, r.proto_data`)
+	if q.FullText != "" {
+		query.WriteString(`, ts_rank(r.fts, websearch_to_tsquery('` + s.config + `', ?)) AS score`)
+		args = append(args, q.FullText)
+	}
+	from, fromArgs, err := s.searchFrom(q)
+	if err != nil {
+		return nil, err
+	}
+	query.WriteString(" " + from)
+	args = append(args, fromArgs...)
+
+	// Ordering
+	if q.OrderBy != "" {
+		order := "ASC"
+		if !q.Ascending {
+			order = "DESC"
+		}
+		path, err := orderByPath(q.OrderBy)
+		if err != nil {
+			return nil, err
+		}
+		query.WriteString(` ORDER BY r.jsontext #> ?::text[] ` + order)
+		args = append(args, path)
+	} else if q.FullText != "" {
+		query.WriteString(` ORDER BY score DESC`)
+	}
+
+	// Pagination
+	if q.Limit > 0 {
+		query.WriteString(" LIMIT ?")
+		args = append(args, q.Limit)
+	}
+	if q.Offset > 0 {
+		query.WriteString(" OFFSET ?")
+		args = append(args, q.Offset)
+	}
+
+	rows, err := s.db.QueryContext(ctx, rebind(query.String()), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*collection.SearchResult
+	for rows.Next() {
+		var r pb.CollectionRecord
+		var score sql.NullFloat64
+		scanArgs := []interface{}{&r.Id, &r.ProtoData}
+		if q.FullText != "" {
+			scanArgs = append(scanArgs, &score)
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			return nil, err
+		}
+		result := &collection.SearchResult{Record: &r}
+		if score.Valid {
+			result.Score = score.Float64
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// CountMatching counts the records matching q's full-text and filter criteria.
+// Ordering and pagination are ignored.
+func (s *PostgresStore) CountMatching(ctx context.Context, q *collection.SearchQuery) (int64, error) {
+	from, args, err := s.searchFrom(q)
+	if err != nil {
+		return 0, err
+	}
+	var c int64
+	err = s.db.QueryRowContext(ctx, rebind("SELECT COUNT(*) "+from), args...).Scan(&c)
+	return c, err
+}
+
+// Checkpoint does nothing: Postgres checkpoints on its own schedule.
+func (s *PostgresStore) Checkpoint(ctx context.Context) error {
+	return nil
+}
+
+// ReIndex rebuilds the table's indexes, including the full-text index.
+func (s *PostgresStore) ReIndex(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `REINDEX TABLE `+quoteIdent(s.table))
+	return err
+}
+
+// ExecuteRaw runs q on the store's database. Placeholders are the driver's,
+// i.e. $1, $2, ...
+func (s *PostgresStore) ExecuteRaw(q string, args ...interface{}) error {
+	_, err := s.db.Exec(q, args...)
+	return err
+}
+
+// Backup exports the table to a new SQLite database at destPath, with the
+// store's JSON and full-text options, so backups, clones and fetches of a
+// Postgres-backed collection produce the same files as SQLite-backed ones.
+// The export reads a single snapshot of the table while writes continue. It
+// is written to destPath.tmp and renamed into place, so a failed backup
+// leaves nothing at destPath.
+func (s *PostgresStore) Backup(ctx context.Context, destPath string) error {
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("backup failed: %s already exists", destPath)
+	}
+	tmpPath := destPath + ".tmp"
+	removeDB(tmpPath)
+	if err := s.export(ctx, tmpPath); err != nil {
+		removeDB(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		removeDB(tmpPath)
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	return nil
+}
+
+// removeDB removes the SQLite database at path and its WAL files.
+func removeDB(path string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+}
+
+// export copies the table into a new SQLite database at path and closes it.
+func (s *PostgresStore) export(ctx context.Context, path string) error {
+	opts := s.StoreOptions()
+	dest, err := sqlite.NewSqliteStore(path, collection.Options{
+		EnableJSON: opts.EnableJSON,
+		EnableFTS:  opts.EnableFTS,
+		Language:   opts.Language,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open destination db: %w", err)
+	}
+	defer dest.Close()
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT `+recordColumns+` FROM `+quoteIdent(s.table)+` ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	defer rows.Close()
+
+	batch := make([]*pb.CollectionRecord, 0, backupBatchSize)
+	for rows.Next() {
+		r, err := scanRecord(rows.Scan)
+		if err != nil {
+			return fmt.Errorf("backup failed: %w", err)
+		}
+		if batch = append(batch, r); len(batch) == backupBatchSize {
+			if err := dest.CreateRecords(ctx, batch); err != nil {
+				return fmt.Errorf("backup failed: %w", err)
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	if len(batch) > 0 {
+		if err := dest.CreateRecords(ctx, batch); err != nil {
+			return fmt.Errorf("backup failed: %w", err)
+		}
+	}
+	if err := dest.Checkpoint(ctx); err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	return dest.Close()
+}
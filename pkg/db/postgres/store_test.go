@@ -0,0 +1,155 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestRebindNumbersPlaceholders(t *testing.T) {
+	got := rebind(`SELECT 1 FROM t WHERE a = ? AND b IN (?, ?) LIMIT ?`)
+	want := `SELECT 1 FROM t WHERE a = $1 AND b IN ($2, $3) LIMIT $4`
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPathLiteral(t *testing.T) {
+	for expr, want := range map[string]string{
+		"status":                    `{"status"}`,
+		"items[0].price":            `{"items",0,"price"}`,
+		"items[-1]":                 `{"items",-1}`,
+		`labels["app.k8s.io/name"]`: `{"labels","app.k8s.io/name"}`,
+	} {
+		path, err := collection.ParseFieldPath(expr)
+		if err != nil {
+			t.Fatalf("ParseFieldPath(%q): %v", expr, err)
+		}
+		if got := pathLiteral(path); got != want {
+			t.Errorf("%s: got %s, want %s", expr, got, want)
+		}
+	}
+	if got := pathLiteral(collection.FieldPath{{Key: `a"b\c`}}); got != `{"a\"b\\c"}` {
+		t.Errorf("expected quotes and backslashes escaped, got %s", got)
+	}
+}
+
+func TestFilterClause(t *testing.T) {
+	for _, tc := range []struct {
+		key    string
+		filter collection.Filter
+		clause string
+		args   []interface{}
+	}{
+		{
+			"age", collection.Filter{Operator: collection.OpGreaterThan, Value: 30},
+			`(r.jsontext #> ?::text[]) > ?::jsonb`,
+			[]interface{}{`{"age"}`, "30"},
+		},
+		{
+			"status", collection.Filter{Operator: collection.OpIn, Value: []interface{}{"open", "held"}},
+			`(r.jsontext #> ?::text[]) IN (?::jsonb, ?::jsonb)`,
+			[]interface{}{`{"status"}`, `"open"`, `"held"`},
+		},
+		{
+			"items[*].sku", collection.Filter{Operator: collection.OpEquals, Value: "A1"},
+			`EXISTS (SELECT 1 FROM ` + arrayElements + ` e(value) WHERE (e.value #> ?::text[]) = ?::jsonb)`,
+			[]interface{}{`{"items"}`, `{"items"}`, `{"sku"}`, `"A1"`},
+		},
+		{
+			"tags[*]", collection.Filter{Operator: collection.OpNotExists},
+			`NOT EXISTS (SELECT 1 FROM ` + arrayElements + ` e(value) WHERE e.value IS NOT NULL)`,
+			[]interface{}{`{"tags"}`, `{"tags"}`},
+		},
+		{
+			"tags", collection.Filter{Operator: collection.OpArrayContains, Value: []interface{}{"a", "b"}},
+			`r.jsontext #> ?::text[] @> ?::jsonb`,
+			[]interface{}{`{"tags"}`, `["a","b"]`},
+		},
+		{
+			"tags", collection.Filter{Operator: collection.OpArrayContainsAny, Value: []interface{}{"a", "b"}},
+			`(r.jsontext #> ?::text[] @> ?::jsonb OR r.jsontext #> ?::text[] @> ?::jsonb)`,
+			[]interface{}{`{"tags"}`, `["a"]`, `{"tags"}`, `["b"]`},
+		},
+	} {
+		clause, args, err := filterClause(tc.key, tc.filter)
+		if err != nil {
+			t.Errorf("%s %s: %v", tc.key, tc.filter.Operator, err)
+			continue
+		}
+		if clause != tc.clause || !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("%s %s: got %s %v, want %s %v", tc.key, tc.filter.Operator, clause, args, tc.clause, tc.args)
+		}
+		if strings.Count(clause, "?") != len(args) {
+			t.Errorf("%s %s: %d placeholders for %d args", tc.key, tc.filter.Operator, strings.Count(clause, "?"), len(args))
+		}
+	}
+
+	clause, args, err := filterClause("created", collection.Filter{Operator: collection.OpSameWeek, Value: "2024-05-09"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(clause, "?") != len(args) || args[len(args)-1] != "2024-05-06" {
+		t.Errorf("unexpected same-week clause %s %v", clause, args)
+	}
+}
+
+func TestNewPostgresStoreRefusesSQLiteOptions(t *testing.T) {
+	if _, err := NewPostgresStore(nil, "Bad-Name", collection.Options{}); err == nil {
+		t.Error("expected an invalid table name to be refused")
+	}
+	_, err := NewPostgresStore(nil, "records", collection.Options{EnableHistory: true, Deduplicate: true})
+	if err == nil || !strings.Contains(err.Error(), "history, deduplication") {
+		t.Errorf("expected history and deduplication to be refused, got %v", err)
+	}
+}
+
+func TestTableName(t *testing.T) {
+	a, b := TableName("prod", "users"), TableName("prod-x", "users")
+	if a == b {
+		t.Errorf("expected distinct table names, got %s twice", a)
+	}
+	long := TableName(strings.Repeat("n", 100), strings.Repeat("c", 100))
+	for _, name := range []string{a, b, long} {
+		if !tableNamePattern.MatchString(name) || len(name) > MaxTableNameLength {
+			t.Errorf("invalid table name %q", name)
+		}
+	}
+	if !strings.HasPrefix(a, "records_prod_users_") {
+		t.Errorf("expected a readable table name, got %s", a)
+	}
+}
+
+func TestRecordExists(t *testing.T) {
+	err := recordExists(errors.New(`ERROR: duplicate key value violates unique constraint "records_pkey" (SQLSTATE 23505)`), "r1")
+	if !errors.Is(err, collection.ErrRecordExists) {
+		t.Errorf("expected ErrRecordExists, got %v", err)
+	}
+}
+
+func TestBackupLeavesNothingOnFailure(t *testing.T) {
+	// The table does not exist, so the export fails after the destination
+	// database has been created
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	store := &PostgresStore{db: db, table: "missing", options: collection.Options{EnableJSON: true}}
+
+	dest := filepath.Join(t.TempDir(), "backup.db")
+	if err := store.Backup(context.Background(), dest); err == nil {
+		t.Fatal("expected the backup to fail")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(dest))
+	for _, e := range entries {
+		t.Errorf("expected no files after a failed backup, found %s", e.Name())
+	}
+}
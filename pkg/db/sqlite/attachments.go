@@ -0,0 +1,99 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// PutAttachment records attachment metadata and extracted text for a record,
+// replacing any attachment with the same name, and points the record's
+// data_uri at dataURI. Touching the record refreshes its full-text entry.
+func (s *SqliteStore) PutAttachment(ctx context.Context, recordID string, a *pb.Attachment, text, dataURI string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT OR REPLACE INTO attachments (record_id, name, content_type, size, sha256, uri, created_at, text, derived_from, processor)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		recordID, a.Name, a.ContentType, a.Size, a.Sha256, a.Uri, a.CreatedAt.GetSeconds(),
+		sql.NullString{String: text, Valid: text != ""}, a.DerivedFrom, a.Processor)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, `UPDATE records SET data_uri = ? WHERE id = ?`, dataURI, recordID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// ListAttachments returns a record's attachments ordered by name.
+func (s *SqliteStore) ListAttachments(ctx context.Context, recordID string) ([]*pb.Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT name, content_type, size, sha256, uri, created_at, derived_from, processor
+		FROM attachments WHERE record_id = ? ORDER BY name`, recordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []*pb.Attachment
+	for rows.Next() {
+		a := &pb.Attachment{}
+		var createdAt int64
+		if err := rows.Scan(&a.Name, &a.ContentType, &a.Size, &a.Sha256, &a.Uri, &createdAt, &a.DerivedFrom, &a.Processor); err != nil {
+			return nil, err
+		}
+		a.CreatedAt = &timestamppb.Timestamp{Seconds: createdAt}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// DeleteAttachment removes an attachment's metadata, returning sql.ErrNoRows
+// if it does not exist. The record's data_uri is cleared once its last
+// attachment is gone, and its full-text entry is refreshed either way.
+func (s *SqliteStore) DeleteAttachment(ctx context.Context, recordID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM attachments WHERE record_id = ? AND name = ?`, recordID, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE records SET data_uri = CASE
+			WHEN EXISTS (SELECT 1 FROM attachments WHERE record_id = ?) THEN data_uri
+		END
+		WHERE id = ?`, recordID, recordID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,79 @@
+package sqlite
+
+import (
+	"context"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// distinctValues returns a query selecting quote() of every non-null value of
+// target among records matching q. quote() keeps values of different types
+// distinct, e.g. 1 and '1'.
+func (s *SqliteStore) distinctValues(q *collection.SearchQuery, target collection.DistinctTarget) (string, []interface{}, error) {
+	if err := target.Validate(); err != nil {
+		return "", nil, err
+	}
+	from, fromArgs, err := s.searchFrom(q)
+	if err != nil {
+		return "", nil, err
+	}
+	matching := `(SELECT r.jsontext AS jsontext, r.labels AS labels ` + from + `) m`
+
+	var value string
+	var args []interface{}
+	if target.Label != "" {
+		value = `SELECT json_extract(m.labels, ?) AS x FROM ` + matching
+		args = append([]interface{}{`$."` + target.Label + `"`}, fromArgs...)
+	} else {
+		path, _ := collection.ParseFieldPath(target.Field)
+		array, element, wildcard := path.SplitWildcard()
+		switch {
+		case !wildcard:
+			value = `SELECT json_extract(m.jsontext, ?) AS x FROM ` + matching
+			args = append([]interface{}{path.JSONPath()}, fromArgs...)
+		case len(element) == 0:
+			value = `SELECT e.value AS x FROM ` + matching + `, json_each(m.jsontext, ?) e`
+			args = append(fromArgs, array.JSONPath())
+		default:
+			value = `SELECT json_extract(e.value, ?) AS x FROM ` + matching + `, json_each(m.jsontext, ?) e`
+			args = append(append([]interface{}{element.JSONPath()}, fromArgs...), array.JSONPath())
+		}
+	}
+	return `SELECT quote(x) AS v FROM (` + value + `) WHERE x IS NOT NULL`, args, nil
+}
+
+// CountDistinct counts distinct values with COUNT(DISTINCT), stopping after
+// limit+1 so large sets cost no more than a bounded scan.
+func (s *SqliteStore) CountDistinct(ctx context.Context, q *collection.SearchQuery, target collection.DistinctTarget, limit int64) (int64, error) {
+	values, args, err := s.distinctValues(q, target)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM (SELECT DISTINCT v FROM (`+values+`) LIMIT ?)`, append(args, limit+1)...).Scan(&n)
+	return n, err
+}
+
+// ScanValues streams the values of target among matching records.
+func (s *SqliteStore) ScanValues(ctx context.Context, q *collection.SearchQuery, target collection.DistinctTarget, fn func(string) error) error {
+	values, args, err := s.distinctValues(q, target)
+	if err != nil {
+		return err
+	}
+	rows, err := s.db.QueryContext(ctx, values, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return err
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
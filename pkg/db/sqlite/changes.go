@@ -0,0 +1,48 @@
+package sqlite
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// ChangesSince returns up to limit records ordered by (updated_at, id) that
+// come after the (since, afterID) cursor.
+func (s *SqliteStore) ChangesSince(ctx context.Context, since time.Time, afterID string, limit int) ([]*pb.CollectionRecord, error) {
+	t := since.Unix()
+	return s.queryRecords(ctx, `
+		SELECT id, `+storedData("")+`, data_uri, created_at, updated_at, labels, hlc
+		FROM records
+		WHERE updated_at > ? OR (updated_at = ? AND id > ?)
+		ORDER BY updated_at, id LIMIT ?`, t, t, afterID, limit)
+}
+
+// DeletedSince returns the IDs of records deleted at or after since. It
+// relies on record history and returns nil when history is disabled.
+func (s *SqliteStore) DeletedSince(ctx context.Context, since time.Time) ([]string, error) {
+	if !s.HistoryEnabled() {
+		return nil, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT h.id FROM records_history h
+		WHERE h.valid_to >= ? AND NOT EXISTS (SELECT 1 FROM records r WHERE r.id = h.id)
+		ORDER BY h.id`, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
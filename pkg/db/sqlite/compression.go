@@ -0,0 +1,354 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// encodingCompressed marks a proto_data value, or a shared blob, that is
+	// a zstd frame. The frame names the dictionary it was compressed with
+	// (none if 0) and the length of the data.
+	encodingCompressed = 1
+
+	// maxCompressedSize is the largest record data that is compressed, the
+	// size records are capped at by default; larger data is stored as is.
+	// Frames claiming to hold more are corrupt and refused, rather than
+	// decompressed into an allocation of the size they claim.
+	maxCompressedSize = collection.DefaultMaxRecordSize
+
+	// compressedHeaderMax bounds a zstd frame header.
+	compressedHeaderMax = zstd.HeaderMaxSize
+
+	// trainingSampleSize caps how much of each sampled record is used to
+	// train a dictionary; shared structure shows up early in a record.
+	trainingSampleSize = 16 * 1024
+)
+
+// recordCodec compresses proto_data on write and decompresses it on read.
+// Decompression works whether or not compression is enabled, so a store
+// that stops compressing can still read what it wrote before.
+type recordCodec struct {
+	db      *sql.DB
+	enabled bool
+	opts    collection.CompressionOptions
+
+	mu        sync.RWMutex
+	dicts     map[uint32][]byte
+	current   uint32                   // Dictionary new records are compressed with
+	encoder   *zstd.Encoder            // Compresses with current; nil until first used
+	decoders  map[uint32]*zstd.Decoder // By dictionary, created on first use
+	untrained int                      // Records compressed without a dictionary
+}
+
+// newRecordCodec loads the store's dictionaries. opts is nil when the store
+// does not compress new records.
+func newRecordCodec(db *sql.DB, opts *collection.CompressionOptions) (*recordCodec, error) {
+	c := &recordCodec{db: db, dicts: make(map[uint32][]byte), decoders: make(map[uint32]*zstd.Decoder)}
+	if opts != nil {
+		c.enabled = true
+		c.opts = opts.WithDefaults()
+	}
+
+	rows, err := db.Query("SELECT id, dictionary FROM compression_dictionaries ORDER BY created_at, rowid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load compression dictionaries: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id   int64
+			dict []byte
+		)
+		if err := rows.Scan(&id, &dict); err != nil {
+			return nil, fmt.Errorf("failed to load compression dictionaries: %w", err)
+		}
+		c.dicts[uint32(id)] = dict
+		c.current = uint32(id)
+	}
+	return c, rows.Err()
+}
+
+// close releases the codec's encoder and decoders.
+func (c *recordCodec) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.encoder != nil {
+		c.encoder.Close()
+		c.encoder = nil
+	}
+	for id, d := range c.decoders {
+		d.Close()
+		delete(c.decoders, id)
+	}
+}
+
+// encode returns the stored form of data and its encoding: compressed when
+// compression is enabled, data is large enough and compressing it saves
+// space.
+func (c *recordCodec) encode(data []byte) ([]byte, int64, error) {
+	if !c.enabled || len(data) < c.opts.MinSize || len(data) > maxCompressedSize {
+		return data, 0, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.encoder == nil {
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if c.current != 0 {
+			opts = append(opts, zstd.WithEncoderDictRaw(c.current, c.dicts[c.current]))
+		}
+		encoder, err := zstd.NewWriter(nil, opts...)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to compress record: %w", err)
+		}
+		c.encoder = encoder
+	}
+	compressed := c.encoder.EncodeAll(data, nil)
+	if len(compressed) >= len(data) {
+		return data, 0, nil
+	}
+	if c.current == 0 {
+		c.untrained++
+	}
+	return compressed, encodingCompressed, nil
+}
+
+// decode returns the original form of stored data with the given encoding.
+func (c *recordCodec) decode(stored []byte, encoding int64) ([]byte, error) {
+	if encoding&encodingCompressed == 0 {
+		return stored, nil
+	}
+	size, dictID, err := compressedSize(stored)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := c.decoder(dictID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decoder.DecodeAll(stored, make([]byte, 0, size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress record: %w", err)
+	}
+	if uint64(len(data)) != size {
+		return nil, fmt.Errorf("failed to decompress record: got %d bytes, expected %d", len(data), size)
+	}
+	return data, nil
+}
+
+// compressedSize reads the length of the data in a zstd frame, and the
+// dictionary it was compressed with, from the frame's header.
+func compressedSize(stored []byte) (size uint64, dictID uint32, err error) {
+	var h zstd.Header
+	if err := h.Decode(stored); err != nil {
+		return 0, 0, fmt.Errorf("failed to decompress record: %w", err)
+	}
+	if !h.HasFCS || h.FrameContentSize > maxCompressedSize {
+		return 0, 0, fmt.Errorf("failed to decompress record: frame claims %d bytes, at most %d are compressed", h.FrameContentSize, maxCompressedSize)
+	}
+	return h.FrameContentSize, h.DictionaryID, nil
+}
+
+// decoder returns the decoder for a dictionary, creating it on first use.
+func (c *recordCodec) decoder(dictID uint32) (*zstd.Decoder, error) {
+	c.mu.RLock()
+	decoder, ok := c.decoders[dictID]
+	c.mu.RUnlock()
+	if ok {
+		return decoder, nil
+	}
+
+	dict, err := c.dictionary(dictID)
+	if err != nil {
+		return nil, err
+	}
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxCompressedSize)}
+	if dictID != 0 {
+		opts = append(opts, zstd.WithDecoderDictRaw(dictID, dict))
+	}
+	decoder, err = zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decompressor: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.decoders[dictID]; ok {
+		decoder.Close()
+		return existing, nil
+	}
+	c.decoders[dictID] = decoder
+	return decoder, nil
+}
+
+// dictionary returns a dictionary by ID, loading it if another store handle
+// trained it after this one was opened.
+func (c *recordCodec) dictionary(id uint32) ([]byte, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	c.mu.RLock()
+	dict, ok := c.dicts[id]
+	c.mu.RUnlock()
+	if ok {
+		return dict, nil
+	}
+
+	if err := c.db.QueryRow("SELECT dictionary FROM compression_dictionaries WHERE id = ?", int64(id)).Scan(&dict); err != nil {
+		return nil, fmt.Errorf("failed to load compression dictionary %d: %w", id, err)
+	}
+	c.mu.Lock()
+	c.dicts[id] = dict
+	c.mu.Unlock()
+	return dict, nil
+}
+
+// needsTraining reports whether enough records were compressed without a
+// dictionary to train one.
+func (c *recordCodec) needsTraining() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.enabled && c.current == 0 && c.untrained >= c.opts.TrainAfter
+}
+
+// train builds a dictionary from a random sample of records and compresses
+// new records with it. Records already written keep their dictionary. It
+// returns the new dictionary's ID, or 0 if the sample shares too little for
+// a dictionary to help.
+func (c *recordCodec) train(ctx context.Context) (uint32, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT `+storedData("")+` FROM records
+		ORDER BY random() LIMIT ?`, c.opts.TrainAfter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to sample records: %w", err)
+	}
+	var samples [][]byte
+	for rows.Next() {
+		var (
+			stored   []byte
+			encoding int64
+		)
+		if err := rows.Scan(&stored, &encoding); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to sample records: %w", err)
+		}
+		data, err := c.decode(stored, encoding)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if len(data) >= c.opts.MinSize {
+			samples = append(samples, data[:min(len(data), trainingSampleSize)])
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to sample records: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.untrained = 0
+
+	dict := collection.TrainDictionary(samples, c.opts.DictionarySize)
+	if dict == nil {
+		return 0, nil
+	}
+	sum := sha256.Sum256(dict)
+	id := binary.BigEndian.Uint32(sum[:]) | 1 // Never 0, which means no dictionary
+	if _, err := c.db.ExecContext(ctx, "INSERT OR IGNORE INTO compression_dictionaries (id, dictionary, created_at) VALUES (?, ?, ?)",
+		int64(id), dict, time.Now().Unix()); err != nil {
+		return 0, fmt.Errorf("failed to save compression dictionary: %w", err)
+	}
+	c.dicts[id] = dict
+	c.current = id
+	if c.encoder != nil {
+		c.encoder.Close()
+		c.encoder = nil
+	}
+	return id, nil
+}
+
+// maybeTrainCompression trains the first dictionary once enough records were
+// compressed without one. Callers hold s.mu for writing. Training failures
+// only delay compression gains, so they do not fail the write.
+func (s *SqliteStore) maybeTrainCompression(ctx context.Context) {
+	if s.codec.needsTraining() {
+		s.codec.train(ctx)
+	}
+}
+
+// TrainCompressionDictionary trains a new dictionary from a sample of the
+// current records, e.g. after their shape changed. New records are
+// compressed with it; existing records stay readable with the dictionary
+// they were written with. It returns 0 if the records share too little for
+// a dictionary to help.
+func (s *SqliteStore) TrainCompressionDictionary(ctx context.Context) (uint32, error) {
+	if !s.codec.enabled {
+		return 0, fmt.Errorf("compression is not enabled for this collection")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.codec.train(ctx)
+}
+
+// CompressionStats reports how well record data compresses. It returns nil
+// for stores that do not compress.
+func (s *SqliteStore) CompressionStats(ctx context.Context) (*pb.CompressionStats, error) {
+	if !s.codec.enabled {
+		return nil, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT substr(data, 1, ?), length(data), encoding
+		FROM (SELECT `+storedData("")+` FROM records WHERE proto_data IS NOT NULL)`, compressedHeaderMax)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan records: %w", err)
+	}
+	defer rows.Close()
+
+	stats := &pb.CompressionStats{}
+	for rows.Next() {
+		var (
+			head     []byte
+			stored   int64
+			encoding int64
+		)
+		if err := rows.Scan(&head, &stored, &encoding); err != nil {
+			return nil, fmt.Errorf("failed to scan records: %w", err)
+		}
+		stats.Records++
+		stats.StoredBytes += stored
+		if encoding&encodingCompressed == 0 {
+			stats.RawBytes += stored
+			continue
+		}
+		size, _, err := compressedSize(head)
+		if err != nil {
+			return nil, err
+		}
+		stats.CompressedRecords++
+		stats.RawBytes += int64(size)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan records: %w", err)
+	}
+
+	s.codec.mu.RLock()
+	stats.DictionaryId = s.codec.current
+	stats.DictionaryBytes = int64(len(s.codec.dicts[s.codec.current]))
+	s.codec.mu.RUnlock()
+	if stats.StoredBytes > 0 {
+		stats.Ratio = float64(stats.RawBytes) / float64(stats.StoredBytes)
+	}
+	return stats, nil
+}
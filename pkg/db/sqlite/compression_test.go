@@ -0,0 +1,227 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ticket returns a text-heavy JSON record; tickets share their field names
+// and boilerplate but differ in their details.
+func ticket(i int) *pb.CollectionRecord {
+	data := fmt.Sprintf(`{"ticket_id": "T-%05d", "status": "open", "priority": "p%d", "reporter": "user%d@example.com",`+
+		` "summary": "Checkout page fails to load for customer %d", "description": "The customer reported that the checkout`+
+		` page shows a spinner and never finishes loading. Steps to reproduce: add any item to the cart, proceed to checkout,`+
+		` select a saved address. Browser console shows a timeout from the payments service after %d seconds.",`+
+		` "labels": ["checkout", "payments", "timeout"]}`, i, i%4, i%97, i, 10+i%50)
+	now := timestamppb.Now()
+	return &pb.CollectionRecord{Id: fmt.Sprintf("t%d", i), ProtoData: []byte(data), Metadata: &pb.Metadata{CreatedAt: now, UpdatedAt: now}}
+}
+
+func TestCompression_RoundTripAndStats(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tickets.db")
+	opts := collection.Options{EnableJSON: true, Compression: &collection.CompressionOptions{MinSize: 256, TrainAfter: 20}}
+	store, err := NewSqliteStore(path, opts)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	// Records before the dictionary is trained are compressed without one
+	for i := 0; i < 20; i++ {
+		if err := store.CreateRecord(ctx, ticket(i)); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	before, err := store.CompressionStats(ctx)
+	if err != nil {
+		t.Fatalf("CompressionStats failed: %v", err)
+	}
+	if before.DictionaryId == 0 || before.CompressedRecords != 20 {
+		t.Fatalf("expected a trained dictionary after 20 compressed records, got %+v", before)
+	}
+
+	// Small records stay raw
+	small := &pb.CollectionRecord{Id: "small", ProtoData: []byte(`{"a": 1}`), Metadata: ticket(0).Metadata}
+	if err := store.CreateRecords(ctx, []*pb.CollectionRecord{small, ticket(20), ticket(21)}); err != nil {
+		t.Fatalf("CreateRecords failed: %v", err)
+	}
+	for i := 22; i < 60; i++ {
+		if err := store.CreateRecord(ctx, ticket(i)); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	updated := ticket(5)
+	updated.ProtoData = bytes.Replace(updated.ProtoData, []byte(`"open"`), []byte(`"closed"`), 1)
+	if err := store.UpdateRecord(ctx, updated); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+
+	stats, err := store.CompressionStats(ctx)
+	if err != nil {
+		t.Fatalf("CompressionStats failed: %v", err)
+	}
+	if stats.Records != 61 || stats.CompressedRecords != 60 || stats.Ratio < 2 {
+		t.Errorf("expected 60 of 61 records compressed at least 2x, got %+v", stats)
+	}
+
+	// Dictionary-compressed records take less space than those without
+	var early, late int64
+	store.db.QueryRow("SELECT length(proto_data) FROM records WHERE id = 't1'").Scan(&early)
+	store.db.QueryRow("SELECT length(proto_data) FROM records WHERE id = 't41'").Scan(&late)
+	if late >= early {
+		t.Errorf("expected the dictionary to help: %d bytes without, %d with", early, late)
+	}
+
+	// Records read back as written, from a reopened store too
+	store.Close()
+	store, err = NewSqliteStore(path, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	for _, want := range []*pb.CollectionRecord{ticket(1), ticket(41), small, updated} {
+		got, err := store.GetRecord(ctx, want.Id)
+		if err != nil || !bytes.Equal(got.ProtoData, want.ProtoData) {
+			t.Errorf("GetRecord(%s) returned %q, %v", want.Id, got.GetProtoData(), err)
+		}
+	}
+	listed, err := store.ListRecords(ctx, 0, 100)
+	if err != nil || len(listed) != 61 {
+		t.Fatalf("ListRecords returned %d records, %v", len(listed), err)
+	}
+	for _, r := range listed {
+		if !strings.HasPrefix(string(r.ProtoData), "{") {
+			t.Fatalf("ListRecords returned undecoded data for %s", r.Id)
+		}
+	}
+
+	// Search still filters on the uncompressed JSON
+	results, err := store.Search(ctx, &collection.SearchQuery{
+		Filters: map[string]collection.Filter{"status": {Operator: collection.OpEquals, Value: "closed"}},
+	})
+	if err != nil || len(results) != 1 || !bytes.Equal(results[0].Record.ProtoData, updated.ProtoData) {
+		t.Errorf("expected the closed ticket from Search, got %v (%v)", results, err)
+	}
+
+	// Retraining switches new records to a new dictionary; old ones stay readable
+	if _, err := store.TrainCompressionDictionary(ctx); err != nil {
+		t.Fatalf("TrainCompressionDictionary failed: %v", err)
+	}
+	if got, err := store.GetRecord(ctx, "t41"); err != nil || !bytes.Equal(got.ProtoData, ticket(41).ProtoData) {
+		t.Errorf("GetRecord after retraining returned %v", err)
+	}
+
+	// A store that stops compressing still reads compressed records
+	store.Close()
+	store, err = NewSqliteStore(path, collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	if got, err := store.GetRecord(ctx, "t41"); err != nil || !bytes.Equal(got.ProtoData, ticket(41).ProtoData) {
+		t.Errorf("GetRecord without compression returned %v", err)
+	}
+	if stats, err := store.CompressionStats(ctx); stats != nil || err != nil {
+		t.Errorf("expected no stats without compression, got %+v (%v)", stats, err)
+	}
+}
+
+func TestTrainDictionary(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 50; i++ {
+		samples = append(samples, ticket(i).ProtoData)
+	}
+	dict := collection.TrainDictionary(samples, 1024)
+	if len(dict) == 0 || len(dict) > 1024 {
+		t.Fatalf("expected a dictionary of up to 1024 bytes, got %d", len(dict))
+	}
+	if !bytes.Contains(dict, []byte("checkout")) {
+		t.Errorf("expected shared text in the dictionary, got %q", dict)
+	}
+
+	// Samples with nothing in common give no dictionary
+	if dict := collection.TrainDictionary([][]byte{[]byte("abcdefghijkl"), []byte("mnopqrstuvwx")}, 1024); dict != nil {
+		t.Errorf("expected no dictionary, got %q", dict)
+	}
+}
+
+func TestCompression_RawDataIsNotMistakenForFrames(t *testing.T) {
+	ctx := context.Background()
+	opts := collection.Options{EnableJSON: true, Deduplicate: true, Compression: &collection.CompressionOptions{MinSize: 256}}
+	store, err := NewSqliteStore(filepath.Join(t.TempDir(), "raw.db"), opts)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	// Small records are stored as they are, even when they begin with what
+	// looks like a zstd frame or a blob reference
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	frame := enc.EncodeAll(ticket(0).ProtoData, nil)
+	enc.Close()
+	lookalikes := map[string][]byte{
+		"zstd": frame[:32],
+		"ref":  append([]byte{0x00, 'd', 'd', 0x01}, bytes.Repeat([]byte{0xab}, 32)...),
+	}
+	for id, data := range lookalikes {
+		rec := &pb.CollectionRecord{Id: id, ProtoData: data, Metadata: ticket(0).Metadata}
+		if err := store.CreateRecord(ctx, rec); err != nil {
+			t.Fatalf("CreateRecord(%s) failed: %v", id, err)
+		}
+		got, err := store.GetRecord(ctx, id)
+		if err != nil {
+			t.Fatalf("GetRecord(%s) failed: %v", id, err)
+		}
+		if !bytes.Equal(got.ProtoData, data) {
+			t.Errorf("%s: expected raw data back, got %x", id, got.ProtoData)
+		}
+	}
+}
+
+func TestCompression_RejectsOversizedFrames(t *testing.T) {
+	ctx := context.Background()
+	opts := collection.Options{EnableJSON: true, Compression: &collection.CompressionOptions{MinSize: 16}}
+	store, err := NewSqliteStore(filepath.Join(t.TempDir(), "frames.db"), opts)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.CreateRecord(ctx, ticket(1)); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	// A frame whose header claims more than a record may hold is refused
+	// before anything is allocated for it
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	huge := enc.EncodeAll(make([]byte, maxCompressedSize+1), nil)
+	enc.Close()
+	if _, err := store.db.Exec("UPDATE records SET proto_data = ?, encoding = ? WHERE id = 't1'", huge, encodingCompressed); err != nil {
+		t.Fatalf("failed to overwrite record: %v", err)
+	}
+	if _, err := store.GetRecord(ctx, "t1"); err == nil || !strings.Contains(err.Error(), "frame claims") {
+		t.Errorf("expected an oversized frame to be refused, got %v", err)
+	}
+
+	// So is data that is not a frame at all
+	if _, err := store.db.Exec("UPDATE records SET proto_data = ? WHERE id = 't1'", []byte("not a frame")); err != nil {
+		t.Fatalf("failed to overwrite record: %v", err)
+	}
+	if _, err := store.GetRecord(ctx, "t1"); err == nil {
+		t.Error("expected corrupt data to fail to decompress")
+	}
+}
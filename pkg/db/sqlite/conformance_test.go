@@ -0,0 +1,21 @@
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"github.com/accretional/collector/pkg/db/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, opts collection.Options) collection.Store {
+		store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), "conformance.db"), opts)
+		if err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
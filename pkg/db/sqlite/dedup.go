@@ -0,0 +1,126 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+const (
+	// encodingBlobRef marks a proto_data value that is the SHA-256 of record
+	// data kept once in record_blobs. The blob has an encoding of its own.
+	encodingBlobRef = 2
+
+	// minDedupSize is the smallest record data worth sharing; a reference
+	// costs 32 bytes plus the blob table row.
+	minDedupSize = 128
+)
+
+// blobSchema keeps deduplicated record data with a count of the records and
+// history versions referring to it. Triggers maintain the counts, so raw
+// statements against records (clone pruning, partition merges) keep them
+// right too; blobs whose count drops to zero are removed by collectBlobs.
+const blobSchema = `
+CREATE TABLE IF NOT EXISTS record_blobs (
+    hash BLOB PRIMARY KEY,
+    data BLOB NOT NULL,
+    encoding INTEGER NOT NULL DEFAULT 0,
+    refs INTEGER NOT NULL DEFAULT 0
+);
+CREATE TRIGGER IF NOT EXISTS record_blobs_ai AFTER INSERT ON records
+WHEN new.encoding & 2 BEGIN
+    UPDATE record_blobs SET refs = refs + 1 WHERE hash = new.proto_data;
+END;
+CREATE TRIGGER IF NOT EXISTS record_blobs_ad AFTER DELETE ON records
+WHEN old.encoding & 2 BEGIN
+    UPDATE record_blobs SET refs = refs - 1 WHERE hash = old.proto_data;
+END;
+CREATE TRIGGER IF NOT EXISTS record_blobs_au AFTER UPDATE OF proto_data, encoding ON records BEGIN
+    UPDATE record_blobs SET refs = refs - 1 WHERE old.encoding & 2 AND hash = old.proto_data;
+    UPDATE record_blobs SET refs = refs + 1 WHERE new.encoding & 2 AND hash = new.proto_data;
+END;
+`
+
+// blobHistorySchema counts history versions as references, so superseded
+// versions stay readable after the live record moves on.
+const blobHistorySchema = `
+CREATE TRIGGER IF NOT EXISTS record_blobs_history_ai AFTER INSERT ON records_history
+WHEN new.encoding & 2 BEGIN
+    UPDATE record_blobs SET refs = refs + 1 WHERE hash = new.proto_data;
+END;
+CREATE TRIGGER IF NOT EXISTS record_blobs_history_ad AFTER DELETE ON records_history
+WHEN old.encoding & 2 BEGIN
+    UPDATE record_blobs SET refs = refs - 1 WHERE hash = old.proto_data;
+END;
+`
+
+// storedData selects the proto_data and encoding columns of the row named
+// by row ("" for the only table queried) as two result columns, with blob
+// references resolved to the shared data and its encoding, ready for
+// recordCodec.decode.
+func storedData(row string) string {
+	if row != "" {
+		row += "."
+	}
+	return fmt.Sprintf(`(CASE WHEN %[1]sencoding & %[2]d
+		THEN (SELECT b.data FROM record_blobs b WHERE b.hash = %[1]sproto_data)
+		ELSE %[1]sproto_data END) AS data,
+		(CASE WHEN %[1]sencoding & %[2]d
+		THEN (SELECT b.encoding FROM record_blobs b WHERE b.hash = %[1]sproto_data)
+		ELSE %[1]sencoding END) AS encoding`, row, encodingBlobRef)
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// encodeData returns the proto_data value to store for record data and its
+// encoding: compressed if the collection compresses, and a reference to a
+// shared blob if it deduplicates. Callers hold s.mu for writing.
+func (s *SqliteStore) encodeData(ctx context.Context, exec execer, data []byte) ([]byte, int64, error) {
+	stored, encoding, err := s.codec.encode(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !s.options.Deduplicate || len(data) < minDedupSize {
+		return stored, encoding, nil
+	}
+
+	hash := sha256.Sum256(data)
+	if _, err := exec.ExecContext(ctx, "INSERT INTO record_blobs (hash, data, encoding) VALUES (?, ?, ?) ON CONFLICT(hash) DO NOTHING", hash[:], stored, encoding); err != nil {
+		return nil, 0, fmt.Errorf("failed to store blob: %w", err)
+	}
+	return hash[:], encodingBlobRef, nil
+}
+
+// collectBlobs removes blobs no record or history version refers to.
+// Callers hold s.mu for writing.
+func (s *SqliteStore) collectBlobs(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM record_blobs WHERE refs <= 0"); err != nil {
+		return fmt.Errorf("failed to remove unreferenced blobs: %w", err)
+	}
+	return nil
+}
+
+// DeduplicationStats reports how much space sharing identical record data
+// saves. It returns nil for stores that do not deduplicate.
+func (s *SqliteStore) DeduplicationStats(ctx context.Context) (*pb.DeduplicationStats, error) {
+	if !s.options.Deduplicate {
+		return nil, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := &pb.DeduplicationStats{}
+	err := s.db.QueryRowContext(ctx, `SELECT count(*), coalesce(sum(refs), 0), coalesce(sum(length(data)), 0),
+		coalesce(sum((refs - 1) * length(data)), 0) FROM record_blobs WHERE refs > 0`).
+		Scan(&stats.Blobs, &stats.References, &stats.BlobBytes, &stats.SavedBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob stats: %w", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,157 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// page returns a crawled page record; mirrors of the same page share data.
+func page(id string, body string, at time.Time) *pb.CollectionRecord {
+	data := fmt.Sprintf(`{"body": %q}`, strings.Repeat(body+" ", 40))
+	return &pb.CollectionRecord{
+		Id:        id,
+		ProtoData: []byte(data),
+		Metadata:  &pb.Metadata{CreatedAt: timestamppb.New(at), UpdatedAt: timestamppb.New(at)},
+	}
+}
+
+func blobCount(t *testing.T, store *SqliteStore) int {
+	t.Helper()
+	var n int
+	if err := store.db.QueryRow("SELECT count(*) FROM record_blobs").Scan(&n); err != nil {
+		t.Fatalf("failed to count blobs: %v", err)
+	}
+	return n
+}
+
+func TestDeduplication_SharesIdenticalData(t *testing.T) {
+	ctx := context.Background()
+	for name, opts := range map[string]collection.Options{
+		"plain":      {EnableJSON: true, Deduplicate: true, EnableHistory: true},
+		"compressed": {EnableJSON: true, Deduplicate: true, EnableHistory: true, Compression: &collection.CompressionOptions{MinSize: 128}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store, err := NewSqliteStore(filepath.Join(t.TempDir(), "pages.db"), opts)
+			if err != nil {
+				t.Fatalf("failed to create store: %v", err)
+			}
+			defer store.Close()
+
+			t0 := historyBase
+			for i := 0; i < 5; i++ {
+				if err := store.CreateRecord(ctx, page(fmt.Sprintf("mirror%d", i), "hello world", t0)); err != nil {
+					t.Fatalf("CreateRecord failed: %v", err)
+				}
+			}
+			if err := store.CreateRecords(ctx, []*pb.CollectionRecord{page("other", "goodbye", t0), page("tiny", "", t0)}); err != nil {
+				t.Fatalf("CreateRecords failed: %v", err)
+			}
+
+			stats, err := store.DeduplicationStats(ctx)
+			if err != nil {
+				t.Fatalf("DeduplicationStats failed: %v", err)
+			}
+			// The tiny page is below the size worth sharing
+			if stats.Blobs != 2 || stats.References != 6 || stats.SavedBytes == 0 {
+				t.Errorf("expected 6 references to 2 blobs, got %+v", stats)
+			}
+
+			// Reads resolve the shared data
+			want := page("mirror3", "hello world", t0).ProtoData
+			got, err := store.GetRecord(ctx, "mirror3")
+			if err != nil || !bytes.Equal(got.ProtoData, want) {
+				t.Fatalf("GetRecord returned %q, %v", got.GetProtoData(), err)
+			}
+			listed, err := store.ListRecords(ctx, 0, 10)
+			if err != nil || len(listed) != 7 {
+				t.Fatalf("ListRecords returned %d records, %v", len(listed), err)
+			}
+			results, err := store.Search(ctx, &collection.SearchQuery{Limit: 10})
+			if err != nil || len(results) != 7 {
+				t.Fatalf("Search returned %d results, %v", len(results), err)
+			}
+			for _, r := range results {
+				if r.Record.ProtoData[0] != '{' {
+					t.Fatalf("Search returned unresolved data for %s", r.Record.Id)
+				}
+			}
+
+			// The last record moving off a blob removes it, once history lets go
+			t1 := t0.Add(time.Hour)
+			if err := store.UpdateRecord(ctx, page("other", "changed", t1)); err != nil {
+				t.Fatalf("UpdateRecord failed: %v", err)
+			}
+			old, err := store.GetRecordAsOf(ctx, "other", t0)
+			if err != nil || !bytes.Equal(old.ProtoData, page("other", "goodbye", t0).ProtoData) {
+				t.Fatalf("GetRecordAsOf returned %q, %v", old.GetProtoData(), err)
+			}
+			if n := blobCount(t, store); n != 3 {
+				t.Errorf("expected the superseded blob to be kept for history, got %d blobs", n)
+			}
+			if _, err := store.PruneHistory(ctx, t1.Add(time.Second)); err != nil {
+				t.Fatalf("PruneHistory failed: %v", err)
+			}
+			if n := blobCount(t, store); n != 2 {
+				t.Errorf("expected the superseded blob to be removed, got %d blobs", n)
+			}
+
+			for i := 0; i < 5; i++ {
+				if err := store.DeleteRecord(ctx, fmt.Sprintf("mirror%d", i)); err != nil {
+					t.Fatalf("DeleteRecord failed: %v", err)
+				}
+			}
+			store.PruneHistory(ctx, time.Now().Add(time.Hour))
+			if n := blobCount(t, store); n != 1 {
+				t.Errorf("expected only the changed page's blob, got %d blobs", n)
+			}
+		})
+	}
+}
+
+func TestDeduplication_PartitionBackup(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewPartitionedStore(filepath.Join(t.TempDir(), "pages"), PartitionDaily, collection.Options{EnableJSON: true, Deduplicate: true})
+	if err != nil {
+		t.Fatalf("failed to create partitioned store: %v", err)
+	}
+	defer store.Close()
+
+	for day := 0; day < 2; day++ {
+		for i := 0; i < 3; i++ {
+			if err := store.CreateRecord(ctx, page(fmt.Sprintf("d%d-%d", day, i), "same page", partitionBase.AddDate(0, 0, day))); err != nil {
+				t.Fatalf("CreateRecord failed: %v", err)
+			}
+		}
+	}
+	stats, err := store.DeduplicationStats(ctx)
+	if err != nil || stats.Blobs != 2 || stats.References != 6 {
+		t.Fatalf("expected one blob per partition, got %+v (%v)", stats, err)
+	}
+
+	backupPath := filepath.Join(t.TempDir(), "backup.db")
+	if err := store.Backup(ctx, backupPath); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	restored, err := NewSqliteStore(backupPath, collection.Options{EnableJSON: true, Deduplicate: true})
+	if err != nil {
+		t.Fatalf("failed to open backup: %v", err)
+	}
+	defer restored.Close()
+	stats, err = restored.DeduplicationStats(ctx)
+	if err != nil || stats.Blobs != 1 || stats.References != 6 {
+		t.Errorf("expected the merged backup to share one blob, got %+v (%v)", stats, err)
+	}
+	got, err := restored.GetRecord(ctx, "d1-2")
+	if err != nil || !bytes.Equal(got.ProtoData, page("", "same page", partitionBase).ProtoData) {
+		t.Errorf("GetRecord from backup returned %q, %v", got.GetProtoData(), err)
+	}
+}
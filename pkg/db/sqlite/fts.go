@@ -0,0 +1,103 @@
+package sqlite
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/accretional/collector/pkg/collection"
+	moderncsqlite "modernc.org/sqlite"
+)
+
+func init() {
+	// Indexing text segmented for CJK collections happens in triggers, so
+	// the segmenter is available to SQL on every connection
+	err := moderncsqlite.RegisterDeterministicScalarFunction("cjk_segment", 1, func(_ *moderncsqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		switch v := args[0].(type) {
+		case string:
+			return collection.SegmentCJK(v), nil
+		case []byte:
+			return collection.SegmentCJK(string(v)), nil
+		}
+		return args[0], nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("register cjk_segment: %v", err))
+	}
+}
+
+// ftsIndexed wraps the SQL expression for a row's indexed text in the
+// language's segmentation.
+func ftsIndexed(expr string, lang collection.Language) string {
+	if lang.Segmented() {
+		return "cjk_segment(" + expr + ")"
+	}
+	return expr
+}
+
+// ftsQuery rewrites a full-text query with the store's synonyms and
+// stopwords, then to match text indexed for its language.
+func (s *SqliteStore) ftsQuery(query string) string {
+	query = s.expander.Expand(query)
+	if s.options.Language.Segmented() {
+		return collection.SegmentCJKQuery(query)
+	}
+	return query
+}
+
+// applyFTSSchema creates the full-text index and the triggers maintaining
+// it. An index built for another language is rebuilt, since its tokens no
+// longer match queries.
+func applyFTSSchema(db *sql.DB, lang collection.Language) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin fts transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	tokenizer := lang.Tokenizer()
+	var table, trigger sql.NullString
+	tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'records_fts'").Scan(&table)
+	tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name = 'records_ai'").Scan(&trigger)
+	rebuild := table.Valid && (!strings.Contains(table.String, `tokenize = "`+tokenizer+`"`) ||
+		strings.Contains(trigger.String, "cjk_segment") != lang.Segmented())
+	if rebuild {
+		if _, err := tx.Exec("DROP TABLE records_fts"); err != nil {
+			return fmt.Errorf("drop fts table: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(collection.FTSSchemaFor(tokenizer)); err != nil {
+		return fmt.Errorf("fts schema failed: %w", err)
+	}
+
+	triggers := `
+	DROP TRIGGER IF EXISTS records_ai;
+	CREATE TRIGGER records_ai AFTER INSERT ON records BEGIN
+		INSERT INTO records_fts(rowid, content) VALUES (new.rowid, ` + ftsIndexed("new.jsontext", lang) + `);
+	END;
+	CREATE TRIGGER IF NOT EXISTS records_ad AFTER DELETE ON records BEGIN
+		DELETE FROM records_fts WHERE rowid=old.rowid;
+	END;
+	DROP TRIGGER IF EXISTS records_au;
+	CREATE TRIGGER records_au AFTER UPDATE ON records BEGIN
+		DELETE FROM records_fts WHERE rowid=old.rowid;
+		INSERT INTO records_fts(rowid, content) VALUES (new.rowid, ` + ftsIndexed(ftsContent("new"), lang) + `);
+	END;
+	`
+	if _, err := tx.Exec(triggers); err != nil {
+		return fmt.Errorf("fts triggers failed: %w", err)
+	}
+
+	if rebuild {
+		if _, err := tx.Exec("INSERT INTO records_fts(rowid, content) SELECT rowid, " + ftsIndexed(ftsContent("records"), lang) + " FROM records"); err != nil {
+			return fmt.Errorf("rebuild fts index: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit fts transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func article(id, body string) *pb.CollectionRecord {
+	return &pb.CollectionRecord{
+		Id:        id,
+		ProtoData: []byte(fmt.Sprintf(`{"body": %q}`, body)),
+		Metadata:  &pb.Metadata{CreatedAt: timestamppb.New(historyBase), UpdatedAt: timestamppb.New(historyBase)},
+	}
+}
+
+func searchIDs(t *testing.T, store *SqliteStore, query string) []string {
+	t.Helper()
+	results, err := store.Search(context.Background(), &collection.SearchQuery{FullText: query, Limit: 10})
+	if err != nil {
+		t.Fatalf("Search(%q) failed: %v", query, err)
+	}
+	var ids []string
+	for _, r := range results {
+		ids = append(ids, r.Record.Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestFTSLanguage(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "news.db")
+	records := []*pb.CollectionRecord{
+		article("tokyo", "東京都で大雨が降りました"),
+		article("kyoto", "京都の天気は晴れです"),
+		article("english", "Crews are running repairs in Tokyo"),
+	}
+
+	store, err := NewSqliteStore(path, collection.Options{EnableFTS: true, EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	if err := store.CreateRecords(ctx, records); err != nil {
+		t.Fatalf("CreateRecords failed: %v", err)
+	}
+	// The default tokenizer indexes a whole run of CJK characters as one word
+	if ids := searchIDs(t, store, "東京"); len(ids) != 0 {
+		t.Errorf("expected no English-tokenized match for 東京, got %v", ids)
+	}
+	store.Close()
+
+	// Reopening with another language rebuilds the index
+	store, err = NewSqliteStore(path, collection.Options{EnableFTS: true, EnableJSON: true, Language: "ja"})
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if err := store.CreateRecord(ctx, article("osaka", "大阪と東京の間")); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	for query, want := range map[string][]string{
+		"東京":           {"osaka", "tokyo"},
+		"東京都":          {"tokyo"},
+		`"京都の天気"`:      {"kyoto"},
+		"晴":            {"kyoto"},
+		"大雨 OR 大阪":     {"osaka", "tokyo"},
+		"run":          {"english"},
+		"tokyo AND 東京": nil,
+	} {
+		if got := searchIDs(t, store, query); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Search(%q) = %v, want %v", query, got, want)
+		}
+	}
+
+	if err := store.UpdateRecord(ctx, article("kyoto", "京都は雨")); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if got := searchIDs(t, store, "京都"); fmt.Sprint(got) != "[kyoto tokyo]" {
+		t.Errorf("expected the updated record to be re-indexed, got %v", got)
+	}
+}
+
+func TestFTSLanguage_Simple(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewSqliteStore(filepath.Join(t.TempDir(), "notes.db"), collection.Options{EnableFTS: true, EnableJSON: true, Language: collection.LanguageSimple})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	if err := store.CreateRecord(ctx, article("fr", "Les élèves étudient")); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if got := searchIDs(t, store, "eleves"); len(got) != 1 {
+		t.Errorf("expected diacritics to be folded, got %v", got)
+	}
+	if got := searchIDs(t, store, "etudie"); len(got) != 0 {
+		t.Errorf("expected no stemming, got %v", got)
+	}
+
+	if _, err := NewSqliteStore(filepath.Join(t.TempDir(), "bad.db"), collection.Options{Language: "klingon"}); err == nil {
+		t.Error("expected an unknown language to be rejected")
+	}
+}
+
+func TestFTSSynonymsAndStopwords(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "docs.db")
+	store, err := NewSqliteStore(path, collection.Options{EnableFTS: true, EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	if err := store.CreateRecords(ctx, []*pb.CollectionRecord{
+		article("guide", "Upgrading a Kubernetes cluster"),
+		article("notes", "k8s node pools"),
+		article("other", "Upgrading the database"),
+	}); err != nil {
+		t.Fatalf("CreateRecords failed: %v", err)
+	}
+	if got := searchIDs(t, store, "k8s"); fmt.Sprint(got) != "[notes]" {
+		t.Errorf("expected only the literal match without synonyms, got %v", got)
+	}
+	store.Close()
+
+	// Reopening with synonyms applies them to existing records
+	store, err = NewSqliteStore(path, collection.Options{
+		EnableFTS: true, EnableJSON: true,
+		Synonyms:  [][]string{{"k8s", "kubernetes"}},
+		Stopwords: []string{"the", "a"},
+	})
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	for query, want := range map[string][]string{
+		"k8s":                 {"guide", "notes"},
+		"upgrade AND k8s":     {"guide"},
+		"upgrading the k8s":   {"guide"},
+		"the":                 {"other"},
+		"database NOT k8s":    {"other"},
+		`"a kubernetes"`:      {"guide"},
+		"kubernetes OR pools": {"guide", "notes"},
+	} {
+		if got := searchIDs(t, store, query); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Search(%q) = %v, want %v", query, got, want)
+		}
+	}
+}
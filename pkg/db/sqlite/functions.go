@@ -0,0 +1,146 @@
+package sqlite
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/accretional/collector/pkg/collection"
+	moderncsqlite "modernc.org/sqlite"
+)
+
+// The driver registers functions for every connection of the process, so a
+// store's custom functions are reached through a variadic udf_<name>
+// trampoline per name whose first argument is the calling store's token.
+// Trampolines are registered once and outlive stores; closing a store
+// forgets its functions.
+var udfs = struct {
+	mu     sync.Mutex
+	names  map[string]bool // Names with a registered trampoline
+	stores sync.Map        // Store token -> map[string]collection.SQLFunction
+	next   atomic.Int64
+}{names: make(map[string]bool)}
+
+// registerTrampolines registers the trampolines of fns not yet registered.
+// It must run before a store's connections open, since the driver adds
+// functions only to new connections.
+func registerTrampolines(fns map[string]collection.SQLFunction) error {
+	udfs.mu.Lock()
+	defer udfs.mu.Unlock()
+	for name := range fns {
+		if udfs.names[name] {
+			continue
+		}
+		name := name
+		err := moderncsqlite.RegisterScalarFunction("udf_"+name, -1, func(_ *moderncsqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			return callFunction(name, args)
+		})
+		if err != nil {
+			return fmt.Errorf("register SQL function %s: %w", name, err)
+		}
+		udfs.names[name] = true
+	}
+	return nil
+}
+
+// storeFunctions makes fns callable by a store and returns the store's
+// token, 0 when there are none.
+func storeFunctions(fns map[string]collection.SQLFunction) int64 {
+	if len(fns) == 0 {
+		return 0
+	}
+	token := udfs.next.Add(1)
+	udfs.stores.Store(token, fns)
+	return token
+}
+
+// forgetFunctions drops the functions of the store with token.
+func forgetFunctions(token int64) {
+	if token != 0 {
+		udfs.stores.Delete(token)
+	}
+}
+
+// callFunction runs the store's function name on args, led by the store's
+// token.
+func callFunction(name string, args []driver.Value) (driver.Value, error) {
+	token, _ := args[0].(int64)
+	fns, ok := udfs.stores.Load(token)
+	if !ok {
+		return nil, fmt.Errorf("SQL function %s is not available", name)
+	}
+	fn, ok := fns.(map[string]collection.SQLFunction)[name]
+	if !ok {
+		return nil, fmt.Errorf("SQL function %s is not available", name)
+	}
+	in := make([]any, len(args)-1)
+	for i, arg := range args[1:] {
+		// The driver reuses argument buffers once the function returns
+		if b, ok := arg.([]byte); ok {
+			arg = append([]byte(nil), b...)
+		}
+		in[i] = arg
+	}
+	out, err := fn.Func(in)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return sqlValue(out)
+}
+
+// sqlValue converts a function's result to a value SQLite stores.
+func sqlValue(v any) (driver.Value, error) {
+	switch v := v.(type) {
+	case nil, int64, float64, string, []byte:
+		return v, nil
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	}
+	return nil, fmt.Errorf("unsupported SQL function result %T", v)
+}
+
+// functionClause translates a filter on a function call into a condition on
+// the function's result for the record.
+func (s *SqliteStore) functionClause(call *collection.FunctionCall, filter collection.Filter) (string, []interface{}, error) {
+	fn, ok := s.functions[call.Name]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: unknown function %q", collection.ErrInvalidFunctionCall, call.Name)
+	}
+	if fn.NArgs >= 0 && len(call.Args) != fn.NArgs {
+		return "", nil, fmt.Errorf("%w: %s takes %d arguments, got %d", collection.ErrInvalidFunctionCall, call.Name, fn.NArgs, len(call.Args))
+	}
+	if err := filter.Validate(); err != nil {
+		return "", nil, err
+	}
+	switch filter.Operator {
+	case collection.OpArrayContains, collection.OpArrayContainsAny:
+		return "", nil, fmt.Errorf("%s cannot be used with function %s", filter.Operator, call.Name)
+	}
+
+	params := []string{"?"}
+	args := []interface{}{s.udfToken}
+	for _, arg := range call.Args {
+		if arg.Field != nil {
+			params = append(params, `json_extract(r.jsontext, ?)`)
+			args = append(args, arg.Field.JSONPath())
+			continue
+		}
+		params = append(params, "?")
+		args = append(args, arg.Value)
+	}
+	value := `udf_` + call.Name + `(` + strings.Join(params, ", ") + `)`
+	return compareClause(jsonField{value: value, typ: `json_type(json_quote(` + value + `))`, args: args}, filter)
+}
@@ -0,0 +1,100 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCustomFunctions(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// Matches records whose title holds the term, scoring by occurrences
+	termScore := collection.SQLFunction{NArgs: 2, Func: func(args []any) (any, error) {
+		title, _ := args[0].(string)
+		term, _ := args[1].(string)
+		return strings.Count(strings.ToLower(title), strings.ToLower(term)), nil
+	}}
+	if err := collection.RegisterSQLExtension(collection.SQLExtension{
+		Name: "test-math",
+		Functions: map[string]collection.SQLFunction{
+			"double_it": {NArgs: 1, Func: func(args []any) (any, error) {
+				n, _ := args[0].(int64)
+				return n * 2, nil
+			}},
+		},
+	}); err != nil {
+		t.Fatalf("RegisterSQLExtension failed: %v", err)
+	}
+
+	store, err := NewSqliteStore(filepath.Join(dir, "scored.db"), collection.Options{
+		EnableJSON: true,
+		Functions:  map[string]collection.SQLFunction{"term_score": termScore},
+		Extensions: []string{"test-math"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	for id, data := range map[string]string{
+		"a": `{"title": "Go, go, go", "n": 1}`,
+		"b": `{"title": "Go home", "n": 3}`,
+		"c": `{"title": "Rust", "n": 5}`,
+	} {
+		now := timestamppb.Now()
+		if err := store.CreateRecord(ctx, &pb.CollectionRecord{Id: id, ProtoData: []byte(data), Metadata: &pb.Metadata{CreatedAt: now, UpdatedAt: now}}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	search := func(store *SqliteStore, filters map[string]collection.Filter) ([]string, error) {
+		t.Helper()
+		results, err := store.Search(ctx, &collection.SearchQuery{Filters: filters})
+		var ids []string
+		for _, r := range results {
+			ids = append(ids, r.Record.Id)
+		}
+		sort.Strings(ids)
+		return ids, err
+	}
+
+	ids, err := search(store, map[string]collection.Filter{
+		`term_score(title, "go")`: {Operator: collection.OpGreaterEqual, Value: 1},
+	})
+	if err != nil || strings.Join(ids, ",") != "a,b" {
+		t.Errorf("expected a and b to score, got %v %v", ids, err)
+	}
+	ids, err = search(store, map[string]collection.Filter{
+		`term_score(title, 'GO')`: {Operator: collection.OpEquals, Value: 3},
+		`double_it(n)`:            {Operator: collection.OpLessThan, Value: 4},
+	})
+	if err != nil || strings.Join(ids, ",") != "a" {
+		t.Errorf("expected a from combined function filters, got %v %v", ids, err)
+	}
+
+	// Other stores do not have the functions, and calls are checked
+	plain, err := NewSqliteStore(filepath.Join(dir, "plain.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer plain.Close()
+	for _, s := range []*SqliteStore{plain, store} {
+		key := `term_score(title)`
+		if s == plain {
+			key = `term_score(title, "go")`
+		}
+		if _, err := search(s, map[string]collection.Filter{key: {Operator: collection.OpExists}}); !errors.Is(err, collection.ErrInvalidFunctionCall) {
+			t.Errorf("expected ErrInvalidFunctionCall for %s, got %v", key, err)
+		}
+	}
+	if _, err := NewSqliteStore(filepath.Join(dir, "bad.db"), collection.Options{Extensions: []string{"missing"}}); err == nil {
+		t.Errorf("expected an unknown extension refused")
+	}
+}
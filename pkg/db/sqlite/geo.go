@@ -0,0 +1,149 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// geoFields holds SQL expressions for a record's indexed location.
+type geoFields struct {
+	latPath, lonPath string
+}
+
+func newGeoFields(opts *collection.GeoOptions) (*geoFields, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	lat, _ := collection.ParseFieldPath(opts.LatField)
+	lon, _ := collection.ParseFieldPath(opts.LonField)
+	return &geoFields{latPath: lat.JSONPath(), lonPath: lon.JSONPath()}, nil
+}
+
+// coordinate reads a numeric field of the records row named by alias, or NULL
+// when it is missing, not a number, or outside [min, max].
+func coordinate(alias, path string, min, max int) string {
+	literal := "'" + strings.ReplaceAll(path, "'", "''") + "'"
+	value := fmt.Sprintf("json_extract(%s.jsontext, %s)", alias, literal)
+	return fmt.Sprintf("(CASE WHEN json_type(%s.jsontext, %s) IN ('integer', 'real') AND %s BETWEEN %d AND %d THEN %s END)",
+		alias, literal, value, min, max, value)
+}
+
+func (g *geoFields) lat(alias string) string { return coordinate(alias, g.latPath, -90, 90) }
+func (g *geoFields) lon(alias string) string { return coordinate(alias, g.lonPath, -180, 180) }
+
+// triggers returns the statements that keep records_geo in step with records.
+func (g *geoFields) triggers() []string {
+	insert := func(alias string) string {
+		lat, lon := g.lat(alias), g.lon(alias)
+		return fmt.Sprintf(`INSERT INTO records_geo (id, min_lat, max_lat, min_lon, max_lon)
+			SELECT %[1]s.rowid, %[2]s, %[2]s, %[3]s, %[3]s WHERE %[2]s IS NOT NULL AND %[3]s IS NOT NULL;`, alias, lat, lon)
+	}
+	return []string{
+		`CREATE TRIGGER records_geo_ai AFTER INSERT ON records BEGIN
+			` + insert("new") + `
+		END`,
+		`CREATE TRIGGER records_geo_au AFTER UPDATE ON records BEGIN
+			DELETE FROM records_geo WHERE id = old.rowid;
+			` + insert("new") + `
+		END`,
+		`CREATE TRIGGER records_geo_ad AFTER DELETE ON records BEGIN
+			DELETE FROM records_geo WHERE id = old.rowid;
+		END`,
+	}
+}
+
+// applyGeoSchema creates the geo index and its triggers. When the declared
+// fields differ from those the index was built with, the index is rebuilt
+// from the stored records.
+func applyGeoSchema(db *sql.DB, g *geoFields) error {
+	triggers := g.triggers()
+
+	var existing string
+	err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name = 'records_geo_ai'`).Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if existing == triggers[0] {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		collection.GeoSchema,
+		`DROP TRIGGER IF EXISTS records_geo_ai`,
+		`DROP TRIGGER IF EXISTS records_geo_au`,
+		`DROP TRIGGER IF EXISTS records_geo_ad`,
+		`DELETE FROM records_geo`,
+	}
+	stmts = append(stmts, triggers...)
+	lat, lon := g.lat("records"), g.lon("records")
+	stmts = append(stmts, fmt.Sprintf(`INSERT INTO records_geo (id, min_lat, max_lat, min_lon, max_lon)
+		SELECT rowid, %[1]s, %[1]s, %[2]s, %[2]s FROM records WHERE %[1]s IS NOT NULL AND %[2]s IS NOT NULL`, lat, lon))
+
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// distance is the haversine distance in meters from the record r to the
+// point bound by the two latitude and one longitude arguments that follow.
+func (g *geoFields) distance() string {
+	lat, lon := g.lat("r"), g.lon("r")
+	return fmt.Sprintf(`(2 * %[3]v * asin(min(1, sqrt(
+		pow(sin(radians(%[1]s - ?) / 2), 2) +
+		cos(radians(?)) * cos(radians(%[1]s)) * pow(sin(radians(%[2]s - ?) / 2), 2)))))`,
+		lat, lon, collection.EarthRadiusMeters)
+}
+
+// boxClauses returns conditions placing the record r inside box: an R-tree
+// lookup on g, then an exact check, since R-tree coordinates are rounded.
+func (g *geoFields) boxClauses(box collection.BoundingBox) ([]string, []interface{}) {
+	clauses := []string{
+		`g.max_lat >= ? AND g.min_lat <= ?`,
+		g.lat("r") + ` BETWEEN ? AND ?`,
+	}
+	args := []interface{}{box.MinLat, box.MaxLat, box.MinLat, box.MaxLat}
+
+	if box.CrossesAntimeridian() {
+		clauses = append(clauses,
+			`(g.max_lon >= ? OR g.min_lon <= ?)`,
+			`(`+g.lon("r")+` >= ? OR `+g.lon("r")+` <= ?)`)
+	} else {
+		clauses = append(clauses,
+			`g.max_lon >= ? AND g.min_lon <= ?`,
+			g.lon("r")+` BETWEEN ? AND ?`)
+	}
+	args = append(args, box.MinLon, box.MaxLon, box.MinLon, box.MaxLon)
+	return clauses, args
+}
+
+// geoClauses returns the join and conditions for a geo filter.
+func (s *SqliteStore) geoClauses(f *collection.GeoFilter) (string, []string, []interface{}, error) {
+	if s.geo == nil {
+		return "", nil, nil, collection.ErrGeoUnavailable
+	}
+	if err := f.Validate(); err != nil {
+		return "", nil, nil, err
+	}
+	const join = `JOIN records_geo g ON g.id = r.rowid `
+
+	if f.Box != nil {
+		clauses, args := s.geo.boxClauses(*f.Box)
+		return join, clauses, args, nil
+	}
+	clauses, args := s.geo.boxClauses(f.Radius.Bounds())
+	clauses = append(clauses, s.geo.distance()+` <= ?`)
+	args = append(args, f.Radius.Lat, f.Radius.Lat, f.Radius.Lon, f.Radius.Meters)
+	return join, clauses, args, nil
+}
@@ -0,0 +1,137 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func geoSearchIDs(t *testing.T, store *SqliteStore, f *collection.GeoFilter) ([]string, []float64) {
+	t.Helper()
+	results, err := store.Search(context.Background(), &collection.SearchQuery{Geo: f})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	var ids []string
+	var distances []float64
+	for _, r := range results {
+		ids = append(ids, r.Record.Id)
+		distances = append(distances, r.Distance)
+	}
+	return ids, distances
+}
+
+func TestGeo_Filters(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "geo.db")
+	opts := collection.Options{EnableJSON: true, Geo: &collection.GeoOptions{LatField: "location.lat", LonField: "location.lon"}}
+	store, err := NewSqliteStore(path, opts)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	places := []struct{ id, data string }{
+		{"sf", `{"location": {"lat": 37.7749, "lon": -122.4194}}`},
+		{"oakland", `{"location": {"lat": 37.8044, "lon": -122.2712}}`},
+		{"la", `{"location": {"lat": 34.0522, "lon": -118.2437}}`},
+		{"fiji", `{"location": {"lat": -17.7134, "lon": 178.065}}`},
+		{"samoa", `{"location": {"lat": -13.759, "lon": -172.1046}}`},
+		{"nowhere", `{"name": "no location"}`},
+		{"bad", `{"location": {"lat": "north", "lon": 200}}`},
+	}
+	for _, p := range places {
+		if err := store.CreateRecord(ctx, historyRecord(p.id, p.data, historyBase, historyBase)); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	// Bay Area box
+	ids, _ := geoSearchIDs(t, store, &collection.GeoFilter{Box: &collection.BoundingBox{MinLat: 37, MinLon: -123, MaxLat: 38, MaxLon: -122}})
+	if fmt.Sprint(ids) != "[sf oakland]" {
+		t.Errorf("box: got %v", ids)
+	}
+
+	// A box across the antimeridian
+	ids, _ = geoSearchIDs(t, store, &collection.GeoFilter{Box: &collection.BoundingBox{MinLat: -20, MinLon: 170, MaxLat: -10, MaxLon: -170}})
+	if fmt.Sprint(ids) != "[fiji samoa]" {
+		t.Errorf("antimeridian box: got %v", ids)
+	}
+
+	// 20km around SF, nearest first, with distances
+	ids, distances := geoSearchIDs(t, store, &collection.GeoFilter{Radius: &collection.GeoRadius{Lat: 37.7749, Lon: -122.4194, Meters: 20000}})
+	if fmt.Sprint(ids) != "[sf oakland]" {
+		t.Fatalf("radius: got %v", ids)
+	}
+	want := collection.HaversineMeters(37.7749, -122.4194, 37.8044, -122.2712)
+	if distances[0] != 0 || math.Abs(distances[1]-want) > 1 {
+		t.Errorf("radius distances = %v, want [0 %.0f]", distances, want)
+	}
+
+	// Radius searches combine with other filters and count like searches
+	count, err := store.CountMatching(ctx, &collection.SearchQuery{
+		Geo: &collection.GeoFilter{Radius: &collection.GeoRadius{Lat: 37.7749, Lon: -122.4194, Meters: 600000}},
+	})
+	if err != nil || count != 3 {
+		t.Errorf("expected 3 records within 600km, got %d (%v)", count, err)
+	}
+
+	// Updates move the indexed point; deletes remove it
+	if err := store.UpdateRecord(ctx, historyRecord("la", `{"location": {"lat": 37.78, "lon": -122.41}}`, historyBase, historyBase)); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if err := store.DeleteRecord(ctx, "oakland"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	ids, _ = geoSearchIDs(t, store, &collection.GeoFilter{Radius: &collection.GeoRadius{Lat: 37.7749, Lon: -122.4194, Meters: 20000}})
+	if fmt.Sprint(ids) != "[sf la]" {
+		t.Errorf("after update and delete: got %v", ids)
+	}
+	store.Close()
+
+	// Reopening with other fields rebuilds the index from stored records
+	world := &collection.GeoFilter{Box: &collection.BoundingBox{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}}
+	for _, tt := range []struct {
+		lat, lon string
+		want     int
+	}{
+		{"home.lat", "home.lon", 0},
+		{"location.lat", "location.lon", 4},
+	} {
+		opts.Geo = &collection.GeoOptions{LatField: tt.lat, LonField: tt.lon}
+		store, err = NewSqliteStore(path, opts)
+		if err != nil {
+			t.Fatalf("failed to reopen store: %v", err)
+		}
+		if ids, _ := geoSearchIDs(t, store, world); len(ids) != tt.want {
+			t.Errorf("fields %s,%s: expected %d located records, got %v", tt.lat, tt.lon, tt.want, ids)
+		}
+		store.Close()
+	}
+}
+
+func TestGeo_Unavailable(t *testing.T) {
+	store, err := NewSqliteStore(filepath.Join(t.TempDir(), "plain.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	_, err = store.Search(context.Background(), &collection.SearchQuery{
+		Geo: &collection.GeoFilter{Box: &collection.BoundingBox{MinLat: 0, MaxLat: 1, MinLon: 0, MaxLon: 1}},
+	})
+	if !errors.Is(err, collection.ErrGeoUnavailable) {
+		t.Errorf("expected ErrGeoUnavailable, got %v", err)
+	}
+
+	if _, err := NewSqliteStore(filepath.Join(t.TempDir(), "nojson.db"), collection.Options{Geo: &collection.GeoOptions{LatField: "lat", LonField: "lon"}}); err == nil {
+		t.Error("expected an error for a geo index without JSON")
+	}
+	if _, err := NewSqliteStore(filepath.Join(t.TempDir(), "badpath.db"), collection.Options{EnableJSON: true, Geo: &collection.GeoOptions{LatField: "points[*].lat", LonField: "lon"}}); err == nil {
+		t.Error("expected an error for a wildcard geo field")
+	}
+}
@@ -0,0 +1,154 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// asOfSource selects every record version current at a point in time: live
+// rows last written at or before it, plus history rows whose validity interval
+// contains it. It takes the as-of Unix time three times. History rows keep
+// no HLC.
+const asOfSource = `(
+	SELECT id, proto_data, encoding, data_uri, created_at, updated_at, labels, jsontext, hlc
+	FROM records WHERE updated_at <= ?
+	UNION ALL
+	SELECT id, proto_data, encoding, data_uri, created_at, updated_at, labels, jsontext, NULL AS hlc
+	FROM records_history WHERE valid_from <= ? AND valid_to > ?
+)`
+
+// HistoryEnabled reports whether the store keeps superseded record versions.
+func (s *SqliteStore) HistoryEnabled() bool { return s.options.EnableHistory }
+
+// GetRecordAsOf returns the version of a record that was current at asOf, or
+// sql.ErrNoRows if it did not exist then.
+func (s *SqliteStore) GetRecordAsOf(ctx context.Context, id string, asOf time.Time) (*pb.CollectionRecord, error) {
+	if !s.HistoryEnabled() {
+		return nil, collection.ErrHistoryUnavailable
+	}
+	t := asOf.Unix()
+	records, err := s.queryRecords(ctx, `
+		SELECT id, `+storedData("")+`, data_uri, created_at, updated_at, labels, hlc
+		FROM `+asOfSource+` WHERE id = ? LIMIT 1`, t, t, t, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return records[0], nil
+}
+
+// ListRecordsAsOf lists records as they existed at asOf, newest first.
+func (s *SqliteStore) ListRecordsAsOf(ctx context.Context, asOf time.Time, offset, limit int) ([]*pb.CollectionRecord, error) {
+	if !s.HistoryEnabled() {
+		return nil, collection.ErrHistoryUnavailable
+	}
+	t := asOf.Unix()
+	return s.queryRecords(ctx, `
+		SELECT id, `+storedData("")+`, data_uri, created_at, updated_at, labels, hlc
+		FROM `+asOfSource+` ORDER BY created_at DESC LIMIT ? OFFSET ?`, t, t, t, limit, offset)
+}
+
+// PruneHistory deletes record versions that stopped being current before
+// cutoff and returns how many were removed. As-of reads earlier than cutoff
+// are no longer accurate afterwards.
+func (s *SqliteStore) PruneHistory(ctx context.Context, cutoff time.Time) (int64, error) {
+	if !s.HistoryEnabled() {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM records_history WHERE valid_to < ?", cutoff.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune history: %w", err)
+	}
+	if err := s.collectBlobs(ctx); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PruneHistoryImpact reports the record versions PruneHistory would delete
+// for cutoff, with up to sample of the IDs of the records they belong to (see
+// collection.ImpactSample), without deleting anything.
+func (s *SqliteStore) PruneHistoryImpact(ctx context.Context, cutoff time.Time, sample int) (*pb.Impact, error) {
+	impact := &pb.Impact{DryRun: true}
+	if !s.HistoryEnabled() {
+		return impact, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM records_history WHERE valid_to < ?", cutoff.Unix()).Scan(&impact.Count); err != nil {
+		return nil, fmt.Errorf("failed to count history: %w", err)
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT id FROM records_history WHERE valid_to < ? ORDER BY id LIMIT ?",
+		cutoff.Unix(), collection.ImpactSample(sample))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample history: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		impact.SampleIds = append(impact.SampleIds, id)
+	}
+	return impact, rows.Err()
+}
+
+// queryRecords runs a query selecting id, storedData, data_uri, created_at,
+// updated_at, labels and hlc, and decodes the rows into records.
+func (s *SqliteStore) queryRecords(ctx context.Context, query string, args ...interface{}) ([]*pb.CollectionRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*pb.CollectionRecord
+	for rows.Next() {
+		var (
+			r                pb.CollectionRecord
+			encoding         int64
+			dataUri          sql.NullString
+			created, updated int64
+			labelsJSON       sql.NullString
+			hlc              sql.NullInt64
+		)
+		if err := rows.Scan(&r.Id, &r.ProtoData, &encoding, &dataUri, &created, &updated, &labelsJSON, &hlc); err != nil {
+			return nil, err
+		}
+		data, err := s.codec.decode(r.ProtoData, encoding)
+		if err != nil {
+			return nil, err
+		}
+		r.ProtoData = data
+		r.Metadata = &pb.Metadata{
+			CreatedAt: &timestamppb.Timestamp{Seconds: created},
+			UpdatedAt: &timestamppb.Timestamp{Seconds: updated},
+			Hlc:       hlc.Int64,
+		}
+		if dataUri.Valid {
+			r.DataUri = dataUri.String
+		}
+		if labelsJSON.String != "" {
+			json.Unmarshal([]byte(labelsJSON.String), &r.Metadata.Labels)
+		}
+		records = append(records, &r)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,146 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var historyBase = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func historyRecord(id, data string, created, updated time.Time) *pb.CollectionRecord {
+	return &pb.CollectionRecord{
+		Id:        id,
+		ProtoData: []byte(data),
+		Metadata:  &pb.Metadata{CreatedAt: timestamppb.New(created), UpdatedAt: timestamppb.New(updated)},
+	}
+}
+
+func TestHistory_AsOfReads(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewSqliteStore(filepath.Join(t.TempDir(), "history.db"), collection.Options{EnableJSON: true, EnableHistory: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	t0 := historyBase
+	t1 := t0.Add(time.Hour)
+	t2 := t0.Add(2 * time.Hour)
+
+	// a is created at t0 and updated at t2; b is created at t1 and later deleted
+	if err := store.CreateRecord(ctx, historyRecord("a", `{"v": 1}`, t0, t0)); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := store.CreateRecord(ctx, historyRecord("b", `{"v": 1}`, t1, t1)); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := store.UpdateRecord(ctx, historyRecord("a", `{"v": 2}`, t0, t2)); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if err := store.DeleteRecord(ctx, "b"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		asOf  time.Time
+		want  map[string]string
+		count int64
+	}{
+		{"before creation", t0.Add(-time.Minute), map[string]string{}, 0},
+		{"first version", t0.Add(30 * time.Minute), map[string]string{"a": `{"v": 1}`}, 1},
+		{"both records", t1.Add(30 * time.Minute), map[string]string{"a": `{"v": 1}`, "b": `{"v": 1}`}, 2},
+		{"after update", t2.Add(time.Minute), map[string]string{"a": `{"v": 2}`, "b": `{"v": 1}`}, 1},
+		{"after delete", time.Now().Add(time.Minute), map[string]string{"a": `{"v": 2}`}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := store.ListRecordsAsOf(ctx, tt.asOf, 0, 10)
+			if err != nil {
+				t.Fatalf("ListRecordsAsOf failed: %v", err)
+			}
+			if len(records) != len(tt.want) {
+				t.Fatalf("expected %d records, got %d", len(tt.want), len(records))
+			}
+			for _, r := range records {
+				if string(r.ProtoData) != tt.want[r.Id] {
+					t.Errorf("record %s: expected %s, got %s", r.Id, tt.want[r.Id], r.ProtoData)
+				}
+			}
+
+			for id, data := range tt.want {
+				r, err := store.GetRecordAsOf(ctx, id, tt.asOf)
+				if err != nil {
+					t.Fatalf("GetRecordAsOf(%s) failed: %v", id, err)
+				}
+				if string(r.ProtoData) != data {
+					t.Errorf("GetRecordAsOf(%s): expected %s, got %s", id, data, r.ProtoData)
+				}
+			}
+
+			count, err := store.CountMatching(ctx, &collection.SearchQuery{
+				AsOf:    tt.asOf,
+				Filters: map[string]collection.Filter{"v": {Operator: collection.OpEquals, Value: 1}},
+			})
+			if err != nil {
+				t.Fatalf("CountMatching failed: %v", err)
+			}
+			if count != tt.count {
+				t.Errorf("expected %d records with v=1, got %d", tt.count, count)
+			}
+		})
+	}
+
+	if _, err := store.GetRecordAsOf(ctx, "b", t0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows before b existed, got %v", err)
+	}
+
+	results, err := store.Search(ctx, &collection.SearchQuery{AsOf: t1.Add(time.Minute), OrderBy: "v"})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Errorf("expected 2 results as of t1, got %d", len(results))
+	}
+
+	impact, err := store.PruneHistoryImpact(ctx, time.Now().Add(time.Hour), 0)
+	if err != nil {
+		t.Fatalf("PruneHistoryImpact failed: %v", err)
+	}
+	if impact.Count != 2 || len(impact.SampleIds) == 0 || !impact.DryRun {
+		t.Errorf("expected a dry run over 2 versions, got %v", impact)
+	}
+
+	pruned, err := store.PruneHistory(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("PruneHistory failed: %v", err)
+	}
+	if pruned != 2 {
+		t.Errorf("expected 2 pruned versions, got %d", pruned)
+	}
+}
+
+func TestHistory_Disabled(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewSqliteStore(filepath.Join(t.TempDir(), "plain.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	if _, err := store.GetRecordAsOf(ctx, "a", historyBase); !errors.Is(err, collection.ErrHistoryUnavailable) {
+		t.Errorf("expected ErrHistoryUnavailable, got %v", err)
+	}
+	if _, err := store.Search(ctx, &collection.SearchQuery{AsOf: historyBase}); !errors.Is(err, collection.ErrHistoryUnavailable) {
+		t.Errorf("expected ErrHistoryUnavailable from Search, got %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// outboxSchema stores the outbox messages of every collection in the store,
+// written in the transaction of the record they announce. A message is due
+// once next_attempt_at (unix milliseconds) passes and is sent once sent_at
+// is set. The indexes serve the relay's scan for due messages, its check for
+// earlier unsent messages with the same topic and key, and ListOutbox.
+const outboxSchema = `
+CREATE TABLE IF NOT EXISTS outbox_messages (
+    id TEXT PRIMARY KEY,
+    collection TEXT NOT NULL,
+    record_id TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    key TEXT NOT NULL DEFAULT '',
+    payload BLOB,
+    headers TEXT NOT NULL DEFAULT '{}',
+    created_at INTEGER NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at INTEGER NOT NULL,
+    sent_at INTEGER
+);
+CREATE INDEX IF NOT EXISTS outbox_messages_due ON outbox_messages(sent_at, next_attempt_at);
+CREATE INDEX IF NOT EXISTS outbox_messages_key ON outbox_messages(topic, key);
+CREATE INDEX IF NOT EXISTS outbox_messages_collection ON outbox_messages(collection);
+`
+
+const outboxColumns = `id, collection, record_id, topic, key, payload, headers, created_at, attempts, last_error, sent_at`
+
+func scanOutboxMessages(rows *sql.Rows) ([]*pb.OutboxMessage, error) {
+	defer rows.Close()
+	var msgs []*pb.OutboxMessage
+	for rows.Next() {
+		var (
+			msg           pb.OutboxMessage
+			coll, headers string
+			createdAt     int64
+			sentAt        sql.NullInt64
+		)
+		if err := rows.Scan(&msg.Id, &coll, &msg.RecordId, &msg.Topic, &msg.Key, &msg.Payload, &headers,
+			&createdAt, &msg.Attempts, &msg.LastError, &sentAt); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox message: %w", err)
+		}
+		msg.Namespace, msg.CollectionName, _ = strings.Cut(coll, "/")
+		if err := json.Unmarshal([]byte(headers), &msg.Headers); err != nil {
+			return nil, fmt.Errorf("failed to decode headers of outbox message %s: %w", msg.Id, err)
+		}
+		msg.CreatedAt = timestamppb.New(time.UnixMilli(createdAt))
+		if sentAt.Valid {
+			msg.SentAt = timestamppb.New(time.UnixMilli(sentAt.Int64))
+		}
+		msgs = append(msgs, &msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan outbox messages: %w", err)
+	}
+	return msgs, nil
+}
+
+// WriteWithOutbox creates or updates r and adds msgs in one transaction.
+func (s *SqliteStore) WriteWithOutbox(ctx context.Context, r *pb.CollectionRecord, update bool, msgs []*pb.OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if update {
+		err = s.updateRecord(ctx, tx, r)
+	} else {
+		err = s.insertRecord(ctx, tx, r)
+	}
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		headers, err := json.Marshal(msg.Headers)
+		if err != nil {
+			return fmt.Errorf("failed to encode headers of outbox message %s: %w", msg.Id, err)
+		}
+		if msg.Headers == nil {
+			headers = []byte("{}")
+		}
+		createdAt := msg.CreatedAt.AsTime().UnixMilli()
+		if _, err := tx.ExecContext(ctx, `INSERT INTO outbox_messages
+			(id, collection, record_id, topic, key, payload, headers, created_at, next_attempt_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			msg.Id, msg.Namespace+"/"+msg.CollectionName, msg.RecordId, msg.Topic, msg.Key, msg.Payload,
+			string(headers), createdAt, createdAt); err != nil {
+			return fmt.Errorf("failed to add outbox message %s: %w", msg.Id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if update {
+		return s.collectBlobs(ctx)
+	}
+	s.maybeTrainCompression(ctx)
+	return nil
+}
+
+// PendingOutbox returns up to max unsent messages due by now in the order
+// they were written, leaving out those behind an earlier unsent message with
+// the same topic and key that is not yet due.
+func (s *SqliteStore) PendingOutbox(ctx context.Context, now time.Time, max int) ([]*pb.OutboxMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+outboxColumns+` FROM outbox_messages m
+		WHERE sent_at IS NULL AND next_attempt_at <= ?
+		AND NOT EXISTS (SELECT 1 FROM outbox_messages p
+			WHERE p.topic = m.topic AND p.key = m.key AND p.sent_at IS NULL
+			AND p.rowid < m.rowid AND p.next_attempt_at > ?)
+		ORDER BY rowid LIMIT ?`, now.UnixMilli(), now.UnixMilli(), max)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select outbox messages: %w", err)
+	}
+	return scanOutboxMessages(rows)
+}
+
+// MarkOutboxSent records that a message was published at at.
+func (s *SqliteStore) MarkOutboxSent(ctx context.Context, id string, at time.Time) error {
+	return s.markOutbox(ctx, id, `UPDATE outbox_messages SET sent_at = ?, attempts = attempts + 1, last_error = ''
+		WHERE id = ?`, at.UnixMilli(), id)
+}
+
+// MarkOutboxFailed records a failed publish of a message, due again at
+// retryAt.
+func (s *SqliteStore) MarkOutboxFailed(ctx context.Context, id, reason string, retryAt time.Time) error {
+	return s.markOutbox(ctx, id, `UPDATE outbox_messages SET attempts = attempts + 1, last_error = ?, next_attempt_at = ?
+		WHERE id = ?`, reason, retryAt.UnixMilli(), id)
+}
+
+func (s *SqliteStore) markOutbox(ctx context.Context, id, query string, args ...any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("outbox message %s not found", id)
+	}
+	return nil
+}
+
+// ListOutbox returns up to limit messages of a collection in the order they
+// were written, with those already sent if includeSent.
+func (s *SqliteStore) ListOutbox(ctx context.Context, namespace, name string, includeSent bool, limit int) ([]*pb.OutboxMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := `SELECT ` + outboxColumns + ` FROM outbox_messages WHERE collection = ?`
+	if !includeSent {
+		query += ` AND sent_at IS NULL`
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY rowid LIMIT ?`, namespace+"/"+name, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox messages: %w", err)
+	}
+	return scanOutboxMessages(rows)
+}
+
+// PurgeOutbox deletes messages sent before before.
+func (s *SqliteStore) PurgeOutbox(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM outbox_messages WHERE sent_at IS NOT NULL AND sent_at < ?`, before.UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge outbox messages: %w", err)
+	}
+	return res.RowsAffected()
+}
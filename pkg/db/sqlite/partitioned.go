@@ -0,0 +1,599 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// PartitionPeriod is the width of a time partition.
+type PartitionPeriod string
+
+const (
+	PartitionHourly  PartitionPeriod = "hourly"
+	PartitionDaily   PartitionPeriod = "daily"
+	PartitionMonthly PartitionPeriod = "monthly"
+)
+
+// layout returns the time layout used to name partition files.
+func (p PartitionPeriod) layout() (string, error) {
+	switch p {
+	case PartitionHourly:
+		return "2006010215", nil
+	case PartitionDaily:
+		return "20060102", nil
+	case PartitionMonthly:
+		return "200601", nil
+	default:
+		return "", fmt.Errorf("unknown partition period %q", p)
+	}
+}
+
+// start truncates t (in UTC) to the beginning of its partition.
+func (p PartitionPeriod) start(t time.Time) time.Time {
+	t = t.UTC()
+	switch p {
+	case PartitionHourly:
+		return t.Truncate(time.Hour)
+	case PartitionMonthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// end returns the exclusive end of the partition that starts at start.
+func (p PartitionPeriod) end(start time.Time) time.Time {
+	switch p {
+	case PartitionHourly:
+		return start.Add(time.Hour)
+	case PartitionMonthly:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+type partition struct {
+	key   string
+	start time.Time
+	end   time.Time
+	store *SqliteStore
+}
+
+// PartitionedStore stores one logical collection as a set of per-period SQLite
+// files in a directory, routed by each record's created_at. Retention drops whole
+// partition files (DropPartitionsBefore) instead of running large DELETEs, and
+// searches with a creation-time range only open the partitions that overlap it.
+//
+// Lookups by ID (Get/Update/Delete) probe partitions newest-first, so they are
+// cheapest for recent records.
+type PartitionedStore struct {
+	dir    string
+	period PartitionPeriod
+	layout string
+	opts   collection.Options
+
+	mu         sync.RWMutex
+	partitions map[string]*partition
+
+	// Serializes creates, so two with one ID cannot both find it absent
+	// and land in different partitions
+	createMu sync.Mutex
+}
+
+// NewPartitionedStore opens (or creates) a partitioned store in dir. Existing
+// partition files are reopened.
+func NewPartitionedStore(dir string, period PartitionPeriod, opts collection.Options) (*PartitionedStore, error) {
+	layout, err := period.layout()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create partition directory: %w", err)
+	}
+
+	s := &PartitionedStore{
+		dir:        dir,
+		period:     period,
+		layout:     layout,
+		opts:       opts,
+		partitions: make(map[string]*partition),
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "p_*.db"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+	for _, m := range matches {
+		key := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), "p_"), ".db")
+		start, err := time.Parse(layout, key)
+		if err != nil {
+			continue // Not a partition of this period
+		}
+		if _, err := s.open(key, start); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// open opens a partition; callers must hold mu for writing or be in the constructor.
+func (s *PartitionedStore) open(key string, start time.Time) (*partition, error) {
+	store, err := NewSqliteStore(filepath.Join(s.dir, "p_"+key+".db"), s.opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partition %s: %w", key, err)
+	}
+	p := &partition{key: key, start: start, end: s.period.end(start), store: store}
+	s.partitions[key] = p
+	return p, nil
+}
+
+// partitionFor returns the partition covering t, creating it if needed.
+func (s *PartitionedStore) partitionFor(t time.Time) (*partition, error) {
+	start := s.period.start(t)
+	key := start.Format(s.layout)
+
+	s.mu.RLock()
+	p, ok := s.partitions[key]
+	s.mu.RUnlock()
+	if ok {
+		return p, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.partitions[key]; ok {
+		return p, nil
+	}
+	return s.open(key, start)
+}
+
+// sorted returns partitions newest-first, optionally restricted to those overlapping [after, before).
+func (s *PartitionedStore) sorted(after, before time.Time) []*partition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	parts := make([]*partition, 0, len(s.partitions))
+	for _, p := range s.partitions {
+		if !after.IsZero() && !p.end.After(after) {
+			continue
+		}
+		if !before.IsZero() && !p.start.Before(before) {
+			continue
+		}
+		parts = append(parts, p)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].start.After(parts[j].start) })
+	return parts
+}
+
+// locate finds the partition holding id.
+func (s *PartitionedStore) locate(ctx context.Context, id string) (*partition, *pb.CollectionRecord, error) {
+	for _, p := range s.sorted(time.Time{}, time.Time{}) {
+		record, err := p.store.GetRecord(ctx, id)
+		if err == nil {
+			return p, record, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, sql.ErrNoRows
+}
+
+// Partitions returns the partition keys, newest first.
+func (s *PartitionedStore) Partitions() []string {
+	parts := s.sorted(time.Time{}, time.Time{})
+	keys := make([]string, len(parts))
+	for i, p := range parts {
+		keys[i] = p.key
+	}
+	return keys
+}
+
+// DropPartitionsBefore deletes every partition whose period ends at or before cutoff
+// and returns the dropped partition keys.
+func (s *PartitionedStore) DropPartitionsBefore(ctx context.Context, cutoff time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var dropped []string
+	for key, p := range s.partitions {
+		if p.end.After(cutoff) {
+			continue
+		}
+		if err := p.store.Close(); err != nil {
+			return dropped, fmt.Errorf("failed to close partition %s: %w", key, err)
+		}
+		base := filepath.Join(s.dir, "p_"+key+".db")
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err := os.Remove(base + suffix); err != nil && !os.IsNotExist(err) {
+				return dropped, fmt.Errorf("failed to remove partition %s: %w", key, err)
+			}
+		}
+		delete(s.partitions, key)
+		dropped = append(dropped, key)
+	}
+	sort.Strings(dropped)
+	return dropped, nil
+}
+
+// DropPartitionsBeforeImpact reports the records DropPartitionsBefore would
+// delete for cutoff, with up to sample of their IDs (see
+// collection.ImpactSample), without dropping anything.
+func (s *PartitionedStore) DropPartitionsBeforeImpact(ctx context.Context, cutoff time.Time, sample int) (*pb.Impact, error) {
+	sample = collection.ImpactSample(sample)
+	impact := &pb.Impact{DryRun: true}
+	for _, p := range s.sorted(time.Time{}, time.Time{}) {
+		if p.end.After(cutoff) {
+			continue
+		}
+		count, err := p.store.CountRecords(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count partition %s: %w", p.key, err)
+		}
+		impact.Count += count
+		if missing := sample - len(impact.SampleIds); missing > 0 {
+			records, err := p.store.ListRecords(ctx, 0, missing)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list partition %s: %w", p.key, err)
+			}
+			for _, r := range records {
+				impact.SampleIds = append(impact.SampleIds, r.Id)
+			}
+		}
+	}
+	return impact, nil
+}
+
+func (s *PartitionedStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, p := range s.partitions {
+		if err := p.store.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Path returns the partition directory.
+func (s *PartitionedStore) Path() string { return s.dir }
+
+// StoreOptions returns the options the partitions are opened with.
+func (s *PartitionedStore) StoreOptions() collection.Options {
+	opts := s.opts
+	opts.PartitionPeriod = string(s.period)
+	return opts
+}
+
+// CreateRecord stores r in the partition of its creation time. IDs are
+// unique across partitions: creates are serialized, so one that finds its
+// ID absent inserts before another looks.
+func (s *PartitionedStore) CreateRecord(ctx context.Context, r *pb.CollectionRecord) error {
+	s.createMu.Lock()
+	defer s.createMu.Unlock()
+	if _, _, err := s.locate(ctx, r.Id); err == nil {
+		return fmt.Errorf("record %s already exists", r.Id)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	p, err := s.partitionFor(r.Metadata.CreatedAt.AsTime())
+	if err != nil {
+		return err
+	}
+	return p.store.CreateRecord(ctx, r)
+}
+
+func (s *PartitionedStore) GetRecord(ctx context.Context, id string) (*pb.CollectionRecord, error) {
+	_, record, err := s.locate(ctx, id)
+	return record, err
+}
+
+func (s *PartitionedStore) UpdateRecord(ctx context.Context, r *pb.CollectionRecord) error {
+	p, _, err := s.locate(ctx, r.Id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("record not found")
+	}
+	if err != nil {
+		return err
+	}
+	return p.store.UpdateRecord(ctx, r)
+}
+
+func (s *PartitionedStore) DeleteRecord(ctx context.Context, id string) error {
+	p, _, err := s.locate(ctx, id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return p.store.DeleteRecord(ctx, id)
+}
+
+// ListRecords pages through records newest-first across partitions, skipping
+// whole partitions that fall entirely before the offset.
+func (s *PartitionedStore) ListRecords(ctx context.Context, offset, limit int) ([]*pb.CollectionRecord, error) {
+	var items []*pb.CollectionRecord
+	for _, p := range s.sorted(time.Time{}, time.Time{}) {
+		if limit > 0 && len(items) >= limit {
+			break
+		}
+
+		count, err := p.store.CountRecords(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if int64(offset) >= count {
+			offset -= int(count)
+			continue
+		}
+
+		want := int(count)
+		if limit > 0 {
+			want = limit - len(items)
+		}
+		page, err := p.store.ListRecords(ctx, offset, want)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+		offset = 0
+	}
+	return items, nil
+}
+
+func (s *PartitionedStore) CountRecords(ctx context.Context) (int64, error) {
+	var total int64
+	for _, p := range s.sorted(time.Time{}, time.Time{}) {
+		c, err := p.store.CountRecords(ctx)
+		if err != nil {
+			return 0, err
+		}
+		total += c
+	}
+	return total, nil
+}
+
+// CompressionStats sums the compression stats of every partition. Each
+// partition trains its own dictionary; the newest partition's is reported.
+func (s *PartitionedStore) CompressionStats(ctx context.Context) (*pb.CompressionStats, error) {
+	if s.opts.Compression == nil {
+		return nil, nil
+	}
+	total := &pb.CompressionStats{}
+	for i, p := range s.sorted(time.Time{}, time.Time{}) {
+		stats, err := p.store.CompressionStats(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", p.key, err)
+		}
+		if i == 0 {
+			total.DictionaryId = stats.DictionaryId
+			total.DictionaryBytes = stats.DictionaryBytes
+		}
+		total.Records += stats.Records
+		total.CompressedRecords += stats.CompressedRecords
+		total.RawBytes += stats.RawBytes
+		total.StoredBytes += stats.StoredBytes
+	}
+	if total.StoredBytes > 0 {
+		total.Ratio = float64(total.RawBytes) / float64(total.StoredBytes)
+	}
+	return total, nil
+}
+
+// DeduplicationStats sums the deduplication stats of every partition. Data
+// is shared within a partition, not across partitions.
+func (s *PartitionedStore) DeduplicationStats(ctx context.Context) (*pb.DeduplicationStats, error) {
+	if !s.opts.Deduplicate {
+		return nil, nil
+	}
+	total := &pb.DeduplicationStats{}
+	for _, p := range s.sorted(time.Time{}, time.Time{}) {
+		stats, err := p.store.DeduplicationStats(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", p.key, err)
+		}
+		total.Blobs += stats.Blobs
+		total.References += stats.References
+		total.BlobBytes += stats.BlobBytes
+		total.SavedBytes += stats.SavedBytes
+	}
+	return total, nil
+}
+
+func (s *PartitionedStore) RecordExists(ctx context.Context, id string) (bool, error) {
+	for _, p := range s.sorted(time.Time{}, time.Time{}) {
+		ok, err := p.store.RecordExists(ctx, id)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// CountMatching sums the matching counts of the partitions overlapping the query's
+// creation-time range.
+func (s *PartitionedStore) CountMatching(ctx context.Context, q *collection.SearchQuery) (int64, error) {
+	var total int64
+	for _, p := range s.sorted(q.CreatedAfter, q.CreatedBefore) {
+		c, err := p.store.CountMatching(ctx, q)
+		if err != nil {
+			return 0, fmt.Errorf("partition %s: %w", p.key, err)
+		}
+		total += c
+	}
+	return total, nil
+}
+
+// ScanValues streams target's values from the partitions overlapping the
+// query's creation-time range. PartitionedStore does not implement
+// DistinctCounter, since per-partition distinct counts cannot be summed.
+func (s *PartitionedStore) ScanValues(ctx context.Context, q *collection.SearchQuery, target collection.DistinctTarget, fn func(string) error) error {
+	for _, p := range s.sorted(q.CreatedAfter, q.CreatedBefore) {
+		if err := p.store.ScanValues(ctx, q, target, fn); err != nil {
+			return fmt.Errorf("partition %s: %w", p.key, err)
+		}
+	}
+	return nil
+}
+
+// Search queries only the partitions overlapping the query's creation-time range
+// and merges the results. Each partition is asked for Offset+Limit rows, then the
+// merged list is ordered and paginated.
+func (s *PartitionedStore) Search(ctx context.Context, q *collection.SearchQuery) ([]*collection.SearchResult, error) {
+	perPartition := *q
+	perPartition.Offset = 0
+	if q.Limit > 0 {
+		perPartition.Limit = q.Offset + q.Limit
+	}
+
+	var results []*collection.SearchResult
+	for _, p := range s.sorted(q.CreatedAfter, q.CreatedBefore) {
+		res, err := p.store.Search(ctx, &perPartition)
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", p.key, err)
+		}
+		results = append(results, res...)
+	}
+
+	switch {
+	case q.OrderBy != "":
+		sort.SliceStable(results, func(i, j int) bool {
+			a, b := results[i].Record.ProtoData, results[j].Record.ProtoData
+			if !q.Ascending {
+				a, b = b, a
+			}
+			return lessJSONField(a, b, q.OrderBy)
+		})
+	case q.FullText != "":
+		// bm25 scores are lower for better matches
+		sort.SliceStable(results, func(i, j int) bool { return results[i].Score < results[j].Score })
+	case q.Geo != nil && q.Geo.Radius != nil:
+		sort.SliceStable(results, func(i, j int) bool { return results[i].Distance < results[j].Distance })
+	}
+
+	if q.Offset > 0 {
+		if q.Offset >= len(results) {
+			return nil, nil
+		}
+		results = results[q.Offset:]
+	}
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results, nil
+}
+
+// lessJSONField compares a JSON field path of two payloads, numbers numerically
+// and everything else by its string form.
+func lessJSONField(a, b []byte, field string) bool {
+	var docA, docB interface{}
+	json.Unmarshal(a, &docA)
+	json.Unmarshal(b, &docB)
+
+	path, _ := collection.ParseFieldPath(field)
+	va, vb := path.Lookup(docA), path.Lookup(docB)
+	if fa, ok := va.(float64); ok {
+		if fb, ok := vb.(float64); ok {
+			return fa < fb
+		}
+	}
+	return fmt.Sprintf("%v", va) < fmt.Sprintf("%v", vb)
+}
+
+func (s *PartitionedStore) Checkpoint(ctx context.Context) error {
+	for _, p := range s.sorted(time.Time{}, time.Time{}) {
+		if err := p.store.Checkpoint(ctx); err != nil {
+			return fmt.Errorf("partition %s: %w", p.key, err)
+		}
+	}
+	return nil
+}
+
+func (s *PartitionedStore) ReIndex(ctx context.Context) error {
+	for _, p := range s.sorted(time.Time{}, time.Time{}) {
+		if err := p.store.ReIndex(ctx); err != nil {
+			return fmt.Errorf("partition %s: %w", p.key, err)
+		}
+	}
+	return nil
+}
+
+// Backup merges all partitions into a single unpartitioned SQLite database at destPath,
+// so backups restore like any other collection.
+func (s *PartitionedStore) Backup(ctx context.Context, destPath string) error {
+	dest, err := NewSqliteStore(destPath, s.opts)
+	if err != nil {
+		return fmt.Errorf("failed to create backup database: %w", err)
+	}
+	defer dest.Close()
+
+	// Attachments are per-connection, so merge on a single connection.
+	conn, err := dest.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open backup connection: %w", err)
+	}
+	defer conn.Close()
+
+	tmpDir, err := os.MkdirTemp("", "partition-backup-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, p := range s.sorted(time.Time{}, time.Time{}) {
+		snapshot := filepath.Join(tmpDir, p.key+".db")
+		if err := p.store.Backup(ctx, snapshot); err != nil {
+			return fmt.Errorf("failed to snapshot partition %s: %w", p.key, err)
+		}
+		if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS part", snapshot); err != nil {
+			return fmt.Errorf("failed to attach partition %s: %w", p.key, err)
+		}
+		// Shared blobs go first; inserting the records that refer to them
+		// counts the references
+		_, err := conn.ExecContext(ctx, `INSERT INTO record_blobs (hash, data, encoding)
+			SELECT hash, data, encoding FROM part.record_blobs WHERE refs > 0 ON CONFLICT(hash) DO NOTHING`)
+		if err == nil {
+			_, err = conn.ExecContext(ctx, `INSERT INTO records (id, proto_data, encoding, data_uri, created_at, updated_at, labels, jsontext, checksum, hlc)
+				SELECT id, proto_data, encoding, data_uri, created_at, updated_at, labels, jsontext, checksum, hlc FROM part.records`)
+		}
+		if err == nil {
+			// Compressed records need the dictionaries they were written with
+			_, err = conn.ExecContext(ctx, `INSERT OR IGNORE INTO compression_dictionaries
+				SELECT id, dictionary, created_at FROM part.compression_dictionaries`)
+		}
+		conn.ExecContext(ctx, "DETACH DATABASE part")
+		if err != nil {
+			return fmt.Errorf("failed to merge partition %s: %w", p.key, err)
+		}
+	}
+
+	return nil
+}
+
+// ExecuteRaw runs the statement against every partition.
+func (s *PartitionedStore) ExecuteRaw(query string, args ...interface{}) error {
+	for _, p := range s.sorted(time.Time{}, time.Time{}) {
+		if err := p.store.ExecuteRaw(query, args...); err != nil {
+			return fmt.Errorf("partition %s: %w", p.key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var partitionBase = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// setupPartitionedStore creates a daily-partitioned store with 5 records on each of 3 days.
+func setupPartitionedStore(t *testing.T) (*PartitionedStore, string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "events")
+
+	store, err := NewPartitionedStore(dir, PartitionDaily, collection.Options{EnableJSON: true, EnableFTS: true})
+	if err != nil {
+		t.Fatalf("failed to create partitioned store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	ctx := context.Background()
+	for day := 0; day < 3; day++ {
+		for i := 0; i < 5; i++ {
+			ts := timestamppb.New(partitionBase.AddDate(0, 0, day).Add(time.Duration(i) * time.Minute))
+			record := &pb.CollectionRecord{
+				Id:        fmt.Sprintf("day%d-%d", day, i),
+				ProtoData: []byte(fmt.Sprintf(`{"day": %d, "seq": %d, "msg": "event on day %d"}`, day, i, day)),
+				Metadata:  &pb.Metadata{CreatedAt: ts, UpdatedAt: ts},
+			}
+			if err := store.CreateRecord(ctx, record); err != nil {
+				t.Fatalf("CreateRecord failed: %v", err)
+			}
+		}
+	}
+	return store, dir
+}
+
+func TestPartitionedStore_RoutesByCreatedAt(t *testing.T) {
+	store, _ := setupPartitionedStore(t)
+	ctx := context.Background()
+
+	parts := store.Partitions()
+	want := []string{"20240303", "20240302", "20240301"}
+	if fmt.Sprint(parts) != fmt.Sprint(want) {
+		t.Errorf("expected partitions %v, got %v", want, parts)
+	}
+
+	count, err := store.CountRecords(ctx)
+	if err != nil || count != 15 {
+		t.Fatalf("expected 15 records, got %d (%v)", count, err)
+	}
+
+	record, err := store.GetRecord(ctx, "day0-3")
+	if err != nil {
+		t.Fatalf("GetRecord failed: %v", err)
+	}
+	record.ProtoData = []byte(`{"day": 0, "updated": true}`)
+	if err := store.UpdateRecord(ctx, record); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if err := store.DeleteRecord(ctx, "day1-0"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if err := store.CreateRecord(ctx, record); err == nil {
+		t.Error("expected duplicate id across partitions to be rejected")
+	}
+
+	// Pagination spans partitions newest-first
+	page, err := store.ListRecords(ctx, 3, 5)
+	if err != nil {
+		t.Fatalf("ListRecords failed: %v", err)
+	}
+	if len(page) != 5 || page[0].Id != "day2-1" || page[2].Id != "day1-4" {
+		ids := make([]string, len(page))
+		for i, r := range page {
+			ids[i] = r.Id
+		}
+		t.Errorf("unexpected page: %v", ids)
+	}
+}
+
+func TestPartitionedStore_SearchPrunesPartitions(t *testing.T) {
+	store, dir := setupPartitionedStore(t)
+	ctx := context.Background()
+
+	// Corrupt the day-0 partition: a pruned search must never touch it
+	store.partitions["20240301"].store.Close()
+	if err := os.WriteFile(filepath.Join(dir, "p_20240301.db"), []byte("garbage"), 0644); err != nil {
+		t.Fatalf("failed to corrupt partition: %v", err)
+	}
+
+	results, err := store.Search(ctx, &collection.SearchQuery{
+		CreatedAfter: partitionBase.AddDate(0, 0, 1).Truncate(24 * time.Hour),
+		OrderBy:      "seq",
+		Ascending:    true,
+	})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(results) != 10 {
+		t.Fatalf("expected 10 results from days 1-2, got %d", len(results))
+	}
+
+	count, err := store.CountMatching(ctx, &collection.SearchQuery{
+		Filters:      map[string]collection.Filter{"seq": {Operator: collection.OpLessThan, Value: 2}},
+		CreatedAfter: partitionBase.AddDate(0, 0, 1).Truncate(24 * time.Hour),
+	})
+	if err != nil || count != 4 {
+		t.Errorf("expected 4 matches from days 1-2, got %d (%v)", count, err)
+	}
+
+	results, err = store.Search(ctx, &collection.SearchQuery{
+		FullText:      "event",
+		CreatedAfter:  partitionBase.AddDate(0, 0, 2).Truncate(24 * time.Hour),
+		CreatedBefore: partitionBase.AddDate(0, 0, 2).Add(2 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Errorf("expected 2 results within the range, got %d", len(results))
+	}
+}
+
+func TestPartitionedStore_CardinalitySpansPartitions(t *testing.T) {
+	store, _ := setupPartitionedStore(t)
+	ctx := context.Background()
+
+	// seq repeats 0-4 in every partition; summing per-partition counts would give 15
+	got, err := collection.Cardinality(ctx, store, &collection.SearchQuery{}, collection.DistinctTarget{Field: "seq"}, 0)
+	if err != nil {
+		t.Fatalf("Cardinality failed: %v", err)
+	}
+	if got.Count != 5 || got.Approximate {
+		t.Errorf("expected exactly 5 distinct seq values, got %+v", got)
+	}
+
+	got, err = collection.Cardinality(ctx, store, &collection.SearchQuery{
+		CreatedAfter: partitionBase.AddDate(0, 0, 1).Truncate(24 * time.Hour),
+	}, collection.DistinctTarget{Field: "day"}, 0)
+	if err != nil || got.Count != 2 {
+		t.Errorf("expected 2 days after pruning, got %+v (%v)", got, err)
+	}
+}
+
+func TestPartitionedStore_DropAndReopen(t *testing.T) {
+	store, dir := setupPartitionedStore(t)
+	ctx := context.Background()
+
+	impact, err := store.DropPartitionsBeforeImpact(ctx, partitionBase.AddDate(0, 0, 2).Truncate(24*time.Hour), 3)
+	if err != nil {
+		t.Fatalf("DropPartitionsBeforeImpact failed: %v", err)
+	}
+	if impact.Count != 10 || len(impact.SampleIds) != 3 || len(store.Partitions()) != 3 {
+		t.Errorf("expected a dry run over 10 records leaving 3 partitions, got %v", impact)
+	}
+
+	dropped, err := store.DropPartitionsBefore(ctx, partitionBase.AddDate(0, 0, 2).Truncate(24*time.Hour))
+	if err != nil {
+		t.Fatalf("DropPartitionsBefore failed: %v", err)
+	}
+	if fmt.Sprint(dropped) != "[20240301 20240302]" {
+		t.Errorf("unexpected dropped partitions: %v", dropped)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "p_20240301.db")); !os.IsNotExist(err) {
+		t.Errorf("expected partition file to be removed")
+	}
+	store.Close()
+
+	reopened, err := NewPartitionedStore(dir, PartitionDaily, collection.Options{EnableJSON: true, EnableFTS: true})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer reopened.Close()
+
+	count, err := reopened.CountRecords(ctx)
+	if err != nil || count != 5 {
+		t.Errorf("expected 5 records after retention, got %d (%v)", count, err)
+	}
+}
+
+func TestPartitionedStore_BackupMergesPartitions(t *testing.T) {
+	store, _ := setupPartitionedStore(t)
+	ctx := context.Background()
+
+	backupPath := filepath.Join(t.TempDir(), "backup.db")
+	if err := store.Backup(ctx, backupPath); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	backup, err := NewSqliteStore(backupPath, collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to open backup: %v", err)
+	}
+	defer backup.Close()
+
+	count, err := backup.CountRecords(ctx)
+	if err != nil || count != 15 {
+		t.Errorf("expected 15 records in merged backup, got %d (%v)", count, err)
+	}
+}
+
+func TestPartitionedStore_ConcurrentCreatesKeepIDsUnique(t *testing.T) {
+	store, err := NewPartitionedStore(filepath.Join(t.TempDir(), "events"), PartitionDaily, collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create partitioned store: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	// Creates of one ID, each dated to a different partition, race to find
+	// it absent; only one of each may land
+	const ids, writers = 20, 16
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	start := make(chan struct{})
+	for id := 0; id < ids; id++ {
+		for day := 0; day < writers; day++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				ts := timestamppb.New(partitionBase.AddDate(0, 0, day))
+				err := store.CreateRecord(ctx, &pb.CollectionRecord{
+					Id:        fmt.Sprintf("dup%d", id),
+					ProtoData: []byte(fmt.Sprintf(`{"day": %d}`, day)),
+					Metadata:  &pb.Metadata{CreatedAt: ts, UpdatedAt: ts},
+				})
+				if err == nil {
+					created.Add(1)
+				}
+			}()
+		}
+	}
+	close(start)
+	wg.Wait()
+
+	if n := created.Load(); n != ids {
+		t.Errorf("expected one create of each of %d IDs to succeed, got %d", ids, n)
+	}
+	if count, err := store.CountRecords(ctx); err != nil || count != ids {
+		t.Errorf("expected %d records across partitions, got %d (%v)", ids, count, err)
+	}
+}
@@ -0,0 +1,248 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// queueSchema stores the messages of every queue collection. A live message
+// is deliverable once visible_at (unix milliseconds) passes; delivering it
+// pushes visible_at out by the visibility timeout and sets the receipt that
+// acks or nacks that delivery. The index serves Dequeue's scan for the
+// oldest visible live messages of a queue.
+const queueSchema = `
+CREATE TABLE IF NOT EXISTS queue_messages (
+    queue TEXT NOT NULL,
+    id TEXT NOT NULL,
+    type_url TEXT NOT NULL DEFAULT '',
+    payload BLOB,
+    state INTEGER NOT NULL DEFAULT 0,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    receipt TEXT,
+    enqueued_at INTEGER NOT NULL,
+    visible_at INTEGER NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (queue, id)
+);
+CREATE INDEX IF NOT EXISTS queue_messages_visible ON queue_messages(queue, state, visible_at);
+`
+
+// Message states.
+const (
+	queueLive = 0
+	queueDead = 1
+)
+
+const queueColumns = `id, type_url, payload, attempts, coalesce(receipt, ''), enqueued_at, visible_at, last_error`
+
+func scanQueueMessages(rows *sql.Rows) ([]*pb.QueueMessage, error) {
+	defer rows.Close()
+	var msgs []*pb.QueueMessage
+	for rows.Next() {
+		var (
+			msg                   pb.QueueMessage
+			item                  anypb.Any
+			enqueuedAt, visibleAt int64
+		)
+		if err := rows.Scan(&msg.Id, &item.TypeUrl, &item.Value, &msg.Attempts, &msg.Receipt, &enqueuedAt, &visibleAt, &msg.LastError); err != nil {
+			return nil, fmt.Errorf("failed to scan queue message: %w", err)
+		}
+		msg.Item = &item
+		msg.EnqueuedAt = timestamppb.New(time.UnixMilli(enqueuedAt))
+		msg.VisibleAt = timestamppb.New(time.UnixMilli(visibleAt))
+		msgs = append(msgs, &msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan queue messages: %w", err)
+	}
+	return msgs, nil
+}
+
+// Enqueue adds messages to a queue in one transaction.
+func (s *SqliteStore) Enqueue(ctx context.Context, queue string, msgs []*pb.QueueMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, msg := range msgs {
+		_, err := tx.ExecContext(ctx, `INSERT INTO queue_messages (queue, id, type_url, payload, enqueued_at, visible_at)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			queue, msg.Id, msg.Item.GetTypeUrl(), msg.Item.GetValue(),
+			msg.EnqueuedAt.AsTime().UnixMilli(), msg.VisibleAt.AsTime().UnixMilli())
+		if err != nil {
+			return fmt.Errorf("failed to enqueue message %s: %w", msg.Id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Dequeue dead-letters visible messages that have used up their attempts,
+// then delivers the oldest visible ones.
+func (s *SqliteStore) Dequeue(ctx context.Context, queue string, max int, visibility time.Duration, maxAttempts int) ([]*pb.QueueMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE queue_messages SET state = ?, receipt = NULL
+		WHERE queue = ? AND state = ? AND visible_at <= ? AND attempts >= ?`,
+		queueDead, queue, queueLive, now.UnixMilli(), maxAttempts); err != nil {
+		return nil, fmt.Errorf("failed to dead-letter messages: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT `+queueColumns+` FROM queue_messages
+		WHERE queue = ? AND state = ? AND visible_at <= ? ORDER BY visible_at, rowid LIMIT ?`,
+		queue, queueLive, now.UnixMilli(), max)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select messages: %w", err)
+	}
+	msgs, err := scanQueueMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	visibleAt := now.Add(visibility)
+	for _, msg := range msgs {
+		msg.Attempts++
+		msg.Receipt = uuid.New().String()
+		msg.VisibleAt = timestamppb.New(visibleAt)
+		if _, err := tx.ExecContext(ctx, `UPDATE queue_messages SET attempts = ?, receipt = ?, visible_at = ?
+			WHERE queue = ? AND id = ?`, msg.Attempts, msg.Receipt, visibleAt.UnixMilli(), queue, msg.Id); err != nil {
+			return nil, fmt.Errorf("failed to deliver message %s: %w", msg.Id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit delivery: %w", err)
+	}
+	return msgs, nil
+}
+
+// Ack deletes a delivered message.
+func (s *SqliteStore) Ack(ctx context.Context, queue, id, receipt string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM queue_messages WHERE queue = ? AND id = ? AND state = ? AND receipt = ?`,
+		queue, id, queueLive, receipt)
+	if err != nil {
+		return fmt.Errorf("failed to ack message %s: %w", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return collection.ErrInvalidReceipt
+	}
+	return nil
+}
+
+// Nack makes a delivered message visible after delay, or dead-letters it.
+func (s *SqliteStore) Nack(ctx context.Context, queue, id, receipt string, delay time.Duration, reason string, maxAttempts int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var attempts int
+	err = tx.QueryRowContext(ctx, `SELECT attempts FROM queue_messages WHERE queue = ? AND id = ? AND state = ? AND receipt = ?`,
+		queue, id, queueLive, receipt).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return false, collection.ErrInvalidReceipt
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read message %s: %w", id, err)
+	}
+
+	dead := attempts >= maxAttempts
+	if dead {
+		_, err = tx.ExecContext(ctx, `UPDATE queue_messages SET state = ?, receipt = NULL, last_error = ? WHERE queue = ? AND id = ?`,
+			queueDead, reason, queue, id)
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE queue_messages SET visible_at = ?, receipt = NULL, last_error = ? WHERE queue = ? AND id = ?`,
+			time.Now().Add(delay).UnixMilli(), reason, queue, id)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to nack message %s: %w", id, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit nack: %w", err)
+	}
+	return dead, nil
+}
+
+// QueueStats counts a queue's messages by state. Messages whose visibility
+// timeout has passed count as ready.
+func (s *SqliteStore) QueueStats(ctx context.Context, queue string) (*pb.QueueStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixMilli()
+	stats := &pb.QueueStats{}
+	err := s.db.QueryRowContext(ctx, `SELECT
+			coalesce(sum(state = ? AND visible_at <= ?), 0),
+			coalesce(sum(state = ? AND visible_at > ? AND receipt IS NOT NULL), 0),
+			coalesce(sum(state = ? AND visible_at > ? AND receipt IS NULL), 0),
+			coalesce(sum(state = ?), 0)
+		FROM queue_messages WHERE queue = ?`,
+		queueLive, now, queueLive, now, queueLive, now, queueDead, queue,
+	).Scan(&stats.Ready, &stats.InFlight, &stats.Delayed, &stats.Dead)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count queue messages: %w", err)
+	}
+	return stats, nil
+}
+
+// DeadLetters returns a queue's dead-lettered messages in enqueue order.
+func (s *SqliteStore) DeadLetters(ctx context.Context, queue string, limit int) ([]*pb.QueueMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+queueColumns+` FROM queue_messages
+		WHERE queue = ? AND state = ? ORDER BY rowid LIMIT ?`, queue, queueDead, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	return scanQueueMessages(rows)
+}
+
+// RedriveDeadLetters makes dead-lettered messages deliverable now with their
+// attempts reset.
+func (s *SqliteStore) RedriveDeadLetters(ctx context.Context, queue string, ids []string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := `UPDATE queue_messages SET state = ?, attempts = 0, receipt = NULL, visible_at = ?
+		WHERE queue = ? AND state = ?`
+	args := []any{queueLive, time.Now().UnixMilli(), queue, queueDead}
+	if len(ids) > 0 {
+		query += ` AND id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)`
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to redrive dead letters: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,168 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// similaritySchema stores each record's SimHash fingerprint split into four
+// 16-bit bands. Fingerprints within 3 bits of each other agree on at least
+// one band, so near-duplicates are found through the band indexes without
+// scanning every fingerprint.
+const similaritySchema = `
+CREATE TABLE IF NOT EXISTS records_simhash (
+    id TEXT PRIMARY KEY,
+    hash INTEGER NOT NULL,
+    band0 INTEGER NOT NULL,
+    band1 INTEGER NOT NULL,
+    band2 INTEGER NOT NULL,
+    band3 INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS records_simhash_band0 ON records_simhash(band0);
+CREATE INDEX IF NOT EXISTS records_simhash_band1 ON records_simhash(band1);
+CREATE INDEX IF NOT EXISTS records_simhash_band2 ON records_simhash(band2);
+CREATE INDEX IF NOT EXISTS records_simhash_band3 ON records_simhash(band3);
+CREATE TRIGGER IF NOT EXISTS records_simhash_ad AFTER DELETE ON records BEGIN
+    DELETE FROM records_simhash WHERE id = old.id;
+END;
+`
+
+// bandedDistance is the largest distance the band indexes answer; larger
+// distances scan every fingerprint.
+const bandedDistance = 3
+
+func bands(hash uint64) [4]int64 {
+	return [4]int64{int64(hash & 0xffff), int64(hash >> 16 & 0xffff), int64(hash >> 32 & 0xffff), int64(hash >> 48)}
+}
+
+// indexSimilarity stores the fingerprint of a record's data. Callers hold
+// s.mu for writing.
+func (s *SqliteStore) indexSimilarity(ctx context.Context, exec execer, id string, data []byte) error {
+	if !s.options.EnableSimilarity {
+		return nil
+	}
+	hash := collection.SimHash(data)
+	b := bands(hash)
+	_, err := exec.ExecContext(ctx, `INSERT OR REPLACE INTO records_simhash (id, hash, band0, band1, band2, band3)
+		VALUES (?, ?, ?, ?, ?, ?)`, id, int64(hash), b[0], b[1], b[2], b[3])
+	if err != nil {
+		return fmt.Errorf("failed to index record %s for similarity: %w", id, err)
+	}
+	return nil
+}
+
+// backfillSimilarity fingerprints records written before the index was
+// enabled.
+func (s *SqliteStore) backfillSimilarity(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, `+storedData("")+` FROM records
+		WHERE id NOT IN (SELECT id FROM records_simhash)`)
+	if err != nil {
+		return fmt.Errorf("failed to scan records: %w", err)
+	}
+	type pending struct {
+		id       string
+		data     []byte
+		encoding int64
+	}
+	var missing []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.data, &p.encoding); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan records: %w", err)
+		}
+		missing = append(missing, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to scan records: %w", err)
+	}
+
+	for _, p := range missing {
+		data, err := s.codec.decode(p.data, p.encoding)
+		if err != nil {
+			return err
+		}
+		if err := s.indexSimilarity(ctx, s.db, p.id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindSimilar returns up to limit records, other than id, whose fingerprints
+// are within maxDistance bits of id's, closest first.
+func (s *SqliteStore) FindSimilar(ctx context.Context, id string, maxDistance, limit int) ([]*collection.SimilarRecord, error) {
+	if !s.options.EnableSimilarity {
+		return nil, collection.ErrSimilarityUnavailable
+	}
+	matches, err := s.similarIDs(ctx, id, maxDistance)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	for _, m := range matches {
+		id := m.Record.Id
+		if m.Record, err = s.GetRecord(ctx, id); err != nil {
+			return nil, fmt.Errorf("failed to read similar record %s: %w", id, err)
+		}
+	}
+	return matches, nil
+}
+
+// similarIDs returns the records within maxDistance of id, closest first,
+// with only their IDs set.
+func (s *SqliteStore) similarIDs(ctx context.Context, id string, maxDistance int) ([]*collection.SimilarRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var stored int64
+	if err := s.db.QueryRowContext(ctx, "SELECT hash FROM records_simhash WHERE id = ?", id).Scan(&stored); err != nil {
+		return nil, err
+	}
+	hash := uint64(stored)
+
+	query := "SELECT id, hash FROM records_simhash WHERE id != ?"
+	args := []any{id}
+	if maxDistance <= bandedDistance {
+		b := bands(hash)
+		query += " AND (band0 = ? OR band1 = ? OR band2 = ? OR band3 = ?)"
+		args = append(args, b[0], b[1], b[2], b[3])
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fingerprints: %w", err)
+	}
+	defer rows.Close()
+
+	var matches []*collection.SimilarRecord
+	for rows.Next() {
+		var (
+			other string
+			h     int64
+		)
+		if err := rows.Scan(&other, &h); err != nil {
+			return nil, fmt.Errorf("failed to query fingerprints: %w", err)
+		}
+		if d := collection.HammingDistance(hash, uint64(h)); d <= maxDistance {
+			matches = append(matches, &collection.SimilarRecord{Record: &pb.CollectionRecord{Id: other}, Distance: d})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query fingerprints: %w", err)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Record.Id < matches[j].Record.Id
+	})
+	return matches, nil
+}
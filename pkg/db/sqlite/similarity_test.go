@@ -0,0 +1,57 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestSimilarity_BackfillAndBands(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "pages.db")
+
+	// Records written before the index is enabled are fingerprinted on open
+	store, err := NewSqliteStore(path, collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if err := store.CreateRecord(ctx, page(id, "the quick brown fox jumps over the lazy dog", historyBase)); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+	if _, err := store.FindSimilar(ctx, "a", 3, 10); err != collection.ErrSimilarityUnavailable {
+		t.Errorf("expected ErrSimilarityUnavailable, got %v", err)
+	}
+	store.Close()
+
+	store, err = NewSqliteStore(path, collection.Options{EnableJSON: true, EnableSimilarity: true})
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if err := store.CreateRecord(ctx, page("c", "an entirely different page about gardening tools", historyBase)); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	similar, err := store.FindSimilar(ctx, "a", 3, 10)
+	if err != nil {
+		t.Fatalf("FindSimilar failed: %v", err)
+	}
+	if len(similar) != 1 || similar[0].Record.Id != "b" || similar[0].Distance != 0 {
+		t.Fatalf("expected only b, got %+v", similar)
+	}
+	if string(similar[0].Record.ProtoData) != string(page("b", "the quick brown fox jumps over the lazy dog", historyBase).ProtoData) {
+		t.Errorf("expected b's data, got %s", similar[0].Record.ProtoData)
+	}
+
+	if err := store.DeleteRecord(ctx, "b"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	var n int
+	if err := store.db.QueryRow("SELECT count(*) FROM records_simhash").Scan(&n); err != nil || n != 2 {
+		t.Errorf("expected the deleted record's fingerprint to be dropped, got %d (%v)", n, err)
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
+	"time"
 
 	pb "github.com/accretional/collector/gen/collector"
 	"github.com/accretional/collector/pkg/collection"
@@ -16,16 +18,51 @@ import (
 )
 
 type SqliteStore struct {
-	db      *sql.DB
-	path    string
-	options collection.Options
-	mu      sync.RWMutex
+	db       *sql.DB
+	path     string
+	options  collection.Options
+	geo      *geoFields // nil unless options.Geo is set
+	codec    *recordCodec
+	expander *collection.QueryExpander // nil without synonyms or stopwords
+	mu       sync.RWMutex
+
+	functions map[string]collection.SQLFunction // Custom functions for filters
+	udfToken  int64                             // Identifies the store to its functions
+}
+
+// ftsContent is the indexed text of the records row named by alias: its JSON
+// plus any text extracted from its attachments.
+func ftsContent(alias string) string {
+	return fmt.Sprintf(`coalesce(%[1]s.jsontext, '') || coalesce((SELECT ' ' || group_concat(a.text, ' ') FROM attachments a WHERE a.record_id = %[1]s.id), '')`, alias)
 }
 
 // NewSqliteStore initializes the database and applies schemas.
 func NewSqliteStore(path string, opts collection.Options) (*SqliteStore, error) {
 	// WAL mode + busy_timeout are critical for concurrent access.
-	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=10000", path)
+	return openStore(fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=10000", path), path, opts)
+}
+
+// NewMemoryStore creates a store whose database lives in memory, shared by
+// the store's connections, until the store is closed. Names must be unique
+// among the memory stores open in the process.
+func NewMemoryStore(name string, opts collection.Options) (*SqliteStore, error) {
+	return openStore(fmt.Sprintf("file:/%s?vfs=memdb&_busy_timeout=10000", name), "", opts)
+}
+
+func openStore(dsn, path string, opts collection.Options) (*SqliteStore, error) {
+	language, err := collection.ParseLanguage(string(opts.Language))
+	if err != nil {
+		return nil, err
+	}
+	opts.Language = language
+	functions, err := opts.SQLFunctions()
+	if err != nil {
+		return nil, err
+	}
+	if err := registerTrampolines(functions); err != nil {
+		return nil, err
+	}
+
 	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open db: %w", err)
@@ -48,6 +85,48 @@ func NewSqliteStore(path string, opts collection.Options) (*SqliteStore, error)
 		db.Close()
 		return nil, fmt.Errorf("default schema failed: %w", err)
 	}
+	if _, err := db.Exec(collection.AttachmentSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("attachment schema failed: %w", err)
+	}
+	if _, err := db.Exec(collection.ProvenanceSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("provenance schema failed: %w", err)
+	}
+	if _, err := db.Exec(collection.ChecksumSchema); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		db.Close()
+		return nil, fmt.Errorf("checksum schema failed: %w", err)
+	}
+	if _, err := db.Exec(collection.HLCSchema); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		db.Close()
+		return nil, fmt.Errorf("hlc schema failed: %w", err)
+	}
+	if _, err := db.Exec(collection.EncodingSchema); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		db.Close()
+		return nil, fmt.Errorf("encoding schema failed: %w", err)
+	}
+	if _, err := db.Exec(collection.CompressionSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("compression schema failed: %w", err)
+	}
+	if _, err := db.Exec(blobSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("blob schema failed: %w", err)
+	}
+	if _, err := db.Exec(queueSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("queue schema failed: %w", err)
+	}
+	if _, err := db.Exec(outboxSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("outbox schema failed: %w", err)
+	}
+	if opts.EnableSimilarity {
+		if _, err := db.Exec(similaritySchema); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("similarity schema failed: %w", err)
+		}
+	}
 
 	if opts.EnableJSON {
 		if _, err := db.Exec(collection.JSONSchema); err != nil {
@@ -56,54 +135,94 @@ func NewSqliteStore(path string, opts collection.Options) (*SqliteStore, error)
 	}
 
 	if opts.EnableFTS {
-		tx, err := db.Begin()
-		if err != nil {
+		if err := applyFTSSchema(db, opts.Language); err != nil {
 			db.Close()
-			return nil, fmt.Errorf("begin fts transaction: %w", err)
+			return nil, err
 		}
+	}
 
-		if _, err := tx.Exec(collection.FTSSchema); err != nil {
-			tx.Rollback()
+	if opts.WriteOnce {
+		if _, err := db.Exec(collection.WriteOnceSchema); err != nil {
 			db.Close()
-			return nil, fmt.Errorf("fts schema failed: %w", err)
-		}
-
-		triggers := `
-		CREATE TRIGGER IF NOT EXISTS records_ai AFTER INSERT ON records BEGIN
-			INSERT INTO records_fts(rowid, content) VALUES (new.rowid, new.jsontext);
-		END;
-		CREATE TRIGGER IF NOT EXISTS records_ad AFTER DELETE ON records BEGIN
-			DELETE FROM records_fts WHERE rowid=old.rowid;
-		END;
-		CREATE TRIGGER IF NOT EXISTS records_au AFTER UPDATE ON records BEGIN
-			DELETE FROM records_fts WHERE rowid=old.rowid;
-			INSERT INTO records_fts(rowid, content) VALUES (new.rowid, new.jsontext);
-		END;
-		`
-		if _, err := tx.Exec(triggers); err != nil {
-			tx.Rollback()
+			return nil, fmt.Errorf("write-once schema failed: %w", err)
+		}
+	}
+
+	if opts.EnableHistory {
+		if _, err := db.Exec(collection.HistorySchema); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("history schema failed: %w", err)
+		}
+		if _, err := db.Exec(blobHistorySchema); err != nil {
 			db.Close()
-			return nil, fmt.Errorf("fts triggers failed: %w", err)
+			return nil, fmt.Errorf("blob history schema failed: %w", err)
 		}
+	}
 
-		if err := tx.Commit(); err != nil {
+	var geo *geoFields
+	if opts.Geo != nil {
+		if !opts.EnableJSON {
 			db.Close()
-			return nil, fmt.Errorf("commit fts transaction: %w", err)
+			return nil, fmt.Errorf("geo index requires EnableJSON")
+		}
+		if geo, err = newGeoFields(opts.Geo); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err := applyGeoSchema(db, geo); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("geo schema failed: %w", err)
 		}
 	}
 
-	return &SqliteStore{db: db, path: path, options: opts}, nil
+	codec, err := newRecordCodec(db, opts.Compression)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &SqliteStore{
+		db:       db,
+		path:     path,
+		options:  opts,
+		geo:      geo,
+		codec:    codec,
+		expander: collection.NewQueryExpander(opts.Synonyms, opts.Stopwords),
+
+		functions: functions,
+		udfToken:  storeFunctions(functions),
+	}
+	if opts.EnableSimilarity {
+		if err := store.backfillSimilarity(context.Background()); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	return store, nil
 }
 
-func (s *SqliteStore) Close() error { return s.db.Close() }
+func (s *SqliteStore) Close() error {
+	forgetFunctions(s.udfToken)
+	s.codec.close()
+	return s.db.Close()
+}
 func (s *SqliteStore) Path() string { return s.path }
 
 func (s *SqliteStore) CreateRecord(ctx context.Context, r *pb.CollectionRecord) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	query := `INSERT INTO records (id, proto_data, data_uri, created_at, updated_at, labels, jsontext) 
-              VALUES (?, ?, ?, ?, ?, ?, ?)`
+	if err := s.insertRecord(ctx, s.db, r); err != nil {
+		return err
+	}
+	s.maybeTrainCompression(ctx)
+	return nil
+}
+
+// insertRecord inserts r through exec. Callers hold s.mu for writing.
+func (s *SqliteStore) insertRecord(ctx context.Context, exec execer, r *pb.CollectionRecord) error {
+	query := `INSERT INTO records (id, proto_data, encoding, data_uri, created_at, updated_at, labels, jsontext, checksum, hlc) 
+              VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 	labelsJSON, _ := json.Marshal(r.Metadata.Labels)
 
@@ -114,16 +233,101 @@ func (s *SqliteStore) CreateRecord(ctx context.Context, r *pb.CollectionRecord)
 	} else {
 		jsonText = "{}"
 	}
+	protoData, encoding, err := s.encodeData(ctx, exec, r.ProtoData)
+	if err != nil {
+		return err
+	}
 
-	_, err := s.db.ExecContext(ctx, query,
+	_, err = exec.ExecContext(ctx, query,
 		r.Id,
-		r.ProtoData,
+		protoData,
+		encoding,
 		r.DataUri,
 		r.Metadata.CreatedAt.Seconds,
 		r.Metadata.UpdatedAt.Seconds,
 		string(labelsJSON),
 		jsonText,
+		r.Metadata.Checksum,
+		r.Metadata.Hlc,
 	)
+	if err != nil {
+		return recordExists(err, r.Id)
+	}
+	return s.indexSimilarity(ctx, exec, r.Id, r.ProtoData)
+}
+
+// CreateRecords inserts a batch of records in a single transaction.
+// Either all records are written or none are.
+func (s *SqliteStore) CreateRecords(ctx context.Context, records []*pb.CollectionRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin batch: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO records (id, proto_data, encoding, data_uri, created_at, updated_at, labels, jsontext, checksum, hlc) 
+              VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("prepare batch insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		labelsJSON, _ := json.Marshal(r.Metadata.Labels)
+
+		jsonText := "{}"
+		if json.Valid(r.ProtoData) {
+			jsonText = string(r.ProtoData)
+		}
+		protoData, encoding, err := s.encodeData(ctx, tx, r.ProtoData)
+		if err != nil {
+			return fmt.Errorf("encode record %s: %w", r.Id, err)
+		}
+
+		if _, err := stmt.ExecContext(ctx,
+			r.Id,
+			protoData,
+			encoding,
+			r.DataUri,
+			r.Metadata.CreatedAt.Seconds,
+			r.Metadata.UpdatedAt.Seconds,
+			string(labelsJSON),
+			jsonText,
+			r.Metadata.Checksum,
+			r.Metadata.Hlc,
+		); err != nil {
+			return fmt.Errorf("insert record %s: %w", r.Id, recordExists(err, r.Id))
+		}
+		if err := s.indexSimilarity(ctx, tx, r.Id, r.ProtoData); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.maybeTrainCompression(ctx)
+	return nil
+}
+
+// recordExists reports an insert that hit the records primary key as
+// collection.ErrRecordExists.
+func recordExists(err error, id string) error {
+	if strings.Contains(err.Error(), "UNIQUE constraint failed: records.id") {
+		return fmt.Errorf("%w: %s", collection.ErrRecordExists, id)
+	}
+	return err
+}
+
+// recordSealed reports a write the write-once triggers refused as
+// collection.ErrRecordSealed.
+func recordSealed(err error, id string) error {
+	if strings.Contains(err.Error(), "records are sealed") {
+		return fmt.Errorf("%w: %s", collection.ErrRecordSealed, id)
+	}
 	return err
 }
 
@@ -133,18 +337,24 @@ func (s *SqliteStore) GetRecord(ctx context.Context, id string) (*pb.CollectionR
 
 	var (
 		protoData            []byte
+		encoding             int64
 		dataUri              sql.NullString
 		createdAt, updatedAt int64
 		labelsJSON           string
+		checksum             sql.NullString
+		hlc                  sql.NullInt64
 	)
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT proto_data, data_uri, created_at, updated_at, labels
-		FROM records WHERE id = ?`, id).Scan(&protoData, &dataUri, &createdAt, &updatedAt, &labelsJSON)
+		SELECT `+storedData("")+`, data_uri, created_at, updated_at, labels, checksum, hlc
+		FROM records WHERE id = ?`, id).Scan(&protoData, &encoding, &dataUri, &createdAt, &updatedAt, &labelsJSON, &checksum, &hlc)
 
 	if err != nil {
 		return nil, err
 	}
+	if protoData, err = s.codec.decode(protoData, encoding); err != nil {
+		return nil, err
+	}
 
 	r := &pb.CollectionRecord{
 		Id:        id,
@@ -152,6 +362,8 @@ func (s *SqliteStore) GetRecord(ctx context.Context, id string) (*pb.CollectionR
 		Metadata: &pb.Metadata{
 			CreatedAt: &timestamppb.Timestamp{Seconds: createdAt},
 			UpdatedAt: &timestamppb.Timestamp{Seconds: updatedAt},
+			Checksum:  checksum.String,
+			Hlc:       hlc.Int64,
 		},
 	}
 	if dataUri.Valid {
@@ -174,7 +386,18 @@ func (s *SqliteStore) UpdateRecord(ctx context.Context, r *pb.CollectionRecord)
 	}
 	defer tx.Rollback()
 
-	query := `UPDATE records SET proto_data=?, updated_at=?, labels=?, jsontext=? WHERE id=?`
+	if err := s.updateRecord(ctx, tx, r); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.collectBlobs(ctx)
+}
+
+// updateRecord updates r in tx. Callers hold s.mu for writing.
+func (s *SqliteStore) updateRecord(ctx context.Context, tx *sql.Tx, r *pb.CollectionRecord) error {
+	query := `UPDATE records SET proto_data=?, encoding=?, updated_at=?, labels=?, jsontext=?, checksum=?, hlc=? WHERE id=?`
 	labelsJSON, _ := json.Marshal(r.Metadata.Labels)
 
 	var jsonText string
@@ -183,39 +406,47 @@ func (s *SqliteStore) UpdateRecord(ctx context.Context, r *pb.CollectionRecord)
 	} else {
 		return fmt.Errorf("invalid JSON")
 	}
+	protoData, encoding, err := s.encodeData(ctx, tx, r.ProtoData)
+	if err != nil {
+		return err
+	}
 
 	res, err := tx.ExecContext(ctx, query,
-		r.ProtoData,
+		protoData,
+		encoding,
 		r.Metadata.UpdatedAt.Seconds,
 		string(labelsJSON),
 		jsonText,
+		r.Metadata.Checksum,
+		r.Metadata.Hlc,
 		r.Id,
 	)
 	if err != nil {
-		return err
+		return recordSealed(err, r.Id)
 	}
 
 	rows, _ := res.RowsAffected()
 	if rows == 0 {
 		return fmt.Errorf("record not found")
 	}
-
-	return tx.Commit()
+	return s.indexSimilarity(ctx, tx, r.Id, r.ProtoData)
 }
 
 func (s *SqliteStore) DeleteRecord(ctx context.Context, id string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	_, err := s.db.ExecContext(ctx, "DELETE FROM records WHERE id=?", id)
-	return err
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM records WHERE id=?", id); err != nil {
+		return recordSealed(err, id)
+	}
+	return s.collectBlobs(ctx)
 }
 
 func (s *SqliteStore) ListRecords(ctx context.Context, offset, limit int) ([]*pb.CollectionRecord, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	rows, err := s.db.QueryContext(ctx, `SELECT id, proto_data, data_uri, created_at, updated_at, labels FROM records ORDER BY created_at DESC LIMIT ? OFFSET ?`, limit, offset)
+	rows, err := s.db.QueryContext(ctx, `SELECT id, `+storedData("")+`, data_uri, created_at, updated_at, labels, checksum, hlc FROM records ORDER BY created_at DESC LIMIT ? OFFSET ?`, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -225,16 +456,26 @@ func (s *SqliteStore) ListRecords(ctx context.Context, offset, limit int) ([]*pb
 	for rows.Next() {
 		var (
 			r                pb.CollectionRecord
+			encoding         int64
 			dUri             sql.NullString
 			created, updated int64
 			lJSON            string
+			checksum         sql.NullString
+			hlc              sql.NullInt64
 		)
 
-		rows.Scan(&r.Id, &r.ProtoData, &dUri, &created, &updated, &lJSON)
+		rows.Scan(&r.Id, &r.ProtoData, &encoding, &dUri, &created, &updated, &lJSON, &checksum, &hlc)
+		data, err := s.codec.decode(r.ProtoData, encoding)
+		if err != nil {
+			return nil, err
+		}
+		r.ProtoData = data
 
 		r.Metadata = &pb.Metadata{
 			CreatedAt: &timestamppb.Timestamp{Seconds: created},
 			UpdatedAt: &timestamppb.Timestamp{Seconds: updated},
+			Checksum:  checksum.String,
+			Hlc:       hlc.Int64,
 		}
 		if dUri.Valid {
 			r.DataUri = dUri.String
@@ -256,50 +497,24 @@ func (s *SqliteStore) CountRecords(ctx context.Context) (int64, error) {
 
 func (s *SqliteStore) Search(ctx context.Context, q *collection.SearchQuery) ([]*collection.SearchResult, error) {
 	var query strings.Builder
-	var args []interface{}
-	var whereClauses []string
 
 	// Base query
-	query.WriteString(`SELECT r.id, r.proto_data `)
+	var args []interface{}
+	query.WriteString(`SELECT r.id, ` + storedData("r") + ` `)
 	if q.FullText != "" {
 		query.WriteString(`, bm25(records_fts) as score `)
 	}
-	query.WriteString(`FROM records r `)
-	if q.FullText != "" {
-		query.WriteString(`JOIN records_fts fts ON r.rowid = fts.rowid `)
+	byDistance := q.Geo != nil && q.Geo.Radius != nil && s.geo != nil
+	if byDistance {
+		query.WriteString(`, ` + s.geo.distance() + ` as distance `)
+		args = append(args, q.Geo.Radius.Lat, q.Geo.Radius.Lat, q.Geo.Radius.Lon)
 	}
-
-	// Full-text search
-	if q.FullText != "" {
-		whereClauses = append(whereClauses, `records_fts MATCH ?`)
-		args = append(args, q.FullText)
-	}
-
-	// JSON filters
-	for key, filter := range q.Filters {
-		// JSON path needs to be properly quoted for keys with dots.
-		path := `$.` + key
-
-		switch filter.Operator {
-		case collection.OpExists:
-			whereClauses = append(whereClauses, `json_extract(r.jsontext, ?) IS NOT NULL`)
-			args = append(args, path)
-		case collection.OpNotExists:
-			whereClauses = append(whereClauses, `json_extract(r.jsontext, ?) IS NULL`)
-			args = append(args, path)
-		case collection.OpContains:
-			whereClauses = append(whereClauses, `json_extract(r.jsontext, ?) LIKE ?`)
-			args = append(args, path, "%"+fmt.Sprintf("%v", filter.Value)+"%")
-		default:
-			whereClauses = append(whereClauses, fmt.Sprintf(`json_extract(r.jsontext, ?) %s ?`, filter.Operator))
-			args = append(args, path, filter.Value)
-		}
-	}
-
-	// Append WHERE clauses
-	if len(whereClauses) > 0 {
-		query.WriteString("WHERE " + strings.Join(whereClauses, " AND "))
+	from, fromArgs, err := s.searchFrom(q)
+	if err != nil {
+		return nil, err
 	}
+	query.WriteString(from)
+	args = append(args, fromArgs...)
 
 	// Ordering
 	if q.OrderBy != "" {
@@ -307,10 +522,17 @@ func (s *SqliteStore) Search(ctx context.Context, q *collection.SearchQuery) ([]
 		if !q.Ascending {
 			order = "DESC"
 		}
-		query.WriteString(fmt.Sprintf(` ORDER BY json_extract(r.jsontext, '$.%s') %s`, q.OrderBy, order))
+		path, err := orderByPath(q.OrderBy)
+		if err != nil {
+			return nil, err
+		}
+		query.WriteString(` ORDER BY json_extract(r.jsontext, ?) ` + order)
+		args = append(args, path)
 	} else if q.FullText != "" {
 		// Default to score for FTS
 		query.WriteString(" ORDER BY score")
+	} else if byDistance {
+		query.WriteString(" ORDER BY distance")
 	}
 
 	// Pagination
@@ -332,31 +554,342 @@ func (s *SqliteStore) Search(ctx context.Context, q *collection.SearchQuery) ([]
 	var results []*collection.SearchResult
 	for rows.Next() {
 		var r pb.CollectionRecord
-		var score sql.NullFloat64
+		var encoding int64
+		var score, distance sql.NullFloat64
 
-		var scanArgs = []any{&r.Id, &r.ProtoData}
+		var scanArgs = []any{&r.Id, &r.ProtoData, &encoding}
 		if q.FullText != "" {
 			scanArgs = append(scanArgs, &score)
 		}
+		if byDistance {
+			scanArgs = append(scanArgs, &distance)
+		}
 
 		if err := rows.Scan(scanArgs...); err != nil {
 			return nil, err
 		}
+		data, err := s.codec.decode(r.ProtoData, encoding)
+		if err != nil {
+			return nil, err
+		}
+		r.ProtoData = data
 
 		searchResult := &collection.SearchResult{Record: &r}
 		if score.Valid {
 			searchResult.Score = score.Float64
 		}
+		if distance.Valid {
+			searchResult.Distance = distance.Float64
+		}
 		results = append(results, searchResult)
 	}
 	return results, nil
 }
 
+// searchFrom builds the FROM and WHERE clauses shared by Search and CountMatching.
+func (s *SqliteStore) searchFrom(q *collection.SearchQuery) (string, []interface{}, error) {
+	var query strings.Builder
+	var args []interface{}
+	var whereClauses []string
+
+	if !q.AsOf.IsZero() {
+		if !s.HistoryEnabled() {
+			return "", nil, collection.ErrHistoryUnavailable
+		}
+		if q.FullText != "" {
+			return "", nil, fmt.Errorf("full-text search is not supported for as-of reads")
+		}
+		if q.Geo != nil {
+			return "", nil, fmt.Errorf("geo filters are not supported for as-of reads")
+		}
+		query.WriteString(`FROM ` + asOfSource + ` r `)
+		args = append(args, q.AsOf.Unix(), q.AsOf.Unix(), q.AsOf.Unix())
+	} else {
+		query.WriteString(`FROM records r `)
+	}
+	if q.FullText != "" {
+		query.WriteString(`JOIN records_fts fts ON r.rowid = fts.rowid `)
+	}
+	if q.Geo != nil {
+		join, clauses, geoArgs, err := s.geoClauses(q.Geo)
+		if err != nil {
+			return "", nil, err
+		}
+		query.WriteString(join)
+		whereClauses = append(whereClauses, clauses...)
+		args = append(args, geoArgs...)
+	}
+
+	// Full-text search
+	if q.FullText != "" {
+		whereClauses = append(whereClauses, `records_fts MATCH ?`)
+		args = append(args, s.ftsQuery(q.FullText))
+	}
+	if len(q.IDs) > 0 {
+		whereClauses = append(whereClauses, `r.id IN (?`+strings.Repeat(", ?", len(q.IDs)-1)+`)`)
+		for _, id := range q.IDs {
+			args = append(args, id)
+		}
+	}
+
+	// JSON filters
+	for key, filter := range q.Filters {
+		var clause string
+		var clauseArgs []interface{}
+		call, isCall, err := collection.ParseFunctionCall(key)
+		switch {
+		case isCall && err == nil:
+			clause, clauseArgs, err = s.functionClause(call, filter)
+		case !isCall:
+			clause, clauseArgs, err = filterClause(key, filter)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		whereClauses = append(whereClauses, clause)
+		args = append(args, clauseArgs...)
+	}
+
+	// Label selector
+	for _, req := range q.LabelRequirements() {
+		clause, clauseArgs := labelClause(req)
+		whereClauses = append(whereClauses, clause)
+		args = append(args, clauseArgs...)
+	}
+
+	// Creation-time range
+	if !q.CreatedAfter.IsZero() {
+		whereClauses = append(whereClauses, `r.created_at >= ?`)
+		args = append(args, q.CreatedAfter.Unix())
+	}
+	if !q.CreatedBefore.IsZero() {
+		whereClauses = append(whereClauses, `r.created_at < ?`)
+		args = append(args, q.CreatedBefore.Unix())
+	}
+
+	// Append WHERE clauses
+	if len(whereClauses) > 0 {
+		query.WriteString("WHERE " + strings.Join(whereClauses, " AND "))
+	}
+	return query.String(), args, nil
+}
+
+// filterClause translates a filter on a field path into a condition on the
+// record JSON. Paths with [*] match when any array element satisfies the
+// filter; NOT_EXISTS on them matches when no element has the field.
+func filterClause(key string, filter collection.Filter) (string, []interface{}, error) {
+	path, err := collection.ParseFieldPath(key)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := filter.Validate(); err != nil {
+		return "", nil, err
+	}
+
+	array, element, wildcard := path.SplitWildcard()
+	switch filter.Operator {
+	case collection.OpArrayContains, collection.OpArrayContainsAny:
+		if wildcard {
+			return "", nil, fmt.Errorf("%s cannot be used with [*] in %q", filter.Operator, key)
+		}
+		return arrayContainsClause(path.JSONPath(), filter)
+	}
+	if !wildcard {
+		return compareClause(jsonField{
+			value: `json_extract(r.jsontext, ?)`, typ: `json_type(r.jsontext, ?)`,
+			args: []interface{}{path.JSONPath()},
+		}, filter)
+	}
+
+	field := jsonField{value: `e.value`, typ: `e.type`}
+	if len(element) > 0 {
+		field = jsonField{
+			value: `json_extract(e.value, ?)`, typ: `json_type(e.value, ?)`,
+			args: []interface{}{element.JSONPath()},
+		}
+	}
+	negate := filter.Operator == collection.OpNotExists
+	if negate {
+		filter.Operator = collection.OpExists
+	}
+	cond, condArgs, err := compareClause(field, filter)
+	if err != nil {
+		return "", nil, err
+	}
+	clause := `EXISTS (SELECT 1 FROM json_each(r.jsontext, ?) e WHERE ` + cond + `)`
+	if negate {
+		clause = `NOT ` + clause
+	}
+	return clause, append([]interface{}{array.JSONPath()}, condArgs...), nil
+}
+
+// jsonField is SQL for a JSON value and its json_type, both of whose
+// placeholders are bound by args.
+type jsonField struct {
+	value, typ string
+	args       []interface{}
+}
+
+// repeat returns the field's args n times, for SQL that uses the field n
+// times.
+func (f jsonField) repeat(n int) []interface{} {
+	var args []interface{}
+	for i := 0; i < n; i++ {
+		args = append(args, f.args...)
+	}
+	return args
+}
+
+// day is the UTC date of the field, which may hold a timestamp string or Unix
+// seconds.
+func (f jsonField) day() string {
+	return `(CASE WHEN typeof(` + f.value + `) IN ('integer', 'real') THEN date(` + f.value + `, 'unixepoch') ELSE date(` + f.value + `) END)`
+}
+
+// compareClause applies a scalar filter operator to field.
+func compareClause(field jsonField, filter collection.Filter) (string, []interface{}, error) {
+	args := field.repeat(1)
+	value := field.value
+	switch filter.Operator {
+	case collection.OpExists:
+		return value + ` IS NOT NULL`, args, nil
+	case collection.OpNotExists:
+		return value + ` IS NULL`, args, nil
+	case collection.OpIsNull:
+		return field.typ + ` = 'null'`, args, nil
+	case collection.OpIsNotNull:
+		return field.typ + ` != 'null'`, args, nil
+	case collection.OpContains:
+		return value + ` LIKE ?`, append(args, "%"+fmt.Sprintf("%v", filter.Value)+"%"), nil
+	case collection.OpIn:
+		values := collection.FilterValues(filter.Value)
+		if len(values) == 0 {
+			return `0`, nil, nil
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(values)), ",")
+		return value + ` IN (` + placeholders + `)`, append(args, values...), nil
+	case collection.OpBetween:
+		bounds := collection.FilterValues(filter.Value)
+		return value + ` BETWEEN ? AND ?`, append(args, bounds...), nil
+	case collection.OpSameDay, collection.OpSameWeek:
+		t, _ := collection.FilterTime(filter.Value)
+		day := field.day()
+		if filter.Operator == collection.OpSameWeek {
+			// 'weekday 0' moves to the next Sunday (or stays on one); the Monday is six days before
+			day = `date(` + day + `, 'weekday 0', '-6 days')`
+			t = collection.WeekStart(t)
+		}
+		return day + ` = ?`, append(field.repeat(3), t.Format(time.DateOnly)), nil
+	case collection.OpEquals, collection.OpNotEquals, collection.OpGreaterThan,
+		collection.OpLessThan, collection.OpGreaterEqual, collection.OpLessEqual:
+		return fmt.Sprintf(`%s %s ?`, value, filter.Operator), append(args, filter.Value), nil
+	}
+	return "", nil, fmt.Errorf("unsupported filter operator %q", filter.Operator)
+}
+
+// arrayContainsClause matches records whose array at path holds every value
+// (OpArrayContains) or any value (OpArrayContainsAny) of the filter.
+func arrayContainsClause(path string, filter collection.Filter) (string, []interface{}, error) {
+	values := collection.FilterValues(filter.Value)
+	if len(values) == 0 {
+		return "", nil, fmt.Errorf("%s requires a value", filter.Operator)
+	}
+	const contains = `EXISTS (SELECT 1 FROM json_each(r.jsontext, ?) a WHERE a.value `
+
+	if filter.Operator == collection.OpArrayContainsAny {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(values)), ",")
+		return contains + `IN (` + placeholders + `))`, append([]interface{}{path}, values...), nil
+	}
+	clauses := make([]string, len(values))
+	var args []interface{}
+	for i, v := range values {
+		clauses[i] = contains + `= ?)`
+		args = append(args, path, v)
+	}
+	return `(` + strings.Join(clauses, ` AND `) + `)`, args, nil
+}
+
+// orderByPath returns the JSON path to sort by.
+func orderByPath(field string) (string, error) {
+	path, err := collection.ParseFieldPath(field)
+	if err != nil {
+		return "", err
+	}
+	if _, _, wildcard := path.SplitWildcard(); wildcard {
+		return "", fmt.Errorf("cannot order by %q: [*] paths select several values", field)
+	}
+	return path.JSONPath(), nil
+}
+
+// labelClause translates a selector requirement into a condition on the
+// labels JSON column.
+func labelClause(req collection.Requirement) (string, []interface{}) {
+	label := `json_extract(r.labels, ?)`
+	args := []interface{}{`$."` + req.Key + `"`}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(req.Values)), ", ")
+	values := make([]interface{}, len(req.Values))
+	for i, v := range req.Values {
+		values[i] = v
+	}
+
+	switch req.Operator {
+	case collection.SelectorEquals:
+		return label + ` = ?`, append(args, values...)
+	case collection.SelectorNotEquals:
+		return `coalesce(` + label + ` != ?, 1)`, append(args, values...)
+	case collection.SelectorIn:
+		return label + ` IN (` + placeholders + `)`, append(args, values...)
+	case collection.SelectorNotIn:
+		return `coalesce(` + label + ` NOT IN (` + placeholders + `), 1)`, append(args, values...)
+	case collection.SelectorDoesNotExist:
+		return label + ` IS NULL`, args
+	default:
+		return label + ` IS NOT NULL`, args
+	}
+}
+
+// CountMatching counts the records matching q's full-text and filter criteria.
+// Ordering and pagination are ignored.
+func (s *SqliteStore) CountMatching(ctx context.Context, q *collection.SearchQuery) (int64, error) {
+	from, args, err := s.searchFrom(q)
+	if err != nil {
+		return 0, err
+	}
+	var c int64
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*) "+from, args...).Scan(&c)
+	return c, err
+}
+
+// RecordExists reports whether a record with the given id exists.
+func (s *SqliteStore) RecordExists(ctx context.Context, id string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM records WHERE id = ?)", id).Scan(&exists)
+	return exists, err
+}
+
 func (s *SqliteStore) Checkpoint(ctx context.Context) error {
 	_, err := s.db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)")
 	return err
 }
 
+// WithWriteBarrier runs fn with the store's writes waiting and its WAL
+// checkpointed into the database file, so the file at path is a complete,
+// consistent image of the store until fn returns.
+func (s *SqliteStore) WithWriteBarrier(ctx context.Context, fn func(path string) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var busy, logFrames, checkpointed int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return fmt.Errorf("checkpoint failed: %w", err)
+	}
+	if busy != 0 {
+		return fmt.Errorf("checkpoint blocked by readers: %d of %d WAL frames checkpointed", checkpointed, logFrames)
+	}
+	return fn(s.path)
+}
+
 func (s *SqliteStore) ExecuteRaw(q string, args ...interface{}) error {
 	_, err := s.db.Exec(q, args...)
 	return err
@@ -500,9 +1033,72 @@ func (s *SqliteStore) ReIndex(ctx context.Context) error {
 		return err
 	}
 
-	if _, err := tx.ExecContext(ctx, "INSERT INTO records_fts(rowid, content) SELECT rowid, jsontext FROM records"); err != nil {
+	if _, err := tx.ExecContext(ctx, "INSERT INTO records_fts(rowid, content) SELECT rowid, "+ftsIndexed(ftsContent("records"), s.options.Language)+" FROM records"); err != nil {
 		return err
 	}
 
 	return tx.Commit()
 }
+
+// StoreOpener opens the stores of moved and write-once collections with
+// opts, and the features their collections were created with. Partitioned
+// collections get a PartitionedStore in collection.PartitionsDir(path),
+// unless path already holds a database: a copy of one, which Backup merges
+// into a single file.
+func StoreOpener(opts collection.Options) collection.StoreOpener {
+	return func(path string, stored *pb.StoreOptions) (collection.Store, error) {
+		opts := opts.WithStored(stored)
+		if opts.PartitionPeriod != "" {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				return NewPartitionedStore(collection.PartitionsDir(path), PartitionPeriod(opts.PartitionPeriod), opts)
+			}
+		}
+		return NewSqliteStore(path, opts)
+	}
+}
+
+// StoreOptions returns the options the store was opened with.
+func (s *SqliteStore) StoreOptions() collection.Options {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.options
+}
+
+// Upgrade enables the JSON column and full-text index if opts asks for them
+// and the store lacks them. A new full-text index is filled from the
+// records already stored; Upgrade returns how many it indexed.
+func (s *SqliteStore) Upgrade(ctx context.Context, opts collection.Options) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if opts.EnableJSON && !s.options.EnableJSON {
+		if _, err := s.db.ExecContext(ctx, collection.JSONSchema); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return 0, fmt.Errorf("json schema failed: %w", err)
+		}
+		s.options.EnableJSON = true
+	}
+	if !opts.EnableFTS || s.options.EnableFTS {
+		return 0, nil
+	}
+	if err := applyFTSSchema(s.db, s.options.Language); err != nil {
+		return 0, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM records_fts"); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO records_fts(rowid, content) SELECT rowid, "+ftsIndexed(ftsContent("records"), s.options.Language)+" FROM records")
+	if err != nil {
+		return 0, fmt.Errorf("backfill fts index: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.options.EnableFTS = true
+	indexed, _ := res.RowsAffected()
+	return indexed, nil
+}
@@ -0,0 +1,42 @@
+package sqlite
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// TempStoreFactory opens the stores of temporary collections with opts:
+// memory stores, or stores in files under dir that are deleted on release.
+func TempStoreFactory(dir string, opts collection.Options) collection.TempStoreFactory {
+	return func(name string, inMemory bool) (collection.Store, func() error, error) {
+		if inMemory {
+			store, err := NewMemoryStore(name, opts)
+			if err != nil {
+				return nil, nil, err
+			}
+			return store, store.Close, nil
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, nil, fmt.Errorf("failed to create temporary store directory: %w", err)
+		}
+		path := filepath.Join(dir, name+".db")
+		store, err := NewSqliteStore(path, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		release := func() error {
+			err := store.Close()
+			for _, suffix := range []string{"", "-wal", "-shm"} {
+				if rmErr := os.Remove(path + suffix); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+					err = rmErr
+				}
+			}
+			return err
+		}
+		return store, release, nil
+	}
+}
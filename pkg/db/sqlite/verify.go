@@ -0,0 +1,133 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// VerifyIntegrity runs SQLite's integrity check over every page of the
+// database, reporting each message it returns other than "ok".
+func (s *SqliteStore) VerifyIntegrity(ctx context.Context, report *collection.CheckReport) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var pages int64
+	if err := s.db.QueryRowContext(ctx, "PRAGMA page_count").Scan(&pages); err != nil {
+		return fmt.Errorf("failed to count pages: %w", err)
+	}
+	report.Checked(pages)
+
+	rows, err := s.db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return fmt.Errorf("integrity check failed: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			return err
+		}
+		if message != "ok" {
+			report.Problem("", "%s", message)
+		}
+	}
+	return rows.Err()
+}
+
+// VerifyFTS checks the full-text index's own structure, then that it holds
+// exactly one up-to-date entry for every record.
+func (s *SqliteStore) VerifyFTS(ctx context.Context, report *collection.CheckReport) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.options.EnableFTS {
+		report.Skip("full-text search is not enabled")
+		return nil
+	}
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO records_fts(records_fts) VALUES ('integrity-check')"); err != nil {
+		report.Problem("", "full-text index is corrupt: %v", err)
+	}
+
+	// Records with no entry, or one indexed from other content
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT r.id, f.rowid IS NULL
+		FROM records r LEFT JOIN records_fts f ON f.rowid = r.rowid
+		WHERE f.rowid IS NULL OR coalesce(f.content, '') != `+ftsIndexed(ftsContent("r"), s.options.Language))
+	if err != nil {
+		return fmt.Errorf("failed to compare records with the full-text index: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var missing bool
+		if err := rows.Scan(&id, &missing); err != nil {
+			return err
+		}
+		if missing {
+			report.Problem(id, "record is missing from the full-text index")
+		} else {
+			report.Problem(id, "full-text entry is out of date")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Entries left behind by deleted records
+	stale, err := s.db.QueryContext(ctx, "SELECT rowid FROM records_fts WHERE rowid NOT IN (SELECT rowid FROM records)")
+	if err != nil {
+		return fmt.Errorf("failed to find stale full-text entries: %w", err)
+	}
+	defer stale.Close()
+	for stale.Next() {
+		var rowid int64
+		if err := stale.Scan(&rowid); err != nil {
+			return err
+		}
+		report.Problem("", "full-text entry %d has no record", rowid)
+	}
+	if err := stale.Err(); err != nil {
+		return err
+	}
+
+	var count int64
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM records").Scan(&count); err != nil {
+		return err
+	}
+	report.Checked(count)
+	return nil
+}
+
+// VerifyLabels checks that every record's labels decode as the JSON object
+// of strings that reads and label selectors expect. Reads drop labels that
+// do not, so without this check they would silently go missing.
+func (s *SqliteStore) VerifyLabels(ctx context.Context, report *collection.CheckReport) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id, labels FROM records")
+	if err != nil {
+		return fmt.Errorf("failed to read labels: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var labels sql.NullString
+		if err := rows.Scan(&id, &labels); err != nil {
+			return err
+		}
+		report.Checked(1)
+		if labels.String == "" {
+			continue
+		}
+		var decoded map[string]string
+		if err := json.Unmarshal([]byte(labels.String), &decoded); err != nil {
+			report.Problem(id, "labels are not a JSON object of strings: %v", err)
+		}
+	}
+	return rows.Err()
+}
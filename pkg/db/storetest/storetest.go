@@ -0,0 +1,363 @@
+// Package storetest holds the conformance cases every collection.Store
+// implementation must pass, so that the SQLite store and the stores that
+// stand in for it behave the same to the repo.
+//
+// A store's tests call Run with a function that returns a new, empty store:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T, opts collection.Options) collection.Store {
+//			store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), "c.db"), opts)
+//			if err != nil {
+//				t.Fatalf("failed to create store: %v", err)
+//			}
+//			t.Cleanup(func() { store.Close() })
+//			return store
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// NewStore returns a new, empty store with opts. It registers the store's
+// cleanup with t.
+type NewStore func(t *testing.T, opts collection.Options) collection.Store
+
+// Run runs every conformance case against stores from newStore, each case
+// in its own subtest with its own store.
+func Run(t *testing.T, newStore NewStore) {
+	for _, c := range []struct {
+		name string
+		run  func(t *testing.T, newStore NewStore)
+	}{
+		{"CRUD", testCRUD},
+		{"CreateRecords", testCreateRecords},
+		{"ListAndCount", testListAndCount},
+		{"Filters", testFilters},
+		{"Labels", testLabels},
+		{"FullText", testFullText},
+		{"Backup", testBackup},
+	} {
+		t.Run(c.name, func(t *testing.T) { c.run(t, newStore) })
+	}
+}
+
+var base = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// record returns a JSON record created i minutes after base.
+func record(id string, i int, data string, labels map[string]string) *pb.CollectionRecord {
+	at := timestamppb.New(base.Add(time.Duration(i) * time.Minute))
+	return &pb.CollectionRecord{
+		Id:        id,
+		ProtoData: []byte(data),
+		Metadata:  &pb.Metadata{CreatedAt: at, UpdatedAt: at, Labels: labels},
+	}
+}
+
+// seed creates the fruit records the search cases run against.
+func seed(t *testing.T, store collection.Store) {
+	t.Helper()
+	ctx := context.Background()
+	for i, r := range []*pb.CollectionRecord{
+		record("apple", 0, `{"name": "apple", "color": "red", "price": 3, "notes": "crisp autumn fruit"}`, map[string]string{"kind": "tree"}),
+		record("banana", 1, `{"name": "banana", "color": "yellow", "price": 1, "notes": "soft tropical fruit"}`, map[string]string{"kind": "plant"}),
+		record("cherry", 2, `{"name": "cherry", "color": "red", "price": 8, "notes": "small stone fruit"}`, map[string]string{"kind": "tree"}),
+		record("lemon", 3, `{"name": "lemon", "color": "yellow", "price": 2}`, nil),
+	} {
+		if err := store.CreateRecord(ctx, r); err != nil {
+			t.Fatalf("CreateRecord(%d) failed: %v", i, err)
+		}
+	}
+}
+
+// ids returns the IDs of results, in order.
+func ids(results []*collection.SearchResult) []string {
+	var out []string
+	for _, r := range results {
+		out = append(out, r.Record.Id)
+	}
+	return out
+}
+
+// sameSet reports whether got and want hold the same IDs in any order.
+func sameSet(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[string]bool, len(want))
+	for _, id := range want {
+		seen[id] = true
+	}
+	for _, id := range got {
+		if !seen[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func testCRUD(t *testing.T, newStore NewStore) {
+	ctx := context.Background()
+	store := newStore(t, collection.Options{EnableJSON: true})
+
+	r := record("r1", 0, `{"status": "open"}`, map[string]string{"team": "core"})
+	r.DataUri = "file://r1"
+	r.Metadata.Checksum = "abc"
+	r.Metadata.Hlc = 42
+	if err := store.CreateRecord(ctx, r); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := store.CreateRecord(ctx, r); !errors.Is(err, collection.ErrRecordExists) {
+		t.Errorf("expected ErrRecordExists for a duplicate id, got %v", err)
+	}
+
+	got, err := store.GetRecord(ctx, "r1")
+	if err != nil {
+		t.Fatalf("GetRecord failed: %v", err)
+	}
+	if string(got.ProtoData) != `{"status": "open"}` || got.DataUri != "file://r1" {
+		t.Errorf("unexpected record: %v", got)
+	}
+	if got.Metadata.GetLabels()["team"] != "core" || got.Metadata.Checksum != "abc" || got.Metadata.Hlc != 42 {
+		t.Errorf("unexpected metadata: %v", got.Metadata)
+	}
+	if !got.Metadata.CreatedAt.AsTime().Equal(base) {
+		t.Errorf("expected created_at %v, got %v", base, got.Metadata.CreatedAt.AsTime())
+	}
+
+	r.ProtoData = []byte(`{"status": "closed"}`)
+	r.Metadata.UpdatedAt = timestamppb.New(base.Add(time.Hour))
+	r.Metadata.Labels = nil
+	if err := store.UpdateRecord(ctx, r); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	got, err = store.GetRecord(ctx, "r1")
+	if err != nil {
+		t.Fatalf("GetRecord failed: %v", err)
+	}
+	if string(got.ProtoData) != `{"status": "closed"}` || len(got.Metadata.GetLabels()) != 0 {
+		t.Errorf("expected the update to replace data and labels, got %v", got)
+	}
+	if !got.Metadata.UpdatedAt.AsTime().Equal(base.Add(time.Hour)) {
+		t.Errorf("expected updated_at to change, got %v", got.Metadata.UpdatedAt.AsTime())
+	}
+
+	if err := store.UpdateRecord(ctx, record("missing", 0, `{}`, nil)); err == nil {
+		t.Error("expected updating a missing record to fail")
+	}
+	if err := store.UpdateRecord(ctx, record("r1", 0, `not json`, nil)); err == nil {
+		t.Error("expected updating with invalid JSON to fail")
+	}
+
+	if err := store.DeleteRecord(ctx, "r1"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if _, err := store.GetRecord(ctx, "r1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows after delete, got %v", err)
+	}
+}
+
+func testCreateRecords(t *testing.T, newStore NewStore) {
+	ctx := context.Background()
+	store := newStore(t, collection.Options{EnableJSON: true})
+	batcher, ok := store.(interface {
+		CreateRecords(context.Context, []*pb.CollectionRecord) error
+	})
+	if !ok {
+		t.Skip("store does not create records in batches")
+	}
+
+	if err := store.CreateRecord(ctx, record("taken", 0, `{}`, nil)); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	// A batch that hits an existing id writes nothing
+	batch := []*pb.CollectionRecord{record("a", 1, `{}`, nil), record("taken", 2, `{}`, nil)}
+	if err := batcher.CreateRecords(ctx, batch); !errors.Is(err, collection.ErrRecordExists) {
+		t.Errorf("expected ErrRecordExists, got %v", err)
+	}
+	if n, err := store.CountRecords(ctx); err != nil || n != 1 {
+		t.Errorf("expected the failed batch to write nothing, got %d records (%v)", n, err)
+	}
+
+	if err := batcher.CreateRecords(ctx, batch[:1]); err != nil {
+		t.Fatalf("CreateRecords failed: %v", err)
+	}
+	if n, err := store.CountRecords(ctx); err != nil || n != 2 {
+		t.Errorf("expected 2 records, got %d (%v)", n, err)
+	}
+}
+
+func testListAndCount(t *testing.T, newStore NewStore) {
+	ctx := context.Background()
+	store := newStore(t, collection.Options{EnableJSON: true})
+	for i := 0; i < 5; i++ {
+		if err := store.CreateRecord(ctx, record(fmt.Sprintf("r%d", i), i, `{}`, nil)); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	if n, err := store.CountRecords(ctx); err != nil || n != 5 {
+		t.Errorf("expected 5 records, got %d (%v)", n, err)
+	}
+	// Newest first, paged
+	var listed []string
+	for offset := 0; offset < 6; offset += 2 {
+		page, err := store.ListRecords(ctx, offset, 2)
+		if err != nil {
+			t.Fatalf("ListRecords failed: %v", err)
+		}
+		for _, r := range page {
+			listed = append(listed, r.Id)
+		}
+	}
+	if fmt.Sprint(listed) != "[r4 r3 r2 r1 r0]" {
+		t.Errorf("expected records newest first, got %v", listed)
+	}
+}
+
+func testFilters(t *testing.T, newStore NewStore) {
+	ctx := context.Background()
+	store := newStore(t, collection.Options{EnableJSON: true})
+	seed(t, store)
+
+	for _, c := range []struct {
+		name    string
+		filters map[string]collection.Filter
+		want    []string
+	}{
+		{"equals", map[string]collection.Filter{"color": {Operator: collection.OpEquals, Value: "red"}}, []string{"apple", "cherry"}},
+		{"not equals", map[string]collection.Filter{"color": {Operator: collection.OpNotEquals, Value: "red"}}, []string{"banana", "lemon"}},
+		{"greater than", map[string]collection.Filter{"price": {Operator: collection.OpGreaterThan, Value: 2}}, []string{"apple", "cherry"}},
+		{"less or equal", map[string]collection.Filter{"price": {Operator: collection.OpLessEqual, Value: 2}}, []string{"banana", "lemon"}},
+		{"in", map[string]collection.Filter{"name": {Operator: collection.OpIn, Value: []interface{}{"apple", "lemon"}}}, []string{"apple", "lemon"}},
+		{"exists", map[string]collection.Filter{"notes": {Operator: collection.OpExists}}, []string{"apple", "banana", "cherry"}},
+		{"not exists", map[string]collection.Filter{"notes": {Operator: collection.OpNotExists}}, []string{"lemon"}},
+		{"combined", map[string]collection.Filter{
+			"color": {Operator: collection.OpEquals, Value: "red"},
+			"price": {Operator: collection.OpLessThan, Value: 5},
+		}, []string{"apple"}},
+	} {
+		results, err := store.Search(ctx, &collection.SearchQuery{Filters: c.filters, Limit: 10})
+		if err != nil {
+			t.Errorf("%s: Search failed: %v", c.name, err)
+			continue
+		}
+		if got := ids(results); !sameSet(got, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+
+	// Ordering by a field, with limit and offset
+	results, err := store.Search(ctx, &collection.SearchQuery{OrderBy: "price", Ascending: true, Limit: 2, Offset: 1})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if got := fmt.Sprint(ids(results)); got != "[lemon apple]" {
+		t.Errorf("expected [lemon apple], got %s", got)
+	}
+}
+
+func testLabels(t *testing.T, newStore NewStore) {
+	ctx := context.Background()
+	store := newStore(t, collection.Options{EnableJSON: true})
+	seed(t, store)
+
+	results, err := store.Search(ctx, &collection.SearchQuery{LabelFilters: map[string]string{"kind": "tree"}, Limit: 10})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if got := ids(results); !sameSet(got, []string{"apple", "cherry"}) {
+		t.Errorf("expected [apple cherry], got %v", got)
+	}
+
+	sel, err := collection.ParseLabelSelector("kind in (tree, plant), kind != tree")
+	if err != nil {
+		t.Fatalf("ParseLabelSelector failed: %v", err)
+	}
+	results, err = store.Search(ctx, &collection.SearchQuery{Labels: sel, Limit: 10})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if got := ids(results); !sameSet(got, []string{"banana"}) {
+		t.Errorf("expected [banana], got %v", got)
+	}
+}
+
+func testFullText(t *testing.T, newStore NewStore) {
+	ctx := context.Background()
+	store := newStore(t, collection.Options{EnableJSON: true, EnableFTS: true})
+	seed(t, store)
+
+	results, err := store.Search(ctx, &collection.SearchQuery{FullText: "tropical", Limit: 10})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if got := ids(results); !sameSet(got, []string{"banana"}) {
+		t.Errorf("expected [banana], got %v", got)
+	}
+
+	// Full text combines with filters
+	results, err = store.Search(ctx, &collection.SearchQuery{
+		FullText: "fruit",
+		Filters:  map[string]collection.Filter{"color": {Operator: collection.OpEquals, Value: "red"}},
+		Limit:    10,
+	})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if got := ids(results); !sameSet(got, []string{"apple", "cherry"}) {
+		t.Errorf("expected [apple cherry], got %v", got)
+	}
+}
+
+func testBackup(t *testing.T, newStore NewStore) {
+	ctx := context.Background()
+	store := newStore(t, collection.Options{EnableJSON: true})
+	seed(t, store)
+
+	// Backups are SQLite files, whatever the store
+	dest := filepath.Join(t.TempDir(), "backup.db")
+	if err := store.Backup(ctx, dest); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	backup, err := sqlite.NewSqliteStore(dest, collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to open backup: %v", err)
+	}
+	defer backup.Close()
+	if n, err := backup.CountRecords(ctx); err != nil || n != 4 {
+		t.Errorf("expected 4 records in the backup, got %d (%v)", n, err)
+	}
+	got, err := backup.GetRecord(ctx, "cherry")
+	if err != nil {
+		t.Fatalf("GetRecord from backup failed: %v", err)
+	}
+	if got.Metadata.GetLabels()["kind"] != "tree" {
+		t.Errorf("expected labels in the backup, got %v", got.Metadata)
+	}
+
+	// An existing destination is left alone
+	existing := filepath.Join(t.TempDir(), "existing.db")
+	if err := os.WriteFile(existing, []byte("keep"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := store.Backup(ctx, existing); err == nil {
+		t.Error("expected a backup onto an existing file to fail")
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "keep" {
+		t.Errorf("expected the existing file to be untouched, got %q", data)
+	}
+}
@@ -0,0 +1,109 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/metadata"
+)
+
+// MethodACLProvider reports the callers allowed to invoke a method. When the
+// dispatcher's RegistryValidator also implements it, Serve and Dispatch
+// refuse calls that the method's ACL does not allow.
+type MethodACLProvider interface {
+	// MethodACL returns the method's ACL, or nil if anyone may call it.
+	MethodACL(ctx context.Context, namespace, serviceName, methodName string) (*pb.MethodACL, error)
+}
+
+// authorize checks a call made by the collector caller for principal
+// against the method's ACL, returning a status refusing it, or nil. The call
+// is allowed if the ACL lists the collector or the principal. Lookup
+// failures refuse the call.
+func (d *Dispatcher) authorize(ctx context.Context, caller, principal, namespace, serviceName, methodName string) *pb.Status {
+	acls, ok := d.registryValidator.(MethodACLProvider)
+	if !ok {
+		return nil
+	}
+	acl, err := acls.MethodACL(ctx, namespace, serviceName, methodName)
+	if err != nil {
+		return &pb.Status{Code: 500, Message: fmt.Sprintf("access check for %s.%s failed: %v", serviceName, methodName, err)}
+	}
+	if acl == nil {
+		return nil
+	}
+	if (caller != "" && slices.Contains(acl.Collectors, caller)) || (principal != "" && slices.Contains(acl.Principals, principal)) {
+		return nil
+	}
+	return &pb.Status{
+		Code:    403,
+		Message: fmt.Sprintf("collector %q with principal %q may not call %s.%s in namespace %s", caller, principal, serviceName, methodName, namespace),
+	}
+}
+
+// AddCollectorPrincipals trusts principals, as authenticated by a
+// collection.PrincipalAuthenticator (a peer's bearer token or client
+// certificate), as the collectors of the same name. Calls they make are
+// checked against method ACLs as that collector, on behalf of the principal
+// they forward in the PrincipalMetadataKey header. This collector's own ID
+// is always trusted, for in-process callers such as the scheduler.
+func (d *Dispatcher) AddCollectorPrincipals(principals ...string) {
+	d.peerMu.Lock()
+	defer d.peerMu.Unlock()
+	if d.peerPrincipals == nil {
+		d.peerPrincipals = make(map[string]bool)
+	}
+	for _, p := range principals {
+		d.peerPrincipals[p] = true
+	}
+}
+
+// SetPeerToken sets the bearer token this collector presents on Serve calls
+// to other collectors, which should authenticate it as this collector's ID.
+// Collectors authenticating each other by client certificates need none.
+func (d *Dispatcher) SetPeerToken(token string) {
+	d.peerMu.Lock()
+	defer d.peerMu.Unlock()
+	d.peerToken = token
+}
+
+// callerIdentity returns who makes a call: the collector it comes from and
+// the principal it is made for. A caller authenticated as a trusted
+// collector may forward the principal it acts for; any other authenticated
+// caller is the principal itself, from no collector. Unauthenticated
+// headers never name either.
+func (d *Dispatcher) callerIdentity(ctx context.Context) (caller, principal string) {
+	authenticated := collection.AuthenticatedPrincipal(ctx)
+	if authenticated == "" {
+		return "", ""
+	}
+	d.peerMu.RLock()
+	trusted := authenticated == d.connManager.collectorID || d.peerPrincipals[authenticated]
+	d.peerMu.RUnlock()
+	if !trusted {
+		return "", authenticated
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(collection.PrincipalMetadataKey); len(values) > 0 {
+		return authenticated, values[0]
+	}
+	return authenticated, ""
+}
+
+// withCaller authenticates an outgoing Serve call as this collector and
+// forwards the principal the call in ctx is made for, so the executing
+// collector can check its ACLs.
+func (d *Dispatcher) withCaller(ctx context.Context) context.Context {
+	d.peerMu.RLock()
+	token := d.peerToken
+	d.peerMu.RUnlock()
+	if token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, collection.AuthorizationMetadataKey, "Bearer "+token)
+	}
+	if _, principal := d.callerIdentity(ctx); principal != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, collection.PrincipalMetadataKey, principal)
+	}
+	return ctx
+}
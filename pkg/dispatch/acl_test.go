@@ -0,0 +1,119 @@
+package dispatch_test
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/testkit"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// aclValidator accepts every method and restricts the ones it lists.
+type aclValidator map[string]*pb.MethodACL
+
+func (v aclValidator) ValidateServiceMethod(ctx context.Context, namespace, serviceName, methodName string) error {
+	return nil
+}
+
+func (v aclValidator) MethodACL(ctx context.Context, namespace, serviceName, methodName string) (*pb.MethodACL, error) {
+	return v[serviceName+"."+methodName], nil
+}
+
+func TestMethodACL_EnforcedOnServeAndDispatch(t *testing.T) {
+	ctx := context.Background()
+
+	acls := aclValidator{
+		"Payroll.Run": {Collectors: []string{"collector0"}, Principals: []string{"alice"}},
+	}
+	mesh := testkit.NewMesh(t, 3, testkit.Options{Namespaces: []string{"hr"}})
+	for _, c := range mesh.Collectors {
+		c.Dispatcher.SetRegistryValidator(acls)
+	}
+	for _, method := range []string{"Run", "Preview"} {
+		mesh.Collector("collector2").Dispatcher.RegisterService("hr", "Payroll", method, testkit.Static(&pb.Status{Message: "done"}))
+	}
+	if err := mesh.ConnectAll(ctx); err != nil {
+		t.Fatalf("ConnectAll failed: %v", err)
+	}
+
+	input, _ := anypb.New(&pb.Status{Message: "march"})
+	dispatchFrom := func(ctx context.Context, id, method string) pb.Status_Code {
+		t.Helper()
+		resp, err := mesh.Collector(id).Dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+			Namespace:         "hr",
+			Service:           &pb.ServiceTypeRef{ServiceName: "Payroll"},
+			MethodName:        method,
+			Input:             input,
+			TargetCollectorId: "collector2",
+		})
+		if err != nil {
+			t.Fatalf("Dispatch failed: %v", err)
+		}
+		return resp.Status.Code
+	}
+
+	if code := dispatchFrom(collection.WithPrincipal(ctx, "collector0"), "collector0", "Run"); code != 200 {
+		t.Errorf("expected collector0 to be allowed, got %d", code)
+	}
+	if code := dispatchFrom(ctx, "collector0", "Run"); code != 403 {
+		t.Errorf("expected an anonymous caller of collector0 to be refused, got %d", code)
+	}
+	if code := dispatchFrom(collection.WithPrincipal(ctx, "collector1"), "collector1", "Run"); code != 403 {
+		t.Errorf("expected collector1 to be refused, got %d", code)
+	}
+	if code := dispatchFrom(ctx, "collector1", "Preview"); code != 200 {
+		t.Errorf("expected unrestricted methods to be allowed, got %d", code)
+	}
+	alice := collection.WithPrincipal(ctx, "alice")
+	if code := dispatchFrom(alice, "collector1", "Run"); code != 200 {
+		t.Errorf("expected alice to be allowed through collector1, got %d", code)
+	}
+	claimed := metadata.NewIncomingContext(ctx, metadata.Pairs(collection.PrincipalMetadataKey, "alice"))
+	if code := dispatchFrom(claimed, "collector1", "Run"); code != 403 {
+		t.Errorf("expected alice named only in the header to be refused, got %d", code)
+	}
+
+	// Calling Serve directly does not bypass the ACL
+	conn, err := mesh.Collector("collector2").Dial()
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewCollectiveDispatcherClient(conn)
+	serveReq := &pb.ServeRequest{
+		Namespace:  "hr",
+		Service:    &pb.ServiceTypeRef{ServiceName: "Payroll"},
+		MethodName: "Run",
+		Input:      input,
+	}
+	resp, err := client.Serve(ctx, serveReq)
+	if err != nil || resp.Status.Code != 403 {
+		t.Errorf("expected an anonymous Serve to be refused, got %v (%v)", resp, err)
+	}
+	resp, err = client.Serve(metadata.AppendToOutgoingContext(ctx, collection.PrincipalMetadataKey, "alice"), serveReq)
+	if err != nil || resp.Status.Code != 403 {
+		t.Errorf("expected a principal claimed without a caller to be refused, got %v (%v)", resp, err)
+	}
+	resp, err = client.Serve(metadata.AppendToOutgoingContext(ctx, "x-collector-caller", "collector0"), serveReq)
+	if err != nil || resp.Status.Code != 403 {
+		t.Errorf("expected Serve with a forged caller header to be refused, got %v (%v)", resp, err)
+	}
+	bearer := func(c *testkit.Collector) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, collection.AuthorizationMetadataKey, "Bearer "+c.Token)
+	}
+	resp, err = client.Serve(bearer(mesh.Collector("collector0")), serveReq)
+	if err != nil || resp.Status.Code != 200 {
+		t.Errorf("expected Serve from collector0 to be allowed, got %v (%v)", resp, err)
+	}
+	resp, err = client.Serve(bearer(mesh.Collector("collector1")), serveReq)
+	if err != nil || resp.Status.Code != 403 {
+		t.Errorf("expected Serve from collector1 to be refused, got %v (%v)", resp, err)
+	}
+	resp, err = client.Serve(metadata.AppendToOutgoingContext(bearer(mesh.Collector("collector1")), collection.PrincipalMetadataKey, "alice"), serveReq)
+	if err != nil || resp.Status.Code != 200 {
+		t.Errorf("expected alice forwarded by collector1 to be allowed, got %v (%v)", resp, err)
+	}
+}
@@ -0,0 +1,177 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// DefaultBreakerThreshold is the number of consecutive failed calls to a
+	// peer that opens its circuit.
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerCooldown is how long a circuit stays open before a probe
+	// call is let through.
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned for calls to a peer whose circuit is open.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// BreakerOptions tunes the circuit breakers kept for each peer collector.
+// Zero fields take their defaults.
+type BreakerOptions struct {
+	Threshold int           // Consecutive failures that open a circuit
+	Cooldown  time.Duration // Time an open circuit waits before probing
+}
+
+// SetCircuitBreaker changes how the dispatcher breaks circuits to failing
+// peers. Breakers use DefaultBreakerThreshold and DefaultBreakerCooldown
+// until this is called.
+func (d *Dispatcher) SetCircuitBreaker(opts BreakerOptions) {
+	d.connManager.breakers.configure(opts)
+}
+
+// circuitBreaker tracks the health of calls to one peer. A closed circuit
+// opens after Threshold consecutive failures; once Cooldown has passed, the
+// next call is let through as a probe (half-open) and its outcome closes or
+// reopens the circuit.
+type circuitBreaker struct {
+	state    pb.CircuitState
+	failures int
+	openedAt time.Time
+}
+
+// peerBreakers holds a circuit breaker per peer address.
+type peerBreakers struct {
+	opts     BreakerOptions
+	breakers map[string]*circuitBreaker
+	mu       sync.Mutex
+}
+
+func newPeerBreakers() *peerBreakers {
+	return &peerBreakers{
+		opts:     BreakerOptions{Threshold: DefaultBreakerThreshold, Cooldown: DefaultBreakerCooldown},
+		breakers: make(map[string]*circuitBreaker),
+	}
+}
+
+func (b *peerBreakers) configure(opts BreakerOptions) {
+	if opts.Threshold <= 0 {
+		opts.Threshold = DefaultBreakerThreshold
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = DefaultBreakerCooldown
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.opts = opts
+}
+
+// allow reports whether a call to address may proceed. When an open
+// circuit's cooldown has passed, allow lets exactly one probe call through
+// and moves the circuit to half-open until record reports its outcome.
+func (b *peerBreakers) allow(address string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cb, ok := b.breakers[address]
+	if !ok {
+		return true
+	}
+	switch cb.state {
+	case pb.CircuitState_CIRCUIT_OPEN:
+		if time.Since(cb.openedAt) < b.opts.Cooldown {
+			return false
+		}
+		cb.state = pb.CircuitState_CIRCUIT_HALF_OPEN
+		return true
+	case pb.CircuitState_CIRCUIT_HALF_OPEN:
+		return false // A probe is already in flight
+	}
+	return true
+}
+
+// blocked reports whether allow would refuse a call to address, without
+// claiming the probe.
+func (b *peerBreakers) blocked(address string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cb, ok := b.breakers[address]
+	if !ok {
+		return false
+	}
+	switch cb.state {
+	case pb.CircuitState_CIRCUIT_OPEN:
+		return time.Since(cb.openedAt) < b.opts.Cooldown
+	case pb.CircuitState_CIRCUIT_HALF_OPEN:
+		return true
+	}
+	return false
+}
+
+// record reports the outcome of a call to address that allow let through.
+// Calls abandoned by the caller say nothing about the peer, so they only
+// release a half-open probe.
+func (b *peerBreakers) record(ctx context.Context, address string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cb, ok := b.breakers[address]
+	if !ok {
+		cb = &circuitBreaker{}
+		b.breakers[address] = cb
+	}
+	switch {
+	case err != nil && ctx.Err() != nil:
+		if cb.state == pb.CircuitState_CIRCUIT_HALF_OPEN {
+			cb.state = pb.CircuitState_CIRCUIT_OPEN
+		}
+	case err != nil:
+		cb.failures++
+		if cb.state == pb.CircuitState_CIRCUIT_HALF_OPEN || cb.failures >= b.opts.Threshold {
+			cb.state = pb.CircuitState_CIRCUIT_OPEN
+			cb.openedAt = time.Now()
+		}
+	default:
+		cb.state = pb.CircuitState_CIRCUIT_CLOSED
+		cb.failures = 0
+		cb.openedAt = time.Time{}
+	}
+}
+
+// annotate copies the breaker state for conn's address into conn.
+func (b *peerBreakers) annotate(conn *pb.Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cb, ok := b.breakers[conn.Address]
+	if !ok {
+		return
+	}
+	conn.CircuitState = cb.state
+	if cb.state == pb.CircuitState_CIRCUIT_OPEN && time.Since(cb.openedAt) >= b.opts.Cooldown {
+		conn.CircuitState = pb.CircuitState_CIRCUIT_HALF_OPEN // The next call probes
+	}
+	conn.ConsecutiveFailures = int32(cb.failures)
+	if !cb.openedAt.IsZero() {
+		conn.CircuitOpenedAt = timestamppb.New(cb.openedAt)
+	}
+}
+
+// serveOn calls Serve on the peer at address through its circuit breaker,
+// returning ErrCircuitOpen without calling it while the circuit is open.
+func (d *Dispatcher) serveOn(ctx context.Context, address string, client pb.CollectiveDispatcherClient, req *pb.ServeRequest) (*pb.ServeResponse, error) {
+	breakers := d.connManager.breakers
+	if !breakers.allow(address) {
+		return nil, ErrCircuitOpen
+	}
+	resp, err := client.Serve(d.withCaller(ctx), req)
+	breakers.record(ctx, address, err)
+	return resp, err
+}
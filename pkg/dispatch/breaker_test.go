@@ -0,0 +1,116 @@
+package dispatch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/dispatch"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// circuitOf returns the connection to address as listed by d.
+func circuitOf(t *testing.T, d *dispatch.Dispatcher, address string) *pb.Connection {
+	t.Helper()
+	for _, conn := range d.GetConnectionManager().ListConnections() {
+		if conn.Address == address {
+			return conn
+		}
+	}
+	t.Fatalf("no connection to %s", address)
+	return nil
+}
+
+func TestCircuitBreaker_OpensRoutesAroundAndRecovers(t *testing.T) {
+	ctx := context.Background()
+
+	server1 := setupRealTestServer(t, "collector1", "localhost:0", []string{"pricing"})
+	defer server1.shutdown()
+	server2 := setupRealTestServer(t, "collector2", "localhost:0", []string{"pricing"})
+	server3 := setupRealTestServer(t, "collector3", "localhost:0", []string{"pricing"})
+	defer server3.shutdown()
+
+	quote := func(ctx context.Context, input interface{}) (interface{}, error) {
+		return anypb.New(&pb.Status{Message: "42"})
+	}
+	server2.dispatcher.RegisterService("pricing", "Pricing", "Quote", quote)
+	server3.dispatcher.RegisterService("pricing", "Pricing", "Quote", quote)
+	for _, s := range []*realTestServer{server2, server3} {
+		if _, err := server1.dispatcher.ConnectTo(ctx, s.address, []string{"pricing"}); err != nil {
+			t.Fatalf("ConnectTo failed: %v", err)
+		}
+	}
+	server1.dispatcher.SetCircuitBreaker(dispatch.BreakerOptions{Threshold: 2, Cooldown: 100 * time.Millisecond})
+
+	dispatchTo := func(target string) *pb.DispatchResponse {
+		t.Helper()
+		resp, err := server1.dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+			Namespace:         "pricing",
+			Service:           &pb.ServiceTypeRef{ServiceName: "Pricing"},
+			MethodName:        "Quote",
+			TargetCollectorId: target,
+		})
+		if err != nil {
+			t.Fatalf("Dispatch failed: %v", err)
+		}
+		return resp
+	}
+
+	// Take collector2 down; two failures open its circuit
+	address2 := server2.address
+	server2.shutdown()
+	for i := 0; i < 2; i++ {
+		if resp := dispatchTo("collector2"); resp.Status.Code != 500 {
+			t.Fatalf("expected a failed call, got %v", resp)
+		}
+	}
+	conn := circuitOf(t, server1.dispatcher, address2)
+	if conn.CircuitState != pb.CircuitState_CIRCUIT_OPEN || conn.ConsecutiveFailures != 2 || conn.CircuitOpenedAt == nil {
+		t.Errorf("expected an open circuit after 2 failures, got %v", conn)
+	}
+
+	// Open circuits fail fast...
+	if resp := dispatchTo("collector2"); resp.Status.Code != 503 {
+		t.Errorf("expected 503 from an open circuit, got %v", resp)
+	}
+	// ...and auto-routing goes around them
+	if resp := dispatchTo(""); resp.Status.Code != 200 || resp.HandledByCollectorId != "collector3" {
+		t.Errorf("expected collector3 to handle the request, got %v", resp)
+	}
+	if conn := circuitOf(t, server1.dispatcher, address2); conn.ConsecutiveFailures != 2 {
+		t.Errorf("expected no calls to the open circuit, got %d failures", conn.ConsecutiveFailures)
+	}
+	if conn := circuitOf(t, server1.dispatcher, server3.address); conn.CircuitState != pb.CircuitState_CIRCUIT_CLOSED {
+		t.Errorf("expected collector3's circuit to stay closed, got %v", conn.CircuitState)
+	}
+
+	// After the cooldown the next call probes; a failed probe reopens the circuit
+	time.Sleep(150 * time.Millisecond)
+	if conn := circuitOf(t, server1.dispatcher, address2); conn.CircuitState != pb.CircuitState_CIRCUIT_HALF_OPEN {
+		t.Errorf("expected a half-open circuit after the cooldown, got %v", conn.CircuitState)
+	}
+	if resp := dispatchTo("collector2"); resp.Status.Code != 500 {
+		t.Errorf("expected the probe to fail, got %v", resp)
+	}
+	if resp := dispatchTo("collector2"); resp.Status.Code != 503 {
+		t.Errorf("expected the circuit to reopen, got %v", resp)
+	}
+
+	// Once collector2 is back, a successful probe closes the circuit
+	restarted := setupRealTestServer(t, "collector2", address2, []string{"pricing"})
+	defer restarted.shutdown()
+	restarted.dispatcher.RegisterService("pricing", "Pricing", "Quote", quote)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for dispatchTo("collector2").Status.Code != 200 {
+		if time.Now().After(deadline) {
+			t.Fatal("circuit did not close after collector2 recovered")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	conn = circuitOf(t, server1.dispatcher, address2)
+	if conn.CircuitState != pb.CircuitState_CIRCUIT_CLOSED || conn.ConsecutiveFailures != 0 || conn.CircuitOpenedAt != nil {
+		t.Errorf("expected a closed circuit, got %v", conn)
+	}
+}
@@ -0,0 +1,141 @@
+package dispatch
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultResultCacheSize is the number of results kept when SetResultCache
+// is given no size.
+const DefaultResultCacheSize = 10000
+
+// CachePolicyProvider reports how long the results of a method may be
+// reused. The registry validators implement it from the cache policies
+// registered with each service.
+type CachePolicyProvider interface {
+	// CachePolicy returns the TTL for a method's results, or 0 if they must
+	// not be cached.
+	CachePolicy(ctx context.Context, namespace, serviceName, methodName string) (time.Duration, error)
+}
+
+// ResultCacheStats counts result cache lookups.
+type ResultCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// resultCache is an LRU cache of successful Dispatch responses.
+type resultCache struct {
+	policies   CachePolicyProvider
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List // Front is most recently used
+	hits       uint64
+	misses     uint64
+	mu         sync.Mutex
+}
+
+type cachedResult struct {
+	key     string
+	resp    *pb.DispatchResponse
+	expires time.Time
+}
+
+// SetResultCache caches successful Dispatch responses for methods that
+// policies marks as cacheable, keeping at most maxEntries results
+// (DefaultResultCacheSize if 0). Repeated dispatches of the same method with
+// the same input are then answered without calling another collector.
+func (d *Dispatcher) SetResultCache(policies CachePolicyProvider, maxEntries int) {
+	if maxEntries <= 0 {
+		maxEntries = DefaultResultCacheSize
+	}
+	d.cache = &resultCache{
+		policies:   policies,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// ResultCacheStats reports the result cache's hits, misses and size.
+func (d *Dispatcher) ResultCacheStats() ResultCacheStats {
+	if d.cache == nil {
+		return ResultCacheStats{}
+	}
+	d.cache.mu.Lock()
+	defer d.cache.mu.Unlock()
+	return ResultCacheStats{Hits: d.cache.hits, Misses: d.cache.misses, Entries: d.cache.order.Len()}
+}
+
+// ttl returns how long req's result may be cached. Policy lookup failures
+// are logged and disable caching for the request.
+func (c *resultCache) ttl(ctx context.Context, req *pb.DispatchRequest) time.Duration {
+	ttl, err := c.policies.CachePolicy(ctx, req.Namespace, req.Service.ServiceName, req.MethodName)
+	if err != nil {
+		log.Printf("Warning: cache policy lookup for %s.%s failed: %v", req.Service.ServiceName, req.MethodName, err)
+		return 0
+	}
+	return ttl
+}
+
+// resultKey identifies a request by namespace, target, method and a digest
+// of its input.
+func resultKey(req *pb.DispatchRequest) string {
+	h := sha256.New()
+	for _, part := range []string{req.Namespace, req.TargetCollectorId, req.Service.ServiceName, req.MethodName, req.Input.GetTypeUrl()} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(req.Input.GetValue())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns a copy of the unexpired result for key.
+func (c *resultCache) get(key string) (*pb.DispatchResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if ok && time.Now().Before(el.Value.(*cachedResult).expires) {
+		c.order.MoveToFront(el)
+		c.hits++
+		resp := proto.Clone(el.Value.(*cachedResult).resp).(*pb.DispatchResponse)
+		resp.Cached = true
+		return resp, true
+	}
+	if ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	c.misses++
+	return nil, false
+}
+
+// put stores resp under key for ttl, evicting the least recently used
+// results beyond maxEntries.
+func (c *resultCache) put(key string, resp *pb.DispatchResponse, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cachedResult{key: key, resp: proto.Clone(resp).(*pb.DispatchResponse), expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResult).key)
+	}
+}
@@ -0,0 +1,144 @@
+package dispatch_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// staticPolicies caches the methods it lists for the given TTLs.
+type staticPolicies map[string]time.Duration
+
+func (p staticPolicies) CachePolicy(ctx context.Context, namespace, serviceName, methodName string) (time.Duration, error) {
+	return p[serviceName+"."+methodName], nil
+}
+
+func TestResultCache_ServesRepeatedDispatches(t *testing.T) {
+	ctx := context.Background()
+
+	server1 := setupRealTestServer(t, "collector1", "localhost:0", []string{"pricing"})
+	defer server1.shutdown()
+	server2 := setupRealTestServer(t, "collector2", "localhost:0", []string{"pricing"})
+	defer server2.shutdown()
+
+	var quotes, purchases atomic.Int32
+	server2.dispatcher.RegisterService("pricing", "Pricing", "Quote", func(ctx context.Context, input interface{}) (interface{}, error) {
+		quotes.Add(1)
+		return anypb.New(&pb.Status{Message: "42"})
+	})
+	server2.dispatcher.RegisterService("pricing", "Pricing", "Purchase", func(ctx context.Context, input interface{}) (interface{}, error) {
+		purchases.Add(1)
+		return anypb.New(&pb.Status{Message: "bought"})
+	})
+	if _, err := server1.dispatcher.ConnectTo(ctx, server2.address, []string{"pricing"}); err != nil {
+		t.Fatalf("ConnectTo failed: %v", err)
+	}
+	server1.dispatcher.SetResultCache(staticPolicies{"Pricing.Quote": 200 * time.Millisecond}, 0)
+
+	dispatchMethod := func(method, item string) *pb.DispatchResponse {
+		t.Helper()
+		input, _ := anypb.New(&pb.Status{Message: item})
+		resp, err := server1.dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+			Namespace:         "pricing",
+			Service:           &pb.ServiceTypeRef{ServiceName: "Pricing"},
+			MethodName:        method,
+			Input:             input,
+			TargetCollectorId: "collector2",
+		})
+		if err != nil || resp.Status.Code != 200 {
+			t.Fatalf("Dispatch %s failed: %v (%v)", method, resp, err)
+		}
+		return resp
+	}
+
+	if resp := dispatchMethod("Quote", "widget"); resp.Cached {
+		t.Error("expected the first quote to reach the remote collector")
+	}
+	resp := dispatchMethod("Quote", "widget")
+	if !resp.Cached || resp.HandledByCollectorId != "collector2" || resp.Output == nil {
+		t.Errorf("expected the cached result, got %v", resp)
+	}
+	if n := quotes.Load(); n != 1 {
+		t.Errorf("expected Quote to run once, ran %d times", n)
+	}
+
+	// A different input is a different result
+	if resp := dispatchMethod("Quote", "gadget"); resp.Cached {
+		t.Error("expected a different input to miss the cache")
+	}
+
+	// Methods without a policy are never cached
+	dispatchMethod("Purchase", "widget")
+	if resp := dispatchMethod("Purchase", "widget"); resp.Cached {
+		t.Error("expected Purchase not to be cached")
+	}
+	if n := purchases.Load(); n != 2 {
+		t.Errorf("expected Purchase to run twice, ran %d times", n)
+	}
+
+	// Results expire after the TTL
+	time.Sleep(250 * time.Millisecond)
+	if resp := dispatchMethod("Quote", "widget"); resp.Cached {
+		t.Error("expected the expired result to be refreshed")
+	}
+	if n := quotes.Load(); n != 3 {
+		t.Errorf("expected Quote to run 3 times, ran %d times", n)
+	}
+
+	stats := server1.dispatcher.ResultCacheStats()
+	if stats.Hits != 1 || stats.Misses != 3 || stats.Entries != 2 {
+		t.Errorf("unexpected cache stats: %+v", stats)
+	}
+}
+
+func TestResultCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+
+	server1 := setupRealTestServer(t, "collector1", "localhost:0", []string{"pricing"})
+	defer server1.shutdown()
+	server2 := setupRealTestServer(t, "collector2", "localhost:0", []string{"pricing"})
+	defer server2.shutdown()
+
+	var calls atomic.Int32
+	server2.dispatcher.RegisterService("pricing", "Pricing", "Quote", func(ctx context.Context, input interface{}) (interface{}, error) {
+		calls.Add(1)
+		return anypb.New(&pb.Status{Message: "42"})
+	})
+	if _, err := server1.dispatcher.ConnectTo(ctx, server2.address, []string{"pricing"}); err != nil {
+		t.Fatalf("ConnectTo failed: %v", err)
+	}
+	server1.dispatcher.SetResultCache(staticPolicies{"Pricing.Quote": time.Minute}, 2)
+
+	quote := func(item string) *pb.DispatchResponse {
+		t.Helper()
+		input, _ := anypb.New(&pb.Status{Message: item})
+		resp, err := server1.dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+			Namespace:  "pricing",
+			Service:    &pb.ServiceTypeRef{ServiceName: "Pricing"},
+			MethodName: "Quote",
+			Input:      input,
+		})
+		if err != nil || resp.Status.Code != 200 {
+			t.Fatalf("Dispatch failed: %v (%v)", resp, err)
+		}
+		return resp
+	}
+
+	quote("a")
+	quote("b")
+	quote("a") // a is now the most recently used
+	quote("c") // evicts b
+	if !quote("a").Cached {
+		t.Error("expected a to stay cached")
+	}
+	if quote("b").Cached {
+		t.Error("expected b to be evicted")
+	}
+	if n := calls.Load(); n != 4 {
+		t.Errorf("expected 4 remote calls, got %d", n)
+	}
+}
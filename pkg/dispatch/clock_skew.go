@@ -0,0 +1,55 @@
+package dispatch
+
+import (
+	"log"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// DefaultMaxClockSkew is how far a peer's clock may be from this
+// collector's before handshakes with it warn, and stop advancing the hybrid
+// clock with its HLCs.
+const DefaultMaxClockSkew = collection.DefaultMaxClockSkew
+
+// SetHybridClock sends hlc's HLCs in every handshake and advances it with
+// the peer's, so records written here after a handshake order after those
+// the peer wrote before it. Give it the repository's clock. Call it before
+// serving requests.
+func (d *Dispatcher) SetHybridClock(hlc *collection.HybridClock) {
+	d.connManager.hlc = hlc
+}
+
+// SetMaxClockSkew sets how far a peer's clock may be from this collector's,
+// by the handshake's estimate, before the connection is flagged and a
+// warning logged. Handshakes use DefaultMaxClockSkew until this is called.
+// Call it before serving requests.
+func (d *Dispatcher) SetMaxClockSkew(max time.Duration) {
+	d.connManager.maxSkew = max
+}
+
+// handshakeHLC returns the HLC to send in a handshake, or 0 without a
+// hybrid clock.
+func (cm *ConnectionManager) handshakeHLC() int64 {
+	if cm.hlc == nil {
+		return 0
+	}
+	return int64(cm.hlc.Now())
+}
+
+// checkSkew records skew, the peer's clock less this collector's, on the
+// connection to it. Beyond the maximum it logs a warning and leaves the
+// peer's HLC unobserved, so a clock far ahead does not drag this
+// collector's HLCs ahead of physical time with it.
+func (cm *ConnectionManager) checkSkew(conn *pb.Connection, peer string, skew time.Duration, peerHLC int64) {
+	conn.ClockSkewMs = skew.Milliseconds()
+	conn.ClockSkewExceeded = skew > cm.maxSkew || skew < -cm.maxSkew
+	if conn.ClockSkewExceeded {
+		log.Printf("Warning: clock of collector %s is %s off this collector's, more than the %s allowed; record times and HLCs will not order across the two", peer, skew.Round(time.Millisecond), cm.maxSkew)
+		return
+	}
+	if cm.hlc != nil && peerHLC != 0 {
+		cm.hlc.Observe(collection.HLC(peerHLC))
+	}
+}
@@ -0,0 +1,70 @@
+package dispatch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/accretional/collector/pkg/collection"
+)
+
+func TestClockSkew_DetectedInHandshake(t *testing.T) {
+	ctx := context.Background()
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	server1 := setupRealTestServer(t, "collector1", "localhost:0", []string{"ns1"})
+	defer server1.shutdown()
+	server2 := setupRealTestServer(t, "collector2", "localhost:0", []string{"ns1"})
+	defer server2.shutdown()
+	server3 := setupRealTestServer(t, "collector3", "localhost:0", []string{"ns1"})
+	defer server3.shutdown()
+
+	// collector2 runs 200ms fast, collector3 an hour fast
+	hlc1 := collection.NewHybridClock(collection.NewFixedClock(base))
+	for server, offset := range map[*realTestServer]time.Duration{server1: 0, server2: 200 * time.Millisecond, server3: time.Hour} {
+		clock := collection.NewFixedClock(base.Add(offset))
+		server.dispatcher.SetClock(clock)
+		server.dispatcher.SetHybridClock(collection.NewHybridClock(clock))
+	}
+	server1.dispatcher.SetHybridClock(hlc1)
+
+	for _, s := range []*realTestServer{server2, server3} {
+		if _, err := server1.dispatcher.ConnectTo(ctx, s.address, []string{"ns1"}); err != nil {
+			t.Fatalf("ConnectTo failed: %v", err)
+		}
+	}
+	near := func(got int64, want time.Duration) bool {
+		return time.Duration(got)*time.Millisecond-want < 50*time.Millisecond && want-time.Duration(got)*time.Millisecond < 50*time.Millisecond
+	}
+
+	// Within the maximum, skew is recorded on both ends and HLCs advance
+	conn := circuitOf(t, server1.dispatcher, server2.address)
+	if !near(conn.ClockSkewMs, 200*time.Millisecond) || conn.ClockSkewExceeded {
+		t.Errorf("expected collector2 about 200ms ahead, got %d ms (exceeded %v)", conn.ClockSkewMs, conn.ClockSkewExceeded)
+	}
+	back := server2.dispatcher.GetConnectionManager().ListConnections()[0]
+	if !near(back.ClockSkewMs, -200*time.Millisecond) || back.ClockSkewExceeded {
+		t.Errorf("expected collector1 about 200ms behind, got %d ms", back.ClockSkewMs)
+	}
+	if now := hlc1.Now(); !now.Wall().After(base.Add(100 * time.Millisecond)) {
+		t.Errorf("expected collector1's HLC advanced past collector2's, got %s", now)
+	}
+
+	// Beyond it, the connection is flagged and the peer's HLC ignored
+	conn = circuitOf(t, server1.dispatcher, server3.address)
+	if !near(conn.ClockSkewMs, time.Hour) || !conn.ClockSkewExceeded {
+		t.Errorf("expected collector3 flagged an hour ahead, got %d ms (exceeded %v)", conn.ClockSkewMs, conn.ClockSkewExceeded)
+	}
+	if now := hlc1.Now(); now.Wall().After(base.Add(time.Second)) {
+		t.Errorf("expected collector1's HLC not dragged ahead by collector3, got %s", now)
+	}
+
+	// A looser maximum accepts it
+	server1.dispatcher.SetMaxClockSkew(2 * time.Hour)
+	if _, err := server1.dispatcher.ConnectTo(ctx, server3.address, []string{"ns1"}); err != nil {
+		t.Fatalf("ConnectTo failed: %v", err)
+	}
+	if now := hlc1.Now(); now.Wall().Before(base.Add(time.Hour)) {
+		t.Errorf("expected collector1's HLC advanced past collector3's, got %s", now)
+	}
+}
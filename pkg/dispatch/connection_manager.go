@@ -3,12 +3,14 @@ package dispatch
 import (
 	"context"
 	"fmt"
+	"log"
 	"sync"
 	"time"
 
 	pb "github.com/accretional/collector/gen/collector"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"github.com/accretional/collector/pkg/channelpool"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -17,6 +19,10 @@ type ConnectionManager struct {
 	collectorID string
 	address     string
 	namespaces  []string
+	version     string
+
+	// Optional inventory updated on every handshake
+	inventory CollectorInventory
 
 	// Track active connections
 	connections      map[string]*ConnectionState
@@ -25,13 +31,27 @@ type ConnectionManager struct {
 	// Track client connections to other collectors
 	clients      map[string]pb.CollectiveDispatcherClient
 	clientsMutex sync.RWMutex
+
+	// Circuit breakers for calls to other collectors, by address
+	breakers *peerBreakers
+
+	// Pooled channels to other collectors; closed on CloseAll if ownPool
+	pool    *channelpool.Pool
+	ownPool bool
+
+	// Connection times and IDs; see Dispatcher.SetClock and SetIDGenerator
+	clock collection.Clock
+	ids   collection.IDGenerator
+
+	// Clock skew detection and HLC exchange in handshakes; see clock_skew.go
+	hlc     *collection.HybridClock
+	maxSkew time.Duration
 }
 
 // ConnectionState represents an active connection
 type ConnectionState struct {
 	Connection   *pb.Connection
 	Client       pb.CollectiveDispatcherClient
-	GrpcConn     *grpc.ClientConn
 	LastActivity time.Time
 }
 
@@ -43,7 +63,24 @@ func NewConnectionManager(collectorID, address string, namespaces []string) *Con
 		namespaces:  namespaces,
 		connections: make(map[string]*ConnectionState),
 		clients:     make(map[string]pb.CollectiveDispatcherClient),
+		breakers:    newPeerBreakers(),
+		pool:        channelpool.New(channelpool.Options{}),
+		ownPool:     true,
+		clock:       collection.SystemClock{},
+		ids:         collection.UUIDGenerator{},
+		maxSkew:     DefaultMaxClockSkew,
+	}
+}
+
+// SetChannelPool makes the connection manager reach other collectors through
+// pool, which may be shared with other subsystems and is not closed by
+// CloseAll. It must be called before connecting to any collector.
+func (cm *ConnectionManager) SetChannelPool(pool *channelpool.Pool) {
+	if cm.ownPool {
+		cm.pool.Close()
 	}
+	cm.pool = pool
+	cm.ownPool = false
 }
 
 // HandleConnect processes an incoming connection request
@@ -62,7 +99,8 @@ func (cm *ConnectionManager) HandleConnect(ctx context.Context, req *pb.ConnectR
 	sharedNamespaces := cm.findSharedNamespaces(req.Namespaces)
 
 	// Generate connection ID
-	connectionID := fmt.Sprintf("conn_%s_%d", req.Address, time.Now().UnixNano())
+	connectionID := "conn_" + cm.ids.NewID()
+	now := cm.clock.Now()
 
 	// Extract source collector ID from metadata
 	sourceCollectorID := "unknown"
@@ -79,16 +117,32 @@ func (cm *ConnectionManager) HandleConnect(ctx context.Context, req *pb.ConnectR
 		SharedNamespaces:  sharedNamespaces,
 		Metadata: &pb.Metadata{
 			Labels:    req.Metadata,
-			CreatedAt: timestamppb.Now(),
-			UpdatedAt: timestamppb.Now(),
+			CreatedAt: timestamppb.New(now),
+			UpdatedAt: timestamppb.New(now),
 		},
-		LastActivity: timestamppb.Now(),
+		LastActivity: timestamppb.New(now),
+	}
+
+	// The request was sent one latency before now, which this
+	// underestimates the skew by
+	if req.SentAt != nil {
+		cm.checkSkew(conn, sourceCollectorID, req.SentAt.AsTime().Sub(now), req.Hlc)
 	}
 
 	// Store connection state
 	cm.connections[connectionID] = &ConnectionState{
 		Connection:   conn,
-		LastActivity: time.Now(),
+		LastActivity: now,
+	}
+
+	if sourceCollectorID != "unknown" {
+		cm.observe(ctx, &pb.Collector{
+			Id:           sourceCollectorID,
+			Address:      req.Address,
+			Namespaces:   req.Namespaces,
+			Version:      req.Metadata["version"],
+			IsDirectPeer: true,
+		})
 	}
 
 	return &pb.ConnectResponse{
@@ -99,37 +153,40 @@ func (cm *ConnectionManager) HandleConnect(ctx context.Context, req *pb.ConnectR
 		ConnectionId:      connectionID,
 		SharedNamespaces:  sharedNamespaces,
 		TargetCollectorId: cm.collectorID,
+		Namespaces:        cm.namespaces,
+		Version:           cm.version,
+		HandledAt:         timestamppb.New(now),
+		Hlc:               cm.handshakeHLC(),
 	}, nil
 }
 
 // ConnectTo initiates a connection to another collector
 func (cm *ConnectionManager) ConnectTo(ctx context.Context, address string, namespaces []string) (*pb.ConnectResponse, error) {
-	// Create gRPC connection
-	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create gRPC client: %w", err)
-	}
-
-	// Create dispatcher client
-	client := pb.NewCollectiveDispatcherClient(conn)
+	// Create dispatcher client over the pooled channels to address
+	client := pb.NewCollectiveDispatcherClient(cm.pool.Channel(address))
 
-	// Send connect request
+	// Send connect request, with this collector's clock for the target to
+	// check its own against
+	sent := cm.clock.Now()
 	req := &pb.ConnectRequest{
 		Address:    cm.address,
 		Namespaces: namespaces,
 		Metadata: map[string]string{
 			"collector_id": cm.collectorID,
+			"version":      cm.version,
 		},
+		SentAt: timestamppb.New(sent),
+		Hlc:    cm.handshakeHLC(),
 	}
 
+	start := time.Now()
 	resp, err := client.Connect(ctx, req)
+	roundTrip := time.Since(start)
 	if err != nil {
-		conn.Close()
 		return nil, fmt.Errorf("connect RPC failed: %w", err)
 	}
 
 	if resp.Status.Code != 200 {
-		conn.Close()
 		return resp, fmt.Errorf("connect failed: %s", resp.Status.Message)
 	}
 
@@ -139,6 +196,7 @@ func (cm *ConnectionManager) ConnectTo(ctx context.Context, address string, name
 	cm.clientsMutex.Unlock()
 
 	// Store connection state with shared namespaces and target ID from the response
+	now := cm.clock.Now()
 	connState := &ConnectionState{
 		Connection: &pb.Connection{
 			Id:                resp.ConnectionId,
@@ -148,20 +206,31 @@ func (cm *ConnectionManager) ConnectTo(ctx context.Context, address string, name
 			SharedNamespaces:  resp.SharedNamespaces,
 			Metadata: &pb.Metadata{
 				Labels:    map[string]string{"initiator": "true"},
-				CreatedAt: timestamppb.Now(),
-				UpdatedAt: timestamppb.Now(),
+				CreatedAt: timestamppb.New(now),
+				UpdatedAt: timestamppb.New(now),
 			},
-			LastActivity: timestamppb.Now(),
+			LastActivity: timestamppb.New(now),
 		},
 		Client:       client,
-		GrpcConn:     conn,
-		LastActivity: time.Now(),
+		LastActivity: now,
+	}
+	// The target read its clock about halfway through the round trip
+	if resp.HandledAt != nil {
+		cm.checkSkew(connState.Connection, resp.TargetCollectorId, resp.HandledAt.AsTime().Sub(sent.Add(roundTrip/2)), resp.Hlc)
 	}
 
 	cm.connectionsMutex.Lock()
 	cm.connections[resp.ConnectionId] = connState
 	cm.connectionsMutex.Unlock()
 
+	cm.observe(ctx, &pb.Collector{
+		Id:           resp.TargetCollectorId,
+		Address:      address,
+		Namespaces:   resp.Namespaces,
+		Version:      resp.Version,
+		IsDirectPeer: true,
+	})
+
 	return resp, nil
 }
 
@@ -183,14 +252,17 @@ func (cm *ConnectionManager) GetConnection(connectionID string) (*ConnectionStat
 	return conn, ok
 }
 
-// ListConnections returns all active connections
+// ListConnections returns all active connections, with the circuit breaker
+// state of each peer
 func (cm *ConnectionManager) ListConnections() []*pb.Connection {
 	cm.connectionsMutex.RLock()
 	defer cm.connectionsMutex.RUnlock()
 
 	connections := make([]*pb.Connection, 0, len(cm.connections))
 	for _, state := range cm.connections {
-		connections = append(connections, state.Connection)
+		conn := proto.Clone(state.Connection).(*pb.Connection)
+		cm.breakers.annotate(conn)
+		connections = append(connections, conn)
 	}
 
 	return connections
@@ -202,8 +274,9 @@ func (cm *ConnectionManager) UpdateActivity(connectionID string) {
 	defer cm.connectionsMutex.Unlock()
 
 	if state, ok := cm.connections[connectionID]; ok {
-		state.LastActivity = time.Now()
-		state.Connection.LastActivity = timestamppb.Now()
+		now := cm.clock.Now()
+		state.LastActivity = now
+		state.Connection.LastActivity = timestamppb.New(now)
 	}
 }
 
@@ -212,16 +285,29 @@ func (cm *ConnectionManager) CloseAll() {
 	cm.connectionsMutex.Lock()
 	defer cm.connectionsMutex.Unlock()
 
-	for _, state := range cm.connections {
-		if state.GrpcConn != nil {
-			state.GrpcConn.Close()
-		}
+	if cm.ownPool {
+		cm.pool.Close()
+		cm.pool = channelpool.New(channelpool.Options{})
 	}
 
 	cm.connections = make(map[string]*ConnectionState)
 	cm.clients = make(map[string]pb.CollectiveDispatcherClient)
 }
 
+// observe records a collector in the inventory, if one is configured.
+// Inventory failures never fail the handshake.
+func (cm *ConnectionManager) observe(ctx context.Context, c *pb.Collector) {
+	if cm.inventory == nil || c.Id == "" {
+		return
+	}
+	if c.LastSeen == nil {
+		c.LastSeen = timestamppb.New(cm.clock.Now())
+	}
+	if err := cm.inventory.Observe(ctx, c); err != nil {
+		log.Printf("Warning: failed to record collector %s in inventory: %v", c.Id, err)
+	}
+}
+
 // findSharedNamespaces finds namespaces that are in both lists
 func (cm *ConnectionManager) findSharedNamespaces(requestedNamespaces []string) []string {
 	if len(cm.namespaces) == 0 || len(requestedNamespaces) == 0 {
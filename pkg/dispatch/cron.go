@@ -0,0 +1,11 @@
+package dispatch
+
+import "github.com/accretional/collector/pkg/cron"
+
+// CronSchedule is a parsed cron expression.
+type CronSchedule = cron.Schedule
+
+// ParseCron parses a cron expression; see cron.Parse.
+func ParseCron(expr string) (*CronSchedule, error) {
+	return cron.Parse(expr)
+}
@@ -0,0 +1,71 @@
+package dispatch_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/accretional/collector/pkg/dispatch"
+)
+
+func TestParseCron_Next(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2025, 1, 15, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, 1, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2025, 1, 15, 13, 0, 0, 0, time.UTC)},
+		{"0,30 2 * * *", time.Date(2025, 1, 16, 2, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * mon-fri", time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2025, 1, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either restricted day field matches: the 1st or any Friday
+		{"0 0 1 * fri", time.Date(2025, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2025, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2025, 1, 15, 10, 31, 30, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		c, err := dispatch.ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := c.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: next after %v = %v, want %v", tt.expr, from, got, tt.want)
+		}
+	}
+
+	// Fields are read in the location of the time passed in
+	nyc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	c, _ := dispatch.ParseCron("0 9 * * *")
+	if got := c.Next(from.In(nyc)); !got.Equal(time.Date(2025, 1, 15, 14, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected 9am New York, got %v", got)
+	}
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * * funday",
+		"@every -1m",
+		"@every soon",
+	} {
+		if _, err := dispatch.ParseCron(expr); err == nil {
+			t.Errorf("expected ParseCron(%q) to fail", expr)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Response headers describing a deprecated method. They are sent alongside
+// the deprecation field of ServeResponse and DispatchResponse so callers can
+// spot deprecated calls without inspecting response bodies.
+const (
+	DeprecatedHeader  = "x-collector-deprecated"  // Deprecated method and notice
+	SunsetHeader      = "x-collector-sunset"      // RFC 3339 sunset time
+	ReplacementHeader = "x-collector-replacement" // Suggested replacement
+)
+
+// DeprecationProvider reports the deprecation registered for a method. The
+// registry validators implement it from the deprecations set with the
+// DeprecateService RPC.
+type DeprecationProvider interface {
+	// Deprecation returns the method's deprecation, or nil if it is not
+	// deprecated.
+	Deprecation(ctx context.Context, namespace, serviceName, methodName string) (*pb.Deprecation, error)
+}
+
+// deprecations looks up and enforces method deprecations.
+type deprecations struct {
+	provider      DeprecationProvider
+	enforceSunset bool
+	now           func() time.Time
+}
+
+// SetDeprecations makes Serve and Dispatch report the deprecations provider
+// knows about in their responses and headers. With enforceSunset, calls to a
+// method past its sunset date are refused with code 410 instead. Call it
+// before serving requests.
+func (d *Dispatcher) SetDeprecations(provider DeprecationProvider, enforceSunset bool) {
+	d.deprecations = &deprecations{provider: provider, enforceSunset: enforceSunset, now: func() time.Time { return d.clock.Now() }}
+}
+
+// deprecation returns the deprecation of a method, or a status refusing the
+// call if the method is past its sunset date and sunsets are enforced.
+// Lookup failures are logged and treat the method as not deprecated.
+func (d *Dispatcher) deprecation(ctx context.Context, namespace, serviceName, methodName string) (*pb.Deprecation, *pb.Status) {
+	if d.deprecations == nil {
+		return nil, nil
+	}
+	dep, err := d.deprecations.provider.Deprecation(ctx, namespace, serviceName, methodName)
+	if err != nil {
+		log.Printf("Warning: deprecation lookup for %s.%s failed: %v", serviceName, methodName, err)
+		return nil, nil
+	}
+	if dep == nil {
+		return nil, nil
+	}
+	if d.deprecations.enforceSunset && dep.SunsetAt != nil && !d.deprecations.now().Before(dep.SunsetAt.AsTime()) {
+		msg := fmt.Sprintf("%s.%s was sunset on %s", serviceName, methodName, dep.SunsetAt.AsTime().Format(time.RFC3339))
+		if dep.Replacement != "" {
+			msg += "; use " + dep.Replacement
+		}
+		return dep, &pb.Status{Code: 410, Message: msg}
+	}
+	return dep, nil
+}
+
+// announceDeprecation sends the deprecation headers for a call. It does
+// nothing outside a gRPC call or for methods that are not deprecated.
+func announceDeprecation(ctx context.Context, serviceName, methodName string, dep *pb.Deprecation) {
+	if dep == nil {
+		return
+	}
+	notice := serviceName + "." + methodName
+	if dep.Message != "" {
+		notice += ": " + dep.Message
+	}
+	md := metadata.Pairs(DeprecatedHeader, notice)
+	if dep.SunsetAt != nil {
+		md.Append(SunsetHeader, dep.SunsetAt.AsTime().UTC().Format(time.RFC3339))
+	}
+	if dep.Replacement != "" {
+		md.Append(ReplacementHeader, dep.Replacement)
+	}
+	_ = grpc.SetHeader(ctx, md)
+}
@@ -0,0 +1,138 @@
+package dispatch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/dispatch"
+	"github.com/accretional/collector/pkg/testkit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// staticDeprecations deprecates the methods it lists.
+type staticDeprecations map[string]*pb.Deprecation
+
+func (d staticDeprecations) Deprecation(ctx context.Context, namespace, serviceName, methodName string) (*pb.Deprecation, error) {
+	return d[serviceName+"."+methodName], nil
+}
+
+func TestDeprecation_ReportedToCallers(t *testing.T) {
+	ctx := context.Background()
+
+	mesh := testkit.NewMesh(t, 2, testkit.Options{Namespaces: []string{"billing"}})
+	server := mesh.Collector("collector1")
+	if err := server.RegisterService(ctx, "billing", "Billing", map[string]dispatch.ServiceHandler{
+		"Charge":   testkit.Static(&pb.Status{Message: "charged"}),
+		"ChargeV2": testkit.Static(&pb.Status{Message: "charged"}),
+	}); err != nil {
+		t.Fatalf("RegisterService failed: %v", err)
+	}
+	if err := mesh.ConnectAll(ctx); err != nil {
+		t.Fatalf("ConnectAll failed: %v", err)
+	}
+	sunset := time.Now().Add(30 * 24 * time.Hour).UTC().Truncate(time.Second)
+	server.Dispatcher.SetDeprecations(staticDeprecations{
+		"Billing.Charge": {Message: "use ChargeV2", SunsetAt: timestamppb.New(sunset), Replacement: "Billing.ChargeV2"},
+	}, true)
+
+	// Dispatch through collector0 so the notice travels back from collector1
+	conn, err := mesh.Collector("collector0").Dial()
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewCollectiveDispatcherClient(conn)
+
+	input, _ := anypb.New(&pb.Status{Message: "order-1"})
+	var header metadata.MD
+	resp, err := client.Dispatch(ctx, &pb.DispatchRequest{
+		Namespace:         "billing",
+		Service:           &pb.ServiceTypeRef{ServiceName: "Billing"},
+		MethodName:        "Charge",
+		Input:             input,
+		TargetCollectorId: "collector1",
+	}, grpc.Header(&header))
+	if err != nil || resp.Status.Code != 200 {
+		t.Fatalf("Dispatch failed: %v (%v)", resp, err)
+	}
+	if resp.Deprecation.GetReplacement() != "Billing.ChargeV2" {
+		t.Errorf("expected the deprecation in the response, got %v", resp.Deprecation)
+	}
+	if got := header.Get(dispatch.DeprecatedHeader); len(got) != 1 || got[0] != "Billing.Charge: use ChargeV2" {
+		t.Errorf("unexpected %s header: %v", dispatch.DeprecatedHeader, got)
+	}
+	if got := header.Get(dispatch.SunsetHeader); len(got) != 1 || got[0] != sunset.Format(time.RFC3339) {
+		t.Errorf("unexpected %s header: %v", dispatch.SunsetHeader, got)
+	}
+
+	header = nil
+	resp, err = client.Dispatch(ctx, &pb.DispatchRequest{
+		Namespace:         "billing",
+		Service:           &pb.ServiceTypeRef{ServiceName: "Billing"},
+		MethodName:        "ChargeV2",
+		Input:             input,
+		TargetCollectorId: "collector1",
+	}, grpc.Header(&header))
+	if err != nil || resp.Status.Code != 200 {
+		t.Fatalf("Dispatch failed: %v (%v)", resp, err)
+	}
+	if resp.Deprecation != nil || len(header.Get(dispatch.DeprecatedHeader)) != 0 {
+		t.Errorf("expected ChargeV2 not to be deprecated, got %v and %v", resp.Deprecation, header)
+	}
+}
+
+func TestDeprecation_SunsetEnforcement(t *testing.T) {
+	ctx := context.Background()
+
+	server := setupRealTestServer(t, "collector1", "localhost:0", []string{"billing"})
+	defer server.shutdown()
+
+	var calls int
+	server.dispatcher.RegisterService("billing", "Billing", "Refund", func(ctx context.Context, input interface{}) (interface{}, error) {
+		calls++
+		return anypb.New(&pb.Status{Message: "refunded"})
+	})
+	deprecations := staticDeprecations{
+		"Billing.Refund": {SunsetAt: timestamppb.New(time.Now().Add(-time.Hour)), Replacement: "Payments.Refund"},
+	}
+	input, _ := anypb.New(&pb.Status{Message: "order-1"})
+	req := &pb.DispatchRequest{
+		Namespace:  "billing",
+		Service:    &pb.ServiceTypeRef{ServiceName: "Billing"},
+		MethodName: "Refund",
+		Input:      input,
+	}
+
+	// Without enforcement, sunset methods keep working but are flagged
+	server.dispatcher.SetDeprecations(deprecations, false)
+	resp, err := server.dispatcher.Dispatch(ctx, req)
+	if err != nil || resp.Status.Code != 200 || resp.Deprecation == nil {
+		t.Fatalf("expected a flagged success, got %v (%v)", resp, err)
+	}
+
+	server.dispatcher.SetDeprecations(deprecations, true)
+	resp, err = server.dispatcher.Dispatch(ctx, req)
+	if err != nil {
+		t.Fatalf("Dispatch failed: %v", err)
+	}
+	if resp.Status.Code != 410 || resp.Deprecation == nil {
+		t.Errorf("expected 410 after the sunset, got %v", resp)
+	}
+	serveResp, err := server.dispatcher.Serve(ctx, &pb.ServeRequest{
+		Namespace:  "billing",
+		Service:    &pb.ServiceTypeRef{ServiceName: "Billing"},
+		MethodName: "Refund",
+		Input:      input,
+	})
+	if err != nil || serveResp.Status.Code != 410 {
+		t.Errorf("expected Serve to refuse the sunset method, got %v (%v)", serveResp, err)
+	}
+	if calls != 1 {
+		t.Errorf("expected the handler to run once, ran %d times", calls)
+	}
+}
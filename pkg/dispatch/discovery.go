@@ -0,0 +1,171 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// DefaultDiscoveryMinInterval is the shortest time between discovery runs
+// triggered by requests that could not be routed.
+const DefaultDiscoveryMinInterval = 5 * time.Second
+
+// PeerResolver discovers collector addresses from an external source such as
+// DNS, Consul, or the Kubernetes API.
+type PeerResolver interface {
+	ResolvePeers(ctx context.Context) ([]string, error)
+}
+
+// peerDiscovery tracks resolvers and the collectors they led to.
+type peerDiscovery struct {
+	resolvers []PeerResolver
+	peers     map[string]*pb.Collector // address -> collector from its Connect response
+	last      time.Time
+	stop      chan struct{}
+	mu        sync.Mutex
+}
+
+func newPeerDiscovery() *peerDiscovery {
+	return &peerDiscovery{peers: make(map[string]*pb.Collector)}
+}
+
+// AddPeerResolver adds an external source of collector addresses. Discovered
+// collectors are connected to on demand, when a Dispatch cannot otherwise be
+// routed, or periodically after StartDiscovery.
+func (d *Dispatcher) AddPeerResolver(r PeerResolver) {
+	d.discovery.mu.Lock()
+	defer d.discovery.mu.Unlock()
+	d.discovery.resolvers = append(d.discovery.resolvers, r)
+}
+
+// DiscoverPeers resolves addresses from every resolver and connects to those
+// not yet connected. It returns the number of new connections. Resolver and
+// connection failures are logged and skipped unless nothing could be resolved.
+func (d *Dispatcher) DiscoverPeers(ctx context.Context) (int, error) {
+	d.discovery.mu.Lock()
+	resolvers := append([]PeerResolver(nil), d.discovery.resolvers...)
+	d.discovery.last = time.Now()
+	d.discovery.mu.Unlock()
+
+	var addresses []string
+	var lastErr error
+	for _, r := range resolvers {
+		resolved, err := r.ResolvePeers(ctx)
+		if err != nil {
+			log.Printf("Warning: peer resolver failed: %v", err)
+			lastErr = err
+			continue
+		}
+		addresses = append(addresses, resolved...)
+	}
+	if len(addresses) == 0 && lastErr != nil {
+		return 0, fmt.Errorf("peer discovery failed: %w", lastErr)
+	}
+
+	connected := 0
+	for _, addr := range addresses {
+		if addr == d.connManager.address {
+			continue
+		}
+		if _, ok := d.connManager.GetClient(addr); ok {
+			continue
+		}
+		resp, err := d.connManager.ConnectTo(ctx, addr, d.connManager.Namespaces())
+		if err != nil {
+			log.Printf("Warning: failed to connect to discovered peer %s: %v", addr, err)
+			continue
+		}
+		if resp.TargetCollectorId == d.connManager.collectorID {
+			// Our own address under another name (e.g. a pod IP)
+			continue
+		}
+
+		d.discovery.mu.Lock()
+		d.discovery.peers[addr] = &pb.Collector{
+			Id:           resp.TargetCollectorId,
+			Address:      addr,
+			Namespaces:   resp.Namespaces,
+			Version:      resp.Version,
+			IsDirectPeer: true,
+		}
+		d.discovery.mu.Unlock()
+		connected++
+	}
+	return connected, nil
+}
+
+// StartDiscovery runs DiscoverPeers every interval until Shutdown.
+func (d *Dispatcher) StartDiscovery(interval time.Duration) {
+	d.discovery.mu.Lock()
+	if d.discovery.stop != nil {
+		d.discovery.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	d.discovery.stop = stop
+	d.discovery.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := d.DiscoverPeers(context.Background()); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopDiscovery ends the StartDiscovery loop, if running.
+func (d *Dispatcher) stopDiscovery() {
+	d.discovery.mu.Lock()
+	defer d.discovery.mu.Unlock()
+	if d.discovery.stop != nil {
+		close(d.discovery.stop)
+		d.discovery.stop = nil
+	}
+}
+
+// discoverOnMiss runs discovery for a request that could not be routed,
+// at most once per DefaultDiscoveryMinInterval. It reports whether new
+// collectors were connected.
+func (d *Dispatcher) discoverOnMiss(ctx context.Context) bool {
+	d.discovery.mu.Lock()
+	skip := len(d.discovery.resolvers) == 0 || time.Since(d.discovery.last) < DefaultDiscoveryMinInterval
+	d.discovery.mu.Unlock()
+	if skip {
+		return false
+	}
+
+	n, err := d.DiscoverPeers(ctx)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return n > 0
+}
+
+// discoveredPeers returns discovered collectors that serve namespace.
+func (d *Dispatcher) discoveredPeers(namespace string) []*pb.Collector {
+	d.discovery.mu.Lock()
+	defer d.discovery.mu.Unlock()
+
+	var peers []*pb.Collector
+	for _, c := range d.discovery.peers {
+		for _, ns := range c.Namespaces {
+			if ns == namespace {
+				peers = append(peers, c)
+				break
+			}
+		}
+	}
+	return peers
+}
@@ -0,0 +1,139 @@
+package dispatch_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/dispatch"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestConsulResolver(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/collector" || r.URL.Query().Get("passing") != "true" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 50051}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "10.1.0.2", "Port": 50052}}
+		]`))
+	}))
+	defer consul.Close()
+
+	resolver, err := dispatch.ParsePeerResolver("consul:" + consul.URL + "/collector")
+	if err != nil {
+		t.Fatalf("ParsePeerResolver failed: %v", err)
+	}
+	addresses, err := resolver.ResolvePeers(context.Background())
+	if err != nil {
+		t.Fatalf("ResolvePeers failed: %v", err)
+	}
+	want := []string{"10.0.0.1:50051", "10.1.0.2:50052"}
+	if !reflect.DeepEqual(addresses, want) {
+		t.Errorf("got %v, want %v", addresses, want)
+	}
+}
+
+func TestKubernetesResolver(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/prod/endpoints/collector" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"subsets": [{
+			"addresses": [{"ip": "10.2.0.1"}, {"ip": "10.2.0.2"}],
+			"ports": [{"name": "metrics", "port": 9090}, {"name": "grpc", "port": 50051}]
+		}]}`))
+	}))
+	defer api.Close()
+
+	resolver := &dispatch.KubernetesResolver{
+		APIServer: api.URL,
+		Namespace: "prod",
+		Service:   "collector",
+		PortName:  "grpc",
+		Token:     "secret",
+	}
+	addresses, err := resolver.ResolvePeers(context.Background())
+	if err != nil {
+		t.Fatalf("ResolvePeers failed: %v", err)
+	}
+	want := []string{"10.2.0.1:50051", "10.2.0.2:50051"}
+	if !reflect.DeepEqual(addresses, want) {
+		t.Errorf("got %v, want %v", addresses, want)
+	}
+
+	resolver.Token = "wrong"
+	if _, err := resolver.ResolvePeers(context.Background()); err == nil {
+		t.Error("expected an error for a rejected request")
+	}
+}
+
+func TestParsePeerResolver_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "static:", "consul:http://127.0.0.1:8500", "k8s:collector", "zookeeper:x"} {
+		if _, err := dispatch.ParsePeerResolver(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestDispatch_RoutesThroughDiscovery(t *testing.T) {
+	ctx := context.Background()
+
+	server1 := setupRealTestServer(t, "collector1", "localhost:0", []string{"ns1"})
+	defer server1.shutdown()
+	server2 := setupRealTestServer(t, "collector2", "localhost:0", []string{"remote"})
+	defer server2.shutdown()
+	server3 := setupRealTestServer(t, "collector3", "localhost:0", []string{"other"})
+	defer server3.shutdown()
+
+	server2.dispatcher.RegisterService("remote", "TestService", "TestMethod", func(ctx context.Context, input interface{}) (interface{}, error) {
+		return &anypb.Any{TypeUrl: "test", Value: []byte("from collector2")}, nil
+	})
+	server3.dispatcher.RegisterService("other", "TestService", "TestMethod", func(ctx context.Context, input interface{}) (interface{}, error) {
+		return &anypb.Any{TypeUrl: "test", Value: []byte("from collector3")}, nil
+	})
+
+	// collector1 has no static connections, only a resolver (which also lists itself)
+	server1.dispatcher.AddPeerResolver(dispatch.StaticPeers{server1.address, server2.address, server3.address})
+
+	// Auto-routing to a namespace collector1 does not serve triggers discovery
+	resp, err := server1.dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+		Namespace:  "remote",
+		Service:    &pb.ServiceTypeRef{ServiceName: "TestService"},
+		MethodName: "TestMethod",
+		Input:      &anypb.Any{},
+	})
+	if err != nil {
+		t.Fatalf("Dispatch failed: %v", err)
+	}
+	if resp.Status.Code != 200 || resp.HandledByCollectorId != "collector2" {
+		t.Errorf("expected collector2 to handle the request, got %v", resp)
+	}
+
+	// Discovered collectors are now addressable by ID
+	resp, err = server1.dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+		Namespace:         "other",
+		Service:           &pb.ServiceTypeRef{ServiceName: "TestService"},
+		MethodName:        "TestMethod",
+		Input:             &anypb.Any{},
+		TargetCollectorId: "collector3",
+	})
+	if err != nil {
+		t.Fatalf("Dispatch failed: %v", err)
+	}
+	if resp.Status.Code != 200 || resp.HandledByCollectorId != "collector3" {
+		t.Errorf("expected collector3 to handle the request, got %v", resp)
+	}
+
+	// Re-running discovery does not reconnect to known peers
+	n, err := server1.dispatcher.DiscoverPeers(ctx)
+	if err != nil || n != 0 {
+		t.Errorf("expected no new peers, got %d (%v)", n, err)
+	}
+}
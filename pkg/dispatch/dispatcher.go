@@ -2,12 +2,17 @@ package dispatch
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/channelpool"
+	"github.com/accretional/collector/pkg/collection"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 )
 
@@ -31,6 +36,38 @@ type Dispatcher struct {
 
 	// Optional registry validator for checking if services are registered
 	registryValidator RegistryValidator
+
+	// External peer discovery (DNS SRV, Consul, Kubernetes)
+	discovery *peerDiscovery
+
+	// Cron-scheduled dispatches
+	scheduler *dispatchScheduler
+
+	// Optional cache of results of idempotent methods
+	cache *resultCache
+
+	// Payload size limits and inspection hooks
+	limits     PayloadLimits
+	inspectors []PayloadInspector
+
+	// Optional namespace aliases resolved on every call
+	aliases *collection.NamespaceAliases
+
+	// Optional deprecation notices and sunset enforcement
+	deprecations *deprecations
+
+	// Per-method call counts and latencies
+	metrics *methodMetrics
+
+	// Authenticated principals of peer collectors, and the bearer token this
+	// collector presents to them
+	peerPrincipals map[string]bool
+	peerToken      string
+	peerMu         sync.RWMutex
+
+	// Timestamps and IDs of schedules, runs and connections
+	clock collection.Clock
+	ids   collection.IDGenerator
 }
 
 // NewDispatcher creates a new dispatcher instance
@@ -38,6 +75,11 @@ func NewDispatcher(collectorID, address string, namespaces []string) *Dispatcher
 	return &Dispatcher{
 		connManager: NewConnectionManager(collectorID, address, namespaces),
 		services:    make(map[string]map[string]ServiceHandler),
+		discovery:   newPeerDiscovery(),
+		scheduler:   newDispatchScheduler(),
+		metrics:     newMethodMetrics(),
+		clock:       collection.SystemClock{},
+		ids:         collection.UUIDGenerator{},
 	}
 }
 
@@ -47,6 +89,11 @@ func NewDispatcherWithRegistry(collectorID, address string, namespaces []string,
 		connManager:       NewConnectionManager(collectorID, address, namespaces),
 		services:          make(map[string]map[string]ServiceHandler),
 		registryValidator: validator,
+		discovery:         newPeerDiscovery(),
+		scheduler:         newDispatchScheduler(),
+		metrics:           newMethodMetrics(),
+		clock:             collection.SystemClock{},
+		ids:               collection.UUIDGenerator{},
 	}
 }
 
@@ -55,6 +102,44 @@ func (d *Dispatcher) SetRegistryValidator(validator RegistryValidator) {
 	d.registryValidator = validator
 }
 
+// SetClock sets the clock schedules, runs, connections and sunsets are
+// timed by. Call it before serving requests or starting the scheduler.
+func (d *Dispatcher) SetClock(clock collection.Clock) {
+	d.clock = clock
+	d.connManager.clock = clock
+}
+
+// SetIDGenerator sets the generator of schedule, run and connection IDs.
+// Call it before serving requests or starting the scheduler.
+func (d *Dispatcher) SetIDGenerator(ids collection.IDGenerator) {
+	d.ids = ids
+	d.connManager.ids = ids
+}
+
+// SetChannelPool shares pool's channels for all calls to other collectors.
+// It must be called before connecting to any collector.
+func (d *Dispatcher) SetChannelPool(pool *channelpool.Pool) {
+	d.connManager.SetChannelPool(pool)
+}
+
+// SetVersion sets the version this collector reports during the Connect handshake.
+func (d *Dispatcher) SetVersion(version string) {
+	d.connManager.version = version
+}
+
+// SetInventory records every collector seen during Connect handshakes in inv,
+// starting with this one, and lets Dispatch route to collectors in the
+// inventory that are not currently connected.
+func (d *Dispatcher) SetInventory(ctx context.Context, inv CollectorInventory) error {
+	d.connManager.inventory = inv
+	return inv.Observe(ctx, &pb.Collector{
+		Id:         d.connManager.collectorID,
+		Address:    d.connManager.address,
+		Namespaces: d.connManager.Namespaces(),
+		Version:    d.connManager.version,
+	})
+}
+
 // Connect handles incoming connection requests
 func (d *Dispatcher) Connect(ctx context.Context, req *pb.ConnectRequest) (*pb.ConnectResponse, error) {
 	return d.connManager.HandleConnect(ctx, req)
@@ -62,6 +147,24 @@ func (d *Dispatcher) Connect(ctx context.Context, req *pb.ConnectRequest) (*pb.C
 
 // Serve handles service method invocations from other collectors
 func (d *Dispatcher) Serve(ctx context.Context, req *pb.ServeRequest) (*pb.ServeResponse, error) {
+	caller, principal := d.callerIdentity(ctx)
+	resp, err := d.serve(ctx, caller, principal, req)
+	if err == nil && req.Service != nil {
+		announceDeprecation(ctx, req.Service.ServiceName, req.MethodName, resp.Deprecation)
+	}
+	return resp, err
+}
+
+// serve runs a method on this collector for the collector caller. Dispatch
+// calls it directly for local methods, leaving the deprecation headers to
+// Dispatch.
+func (d *Dispatcher) serve(ctx context.Context, caller, principal string, req *pb.ServeRequest) (resp *pb.ServeResponse, err error) {
+	start := time.Now()
+	resolved := false // set once a handler is found
+	defer func() {
+		d.metrics.observe(StageServe, req.Namespace, req.Service.GetServiceName(), req.MethodName, resolved, time.Since(start), err != nil || resp.GetStatus().GetCode() != 200)
+	}()
+
 	// Validate request
 	if req.Namespace == "" {
 		return &pb.ServeResponse{
@@ -81,6 +184,11 @@ func (d *Dispatcher) Serve(ctx context.Context, req *pb.ServeRequest) (*pb.Serve
 		}, nil
 	}
 
+	if ns := d.aliases.Resolve(req.Namespace); ns != req.Namespace {
+		req = proto.Clone(req).(*pb.ServeRequest)
+		req.Namespace = ns
+	}
+
 	// Validate against registry if validator is configured
 	if d.registryValidator != nil {
 		if err := d.registryValidator.ValidateServiceMethod(ctx, req.Namespace, req.Service.ServiceName, req.MethodName); err != nil {
@@ -93,6 +201,10 @@ func (d *Dispatcher) Serve(ctx context.Context, req *pb.ServeRequest) (*pb.Serve
 		}
 	}
 
+	if denied := d.authorize(ctx, caller, principal, req.Namespace, req.Service.ServiceName, req.MethodName); denied != nil {
+		return &pb.ServeResponse{Status: denied}, nil
+	}
+
 	// Look up the handler
 	d.servicesMutex.RLock()
 	namespaceMethods, ok := d.services[req.Namespace]
@@ -118,6 +230,23 @@ func (d *Dispatcher) Serve(ctx context.Context, req *pb.ServeRequest) (*pb.Serve
 			},
 		}, nil
 	}
+	resolved = true
+
+	dep, rejected := d.deprecation(ctx, req.Namespace, req.Service.ServiceName, req.MethodName)
+	if rejected != nil {
+		return &pb.ServeResponse{Status: rejected, Deprecation: dep}, nil
+	}
+
+	if rejected := d.checkInput(ctx, &Payload{
+		Stage:            StageServe,
+		Namespace:        req.Namespace,
+		ServiceName:      req.Service.ServiceName,
+		MethodName:       req.MethodName,
+		ExecutionContext: req.ExecutionContext,
+		Input:            req.Input,
+	}); rejected != nil {
+		return &pb.ServeResponse{Status: rejected}, nil
+	}
 
 	// Execute the handler
 	output, err := handler(ctx, req.Input)
@@ -129,19 +258,29 @@ func (d *Dispatcher) Serve(ctx context.Context, req *pb.ServeRequest) (*pb.Serve
 			},
 		}, nil
 	}
+	if rejected := d.checkOutput(output.(*anypb.Any)); rejected != nil {
+		return &pb.ServeResponse{Status: rejected}, nil
+	}
 
 	return &pb.ServeResponse{
 		Status: &pb.Status{
 			Code:    200,
 			Message: "OK",
 		},
-		Output:     output.(*anypb.Any),
-		ExecutorId: d.connManager.collectorID,
+		Output:      output.(*anypb.Any),
+		ExecutorId:  d.connManager.collectorID,
+		Deprecation: dep,
 	}, nil
 }
 
 // Dispatch routes a request to the appropriate collector
-func (d *Dispatcher) Dispatch(ctx context.Context, req *pb.DispatchRequest) (*pb.DispatchResponse, error) {
+func (d *Dispatcher) Dispatch(ctx context.Context, req *pb.DispatchRequest) (resp *pb.DispatchResponse, err error) {
+	start := time.Now()
+	routed := false // set once the request is valid and allowed
+	defer func() {
+		d.metrics.observe(StageDispatch, req.Namespace, req.Service.GetServiceName(), req.MethodName, routed && err == nil && reachedHandler(resp.GetStatus().GetCode()), time.Since(start), err != nil || resp.GetStatus().GetCode() != 200)
+	}()
+
 	// Validate request
 	if req.Namespace == "" {
 		return &pb.DispatchResponse{
@@ -161,6 +300,80 @@ func (d *Dispatcher) Dispatch(ctx context.Context, req *pb.DispatchRequest) (*pb
 		}, nil
 	}
 
+	if ns := d.aliases.Resolve(req.Namespace); ns != req.Namespace {
+		req = proto.Clone(req).(*pb.DispatchRequest)
+		req.Namespace = ns
+	}
+
+	caller, principal := d.callerIdentity(ctx)
+	if denied := d.authorize(ctx, caller, principal, req.Namespace, req.Service.ServiceName, req.MethodName); denied != nil {
+		return &pb.DispatchResponse{Status: denied}, nil
+	}
+
+	if rejected := d.checkInput(ctx, &Payload{
+		Stage:             StageDispatch,
+		Namespace:         req.Namespace,
+		ServiceName:       req.Service.ServiceName,
+		MethodName:        req.MethodName,
+		TargetCollectorID: req.TargetCollectorId,
+		Input:             req.Input,
+	}); rejected != nil {
+		return &pb.DispatchResponse{Status: rejected}, nil
+	}
+
+	dep, rejected := d.deprecation(ctx, req.Namespace, req.Service.ServiceName, req.MethodName)
+	if rejected != nil {
+		announceDeprecation(ctx, req.Service.ServiceName, req.MethodName, dep)
+		return &pb.DispatchResponse{Status: rejected, Deprecation: dep}, nil
+	}
+
+	routed = true
+	resp, err = d.dispatchCached(ctx, req)
+	if err == nil {
+		// The serving collector's notice wins over our own registry's
+		if resp.Deprecation == nil {
+			resp.Deprecation = dep
+		}
+		announceDeprecation(ctx, req.Service.ServiceName, req.MethodName, resp.Deprecation)
+	}
+	return resp, err
+}
+
+// reachedHandler reports whether a routed call with status code reached a
+// handler: the serving collector refuses calls of methods it does not serve,
+// and invalid or unauthorized ones, with 404, 400 and 403.
+func reachedHandler(code pb.Status_Code) bool {
+	return code != 400 && code != 403 && code != 404
+}
+
+// dispatchCached answers repeated calls of cacheable methods from the result
+// cache, and routes the rest.
+func (d *Dispatcher) dispatchCached(ctx context.Context, req *pb.DispatchRequest) (*pb.DispatchResponse, error) {
+	var ttl time.Duration
+	var key string
+	if d.cache != nil {
+		if ttl = d.cache.ttl(ctx, req); ttl > 0 {
+			key = resultKey(req)
+			if resp, ok := d.cache.get(key); ok {
+				return resp, nil
+			}
+		}
+	}
+
+	resp, err := d.route(ctx, req)
+	if err == nil {
+		if rejected := d.checkOutput(resp.Output); rejected != nil {
+			return &pb.DispatchResponse{Status: rejected, HandledByCollectorId: resp.HandledByCollectorId}, nil
+		}
+	}
+	if err == nil && ttl > 0 && resp.Status.GetCode() == 200 {
+		d.cache.put(key, resp, ttl)
+	}
+	return resp, err
+}
+
+// route sends a validated request to its target, or auto-routes it.
+func (d *Dispatcher) route(ctx context.Context, req *pb.DispatchRequest) (*pb.DispatchResponse, error) {
 	// If target is specified, route directly
 	if req.TargetCollectorId != "" {
 		return d.dispatchToTarget(ctx, req)
@@ -172,6 +385,7 @@ func (d *Dispatcher) Dispatch(ctx context.Context, req *pb.DispatchRequest) (*pb
 
 // RegisterService registers a service handler for a namespace and method
 func (d *Dispatcher) RegisterService(namespace, serviceName, methodName string, handler ServiceHandler) {
+	namespace = d.aliases.Resolve(namespace)
 	d.servicesMutex.Lock()
 	defer d.servicesMutex.Unlock()
 
@@ -196,17 +410,23 @@ func (d *Dispatcher) GetConnectionManager() *ConnectionManager {
 // dispatchToTarget sends a request to a specific target collector
 func (d *Dispatcher) dispatchToTarget(ctx context.Context, req *pb.DispatchRequest) (*pb.DispatchResponse, error) {
 	// Find connection to target
-	connections := d.connManager.ListConnections()
 	var targetClient pb.CollectiveDispatcherClient
-	var targetAddress string
+	targetAddress := d.connectedAddress(req.TargetCollectorId)
 
-	for _, conn := range connections {
-		if conn.SourceCollectorId == req.TargetCollectorId || conn.TargetCollectorId == req.TargetCollectorId {
-			targetAddress = conn.Address
-			break
+	// Fall back to the inventory for collectors we are not connected to
+	if targetAddress == "" && d.connManager.inventory != nil {
+		if c, err := d.connManager.inventory.Lookup(ctx, req.TargetCollectorId); err == nil && c.Address != "" {
+			if _, err := d.connectToKnown(ctx, c, req.Namespace); err == nil {
+				targetAddress = c.Address
+			}
 		}
 	}
 
+	// Then to external discovery
+	if targetAddress == "" && d.discoverOnMiss(ctx) {
+		targetAddress = d.connectedAddress(req.TargetCollectorId)
+	}
+
 	if targetAddress == "" {
 		return &pb.DispatchResponse{
 			Status: &pb.Status{
@@ -237,7 +457,15 @@ func (d *Dispatcher) dispatchToTarget(ctx context.Context, req *pb.DispatchReque
 		Input:      req.Input,
 	}
 
-	serveResp, err := targetClient.Serve(ctx, serveReq)
+	serveResp, err := d.serveOn(ctx, targetAddress, targetClient, serveReq)
+	if errors.Is(err, ErrCircuitOpen) {
+		return &pb.DispatchResponse{
+			Status: &pb.Status{
+				Code:    503,
+				Message: fmt.Sprintf("circuit open for collector '%s'", req.TargetCollectorId),
+			},
+		}, nil
+	}
 	if err != nil {
 		return &pb.DispatchResponse{
 			Status: &pb.Status{
@@ -251,6 +479,7 @@ func (d *Dispatcher) dispatchToTarget(ctx context.Context, req *pb.DispatchReque
 		Status:               serveResp.Status,
 		Output:               serveResp.Output,
 		HandledByCollectorId: serveResp.ExecutorId,
+		Deprecation:          serveResp.Deprecation,
 	}, nil
 }
 
@@ -265,7 +494,8 @@ func (d *Dispatcher) autoRoute(ctx context.Context, req *pb.DispatchRequest) (*p
 		if hasMethod {
 			d.servicesMutex.RUnlock()
 			// Handle locally
-			serveResp, err := d.Serve(ctx, &pb.ServeRequest{
+			caller, principal := d.callerIdentity(ctx)
+			serveResp, err := d.serve(ctx, caller, principal, &pb.ServeRequest{
 				Namespace:  req.Namespace,
 				Service:    req.Service,
 				MethodName: req.MethodName,
@@ -278,6 +508,7 @@ func (d *Dispatcher) autoRoute(ctx context.Context, req *pb.DispatchRequest) (*p
 				Status:               serveResp.Status,
 				Output:               serveResp.Output,
 				HandledByCollectorId: serveResp.ExecutorId,
+				Deprecation:          serveResp.Deprecation,
 			}, nil
 		}
 	}
@@ -301,9 +532,9 @@ func (d *Dispatcher) autoRoute(ctx context.Context, req *pb.DispatchRequest) (*p
 					Input:      req.Input,
 				}
 
-				serveResp, err := client.Serve(ctx, serveReq)
+				serveResp, err := d.serveOn(ctx, conn.Address, client, serveReq)
 				if err != nil {
-					continue
+					continue // Reroute past failing peers and open circuits
 				}
 
 				if serveResp.Status.Code == 200 {
@@ -311,12 +542,33 @@ func (d *Dispatcher) autoRoute(ctx context.Context, req *pb.DispatchRequest) (*p
 						Status:               serveResp.Status,
 						Output:               serveResp.Output,
 						HandledByCollectorId: serveResp.ExecutorId,
+						Deprecation:          serveResp.Deprecation,
 					}, nil
 				}
 			}
 		}
 	}
 
+	// Try collectors from the inventory that serve this namespace
+	if d.connManager.inventory != nil {
+		known, err := d.connManager.inventory.FindByNamespace(ctx, req.Namespace)
+		if err == nil {
+			if resp := d.routeToKnown(ctx, req, known); resp != nil {
+				return resp, nil
+			}
+		}
+	}
+
+	// Then collectors found through external discovery, discovering more if needed
+	if resp := d.routeToKnown(ctx, req, d.discoveredPeers(req.Namespace)); resp != nil {
+		return resp, nil
+	}
+	if d.discoverOnMiss(ctx) {
+		if resp := d.routeToKnown(ctx, req, d.discoveredPeers(req.Namespace)); resp != nil {
+			return resp, nil
+		}
+	}
+
 	return &pb.DispatchResponse{
 		Status: &pb.Status{
 			Code:    404,
@@ -325,8 +577,66 @@ func (d *Dispatcher) autoRoute(ctx context.Context, req *pb.DispatchRequest) (*p
 	}, nil
 }
 
+// connectedAddress returns the address of the connection to collectorID, or "".
+func (d *Dispatcher) connectedAddress(collectorID string) string {
+	for _, conn := range d.connManager.ListConnections() {
+		if conn.SourceCollectorId == collectorID || conn.TargetCollectorId == collectorID {
+			return conn.Address
+		}
+	}
+	return ""
+}
+
+// routeToKnown serves req on the first of collectors that handles it
+// successfully, connecting as needed. It returns nil if none did.
+func (d *Dispatcher) routeToKnown(ctx context.Context, req *pb.DispatchRequest, collectors []*pb.Collector) *pb.DispatchResponse {
+	for _, c := range collectors {
+		if c.Id == d.connManager.collectorID || c.Address == "" || d.connManager.breakers.blocked(c.Address) {
+			continue
+		}
+		client, err := d.connectToKnown(ctx, c, req.Namespace)
+		if err != nil {
+			continue
+		}
+
+		serveResp, err := d.serveOn(ctx, c.Address, client, &pb.ServeRequest{
+			Namespace:  req.Namespace,
+			Service:    req.Service,
+			MethodName: req.MethodName,
+			Input:      req.Input,
+		})
+		if err == nil && serveResp.Status.Code == 200 {
+			return &pb.DispatchResponse{
+				Status:               serveResp.Status,
+				Output:               serveResp.Output,
+				HandledByCollectorId: serveResp.ExecutorId,
+				Deprecation:          serveResp.Deprecation,
+			}
+		}
+	}
+	return nil
+}
+
+// connectToKnown returns a client for a collector from the inventory or
+// discovery, connecting to it first if needed.
+func (d *Dispatcher) connectToKnown(ctx context.Context, c *pb.Collector, namespace string) (pb.CollectiveDispatcherClient, error) {
+	if client, ok := d.connManager.GetClient(c.Address); ok {
+		return client, nil
+	}
+	if _, err := d.connManager.ConnectTo(ctx, c.Address, []string{namespace}); err != nil {
+		return nil, err
+	}
+	client, ok := d.connManager.GetClient(c.Address)
+	if !ok {
+		return nil, fmt.Errorf("client not found for address '%s'", c.Address)
+	}
+	return client, nil
+}
+
 // Shutdown closes all connections
 func (d *Dispatcher) Shutdown() {
+	d.stopDiscovery()
+	d.stopScheduler()
 	d.connManager.CloseAll()
 }
 
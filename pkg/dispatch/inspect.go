@@ -0,0 +1,110 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// PayloadLimits caps the size of the inputs and outputs of dispatched
+// methods, in bytes of their serialized message. Zero means unlimited.
+type PayloadLimits struct {
+	MaxInputBytes  int
+	MaxOutputBytes int
+}
+
+// PayloadStage is where in the dispatcher a payload is inspected.
+type PayloadStage string
+
+const (
+	// StageDispatch is a Dispatch call on the calling collector, before it
+	// is routed.
+	StageDispatch PayloadStage = "dispatch"
+	// StageServe is a Serve call on the executing collector, before the
+	// handler runs.
+	StageServe PayloadStage = "serve"
+)
+
+// Payload describes a method input about to be executed.
+type Payload struct {
+	Stage       PayloadStage
+	Namespace   string
+	ServiceName string
+	MethodName  string
+	// TargetCollectorID is the collector a Dispatch was addressed to, or ""
+	// when it is auto-routed.
+	TargetCollectorID string
+	TypeURL           string
+	Size              int
+	// ExecutionContext is the Serve request's execution context.
+	ExecutionContext map[string]string
+	// Input is the payload itself, for inspectors that look inside it. It
+	// must not be modified.
+	Input *anypb.Any
+}
+
+// PayloadInspector examines inputs before they are executed, e.g. for data
+// loss prevention or audit logging. Returning an error rejects the call
+// with a 403 status carrying the error's message.
+type PayloadInspector interface {
+	Inspect(ctx context.Context, p *Payload) error
+}
+
+// PayloadInspectorFunc adapts a function to a PayloadInspector.
+type PayloadInspectorFunc func(ctx context.Context, p *Payload) error
+
+// Inspect calls f.
+func (f PayloadInspectorFunc) Inspect(ctx context.Context, p *Payload) error {
+	return f(ctx, p)
+}
+
+// LogPayloads returns an inspector that logs every payload's method and
+// metadata, but not its contents.
+func LogPayloads() PayloadInspector {
+	return PayloadInspectorFunc(func(ctx context.Context, p *Payload) error {
+		log.Printf("%s %s/%s.%s: %s, %d bytes", p.Stage, p.Namespace, p.ServiceName, p.MethodName, p.TypeURL, p.Size)
+		return nil
+	})
+}
+
+// SetPayloadLimits rejects Serve and Dispatch calls whose input or output
+// exceeds limits with a 413 status. Call it before serving requests.
+func (d *Dispatcher) SetPayloadLimits(limits PayloadLimits) {
+	d.limits = limits
+}
+
+// AddPayloadInspector has inspector examine the input of every Dispatch
+// before it is routed and of every Serve before its handler runs.
+// Inspectors run in the order they were added. Call it before serving
+// requests.
+func (d *Dispatcher) AddPayloadInspector(inspector PayloadInspector) {
+	d.inspectors = append(d.inspectors, inspector)
+}
+
+// checkInput enforces the input limit and runs the inspectors, returning
+// the status to reject the call with, or nil.
+func (d *Dispatcher) checkInput(ctx context.Context, p *Payload) *pb.Status {
+	p.TypeURL = p.Input.GetTypeUrl()
+	p.Size = len(p.Input.GetValue())
+	if max := d.limits.MaxInputBytes; max > 0 && p.Size > max {
+		return &pb.Status{Code: 413, Message: fmt.Sprintf("input of %d bytes exceeds the limit of %d", p.Size, max)}
+	}
+	for _, inspector := range d.inspectors {
+		if err := inspector.Inspect(ctx, p); err != nil {
+			return &pb.Status{Code: 403, Message: fmt.Sprintf("rejected by payload inspection: %v", err)}
+		}
+	}
+	return nil
+}
+
+// checkOutput enforces the output limit, returning the status to reject the
+// call with, or nil.
+func (d *Dispatcher) checkOutput(output *anypb.Any) *pb.Status {
+	if max := d.limits.MaxOutputBytes; max > 0 && len(output.GetValue()) > max {
+		return &pb.Status{Code: 413, Message: fmt.Sprintf("output of %d bytes exceeds the limit of %d", len(output.GetValue()), max)}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package dispatch_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/dispatch"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestDispatcher_PayloadLimitsAndInspection(t *testing.T) {
+	ctx := context.Background()
+	d := dispatch.NewDispatcher("collector-1", "localhost:0", []string{"test"})
+	defer d.Shutdown()
+	d.RegisterService("test", "TestService", "Echo", func(ctx context.Context, input interface{}) (interface{}, error) {
+		return input, nil
+	})
+	d.RegisterService("test", "TestService", "Grow", func(ctx context.Context, input interface{}) (interface{}, error) {
+		return anypb.New(&pb.Status{Message: strings.Repeat("x", 200)})
+	})
+	d.SetPayloadLimits(dispatch.PayloadLimits{MaxInputBytes: 100, MaxOutputBytes: 150})
+
+	var seen []*dispatch.Payload
+	d.AddPayloadInspector(dispatch.PayloadInspectorFunc(func(ctx context.Context, p *dispatch.Payload) error {
+		seen = append(seen, p)
+		if strings.Contains(string(p.Input.GetValue()), "ssn=") {
+			return errors.New("input contains an SSN")
+		}
+		return nil
+	}))
+
+	input := func(msg string) *anypb.Any {
+		a, _ := anypb.New(&pb.Status{Message: msg})
+		return a
+	}
+	serve := func(method string, in *anypb.Any) *pb.Status {
+		resp, err := d.Serve(ctx, &pb.ServeRequest{
+			Namespace: "test", Service: &pb.ServiceTypeRef{ServiceName: "TestService"}, MethodName: method, Input: in,
+			ExecutionContext: map[string]string{"caller": "c1"},
+		})
+		if err != nil {
+			t.Fatalf("Serve failed: %v", err)
+		}
+		return resp.Status
+	}
+
+	if st := serve("Echo", input("hello")); st.Code != 200 {
+		t.Fatalf("expected a small input to be served, got %v", st)
+	}
+	if len(seen) != 1 || seen[0].Stage != dispatch.StageServe || seen[0].MethodName != "Echo" ||
+		seen[0].TypeURL != "type.googleapis.com/collector.Status" || seen[0].Size == 0 || seen[0].ExecutionContext["caller"] != "c1" {
+		t.Errorf("unexpected inspected payload %+v", seen)
+	}
+	if st := serve("Echo", input(strings.Repeat("x", 200))); st.Code != 413 {
+		t.Errorf("expected an oversized input to be rejected with 413, got %v", st)
+	}
+	if st := serve("Grow", input("hello")); st.Code != 413 {
+		t.Errorf("expected an oversized output to be rejected with 413, got %v", st)
+	}
+	if st := serve("Echo", input("ssn=123-45-6789")); st.Code != 403 || !strings.Contains(st.Message, "SSN") {
+		t.Errorf("expected the inspector to reject the input with 403, got %v", st)
+	}
+
+	// Dispatch inspects before routing, then Serve inspects again locally
+	seen = nil
+	resp, err := d.Dispatch(ctx, &pb.DispatchRequest{
+		Namespace: "test", Service: &pb.ServiceTypeRef{ServiceName: "TestService"}, MethodName: "Echo", Input: input("hello"),
+	})
+	if err != nil || resp.Status.Code != 200 {
+		t.Fatalf("Dispatch returned %v, %v", resp, err)
+	}
+	if len(seen) != 2 || seen[0].Stage != dispatch.StageDispatch || seen[1].Stage != dispatch.StageServe {
+		t.Errorf("expected dispatch then serve inspection, got %+v", seen)
+	}
+}
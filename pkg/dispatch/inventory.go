@@ -0,0 +1,121 @@
+package dispatch
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// InventoryNamespace and InventoryCollection name the collection that holds
+	// the collector inventory.
+	InventoryNamespace  = "system"
+	InventoryCollection = "collectors"
+)
+
+// CollectorInventory records collectors learned through the Connect handshake
+// and answers lookups used for routing.
+type CollectorInventory interface {
+	// Observe creates or refreshes the entry for a collector.
+	Observe(ctx context.Context, c *pb.Collector) error
+	// Lookup returns the collector with the given ID.
+	Lookup(ctx context.Context, collectorID string) (*pb.Collector, error)
+	// FindByNamespace returns collectors serving namespace, most recently seen first.
+	FindByNamespace(ctx context.Context, namespace string) ([]*pb.Collector, error)
+}
+
+// Inventory is a CollectorInventory stored in a collection, conventionally
+// system/collectors. Each record is a Collector encoded as JSON with proto
+// field names, so the inventory can be searched with the regular Search API
+// (e.g. a filter on "address" or "version").
+type Inventory struct {
+	coll *collection.Collection
+	mu   sync.Mutex
+}
+
+// NewInventory creates an Inventory backed by coll.
+func NewInventory(coll *collection.Collection) *Inventory {
+	return &Inventory{coll: coll}
+}
+
+var inventoryJSON = protojson.MarshalOptions{UseProtoNames: true}
+
+// Observe creates or refreshes the entry for c. LastSeen defaults to now.
+func (inv *Inventory) Observe(ctx context.Context, c *pb.Collector) error {
+	if c.Id == "" {
+		return fmt.Errorf("collector id is required")
+	}
+	if c.LastSeen == nil {
+		c.LastSeen = timestamppb.Now()
+	}
+
+	data, err := inventoryJSON.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to encode collector: %w", err)
+	}
+	record := &pb.CollectionRecord{Id: c.Id, ProtoData: data}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	existing, err := inv.coll.GetRecord(ctx, c.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return inv.coll.CreateRecord(ctx, record)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read collector %s: %w", c.Id, err)
+	}
+	record.Metadata = existing.Metadata
+	return inv.coll.UpdateRecord(ctx, record)
+}
+
+// Lookup returns the collector with the given ID.
+func (inv *Inventory) Lookup(ctx context.Context, collectorID string) (*pb.Collector, error) {
+	record, err := inv.coll.GetRecord(ctx, collectorID)
+	if err != nil {
+		return nil, fmt.Errorf("collector %s not found: %w", collectorID, err)
+	}
+	return decodeCollector(record.ProtoData)
+}
+
+// FindByNamespace returns collectors serving namespace, most recently seen first.
+func (inv *Inventory) FindByNamespace(ctx context.Context, namespace string) ([]*pb.Collector, error) {
+	results, err := inv.coll.Search(ctx, &collection.SearchQuery{
+		Filters: map[string]collection.Filter{
+			"namespaces": {Operator: collection.OpArrayContains, Value: namespace},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search inventory: %w", err)
+	}
+
+	var collectors []*pb.Collector
+	for _, r := range results {
+		c, err := decodeCollector(r.Record.ProtoData)
+		if err != nil {
+			continue
+		}
+		collectors = append(collectors, c)
+	}
+
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].LastSeen.AsTime().After(collectors[j].LastSeen.AsTime())
+	})
+	return collectors, nil
+}
+
+func decodeCollector(data []byte) (*pb.Collector, error) {
+	c := &pb.Collector{}
+	if err := protojson.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to decode collector: %w", err)
+	}
+	return c, nil
+}
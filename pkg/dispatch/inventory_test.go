@@ -0,0 +1,156 @@
+package dispatch_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"github.com/accretional/collector/pkg/dispatch"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// setupInventory creates a system/collectors collection backed by a fresh SQLite store.
+func setupInventory(t *testing.T) (*dispatch.Inventory, *collection.Collection) {
+	t.Helper()
+	store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), "collectors.db"), collection.Options{EnableJSON: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	coll, err := collection.NewCollection(
+		&pb.Collection{Namespace: dispatch.InventoryNamespace, Name: dispatch.InventoryCollection},
+		store,
+		&collection.LocalFileSystem{},
+	)
+	if err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	return dispatch.NewInventory(coll), coll
+}
+
+func TestInventory_UpdatedByHandshake(t *testing.T) {
+	ctx := context.Background()
+
+	server1 := setupRealTestServer(t, "collector1", "localhost:0", []string{"ns1"})
+	defer server1.shutdown()
+	server2 := setupRealTestServer(t, "collector2", "localhost:0", []string{"ns1", "ns2"})
+	defer server2.shutdown()
+
+	inv1, coll1 := setupInventory(t)
+	server1.dispatcher.SetVersion("1.0.0")
+	if err := server1.dispatcher.SetInventory(ctx, inv1); err != nil {
+		t.Fatalf("SetInventory failed: %v", err)
+	}
+	inv2, _ := setupInventory(t)
+	server2.dispatcher.SetVersion("2.0.0")
+	if err := server2.dispatcher.SetInventory(ctx, inv2); err != nil {
+		t.Fatalf("SetInventory failed: %v", err)
+	}
+
+	if _, err := server1.dispatcher.ConnectTo(ctx, server2.address, []string{"ns1"}); err != nil {
+		t.Fatalf("ConnectTo failed: %v", err)
+	}
+
+	// The initiator learns the target's full namespace list and version from the response
+	peer, err := inv1.Lookup(ctx, "collector2")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if peer.Address != server2.address || peer.Version != "2.0.0" || len(peer.Namespaces) != 2 || peer.LastSeen == nil {
+		t.Errorf("unexpected inventory entry: %v", peer)
+	}
+
+	// The target records the initiator from the request
+	peer, err = inv2.Lookup(ctx, "collector1")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if peer.Address != server1.address || peer.Version != "1.0.0" {
+		t.Errorf("unexpected inventory entry: %v", peer)
+	}
+
+	// Each inventory also holds its own collector
+	self, err := inv1.Lookup(ctx, "collector1")
+	if err != nil || self.Version != "1.0.0" {
+		t.Errorf("expected self entry, got %v (%v)", self, err)
+	}
+
+	// Entries are searchable with the regular collection APIs
+	results, err := coll1.Search(ctx, &collection.SearchQuery{
+		Filters: map[string]collection.Filter{
+			"version": {Operator: collection.OpEquals, Value: "2.0.0"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(results) != 1 || results[0].Record.Id != "collector2" {
+		t.Errorf("expected collector2 from search, got %d results", len(results))
+	}
+
+	found, err := inv1.FindByNamespace(ctx, "ns2")
+	if err != nil || len(found) != 1 || found[0].Id != "collector2" {
+		t.Errorf("expected collector2 for ns2, got %v (%v)", found, err)
+	}
+}
+
+func TestDispatch_RoutesThroughInventory(t *testing.T) {
+	ctx := context.Background()
+
+	server1 := setupRealTestServer(t, "collector1", "localhost:0", []string{"ns1"})
+	defer server1.shutdown()
+	server2 := setupRealTestServer(t, "collector2", "localhost:0", []string{"remote"})
+	defer server2.shutdown()
+
+	server2.dispatcher.RegisterService("remote", "TestService", "TestMethod", func(ctx context.Context, input interface{}) (interface{}, error) {
+		return &anypb.Any{TypeUrl: "test", Value: []byte("from collector2")}, nil
+	})
+
+	// collector1 knows about collector2 only through its inventory, with no open connection
+	inv, _ := setupInventory(t)
+	if err := server1.dispatcher.SetInventory(ctx, inv); err != nil {
+		t.Fatalf("SetInventory failed: %v", err)
+	}
+	if err := inv.Observe(ctx, &pb.Collector{Id: "collector2", Address: server2.address, Namespaces: []string{"remote"}}); err != nil {
+		t.Fatalf("Observe failed: %v", err)
+	}
+
+	req := &pb.DispatchRequest{
+		Namespace:  "remote",
+		Service:    &pb.ServiceTypeRef{ServiceName: "TestService"},
+		MethodName: "TestMethod",
+		Input:      &anypb.Any{},
+	}
+
+	// Auto-routing by namespace
+	resp, err := server1.dispatcher.Dispatch(ctx, req)
+	if err != nil {
+		t.Fatalf("Dispatch failed: %v", err)
+	}
+	if resp.Status.Code != 200 || resp.HandledByCollectorId != "collector2" {
+		t.Errorf("expected collector2 to handle auto-routed dispatch, got %v", resp)
+	}
+
+	// Explicit target ID resolved through the inventory
+	server3 := setupRealTestServer(t, "collector3", "localhost:0", []string{"remote"})
+	defer server3.shutdown()
+	server3.dispatcher.RegisterService("remote", "TestService", "TestMethod", func(ctx context.Context, input interface{}) (interface{}, error) {
+		return &anypb.Any{TypeUrl: "test", Value: []byte("from collector3")}, nil
+	})
+	if err := inv.Observe(ctx, &pb.Collector{Id: "collector3", Address: server3.address, Namespaces: []string{"remote"}}); err != nil {
+		t.Fatalf("Observe failed: %v", err)
+	}
+
+	req.TargetCollectorId = "collector3"
+	resp, err = server1.dispatcher.Dispatch(ctx, req)
+	if err != nil {
+		t.Fatalf("Dispatch failed: %v", err)
+	}
+	if resp.Status.Code != 200 || resp.HandledByCollectorId != "collector3" {
+		t.Errorf("expected collector3 to handle targeted dispatch, got %v", resp)
+	}
+}
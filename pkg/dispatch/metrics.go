@@ -0,0 +1,264 @@
+package dispatch
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the method latency
+// histograms.
+var LatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// MaxMethodSeries bounds the methods tracked, so that callers inventing
+// method names cannot grow the metrics without limit. Calls of further
+// methods are only counted in collector_dispatch_untracked_calls_total.
+const MaxMethodSeries = 10000
+
+// DefaultTopMethods is the number of methods TopMethods returns when the
+// request sets no limit.
+const DefaultTopMethods = 10
+
+// UnknownMethod is the namespace, service and method label of calls that
+// did not reach a handler, such as invalid, unauthorized or misrouted ones.
+// Their names come from the caller, so recording them would let callers
+// inventing names fill MaxMethodSeries.
+const UnknownMethod = "unknown"
+
+// methodKey identifies the calls of a method at one stage.
+type methodKey struct {
+	stage     PayloadStage
+	namespace string
+	service   string
+	method    string
+}
+
+// methodSeries accumulates the calls of a method.
+type methodSeries struct {
+	calls      int64
+	failures   int64
+	seconds    float64 // Sum of latencies
+	buckets    []int64 // Per LatencyBuckets, then +Inf; not cumulative
+	lastCalled time.Time
+}
+
+// methodMetrics records Serve and Dispatch calls per method.
+type methodMetrics struct {
+	series    map[methodKey]*methodSeries
+	untracked int64
+	mu        sync.Mutex
+}
+
+func newMethodMetrics() *methodMetrics {
+	return &methodMetrics{series: make(map[methodKey]*methodSeries)}
+}
+
+// observe records a call that took elapsed, under its method if it was
+// resolved to a handler and under UnknownMethod otherwise.
+func (m *methodMetrics) observe(stage PayloadStage, namespace, service, method string, resolved bool, elapsed time.Duration, failed bool) {
+	if !resolved {
+		namespace, service, method = UnknownMethod, UnknownMethod, UnknownMethod
+	}
+	key := methodKey{stage: stage, namespace: namespace, service: service, method: method}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		if len(m.series) >= MaxMethodSeries {
+			m.untracked++
+			return
+		}
+		s = &methodSeries{buckets: make([]int64, len(LatencyBuckets)+1)}
+		m.series[key] = s
+	}
+	s.calls++
+	if failed {
+		s.failures++
+	}
+	secs := elapsed.Seconds()
+	s.seconds += secs
+	s.buckets[sort.SearchFloat64s(LatencyBuckets, secs)]++
+	s.lastCalled = time.Now()
+}
+
+// quantile estimates the q-quantile of the latencies in seconds by linear
+// interpolation within its histogram bucket. Latencies beyond the last
+// bucket are reported as its upper bound.
+func (s *methodSeries) quantile(q float64) float64 {
+	rank := q * float64(s.calls)
+	var seen int64
+	for i, n := range s.buckets {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		if i == len(LatencyBuckets) {
+			return LatencyBuckets[i-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = LatencyBuckets[i-1]
+		}
+		return lower + (LatencyBuckets[i]-lower)*(rank-float64(seen))/float64(n)
+	}
+	return 0
+}
+
+// stats summarizes a series.
+func (s *methodSeries) stats(key methodKey) *pb.MethodStats {
+	st := &pb.MethodStats{
+		Stage:        string(key.stage),
+		Namespace:    key.namespace,
+		ServiceName:  key.service,
+		MethodName:   key.method,
+		Calls:        s.calls,
+		Failures:     s.failures,
+		P50LatencyMs: s.quantile(0.5) * 1000,
+		P99LatencyMs: s.quantile(0.99) * 1000,
+	}
+	if s.calls > 0 {
+		st.FailureRate = float64(s.failures) / float64(s.calls)
+		st.MeanLatencyMs = s.seconds / float64(s.calls) * 1000
+	}
+	if !s.lastCalled.IsZero() {
+		st.LastCalledAt = timestamppb.New(s.lastCalled)
+	}
+	return st
+}
+
+// keys returns the tracked methods in a stable order.
+func (m *methodMetrics) keys() []methodKey {
+	keys := make([]methodKey, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.stage != b.stage {
+			return a.stage < b.stage
+		}
+		if a.namespace != b.namespace {
+			return a.namespace < b.namespace
+		}
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		return a.method < b.method
+	})
+	return keys
+}
+
+// TopMethods returns the most called, most failing or slowest methods this
+// collector has dispatched or served since it started.
+func (d *Dispatcher) TopMethods(ctx context.Context, req *pb.TopMethodsRequest) (*pb.TopMethodsResponse, error) {
+	if req.Stage != "" && req.Stage != string(StageDispatch) && req.Stage != string(StageServe) {
+		return &pb.TopMethodsResponse{
+			Status: &pb.Status{Code: 400, Message: fmt.Sprintf("stage must be %q or %q, got %q", StageDispatch, StageServe, req.Stage)},
+		}, nil
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = DefaultTopMethods
+	}
+
+	d.metrics.mu.Lock()
+	var methods []*pb.MethodStats
+	for _, key := range d.metrics.keys() {
+		if (req.Stage == "" || string(key.stage) == req.Stage) && (req.Namespace == "" || key.namespace == req.Namespace) {
+			methods = append(methods, d.metrics.series[key].stats(key))
+		}
+	}
+	d.metrics.mu.Unlock()
+
+	sort.SliceStable(methods, func(i, j int) bool {
+		a, b := methods[i], methods[j]
+		switch req.OrderBy {
+		case pb.MethodOrder_METHOD_ORDER_FAILURES:
+			return a.Failures > b.Failures
+		case pb.MethodOrder_METHOD_ORDER_LATENCY:
+			return a.P99LatencyMs > b.P99LatencyMs
+		default:
+			return a.Calls > b.Calls
+		}
+	})
+	if len(methods) > limit {
+		methods = methods[:limit]
+	}
+	return &pb.TopMethodsResponse{
+		Status:  &pb.Status{Code: 200, Message: "OK"},
+		Methods: methods,
+	}, nil
+}
+
+// MetricsHandler serves the method metrics in the Prometheus text format:
+// collector_dispatch_calls_total and collector_dispatch_failures_total
+// counters and a collector_dispatch_duration_seconds histogram, labelled by
+// stage, namespace, service and method.
+func (d *Dispatcher) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		d.writeMetrics(bw)
+		bw.Flush()
+	})
+}
+
+// writeMetrics writes the method metrics in the Prometheus text format.
+func (d *Dispatcher) writeMetrics(w *bufio.Writer) {
+	m := d.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := m.keys()
+
+	fmt.Fprintf(w, "# HELP collector_dispatch_calls_total Dispatch and Serve calls by method.\n")
+	fmt.Fprintf(w, "# TYPE collector_dispatch_calls_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "collector_dispatch_calls_total{%s} %d\n", key.labels(), m.series[key].calls)
+	}
+
+	fmt.Fprintf(w, "# HELP collector_dispatch_failures_total Dispatch and Serve calls that did not succeed, by method.\n")
+	fmt.Fprintf(w, "# TYPE collector_dispatch_failures_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "collector_dispatch_failures_total{%s} %d\n", key.labels(), m.series[key].failures)
+	}
+
+	fmt.Fprintf(w, "# HELP collector_dispatch_duration_seconds Dispatch and Serve latency by method.\n")
+	fmt.Fprintf(w, "# TYPE collector_dispatch_duration_seconds histogram\n")
+	for _, key := range keys {
+		s, labels := m.series[key], key.labels()
+		var cumulative int64
+		for i, n := range s.buckets {
+			cumulative += n
+			le := "+Inf"
+			if i < len(LatencyBuckets) {
+				le = strconv.FormatFloat(LatencyBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "collector_dispatch_duration_seconds_bucket{%s,le=%q} %d\n", labels, le, cumulative)
+		}
+		fmt.Fprintf(w, "collector_dispatch_duration_seconds_sum{%s} %g\n", labels, s.seconds)
+		fmt.Fprintf(w, "collector_dispatch_duration_seconds_count{%s} %d\n", labels, s.calls)
+	}
+
+	fmt.Fprintf(w, "# HELP collector_dispatch_untracked_calls_total Calls of methods beyond the tracked limit.\n")
+	fmt.Fprintf(w, "# TYPE collector_dispatch_untracked_calls_total counter\n")
+	fmt.Fprintf(w, "collector_dispatch_untracked_calls_total %d\n", m.untracked)
+}
+
+// labelEscaper escapes Prometheus label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats the key as Prometheus labels.
+func (k methodKey) labels() string {
+	return fmt.Sprintf(`stage="%s",namespace="%s",service="%s",method="%s"`,
+		k.stage, labelEscaper.Replace(k.namespace), labelEscaper.Replace(k.service), labelEscaper.Replace(k.method))
+}
@@ -0,0 +1,139 @@
+package dispatch_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/dispatch"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestMethodMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	server := setupRealTestServer(t, "collector1", "localhost:0", []string{"orders"})
+	defer server.shutdown()
+
+	server.dispatcher.RegisterService("orders", "Orders", "Get", func(ctx context.Context, input interface{}) (interface{}, error) {
+		return anypb.New(&pb.Status{Message: "order"})
+	})
+	server.dispatcher.RegisterService("orders", "Orders", "Ship", func(ctx context.Context, input interface{}) (interface{}, error) {
+		time.Sleep(20 * time.Millisecond)
+		return nil, errors.New("carrier unavailable")
+	})
+
+	input, _ := anypb.New(&pb.Status{Message: "o-1"})
+	dispatchMethod := func(method string) {
+		if _, err := server.dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+			Namespace:  "orders",
+			Service:    &pb.ServiceTypeRef{ServiceName: "Orders"},
+			MethodName: method,
+			Input:      input,
+		}); err != nil {
+			t.Fatalf("Dispatch failed: %v", err)
+		}
+	}
+	for range 3 {
+		dispatchMethod("Get")
+	}
+	dispatchMethod("Ship")
+
+	top, err := server.dispatcher.TopMethods(ctx, &pb.TopMethodsRequest{Stage: "dispatch"})
+	if err != nil || top.Status.Code != 200 {
+		t.Fatalf("TopMethods failed: %v (%v)", top, err)
+	}
+	if len(top.Methods) != 2 || top.Methods[0].MethodName != "Get" || top.Methods[0].Calls != 3 {
+		t.Fatalf("expected Get first with 3 calls, got %v", top.Methods)
+	}
+
+	// Local executions are recorded at the serve stage too
+	top, _ = server.dispatcher.TopMethods(ctx, &pb.TopMethodsRequest{
+		Stage:   "serve",
+		OrderBy: pb.MethodOrder_METHOD_ORDER_FAILURES,
+		Limit:   1,
+	})
+	if len(top.Methods) != 1 {
+		t.Fatalf("expected one method, got %v", top.Methods)
+	}
+	ship := top.Methods[0]
+	if ship.MethodName != "Ship" || ship.Failures != 1 || ship.FailureRate != 1 {
+		t.Errorf("expected Ship to have failed once, got %v", ship)
+	}
+	if ship.P99LatencyMs < 10 || ship.MeanLatencyMs < 20 {
+		t.Errorf("expected at least 20ms of latency, got p99 %.1fms and mean %.1fms", ship.P99LatencyMs, ship.MeanLatencyMs)
+	}
+
+	if resp, _ := server.dispatcher.TopMethods(ctx, &pb.TopMethodsRequest{Stage: "execute"}); resp.Status.Code != 400 {
+		t.Errorf("expected an unknown stage to be rejected, got %v", resp.Status)
+	}
+
+	rec := httptest.NewRecorder()
+	server.dispatcher.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`collector_dispatch_calls_total{stage="dispatch",namespace="orders",service="Orders",method="Get"} 3`,
+		`collector_dispatch_failures_total{stage="serve",namespace="orders",service="Orders",method="Ship"} 1`,
+		`collector_dispatch_duration_seconds_bucket{stage="serve",namespace="orders",service="Orders",method="Ship",le="+Inf"} 1`,
+		`collector_dispatch_duration_seconds_bucket{stage="serve",namespace="orders",service="Orders",method="Ship",le="0.01"} 0`,
+		`collector_dispatch_duration_seconds_count{stage="dispatch",namespace="orders",service="Orders",method="Get"} 3`,
+		"# TYPE collector_dispatch_duration_seconds histogram",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMethodMetrics_UnknownMethods(t *testing.T) {
+	ctx := context.Background()
+
+	server := setupRealTestServer(t, "collector1", "localhost:0", []string{"orders"})
+	defer server.shutdown()
+	server.dispatcher.RegisterService("orders", "Orders", "Get", func(ctx context.Context, input interface{}) (interface{}, error) {
+		return anypb.New(&pb.Status{Message: "order"})
+	})
+
+	// Invented names are not recorded as methods of their own, however many
+	input, _ := anypb.New(&pb.Status{Message: "o-1"})
+	for i := range 50 {
+		resp, err := server.dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+			Namespace:  "orders",
+			Service:    &pb.ServiceTypeRef{ServiceName: "Orders"},
+			MethodName: fmt.Sprintf("Invented%d", i),
+			Input:      input,
+		})
+		if err != nil || resp.Status.Code != 404 {
+			t.Fatalf("expected 404 for an unknown method, got %v, %v", resp, err)
+		}
+	}
+	if _, err := server.dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+		Namespace:  "orders",
+		Service:    &pb.ServiceTypeRef{ServiceName: "Orders"},
+		MethodName: "Get",
+		Input:      input,
+	}); err != nil {
+		t.Fatalf("Dispatch failed: %v", err)
+	}
+
+	top, err := server.dispatcher.TopMethods(ctx, &pb.TopMethodsRequest{Stage: "dispatch"})
+	if err != nil || top.Status.Code != 200 {
+		t.Fatalf("TopMethods failed: %v (%v)", top, err)
+	}
+	if len(top.Methods) != 2 {
+		t.Fatalf("expected Get and the unknown methods, got %v", top.Methods)
+	}
+	unknown := top.Methods[0]
+	if unknown.Namespace != dispatch.UnknownMethod || unknown.ServiceName != dispatch.UnknownMethod || unknown.MethodName != dispatch.UnknownMethod || unknown.Calls != 50 || unknown.Failures != 50 {
+		t.Errorf("expected the invented methods counted as unknown, got %v", unknown)
+	}
+	if get := top.Methods[1]; get.MethodName != "Get" || get.Calls != 1 {
+		t.Errorf("expected Get with 1 call, got %v", get)
+	}
+}
@@ -0,0 +1,110 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// SetNamespaceAliases makes Serve, Dispatch and RegisterService resolve
+// namespace aliases, so calls addressed to an alias reach the services of
+// its namespace. Call it before serving requests.
+func (d *Dispatcher) SetNamespaceAliases(aliases *collection.NamespaceAliases) {
+	d.aliases = aliases
+}
+
+// Namespaces returns the namespaces this collector advertises.
+func (cm *ConnectionManager) Namespaces() []string {
+	cm.connectionsMutex.RLock()
+	defer cm.connectionsMutex.RUnlock()
+	return slices.Clone(cm.namespaces)
+}
+
+// CheckNamespaceUnused reports namespaces that have services registered
+// with the dispatcher.
+func (d *Dispatcher) CheckNamespaceUnused(ctx context.Context, namespace string) error {
+	d.servicesMutex.RLock()
+	defer d.servicesMutex.RUnlock()
+	if len(d.services[namespace]) > 0 {
+		return fmt.Errorf("%w: %s has dispatcher services", collection.ErrNamespaceInUse, namespace)
+	}
+	return nil
+}
+
+// CheckNamespaceRename refuses to rename into a namespace that already has
+// services registered with the dispatcher.
+func (d *Dispatcher) CheckNamespaceRename(ctx context.Context, from, to string) error {
+	if err := d.CheckNamespaceUnused(ctx, to); err != nil {
+		return fmt.Errorf("%w: %w", collection.ErrRenameConflict, err)
+	}
+	return nil
+}
+
+// RenameNamespace moves the services registered under from to to, and
+// advertises to instead of from: in the namespaces sent during Connect
+// handshakes, the inventory entry of this collector, and to the peers this
+// collector connected to, which are reconnected so that they learn the new
+// name. Peers that cannot be reached are logged and learn it on their next
+// handshake.
+func (d *Dispatcher) RenameNamespace(ctx context.Context, from, to string) error {
+	d.servicesMutex.Lock()
+	if methods, ok := d.services[from]; ok {
+		d.services[to] = methods
+		delete(d.services, from)
+	}
+	d.servicesMutex.Unlock()
+
+	cm := d.connManager
+	cm.connectionsMutex.Lock()
+	advertised := slices.Contains(cm.namespaces, from)
+	cm.namespaces = renameIn(cm.namespaces, from, to)
+	var peers []*pb.Connection
+	for _, state := range cm.connections {
+		if !slices.Contains(state.Connection.SharedNamespaces, from) {
+			continue
+		}
+		state.Connection.SharedNamespaces = renameIn(state.Connection.SharedNamespaces, from, to)
+		if state.Connection.Metadata.GetLabels()["initiator"] == "true" {
+			peers = append(peers, state.Connection)
+		}
+	}
+	cm.connectionsMutex.Unlock()
+	if !advertised {
+		return nil
+	}
+
+	cm.observe(ctx, &pb.Collector{
+		Id:         cm.collectorID,
+		Address:    cm.address,
+		Namespaces: cm.Namespaces(),
+		Version:    cm.version,
+	})
+	for _, peer := range peers {
+		if _, err := cm.ConnectTo(ctx, peer.Address, peer.SharedNamespaces); err != nil {
+			log.Printf("Warning: failed to advertise namespace %s to %s: %v", to, peer.Address, err)
+			continue
+		}
+		cm.connectionsMutex.Lock()
+		delete(cm.connections, peer.Id)
+		cm.connectionsMutex.Unlock()
+	}
+	return nil
+}
+
+// renameIn returns namespaces with from replaced by to.
+func renameIn(namespaces []string, from, to string) []string {
+	renamed := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if ns == from {
+			ns = to
+		}
+		if !slices.Contains(renamed, ns) {
+			renamed = append(renamed, ns)
+		}
+	}
+	return renamed
+}
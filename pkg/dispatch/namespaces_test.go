@@ -0,0 +1,60 @@
+package dispatch_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/dispatch"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestDispatcher_NamespaceAliasesAndRename(t *testing.T) {
+	ctx := context.Background()
+	d := dispatch.NewDispatcher("collector-1", "localhost:0", []string{"prod"})
+	defer d.Shutdown()
+	aliases := collection.NewNamespaceAliases()
+	d.SetNamespaceAliases(aliases)
+	d.RegisterService("prod", "Users", "Get", func(ctx context.Context, input interface{}) (interface{}, error) {
+		return input, nil
+	})
+	if err := aliases.Add("production", "prod"); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	input, _ := anypb.New(&pb.Status{Message: "u1"})
+	dispatchTo := func(ns string) *pb.Status {
+		resp, err := d.Dispatch(ctx, &pb.DispatchRequest{
+			Namespace: ns, Service: &pb.ServiceTypeRef{ServiceName: "Users"}, MethodName: "Get", Input: input,
+		})
+		if err != nil {
+			t.Fatalf("Dispatch failed: %v", err)
+		}
+		return resp.Status
+	}
+	if st := dispatchTo("production"); st.Code != 200 {
+		t.Fatalf("expected the alias to reach prod's services, got %v", st)
+	}
+
+	if err := collection.RenameNamespace(ctx, aliases, "prod", "live", false, d); err != nil {
+		t.Fatalf("RenameNamespace failed: %v", err)
+	}
+	if got := d.GetConnectionManager().Namespaces(); len(got) != 1 || got[0] != "live" {
+		t.Errorf("expected live to be advertised, got %v", got)
+	}
+	for _, ns := range []string{"live", "production"} {
+		if st := dispatchTo(ns); st.Code != 200 {
+			t.Errorf("expected %s to reach the renamed services, got %v", ns, st)
+		}
+	}
+	if st := dispatchTo("prod"); st.Code != 404 {
+		t.Errorf("expected the old name to be gone without keep_alias, got %v", st)
+	}
+
+	// A namespace with services cannot become an alias
+	if err := collection.AddNamespaceAlias(ctx, aliases, "live", "other", d); !errors.Is(err, collection.ErrNamespaceInUse) {
+		t.Errorf("expected a namespace with services to be refused as an alias, got %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package dispatch
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// StaticPeers is a PeerResolver for a fixed list of addresses.
+type StaticPeers []string
+
+// ResolvePeers returns the configured addresses.
+func (s StaticPeers) ResolvePeers(ctx context.Context) ([]string, error) {
+	return append([]string(nil), s...), nil
+}
+
+// DNSSRVResolver discovers collectors from DNS SRV records, e.g. a Kubernetes
+// headless service (_grpc._tcp.collector.default.svc.cluster.local).
+type DNSSRVResolver struct {
+	// Service and Proto build the _service._proto.name query; leave both empty
+	// to look up Name directly.
+	Service string
+	Proto   string
+	Name    string
+
+	// Resolver overrides net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+// ResolvePeers looks up the SRV records and returns their host:port targets.
+func (r *DNSSRVResolver) ResolvePeers(ctx context.Context) ([]string, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, records, err := resolver.LookupSRV(ctx, r.Service, r.Proto, r.Name)
+	if err != nil {
+		return nil, fmt.Errorf("SRV lookup for %s failed: %w", r.Name, err)
+	}
+
+	addresses := make([]string, 0, len(records))
+	for _, srv := range records {
+		host := strings.TrimSuffix(srv.Target, ".")
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+	return addresses, nil
+}
+
+// ConsulResolver discovers collectors registered as a Consul service, using
+// the health endpoint so only instances passing their checks are returned.
+type ConsulResolver struct {
+	Address string // Consul HTTP address, e.g. http://127.0.0.1:8500
+	Service string
+	Tag     string // Optional tag filter
+	Token   string // Optional ACL token
+
+	Client *http.Client
+}
+
+// NewConsulResolver creates a resolver for service using the Consul agent at address.
+func NewConsulResolver(address, service string) *ConsulResolver {
+	return &ConsulResolver{Address: address, Service: service}
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// ResolvePeers returns the address of every healthy instance of the service.
+func (r *ConsulResolver) ResolvePeers(ctx context.Context) ([]string, error) {
+	query := url.Values{"passing": {"true"}}
+	if r.Tag != "" {
+		query.Set("tag", r.Tag)
+	}
+	endpoint := strings.TrimSuffix(r.Address, "/") + "/v1/health/service/" + url.PathEscape(r.Service) + "?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.Token != "" {
+		req.Header.Set("X-Consul-Token", r.Token)
+	}
+
+	var entries []consulServiceEntry
+	if err := getJSON(r.Client, req, &entries); err != nil {
+		return nil, fmt.Errorf("consul lookup for %s failed: %w", r.Service, err)
+	}
+
+	addresses := make([]string, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+	return addresses, nil
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesResolver discovers collectors from the ready addresses of a
+// Kubernetes Service's Endpoints object.
+type KubernetesResolver struct {
+	APIServer string // e.g. https://kubernetes.default.svc
+	Namespace string
+	Service   string
+	PortName  string // Endpoint port to use; empty uses the first port
+	Token     string // Bearer token
+
+	Client *http.Client
+}
+
+// NewInClusterKubernetesResolver creates a KubernetesResolver using the pod's
+// service account. An empty namespace means the pod's own namespace.
+func NewInClusterKubernetesResolver(namespace, service, portName string) (*KubernetesResolver, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+
+	token, err := os.ReadFile(path.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	if namespace == "" {
+		ns, err := os.ReadFile(path.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	ca, err := os.ReadFile(path.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid cluster CA certificate")
+	}
+
+	return &KubernetesResolver{
+		APIServer: "https://" + net.JoinHostPort(host, port),
+		Namespace: namespace,
+		Service:   service,
+		PortName:  portName,
+		Token:     strings.TrimSpace(string(token)),
+		Client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+type kubernetesEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// ResolvePeers returns ip:port for every ready endpoint address.
+func (r *KubernetesResolver) ResolvePeers(ctx context.Context) ([]string, error) {
+	endpoint := fmt.Sprintf("%s/api/v1/namespaces/%s/endpoints/%s",
+		strings.TrimSuffix(r.APIServer, "/"), url.PathEscape(r.Namespace), url.PathEscape(r.Service))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+
+	var eps kubernetesEndpoints
+	if err := getJSON(r.Client, req, &eps); err != nil {
+		return nil, fmt.Errorf("endpoints lookup for %s/%s failed: %w", r.Namespace, r.Service, err)
+	}
+
+	var addresses []string
+	for _, subset := range eps.Subsets {
+		port := 0
+		for _, p := range subset.Ports {
+			if r.PortName == "" || p.Name == r.PortName {
+				port = p.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, a := range subset.Addresses {
+			addresses = append(addresses, net.JoinHostPort(a.IP, strconv.Itoa(port)))
+		}
+	}
+	return addresses, nil
+}
+
+// ParsePeerResolver builds a PeerResolver from a spec string:
+//
+//	static:host1:port,host2:port
+//	dns+srv:_grpc._tcp.collector.default.svc.cluster.local
+//	consul:http://127.0.0.1:8500/collector
+//	k8s:namespace/service[:port-name]   (namespace may be empty)
+func ParsePeerResolver(spec string) (PeerResolver, error) {
+	scheme, rest, ok := strings.Cut(spec, ":")
+	if !ok || rest == "" {
+		return nil, fmt.Errorf("invalid peer resolver spec %q", spec)
+	}
+
+	switch scheme {
+	case "static":
+		return StaticPeers(strings.Split(rest, ",")), nil
+	case "dns+srv":
+		return &DNSSRVResolver{Name: rest}, nil
+	case "consul":
+		u, err := url.Parse(rest)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid consul spec %q: expected http://host:port/service", spec)
+		}
+		service := strings.Trim(u.Path, "/")
+		if service == "" {
+			return nil, fmt.Errorf("invalid consul spec %q: missing service name", spec)
+		}
+		u.Path = ""
+		return NewConsulResolver(u.String(), service), nil
+	case "k8s":
+		namespace, service, ok := strings.Cut(rest, "/")
+		if !ok || service == "" {
+			return nil, fmt.Errorf("invalid k8s spec %q: expected namespace/service[:port-name]", spec)
+		}
+		service, portName, _ := strings.Cut(service, ":")
+		return NewInClusterKubernetesResolver(namespace, service, portName)
+	default:
+		return nil, fmt.Errorf("unknown peer resolver %q", scheme)
+	}
+}
+
+// getJSON performs req and decodes a 200 response body into v.
+func getJSON(client *http.Client, req *http.Request, v interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,582 @@
+package dispatch
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// SchedulesNamespace, SchedulesCollection and DispatchesCollection name
+	// the collections that hold scheduled dispatches and their runs.
+	SchedulesNamespace   = "system"
+	SchedulesCollection  = "schedules"
+	DispatchesCollection = "dispatches"
+
+	// DefaultScheduleRunTimeout bounds a single scheduled dispatch.
+	DefaultScheduleRunTimeout = 5 * time.Minute
+
+	defaultScheduleRunsLimit = 100
+)
+
+// ScheduleStore persists scheduled dispatches and the history of their runs.
+type ScheduleStore interface {
+	// SaveSchedule creates or replaces a schedule.
+	SaveSchedule(ctx context.Context, s *pb.ScheduledDispatch) error
+	// DeleteSchedule removes a schedule; its run history is kept.
+	DeleteSchedule(ctx context.Context, id string) error
+	// ListSchedules returns every schedule.
+	ListSchedules(ctx context.Context) ([]*pb.ScheduledDispatch, error)
+	// RecordRun adds a run to the history.
+	RecordRun(ctx context.Context, run *pb.Dispatch) error
+	// ListRuns returns up to limit runs of a schedule, newest first.
+	ListRuns(ctx context.Context, scheduleID string, limit int) ([]*pb.Dispatch, error)
+}
+
+// CollectionScheduleStore is a ScheduleStore kept in two collections,
+// conventionally system/schedules and system/dispatches. Records are
+// ScheduledDispatch and Dispatch messages encoded as JSON with proto field
+// names, so run history can also be searched with the regular Search API
+// (e.g. a filter on "schedule_id" or "result_status.code").
+type CollectionScheduleStore struct {
+	schedules *collection.Collection
+	history   *collection.Collection
+	mu        sync.Mutex
+}
+
+// NewScheduleStore creates a CollectionScheduleStore backed by schedules and history.
+func NewScheduleStore(schedules, history *collection.Collection) *CollectionScheduleStore {
+	return &CollectionScheduleStore{schedules: schedules, history: history}
+}
+
+func (s *CollectionScheduleStore) SaveSchedule(ctx context.Context, sched *pb.ScheduledDispatch) error {
+	data, err := inventoryJSON.Marshal(sched)
+	if err != nil {
+		return fmt.Errorf("failed to encode schedule: %w", err)
+	}
+	record := &pb.CollectionRecord{Id: sched.Id, ProtoData: data}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.schedules.GetRecord(ctx, sched.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.schedules.CreateRecord(ctx, record)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read schedule %s: %w", sched.Id, err)
+	}
+	record.Metadata = existing.Metadata
+	return s.schedules.UpdateRecord(ctx, record)
+}
+
+func (s *CollectionScheduleStore) DeleteSchedule(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.schedules.DeleteRecord(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+func (s *CollectionScheduleStore) ListSchedules(ctx context.Context) ([]*pb.ScheduledDispatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results, err := s.schedules.Search(ctx, &collection.SearchQuery{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schedules: %w", err)
+	}
+	var list []*pb.ScheduledDispatch
+	for _, r := range results {
+		sched := &pb.ScheduledDispatch{}
+		if err := protojson.Unmarshal(r.Record.ProtoData, sched); err != nil {
+			continue
+		}
+		list = append(list, sched)
+	}
+	return list, nil
+}
+
+func (s *CollectionScheduleStore) RecordRun(ctx context.Context, run *pb.Dispatch) error {
+	data, err := inventoryJSON.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("failed to encode run: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.history.CreateRecord(ctx, &pb.CollectionRecord{Id: run.Id, ProtoData: data})
+}
+
+func (s *CollectionScheduleStore) ListRuns(ctx context.Context, scheduleID string, limit int) ([]*pb.Dispatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results, err := s.history.Search(ctx, &collection.SearchQuery{
+		Filters: map[string]collection.Filter{
+			"schedule_id": {Operator: collection.OpEquals, Value: scheduleID},
+		},
+		OrderBy: "started_at",
+		Limit:   limit,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search runs: %w", err)
+	}
+
+	var runs []*pb.Dispatch
+	for _, r := range results {
+		run := &pb.Dispatch{}
+		if err := protojson.Unmarshal(r.Record.ProtoData, run); err != nil {
+			continue
+		}
+		runs = append(runs, run)
+	}
+	sortRuns(runs)
+	return runs, nil
+}
+
+// sortRuns orders runs newest first.
+func sortRuns(runs []*pb.Dispatch) {
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].StartedAt.AsTime().After(runs[j].StartedAt.AsTime())
+	})
+}
+
+// memoryScheduleStore keeps schedules and the latest runs of each in memory;
+// it is used until SetScheduleStore is called.
+type memoryScheduleStore struct {
+	schedules map[string]*pb.ScheduledDispatch
+	runs      map[string][]*pb.Dispatch
+	mu        sync.Mutex
+}
+
+func newMemoryScheduleStore() *memoryScheduleStore {
+	return &memoryScheduleStore{
+		schedules: make(map[string]*pb.ScheduledDispatch),
+		runs:      make(map[string][]*pb.Dispatch),
+	}
+}
+
+func (s *memoryScheduleStore) SaveSchedule(ctx context.Context, sched *pb.ScheduledDispatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedules[sched.Id] = proto.Clone(sched).(*pb.ScheduledDispatch)
+	return nil
+}
+
+func (s *memoryScheduleStore) DeleteSchedule(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.schedules, id)
+	return nil
+}
+
+func (s *memoryScheduleStore) ListSchedules(ctx context.Context) ([]*pb.ScheduledDispatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*pb.ScheduledDispatch, 0, len(s.schedules))
+	for _, sched := range s.schedules {
+		list = append(list, proto.Clone(sched).(*pb.ScheduledDispatch))
+	}
+	return list, nil
+}
+
+func (s *memoryScheduleStore) RecordRun(ctx context.Context, run *pb.Dispatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs := append(s.runs[run.ScheduleId], proto.Clone(run).(*pb.Dispatch))
+	if len(runs) > defaultScheduleRunsLimit {
+		runs = runs[len(runs)-defaultScheduleRunsLimit:]
+	}
+	s.runs[run.ScheduleId] = runs
+	return nil
+}
+
+func (s *memoryScheduleStore) ListRuns(ctx context.Context, scheduleID string, limit int) ([]*pb.Dispatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var runs []*pb.Dispatch
+	for _, run := range s.runs[scheduleID] {
+		runs = append(runs, proto.Clone(run).(*pb.Dispatch))
+	}
+	sortRuns(runs)
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+// scheduleEntry is a registered schedule with its parsed cron expression.
+type scheduleEntry struct {
+	schedule *pb.ScheduledDispatch
+	cron     *CronSchedule
+	loc      *time.Location
+	running  bool
+}
+
+// dispatchScheduler fires scheduled dispatches.
+type dispatchScheduler struct {
+	store   ScheduleStore
+	entries map[string]*scheduleEntry
+	wake    chan struct{}
+	stop    chan struct{}
+	mu      sync.Mutex
+}
+
+func newDispatchScheduler() *dispatchScheduler {
+	return &dispatchScheduler{
+		store:   newMemoryScheduleStore(),
+		entries: make(map[string]*scheduleEntry),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// newScheduleEntry validates a schedule and parses its cron expression.
+func newScheduleEntry(sched *pb.ScheduledDispatch) (*scheduleEntry, error) {
+	t := sched.GetTemplate()
+	if t == nil || t.Namespace == "" || t.Service.GetServiceName() == "" || t.MethodName == "" {
+		return nil, fmt.Errorf("template with namespace, service and method_name is required")
+	}
+	cron, err := ParseCron(sched.Cron)
+	if err != nil {
+		return nil, err
+	}
+	loc := time.UTC
+	if sched.Timezone != "" {
+		if loc, err = time.LoadLocation(sched.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+	return &scheduleEntry{schedule: sched, cron: cron, loc: loc}, nil
+}
+
+// next returns the next tick after t.
+func (e *scheduleEntry) next(t time.Time) *timestamppb.Timestamp {
+	return timestamppb.New(e.cron.Next(t.In(e.loc)))
+}
+
+// SetScheduleStore persists scheduled dispatches and their runs in store and
+// loads the schedules already there. Ticks missed while no collector was
+// running are not made up; each schedule next fires at its first tick from
+// now.
+func (d *Dispatcher) SetScheduleStore(ctx context.Context, store ScheduleStore) error {
+	list, err := store.ListSchedules(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load schedules: %w", err)
+	}
+
+	now := d.clock.Now()
+	entries := make(map[string]*scheduleEntry, len(list))
+	for _, sched := range list {
+		entry, err := newScheduleEntry(sched)
+		if err != nil {
+			log.Printf("Warning: skipping schedule %s: %v", sched.Id, err)
+			continue
+		}
+		sched.NextRunAt = entry.next(now)
+		entries[sched.Id] = entry
+	}
+
+	d.scheduler.mu.Lock()
+	d.scheduler.store = store
+	d.scheduler.entries = entries
+	d.scheduler.mu.Unlock()
+	d.scheduler.notify()
+	return nil
+}
+
+// StartScheduler fires scheduled dispatches until Shutdown.
+func (d *Dispatcher) StartScheduler() {
+	d.scheduler.mu.Lock()
+	if d.scheduler.stop != nil {
+		d.scheduler.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	d.scheduler.stop = stop
+	d.scheduler.mu.Unlock()
+
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			wait := time.Hour
+			if next := d.fireDueSchedules(d.clock.Now()); !next.IsZero() {
+				wait = next.Sub(d.clock.Now())
+			}
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-d.scheduler.wake:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopScheduler ends the StartScheduler loop, if running.
+func (d *Dispatcher) stopScheduler() {
+	d.scheduler.mu.Lock()
+	defer d.scheduler.mu.Unlock()
+	if d.scheduler.stop != nil {
+		close(d.scheduler.stop)
+		d.scheduler.stop = nil
+	}
+}
+
+// notify wakes the scheduler loop to recompute its next tick.
+func (s *dispatchScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fireDueSchedules starts every schedule due at now and returns the time of
+// the next tick, or the zero time if nothing is scheduled. A schedule whose
+// previous run is still going skips the tick.
+func (d *Dispatcher) fireDueSchedules(now time.Time) time.Time {
+	type due struct {
+		entry *scheduleEntry
+		at    time.Time
+	}
+	var fire []due
+	var earliest time.Time
+
+	d.scheduler.mu.Lock()
+	for _, e := range d.scheduler.entries {
+		if e.schedule.Paused {
+			continue
+		}
+		next := e.schedule.NextRunAt.AsTime()
+		if !next.After(now) {
+			if e.running {
+				log.Printf("Warning: schedule %s is still running, skipping its %s tick", e.schedule.Id, next.Format(time.RFC3339))
+			} else {
+				e.running = true
+				fire = append(fire, due{e, next})
+			}
+			e.schedule.NextRunAt = e.next(now)
+			next = e.schedule.NextRunAt.AsTime()
+		}
+		if earliest.IsZero() || next.Before(earliest) {
+			earliest = next
+		}
+	}
+	d.scheduler.mu.Unlock()
+
+	for _, f := range fire {
+		go d.runSchedule(f.entry, f.at)
+	}
+	return earliest
+}
+
+// runSchedule dispatches a schedule's template once and records the run.
+func (d *Dispatcher) runSchedule(e *scheduleEntry, scheduledAt time.Time) {
+	d.scheduler.mu.Lock()
+	req := proto.Clone(e.schedule.Template).(*pb.DispatchRequest)
+	id := e.schedule.Id
+	store := d.scheduler.store
+	d.scheduler.mu.Unlock()
+
+	// Schedules run as this collector, for method ACLs
+	ctx, cancel := context.WithTimeout(collection.WithPrincipal(context.Background(), d.connManager.collectorID), DefaultScheduleRunTimeout)
+	defer cancel()
+
+	run := &pb.Dispatch{
+		Id:                d.ids.NewID(),
+		Namespace:         req.Namespace,
+		Service:           req.Service,
+		MethodName:        req.MethodName,
+		SourceCollectorId: d.connManager.collectorID,
+		ScheduleId:        id,
+		ScheduledAt:       timestamppb.New(scheduledAt),
+		StartedAt:         timestamppb.New(d.clock.Now()),
+	}
+	resp, err := d.Dispatch(ctx, req)
+	if err != nil {
+		run.ResultStatus = &pb.Status{Code: 500, Message: fmt.Sprintf("dispatch failed: %v", err)}
+	} else {
+		run.ResultStatus = resp.Status
+		run.TargetCollectorId = resp.HandledByCollectorId
+	}
+	run.CompletedAt = timestamppb.New(d.clock.Now())
+
+	if err := store.RecordRun(context.Background(), run); err != nil {
+		log.Printf("Warning: failed to record run of schedule %s: %v", id, err)
+	}
+
+	d.scheduler.mu.Lock()
+	e.running = false
+	current := d.scheduler.entries[id] == e
+	if current {
+		e.schedule.LastRunAt = run.StartedAt
+		e.schedule.LastStatus = run.ResultStatus
+	}
+	sched := proto.Clone(e.schedule).(*pb.ScheduledDispatch)
+	d.scheduler.mu.Unlock()
+
+	// A schedule deleted or replaced while it ran keeps only its history
+	if current {
+		if err := store.SaveSchedule(context.Background(), sched); err != nil {
+			log.Printf("Warning: failed to save schedule %s: %v", id, err)
+		}
+	}
+}
+
+// CreateSchedule registers a DispatchRequest template to be dispatched at
+// every tick of a cron expression, replacing any schedule with the same ID.
+// Each run is auto-routed like Dispatch unless the template names a target.
+func (d *Dispatcher) CreateSchedule(ctx context.Context, req *pb.CreateScheduleRequest) (*pb.CreateScheduleResponse, error) {
+	if req.Schedule == nil {
+		return &pb.CreateScheduleResponse{
+			Status: &pb.Status{Code: 400, Message: "schedule is required"},
+		}, nil
+	}
+	sched := proto.Clone(req.Schedule).(*pb.ScheduledDispatch)
+	entry, err := newScheduleEntry(sched)
+	if err != nil {
+		return &pb.CreateScheduleResponse{
+			Status: &pb.Status{Code: 400, Message: err.Error()},
+		}, nil
+	}
+
+	if sched.Id == "" {
+		sched.Id = d.ids.NewID()
+	}
+	now := d.clock.Now()
+	sched.CreatedAt = timestamppb.New(now)
+	sched.LastRunAt, sched.LastStatus = nil, nil
+	sched.NextRunAt = entry.next(now)
+
+	d.scheduler.mu.Lock()
+	store := d.scheduler.store
+	d.scheduler.mu.Unlock()
+	if err := store.SaveSchedule(ctx, sched); err != nil {
+		return &pb.CreateScheduleResponse{
+			Status: &pb.Status{Code: 500, Message: fmt.Sprintf("failed to save schedule: %v", err)},
+		}, nil
+	}
+
+	d.scheduler.mu.Lock()
+	d.scheduler.entries[sched.Id] = entry
+	d.scheduler.mu.Unlock()
+	d.scheduler.notify()
+
+	return &pb.CreateScheduleResponse{
+		Status:   &pb.Status{Code: 200, Message: "OK"},
+		Schedule: proto.Clone(sched).(*pb.ScheduledDispatch),
+	}, nil
+}
+
+// ListSchedules returns every schedule, ordered by ID.
+func (d *Dispatcher) ListSchedules(ctx context.Context, req *pb.ListSchedulesRequest) (*pb.ListSchedulesResponse, error) {
+	d.scheduler.mu.Lock()
+	list := make([]*pb.ScheduledDispatch, 0, len(d.scheduler.entries))
+	for _, e := range d.scheduler.entries {
+		list = append(list, proto.Clone(e.schedule).(*pb.ScheduledDispatch))
+	}
+	d.scheduler.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return &pb.ListSchedulesResponse{
+		Status:    &pb.Status{Code: 200, Message: "OK"},
+		Schedules: list,
+	}, nil
+}
+
+// DeleteSchedule stops and removes a schedule. A run in progress completes.
+func (d *Dispatcher) DeleteSchedule(ctx context.Context, req *pb.DeleteScheduleRequest) (*pb.DeleteScheduleResponse, error) {
+	d.scheduler.mu.Lock()
+	_, ok := d.scheduler.entries[req.Id]
+	delete(d.scheduler.entries, req.Id)
+	store := d.scheduler.store
+	d.scheduler.mu.Unlock()
+
+	if !ok {
+		return &pb.DeleteScheduleResponse{
+			Status: &pb.Status{Code: 404, Message: fmt.Sprintf("schedule '%s' not found", req.Id)},
+		}, nil
+	}
+	if err := store.DeleteSchedule(ctx, req.Id); err != nil {
+		return &pb.DeleteScheduleResponse{
+			Status: &pb.Status{Code: 500, Message: fmt.Sprintf("failed to delete schedule: %v", err)},
+		}, nil
+	}
+	d.scheduler.notify()
+	return &pb.DeleteScheduleResponse{Status: &pb.Status{Code: 200, Message: "OK"}}, nil
+}
+
+// PauseSchedule pauses or resumes a schedule. A resumed schedule next fires
+// at its first tick from now.
+func (d *Dispatcher) PauseSchedule(ctx context.Context, req *pb.PauseScheduleRequest) (*pb.PauseScheduleResponse, error) {
+	d.scheduler.mu.Lock()
+	e, ok := d.scheduler.entries[req.Id]
+	if !ok {
+		d.scheduler.mu.Unlock()
+		return &pb.PauseScheduleResponse{
+			Status: &pb.Status{Code: 404, Message: fmt.Sprintf("schedule '%s' not found", req.Id)},
+		}, nil
+	}
+	if e.schedule.Paused && !req.Paused {
+		e.schedule.NextRunAt = e.next(d.clock.Now())
+	}
+	e.schedule.Paused = req.Paused
+	sched := proto.Clone(e.schedule).(*pb.ScheduledDispatch)
+	store := d.scheduler.store
+	d.scheduler.mu.Unlock()
+
+	if err := store.SaveSchedule(ctx, sched); err != nil {
+		return &pb.PauseScheduleResponse{
+			Status: &pb.Status{Code: 500, Message: fmt.Sprintf("failed to save schedule: %v", err)},
+		}, nil
+	}
+	d.scheduler.notify()
+	return &pb.PauseScheduleResponse{
+		Status:   &pb.Status{Code: 200, Message: "OK"},
+		Schedule: sched,
+	}, nil
+}
+
+// ListScheduleRuns returns the run history of a schedule, newest first.
+func (d *Dispatcher) ListScheduleRuns(ctx context.Context, req *pb.ListScheduleRunsRequest) (*pb.ListScheduleRunsResponse, error) {
+	if req.ScheduleId == "" {
+		return &pb.ListScheduleRunsResponse{
+			Status: &pb.Status{Code: 400, Message: "schedule_id is required"},
+		}, nil
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultScheduleRunsLimit
+	}
+
+	d.scheduler.mu.Lock()
+	store := d.scheduler.store
+	d.scheduler.mu.Unlock()
+
+	runs, err := store.ListRuns(ctx, req.ScheduleId, limit)
+	if err != nil {
+		return &pb.ListScheduleRunsResponse{
+			Status: &pb.Status{Code: 500, Message: err.Error()},
+		}, nil
+	}
+	return &pb.ListScheduleRunsResponse{
+		Status: &pb.Status{Code: 200, Message: "OK"},
+		Runs:   runs,
+	}, nil
+}
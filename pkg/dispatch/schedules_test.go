@@ -0,0 +1,232 @@
+package dispatch_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"github.com/accretional/collector/pkg/dispatch"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// setupScheduleStore creates system/schedules and system/dispatches
+// collections, each backed by a fresh SQLite store.
+func setupScheduleStore(t *testing.T) *dispatch.CollectionScheduleStore {
+	t.Helper()
+	var colls []*collection.Collection
+	for _, name := range []string{dispatch.SchedulesCollection, dispatch.DispatchesCollection} {
+		store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), name+".db"), collection.Options{EnableJSON: true})
+		if err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+
+		coll, err := collection.NewCollection(
+			&pb.Collection{Namespace: dispatch.SchedulesNamespace, Name: name},
+			store,
+			&collection.LocalFileSystem{},
+		)
+		if err != nil {
+			t.Fatalf("failed to create collection: %v", err)
+		}
+		colls = append(colls, coll)
+	}
+	return dispatch.NewScheduleStore(colls[0], colls[1])
+}
+
+// waitForRuns polls ListScheduleRuns until at least n runs are recorded.
+func waitForRuns(t *testing.T, d *dispatch.Dispatcher, id string, n int) []*pb.Dispatch {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := d.ListScheduleRuns(context.Background(), &pb.ListScheduleRunsRequest{ScheduleId: id})
+		if err != nil || resp.Status.Code != 200 {
+			t.Fatalf("ListScheduleRuns failed: %v (%v)", resp, err)
+		}
+		if len(resp.Runs) >= n {
+			return resp.Runs
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("schedule %s did not run %d times", id, n)
+	return nil
+}
+
+func TestSchedule_DispatchesToRemoteCollector(t *testing.T) {
+	ctx := context.Background()
+
+	server1 := setupRealTestServer(t, "collector1", "localhost:0", []string{"jobs"})
+	defer server1.shutdown()
+	server2 := setupRealTestServer(t, "collector2", "localhost:0", []string{"jobs"})
+	defer server2.shutdown()
+
+	server2.dispatcher.RegisterService("jobs", "Maintenance", "Compact", func(ctx context.Context, input interface{}) (interface{}, error) {
+		return anypb.New(&pb.Status{Message: "compacted"})
+	})
+	if _, err := server1.dispatcher.ConnectTo(ctx, server2.address, []string{"jobs"}); err != nil {
+		t.Fatalf("ConnectTo failed: %v", err)
+	}
+
+	store := setupScheduleStore(t)
+	if err := server1.dispatcher.SetScheduleStore(ctx, store); err != nil {
+		t.Fatalf("SetScheduleStore failed: %v", err)
+	}
+	server1.dispatcher.StartScheduler()
+
+	created, err := server1.dispatcher.CreateSchedule(ctx, &pb.CreateScheduleRequest{
+		Schedule: &pb.ScheduledDispatch{
+			Id:   "compact",
+			Cron: "@every 50ms",
+			Template: &pb.DispatchRequest{
+				Namespace:  "jobs",
+				Service:    &pb.ServiceTypeRef{ServiceName: "Maintenance"},
+				MethodName: "Compact",
+			},
+		},
+	})
+	if err != nil || created.Status.Code != 200 {
+		t.Fatalf("CreateSchedule failed: %v (%v)", created, err)
+	}
+	if created.Schedule.NextRunAt == nil || created.Schedule.CreatedAt == nil {
+		t.Errorf("expected the schedule's next run to be set: %v", created.Schedule)
+	}
+
+	runs := waitForRuns(t, server1.dispatcher, "compact", 2)
+	for _, run := range runs {
+		if run.ResultStatus.GetCode() != 200 || run.TargetCollectorId != "collector2" || run.SourceCollectorId != "collector1" {
+			t.Errorf("unexpected run: %v", run)
+		}
+		if run.ScheduledAt == nil || run.StartedAt == nil || run.CompletedAt == nil {
+			t.Errorf("expected run timestamps: %v", run)
+		}
+	}
+	if runs[0].StartedAt.AsTime().Before(runs[1].StartedAt.AsTime()) {
+		t.Errorf("expected newest run first: %v", runs)
+	}
+
+	// Paused schedules stop firing
+	paused, err := server1.dispatcher.PauseSchedule(ctx, &pb.PauseScheduleRequest{Id: "compact", Paused: true})
+	if err != nil || paused.Status.Code != 200 || !paused.Schedule.Paused {
+		t.Fatalf("PauseSchedule failed: %v (%v)", paused, err)
+	}
+	time.Sleep(100 * time.Millisecond) // Let a run already in flight finish
+	before, _ := server1.dispatcher.ListScheduleRuns(ctx, &pb.ListScheduleRunsRequest{ScheduleId: "compact"})
+	time.Sleep(200 * time.Millisecond)
+	after, _ := server1.dispatcher.ListScheduleRuns(ctx, &pb.ListScheduleRunsRequest{ScheduleId: "compact"})
+	if len(after.Runs) != len(before.Runs) {
+		t.Errorf("paused schedule kept running: %d -> %d runs", len(before.Runs), len(after.Runs))
+	}
+
+	// Schedules survive a restart through the store
+	restarted := dispatch.NewDispatcher("collector1", "localhost:0", []string{"jobs"})
+	defer restarted.Shutdown()
+	if err := restarted.SetScheduleStore(ctx, store); err != nil {
+		t.Fatalf("SetScheduleStore failed: %v", err)
+	}
+	list, _ := restarted.ListSchedules(ctx, &pb.ListSchedulesRequest{})
+	if len(list.Schedules) != 1 || !list.Schedules[0].Paused || list.Schedules[0].LastStatus.GetCode() != 200 {
+		t.Errorf("expected the paused schedule with its last status, got %v", list.Schedules)
+	}
+
+	deleted, err := server1.dispatcher.DeleteSchedule(ctx, &pb.DeleteScheduleRequest{Id: "compact"})
+	if err != nil || deleted.Status.Code != 200 {
+		t.Fatalf("DeleteSchedule failed: %v (%v)", deleted, err)
+	}
+	if stored, _ := store.ListSchedules(ctx); len(stored) != 0 {
+		t.Errorf("expected the schedule to be removed from the store, got %v", stored)
+	}
+	// History outlives the schedule
+	if runs, _ := store.ListRuns(ctx, "compact", 1); len(runs) != 1 {
+		t.Errorf("expected to list 1 run, got %d", len(runs))
+	}
+}
+
+func TestSchedule_RecordsFailedRuns(t *testing.T) {
+	ctx := context.Background()
+	d := dispatch.NewDispatcher("collector1", "localhost:0", []string{"jobs"})
+	defer d.Shutdown()
+	d.StartScheduler()
+
+	created, _ := d.CreateSchedule(ctx, &pb.CreateScheduleRequest{
+		Schedule: &pb.ScheduledDispatch{
+			Cron: "@every 20ms",
+			Template: &pb.DispatchRequest{
+				Namespace:  "nowhere",
+				Service:    &pb.ServiceTypeRef{ServiceName: "Maintenance"},
+				MethodName: "Compact",
+			},
+		},
+	})
+	if created.Schedule.GetId() == "" {
+		t.Fatalf("expected a generated schedule ID, got %v", created)
+	}
+
+	runs := waitForRuns(t, d, created.Schedule.Id, 1)
+	if runs[0].ResultStatus.GetCode() != 404 || runs[0].TargetCollectorId != "" {
+		t.Errorf("expected an unroutable run, got %v", runs[0])
+	}
+}
+
+func TestSchedule_InvalidRequests(t *testing.T) {
+	ctx := context.Background()
+	d := dispatch.NewDispatcher("collector1", "localhost:0", []string{"jobs"})
+	defer d.Shutdown()
+
+	template := &pb.DispatchRequest{
+		Namespace:  "jobs",
+		Service:    &pb.ServiceTypeRef{ServiceName: "Maintenance"},
+		MethodName: "Compact",
+	}
+	for name, sched := range map[string]*pb.ScheduledDispatch{
+		"missing template": {Cron: "@hourly"},
+		"missing method":   {Cron: "@hourly", Template: &pb.DispatchRequest{Namespace: "jobs", Service: template.Service}},
+		"bad cron":         {Cron: "every day", Template: template},
+		"bad timezone":     {Cron: "@hourly", Template: template, Timezone: "Mars/Olympus"},
+	} {
+		resp, err := d.CreateSchedule(ctx, &pb.CreateScheduleRequest{Schedule: sched})
+		if err != nil || resp.Status.Code != 400 {
+			t.Errorf("%s: expected 400, got %v (%v)", name, resp, err)
+		}
+	}
+
+	if resp, _ := d.DeleteSchedule(ctx, &pb.DeleteScheduleRequest{Id: "missing"}); resp.Status.Code != 404 {
+		t.Errorf("expected 404, got %v", resp)
+	}
+	if resp, _ := d.PauseSchedule(ctx, &pb.PauseScheduleRequest{Id: "missing", Paused: true}); resp.Status.Code != 404 {
+		t.Errorf("expected 404, got %v", resp)
+	}
+	if resp, _ := d.ListScheduleRuns(ctx, &pb.ListScheduleRunsRequest{}); resp.Status.Code != 400 {
+		t.Errorf("expected 400, got %v", resp)
+	}
+}
+
+func TestSchedule_ClockAndIDs(t *testing.T) {
+	ctx := context.Background()
+	d := dispatch.NewDispatcher("collector1", "localhost:0", []string{"jobs"})
+	defer d.Shutdown()
+	now := time.Date(2024, 5, 9, 8, 15, 0, 0, time.UTC)
+	d.SetClock(collection.NewFixedClock(now))
+	d.SetIDGenerator(&collection.SequentialIDs{Prefix: "sched-"})
+
+	created, _ := d.CreateSchedule(ctx, &pb.CreateScheduleRequest{
+		Schedule: &pb.ScheduledDispatch{
+			Cron: "0 9 * * *",
+			Template: &pb.DispatchRequest{
+				Namespace:  "jobs",
+				Service:    &pb.ServiceTypeRef{ServiceName: "Maintenance"},
+				MethodName: "Compact",
+			},
+		},
+	})
+	if created.Status.Code != 200 {
+		t.Fatalf("CreateSchedule failed: %v", created.Status)
+	}
+	s := created.Schedule
+	if s.Id != "sched-1" || !s.CreatedAt.AsTime().Equal(now) || !s.NextRunAt.AsTime().Equal(now.Add(45*time.Minute)) {
+		t.Errorf("expected times from the fixed clock and a sequential ID, got %v", s)
+	}
+}
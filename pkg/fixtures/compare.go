@@ -0,0 +1,177 @@
+package fixtures
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+)
+
+// listPageSize is the page size used when reading records for comparison.
+const listPageSize = 500
+
+// CompareOptions controls which aspects of two collections must match.
+type CompareOptions struct {
+	// IgnoreTimestamps skips created_at/updated_at, e.g. for copies that re-stamp records.
+	IgnoreTimestamps bool
+	// IgnoreFiles skips the filesystem comparison.
+	IgnoreFiles bool
+}
+
+// Difference is a single mismatch between two collections.
+type Difference struct {
+	Path   string // e.g. "records/item-00001" or "files/attachments/file-0001.bin"
+	Reason string
+}
+
+func (d Difference) String() string { return d.Path + ": " + d.Reason }
+
+// Equal reports whether two collections are semantically equal under opts.
+func Equal(ctx context.Context, a, b *collection.Collection, opts CompareOptions) (bool, error) {
+	diffs, err := Diff(ctx, a, b, opts)
+	if err != nil {
+		return false, err
+	}
+	return len(diffs) == 0, nil
+}
+
+// Diff compares two collections and returns their differences, sorted by path.
+// Record payloads that are valid JSON are compared structurally, so key order
+// and whitespace do not matter; other payloads are compared byte for byte.
+func Diff(ctx context.Context, a, b *collection.Collection, opts CompareOptions) ([]Difference, error) {
+	recordsA, err := loadRecords(ctx, a)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read records from %s/%s: %w", a.GetNamespace(), a.GetName(), err)
+	}
+	recordsB, err := loadRecords(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read records from %s/%s: %w", b.GetNamespace(), b.GetName(), err)
+	}
+
+	var diffs []Difference
+	for id, ra := range recordsA {
+		path := "records/" + id
+		rb, ok := recordsB[id]
+		if !ok {
+			diffs = append(diffs, Difference{Path: path, Reason: "missing from second collection"})
+			continue
+		}
+		if reason := compareRecords(ra, rb, opts); reason != "" {
+			diffs = append(diffs, Difference{Path: path, Reason: reason})
+		}
+	}
+	for id := range recordsB {
+		if _, ok := recordsA[id]; !ok {
+			diffs = append(diffs, Difference{Path: "records/" + id, Reason: "missing from first collection"})
+		}
+	}
+
+	if !opts.IgnoreFiles && a.FS != nil && b.FS != nil {
+		fileDiffs, err := diffFiles(ctx, a.FS, b.FS)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, fileDiffs...)
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs, nil
+}
+
+func loadRecords(ctx context.Context, c *collection.Collection) (map[string]*pb.CollectionRecord, error) {
+	records := make(map[string]*pb.CollectionRecord)
+	for offset := 0; ; offset += listPageSize {
+		page, err := c.ListRecords(ctx, offset, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page {
+			records[r.Id] = r
+		}
+		if len(page) < listPageSize {
+			return records, nil
+		}
+	}
+}
+
+func compareRecords(a, b *pb.CollectionRecord, opts CompareOptions) string {
+	if !payloadEqual(a.ProtoData, b.ProtoData) {
+		return "payload differs"
+	}
+	if a.DataUri != b.DataUri {
+		return fmt.Sprintf("data_uri %q != %q", a.DataUri, b.DataUri)
+	}
+
+	labelsA, labelsB := a.GetMetadata().GetLabels(), b.GetMetadata().GetLabels()
+	if len(labelsA) != len(labelsB) || (len(labelsA) > 0 && !reflect.DeepEqual(labelsA, labelsB)) {
+		return fmt.Sprintf("labels %v != %v", labelsA, labelsB)
+	}
+
+	if !opts.IgnoreTimestamps {
+		if a.GetMetadata().GetCreatedAt().GetSeconds() != b.GetMetadata().GetCreatedAt().GetSeconds() {
+			return "created_at differs"
+		}
+		if a.GetMetadata().GetUpdatedAt().GetSeconds() != b.GetMetadata().GetUpdatedAt().GetSeconds() {
+			return "updated_at differs"
+		}
+	}
+	return ""
+}
+
+func payloadEqual(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func diffFiles(ctx context.Context, a, b collection.FileSystem) ([]Difference, error) {
+	filesA, err := a.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+	filesB, err := b.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	inB := make(map[string]bool, len(filesB))
+	for _, f := range filesB {
+		inB[f] = true
+	}
+
+	var diffs []Difference
+	for _, f := range filesA {
+		path := "files/" + f
+		if !inB[f] {
+			diffs = append(diffs, Difference{Path: path, Reason: "missing from second collection"})
+			continue
+		}
+		delete(inB, f)
+
+		contentA, err := a.Load(ctx, f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", f, err)
+		}
+		contentB, err := b.Load(ctx, f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", f, err)
+		}
+		if !bytes.Equal(contentA, contentB) {
+			diffs = append(diffs, Difference{Path: path, Reason: "content differs"})
+		}
+	}
+	for f := range inB {
+		diffs = append(diffs, Difference{Path: "files/" + f, Reason: "missing from first collection"})
+	}
+	return diffs, nil
+}
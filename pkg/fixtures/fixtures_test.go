@@ -0,0 +1,166 @@
+package fixtures_test
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/fixtures"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+)
+
+var spec = fixtures.Spec{Seed: 7, Records: 120, Files: 3}
+
+func TestSpecIsDeterministic(t *testing.T) {
+	first, second := spec.GenerateRecords(), spec.GenerateRecords()
+	if len(first) != 120 {
+		t.Fatalf("expected 120 records, got %d", len(first))
+	}
+	for i := range first {
+		if !proto.Equal(first[i], second[i]) {
+			t.Fatalf("record %d differs between runs", i)
+		}
+	}
+
+	other := fixtures.Spec{Seed: 8, Records: 120}.GenerateRecords()
+	if proto.Equal(first[0], other[0]) {
+		t.Error("expected a different seed to produce different content")
+	}
+}
+
+func TestDescriptorIsValid(t *testing.T) {
+	if _, err := protodesc.NewFile(fixtures.Descriptor("fixtures"), nil); err != nil {
+		t.Fatalf("descriptor does not build: %v", err)
+	}
+}
+
+func TestGeneratedCollectionsAreEqual(t *testing.T) {
+	ctx := context.Background()
+
+	a, err := fixtures.NewCollection(ctx, t.TempDir(), spec)
+	if err != nil {
+		t.Fatalf("NewCollection failed: %v", err)
+	}
+	defer a.Close()
+
+	b, err := fixtures.NewCollection(ctx, t.TempDir(), spec)
+	if err != nil {
+		t.Fatalf("NewCollection failed: %v", err)
+	}
+	defer b.Close()
+
+	diffs, err := fixtures.Diff(ctx, a, b, fixtures.CompareOptions{})
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected identical collections, got %v", diffs)
+	}
+}
+
+func TestDiffReportsChanges(t *testing.T) {
+	ctx := context.Background()
+
+	a, err := fixtures.NewCollection(ctx, t.TempDir(), spec)
+	if err != nil {
+		t.Fatalf("NewCollection failed: %v", err)
+	}
+	defer a.Close()
+
+	b, err := fixtures.NewCollection(ctx, t.TempDir(), spec)
+	if err != nil {
+		t.Fatalf("NewCollection failed: %v", err)
+	}
+	defer b.Close()
+
+	// Re-encoding the payload reorders its keys, which must still compare equal
+	record, err := b.GetRecord(ctx, "item-00000")
+	if err != nil {
+		t.Fatalf("GetRecord failed: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(record.ProtoData, &doc); err != nil {
+		t.Fatalf("invalid fixture JSON: %v", err)
+	}
+	if record.ProtoData, err = json.Marshal(doc); err != nil {
+		t.Fatalf("failed to re-encode payload: %v", err)
+	}
+	if err := b.UpdateRecord(ctx, record); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+
+	if err := b.UpdateRecord(ctx, &pb.CollectionRecord{
+		Id:        "item-00001",
+		ProtoData: []byte(`{"title": "changed"}`),
+		Metadata:  spec.GenerateRecords()[1].Metadata,
+	}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if err := b.DeleteRecord(ctx, "item-00002"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if err := b.SaveFile(ctx, filepath.Join("attachments", "file-0000.bin"), &pb.CollectionData{
+		Content: &pb.CollectionData_Data{Data: []byte("tampered")},
+	}); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+
+	diffs, err := fixtures.Diff(ctx, a, b, fixtures.CompareOptions{IgnoreTimestamps: true})
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+
+	want := []string{
+		"files/attachments/file-0000.bin",
+		"records/item-00001",
+		"records/item-00002",
+	}
+	if len(diffs) != len(want) {
+		t.Fatalf("expected %d differences, got %v", len(want), diffs)
+	}
+	for i, d := range diffs {
+		if d.Path != want[i] {
+			t.Errorf("difference %d: expected %s, got %s", i, want[i], d)
+		}
+	}
+
+	if equal, _ := fixtures.Equal(ctx, a, b, fixtures.CompareOptions{IgnoreTimestamps: true, IgnoreFiles: true}); equal {
+		t.Error("expected collections to differ")
+	}
+}
+
+func TestCloneEqualsSource(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	src, err := fixtures.NewCollection(ctx, filepath.Join(dir, "src"), spec)
+	if err != nil {
+		t.Fatalf("NewCollection failed: %v", err)
+	}
+	defer src.Close()
+
+	// A clone via the transport layer must be equal to its source
+	transport := &collection.SqliteTransport{}
+	destPath := filepath.Join(dir, "clone", "collection.db")
+	if err := transport.Clone(ctx, src, destPath); err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+
+	clone, err := fixtures.NewCollection(ctx, filepath.Join(dir, "clone"), fixtures.Spec{Namespace: "fixtures", Name: "items"})
+	if err != nil {
+		t.Fatalf("failed to open clone: %v", err)
+	}
+	defer clone.Close()
+
+	equal, err := fixtures.Equal(ctx, src, clone, fixtures.CompareOptions{IgnoreFiles: true})
+	if err != nil {
+		t.Fatalf("Equal failed: %v", err)
+	}
+	if !equal {
+		t.Error("expected clone to equal its source")
+	}
+}
@@ -0,0 +1,301 @@
+// Package s3 implements the collection FileSystem on S3-compatible object
+// storage (AWS S3, MinIO, R2, GCS interoperability mode) using plain HTTP and
+// AWS Signature Version 4.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// MaxSignedURLExpiry is the longest validity SigV4 allows for a presigned URL.
+const MaxSignedURLExpiry = 7 * 24 * time.Hour
+
+// Config describes a bucket and the credentials used to access it.
+type Config struct {
+	// Endpoint is the service URL, e.g. https://s3.us-east-1.amazonaws.com
+	// or http://minio:9000.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to every object key, scoping the FileSystem to
+	// part of the bucket.
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// PathStyle addresses objects as Endpoint/bucket/key instead of
+	// bucket.host/key; most S3-compatible servers need it.
+	PathStyle bool
+
+	// PartSize is the part size of multipart uploads by UploadFile, at least
+	// MinPartSize; zero uses DefaultPartSize.
+	PartSize int64
+
+	Client *http.Client
+}
+
+// ConfigFromEnv builds a Config for bucket from the standard AWS_* variables
+// and S3_ENDPOINT, which also switches to path-style addressing.
+func ConfigFromEnv(bucket string) Config {
+	cfg := Config{
+		Region:          os.Getenv("AWS_REGION"),
+		Bucket:          bucket,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		cfg.Endpoint = endpoint
+		cfg.PathStyle = true
+	}
+	return cfg
+}
+
+// GCSEndpoint is the S3-compatible XML API of Google Cloud Storage.
+const GCSEndpoint = "https://storage.googleapis.com"
+
+// GCSConfigFromEnv builds a Config for a Google Cloud Storage bucket, used
+// through its S3-compatible XML API with the HMAC key in GCS_ACCESS_KEY_ID
+// and GCS_SECRET_ACCESS_KEY. GCS_ENDPOINT overrides the endpoint.
+func GCSConfigFromEnv(bucket string) Config {
+	cfg := Config{
+		Endpoint:        GCSEndpoint,
+		Region:          "auto",
+		Bucket:          bucket,
+		AccessKeyID:     os.Getenv("GCS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("GCS_SECRET_ACCESS_KEY"),
+		PathStyle:       true,
+	}
+	if endpoint := os.Getenv("GCS_ENDPOINT"); endpoint != "" {
+		cfg.Endpoint = endpoint
+	}
+	return cfg
+}
+
+// FileSystem stores files as objects in an S3-compatible bucket.
+type FileSystem struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	pathStyle bool
+	partSize  int64
+	signer    *signer
+	client    *http.Client
+	now       func() time.Time
+}
+
+// NewFileSystem creates a FileSystem for the configured bucket.
+func NewFileSystem(cfg Config) (*FileSystem, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("region is required")
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	partSize := cfg.PartSize
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	if partSize < MinPartSize {
+		return nil, fmt.Errorf("part size must be at least %d bytes", MinPartSize)
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &FileSystem{
+		endpoint:  u,
+		bucket:    cfg.Bucket,
+		prefix:    prefix,
+		pathStyle: cfg.PathStyle,
+		partSize:  partSize,
+		signer: &signer{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			sessionToken:    cfg.SessionToken,
+			region:          cfg.Region,
+		},
+		client: client,
+		now:    time.Now,
+	}, nil
+}
+
+func (f *FileSystem) key(path string) string {
+	return f.prefix + strings.TrimPrefix(path, "/")
+}
+
+// objectURL returns the URL of key, or of the bucket when key is empty.
+func (f *FileSystem) objectURL(key string) *url.URL {
+	u := &url.URL{Scheme: f.endpoint.Scheme, Host: f.endpoint.Host}
+	base := strings.TrimSuffix(f.endpoint.Path, "/")
+	if f.pathStyle {
+		base += "/" + f.bucket
+	} else {
+		u.Host = f.bucket + "." + u.Host
+	}
+	u.Path = base + "/" + key
+	u.RawPath = encodePath(u.Path)
+	return u
+}
+
+func (f *FileSystem) do(ctx context.Context, method string, u *url.URL, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	f.signer.signRequest(req, hashHex(body), f.now())
+	return f.client.Do(req)
+}
+
+// statusError describes an unexpected response; 404s wrap fs.ErrNotExist.
+func statusError(op, key string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", op, key, fs.ErrNotExist)
+	}
+	return fmt.Errorf("%s %s: unexpected status %s: %s", op, key, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// Save uploads content to path, replacing any existing object.
+func (f *FileSystem) Save(ctx context.Context, path string, content []byte) error {
+	key := f.key(path)
+	resp, err := f.do(ctx, http.MethodPut, f.objectURL(key), content)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError("upload", key, resp)
+	}
+	return nil
+}
+
+// Load downloads the object at path.
+func (f *FileSystem) Load(ctx context.Context, path string) ([]byte, error) {
+	key := f.key(path)
+	resp, err := f.do(ctx, http.MethodGet, f.objectURL(key), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError("download", key, resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Delete removes the object at path. Deleting a missing object succeeds.
+func (f *FileSystem) Delete(ctx context.Context, path string) error {
+	key := f.key(path)
+	resp, err := f.do(ctx, http.MethodDelete, f.objectURL(key), nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return statusError("delete", key, resp)
+	}
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the paths of all objects under prefix, relative to the
+// FileSystem root.
+func (f *FileSystem) List(ctx context.Context, prefix string) ([]string, error) {
+	var files []string
+	token := ""
+	for {
+		u := f.objectURL("")
+		query := url.Values{"list-type": {"2"}, "prefix": {f.key(prefix)}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = canonicalQuery(query)
+
+		resp, err := f.do(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		var result listBucketResult
+		if resp.StatusCode != http.StatusOK {
+			err = statusError("list", prefix, resp)
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range result.Contents {
+			files = append(files, strings.TrimPrefix(obj.Key, f.prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Stat returns the size of the object at path.
+func (f *FileSystem) Stat(ctx context.Context, path string) (int64, error) {
+	key := f.key(path)
+	resp, err := f.do(ctx, http.MethodHead, f.objectURL(key), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, statusError("stat", key, resp)
+	}
+	return resp.ContentLength, nil
+}
+
+// SignURL returns a presigned URL that allows method (GET to download, PUT to
+// upload) on path without further credentials until expiry elapses.
+func (f *FileSystem) SignURL(ctx context.Context, path, method string, expiry time.Duration) (string, error) {
+	if method != http.MethodGet && method != http.MethodPut {
+		return "", fmt.Errorf("unsupported signed URL method %q", method)
+	}
+	if expiry <= 0 || expiry > MaxSignedURLExpiry {
+		return "", fmt.Errorf("signed URL expiry must be between 1s and %s", MaxSignedURLExpiry)
+	}
+	return f.signer.presign(method, f.objectURL(f.key(path)), expiry, f.now()).String(), nil
+}
@@ -0,0 +1,196 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultPartSize is the part size of multipart uploads when
+	// Config.PartSize is zero. Files up to one part are uploaded with a
+	// single PUT.
+	DefaultPartSize = 16 << 20
+	// MinPartSize is the smallest part S3 accepts, other than the last.
+	MinPartSize = 5 << 20
+	// maxParts is the most parts S3 accepts in one upload.
+	maxParts = 10000
+)
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// UploadFile uploads the file at localPath to path, replacing any existing
+// object. Files larger than the part size are sent in parts with a multipart
+// upload, holding one part in memory at a time; a failed multipart upload is
+// aborted so its parts are not left behind.
+func (f *FileSystem) UploadFile(ctx context.Context, path, localPath string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	partSize := f.partSize
+	if info.Size() > partSize*maxParts {
+		partSize = (info.Size() + maxParts - 1) / maxParts
+	}
+	if info.Size() <= partSize {
+		content, err := io.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		return f.Save(ctx, path, content)
+	}
+
+	key := f.key(path)
+	uploadID, err := f.initiateMultipart(ctx, key)
+	if err != nil {
+		return err
+	}
+	parts, err := f.uploadParts(ctx, key, uploadID, file, partSize)
+	if err == nil {
+		err = f.completeMultipart(ctx, key, uploadID, parts)
+	}
+	if err != nil {
+		f.abortMultipart(key, uploadID)
+		return err
+	}
+	return nil
+}
+
+// multipartURL returns the URL of key with the given query.
+func (f *FileSystem) multipartURL(key string, query url.Values) *url.URL {
+	u := f.objectURL(key)
+	u.RawQuery = canonicalQuery(query)
+	return u
+}
+
+func (f *FileSystem) initiateMultipart(ctx context.Context, key string) (string, error) {
+	resp, err := f.do(ctx, http.MethodPost, f.multipartURL(key, url.Values{"uploads": {""}}), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to start upload of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError("start upload", key, resp)
+	}
+	var result initiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("start upload %s: no upload ID in response (%v)", key, err)
+	}
+	return result.UploadID, nil
+}
+
+func (f *FileSystem) uploadParts(ctx context.Context, key, uploadID string, r io.Reader, partSize int64) ([]completedPart, error) {
+	var parts []completedPart
+	buf := make([]byte, partSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(r, buf)
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			return parts, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := f.do(ctx, http.MethodPut, f.multipartURL(key, query), buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload part %d of %s: %w", number, key, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := statusError(fmt.Sprintf("upload part %d of", number), key, resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		if int64(n) < partSize {
+			return parts, nil
+		}
+	}
+}
+
+func (f *FileSystem) completeMultipart(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := f.do(ctx, http.MethodPost, f.multipartURL(key, url.Values{"uploadId": {uploadID}}), body)
+	if err != nil {
+		return fmt.Errorf("failed to complete upload of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError("complete upload", key, resp)
+	}
+	// S3 reports failures found while assembling the parts in a 200 response
+	result, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if bytes.Contains(result, []byte("<Error>")) {
+		return fmt.Errorf("complete upload %s: %s", key, strings.TrimSpace(string(result)))
+	}
+	return nil
+}
+
+// abortMultipart discards the uploaded parts of a failed upload. It runs
+// even when the upload's context is done.
+func (f *FileSystem) abortMultipart(key, uploadID string) {
+	resp, err := f.do(context.Background(), http.MethodDelete, f.multipartURL(key, url.Values{"uploadId": {uploadID}}), nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// DownloadFile downloads the object at path to a new file at localPath,
+// streaming it to disk. A partial download is removed.
+func (f *FileSystem) DownloadFile(ctx context.Context, path, localPath string) error {
+	key := f.key(path)
+	resp, err := f.do(ctx, http.MethodGet, f.objectURL(key), nil)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError("download", key, resp)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(localPath)
+		return fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return nil
+}
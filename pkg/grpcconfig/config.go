@@ -0,0 +1,175 @@
+// Package grpcconfig holds the transport settings shared by a collector's
+// gRPC server and its clients: keepalive, message size limits and flow
+// control windows. Settings are read from COLLECTOR_GRPC_* environment
+// variables and turned into server and dial options.
+package grpcconfig
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	// DefaultKeepaliveTime is the interval between keepalive pings sent by
+	// clients and by the server.
+	DefaultKeepaliveTime = 5 * time.Minute
+	// DefaultKeepaliveTimeout is how long a ping may go unanswered before the
+	// connection is closed.
+	DefaultKeepaliveTimeout = 20 * time.Second
+	// DefaultKeepaliveMinTime is the shortest ping interval the server
+	// accepts from clients before closing their connection.
+	DefaultKeepaliveMinTime = time.Minute
+	// DefaultMaxMessageSize is gRPC's default limit on received messages.
+	DefaultMaxMessageSize = 4 * 1024 * 1024
+
+	// minWindowSize is the smallest flow control window gRPC accepts.
+	minWindowSize = 64 * 1024
+)
+
+// Config holds gRPC transport settings. Use Default or FromEnv to get one.
+type Config struct {
+	// KeepaliveTime is the ping interval on idle connections, for both the
+	// server and clients.
+	KeepaliveTime time.Duration
+	// KeepaliveTimeout is how long to wait for a ping acknowledgement.
+	KeepaliveTimeout time.Duration
+	// KeepaliveMinTime is the shortest ping interval the server allows.
+	// Clients must not ping more often, or their connection is closed.
+	KeepaliveMinTime time.Duration
+	// KeepaliveWithoutCalls keeps pinging connections with no calls in
+	// flight, so NATs and load balancers do not drop idle peer connections.
+	// The server permits such pings only when it is set too.
+	KeepaliveWithoutCalls bool
+	// MaxConnectionIdle closes server connections without calls for this
+	// long. Zero keeps them open.
+	MaxConnectionIdle time.Duration
+	// MaxMessageSize limits messages sent and received, in bytes.
+	MaxMessageSize int
+	// WindowSize and ConnWindowSize set the per-stream and per-connection
+	// flow control windows, in bytes. Zero lets gRPC size windows
+	// dynamically from the measured bandwidth-delay product.
+	WindowSize     int32
+	ConnWindowSize int32
+}
+
+// Default returns the default settings.
+func Default() Config {
+	return Config{
+		KeepaliveTime:    DefaultKeepaliveTime,
+		KeepaliveTimeout: DefaultKeepaliveTimeout,
+		KeepaliveMinTime: DefaultKeepaliveMinTime,
+		MaxMessageSize:   DefaultMaxMessageSize,
+	}
+}
+
+// FromEnv returns the default settings overridden by these variables:
+//
+//	COLLECTOR_GRPC_KEEPALIVE_TIME           duration, e.g. 30s
+//	COLLECTOR_GRPC_KEEPALIVE_TIMEOUT        duration
+//	COLLECTOR_GRPC_KEEPALIVE_MIN_TIME       duration
+//	COLLECTOR_GRPC_KEEPALIVE_WITHOUT_CALLS  true or false
+//	COLLECTOR_GRPC_MAX_CONNECTION_IDLE      duration
+//	COLLECTOR_GRPC_MAX_MESSAGE_SIZE         bytes
+//	COLLECTOR_GRPC_WINDOW_SIZE              bytes, at least 65536
+//	COLLECTOR_GRPC_CONN_WINDOW_SIZE         bytes, at least 65536
+func FromEnv() (Config, error) {
+	c := Default()
+	for name, target := range map[string]*time.Duration{
+		"COLLECTOR_GRPC_KEEPALIVE_TIME":      &c.KeepaliveTime,
+		"COLLECTOR_GRPC_KEEPALIVE_TIMEOUT":   &c.KeepaliveTimeout,
+		"COLLECTOR_GRPC_KEEPALIVE_MIN_TIME":  &c.KeepaliveMinTime,
+		"COLLECTOR_GRPC_MAX_CONNECTION_IDLE": &c.MaxConnectionIdle,
+	} {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return Config{}, fmt.Errorf("%s must be a positive duration, got %q", name, v)
+			}
+			*target = d
+		}
+	}
+	if v := os.Getenv("COLLECTOR_GRPC_KEEPALIVE_WITHOUT_CALLS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("COLLECTOR_GRPC_KEEPALIVE_WITHOUT_CALLS must be true or false, got %q", v)
+		}
+		c.KeepaliveWithoutCalls = b
+	}
+	if v := os.Getenv("COLLECTOR_GRPC_MAX_MESSAGE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("COLLECTOR_GRPC_MAX_MESSAGE_SIZE must be a positive number of bytes, got %q", v)
+		}
+		c.MaxMessageSize = n
+	}
+	for name, target := range map[string]*int32{
+		"COLLECTOR_GRPC_WINDOW_SIZE":      &c.WindowSize,
+		"COLLECTOR_GRPC_CONN_WINDOW_SIZE": &c.ConnWindowSize,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 32)
+			if err != nil || n < minWindowSize {
+				return Config{}, fmt.Errorf("%s must be at least %d bytes, got %q", name, minWindowSize, v)
+			}
+			*target = int32(n)
+		}
+	}
+	if c.KeepaliveTime < c.KeepaliveMinTime {
+		return Config{}, fmt.Errorf("keepalive time %v is below the minimum ping interval %v the server allows", c.KeepaliveTime, c.KeepaliveMinTime)
+	}
+	return c, nil
+}
+
+// ServerOptions returns options applying the settings to a gRPC server.
+func (c Config) ServerOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:              c.KeepaliveTime,
+			Timeout:           c.KeepaliveTimeout,
+			MaxConnectionIdle: c.MaxConnectionIdle,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             c.KeepaliveMinTime,
+			PermitWithoutStream: c.KeepaliveWithoutCalls,
+		}),
+	}
+	if c.MaxMessageSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(c.MaxMessageSize), grpc.MaxSendMsgSize(c.MaxMessageSize))
+	}
+	if c.WindowSize > 0 {
+		opts = append(opts, grpc.InitialWindowSize(c.WindowSize))
+	}
+	if c.ConnWindowSize > 0 {
+		opts = append(opts, grpc.InitialConnWindowSize(c.ConnWindowSize))
+	}
+	return opts
+}
+
+// DialOptions returns options applying the settings to a gRPC client.
+func (c Config) DialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                c.KeepaliveTime,
+			Timeout:             c.KeepaliveTimeout,
+			PermitWithoutStream: c.KeepaliveWithoutCalls,
+		}),
+	}
+	if c.MaxMessageSize > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(c.MaxMessageSize),
+			grpc.MaxCallSendMsgSize(c.MaxMessageSize),
+		))
+	}
+	if c.WindowSize > 0 {
+		opts = append(opts, grpc.WithInitialWindowSize(c.WindowSize))
+	}
+	if c.ConnWindowSize > 0 {
+		opts = append(opts, grpc.WithInitialConnWindowSize(c.ConnWindowSize))
+	}
+	return opts
+}
@@ -0,0 +1,98 @@
+package grpcconfig_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/accretional/collector/pkg/grpcconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("COLLECTOR_GRPC_KEEPALIVE_TIME", "30s")
+	t.Setenv("COLLECTOR_GRPC_KEEPALIVE_MIN_TIME", "10s")
+	t.Setenv("COLLECTOR_GRPC_KEEPALIVE_WITHOUT_CALLS", "true")
+	t.Setenv("COLLECTOR_GRPC_MAX_MESSAGE_SIZE", "16777216")
+	t.Setenv("COLLECTOR_GRPC_WINDOW_SIZE", "1048576")
+
+	c, err := grpcconfig.FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv failed: %v", err)
+	}
+	want := grpcconfig.Default()
+	want.KeepaliveTime = 30 * time.Second
+	want.KeepaliveMinTime = 10 * time.Second
+	want.KeepaliveWithoutCalls = true
+	want.MaxMessageSize = 16 << 20
+	want.WindowSize = 1 << 20
+	if c != want {
+		t.Errorf("expected %+v, got %+v", want, c)
+	}
+}
+
+func TestFromEnv_Invalid(t *testing.T) {
+	for name, env := range map[string][2]string{
+		"bad duration":        {"COLLECTOR_GRPC_KEEPALIVE_TIMEOUT", "soon"},
+		"bad bool":            {"COLLECTOR_GRPC_KEEPALIVE_WITHOUT_CALLS", "sometimes"},
+		"zero message size":   {"COLLECTOR_GRPC_MAX_MESSAGE_SIZE", "0"},
+		"small window":        {"COLLECTOR_GRPC_CONN_WINDOW_SIZE", "1024"},
+		"pings below minimum": {"COLLECTOR_GRPC_KEEPALIVE_TIME", "10s"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(env[0], env[1])
+			if _, err := grpcconfig.FromEnv(); err == nil {
+				t.Errorf("expected an error for %s=%s", env[0], env[1])
+			}
+		})
+	}
+}
+
+// check sends a health check whose request is about size bytes, between a
+// server and client configured with c.
+func check(t *testing.T, c grpcconfig.Config, size int) error {
+	t.Helper()
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := grpc.NewServer(c.ServerOptions()...)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), append(c.DialOptions(), grpc.WithTransportCredentials(insecure.NewCredentials()))...)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: strings.Repeat("x", size)})
+	return err
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	// Over the default limit, the client refuses to send
+	if err := check(t, grpcconfig.Default(), 6<<20); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted with the default limit, got %v", err)
+	}
+
+	// A raised limit lets the message through; the server then reports the
+	// unknown service
+	c := grpcconfig.Default()
+	c.MaxMessageSize = 8 << 20
+	c.WindowSize = 1 << 20
+	c.ConnWindowSize = 4 << 20
+	if err := check(t, c, 6<<20); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound with a raised limit, got %v", err)
+	}
+}
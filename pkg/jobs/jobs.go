@@ -0,0 +1,625 @@
+// Package jobs runs long-lived operations such as backups, clones and
+// reindexing in the background. Jobs are persisted in a Store, retried with
+// backoff, limited in concurrency per kind, and resumed when the process
+// restarts.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var (
+	// ErrNotFound is returned for unknown job IDs.
+	ErrNotFound = errors.New("job not found")
+	// ErrUnknownKind is returned when submitting a kind with no handler.
+	ErrUnknownKind = errors.New("unknown job kind")
+	// ErrStopped is returned when submitting to a stopped Manager.
+	ErrStopped = errors.New("job manager is stopped")
+)
+
+// progressSaveInterval throttles how often progress updates are persisted;
+// state changes are always persisted.
+const progressSaveInterval = time.Second
+
+// ProgressFunc reports how much of a job is done, in units the handler
+// chooses. total is 0 when unknown.
+type ProgressFunc func(done, total int64)
+
+// Handler runs one attempt of a job and returns its result. Errors are
+// retried until the job's attempts run out, unless wrapped with Permanent.
+// Handlers must return promptly once ctx is cancelled.
+type Handler func(ctx context.Context, params *anypb.Any, progress ProgressFunc) (proto.Message, error)
+
+// Typed adapts a handler taking a concrete params message.
+func Typed[T proto.Message](fn func(ctx context.Context, params T, progress ProgressFunc) (proto.Message, error)) Handler {
+	return func(ctx context.Context, params *anypb.Any, progress ProgressFunc) (proto.Message, error) {
+		if params == nil {
+			return nil, Permanent(fmt.Errorf("job params are required"))
+		}
+		msg, err := params.UnmarshalNew()
+		if err != nil {
+			return nil, Permanent(fmt.Errorf("invalid job params: %w", err))
+		}
+		typed, ok := msg.(T)
+		if !ok {
+			return nil, Permanent(fmt.Errorf("unexpected job params type %s", params.TypeUrl))
+		}
+		return fn(ctx, typed, progress)
+	}
+}
+
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying, such as invalid params.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// Options configures a Manager.
+type Options struct {
+	Concurrency  int           // Jobs running at once across all kinds; default 4
+	MaxAttempts  int           // Default attempts per job; default 3
+	RetryBackoff time.Duration // Wait before the first retry, doubling after; default 5s
+	Retention    time.Duration // How long finished jobs are kept; default 7 days
+}
+
+func (o *Options) setDefaults() {
+	if o.Concurrency <= 0 {
+		o.Concurrency = 4
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 3
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = 5 * time.Second
+	}
+	if o.Retention <= 0 {
+		o.Retention = 7 * 24 * time.Hour
+	}
+}
+
+// KindOptions configures one kind of job.
+type KindOptions struct {
+	Concurrency int // Jobs of this kind running at once; 0 means only the Manager limit
+	MaxAttempts int // Overrides Options.MaxAttempts
+}
+
+// SubmitOptions configures one job.
+type SubmitOptions struct {
+	MaxAttempts int // Overrides the kind's setting
+	Labels      map[string]string
+}
+
+// ListOptions filters List. Zero values match everything.
+type ListOptions struct {
+	Kind   string
+	States []pb.JobState
+	Match  func(labels map[string]string) bool
+	Limit  int // Newest first
+}
+
+type kind struct {
+	handler Handler
+	opts    KindOptions
+	sem     chan struct{} // nil when unlimited
+}
+
+type activeJob struct {
+	job       *pb.Job // Guarded by Manager.mu
+	kind      *kind
+	retryAt   time.Time
+	cancel    context.CancelFunc
+	cancelled bool          // By Cancel, as opposed to Stop
+	changed   chan struct{} // Closed and replaced on every update
+	done      chan struct{}
+
+	saveMu  sync.Mutex
+	savedAt time.Time
+}
+
+// Manager runs jobs with registered handlers.
+type Manager struct {
+	store Store
+	opts  Options
+	sem   chan struct{}
+
+	ctx  context.Context // Cancelled by Stop
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	kinds   map[string]*kind
+	active  map[string]*activeJob
+	stopped bool
+}
+
+// NewManager creates a Manager persisting jobs in store. Register handlers,
+// then call Start to resume jobs left unfinished by a previous process.
+func NewManager(store Store, opts Options) *Manager {
+	opts.setDefaults()
+	ctx, stop := context.WithCancel(context.Background())
+	return &Manager{
+		store:  store,
+		opts:   opts,
+		sem:    make(chan struct{}, opts.Concurrency),
+		ctx:    ctx,
+		stop:   stop,
+		kinds:  make(map[string]*kind),
+		active: make(map[string]*activeJob),
+	}
+}
+
+// Register sets the handler for a kind of job.
+func (m *Manager) Register(name string, handler Handler, opts KindOptions) {
+	k := &kind{handler: handler, opts: opts}
+	if opts.Concurrency > 0 {
+		k.sem = make(chan struct{}, opts.Concurrency)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kinds[name] = k
+}
+
+// Start resumes unfinished jobs from the store and begins removing finished
+// jobs older than Options.Retention. Jobs that were running when the previous
+// process stopped count that attempt as used.
+func (m *Manager) Start(ctx context.Context) error {
+	stored, err := m.store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load jobs: %w", err)
+	}
+
+	for _, job := range stored {
+		if Finished(job.State) {
+			continue
+		}
+		m.mu.Lock()
+		k := m.kinds[job.Kind]
+		m.mu.Unlock()
+
+		switch {
+		case k == nil:
+			job.State, job.Error = pb.JobState_JOB_FAILED, fmt.Sprintf("no handler registered for kind %q", job.Kind)
+		case job.State == pb.JobState_JOB_RUNNING && job.Attempts >= job.MaxAttempts:
+			job.State = pb.JobState_JOB_FAILED
+			job.Error = fmt.Sprintf("interrupted on final attempt %d: %s", job.Attempts, job.Error)
+		default:
+			if job.State == pb.JobState_JOB_RUNNING {
+				job.State = pb.JobState_JOB_PENDING
+			}
+			if err := m.launch(job, k, time.Unix(job.NextAttemptAt, 0)); err != nil {
+				return err
+			}
+			continue
+		}
+		job.FinishedAt = time.Now().Unix()
+		if err := m.store.Save(ctx, job); err != nil {
+			return fmt.Errorf("failed to save job %s: %w", job.JobId, err)
+		}
+	}
+
+	m.prune(ctx)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.prune(m.ctx)
+			case <-m.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// prune deletes finished jobs older than Options.Retention.
+func (m *Manager) prune(ctx context.Context) {
+	stored, err := m.store.List(ctx)
+	if err != nil {
+		log.Printf("Warning: failed to list jobs for pruning: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-m.opts.Retention).Unix()
+	for _, job := range stored {
+		if Finished(job.State) && job.FinishedAt < cutoff {
+			if err := m.store.Delete(ctx, job.JobId); err != nil {
+				log.Printf("Warning: failed to delete job %s: %v", job.JobId, err)
+			}
+		}
+	}
+}
+
+// Stop cancels running jobs without marking them cancelled, so the next
+// Start resumes them, and waits for their handlers to return.
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	m.stopped = true
+	m.mu.Unlock()
+	m.stop()
+	m.wg.Wait()
+}
+
+// Submit persists a new job and starts it once a slot is free. params may
+// already be an Any.
+func (m *Manager) Submit(ctx context.Context, kindName string, params proto.Message, opts SubmitOptions) (*pb.Job, error) {
+	m.mu.Lock()
+	k, ok := m.kinds[kindName]
+	stopped := m.stopped
+	m.mu.Unlock()
+	if stopped {
+		return nil, ErrStopped
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKind, kindName)
+	}
+
+	packed, ok := params.(*anypb.Any)
+	if !ok && params != nil {
+		var err error
+		if packed, err = anypb.New(params); err != nil {
+			return nil, fmt.Errorf("failed to encode job params: %w", err)
+		}
+	}
+
+	maxAttempts := opts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = k.opts.MaxAttempts
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = m.opts.MaxAttempts
+	}
+
+	job := &pb.Job{
+		JobId:       uuid.New().String(),
+		Kind:        kindName,
+		State:       pb.JobState_JOB_PENDING,
+		Params:      packed,
+		MaxAttempts: int32(maxAttempts),
+		CreatedAt:   time.Now().Unix(),
+		Labels:      opts.Labels,
+	}
+	if err := m.store.Save(ctx, job); err != nil {
+		return nil, fmt.Errorf("failed to save job: %w", err)
+	}
+	snapshot := proto.Clone(job).(*pb.Job)
+	if err := m.launch(job, k, time.Time{}); err != nil {
+		// Stopped since the check above; don't leave the job to be resumed
+		m.store.Delete(ctx, job.JobId)
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (m *Manager) launch(job *pb.Job, k *kind, retryAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return ErrStopped
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	t := &activeJob{
+		job:     job,
+		kind:    k,
+		retryAt: retryAt,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	m.active[job.JobId] = t
+	m.wg.Add(1)
+	go m.run(ctx, t)
+	return nil
+}
+
+func (m *Manager) run(ctx context.Context, t *activeJob) {
+	defer m.wg.Done()
+	defer close(t.done)
+	defer t.cancel()
+	defer func() {
+		m.mu.Lock()
+		delete(m.active, t.job.JobId)
+		m.mu.Unlock()
+	}()
+
+	for {
+		if !m.acquire(ctx, t) {
+			m.interrupted(t, false)
+			return
+		}
+
+		m.update(t, func(job *pb.Job) {
+			job.State = pb.JobState_JOB_RUNNING
+			job.Attempts++
+			job.NextAttemptAt = 0
+			if job.StartedAt == 0 {
+				job.StartedAt = time.Now().Unix()
+			}
+		})
+		m.persist(t, true)
+
+		progress := func(done, total int64) {
+			m.update(t, func(job *pb.Job) {
+				job.ProgressDone, job.ProgressTotal = done, total
+			})
+			m.persist(t, false)
+		}
+		result, err := t.kind.handler(ctx, t.job.Params, progress)
+		m.release(t)
+
+		if err != nil && ctx.Err() != nil {
+			m.interrupted(t, true)
+			return
+		}
+
+		var packed *anypb.Any
+		if err == nil && result != nil {
+			if packed, err = anypb.New(result); err != nil {
+				err = Permanent(fmt.Errorf("failed to encode job result: %w", err))
+			}
+		}
+
+		retry := false
+		m.update(t, func(job *pb.Job) {
+			switch {
+			case err == nil:
+				job.State, job.Result, job.Error = pb.JobState_JOB_SUCCEEDED, packed, ""
+			case IsPermanent(err) || job.Attempts >= job.MaxAttempts:
+				job.State, job.Error = pb.JobState_JOB_FAILED, err.Error()
+			default:
+				retry = true
+				t.retryAt = time.Now().Add(m.opts.RetryBackoff << (job.Attempts - 1))
+				job.State, job.Error, job.NextAttemptAt = pb.JobState_JOB_RETRYING, err.Error(), t.retryAt.Unix()
+			}
+			if !retry {
+				job.FinishedAt = time.Now().Unix()
+			}
+		})
+		m.persist(t, true)
+		if !retry {
+			return
+		}
+	}
+}
+
+// acquire waits until the job may run: past its retry time, with a slot
+// free for its kind and overall. It returns false if ctx ends first.
+func (m *Manager) acquire(ctx context.Context, t *activeJob) bool {
+	if wait := time.Until(t.retryAt); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	if t.kind.sem != nil {
+		select {
+		case t.kind.sem <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	select {
+	case m.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		if t.kind.sem != nil {
+			<-t.kind.sem
+		}
+		return false
+	}
+}
+
+func (m *Manager) release(t *activeJob) {
+	<-m.sem
+	if t.kind.sem != nil {
+		<-t.kind.sem
+	}
+}
+
+// interrupted records a job stopped by Cancel or Stop. A job interrupted by
+// Stop while running gives its attempt back and waits to be resumed.
+func (m *Manager) interrupted(t *activeJob, running bool) {
+	m.update(t, func(job *pb.Job) {
+		switch {
+		case t.cancelled:
+			job.State, job.FinishedAt = pb.JobState_JOB_CANCELLED, time.Now().Unix()
+		case running:
+			job.State = pb.JobState_JOB_PENDING
+			job.Attempts--
+		}
+	})
+	m.persist(t, true)
+}
+
+// update applies fn to the job and wakes its watchers.
+func (m *Manager) update(t *activeJob, fn func(*pb.Job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(t.job)
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// persist saves the job's current state. Progress-only updates are saved at
+// most once per progressSaveInterval.
+func (m *Manager) persist(t *activeJob, force bool) {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+	if !force && time.Since(t.savedAt) < progressSaveInterval {
+		return
+	}
+	m.mu.Lock()
+	snapshot := proto.Clone(t.job).(*pb.Job)
+	m.mu.Unlock()
+
+	// Saved even after Stop, so interrupted jobs are recorded for resumption
+	if err := m.store.Save(context.Background(), snapshot); err != nil {
+		log.Printf("Warning: failed to save job %s: %v", snapshot.JobId, err)
+		return
+	}
+	t.savedAt = time.Now()
+}
+
+// snapshot returns a copy of an active job and a channel closed on its next
+// update, or nil if the job is not active.
+func (m *Manager) snapshot(id string) (*pb.Job, <-chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.active[id]
+	if !ok {
+		return nil, nil
+	}
+	return proto.Clone(t.job).(*pb.Job), t.changed
+}
+
+// Active returns the number of jobs queued or running in this process.
+func (m *Manager) Active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.active)
+}
+
+// Get returns a job's current state.
+func (m *Manager) Get(ctx context.Context, id string) (*pb.Job, error) {
+	if job, _ := m.snapshot(id); job != nil {
+		return job, nil
+	}
+	return m.store.Load(ctx, id)
+}
+
+// List returns the jobs matching opts, newest first.
+func (m *Manager) List(ctx context.Context, opts ListOptions) ([]*pb.Job, error) {
+	stored, err := m.store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+
+	var jobs []*pb.Job
+	for _, job := range stored {
+		// Running jobs have fresher progress in memory
+		if active, _ := m.snapshot(job.JobId); active != nil {
+			job = active
+		}
+		if opts.Kind != "" && job.Kind != opts.Kind {
+			continue
+		}
+		if len(opts.States) > 0 && !containsState(opts.States, job.State) {
+			continue
+		}
+		if opts.Match != nil && !opts.Match(job.Labels) {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].CreatedAt != jobs[j].CreatedAt {
+			return jobs[i].CreatedAt > jobs[j].CreatedAt
+		}
+		return jobs[i].JobId < jobs[j].JobId
+	})
+	if opts.Limit > 0 && len(jobs) > opts.Limit {
+		jobs = jobs[:opts.Limit]
+	}
+	return jobs, nil
+}
+
+// Watch calls fn with the job's state now and after every change, returning
+// once the job has finished or ctx is done.
+func (m *Manager) Watch(ctx context.Context, id string, fn func(*pb.Job) error) error {
+	for {
+		job, changed := m.snapshot(id)
+		if job == nil {
+			stored, err := m.store.Load(ctx, id)
+			if err != nil {
+				return err
+			}
+			return fn(stored)
+		}
+		if err := fn(job); err != nil {
+			return err
+		}
+		if Finished(job.State) {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Cancel stops a job and waits for its handler to return. Cancelling a
+// finished job leaves it unchanged.
+func (m *Manager) Cancel(ctx context.Context, id string) (*pb.Job, error) {
+	m.mu.Lock()
+	t, ok := m.active[id]
+	if ok {
+		t.cancelled = true
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		job, err := m.store.Load(ctx, id)
+		if err != nil || Finished(job.State) {
+			return job, err
+		}
+		// Unfinished but not running here, e.g. before Start resumed it
+		job.State, job.FinishedAt = pb.JobState_JOB_CANCELLED, time.Now().Unix()
+		return job, m.store.Save(ctx, job)
+	}
+
+	t.cancel()
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return m.store.Load(ctx, id)
+}
+
+// Finished reports whether a job in state will not run again.
+func Finished(state pb.JobState) bool {
+	return state == pb.JobState_JOB_SUCCEEDED ||
+		state == pb.JobState_JOB_FAILED ||
+		state == pb.JobState_JOB_CANCELLED
+}
+
+func containsState(states []pb.JobState, s pb.JobState) bool {
+	for _, state := range states {
+		if state == s {
+			return true
+		}
+	}
+	return false
+}
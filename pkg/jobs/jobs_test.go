@@ -0,0 +1,228 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var testParams = &pb.NamespacedName{Namespace: "prod", Name: "users"}
+
+// wait follows a job until it finishes and returns its final state.
+func wait(t *testing.T, m *Manager, id string) *pb.Job {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var last *pb.Job
+	if err := m.Watch(ctx, id, func(job *pb.Job) error {
+		last = job
+		return nil
+	}); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	return last
+}
+
+func TestManager_RunsJobWithProgressAndResult(t *testing.T) {
+	m := NewManager(NewMemoryStore(), Options{})
+	defer m.Stop()
+	m.Register("echo", Typed(func(ctx context.Context, name *pb.NamespacedName, progress ProgressFunc) (proto.Message, error) {
+		progress(5, 10)
+		progress(10, 10)
+		return &pb.Status{Message: name.Namespace + "/" + name.Name}, nil
+	}), KindOptions{})
+
+	ctx := context.Background()
+	job, err := m.Submit(ctx, "echo", testParams, SubmitOptions{Labels: map[string]string{"team": "search"}})
+	if err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	if job.State != pb.JobState_JOB_PENDING || job.MaxAttempts != 3 {
+		t.Errorf("unexpected submitted job: %v", job)
+	}
+
+	done := wait(t, m, job.JobId)
+	if done.State != pb.JobState_JOB_SUCCEEDED || done.Attempts != 1 || done.ProgressDone != 10 {
+		t.Fatalf("unexpected finished job: %v", done)
+	}
+	result := &pb.Status{}
+	if err := done.Result.UnmarshalTo(result); err != nil || result.Message != "prod/users" {
+		t.Errorf("unexpected result %v (%v)", result, err)
+	}
+
+	if _, err := m.Submit(ctx, "missing", testParams, SubmitOptions{}); !errors.Is(err, ErrUnknownKind) {
+		t.Errorf("expected ErrUnknownKind, got %v", err)
+	}
+	if _, err := m.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestManager_Retries(t *testing.T) {
+	m := NewManager(NewMemoryStore(), Options{RetryBackoff: time.Millisecond})
+	defer m.Stop()
+
+	var calls atomic.Int32
+	m.Register("flaky", func(ctx context.Context, _ *anypb.Any, _ ProgressFunc) (proto.Message, error) {
+		if calls.Add(1) < 3 {
+			return nil, errors.New("connection reset")
+		}
+		return nil, nil
+	}, KindOptions{})
+	m.Register("invalid", func(ctx context.Context, _ *anypb.Any, _ ProgressFunc) (proto.Message, error) {
+		return nil, Permanent(errors.New("bad params"))
+	}, KindOptions{})
+
+	ctx := context.Background()
+	job, _ := m.Submit(ctx, "flaky", testParams, SubmitOptions{})
+	if done := wait(t, m, job.JobId); done.State != pb.JobState_JOB_SUCCEEDED || done.Attempts != 3 {
+		t.Errorf("expected success on the third attempt, got %v", done)
+	}
+
+	calls.Store(0)
+	job, _ = m.Submit(ctx, "flaky", testParams, SubmitOptions{MaxAttempts: 2})
+	if done := wait(t, m, job.JobId); done.State != pb.JobState_JOB_FAILED || done.Attempts != 2 || done.Error != "connection reset" {
+		t.Errorf("expected failure after 2 attempts, got %v", done)
+	}
+
+	job, _ = m.Submit(ctx, "invalid", testParams, SubmitOptions{})
+	if done := wait(t, m, job.JobId); done.State != pb.JobState_JOB_FAILED || done.Attempts != 1 {
+		t.Errorf("expected permanent errors not to be retried, got %v", done)
+	}
+}
+
+func TestManager_ConcurrencyLimits(t *testing.T) {
+	m := NewManager(NewMemoryStore(), Options{Concurrency: 3})
+	defer m.Stop()
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	m.Register("serial", func(ctx context.Context, _ *anypb.Any, _ ProgressFunc) (proto.Message, error) {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil, nil
+	}, KindOptions{Concurrency: 1})
+
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 4; i++ {
+		job, err := m.Submit(ctx, "serial", testParams, SubmitOptions{})
+		if err != nil {
+			t.Fatalf("Submit failed: %v", err)
+		}
+		ids = append(ids, job.JobId)
+	}
+	for _, id := range ids {
+		if done := wait(t, m, id); done.State != pb.JobState_JOB_SUCCEEDED {
+			t.Errorf("job %s: %v", id, done)
+		}
+	}
+	if peak != 1 {
+		t.Errorf("expected at most 1 concurrent job of the kind, saw %d", peak)
+	}
+}
+
+func TestManager_Cancel(t *testing.T) {
+	m := NewManager(NewMemoryStore(), Options{})
+	defer m.Stop()
+
+	started := make(chan struct{})
+	m.Register("block", func(ctx context.Context, _ *anypb.Any, _ ProgressFunc) (proto.Message, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, KindOptions{})
+
+	ctx := context.Background()
+	job, _ := m.Submit(ctx, "block", testParams, SubmitOptions{})
+	<-started
+
+	cancelled, err := m.Cancel(ctx, job.JobId)
+	if err != nil || cancelled.State != pb.JobState_JOB_CANCELLED || cancelled.FinishedAt == 0 {
+		t.Fatalf("expected CANCELLED, got %v (%v)", cancelled, err)
+	}
+
+	// Cancelling again leaves the job as it is
+	again, err := m.Cancel(ctx, job.JobId)
+	if err != nil || again.State != pb.JobState_JOB_CANCELLED {
+		t.Errorf("unexpected second cancel: %v (%v)", again, err)
+	}
+}
+
+func TestManager_ResumesAfterRestart(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+
+	// The first process is stopped while the job runs
+	first := NewManager(store, Options{})
+	started := make(chan struct{})
+	first.Register("sync", func(ctx context.Context, _ *anypb.Any, _ ProgressFunc) (proto.Message, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, KindOptions{})
+	job, _ := first.Submit(ctx, "sync", testParams, SubmitOptions{})
+	<-started
+	first.Stop()
+
+	stored, _ := store.Load(ctx, job.JobId)
+	if stored.State != pb.JobState_JOB_PENDING || stored.Attempts != 0 {
+		t.Fatalf("expected a stopped job to wait for resumption, got %v", stored)
+	}
+	if _, err := first.Submit(ctx, "sync", testParams, SubmitOptions{}); !errors.Is(err, ErrStopped) {
+		t.Errorf("expected ErrStopped, got %v", err)
+	}
+
+	// Simulate jobs a crashed process left running
+	crashed := proto.Clone(stored).(*pb.Job)
+	crashed.JobId, crashed.State, crashed.Attempts, crashed.MaxAttempts = "crashed", pb.JobState_JOB_RUNNING, 1, 1
+	store.Save(ctx, crashed)
+	orphan := proto.Clone(stored).(*pb.Job)
+	orphan.JobId, orphan.Kind = "orphan", "retired"
+	store.Save(ctx, orphan)
+
+	second := NewManager(store, Options{})
+	defer second.Stop()
+	second.Register("sync", func(ctx context.Context, _ *anypb.Any, _ ProgressFunc) (proto.Message, error) {
+		return nil, nil
+	}, KindOptions{})
+	if err := second.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	if done := wait(t, second, job.JobId); done.State != pb.JobState_JOB_SUCCEEDED || done.Attempts != 1 {
+		t.Errorf("expected the job to resume and succeed, got %v", done)
+	}
+	if got, _ := second.Get(ctx, "crashed"); got.State != pb.JobState_JOB_FAILED {
+		t.Errorf("expected a job interrupted on its final attempt to fail, got %v", got)
+	}
+	if got, _ := second.Get(ctx, "orphan"); got.State != pb.JobState_JOB_FAILED {
+		t.Errorf("expected a job without a handler to fail, got %v", got)
+	}
+
+	list, err := second.List(ctx, ListOptions{States: []pb.JobState{pb.JobState_JOB_FAILED}})
+	if err != nil || len(list) != 2 {
+		t.Errorf("expected 2 failed jobs, got %v (%v)", list, err)
+	}
+	list, _ = second.List(ctx, ListOptions{Kind: "sync", States: []pb.JobState{pb.JobState_JOB_SUCCEEDED}})
+	if len(list) != 1 || list[0].JobId != job.JobId {
+		t.Errorf("unexpected filtered list: %v", list)
+	}
+	list, _ = second.List(ctx, ListOptions{Kind: "sync", Limit: 1})
+	if len(list) != 1 {
+		t.Errorf("unexpected filtered list: %v", list)
+	}
+}
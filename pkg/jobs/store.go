@@ -0,0 +1,67 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"google.golang.org/protobuf/proto"
+)
+
+// Store persists jobs. Implementations must be safe for concurrent use.
+type Store interface {
+	// Save creates or replaces a job.
+	Save(ctx context.Context, job *pb.Job) error
+	// Load returns a job, or ErrNotFound.
+	Load(ctx context.Context, id string) (*pb.Job, error)
+	// List returns every stored job, in any order.
+	List(ctx context.Context) ([]*pb.Job, error)
+	// Delete removes a job; deleting a missing job is not an error.
+	Delete(ctx context.Context, id string) error
+}
+
+// MemoryStore is a Store that keeps jobs in memory, for tests and for
+// processes that need no recovery across restarts.
+type MemoryStore struct {
+	mu   sync.Mutex
+	jobs map[string]*pb.Job
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jobs: make(map[string]*pb.Job)}
+}
+
+func (s *MemoryStore) Save(ctx context.Context, job *pb.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.JobId] = proto.Clone(job).(*pb.Job)
+	return nil
+}
+
+func (s *MemoryStore) Load(ctx context.Context, id string) (*pb.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(job).(*pb.Job), nil
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]*pb.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]*pb.Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, proto.Clone(job).(*pb.Job))
+	}
+	return jobs, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	return nil
+}
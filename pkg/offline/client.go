@@ -0,0 +1,606 @@
+// Package offline provides an embedded, offline-first copy of a remote
+// collection. Applications read and write a local SQLite store and call Sync
+// when connected to push local changes and pull remote ones.
+package offline
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	pendingNone   = ""
+	pendingUpsert = "upsert"
+	pendingDelete = "delete"
+
+	// maxPushRounds bounds how often Sync re-pushes changes rebased by conflict resolution.
+	maxPushRounds = 3
+)
+
+// syncSchema tracks, per record, the remote version local state is based on
+// and whether a local change is waiting to be pushed.
+const syncSchema = `
+CREATE TABLE IF NOT EXISTS sync_records (
+	id TEXT PRIMARY KEY,
+	base_updated_at INTEGER,
+	pending TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS sync_state (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+`
+
+// Config identifies the remote collection a Client mirrors.
+type Config struct {
+	Namespace      string
+	CollectionName string
+
+	// StoreOptions configures the local SQLite store. JSON is always enabled.
+	StoreOptions collection.Options
+
+	// PullPageSize is the number of records requested per PullChanges call.
+	// Zero uses the server default.
+	PullPageSize int
+
+	// Origin, when set, names this client in its pushes, e.g. by device.
+	// A record created here whose ID another client took first is then
+	// renamed to collection.RemappedID(Origin, id), here and remotely,
+	// instead of conflicting.
+	Origin string
+}
+
+// SyncResult summarizes one Sync.
+type SyncResult struct {
+	Pulled    int // Remote records and deletions applied locally
+	Pushed    int // Local changes accepted by the remote
+	Conflicts int // Conflicts passed to the resolver
+
+	// Records created here renamed because their ID was taken remotely,
+	// by their old ID
+	Remapped map[string]string
+}
+
+// Client is a local, offline-capable replica of one remote collection.
+type Client struct {
+	cfg     Config
+	store   *sqlite.SqliteStore
+	local   *collection.Collection
+	db      *sql.DB
+	remote  pb.CollectionServiceClient
+	resolve ConflictResolver
+	mu      sync.Mutex
+}
+
+// NewClient opens (or creates) the local store at path. remote is only used by Sync,
+// so the client works without a reachable server.
+func NewClient(path string, remote pb.CollectionServiceClient, cfg Config) (*Client, error) {
+	if cfg.Namespace == "" || cfg.CollectionName == "" {
+		return nil, fmt.Errorf("namespace and collection name are required")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create local store directory: %w", err)
+	}
+
+	opts := cfg.StoreOptions
+	opts.EnableJSON = true
+	store, err := sqlite.NewSqliteStore(path, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local store: %w", err)
+	}
+
+	local, err := collection.NewCollection(
+		&pb.Collection{Namespace: cfg.Namespace, Name: cfg.CollectionName},
+		store,
+		&collection.LocalFileSystem{},
+	)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=10000", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to open sync state: %w", err)
+	}
+	if _, err := db.Exec(syncSchema); err != nil {
+		db.Close()
+		store.Close()
+		return nil, fmt.Errorf("failed to create sync schema: %w", err)
+	}
+
+	return &Client{
+		cfg:     cfg,
+		store:   store,
+		local:   local,
+		db:      db,
+		remote:  remote,
+		resolve: RemoteWins,
+	}, nil
+}
+
+// SetConflictResolver sets the callback used when local and remote changes
+// to the same record conflict. The default is RemoteWins.
+func (c *Client) SetConflictResolver(r ConflictResolver) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resolve = r
+}
+
+// Close closes the local store.
+func (c *Client) Close() error {
+	c.db.Close()
+	return c.store.Close()
+}
+
+// Put creates or replaces a record locally and queues it for the next Sync.
+func (c *Client) Put(ctx context.Context, id string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	exists, err := c.local.Exists(ctx, id)
+	if err != nil {
+		return err
+	}
+	record := &pb.CollectionRecord{Id: id, ProtoData: data}
+	if exists {
+		err = c.local.UpdateRecord(ctx, record)
+	} else {
+		err = c.local.CreateRecord(ctx, record)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write record %s: %w", id, err)
+	}
+
+	_, err = c.db.ExecContext(ctx, `
+		INSERT INTO sync_records (id, pending) VALUES (?, ?)
+		ON CONFLICT(id) DO UPDATE SET pending = excluded.pending`, id, pendingUpsert)
+	return err
+}
+
+// Delete removes a record locally and queues the deletion for the next Sync.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.local.DeleteRecord(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete record %s: %w", id, err)
+	}
+
+	row, err := c.syncRow(ctx, id)
+	if err != nil {
+		return err
+	}
+	if row.base == nil {
+		// Never synced, so there is nothing to delete remotely
+		return c.forget(ctx, id)
+	}
+	return c.setRow(ctx, id, row.base, pendingDelete)
+}
+
+// Get reads a record from the local store.
+func (c *Client) Get(ctx context.Context, id string) (*pb.CollectionRecord, error) {
+	return c.local.GetRecord(ctx, id)
+}
+
+// Search queries the local store.
+func (c *Client) Search(ctx context.Context, query *collection.SearchQuery) ([]*collection.SearchResult, error) {
+	return c.local.Search(ctx, query)
+}
+
+// Pending returns the number of local changes not yet pushed.
+func (c *Client) Pending(ctx context.Context) (int, error) {
+	var n int
+	err := c.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sync_records WHERE pending != ''").Scan(&n)
+	return n, err
+}
+
+// Sync pulls remote changes, resolving conflicts with pending local changes,
+// and then pushes the remaining local changes. Progress is saved as it goes,
+// so a failed Sync can simply be retried.
+func (c *Client) Sync(ctx context.Context) (*SyncResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := &SyncResult{}
+	if err := c.pull(ctx, result); err != nil {
+		return result, fmt.Errorf("pull failed: %w", err)
+	}
+	for round := 0; round < maxPushRounds; round++ {
+		conflicts, err := c.push(ctx, result)
+		if err != nil {
+			return result, fmt.Errorf("push failed: %w", err)
+		}
+		if conflicts == 0 {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (c *Client) pull(ctx context.Context, result *SyncResult) error {
+	since, afterID, err := c.cursor(ctx)
+	if err != nil {
+		return err
+	}
+
+	first := true
+	for {
+		req := &pb.PullChangesRequest{
+			Namespace:      c.cfg.Namespace,
+			CollectionName: c.cfg.CollectionName,
+			Since:          since,
+			AfterId:        afterID,
+			Limit:          int32(c.cfg.PullPageSize),
+		}
+		resp, err := c.remote.PullChanges(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		// Deletions are reported relative to since, so the first page covers them all
+		if first {
+			for _, id := range resp.DeletedIds {
+				applied, err := c.applyRemoteDelete(ctx, id, result)
+				if err != nil {
+					return err
+				}
+				if applied {
+					result.Pulled++
+				}
+			}
+			first = false
+		}
+
+		for _, r := range resp.Records {
+			if err := c.applyRemote(ctx, r, result); err != nil {
+				return err
+			}
+			result.Pulled++
+			since, afterID = r.UpdatedAt, r.Id
+		}
+		if len(resp.Records) > 0 {
+			if err := c.saveCursor(ctx, since, afterID); err != nil {
+				return err
+			}
+		}
+		if !resp.HasMore {
+			return nil
+		}
+	}
+}
+
+// applyRemote applies a pulled record, handing it to the resolver if a local
+// change based on an older version is pending.
+func (c *Client) applyRemote(ctx context.Context, r *pb.SyncRecord, result *SyncResult) error {
+	row, err := c.syncRow(ctx, r.Id)
+	if err != nil {
+		return err
+	}
+	if row.pending != pendingNone {
+		if row.base != nil && *row.base == r.UpdatedAt.GetSeconds() {
+			return nil
+		}
+		if row.base == nil && row.pending == pendingUpsert && c.cfg.Origin != "" {
+			// Created here and remotely: two records, not a conflict
+			if err := c.rename(ctx, r.Id, result); err != nil {
+				return err
+			}
+			if err := c.writeLocal(ctx, r); err != nil {
+				return err
+			}
+			return c.setRow(ctx, r.Id, seconds(r.UpdatedAt), pendingNone)
+		}
+		result.Conflicts++
+		return c.resolveConflict(ctx, r.Id, r)
+	}
+	if err := c.writeLocal(ctx, r); err != nil {
+		return err
+	}
+	return c.setRow(ctx, r.Id, seconds(r.UpdatedAt), pendingNone)
+}
+
+// applyRemoteDelete applies a pulled deletion and reports whether local state changed.
+func (c *Client) applyRemoteDelete(ctx context.Context, id string, result *SyncResult) (bool, error) {
+	row, err := c.syncRow(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case row.pending == pendingDelete:
+		return true, c.forget(ctx, id)
+	case row.pending != pendingNone:
+		result.Conflicts++
+		return true, c.resolveConflict(ctx, id, nil)
+	case row.base == nil:
+		// Not known locally
+		return false, nil
+	}
+	if err := c.local.DeleteRecord(ctx, id); err != nil {
+		return false, err
+	}
+	return true, c.forget(ctx, id)
+}
+
+func (c *Client) push(ctx context.Context, result *SyncResult) (int, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT id, base_updated_at, pending FROM sync_records WHERE pending != '' ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+	var pending []syncRow
+	for rows.Next() {
+		var row syncRow
+		var base sql.NullInt64
+		if err := rows.Scan(&row.id, &base, &row.pending); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if base.Valid {
+			row.base = &base.Int64
+		}
+		pending = append(pending, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	req := &pb.PushChangesRequest{Namespace: c.cfg.Namespace, CollectionName: c.cfg.CollectionName}
+	if c.cfg.Origin != "" {
+		req.Origin = c.cfg.Origin
+		req.OnIdCollision = pb.IdCollisionPolicy_ID_COLLISION_REMAP
+	}
+	for _, row := range pending {
+		change := &pb.RecordChange{Id: row.id, Deleted: row.pending == pendingDelete}
+		if row.base != nil {
+			change.BaseUpdatedAt = &timestamppb.Timestamp{Seconds: *row.base}
+		}
+		if !change.Deleted {
+			record, err := c.local.GetRecord(ctx, row.id)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read pending record %s: %w", row.id, err)
+			}
+			change.Data = record.ProtoData
+		}
+		req.Changes = append(req.Changes, change)
+	}
+
+	resp, err := c.remote.PushChanges(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	// Records taken remotely while this push was on its way were stored
+	// under their remapped ID, which the rename gives them here too
+	for id := range resp.RemappedIds {
+		if err := c.rename(ctx, id, result); err != nil {
+			return 0, err
+		}
+	}
+	for _, r := range resp.Applied {
+		if err := c.setRow(ctx, r.Id, seconds(r.UpdatedAt), pendingNone); err != nil {
+			return 0, err
+		}
+		result.Pushed++
+	}
+	for _, id := range resp.DeletedIds {
+		if err := c.forget(ctx, id); err != nil {
+			return 0, err
+		}
+		result.Pushed++
+	}
+	for _, conflict := range resp.Conflicts {
+		result.Conflicts++
+		if err := c.resolveConflict(ctx, conflict.Id, conflict.Remote); err != nil {
+			return 0, err
+		}
+	}
+	return len(resp.Conflicts), nil
+}
+
+// resolveConflict asks the resolver how to reconcile a pending local change
+// with remote (nil if the record was deleted remotely) and applies the answer.
+func (c *Client) resolveConflict(ctx context.Context, id string, remote *pb.SyncRecord) error {
+	row, err := c.syncRow(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	conflict := &Conflict{ID: id}
+	if row.pending != pendingDelete {
+		local, err := c.local.GetRecord(ctx, id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		conflict.Local = local
+	}
+	if remote != nil {
+		conflict.Remote = &pb.CollectionRecord{
+			Id:        remote.Id,
+			ProtoData: remote.Data,
+			Metadata:  &pb.Metadata{CreatedAt: remote.CreatedAt, UpdatedAt: remote.UpdatedAt},
+		}
+	}
+
+	res, err := c.resolve(ctx, conflict)
+	if err != nil {
+		return fmt.Errorf("conflict resolver failed for %s: %w", id, err)
+	}
+
+	// Keeping or merging the local change rebases it on the remote version
+	base := seconds(remote.GetUpdatedAt())
+	switch res.Action {
+	case KeepRemote:
+		if remote == nil {
+			if err := c.local.DeleteRecord(ctx, id); err != nil {
+				return err
+			}
+			return c.forget(ctx, id)
+		}
+		if err := c.writeLocal(ctx, remote); err != nil {
+			return err
+		}
+		return c.setRow(ctx, id, base, pendingNone)
+	case KeepLocal:
+		if remote == nil && row.pending == pendingDelete {
+			return c.forget(ctx, id)
+		}
+		return c.setRow(ctx, id, base, row.pending)
+	case Merge:
+		merged := &pb.SyncRecord{Id: id, Data: res.Data, UpdatedAt: timestamppb.Now()}
+		if remote != nil {
+			merged.CreatedAt = remote.CreatedAt
+		}
+		if err := c.writeLocal(ctx, merged); err != nil {
+			return err
+		}
+		return c.setRow(ctx, id, base, pendingUpsert)
+	default:
+		return fmt.Errorf("unknown conflict resolution %d for %s", res.Action, id)
+	}
+}
+
+// rename moves the local record id, created here and not yet pushed, to its
+// remapped ID, pending creation there.
+func (c *Client) rename(ctx context.Context, id string, result *SyncResult) error {
+	to := collection.RemappedID(c.cfg.Origin, id)
+	record, err := c.local.GetRecord(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to read record %s: %w", id, err)
+	}
+	if err := c.writeLocal(ctx, &pb.SyncRecord{Id: to, Data: record.ProtoData, CreatedAt: record.Metadata.GetCreatedAt(), UpdatedAt: record.Metadata.GetUpdatedAt()}); err != nil {
+		return fmt.Errorf("failed to rename record %s to %s: %w", id, to, err)
+	}
+	if err := c.local.DeleteRecord(ctx, id); err != nil {
+		return err
+	}
+	if err := c.forget(ctx, id); err != nil {
+		return err
+	}
+	if result.Remapped == nil {
+		result.Remapped = make(map[string]string)
+	}
+	result.Remapped[id] = to
+	return c.setRow(ctx, to, nil, pendingUpsert)
+}
+
+// writeLocal stores r in the local store, keeping its timestamps.
+func (c *Client) writeLocal(ctx context.Context, r *pb.SyncRecord) error {
+	createdAt := r.CreatedAt
+	if createdAt == nil {
+		createdAt = r.UpdatedAt
+	}
+	record := &pb.CollectionRecord{
+		Id:        r.Id,
+		ProtoData: r.Data,
+		Metadata:  &pb.Metadata{CreatedAt: createdAt, UpdatedAt: r.UpdatedAt},
+	}
+
+	exists, err := c.local.Exists(ctx, r.Id)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return c.store.UpdateRecord(ctx, record)
+	}
+	return c.store.CreateRecord(ctx, record)
+}
+
+type syncRow struct {
+	id      string
+	base    *int64
+	pending string
+}
+
+func (c *Client) syncRow(ctx context.Context, id string) (syncRow, error) {
+	row := syncRow{id: id}
+	var base sql.NullInt64
+	err := c.db.QueryRowContext(ctx, "SELECT base_updated_at, pending FROM sync_records WHERE id = ?", id).Scan(&base, &row.pending)
+	if errors.Is(err, sql.ErrNoRows) {
+		return row, nil
+	}
+	if err != nil {
+		return row, err
+	}
+	if base.Valid {
+		row.base = &base.Int64
+	}
+	return row, nil
+}
+
+func (c *Client) setRow(ctx context.Context, id string, base *int64, pending string) error {
+	_, err := c.db.ExecContext(ctx, `
+		INSERT INTO sync_records (id, base_updated_at, pending) VALUES (?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET base_updated_at = excluded.base_updated_at, pending = excluded.pending`,
+		id, base, pending)
+	return err
+}
+
+func (c *Client) forget(ctx context.Context, id string) error {
+	_, err := c.db.ExecContext(ctx, "DELETE FROM sync_records WHERE id = ?", id)
+	return err
+}
+
+// cursor returns the (updated_at, id) position of the last pulled record.
+func (c *Client) cursor(ctx context.Context) (*timestamppb.Timestamp, string, error) {
+	values := map[string]string{}
+	rows, err := c.db.QueryContext(ctx, "SELECT key, value FROM sync_state WHERE key IN ('cursor_updated_at', 'cursor_id')")
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, "", err
+		}
+		values[k] = v
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	raw, ok := values["cursor_updated_at"]
+	if !ok {
+		return nil, "", nil
+	}
+	secs, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid sync cursor %q: %w", raw, err)
+	}
+	return &timestamppb.Timestamp{Seconds: secs}, values["cursor_id"], nil
+}
+
+func (c *Client) saveCursor(ctx context.Context, since *timestamppb.Timestamp, afterID string) error {
+	_, err := c.db.ExecContext(ctx, `
+		INSERT INTO sync_state (key, value) VALUES ('cursor_updated_at', ?), ('cursor_id', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`,
+		strconv.FormatInt(since.GetSeconds(), 10), afterID)
+	return err
+}
+
+// seconds returns ts as Unix seconds, or nil for an unset timestamp.
+func seconds(ts *timestamppb.Timestamp) *int64 {
+	if ts == nil {
+		return nil
+	}
+	s := ts.Seconds
+	return &s
+}
@@ -0,0 +1,279 @@
+package offline_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"github.com/accretional/collector/pkg/offline"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// startServer serves a history-enabled "edge/notes" collection over loopback TCP.
+func startServer(t *testing.T) (*collection.Collection, pb.CollectionServiceClient) {
+	t.Helper()
+	ctx := context.Background()
+
+	store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), "central.db"), collection.Options{EnableJSON: true, EnableHistory: true})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	repo := collection.NewCollectionRepo(store)
+	if _, err := repo.CreateCollection(ctx, &pb.Collection{Namespace: "edge", Name: "notes"}); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, err := repo.GetCollection(ctx, "edge", "notes")
+	if err != nil {
+		t.Fatalf("failed to get collection: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	pb.RegisterCollectionServiceServer(grpcServer, collection.NewCollectionServer(repo))
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	return coll, dial(t, lis.Addr().String())
+}
+
+func dial(t *testing.T, addr string) pb.CollectionServiceClient {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewCollectionServiceClient(conn)
+}
+
+func newClient(t *testing.T, remote pb.CollectionServiceClient, name string) *offline.Client {
+	t.Helper()
+	client, err := offline.NewClient(filepath.Join(t.TempDir(), name+".db"), remote, offline.Config{
+		Namespace:      "edge",
+		CollectionName: "notes",
+		PullPageSize:   2,
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func mustSync(t *testing.T, client *offline.Client) *offline.SyncResult {
+	t.Helper()
+	result, err := client.Sync(context.Background())
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	return result
+}
+
+func assertData(t *testing.T, client *offline.Client, id, want string) {
+	t.Helper()
+	r, err := client.Get(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Get(%s) failed: %v", id, err)
+	}
+	if string(r.ProtoData) != want {
+		t.Errorf("Get(%s) = %s, want %s", id, r.ProtoData, want)
+	}
+}
+
+func TestClient_PushAndPull(t *testing.T) {
+	ctx := context.Background()
+	central, remote := startServer(t)
+	a := newClient(t, remote, "a")
+	b := newClient(t, remote, "b")
+
+	for i := 0; i < 5; i++ {
+		if err := a.Put(ctx, fmt.Sprintf("n%d", i), []byte(fmt.Sprintf(`{"n": %d}`, i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if n, _ := a.Pending(ctx); n != 5 {
+		t.Fatalf("expected 5 pending changes, got %d", n)
+	}
+
+	if result := mustSync(t, a); result.Pushed != 5 {
+		t.Errorf("expected 5 pushed, got %+v", result)
+	}
+	if n, _ := a.Pending(ctx); n != 0 {
+		t.Errorf("expected no pending changes after sync, got %d", n)
+	}
+	if count, _ := central.CountRecords(ctx); count != 5 {
+		t.Errorf("expected 5 central records, got %d", count)
+	}
+
+	// b pulls everything across several pages
+	if result := mustSync(t, b); result.Pulled != 5 {
+		t.Errorf("expected 5 pulled, got %+v", result)
+	}
+	assertData(t, b, "n3", `{"n": 3}`)
+
+	// Deletions propagate
+	if err := a.Delete(ctx, "n3"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	mustSync(t, a)
+	mustSync(t, b)
+	if _, err := b.Get(ctx, "n3"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected n3 deleted on b, got %v", err)
+	}
+	assertData(t, b, "n4", `{"n": 4}`)
+}
+
+func TestClient_ConflictResolution(t *testing.T) {
+	ctx := context.Background()
+	central, remote := startServer(t)
+
+	// Seed an old version so later edits get a distinct updated_at
+	old := timestamppb.New(time.Now().Add(-time.Hour))
+	if err := central.Store.CreateRecord(ctx, &pb.CollectionRecord{
+		Id:        "doc",
+		ProtoData: []byte(`{"v": "base"}`),
+		Metadata:  &pb.Metadata{CreatedAt: old, UpdatedAt: old},
+	}); err != nil {
+		t.Fatalf("failed to seed record: %v", err)
+	}
+
+	a := newClient(t, remote, "a")
+	b := newClient(t, remote, "b")
+	mustSync(t, a)
+	mustSync(t, b)
+
+	// Both edit the same record while "offline"; a syncs first
+	if err := a.Put(ctx, "doc", []byte(`{"v": "from a"}`)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Put(ctx, "doc", []byte(`{"v": "from b"}`)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	mustSync(t, a)
+
+	var seen *offline.Conflict
+	b.SetConflictResolver(func(ctx context.Context, c *offline.Conflict) (offline.Resolution, error) {
+		seen = c
+		merged := fmt.Sprintf(`{"remote": %q, "local": %q}`, c.Remote.ProtoData, c.Local.ProtoData)
+		return offline.Resolution{Action: offline.Merge, Data: []byte(merged)}, nil
+	})
+	result := mustSync(t, b)
+	if result.Conflicts != 1 || result.Pushed != 1 {
+		t.Errorf("expected one resolved conflict and one push, got %+v", result)
+	}
+	if seen == nil || string(seen.Local.ProtoData) != `{"v": "from b"}` || string(seen.Remote.ProtoData) != `{"v": "from a"}` {
+		t.Fatalf("unexpected conflict: %+v", seen)
+	}
+
+	stored, err := central.GetRecord(ctx, "doc")
+	if err != nil {
+		t.Fatalf("GetRecord failed: %v", err)
+	}
+	want := `{"remote": "{\"v\": \"from a\"}", "local": "{\"v\": \"from b\"}"}`
+	if string(stored.ProtoData) != want {
+		t.Errorf("central has %s, want %s", stored.ProtoData, want)
+	}
+
+	mustSync(t, a)
+	assertData(t, a, "doc", want)
+}
+
+func TestClient_Offline(t *testing.T) {
+	ctx := context.Background()
+
+	// Nothing listens on this address
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	client := newClient(t, dial(t, addr), "edge")
+	if err := client.Put(ctx, "n1", []byte(`{"n": 1}`)); err != nil {
+		t.Fatalf("Put failed while offline: %v", err)
+	}
+	assertData(t, client, "n1", `{"n": 1}`)
+
+	shortCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if _, err := client.Sync(shortCtx); err == nil {
+		t.Fatal("expected Sync to fail while offline")
+	}
+	if n, _ := client.Pending(ctx); n != 1 {
+		t.Errorf("expected the change to stay pending, got %d", n)
+	}
+}
+
+func TestClient_RemapsIDCollisions(t *testing.T) {
+	ctx := context.Background()
+	central, remote := startServer(t)
+	clients := make(map[string]*offline.Client)
+	for _, origin := range []string{"a", "b"} {
+		client, err := offline.NewClient(filepath.Join(t.TempDir(), origin+".db"), remote, offline.Config{Namespace: "edge", CollectionName: "notes", Origin: origin})
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		clients[origin] = client
+	}
+	a, b := clients["a"], clients["b"]
+
+	// Both create "todo" while apart; b learns of a's when it pulls
+	if err := a.Put(ctx, "todo", []byte(`{"by": "a"}`)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := b.Put(ctx, "todo", []byte(`{"by": "b"}`)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	mustSync(t, a)
+	if result := mustSync(t, b); result.Conflicts != 0 || result.Remapped["todo"] != "b:todo" || result.Pushed != 1 {
+		t.Errorf("expected b's todo renamed to b:todo and pushed, got %+v", result)
+	}
+	assertData(t, b, "todo", `{"by": "a"}`)
+	assertData(t, b, "b:todo", `{"by": "b"}`)
+	mustSync(t, a)
+	assertData(t, a, "b:todo", `{"by": "b"}`)
+	if count, _ := central.CountRecords(ctx); count != 2 {
+		t.Errorf("expected both records kept centrally, got %d", count)
+	}
+
+	// A collision the pushing client has not pulled yet is remapped remotely
+	push := func(policy pb.IdCollisionPolicy, origin string) (*pb.PushChangesResponse, error) {
+		return remote.PushChanges(ctx, &pb.PushChangesRequest{
+			Namespace: "edge", CollectionName: "notes",
+			Changes: []*pb.RecordChange{{Id: "todo", Data: []byte(`{"by": "c"}`)}},
+			Origin:  origin, OnIdCollision: policy,
+		})
+	}
+	if resp, err := push(pb.IdCollisionPolicy_ID_COLLISION_CONFLICT, "c"); err != nil || len(resp.Conflicts) != 1 {
+		t.Errorf("expected a conflict by default, got %v %v", resp, err)
+	}
+	if _, err := push(pb.IdCollisionPolicy_ID_COLLISION_REMAP, ""); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected remapping without an origin refused, got %v", err)
+	}
+	resp, err := push(pb.IdCollisionPolicy_ID_COLLISION_REMAP, "c")
+	if err != nil || resp.RemappedIds["todo"] != "c:todo" || len(resp.Applied) != 1 || resp.Applied[0].Id != "c:todo" {
+		t.Fatalf("expected todo stored as c:todo, got %v %v", resp, err)
+	}
+	if resp, err := push(pb.IdCollisionPolicy_ID_COLLISION_REMAP, "c"); err != nil || len(resp.Conflicts) != 1 || len(resp.RemappedIds) != 0 {
+		t.Errorf("expected a conflict once the remapped id is taken too, got %v %v", resp, err)
+	}
+}
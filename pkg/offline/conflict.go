@@ -0,0 +1,48 @@
+package offline
+
+import (
+	"context"
+
+	pb "github.com/accretional/collector/gen/collector"
+)
+
+// Action says how a conflict is resolved.
+type Action int
+
+const (
+	// KeepRemote discards the local change and takes the remote version.
+	KeepRemote Action = iota
+	// KeepLocal keeps the local change and pushes it over the remote version.
+	KeepLocal
+	// Merge replaces the local change with Resolution.Data and pushes that.
+	Merge
+)
+
+// Conflict describes a record changed both locally and remotely since the
+// last Sync. Local is nil if the record was deleted locally; Remote is nil if
+// it was deleted remotely.
+type Conflict struct {
+	ID     string
+	Local  *pb.CollectionRecord
+	Remote *pb.CollectionRecord
+}
+
+// Resolution is a ConflictResolver's decision.
+type Resolution struct {
+	Action Action
+	Data   []byte // Merged record content, for Merge
+}
+
+// ConflictResolver decides how to reconcile a Conflict. Returning an error
+// aborts the Sync; the conflict is offered again on the next one.
+type ConflictResolver func(ctx context.Context, c *Conflict) (Resolution, error)
+
+// RemoteWins resolves every conflict in favor of the remote version.
+func RemoteWins(ctx context.Context, c *Conflict) (Resolution, error) {
+	return Resolution{Action: KeepRemote}, nil
+}
+
+// LocalWins resolves every conflict in favor of the local change.
+func LocalWins(ctx context.Context, c *Conflict) (Resolution, error) {
+	return Resolution{Action: KeepLocal}, nil
+}
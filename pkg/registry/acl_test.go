@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestRegisterService_MethodACLs(t *testing.T) {
+	ctx := context.Background()
+	server, _, _ := setupTestServer(t)
+	desc := &descriptorpb.ServiceDescriptorProto{
+		Name: proto.String("Payroll"),
+		Method: []*descriptorpb.MethodDescriptorProto{
+			{Name: proto.String("Run")},
+			{Name: proto.String("Preview")},
+		},
+	}
+
+	for name, acls := range map[string]map[string]*collector.MethodACL{
+		"unknown method": {"Void": {Principals: []string{"alice"}}},
+		"empty acl":      {"Run": {}},
+	} {
+		_, err := server.RegisterService(ctx, &collector.RegisterServiceRequest{Namespace: "hr", ServiceDescriptor: desc, MethodAcls: acls})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", name, err)
+		}
+	}
+
+	if _, err := server.RegisterService(ctx, &collector.RegisterServiceRequest{
+		Namespace:         "hr",
+		ServiceDescriptor: desc,
+		MethodAcls: map[string]*collector.MethodACL{
+			"Run": {Collectors: []string{"payroll-1"}, Principals: []string{"alice"}},
+		},
+	}); err != nil {
+		t.Fatalf("RegisterService failed: %v", err)
+	}
+
+	validator := NewRegistryValidator(server)
+	acl, err := validator.MethodACL(ctx, "hr", "Payroll", "Run")
+	if err != nil || len(acl.GetCollectors()) != 1 || acl.Collectors[0] != "payroll-1" {
+		t.Errorf("expected the Run acl, got %v (%v)", acl, err)
+	}
+	if acl, err := validator.MethodACL(ctx, "hr", "Payroll", "Preview"); err != nil || acl != nil {
+		t.Errorf("expected Preview to be unrestricted, got %v (%v)", acl, err)
+	}
+	lookup, _ := server.LookupService(ctx, &collector.LookupServiceRequest{Namespace: "hr", ServiceName: "Payroll"})
+	if lookup.Service.MethodAcls["Run"] == nil {
+		t.Errorf("expected LookupService to include the acl, got %v", lookup.Service)
+	}
+}
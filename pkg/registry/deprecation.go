@@ -0,0 +1,94 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DeprecateService marks a registered service, or one of its methods, as
+// deprecated. A request without a deprecation clears the existing one. The
+// service stays callable; dispatchers surface the notice to callers.
+func (s *RegistryServer) DeprecateService(ctx context.Context, req *collector.DeprecateServiceRequest) (*collector.DeprecateServiceResponse, error) {
+	if req.Namespace == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "namespace is required")
+	}
+	if req.ServiceName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "service name is required")
+	}
+	dep := req.Deprecation
+	if dep != nil {
+		dep = proto.Clone(dep).(*collector.Deprecation)
+		if dep.DeprecatedAt == nil {
+			dep.DeprecatedAt = timestamppb.Now()
+		}
+		if dep.SunsetAt != nil && dep.SunsetAt.AsTime().Before(dep.DeprecatedAt.AsTime()) {
+			return nil, status.Errorf(codes.InvalidArgument, "sunset_at must not be before deprecated_at")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	service, err := s.lookupService(ctx, req.Namespace, req.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case req.MethodName == "":
+		service.Deprecation = dep
+	case !slices.Contains(service.MethodNames, req.MethodName):
+		return nil, status.Errorf(codes.NotFound, "method %s not found on service %s", req.MethodName, service.Id)
+	case dep == nil:
+		delete(service.MethodDeprecations, req.MethodName)
+	default:
+		if service.MethodDeprecations == nil {
+			service.MethodDeprecations = make(map[string]*collector.Deprecation)
+		}
+		service.MethodDeprecations[req.MethodName] = dep
+	}
+
+	service.Version++
+	if err := s.replaceService(ctx, service); err != nil {
+		return nil, err
+	}
+	s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_UPDATED, service.Namespace, "", service.Id, service.Version)
+
+	return &collector.DeprecateServiceResponse{
+		Status:  &collector.Status{Code: collector.Status_OK},
+		Service: service,
+	}, nil
+}
+
+// replaceService overwrites a stored service. Registry records hold binary
+// protos, which the stores only accept on create, so the old record is
+// deleted first.
+func (s *RegistryServer) replaceService(ctx context.Context, service *collector.RegisteredService) error {
+	data, err := proto.Marshal(service)
+	if err != nil {
+		return err
+	}
+	if err := s.registeredServices.DeleteRecord(ctx, service.Id); err != nil {
+		return fmt.Errorf("replace %s: %w", service.Id, err)
+	}
+	if err := s.registeredServices.CreateRecord(ctx, &collector.CollectionRecord{Id: service.Id, ProtoData: data}); err != nil {
+		return fmt.Errorf("replace %s: %w", service.Id, err)
+	}
+	return nil
+}
+
+// methodDeprecation returns the deprecation that applies to a method of a
+// registered service: the method's own, or else the service's. It returns nil
+// when the method is not deprecated.
+func methodDeprecation(service *collector.RegisteredService, methodName string) *collector.Deprecation {
+	if dep := service.GetMethodDeprecations()[methodName]; dep != nil {
+		return dep
+	}
+	return service.GetDeprecation()
+}
@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestDeprecateService(t *testing.T) {
+	ctx := context.Background()
+	server, _, _ := setupTestServer(t)
+	if _, err := server.RegisterService(ctx, &collector.RegisterServiceRequest{
+		Namespace: "billing",
+		ServiceDescriptor: &descriptorpb.ServiceDescriptorProto{
+			Name: proto.String("Billing"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				{Name: proto.String("Charge")},
+				{Name: proto.String("Refund")},
+			},
+		},
+	}); err != nil {
+		t.Fatalf("RegisterService failed: %v", err)
+	}
+	validator := NewRegistryValidator(server)
+	sunset := timestamppb.New(time.Now().Add(90 * 24 * time.Hour))
+
+	// Deprecating the service applies to every method
+	resp, err := server.DeprecateService(ctx, &collector.DeprecateServiceRequest{
+		Namespace:   "billing",
+		ServiceName: "Billing",
+		Deprecation: &collector.Deprecation{Message: "moving to payments", SunsetAt: sunset},
+	})
+	if err != nil {
+		t.Fatalf("DeprecateService failed: %v", err)
+	}
+	if resp.Service.Deprecation.GetDeprecatedAt() == nil {
+		t.Error("expected deprecated_at to default to now")
+	}
+	dep, err := validator.Deprecation(ctx, "billing", "Billing", "Refund")
+	if err != nil || dep.GetMessage() != "moving to payments" {
+		t.Errorf("expected the service deprecation for Refund, got %v (%v)", dep, err)
+	}
+
+	// A method's own deprecation takes precedence
+	if _, err := server.DeprecateService(ctx, &collector.DeprecateServiceRequest{
+		Namespace:   "billing",
+		ServiceName: "Billing",
+		MethodName:  "Charge",
+		Deprecation: &collector.Deprecation{Replacement: "payments/Payments.Charge", SunsetAt: sunset},
+	}); err != nil {
+		t.Fatalf("DeprecateService failed: %v", err)
+	}
+	validate, _ := server.ValidateMethod(ctx, &collector.ValidateMethodRequest{Namespace: "billing", ServiceName: "Billing", MethodName: "Charge"})
+	if !validate.IsValid || validate.Deprecation.GetReplacement() != "payments/Payments.Charge" {
+		t.Errorf("expected the method deprecation, got %v", validate)
+	}
+
+	// Lookups and listings expose the deprecations
+	list, _ := server.ListServices(ctx, &collector.ListServicesRequest{Namespace: "billing"})
+	if len(list.Services) != 1 || list.Services[0].Deprecation == nil || list.Services[0].MethodDeprecations["Charge"] == nil {
+		t.Errorf("expected ListServices to include deprecations, got %v", list.Services)
+	}
+
+	// Clearing the service deprecation leaves the method's in place
+	if _, err := server.DeprecateService(ctx, &collector.DeprecateServiceRequest{Namespace: "billing", ServiceName: "Billing"}); err != nil {
+		t.Fatalf("DeprecateService failed: %v", err)
+	}
+	if dep, _ := validator.Deprecation(ctx, "billing", "Billing", "Refund"); dep != nil {
+		t.Errorf("expected Refund to be undeprecated, got %v", dep)
+	}
+	lookup, _ := server.LookupService(ctx, &collector.LookupServiceRequest{Namespace: "billing", ServiceName: "Billing"})
+	if lookup.Service.Deprecation != nil || lookup.Service.MethodDeprecations["Charge"] == nil {
+		t.Errorf("expected only the Charge deprecation to remain, got %v", lookup.Service)
+	}
+
+	for name, req := range map[string]*collector.DeprecateServiceRequest{
+		"unknown service": {Namespace: "billing", ServiceName: "Invoices"},
+		"unknown method":  {Namespace: "billing", ServiceName: "Billing", MethodName: "Void"},
+	} {
+		if _, err := server.DeprecateService(ctx, req); status.Code(err) != codes.NotFound {
+			t.Errorf("%s: expected NotFound, got %v", name, err)
+		}
+	}
+	if _, err := server.DeprecateService(ctx, &collector.DeprecateServiceRequest{
+		Namespace:   "billing",
+		ServiceName: "Billing",
+		Deprecation: &collector.Deprecation{SunsetAt: timestamppb.New(time.Now().Add(-time.Hour))},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected a sunset in the past to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package registry
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// wellKnownPrefix is where the well-known types imports may always name live.
+const wellKnownPrefix = "google/protobuf/"
+
+// RegisterDescriptorSet registers every file of a descriptor set, all or
+// nothing. Files are ordered so imports come first, and each is built
+// against its imports, so missing imports, import cycles and unresolved
+// type references are refused before anything is stored.
+func (s *RegistryServer) RegisterDescriptorSet(ctx context.Context, req *collector.RegisterDescriptorSetRequest) (*collector.RegisterDescriptorSetResponse, error) {
+	if req.Namespace == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "namespace is required")
+	}
+	if len(req.DescriptorSet.GetFile()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "descriptor set has no files")
+	}
+	namespace := s.aliases.Resolve(req.Namespace)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.typesChanged()
+	ordered, err := sortByImports(req.DescriptorSet.File)
+	if err != nil {
+		return nil, err
+	}
+
+	// Imports from outside the set must already resolve
+	files := new(protoregistry.Files)
+	inSet := make(map[string]bool, len(ordered))
+	for _, fd := range ordered {
+		inSet[fd.GetName()] = true
+	}
+	var missing []string
+	for _, fd := range ordered {
+		for _, dep := range fd.Dependency {
+			if inSet[dep] {
+				continue
+			}
+			if err := s.loadImport(ctx, namespace, dep, files, nil); err != nil {
+				if status.Code(err) != codes.NotFound {
+					return nil, err
+				}
+				missing = append(missing, fmt.Sprintf("%s (imported by %s)", dep, fd.GetName()))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "missing imports: %s", strings.Join(missing, ", "))
+	}
+	for _, fd := range ordered {
+		built, err := protodesc.NewFile(fd, files)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s: %v", fd.GetName(), err)
+		}
+		if err := files.RegisterFile(built); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s: %v", fd.GetName(), err)
+		}
+	}
+
+	for _, fd := range ordered {
+		protoID := fmt.Sprintf("%s/%s", namespace, fd.GetName())
+		if _, err := s.registeredProtos.GetRecord(ctx, protoID); err == nil {
+			return nil, status.Errorf(codes.AlreadyExists, "proto %s already exists", protoID)
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	var ids []string
+	for _, fd := range ordered {
+		registered := &collector.RegisteredProto{
+			Id:        fmt.Sprintf("%s/%s", namespace, fd.GetName()),
+			Namespace: namespace,
+			Version:   1,
+		}
+		setFile(registered, fd)
+		recordVersion(ctx, nil, registered)
+		data, err := proto.Marshal(registered)
+		if err == nil {
+			err = s.registeredProtos.CreateRecord(ctx, &collector.CollectionRecord{Id: registered.Id, ProtoData: data})
+		}
+		if err != nil {
+			for _, id := range ids {
+				s.registeredProtos.DeleteRecord(ctx, id)
+			}
+			return nil, fmt.Errorf("register %s: %w", registered.Id, err)
+		}
+		ids = append(ids, registered.Id)
+	}
+	for _, id := range ids {
+		s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_REGISTERED, namespace, id, "", 1)
+	}
+
+	return &collector.RegisterDescriptorSetResponse{
+		Status:   &collector.Status{Code: collector.Status_OK},
+		ProtoIds: ids,
+	}, nil
+}
+
+// sortByImports orders files so every file comes after the files of the set
+// it imports, refusing duplicates and import cycles.
+func sortByImports(fds []*descriptorpb.FileDescriptorProto) ([]*descriptorpb.FileDescriptorProto, error) {
+	byName := make(map[string]*descriptorpb.FileDescriptorProto, len(fds))
+	for _, fd := range fds {
+		if fd.GetName() == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "file descriptor name is required")
+		}
+		if byName[fd.GetName()] != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is in the descriptor set twice", fd.GetName())
+		}
+		byName[fd.GetName()] = fd
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int, len(fds))
+	ordered := make([]*descriptorpb.FileDescriptorProto, 0, len(fds))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return status.Errorf(codes.InvalidArgument, "import cycle: %s", strings.Join(append(path, name), " -> "))
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		fd := byName[name]
+		for _, dep := range fd.Dependency {
+			if byName[dep] != nil {
+				if err := visit(dep, append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = done
+		ordered = append(ordered, fd)
+		return nil
+	}
+	// Visit in the set's order, so independent files keep it
+	for _, fd := range fds {
+		if err := visit(fd.GetName(), nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// loadImport adds an import from outside a descriptor set to files: a proto
+// registered in namespace, built with its own imports, or a well-known type.
+// It returns NotFound when the import is neither.
+func (s *RegistryServer) loadImport(ctx context.Context, namespace, path string, files *protoregistry.Files, loading []string) error {
+	if _, err := files.FindFileByPath(path); err == nil {
+		return nil
+	}
+	for _, p := range loading {
+		if p == path {
+			return status.Errorf(codes.FailedPrecondition, "registered protos import each other: %s", strings.Join(append(loading, path), " -> "))
+		}
+	}
+
+	registered, err := s.LookupProto(ctx, namespace, path)
+	if status.Code(err) == codes.NotFound {
+		if !strings.HasPrefix(path, wellKnownPrefix) {
+			return err
+		}
+		wellKnown, err := protoregistry.GlobalFiles.FindFileByPath(path)
+		if err != nil {
+			return status.Errorf(codes.NotFound, "%s is not a well-known type", path)
+		}
+		return files.RegisterFile(wellKnown)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, dep := range registered.FileDescriptor.GetDependency() {
+		if err := s.loadImport(ctx, namespace, dep, files, append(loading, path)); err != nil {
+			if status.Code(err) == codes.NotFound {
+				return status.Errorf(codes.FailedPrecondition, "registered %s imports %s, which is not registered", registered.Id, dep)
+			}
+			return err
+		}
+	}
+	built, err := protodesc.NewFile(registered.FileDescriptor, files)
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "registered %s does not build: %v", registered.Id, err)
+	}
+	return files.RegisterFile(built)
+}
@@ -0,0 +1,111 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// testFile returns a proto3 file in package shop with one message, whose
+// fields have the given type names, importing deps.
+func testFile(name, message string, deps []string, fieldTypes ...string) *descriptorpb.FileDescriptorProto {
+	msg := &descriptorpb.DescriptorProto{Name: proto.String(message)}
+	for i, typeName := range fieldTypes {
+		msg.Field = append(msg.Field, &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String("f" + string(rune('a'+i))),
+			Number:   proto.Int32(int32(i + 1)),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+			TypeName: proto.String(typeName),
+		})
+	}
+	return &descriptorpb.FileDescriptorProto{
+		Name:        proto.String(name),
+		Package:     proto.String("shop"),
+		Syntax:      proto.String("proto3"),
+		Dependency:  deps,
+		MessageType: []*descriptorpb.DescriptorProto{msg},
+	}
+}
+
+func TestRegisterDescriptorSet(t *testing.T) {
+	ctx := context.Background()
+	server, _, _ := setupTestServer(t)
+	money := testFile("money.proto", "Money", nil)
+	orders := testFile("orders.proto", "Order", []string{"money.proto", "google/protobuf/timestamp.proto"}, ".shop.Money", ".google.protobuf.Timestamp")
+
+	// Files are registered imports first, whatever the set's order
+	resp, err := server.RegisterDescriptorSet(ctx, &collector.RegisterDescriptorSetRequest{
+		Namespace:     "shop",
+		DescriptorSet: &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{orders, money}},
+	})
+	if err != nil {
+		t.Fatalf("RegisterDescriptorSet failed: %v", err)
+	}
+	if len(resp.ProtoIds) != 2 || resp.ProtoIds[0] != "shop/money.proto" || resp.ProtoIds[1] != "shop/orders.proto" {
+		t.Errorf("expected money.proto before orders.proto, got %v", resp.ProtoIds)
+	}
+	if got, err := server.LookupProto(ctx, "shop", "orders.proto"); err != nil || got.Version != 1 || got.MessageNames[0] != "Order" {
+		t.Errorf("expected orders.proto registered, got %v %v", got, err)
+	}
+
+	// Later sets may import what is registered
+	invoices := testFile("invoices.proto", "Invoice", []string{"orders.proto"}, ".shop.Order")
+	if _, err := server.RegisterDescriptorSet(ctx, &collector.RegisterDescriptorSetRequest{
+		Namespace:     "shop",
+		DescriptorSet: &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{invoices}},
+	}); err != nil {
+		t.Fatalf("RegisterDescriptorSet with registered imports failed: %v", err)
+	}
+
+	// Sets that do not resolve are refused, and register nothing
+	for name, tc := range map[string]struct {
+		files []*descriptorpb.FileDescriptorProto
+		code  codes.Code
+	}{
+		"missing import": {
+			files: []*descriptorpb.FileDescriptorProto{
+				testFile("refunds.proto", "Refund", nil),
+				testFile("returns.proto", "Return", []string{"shipping.proto"}, ".shop.Shipment"),
+			},
+			code: codes.FailedPrecondition,
+		},
+		"import cycle": {
+			files: []*descriptorpb.FileDescriptorProto{
+				testFile("a.proto", "A", []string{"b.proto"}),
+				testFile("b.proto", "B", []string{"a.proto"}),
+			},
+			code: codes.InvalidArgument,
+		},
+		"unresolved type": {
+			files: []*descriptorpb.FileDescriptorProto{
+				testFile("carts.proto", "Cart", []string{"money.proto"}, ".shop.Coupon"),
+			},
+			code: codes.InvalidArgument,
+		},
+		"already registered": {
+			files: []*descriptorpb.FileDescriptorProto{
+				testFile("coupons.proto", "Coupon", nil),
+				money,
+			},
+			code: codes.AlreadyExists,
+		},
+	} {
+		_, err := server.RegisterDescriptorSet(ctx, &collector.RegisterDescriptorSetRequest{
+			Namespace:     "shop",
+			DescriptorSet: &descriptorpb.FileDescriptorSet{File: tc.files},
+		})
+		if status.Code(err) != tc.code {
+			t.Errorf("%s: expected %v, got %v", name, tc.code, err)
+		}
+	}
+	list, _ := server.ListProtos(ctx, &collector.ListProtosRequest{Namespace: "shop"})
+	if len(list.Protos) != 3 {
+		t.Errorf("expected only the 3 valid protos registered, got %d", len(list.Protos))
+	}
+}
@@ -3,6 +3,7 @@ package registry
 import (
 	"context"
 	"fmt"
+	"time"
 
 	pb "github.com/accretional/collector/gen/collector"
 	"google.golang.org/grpc"
@@ -14,6 +15,24 @@ type ServiceMethodValidator interface {
 	ValidateServiceMethod(ctx context.Context, namespace, serviceName, methodName string) error
 }
 
+// CachePolicyProvider reports how long a method's results may be cached; it
+// matches dispatch.CachePolicyProvider.
+type CachePolicyProvider interface {
+	CachePolicy(ctx context.Context, namespace, serviceName, methodName string) (time.Duration, error)
+}
+
+// DeprecationProvider reports the deprecation registered for a method; it
+// matches dispatch.DeprecationProvider.
+type DeprecationProvider interface {
+	Deprecation(ctx context.Context, namespace, serviceName, methodName string) (*pb.Deprecation, error)
+}
+
+// MethodACLProvider reports the callers allowed to invoke a method; it
+// matches dispatch.MethodACLProvider.
+type MethodACLProvider interface {
+	MethodACL(ctx context.Context, namespace, serviceName, methodName string) (*pb.MethodACL, error)
+}
+
 // GRPCRegistryValidator validates services via gRPC (recommended approach)
 // This ensures proper service-to-service communication using the gRPC stack
 type GRPCRegistryValidator struct {
@@ -32,6 +51,33 @@ func (v *GRPCRegistryValidator) ValidateServiceMethod(ctx context.Context, names
 	return v.validator.ValidateServiceMethod(ctx, namespace, serviceName, methodName)
 }
 
+// CachePolicy delegates to the underlying validator if it is a
+// CachePolicyProvider, and otherwise reports every method as uncacheable.
+func (v *GRPCRegistryValidator) CachePolicy(ctx context.Context, namespace, serviceName, methodName string) (time.Duration, error) {
+	if p, ok := v.validator.(CachePolicyProvider); ok {
+		return p.CachePolicy(ctx, namespace, serviceName, methodName)
+	}
+	return 0, nil
+}
+
+// Deprecation delegates to the underlying validator if it is a
+// DeprecationProvider, and otherwise reports no method as deprecated.
+func (v *GRPCRegistryValidator) Deprecation(ctx context.Context, namespace, serviceName, methodName string) (*pb.Deprecation, error) {
+	if p, ok := v.validator.(DeprecationProvider); ok {
+		return p.Deprecation(ctx, namespace, serviceName, methodName)
+	}
+	return nil, nil
+}
+
+// MethodACL delegates to the underlying validator if it is a
+// MethodACLProvider, and otherwise reports every method as unrestricted.
+func (v *GRPCRegistryValidator) MethodACL(ctx context.Context, namespace, serviceName, methodName string) (*pb.MethodACL, error) {
+	if p, ok := v.validator.(MethodACLProvider); ok {
+		return p.MethodACL(ctx, namespace, serviceName, methodName)
+	}
+	return nil, nil
+}
+
 // RegistryServerValidator wraps a RegistryServer to provide validation
 type RegistryServerValidator struct {
 	server *RegistryServer
@@ -58,6 +104,54 @@ func (v *RegistryServerValidator) ValidateServiceMethod(ctx context.Context, nam
 	return nil
 }
 
+// CachePolicy returns the TTL registered for a method, or 0 if its results
+// must not be cached.
+func (v *RegistryServerValidator) CachePolicy(ctx context.Context, namespace, serviceName, methodName string) (time.Duration, error) {
+	resp, err := v.server.ValidateMethod(ctx, &pb.ValidateMethodRequest{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		MethodName:  methodName,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !resp.IsValid {
+		return 0, fmt.Errorf("method %s.%s not registered in namespace %s", serviceName, methodName, namespace)
+	}
+	return time.Duration(resp.CachePolicy.GetTtlMs()) * time.Millisecond, nil
+}
+
+// Deprecation returns the deprecation that applies to a method, or nil if
+// neither the method nor its service is deprecated, or the method is not
+// registered here.
+func (v *RegistryServerValidator) Deprecation(ctx context.Context, namespace, serviceName, methodName string) (*pb.Deprecation, error) {
+	resp, err := v.server.ValidateMethod(ctx, &pb.ValidateMethodRequest{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		MethodName:  methodName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Methods registered only on other collectors are theirs to deprecate
+	return resp.Deprecation, nil
+}
+
+// MethodACL returns the callers allowed to invoke a method, or nil if anyone
+// may call it or the method is not registered here.
+func (v *RegistryServerValidator) MethodACL(ctx context.Context, namespace, serviceName, methodName string) (*pb.MethodACL, error) {
+	resp, err := v.server.ValidateMethod(ctx, &pb.ValidateMethodRequest{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		MethodName:  methodName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Methods registered only on other collectors are theirs to restrict
+	return resp.Acl, nil
+}
+
 // WithValidation returns gRPC server options that add registry validation interceptors
 // for the specified namespace.
 func WithValidation(registry *RegistryServer, namespace string) []grpc.ServerOption {
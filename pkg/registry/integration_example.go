@@ -169,6 +169,46 @@ func RegisterCollectionRepoService(ctx context.Context, registry *RegistryServer
 	return err
 }
 
+// RegisterCollectionBackupService registers the CollectionBackup service with the registry
+func RegisterCollectionBackupService(ctx context.Context, registry *RegistryServer, namespace string) error {
+	serviceDesc := &descriptorpb.ServiceDescriptorProto{
+		Name: stringPtr("CollectionBackup"),
+		Method: []*descriptorpb.MethodDescriptorProto{
+			{Name: stringPtr("Backup")},
+			{Name: stringPtr("Restore")},
+			{Name: stringPtr("List")},
+			{Name: stringPtr("Delete")},
+			{Name: stringPtr("Verify")},
+		},
+	}
+
+	_, err := registry.RegisterService(ctx, &pb.RegisterServiceRequest{
+		Namespace:         namespace,
+		ServiceDescriptor: serviceDesc,
+	})
+	return err
+}
+
+// RegisterWorkerService registers the CollectiveWorker service with the registry
+func RegisterWorkerService(ctx context.Context, registry *RegistryServer, namespace string) error {
+	serviceDesc := &descriptorpb.ServiceDescriptorProto{
+		Name: stringPtr("CollectiveWorker"),
+		Method: []*descriptorpb.MethodDescriptorProto{
+			{Name: stringPtr("RegisterWorkflow")},
+			{Name: stringPtr("StartWorkflow")},
+			{Name: stringPtr("GetWorkflowStatus")},
+			{Name: stringPtr("GetWorkflowHistory")},
+			{Name: stringPtr("CancelWorkflow")},
+		},
+	}
+
+	_, err := registry.RegisterService(ctx, &pb.RegisterServiceRequest{
+		Namespace:         namespace,
+		ServiceDescriptor: serviceDesc,
+	})
+	return err
+}
+
 func stringPtr(s string) *string {
 	return &s
 }
@@ -211,6 +211,7 @@ func TestDynamicServiceLookup(t *testing.T) {
 		{RegisterCollectionService, "CollectionService", 11},
 		{RegisterDispatcherService, "CollectiveDispatcher", 3},
 		{RegisterCollectionRepoService, "CollectionRepo", 4},
+		{RegisterWorkerService, "CollectiveWorker", 5},
 	}
 
 	namespace := "dynamic"
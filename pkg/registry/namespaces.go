@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/proto"
+)
+
+// SetNamespaceAliases makes registrations and lookups resolve namespace
+// aliases, so services registered in a namespace are found under its
+// aliases too. Call it before serving requests.
+func (s *RegistryServer) SetNamespaceAliases(aliases *collection.NamespaceAliases) {
+	s.aliases = aliases
+}
+
+// CheckNamespaceUnused reports namespaces that have registered protos or
+// services.
+func (s *RegistryServer) CheckNamespaceUnused(ctx context.Context, namespace string) error {
+	for _, coll := range []*collection.Collection{s.registeredProtos, s.registeredServices} {
+		records, err := coll.ListRecords(ctx, 0, 10000)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if strings.HasPrefix(record.Id, namespace+"/") {
+				return fmt.Errorf("%w: %s has registry entries", collection.ErrNamespaceInUse, namespace)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckNamespaceRename refuses to rename into a namespace that already has
+// registered protos or services.
+func (s *RegistryServer) CheckNamespaceRename(ctx context.Context, from, to string) error {
+	err := s.CheckNamespaceUnused(ctx, to)
+	if errors.Is(err, collection.ErrNamespaceInUse) {
+		return fmt.Errorf("%w: %w", collection.ErrRenameConflict, err)
+	}
+	return err
+}
+
+// RenameNamespace moves the protos and services registered in from to to.
+func (s *RegistryServer) RenameNamespace(ctx context.Context, from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.typesChanged()
+	protos, err := s.protosIn(ctx, from)
+	if err != nil {
+		return err
+	}
+	for _, p := range protos {
+		moved := proto.Clone(p).(*collector.RegisteredProto)
+		moved.Namespace = to
+		moved.Id = to + "/" + moved.FileDescriptor.GetName()
+		if err := s.moveRecord(ctx, s.registeredProtos, p.Id, moved.Id, moved); err != nil {
+			return err
+		}
+		s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_REMOVED, p.Namespace, p.Id, "", 0)
+		s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_REGISTERED, to, moved.Id, "", moved.Version)
+	}
+
+	resp, err := s.ListServices(ctx, &collector.ListServicesRequest{Namespace: from})
+	if err != nil {
+		return err
+	}
+	if resp.Status.Code != collector.Status_OK {
+		return fmt.Errorf("list services: %s", resp.Status.Message)
+	}
+	for _, svc := range resp.Services {
+		moved := proto.Clone(svc).(*collector.RegisteredService)
+		moved.Namespace = to
+		moved.Id = to + "/" + moved.ServiceName
+		if err := s.moveRecord(ctx, s.registeredServices, svc.Id, moved.Id, moved); err != nil {
+			return err
+		}
+		s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_REMOVED, svc.Namespace, "", svc.Id, 0)
+		s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_REGISTERED, to, "", moved.Id, moved.Version)
+	}
+	return nil
+}
+
+// moveRecord stores msg under newID and deletes oldID.
+func (s *RegistryServer) moveRecord(ctx context.Context, coll *collection.Collection, oldID, newID string, msg proto.Message) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := coll.CreateRecord(ctx, &collector.CollectionRecord{Id: newID, ProtoData: data}); err != nil {
+		return fmt.Errorf("move %s to %s: %w", oldID, newID, err)
+	}
+	if err := coll.DeleteRecord(ctx, oldID); err != nil {
+		return fmt.Errorf("move %s to %s: %w", oldID, newID, err)
+	}
+	return nil
+}
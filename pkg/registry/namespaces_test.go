@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestRegistry_NamespaceAliasesAndRename(t *testing.T) {
+	ctx := context.Background()
+	server, _, _ := setupTestServer(t)
+	aliases := collection.NewNamespaceAliases()
+	server.SetNamespaceAliases(aliases)
+	if err := aliases.Add("production", "prod"); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	// Registering under an alias registers in its namespace
+	if _, err := server.RegisterService(ctx, &collector.RegisterServiceRequest{
+		Namespace: "production",
+		ServiceDescriptor: &descriptorpb.ServiceDescriptorProto{
+			Name:   proto.String("Users"),
+			Method: []*descriptorpb.MethodDescriptorProto{{Name: proto.String("Get")}},
+		},
+	}); err != nil {
+		t.Fatalf("RegisterService failed: %v", err)
+	}
+	resp, _ := server.LookupService(ctx, &collector.LookupServiceRequest{Namespace: "prod", ServiceName: "Users"})
+	if resp.Status.Code != collector.Status_OK || resp.Service.Id != "prod/Users" {
+		t.Fatalf("expected prod/Users, got %v", resp)
+	}
+	if err := server.ValidateService(ctx, "production", "Users"); err != nil {
+		t.Errorf("expected the alias to validate, got %v", err)
+	}
+
+	if err := collection.RenameNamespace(ctx, aliases, "prod", "live", true, server); err != nil {
+		t.Fatalf("RenameNamespace failed: %v", err)
+	}
+	for _, ns := range []string{"live", "prod", "production"} {
+		resp, _ := server.LookupService(ctx, &collector.LookupServiceRequest{Namespace: ns, ServiceName: "Users"})
+		if resp.Status.Code != collector.Status_OK || resp.Service.Id != "live/Users" || resp.Service.Namespace != "live" {
+			t.Errorf("expected %s/Users to find live/Users, got %v", ns, resp)
+		}
+	}
+	list, _ := server.ListServices(ctx, &collector.ListServicesRequest{})
+	if len(list.Services) != 1 {
+		t.Errorf("expected the old entry to be removed, got %v", list.Services)
+	}
+
+	if _, err := server.RegisterService(ctx, &collector.RegisterServiceRequest{
+		Namespace:         "staging",
+		ServiceDescriptor: &descriptorpb.ServiceDescriptorProto{Name: proto.String("Users")},
+	}); err != nil {
+		t.Fatalf("RegisterService failed: %v", err)
+	}
+	if err := collection.RenameNamespace(ctx, aliases, "live", "staging", false, server); !errors.Is(err, collection.ErrRenameConflict) {
+		t.Errorf("expected renaming into a namespace with services to conflict, got %v", err)
+	}
+	if err := collection.AddNamespaceAlias(ctx, aliases, "staging", "live", server); !errors.Is(err, collection.ErrNamespaceInUse) {
+		t.Errorf("expected a namespace with services to be refused as an alias, got %v", err)
+	}
+	if aliases.Resolve("staging") != "staging" {
+		t.Errorf("expected staging not to become an alias")
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/accretional/collector/gen/collector"
 	"github.com/accretional/collector/pkg/collection"
@@ -16,6 +20,14 @@ type RegistryServer struct {
 	collector.UnimplementedCollectorRegistryServer
 	registeredProtos   *collection.Collection
 	registeredServices *collection.Collection
+	aliases            *collection.NamespaceAliases
+
+	// mu serializes read-modify-writes of registered entries, so version
+	// checks and bumps are not lost to concurrent updates
+	mu sync.Mutex
+
+	types   typeCache
+	changes changeLog
 }
 
 func NewRegistryServer(registeredProtos, registeredServices *collection.Collection) *RegistryServer {
@@ -35,30 +47,44 @@ func (s *RegistryServer) RegisterProto(ctx context.Context, req *collector.Regis
 	if req.FileDescriptor.GetName() == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "file descriptor name is required")
 	}
-
-	registeredMessages := []string{}
-	for _, msg := range req.FileDescriptor.MessageType {
-		registeredMessages = append(registeredMessages, msg.GetName())
+	if req.Version < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "version must not be negative")
 	}
 
-	protoID := fmt.Sprintf("%s/%s", req.Namespace, req.FileDescriptor.GetName())
+	namespace := s.aliases.Resolve(req.Namespace)
+	protoID := fmt.Sprintf("%s/%s", namespace, req.FileDescriptor.GetName())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.typesChanged()
 
-	// Check for duplicates
-	_, err := s.registeredProtos.GetRecord(ctx, protoID)
+	// Check for duplicates; with a version, the file gets a new version
+	current, err := s.LookupProto(ctx, namespace, req.FileDescriptor.GetName())
 	if err == nil {
-		return nil, status.Errorf(codes.AlreadyExists, "proto already exists")
-	} else if err != sql.ErrNoRows {
+		if req.Version == 0 {
+			return nil, status.Errorf(codes.AlreadyExists, "proto already exists")
+		}
+		updated, err := s.addProtoVersion(ctx, current, req.FileDescriptor, req.Version)
+		if err != nil {
+			return nil, err
+		}
+		return &collector.RegisterProtoResponse{
+			Status:             &collector.Status{Code: collector.Status_OK},
+			ProtoId:            protoID,
+			RegisteredMessages: updated.MessageNames,
+		}, nil
+	} else if status.Code(err) != codes.NotFound {
 		// If it's not a "not found" error, return the error
 		return nil, err
 	}
 
 	registeredProto := &collector.RegisteredProto{
-		Id:             protoID,
-		Namespace:      req.Namespace,
-		MessageNames:   registeredMessages,
-		FileDescriptor: req.FileDescriptor,
-		Dependencies:   req.FileDescriptor.Dependency,
+		Id:        protoID,
+		Namespace: namespace,
+		Version:   max(req.Version, 1),
 	}
+	setFile(registeredProto, req.FileDescriptor)
+	recordVersion(ctx, nil, registeredProto)
+	registeredMessages := registeredProto.MessageNames
 
 	data, err := proto.Marshal(registeredProto)
 	if err != nil {
@@ -72,6 +98,7 @@ func (s *RegistryServer) RegisterProto(ctx context.Context, req *collector.Regis
 	if err != nil {
 		return nil, err
 	}
+	s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_REGISTERED, namespace, protoID, "", registeredProto.Version)
 
 	return &collector.RegisterProtoResponse{
 		Status:             &collector.Status{Code: collector.Status_OK},
@@ -95,8 +122,12 @@ func (s *RegistryServer) RegisterService(ctx context.Context, req *collector.Reg
 	for _, method := range req.ServiceDescriptor.Method {
 		methodNames = append(methodNames, method.GetName())
 	}
+	if err := checkMethodPolicies(methodNames, req.CachePolicies, req.MethodAcls); err != nil {
+		return nil, err
+	}
 
-	serviceID := fmt.Sprintf("%s/%s", req.Namespace, req.ServiceDescriptor.GetName())
+	namespace := s.aliases.Resolve(req.Namespace)
+	serviceID := fmt.Sprintf("%s/%s", namespace, req.ServiceDescriptor.GetName())
 
 	// Check for duplicates
 	_, err := s.registeredServices.GetRecord(ctx, serviceID)
@@ -109,10 +140,13 @@ func (s *RegistryServer) RegisterService(ctx context.Context, req *collector.Reg
 
 	registeredService := &collector.RegisteredService{
 		Id:                serviceID,
-		Namespace:         req.Namespace,
+		Namespace:         namespace,
 		ServiceName:       req.ServiceDescriptor.GetName(),
 		ServiceDescriptor: req.ServiceDescriptor,
 		MethodNames:       methodNames,
+		CachePolicies:     req.CachePolicies,
+		MethodAcls:        req.MethodAcls,
+		Version:           1,
 	}
 
 	data, err := proto.Marshal(registeredService)
@@ -127,6 +161,7 @@ func (s *RegistryServer) RegisterService(ctx context.Context, req *collector.Reg
 	if err != nil {
 		return nil, err
 	}
+	s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_REGISTERED, namespace, "", serviceID, registeredService.Version)
 
 	return &collector.RegisterServiceResponse{
 		Status:            &collector.Status{Code: collector.Status_OK},
@@ -135,9 +170,31 @@ func (s *RegistryServer) RegisterService(ctx context.Context, req *collector.Reg
 	}, nil
 }
 
+// checkMethodPolicies checks that cache policies and ACLs name methods of
+// the service and are usable.
+func checkMethodPolicies(methodNames []string, cachePolicies map[string]*collector.CachePolicy, acls map[string]*collector.MethodACL) error {
+	for method, policy := range cachePolicies {
+		if !slices.Contains(methodNames, method) {
+			return status.Errorf(codes.InvalidArgument, "cache policy for unknown method %s", method)
+		}
+		if policy.GetTtlMs() <= 0 {
+			return status.Errorf(codes.InvalidArgument, "cache policy for %s needs a positive ttl_ms", method)
+		}
+	}
+	for method, acl := range acls {
+		if !slices.Contains(methodNames, method) {
+			return status.Errorf(codes.InvalidArgument, "acl for unknown method %s", method)
+		}
+		if len(acl.GetCollectors()) == 0 && len(acl.GetPrincipals()) == 0 {
+			return status.Errorf(codes.InvalidArgument, "acl for %s must allow at least one collector or principal", method)
+		}
+	}
+	return nil
+}
+
 // LookupProto retrieves a registered proto by namespace and file name
 func (s *RegistryServer) LookupProto(ctx context.Context, namespace, fileName string) (*collector.RegisteredProto, error) {
-	protoID := fmt.Sprintf("%s/%s", namespace, fileName)
+	protoID := fmt.Sprintf("%s/%s", s.aliases.Resolve(namespace), fileName)
 	record, err := s.registeredProtos.GetRecord(ctx, protoID)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -156,7 +213,7 @@ func (s *RegistryServer) LookupProto(ctx context.Context, namespace, fileName st
 
 // LookupService retrieves a registered service by namespace and service name
 func (s *RegistryServer) LookupService(ctx context.Context, req *collector.LookupServiceRequest) (*collector.LookupServiceResponse, error) {
-	serviceID := fmt.Sprintf("%s/%s", req.Namespace, req.ServiceName)
+	serviceID := fmt.Sprintf("%s/%s", s.aliases.Resolve(req.Namespace), req.ServiceName)
 	record, err := s.registeredServices.GetRecord(ctx, serviceID)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -240,7 +297,10 @@ func (s *RegistryServer) ValidateMethod(ctx context.Context, req *collector.Vali
 					Code:    collector.Status_OK,
 					Message: "Method is valid",
 				},
-				IsValid: true,
+				IsValid:     true,
+				CachePolicy: service.CachePolicies[method],
+				Deprecation: methodDeprecation(service, method),
+				Acl:         service.MethodAcls[method],
 			}, nil
 		}
 	}
@@ -254,8 +314,83 @@ func (s *RegistryServer) ValidateMethod(ctx context.Context, req *collector.Vali
 	}, nil
 }
 
-// ListProtos returns all registered protos, optionally filtered by namespace
-func (s *RegistryServer) ListProtos(ctx context.Context, namespace string) ([]*collector.RegisteredProto, error) {
+// GetProto retrieves a registered proto by namespace and file name, as it
+// is or at an earlier version
+func (s *RegistryServer) GetProto(ctx context.Context, req *collector.GetProtoRequest) (*collector.GetProtoResponse, error) {
+	if req.FileName == "" {
+		return &collector.GetProtoResponse{
+			Status: &collector.Status{
+				Code:    collector.Status_INVALID_ARGUMENT,
+				Message: "file_name is required",
+			},
+		}, nil
+	}
+	registeredProto, err := s.LookupProto(ctx, req.Namespace, req.FileName)
+	if status.Code(err) == codes.NotFound {
+		return &collector.GetProtoResponse{
+			Status: &collector.Status{
+				Code:    collector.Status_NOT_FOUND,
+				Message: status.Convert(err).Message(),
+			},
+		}, nil
+	}
+	if err != nil {
+		return &collector.GetProtoResponse{
+			Status: &collector.Status{
+				Code:    collector.Status_INTERNAL,
+				Message: err.Error(),
+			},
+		}, nil
+	}
+	registeredProto, err = protoAtVersion(registeredProto, req.Version)
+	if err != nil {
+		return &collector.GetProtoResponse{
+			Status: &collector.Status{
+				Code:    collector.Status_NOT_FOUND,
+				Message: status.Convert(err).Message(),
+			},
+		}, nil
+	}
+	return &collector.GetProtoResponse{
+		Status: &collector.Status{Code: collector.Status_OK, Message: "Success"},
+		Proto:  withoutHistoryFiles(registeredProto),
+	}, nil
+}
+
+// ListProtos returns registered protos, optionally filtered by namespace, a
+// page at a time
+func (s *RegistryServer) ListProtos(ctx context.Context, req *collector.ListProtosRequest) (*collector.ListProtosResponse, error) {
+	protos, err := s.protosIn(ctx, req.Namespace)
+	if err != nil {
+		return &collector.ListProtosResponse{
+			Status: &collector.Status{
+				Code:    collector.Status_INTERNAL,
+				Message: err.Error(),
+			},
+		}, nil
+	}
+	protos, next, err := page(protos, req.PageSize, req.PageToken)
+	if err != nil {
+		return &collector.ListProtosResponse{
+			Status: &collector.Status{
+				Code:    collector.Status_INVALID_ARGUMENT,
+				Message: err.Error(),
+			},
+		}, nil
+	}
+	for i, p := range protos {
+		protos[i] = withoutHistoryFiles(p)
+	}
+	return &collector.ListProtosResponse{
+		Status:        &collector.Status{Code: collector.Status_OK, Message: "Success"},
+		Protos:        protos,
+		NextPageToken: next,
+	}, nil
+}
+
+// protosIn returns the protos registered in namespace, or in every namespace
+// when it is empty, sorted by ID
+func (s *RegistryServer) protosIn(ctx context.Context, namespace string) ([]*collector.RegisteredProto, error) {
 	// TODO: Implement filtering when Collection supports prefix queries
 	// For now, we'll get all records and filter manually
 	records, err := s.registeredProtos.ListRecords(ctx, 0, 10000)
@@ -270,19 +405,18 @@ func (s *RegistryServer) ListProtos(ctx context.Context, namespace string) ([]*c
 			return nil, err
 		}
 
-		if namespace == "" || registeredProto.Namespace == namespace {
+		if namespace == "" || registeredProto.Namespace == s.aliases.Resolve(namespace) {
 			protos = append(protos, registeredProto)
 		}
 	}
-
+	slices.SortFunc(protos, func(a, b *collector.RegisteredProto) int { return strings.Compare(a.Id, b.Id) })
 	return protos, nil
 }
 
-// ListServices returns all registered services, optionally filtered by namespace
+// ListServices returns registered services, optionally filtered by
+// namespace, a page at a time
 func (s *RegistryServer) ListServices(ctx context.Context, req *collector.ListServicesRequest) (*collector.ListServicesResponse, error) {
-	// TODO: Implement filtering when Collection supports prefix queries
-	// For now, we'll get all records and filter manually
-	records, err := s.registeredServices.ListRecords(ctx, 0, 10000)
+	services, err := s.servicesIn(ctx, req.Namespace)
 	if err != nil {
 		return &collector.ListServicesResponse{
 			Status: &collector.Status{
@@ -291,29 +425,74 @@ func (s *RegistryServer) ListServices(ctx context.Context, req *collector.ListSe
 			},
 		}, nil
 	}
+	services, next, err := page(services, req.PageSize, req.PageToken)
+	if err != nil {
+		return &collector.ListServicesResponse{
+			Status: &collector.Status{
+				Code:    collector.Status_INVALID_ARGUMENT,
+				Message: err.Error(),
+			},
+		}, nil
+	}
+
+	return &collector.ListServicesResponse{
+		Status: &collector.Status{
+			Code:    collector.Status_OK,
+			Message: "Success",
+		},
+		Services:      services,
+		NextPageToken: next,
+	}, nil
+}
+
+// servicesIn returns the services registered in namespace, or in every
+// namespace when it is empty, sorted by ID
+func (s *RegistryServer) servicesIn(ctx context.Context, namespace string) ([]*collector.RegisteredService, error) {
+	// TODO: Implement filtering when Collection supports prefix queries
+	// For now, we'll get all records and filter manually
+	records, err := s.registeredServices.ListRecords(ctx, 0, 10000)
+	if err != nil {
+		return nil, err
+	}
 
 	var services []*collector.RegisteredService
 	for _, record := range records {
 		registeredService := &collector.RegisteredService{}
 		if err := proto.Unmarshal(record.ProtoData, registeredService); err != nil {
-			return &collector.ListServicesResponse{
-				Status: &collector.Status{
-					Code:    collector.Status_INTERNAL,
-					Message: err.Error(),
-				},
-			}, nil
+			return nil, err
 		}
 
-		if req.Namespace == "" || registeredService.Namespace == req.Namespace {
+		if namespace == "" || registeredService.Namespace == s.aliases.Resolve(namespace) {
 			services = append(services, registeredService)
 		}
 	}
+	slices.SortFunc(services, func(a, b *collector.RegisteredService) int { return strings.Compare(a.Id, b.Id) })
+	return services, nil
+}
 
-	return &collector.ListServicesResponse{
-		Status: &collector.Status{
-			Code:    collector.Status_OK,
-			Message: "Success",
-		},
-		Services: services,
-	}, nil
+// page returns the page of items starting at token's offset, all of them
+// when size is 0, and the token of the next page while more remain
+func page[T any](items []T, size int32, token string) ([]T, string, error) {
+	if size < 0 {
+		return nil, "", fmt.Errorf("page_size must not be negative")
+	}
+	offset := 0
+	if token != "" {
+		n, err := strconv.Atoi(token)
+		if err != nil || n < 0 {
+			return nil, "", fmt.Errorf("invalid page_token %q", token)
+		}
+		offset = n
+	}
+	if offset > len(items) {
+		offset = len(items)
+	}
+	if size == 0 {
+		return items[offset:], "", nil
+	}
+	end := offset + int(size)
+	if end >= len(items) {
+		return items[offset:], "", nil
+	}
+	return items[offset:end], strconv.Itoa(end), nil
 }
@@ -3,7 +3,9 @@ package registry
 import (
 	"context"
 	"os"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/accretional/collector/gen/collector"
 	"github.com/accretional/collector/pkg/collection"
@@ -968,6 +970,57 @@ func TestValidateMethod(t *testing.T) {
 	}
 }
 
+// TestRegisterService_CachePolicies tests registering cacheable methods
+func TestRegisterService_CachePolicies(t *testing.T) {
+	server, _, _ := setupTestServer(t)
+	ctx := context.Background()
+
+	desc := &descriptorpb.ServiceDescriptorProto{
+		Name: proto.String("PricingService"),
+		Method: []*descriptorpb.MethodDescriptorProto{
+			{Name: proto.String("Quote")},
+			{Name: proto.String("Purchase")},
+		},
+	}
+
+	// Policies must name known methods and have a positive TTL
+	for name, policies := range map[string]map[string]*collector.CachePolicy{
+		"unknown method": {"Refund": {TtlMs: 1000}},
+		"zero ttl":       {"Quote": {}},
+	} {
+		_, err := server.RegisterService(ctx, &collector.RegisterServiceRequest{
+			Namespace:         "test",
+			ServiceDescriptor: desc,
+			CachePolicies:     policies,
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", name, err)
+		}
+	}
+
+	_, err := server.RegisterService(ctx, &collector.RegisterServiceRequest{
+		Namespace:         "test",
+		ServiceDescriptor: desc,
+		CachePolicies:     map[string]*collector.CachePolicy{"Quote": {TtlMs: 30000}},
+	})
+	if err != nil {
+		t.Fatalf("RegisterService failed: %v", err)
+	}
+
+	validator := NewRegistryValidator(server)
+	ttl, err := validator.CachePolicy(ctx, "test", "PricingService", "Quote")
+	if err != nil || ttl != 30*time.Second {
+		t.Errorf("expected a 30s TTL for Quote, got %v (%v)", ttl, err)
+	}
+	ttl, err = validator.CachePolicy(ctx, "test", "PricingService", "Purchase")
+	if err != nil || ttl != 0 {
+		t.Errorf("expected Purchase to be uncacheable, got %v (%v)", ttl, err)
+	}
+	if _, err := validator.CachePolicy(ctx, "test", "PricingService", "Refund"); err == nil {
+		t.Error("expected an error for an unregistered method")
+	}
+}
+
 // TestListProtos tests listing all registered protos
 func TestListProtos(t *testing.T) {
 	server, _, _ := setupTestServer(t)
@@ -999,30 +1052,83 @@ func TestListProtos(t *testing.T) {
 	}
 
 	// List all protos
-	allProtos, err := server.ListProtos(context.Background(), "")
+	allResp, err := server.ListProtos(context.Background(), &collector.ListProtosRequest{})
 	if err != nil {
 		t.Fatalf("ListProtos failed: %v", err)
 	}
 
-	if len(allProtos) != 3 {
-		t.Errorf("expected 3 protos, got %d", len(allProtos))
+	if len(allResp.Protos) != 3 {
+		t.Errorf("expected 3 protos, got %d", len(allResp.Protos))
 	}
 
 	// List protos filtered by namespace
-	namespace1Protos, err := server.ListProtos(context.Background(), "namespace1")
+	ns1Resp, err := server.ListProtos(context.Background(), &collector.ListProtosRequest{Namespace: "namespace1"})
 	if err != nil {
 		t.Fatalf("ListProtos failed: %v", err)
 	}
 
-	if len(namespace1Protos) != 2 {
-		t.Errorf("expected 2 protos in namespace1, got %d", len(namespace1Protos))
+	if len(ns1Resp.Protos) != 2 {
+		t.Errorf("expected 2 protos in namespace1, got %d", len(ns1Resp.Protos))
 	}
 
-	for _, p := range namespace1Protos {
+	for _, p := range ns1Resp.Protos {
 		if p.Namespace != "namespace1" {
 			t.Errorf("expected namespace 'namespace1', got '%s'", p.Namespace)
 		}
 	}
+
+	// Page through all protos, in ID order
+	var ids []string
+	token := ""
+	for {
+		resp, err := server.ListProtos(context.Background(), &collector.ListProtosRequest{PageSize: 2, PageToken: token})
+		if err != nil || resp.Status.Code != collector.Status_OK {
+			t.Fatalf("ListProtos page failed: %v %v", resp, err)
+		}
+		for _, p := range resp.Protos {
+			ids = append(ids, p.Id)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	want := []string{"namespace1/file1.proto", "namespace1/file2.proto", "namespace2/file1.proto"}
+	if !slices.Equal(ids, want) {
+		t.Errorf("expected pages %v, got %v", want, ids)
+	}
+
+	badResp, _ := server.ListProtos(context.Background(), &collector.ListProtosRequest{PageToken: "nope"})
+	if badResp.Status.Code != collector.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT for a bad page token, got %v", badResp.Status)
+	}
+}
+
+// TestGetProto tests retrieving a registered proto by file name
+func TestGetProto(t *testing.T) {
+	server, _, _ := setupTestServer(t)
+	_, err := server.RegisterProto(context.Background(), &collector.RegisterProtoRequest{
+		Namespace: "namespace1",
+		FileDescriptor: &descriptorpb.FileDescriptorProto{
+			Name:        proto.String("file1.proto"),
+			MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("Message")}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("RegisterProto failed: %v", err)
+	}
+
+	resp, err := server.GetProto(context.Background(), &collector.GetProtoRequest{Namespace: "namespace1", FileName: "file1.proto"})
+	if err != nil || resp.Status.Code != collector.Status_OK {
+		t.Fatalf("GetProto failed: %v %v", resp, err)
+	}
+	if resp.Proto.FileDescriptor.GetName() != "file1.proto" || resp.Proto.Namespace != "namespace1" {
+		t.Errorf("unexpected proto %v", resp.Proto)
+	}
+
+	resp, _ = server.GetProto(context.Background(), &collector.GetProtoRequest{Namespace: "namespace1", FileName: "missing.proto"})
+	if resp.Status.Code != collector.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND, got %v", resp.Status)
+	}
 }
 
 // TestListServices tests listing all registered services
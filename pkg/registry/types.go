@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// typeCache holds the message types of each namespace, built from its
+// registered protos. Registry writes that change protos clear it.
+type typeCache struct {
+	mu    sync.Mutex
+	files map[string]*protoregistry.Files
+}
+
+// typesChanged drops the cached types after a change to registered protos.
+func (s *RegistryServer) typesChanged() {
+	s.types.mu.Lock()
+	defer s.types.mu.Unlock()
+	s.types.files = nil
+}
+
+// ResolveMessage returns the descriptor of a message registered in
+// namespace, by full name ("shop.Order") or, when unambiguous, by the name
+// within its package ("Order"). It makes the registry a
+// collection.DescriptorResolver, so collections can decode and analyze
+// records of their message type.
+func (s *RegistryServer) ResolveMessage(ctx context.Context, namespace, messageName string) (protoreflect.MessageDescriptor, error) {
+	if namespace == "" || messageName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "namespace and message name are required")
+	}
+	files, err := s.namespaceTypes(ctx, s.aliases.Resolve(namespace))
+	if err != nil {
+		return nil, err
+	}
+
+	if d, err := files.FindDescriptorByName(protoreflect.FullName(messageName)); err == nil {
+		if md, ok := d.(protoreflect.MessageDescriptor); ok {
+			return md, nil
+		}
+	}
+	var found []protoreflect.MessageDescriptor
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		found = appendMatching(found, fd.Messages(), messageName)
+		return true
+	})
+	switch len(found) {
+	case 0:
+		return nil, status.Errorf(codes.NotFound, "message %s is not registered in namespace %s", messageName, namespace)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, status.Errorf(codes.FailedPrecondition, "message name %s is ambiguous in namespace %s: %s and %s", messageName, namespace, found[0].FullName(), found[1].FullName())
+	}
+}
+
+// appendMatching appends the messages, nested ones included, whose full
+// name ends in name.
+func appendMatching(found []protoreflect.MessageDescriptor, msgs protoreflect.MessageDescriptors, name string) []protoreflect.MessageDescriptor {
+	for i := 0; i < msgs.Len(); i++ {
+		md := msgs.Get(i)
+		if strings.HasSuffix(string(md.FullName()), "."+name) {
+			found = append(found, md)
+		}
+		found = appendMatching(found, md.Messages(), name)
+	}
+	return found
+}
+
+// namespaceTypes returns the types of namespace's registered protos,
+// building them on first use. Protos that do not build are left out.
+func (s *RegistryServer) namespaceTypes(ctx context.Context, namespace string) (*protoregistry.Files, error) {
+	s.types.mu.Lock()
+	defer s.types.mu.Unlock()
+	if files, ok := s.types.files[namespace]; ok {
+		return files, nil
+	}
+
+	protos, err := s.protosIn(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	files := new(protoregistry.Files)
+	for _, p := range protos {
+		if err := s.loadImport(ctx, namespace, p.FileDescriptor.GetName(), files, nil); err != nil {
+			log.Printf("Warning: registered proto %s left out of namespace types: %v", p.Id, err)
+		}
+	}
+	if s.types.files == nil {
+		s.types.files = make(map[string]*protoregistry.Files)
+	}
+	s.types.files[namespace] = files
+	return files, nil
+}
@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestResolveMessage(t *testing.T) {
+	ctx := context.Background()
+	server, _, _ := setupTestServer(t)
+	money := testFile("money.proto", "Money", nil)
+	orders := testFile("orders.proto", "Order", []string{"money.proto"}, ".shop.Money")
+	orders.MessageType[0].NestedType = []*descriptorpb.DescriptorProto{{Name: proto.String("Line")}}
+	if _, err := server.RegisterDescriptorSet(ctx, &collector.RegisterDescriptorSetRequest{
+		Namespace:     "shop",
+		DescriptorSet: &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{money, orders}},
+	}); err != nil {
+		t.Fatalf("RegisterDescriptorSet failed: %v", err)
+	}
+
+	for _, name := range []string{"shop.Order", "Order", "Order.Line"} {
+		md, err := server.ResolveMessage(ctx, "shop", name)
+		if err != nil {
+			t.Errorf("ResolveMessage(%s) failed: %v", name, err)
+			continue
+		}
+		if name != "Order.Line" && md.Fields().ByName("fa").Message().FullName() != "shop.Money" {
+			t.Errorf("expected %s to reference shop.Money, got %v", name, md.Fields().ByName("fa"))
+		}
+	}
+	if _, err := server.ResolveMessage(ctx, "other", "Order"); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound in another namespace, got %v", err)
+	}
+
+	// Registry changes are seen by the next resolution
+	if _, err := server.ResolveMessage(ctx, "shop", "Refund"); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound before registering, got %v", err)
+	}
+	if _, err := server.RegisterProto(ctx, &collector.RegisterProtoRequest{Namespace: "shop", FileDescriptor: testFile("refunds.proto", "Refund", nil)}); err != nil {
+		t.Fatalf("RegisterProto failed: %v", err)
+	}
+	if md, err := server.ResolveMessage(ctx, "shop", "Refund"); err != nil || md.FullName() != "shop.Refund" {
+		t.Errorf("expected the new message resolved, got %v %v", md, err)
+	}
+
+	other := testFile("legacy.proto", "Line", nil)
+	other.Package = proto.String("legacy")
+	if _, err := server.RegisterProto(ctx, &collector.RegisterProtoRequest{Namespace: "shop", FileDescriptor: other}); err != nil {
+		t.Fatalf("RegisterProto failed: %v", err)
+	}
+	if _, err := server.ResolveMessage(ctx, "shop", "Line"); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected an ambiguous name refused, got %v", err)
+	}
+	if md, err := server.ResolveMessage(ctx, "shop", "legacy.Line"); err != nil || md.FullName() != "legacy.Line" {
+		t.Errorf("expected the full name to resolve, got %v %v", md, err)
+	}
+}
@@ -0,0 +1,203 @@
+package registry
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+
+	"github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// UpdateProto replaces a registered proto with a new version of its file,
+// so message types can evolve without wiping the registry.
+func (s *RegistryServer) UpdateProto(ctx context.Context, req *collector.UpdateProtoRequest) (*collector.UpdateProtoResponse, error) {
+	if req.Namespace == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "namespace is required")
+	}
+	if req.FileDescriptor.GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "file descriptor name is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.typesChanged()
+	current, err := s.LookupProto(ctx, req.Namespace, req.FileDescriptor.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(current.Id, current.Version, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+
+	updated := proto.Clone(current).(*collector.RegisteredProto)
+	setFile(updated, req.FileDescriptor)
+	updated.Version = current.Version + 1
+	recordVersion(ctx, current, updated)
+	if err := s.replaceProto(ctx, updated); err != nil {
+		return nil, err
+	}
+	s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_UPDATED, updated.Namespace, updated.Id, "", updated.Version)
+
+	return &collector.UpdateProtoResponse{
+		Status: &collector.Status{Code: collector.Status_OK},
+		Proto:  updated,
+	}, nil
+}
+
+// UnregisterProto removes a registered proto. Protos in the same namespace
+// that import it must be unregistered, or updated not to, first.
+func (s *RegistryServer) UnregisterProto(ctx context.Context, req *collector.UnregisterProtoRequest) (*collector.UnregisterProtoResponse, error) {
+	if req.Namespace == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "namespace is required")
+	}
+	if req.FileName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "file name is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.typesChanged()
+	current, err := s.LookupProto(ctx, req.Namespace, req.FileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(current.Id, current.Version, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	protos, err := s.protosIn(ctx, current.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range protos {
+		if slices.Contains(p.Dependencies, req.FileName) {
+			return nil, status.Errorf(codes.FailedPrecondition, "proto %s is imported by %s", current.Id, p.Id)
+		}
+	}
+
+	if err := s.registeredProtos.DeleteRecord(ctx, current.Id); err != nil {
+		return nil, fmt.Errorf("unregister %s: %w", current.Id, err)
+	}
+	s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_REMOVED, current.Namespace, current.Id, "", 0)
+	return &collector.UnregisterProtoResponse{Status: &collector.Status{Code: collector.Status_OK}}, nil
+}
+
+// UpdateService replaces a registered service's methods, cache policies and
+// ACLs. The service's deprecation, and those of methods it keeps, carry over.
+func (s *RegistryServer) UpdateService(ctx context.Context, req *collector.UpdateServiceRequest) (*collector.UpdateServiceResponse, error) {
+	if req.Namespace == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "namespace is required")
+	}
+	if req.ServiceDescriptor.GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "service descriptor name is required")
+	}
+	methodNames := []string{}
+	for _, method := range req.ServiceDescriptor.Method {
+		methodNames = append(methodNames, method.GetName())
+	}
+	if err := checkMethodPolicies(methodNames, req.CachePolicies, req.MethodAcls); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.lookupService(ctx, req.Namespace, req.ServiceDescriptor.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(current.Id, current.Version, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+
+	updated := proto.Clone(current).(*collector.RegisteredService)
+	updated.ServiceDescriptor = req.ServiceDescriptor
+	updated.MethodNames = methodNames
+	updated.CachePolicies = req.CachePolicies
+	updated.MethodAcls = req.MethodAcls
+	for method := range updated.MethodDeprecations {
+		if !slices.Contains(methodNames, method) {
+			delete(updated.MethodDeprecations, method)
+		}
+	}
+	updated.Version = current.Version + 1
+	if err := s.replaceService(ctx, updated); err != nil {
+		return nil, err
+	}
+	s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_UPDATED, updated.Namespace, "", updated.Id, updated.Version)
+
+	return &collector.UpdateServiceResponse{
+		Status:  &collector.Status{Code: collector.Status_OK},
+		Service: updated,
+	}, nil
+}
+
+// UnregisterService removes a registered service; calls to its methods fail
+// validation from then on.
+func (s *RegistryServer) UnregisterService(ctx context.Context, req *collector.UnregisterServiceRequest) (*collector.UnregisterServiceResponse, error) {
+	if req.Namespace == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "namespace is required")
+	}
+	if req.ServiceName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "service name is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.lookupService(ctx, req.Namespace, req.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(current.Id, current.Version, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	if err := s.registeredServices.DeleteRecord(ctx, current.Id); err != nil {
+		return nil, fmt.Errorf("unregister %s: %w", current.Id, err)
+	}
+	s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_REMOVED, current.Namespace, "", current.Id, 0)
+	return &collector.UnregisterServiceResponse{Status: &collector.Status{Code: collector.Status_OK}}, nil
+}
+
+// lookupService returns a registered service, or a NotFound error.
+func (s *RegistryServer) lookupService(ctx context.Context, namespace, serviceName string) (*collector.RegisteredService, error) {
+	serviceID := fmt.Sprintf("%s/%s", s.aliases.Resolve(namespace), serviceName)
+	record, err := s.registeredServices.GetRecord(ctx, serviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "service %s not found", serviceID)
+		}
+		return nil, err
+	}
+	service := &collector.RegisteredService{}
+	if err := proto.Unmarshal(record.ProtoData, service); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// replaceProto overwrites a stored proto, deleting the old record first as
+// replaceService does.
+func (s *RegistryServer) replaceProto(ctx context.Context, p *collector.RegisteredProto) error {
+	data, err := proto.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := s.registeredProtos.DeleteRecord(ctx, p.Id); err != nil {
+		return fmt.Errorf("replace %s: %w", p.Id, err)
+	}
+	if err := s.registeredProtos.CreateRecord(ctx, &collector.CollectionRecord{Id: p.Id, ProtoData: data}); err != nil {
+		return fmt.Errorf("replace %s: %w", p.Id, err)
+	}
+	return nil
+}
+
+// checkVersion returns an Aborted error when expected is set and is not an
+// entry's current version.
+func checkVersion(id string, current, expected int64) error {
+	if expected != 0 && expected != current {
+		return status.Errorf(codes.Aborted, "%s is at version %d, not %d", id, current, expected)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestUpdateAndUnregisterProto(t *testing.T) {
+	ctx := context.Background()
+	server, _, _ := setupTestServer(t)
+	for _, file := range []*descriptorpb.FileDescriptorProto{
+		{Name: proto.String("common.proto"), MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("Money")}}},
+		{Name: proto.String("orders.proto"), Dependency: []string{"common.proto"}, MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("Order")}}},
+	} {
+		if _, err := server.RegisterProto(ctx, &collector.RegisterProtoRequest{Namespace: "shop", FileDescriptor: file}); err != nil {
+			t.Fatalf("RegisterProto failed: %v", err)
+		}
+	}
+
+	// An update replaces the messages and bumps the version
+	resp, err := server.UpdateProto(ctx, &collector.UpdateProtoRequest{
+		Namespace:       "shop",
+		FileDescriptor:  &descriptorpb.FileDescriptorProto{Name: proto.String("common.proto"), MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("Money")}, {Name: proto.String("Address")}}},
+		ExpectedVersion: 1,
+	})
+	if err != nil || resp.Proto.Version != 2 || len(resp.Proto.MessageNames) != 2 {
+		t.Fatalf("UpdateProto failed: %v %v", resp, err)
+	}
+	got, _ := server.LookupProto(ctx, "shop", "common.proto")
+	if got.Version != 2 || got.MessageNames[1] != "Address" {
+		t.Errorf("expected the update stored, got %v", got)
+	}
+
+	// A stale version is refused
+	if _, err := server.UpdateProto(ctx, &collector.UpdateProtoRequest{
+		Namespace:       "shop",
+		FileDescriptor:  &descriptorpb.FileDescriptorProto{Name: proto.String("common.proto")},
+		ExpectedVersion: 1,
+	}); status.Code(err) != codes.Aborted {
+		t.Errorf("expected a stale update aborted, got %v", err)
+	}
+	if _, err := server.UpdateProto(ctx, &collector.UpdateProtoRequest{
+		Namespace:      "shop",
+		FileDescriptor: &descriptorpb.FileDescriptorProto{Name: proto.String("missing.proto")},
+	}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound updating an unregistered proto, got %v", err)
+	}
+
+	// A proto cannot be unregistered while another imports it
+	if _, err := server.UnregisterProto(ctx, &collector.UnregisterProtoRequest{Namespace: "shop", FileName: "common.proto"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected an imported proto kept, got %v", err)
+	}
+	if _, err := server.UnregisterProto(ctx, &collector.UnregisterProtoRequest{Namespace: "shop", FileName: "orders.proto", ExpectedVersion: 2}); status.Code(err) != codes.Aborted {
+		t.Errorf("expected a stale unregistration aborted, got %v", err)
+	}
+	for _, file := range []string{"orders.proto", "common.proto"} {
+		if _, err := server.UnregisterProto(ctx, &collector.UnregisterProtoRequest{Namespace: "shop", FileName: file}); err != nil {
+			t.Fatalf("UnregisterProto %s failed: %v", file, err)
+		}
+	}
+	if list, _ := server.ListProtos(ctx, &collector.ListProtosRequest{Namespace: "shop"}); len(list.Protos) != 0 {
+		t.Errorf("expected no protos left, got %v", list.Protos)
+	}
+
+	// The file name can be registered again, from version 1
+	reg, err := server.RegisterProto(ctx, &collector.RegisterProtoRequest{Namespace: "shop", FileDescriptor: &descriptorpb.FileDescriptorProto{Name: proto.String("common.proto")}})
+	if err != nil {
+		t.Fatalf("re-registering failed: %v", err)
+	}
+	if got, _ := server.LookupProto(ctx, "shop", "common.proto"); reg.ProtoId != "shop/common.proto" || got.Version != 1 {
+		t.Errorf("expected a fresh registration, got %v", got)
+	}
+}
+
+func TestUpdateAndUnregisterService(t *testing.T) {
+	ctx := context.Background()
+	server, _, _ := setupTestServer(t)
+	if _, err := server.RegisterService(ctx, &collector.RegisterServiceRequest{
+		Namespace: "billing",
+		ServiceDescriptor: &descriptorpb.ServiceDescriptorProto{
+			Name:   proto.String("Billing"),
+			Method: []*descriptorpb.MethodDescriptorProto{{Name: proto.String("Charge")}, {Name: proto.String("Refund")}},
+		},
+	}); err != nil {
+		t.Fatalf("RegisterService failed: %v", err)
+	}
+	dep, err := server.DeprecateService(ctx, &collector.DeprecateServiceRequest{
+		Namespace: "billing", ServiceName: "Billing", MethodName: "Refund",
+		Deprecation: &collector.Deprecation{Message: "use Reverse"},
+	})
+	if err != nil || dep.Service.Version != 2 {
+		t.Fatalf("expected deprecating to bump the version, got %v %v", dep, err)
+	}
+
+	// Updating replaces the methods; deprecations of removed methods go
+	resp, err := server.UpdateService(ctx, &collector.UpdateServiceRequest{
+		Namespace: "billing",
+		ServiceDescriptor: &descriptorpb.ServiceDescriptorProto{
+			Name:   proto.String("Billing"),
+			Method: []*descriptorpb.MethodDescriptorProto{{Name: proto.String("Charge")}, {Name: proto.String("Reverse")}},
+		},
+		CachePolicies:   map[string]*collector.CachePolicy{"Reverse": {TtlMs: 1000}},
+		ExpectedVersion: 2,
+	})
+	if err != nil || resp.Service.Version != 3 || len(resp.Service.MethodDeprecations) != 0 {
+		t.Fatalf("UpdateService failed: %v %v", resp, err)
+	}
+	for method, valid := range map[string]bool{"Charge": true, "Reverse": true, "Refund": false} {
+		v, _ := server.ValidateMethod(ctx, &collector.ValidateMethodRequest{Namespace: "billing", ServiceName: "Billing", MethodName: method})
+		if v.IsValid != valid {
+			t.Errorf("expected %s valid=%v after the update, got %v", method, valid, v)
+		}
+	}
+
+	// Invalid policies and stale versions are refused
+	if _, err := server.UpdateService(ctx, &collector.UpdateServiceRequest{
+		Namespace:         "billing",
+		ServiceDescriptor: &descriptorpb.ServiceDescriptorProto{Name: proto.String("Billing")},
+		CachePolicies:     map[string]*collector.CachePolicy{"Charge": {TtlMs: 1000}},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected a policy for a removed method refused, got %v", err)
+	}
+	if _, err := server.UnregisterService(ctx, &collector.UnregisterServiceRequest{Namespace: "billing", ServiceName: "Billing", ExpectedVersion: 2}); status.Code(err) != codes.Aborted {
+		t.Errorf("expected a stale unregistration aborted, got %v", err)
+	}
+
+	if _, err := server.UnregisterService(ctx, &collector.UnregisterServiceRequest{Namespace: "billing", ServiceName: "Billing", ExpectedVersion: 3}); err != nil {
+		t.Fatalf("UnregisterService failed: %v", err)
+	}
+	if lookup, _ := server.LookupService(ctx, &collector.LookupServiceRequest{Namespace: "billing", ServiceName: "Billing"}); lookup.Status.Code != collector.Status_NOT_FOUND {
+		t.Errorf("expected the service gone, got %v", lookup.Status)
+	}
+	if _, err := server.UnregisterService(ctx, &collector.UnregisterServiceRequest{Namespace: "billing", ServiceName: "Billing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound unregistering twice, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package registry
+
+import (
+	"context"
+
+	"github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// recordVersion appends p's current version to its history, naming the
+// caller as its registrant. A proto registered before history was kept gets
+// the version p replaces, previous, added first, without a time or
+// registrant.
+func recordVersion(ctx context.Context, previous, p *collector.RegisteredProto) {
+	if previous != nil && len(p.History) == 0 {
+		p.History = append(p.History, &collector.ProtoVersion{Version: previous.Version, FileDescriptor: previous.FileDescriptor})
+	}
+	p.History = append(p.History, &collector.ProtoVersion{
+		Version:        p.Version,
+		FileDescriptor: p.FileDescriptor,
+		RegisteredAt:   timestamppb.Now(),
+		RegisteredBy:   collection.PrincipalFromContext(ctx),
+	})
+}
+
+// setFile makes fd a proto's current file.
+func setFile(p *collector.RegisteredProto, fd *descriptorpb.FileDescriptorProto) {
+	p.FileDescriptor = fd
+	p.Dependencies = fd.Dependency
+	p.MessageNames = []string{}
+	for _, msg := range fd.MessageType {
+		p.MessageNames = append(p.MessageNames, msg.GetName())
+	}
+}
+
+// addProtoVersion registers fd as version of an already registered proto.
+// The version must be above the current one, unless it is already
+// registered with the same file, which changes nothing. Callers hold mu.
+func (s *RegistryServer) addProtoVersion(ctx context.Context, current *collector.RegisteredProto, fd *descriptorpb.FileDescriptorProto, version int64) (*collector.RegisteredProto, error) {
+	if existing, err := protoAtVersion(current, version); err == nil {
+		if proto.Equal(existing.FileDescriptor, fd) {
+			return current, nil
+		}
+		return nil, status.Errorf(codes.AlreadyExists, "version %d of %s is already registered with another file", version, current.Id)
+	}
+	if version <= current.Version {
+		return nil, status.Errorf(codes.AlreadyExists, "%s is at version %d; register a higher version", current.Id, current.Version)
+	}
+
+	updated := proto.Clone(current).(*collector.RegisteredProto)
+	setFile(updated, fd)
+	updated.Version = version
+	recordVersion(ctx, current, updated)
+	if err := s.replaceProto(ctx, updated); err != nil {
+		return nil, err
+	}
+	s.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_UPDATED, updated.Namespace, updated.Id, "", updated.Version)
+	return updated, nil
+}
+
+// protoAtVersion returns a proto as it was at version, from its history,
+// or NotFound. Version 0 is the current version.
+func protoAtVersion(p *collector.RegisteredProto, version int64) (*collector.RegisteredProto, error) {
+	if version == 0 || version == p.Version {
+		return p, nil
+	}
+	for _, v := range p.History {
+		if v.Version == version {
+			at := proto.Clone(p).(*collector.RegisteredProto)
+			setFile(at, v.FileDescriptor)
+			at.Version = v.Version
+			return at, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "proto %s has no version %d", p.Id, version)
+}
+
+// withoutHistoryFiles returns p with the files of its history left out, for
+// responses.
+func withoutHistoryFiles(p *collector.RegisteredProto) *collector.RegisteredProto {
+	if len(p.History) == 0 {
+		return p
+	}
+	p = proto.Clone(p).(*collector.RegisteredProto)
+	for _, v := range p.History {
+		v.FileDescriptor = nil
+	}
+	return p
+}
@@ -0,0 +1,82 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestProtoVersions(t *testing.T) {
+	ctx := collection.WithPrincipal(context.Background(), "alice")
+	server, _, _ := setupTestServer(t)
+	register := func(ctx context.Context, version int64, message string) error {
+		_, err := server.RegisterProto(ctx, &collector.RegisterProtoRequest{Namespace: "shop", FileDescriptor: testFile("money.proto", message, nil), Version: version})
+		return err
+	}
+
+	if err := register(ctx, 0, "Money"); err != nil {
+		t.Fatalf("RegisterProto failed: %v", err)
+	}
+	if err := register(ctx, 0, "Money"); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected registering without a version to refuse a registered file, got %v", err)
+	}
+
+	// Explicit versions add to the history, by whoever registers them
+	if err := register(collection.WithPrincipal(ctx, "bob"), 3, "Cash"); err != nil {
+		t.Fatalf("RegisterProto of version 3 failed: %v", err)
+	}
+	if err := register(ctx, 3, "Cash"); err != nil {
+		t.Errorf("expected registering the same version again to be a no-op, got %v", err)
+	}
+	for version, message := range map[int64]string{3: "Coins", 2: "Coins"} {
+		if err := register(ctx, version, message); status.Code(err) != codes.AlreadyExists {
+			t.Errorf("version %d: expected AlreadyExists, got %v", version, err)
+		}
+	}
+	if _, err := server.UpdateProto(ctx, &collector.UpdateProtoRequest{Namespace: "shop", FileDescriptor: testFile("money.proto", "Currency", nil)}); err != nil {
+		t.Fatalf("UpdateProto failed: %v", err)
+	}
+
+	resp, err := server.GetProto(ctx, &collector.GetProtoRequest{Namespace: "shop", FileName: "money.proto"})
+	if err != nil || resp.Status.Code != collector.Status_OK {
+		t.Fatalf("GetProto failed: %v %v", resp, err)
+	}
+	type version struct {
+		version int64
+		by      string
+	}
+	var history []version
+	for _, v := range resp.Proto.History {
+		if v.RegisteredAt == nil || v.FileDescriptor != nil {
+			t.Errorf("expected a timestamp and no file in %v", v)
+		}
+		history = append(history, version{v.Version, v.RegisteredBy})
+	}
+	if want := []version{{1, "alice"}, {3, "bob"}, {4, "alice"}}; resp.Proto.Version != 4 || len(history) != 3 || history[0] != want[0] || history[1] != want[1] || history[2] != want[2] {
+		t.Errorf("expected versions %v, got %d %v", want, resp.Proto.Version, history)
+	}
+
+	// Earlier versions are returned as they were
+	for v, message := range map[int64]string{1: "Money", 3: "Cash", 4: "Currency"} {
+		resp, err := server.GetProto(ctx, &collector.GetProtoRequest{Namespace: "shop", FileName: "money.proto", Version: v})
+		if err != nil || resp.Status.Code != collector.Status_OK || resp.Proto.Version != v || resp.Proto.MessageNames[0] != message {
+			t.Errorf("version %d: expected %s, got %v %v", v, message, resp, err)
+		}
+	}
+	if resp, _ := server.GetProto(ctx, &collector.GetProtoRequest{Namespace: "shop", FileName: "money.proto", Version: 2}); resp.Status.Code != collector.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND for a version never registered, got %v", resp.Status)
+	}
+
+	// A new file can start at any version
+	if _, err := server.RegisterProto(ctx, &collector.RegisterProtoRequest{Namespace: "shop", FileDescriptor: testFile("orders.proto", "Order", nil), Version: 7}); err != nil {
+		t.Fatalf("RegisterProto failed: %v", err)
+	}
+	if p, err := server.LookupProto(ctx, "shop", "orders.proto"); err != nil || p.Version != 7 || len(p.History) != 1 || !proto.Equal(p.History[0].FileDescriptor, p.FileDescriptor) {
+		t.Errorf("expected orders.proto at version 7, got %v %v", p, err)
+	}
+}
@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+)
+
+// maxRecentChanges is how many changes the registry keeps for watchers
+// resuming after a disconnect. Watchers further behind are sent a RESET.
+const maxRecentChanges = 1000
+
+// changeLog numbers the registry's changes and keeps the most recent, for
+// WatchRegistry. Watchers wait on changed, which is closed and replaced on
+// every change.
+type changeLog struct {
+	mu       sync.Mutex
+	instance string
+	sequence uint64
+	recent   []*collector.RegistryChange
+	changed  chan struct{}
+}
+
+// init sets up the log on first use. Callers hold mu.
+func (l *changeLog) init() {
+	if l.changed == nil {
+		l.instance = uuid.NewString()[:8]
+		l.changed = make(chan struct{})
+	}
+}
+
+// publish records a change to a registered proto or service and wakes
+// watchers.
+func (s *RegistryServer) publish(kind collector.RegistryChangeKind, namespace, protoID, serviceID string, version int64) {
+	l := &s.changes
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	l.sequence++
+	l.recent = append(l.recent, &collector.RegistryChange{
+		Sequence:  l.sequence,
+		Instance:  l.instance,
+		Kind:      kind,
+		Namespace: namespace,
+		ProtoId:   protoID,
+		ServiceId: serviceID,
+		Version:   version,
+		ChangedAt: time.Now().Unix(),
+	})
+	if len(l.recent) > maxRecentChanges {
+		l.recent = append(l.recent[:0], l.recent[1:]...)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// head returns the sequence of the last change and the log's instance.
+func (l *changeLog) head() (uint64, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	return l.sequence, l.instance
+}
+
+// since returns the changes after sequence after of instance, and a channel
+// closed on the next change. When those changes are no longer kept, or
+// instance is another, they are replaced by a RESET at the last change.
+func (l *changeLog) since(after uint64, instance string) ([]*collector.RegistryChange, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	oldest := l.sequence - uint64(len(l.recent)) // The change before the first kept
+	if instance != l.instance || after > l.sequence || after < oldest {
+		return []*collector.RegistryChange{{
+			Sequence:  l.sequence,
+			Instance:  l.instance,
+			Kind:      collector.RegistryChangeKind_REGISTRY_CHANGE_RESET,
+			ChangedAt: time.Now().Unix(),
+		}}, l.changed
+	}
+	return append([]*collector.RegistryChange(nil), l.recent[after-oldest:]...), l.changed
+}
+
+// WatchRegistry streams changes to registered protos and services, in
+// order, until the client goes away. A watcher that reconnects passes the
+// sequence and instance of the last change it saw to resume; if the
+// registry no longer has the changes since, it is sent a RESET and should
+// reload whatever it caches.
+func (s *RegistryServer) WatchRegistry(req *collector.WatchRegistryRequest, stream collector.CollectorRegistry_WatchRegistryServer) error {
+	namespace := req.Namespace
+	if namespace != "" {
+		namespace = s.aliases.Resolve(namespace)
+	}
+	after, instance := req.SinceSequence, req.Instance
+	if after == 0 {
+		after, instance = s.changes.head()
+	}
+
+	for {
+		changes, changed := s.changes.since(after, instance)
+		for _, change := range changes {
+			if change.Kind == collector.RegistryChangeKind_REGISTRY_CHANGE_RESET || namespace == "" || change.Namespace == namespace {
+				if err := stream.Send(change); err != nil {
+					return err
+				}
+			}
+			after, instance = change.Sequence, change.Instance
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
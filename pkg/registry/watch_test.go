@@ -0,0 +1,128 @@
+package registry
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/accretional/collector/gen/collector"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// watchClient serves server over an in-memory connection and returns a
+// client of it.
+func watchClient(t *testing.T, server *RegistryServer) collector.CollectorRegistryClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	collector.RegisterCollectorRegistryServer(grpcServer, server)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return collector.NewCollectorRegistryClient(conn)
+}
+
+// recvChanges receives n changes from a watch.
+func recvChanges(t *testing.T, stream collector.CollectorRegistry_WatchRegistryClient, n int) []*collector.RegistryChange {
+	t.Helper()
+	var changes []*collector.RegistryChange
+	for len(changes) < n {
+		change, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed after %d changes: %v", len(changes), err)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func TestWatchRegistry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server, _, _ := setupTestServer(t)
+	client := watchClient(t, server)
+
+	// Resume from a known point, so the watch cannot miss changes made
+	// while it starts
+	if _, err := server.RegisterProto(ctx, &collector.RegisterProtoRequest{Namespace: "other", FileDescriptor: testFile("other.proto", "Other", nil)}); err != nil {
+		t.Fatalf("RegisterProto failed: %v", err)
+	}
+	head, instance := server.changes.head()
+	stream, err := client.WatchRegistry(ctx, &collector.WatchRegistryRequest{Namespace: "shop", SinceSequence: head, Instance: instance})
+	if err != nil {
+		t.Fatalf("WatchRegistry failed: %v", err)
+	}
+
+	server.RegisterProto(ctx, &collector.RegisterProtoRequest{Namespace: "shop", FileDescriptor: testFile("money.proto", "Money", nil)})
+	server.RegisterProto(ctx, &collector.RegisterProtoRequest{Namespace: "other", FileDescriptor: testFile("ignored.proto", "Ignored", nil)})
+	server.UpdateProto(ctx, &collector.UpdateProtoRequest{Namespace: "shop", FileDescriptor: testFile("money.proto", "Money", nil)})
+	server.RegisterService(ctx, &collector.RegisterServiceRequest{
+		Namespace:         "shop",
+		ServiceDescriptor: &descriptorpb.ServiceDescriptorProto{Name: proto.String("Checkout"), Method: []*descriptorpb.MethodDescriptorProto{{Name: proto.String("Pay")}}},
+	})
+	server.DeprecateService(ctx, &collector.DeprecateServiceRequest{Namespace: "shop", ServiceName: "Checkout", Deprecation: &collector.Deprecation{Message: "use Checkout2"}})
+	server.UnregisterProto(ctx, &collector.UnregisterProtoRequest{Namespace: "shop", FileName: "money.proto"})
+
+	type seen struct {
+		kind     collector.RegistryChangeKind
+		id       string
+		version  int64
+		sequence uint64
+	}
+	want := []seen{
+		{collector.RegistryChangeKind_REGISTRY_CHANGE_REGISTERED, "shop/money.proto", 1, 2},
+		{collector.RegistryChangeKind_REGISTRY_CHANGE_UPDATED, "shop/money.proto", 2, 4},
+		{collector.RegistryChangeKind_REGISTRY_CHANGE_REGISTERED, "shop/Checkout", 1, 5},
+		{collector.RegistryChangeKind_REGISTRY_CHANGE_UPDATED, "shop/Checkout", 2, 6},
+		{collector.RegistryChangeKind_REGISTRY_CHANGE_REMOVED, "shop/money.proto", 0, 7},
+	}
+	changes := recvChanges(t, stream, len(want))
+	for i, change := range changes {
+		got := seen{change.Kind, change.ProtoId + change.ServiceId, change.Version, change.Sequence}
+		if got != want[i] || change.Namespace != "shop" || change.Instance != instance {
+			t.Errorf("change %d: expected %v, got %v", i, want[i], change)
+		}
+	}
+
+	// A watcher resuming is replayed what it missed
+	resumed, err := client.WatchRegistry(ctx, &collector.WatchRegistryRequest{SinceSequence: 5, Instance: instance})
+	if err != nil {
+		t.Fatalf("WatchRegistry failed: %v", err)
+	}
+	if replayed := recvChanges(t, resumed, 2); replayed[0].Sequence != 6 || replayed[1].Sequence != 7 {
+		t.Errorf("expected changes 6 and 7 replayed, got %v", replayed)
+	}
+
+	// One that cannot be replayed to is told to reset: after a restart, or
+	// once the changes it missed are gone
+	for name, req := range map[string]*collector.WatchRegistryRequest{
+		"restarted":   {SinceSequence: 5, Instance: "gone"},
+		"fell behind": {SinceSequence: 1, Instance: instance},
+	} {
+		if name == "fell behind" {
+			for i := 0; i < maxRecentChanges; i++ {
+				server.publish(collector.RegistryChangeKind_REGISTRY_CHANGE_UPDATED, "other", "other/other.proto", "", 1)
+			}
+		}
+		reset, err := client.WatchRegistry(ctx, req)
+		if err != nil {
+			t.Fatalf("WatchRegistry failed: %v", err)
+		}
+		head, _ := server.changes.head()
+		if got := recvChanges(t, reset, 1)[0]; got.Kind != collector.RegistryChangeKind_REGISTRY_CHANGE_RESET || got.Sequence != head || got.Instance != instance {
+			t.Errorf("%s: expected a RESET at %d, got %v", name, head, got)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package testkit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/accretional/collector/pkg/dispatch"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Echo returns a handler that responds with its input.
+func Echo() dispatch.ServiceHandler {
+	return func(ctx context.Context, input interface{}) (interface{}, error) {
+		if in, _ := input.(*anypb.Any); in != nil {
+			return in, nil
+		}
+		return &anypb.Any{}, nil
+	}
+}
+
+// Static returns a handler that always responds with msg.
+func Static(msg proto.Message) dispatch.ServiceHandler {
+	return func(ctx context.Context, input interface{}) (interface{}, error) {
+		return anypb.New(msg)
+	}
+}
+
+// Fail returns a handler that always fails with err.
+func Fail(err error) dispatch.ServiceHandler {
+	return func(ctx context.Context, input interface{}) (interface{}, error) {
+		return nil, err
+	}
+}
+
+// Delay returns a handler that waits for d, or until the call is canceled,
+// before calling next.
+func Delay(d time.Duration, next dispatch.ServiceHandler) dispatch.ServiceHandler {
+	return func(ctx context.Context, input interface{}) (interface{}, error) {
+		select {
+		case <-time.After(d):
+			return next(ctx, input)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Recorder records the inputs of the calls made through its handlers. It
+// is safe for concurrent use.
+type Recorder struct {
+	inputs []*anypb.Any
+	mu     sync.Mutex
+}
+
+// Wrap returns a handler that records each call and then calls next.
+func (r *Recorder) Wrap(next dispatch.ServiceHandler) dispatch.ServiceHandler {
+	return func(ctx context.Context, input interface{}) (interface{}, error) {
+		in, _ := input.(*anypb.Any)
+		r.mu.Lock()
+		r.inputs = append(r.inputs, in)
+		r.mu.Unlock()
+		return next(ctx, input)
+	}
+}
+
+// Calls returns the number of calls recorded.
+func (r *Recorder) Calls() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.inputs)
+}
+
+// Inputs returns the recorded inputs in call order.
+func (r *Recorder) Inputs() []*anypb.Any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*anypb.Any(nil), r.inputs...)
+}
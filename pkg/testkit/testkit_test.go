@@ -0,0 +1,106 @@
+package testkit_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/dispatch"
+	"github.com/accretional/collector/pkg/testkit"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestMesh_DispatchAcrossCollectors(t *testing.T) {
+	ctx := context.Background()
+	mesh := testkit.NewMesh(t, 3, testkit.Options{Namespaces: []string{"orders"}})
+
+	var rec testkit.Recorder
+	server := mesh.Collector("collector2")
+	if err := server.RegisterService(ctx, "orders", "Orders", map[string]dispatch.ServiceHandler{
+		"Get":    rec.Wrap(testkit.Echo()),
+		"Cancel": testkit.Fail(errors.New("already shipped")),
+		"Ship":   testkit.Delay(time.Second, testkit.Static(&pb.Status{Message: "shipped"})),
+	}); err != nil {
+		t.Fatalf("RegisterService failed: %v", err)
+	}
+	if err := mesh.ConnectAll(ctx); err != nil {
+		t.Fatalf("ConnectAll failed: %v", err)
+	}
+	if n := len(mesh.Collectors[0].Dispatcher.GetConnectionManager().ListConnections()); n != 4 {
+		t.Errorf("expected collector0 to hold 4 connections (2 out, 2 in), got %d", n)
+	}
+
+	input, _ := anypb.New(&pb.Status{Message: "o-1"})
+	dispatchMethod := func(ctx context.Context, method string) *pb.DispatchResponse {
+		t.Helper()
+		resp, err := mesh.Collectors[0].Dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+			Namespace:         "orders",
+			Service:           &pb.ServiceTypeRef{ServiceName: "Orders"},
+			MethodName:        method,
+			Input:             input,
+			TargetCollectorId: "collector2",
+		})
+		if err != nil {
+			t.Fatalf("Dispatch %s failed: %v", method, err)
+		}
+		return resp
+	}
+
+	resp := dispatchMethod(ctx, "Get")
+	if resp.Status.Code != 200 || resp.HandledByCollectorId != "collector2" || !proto.Equal(resp.Output, input) {
+		t.Errorf("expected collector2 to echo the input, got %v", resp)
+	}
+	if rec.Calls() != 1 || !proto.Equal(rec.Inputs()[0], input) {
+		t.Errorf("expected one recorded call, got %v", rec.Inputs())
+	}
+	if resp := dispatchMethod(ctx, "Cancel"); resp.Status.Code != 500 {
+		t.Errorf("expected Cancel to fail, got %v", resp.Status)
+	}
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if resp := dispatchMethod(short, "Ship"); resp.Status.Code == 200 {
+		t.Errorf("expected the delayed handler to outlast the deadline, got %v", resp.Status)
+	}
+
+	// External clients reach collectors through the mesh too
+	conn, err := mesh.Collectors[1].Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	resp, err = pb.NewCollectiveDispatcherClient(conn).Dispatch(ctx, &pb.DispatchRequest{
+		Namespace:  "orders",
+		Service:    &pb.ServiceTypeRef{ServiceName: "Orders"},
+		MethodName: "Get",
+		Input:      input,
+	})
+	if err != nil || resp.Status.Code != 200 || resp.HandledByCollectorId != "collector2" {
+		t.Errorf("expected collector1 to auto-route to collector2, got %v (%v)", resp, err)
+	}
+}
+
+func TestMesh_Add(t *testing.T) {
+	ctx := context.Background()
+	mesh := testkit.NewMesh(t, 1, testkit.Options{IDPrefix: "node"})
+
+	late := mesh.Add("late")
+	if err := late.RegisterService(ctx, testkit.DefaultNamespace, "Clock", map[string]dispatch.ServiceHandler{
+		"Now": testkit.Static(&pb.Status{Message: "noon"}),
+	}); err != nil {
+		t.Fatalf("RegisterService failed: %v", err)
+	}
+	if err := mesh.Collector("node0").ConnectTo(ctx, late); err != nil {
+		t.Fatalf("ConnectTo failed: %v", err)
+	}
+	resp, err := mesh.Collector("node0").Dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+		Namespace:  testkit.DefaultNamespace,
+		Service:    &pb.ServiceTypeRef{ServiceName: "Clock"},
+		MethodName: "Now",
+	})
+	if err != nil || resp.Status.Code != 200 || resp.HandledByCollectorId != "late" {
+		t.Errorf("expected node0 to reach the late collector, got %v (%v)", resp, err)
+	}
+}
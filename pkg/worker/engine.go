@@ -0,0 +1,548 @@
+// Package worker runs workflows: ordered chains of dispatches in which the
+// output of each step is the input of the next. Workflows are persisted in a
+// Store after every step, so a collector that restarts resumes them where
+// they stopped.
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultHistoryPageSize is the page size of GetWorkflowHistory when none is given.
+const DefaultHistoryPageSize = 100
+
+// Dispatcher sends a step to the collector that serves it;
+// *dispatch.Dispatcher implements it.
+type Dispatcher interface {
+	Dispatch(ctx context.Context, req *pb.DispatchRequest) (*pb.DispatchResponse, error)
+}
+
+// Engine implements the CollectiveWorker service.
+type Engine struct {
+	pb.UnimplementedCollectiveWorkerServer
+
+	store      Store
+	dispatcher Dispatcher
+
+	base    context.Context // Cancelled by Stop
+	stop    context.CancelFunc
+	running map[string]*run
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+}
+
+// run is a workflow executing in this engine.
+type run struct {
+	cancel    context.CancelFunc
+	cancelled bool // Set by CancelWorkflow, as opposed to Stop
+}
+
+// NewEngine creates an engine that keeps workflows in store and runs their
+// steps through dispatcher.
+func NewEngine(store Store, dispatcher Dispatcher) *Engine {
+	base, stop := context.WithCancel(context.Background())
+	return &Engine{
+		store:      store,
+		dispatcher: dispatcher,
+		base:       base,
+		stop:       stop,
+		running:    make(map[string]*run),
+	}
+}
+
+// Start resumes the workflows a previous engine left pending or running.
+func (e *Engine) Start(ctx context.Context) error {
+	list, err := e.store.ListWorkflows(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load workflows: %w", err)
+	}
+	for _, wf := range list {
+		if wf.State == pb.WorkflowState_WORKFLOW_PENDING || wf.State == pb.WorkflowState_WORKFLOW_RUNNING {
+			e.launch(wf)
+		}
+	}
+	return nil
+}
+
+// Stop interrupts running workflows and waits for them to return. Their
+// state is kept so the next Start resumes them.
+func (e *Engine) Stop() {
+	e.stop()
+	e.wg.Wait()
+}
+
+// launch runs wf in the background.
+func (e *Engine) launch(wf *pb.ActiveWorkflow) {
+	ctx, cancel := context.WithCancel(e.base)
+	e.mu.Lock()
+	r := &run{cancel: cancel}
+	e.running[wf.Id] = r
+	e.mu.Unlock()
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer cancel()
+		e.execute(ctx, wf, r)
+
+		e.mu.Lock()
+		delete(e.running, wf.Id)
+		e.mu.Unlock()
+	}()
+}
+
+// isCancelled reports whether CancelWorkflow was called for r.
+func (e *Engine) isCancelled(r *run) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return r.cancelled
+}
+
+// save persists wf, logging failures; the workflow carries on in memory.
+func (e *Engine) save(wf *pb.ActiveWorkflow) {
+	wf.Metadata.UpdatedAt = timestamppb.Now()
+	if err := e.store.SaveWorkflow(context.Background(), wf); err != nil {
+		log.Printf("Warning: failed to save workflow %s: %v", wf.Id, err)
+	}
+}
+
+// execute runs the remaining steps of wf, then compensates if it failed or
+// was cancelled. It returns early, leaving wf resumable, when the engine
+// stops.
+func (e *Engine) execute(ctx context.Context, wf *pb.ActiveWorkflow, r *run) {
+	tasks := wf.Definition.GetTasks()
+	if wf.State == pb.WorkflowState_WORKFLOW_PENDING {
+		wf.State = pb.WorkflowState_WORKFLOW_RUNNING
+		e.save(wf)
+	}
+
+	if !wf.Compensating {
+		input := wf.Input
+		for _, task := range tasks {
+			te := wf.TaskExecutions[task.Id]
+			if te.State == pb.ExecutionState_EXECUTION_SUCCEEDED {
+				input = wf.CurrentOutput
+				continue
+			}
+
+			output, err := e.runTask(ctx, wf, task, input)
+			if ctx.Err() != nil {
+				if !e.isCancelled(r) {
+					e.save(wf)
+					return
+				}
+				wf.CancelRequested = true
+				te.State = pb.ExecutionState_EXECUTION_CANCELLED
+				break
+			}
+			if err != nil {
+				wf.Error = fmt.Sprintf("task %s: %v", task.Id, err)
+				break
+			}
+			wf.CurrentOutput = output
+			input = output
+			e.save(wf)
+		}
+
+		if wf.Error == "" && !wf.CancelRequested {
+			wf.State = pb.WorkflowState_WORKFLOW_SUCCEEDED
+			e.save(wf)
+			return
+		}
+		wf.Compensating = true
+		e.save(wf)
+	}
+
+	// Undo the succeeded steps in reverse, even after a cancel
+	for i := len(tasks) - 1; i >= 0; i-- {
+		task := tasks[i]
+		te := wf.TaskExecutions[task.Id]
+		if te.State != pb.ExecutionState_EXECUTION_SUCCEEDED || te.Compensated || task.Compensation == nil {
+			continue
+		}
+		if err := e.compensate(e.base, wf, task); err != nil {
+			if e.base.Err() != nil {
+				return
+			}
+			log.Printf("Warning: compensation of task %s in workflow %s failed: %v", task.Id, wf.Id, err)
+		}
+		te.Compensated = true
+		e.save(wf)
+	}
+
+	wf.Compensating = false
+	wf.State = pb.WorkflowState_WORKFLOW_FAILED
+	if wf.CancelRequested {
+		wf.State = pb.WorkflowState_WORKFLOW_CANCELLED
+	}
+	e.save(wf)
+}
+
+// runTask dispatches a task, retrying by its policy, and returns its output.
+func (e *Engine) runTask(ctx context.Context, wf *pb.ActiveWorkflow, task *pb.Task, input *anypb.Any) (*anypb.Any, error) {
+	te := wf.TaskExecutions[task.Id]
+	policy := task.RetryPolicy
+	attempts := max(int(policy.GetMaxAttempts()), 1)
+
+	// A task resumed after its final attempt was interrupted by a crash
+	err := fmt.Errorf("interrupted on attempt %d of %d", te.AttemptNumber, attempts)
+	for attempt := int(te.AttemptNumber) + 1; attempt <= attempts; attempt++ {
+		te.State, te.AttemptNumber = pb.ExecutionState_EXECUTION_RUNNING, int32(attempt)
+		e.save(wf)
+
+		var output *anypb.Any
+		output, err = e.dispatch(ctx, wf, task, task.Service, task.MethodName, input, int32(attempt), false)
+		if err == nil {
+			te.State = pb.ExecutionState_EXECUTION_SUCCEEDED
+			return output, nil
+		}
+		if ctx.Err() != nil {
+			// The interrupted attempt does not count
+			te.State, te.AttemptNumber = pb.ExecutionState_EXECUTION_PENDING, int32(attempt-1)
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, errInvalid) || attempt == attempts {
+			break
+		}
+
+		te.State = pb.ExecutionState_EXECUTION_RETRYING
+		e.save(wf)
+		select {
+		case <-time.After(retryDelay(policy, attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	te.State = pb.ExecutionState_EXECUTION_FAILED
+	return nil, err
+}
+
+// compensate dispatches a task's compensation with the task's output,
+// retrying by the task's policy.
+func (e *Engine) compensate(ctx context.Context, wf *pb.ActiveWorkflow, task *pb.Task) error {
+	output, err := e.taskOutput(ctx, wf.Id, task.Id)
+	if err != nil {
+		return err
+	}
+	attempts := max(int(task.RetryPolicy.GetMaxAttempts()), 1)
+	for attempt := 1; ; attempt++ {
+		_, err = e.dispatch(ctx, wf, task, task.Compensation.Service, task.Compensation.MethodName, output, int32(attempt), true)
+		if err == nil || ctx.Err() != nil || errors.Is(err, errInvalid) || attempt == attempts {
+			return err
+		}
+		select {
+		case <-time.After(retryDelay(task.RetryPolicy, attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// taskOutput returns the output of a task's successful execution.
+func (e *Engine) taskOutput(ctx context.Context, workflowID, taskID string) (*anypb.Any, error) {
+	execs, err := e.store.ListExecutions(ctx, workflowID)
+	if err != nil {
+		return nil, err
+	}
+	for _, exec := range execs {
+		if exec.TaskId == taskID && !exec.Compensation && exec.State == pb.ExecutionState_EXECUTION_SUCCEEDED {
+			return exec.Output, nil
+		}
+	}
+	return nil, fmt.Errorf("no successful execution of task %s", taskID)
+}
+
+// errInvalid marks step failures that retrying cannot fix.
+var errInvalid = errors.New("invalid request")
+
+// dispatch sends one attempt of a step and records it as an Execution.
+func (e *Engine) dispatch(ctx context.Context, wf *pb.ActiveWorkflow, task *pb.Task, service *pb.ServiceTypeRef, method string, input *anypb.Any, attempt int32, compensation bool) (*anypb.Any, error) {
+	exec := &pb.Execution{
+		Id:            uuid.New().String(),
+		WorkflowId:    wf.Id,
+		TaskId:        task.Id,
+		Namespace:     wf.Namespace,
+		Service:       service,
+		MethodName:    method,
+		Input:         input,
+		AttemptNumber: attempt,
+		Compensation:  compensation,
+		Metadata:      &pb.Metadata{CreatedAt: timestamppb.Now()},
+	}
+
+	resp, err := e.dispatcher.Dispatch(ctx, &pb.DispatchRequest{
+		Namespace:  wf.Namespace,
+		Service:    service,
+		MethodName: method,
+		Input:      input,
+	})
+	switch {
+	case err != nil:
+		err = fmt.Errorf("dispatch failed: %w", err)
+	case resp.Status.GetCode() == 400:
+		err = fmt.Errorf("%w: %s", errInvalid, resp.Status.GetMessage())
+	case resp.Status.GetCode() != 200:
+		err = fmt.Errorf("status %d: %s", resp.Status.GetCode(), resp.Status.GetMessage())
+	}
+
+	exec.Metadata.UpdatedAt = timestamppb.Now()
+	if err != nil {
+		exec.State = pb.ExecutionState_EXECUTION_FAILED
+		exec.Error = &pb.Status{Code: pb.Status_UNKNOWN, Message: err.Error()}
+		if resp != nil {
+			exec.Error = resp.Status
+		}
+	} else {
+		exec.State = pb.ExecutionState_EXECUTION_SUCCEEDED
+		exec.Output = resp.Output
+		exec.ExecutorId = resp.HandledByCollectorId
+	}
+	if err := e.store.RecordExecution(context.Background(), exec); err != nil {
+		log.Printf("Warning: failed to record execution of task %s in workflow %s: %v", task.Id, wf.Id, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Output, nil
+}
+
+// retryDelay returns the wait after a failed attempt: initial_delay_seconds
+// multiplied by backoff_multiplier (default 2) per further attempt, capped at
+// max_delay_seconds.
+func retryDelay(policy *pb.RetryPolicy, attempt int) time.Duration {
+	multiplier := policy.GetBackoffMultiplier()
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	delay := float64(policy.GetInitialDelaySeconds()) * math.Pow(multiplier, float64(attempt-1))
+	if limit := float64(policy.GetMaxDelaySeconds()); limit > 0 && delay > limit {
+		delay = limit
+	}
+	return time.Duration(delay * float64(time.Second))
+}
+
+// definitionID is the ID a definition is stored under.
+func definitionID(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// validateDefinition checks that def can run.
+func validateDefinition(def *pb.WorkflowDefinition) error {
+	if def.Namespace == "" || def.Name == "" {
+		return fmt.Errorf("namespace and name are required")
+	}
+	if len(def.Tasks) == 0 {
+		return fmt.Errorf("at least one task is required")
+	}
+	seen := make(map[string]bool, len(def.Tasks))
+	for i, task := range def.Tasks {
+		if task.Id == "" {
+			return fmt.Errorf("task %d: id is required", i)
+		}
+		if seen[task.Id] {
+			return fmt.Errorf("task %s: duplicate id", task.Id)
+		}
+		if task.Service.GetServiceName() == "" || task.MethodName == "" {
+			return fmt.Errorf("task %s: service and method_name are required", task.Id)
+		}
+		if c := task.Compensation; c != nil && (c.Service.GetServiceName() == "" || c.MethodName == "") {
+			return fmt.Errorf("task %s: compensation needs service and method_name", task.Id)
+		}
+		// Tasks run in order, so a task can only depend on earlier ones
+		for _, dep := range task.Dependencies {
+			if !seen[dep] {
+				return fmt.Errorf("task %s: dependency %s is not an earlier task", task.Id, dep)
+			}
+		}
+		seen[task.Id] = true
+	}
+	return nil
+}
+
+// RegisterWorkflow creates or replaces a workflow definition. Workflows
+// already started keep the definition they started with.
+func (e *Engine) RegisterWorkflow(ctx context.Context, req *pb.RegisterWorkflowRequest) (*pb.RegisterWorkflowResponse, error) {
+	if req.Definition == nil {
+		return &pb.RegisterWorkflowResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "definition is required"},
+		}, nil
+	}
+	def := proto.Clone(req.Definition).(*pb.WorkflowDefinition)
+	if err := validateDefinition(def); err != nil {
+		return &pb.RegisterWorkflowResponse{
+			Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: err.Error()},
+		}, nil
+	}
+
+	def.Id = definitionID(def.Namespace, def.Name)
+	now := timestamppb.Now()
+	if def.Metadata == nil {
+		def.Metadata = &pb.Metadata{}
+	}
+	if existing, err := e.store.LoadDefinition(ctx, def.Id); err == nil && existing.Metadata != nil {
+		def.Metadata.CreatedAt = existing.Metadata.CreatedAt
+	} else {
+		def.Metadata.CreatedAt = now
+	}
+	def.Metadata.UpdatedAt = now
+
+	if err := e.store.SaveDefinition(ctx, def); err != nil {
+		return &pb.RegisterWorkflowResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: fmt.Sprintf("failed to save definition: %v", err)},
+		}, nil
+	}
+	return &pb.RegisterWorkflowResponse{
+		Status:     &pb.Status{Code: pb.Status_OK, Message: "Workflow registered"},
+		Definition: def,
+	}, nil
+}
+
+// StartWorkflow starts a registered workflow with the given input, which
+// becomes the input of its first task.
+func (e *Engine) StartWorkflow(ctx context.Context, req *pb.StartWorkflowRequest) (*pb.StartWorkflowResponse, error) {
+	def, err := e.store.LoadDefinition(ctx, definitionID(req.Namespace, req.WorkflowName))
+	if errors.Is(err, ErrNotFound) {
+		return &pb.StartWorkflowResponse{
+			Status: &pb.Status{Code: pb.Status_NOT_FOUND, Message: fmt.Sprintf("workflow %s/%s not registered", req.Namespace, req.WorkflowName)},
+		}, nil
+	}
+	if err != nil {
+		return &pb.StartWorkflowResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()},
+		}, nil
+	}
+	if e.base.Err() != nil {
+		return &pb.StartWorkflowResponse{
+			Status: &pb.Status{Code: pb.Status_UNAVAILABLE, Message: "worker is stopped"},
+		}, nil
+	}
+
+	now := timestamppb.Now()
+	wf := &pb.ActiveWorkflow{
+		Id:                   uuid.New().String(),
+		WorkflowDefinitionId: def.Id,
+		Namespace:            def.Namespace,
+		State:                pb.WorkflowState_WORKFLOW_PENDING,
+		Input:                req.Input,
+		TaskExecutions:       make(map[string]*pb.TaskExecution, len(def.Tasks)),
+		Metadata:             &pb.Metadata{CreatedAt: now, UpdatedAt: now, Labels: req.Metadata},
+		Definition:           def,
+	}
+	for _, task := range def.Tasks {
+		wf.TaskExecutions[task.Id] = &pb.TaskExecution{TaskId: task.Id, ExecutionId: wf.Id + "/" + task.Id}
+	}
+	if err := e.store.SaveWorkflow(ctx, wf); err != nil {
+		return &pb.StartWorkflowResponse{
+			Status: &pb.Status{Code: pb.Status_INTERNAL, Message: fmt.Sprintf("failed to save workflow: %v", err)},
+		}, nil
+	}
+
+	e.launch(proto.Clone(wf).(*pb.ActiveWorkflow))
+	return &pb.StartWorkflowResponse{
+		Status:     &pb.Status{Code: pb.Status_OK, Message: "Workflow started"},
+		WorkflowId: wf.Id,
+	}, nil
+}
+
+// loadWorkflow returns a workflow in namespace, or ErrNotFound. An empty
+// namespace matches any.
+func (e *Engine) loadWorkflow(ctx context.Context, namespace, id string) (*pb.ActiveWorkflow, error) {
+	wf, err := e.store.LoadWorkflow(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if namespace != "" && wf.Namespace != namespace {
+		return nil, ErrNotFound
+	}
+	return wf, nil
+}
+
+func errorStatus(err error) *pb.Status {
+	if errors.Is(err, ErrNotFound) {
+		return &pb.Status{Code: pb.Status_NOT_FOUND, Message: "workflow not found"}
+	}
+	return &pb.Status{Code: pb.Status_INTERNAL, Message: err.Error()}
+}
+
+// GetWorkflowStatus returns a workflow with the state of each task.
+func (e *Engine) GetWorkflowStatus(ctx context.Context, req *pb.GetWorkflowStatusRequest) (*pb.GetWorkflowStatusResponse, error) {
+	wf, err := e.loadWorkflow(ctx, req.Namespace, req.WorkflowId)
+	if err != nil {
+		return &pb.GetWorkflowStatusResponse{Status: errorStatus(err)}, nil
+	}
+	return &pb.GetWorkflowStatusResponse{Status: &pb.Status{Code: pb.Status_OK}, Workflow: wf}, nil
+}
+
+// GetWorkflowHistory pages through a workflow's step executions, oldest
+// first, including retries and compensations.
+func (e *Engine) GetWorkflowHistory(ctx context.Context, req *pb.GetWorkflowHistoryRequest) (*pb.GetWorkflowHistoryResponse, error) {
+	if _, err := e.loadWorkflow(ctx, req.Namespace, req.WorkflowId); err != nil {
+		return &pb.GetWorkflowHistoryResponse{Status: errorStatus(err)}, nil
+	}
+
+	offset := 0
+	if req.PageToken != "" {
+		n, err := strconv.Atoi(req.PageToken)
+		if err != nil || n < 0 {
+			return &pb.GetWorkflowHistoryResponse{
+				Status: &pb.Status{Code: pb.Status_INVALID_ARGUMENT, Message: "invalid page_token"},
+			}, nil
+		}
+		offset = n
+	}
+	size := int(req.PageSize)
+	if size <= 0 {
+		size = DefaultHistoryPageSize
+	}
+
+	execs, err := e.store.ListExecutions(ctx, req.WorkflowId)
+	if err != nil {
+		return &pb.GetWorkflowHistoryResponse{Status: errorStatus(err)}, nil
+	}
+	resp := &pb.GetWorkflowHistoryResponse{Status: &pb.Status{Code: pb.Status_OK}}
+	if offset < len(execs) {
+		end := min(offset+size, len(execs))
+		resp.Executions = execs[offset:end]
+		if end < len(execs) {
+			resp.NextPageToken = strconv.Itoa(end)
+		}
+	}
+	return resp, nil
+}
+
+// CancelWorkflow stops a running workflow. Its succeeded tasks are then
+// compensated in reverse order before it ends WORKFLOW_CANCELLED.
+func (e *Engine) CancelWorkflow(ctx context.Context, req *pb.CancelWorkflowRequest) (*pb.CancelWorkflowResponse, error) {
+	wf, err := e.loadWorkflow(ctx, req.Namespace, req.WorkflowId)
+	if err != nil {
+		return &pb.CancelWorkflowResponse{Status: errorStatus(err)}, nil
+	}
+
+	e.mu.Lock()
+	r, ok := e.running[wf.Id]
+	if ok {
+		r.cancelled = true
+		r.cancel()
+	}
+	e.mu.Unlock()
+
+	if !ok {
+		return &pb.CancelWorkflowResponse{
+			Status: &pb.Status{Code: pb.Status_FAILED_PRECONDITION, Message: fmt.Sprintf("workflow is %s", wf.State)},
+		}, nil
+	}
+	return &pb.CancelWorkflowResponse{Status: &pb.Status{Code: pb.Status_OK, Message: "Workflow cancelled"}}, nil
+}
@@ -0,0 +1,342 @@
+package worker_test
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"github.com/accretional/collector/pkg/db/sqlite"
+	"github.com/accretional/collector/pkg/worker"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// fakeDispatcher serves methods from a map and counts calls per method.
+type fakeDispatcher struct {
+	mu      sync.Mutex
+	methods map[string]func(ctx context.Context, in *pb.Status) (*pb.Status, int32)
+	calls   map[string]int
+	inputs  map[string][]string
+}
+
+func newFakeDispatcher() *fakeDispatcher {
+	return &fakeDispatcher{
+		methods: make(map[string]func(ctx context.Context, in *pb.Status) (*pb.Status, int32)),
+		calls:   make(map[string]int),
+		inputs:  make(map[string][]string),
+	}
+}
+
+// handle registers a method; the returned code is the dispatch status code.
+func (f *fakeDispatcher) handle(method string, fn func(ctx context.Context, in *pb.Status) (*pb.Status, int32)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.methods[method] = fn
+}
+
+func (f *fakeDispatcher) called(method string) (int, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method], append([]string(nil), f.inputs[method]...)
+}
+
+func (f *fakeDispatcher) Dispatch(ctx context.Context, req *pb.DispatchRequest) (*pb.DispatchResponse, error) {
+	in := &pb.Status{}
+	if req.Input != nil {
+		if err := req.Input.UnmarshalTo(in); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	fn := f.methods[req.MethodName]
+	f.calls[req.MethodName]++
+	f.inputs[req.MethodName] = append(f.inputs[req.MethodName], in.Message)
+	f.mu.Unlock()
+
+	if fn == nil {
+		return &pb.DispatchResponse{Status: &pb.Status{Code: 404, Message: "no such method"}}, nil
+	}
+	out, code := fn(ctx, in)
+	if code != 200 {
+		return &pb.DispatchResponse{Status: &pb.Status{Code: pb.Status_Code(code), Message: out.GetMessage()}}, nil
+	}
+	output, _ := anypb.New(out)
+	return &pb.DispatchResponse{Status: &pb.Status{Code: 200}, Output: output, HandledByCollectorId: "collector2"}, nil
+}
+
+// appender returns a step that appends suffix to its input.
+func appender(suffix string) func(ctx context.Context, in *pb.Status) (*pb.Status, int32) {
+	return func(ctx context.Context, in *pb.Status) (*pb.Status, int32) {
+		return &pb.Status{Message: in.Message + suffix}, 200
+	}
+}
+
+func step(id, method string) *pb.Task {
+	return &pb.Task{Id: id, Service: &pb.ServiceTypeRef{ServiceName: "Orders"}, MethodName: method}
+}
+
+func register(t *testing.T, e *worker.Engine, tasks ...*pb.Task) {
+	t.Helper()
+	resp, err := e.RegisterWorkflow(context.Background(), &pb.RegisterWorkflowRequest{
+		Definition: &pb.WorkflowDefinition{Namespace: "shop", Name: "checkout", Tasks: tasks},
+	})
+	if err != nil || resp.Status.Code != pb.Status_OK {
+		t.Fatalf("RegisterWorkflow failed: %v (%v)", resp, err)
+	}
+}
+
+func start(t *testing.T, e *worker.Engine, input string) string {
+	t.Helper()
+	in, _ := anypb.New(&pb.Status{Message: input})
+	resp, err := e.StartWorkflow(context.Background(), &pb.StartWorkflowRequest{Namespace: "shop", WorkflowName: "checkout", Input: in})
+	if err != nil || resp.Status.Code != pb.Status_OK {
+		t.Fatalf("StartWorkflow failed: %v (%v)", resp, err)
+	}
+	return resp.WorkflowId
+}
+
+// waitForState polls GetWorkflowStatus until the workflow reaches state.
+func waitForState(t *testing.T, e *worker.Engine, id string, state pb.WorkflowState) *pb.ActiveWorkflow {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := e.GetWorkflowStatus(context.Background(), &pb.GetWorkflowStatusRequest{Namespace: "shop", WorkflowId: id})
+		if err != nil || resp.Status.Code != pb.Status_OK {
+			t.Fatalf("GetWorkflowStatus failed: %v (%v)", resp, err)
+		}
+		if resp.Workflow.State == state {
+			return resp.Workflow
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("workflow %s did not reach %v", id, state)
+	return nil
+}
+
+func output(t *testing.T, wf *pb.ActiveWorkflow) string {
+	t.Helper()
+	out := &pb.Status{}
+	if err := wf.CurrentOutput.UnmarshalTo(out); err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	return out.Message
+}
+
+func TestEngine_ChainsOutputs(t *testing.T) {
+	d := newFakeDispatcher()
+	d.handle("Reserve", appender("+reserved"))
+	d.handle("Charge", appender("+charged"))
+	e := worker.NewEngine(worker.NewMemoryStore(), d)
+	defer e.Stop()
+
+	register(t, e, step("reserve", "Reserve"), step("charge", "Charge"))
+	id := start(t, e, "order-1")
+
+	wf := waitForState(t, e, id, pb.WorkflowState_WORKFLOW_SUCCEEDED)
+	if got := output(t, wf); got != "order-1+reserved+charged" {
+		t.Errorf("unexpected output %q", got)
+	}
+	if _, inputs := d.called("Charge"); len(inputs) != 1 || inputs[0] != "order-1+reserved" {
+		t.Errorf("expected the second step to get the first step's output, got %v", inputs)
+	}
+
+	history, err := e.GetWorkflowHistory(context.Background(), &pb.GetWorkflowHistoryRequest{WorkflowId: id, PageSize: 1})
+	if err != nil || len(history.Executions) != 1 || history.Executions[0].TaskId != "reserve" || history.NextPageToken == "" {
+		t.Fatalf("unexpected first page: %v (%v)", history, err)
+	}
+	history, _ = e.GetWorkflowHistory(context.Background(), &pb.GetWorkflowHistoryRequest{WorkflowId: id, PageToken: history.NextPageToken})
+	if len(history.Executions) != 1 || history.Executions[0].TaskId != "charge" || history.Executions[0].ExecutorId != "collector2" {
+		t.Errorf("unexpected second page: %v", history)
+	}
+}
+
+func TestEngine_RetriesSteps(t *testing.T) {
+	d := newFakeDispatcher()
+	failures := 2
+	d.handle("Charge", func(ctx context.Context, in *pb.Status) (*pb.Status, int32) {
+		if failures > 0 {
+			failures--
+			return &pb.Status{Message: "card network down"}, 503
+		}
+		return in, 200
+	})
+	e := worker.NewEngine(worker.NewMemoryStore(), d)
+	defer e.Stop()
+
+	charge := step("charge", "Charge")
+	charge.RetryPolicy = &pb.RetryPolicy{MaxAttempts: 3}
+	register(t, e, charge)
+	wf := waitForState(t, e, start(t, e, "order-1"), pb.WorkflowState_WORKFLOW_SUCCEEDED)
+	if te := wf.TaskExecutions["charge"]; te.AttemptNumber != 3 || te.State != pb.ExecutionState_EXECUTION_SUCCEEDED {
+		t.Errorf("expected success on the third attempt, got %v", te)
+	}
+
+	// Invalid requests are not retried
+	d.handle("Charge", func(ctx context.Context, in *pb.Status) (*pb.Status, int32) {
+		return &pb.Status{Message: "bad card"}, 400
+	})
+	wf = waitForState(t, e, start(t, e, "order-2"), pb.WorkflowState_WORKFLOW_FAILED)
+	if te := wf.TaskExecutions["charge"]; te.AttemptNumber != 1 || te.State != pb.ExecutionState_EXECUTION_FAILED || wf.Error == "" {
+		t.Errorf("expected a single failed attempt, got %v", wf)
+	}
+}
+
+func TestEngine_CompensatesOnFailure(t *testing.T) {
+	d := newFakeDispatcher()
+	d.handle("Reserve", appender("+reserved"))
+	d.handle("Release", appender("+released"))
+	d.handle("Charge", func(ctx context.Context, in *pb.Status) (*pb.Status, int32) {
+		return &pb.Status{Message: "declined"}, 402
+	})
+	e := worker.NewEngine(worker.NewMemoryStore(), d)
+	defer e.Stop()
+
+	reserve := step("reserve", "Reserve")
+	reserve.Compensation = &pb.Compensation{Service: reserve.Service, MethodName: "Release"}
+	register(t, e, reserve, step("charge", "Charge"))
+
+	wf := waitForState(t, e, start(t, e, "order-1"), pb.WorkflowState_WORKFLOW_FAILED)
+	if !wf.TaskExecutions["reserve"].Compensated || wf.Compensating {
+		t.Errorf("expected the reservation to be compensated, got %v", wf)
+	}
+	if _, inputs := d.called("Release"); len(inputs) != 1 || inputs[0] != "order-1+reserved" {
+		t.Errorf("expected the compensation to get the step's output, got %v", inputs)
+	}
+
+	history, _ := e.GetWorkflowHistory(context.Background(), &pb.GetWorkflowHistoryRequest{WorkflowId: wf.Id})
+	if n := len(history.Executions); n != 3 || !history.Executions[2].Compensation {
+		t.Errorf("expected reserve, charge and the compensation in history, got %v", history.Executions)
+	}
+}
+
+func TestEngine_Cancel(t *testing.T) {
+	d := newFakeDispatcher()
+	d.handle("Reserve", appender("+reserved"))
+	d.handle("Release", appender("+released"))
+	started := make(chan struct{})
+	d.handle("Ship", func(ctx context.Context, in *pb.Status) (*pb.Status, int32) {
+		close(started)
+		<-ctx.Done()
+		return &pb.Status{Message: ctx.Err().Error()}, 500
+	})
+	e := worker.NewEngine(worker.NewMemoryStore(), d)
+	defer e.Stop()
+
+	reserve := step("reserve", "Reserve")
+	reserve.Compensation = &pb.Compensation{Service: reserve.Service, MethodName: "Release"}
+	register(t, e, reserve, step("ship", "Ship"))
+	id := start(t, e, "order-1")
+	<-started
+
+	resp, err := e.CancelWorkflow(context.Background(), &pb.CancelWorkflowRequest{Namespace: "shop", WorkflowId: id})
+	if err != nil || resp.Status.Code != pb.Status_OK {
+		t.Fatalf("CancelWorkflow failed: %v (%v)", resp, err)
+	}
+	wf := waitForState(t, e, id, pb.WorkflowState_WORKFLOW_CANCELLED)
+	if wf.TaskExecutions["ship"].State != pb.ExecutionState_EXECUTION_CANCELLED || !wf.TaskExecutions["reserve"].Compensated {
+		t.Errorf("unexpected cancelled workflow: %v", wf)
+	}
+
+	resp, _ = e.CancelWorkflow(context.Background(), &pb.CancelWorkflowRequest{WorkflowId: id})
+	if resp.Status.Code != pb.Status_FAILED_PRECONDITION {
+		t.Errorf("expected FAILED_PRECONDITION for a finished workflow, got %v", resp)
+	}
+}
+
+func TestEngine_ResumesAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	var colls []*collection.Collection
+	for _, name := range []string{worker.DefinitionsCollection, worker.WorkflowsCollection, worker.ExecutionsCollection} {
+		store, err := sqlite.NewSqliteStore(filepath.Join(t.TempDir(), name+".db"), collection.Options{EnableJSON: true})
+		if err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		defer store.Close()
+		coll, err := collection.NewCollection(&pb.Collection{Namespace: worker.Namespace, Name: name}, store, &collection.LocalFileSystem{})
+		if err != nil {
+			t.Fatalf("failed to create collection: %v", err)
+		}
+		colls = append(colls, coll)
+	}
+	store := worker.NewCollectionStore(colls[0], colls[1], colls[2])
+
+	// The first collector stops while the second step runs
+	d := newFakeDispatcher()
+	d.handle("Reserve", appender("+reserved"))
+	started := make(chan struct{})
+	d.handle("Charge", func(ctx context.Context, in *pb.Status) (*pb.Status, int32) {
+		close(started)
+		<-ctx.Done()
+		return &pb.Status{Message: ctx.Err().Error()}, 500
+	})
+	first := worker.NewEngine(store, d)
+	register(t, first, step("reserve", "Reserve"), step("charge", "Charge"))
+	id := start(t, first, "order-1")
+	<-started
+	first.Stop()
+
+	if resp, _ := first.StartWorkflow(ctx, &pb.StartWorkflowRequest{Namespace: "shop", WorkflowName: "checkout"}); resp.Status.Code != pb.Status_UNAVAILABLE {
+		t.Errorf("expected a stopped engine to refuse workflows, got %v", resp)
+	}
+
+	// The second picks up at the interrupted step with the first step's output
+	d2 := newFakeDispatcher()
+	d2.handle("Reserve", appender("+reserved"))
+	d2.handle("Charge", appender("+charged"))
+	second := worker.NewEngine(store, d2)
+	defer second.Stop()
+	if err := second.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	wf := waitForState(t, second, id, pb.WorkflowState_WORKFLOW_SUCCEEDED)
+	if got := output(t, wf); got != "order-1+reserved+charged" {
+		t.Errorf("unexpected output %q", got)
+	}
+	if n, _ := d2.called("Reserve"); n != 0 {
+		t.Errorf("expected the finished step not to run again, ran %d times", n)
+	}
+	if te := wf.TaskExecutions["charge"]; te.AttemptNumber != 1 {
+		t.Errorf("expected the interrupted attempt not to count, got %v", te)
+	}
+}
+
+func TestEngine_InvalidRequests(t *testing.T) {
+	ctx := context.Background()
+	e := worker.NewEngine(worker.NewMemoryStore(), newFakeDispatcher())
+	defer e.Stop()
+
+	charge := step("charge", "Charge")
+	for name, def := range map[string]*pb.WorkflowDefinition{
+		"missing name":       {Namespace: "shop", Tasks: []*pb.Task{charge}},
+		"no tasks":           {Namespace: "shop", Name: "checkout"},
+		"duplicate task":     {Namespace: "shop", Name: "checkout", Tasks: []*pb.Task{charge, charge}},
+		"missing method":     {Namespace: "shop", Name: "checkout", Tasks: []*pb.Task{{Id: "charge", Service: charge.Service}}},
+		"later dependency":   {Namespace: "shop", Name: "checkout", Tasks: []*pb.Task{{Id: "a", Service: charge.Service, MethodName: "A", Dependencies: []string{"charge"}}, charge}},
+		"empty compensation": {Namespace: "shop", Name: "checkout", Tasks: []*pb.Task{{Id: "a", Service: charge.Service, MethodName: "A", Compensation: &pb.Compensation{}}}},
+	} {
+		resp, err := e.RegisterWorkflow(ctx, &pb.RegisterWorkflowRequest{Definition: def})
+		if err != nil || resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+			t.Errorf("%s: expected INVALID_ARGUMENT, got %v (%v)", name, resp, err)
+		}
+	}
+
+	if resp, _ := e.StartWorkflow(ctx, &pb.StartWorkflowRequest{Namespace: "shop", WorkflowName: "missing"}); resp.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND, got %v", resp)
+	}
+	if resp, _ := e.GetWorkflowStatus(ctx, &pb.GetWorkflowStatusRequest{WorkflowId: "missing"}); resp.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND, got %v", resp)
+	}
+
+	register(t, e, charge)
+	id := start(t, e, "order-1")
+	if resp, _ := e.GetWorkflowStatus(ctx, &pb.GetWorkflowStatusRequest{Namespace: "other", WorkflowId: id}); resp.Status.Code != pb.Status_NOT_FOUND {
+		t.Errorf("expected NOT_FOUND in another namespace, got %v", resp)
+	}
+	if resp, _ := e.GetWorkflowHistory(ctx, &pb.GetWorkflowHistoryRequest{WorkflowId: id, PageToken: "x"}); resp.Status.Code != pb.Status_INVALID_ARGUMENT {
+		t.Errorf("expected INVALID_ARGUMENT for a bad page token, got %v", resp)
+	}
+}
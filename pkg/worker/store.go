@@ -0,0 +1,265 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	pb "github.com/accretional/collector/gen/collector"
+	"github.com/accretional/collector/pkg/collection"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Namespace, DefinitionsCollection, WorkflowsCollection and
+	// ExecutionsCollection name the collections that conventionally hold
+	// workflow definitions, workflow runs and step executions.
+	Namespace             = "system"
+	DefinitionsCollection = "workflow_definitions"
+	WorkflowsCollection   = "workflows"
+	ExecutionsCollection  = "workflow_executions"
+)
+
+// ErrNotFound is returned for unknown definitions and workflows.
+var ErrNotFound = errors.New("not found")
+
+// Store persists workflow definitions, workflows and the history of their
+// step executions. Implementations must be safe for concurrent use.
+type Store interface {
+	// SaveDefinition creates or replaces the definition with def.Id.
+	SaveDefinition(ctx context.Context, def *pb.WorkflowDefinition) error
+	// LoadDefinition returns a definition, or ErrNotFound.
+	LoadDefinition(ctx context.Context, id string) (*pb.WorkflowDefinition, error)
+	// SaveWorkflow creates or replaces a workflow.
+	SaveWorkflow(ctx context.Context, wf *pb.ActiveWorkflow) error
+	// LoadWorkflow returns a workflow, or ErrNotFound.
+	LoadWorkflow(ctx context.Context, id string) (*pb.ActiveWorkflow, error)
+	// ListWorkflows returns every stored workflow, in any order.
+	ListWorkflows(ctx context.Context) ([]*pb.ActiveWorkflow, error)
+	// RecordExecution adds an execution to the history.
+	RecordExecution(ctx context.Context, exec *pb.Execution) error
+	// ListExecutions returns a workflow's executions, oldest first.
+	ListExecutions(ctx context.Context, workflowID string) ([]*pb.Execution, error)
+}
+
+// sortExecutions orders executions oldest first.
+func sortExecutions(execs []*pb.Execution) {
+	sort.SliceStable(execs, func(i, j int) bool {
+		return execs[i].GetMetadata().GetCreatedAt().AsTime().Before(execs[j].GetMetadata().GetCreatedAt().AsTime())
+	})
+}
+
+// MemoryStore is a Store that keeps everything in memory, for tests and for
+// processes that need no recovery across restarts.
+type MemoryStore struct {
+	definitions map[string]*pb.WorkflowDefinition
+	workflows   map[string]*pb.ActiveWorkflow
+	executions  map[string][]*pb.Execution
+	mu          sync.Mutex
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		definitions: make(map[string]*pb.WorkflowDefinition),
+		workflows:   make(map[string]*pb.ActiveWorkflow),
+		executions:  make(map[string][]*pb.Execution),
+	}
+}
+
+func (s *MemoryStore) SaveDefinition(ctx context.Context, def *pb.WorkflowDefinition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.definitions[def.Id] = proto.Clone(def).(*pb.WorkflowDefinition)
+	return nil
+}
+
+func (s *MemoryStore) LoadDefinition(ctx context.Context, id string) (*pb.WorkflowDefinition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	def, ok := s.definitions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(def).(*pb.WorkflowDefinition), nil
+}
+
+func (s *MemoryStore) SaveWorkflow(ctx context.Context, wf *pb.ActiveWorkflow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workflows[wf.Id] = proto.Clone(wf).(*pb.ActiveWorkflow)
+	return nil
+}
+
+func (s *MemoryStore) LoadWorkflow(ctx context.Context, id string) (*pb.ActiveWorkflow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wf, ok := s.workflows[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(wf).(*pb.ActiveWorkflow), nil
+}
+
+func (s *MemoryStore) ListWorkflows(ctx context.Context) ([]*pb.ActiveWorkflow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*pb.ActiveWorkflow, 0, len(s.workflows))
+	for _, wf := range s.workflows {
+		list = append(list, proto.Clone(wf).(*pb.ActiveWorkflow))
+	}
+	return list, nil
+}
+
+func (s *MemoryStore) RecordExecution(ctx context.Context, exec *pb.Execution) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.executions[exec.WorkflowId] = append(s.executions[exec.WorkflowId], proto.Clone(exec).(*pb.Execution))
+	return nil
+}
+
+func (s *MemoryStore) ListExecutions(ctx context.Context, workflowID string) ([]*pb.Execution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var execs []*pb.Execution
+	for _, exec := range s.executions[workflowID] {
+		execs = append(execs, proto.Clone(exec).(*pb.Execution))
+	}
+	sortExecutions(execs)
+	return execs, nil
+}
+
+// CollectionStore is a Store kept in three collections, conventionally
+// system/workflow_definitions, system/workflows and
+// system/workflow_executions, each on a store of its own. Records are the
+// stored messages encoded as JSON with proto field names, so they can also
+// be searched with the regular Search API (e.g. a filter on "state").
+type CollectionStore struct {
+	definitions *collection.Collection
+	workflows   *collection.Collection
+	executions  *collection.Collection
+	mu          sync.Mutex // serializes access so updates never contend for the sqlite lock
+}
+
+// NewCollectionStore creates a CollectionStore backed by the given collections.
+func NewCollectionStore(definitions, workflows, executions *collection.Collection) *CollectionStore {
+	return &CollectionStore{definitions: definitions, workflows: workflows, executions: executions}
+}
+
+var storeJSON = protojson.MarshalOptions{UseProtoNames: true}
+
+// put creates or replaces the record with id in coll.
+func (s *CollectionStore) put(ctx context.Context, coll *collection.Collection, id string, m proto.Message) error {
+	data, err := storeJSON.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", id, err)
+	}
+	record := &pb.CollectionRecord{Id: id, ProtoData: data}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := coll.GetRecord(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return coll.CreateRecord(ctx, record)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", id, err)
+	}
+	record.Metadata = existing.Metadata
+	return coll.UpdateRecord(ctx, record)
+}
+
+// get decodes the record with id in coll into m.
+func (s *CollectionStore) get(ctx context.Context, coll *collection.Collection, id string, m proto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := coll.GetRecord(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", id, err)
+	}
+	if err := protojson.Unmarshal(record.ProtoData, m); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", id, err)
+	}
+	return nil
+}
+
+// search returns the records of coll matching query.
+func (s *CollectionStore) search(ctx context.Context, coll *collection.Collection, query *collection.SearchQuery) ([]*collection.SearchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return coll.Search(ctx, query)
+}
+
+func (s *CollectionStore) SaveDefinition(ctx context.Context, def *pb.WorkflowDefinition) error {
+	return s.put(ctx, s.definitions, def.Id, def)
+}
+
+func (s *CollectionStore) LoadDefinition(ctx context.Context, id string) (*pb.WorkflowDefinition, error) {
+	def := &pb.WorkflowDefinition{}
+	if err := s.get(ctx, s.definitions, id, def); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+func (s *CollectionStore) SaveWorkflow(ctx context.Context, wf *pb.ActiveWorkflow) error {
+	return s.put(ctx, s.workflows, wf.Id, wf)
+}
+
+func (s *CollectionStore) LoadWorkflow(ctx context.Context, id string) (*pb.ActiveWorkflow, error) {
+	wf := &pb.ActiveWorkflow{}
+	if err := s.get(ctx, s.workflows, id, wf); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+func (s *CollectionStore) ListWorkflows(ctx context.Context) ([]*pb.ActiveWorkflow, error) {
+	results, err := s.search(ctx, s.workflows, &collection.SearchQuery{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list workflows: %w", err)
+	}
+	var list []*pb.ActiveWorkflow
+	for _, r := range results {
+		wf := &pb.ActiveWorkflow{}
+		if err := protojson.Unmarshal(r.Record.ProtoData, wf); err != nil {
+			continue
+		}
+		list = append(list, wf)
+	}
+	return list, nil
+}
+
+func (s *CollectionStore) RecordExecution(ctx context.Context, exec *pb.Execution) error {
+	return s.put(ctx, s.executions, exec.Id, exec)
+}
+
+func (s *CollectionStore) ListExecutions(ctx context.Context, workflowID string) ([]*pb.Execution, error) {
+	results, err := s.search(ctx, s.executions, &collection.SearchQuery{
+		Filters: map[string]collection.Filter{
+			"workflow_id": {Operator: collection.OpEquals, Value: workflowID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list executions: %w", err)
+	}
+	var execs []*pb.Execution
+	for _, r := range results {
+		exec := &pb.Execution{}
+		if err := protojson.Unmarshal(r.Record.ProtoData, exec); err != nil {
+			continue
+		}
+		execs = append(execs, exec)
+	}
+	sortExecutions(execs)
+	return execs, nil
+}